@@ -0,0 +1,35 @@
+/* eslint-disable no-restricted-globals */
+// The service worker of the dashboard, which shows the Web Push notifications
+// sent by AdGuard Home even when the dashboard isn't open.
+
+self.addEventListener('push', (event) => {
+    let data = {};
+    try {
+        data = event.data ? event.data.json() : {};
+    } catch (error) {
+        data = { body: event.data.text() };
+    }
+
+    event.waitUntil(self.registration.showNotification(data.title || 'AdGuard Home', {
+        body: data.body,
+        tag: data.tag,
+        icon: 'favicon.png',
+    }));
+});
+
+self.addEventListener('notificationclick', (event) => {
+    event.notification.close();
+
+    // The worker is served from the assets directory, so the dashboard is one
+    // level up.
+    const url = new URL('..', self.registration.scope).href;
+
+    event.waitUntil(self.clients.matchAll({ type: 'window' }).then((windows) => {
+        const client = windows.find((w) => w.url.startsWith(url));
+        if (client) {
+            return client.focus();
+        }
+
+        return self.clients.openWindow(url);
+    }));
+});
@@ -60,3 +60,21 @@ export const updateClient = (config, name) => async (dispatch) => {
         dispatch(updateClientFailure());
     }
 };
+
+export const quarantineClientRequest = createAction('QUARANTINE_CLIENT_REQUEST');
+export const quarantineClientFailure = createAction('QUARANTINE_CLIENT_FAILURE');
+export const quarantineClientSuccess = createAction('QUARANTINE_CLIENT_SUCCESS');
+
+export const quarantineClient = (name, enabled) => async (dispatch) => {
+    dispatch(quarantineClientRequest());
+    try {
+        await apiClient.quarantineClient({ name, enabled });
+        dispatch(quarantineClientSuccess());
+        const message = enabled ? 'client_quarantined' : 'client_released';
+        dispatch(addSuccessToast(i18next.t(message, { key: name })));
+        dispatch(getClients());
+    } catch (error) {
+        dispatch(addErrorToast({ error }));
+        dispatch(quarantineClientFailure());
+    }
+};
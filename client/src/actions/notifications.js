@@ -0,0 +1,123 @@
+import { createAction } from 'redux-actions';
+import i18next from 'i18next';
+
+import apiClient from '../api/Api';
+import { addErrorToast, addSuccessToast } from './toasts';
+
+const SERVICE_WORKER_PATH = 'assets/sw.js';
+
+/**
+ * @returns {boolean} true if the browser supports the Web Push notifications.
+ */
+export const isWebPushSupported = () => 'serviceWorker' in navigator
+    && 'PushManager' in window
+    && 'Notification' in window;
+
+/**
+ * Converts the base64url-encoded VAPID public key into the form accepted by
+ * PushManager.subscribe.
+ *
+ * @param {string} key
+ * @returns {Uint8Array}
+ */
+const decodeApplicationServerKey = (key) => {
+    const base64 = key.replace(/-/g, '+').replace(/_/g, '/');
+    const raw = window.atob(base64.padEnd(Math.ceil(base64.length / 4) * 4, '='));
+
+    return Uint8Array.from(raw, (c) => c.charCodeAt(0));
+};
+
+/**
+ * @returns {Promise<PushSubscription|null>} the push subscription of this
+ * browser, if any.
+ */
+const getPushSubscription = async () => {
+    const registration = await navigator.serviceWorker.getRegistration(SERVICE_WORKER_PATH);
+    if (!registration) {
+        return null;
+    }
+
+    return registration.pushManager.getSubscription();
+};
+
+export const getWebPushStatusRequest = createAction('GET_WEB_PUSH_STATUS_REQUEST');
+export const getWebPushStatusFailure = createAction('GET_WEB_PUSH_STATUS_FAILURE');
+export const getWebPushStatusSuccess = createAction('GET_WEB_PUSH_STATUS_SUCCESS');
+
+export const getWebPushStatus = () => async (dispatch) => {
+    dispatch(getWebPushStatusRequest());
+    try {
+        const data = await apiClient.getWebPushStatus();
+        const subscription = isWebPushSupported() ? await getPushSubscription() : null;
+        dispatch(getWebPushStatusSuccess({ ...data, subscribed: !!subscription }));
+    } catch (error) {
+        dispatch(addErrorToast({ error }));
+        dispatch(getWebPushStatusFailure());
+    }
+};
+
+export const subscribeWebPushRequest = createAction('SUBSCRIBE_WEB_PUSH_REQUEST');
+export const subscribeWebPushFailure = createAction('SUBSCRIBE_WEB_PUSH_FAILURE');
+export const subscribeWebPushSuccess = createAction('SUBSCRIBE_WEB_PUSH_SUCCESS');
+
+export const subscribeWebPush = (publicKey) => async (dispatch) => {
+    dispatch(subscribeWebPushRequest());
+    try {
+        const permission = await Notification.requestPermission();
+        if (permission !== 'granted') {
+            throw new Error(i18next.t('web_push_permission_denied'));
+        }
+
+        const registration = await navigator.serviceWorker.register(SERVICE_WORKER_PATH);
+        const subscription = await registration.pushManager.subscribe({
+            userVisibleOnly: true,
+            applicationServerKey: decodeApplicationServerKey(publicKey),
+        });
+
+        await apiClient.subscribeWebPush(subscription.toJSON());
+        dispatch(subscribeWebPushSuccess());
+        dispatch(addSuccessToast('web_push_subscribed'));
+        dispatch(getWebPushStatus());
+    } catch (error) {
+        dispatch(addErrorToast({ error }));
+        dispatch(subscribeWebPushFailure());
+    }
+};
+
+export const unsubscribeWebPushRequest = createAction('UNSUBSCRIBE_WEB_PUSH_REQUEST');
+export const unsubscribeWebPushFailure = createAction('UNSUBSCRIBE_WEB_PUSH_FAILURE');
+export const unsubscribeWebPushSuccess = createAction('UNSUBSCRIBE_WEB_PUSH_SUCCESS');
+
+export const unsubscribeWebPush = () => async (dispatch) => {
+    dispatch(unsubscribeWebPushRequest());
+    try {
+        const subscription = await getPushSubscription();
+        if (subscription) {
+            await apiClient.unsubscribeWebPush({ endpoint: subscription.endpoint });
+            await subscription.unsubscribe();
+        }
+
+        dispatch(unsubscribeWebPushSuccess());
+        dispatch(addSuccessToast('web_push_unsubscribed'));
+        dispatch(getWebPushStatus());
+    } catch (error) {
+        dispatch(addErrorToast({ error }));
+        dispatch(unsubscribeWebPushFailure());
+    }
+};
+
+export const testWebPushRequest = createAction('TEST_WEB_PUSH_REQUEST');
+export const testWebPushFailure = createAction('TEST_WEB_PUSH_FAILURE');
+export const testWebPushSuccess = createAction('TEST_WEB_PUSH_SUCCESS');
+
+export const testWebPush = () => async (dispatch) => {
+    dispatch(testWebPushRequest());
+    try {
+        await apiClient.testWebPush();
+        dispatch(testWebPushSuccess());
+        dispatch(addSuccessToast('web_push_test_sent'));
+    } catch (error) {
+        dispatch(addErrorToast({ error }));
+        dispatch(testWebPushFailure());
+    }
+};
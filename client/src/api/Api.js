@@ -21,8 +21,10 @@ class Api {
             const errorPath = url;
             if (error.response) {
                 const { pathname } = document.location;
-                const shouldRedirect = pathname !== HTML_PAGES.LOGIN
-                        && pathname !== HTML_PAGES.INSTALL;
+                // The web UI may be served under a base path, so only check
+                // the last part of the path.
+                const shouldRedirect = !pathname.endsWith(HTML_PAGES.LOGIN)
+                        && !pathname.endsWith(HTML_PAGES.INSTALL);
 
                 if (error.response.status === 403 && shouldRedirect) {
                     const loginPageUrl = window.location.href
@@ -393,6 +395,8 @@ class Api {
 
     UPDATE_CLIENT = { path: 'clients/update', method: 'POST' };
 
+    QUARANTINE_CLIENT = { path: 'clients/quarantine', method: 'POST' };
+
     getClients() {
         const { path, method } = this.GET_CLIENTS;
         return this.makeRequest(path, method);
@@ -425,6 +429,15 @@ class Api {
         return this.makeRequest(path, method, parameters);
     }
 
+    quarantineClient(config) {
+        const { path, method } = this.QUARANTINE_CLIENT;
+        const parameters = {
+            data: config,
+            headers: { 'Content-Type': 'application/json' },
+        };
+        return this.makeRequest(path, method, parameters);
+    }
+
     findClients(params) {
         const { path, method } = this.FIND_CLIENTS;
         const url = getPathWithQueryString(path, params);
@@ -606,6 +619,43 @@ class Api {
         };
         return this.makeRequest(path, method, config);
     }
+
+    // Notifications
+    GET_WEB_PUSH_STATUS = { path: 'notifications/web_push/status', method: 'GET' };
+
+    SUBSCRIBE_WEB_PUSH = { path: 'notifications/web_push/subscribe', method: 'POST' };
+
+    UNSUBSCRIBE_WEB_PUSH = { path: 'notifications/web_push/unsubscribe', method: 'POST' };
+
+    TEST_WEB_PUSH = { path: 'notifications/web_push/test', method: 'POST' };
+
+    getWebPushStatus() {
+        const { path, method } = this.GET_WEB_PUSH_STATUS;
+        return this.makeRequest(path, method);
+    }
+
+    subscribeWebPush(data) {
+        const { path, method } = this.SUBSCRIBE_WEB_PUSH;
+        const config = {
+            data,
+            headers: { 'Content-Type': 'application/json' },
+        };
+        return this.makeRequest(path, method, config);
+    }
+
+    unsubscribeWebPush(data) {
+        const { path, method } = this.UNSUBSCRIBE_WEB_PUSH;
+        const config = {
+            data,
+            headers: { 'Content-Type': 'application/json' },
+        };
+        return this.makeRequest(path, method, config);
+    }
+
+    testWebPush() {
+        const { path, method } = this.TEST_WEB_PUSH;
+        return this.makeRequest(path, method);
+    }
 }
 
 const apiClient = new Api();
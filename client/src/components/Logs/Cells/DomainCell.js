@@ -17,6 +17,7 @@ const DomainCell = ({
     client_proto,
     domain,
     unicodeName,
+    homograph,
     time,
     tracker,
     type,
@@ -56,6 +57,13 @@ const DomainCell = ({
         };
     }
 
+    if (homograph) {
+        requestDetailsObj = {
+            ...requestDetailsObj,
+            homograph_label: 'homograph_warning',
+        };
+    }
+
     requestDetailsObj = {
         ...requestDetailsObj,
         type_table_header: type,
@@ -139,7 +147,10 @@ const DomainCell = ({
             />
             <div className={valueClass}>
                 {unicodeName ? (
-                    <div className="text-truncate" title={unicodeName}>
+                    <div
+                        className={classNames('text-truncate', { 'text-danger': homograph })}
+                        title={homograph ? `${unicodeName}: ${t('homograph_warning')}` : unicodeName}
+                    >
                         {unicodeName}
                     </div>
                 ) : (
@@ -165,6 +176,7 @@ DomainCell.propTypes = {
     client_proto: propTypes.string.isRequired,
     domain: propTypes.string.isRequired,
     unicodeName: propTypes.string,
+    homograph: propTypes.bool,
     time: propTypes.string.isRequired,
     type: propTypes.string.isRequired,
     tracker: propTypes.object,
@@ -86,6 +86,15 @@ class ClientsTable extends Component {
         }
     };
 
+    handleQuarantine = (name, quarantined) => {
+        const { t, quarantineClient } = this.props;
+
+        // eslint-disable-next-line no-alert
+        if (quarantined || window.confirm(t('client_confirm_quarantine', { key: name }))) {
+            quarantineClient(name, !quarantined);
+        }
+    };
+
     columns = [
         {
             Header: this.props.t('table_client'),
@@ -223,9 +232,13 @@ class ClientsTable extends Component {
         {
             Header: this.props.t('actions_table_header'),
             accessor: 'actions',
-            maxWidth: 100,
+            maxWidth: 150,
             Cell: (row) => {
-                const clientName = row.original.name;
+                const { name: clientName, quarantined } = row.original;
+                const quarantineClass = quarantined ? 'btn-danger' : 'btn-outline-danger';
+                const quarantineTitle = quarantined
+                    ? 'client_release_action'
+                    : 'client_quarantine_action';
                 const {
                     toggleClientModal, processingDeleting, processingUpdating, t,
                 } = this.props;
@@ -247,6 +260,17 @@ class ClientsTable extends Component {
                                 <use xlinkHref="#edit" />
                             </svg>
                         </button>
+                        <button
+                            type="button"
+                            className={`btn btn-icon btn-sm mr-2 ${quarantineClass}`}
+                            onClick={() => this.handleQuarantine(clientName, quarantined)}
+                            disabled={processingUpdating}
+                            title={t(quarantineTitle)}
+                        >
+                            <svg className="icons">
+                                <use xlinkHref="#lock" />
+                            </svg>
+                        </button>
                         <button
                             type="button"
                             className="btn btn-icon btn-outline-secondary btn-sm"
@@ -338,6 +362,7 @@ ClientsTable.propTypes = {
     normalizedTopClients: PropTypes.object.isRequired,
     toggleClientModal: PropTypes.func.isRequired,
     deleteClient: PropTypes.func.isRequired,
+    quarantineClient: PropTypes.func.isRequired,
     addClient: PropTypes.func.isRequired,
     updateClient: PropTypes.func.isRequired,
     isModalOpen: PropTypes.bool.isRequired,
@@ -22,6 +22,7 @@ class Clients extends Component {
             addClient,
             updateClient,
             deleteClient,
+            quarantineClient,
             toggleClientModal,
             getStats,
         } = this.props;
@@ -41,6 +42,7 @@ class Clients extends Component {
                             addClient={addClient}
                             updateClient={updateClient}
                             deleteClient={deleteClient}
+                            quarantineClient={quarantineClient}
                             toggleClientModal={toggleClientModal}
                             processingAdding={clients.processingAdding}
                             processingDeleting={clients.processingDeleting}
@@ -66,6 +68,7 @@ Clients.propTypes = {
     clients: PropTypes.object.isRequired,
     toggleClientModal: PropTypes.func.isRequired,
     deleteClient: PropTypes.func.isRequired,
+    quarantineClient: PropTypes.func.isRequired,
     addClient: PropTypes.func.isRequired,
     updateClient: PropTypes.func.isRequired,
     getClients: PropTypes.func.isRequired,
@@ -26,6 +26,24 @@ const INPUTS_FIELDS = [
         description: 'cache_ttl_max_override_desc',
         placeholder: 'enter_cache_ttl_max_override',
     },
+    {
+        name: CACHE_CONFIG_FIELDS.cache_negative_ttl_min,
+        title: 'cache_negative_ttl_min',
+        description: 'cache_negative_ttl_min_desc',
+        placeholder: 'enter_cache_ttl_min_override',
+    },
+    {
+        name: CACHE_CONFIG_FIELDS.cache_negative_ttl_max,
+        title: 'cache_negative_ttl_max',
+        description: 'cache_negative_ttl_max_desc',
+        placeholder: 'enter_cache_ttl_max_override',
+    },
+    {
+        name: CACHE_CONFIG_FIELDS.cache_max_stale_ttl,
+        title: 'cache_max_stale_ttl',
+        description: 'cache_max_stale_ttl_desc',
+        placeholder: 'enter_cache_max_stale_ttl',
+    },
 ];
 
 const Form = ({
@@ -35,10 +53,12 @@ const Form = ({
 
     const { processingSetConfig } = useSelector((state) => state.dnsConfig, shallowEqual);
     const {
-        cache_ttl_max, cache_ttl_min,
+        cache_ttl_max, cache_ttl_min, cache_negative_ttl_min, cache_negative_ttl_max,
     } = useSelector((state) => state.form[FORM_NAME.CACHE].values, shallowEqual);
 
     const minExceedsMax = cache_ttl_min > cache_ttl_max;
+    const negativeMinExceedsMax = !!cache_negative_ttl_max
+        && cache_negative_ttl_min > cache_negative_ttl_max;
 
     return <form onSubmit={handleSubmit}>
         <div className="row">
@@ -75,6 +95,11 @@ const Form = ({
                     {t('ttl_cache_validation')}
                 </span>
             )}
+            {negativeMinExceedsMax && (
+                <span className="text-danger pl-3 pb-3">
+                    {t('negative_ttl_cache_validation')}
+                </span>
+            )}
         </div>
         <div className="row">
             <div className="col-12 col-md-7">
@@ -88,12 +113,35 @@ const Form = ({
                         subtitle={t('cache_optimistic_desc')}
                     />
                 </div>
+                <div className="form__group form__group--settings">
+                    <Field
+                        name="cache_serve_stale"
+                        type="checkbox"
+                        component={CheckboxField}
+                        placeholder={t('cache_serve_stale')}
+                        disabled={processingSetConfig}
+                        subtitle={t('cache_serve_stale_desc')}
+                    />
+                </div>
+                <div className="form__group form__group--settings">
+                    <Field
+                        name="cache_persistent"
+                        type="checkbox"
+                        component={CheckboxField}
+                        placeholder={t('cache_persistent')}
+                        disabled={processingSetConfig}
+                        subtitle={t('cache_persistent_desc')}
+                    />
+                </div>
             </div>
         </div>
         <button
             type="submit"
             className="btn btn-success btn-standard btn-large"
-            disabled={submitting || invalid || processingSetConfig || minExceedsMax}
+            disabled={
+                submitting || invalid || processingSetConfig
+                || minExceedsMax || negativeMinExceedsMax
+            }
         >
             <Trans>save_btn</Trans>
         </button>
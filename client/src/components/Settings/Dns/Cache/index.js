@@ -11,6 +11,8 @@ const CacheConfig = () => {
     const dispatch = useDispatch();
     const {
         cache_size, cache_ttl_max, cache_ttl_min, cache_optimistic,
+        cache_serve_stale, cache_max_stale_ttl, cache_persistent,
+        cache_negative_ttl_min, cache_negative_ttl_max,
     } = useSelector((state) => state.dnsConfig, shallowEqual);
 
     const handleFormSubmit = (values) => {
@@ -32,6 +34,11 @@ const CacheConfig = () => {
                         cache_ttl_max: replaceZeroWithEmptyString(cache_ttl_max),
                         cache_ttl_min: replaceZeroWithEmptyString(cache_ttl_min),
                         cache_optimistic,
+                        cache_serve_stale,
+                        cache_max_stale_ttl: replaceZeroWithEmptyString(cache_max_stale_ttl),
+                        cache_persistent,
+                        cache_negative_ttl_min: replaceZeroWithEmptyString(cache_negative_ttl_min),
+                        cache_negative_ttl_max: replaceZeroWithEmptyString(cache_negative_ttl_max),
                     }}
                     onSubmit={handleFormSubmit}
                 />
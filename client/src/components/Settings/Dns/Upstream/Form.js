@@ -117,6 +117,30 @@ const INPUT_FIELDS = [
         subtitle: 'fastest_addr_desc',
         placeholder: 'fastest_addr',
     },
+    {
+        name: UPSTREAM_MODE_NAME,
+        type: 'radio',
+        value: DNS_REQUEST_OPTIONS.WEIGHTED,
+        component: renderRadioField,
+        subtitle: 'upstream_weighted_desc',
+        placeholder: 'upstream_weighted',
+    },
+    {
+        name: UPSTREAM_MODE_NAME,
+        type: 'radio',
+        value: DNS_REQUEST_OPTIONS.ADAPTIVE,
+        component: renderRadioField,
+        subtitle: 'upstream_adaptive_desc',
+        placeholder: 'upstream_adaptive',
+    },
+    {
+        name: UPSTREAM_MODE_NAME,
+        type: 'radio',
+        value: DNS_REQUEST_OPTIONS.STICKY,
+        component: renderRadioField,
+        subtitle: 'upstream_sticky_desc',
+        placeholder: 'upstream_sticky',
+    },
 ];
 
 const Form = ({
@@ -0,0 +1,82 @@
+import React from 'react';
+import PropTypes from 'prop-types';
+import { Trans, withTranslation } from 'react-i18next';
+
+import Card from '../../ui/Card';
+import { isWebPushSupported } from '../../../actions/notifications';
+
+const NotificationsConfig = ({
+    t,
+    publicKey,
+    subscriptions,
+    subscribed,
+    processingSubscribe,
+    processingTest,
+    subscribeWebPush,
+    unsubscribeWebPush,
+    testWebPush,
+}) => {
+    const supported = isWebPushSupported();
+
+    return (
+        <Card
+            title={t('notifications_configuration')}
+            bodyType="card-body box-body--settings"
+            id="notifications-config"
+        >
+            <div className="form">
+                <div className="form__desc form__desc--top">
+                    <Trans>web_push_desc</Trans>
+                </div>
+                <div className="form__desc mt-2">
+                    {supported
+                        ? <Trans values={{ count: subscriptions }}>web_push_subscriptions</Trans>
+                        : <Trans>web_push_not_supported</Trans>}
+                </div>
+                <div className="mt-5">
+                    {subscribed ? (
+                        <button
+                            type="button"
+                            className="btn btn-outline-secondary btn-standard btn-large"
+                            onClick={() => unsubscribeWebPush()}
+                            disabled={processingSubscribe}
+                        >
+                            <Trans>web_push_unsubscribe</Trans>
+                        </button>
+                    ) : (
+                        <button
+                            type="button"
+                            className="btn btn-success btn-standard btn-large"
+                            onClick={() => subscribeWebPush(publicKey)}
+                            disabled={!supported || !publicKey || processingSubscribe}
+                        >
+                            <Trans>web_push_subscribe</Trans>
+                        </button>
+                    )}
+                    <button
+                        type="button"
+                        className="btn btn-outline-secondary btn-standard form__button"
+                        onClick={() => testWebPush()}
+                        disabled={subscriptions === 0 || processingTest}
+                    >
+                        <Trans>web_push_test</Trans>
+                    </button>
+                </div>
+            </div>
+        </Card>
+    );
+};
+
+NotificationsConfig.propTypes = {
+    t: PropTypes.func.isRequired,
+    publicKey: PropTypes.string.isRequired,
+    subscriptions: PropTypes.number.isRequired,
+    subscribed: PropTypes.bool.isRequired,
+    processingSubscribe: PropTypes.bool.isRequired,
+    processingTest: PropTypes.bool.isRequired,
+    subscribeWebPush: PropTypes.func.isRequired,
+    unsubscribeWebPush: PropTypes.func.isRequired,
+    testWebPush: PropTypes.func.isRequired,
+};
+
+export default withTranslation()(NotificationsConfig);
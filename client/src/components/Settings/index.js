@@ -5,6 +5,7 @@ import { withTranslation } from 'react-i18next';
 import StatsConfig from './StatsConfig';
 import LogsConfig from './LogsConfig';
 import FiltersConfig from './FiltersConfig';
+import NotificationsConfig from './NotificationsConfig';
 
 import Checkbox from '../ui/Checkbox';
 import Loading from '../ui/Loading';
@@ -42,6 +43,7 @@ class Settings extends Component {
         this.props.getStatsConfig();
         this.props.getLogsConfig();
         this.props.getFilteringStatus();
+        this.props.getWebPushStatus();
     }
 
     renderSettings = (settings) => getObjectKeysSorted(settings, ORDER_KEY)
@@ -66,6 +68,10 @@ class Settings extends Component {
             clearLogs,
             filtering,
             setFiltersConfig,
+            notifications,
+            subscribeWebPush,
+            unsubscribeWebPush,
+            testWebPush,
             t,
         } = this.props;
 
@@ -115,6 +121,18 @@ class Settings extends Component {
                                     resetStats={resetStats}
                                 />
                             </div>
+                            <div className="col-md-12">
+                                <NotificationsConfig
+                                    publicKey={notifications.publicKey}
+                                    subscriptions={notifications.subscriptions}
+                                    subscribed={notifications.subscribed}
+                                    processingSubscribe={notifications.processingSubscribe}
+                                    processingTest={notifications.processingTest}
+                                    subscribeWebPush={subscribeWebPush}
+                                    unsubscribeWebPush={unsubscribeWebPush}
+                                    testWebPush={testWebPush}
+                                />
+                            </div>
                         </div>
                     </div>
                 )}
@@ -132,6 +150,10 @@ Settings.propTypes = {
     resetStats: PropTypes.func.isRequired,
     setFiltersConfig: PropTypes.func.isRequired,
     getFilteringStatus: PropTypes.func.isRequired,
+    getWebPushStatus: PropTypes.func.isRequired,
+    subscribeWebPush: PropTypes.func.isRequired,
+    unsubscribeWebPush: PropTypes.func.isRequired,
+    testWebPush: PropTypes.func.isRequired,
     t: PropTypes.func.isRequired,
     getLogsConfig: PropTypes.func,
     setLogsConfig: PropTypes.func,
@@ -155,6 +177,13 @@ Settings.propTypes = {
         enabled: PropTypes.bool,
         processingSetConfig: PropTypes.bool,
     }),
+    notifications: PropTypes.shape({
+        publicKey: PropTypes.string,
+        subscriptions: PropTypes.number,
+        subscribed: PropTypes.bool,
+        processingSubscribe: PropTypes.bool,
+        processingTest: PropTypes.bool,
+    }),
 };
 
 export default withTranslation()(Settings);
@@ -2,7 +2,7 @@ import { connect } from 'react-redux';
 import { getClients } from '../actions';
 import { getStats } from '../actions/stats';
 import {
-    addClient, updateClient, deleteClient, toggleClientModal,
+    addClient, updateClient, deleteClient, quarantineClient, toggleClientModal,
 } from '../actions/clients';
 import Clients from '../components/Settings/Clients';
 
@@ -22,6 +22,7 @@ const mapDispatchToProps = {
     addClient,
     updateClient,
     deleteClient,
+    quarantineClient,
     toggleClientModal,
 };
 
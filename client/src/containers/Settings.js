@@ -4,11 +4,14 @@ import { getBlockedServices, setBlockedServices } from '../actions/services';
 import { getStatsConfig, setStatsConfig, resetStats } from '../actions/stats';
 import { clearLogs, getLogsConfig, setLogsConfig } from '../actions/queryLogs';
 import { getFilteringStatus, setFiltersConfig } from '../actions/filtering';
+import {
+    getWebPushStatus, subscribeWebPush, unsubscribeWebPush, testWebPush,
+} from '../actions/notifications';
 import Settings from '../components/Settings';
 
 const mapStateToProps = (state) => {
     const {
-        settings, services, stats, queryLogs, filtering,
+        settings, services, stats, queryLogs, filtering, notifications,
     } = state;
     const props = {
         settings,
@@ -16,6 +19,7 @@ const mapStateToProps = (state) => {
         stats,
         queryLogs,
         filtering,
+        notifications,
     };
     return props;
 };
@@ -33,6 +37,10 @@ const mapDispatchToProps = {
     setLogsConfig,
     getFilteringStatus,
     setFiltersConfig,
+    getWebPushStatus,
+    subscribeWebPush,
+    unsubscribeWebPush,
+    testWebPush,
 };
 
 export default connect(
@@ -63,6 +63,7 @@ export const GETTING_STARTED_LINK = 'https://github.com/AdguardTeam/AdGuardHome/
 export const FILTERS_RELATIVE_LINK = '#filters';
 
 export const ADDRESS_IN_USE_TEXT = 'address already in use';
+export const RESOLVED_SERVICE = 'systemd-resolved';
 
 export const INSTALL_FIRST_STEP = 1;
 export const INSTALL_TOTAL_STEPS = 5;
@@ -401,6 +402,7 @@ export const FILTERED_STATUS = {
     FILTERED_SAFE_SEARCH: 'FilteredSafeSearch',
     FILTERED_SAFE_BROWSING: 'FilteredSafeBrowsing',
     FILTERED_PARENTAL: 'FilteredParental',
+    FILTERED_QUARANTINE: 'FilteredQuarantine',
 };
 
 export const RESPONSE_FILTER = {
@@ -501,6 +503,10 @@ export const FILTERED_STATUS_TO_META_MAP = {
         LABEL: RESPONSE_FILTER.BLOCKED_ADULT_WEBSITES.LABEL,
         COLOR: QUERY_STATUS_COLORS.YELLOW,
     },
+    [FILTERED_STATUS.FILTERED_QUARANTINE]: {
+        LABEL: 'blocked_quarantine',
+        COLOR: QUERY_STATUS_COLORS.RED,
+    },
 };
 
 export const DEFAULT_TIME_FORMAT = 'HH:mm:ss';
@@ -535,6 +541,10 @@ export const SPECIAL_FILTER_ID = {
     PARENTAL: -3,
     SAFE_BROWSING: -4,
     SAFE_SEARCH: -5,
+    CUSTOM_FUNCTIONS: -6,
+    QUARANTINE: -7,
+    RPZ: -8,
+    ANSWER_NETS: -9,
 };
 
 export const BLOCK_ACTIONS = {
@@ -554,6 +564,9 @@ export const DNS_REQUEST_OPTIONS = {
     PARALLEL: 'parallel',
     FASTEST_ADDR: 'fastest_addr',
     LOAD_BALANCING: '',
+    WEIGHTED: 'weighted',
+    ADAPTIVE: 'adaptive',
+    STICKY: 'sticky',
 };
 
 export const DHCP_FORM_NAMES = {
@@ -649,6 +662,9 @@ export const CACHE_CONFIG_FIELDS = {
     cache_size: 'cache_size',
     cache_ttl_min: 'cache_ttl_min',
     cache_ttl_max: 'cache_ttl_max',
+    cache_max_stale_ttl: 'cache_max_stale_ttl',
+    cache_negative_ttl_min: 'cache_negative_ttl_min',
+    cache_negative_ttl_max: 'cache_negative_ttl_max',
 };
 
 export const isFirefox = navigator.userAgent.indexOf('Firefox') !== -1;
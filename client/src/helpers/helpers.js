@@ -78,7 +78,9 @@ export const normalizeLogs = (logs) => logs.map((log) => {
         cached,
     } = log;
 
-    const { name: domain, unicode_name: unicodeName, type } = question;
+    const {
+        name: domain, unicode_name: unicodeName, homograph, type,
+    } = question;
 
     const processResponse = (data) => (data ? data.map((response) => {
         const { value, type, ttl } = response;
@@ -98,6 +100,7 @@ export const normalizeLogs = (logs) => logs.map((log) => {
         time,
         domain,
         unicodeName,
+        homograph: !!homograph,
         type,
         response: processResponse(answer),
         reason,
@@ -794,6 +797,14 @@ export const getSpecialFilterName = (filterId) => {
             return i18n.t('safe_browsing');
         case SPECIAL_FILTER_ID.SAFE_SEARCH:
             return i18n.t('safe_search');
+        case SPECIAL_FILTER_ID.CUSTOM_FUNCTIONS:
+            return i18n.t('custom_filter_functions');
+        case SPECIAL_FILTER_ID.QUARANTINE:
+            return i18n.t('quarantine');
+        case SPECIAL_FILTER_ID.RPZ:
+            return i18n.t('response_policy_zones');
+        case SPECIAL_FILTER_ID.ANSWER_NETS:
+            return i18n.t('blocked_answer_networks');
         default:
             return i18n.t('unknown_filter', { filterId });
     }
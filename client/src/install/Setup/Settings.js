@@ -14,6 +14,7 @@ import {
     FORM_NAME,
     ADDRESS_IN_USE_TEXT,
     PORT_53_FAQ_LINK,
+    RESOLVED_SERVICE,
     STATUS_RESPONSE,
     STANDARD_DNS_PORT,
     STANDARD_WEB_PORT,
@@ -170,7 +171,9 @@ class Settings extends Component {
         const {
             status: dnsStatus,
             can_autofix: isDnsFixAvailable,
+            autofix_service: dnsFixService,
         } = config.dns;
+        const isResolvedFix = !dnsFixService || dnsFixService === RESOLVED_SERVICE;
         const { staticIp } = config;
 
         return (
@@ -298,7 +301,7 @@ class Settings extends Component {
                                     </button>
                                     }
                                 </div>
-                                {isDnsFixAvailable
+                                {isDnsFixAvailable && isResolvedFix
                                 && <div className="text-muted mb-2">
                                     <p className="mb-1">
                                         <Trans>autofix_warning_text</Trans>
@@ -310,6 +313,14 @@ class Settings extends Component {
                                         <Trans>autofix_warning_result</Trans>
                                     </p>
                                 </div>}
+                                {isDnsFixAvailable && !isResolvedFix
+                                && <div className="text-muted mb-2">
+                                    <p className="mb-1">
+                                        <Trans values={{ service: dnsFixService }}>
+                                            autofix_warning_service
+                                        </Trans>
+                                    </p>
+                                </div>}
                             </>}
                             {dnsPort === STANDARD_DNS_PORT && !isDnsFixAvailable
                             && dnsStatus.includes(ADDRESS_IN_USE_TEXT)
@@ -0,0 +1,39 @@
+import { handleActions } from 'redux-actions';
+
+import * as actions from '../actions/notifications';
+
+const notifications = handleActions(
+    {
+        [actions.getWebPushStatusRequest]: (state) => ({ ...state, processing: true }),
+        [actions.getWebPushStatusFailure]: (state) => ({ ...state, processing: false }),
+        [actions.getWebPushStatusSuccess]: (state, { payload }) => ({
+            ...state,
+            publicKey: payload.public_key,
+            subscriptions: payload.subscriptions,
+            subscribed: payload.subscribed,
+            processing: false,
+        }),
+
+        [actions.subscribeWebPushRequest]: (state) => ({ ...state, processingSubscribe: true }),
+        [actions.subscribeWebPushFailure]: (state) => ({ ...state, processingSubscribe: false }),
+        [actions.subscribeWebPushSuccess]: (state) => ({ ...state, processingSubscribe: false }),
+
+        [actions.unsubscribeWebPushRequest]: (state) => ({ ...state, processingSubscribe: true }),
+        [actions.unsubscribeWebPushFailure]: (state) => ({ ...state, processingSubscribe: false }),
+        [actions.unsubscribeWebPushSuccess]: (state) => ({ ...state, processingSubscribe: false }),
+
+        [actions.testWebPushRequest]: (state) => ({ ...state, processingTest: true }),
+        [actions.testWebPushFailure]: (state) => ({ ...state, processingTest: false }),
+        [actions.testWebPushSuccess]: (state) => ({ ...state, processingTest: false }),
+    },
+    {
+        processing: true,
+        processingSubscribe: false,
+        processingTest: false,
+        publicKey: '',
+        subscriptions: 0,
+        subscribed: false,
+    },
+);
+
+export default notifications;
@@ -1,5 +1,5 @@
-//go:build windows
-// +build windows
+//go:build !(aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
 
 package aghnet
 
@@ -108,10 +108,10 @@ type HostsContainer struct {
 	done chan struct{}
 
 	// updates is the channel for receiving updated hosts.
-	updates chan *netutil.IPMap
+	updates chan *IPMap
 
 	// last is the set of hosts that was cached within last detected change.
-	last *netutil.IPMap
+	last *IPMap
 
 	// fsys is the working file system to read hosts files from.
 	fsys fs.FS
@@ -160,7 +160,7 @@ func NewHostsContainer(
 		},
 		listID:   listID,
 		done:     make(chan struct{}, 1),
-		updates:  make(chan *netutil.IPMap, 1),
+		updates:  make(chan *IPMap, 1),
 		fsys:     fsys,
 		w:        w,
 		patterns: patterns,
@@ -200,7 +200,7 @@ func (hc *HostsContainer) Close() (err error) {
 
 // Upd returns the channel into which the updates are sent.  The receivable
 // map's values are guaranteed to be of type of *stringutil.Set.
-func (hc *HostsContainer) Upd() (updates <-chan *netutil.IPMap) {
+func (hc *HostsContainer) Upd() (updates <-chan *IPMap) {
 	return hc.updates
 }
 
@@ -231,7 +231,7 @@ func pathsToPatterns(fsys fs.FS, paths []string) (patterns []string, err error)
 // handleEvents concurrently handles the events.  It closes the update channel
 // of HostsContainer when finishes.  Used to be called within a goroutine.
 func (hc *HostsContainer) handleEvents() {
-	defer log.OnPanic(fmt.Sprintf("%s: handling events", hostsContainerPref))
+	defer aghos.OnPanicAndExit(fmt.Sprintf("%s: handling events", hostsContainerPref))
 
 	defer close(hc.updates)
 
@@ -269,7 +269,7 @@ type hostsParser struct {
 
 	// table stores only the unique IP-hostname pairs.  It's also sent to the
 	// updates channel afterwards.
-	table *netutil.IPMap
+	table *IPMap
 }
 
 func (hc *HostsContainer) newHostsParser() (hp *hostsParser) {
@@ -278,7 +278,7 @@ func (hc *HostsContainer) newHostsParser() (hp *hostsParser) {
 		// For A/AAAA and PTRs.
 		translations: make(map[string]string, hc.last.Len()*2),
 		cnameSet:     stringutil.NewSet(),
-		table:        netutil.NewIPMap(hc.last.Len()),
+		table:        NewIPMap(hc.last.Len()),
 	}
 }
 
@@ -326,7 +326,7 @@ func (hp *hostsParser) parseLine(line string) (ip net.IP, hosts []string) {
 		// Make sure that invalid hosts aren't turned into rules.
 		//
 		// See https://github.com/AdguardTeam/AdGuardHome/issues/3946.
-		err := netutil.ValidateDomainName(f)
+		err := netutil.ValidateHostname(f)
 		if err != nil {
 			log.Error("%s: host %q is invalid, ignoring", hostsContainerPref, f)
 
@@ -478,7 +478,7 @@ func (hp *hostsParser) writeMainHostRule(host string, ip net.IP) (added, addedPt
 }
 
 // equalSet returns true if the internal hosts table just parsed equals target.
-func (hp *hostsParser) equalSet(target *netutil.IPMap) (ok bool) {
+func (hp *hostsParser) equalSet(target *IPMap) (ok bool) {
 	if target == nil {
 		// hp.table shouldn't appear nil since it's initialized on each refresh.
 		return target == hp.table
@@ -505,7 +505,7 @@ func (hp *hostsParser) equalSet(target *netutil.IPMap) (ok bool) {
 }
 
 // sendUpd tries to send the parsed data to the ch.
-func (hp *hostsParser) sendUpd(ch chan *netutil.IPMap) {
+func (hp *hostsParser) sendUpd(ch chan *IPMap) {
 	log.Debug("%s: sending upd", hostsContainerPref)
 
 	upd := hp.table
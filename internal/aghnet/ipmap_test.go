@@ -0,0 +1,70 @@
+package aghnet
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPMap(t *testing.T) {
+	const val = 42
+
+	t.Run("nil", func(t *testing.T) {
+		var m *IPMap
+
+		assert.NotPanics(t, func() {
+			m.Clear()
+			m.Del(net.IP{1, 2, 3, 4})
+		})
+
+		v, ok := m.Get(net.IP{1, 2, 3, 4})
+		assert.Nil(t, v)
+		assert.False(t, ok)
+
+		assert.Equal(t, 0, m.Len())
+		assert.Nil(t, m.ShallowClone())
+
+		assert.Panics(t, func() {
+			m.Set(net.IP{1, 2, 3, 4}, val)
+		})
+	})
+
+	testCases := []struct {
+		ip   net.IP
+		name string
+		want string
+	}{{
+		ip:   net.IP{1, 2, 3, 4},
+		name: "ipv4",
+		want: "map[1.2.3.4:42]",
+	}, {
+		ip:   net.ParseIP("1234::cdef"),
+		name: "ipv6",
+		want: "map[1234::cdef:42]",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewIPMap(0)
+			m.Set(tc.ip, val)
+
+			v, ok := m.Get(tc.ip.To16())
+			assert.Equal(t, val, v)
+			assert.True(t, ok)
+
+			m.Range(func(ip net.IP, v any) (cont bool) {
+				assert.Equal(t, tc.ip.To16(), ip)
+				assert.Equal(t, val, v)
+
+				return true
+			})
+
+			assert.Equal(t, m, m.ShallowClone())
+			assert.Equal(t, tc.want, m.String())
+
+			m.Del(tc.ip)
+			assert.Equal(t, 0, m.Len())
+		})
+	}
+}
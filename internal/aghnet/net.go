@@ -7,12 +7,12 @@ import (
 	"io"
 	"net"
 	"os/exec"
+	"slices"
 	"strings"
 	"syscall"
 
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
-	"github.com/AdguardTeam/golibs/netutil"
 )
 
 // ErrNoStaticIPInfo is returned by IfaceHasStaticIP when no information about
@@ -190,7 +190,7 @@ func GetSubnet(ifaceName string) *net.IPNet {
 // CheckPort checks if the port is available for binding.
 func CheckPort(network string, ip net.IP, port int) (err error) {
 	var c io.Closer
-	addr := netutil.IPPort{IP: ip, Port: port}.String()
+	addr := (&net.UDPAddr{IP: ip, Port: port}).String()
 	switch network {
 	case "tcp":
 		c, err = net.Listen(network, addr)
@@ -200,7 +200,11 @@ func CheckPort(network string, ip net.IP, port int) (err error) {
 		return nil
 	}
 
-	return errors.WithDeferred(err, closePortChecker(c))
+	if err != nil {
+		return err
+	}
+
+	return closePortChecker(c)
 }
 
 // IsAddrInUse checks if err is about unsuccessful address binding.
@@ -213,6 +217,18 @@ func IsAddrInUse(err error) (ok bool) {
 	return isAddrInUse(sysErr)
 }
 
+// IsAddrNotAvail checks if err is about binding to an address, which isn't
+// assigned to any of the network interfaces, for example until the interface
+// gets its address from a DHCP server.
+func IsAddrNotAvail(err error) (ok bool) {
+	var sysErr syscall.Errno
+	if !errors.As(err, &sysErr) {
+		return false
+	}
+
+	return isAddrNotAvail(sysErr)
+}
+
 // SplitHost is a wrapper for net.SplitHostPort for the cases when the hostport
 // does not necessarily contain a port.
 func SplitHost(hostport string) (host string, err error) {
@@ -268,7 +284,7 @@ func CollectAllIfacesAddrs() (addrs []string, err error) {
 
 // BroadcastFromIPNet calculates the broadcast IP address for n.
 func BroadcastFromIPNet(n *net.IPNet) (dc net.IP) {
-	dc = netutil.CloneIP(n.IP)
+	dc = slices.Clone(n.IP)
 
 	mask := n.Mask
 	if mask == nil {
@@ -1,5 +1,5 @@
-//go:build openbsd || freebsd || linux || darwin
-// +build openbsd freebsd linux darwin
+//go:build openbsd || freebsd || linux || darwin || solaris
+// +build openbsd freebsd linux darwin solaris
 
 package aghnet
 
@@ -17,3 +17,7 @@ func closePortChecker(c io.Closer) (err error) {
 func isAddrInUse(err syscall.Errno) (ok bool) {
 	return errors.Is(err, syscall.EADDRINUSE)
 }
+
+func isAddrNotAvail(err syscall.Errno) (ok bool) {
+	return errors.Is(err, syscall.EADDRNOTAVAIL)
+}
@@ -1,5 +1,5 @@
-//go:build !(linux || darwin || freebsd || openbsd)
-// +build !linux,!darwin,!freebsd,!openbsd
+//go:build !(linux || darwin || freebsd || openbsd || solaris)
+// +build !linux,!darwin,!freebsd,!openbsd,!solaris
 
 package aghnet
 
@@ -43,3 +43,7 @@ func closePortChecker(c io.Closer) (err error) {
 func isAddrInUse(err syscall.Errno) (ok bool) {
 	return errors.Is(err, windows.WSAEADDRINUSE)
 }
+
+func isAddrNotAvail(err syscall.Errno) (ok bool) {
+	return errors.Is(err, windows.WSAEADDRNOTAVAIL)
+}
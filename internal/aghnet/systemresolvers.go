@@ -3,6 +3,7 @@ package aghnet
 import (
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
 	"github.com/AdguardTeam/golibs/log"
 )
 
@@ -26,7 +27,7 @@ type SystemResolvers interface {
 
 // refreshWithTicker refreshes the cache of sr after each tick form tickCh.
 func refreshWithTicker(sr SystemResolvers, tickCh <-chan time.Time) {
-	defer log.OnPanic("systemResolvers")
+	defer aghos.OnPanicAndExit("systemResolvers")
 
 	// TODO(e.burkov): Implement a functionality to stop ticker.
 	for range tickCh {
@@ -0,0 +1,31 @@
+package aghos
+
+// FSAccess is the level of access to a part of the filesystem granted to the
+// confined process.
+type FSAccess uint8
+
+// FSAccess values.
+const (
+	// FSAccessRead allows reading and executing the files and listing the
+	// directories.
+	FSAccessRead FSAccess = iota + 1
+
+	// FSAccessReadWrite additionally allows writing into the existing files.
+	FSAccessReadWrite
+
+	// FSAccessFull additionally allows creating, renaming, and removing the
+	// files and the directories.
+	FSAccessFull
+)
+
+// Confine restricts the process to the system calls and the parts of the
+// filesystem it's supposed to use, which can't be undone.  paths are the
+// additional paths to grant the access to.  The restrictions are inherited by
+// the child processes.
+//
+// The restrictions not supported by the kernel are skipped, and err is only
+// returned if a supported one couldn't be applied.  On the OSes other than
+// Linux it always returns an *UnsupportedError.
+func Confine(paths map[string]FSAccess) (err error) {
+	return confine(paths)
+}
@@ -0,0 +1,331 @@
+//go:build linux
+// +build linux
+
+package aghos
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/sys/unix"
+)
+
+// systemPaths are the parts of the filesystem the process and the utilities it
+// runs need regardless of the configuration.
+var systemPaths = map[string]FSAccess{
+	"/bin":   FSAccessRead,
+	"/etc":   FSAccessRead,
+	"/lib":   FSAccessRead,
+	"/lib32": FSAccessRead,
+	"/lib64": FSAccessRead,
+	"/proc":  FSAccessRead,
+	"/run":   FSAccessRead,
+	"/sbin":  FSAccessRead,
+	"/sys":   FSAccessRead,
+	"/usr":   FSAccessRead,
+	"/dev":   FSAccessReadWrite,
+	"/tmp":   FSAccessFull,
+}
+
+func confine(paths map[string]FSAccess) (err error) {
+	// Both seccomp and Landlock require either CAP_SYS_ADMIN or no_new_privs.
+	_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0)
+	if errno == syscall.ENOTSUP {
+		// See the documentation of syscall.AllThreadsSyscall.
+		return errors.Error("confinement requires building without cgo")
+	} else if errno != 0 {
+		return fmt.Errorf("setting no_new_privs: %w", errno)
+	}
+
+	err = landlock(paths)
+	if err != nil {
+		return fmt.Errorf("landlock: %w", err)
+	}
+
+	err = seccomp()
+	if err != nil {
+		return fmt.Errorf("seccomp: %w", err)
+	}
+
+	return nil
+}
+
+// Landlock access rights.
+const (
+	llFileAccess = unix.LANDLOCK_ACCESS_FS_EXECUTE |
+		unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_FILE
+
+	llAccessAll = llFileAccess |
+		unix.LANDLOCK_ACCESS_FS_READ_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+		unix.LANDLOCK_ACCESS_FS_MAKE_CHAR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_REG |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_FIFO |
+		unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SYM
+)
+
+// llAccess returns the Landlock access rights for a.
+func llAccess(a FSAccess) (access uint64) {
+	switch a {
+	case FSAccessRead:
+		return unix.LANDLOCK_ACCESS_FS_EXECUTE |
+			unix.LANDLOCK_ACCESS_FS_READ_FILE |
+			unix.LANDLOCK_ACCESS_FS_READ_DIR
+	case FSAccessReadWrite:
+		return unix.LANDLOCK_ACCESS_FS_EXECUTE |
+			unix.LANDLOCK_ACCESS_FS_READ_FILE |
+			unix.LANDLOCK_ACCESS_FS_READ_DIR |
+			unix.LANDLOCK_ACCESS_FS_WRITE_FILE
+	case FSAccessFull:
+		return llAccessAll
+	default:
+		return 0
+	}
+}
+
+// landlock restricts the filesystem access of all the threads of the process
+// to paths and systemPaths.  It does nothing if Landlock isn't supported.
+func landlock(paths map[string]FSAccess) (err error) {
+	attr := &unix.LandlockRulesetAttr{
+		Access_fs: llAccessAll,
+	}
+	fd, _, errno := unix.Syscall(
+		unix.SYS_LANDLOCK_CREATE_RULESET,
+		uintptr(unsafe.Pointer(attr)),
+		unsafe.Sizeof(*attr),
+		0,
+	)
+	switch errno {
+	case 0:
+		// Go on.
+	case unix.ENOSYS, unix.EOPNOTSUPP:
+		log.Info("confinement: landlock is not supported, skipping")
+
+		return nil
+	default:
+		return fmt.Errorf("creating ruleset: %w", errno)
+	}
+	defer func() { err = errors.WithDeferred(err, unix.Close(int(fd))) }()
+
+	for _, m := range []map[string]FSAccess{systemPaths, paths} {
+		for p, a := range m {
+			err = addLandlockRule(int(fd), p, llAccess(a))
+			if err != nil {
+				return fmt.Errorf("adding rule for %q: %w", p, err)
+			}
+		}
+	}
+
+	// Unlike seccomp, Landlock has no way to restrict the other threads, so
+	// restrict each of them.
+	_, _, errno = syscall.AllThreadsSyscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("restricting: %w", errno)
+	}
+
+	return nil
+}
+
+// addLandlockRule allows access to the path p within the ruleset fd.  Paths
+// that don't exist are skipped.
+func addLandlockRule(fd int, p string, access uint64) (err error) {
+	pfd, err := unix.Open(p, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if errors.Is(err, unix.ENOENT) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("opening: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, unix.Close(pfd)) }()
+
+	var st unix.Stat_t
+	err = unix.Fstat(pfd, &st)
+	if err != nil {
+		return fmt.Errorf("getting file info: %w", err)
+	}
+
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		// Only the file access rights are applicable to files.
+		access &= llFileAccess
+	}
+
+	attr := &unix.LandlockPathBeneathAttr{
+		Allowed_access: access,
+		Parent_fd:      int32(pfd),
+	}
+	_, _, errno := unix.Syscall6(
+		unix.SYS_LANDLOCK_ADD_RULE,
+		uintptr(fd),
+		unix.LANDLOCK_RULE_PATH_BENEATH,
+		uintptr(unsafe.Pointer(attr)),
+		0,
+		0,
+		0,
+	)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// deniedSyscalls are the system calls neither AdGuard Home nor the utilities
+// it runs need, but which are useful to an attacker having taken control over
+// the process.
+var deniedSyscalls = []uint32{
+	unix.SYS_ACCT,
+	unix.SYS_ADD_KEY,
+	unix.SYS_BPF,
+	unix.SYS_CHROOT,
+	unix.SYS_CLOCK_ADJTIME,
+	unix.SYS_CLOCK_SETTIME,
+	unix.SYS_DELETE_MODULE,
+	unix.SYS_FANOTIFY_INIT,
+	unix.SYS_FINIT_MODULE,
+	unix.SYS_FSCONFIG,
+	unix.SYS_FSMOUNT,
+	unix.SYS_FSOPEN,
+	unix.SYS_FSPICK,
+	unix.SYS_INIT_MODULE,
+	unix.SYS_KCMP,
+	unix.SYS_KEXEC_LOAD,
+	unix.SYS_KEYCTL,
+	unix.SYS_LOOKUP_DCOOKIE,
+	unix.SYS_MOUNT,
+	unix.SYS_MOVE_MOUNT,
+	unix.SYS_NAME_TO_HANDLE_AT,
+	unix.SYS_OPEN_BY_HANDLE_AT,
+	unix.SYS_OPEN_TREE,
+	unix.SYS_PERF_EVENT_OPEN,
+	unix.SYS_PIVOT_ROOT,
+	unix.SYS_PROCESS_VM_READV,
+	unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_PTRACE,
+	unix.SYS_QUOTACTL,
+	unix.SYS_REBOOT,
+	unix.SYS_REQUEST_KEY,
+	unix.SYS_SETDOMAINNAME,
+	unix.SYS_SETHOSTNAME,
+	unix.SYS_SETNS,
+	unix.SYS_SETTIMEOFDAY,
+	unix.SYS_SWAPOFF,
+	unix.SYS_SWAPON,
+	unix.SYS_SYSLOG,
+	unix.SYS_UMOUNT2,
+	unix.SYS_UNSHARE,
+	unix.SYS_USERFAULTFD,
+	unix.SYS_VHANGUP,
+}
+
+// Seccomp constants missing from package unix.
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTSync = 1
+
+	seccompRetAllow = 0x7fff_0000
+	seccompRetErrno = 0x0005_0000
+
+	// The offsets of the fields of struct seccomp_data.
+	seccompDataNrOff   = 0
+	seccompDataArchOff = 4
+)
+
+// seccompFilter returns the BPF program of the seccomp filter, which makes the
+// denied system calls fail with EPERM.  The system calls of the other
+// architectures and ABIs fail as well, since their numbers differ.
+func seccompFilter() (prog []unix.SockFilter) {
+	stmt := func(code uint16, k uint32) (f unix.SockFilter) {
+		return unix.SockFilter{Code: code, K: k}
+	}
+
+	prog = []unix.SockFilter{
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataArchOff),
+		// The jump offset is set below, when the position of the denying
+		// instruction is known.
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: auditArch},
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataNrOff),
+	}
+
+	if x32SyscallBit != 0 {
+		prog = append(prog, unix.SockFilter{
+			Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K,
+			K:    x32SyscallBit,
+		})
+	}
+
+	for _, nr := range deniedSyscalls {
+		prog = append(prog, unix.SockFilter{
+			Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K,
+			K:    nr,
+		})
+	}
+
+	prog = append(
+		prog,
+		stmt(unix.BPF_RET|unix.BPF_K, seccompRetAllow),
+		stmt(unix.BPF_RET|unix.BPF_K, seccompRetErrno|uint32(unix.EPERM)),
+	)
+
+	// bpfClassMask is the mask of the instruction class, BPF_CLASS in C.
+	const bpfClassMask = 0x07
+
+	deny := len(prog) - 1
+	for i := range prog[:deny-1] {
+		f := &prog[i]
+		switch {
+		case f.Code&bpfClassMask != unix.BPF_JMP:
+			// Go on.
+		case i == 1:
+			// Deny if the architecture doesn't match.
+			f.Jf = uint8(deny - i - 1)
+		default:
+			f.Jt = uint8(deny - i - 1)
+		}
+	}
+
+	return prog
+}
+
+// seccomp installs the seccomp filter into all the threads of the process.  It
+// does nothing if the filter isn't built for the architecture or seccomp isn't
+// supported.
+func seccomp() (err error) {
+	if auditArch == 0 {
+		log.Info("confinement: seccomp is not supported on %s, skipping", runtime.GOARCH)
+
+		return nil
+	}
+
+	filter := seccompFilter()
+	prog := &unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+
+	_, _, errno := unix.Syscall(
+		unix.SYS_SECCOMP,
+		seccompSetModeFilter,
+		seccompFilterFlagTSync,
+		uintptr(unsafe.Pointer(prog)),
+	)
+	runtime.KeepAlive(filter)
+
+	switch errno {
+	case 0:
+		return nil
+	case unix.ENOSYS, unix.EINVAL:
+		log.Info("confinement: seccomp filters are not supported, skipping")
+
+		return nil
+	default:
+		return errno
+	}
+}
@@ -0,0 +1,12 @@
+//go:build linux
+// +build linux
+
+package aghos
+
+// auditArch is the AUDIT_ARCH value of the architecture the seccomp filter is
+// built for.
+const auditArch = 0xc00000b7
+
+// x32SyscallBit is the bit set in the numbers of the x32 ABI system calls, or
+// zero if the architecture has no such ABI.
+const x32SyscallBit = 0
@@ -0,0 +1,10 @@
+//go:build linux && !(amd64 || arm64 || 386 || arm)
+// +build linux,!amd64,!arm64,!386,!arm
+
+package aghos
+
+// auditArch is zero, since the seccomp filter isn't built for the architecture.
+const auditArch = 0
+
+// x32SyscallBit is zero, since the architecture has no x32 ABI.
+const x32SyscallBit = 0
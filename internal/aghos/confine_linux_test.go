@@ -0,0 +1,111 @@
+//go:build linux
+// +build linux
+
+package aghos
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestSeccompFilter(t *testing.T) {
+	prog := seccompFilter()
+	require.Greater(t, len(prog), len(deniedSyscalls)+4)
+
+	deny := len(prog) - 1
+	assert.Equal(t, unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetAllow}, prog[deny-1])
+	assert.Equal(t, uint32(seccompRetErrno|uint32(unix.EPERM)), prog[deny].K)
+
+	for i, f := range prog[:deny-1] {
+		if f.Code&0x07 != unix.BPF_JMP {
+			continue
+		}
+
+		target := i + 1 + int(f.Jt)
+		if i == 1 {
+			target = i + 1 + int(f.Jf)
+		}
+
+		assert.Equalf(t, deny, target, "instruction at index %d", i)
+	}
+}
+
+// confineTestEnv is the environment variable making TestConfine run the
+// confined part.
+const confineTestEnv = "AGHOS_TEST_CONFINE_DIR"
+
+// errString returns the string describing the result of an operation.
+func errString(err error) (s string) {
+	var errno unix.Errno
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.As(err, &errno):
+		return unix.ErrnoName(errno)
+	default:
+		return err.Error()
+	}
+}
+
+// runConfined confines the process and prints the results of the operations,
+// which are expected to be restricted.
+func runConfined(dir string) {
+	_, _, errno := unix.Syscall(
+		unix.SYS_LANDLOCK_CREATE_RULESET,
+		0,
+		0,
+		unix.LANDLOCK_CREATE_RULESET_VERSION,
+	)
+	fmt.Printf("landlock: %t\n", errno == 0)
+
+	err := Confine(map[string]FSAccess{dir: FSAccessFull})
+	fmt.Printf("confine: %s\n", errString(err))
+
+	err = os.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0o600)
+	fmt.Printf("write allowed: %s\n", errString(err))
+
+	// The working directory of the test is the package directory.
+	_, err = os.ReadFile("confine.go")
+	fmt.Printf("read denied: %s\n", errString(err))
+
+	fmt.Printf("unshare: %s\n", errString(unix.Unshare(0)))
+}
+
+func TestConfine(t *testing.T) {
+	if dir := os.Getenv(confineTestEnv); dir != "" {
+		runConfined(dir)
+
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestConfine$")
+	cmd.Env = append(os.Environ(), confineTestEnv+"="+t.TempDir())
+
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	res := string(out)
+	if strings.Contains(res, "without cgo") {
+		t.Skip("confinement isn't available in the builds with cgo")
+	}
+
+	require.Contains(t, res, "confine: ok\n")
+
+	assert.Contains(t, res, "write allowed: ok\n")
+	assert.Contains(t, res, "unshare: EPERM\n")
+
+	if strings.Contains(res, "landlock: true\n") {
+		assert.Contains(t, res, "read denied: EACCES\n")
+	} else {
+		assert.Contains(t, res, "read denied: ok\n")
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package aghos
+
+func confine(_ map[string]FSAccess) (err error) {
+	return Unsupported("confinement")
+}
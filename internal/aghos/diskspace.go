@@ -0,0 +1,7 @@
+package aghos
+
+// FreeSpace returns the number of bytes available to the unprivileged users on
+// the filesystem containing path.
+func FreeSpace(path string) (free uint64, err error) {
+	return freeSpace(path)
+}
@@ -0,0 +1,16 @@
+//go:build openbsd
+// +build openbsd
+
+package aghos
+
+import "golang.org/x/sys/unix"
+
+func freeSpace(path string) (free uint64, err error) {
+	var st unix.Statfs_t
+	err = unix.Statfs(path, &st)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(st.F_bavail) * uint64(st.F_bsize), nil
+}
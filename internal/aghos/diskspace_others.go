@@ -0,0 +1,8 @@
+//go:build !(darwin || freebsd || linux || openbsd || windows)
+// +build !darwin,!freebsd,!linux,!openbsd,!windows
+
+package aghos
+
+func freeSpace(_ string) (free uint64, err error) {
+	return 0, Unsupported("free space")
+}
@@ -0,0 +1,16 @@
+//go:build darwin || freebsd || linux
+// +build darwin freebsd linux
+
+package aghos
+
+import "golang.org/x/sys/unix"
+
+func freeSpace(path string) (free uint64, err error) {
+	var st unix.Statfs_t
+	err = unix.Statfs(path, &st)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,20 @@
+//go:build windows
+// +build windows
+
+package aghos
+
+import "golang.org/x/sys/windows"
+
+func freeSpace(path string) (free uint64, err error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+
+	err = windows.GetDiskFreeSpaceEx(p, &free, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return free, nil
+}
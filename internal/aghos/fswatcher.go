@@ -69,7 +69,7 @@ func NewOSWritesWatcher() (w FSWatcher, err error) {
 // handleErrors handles accompanying errors.  It used to be called in a separate
 // goroutine.
 func (w *osWatcher) handleErrors() {
-	defer log.OnPanic(fmt.Sprintf("%s: handling errors", osWatcherPref))
+	defer OnPanicAndExit(fmt.Sprintf("%s: handling errors", osWatcherPref))
 
 	for err := range w.w.Errors {
 		log.Error("%s: %s", osWatcherPref, err)
@@ -102,7 +102,7 @@ func (w *osWatcher) Close() (err error) {
 // handleEvents notifies about the received file system's event if needed.  It
 // used to be called in a separate goroutine.
 func (w *osWatcher) handleEvents() {
-	defer log.OnPanic(fmt.Sprintf("%s: handling events", osWatcherPref))
+	defer OnPanicAndExit(fmt.Sprintf("%s: handling events", osWatcherPref))
 
 	defer close(w.events)
 
@@ -0,0 +1,40 @@
+package aghos
+
+import (
+	"os"
+	"runtime/debug"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// PanicHandler handles the panic with value v, which has happened in the
+// goroutine described by prefix.  It's expected to exit.
+type PanicHandler func(prefix string, v interface{})
+
+// panicHandler contains the PanicHandler set by SetPanicHandler.
+var panicHandler atomic.Value
+
+// SetPanicHandler makes OnPanicAndExit call h.  h must not be nil.
+func SetPanicHandler(h PanicHandler) {
+	panicHandler.Store(h)
+}
+
+// OnPanicAndExit is a deferred helper for the long-lived goroutines.  Once a
+// panic happens, it calls the handler set by SetPanicHandler or, if there is
+// none, logs the panic and exits.
+func OnPanicAndExit(prefix string) {
+	v := recover()
+	if v == nil {
+		return
+	}
+
+	if h, ok := panicHandler.Load().(PanicHandler); ok {
+		h(prefix, v)
+	}
+
+	log.Error("%s: panic encountered, exiting: %v", prefix, v)
+	debug.PrintStack()
+
+	os.Exit(1)
+}
@@ -0,0 +1,40 @@
+package aghos
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOnPanicAndExit(t *testing.T) {
+	type handled struct {
+		v      interface{}
+		prefix string
+	}
+
+	// The handler panics instead of exiting, so that the test can recover
+	// the call.
+	prev := panicHandler.Load()
+	SetPanicHandler(func(prefix string, v interface{}) {
+		panic(handled{v: v, prefix: prefix})
+	})
+	t.Cleanup(func() {
+		if prev != nil {
+			panicHandler.Store(prev)
+		}
+	})
+
+	var got interface{}
+	func() {
+		defer func() { got = recover() }()
+		defer OnPanicAndExit("test")
+
+		panic("boom")
+	}()
+
+	assert.Equal(t, handled{v: "boom", prefix: "test"}, got)
+
+	assert.NotPanics(t, func() {
+		defer OnPanicAndExit("test")
+	})
+}
@@ -0,0 +1,177 @@
+package aghos
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// PortHolder is a process holding a network port.
+type PortHolder struct {
+	// Name is the name of the executable of the process.  It may be empty if
+	// it's unknown.
+	Name string
+
+	// PID is the ID of the process.
+	PID int
+}
+
+// String implements the fmt.Stringer interface for *PortHolder.
+func (h *PortHolder) String() (s string) {
+	if h.Name == "" {
+		return fmt.Sprintf("pid %d", h.PID)
+	}
+
+	return fmt.Sprintf("%s (pid %d)", h.Name, h.PID)
+}
+
+// ErrNoPortHolder is returned by FindPortHolder when the process holding the
+// port can't be found, for example because of the lack of the permissions.
+const ErrNoPortHolder errors.Error = "no process holding the port found"
+
+// FindPortHolder returns the process holding port of network, which must be
+// either "tcp" or "udp".  For TCP, only the listening sockets are considered.
+// It uses /proc on Linux, lsof on the other Unix systems, and netstat with
+// tasklist on Windows.
+func FindPortHolder(network string, port int) (h *PortHolder, err error) {
+	if network != "tcp" && network != "udp" {
+		return nil, fmt.Errorf("bad network %q", network)
+	}
+
+	return findPortHolder(network, port)
+}
+
+// tcpListenState is the state of the listening TCP sockets in /proc/net/tcp
+// and /proc/net/tcp6.
+const tcpListenState = "0A"
+
+// parseProcNet returns the inodes of the sockets bound to port from r, which
+// is the contents of a file like /proc/net/tcp.  If listenOnly is true, only
+// the listening sockets are returned.  A valid line from r should look like:
+//
+//	0: 00000000:0035 00000000:0000 0A 00000000:00000000 00:00000000 00000000 0 0 12345 1 0000000000000000
+func parseProcNet(r io.Reader, port int, listenOnly bool) (inodes []string, err error) {
+	hexPort := fmt.Sprintf(":%04X", port)
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 10 || !strings.HasSuffix(fields[1], hexPort) {
+			continue
+		} else if listenOnly && fields[3] != tcpListenState {
+			continue
+		}
+
+		if inode := fields[9]; inode != "0" {
+			inodes = append(inodes, inode)
+		}
+	}
+
+	if err = s.Err(); err != nil {
+		return nil, fmt.Errorf("scanning: %w", err)
+	}
+
+	return inodes, nil
+}
+
+// parseLsofOutput parses the output of lsof with the "-Fpc" flag and returns
+// the first process in it.  The output should look like:
+//
+//	p123
+//	csystemd-resolve
+//	f12
+func parseLsofOutput(r io.Reader) (h *PortHolder, err error) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		l := s.Text()
+		if l == "" {
+			continue
+		}
+
+		switch l[0] {
+		case 'p':
+			if h != nil {
+				return h, nil
+			}
+
+			var pid int
+			pid, err = strconv.Atoi(l[1:])
+			if err != nil {
+				return nil, fmt.Errorf("parsing pid: %w", err)
+			}
+
+			h = &PortHolder{PID: pid}
+		case 'c':
+			if h != nil {
+				h.Name = l[1:]
+			}
+		default:
+			// Go on.
+		}
+	}
+
+	if err = s.Err(); err != nil {
+		return nil, fmt.Errorf("scanning: %w", err)
+	} else if h == nil {
+		return nil, ErrNoPortHolder
+	}
+
+	return h, nil
+}
+
+// parseNetstatOutput returns the ID of the process holding port of network
+// from the output of the Windows' "netstat -ano".  The valid lines from r
+// should look like:
+//
+//	TCP    0.0.0.0:53     0.0.0.0:0     LISTENING     1234
+//	UDP    [::]:53        *:*                         1234
+func parseNetstatOutput(r io.Reader, network string, port int) (pid int, err error) {
+	portSuffix := ":" + strconv.Itoa(port)
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 4 || !strings.EqualFold(fields[0], network) {
+			continue
+		} else if !strings.HasSuffix(fields[1], portSuffix) {
+			continue
+		} else if network == "tcp" && fields[3] != "LISTENING" {
+			continue
+		}
+
+		pid, err = strconv.Atoi(fields[len(fields)-1])
+		if err != nil {
+			return 0, fmt.Errorf("parsing pid: %w", err)
+		}
+
+		return pid, nil
+	}
+
+	if err = s.Err(); err != nil {
+		return 0, fmt.Errorf("scanning: %w", err)
+	}
+
+	return 0, ErrNoPortHolder
+}
+
+// parseTasklistOutput returns the name of the process from the output of the
+// Windows' "tasklist /FO CSV /NH", which should look like:
+//
+//	"dns.exe","1234","Services","0","5,000 K"
+func parseTasklistOutput(out string) (name string) {
+	l := strings.TrimSpace(out)
+	if !strings.HasPrefix(l, `"`) {
+		return ""
+	}
+
+	l = l[1:]
+	if i := strings.IndexByte(l, '"'); i >= 0 {
+		return l[:i]
+	}
+
+	return ""
+}
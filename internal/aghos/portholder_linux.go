@@ -0,0 +1,85 @@
+//go:build linux
+// +build linux
+
+package aghos
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+func findPortHolder(network string, port int) (h *PortHolder, err error) {
+	var inodes []string
+	for _, name := range []string{network, network + "6"} {
+		var f *os.File
+		f, err = os.Open(filepath.Join("/proc/net", name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		var found []string
+		found, err = parseProcNet(f, port, network == "tcp")
+		err = errors.WithDeferred(err, f.Close())
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", name, err)
+		}
+
+		inodes = append(inodes, found...)
+	}
+
+	if len(inodes) == 0 {
+		return nil, ErrNoPortHolder
+	}
+
+	return findSocketProcess(inodes)
+}
+
+// findSocketProcess returns the first process having an open file descriptor
+// of a socket with one of inodes.  The descriptors of the processes of the
+// other users are only accessible with the root rights.
+func findSocketProcess(inodes []string) (h *PortHolder, err error) {
+	links := make(map[string]struct{}, len(inodes))
+	for _, inode := range inodes {
+		links["socket:["+inode+"]"] = struct{}{}
+	}
+
+	fds, err := filepath.Glob("/proc/[0-9]*/fd/*")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fd := range fds {
+		link, lerr := os.Readlink(fd)
+		if lerr != nil {
+			continue
+		} else if _, ok := links[link]; !ok {
+			continue
+		}
+
+		procDir := filepath.Dir(filepath.Dir(fd))
+
+		var pid int
+		pid, err = strconv.Atoi(filepath.Base(procDir))
+		if err != nil {
+			return nil, fmt.Errorf("parsing pid: %w", err)
+		}
+
+		h = &PortHolder{PID: pid}
+
+		comm, cerr := os.ReadFile(filepath.Join(procDir, "comm"))
+		if cerr == nil {
+			h.Name = strings.TrimSpace(string(comm))
+		}
+
+		return h, nil
+	}
+
+	return nil, ErrNoPortHolder
+}
@@ -0,0 +1,60 @@
+package aghos
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProcNet(t *testing.T) {
+	const data = "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n" +
+		"   0: 3500007F:0035 00000000:0000 0A 00000000:00000000 00:00000000 00000000   101        0 1111 1 0000000000000000 100 0 0 10 0\n" +
+		"   1: 0100007F:0035 0100007F:C350 01 00000000:00000000 00:00000000 00000000   101        0 2222 1 0000000000000000 20 4 30 10 -1\n" +
+		"   2: 00000000:0050 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 3333 1 0000000000000000 100 0 0 10 0\n"
+
+	inodes, err := parseProcNet(strings.NewReader(data), 53, true)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"1111"}, inodes)
+
+	inodes, err = parseProcNet(strings.NewReader(data), 53, false)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"1111", "2222"}, inodes)
+}
+
+func TestParseLsofOutput(t *testing.T) {
+	h, err := parseLsofOutput(strings.NewReader("p123\ncmDNSResponder\nf12\np456\ncother\n"))
+	require.NoError(t, err)
+
+	assert.Equal(t, &PortHolder{Name: "mDNSResponder", PID: 123}, h)
+
+	_, err = parseLsofOutput(strings.NewReader(""))
+	assert.ErrorIs(t, err, ErrNoPortHolder)
+}
+
+func TestParseNetstatOutput(t *testing.T) {
+	const data = "\r\nActive Connections\r\n\r\n" +
+		"  Proto  Local Address          Foreign Address        State           PID\r\n" +
+		"  TCP    0.0.0.0:53             192.0.2.1:443          ESTABLISHED     111\r\n" +
+		"  TCP    0.0.0.0:53             0.0.0.0:0              LISTENING       222\r\n" +
+		"  UDP    [::]:53                *:*                                    333\r\n"
+
+	pid, err := parseNetstatOutput(strings.NewReader(data), "tcp", 53)
+	require.NoError(t, err)
+
+	assert.Equal(t, 222, pid)
+
+	pid, err = parseNetstatOutput(strings.NewReader(data), "udp", 53)
+	require.NoError(t, err)
+
+	assert.Equal(t, 333, pid)
+
+	_, err = parseNetstatOutput(strings.NewReader(data), "udp", 853)
+	assert.ErrorIs(t, err, ErrNoPortHolder)
+
+	assert.Equal(t, "dns.exe", parseTasklistOutput(`"dns.exe","222","Services","0","5,000 K"`+"\r\n"))
+	assert.Empty(t, parseTasklistOutput("INFO: No tasks are running.\r\n"))
+}
@@ -0,0 +1,31 @@
+//go:build darwin || freebsd || netbsd || openbsd || solaris
+// +build darwin freebsd netbsd openbsd solaris
+
+package aghos
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+func findPortHolder(network string, port int) (h *PortHolder, err error) {
+	args := []string{"-nP", fmt.Sprintf("-i%s:%d", strings.ToUpper(network), port), "-Fpc"}
+	if network == "tcp" {
+		args = append(args, "-sTCP:LISTEN")
+	}
+
+	// lsof exits with 1 if there are no such files, so only check the
+	// output.
+	out, err := exec.Command("lsof", args...).Output()
+	if len(out) == 0 {
+		if _, ok := err.(*exec.Error); ok {
+			return nil, fmt.Errorf("running lsof: %w", err)
+		}
+
+		return nil, ErrNoPortHolder
+	}
+
+	return parseLsofOutput(bytes.NewReader(out))
+}
@@ -0,0 +1,31 @@
+//go:build windows
+// +build windows
+
+package aghos
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+)
+
+func findPortHolder(network string, port int) (h *PortHolder, err error) {
+	out, err := exec.Command("netstat", "-ano").Output()
+	if err != nil {
+		return nil, fmt.Errorf("running netstat: %w", err)
+	}
+
+	pid, err := parseNetstatOutput(bytes.NewReader(out), network, port)
+	if err != nil {
+		return nil, err
+	}
+
+	h = &PortHolder{PID: pid}
+
+	_, name, err := RunCommand("tasklist", "/FI", fmt.Sprintf("PID eq %d", pid), "/FO", "CSV", "/NH")
+	if err == nil {
+		h.Name = parseTasklistOutput(name)
+	}
+
+	return h, nil
+}
@@ -109,6 +109,11 @@ func (u *TestUpstream) Address() string {
 	return u.Addr
 }
 
+// Close implements the upstream.Upstream interface for *TestUpstream.
+func (u *TestUpstream) Close() (err error) {
+	return nil
+}
+
 // TestBlockUpstream implements upstream.Upstream interface for replacing real
 // upstream in tests.
 type TestBlockUpstream struct {
@@ -164,6 +169,11 @@ func (u *TestBlockUpstream) RequestsCount() int {
 	return u.reqNum
 }
 
+// Close implements the upstream.Upstream interface for *TestBlockUpstream.
+func (u *TestBlockUpstream) Close() (err error) {
+	return nil
+}
+
 // TestErrUpstream implements upstream.Upstream interface for replacing real
 // upstream in tests.
 type TestErrUpstream struct {
@@ -180,3 +190,8 @@ func (u *TestErrUpstream) Exchange(*dns.Msg) (*dns.Msg, error) {
 func (u *TestErrUpstream) Address() string {
 	return ""
 }
+
+// Close implements the upstream.Upstream interface for *TestErrUpstream.
+func (u *TestErrUpstream) Close() (err error) {
+	return nil
+}
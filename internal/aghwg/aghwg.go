@@ -0,0 +1,34 @@
+// Package aghwg implements a userspace WireGuard endpoint, which only accepts
+// the DNS requests sent through the tunnel to the server's tunnel addresses.
+// The WireGuard protocol itself is implemented by wireguard-go, and the tunnel
+// is terminated in its userspace network stack, which only delivers the
+// packets destined to the tunnel addresses and never forwards any packets
+// anywhere else.  So the peers get filtered DNS without the server becoming a
+// VPN gateway.
+package aghwg
+
+import "net"
+
+// Handler processes the DNS request req sent through the tunnel from the
+// client, which is the tunnel address of the peer, and returns the response.
+// resp is nil if there is nothing to reply.
+type Handler func(req []byte, client *net.UDPAddr) (resp []byte, err error)
+
+// Config is the configuration of a WireGuard endpoint.
+type Config struct {
+	// Handler processes the DNS requests.  It must not be nil.
+	Handler Handler
+
+	// ListenAddr is the UDP address to listen on for the WireGuard packets.
+	ListenAddr *net.UDPAddr
+
+	// Addresses are the tunnel addresses of the DNS server.  The peers should
+	// use them as their DNS servers.
+	Addresses []net.IP
+
+	// Peers are the initial peers of the server.
+	Peers []*PeerConfig
+
+	// PrivateKey is the static private key of the server.
+	PrivateKey Key
+}
@@ -0,0 +1,147 @@
+//go:build !solaris
+// +build !solaris
+
+package aghwg
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+// newTestKey returns a new private key and fails the test on errors.
+func newTestKey(t *testing.T) (k Key) {
+	t.Helper()
+
+	k, err := NewPrivateKey()
+	require.NoError(t, err)
+
+	return k
+}
+
+// newTestPeer starts a WireGuard peer with the private key priv and the tunnel
+// address addr connected to the server s and returns its network stack.
+func newTestPeer(t *testing.T, s *Server, priv Key, addr netip.Addr) (tnet *netstack.Net) {
+	t.Helper()
+
+	tunDev, tnet, err := netstack.CreateNetTUN([]netip.Addr{addr}, nil, device.DefaultMTU)
+	require.NoError(t, err)
+
+	dev := device.NewDevice(tunDev, conn.NewDefaultBind(), device.NewLogger(device.LogLevelSilent, ""))
+	t.Cleanup(dev.Close)
+
+	srvAddr := s.LocalAddr().(*net.UDPAddr)
+	require.NoError(t, dev.IpcSet(fmt.Sprintf(
+		"private_key=%s\npublic_key=%s\nendpoint=%s\nallowed_ip=0.0.0.0/0\n",
+		priv.hex(),
+		s.PublicKey().hex(),
+		srvAddr,
+	)))
+	require.NoError(t, dev.Up())
+
+	return tnet
+}
+
+func TestServer(t *testing.T) {
+	serverPriv := newTestKey(t)
+	peerPriv := newTestKey(t)
+
+	serverIP, peerIP := netip.MustParseAddr("10.99.0.1"), netip.MustParseAddr("10.99.0.2")
+
+	clients := make(chan *net.UDPAddr, 1)
+	s, err := NewServer(&Config{
+		Handler: func(req []byte, client *net.UDPAddr) (resp []byte, err error) {
+			clients <- client
+
+			return append([]byte("re:"), req...), nil
+		},
+		ListenAddr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+		Addresses:  []net.IP{serverIP.AsSlice()},
+		Peers: []*PeerConfig{{
+			Name:       "phone",
+			AllowedIPs: []net.IP{peerIP.AsSlice()},
+			PublicKey:  peerPriv.PublicKey(),
+		}},
+		PrivateKey: serverPriv,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, s.Start())
+	testutil.CleanupAndRequireSuccess(t, s.Close)
+
+	tnet := newTestPeer(t, s, peerPriv, peerIP)
+
+	exchange := func(t *testing.T, port uint16, timeout time.Duration) (resp []byte, err error) {
+		t.Helper()
+
+		c, err := tnet.DialUDPAddrPort(netip.AddrPort{}, netip.AddrPortFrom(serverIP, port))
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, c.Close)
+
+		_, err = c.Write([]byte("query"))
+		require.NoError(t, err)
+
+		require.NoError(t, c.SetReadDeadline(time.Now().Add(timeout)))
+
+		buf := make([]byte, maxPacketLen)
+		n, err := c.Read(buf)
+
+		return buf[:n], err
+	}
+
+	resp, err := exchange(t, dnsPort, 5*time.Second)
+	require.NoError(t, err)
+
+	assert.Equal(t, []byte("re:query"), resp)
+	gotClient := <-clients
+	assert.True(t, net.IP(peerIP.AsSlice()).Equal(gotClient.IP))
+
+	sts := s.Peers()
+	require.Len(t, sts, 1)
+
+	assert.Equal(t, "phone", sts[0].Name)
+	assert.NotZero(t, sts[0].RxBytes)
+	assert.NotZero(t, sts[0].TxBytes)
+	assert.False(t, sts[0].LastHandshake.IsZero())
+	require.NotNil(t, sts[0].Endpoint)
+	assert.True(t, sts[0].Endpoint.IP.IsLoopback())
+
+	t.Run("other_port", func(t *testing.T) {
+		_, err = exchange(t, dnsPort+1, 100*time.Millisecond)
+		assert.Error(t, err)
+	})
+
+	t.Run("removed_peer", func(t *testing.T) {
+		require.True(t, s.RemovePeer(peerPriv.PublicKey()))
+		assert.Empty(t, s.Peers())
+
+		_, err = exchange(t, dnsPort, 100*time.Millisecond)
+		assert.Error(t, err)
+	})
+}
+
+func TestPeerConfig_ipcConfig(t *testing.T) {
+	var pub, psk Key
+	pub[0], psk[0] = 1, 2
+
+	conf := &PeerConfig{
+		AllowedIPs:   []net.IP{net.IPv4(10, 99, 0, 2), net.ParseIP("fd00::2")},
+		PublicKey:    pub,
+		PresharedKey: psk,
+	}
+
+	assert.Equal(t, "public_key="+pub.hex()+"\n"+
+		"preshared_key="+psk.hex()+"\n"+
+		"replace_allowed_ips=true\n"+
+		"allowed_ip=10.99.0.2/32\n"+
+		"allowed_ip=fd00::2/128\n", conf.ipcConfig())
+}
@@ -0,0 +1,133 @@
+//go:build !solaris
+// +build !solaris
+
+package aghwg
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// hostBind is a conn.Bind listening on a single host, which the default bind
+// of wireguard-go doesn't support.
+type hostBind struct {
+	// mu protects udp.
+	mu *sync.Mutex
+
+	// udp is the listening connection.  It's nil if the bind is closed.
+	udp *net.UDPConn
+
+	// host is the address to listen on.
+	host net.IP
+}
+
+// type check
+var _ conn.Bind = (*hostBind)(nil)
+
+// newHostBind returns a new bind listening on host.
+func newHostBind(host net.IP) (b *hostBind) {
+	return &hostBind{
+		mu:   &sync.Mutex{},
+		host: host,
+	}
+}
+
+// Open implements the conn.Bind interface for *hostBind.
+func (b *hostBind) Open(port uint16) (fns []conn.ReceiveFunc, actual uint16, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.udp != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: b.host, Port: int(port)})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	b.udp = udp
+
+	return []conn.ReceiveFunc{receiveFunc(udp)}, uint16(udp.LocalAddr().(*net.UDPAddr).Port), nil
+}
+
+// receiveFunc returns a function receiving a single packet from udp at a
+// time.
+func receiveFunc(udp *net.UDPConn) (f conn.ReceiveFunc) {
+	return func(packets [][]byte, sizes []int, eps []conn.Endpoint) (n int, err error) {
+		sz, addr, err := udp.ReadFromUDPAddrPort(packets[0])
+		if err != nil {
+			return 0, err
+		}
+
+		sizes[0] = sz
+		eps[0] = &conn.StdNetEndpoint{
+			AddrPort: netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port()),
+		}
+
+		return 1, nil
+	}
+}
+
+// Close implements the conn.Bind interface for *hostBind.
+func (b *hostBind) Close() (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.udp == nil {
+		return nil
+	}
+
+	err = b.udp.Close()
+	b.udp = nil
+
+	return err
+}
+
+// SetMark implements the conn.Bind interface for *hostBind.
+func (b *hostBind) SetMark(_ uint32) (err error) {
+	return nil
+}
+
+// Send implements the conn.Bind interface for *hostBind.
+func (b *hostBind) Send(bufs [][]byte, ep conn.Endpoint) (err error) {
+	se, ok := ep.(*conn.StdNetEndpoint)
+	if !ok {
+		return conn.ErrWrongEndpointType
+	}
+
+	b.mu.Lock()
+	udp := b.udp
+	b.mu.Unlock()
+
+	if udp == nil {
+		return net.ErrClosed
+	}
+
+	for _, buf := range bufs {
+		_, err = udp.WriteToUDPAddrPort(buf, se.AddrPort)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ParseEndpoint implements the conn.Bind interface for *hostBind.
+func (b *hostBind) ParseEndpoint(s string) (ep conn.Endpoint, err error) {
+	addr, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &conn.StdNetEndpoint{AddrPort: addr}, nil
+}
+
+// BatchSize implements the conn.Bind interface for *hostBind.
+func (b *hostBind) BatchSize() (n int) {
+	return 1
+}
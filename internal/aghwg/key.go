@@ -0,0 +1,85 @@
+package aghwg
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// KeyLen is the length of the WireGuard keys.
+const KeyLen = 32
+
+// Key is a Curve25519 private or public key, or a preshared key.
+type Key [KeyLen]byte
+
+// ParseKey parses the base64-encoded key in the format used by the wg tool.
+func ParseKey(s string) (k Key, err error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return k, fmt.Errorf("decoding key: %w", err)
+	} else if len(b) != KeyLen {
+		return k, fmt.Errorf("bad key length %d, want %d", len(b), KeyLen)
+	}
+
+	copy(k[:], b)
+
+	return k, nil
+}
+
+// parseHexKey parses the hex-encoded key in the format used by the
+// configuration protocol of the WireGuard device.
+func parseHexKey(s string) (k Key, err error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return k, fmt.Errorf("decoding key: %w", err)
+	} else if len(b) != KeyLen {
+		return k, fmt.Errorf("bad key length %d, want %d", len(b), KeyLen)
+	}
+
+	copy(k[:], b)
+
+	return k, nil
+}
+
+// NewPrivateKey generates a new private key.
+func NewPrivateKey() (k Key, err error) {
+	_, err = rand.Read(k[:])
+	if err != nil {
+		return k, fmt.Errorf("generating key: %w", err)
+	}
+
+	// Clamp the key the way wg genkey does.
+	k[0] &= 248
+	k[31] = (k[31] & 127) | 64
+
+	return k, nil
+}
+
+// String implements the fmt.Stringer interface for Key.
+func (k Key) String() (s string) {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// hex returns the hex encoding of k used by the configuration protocol of the
+// WireGuard device.
+func (k Key) hex() (s string) {
+	return hex.EncodeToString(k[:])
+}
+
+// IsZero returns true if k is all zeroes.
+func (k Key) IsZero() (ok bool) {
+	var zero Key
+
+	return subtle.ConstantTimeCompare(k[:], zero[:]) == 1
+}
+
+// PublicKey returns the public key of the private key k.
+func (k Key) PublicKey() (pub Key) {
+	curve25519.ScalarBaseMult((*[KeyLen]byte)(&pub), (*[KeyLen]byte)(&k))
+
+	return pub
+}
@@ -0,0 +1,156 @@
+package aghwg
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PeerConfig is the configuration of a WireGuard peer.
+type PeerConfig struct {
+	// Name is the human-readable name of the peer.
+	Name string
+
+	// AllowedIPs are the tunnel addresses of the peer.  Only the packets with
+	// one of these source addresses are accepted from the peer.
+	AllowedIPs []net.IP
+
+	// PublicKey is the static public key of the peer.
+	PublicKey Key
+
+	// PresharedKey is the optional symmetric key mixed into the handshake.
+	PresharedKey Key
+}
+
+// validate returns an error if conf is invalid.
+func (conf *PeerConfig) validate() (err error) {
+	if conf.PublicKey.IsZero() {
+		return fmt.Errorf("peer %q: no public key", conf.Name)
+	}
+
+	for _, ip := range conf.AllowedIPs {
+		if ip.To16() == nil {
+			return fmt.Errorf("peer %q: bad allowed ip %q", conf.Name, ip)
+		}
+	}
+
+	return nil
+}
+
+// ipcConfig returns the configuration of the peer in the format of the
+// configuration protocol of the WireGuard device.  The allowed IPs of the
+// existing peer with the same public key are replaced, and a zero preshared
+// key disables it.  See https://www.wireguard.com/xplatform.
+func (conf *PeerConfig) ipcConfig() (s string) {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "public_key=%s\n", conf.PublicKey.hex())
+	fmt.Fprintf(b, "preshared_key=%s\n", conf.PresharedKey.hex())
+	b.WriteString("replace_allowed_ips=true\n")
+	for _, ip := range conf.AllowedIPs {
+		bits := net.IPv6len * 8
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, net.IPv4len*8
+		}
+
+		fmt.Fprintf(b, "allowed_ip=%s/%d\n", ip, bits)
+	}
+
+	return b.String()
+}
+
+// PeerStatus is the current state of a WireGuard peer.
+type PeerStatus struct {
+	// LastHandshake is the time of the last successful handshake.  It's zero
+	// if there was none.
+	LastHandshake time.Time
+
+	// Endpoint is the last known address of the peer.  It's nil if the peer
+	// has never connected.
+	Endpoint *net.UDPAddr
+
+	PeerConfig
+
+	// RxBytes is the number of bytes received from the peer.
+	RxBytes uint64
+
+	// TxBytes is the number of bytes sent to the peer.
+	TxBytes uint64
+}
+
+// parsePeerStatuses parses the statuses of the peers from the state of the
+// WireGuard device in the format of the configuration protocol.  The
+// statuses only contain the public keys and the dynamic state of the peers.
+func parsePeerStatuses(state string) (sts map[Key]*PeerStatus, err error) {
+	sts = map[Key]*PeerStatus{}
+
+	var st *PeerStatus
+	var hsSec, hsNsec int64
+	flush := func() {
+		if st != nil && (hsSec != 0 || hsNsec != 0) {
+			st.LastHandshake = time.Unix(hsSec, hsNsec)
+		}
+
+		hsSec, hsNsec = 0, 0
+	}
+
+	s := bufio.NewScanner(strings.NewReader(state))
+	for s.Scan() {
+		kv := strings.SplitN(s.Text(), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		key, val := kv[0], kv[1]
+		if key == "public_key" {
+			flush()
+
+			var pub Key
+			pub, err = parseHexKey(val)
+			if err != nil {
+				return nil, fmt.Errorf("public key: %w", err)
+			}
+
+			st = &PeerStatus{PeerConfig: PeerConfig{PublicKey: pub}}
+			sts[pub] = st
+
+			continue
+		} else if st == nil {
+			// Interface settings.
+			continue
+		}
+
+		err = st.setField(key, val, &hsSec, &hsNsec)
+		if err != nil {
+			return nil, fmt.Errorf("peer %s: %s: %w", st.PublicKey, key, err)
+		}
+	}
+
+	flush()
+
+	return sts, s.Err()
+}
+
+// setField sets the field of st by its key in the configuration protocol.
+// The handshake time is accumulated in hsSec and hsNsec.  Unknown keys are
+// ignored.
+func (st *PeerStatus) setField(key, val string, hsSec, hsNsec *int64) (err error) {
+	switch key {
+	case "endpoint":
+		st.Endpoint, err = net.ResolveUDPAddr("udp", val)
+	case "last_handshake_time_sec":
+		*hsSec, err = strconv.ParseInt(val, 10, 64)
+	case "last_handshake_time_nsec":
+		*hsNsec, err = strconv.ParseInt(val, 10, 64)
+	case "rx_bytes":
+		st.RxBytes, err = strconv.ParseUint(val, 10, 64)
+	case "tx_bytes":
+		st.TxBytes, err = strconv.ParseUint(val, 10, 64)
+	default:
+		// Go on.
+	}
+
+	return err
+}
@@ -0,0 +1,345 @@
+//go:build !solaris
+// +build !solaris
+
+package aghwg
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+// dnsPort is the only tunneled port the server accepts the packets on.
+const dnsPort = 53
+
+// maxPacketLen is the maximum length of an incoming UDP datagram.
+const maxPacketLen = 1<<16 - 1
+
+// Server is a WireGuard endpoint serving the DNS requests.
+type Server struct {
+	conf *Config
+
+	// mu protects peers, dev, bind, and conns.
+	mu *sync.Mutex
+
+	// peers are the configurations of the known peers by their static public
+	// keys.
+	peers map[Key]*PeerConfig
+
+	// dev is the WireGuard device.  It's nil if the server isn't started.
+	dev *device.Device
+
+	// bind is the connection of dev to the network.
+	bind *hostBind
+
+	// conns are the DNS listeners on each of the tunnel addresses.
+	conns []net.PacketConn
+
+	// addrs are the tunnel addresses of the server.
+	addrs []netip.Addr
+
+	// publicKey is the static public key of the server.
+	publicKey Key
+}
+
+// NewServer returns a new properly initialized WireGuard endpoint.
+func NewServer(conf *Config) (s *Server, err error) {
+	if conf.Handler == nil {
+		return nil, errors.Error("no handler")
+	} else if conf.PrivateKey.IsZero() {
+		return nil, errors.Error("no private key")
+	} else if len(conf.Addresses) == 0 {
+		return nil, errors.Error("no tunnel addresses")
+	}
+
+	s = &Server{
+		conf:      conf,
+		mu:        &sync.Mutex{},
+		peers:     map[Key]*PeerConfig{},
+		addrs:     make([]netip.Addr, 0, len(conf.Addresses)),
+		publicKey: conf.PrivateKey.PublicKey(),
+	}
+
+	for _, ip := range conf.Addresses {
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			return nil, fmt.Errorf("bad tunnel address %q", ip)
+		}
+
+		s.addrs = append(s.addrs, addr.Unmap())
+	}
+
+	for _, pc := range conf.Peers {
+		err = s.AddPeer(pc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// PublicKey returns the static public key of the server.
+func (s *Server) PublicKey() (pub Key) {
+	return s.publicKey
+}
+
+// Start starts listening for the WireGuard packets.
+func (s *Server) Start() (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dev != nil {
+		return errors.Error("already started")
+	}
+
+	tunDev, tnet, err := netstack.CreateNetTUN(s.addrs, nil, device.DefaultMTU)
+	if err != nil {
+		return fmt.Errorf("creating tun: %w", err)
+	}
+
+	var host net.IP
+	var port int
+	if la := s.conf.ListenAddr; la != nil {
+		host, port = la.IP, la.Port
+	}
+
+	bind := newHostBind(host)
+	dev := device.NewDevice(tunDev, bind, &device.Logger{
+		Verbosef: func(format string, args ...interface{}) {
+			log.Debug("wireguard: "+format, args...)
+		},
+		Errorf: func(format string, args ...interface{}) {
+			log.Error("wireguard: "+format, args...)
+		},
+	})
+
+	cfg := &strings.Builder{}
+	fmt.Fprintf(cfg, "private_key=%s\nlisten_port=%d\n", s.conf.PrivateKey.hex(), port)
+	for _, pc := range s.peers {
+		cfg.WriteString(pc.ipcConfig())
+	}
+
+	err = dev.IpcSet(cfg.String())
+	if err != nil {
+		dev.Close()
+
+		return fmt.Errorf("configuring device: %w", err)
+	}
+
+	err = dev.Up()
+	if err != nil {
+		dev.Close()
+
+		return fmt.Errorf("starting device: %w", err)
+	}
+
+	conns := make([]net.PacketConn, 0, len(s.addrs))
+	for _, addr := range s.addrs {
+		var c net.PacketConn
+		c, err = tnet.ListenUDPAddrPort(netip.AddrPortFrom(addr, dnsPort))
+		if err != nil {
+			closeAll(dev, conns)
+
+			return fmt.Errorf("listening on %s: %w", addr, err)
+		}
+
+		conns = append(conns, c)
+	}
+
+	s.dev, s.bind, s.conns = dev, bind, conns
+
+	log.Info("wireguard: listening on %s", s.localAddr())
+
+	for _, c := range conns {
+		go s.serve(c)
+	}
+
+	return nil
+}
+
+// closeAll closes dev and conns.
+func closeAll(dev *device.Device, conns []net.PacketConn) {
+	for _, c := range conns {
+		_ = c.Close()
+	}
+
+	dev.Close()
+}
+
+// LocalAddr returns the address the server listens on.  It's nil if the
+// server isn't started.
+func (s *Server) LocalAddr() (addr net.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.localAddr()
+}
+
+// localAddr returns the address the server listens on.  s.mu is expected to be
+// locked.
+func (s *Server) localAddr() (addr net.Addr) {
+	if s.bind == nil {
+		return nil
+	}
+
+	s.bind.mu.Lock()
+	defer s.bind.mu.Unlock()
+
+	if s.bind.udp == nil {
+		return nil
+	}
+
+	return s.bind.udp.LocalAddr()
+}
+
+// Close stops the server and forgets all the sessions.
+func (s *Server) Close() (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dev == nil {
+		return nil
+	}
+
+	closeAll(s.dev, s.conns)
+	s.dev, s.bind, s.conns = nil, nil, nil
+
+	return nil
+}
+
+// AddPeer adds a new peer or replaces the one with the same public key.
+func (s *Server) AddPeer(conf *PeerConfig) (err error) {
+	err = conf.validate()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dev != nil {
+		err = s.dev.IpcSet(conf.ipcConfig())
+		if err != nil {
+			return fmt.Errorf("peer %q: configuring device: %w", conf.Name, err)
+		}
+	}
+
+	s.peers[conf.PublicKey] = conf
+
+	return nil
+}
+
+// RemovePeer removes the peer with the public key pub and all its sessions.
+// ok is false if there is no such peer.
+func (s *Server) RemovePeer(pub Key) (ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok = s.peers[pub]; !ok {
+		return false
+	}
+
+	delete(s.peers, pub)
+	if s.dev != nil {
+		err := s.dev.IpcSet(fmt.Sprintf("public_key=%s\nremove=true\n", pub.hex()))
+		if err != nil {
+			log.Error("wireguard: removing peer %s: %s", pub, err)
+		}
+	}
+
+	return true
+}
+
+// Peers returns the statuses of all the peers.
+func (s *Server) Peers() (sts []*PeerStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var devSts map[Key]*PeerStatus
+	if s.dev != nil {
+		state, err := s.dev.IpcGet()
+		if err == nil {
+			devSts, err = parsePeerStatuses(state)
+		}
+
+		if err != nil {
+			log.Error("wireguard: getting peer statuses: %s", err)
+		}
+	}
+
+	sts = make([]*PeerStatus, 0, len(s.peers))
+	for pub, pc := range s.peers {
+		st, ok := devSts[pub]
+		if !ok {
+			st = &PeerStatus{}
+		}
+
+		st.PeerConfig = *pc
+		sts = append(sts, st)
+	}
+
+	return sts
+}
+
+// serve reads the DNS requests from conn until it's closed.
+func (s *Server) serve(conn net.PacketConn) {
+	defer aghos.OnPanicAndExit("wireguard: serving")
+
+	buf := make([]byte, maxPacketLen)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			// The listeners of the userspace network stack return io.EOF
+			// when closed.
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			log.Debug("wireguard: reading: %s", err)
+
+			continue
+		}
+
+		client, ok := addr.(*net.UDPAddr)
+		if !ok {
+			log.Debug("wireguard: unexpected client address %T(%[1]s)", addr)
+
+			continue
+		}
+
+		req := make([]byte, n)
+		copy(req, buf[:n])
+
+		go s.handleDNS(conn, req, client)
+	}
+}
+
+// handleDNS passes the DNS request req to the handler and sends the response
+// back to client.
+func (s *Server) handleDNS(conn net.PacketConn, req []byte, client *net.UDPAddr) {
+	defer log.OnPanic("wireguard: handling dns")
+
+	resp, err := s.conf.Handler(req, client)
+	if err != nil {
+		log.Debug("wireguard: handling request from %s: %s", client, err)
+
+		return
+	} else if resp == nil {
+		return
+	}
+
+	_, err = conn.WriteTo(resp, client)
+	if err != nil {
+		log.Debug("wireguard: sending response to %s: %s", client, err)
+	}
+}
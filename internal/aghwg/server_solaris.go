@@ -0,0 +1,29 @@
+//go:build solaris
+// +build solaris
+
+package aghwg
+
+// wireguard-go doesn't build on Solaris, so the endpoint is unsupported there.
+
+import (
+	"net"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+)
+
+// Server is a stub of the WireGuard endpoint.
+type Server struct{}
+
+// NewServer always returns an error, since the WireGuard endpoint isn't
+// supported on Solaris.
+func NewServer(_ *Config) (s *Server, err error) {
+	return nil, aghos.Unsupported("wireguard")
+}
+
+func (s *Server) PublicKey() (pub Key)              { return Key{} }
+func (s *Server) Start() (err error)                { return aghos.Unsupported("wireguard") }
+func (s *Server) LocalAddr() (addr net.Addr)        { return nil }
+func (s *Server) Close() (err error)                { return nil }
+func (s *Server) AddPeer(_ *PeerConfig) (err error) { return aghos.Unsupported("wireguard") }
+func (s *Server) RemovePeer(_ Key) (ok bool)        { return false }
+func (s *Server) Peers() (sts []*PeerStatus)        { return nil }
@@ -1,5 +1,5 @@
-//go:build aix || darwin || dragonfly || linux || netbsd || solaris
-// +build aix darwin dragonfly linux netbsd solaris
+//go:build aix || darwin || dragonfly || linux || netbsd
+// +build aix darwin dragonfly linux netbsd
 
 package dhcpd
 
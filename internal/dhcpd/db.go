@@ -171,6 +171,12 @@ func (s *Server) dbStore() (err error) {
 		}
 	}
 
+	err = s.updateHistory()
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
 	var data []byte
 	data, err = json.Marshal(leases)
 	if err != nil {
@@ -186,3 +192,24 @@ func (s *Server) dbStore() (err error) {
 
 	return nil
 }
+
+// updateHistory records the current leases into the lease history.  Just like
+// dbStore, it uses the leases without locking.
+func (s *Server) updateHistory() (err error) {
+	if s.history == nil {
+		return nil
+	}
+
+	var leases []*Lease
+	leases = append(leases, s.srv4.getLeasesRef()...)
+	if s.srv6 != nil {
+		leases = append(leases, s.srv6.getLeasesRef()...)
+	}
+
+	err = s.history.update(leases, time.Now())
+	if err != nil {
+		return fmt.Errorf("updating lease history: %w", err)
+	}
+
+	return nil
+}
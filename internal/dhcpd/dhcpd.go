@@ -8,10 +8,10 @@ import (
 	"net/http"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"time"
 
 	"github.com/AdguardTeam/golibs/log"
-	"github.com/AdguardTeam/golibs/netutil"
 )
 
 const (
@@ -45,8 +45,8 @@ func (l *Lease) Clone() (clone *Lease) {
 	return &Lease{
 		Expiry:   l.Expiry,
 		Hostname: l.Hostname,
-		HWAddr:   netutil.CloneMAC(l.HWAddr),
-		IP:       netutil.CloneIP(l.IP),
+		HWAddr:   slices.Clone(l.HWAddr),
+		IP:       slices.Clone(l.IP),
 	}
 }
 
@@ -128,6 +128,9 @@ type ServerConfig struct {
 	Conf4 V4ServerConf `yaml:"dhcpv4"`
 	Conf6 V6ServerConf `yaml:"dhcpv6"`
 
+	// History is the configuration of the history of the lease assignments.
+	History LeaseHistoryConfig `yaml:"lease_history"`
+
 	WorkDir    string `yaml:"-"`
 	DBFilePath string `yaml:"-"` // path to DB file
 
@@ -158,6 +161,10 @@ type Server struct {
 
 	conf ServerConfig
 
+	// history is the history of the lease assignments.  It's nil if the
+	// history is disabled.
+	history *leaseHistory
+
 	// Called when the leases DB is modified
 	onLeaseChanged []OnLeaseChangedT
 }
@@ -170,6 +177,11 @@ const (
 	LeasesDynamic GetLeasesFlags = 0b0001
 	LeasesStatic  GetLeasesFlags = 0b0010
 
+	// LeasesBlocklisted means the currently blocklisted leases, that is the
+	// addresses the conflict detector has found to be used by other hosts.
+	// It isn't included into LeasesAll.
+	LeasesBlocklisted GetLeasesFlags = 0b0100
+
 	LeasesAll = LeasesDynamic | LeasesStatic
 )
 
@@ -178,6 +190,7 @@ type ServerInterface interface {
 	Enabled() (ok bool)
 	Leases(flags GetLeasesFlags) (leases []*Lease)
 	SetOnLeaseChanged(onLeaseChanged OnLeaseChangedT)
+	Subnets() (nets []*net.IPNet)
 }
 
 // Create - create object
@@ -189,6 +202,12 @@ func Create(conf ServerConfig) (s *Server, err error) {
 	s.conf.HTTPRegister = conf.HTTPRegister
 	s.conf.ConfigModified = conf.ConfigModified
 	s.conf.DBFilePath = filepath.Join(conf.WorkDir, dbFilename)
+	s.conf.History = conf.History
+
+	s.history, err = newLeaseHistory(&conf.History, filepath.Join(conf.WorkDir, historyFilename))
+	if err != nil {
+		return nil, fmt.Errorf("lease history: %w", err)
+	}
 
 	if !webHandlersRegistered && s.conf.HTTPRegister != nil {
 		if runtime.GOOS == "windows" {
@@ -223,7 +242,7 @@ func Create(conf ServerConfig) (s *Server, err error) {
 
 	v6conf := conf.Conf6
 	v6conf.Enabled = s.conf.Enabled
-	if len(v6conf.RangeStart) == 0 {
+	if len(v6conf.RangeStart) == 0 && !v6conf.RADNSOnly {
 		v6conf.Enabled = false
 	}
 	v6conf.InterfaceName = s.conf.InterfaceName
@@ -305,6 +324,7 @@ func (s *Server) notify(flags int) {
 func (s *Server) WriteDiskConfig(c *ServerConfig) {
 	c.Enabled = s.conf.Enabled
 	c.InterfaceName = s.conf.InterfaceName
+	c.History = s.conf.History
 	s.srv4.WriteDiskConfig4(&c.Conf4)
 	s.srv6.WriteDiskConfig6(&c.Conf6)
 }
@@ -345,6 +365,32 @@ func (s *Server) Leases(flags GetLeasesFlags) (leases []*Lease) {
 	return append(s.srv4.GetLeases(flags), s.srv6.GetLeases(flags)...)
 }
 
+// Subnets returns the networks served by the enabled DHCPv4 and DHCPv6
+// servers.  The network of the DHCPv6 server is the one containing its range,
+// which ends with the 0xff byte.
+func (s *Server) Subnets() (nets []*net.IPNet) {
+	conf4 := &V4ServerConf{}
+	s.srv4.WriteDiskConfig4(conf4)
+	if conf4.Enabled && conf4.subnet != nil {
+		nets = append(nets, &net.IPNet{
+			IP:   conf4.subnet.IP.Mask(conf4.subnet.Mask),
+			Mask: conf4.subnet.Mask,
+		})
+	}
+
+	conf6 := &V6ServerConf{}
+	s.srv6.WriteDiskConfig6(conf6)
+	if conf6.Enabled && !conf6.RADNSOnly && conf6.RangeStart != nil {
+		mask := net.CIDRMask(120, net.IPv6len*8)
+		nets = append(nets, &net.IPNet{
+			IP:   conf6.RangeStart.Mask(mask),
+			Mask: mask,
+		})
+	}
+
+	return nets
+}
+
 // FindMACbyIP - find a MAC address by IP address in the currently active DHCP leases
 func (s *Server) FindMACbyIP(ip net.IP) net.HardwareAddr {
 	if ip.To4() != nil {
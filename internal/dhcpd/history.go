@@ -0,0 +1,271 @@
+package dhcpd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/google/renameio/maybe"
+)
+
+// historyFilename is the name of the file with the history of the lease
+// assignments within the working directory.
+const historyFilename = "leases_history.db"
+
+// defaultHistoryRetention is the default retention of the finished lease
+// assignments.
+const defaultHistoryRetention = 90 * timeutil.Day
+
+// LeaseHistoryConfig is the configuration of the history of the lease
+// assignments.
+type LeaseHistoryConfig struct {
+	// Retention is the time, for which the finished assignments are kept.  If
+	// it's zero, 90 days are used.
+	Retention timeutil.Duration `yaml:"retention"`
+
+	// Enabled defines if the history is kept.
+	Enabled bool `yaml:"enabled"`
+}
+
+// LeaseRecord is an assignment of an IP address to a client.
+type LeaseRecord struct {
+	// Start is the time the address was first seen assigned to the client.
+	Start time.Time `json:"start"`
+
+	// End is the time the assignment has ended.  For the active dynamic
+	// leases it's their current expiration time, and for the active static
+	// ones it's the last time they were seen.
+	End time.Time `json:"end"`
+
+	// Hostname is the last known hostname of the client.
+	Hostname string `json:"hostname"`
+
+	// MAC is the hardware address of the client.
+	MAC string `json:"mac"`
+
+	// IP is the assigned address.
+	IP net.IP `json:"ip"`
+
+	// Static is true if the lease is static.
+	Static bool `json:"static"`
+
+	// Active is true if the assignment is still in effect.
+	Active bool `json:"active"`
+}
+
+// overlaps returns true if the assignment was in effect at any moment between
+// from and to.  Zero to means no upper bound.  Only the active static
+// assignments are open-ended, since the active dynamic ones end at the
+// expiration of their leases.
+func (r *LeaseRecord) overlaps(from, to time.Time) (ok bool) {
+	if !to.IsZero() && r.Start.After(to) {
+		return false
+	}
+
+	return (r.Static && r.Active) || !r.End.Before(from)
+}
+
+// finish marks the assignment as ended at now, unless the dynamic lease has
+// already expired earlier.
+func (r *LeaseRecord) finish(now time.Time) {
+	r.Active = false
+	if r.Static || r.End.After(now) {
+		r.End = now
+	}
+}
+
+// leaseHistory is the history of the lease assignments.
+type leaseHistory struct {
+	// mu protects records.
+	mu *sync.Mutex
+
+	// records are the assignments, oldest first.
+	records []*LeaseRecord
+
+	// path is the path to the file, in which the records are stored.
+	path string
+
+	// retention is the time, for which the finished assignments are kept.
+	retention time.Duration
+}
+
+// newLeaseHistory returns a new lease history stored in the file at path and
+// loads the records from it.  h is nil if the history is disabled.
+func newLeaseHistory(c *LeaseHistoryConfig, path string) (h *leaseHistory, err error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+
+	h = &leaseHistory{
+		mu:        &sync.Mutex{},
+		path:      path,
+		retention: c.Retention.Duration,
+	}
+
+	if h.retention < 0 {
+		return nil, fmt.Errorf("negative retention %s", c.Retention)
+	} else if h.retention == 0 {
+		h.retention = defaultHistoryRetention
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return h, nil
+		}
+
+		return nil, fmt.Errorf("reading history: %w", err)
+	}
+
+	err = json.Unmarshal(data, &h.records)
+	if err != nil {
+		return nil, fmt.Errorf("decoding history: %w", err)
+	}
+
+	log.Debug("dhcp: loaded %d lease history records", len(h.records))
+
+	return h, nil
+}
+
+// update records the changes between the current leases and the active
+// assignments, removes the records older than the retention, and stores the
+// history if anything has changed.  h may be nil.
+func (h *leaseHistory) update(leases []*Lease, now time.Time) (err error) {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	active := map[string]*LeaseRecord{}
+	for _, r := range h.records {
+		if r.Active {
+			active[r.IP.String()] = r
+		}
+	}
+
+	changed := false
+	seen := map[string]struct{}{}
+	for _, l := range leases {
+		static := l.IsStatic()
+		if l.IsBlocklisted() || l.Expiry.Unix() == 0 || (!static && !l.Expiry.After(now)) {
+			continue
+		}
+
+		key := l.IP.String()
+		seen[key] = struct{}{}
+
+		end := l.Expiry
+		if static {
+			end = now
+		}
+
+		r := active[key]
+		if r != nil && r.MAC == l.HWAddr.String() && r.Static == static {
+			// Don't store the history only because a static lease has been
+			// seen again.
+			changed = changed || (!static && !r.End.Equal(end)) || r.Hostname != l.Hostname
+			r.End, r.Hostname = end, l.Hostname
+
+			continue
+		} else if r != nil {
+			r.finish(now)
+		}
+
+		r = &LeaseRecord{
+			Start:    now,
+			End:      end,
+			Hostname: l.Hostname,
+			MAC:      l.HWAddr.String(),
+			IP:       slices.Clone(l.IP),
+			Static:   static,
+			Active:   true,
+		}
+		h.records = append(h.records, r)
+		active[key] = r
+		changed = true
+	}
+
+	for key, r := range active {
+		if _, ok := seen[key]; !ok {
+			r.finish(now)
+			changed = true
+		}
+	}
+
+	changed = h.prune(now) || changed
+	if !changed {
+		return nil
+	}
+
+	return h.store()
+}
+
+// prune removes the finished assignments older than the retention.  h.mu is
+// expected to be locked.
+func (h *leaseHistory) prune(now time.Time) (changed bool) {
+	cutoff := now.Add(-h.retention)
+
+	records := h.records[:0]
+	for _, r := range h.records {
+		if r.Active || !r.End.Before(cutoff) {
+			records = append(records, r)
+		}
+	}
+
+	changed = len(records) != len(h.records)
+	for i := len(records); i < len(h.records); i++ {
+		h.records[i] = nil
+	}
+
+	h.records = records
+
+	return changed
+}
+
+// store writes the records into the file.  h.mu is expected to be locked.
+func (h *leaseHistory) store() (err error) {
+	records := h.records
+	if records == nil {
+		// Don't write "null" into the file.
+		records = []*LeaseRecord{}
+	}
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		return fmt.Errorf("encoding history: %w", err)
+	}
+
+	err = maybe.WriteFile(h.path, data, 0o644)
+	if err != nil {
+		return fmt.Errorf("writing history: %w", err)
+	}
+
+	return nil
+}
+
+// find returns the copies of the assignments of ip, which were in effect at any
+// moment between from and to.  Nil ip means any address, and zero to means no
+// upper bound.
+func (h *leaseHistory) find(ip net.IP, from, to time.Time) (records []*LeaseRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	records = []*LeaseRecord{}
+	for _, r := range h.records {
+		if (ip == nil || r.IP.Equal(ip)) && r.overlaps(from, to) {
+			rc := *r
+			records = append(records, &rc)
+		}
+	}
+
+	return records
+}
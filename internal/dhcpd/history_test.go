@@ -0,0 +1,166 @@
+package dhcpd
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeaseHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), historyFilename)
+	conf := &LeaseHistoryConfig{
+		Retention: timeutil.Duration{Duration: timeutil.Day},
+		Enabled:   true,
+	}
+
+	h, err := newLeaseHistory(conf, path)
+	require.NoError(t, err)
+	require.NotNil(t, h)
+
+	ip := net.IP{192, 168, 10, 100}
+	mac1 := net.HardwareAddr{0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA}
+	mac2 := net.HardwareAddr{0xBB, 0xBB, 0xBB, 0xBB, 0xBB, 0xBB}
+
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	t1 := start.Add(time.Hour)
+	t2 := start.Add(2 * time.Hour)
+
+	err = h.update([]*Lease{{
+		Expiry:   start.Add(timeutil.Day),
+		Hostname: "first",
+		HWAddr:   mac1,
+		IP:       ip,
+	}}, start)
+	require.NoError(t, err)
+
+	// The address is given to another client.
+	err = h.update([]*Lease{{
+		Expiry:   t1.Add(timeutil.Day),
+		Hostname: "second",
+		HWAddr:   mac2,
+		IP:       ip,
+	}}, t1)
+	require.NoError(t, err)
+
+	// The lease of the second client is released.
+	err = h.update(nil, t2)
+	require.NoError(t, err)
+
+	hostsAt := func(h *leaseHistory, from, to time.Time) (hosts []string) {
+		for _, r := range h.find(ip, from, to) {
+			hosts = append(hosts, r.Hostname)
+		}
+
+		return hosts
+	}
+
+	assert.Equal(t, []string{"first"}, hostsAt(h, start.Add(time.Minute), start.Add(time.Minute)))
+	assert.Equal(t, []string{"second"}, hostsAt(h, t2.Add(-time.Minute), t2.Add(-time.Minute)))
+	assert.Equal(t, []string{"first", "second"}, hostsAt(h, time.Time{}, time.Time{}))
+	assert.Empty(t, hostsAt(h, t2.Add(time.Minute), time.Time{}))
+	assert.Empty(t, h.find(net.IP{192, 168, 10, 101}, time.Time{}, time.Time{}))
+
+	t.Run("load", func(t *testing.T) {
+		var loaded *leaseHistory
+		loaded, err = newLeaseHistory(conf, path)
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"first", "second"}, hostsAt(loaded, time.Time{}, time.Time{}))
+	})
+
+	t.Run("prune", func(t *testing.T) {
+		err = h.update(nil, t1.Add(timeutil.Day+time.Minute))
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"second"}, hostsAt(h, time.Time{}, time.Time{}))
+	})
+}
+
+func TestLeaseHistory_static(t *testing.T) {
+	h, err := newLeaseHistory(&LeaseHistoryConfig{Enabled: true}, filepath.Join(t.TempDir(), historyFilename))
+	require.NoError(t, err)
+
+	l := &Lease{
+		Expiry:   time.Unix(leaseExpireStatic, 0),
+		Hostname: "static",
+		HWAddr:   net.HardwareAddr{0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA},
+		IP:       net.IP{192, 168, 10, 150},
+	}
+
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	err = h.update([]*Lease{l}, start)
+	require.NoError(t, err)
+
+	later := start.Add(timeutil.Day)
+	err = h.update([]*Lease{l}, later)
+	require.NoError(t, err)
+
+	records := h.find(nil, later.Add(time.Hour), time.Time{})
+	require.Len(t, records, 1)
+
+	r := records[0]
+	assert.True(t, r.Static)
+	assert.True(t, r.Active)
+	assert.Equal(t, start, r.Start)
+	assert.Equal(t, later, r.End)
+}
+
+func TestLeaseRecord_overlaps(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	later := end.Add(time.Hour)
+
+	testCases := []struct {
+		name   string
+		static bool
+		active bool
+		want   bool
+	}{{
+		name:   "dynamic_active",
+		static: false,
+		active: true,
+		want:   false,
+	}, {
+		name:   "dynamic_finished",
+		static: false,
+		active: false,
+		want:   false,
+	}, {
+		name:   "static_active",
+		static: true,
+		active: true,
+		want:   true,
+	}, {
+		name:   "static_finished",
+		static: true,
+		active: false,
+		want:   false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &LeaseRecord{
+				Start:  start,
+				End:    end,
+				Static: tc.static,
+				Active: tc.active,
+			}
+
+			assert.True(t, r.overlaps(start, end))
+			assert.Equal(t, tc.want, r.overlaps(later, time.Time{}))
+		})
+	}
+}
+
+func TestNewLeaseHistory_disabled(t *testing.T) {
+	h, err := newLeaseHistory(&LeaseHistoryConfig{}, "")
+	require.NoError(t, err)
+
+	assert.Nil(t, h)
+	assert.NoError(t, h.update(nil, time.Now()))
+}
@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -183,10 +184,6 @@ func (s *Server) handleDHCPSetConfigV6(
 	}
 
 	v6Conf := v6JSONToServerConf(conf.V6)
-	v6Conf.Enabled = conf.Enabled == nbTrue
-	if len(v6Conf.RangeStart) == 0 {
-		v6Conf.Enabled = false
-	}
 
 	// Don't overwrite the RA/SLAAC settings from the config file.
 	//
@@ -194,6 +191,13 @@ func (s *Server) handleDHCPSetConfigV6(
 	// changing them from the HTTP API?
 	v6Conf.RASLAACOnly = s.conf.Conf6.RASLAACOnly
 	v6Conf.RAAllowSLAAC = s.conf.Conf6.RAAllowSLAAC
+	v6Conf.RADNSOnly = s.conf.Conf6.RADNSOnly
+	v6Conf.RADNSSearchList = s.conf.Conf6.RADNSSearchList
+
+	v6Conf.Enabled = conf.Enabled == nbTrue
+	if len(v6Conf.RangeStart) == 0 && !v6Conf.RADNSOnly {
+		v6Conf.Enabled = false
+	}
 
 	enabled = v6Conf.Enabled
 	v6Conf.InterfaceName = conf.InterfaceName
@@ -581,6 +585,7 @@ func (s *Server) handleReset(w http.ResponseWriter, r *http.Request) {
 		HTTPRegister:   oldconf.HTTPRegister,
 		ConfigModified: oldconf.ConfigModified,
 		DBFilePath:     oldconf.DBFilePath,
+		History:        oldconf.History,
 	}
 
 	v4conf := V4ServerConf{
@@ -609,6 +614,111 @@ func (s *Server) handleResetLeases(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleDHCPPlan is the handler for the GET /control/dhcp/plan HTTP API.  It
+// reports the utilization of the DHCPv4 dynamic range, the address conflicts,
+// and the addresses suggested for the new static leases.  The optional count
+// query parameter is the number of the suggestions.
+func (s *Server) handleDHCPPlan(w http.ResponseWriter, r *http.Request) {
+	n := defaultPlanSuggestions
+	if cs := r.URL.Query().Get("count"); cs != "" {
+		var err error
+		n, err = strconv.Atoi(cs)
+		if err != nil || n < 0 || n > maxPlanSuggestions {
+			aghhttp.Error(
+				r,
+				w,
+				http.StatusBadRequest,
+				"count must be an integer from 0 to %d",
+				maxPlanSuggestions,
+			)
+
+			return
+		}
+	}
+
+	conf := &V4ServerConf{}
+	s.srv4.WriteDiskConfig4(conf)
+	if conf.ipRange == nil || conf.subnet == nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "dhcpv4 is not configured")
+
+		return
+	}
+
+	plan := newPlan(conf, s.srv4.GetLeases(LeasesAll|LeasesBlocklisted), n)
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(plan)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "encoding dhcp plan: %s", err)
+	}
+}
+
+// leaseHistoryJSON is the response for the GET /control/dhcp/lease_history
+// HTTP API.
+type leaseHistoryJSON struct {
+	Records []*LeaseRecord `json:"records"`
+	Enabled bool           `json:"enabled"`
+}
+
+// handleLeaseHistory is the handler for the GET /control/dhcp/lease_history
+// HTTP API.  It responds with the lease assignments in effect at any moment
+// between the optional from and to query parameters, in RFC 3339 format.  The
+// optional ip query parameter limits the assignments to the ones of the
+// address.
+func (s *Server) handleLeaseHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var ip net.IP
+	if ipStr := q.Get("ip"); ipStr != "" {
+		ip = net.ParseIP(ipStr)
+		if ip == nil {
+			aghhttp.Error(r, w, http.StatusBadRequest, "bad ip %q", ipStr)
+
+			return
+		}
+	}
+
+	var from, to time.Time
+	for _, p := range []struct {
+		t    *time.Time
+		name string
+	}{{
+		t:    &from,
+		name: "from",
+	}, {
+		t:    &to,
+		name: "to",
+	}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+
+		var err error
+		*p.t, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			aghhttp.Error(r, w, http.StatusBadRequest, "bad %s: %s", p.name, err)
+
+			return
+		}
+	}
+
+	resp := &leaseHistoryJSON{
+		Records: []*LeaseRecord{},
+		Enabled: s.history != nil,
+	}
+
+	if s.history != nil {
+		resp.Records = s.history.find(ip, from, to)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "encoding lease history: %s", err)
+	}
+}
+
 func (s *Server) registerHandlers() {
 	s.conf.HTTPRegister(http.MethodGet, "/control/dhcp/status", s.handleDHCPStatus)
 	s.conf.HTTPRegister(http.MethodGet, "/control/dhcp/interfaces", s.handleDHCPInterfaces)
@@ -618,6 +728,8 @@ func (s *Server) registerHandlers() {
 	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/remove_static_lease", s.handleDHCPRemoveStaticLease)
 	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/reset", s.handleReset)
 	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/reset_leases", s.handleResetLeases)
+	s.conf.HTTPRegister(http.MethodGet, "/control/dhcp/plan", s.handleDHCPPlan)
+	s.conf.HTTPRegister(http.MethodGet, "/control/dhcp/lease_history", s.handleLeaseHistory)
 }
 
 // jsonError is a generic JSON error response.
@@ -659,4 +771,6 @@ func (s *Server) registerNotImplementedHandlers() {
 	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/remove_static_lease", h)
 	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/reset", h)
 	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/reset_leases", h)
+	s.conf.HTTPRegister(http.MethodGet, "/control/dhcp/plan", h)
+	s.conf.HTTPRegister(http.MethodGet, "/control/dhcp/lease_history", h)
 }
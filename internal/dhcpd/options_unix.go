@@ -1,5 +1,5 @@
-//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
-// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build aix darwin dragonfly freebsd linux netbsd openbsd
 
 package dhcpd
 
@@ -7,6 +7,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"net"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -172,7 +173,7 @@ func prepareOptions(conf V4ServerConf) (opts dhcpv4.Options) {
 
 		// Values From Configuration
 
-		dhcpv4.OptionRouter.Code():     netutil.CloneIP(conf.subnet.IP),
+		dhcpv4.OptionRouter.Code():     slices.Clone(conf.subnet.IP),
 		dhcpv4.OptionSubnetMask.Code(): dhcpv4.IPMask(conf.subnet.Mask).ToBytes(),
 	}
 
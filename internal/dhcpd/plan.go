@@ -0,0 +1,302 @@
+package dhcpd
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// Default and maximum numbers of the suggested static lease addresses.
+const (
+	defaultPlanSuggestions = 5
+	maxPlanSuggestions     = 100
+)
+
+// Heatmap block parameters.  The block is at least minPlanBlockSize addresses
+// long, but the range is never split into more than maxPlanBlocks blocks.
+const (
+	minPlanBlockSize = 16
+	maxPlanBlocks    = 256
+)
+
+// planConflictKind is the kind of an address conflict found in the leases.
+type planConflictKind string
+
+// planConflictKind values.
+const (
+	// planConflictInUse means that the conflict detector has found the
+	// address to be used by an unknown host, so it's blocklisted.
+	planConflictInUse planConflictKind = "in_use"
+
+	// planConflictDuplicateIP means that several leases have the same
+	// address.
+	planConflictDuplicateIP planConflictKind = "duplicate_ip"
+
+	// planConflictDuplicateMAC means that a client with a static lease has
+	// also got a dynamic one.
+	planConflictDuplicateMAC planConflictKind = "duplicate_mac"
+
+	// planConflictGateway means that the address of the lease is the
+	// address of the gateway.
+	planConflictGateway planConflictKind = "gateway"
+
+	// planConflictOutsideSubnet means that the static lease is outside of
+	// the subnet of the DHCP server.
+	planConflictOutsideSubnet planConflictKind = "outside_subnet"
+)
+
+// planConflictJSON is a single conflict found in the leases.
+type planConflictJSON struct {
+	Kind planConflictKind `json:"kind"`
+	IP   net.IP           `json:"ip"`
+
+	// MAC is empty for the addresses used by the unknown hosts.
+	MAC string `json:"mac,omitempty"`
+}
+
+// planBlockJSON is a block of the dynamic range in the utilization heatmap.
+type planBlockJSON struct {
+	Start     net.IP `json:"start"`
+	Size      uint32 `json:"size"`
+	Used      uint32 `json:"used"`
+	Conflicts uint32 `json:"conflicts"`
+}
+
+// dhcpPlanJSON is the response for the GET /control/dhcp/plan HTTP API.
+type dhcpPlanJSON struct {
+	RangeStart net.IP `json:"range_start"`
+	RangeEnd   net.IP `json:"range_end"`
+
+	// Blocks is the utilization heatmap of the dynamic range.
+	Blocks []*planBlockJSON `json:"blocks"`
+
+	Conflicts []*planConflictJSON `json:"conflicts"`
+
+	// Suggestions are the free addresses for the new static leases.  The
+	// addresses outside of the dynamic range come first.
+	Suggestions []net.IP `json:"suggestions"`
+
+	// Size is the number of the addresses in the dynamic range.
+	Size uint32 `json:"size"`
+
+	// Dynamic, Static, and InUse are the numbers of the addresses in the
+	// dynamic range leased dynamically, leased statically, and used by the
+	// unknown hosts.
+	Dynamic uint32 `json:"dynamic"`
+	Static  uint32 `json:"static"`
+	InUse   uint32 `json:"in_use"`
+
+	// Free is the number of the addresses in the dynamic range available for
+	// the new dynamic leases.
+	Free uint32 `json:"free"`
+
+	// Utilization is the share of the used addresses in the dynamic range in
+	// percent.
+	Utilization float64 `json:"utilization"`
+}
+
+// ip4ToUint32 returns the IPv4 address ip as a number.  ip must be an IPv4
+// address.
+func ip4ToUint32(ip net.IP) (n uint32) {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+// uint32ToIP4 returns the IPv4 address with number n.
+func uint32ToIP4(n uint32) (ip net.IP) {
+	ip = make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+
+	return ip
+}
+
+// blockSize returns the size of the heatmap blocks for the range of size
+// addresses.
+func blockSize(size uint32) (bs uint32) {
+	bs = minPlanBlockSize
+	if n := (uint64(size) + maxPlanBlocks - 1) / maxPlanBlocks; n > uint64(bs) {
+		bs = uint32(n)
+	}
+
+	return bs
+}
+
+// planner computes the DHCPv4 address plan.
+type planner struct {
+	conf *V4ServerConf
+
+	// used are the addresses which can't be suggested.
+	used map[uint32]struct{}
+
+	plan *dhcpPlanJSON
+
+	start uint32
+	end   uint32
+}
+
+// newPlan computes the plan of the DHCPv4 addresses from conf and leases,
+// suggesting up to n addresses for the new static leases.  conf must be a
+// valid configuration.
+func newPlan(conf *V4ServerConf, leases []*Lease, n int) (plan *dhcpPlanJSON) {
+	p := &planner{
+		conf:  conf,
+		used:  map[uint32]struct{}{},
+		start: ip4ToUint32(conf.RangeStart),
+		end:   ip4ToUint32(conf.RangeEnd),
+	}
+
+	size := p.end - p.start + 1
+	p.plan = &dhcpPlanJSON{
+		RangeStart:  conf.RangeStart,
+		RangeEnd:    conf.RangeEnd,
+		Blocks:      newPlanBlocks(p.start, size),
+		Conflicts:   []*planConflictJSON{},
+		Suggestions: []net.IP{},
+		Size:        size,
+	}
+
+	if gw := conf.GatewayIP.To4(); gw != nil {
+		p.used[ip4ToUint32(gw)] = struct{}{}
+	}
+
+	p.addLeases(leases)
+	p.suggest(n)
+
+	plan = p.plan
+	plan.Free = size - plan.Dynamic - plan.Static - plan.InUse
+	plan.Utilization = float64(size-plan.Free) * 100 / float64(size)
+
+	return plan
+}
+
+// newPlanBlocks returns the empty heatmap blocks for the range of size
+// addresses starting with start.
+func newPlanBlocks(start, size uint32) (blocks []*planBlockJSON) {
+	bs := blockSize(size)
+	for off := uint64(0); off < uint64(size); off += uint64(bs) {
+		b := &planBlockJSON{
+			Start: uint32ToIP4(start + uint32(off)),
+			Size:  bs,
+		}
+		if rest := uint64(size) - off; rest < uint64(bs) {
+			b.Size = uint32(rest)
+		}
+
+		blocks = append(blocks, b)
+	}
+
+	return blocks
+}
+
+// addLeases accounts for leases in the plan and finds the conflicts.
+func (p *planner) addLeases(leases []*Lease) {
+	gw := p.conf.GatewayIP.To4()
+	staticMACs := map[string]net.IP{}
+	for _, l := range leases {
+		if l.IsStatic() {
+			staticMACs[l.HWAddr.String()] = l.IP
+		}
+	}
+
+	for _, l := range leases {
+		ip4 := l.IP.To4()
+		if ip4 == nil {
+			continue
+		}
+
+		n := ip4ToUint32(ip4)
+		_, dup := p.used[n]
+		p.used[n] = struct{}{}
+
+		switch {
+		case l.IsBlocklisted():
+			p.addConflict(planConflictInUse, ip4, nil)
+		case gw != nil && ip4.Equal(gw):
+			p.addConflict(planConflictGateway, ip4, l.HWAddr)
+		case dup:
+			p.addConflict(planConflictDuplicateIP, ip4, l.HWAddr)
+		case l.IsStatic() && p.conf.subnet != nil && !p.conf.subnet.Contains(ip4):
+			p.addConflict(planConflictOutsideSubnet, ip4, l.HWAddr)
+		case !l.IsStatic() && staticMACs[l.HWAddr.String()] != nil:
+			p.addConflict(planConflictDuplicateMAC, ip4, l.HWAddr)
+		}
+
+		if n < p.start || n > p.end || dup {
+			continue
+		}
+
+		b := p.plan.Blocks[(n-p.start)/blockSize(p.plan.Size)]
+		b.Used++
+		switch {
+		case l.IsBlocklisted():
+			b.Conflicts++
+			p.plan.InUse++
+		case l.IsStatic():
+			p.plan.Static++
+		default:
+			p.plan.Dynamic++
+		}
+	}
+}
+
+// addConflict adds the conflict of kind for ip and mac to the plan and marks
+// the heatmap block, if there is one.
+func (p *planner) addConflict(kind planConflictKind, ip net.IP, mac net.HardwareAddr) {
+	c := &planConflictJSON{
+		Kind: kind,
+		IP:   ip,
+	}
+	if kind != planConflictInUse {
+		c.MAC = mac.String()
+	}
+
+	p.plan.Conflicts = append(p.plan.Conflicts, c)
+
+	n := ip4ToUint32(ip)
+	if kind != planConflictInUse && n >= p.start && n <= p.end {
+		p.plan.Blocks[(n-p.start)/blockSize(p.plan.Size)].Conflicts++
+	}
+}
+
+// suggest adds up to n free addresses to the suggestions.  The addresses of
+// the subnet outside of the dynamic range are preferred, since the static
+// leases there don't shrink the dynamic pool.  The addresses from the dynamic
+// range are taken from its end, since the dynamic leases are allocated from
+// its start.
+func (p *planner) suggest(n int) {
+	subnet := p.conf.subnet
+	if subnet == nil || n <= 0 {
+		return
+	}
+
+	ones, bits := subnet.Mask.Size()
+	first := ip4ToUint32(subnet.IP.Mask(subnet.Mask))
+	last := first | uint32(1<<uint(bits-ones)-1)
+
+	// Skip the network and the broadcast addresses.
+	for a := first + 1; a < last && len(p.plan.Suggestions) < n; a++ {
+		if a >= p.start && a <= p.end {
+			// Jump over the dynamic range.
+			a = p.end
+
+			continue
+		}
+
+		p.suggestAddr(a)
+	}
+
+	for a := p.end; a >= p.start && len(p.plan.Suggestions) < n; a-- {
+		p.suggestAddr(a)
+		if a == 0 {
+			break
+		}
+	}
+}
+
+// suggestAddr adds a to the suggestions if it's free.
+func (p *planner) suggestAddr(a uint32) {
+	if _, ok := p.used[a]; ok {
+		return
+	}
+
+	p.used[a] = struct{}{}
+	p.plan.Suggestions = append(p.plan.Suggestions, uint32ToIP4(a))
+}
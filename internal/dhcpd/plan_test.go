@@ -0,0 +1,109 @@
+package dhcpd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPlan(t *testing.T) {
+	conf := &V4ServerConf{
+		GatewayIP:  net.IP{192, 168, 10, 1},
+		SubnetMask: net.IP{255, 255, 255, 0},
+		RangeStart: net.IP{192, 168, 10, 100},
+		RangeEnd:   net.IP{192, 168, 10, 131},
+		subnet: &net.IPNet{
+			IP:   net.IP{192, 168, 10, 1},
+			Mask: net.CIDRMask(24, 32),
+		},
+	}
+
+	static := time.Unix(leaseExpireStatic, 0)
+	dynamic := time.Now().Add(time.Hour)
+	newLease := func(ip net.IP, macLast byte, exp time.Time) (l *Lease) {
+		return &Lease{
+			Expiry: exp,
+			HWAddr: net.HardwareAddr{0xAA, 0xAA, 0xAA, 0xAA, 0xAA, macLast},
+			IP:     ip,
+		}
+	}
+
+	blocklisted := newLease(net.IP{192, 168, 10, 101}, 0, dynamic)
+	blocklisted.HWAddr = make(net.HardwareAddr, 6)
+
+	leases := []*Lease{
+		newLease(net.IP{192, 168, 10, 100}, 1, dynamic),
+		newLease(net.IP{192, 168, 10, 10}, 2, static),
+		newLease(net.IP{10, 0, 0, 5}, 3, static),
+		blocklisted,
+		newLease(net.IP{192, 168, 10, 120}, 2, dynamic),
+		newLease(net.IP{192, 168, 10, 131}, 4, static),
+		newLease(net.IP{192, 168, 10, 100}, 5, dynamic),
+	}
+
+	plan := newPlan(conf, leases, 3)
+
+	assert.Equal(t, uint32(32), plan.Size)
+	assert.Equal(t, uint32(2), plan.Dynamic)
+	assert.Equal(t, uint32(1), plan.Static)
+	assert.Equal(t, uint32(1), plan.InUse)
+	assert.Equal(t, uint32(28), plan.Free)
+	assert.Equal(t, 12.5, plan.Utilization)
+
+	assert.Equal(t, []*planConflictJSON{{
+		Kind: planConflictOutsideSubnet,
+		IP:   net.IP{10, 0, 0, 5},
+		MAC:  "aa:aa:aa:aa:aa:03",
+	}, {
+		Kind: planConflictInUse,
+		IP:   net.IP{192, 168, 10, 101},
+	}, {
+		Kind: planConflictDuplicateMAC,
+		IP:   net.IP{192, 168, 10, 120},
+		MAC:  "aa:aa:aa:aa:aa:02",
+	}, {
+		Kind: planConflictDuplicateIP,
+		IP:   net.IP{192, 168, 10, 100},
+		MAC:  "aa:aa:aa:aa:aa:05",
+	}}, plan.Conflicts)
+
+	assert.Equal(t, []*planBlockJSON{{
+		Start:     net.IP{192, 168, 10, 100},
+		Size:      16,
+		Used:      2,
+		Conflicts: 2,
+	}, {
+		Start:     net.IP{192, 168, 10, 116},
+		Size:      16,
+		Used:      2,
+		Conflicts: 1,
+	}}, plan.Blocks)
+
+	assert.Equal(t, []net.IP{
+		{192, 168, 10, 2},
+		{192, 168, 10, 3},
+		{192, 168, 10, 4},
+	}, plan.Suggestions)
+}
+
+func TestNewPlan_suggestInRange(t *testing.T) {
+	conf := &V4ServerConf{
+		GatewayIP:  net.IP{10, 0, 0, 1},
+		SubnetMask: net.IP{255, 255, 255, 248},
+		RangeStart: net.IP{10, 0, 0, 2},
+		RangeEnd:   net.IP{10, 0, 0, 6},
+		subnet: &net.IPNet{
+			IP:   net.IP{10, 0, 0, 1},
+			Mask: net.CIDRMask(29, 32),
+		},
+	}
+
+	plan := newPlan(conf, nil, 2)
+	require.Len(t, plan.Blocks, 1)
+
+	assert.Equal(t, uint32(5), plan.Blocks[0].Size)
+	assert.Equal(t, []net.IP{{10, 0, 0, 6}, {10, 0, 0, 5}}, plan.Suggestions)
+}
@@ -4,9 +4,11 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
+	"strings"
 	"sync/atomic"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
 	"golang.org/x/net/icmp"
@@ -14,11 +16,13 @@ import (
 )
 
 type raCtx struct {
-	raAllowSLAAC     bool   // send RA packets without MO flags
-	raSLAACOnly      bool   // send RA packets with MO flags
-	ipAddr           net.IP // source IP address (link-local-unicast)
-	dnsIPAddr        net.IP // IP address for DNS Server option
-	prefixIPAddr     net.IP // IP address for Prefix option
+	raAllowSLAAC     bool     // send RA packets without MO flags
+	raSLAACOnly      bool     // send RA packets with MO flags
+	dnsOnly          bool     // send RA packets with only DNS options
+	ipAddr           net.IP   // source IP address (link-local-unicast)
+	dnsIPAddr        net.IP   // IP address for DNS Server option
+	prefixIPAddr     net.IP   // IP address for Prefix option
+	dnsSearchList    []string // domains for DNS Search List option
 	ifaceName        string
 	iface            *net.Interface
 	packetSendPeriod time.Duration // how often RA packets are sent
@@ -37,6 +41,24 @@ type icmpv6RA struct {
 	mtu                         uint32
 }
 
+// icmpv6RADNS are the parameters of an ICMPv6.RouterAdvertisement packet,
+// which only announces the DNS configuration.
+type icmpv6RADNS struct {
+	sourceLinkLayerAddress net.HardwareAddr
+	recursiveDNSServer     net.IP
+	dnsSearchList          []string
+}
+
+// ICMPv6 Router Advertisement option types.  See RFC 4861 and RFC 8106.
+const (
+	raOptSourceLinkLayerAddress = 1
+	raOptRecursiveDNSServer     = 25
+	raOptDNSSearchList          = 31
+)
+
+// raDNSLifetime is the lifetime of the DNS options in seconds.
+const raDNSLifetime = 3600
+
 // hwAddrToLinkLayerAddr converts a hardware address into a form required by
 // RFC4861.  That is, a byte slice of length divisible by 8.
 //
@@ -192,16 +214,117 @@ func createICMPv6RAPacket(params icmpv6RA) (data []byte, err error) {
 	return data, nil
 }
 
-// Init - initialize RA module
-func (ra *raCtx) Init() (err error) {
-	ra.stop.Store(0)
-	ra.conn = nil
-	if !(ra.raAllowSLAAC || ra.raSLAACOnly) {
-		return nil
+// appendRAOption appends the option with the type typ and body to data.  body
+// is padded with zeros, so that the whole option is a multiple of 8 bytes.
+func appendRAOption(data []byte, typ byte, body []byte) (res []byte) {
+	l := 2 + len(body)
+	if rem := l % 8; rem != 0 {
+		l += 8 - rem
 	}
 
-	log.Debug("dhcpv6 ra: source IP address: %s  DNS IP address: %s",
-		ra.ipAddr, ra.dnsIPAddr)
+	opt := make([]byte, l)
+	opt[0] = typ
+	opt[1] = byte(l / 8)
+	copy(opt[2:], body)
+
+	return append(data, opt...)
+}
+
+// packDNSSearchList encodes domains as the sequence of the DNS names as
+// required by RFC 8106.
+func packDNSSearchList(domains []string) (data []byte) {
+	for _, d := range domains {
+		for _, label := range strings.Split(strings.TrimSuffix(d, "."), ".") {
+			data = append(data, byte(len(label)))
+			data = append(data, label...)
+		}
+
+		data = append(data, 0)
+	}
+
+	return data
+}
+
+// createICMPv6RADNSPacket creates an ICMPv6.RouterAdvertisement packet, which
+// only announces the DNS server and the DNS search list.  The router lifetime
+// is zero, so that the hosts don't use AdGuard Home as the default router, and
+// there are no M and O flags nor prefixes, so that the hosts keep configuring
+// the addresses as before.
+//
+// ICMPv6:
+// type[1]
+// code[1]
+// chksum[2]
+// body (RouterAdvertisement):
+//
+//	Cur Hop Limit[1]
+//	Flags[1]: ........
+//	Router Lifetime[2]: 0
+//	Reachable Time[4]
+//	Retrans Timer[4]
+//	Option=Source link-layer address(1)
+//	Option=Recursive DNS Server(25)
+//	Option=DNS Search List(31), if there are domains:
+//	  Type[1]
+//	  Length * 8bytes[1]
+//	  Reserved[2]
+//	  Lifetime[4]
+//	  Domain Names of DNS Search List[padded to 8 bytes]
+func createICMPv6RADNSPacket(params icmpv6RADNS) (data []byte, err error) {
+	lla := params.sourceLinkLayerAddress
+	err = netutil.ValidateMAC(lla)
+	if err != nil {
+		return nil, fmt.Errorf("validating source link layer address: %w", err)
+	}
+
+	dnsIP := params.recursiveDNSServer.To16()
+	if dnsIP == nil {
+		return nil, fmt.Errorf("bad dns server address %v", params.recursiveDNSServer)
+	}
+
+	data = []byte{
+		// ICMPv6: type, code, chksum.
+		134, 0, 0, 0,
+		// RouterAdvertisement: Cur Hop Limit, Flags, Router Lifetime.
+		64, 0, 0, 0,
+		// Reachable Time.
+		0, 0, 0, 0,
+		// Retrans Timer.
+		0, 0, 0, 0,
+	}
+
+	// The option is padded by appendRAOption.  See RFC 4861, section 4.6.1.
+	data = appendRAOption(data, raOptSourceLinkLayerAddress, lla)
+
+	// Reserved[2], Lifetime[4], Addresses[16].
+	rdnss := make([]byte, 6, 6+len(dnsIP))
+	binary.BigEndian.PutUint32(rdnss[2:], raDNSLifetime)
+	rdnss = append(rdnss, dnsIP...)
+	data = appendRAOption(data, raOptRecursiveDNSServer, rdnss)
+
+	if len(params.dnsSearchList) == 0 {
+		return data, nil
+	}
+
+	// Reserved[2], Lifetime[4], Domain Names.
+	dnssl := make([]byte, 6)
+	binary.BigEndian.PutUint32(dnssl[2:], raDNSLifetime)
+	dnssl = append(dnssl, packDNSSearchList(params.dnsSearchList)...)
+	data = appendRAOption(data, raOptDNSSearchList, dnssl)
+
+	return data, nil
+}
+
+// createPacket creates the ICMPv6.RouterAdvertisement packet for the mode of
+// ra.
+func (ra *raCtx) createPacket() (data []byte, err error) {
+	if ra.dnsOnly {
+		return createICMPv6RADNSPacket(icmpv6RADNS{
+			sourceLinkLayerAddress: ra.iface.HardwareAddr,
+			recursiveDNSServer:     ra.dnsIPAddr,
+			dnsSearchList:          ra.dnsSearchList,
+		})
+	}
 
 	params := icmpv6RA{
 		managedAddressConfiguration: !ra.raSLAACOnly,
@@ -214,8 +337,22 @@ func (ra *raCtx) Init() (err error) {
 	params.prefix = make([]byte, 16)
 	copy(params.prefix, ra.prefixIPAddr[:8]) // /64
 
+	return createICMPv6RAPacket(params)
+}
+
+// Init - initialize RA module
+func (ra *raCtx) Init() (err error) {
+	ra.stop.Store(0)
+	ra.conn = nil
+	if !(ra.raAllowSLAAC || ra.raSLAACOnly || ra.dnsOnly) {
+		return nil
+	}
+
+	log.Debug("dhcpv6 ra: source IP address: %s  DNS IP address: %s",
+		ra.ipAddr, ra.dnsIPAddr)
+
 	var data []byte
-	data, err = createICMPv6RAPacket(params)
+	data, err = ra.createPacket()
 	if err != nil {
 		return fmt.Errorf("creating packet: %w", err)
 	}
@@ -255,6 +392,8 @@ func (ra *raCtx) Init() (err error) {
 	}
 
 	go func() {
+		defer aghos.OnPanicAndExit("dhcpv6 ra")
+
 		log.Debug("dhcpv6 ra: starting to send periodic RouterAdvertisement packets")
 		for ra.stop.Load() == 0 {
 			_, err = con6.WriteTo(data, msg, addr)
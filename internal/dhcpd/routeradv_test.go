@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestCreateICMPv6RAPacket(t *testing.T) {
@@ -36,3 +37,56 @@ func TestCreateICMPv6RAPacket(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, wantData, gotData)
 }
+
+func TestCreateICMPv6RADNSPacket(t *testing.T) {
+	lla := []byte{0x0a, 0x00, 0x27, 0x00, 0x00, 0x00}
+	dnsIP := net.ParseIP("fe80::800:27ff:fe00:0")
+
+	wantHeader := []byte{
+		0x86, 0x00, 0x00, 0x00, 0x40, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x01, 0x01, 0x0a, 0x00, 0x27, 0x00, 0x00, 0x00,
+		0x19, 0x03, 0x00, 0x00, 0x00, 0x00, 0x0e, 0x10,
+		0xfe, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x08, 0x00, 0x27, 0xff, 0xfe, 0x00, 0x00, 0x00,
+	}
+
+	testCases := []struct {
+		name       string
+		searchList []string
+		wantDNSSL  []byte
+	}{{
+		name:       "no_search_list",
+		searchList: nil,
+		wantDNSSL:  nil,
+	}, {
+		name:       "search_list",
+		searchList: []string{"lan", "home.arpa."},
+		wantDNSSL: []byte{
+			0x1f, 0x03, 0x00, 0x00, 0x00, 0x00, 0x0e, 0x10,
+			0x03, 'l', 'a', 'n', 0x00, 0x04, 'h', 'o',
+			'm', 'e', 0x04, 'a', 'r', 'p', 'a', 0x00,
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := createICMPv6RADNSPacket(icmpv6RADNS{
+				sourceLinkLayerAddress: lla,
+				recursiveDNSServer:     dnsIP,
+				dnsSearchList:          tc.searchList,
+			})
+			require.NoError(t, err)
+
+			assert.Equal(t, append(append([]byte{}, wantHeader...), tc.wantDNSSL...), data)
+		})
+	}
+
+	t.Run("bad_mac", func(t *testing.T) {
+		_, err := createICMPv6RADNSPacket(icmpv6RADNS{
+			sourceLinkLayerAddress: []byte{0x0a},
+			recursiveDNSServer:     dnsIP,
+		})
+		assert.Error(t, err)
+	})
+}
@@ -95,6 +95,16 @@ type V6ServerConf struct {
 	RASLAACOnly  bool `yaml:"ra_slaac_only" json:"-"`  // send ICMPv6.RA packets without MO flags
 	RAAllowSLAAC bool `yaml:"ra_allow_slaac" json:"-"` // send ICMPv6.RA packets with MO flags
 
+	// RADNSOnly defines if the ICMPv6.RA packets should only announce AdGuard
+	// Home as the DNS server with the RDNSS and DNSSL options.  Neither the
+	// DHCPv6 server is started nor the addresses are configured in this mode,
+	// so the RangeStart isn't required.  See RFC 8106.
+	RADNSOnly bool `yaml:"ra_dns_only" json:"-"`
+
+	// RADNSSearchList are the domains announced with the DNSSL option in the
+	// RADNSOnly mode.
+	RADNSSearchList []string `yaml:"ra_dns_search_list" json:"-"`
+
 	ipStart    net.IP        // starting IP address for dynamic leases
 	leaseTime  time.Duration // the time during which a dynamic lease is considered valid
 	dnsIPAddrs []net.IP      // IPv6 addresses to return to DHCP clients as DNS server addresses
@@ -1,5 +1,5 @@
-//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
-// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build aix darwin dragonfly freebsd linux netbsd openbsd
 
 package dhcpd
 
@@ -7,11 +7,13 @@ import (
 	"bytes"
 	"fmt"
 	"net"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
@@ -93,7 +95,7 @@ func (s *v4Server) validHostnameForClient(cliHostname string, ip net.IP) (hostna
 		hostname = aghnet.GenerateHostname(ip)
 	}
 
-	err = netutil.ValidateDomainName(hostname)
+	err = netutil.ValidateHostname(hostname)
 	if err != nil {
 		log.Info("dhcpv4: %s", err)
 		hostname = ""
@@ -170,13 +172,22 @@ func (s *v4Server) GetLeases(flags GetLeasesFlags) (leases []*Lease) {
 
 	getDynamic := flags&LeasesDynamic != 0
 	getStatic := flags&LeasesStatic != 0
+	getBlocklisted := flags&LeasesBlocklisted != 0
 
 	s.leasesLock.Lock()
 	defer s.leasesLock.Unlock()
 
 	now := time.Now()
 	for _, l := range s.leases {
-		if getDynamic && l.Expiry.After(now) && !s.isBlocklisted(l) {
+		if s.isBlocklisted(l) {
+			if getBlocklisted && l.Expiry.After(now) {
+				leases = append(leases, l.Clone())
+			}
+
+			continue
+		}
+
+		if getDynamic && l.Expiry.After(now) {
 			leases = append(leases, l.Clone())
 
 			continue
@@ -354,7 +365,7 @@ func (s *v4Server) AddStaticLease(l *Lease) (err error) {
 			return err
 		}
 
-		err = netutil.ValidateDomainName(hostname)
+		err = netutil.ValidateHostname(hostname)
 		if err != nil {
 			return fmt.Errorf("validating hostname: %w", err)
 		}
@@ -883,7 +894,7 @@ func (s *v4Server) process(req, resp *dhcpv4.DHCPv4) int {
 	}
 
 	if l != nil {
-		resp.YourIPAddr = netutil.CloneIP(l.IP)
+		resp.YourIPAddr = slices.Clone(l.IP)
 	}
 
 	// Set IP address lease time for all DHCPOFFER messages and DHCPACK
@@ -1054,6 +1065,8 @@ func (s *v4Server) Start() (err error) {
 	log.Info("dhcpv4: listening")
 
 	go func() {
+		defer aghos.OnPanicAndExit("dhcpv4")
+
 		if serr := s.srv.Serve(); errors.Is(serr, net.ErrClosed) {
 			log.Info("dhcpv4: server is closed")
 
@@ -0,0 +1,24 @@
+//go:build !(aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package dhcpd
+
+// 'u-root/u-root' package, a dependency of 'insomniacslk/dhcp' package, doesn't
+// build on Windows and Solaris.
+
+import "net"
+
+type stubServer struct{}
+
+func (s *stubServer) ResetLeases(_ []*Lease) (err error)           { return nil }
+func (s *stubServer) GetLeases(_ GetLeasesFlags) (leases []*Lease) { return nil }
+func (s *stubServer) getLeasesRef() []*Lease                       { return nil }
+func (s *stubServer) AddStaticLease(_ *Lease) (err error)          { return nil }
+func (s *stubServer) RemoveStaticLease(_ *Lease) (err error)       { return nil }
+func (s *stubServer) FindMACbyIP(ip net.IP) (mac net.HardwareAddr) { return nil }
+func (s *stubServer) WriteDiskConfig4(c *V4ServerConf)             {}
+func (s *stubServer) WriteDiskConfig6(c *V6ServerConf)             {}
+func (s *stubServer) Start() (err error)                           { return nil }
+func (s *stubServer) Stop() (err error)                            { return nil }
+func v4Create(conf V4ServerConf) (DHCPServer, error)               { return &stubServer{}, nil }
+func v6Create(conf V6ServerConf) (DHCPServer, error)               { return &stubServer{}, nil }
@@ -1,5 +1,5 @@
-//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
-// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build aix darwin dragonfly freebsd linux netbsd openbsd
 
 package dhcpd
 
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
@@ -87,6 +88,7 @@ func (s *v6Server) GetLeases(flags GetLeasesFlags) (leases []*Lease) {
 	// behaves differently in cases like marshalling.  Our front-end also
 	// requires non-nil value in the response.
 	leases = []*Lease{}
+	now := time.Now()
 	s.leasesLock.Lock()
 	for _, l := range s.leases {
 		if l.Expiry.Unix() == leaseExpireStatic {
@@ -94,7 +96,7 @@ func (s *v6Server) GetLeases(flags GetLeasesFlags) (leases []*Lease) {
 				leases = append(leases, l.Clone())
 			}
 		} else {
-			if (flags & LeasesDynamic) != 0 {
+			if (flags&LeasesDynamic) != 0 && l.Expiry.After(now) {
 				leases = append(leases, l.Clone())
 			}
 		}
@@ -585,6 +587,8 @@ func (s *v6Server) initRA(iface *net.Interface) error {
 
 	s.ra.raAllowSLAAC = s.conf.RAAllowSLAAC
 	s.ra.raSLAACOnly = s.conf.RASLAACOnly
+	s.ra.dnsOnly = s.conf.RADNSOnly
+	s.ra.dnsSearchList = s.conf.RADNSSearchList
 	s.ra.dnsIPAddr = s.ra.ipAddr
 	s.ra.prefixIPAddr = s.conf.ipStart
 	s.ra.ifaceName = s.conf.InterfaceName
@@ -638,6 +642,13 @@ func (s *v6Server) Start() (err error) {
 		return nil
 	}
 
+	// don't initialize DHCPv6 server if only the DNS server is announced
+	if s.conf.RADNSOnly {
+		log.Debug("not starting dhcpv6 server due to ra_dns_only=true")
+
+		return nil
+	}
+
 	log.Debug("dhcpv6: listening...")
 
 	err = netutil.ValidateMAC(iface.HardwareAddr)
@@ -662,6 +673,8 @@ func (s *v6Server) Start() (err error) {
 	}
 
 	go func() {
+		defer aghos.OnPanicAndExit("dhcpv6")
+
 		err = s.srv.Serve()
 		log.Error("dhcpv6: srv.Serve: %s", err)
 	}()
@@ -676,7 +689,8 @@ func (s *v6Server) Stop() (err error) {
 		return fmt.Errorf("closing ra ctx: %w", err)
 	}
 
-	// DHCPv6 server may not be initialized if ra_slaac_only=true
+	// DHCPv6 server may not be initialized if ra_slaac_only=true or
+	// ra_dns_only=true
 	if s.srv == nil {
 		return
 	}
@@ -702,6 +716,17 @@ func v6Create(conf V6ServerConf) (DHCPServer, error) {
 		return s, nil
 	}
 
+	if conf.RADNSOnly {
+		for _, d := range conf.RADNSSearchList {
+			err := netutil.ValidateHostname(d)
+			if err != nil {
+				return s, fmt.Errorf("dhcpv6: ra dns search list: %w", err)
+			}
+		}
+
+		return s, nil
+	}
+
 	s.conf.ipStart = conf.RangeStart
 	if s.conf.ipStart == nil || s.conf.ipStart.To16() == nil {
 		return s, fmt.Errorf("dhcpv6: invalid range-start IP: %s", conf.RangeStart)
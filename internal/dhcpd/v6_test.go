@@ -1,5 +1,5 @@
-//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
-// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build aix darwin dragonfly freebsd linux netbsd openbsd
 
 package dhcpd
 
@@ -309,3 +309,45 @@ func TestIP6InRange(t *testing.T) {
 		})
 	}
 }
+
+func TestV6Create_raDNSOnly(t *testing.T) {
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		searchList []string
+	}{{
+		name:       "no_search_list",
+		wantErrMsg: "",
+		searchList: nil,
+	}, {
+		name:       "search_list",
+		wantErrMsg: "",
+		searchList: []string{"lan", "home.arpa"},
+	}, {
+		name: "bad_domain",
+		wantErrMsg: `dhcpv6: ra dns search list: ` +
+			`bad hostname "-bad": bad top-level domain name label "-bad": ` +
+			`bad top-level domain name label rune '-'`,
+		searchList: []string{"-bad"},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := v6Create(V6ServerConf{
+				Enabled:         true,
+				RADNSOnly:       true,
+				RADNSSearchList: tc.searchList,
+				notify:          notify6,
+			})
+			if tc.wantErrMsg == "" {
+				assert.NoError(t, err)
+
+				return
+			}
+
+			require.Error(t, err)
+
+			assert.Equal(t, tc.wantErrMsg, err.Error())
+		})
+	}
+}
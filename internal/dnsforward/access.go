@@ -8,9 +8,9 @@ import (
 	"strings"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
-	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/stringutil"
 	"github.com/AdguardTeam/urlfilter"
 	"github.com/AdguardTeam/urlfilter/filterlist"
@@ -19,8 +19,8 @@ import (
 // accessCtx controls IP and client blocking that takes place before all other
 // processing.  An accessCtx is safe for concurrent use.
 type accessCtx struct {
-	allowedIPs *netutil.IPMap
-	blockedIPs *netutil.IPMap
+	allowedIPs *aghnet.IPMap
+	blockedIPs *aghnet.IPMap
 
 	allowedClientIDs *stringutil.Set
 	blockedClientIDs *stringutil.Set
@@ -31,6 +31,10 @@ type accessCtx struct {
 	// netutil.IPNetSet?
 	allowedNets []*net.IPNet
 	blockedNets []*net.IPNet
+
+	// protoScheds are the schedules during which the protocols are
+	// disabled.
+	protoScheds []*protoSched
 }
 
 // unit is a convenient alias for struct{}
@@ -40,7 +44,7 @@ type unit = struct{}
 // which may be an IP address, a CIDR, or a ClientID.
 func processAccessClients(
 	clientStrs []string,
-	ips *netutil.IPMap,
+	ips *aghnet.IPMap,
 	nets *[]*net.IPNet,
 	clientIDs *stringutil.Set,
 ) (err error) {
@@ -68,10 +72,15 @@ func processAccessClients(
 }
 
 // newAccessCtx creates a new accessCtx.
-func newAccessCtx(allowed, blocked, blockedHosts []string) (a *accessCtx, err error) {
+func newAccessCtx(
+	allowed []string,
+	blocked []string,
+	blockedHosts []string,
+	scheds []*ProtoSchedule,
+) (a *accessCtx, err error) {
 	a = &accessCtx{
-		allowedIPs: netutil.NewIPMap(0),
-		blockedIPs: netutil.NewIPMap(0),
+		allowedIPs: aghnet.NewIPMap(0),
+		blockedIPs: aghnet.NewIPMap(0),
 
 		allowedClientIDs: stringutil.NewSet(),
 		blockedClientIDs: stringutil.NewSet(),
@@ -107,6 +116,16 @@ func newAccessCtx(allowed, blocked, blockedHosts []string) (a *accessCtx, err er
 
 	a.blockedHostsEng = urlfilter.NewDNSEngine(rulesStrg)
 
+	for i, ps := range scheds {
+		var sched *protoSched
+		sched, err = newProtoSched(ps)
+		if err != nil {
+			return nil, fmt.Errorf("protocol schedule at index %d: %w", i, err)
+		}
+
+		a.protoScheds = append(a.protoScheds, sched)
+	}
+
 	return a, nil
 }
 
@@ -264,8 +283,12 @@ func (s *Server) handleAccessSet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.serverLock.RLock()
+	scheds := s.conf.ProtoSchedules
+	s.serverLock.RUnlock()
+
 	var a *accessCtx
-	a, err = newAccessCtx(list.AllowedClients, list.DisallowedClients, list.BlockedHosts)
+	a, err = newAccessCtx(list.AllowedClients, list.DisallowedClients, list.BlockedHosts, scheds)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "creating access ctx: %s", err)
 
@@ -3,7 +3,11 @@ package dnsforward
 import (
 	"net"
 	"testing"
+	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/schedule"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -12,12 +16,12 @@ func TestIsBlockedClientID(t *testing.T) {
 	clientID := "client-1"
 	clients := []string{clientID}
 
-	a, err := newAccessCtx(clients, nil, nil)
+	a, err := newAccessCtx(clients, nil, nil, nil)
 	require.NoError(t, err)
 
 	assert.False(t, a.isBlockedClientID(clientID))
 
-	a, err = newAccessCtx(nil, clients, nil)
+	a, err = newAccessCtx(nil, clients, nil, nil)
 	require.NoError(t, err)
 
 	assert.True(t, a.isBlockedClientID(clientID))
@@ -28,7 +32,7 @@ func TestIsBlockedHost(t *testing.T) {
 		"host1",
 		"*.host.com",
 		"||host3.com^",
-	})
+	}, nil)
 	require.NoError(t, err)
 
 	testCases := []struct {
@@ -86,10 +90,10 @@ func TestIsBlockedIP(t *testing.T) {
 		"5.6.7.8/24",
 	}
 
-	allowCtx, err := newAccessCtx(clients, nil, nil)
+	allowCtx, err := newAccessCtx(clients, nil, nil, nil)
 	require.NoError(t, err)
 
-	blockCtx, err := newAccessCtx(nil, clients, nil)
+	blockCtx, err := newAccessCtx(nil, clients, nil, nil)
 	require.NoError(t, err)
 
 	testCases := []struct {
@@ -135,3 +139,243 @@ func TestIsBlockedIP(t *testing.T) {
 		}
 	})
 }
+
+func TestAccessCtx_isDisabledProto(t *testing.T) {
+	a, err := newAccessCtx(nil, nil, nil, []*ProtoSchedule{{
+		Proto:     "dns",
+		Listeners: []string{"192.168.2.0/24"},
+		Config: schedule.Config{
+			Days:  []string{"mon", "tue", "wed", "thu", "fri"},
+			Start: "09:00",
+			End:   "18:00",
+		},
+	}, {
+		Proto: "doh",
+		Config: schedule.Config{
+			Start: "23:00",
+			End:   "06:00",
+		},
+	}})
+	require.NoError(t, err)
+
+	guestIP, mainIP := net.IP{192, 168, 2, 1}, net.IP{192, 168, 1, 1}
+
+	// 2022-01-17 is a Monday.
+	monNoon := time.Date(2022, 1, 17, 12, 0, 0, 0, time.UTC)
+	satNoon := time.Date(2022, 1, 22, 12, 0, 0, 0, time.UTC)
+	monNight := time.Date(2022, 1, 17, 23, 30, 0, 0, time.UTC)
+	tueEarly := time.Date(2022, 1, 18, 5, 59, 0, 0, time.UTC)
+	tueMorning := time.Date(2022, 1, 18, 6, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		now   time.Time
+		name  string
+		proto proxy.Proto
+		ip    net.IP
+		want  bool
+	}{{
+		now:   monNoon,
+		name:  "dns_guest_workday",
+		proto: proxy.ProtoUDP,
+		ip:    guestIP,
+		want:  true,
+	}, {
+		now:   monNoon,
+		name:  "tcp_guest_workday",
+		proto: proxy.ProtoTCP,
+		ip:    guestIP,
+		want:  true,
+	}, {
+		now:   monNoon,
+		name:  "dns_main_workday",
+		proto: proxy.ProtoUDP,
+		ip:    mainIP,
+		want:  false,
+	}, {
+		now:   monNoon,
+		name:  "dns_unknown_listener",
+		proto: proxy.ProtoUDP,
+		ip:    nil,
+		want:  false,
+	}, {
+		now:   satNoon,
+		name:  "dns_guest_weekend",
+		proto: proxy.ProtoUDP,
+		ip:    guestIP,
+		want:  false,
+	}, {
+		now:   monNight,
+		name:  "doh_night",
+		proto: proxy.ProtoHTTPS,
+		ip:    nil,
+		want:  true,
+	}, {
+		now:   tueEarly,
+		name:  "doh_early_morning",
+		proto: proxy.ProtoHTTPS,
+		ip:    mainIP,
+		want:  true,
+	}, {
+		now:   tueMorning,
+		name:  "doh_morning",
+		proto: proxy.ProtoHTTPS,
+		ip:    mainIP,
+		want:  false,
+	}, {
+		now:   monNight,
+		name:  "dot_night",
+		proto: proxy.ProtoTLS,
+		ip:    mainIP,
+		want:  false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, a.isDisabledProto(tc.proto, tc.ip, tc.now))
+		})
+	}
+
+	t.Run("bad_schedule", func(t *testing.T) {
+		_, err = newAccessCtx(nil, nil, nil, []*ProtoSchedule{{
+			Proto: "gopher",
+			Config: schedule.Config{
+				Start: "09:00",
+				End:   "18:00",
+			},
+		}})
+		assert.Error(t, err)
+
+		_, err = newAccessCtx(nil, nil, nil, []*ProtoSchedule{{
+			Proto: "dot",
+			Config: schedule.Config{
+				Start: "09:00",
+				End:   "09:00",
+			},
+		}})
+		assert.Error(t, err)
+	})
+}
+
+func TestServer_beforeRequestHandler_errorResponses(t *testing.T) {
+	a, err := newAccessCtx(nil, []string{"192.168.1.3"}, []string{"blocked.example"}, nil)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name      string
+		mode      ErrorResponseMode
+		ip        net.IP
+		host      string
+		proto     proxy.Proto
+		wantRcode int
+		wantReply bool
+	}{{
+		name:      "disallowed_default_udp",
+		mode:      ErrorResponseModeDefault,
+		ip:        net.IP{192, 168, 1, 3},
+		host:      "example.org.",
+		proto:     proxy.ProtoUDP,
+		wantRcode: 0,
+		wantReply: false,
+	}, {
+		name:      "disallowed_default_tcp",
+		mode:      ErrorResponseModeDefault,
+		ip:        net.IP{192, 168, 1, 3},
+		host:      "example.org.",
+		proto:     proxy.ProtoTCP,
+		wantRcode: dns.RcodeRefused,
+		wantReply: true,
+	}, {
+		name:      "disallowed_drop_tcp",
+		mode:      ErrorResponseModeDrop,
+		ip:        net.IP{192, 168, 1, 3},
+		host:      "example.org.",
+		proto:     proxy.ProtoTCP,
+		wantRcode: 0,
+		wantReply: false,
+	}, {
+		name:      "disallowed_refused_udp",
+		mode:      ErrorResponseModeREFUSED,
+		ip:        net.IP{192, 168, 1, 3},
+		host:      "example.org.",
+		proto:     proxy.ProtoUDP,
+		wantRcode: dns.RcodeRefused,
+		wantReply: true,
+	}, {
+		name:      "blocked_host_nxdomain_udp",
+		mode:      ErrorResponseModeNXDOMAIN,
+		ip:        net.IP{192, 168, 1, 2},
+		host:      "blocked.example.",
+		proto:     proxy.ProtoUDP,
+		wantRcode: dns.RcodeNameError,
+		wantReply: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{
+				access: a,
+			}
+			s.conf.DisallowedResponse = tc.mode
+			s.conf.BlockedHostsResponse = tc.mode
+			s.conf.ExtendedErrors = true
+
+			req := (&dns.Msg{}).SetQuestion(tc.host, dns.TypeA)
+			req.SetEdns0(dns.DefaultMsgSize, false)
+			pctx := &proxy.DNSContext{
+				Proto: tc.proto,
+				Req:   req,
+				Addr:  &net.UDPAddr{IP: tc.ip, Port: 53},
+			}
+
+			reply, rerr := s.beforeRequestHandler(nil, pctx)
+			require.NoError(t, rerr)
+
+			require.Equal(t, tc.wantReply, reply)
+			if !tc.wantReply {
+				assert.Nil(t, pctx.Res)
+
+				return
+			}
+
+			require.NotNil(t, pctx.Res)
+
+			assert.Equal(t, tc.wantRcode, pctx.Res.Rcode)
+			assert.Len(t, extendedErrors(pctx.Res), 1)
+		})
+	}
+
+	t.Run("ratelimit", func(t *testing.T) {
+		s := &Server{
+			access: a,
+		}
+		s.conf.Ratelimit = 1
+		s.conf.RatelimitResponse = ErrorResponseModeREFUSED
+
+		var err error
+		s.ratelimiter, err = newRatelimiter(&s.conf.FilteringConfig)
+		require.NoError(t, err)
+
+		newCtx := func() (pctx *proxy.DNSContext) {
+			return &proxy.DNSContext{
+				Proto: proxy.ProtoUDP,
+				Req:   (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA),
+				Addr:  &net.UDPAddr{IP: net.IP{192, 168, 1, 2}, Port: 53},
+			}
+		}
+
+		pctx := newCtx()
+		reply, rerr := s.beforeRequestHandler(nil, pctx)
+		require.NoError(t, rerr)
+
+		assert.True(t, reply)
+		assert.Nil(t, pctx.Res)
+
+		pctx = newCtx()
+		reply, rerr = s.beforeRequestHandler(nil, pctx)
+		require.NoError(t, rerr)
+
+		assert.True(t, reply)
+		require.NotNil(t, pctx.Res)
+		assert.Equal(t, dns.RcodeRefused, pctx.Res.Rcode)
+	})
+}
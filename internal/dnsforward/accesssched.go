@@ -0,0 +1,180 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/schedule"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+)
+
+// ProtoSchedule is the schedule during which a protocol is disabled.
+type ProtoSchedule struct {
+	// Proto is the disabled protocol.  It must be one of "dns" for plain
+	// DNS over UDP and TCP, "doh", "dot", "doq", or "dnscrypt".
+	Proto string `yaml:"proto"`
+
+	// Listeners are the IP addresses or CIDRs of the listeners on which the
+	// protocol is disabled.  For plain DNS, the addresses are matched
+	// against the ones from bind_hosts.  If Listeners are empty, the
+	// protocol is disabled on all the listeners.
+	Listeners []string `yaml:"listeners"`
+
+	// Config is the time interval during which the protocol is disabled.
+	schedule.Config `yaml:",inline"`
+}
+
+// protoSched is the parsed ProtoSchedule.
+type protoSched struct {
+	// protos are the disabled protocols.
+	protos []proxy.Proto
+
+	// nets are the networks of the listeners.  If it's empty, the schedule
+	// applies to all the listeners.
+	nets []*net.IPNet
+
+	// ivl is the interval during which the protocol is disabled.
+	ivl *schedule.Interval
+}
+
+// scheduleProtos maps the protocol names of ProtoSchedule to the protocols.
+var scheduleProtos = map[string][]proxy.Proto{
+	"dns":      {proxy.ProtoUDP, proxy.ProtoTCP},
+	"doh":      {proxy.ProtoHTTPS},
+	"dot":      {proxy.ProtoTLS},
+	"doq":      {proxy.ProtoQUIC},
+	"dnscrypt": {proxy.ProtoDNSCrypt},
+}
+
+// newProtoSched parses the schedule.
+func newProtoSched(ps *ProtoSchedule) (s *protoSched, err error) {
+	s = &protoSched{}
+
+	var ok bool
+	s.protos, ok = scheduleProtos[strings.ToLower(ps.Proto)]
+	if !ok {
+		return nil, fmt.Errorf("bad proto %q", ps.Proto)
+	}
+
+	s.nets, err = parseListenerNets(ps.Listeners)
+	if err != nil {
+		return nil, err
+	}
+
+	s.ivl, err = schedule.New(&ps.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// parseListenerNets parses the IP addresses or CIDRs of the listeners.
+func parseListenerNets(listeners []string) (nets []*net.IPNet, err error) {
+	for _, l := range listeners {
+		var n *net.IPNet
+		if ip := net.ParseIP(l); ip != nil {
+			bits := net.IPv6len * 8
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, net.IPv4len*8
+			}
+
+			n = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		} else if _, n, err = net.ParseCIDR(l); err != nil {
+			return nil, fmt.Errorf("bad listener %q: %w", l, err)
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// listenerMatches returns true if ip is in one of nets or if nets are empty.
+// ip may be nil, in which case it only matches the empty nets.
+func listenerMatches(nets []*net.IPNet, ip net.IP) (ok bool) {
+	if len(nets) == 0 {
+		return true
+	} else if ip == nil {
+		return false
+	}
+
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasProto returns true if the schedule applies to proto.
+func (s *protoSched) hasProto(proto proxy.Proto) (ok bool) {
+	for _, p := range s.protos {
+		if p == proto {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasListener returns true if the schedule applies to the listener with ip.
+// ip may be nil, in which case it only matches the schedules for all
+// listeners.
+func (s *protoSched) hasListener(ip net.IP) (ok bool) {
+	return listenerMatches(s.nets, ip)
+}
+
+// isDisabledProto returns true if the requests received over proto on a
+// listener with localIP are disabled at the moment now.
+func (a *accessCtx) isDisabledProto(proto proxy.Proto, localIP net.IP, now time.Time) (ok bool) {
+	for _, s := range a.protoScheds {
+		if s.hasProto(proto) && s.hasListener(localIP) && s.ivl.Contains(now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isDisabledProto returns true if the protocol of the request in pctx is
+// currently disabled on the listener that has received it.
+func (s *Server) isDisabledProto(pctx *proxy.DNSContext) (ok bool) {
+	s.serverLock.RLock()
+	defer s.serverLock.RUnlock()
+
+	if len(s.access.protoScheds) == 0 {
+		return false
+	}
+
+	return s.access.isDisabledProto(pctx.Proto, localIPFromDNSContext(pctx), time.Now())
+}
+
+// localIPFromDNSContext returns the local IP address on which the request has
+// been received, if it's known.
+func localIPFromDNSContext(pctx *proxy.DNSContext) (ip net.IP) {
+	var addr net.Addr
+	switch {
+	case pctx.Conn != nil:
+		addr = pctx.Conn.LocalAddr()
+	case pctx.HTTPRequest != nil:
+		addr, _ = pctx.HTTPRequest.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	case pctx.QUICConnection != nil:
+		addr = pctx.QUICConnection.LocalAddr()
+	default:
+		// Go on.
+	}
+
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,140 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Modes of filtering the answers within the blocked networks.
+const (
+	answerNetsModeBlock = "block"
+	answerNetsModeStrip = "strip"
+)
+
+// parseAnswerNets parses the IP addresses and the CIDRs of the blocked answer
+// networks as well as the mode of filtering the answers within them.  The
+// networks are matched by the filter along with the ones from the IP
+// blocklists, see filtering.DNSFilter.MatchAnswerIP.  Unlike the filtering
+// rules matching the addresses, they cover the fast-flux domains, which change
+// their names but keep their address space.
+func parseAnswerNets(addrs []string, mode string) (nets []*net.IPNet, strip bool, err error) {
+	switch mode {
+	case "", answerNetsModeBlock:
+		// Go on.
+	case answerNetsModeStrip:
+		strip = true
+	default:
+		return nil, false, fmt.Errorf("blocked_answer_mode: bad mode %q", mode)
+	}
+
+	for i, a := range addrs {
+		var n *net.IPNet
+		n, err = parseIPNet(a)
+		if err != nil {
+			return nil, false, fmt.Errorf("blocked_answer_nets at index %d: %w", i, err)
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, strip, nil
+}
+
+// parseIPNet parses either an IP address, which is converted into the
+// single-address network, or a CIDR.
+func parseIPNet(s string) (n *net.IPNet, err error) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := net.IPv6len * 8
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, net.IPv4len*8
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, n, err = net.ParseCIDR(s)
+
+	return n, err
+}
+
+// processAnswerNets filters the A and AAAA answers within the blocked networks,
+// both the static ones and the ones from the IP blocklists, out of the
+// responses of the upstreams.
+func (s *Server) processAnswerNets(dctx *dnsContext) (rc resultCode) {
+	pctx := dctx.proxyCtx
+	if !dctx.protectionEnabled ||
+		!dctx.responseFromUpstream ||
+		pctx.Res == nil ||
+		(dctx.setts != nil && !dctx.setts.FilteringEnabled) {
+		return resultCodeSuccess
+	}
+
+	// Don't filter the allowlisted, rewritten, and already blocked
+	// responses.
+	if res := dctx.result; res != nil && (res.IsFiltered || res.Reason != filtering.NotFilteredNotFound) {
+		return resultCodeSuccess
+	}
+
+	s.serverLock.RLock()
+	f, strip := s.dnsFilter, s.answerNetsStrip
+	s.serverLock.RUnlock()
+	if f == nil {
+		return resultCodeSuccess
+	}
+
+	host := pctx.Req.Question[0].Name
+	ans := make([]dns.RR, 0, len(pctx.Res.Answer))
+	for _, rr := range pctx.Res.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			// Go on.
+		}
+
+		var n *net.IPNet
+		if ip != nil {
+			n = f.MatchAnswerIP(ip)
+		}
+
+		if n == nil {
+			ans = append(ans, rr)
+
+			continue
+		}
+
+		if !strip {
+			log.Debug("dns: answer %s for %q is in blocked network %s", ip, host, n)
+
+			res := &filtering.Result{
+				Rules: []*filtering.ResultRule{{
+					Text:         n.String(),
+					FilterListID: filtering.AnswerNetsListID,
+				}},
+				Reason:     filtering.FilteredBlockList,
+				IsFiltered: true,
+			}
+
+			dctx.origResp = pctx.Res
+			dctx.result = res
+			pctx.Res = s.genDNSFilterMessage(pctx, res)
+
+			return resultCodeSuccess
+		}
+	}
+
+	if stripped := len(pctx.Res.Answer) - len(ans); stripped > 0 {
+		log.Debug("dns: stripped %d answers for %q in blocked networks", stripped, host)
+
+		pctx.Res.Answer = ans
+	}
+
+	return resultCodeSuccess
+}
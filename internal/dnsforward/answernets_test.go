@@ -0,0 +1,165 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAnswerNets(t *testing.T) {
+	testCases := []struct {
+		name       string
+		mode       string
+		wantErrMsg string
+		addrs      []string
+		wantLen    int
+		wantStrip  bool
+	}{{
+		name:       "none",
+		mode:       "",
+		wantErrMsg: "",
+		addrs:      nil,
+		wantLen:    0,
+		wantStrip:  false,
+	}, {
+		name:       "valid",
+		mode:       answerNetsModeStrip,
+		wantErrMsg: "",
+		addrs:      []string{"1.2.3.0/24", "2001:db8::1"},
+		wantLen:    2,
+		wantStrip:  true,
+	}, {
+		name:       "bad_mode",
+		mode:       "drop",
+		wantErrMsg: `blocked_answer_mode: bad mode "drop"`,
+		addrs:      []string{"1.2.3.0/24"},
+		wantLen:    0,
+		wantStrip:  false,
+	}, {
+		name: "bad_net",
+		mode: answerNetsModeBlock,
+		wantErrMsg: "blocked_answer_nets at index 1: " +
+			"invalid CIDR address: 1.2.3.0/33",
+		addrs:     []string{"1.2.3.4", "1.2.3.0/33"},
+		wantLen:   0,
+		wantStrip: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			nets, strip, err := parseAnswerNets(tc.addrs, tc.mode)
+			if tc.wantErrMsg == "" {
+				assert.NoError(t, err)
+			} else {
+				require.Error(t, err)
+
+				assert.Equal(t, tc.wantErrMsg, err.Error())
+			}
+
+			assert.Len(t, nets, tc.wantLen)
+			assert.Equal(t, tc.wantStrip, strip)
+		})
+	}
+}
+
+func TestServer_processAnswerNets(t *testing.T) {
+	const host = "fastflux.example."
+
+	blockedIP, otherIP := net.IP{1, 2, 3, 4}, net.IP{5, 6, 7, 8}
+
+	testCases := []struct {
+		result     *filtering.Result
+		name       string
+		mode       string
+		wantIPs    []net.IP
+		wantFilter bool
+	}{{
+		result:     nil,
+		name:       "block",
+		mode:       answerNetsModeBlock,
+		wantIPs:    []net.IP{{0, 0, 0, 0}},
+		wantFilter: true,
+	}, {
+		result:     nil,
+		name:       "strip",
+		mode:       answerNetsModeStrip,
+		wantIPs:    []net.IP{otherIP},
+		wantFilter: false,
+	}, {
+		result:     &filtering.Result{Reason: filtering.NotFilteredAllowList},
+		name:       "allowlisted",
+		mode:       answerNetsModeBlock,
+		wantIPs:    []net.IP{blockedIP, otherIP},
+		wantFilter: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			nets, strip, err := parseAnswerNets([]string{"1.2.3.0/24"}, tc.mode)
+			require.NoError(t, err)
+
+			f := filtering.New(&filtering.Config{}, nil)
+			t.Cleanup(f.Close)
+
+			f.SetBlockedAnswerNets(nets)
+
+			s := &Server{
+				conf: ServerConfig{
+					FilteringConfig: FilteringConfig{
+						BlockingMode: BlockingModeNullIP,
+					},
+				},
+				dnsFilter:       f,
+				answerNetsStrip: strip,
+			}
+
+			req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+			resp := (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{
+				newA(host, blockedIP),
+				newA(host, otherIP),
+			}
+
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Req: req,
+					Res: resp,
+				},
+				result:               tc.result,
+				protectionEnabled:    true,
+				responseFromUpstream: true,
+			}
+
+			rc := s.processAnswerNets(dctx)
+			require.Equal(t, resultCodeSuccess, rc)
+
+			var ips []net.IP
+			for _, rr := range dctx.proxyCtx.Res.Answer {
+				a, ok := rr.(*dns.A)
+				require.True(t, ok)
+
+				ips = append(ips, a.A.To4())
+			}
+
+			assert.Equal(t, tc.wantIPs, ips)
+
+			if !tc.wantFilter {
+				assert.Equal(t, tc.result, dctx.result)
+
+				return
+			}
+
+			require.NotNil(t, dctx.result)
+			require.Len(t, dctx.result.Rules, 1)
+
+			assert.True(t, dctx.result.IsFiltered)
+			assert.Equal(t, "1.2.3.0/24", dctx.result.Rules[0].Text)
+			assert.Equal(t, resp, dctx.origResp)
+		})
+	}
+}
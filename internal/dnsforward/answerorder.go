@@ -0,0 +1,166 @@
+package dnsforward
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Answer ordering policies.
+const (
+	// AnswerOrderIPv4First puts the A records before the AAAA ones.
+	AnswerOrderIPv4First = "ipv4_first"
+
+	// AnswerOrderIPv6First puts the AAAA records before the A ones.
+	AnswerOrderIPv6First = "ipv6_first"
+
+	// AnswerOrderInterleave alternates the A and AAAA records starting with
+	// the family of the first one.
+	AnswerOrderInterleave = "interleave"
+)
+
+// ValidateAnswerOrder returns an error if order isn't a known answer ordering
+// policy.  An empty order means that the order of the records is kept.
+func ValidateAnswerOrder(order string) (err error) {
+	switch order {
+	case "", AnswerOrderIPv4First, AnswerOrderIPv6First, AnswerOrderInterleave:
+		return nil
+	default:
+		return fmt.Errorf("unknown value %q", order)
+	}
+}
+
+// orderAddrRecords reorders the A and AAAA records of rrs according to order.
+// The other records keep their positions, and the records of the same family
+// keep their relative order.
+func orderAddrRecords(rrs []dns.RR, order string) {
+	var pos []int
+	var v4, v6 []dns.RR
+	for i, rr := range rrs {
+		switch rr.Header().Rrtype {
+		case dns.TypeA:
+			v4 = append(v4, rr)
+		case dns.TypeAAAA:
+			v6 = append(v6, rr)
+		default:
+			continue
+		}
+
+		pos = append(pos, i)
+	}
+
+	if len(v4) == 0 || len(v6) == 0 {
+		return
+	}
+
+	ordered := make([]dns.RR, 0, len(pos))
+	switch order {
+	case AnswerOrderIPv4First:
+		ordered = append(append(ordered, v4...), v6...)
+	case AnswerOrderIPv6First:
+		ordered = append(append(ordered, v6...), v4...)
+	case AnswerOrderInterleave:
+		first, second := v4, v6
+		if rrs[pos[0]].Header().Rrtype == dns.TypeAAAA {
+			first, second = v6, v4
+		}
+
+		for i := 0; i < len(first) || i < len(second); i++ {
+			if i < len(first) {
+				ordered = append(ordered, first[i])
+			}
+
+			if i < len(second) {
+				ordered = append(ordered, second[i])
+			}
+		}
+	default:
+		return
+	}
+
+	for i, p := range pos {
+		rrs[p] = ordered[i]
+	}
+}
+
+// processAnswerOrder applies the IPv4 and IPv6 preferences of the client to
+// the response.
+func (s *Server) processAnswerOrder(dctx *dnsContext) (rc resultCode) {
+	pctx := dctx.proxyCtx
+	setts := dctx.setts
+	if pctx.Res == nil || setts == nil || (setts.AnswerOrder == "" && !setts.SuppressAAAAWithoutA) {
+		return resultCodeSuccess
+	}
+
+	if setts.SuppressAAAAWithoutA {
+		s.suppressAAAA(dctx)
+	}
+
+	if setts.AnswerOrder != "" {
+		orderAddrRecords(pctx.Res.Answer, setts.AnswerOrder)
+		orderAddrRecords(pctx.Res.Extra, setts.AnswerOrder)
+	}
+
+	return resultCodeSuccess
+}
+
+// suppressAAAA removes the AAAA records from the response to an AAAA request,
+// if the requested name has no A records, for the stub resolvers, which are
+// known to break on the IPv6-only names.
+func (s *Server) suppressAAAA(dctx *dnsContext) {
+	pctx := dctx.proxyCtx
+	q := pctx.Req.Question[0]
+	if q.Qtype != dns.TypeAAAA || pctx.Res.Rcode != dns.RcodeSuccess {
+		return
+	} else if res := dctx.result; res != nil && res.IsFiltered {
+		return
+	}
+
+	var hasAAAA bool
+	for _, rr := range pctx.Res.Answer {
+		if rr.Header().Rrtype == dns.TypeAAAA {
+			hasAAAA = true
+
+			break
+		}
+	}
+
+	if !hasAAAA || s.hasARecords(q.Name) {
+		return
+	}
+
+	log.Debug("dns: %s has no a records, removing aaaa records", q.Name)
+
+	ans := pctx.Res.Answer[:0]
+	for _, rr := range pctx.Res.Answer {
+		if rr.Header().Rrtype != dns.TypeAAAA {
+			ans = append(ans, rr)
+		}
+	}
+
+	pctx.Res.Answer = ans
+}
+
+// hasARecords returns true if name has A records.  It also returns true if
+// the lookup fails, so that the AAAA records aren't removed by mistake.
+func (s *Server) hasARecords(name string) (ok bool) {
+	pctx := &proxy.DNSContext{
+		Proto:     proxy.ProtoUDP,
+		Req:       (&dns.Msg{}).SetQuestion(name, dns.TypeA),
+		StartTime: time.Now(),
+	}
+
+	err := s.internalProxy.Resolve(pctx)
+	if err != nil || pctx.Res == nil || pctx.Res.Rcode != dns.RcodeSuccess {
+		log.Debug("dns: looking up a records of %s: %v", name, err)
+
+		return true
+	}
+
+	_, answered := cnameChain(pctx.Res.Answer, name, dns.TypeA)
+
+	return answered
+}
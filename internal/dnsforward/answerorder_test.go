@@ -0,0 +1,174 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newAAAA returns a new AAAA record for host with ip.
+func newAAAA(host string, ip net.IP) (rr *dns.AAAA) {
+	return &dns.AAAA{
+		Hdr: dns.RR_Header{
+			Name:   host,
+			Rrtype: dns.TypeAAAA,
+			Class:  dns.ClassINET,
+			Ttl:    60,
+		},
+		AAAA: ip,
+	}
+}
+
+// noDataUpstream is an upstream, which responds to every request with an empty
+// NOERROR response, except for the A requests for the names in a.
+type noDataUpstream struct {
+	a map[string]net.IP
+}
+
+// Exchange implements the upstream.Upstream interface for *noDataUpstream.
+func (u *noDataUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	resp = (&dns.Msg{}).SetReply(req)
+
+	q := req.Question[0]
+	if ip, ok := u.a[q.Name]; ok && q.Qtype == dns.TypeA {
+		resp.Answer = append(resp.Answer, newA(q.Name, ip))
+	}
+
+	return resp, nil
+}
+
+// Address implements the upstream.Upstream interface for *noDataUpstream.
+func (u *noDataUpstream) Address() (addr string) {
+	return "192.0.2.53:53"
+}
+
+// Close implements the upstream.Upstream interface for *noDataUpstream.
+func (u *noDataUpstream) Close() (err error) {
+	return nil
+}
+
+// rrTypes returns the types of the records of rrs.
+func rrTypes(rrs []dns.RR) (types []uint16) {
+	for _, rr := range rrs {
+		types = append(types, rr.Header().Rrtype)
+	}
+
+	return types
+}
+
+func TestOrderAddrRecords(t *testing.T) {
+	const host = "example.org."
+
+	a1, a2 := newA(host, net.IP{192, 0, 2, 1}), newA(host, net.IP{192, 0, 2, 2})
+	aaaa1, aaaa2 := newAAAA(host, net.ParseIP("2001:db8::1")), newAAAA(host, net.ParseIP("2001:db8::2"))
+	cname := newCNAME("www.example.org.", host)
+
+	testCases := []struct {
+		name  string
+		order string
+		rrs   []dns.RR
+		want  []dns.RR
+	}{{
+		name:  "ipv4_first",
+		order: AnswerOrderIPv4First,
+		rrs:   []dns.RR{cname, aaaa1, a1, aaaa2, a2},
+		want:  []dns.RR{cname, a1, a2, aaaa1, aaaa2},
+	}, {
+		name:  "ipv6_first",
+		order: AnswerOrderIPv6First,
+		rrs:   []dns.RR{a1, a2, cname, aaaa1, aaaa2},
+		want:  []dns.RR{aaaa1, aaaa2, cname, a1, a2},
+	}, {
+		name:  "interleave",
+		order: AnswerOrderInterleave,
+		rrs:   []dns.RR{a1, a2, aaaa1, aaaa2},
+		want:  []dns.RR{a1, aaaa1, a2, aaaa2},
+	}, {
+		name:  "interleave_ipv6",
+		order: AnswerOrderInterleave,
+		rrs:   []dns.RR{aaaa1, a1, a2},
+		want:  []dns.RR{aaaa1, a1, a2},
+	}, {
+		name:  "single_family",
+		order: AnswerOrderIPv6First,
+		rrs:   []dns.RR{a1, cname, a2},
+		want:  []dns.RR{a1, cname, a2},
+	}, {
+		name:  "none",
+		order: "",
+		rrs:   []dns.RR{aaaa1, a1},
+		want:  []dns.RR{aaaa1, a1},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			orderAddrRecords(tc.rrs, tc.order)
+			assert.Equal(t, tc.want, tc.rrs)
+		})
+	}
+}
+
+func TestServer_processAnswerOrder(t *testing.T) {
+	s := createTestServer(t, &filtering.Config{}, ServerConfig{
+		UDPListenAddrs: []*net.UDPAddr{{}},
+		TCPListenAddrs: []*net.TCPAddr{{}},
+	}, nil)
+	s.internalProxy.UpstreamConfig.Upstreams = []upstream.Upstream{
+		&noDataUpstream{
+			a: map[string]net.IP{"www.dual.example.": {192, 0, 2, 1}},
+		},
+	}
+
+	testCases := []struct {
+		name      string
+		host      string
+		setts     *filtering.Settings
+		wantTypes []uint16
+	}{{
+		name:      "ipv6_only",
+		host:      "ipv6.example.",
+		setts:     &filtering.Settings{SuppressAAAAWithoutA: true},
+		wantTypes: []uint16{dns.TypeCNAME},
+	}, {
+		name:      "dual_stack",
+		host:      "dual.example.",
+		setts:     &filtering.Settings{SuppressAAAAWithoutA: true},
+		wantTypes: []uint16{dns.TypeCNAME, dns.TypeAAAA},
+	}, {
+		name:      "disabled",
+		host:      "ipv6.example.",
+		setts:     &filtering.Settings{},
+		wantTypes: []uint16{dns.TypeCNAME, dns.TypeAAAA},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := (&dns.Msg{}).SetQuestion("www."+tc.host, dns.TypeAAAA)
+			resp := (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{
+				newCNAME("www."+tc.host, tc.host),
+				newAAAA(tc.host, net.ParseIP("2001:db8::1")),
+			}
+
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Req: req,
+					Res: resp,
+				},
+				setts:  tc.setts,
+				result: &filtering.Result{},
+			}
+
+			rc := s.processAnswerOrder(dctx)
+			require.Equal(t, resultCodeSuccess, rc)
+
+			assert.Equal(t, tc.wantTypes, rrTypes(dctx.proxyCtx.Res.Answer))
+		})
+	}
+}
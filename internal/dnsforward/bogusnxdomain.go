@@ -0,0 +1,78 @@
+package dnsforward
+
+import (
+	"net"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// newBogusNXDomain parses the IP addresses and the CIDRs of the networks of the
+// bogus NXDOMAIN addresses.  The invalid ones are logged and skipped.
+func newBogusNXDomain(addrs []string) (nets []*net.IPNet) {
+	for _, a := range addrs {
+		n, err := parseIPNet(a)
+		if err != nil {
+			log.Error("dns: invalid bogus nxdomain address %q: %s", a, err)
+
+			continue
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets
+}
+
+// bogusNXDomainIP returns the first address from the A and AAAA records of
+// answer, which is within one of nets, or nil if there is none.
+func bogusNXDomainIP(answer []dns.RR, nets []*net.IPNet) (ip net.IP) {
+	for _, rr := range answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return ip
+			}
+		}
+	}
+
+	return nil
+}
+
+// processBogusNXDomain replaces the responses of the upstreams containing the
+// addresses from BogusNXDomain with NXDOMAIN ones, like the bogus-nxdomain
+// option of dnsmasq does.  Some ISP resolvers answer the requests for the
+// nonexistent names with the addresses of their search pages.
+func (s *Server) processBogusNXDomain(dctx *dnsContext) (rc resultCode) {
+	pctx := dctx.proxyCtx
+	if !dctx.responseFromUpstream || pctx.Res == nil || pctx.Res.Rcode != dns.RcodeSuccess {
+		return resultCodeSuccess
+	}
+
+	s.serverLock.RLock()
+	nets := s.bogusNXDomain
+	s.serverLock.RUnlock()
+	if len(nets) == 0 {
+		return resultCodeSuccess
+	}
+
+	ip := bogusNXDomainIP(pctx.Res.Answer, nets)
+	if ip == nil {
+		return resultCodeSuccess
+	}
+
+	log.Debug("dns: bogus nxdomain address %s in answer for %q", ip, pctx.Req.Question[0].Name)
+
+	dctx.origResp = pctx.Res
+	pctx.Res = s.genNXDomain(pctx.Req)
+
+	return resultCodeSuccess
+}
@@ -0,0 +1,75 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_processBogusNXDomain(t *testing.T) {
+	const host = "nonexistent.example."
+
+	nets := newBogusNXDomain([]string{"192.0.2.1", "bad", "2001:db8::/64"})
+	require.Len(t, nets, 2)
+
+	s := &Server{bogusNXDomain: nets}
+
+	testCases := []struct {
+		name         string
+		answer       []dns.RR
+		fromUpstream bool
+		wantRcode    int
+	}{{
+		name:         "bogus_a",
+		answer:       []dns.RR{newA(host, net.IP{192, 0, 2, 1})},
+		fromUpstream: true,
+		wantRcode:    dns.RcodeNameError,
+	}, {
+		name: "bogus_aaaa_after_cname",
+		answer: []dns.RR{
+			newCNAME(host, "search.example."),
+			newAAAA("search.example.", net.ParseIP("2001:db8::5")),
+		},
+		fromUpstream: true,
+		wantRcode:    dns.RcodeNameError,
+	}, {
+		name:         "other",
+		answer:       []dns.RR{newA(host, net.IP{192, 0, 2, 2})},
+		fromUpstream: true,
+		wantRcode:    dns.RcodeSuccess,
+	}, {
+		name:         "not_upstream",
+		answer:       []dns.RR{newA(host, net.IP{192, 0, 2, 1})},
+		fromUpstream: false,
+		wantRcode:    dns.RcodeSuccess,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+			resp := (&dns.Msg{}).SetReply(req)
+			resp.Answer = tc.answer
+
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Req: req,
+					Res: resp,
+				},
+				responseFromUpstream: tc.fromUpstream,
+			}
+
+			rc := s.processBogusNXDomain(dctx)
+			require.Equal(t, resultCodeSuccess, rc)
+
+			assert.Equal(t, tc.wantRcode, dctx.proxyCtx.Res.Rcode)
+			if tc.wantRcode == dns.RcodeNameError {
+				assert.Empty(t, dctx.proxyCtx.Res.Answer)
+				assert.Same(t, resp, dctx.origResp)
+			}
+		})
+	}
+}
@@ -0,0 +1,477 @@
+package dnsforward
+
+import (
+	"container/list"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/google/renameio/maybe"
+	"github.com/miekg/dns"
+)
+
+// cacheSnapshotInterval is the interval between the periodic snapshots of the
+// cache.
+const cacheSnapshotInterval = 10 * time.Minute
+
+// cacheSnapshotItem is a response kept in the cache snapshot.
+type cacheSnapshotItem struct {
+	// Time is the time when the response has been received.
+	Time time.Time `json:"time"`
+
+	// Msg is the packed response.
+	Msg []byte `json:"msg"`
+
+	// TTL is the minimum TTL of the records of the response.
+	TTL uint32 `json:"ttl"`
+
+	// key is the key of the response as returned by cacheSnapshotKey.
+	key string
+}
+
+// expired returns true if the response in item is expired at now.
+func (item *cacheSnapshotItem) expired(now time.Time) (ok bool) {
+	return !now.Before(item.Time.Add(time.Duration(item.TTL) * time.Second))
+}
+
+// response returns the response of item with its TTLs decreased by the time
+// elapsed since it's been received.
+func (item *cacheSnapshotItem) response(now time.Time) (resp *dns.Msg, err error) {
+	resp = &dns.Msg{}
+	err = resp.Unpack(item.Msg)
+	if err != nil {
+		return nil, err
+	}
+
+	elapsed := uint32(now.Sub(item.Time) / time.Second)
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range rrs {
+			if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT {
+				hdr.Ttl -= elapsed
+			}
+		}
+	}
+
+	return resp, nil
+}
+
+// cacheSnapshotKey returns the key of the responses to the messages with the
+// same question as m.  Like the general cache of dnsproxy, it only takes the
+// question into account.  key is empty if m doesn't have exactly one question.
+func cacheSnapshotKey(m *dns.Msg) (key string) {
+	if len(m.Question) != 1 {
+		return ""
+	}
+
+	q := m.Question[0]
+	b := make([]byte, 4, 4+len(q.Name))
+	binary.BigEndian.PutUint16(b, q.Qtype)
+	binary.BigEndian.PutUint16(b[2:], q.Qclass)
+
+	return string(append(b, strings.ToLower(q.Name)...))
+}
+
+// cacheSnapshotFile is the structure of the snapshot file.
+type cacheSnapshotFile struct {
+	Items []*cacheSnapshotItem `json:"items"`
+}
+
+// cacheSnapshot mirrors the general cache of dnsproxy to save it to the file
+// and to put the saved responses back into the cache after a restart, since
+// dnsproxy doesn't allow exporting or importing the items of its cache.
+type cacheSnapshot struct {
+	// mu protects all the fields except done.
+	mu *sync.Mutex
+
+	// items are the elements of lru by the keys of their responses.
+	items map[string]*list.Element
+
+	// lru contains *cacheSnapshotItem values from the most recently received
+	// to the least recently received one.
+	lru *list.List
+
+	// restored are the responses loaded from the snapshot file by their keys,
+	// which are yet to be put into the cache of dnsproxy.
+	restored map[string]*cacheSnapshotItem
+
+	// done is closed when the periodic snapshots are stopped.
+	done chan struct{}
+
+	// path is the path to the snapshot file.
+	path string
+
+	// size is the total size of the packed responses in lru.
+	size int
+
+	// maxSize is the maximum value of size, the same as the size of the
+	// cache of dnsproxy.
+	maxSize int
+
+	// loaded is true if the snapshot file has already been loaded.
+	loaded bool
+}
+
+// newCacheSnapshot returns a new cache snapshot.
+func newCacheSnapshot() (c *cacheSnapshot) {
+	return &cacheSnapshot{
+		mu:    &sync.Mutex{},
+		items: map[string]*list.Element{},
+		lru:   list.New(),
+	}
+}
+
+// record keeps resp received at now, if the general cache of dnsproxy keeps it
+// as well.
+func (c *cacheSnapshot) record(resp *dns.Msg, now time.Time) {
+	key := cacheSnapshotKey(resp)
+	if key == "" || !isStaleCacheable(resp) {
+		return
+	}
+
+	packed, err := resp.Pack()
+	if err != nil {
+		log.Debug("dns: packing response for cache snapshot: %s", err)
+
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.setLocked(&cacheSnapshotItem{
+		Time: now,
+		Msg:  packed,
+		TTL:  staleResponseTTL(resp),
+		key:  key,
+	})
+}
+
+// setLocked puts item into c and evicts the least recently received items if
+// c has grown too large.  c.mu must be locked.
+func (c *cacheSnapshot) setLocked(item *cacheSnapshotItem) {
+	if e, ok := c.items[item.key]; ok {
+		c.removeLocked(e)
+	}
+
+	c.items[item.key] = c.lru.PushFront(item)
+	c.size += len(item.Msg)
+
+	for c.maxSize > 0 && c.size > c.maxSize {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+// removeLocked removes e from c.  c.mu must be locked.
+func (c *cacheSnapshot) removeLocked(e *list.Element) {
+	item := c.lru.Remove(e).(*cacheSnapshotItem)
+	delete(c.items, item.key)
+	c.size -= len(item.Msg)
+}
+
+// restoredResponse returns the response loaded from the snapshot file for req,
+// if it's not put into the cache of dnsproxy yet and hasn't expired.
+func (c *cacheSnapshot) restoredResponse(req *dns.Msg, now time.Time) (resp *dns.Msg) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.restored) == 0 {
+		return nil
+	}
+
+	item, ok := c.restored[cacheSnapshotKey(req)]
+	if !ok || item.expired(now) {
+		return nil
+	}
+
+	resp, err := item.response(now)
+	if err != nil {
+		log.Debug("dns: unpacking response from cache snapshot: %s", err)
+
+		return nil
+	}
+
+	resp.Id = req.Id
+
+	return resp
+}
+
+// load loads the unexpired responses from the snapshot file, unless it has
+// already been loaded.  The loaded responses are also kept in c.restored until
+// they are put into the cache of dnsproxy.
+func (c *cacheSnapshot) load(now time.Time) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.loaded || c.path == "" {
+		return nil
+	}
+
+	c.loaded = true
+
+	data, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	f := &cacheSnapshotFile{}
+	err = json.Unmarshal(data, f)
+	if err != nil {
+		return fmt.Errorf("decoding %q: %w", c.path, err)
+	}
+
+	c.restored = make(map[string]*cacheSnapshotItem, len(f.Items))
+
+	// The items are saved from the most recently received one, so put them
+	// in the reverse order to keep the order of lru.
+	for i := len(f.Items) - 1; i >= 0; i-- {
+		item := f.Items[i]
+		if item.expired(now) {
+			continue
+		}
+
+		msg := &dns.Msg{}
+		err = msg.Unpack(item.Msg)
+		if err != nil {
+			log.Debug("dns: cache snapshot: bad item at index %d: %s", i, err)
+
+			continue
+		}
+
+		item.key = cacheSnapshotKey(msg)
+		if item.key == "" {
+			continue
+		}
+
+		c.setLocked(item)
+	}
+
+	for _, e := range c.items {
+		item := e.Value.(*cacheSnapshotItem)
+		c.restored[item.key] = item
+	}
+
+	log.Debug("dns: loaded %d responses from cache snapshot", len(c.restored))
+
+	return nil
+}
+
+// restore puts the responses loaded from the snapshot file into the cache of
+// prx by resolving their questions, which the upstreams wrapped by c answer
+// with these responses.
+func (c *cacheSnapshot) restore(prx *proxy.Proxy) {
+	defer log.OnPanic("dns: restoring cache snapshot")
+
+	c.mu.Lock()
+	restored := c.restored
+	c.mu.Unlock()
+
+	if len(restored) == 0 {
+		return
+	}
+
+	defer func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.restored = nil
+	}()
+
+	// The subnet cache is keyed by the addresses of the clients, which
+	// aren't saved.
+	if prx.EnableEDNSClientSubnet {
+		log.Debug("dns: cache snapshot: edns client subnet is enabled, not restoring")
+
+		return
+	}
+
+	now := time.Now()
+	for _, item := range restored {
+		resp, err := item.response(now)
+		if err != nil {
+			continue
+		}
+
+		q := resp.Question[0]
+		req := (&dns.Msg{}).SetQuestion(q.Name, q.Qtype)
+		req.Question[0].Qclass = q.Qclass
+
+		err = prx.Resolve(&proxy.DNSContext{
+			Proto: proxy.ProtoUDP,
+			Req:   req,
+		})
+		if err != nil {
+			log.Debug("dns: cache snapshot: restoring %s: %s", q.Name, err)
+		}
+	}
+
+	log.Debug("dns: restored %d responses from cache snapshot", len(restored))
+}
+
+// save writes the unexpired responses to the snapshot file.
+func (c *cacheSnapshot) save(now time.Time) (err error) {
+	c.mu.Lock()
+	if c.path == "" {
+		c.mu.Unlock()
+
+		return nil
+	}
+
+	path := c.path
+	f := &cacheSnapshotFile{
+		Items: make([]*cacheSnapshotItem, 0, c.lru.Len()),
+	}
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if item := e.Value.(*cacheSnapshotItem); item.expired(now) {
+			c.removeLocked(e)
+		} else {
+			f.Items = append(f.Items, item)
+		}
+
+		e = next
+	}
+	c.mu.Unlock()
+
+	data, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("encoding: %w", err)
+	}
+
+	log.Debug("dns: saving %d responses to cache snapshot", len(f.Items))
+
+	return maybe.WriteFile(path, data, 0o644)
+}
+
+// start loads the snapshot file at path into the cache of prx, if it's not
+// loaded yet, and starts saving the snapshots to it periodically.  maxSize is
+// the size of the cache of prx in bytes.  c may be nil.
+func (c *cacheSnapshot) start(path string, maxSize int, prx *proxy.Proxy) {
+	if c == nil || c.done != nil {
+		return
+	}
+
+	c.mu.Lock()
+	c.path = path
+	c.maxSize = maxSize
+	c.mu.Unlock()
+
+	err := c.load(time.Now())
+	if err != nil {
+		log.Error("dns: loading cache snapshot: %s", err)
+	}
+
+	go c.restore(prx)
+
+	c.done = make(chan struct{})
+	go c.run(c.done)
+}
+
+// stop stops saving the snapshots periodically and saves the last one.  c may
+// be nil.
+func (c *cacheSnapshot) stop() {
+	if c == nil || c.done == nil {
+		return
+	}
+
+	close(c.done)
+	c.done = nil
+
+	err := c.save(time.Now())
+	if err != nil {
+		log.Error("dns: saving cache snapshot: %s", err)
+	}
+}
+
+// run saves the snapshots on the interval until done is closed.
+func (c *cacheSnapshot) run(done <-chan struct{}) {
+	defer aghos.OnPanicAndExit("dns: cache snapshots")
+
+	t := time.NewTicker(cacheSnapshotInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			err := c.save(time.Now())
+			if err != nil {
+				log.Error("dns: saving cache snapshot: %s", err)
+			}
+		}
+	}
+}
+
+// snapshotUpstream is an upstream, which records the responses of the wrapped
+// upstream to the cache snapshot and answers with the responses restored from
+// it.
+type snapshotUpstream struct {
+	upstream.Upstream
+
+	// snap is the cache snapshot.
+	snap *cacheSnapshot
+}
+
+// type check
+var _ upstream.Upstream = (*snapshotUpstream)(nil)
+
+// Exchange implements the upstream.Upstream interface for *snapshotUpstream.
+// Only the responses, which dnsproxy puts into its general cache, are
+// recorded.
+func (u *snapshotUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	now := time.Now()
+	if resp = u.snap.restoredResponse(req, now); resp != nil {
+		return resp, nil
+	}
+
+	resp, err = u.Upstream.Exchange(req)
+	if err != nil || resp == nil || req.CheckingDisabled {
+		return resp, err
+	}
+
+	// The responses to the requests with EDNS Client Subnet are kept in the
+	// subnet cache.
+	if _, _, e := ecsOption(req); e == nil {
+		u.snap.record(resp, now)
+	}
+
+	return resp, nil
+}
+
+// wrap makes the upstreams of conf record their responses to c.  It must be
+// applied after all the other wrappers, so that the responses are recorded
+// the same way dnsproxy receives them.
+func (c *cacheSnapshot) wrap(conf *proxy.UpstreamConfig) {
+	wrap := func(ups []upstream.Upstream) {
+		for i, u := range ups {
+			if _, ok := u.(*snapshotUpstream); !ok {
+				ups[i] = &snapshotUpstream{Upstream: u, snap: c}
+			}
+		}
+	}
+
+	wrap(conf.Upstreams)
+	for _, ups := range conf.DomainReservedUpstreams {
+		wrap(ups)
+	}
+
+	for _, ups := range conf.SpecifiedDomainUpstreams {
+		wrap(ups)
+	}
+}
+
+// cacheSnapshotEnabled returns true if the cache of s should be persisted.
+func (s *Server) cacheSnapshotEnabled() (ok bool) {
+	return s.conf.CachePersistent && s.conf.CacheSize != 0 && s.conf.CacheSnapshotFile != ""
+}
@@ -0,0 +1,203 @@
+package dnsforward
+
+import (
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSnapshotTestResp returns a new response for host with a single A record
+// with ttl.
+func newSnapshotTestResp(host string, ttl uint32) (resp *dns.Msg) {
+	resp = (&dns.Msg{}).SetReply((&dns.Msg{}).SetQuestion(host, dns.TypeA))
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   net.IP{192, 0, 2, 1},
+	}}
+
+	return resp
+}
+
+// snapshotTestUpstream is an upstream, which answers any A request and counts
+// the exchanges.
+type snapshotTestUpstream struct {
+	// exchanges is the number of the exchanges.  It must be accessed
+	// atomically.
+	exchanges uint32
+}
+
+// Exchange implements the upstream.Upstream interface for
+// *snapshotTestUpstream.
+func (u *snapshotTestUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	atomic.AddUint32(&u.exchanges, 1)
+
+	resp = newSnapshotTestResp(req.Question[0].Name, 3600)
+	resp.Id = req.Id
+
+	return resp, nil
+}
+
+// Address implements the upstream.Upstream interface for
+// *snapshotTestUpstream.
+func (u *snapshotTestUpstream) Address() (addr string) {
+	return "snapshot.example"
+}
+
+// Close implements the upstream.Upstream interface for *snapshotTestUpstream.
+func (u *snapshotTestUpstream) Close() (err error) {
+	return nil
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	const (
+		shortTTL = 10
+		longTTL  = 3600
+	)
+
+	shortReq := (&dns.Msg{}).SetQuestion("short.example.", dns.TypeA)
+	longReq := (&dns.Msg{}).SetQuestion("long.example.", dns.TypeA)
+
+	path := filepath.Join(t.TempDir(), "dns_cache.json")
+	now := time.Now()
+
+	c := newCacheSnapshot()
+	c.path = path
+	c.record(newSnapshotTestResp("short.example.", shortTTL), now)
+	c.record(newSnapshotTestResp("LONG.example.", longTTL), now)
+	c.record(newSnapshotTestResp("zero.example.", 0), now)
+
+	assert.Equal(t, 2, c.lru.Len())
+
+	// The recorded responses aren't served, since they are in the cache of
+	// dnsproxy already.
+	assert.Nil(t, c.restoredResponse(longReq, now))
+
+	require.NoError(t, c.save(now))
+
+	// Load the snapshot after a restart, when the short response has
+	// expired.
+	later := now.Add(2 * shortTTL * time.Second)
+
+	c = newCacheSnapshot()
+	c.path = path
+	require.NoError(t, c.load(later))
+
+	assert.Len(t, c.restored, 1)
+	assert.Nil(t, c.restoredResponse(shortReq, later))
+
+	resp := c.restoredResponse(longReq, later)
+	require.NotNil(t, resp)
+	require.Len(t, resp.Answer, 1)
+
+	assert.Equal(t, longReq.Id, resp.Id)
+	assert.Equal(t, uint32(longTTL-2*shortTTL), resp.Answer[0].Header().Ttl)
+
+	t.Run("no_file", func(t *testing.T) {
+		c = newCacheSnapshot()
+		c.path = filepath.Join(t.TempDir(), "none.json")
+
+		assert.NoError(t, c.load(now))
+		assert.Empty(t, c.items)
+	})
+}
+
+func TestCacheSnapshot_evict(t *testing.T) {
+	c := newCacheSnapshot()
+	now := time.Now()
+
+	packed, err := newSnapshotTestResp("host-0.example.", 60).Pack()
+	require.NoError(t, err)
+
+	const maxItems = 10
+	c.maxSize = maxItems * len(packed)
+
+	for _, host := range []string{
+		"host-0.example.",
+		"host-1.example.",
+		"host-2.example.",
+		"host-3.example.",
+		"host-4.example.",
+		"host-5.example.",
+		"host-6.example.",
+		"host-7.example.",
+		"host-8.example.",
+		"host-9.example.",
+		"host-a.example.",
+		"host-b.example.",
+	} {
+		c.record(newSnapshotTestResp(host, 60), now)
+	}
+
+	assert.Equal(t, maxItems, c.lru.Len())
+	assert.Equal(t, c.maxSize, c.size)
+
+	// The least recently received responses are evicted first.
+	assert.NotContains(t, c.items, cacheSnapshotKey(newSnapshotTestResp("host-1.example.", 60)))
+	assert.Contains(t, c.items, cacheSnapshotKey(newSnapshotTestResp("host-b.example.", 60)))
+}
+
+func TestCacheSnapshot_restore(t *testing.T) {
+	const host = "restored.example."
+
+	path := filepath.Join(t.TempDir(), "dns_cache.json")
+	now := time.Now()
+
+	c := newCacheSnapshot()
+	c.path = path
+	c.record(newSnapshotTestResp(host, 3600), now)
+	require.NoError(t, c.save(now))
+
+	ups := &snapshotTestUpstream{}
+	c = newCacheSnapshot()
+	c.path = path
+
+	conf := &proxy.UpstreamConfig{Upstreams: []upstream.Upstream{ups}}
+	c.wrap(conf)
+
+	prx := &proxy.Proxy{
+		Config: proxy.Config{
+			UpstreamConfig: conf,
+			CacheEnabled:   true,
+			CacheSizeBytes: 4096,
+		},
+	}
+	require.NoError(t, prx.Init())
+
+	require.NoError(t, c.load(now))
+	c.restore(prx)
+
+	// The restored response is put into the cache of dnsproxy without
+	// querying the upstream.
+	assert.Zero(t, atomic.LoadUint32(&ups.exchanges))
+	assert.Empty(t, c.restored)
+
+	dctx := &proxy.DNSContext{
+		Proto: proxy.ProtoUDP,
+		Req:   (&dns.Msg{}).SetQuestion(host, dns.TypeA),
+	}
+	require.NoError(t, prx.Resolve(dctx))
+
+	assert.NotEmpty(t, dctx.CachedUpstreamAddr)
+	assert.Zero(t, atomic.LoadUint32(&ups.exchanges))
+
+	// The new responses are recorded, unless they're requested with the CD
+	// bit, which dnsproxy doesn't cache.
+	cdReq := (&dns.Msg{}).SetQuestion("cd.example.", dns.TypeA)
+	cdReq.CheckingDisabled = true
+	_, err := conf.Upstreams[0].Exchange(cdReq)
+	require.NoError(t, err)
+
+	_, err = conf.Upstreams[0].Exchange((&dns.Msg{}).SetQuestion("new.example.", dns.TypeA))
+	require.NoError(t, err)
+
+	assert.Equal(t, uint32(2), atomic.LoadUint32(&ups.exchanges))
+	assert.Equal(t, 2, c.lru.Len())
+}
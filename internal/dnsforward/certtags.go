@@ -0,0 +1,228 @@
+package dnsforward
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// CertTagRule assigns client tags to the clients of the encrypted DNS
+// listeners with matching certificates.
+type CertTagRule struct {
+	// Pattern is the shell pattern, as in path.Match, matched against the
+	// common name and the DNS names, email addresses, and URIs from the
+	// subject alternative names of the client certificate.  The match is
+	// case-insensitive.  For example, "*.kids.home.arpa".
+	Pattern string `yaml:"pattern"`
+
+	// Tags are the client tags assigned to the matching clients.
+	Tags []string `yaml:"tags"`
+}
+
+// CertClientIDRule assigns a ClientID to the clients of the encrypted DNS
+// listeners with matching certificates.
+type CertClientIDRule struct {
+	// Pattern is the shell pattern matched against the names of the client
+	// certificate the same way as CertTagRule.Pattern.
+	Pattern string `yaml:"pattern"`
+
+	// ClientID is the ClientID assigned to the matching clients.
+	ClientID string `yaml:"client_id"`
+}
+
+// validateCertClientIDs returns an error if any of rules is invalid.
+func validateCertClientIDs(rules []*CertClientIDRule) (err error) {
+	for _, r := range rules {
+		if _, err = path.Match(r.Pattern, ""); err != nil {
+			return fmt.Errorf("bad pattern %q: %w", r.Pattern, err)
+		}
+
+		if err = ValidateClientID(r.ClientID); err != nil {
+			return fmt.Errorf("pattern %q: %w", r.Pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// LoadClientCAs returns the pool with the CA certificates from the PEM file
+// at caPath.
+func LoadClientCAs(caPath string) (pool *x509.CertPool, err error) {
+	pem, err := os.ReadFile(caPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading ca file: %w", err)
+	}
+
+	pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Error("no certificates in ca file")
+	}
+
+	return pool, nil
+}
+
+// mTLSConfig returns a copy of conf, which requires and verifies the client
+// certificates using the CAs from caPath.
+func (c *TLSConfig) mTLSConfig(conf *tls.Config, caPath string) (mConf *tls.Config, err error) {
+	for _, r := range c.ClientCertTags {
+		if _, err = path.Match(r.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad pattern %q: %w", r.Pattern, err)
+		}
+	}
+
+	pool, err := LoadClientCAs(caPath)
+	if err != nil {
+		return nil, err
+	}
+
+	mConf = conf.Clone()
+	mConf.ClientCAs = pool
+	mConf.ClientAuth = tls.RequireAndVerifyClientCert
+
+	return mConf, nil
+}
+
+// peerCert returns the certificate of the client of an encrypted DNS
+// listener, which has sent the request in pctx, or nil if there is none.  The
+// certificates are only requested when the client CAs are configured, so cert
+// is always verified.
+func peerCert(pctx *proxy.DNSContext) (cert *x509.Certificate) {
+	var certs []*x509.Certificate
+	switch pctx.Proto {
+	case proxy.ProtoTLS:
+		if tc, ok := pctx.Conn.(tlsConn); ok {
+			certs = tc.ConnectionState().PeerCertificates
+		}
+	case proxy.ProtoQUIC:
+		if qs, ok := pctx.QUICConnection.(quicConnection); ok {
+			certs = qs.ConnectionState().TLS.PeerCertificates
+		}
+	case proxy.ProtoHTTPS:
+		if r := pctx.HTTPRequest; r != nil && r.TLS != nil {
+			certs = r.TLS.PeerCertificates
+		}
+	}
+
+	if len(certs) == 0 {
+		return nil
+	}
+
+	return certs[0]
+}
+
+// certTags returns the client tags assigned by the certificate of the client,
+// which has sent the request in pctx.
+func (s *Server) certTags(pctx *proxy.DNSContext) (tags []string) {
+	rules := s.conf.ClientCertTags
+	if len(rules) == 0 {
+		return nil
+	}
+
+	cert := peerCert(pctx)
+	if cert == nil {
+		return nil
+	}
+
+	return matchCertTags(rules, cert)
+}
+
+// certClientID returns the ClientID assigned by the certificate of the client,
+// which has sent the request in pctx, or an empty string if there is none.
+func (s *Server) certClientID(pctx *proxy.DNSContext) (clientID string) {
+	rules := s.conf.ClientCertIDs
+	if len(rules) == 0 {
+		return ""
+	}
+
+	cert := peerCert(pctx)
+	if cert == nil {
+		return ""
+	}
+
+	return matchCertClientID(rules, cert)
+}
+
+// matchCertClientID returns the ClientID of the first of rules, which matches
+// cert, or an empty string if none do.
+func matchCertClientID(rules []*CertClientIDRule, cert *x509.Certificate) (clientID string) {
+	names := certNames(cert)
+	for _, r := range rules {
+		pat := strings.ToLower(r.Pattern)
+		for _, name := range names {
+			if ok, _ := path.Match(pat, name); ok {
+				log.Debug("dns: cert name %q matches %q, client id %q", name, r.Pattern, r.ClientID)
+
+				return r.ClientID
+			}
+		}
+	}
+
+	return ""
+}
+
+// matchCertTags returns the tags of all rules, which match cert.
+func matchCertTags(rules []*CertTagRule, cert *x509.Certificate) (tags []string) {
+	names := certNames(cert)
+	for _, r := range rules {
+		pat := strings.ToLower(r.Pattern)
+		for _, name := range names {
+			if ok, _ := path.Match(pat, name); ok {
+				log.Debug("dns: cert name %q matches %q, tags %q", name, r.Pattern, r.Tags)
+				tags = append(tags, r.Tags...)
+
+				break
+			}
+		}
+	}
+
+	return tags
+}
+
+// certNames returns the lowercased names of the subject of cert.
+func certNames(cert *x509.Certificate) (names []string) {
+	if cn := cert.Subject.CommonName; cn != "" {
+		names = append(names, strings.ToLower(cn))
+	}
+
+	for _, n := range cert.DNSNames {
+		names = append(names, strings.ToLower(n))
+	}
+
+	for _, e := range cert.EmailAddresses {
+		names = append(names, strings.ToLower(e))
+	}
+
+	for _, u := range cert.URIs {
+		names = append(names, strings.ToLower(u.String()))
+	}
+
+	return names
+}
+
+// mergeTags returns the sorted union of tags and other without duplicates.
+func mergeTags(tags, other []string) (merged []string) {
+	merged = make([]string, 0, len(tags)+len(other))
+	merged = append(merged, tags...)
+	merged = append(merged, other...)
+	sort.Strings(merged)
+
+	i := 0
+	for _, t := range merged {
+		if i > 0 && merged[i-1] == t {
+			continue
+		}
+
+		merged[i] = t
+		i++
+	}
+
+	return merged[:i]
+}
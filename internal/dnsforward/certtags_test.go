@@ -0,0 +1,146 @@
+package dnsforward
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchCertTags(t *testing.T) {
+	rules := []*CertTagRule{{
+		Pattern: "*.kids.home.arpa",
+		Tags:    []string{"user_child"},
+	}, {
+		Pattern: "*@example.org",
+		Tags:    []string{"user_regular", "device_phone"},
+	}, {
+		Pattern: "spiffe://home/tv/*",
+		Tags:    []string{"device_tv"},
+	}}
+
+	testCases := []struct {
+		cert *x509.Certificate
+		name string
+		want []string
+	}{{
+		cert: &x509.Certificate{
+			Subject: pkix.Name{CommonName: "Tablet.Kids.Home.Arpa"},
+		},
+		name: "cn",
+		want: []string{"user_child"},
+	}, {
+		cert: &x509.Certificate{
+			Subject:        pkix.Name{CommonName: "Dave"},
+			DNSNames:       []string{"phone.kids.home.arpa"},
+			EmailAddresses: []string{"dave@example.org"},
+		},
+		name: "san",
+		want: []string{"user_child", "user_regular", "device_phone"},
+	}, {
+		cert: &x509.Certificate{
+			URIs: []*url.URL{{Scheme: "spiffe", Host: "home", Path: "/tv/living-room"}},
+		},
+		name: "uri",
+		want: []string{"device_tv"},
+	}, {
+		cert: &x509.Certificate{
+			DNSNames: []string{"kids.home.arpa", "laptop.example.org"},
+		},
+		name: "none",
+		want: nil,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, matchCertTags(rules, tc.cert))
+		})
+	}
+}
+
+func TestServer_certClientID(t *testing.T) {
+	srv := &Server{
+		conf: ServerConfig{
+			TLSConfig: TLSConfig{
+				ClientCertIDs: []*CertClientIDRule{{
+					Pattern:  "*.kids.home.arpa",
+					ClientID: "kids",
+				}, {
+					Pattern:  "tablet.*",
+					ClientID: "tablet",
+				}},
+			},
+		},
+	}
+
+	newCtx := func(proto proxy.Proto, names ...string) (pctx *proxy.DNSContext) {
+		var certs []*x509.Certificate
+		if names != nil {
+			certs = []*x509.Certificate{{DNSNames: names}}
+		}
+
+		return &proxy.DNSContext{
+			Proto: proto,
+			HTTPRequest: &http.Request{
+				TLS: &tls.ConnectionState{PeerCertificates: certs},
+			},
+		}
+	}
+
+	testCases := []struct {
+		pctx *proxy.DNSContext
+		name string
+		want string
+	}{{
+		pctx: newCtx(proxy.ProtoHTTPS, "tablet.kids.home.arpa"),
+		name: "first_match",
+		want: "kids",
+	}, {
+		pctx: newCtx(proxy.ProtoHTTPS, "tablet.example.org"),
+		name: "second_match",
+		want: "tablet",
+	}, {
+		pctx: newCtx(proxy.ProtoHTTPS, "laptop.example.org"),
+		name: "no_match",
+		want: "",
+	}, {
+		pctx: newCtx(proxy.ProtoHTTPS),
+		name: "no_cert",
+		want: "",
+	}, {
+		pctx: newCtx(proxy.ProtoUDP, "tablet.kids.home.arpa"),
+		name: "plain",
+		want: "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, srv.certClientID(tc.pctx))
+		})
+	}
+}
+
+func TestValidateCertClientIDs(t *testing.T) {
+	err := validateCertClientIDs([]*CertClientIDRule{{Pattern: "[", ClientID: "cli"}})
+	require.Error(t, err)
+
+	assert.Equal(t, `bad pattern "[": syntax error in pattern`, err.Error())
+
+	err = validateCertClientIDs([]*CertClientIDRule{{Pattern: "*", ClientID: "bad id"}})
+	require.Error(t, err)
+
+	assert.Contains(t, err.Error(), `pattern "*": `)
+}
+
+func TestMergeTags(t *testing.T) {
+	got := mergeTags([]string{"device_pc", "user_admin"}, []string{"user_admin", "device_audio"})
+	assert.Equal(t, []string{"device_audio", "device_pc", "user_admin"}, got)
+
+	assert.Empty(t, mergeTags(nil, nil))
+}
@@ -0,0 +1,150 @@
+package dnsforward
+
+import (
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// maxCNAMEChainLen is the maximum number of the names in the inspected CNAME
+// chains, which also limits the number of the additional lookups.
+const maxCNAMEChainLen = 16
+
+// cnameChain follows the CNAME chain starting from name within answer and
+// returns the names it goes through, excluding name itself.  answered is true
+// if answer contains the records of qtype for the last name of the chain.
+func cnameChain(answer []dns.RR, name string, qtype uint16) (names []string, answered bool) {
+	cur := name
+	for len(names) < maxCNAMEChainLen {
+		var next string
+		for _, rr := range answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, cur) {
+				next = cname.Target
+
+				break
+			}
+		}
+
+		if next == "" {
+			break
+		}
+
+		names = append(names, next)
+		cur = next
+	}
+
+	for _, rr := range answer {
+		h := rr.Header()
+		if h.Rrtype == qtype && strings.EqualFold(h.Name, cur) {
+			return names, true
+		}
+	}
+
+	return names, false
+}
+
+// processCNAMEChain resolves the rest of the CNAME chain, if the response of
+// the upstream leaves it incomplete, and checks the resolved names against the
+// filtering rules.  The names within the response itself are checked by
+// processFilteringAfterResponse.
+func (s *Server) processCNAMEChain(dctx *dnsContext) (rc resultCode) {
+	pctx := dctx.proxyCtx
+	if !dctx.protectionEnabled ||
+		!dctx.responseFromUpstream ||
+		pctx.Res == nil ||
+		pctx.Res.Rcode != dns.RcodeSuccess ||
+		s.dnsFilter == nil {
+		return resultCodeSuccess
+	}
+
+	if res := dctx.result; res != nil && (res.IsFiltered || res.Reason != filtering.NotFilteredNotFound) {
+		return resultCodeSuccess
+	}
+
+	s.serverLock.RLock()
+	enabled := s.conf.CNAMEInspection
+	s.serverLock.RUnlock()
+	if !enabled {
+		return resultCodeSuccess
+	}
+
+	q := pctx.Req.Question[0]
+	if q.Qtype == dns.TypeCNAME {
+		return resultCodeSuccess
+	}
+
+	names, answered := cnameChain(pctx.Res.Answer, q.Name, q.Qtype)
+	seen := map[string]struct{}{}
+	for _, n := range names {
+		seen[strings.ToLower(n)] = struct{}{}
+	}
+
+	for !answered && len(names) > 0 && len(seen) < maxCNAMEChainLen {
+		tail := names[len(names)-1]
+		names, answered = s.lookupCNAMEChain(tail, q.Qtype)
+		for i, n := range names {
+			key := strings.ToLower(n)
+			if _, ok := seen[key]; ok {
+				// A loop.
+				names, answered = names[:i], true
+
+				break
+			}
+
+			seen[key] = struct{}{}
+
+			if s.blockCNAME(dctx, n) {
+				return resultCodeSuccess
+			}
+		}
+	}
+
+	return resultCodeSuccess
+}
+
+// lookupCNAMEChain resolves name and returns the CNAME chain of the response.
+func (s *Server) lookupCNAMEChain(name string, qtype uint16) (names []string, answered bool) {
+	req := (&dns.Msg{}).SetQuestion(name, qtype)
+	pctx := &proxy.DNSContext{
+		Proto:     proxy.ProtoUDP,
+		Req:       req,
+		StartTime: time.Now(),
+	}
+
+	if err := s.internalProxy.Resolve(pctx); err != nil {
+		log.Debug("dns: cname chain: resolving %s: %s", name, err)
+
+		return nil, true
+	} else if pctx.Res == nil {
+		return nil, true
+	}
+
+	return cnameChain(pctx.Res.Answer, name, qtype)
+}
+
+// blockCNAME checks the name from the CNAME chain against the filtering rules
+// and blocks the response if it's filtered.
+func (s *Server) blockCNAME(dctx *dnsContext, name string) (ok bool) {
+	pctx := dctx.proxyCtx
+	host := strings.TrimSuffix(name, ".")
+	res, err := s.checkHostRules(host, pctx.Req.Question[0].Qtype, dctx.setts)
+	if err != nil {
+		log.Debug("dns: cname chain: checking %s: %s", host, err)
+
+		return false
+	} else if res == nil || !res.IsFiltered {
+		return false
+	}
+
+	log.Debug("dns: cname chain: %s for %s is filtered", host, pctx.Req.Question[0].Name)
+
+	dctx.origResp = pctx.Res
+	dctx.result = res
+	pctx.Res = s.genDNSFilterMessage(pctx, res)
+
+	return true
+}
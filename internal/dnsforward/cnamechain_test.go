@@ -0,0 +1,138 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newCNAME returns a new CNAME record for host with target.
+func newCNAME(host, target string) (rr *dns.CNAME) {
+	return &dns.CNAME{
+		Hdr: dns.RR_Header{
+			Name:   host,
+			Rrtype: dns.TypeCNAME,
+			Class:  dns.ClassINET,
+			Ttl:    60,
+		},
+		Target: target,
+	}
+}
+
+func TestCNAMEChain(t *testing.T) {
+	testCases := []struct {
+		name         string
+		answer       []dns.RR
+		wantNames    []string
+		wantAnswered bool
+	}{{
+		name:         "no_chain",
+		answer:       []dns.RR{newA("first.example.", net.IP{1, 2, 3, 4})},
+		wantNames:    nil,
+		wantAnswered: true,
+	}, {
+		name: "full",
+		answer: []dns.RR{
+			newCNAME("first.example.", "cdn.first.example."),
+			newCNAME("CDN.first.example.", "edge.cdn.example."),
+			newA("edge.cdn.example.", net.IP{1, 2, 3, 4}),
+		},
+		wantNames:    []string{"cdn.first.example.", "edge.cdn.example."},
+		wantAnswered: true,
+	}, {
+		name: "dangling",
+		answer: []dns.RR{
+			newCNAME("first.example.", "cdn.first.example."),
+		},
+		wantNames:    []string{"cdn.first.example."},
+		wantAnswered: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			names, answered := cnameChain(tc.answer, "first.example.", dns.TypeA)
+			assert.Equal(t, tc.wantNames, names)
+			assert.Equal(t, tc.wantAnswered, answered)
+		})
+	}
+}
+
+func TestServer_processCNAMEChain(t *testing.T) {
+	s := createTestServer(t, &filtering.Config{}, ServerConfig{
+		UDPListenAddrs: []*net.UDPAddr{{}},
+		TCPListenAddrs: []*net.TCPAddr{{}},
+		FilteringConfig: FilteringConfig{
+			ProtectionEnabled: true,
+			BlockingMode:      BlockingModeNullIP,
+			CNAMEInspection:   true,
+		},
+	}, nil)
+	s.internalProxy.UpstreamConfig.Upstreams = []upstream.Upstream{
+		&aghtest.TestUpstream{
+			CName: map[string]string{
+				"cdn.tracked.example.": "null.example.org.",
+				"cdn.clean.example.":   "edge.cdn.example.",
+			},
+		},
+	}
+
+	testCases := []struct {
+		name        string
+		host        string
+		wantBlocked bool
+	}{{
+		name:        "tracker",
+		host:        "tracked.example.",
+		wantBlocked: true,
+	}, {
+		name:        "clean",
+		host:        "clean.example.",
+		wantBlocked: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := (&dns.Msg{}).SetQuestion(tc.host, dns.TypeA)
+			resp := (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{newCNAME(tc.host, "cdn."+tc.host)}
+
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Req: req,
+					Res: resp,
+				},
+				setts:                s.getClientRequestFilteringSettings(&dnsContext{protectionEnabled: true}),
+				result:               &filtering.Result{},
+				protectionEnabled:    true,
+				responseFromUpstream: true,
+			}
+
+			rc := s.processCNAMEChain(dctx)
+			require.Equal(t, resultCodeSuccess, rc)
+
+			if !tc.wantBlocked {
+				assert.Same(t, resp, dctx.proxyCtx.Res)
+				assert.False(t, dctx.result.IsFiltered)
+
+				return
+			}
+
+			assert.True(t, dctx.result.IsFiltered)
+			assert.Same(t, resp, dctx.origResp)
+
+			require.Len(t, dctx.proxyCtx.Res.Answer, 1)
+
+			a, ok := dctx.proxyCtx.Res.Answer[0].(*dns.A)
+			require.True(t, ok)
+
+			assert.True(t, a.A.IsUnspecified())
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package dnsforward
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// inflightExchange is a pending exchange with an upstream.
+type inflightExchange struct {
+	// done is closed when resp and err are set.
+	done chan struct{}
+
+	// resp is the response of the upstream.  It must not be modified after
+	// done is closed.
+	resp *dns.Msg
+
+	// err is the error of the exchange.
+	err error
+
+	// waiters is the number of the coalesced requests.  It's protected by
+	// the mutex of the upstream.
+	waiters int
+}
+
+// coalescingUpstream is an upstream, which sends the identical requests
+// arriving while an exchange is pending to the wrapped upstream only once.
+type coalescingUpstream struct {
+	upstream.Upstream
+
+	// mu protects inflight.
+	mu *sync.Mutex
+
+	// inflight are the pending exchanges by the keys of their requests.
+	inflight map[string]*inflightExchange
+}
+
+// type check
+var _ upstream.Upstream = (*coalescingUpstream)(nil)
+
+// newCoalescingUpstream returns a new coalescing upstream wrapping u.
+func newCoalescingUpstream(u upstream.Upstream) (c *coalescingUpstream) {
+	return &coalescingUpstream{
+		Upstream: u,
+		mu:       &sync.Mutex{},
+		inflight: map[string]*inflightExchange{},
+	}
+}
+
+// coalesceKey returns the key identifying the requests, which may be answered
+// with the same response.  key is empty if req can't be coalesced.
+func coalesceKey(req *dns.Msg) (key string) {
+	if len(req.Question) != 1 {
+		return ""
+	}
+
+	q := req.Question[0]
+
+	b := &strings.Builder{}
+	b.WriteString(strings.ToLower(q.Name))
+	b.WriteByte('/')
+	b.WriteString(strconv.Itoa(int(q.Qtype)))
+	b.WriteByte('/')
+	b.WriteString(strconv.Itoa(int(q.Qclass)))
+	b.WriteByte('/')
+	if req.RecursionDesired {
+		b.WriteByte('r')
+	}
+
+	if req.CheckingDisabled {
+		b.WriteByte('c')
+	}
+
+	opt := req.IsEdns0()
+	if opt == nil {
+		return b.String()
+	}
+
+	if opt.Do() {
+		b.WriteByte('d')
+	}
+
+	for _, o := range opt.Option {
+		// The ECS option determines the response, so requests with
+		// different subnets aren't coalesced.  The requests with other
+		// options aren't coalesced at all, since the response may depend on
+		// them as well.
+		subnet, ok := o.(*dns.EDNS0_SUBNET)
+		if !ok {
+			return ""
+		}
+
+		b.WriteByte('/')
+		b.WriteString(subnet.String())
+	}
+
+	return b.String()
+}
+
+// Exchange implements the upstream.Upstream interface for
+// *coalescingUpstream.
+func (u *coalescingUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	key := coalesceKey(req)
+	if key == "" {
+		return u.Upstream.Exchange(req)
+	}
+
+	u.mu.Lock()
+	e, ok := u.inflight[key]
+	if ok {
+		e.waiters++
+		u.mu.Unlock()
+
+		<-e.done
+		if e.resp == nil {
+			return nil, e.err
+		}
+
+		resp = e.resp.Copy()
+		resp.Id = req.Id
+
+		return resp, e.err
+	}
+
+	e = &inflightExchange{
+		done: make(chan struct{}),
+	}
+	u.inflight[key] = e
+	u.mu.Unlock()
+
+	resp, err = u.Upstream.Exchange(req)
+
+	u.mu.Lock()
+	delete(u.inflight, key)
+	waiters := e.waiters
+	u.mu.Unlock()
+
+	if waiters > 0 && resp != nil {
+		// Keep a copy, since the caller may modify resp.
+		e.resp = resp.Copy()
+	}
+
+	e.err = err
+	close(e.done)
+
+	return resp, err
+}
+
+// applyCoalescing wraps the upstreams of conf with the ones coalescing the
+// identical requests.
+func applyCoalescing(conf *proxy.UpstreamConfig) {
+	wrap := func(ups []upstream.Upstream) {
+		for i, u := range ups {
+			if _, ok := u.(*coalescingUpstream); !ok {
+				ups[i] = newCoalescingUpstream(u)
+			}
+		}
+	}
+
+	wrap(conf.Upstreams)
+	for _, ups := range conf.DomainReservedUpstreams {
+		wrap(ups)
+	}
+}
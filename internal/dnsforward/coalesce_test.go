@@ -0,0 +1,154 @@
+package dnsforward
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gatedUpstream is an upstream, which counts the exchanges and blocks them
+// until its gate is closed.
+type gatedUpstream struct {
+	gate  chan struct{}
+	count uint32
+}
+
+// Exchange implements the upstream.Upstream interface for *gatedUpstream.
+func (u *gatedUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	atomic.AddUint32(&u.count, 1)
+	<-u.gate
+
+	resp = (&dns.Msg{}).SetReply(req)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{
+			Name:   req.Question[0].Name,
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    60,
+		},
+		A: net.IP{192, 0, 2, 1},
+	}}
+
+	return resp, nil
+}
+
+// Address implements the upstream.Upstream interface for *gatedUpstream.
+func (u *gatedUpstream) Address() (addr string) {
+	return "gated"
+}
+
+// Close implements the upstream.Upstream interface for *gatedUpstream.
+func (u *gatedUpstream) Close() (err error) {
+	return nil
+}
+
+func TestCoalescingUpstream_Exchange(t *testing.T) {
+	const n = 10
+
+	ups := &gatedUpstream{gate: make(chan struct{})}
+	c := newCoalescingUpstream(ups)
+
+	wg := &sync.WaitGroup{}
+	resps := make([]*dns.Msg, n)
+	reqs := make([]*dns.Msg, n)
+	for i := range reqs {
+		reqs[i] = (&dns.Msg{}).SetQuestion("host.example.", dns.TypeA)
+		reqs[i].Id = uint16(i + 1)
+	}
+
+	// other has a different type, so it isn't coalesced.
+	other := (&dns.Msg{}).SetQuestion("host.example.", dns.TypeAAAA)
+
+	// Start the first exchange and make sure it's pending.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		resps[0], _ = c.Exchange(reqs[0])
+	}()
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadUint32(&ups.count) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	for i := 1; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			resps[i], _ = c.Exchange(reqs[i])
+		}(i)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		_, _ = c.Exchange(other)
+	}()
+
+	require.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		e, ok := c.inflight[coalesceKey(reqs[0])]
+
+		return ok && e.waiters == n-1 && atomic.LoadUint32(&ups.count) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	close(ups.gate)
+	wg.Wait()
+
+	assert.Equal(t, uint32(2), atomic.LoadUint32(&ups.count))
+	for i, resp := range resps {
+		require.NotNil(t, resp)
+		require.Len(t, resp.Answer, 1)
+
+		assert.Equal(t, reqs[i].Id, resp.Id)
+	}
+
+	assert.Empty(t, c.inflight)
+}
+
+func TestCoalesceKey(t *testing.T) {
+	newReq := func(name string, subnet net.IP) (req *dns.Msg) {
+		req = (&dns.Msg{}).SetQuestion(name, dns.TypeA)
+		if subnet != nil {
+			req.SetEdns0(dns.DefaultMsgSize, false)
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        1,
+				SourceNetmask: 24,
+				Address:       subnet,
+			})
+		}
+
+		return req
+	}
+
+	noECS := coalesceKey(newReq("host.example.", nil))
+	require.NotEmpty(t, noECS)
+
+	assert.Equal(t, noECS, coalesceKey(newReq("HOST.example.", nil)))
+
+	ecs := coalesceKey(newReq("host.example.", net.IP{192, 0, 2, 0}))
+	require.NotEmpty(t, ecs)
+
+	assert.NotEqual(t, noECS, ecs)
+	assert.NotEqual(t, ecs, coalesceKey(newReq("host.example.", net.IP{198, 51, 100, 0})))
+
+	withCookie := newReq("host.example.", nil)
+	withCookie.SetEdns0(dns.DefaultMsgSize, false)
+	opt := withCookie.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"})
+
+	assert.Empty(t, coalesceKey(withCookie))
+	assert.Empty(t, coalesceKey(&dns.Msg{}))
+}
@@ -0,0 +1,161 @@
+package dnsforward
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// defaultConsensusUpstreamsNum is the default number of upstreams queried for
+// the consensus domains.
+const defaultConsensusUpstreamsNum = 2
+
+// errConsensusDiverged is returned by consensusUpstream when the upstreams have
+// returned different answers.
+const errConsensusDiverged errors.Error = "answers of consensus upstreams diverge"
+
+// consensusUpstream is an upstream, which sends the queries to all of its
+// upstreams and only returns the answer if they all agree on it.
+type consensusUpstream struct {
+	// ups are the upstreams, which must agree on the answer.
+	ups []upstream.Upstream
+}
+
+// type check
+var _ upstream.Upstream = (*consensusUpstream)(nil)
+
+// Address implements the upstream.Upstream interface for *consensusUpstream.
+func (u *consensusUpstream) Address() (addr string) {
+	return "consensus"
+}
+
+// Close implements the upstream.Upstream interface for *consensusUpstream.
+func (u *consensusUpstream) Close() (err error) {
+	return closeUpstreams(u.ups...)
+}
+
+// Exchange implements the upstream.Upstream interface for *consensusUpstream.
+// It returns errConsensusDiverged if the upstreams have returned different
+// answers, so that the divergence is never cached.
+func (u *consensusUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	resps := make([]*dns.Msg, len(u.ups))
+	errs := make([]error, len(u.ups))
+
+	wg := &sync.WaitGroup{}
+	wg.Add(len(u.ups))
+	for i, ups := range u.ups {
+		go func(i int, ups upstream.Upstream) {
+			defer log.OnPanic("dns: consensus")
+			defer wg.Done()
+
+			resps[i], errs[i] = ups.Exchange(req.Copy())
+		}(i, ups)
+	}
+	wg.Wait()
+
+	for i, e := range errs {
+		if e != nil {
+			return nil, fmt.Errorf("consensus: upstream %s: %w", u.ups[i].Address(), e)
+		} else if resps[i] == nil {
+			return nil, fmt.Errorf("consensus: upstream %s: %w", u.ups[i].Address(), errors.Error("no response"))
+		}
+	}
+
+	want := answerFingerprint(resps[0])
+	for i, r := range resps[1:] {
+		if got := answerFingerprint(r); got != want {
+			log.Info(
+				"dns: consensus: answers of %s and %s for %s diverge",
+				u.ups[0].Address(),
+				u.ups[i+1].Address(),
+				req.Question[0].Name,
+			)
+
+			return nil, errConsensusDiverged
+		}
+	}
+
+	return resps[0], nil
+}
+
+// applyConsensus makes the first s.conf.ConsensusUpstreamsNum default
+// upstreams of conf resolve the consensus domains.  The domains, for which
+// conf already has the reserved upstreams, including the ones of their parent
+// domains, are resolved by those instead.
+func (s *Server) applyConsensus(conf *proxy.UpstreamConfig) (err error) {
+	if len(s.conf.ConsensusDomains) == 0 {
+		return nil
+	}
+
+	n := s.conf.ConsensusUpstreamsNum
+	if n == 0 {
+		n = defaultConsensusUpstreamsNum
+	}
+
+	if l := len(conf.Upstreams); n < 2 || n > l {
+		return fmt.Errorf("consensus_upstreams_num: must be from 2 to %d, got %d", l, n)
+	}
+
+	u := &consensusUpstream{
+		ups: slices.Clone(conf.Upstreams[:n]),
+	}
+
+	for _, d := range s.conf.ConsensusDomains {
+		d = upstreamGroupDomain(strings.TrimPrefix(d, "*."))
+		if hasReservedUpstreams(conf, d) {
+			log.Debug("dns: consensus: %s has reserved upstreams", d)
+
+			continue
+		}
+
+		if conf.DomainReservedUpstreams == nil {
+			conf.DomainReservedUpstreams = map[string][]upstream.Upstream{}
+		}
+
+		conf.DomainReservedUpstreams[d] = []upstream.Upstream{u}
+	}
+
+	return nil
+}
+
+// hasReservedUpstreams returns true if conf has the reserved upstreams for the
+// FQDN d or any of its parent domains.
+func hasReservedUpstreams(conf *proxy.UpstreamConfig, d string) (ok bool) {
+	for name := d; name != ""; {
+		if ups, found := conf.DomainReservedUpstreams[name]; found {
+			// The domains excluded with "[/domain/]#" are resolved by the
+			// default upstreams.
+			return len(ups) > 0
+		}
+
+		_, name, _ = strings.Cut(name, ".")
+	}
+
+	return false
+}
+
+// answerFingerprint returns a string that is equal for the responses with the
+// same response code and the same set of answer records regardless of their
+// order and TTLs.
+func answerFingerprint(resp *dns.Msg) (fp string) {
+	rrs := make([]string, 0, len(resp.Answer))
+	for _, rr := range resp.Answer {
+		rr = dns.Copy(rr)
+		hdr := rr.Header()
+		hdr.Ttl = 0
+		hdr.Name = strings.ToLower(hdr.Name)
+		rrs = append(rrs, rr.String())
+	}
+
+	sort.Strings(rrs)
+
+	return dns.RcodeToString[resp.Rcode] + "\n" + strings.Join(rrs, "\n")
+}
@@ -0,0 +1,148 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsensusUpstream_Exchange(t *testing.T) {
+	const host = "bank.example."
+
+	newUps := func(addr string, ips ...net.IP) (u upstream.Upstream) {
+		return &aghtest.TestUpstream{
+			IPv4: map[string][]net.IP{host: ips},
+			Addr: addr,
+		}
+	}
+
+	ip1, ip2 := net.IP{1, 2, 3, 4}, net.IP{5, 6, 7, 8}
+	req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+
+	t.Run("agree", func(t *testing.T) {
+		u := &consensusUpstream{
+			ups: []upstream.Upstream{
+				newUps("first", ip1, ip2),
+				newUps("second", ip2, ip1),
+			},
+		}
+
+		resp, err := u.Exchange(req)
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.Len(t, resp.Answer, 2)
+	})
+
+	t.Run("diverge", func(t *testing.T) {
+		u := &consensusUpstream{
+			ups: []upstream.Upstream{
+				newUps("first", ip1),
+				newUps("second", ip2),
+			},
+		}
+
+		_, err := u.Exchange(req)
+		assert.ErrorIs(t, err, errConsensusDiverged)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		u := &consensusUpstream{
+			ups: []upstream.Upstream{
+				newUps("first", ip1),
+				&aghtest.TestErrUpstream{},
+			},
+		}
+
+		_, err := u.Exchange(req)
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, errConsensusDiverged)
+	})
+}
+
+func TestServer_applyConsensus(t *testing.T) {
+	newConf := func() (conf *proxy.UpstreamConfig) {
+		return &proxy.UpstreamConfig{
+			Upstreams: []upstream.Upstream{
+				&aghtest.TestUpstream{Addr: "first"},
+				&aghtest.TestUpstream{Addr: "second"},
+				&aghtest.TestUpstream{Addr: "third"},
+			},
+		}
+	}
+
+	newServer := func(n int) (s *Server) {
+		return &Server{
+			conf: ServerConfig{
+				FilteringConfig: FilteringConfig{
+					ConsensusDomains:      []string{"bank.example", "*.Pay.Example."},
+					ConsensusUpstreamsNum: n,
+				},
+			},
+		}
+	}
+
+	t.Run("default", func(t *testing.T) {
+		conf := newConf()
+		err := newServer(0).applyConsensus(conf)
+		require.NoError(t, err)
+
+		for _, d := range []string{"bank.example.", "pay.example."} {
+			require.Len(t, conf.DomainReservedUpstreams[d], 1)
+
+			u, ok := conf.DomainReservedUpstreams[d][0].(*consensusUpstream)
+			require.True(t, ok)
+
+			assert.Equal(t, conf.Upstreams[:2], u.ups)
+		}
+	})
+
+	t.Run("reserved", func(t *testing.T) {
+		reserved := []upstream.Upstream{&aghtest.TestUpstream{Addr: "reserved"}}
+
+		conf := newConf()
+		conf.DomainReservedUpstreams = map[string][]upstream.Upstream{
+			"example.": reserved,
+		}
+
+		err := newServer(3).applyConsensus(conf)
+		require.NoError(t, err)
+
+		assert.Equal(t, map[string][]upstream.Upstream{
+			"example.": reserved,
+		}, conf.DomainReservedUpstreams)
+	})
+
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		n          int
+	}{{
+		name:       "too_few",
+		wantErrMsg: "consensus_upstreams_num: must be from 2 to 3, got 1",
+		n:          1,
+	}, {
+		name:       "negative",
+		wantErrMsg: "consensus_upstreams_num: must be from 2 to 3, got -1",
+		n:          -1,
+	}, {
+		name:       "too_many",
+		wantErrMsg: "consensus_upstreams_num: must be from 2 to 3, got 4",
+		n:          4,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := newServer(tc.n).applyConsensus(newConf())
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
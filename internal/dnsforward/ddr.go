@@ -0,0 +1,512 @@
+package dnsforward
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/google/renameio/maybe"
+	"github.com/miekg/dns"
+)
+
+// ddrName is the special-use domain name, which the designated resolvers of a
+// resolver are discovered by.  See RFC 9462.
+const ddrName = "_dns.resolver.arpa."
+
+// svcbDoHPath is the key of the "dohpath" SVCB parameter, which the used
+// version of package dns doesn't define.  See RFC 9461.
+const svcbDoHPath dns.SVCBKey = 7
+
+// ddrDesignation is a designated resolver advertised by a plain one.
+type ddrDesignation struct {
+	// Addr is the address of the designated resolver in the format of the
+	// upstream servers, for example "tls://dns.example:853".
+	Addr string `json:"addr"`
+
+	// Hints are the addresses of the designated resolver from the ipv4hint
+	// and ipv6hint parameters, if any.
+	Hints []net.IP `json:"hints,omitempty"`
+
+	// priority is the SvcPriority of the record.
+	priority uint16
+}
+
+// ddrDesignations returns the supported designated resolvers from the SVCB
+// records of resp sorted by priority.  Only the DNS-over-TLS and the
+// DNS-over-HTTPS ones are supported.
+func ddrDesignations(resp *dns.Msg) (ds []*ddrDesignation) {
+	for _, rr := range resp.Answer {
+		svcb, ok := rr.(*dns.SVCB)
+		if !ok || svcb.Priority == 0 || svcb.Target == "." {
+			// Skip the AliasMode records and the ones pointing to the special
+			// name itself.
+			continue
+		}
+
+		ds = append(ds, svcbDesignations(svcb)...)
+	}
+
+	sort.SliceStable(ds, func(i, j int) bool {
+		return ds[i].priority < ds[j].priority
+	})
+
+	return ds
+}
+
+// svcbDesignations returns the supported designated resolvers advertised by
+// svcb.
+func svcbDesignations(svcb *dns.SVCB) (ds []*ddrDesignation) {
+	host := strings.TrimSuffix(svcb.Target, ".")
+
+	var alpns []string
+	var port, path string
+	var hints []net.IP
+	for _, kv := range svcb.Value {
+		switch kv := kv.(type) {
+		case *dns.SVCBAlpn:
+			alpns = kv.Alpn
+		case *dns.SVCBPort:
+			port = strconv.Itoa(int(kv.Port))
+		case *dns.SVCBIPv4Hint:
+			hints = append(hints, kv.Hint...)
+		case *dns.SVCBIPv6Hint:
+			hints = append(hints, kv.Hint...)
+		case *dns.SVCBLocal:
+			if kv.KeyCode == svcbDoHPath {
+				// Only the "{?dns}" variable of the URI template is expected.
+				path = string(kv.Data)
+				if i := strings.IndexByte(path, '{'); i >= 0 {
+					path = path[:i]
+				}
+			}
+		}
+	}
+
+	for _, alpn := range alpns {
+		u := &url.URL{}
+		switch alpn {
+		case "dot":
+			u.Scheme, u.Host = "tls", joinPortOr(host, port, "853")
+		case "h2":
+			if !strings.HasPrefix(path, "/") {
+				continue
+			}
+
+			u.Scheme, u.Host, u.Path = "https", joinPortOr(host, port, "443"), path
+		default:
+			continue
+		}
+
+		ds = append(ds, &ddrDesignation{
+			Addr:     u.String(),
+			Hints:    hints,
+			priority: svcb.Priority,
+		})
+	}
+
+	return ds
+}
+
+// joinPortOr joins host with port or with defPort, if port is empty.
+func joinPortOr(host, port, defPort string) (hostPort string) {
+	if port == "" {
+		port = defPort
+	}
+
+	return net.JoinHostPort(host, port)
+}
+
+// verifyDesignatedIP returns a function, which verifies that the certificate
+// of a designated resolver also covers ip, the address of the plain resolver
+// designating it.  See RFC 9462, Section 4.2.
+func verifyDesignatedIP(ip net.IP) (verify func(cs tls.ConnectionState) (err error)) {
+	return func(cs tls.ConnectionState) (err error) {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.Error("no certificates")
+		}
+
+		err = cs.PeerCertificates[0].VerifyHostname(ip.String())
+		if err != nil {
+			return fmt.Errorf("verifying designation: %w", err)
+		}
+
+		return nil
+	}
+}
+
+// ddrUpstream is a plain upstream, which is upgraded to its designated
+// encrypted resolver once it's discovered.  There is no fallback to the plain
+// upstream after the upgrade, since that would allow downgrade attacks.
+type ddrUpstream struct {
+	// plain is the plain upstream.
+	plain upstream.Upstream
+
+	// ip is the address of the plain upstream.
+	ip net.IP
+
+	// mu protects designated.
+	mu *sync.RWMutex
+
+	// designated is the designated resolver.  It's nil until it's discovered.
+	designated upstream.Upstream
+}
+
+// type check
+var _ upstream.Upstream = (*ddrUpstream)(nil)
+
+// Exchange implements the upstream.Upstream interface for *ddrUpstream.
+func (u *ddrUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	u.mu.RLock()
+	d := u.designated
+	u.mu.RUnlock()
+
+	if d != nil {
+		return d.Exchange(req)
+	}
+
+	return u.plain.Exchange(req)
+}
+
+// Address implements the upstream.Upstream interface for *ddrUpstream.  It's
+// the address of the plain upstream.
+func (u *ddrUpstream) Address() (addr string) {
+	return u.plain.Address()
+}
+
+// Close implements the upstream.Upstream interface for *ddrUpstream.
+func (u *ddrUpstream) Close() (err error) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	if u.designated == nil {
+		return u.plain.Close()
+	}
+
+	return closeUpstreams(u.plain, u.designated)
+}
+
+// upgraded returns true if u has been upgraded to the designated resolver.
+func (u *ddrUpstream) upgraded() (ok bool) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	return u.designated != nil
+}
+
+// upgrade makes u use d instead of the plain upstream.
+func (u *ddrUpstream) upgrade(d upstream.Upstream) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.designated = d
+}
+
+// ddrPlainIP returns the address of u if it's a plain DNS upstream specified
+// by an IP address.  Otherwise, it returns nil.
+func ddrPlainIP(u upstream.Upstream) (ip net.IP) {
+	if _, ok := u.(*boundUpstream); ok {
+		// The designated resolver wouldn't keep the binding.
+		return nil
+	}
+
+	addr := u.Address()
+	if !strings.Contains(addr, "://") {
+		addr = "udp://" + addr
+	}
+
+	parsed, err := url.Parse(addr)
+	if err != nil || (parsed.Scheme != "udp" && parsed.Scheme != "tcp") {
+		return nil
+	}
+
+	return net.ParseIP(parsed.Hostname())
+}
+
+// ddrDiscoverer discovers the designated resolvers of the plain upstreams in
+// the background and upgrades the upstreams to them.
+type ddrDiscoverer struct {
+	// roots are the root CAs used to verify the designated resolvers.
+	roots *x509.CertPool
+
+	// pool are the connection pool settings of the designated resolvers.
+	pool *UpstreamPoolConfig
+
+	// proxies are the proxies of the upstreams.  The designated resolvers are
+	// tunneled through the proxies configured for their addresses or through
+	// the global one.  It may be nil.
+	proxies *upstreamProxies
+
+	// padding is the query padding policy of the designated resolvers.
+	padding string
+
+	// done is closed when the discoverer is stopped.
+	done chan struct{}
+
+	// mu protects pins.
+	mu *sync.Mutex
+
+	// pins are the discovered designated resolvers by the addresses of the
+	// plain upstreams.
+	pins map[string]*ddrDesignation
+
+	// pinFile is the path to the file, which the pins are kept in.  It's
+	// empty if pinning is disabled.
+	pinFile string
+
+	// ups are the upstreams being upgraded.
+	ups []*ddrUpstream
+
+	// timeout is the timeout of the exchanges.
+	timeout time.Duration
+}
+
+// newDDRDiscoverer returns a new discoverer.  If pinFile isn't empty, the
+// pinned designated resolvers are loaded from it.
+func newDDRDiscoverer(
+	pinFile string,
+	timeout time.Duration,
+	roots *x509.CertPool,
+	pool *UpstreamPoolConfig,
+) (d *ddrDiscoverer, err error) {
+	d = &ddrDiscoverer{
+		roots:   roots,
+		pool:    pool,
+		mu:      &sync.Mutex{},
+		pins:    map[string]*ddrDesignation{},
+		pinFile: pinFile,
+		timeout: timeout,
+	}
+
+	if pinFile == "" {
+		return d, nil
+	}
+
+	data, err := os.ReadFile(pinFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return d, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading pins: %w", err)
+	}
+
+	err = json.Unmarshal(data, &d.pins)
+	if err != nil {
+		return nil, fmt.Errorf("decoding pins from %q: %w", pinFile, err)
+	}
+
+	return d, nil
+}
+
+// wrap replaces the plain upstreams of conf specified by IP addresses with the
+// ones upgraded by d.  The ones having pinned designated resolvers are
+// upgraded immediately.  d may be nil.
+func (d *ddrDiscoverer) wrap(conf *proxy.UpstreamConfig) {
+	if d == nil {
+		return
+	}
+
+	d.wrapSet(conf.Upstreams)
+	for _, ups := range conf.DomainReservedUpstreams {
+		d.wrapSet(ups)
+	}
+}
+
+// wrapSet replaces the plain upstreams of ups with the ones upgraded by d.
+func (d *ddrDiscoverer) wrapSet(ups []upstream.Upstream) {
+	for i, u := range ups {
+		ip := ddrPlainIP(u)
+		if ip == nil {
+			continue
+		}
+
+		du := d.find(u.Address())
+		if du == nil {
+			du = &ddrUpstream{
+				plain: u,
+				ip:    ip,
+				mu:    &sync.RWMutex{},
+			}
+			d.ups = append(d.ups, du)
+			d.upgradePinned(du)
+		}
+
+		ups[i] = du
+	}
+}
+
+// find returns the upstream upgraded by d with addr, if any.
+func (d *ddrDiscoverer) find(addr string) (u *ddrUpstream) {
+	for _, u = range d.ups {
+		if u.Address() == addr {
+			return u
+		}
+	}
+
+	return nil
+}
+
+// upgradePinned upgrades u to its pinned designated resolver, if there is
+// one.
+func (d *ddrDiscoverer) upgradePinned(u *ddrUpstream) {
+	pin, ok := d.pins[u.Address()]
+	if !ok {
+		return
+	}
+
+	tu, err := d.newDesignated(u, pin)
+	if err != nil {
+		log.Error("dns: ddr: pinned designated resolver of %s: %s", u.Address(), err)
+
+		return
+	}
+
+	log.Debug("dns: ddr: using pinned designated resolver %s of %s", pin.Addr, u.Address())
+
+	u.upgrade(padUpstream(tu, d.padding))
+}
+
+// newDesignated returns the upstream for the designated resolver des of u.
+// The hostname of the designated resolver is resolved by u, unless there are
+// address hints or it's tunneled through a proxy.
+func (d *ddrDiscoverer) newDesignated(u *ddrUpstream, des *ddrDesignation) (tu *tlsUpstream, err error) {
+	tu, err = newTLSUpstream(
+		&UpstreamTLSConfig{Upstream: des.Addr},
+		[]string{u.plain.Address()},
+		d.timeout,
+		d.roots,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	tu.tunePool(d.pool)
+	tu.proxy, _ = d.proxies.forAddr(tu.Address())
+	tu.conf.VerifyConnection = verifyDesignatedIP(u.ip)
+	for _, ip := range des.Hints {
+		tu.hints = append(tu.hints, net.IPAddr{IP: ip})
+	}
+
+	return tu, nil
+}
+
+// discover queries the designated resolvers of u and upgrades u to the first
+// one, which is verified.
+func (d *ddrDiscoverer) discover(u *ddrUpstream) (des *ddrDesignation, err error) {
+	req := (&dns.Msg{}).SetQuestion(ddrName, dns.TypeSVCB)
+	resp, err := u.plain.Exchange(req)
+	if err != nil {
+		return nil, fmt.Errorf("querying %s: %w", ddrName, err)
+	}
+
+	for _, des = range ddrDesignations(resp) {
+		var tu *tlsUpstream
+		tu, err = d.newDesignated(u, des)
+		if err == nil {
+			// Make sure that the designated resolver is reachable and its
+			// certificate is valid.
+			_, err = tu.Exchange((&dns.Msg{}).SetQuestion(".", dns.TypeNS))
+		}
+
+		if err != nil {
+			log.Debug("dns: ddr: designated resolver %s of %s: %s", des.Addr, u.Address(), err)
+
+			continue
+		}
+
+		u.upgrade(padUpstream(tu, d.padding))
+
+		return des, nil
+	}
+
+	return nil, errors.Error("no verified designated resolvers")
+}
+
+// start starts discovering the designated resolvers.  d may be nil.
+func (d *ddrDiscoverer) start() {
+	if d == nil || d.done != nil {
+		return
+	}
+
+	d.done = make(chan struct{})
+	go d.run(d.done)
+}
+
+// stop stops discovering the designated resolvers.  d may be nil.
+func (d *ddrDiscoverer) stop() {
+	if d == nil || d.done == nil {
+		return
+	}
+
+	close(d.done)
+	d.done = nil
+}
+
+// run discovers the designated resolvers of the upstreams, which aren't
+// upgraded yet, until done is closed.
+func (d *ddrDiscoverer) run(done <-chan struct{}) {
+	defer aghos.OnPanicAndExit("dns: ddr discoverer")
+
+	var pinned bool
+	for _, u := range d.ups {
+		select {
+		case <-done:
+			return
+		default:
+			// Go on.
+		}
+
+		if u.upgraded() {
+			continue
+		}
+
+		des, err := d.discover(u)
+		if err != nil {
+			log.Info("dns: ddr: upstream %s isn't upgraded: %s", u.Address(), err)
+
+			continue
+		}
+
+		log.Info("dns: ddr: upstream %s is upgraded to %s", u.Address(), des.Addr)
+
+		if d.pinFile != "" {
+			d.mu.Lock()
+			d.pins[u.Address()] = des
+			d.mu.Unlock()
+
+			pinned = true
+		}
+	}
+
+	if pinned {
+		err := d.savePins()
+		if err != nil {
+			log.Error("dns: ddr: saving pins: %s", err)
+		}
+	}
+}
+
+// savePins writes the pins to the pin file.
+func (d *ddrDiscoverer) savePins() (err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	data, err := json.Marshal(d.pins)
+	if err != nil {
+		return fmt.Errorf("encoding: %w", err)
+	}
+
+	return maybe.WriteFile(d.pinFile, data, 0o644)
+}
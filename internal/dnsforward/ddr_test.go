@@ -0,0 +1,222 @@
+package dnsforward
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ddrTestUpstream is a plain upstream, which responds to the DDR queries with
+// its SVCB records.
+type ddrTestUpstream struct {
+	addr string
+	svcb []dns.RR
+}
+
+// type check
+var _ upstream.Upstream = (*ddrTestUpstream)(nil)
+
+// Exchange implements the upstream.Upstream interface for *ddrTestUpstream.
+func (u *ddrTestUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	resp = (&dns.Msg{}).SetReply(req)
+	if req.Question[0].Name == ddrName && req.Question[0].Qtype == dns.TypeSVCB {
+		resp.Answer = u.svcb
+	}
+
+	return resp, nil
+}
+
+// Address implements the upstream.Upstream interface for *ddrTestUpstream.
+func (u *ddrTestUpstream) Address() (addr string) {
+	return u.addr
+}
+
+// Close implements the upstream.Upstream interface for *ddrTestUpstream.
+func (u *ddrTestUpstream) Close() (err error) {
+	return nil
+}
+
+// newDDRSVCB returns a new SVCB record designating target.
+func newDDRSVCB(prio uint16, target string, kvs ...dns.SVCBKeyValue) (rr *dns.SVCB) {
+	return &dns.SVCB{
+		Hdr: dns.RR_Header{
+			Name:   ddrName,
+			Rrtype: dns.TypeSVCB,
+			Class:  dns.ClassINET,
+			Ttl:    300,
+		},
+		Priority: prio,
+		Target:   target,
+		Value:    kvs,
+	}
+}
+
+func TestDDRDesignations(t *testing.T) {
+	resp := &dns.Msg{
+		Answer: []dns.RR{
+			newDDRSVCB(0, "alias.example."),
+			newDDRSVCB(2, "doh.example.",
+				&dns.SVCBAlpn{Alpn: []string{"h2", "h3"}},
+				&dns.SVCBLocal{KeyCode: svcbDoHPath, Data: []byte("/dns-query{?dns}")},
+			),
+			newDDRSVCB(1, "dot.example.",
+				&dns.SVCBAlpn{Alpn: []string{"dot"}},
+				&dns.SVCBPort{Port: 8853},
+				&dns.SVCBIPv4Hint{Hint: []net.IP{{192, 0, 2, 1}}},
+			),
+			newDDRSVCB(3, "doq.example.", &dns.SVCBAlpn{Alpn: []string{"doq"}}),
+			newDDRSVCB(3, "nopath.example.", &dns.SVCBAlpn{Alpn: []string{"h2"}}),
+		},
+	}
+
+	ds := ddrDesignations(resp)
+	require.Len(t, ds, 2)
+
+	assert.Equal(t, "tls://dot.example:8853", ds[0].Addr)
+	assert.Equal(t, []net.IP{{192, 0, 2, 1}}, ds[0].Hints)
+
+	assert.Equal(t, "https://doh.example:443/dns-query", ds[1].Addr)
+	assert.Empty(t, ds[1].Hints)
+}
+
+func TestDDRDiscoverer(t *testing.T) {
+	srv := httptest.NewTLSServer(testDoHHandler(t))
+	t.Cleanup(srv.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	srvURL, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	port, err := strconv.Atoi(srvURL.Port())
+	require.NoError(t, err)
+
+	// The certificate of the test server is issued for example.com and
+	// 127.0.0.1.
+	svcb := []dns.RR{newDDRSVCB(1, "example.com.",
+		&dns.SVCBAlpn{Alpn: []string{"h2"}},
+		&dns.SVCBPort{Port: uint16(port)},
+		&dns.SVCBIPv4Hint{Hint: []net.IP{{127, 0, 0, 1}}},
+		&dns.SVCBLocal{KeyCode: svcbDoHPath, Data: []byte("/dns-query{?dns}")},
+	)}
+
+	verified := &ddrTestUpstream{addr: "127.0.0.1:53", svcb: svcb}
+	unverified := &ddrTestUpstream{addr: "192.0.2.1:53", svcb: svcb}
+
+	pinFile := filepath.Join(t.TempDir(), "ddr_pins.json")
+	d, err := newDDRDiscoverer(pinFile, time.Second, roots, &UpstreamPoolConfig{})
+	require.NoError(t, err)
+
+	conf := &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{verified, unverified},
+		DomainReservedUpstreams: map[string][]upstream.Upstream{
+			"domain.example.": {verified},
+		},
+	}
+	d.wrap(conf)
+
+	require.Len(t, conf.Upstreams, 2)
+	require.Len(t, d.ups, 2)
+
+	du, ok := conf.Upstreams[0].(*ddrUpstream)
+	require.True(t, ok)
+
+	assert.Same(t, du, conf.DomainReservedUpstreams["domain.example."][0])
+
+	d.run(make(chan struct{}))
+
+	require.True(t, du.upgraded())
+	assert.Equal(t, "127.0.0.1:53", du.Address())
+
+	resp, err := du.Exchange((&dns.Msg{}).SetQuestion("example.org.", dns.TypeA))
+	require.NoError(t, err)
+	require.Len(t, resp.Answer, 1)
+
+	assert.Equal(t, net.IP{1, 2, 3, 4}, resp.Answer[0].(*dns.A).A.To4())
+
+	// The certificate doesn't cover 192.0.2.1.
+	assert.False(t, d.ups[1].upgraded())
+
+	t.Run("pinned", func(t *testing.T) {
+		d, err = newDDRDiscoverer(pinFile, time.Second, roots, &UpstreamPoolConfig{})
+		require.NoError(t, err)
+		require.Contains(t, d.pins, "127.0.0.1:53")
+
+		conf = &proxy.UpstreamConfig{
+			Upstreams: []upstream.Upstream{&ddrTestUpstream{addr: "127.0.0.1:53"}},
+		}
+		d.wrap(conf)
+
+		du, ok = conf.Upstreams[0].(*ddrUpstream)
+		require.True(t, ok)
+
+		assert.True(t, du.upgraded())
+	})
+}
+
+func TestVerifyDesignatedIP(t *testing.T) {
+	srv := httptest.NewTLSServer(testDoHHandler(t))
+	t.Cleanup(srv.Close)
+
+	cs := tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{srv.Certificate()},
+	}
+
+	assert.NoError(t, verifyDesignatedIP(net.IP{127, 0, 0, 1})(cs))
+	assert.Error(t, verifyDesignatedIP(net.IP{192, 0, 2, 1})(cs))
+	assert.Error(t, verifyDesignatedIP(net.IP{127, 0, 0, 1})(tls.ConnectionState{}))
+}
+
+func TestDDRDiscoverer_newDesignated_proxy(t *testing.T) {
+	global := &upstreamProxy{url: &url.URL{Scheme: "socks5", Host: "127.0.0.1:1080"}}
+	d, err := newDDRDiscoverer("", time.Second, nil, &UpstreamPoolConfig{})
+	require.NoError(t, err)
+
+	d.proxies = &upstreamProxies{
+		global: global,
+		byAddr: map[string]*upstreamProxy{
+			"tls://direct.example:853": nil,
+		},
+	}
+
+	u := &ddrUpstream{
+		plain: &ddrTestUpstream{addr: "127.0.0.1:53"},
+		ip:    net.IP{127, 0, 0, 1},
+	}
+
+	testCases := []struct {
+		want *upstreamProxy
+		name string
+		addr string
+	}{{
+		want: global,
+		name: "global",
+		addr: "tls://dns.example:853",
+	}, {
+		want: nil,
+		name: "direct",
+		addr: "tls://direct.example:853",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tu, dErr := d.newDesignated(u, &ddrDesignation{Addr: tc.addr})
+			require.NoError(t, dErr)
+
+			assert.Same(t, tc.want, tu.proxy)
+		})
+	}
+}
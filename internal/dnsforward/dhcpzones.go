@@ -0,0 +1,183 @@
+package dnsforward
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// reverseZoneNames returns the names of the smallest set of reverse zones
+// covering n.  The zones are delegated on the octet boundaries for IPv4 and
+// on the nibble boundaries for IPv6, so a network with a prefix in between is
+// covered by several zones, for example a /22 network by four /24 zones.
+func reverseZoneNames(n *net.IPNet) (names []string) {
+	ip := n.IP.To4()
+	step := 8
+	if ip == nil {
+		ip, step = n.IP.To16(), 4
+	}
+
+	ones, bits := n.Mask.Size()
+	if ip == nil || bits != len(ip)*8 {
+		return nil
+	}
+
+	ip = ip.Mask(n.Mask)
+	zoneBits := (ones + step - 1) / step * step
+	// skip is the number of the labels of the full reverse name below the
+	// zone name.
+	skip := (bits - zoneBits) / step
+
+	count := 1 << (zoneBits - ones)
+	names = make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		zoneIP := slices.Clone(ip)
+		if i > 0 {
+			// The varying bits end on the zone boundary.
+			zoneIP[(zoneBits-1)/8] |= byte(i << ((8 - zoneBits%8) % 8))
+		}
+
+		name, err := dns.ReverseAddr(zoneIP.String())
+		if err != nil {
+			// Generally shouldn't happen.
+			log.Debug("dns: dhcp zones: reversing %s: %s", zoneIP, err)
+
+			continue
+		}
+
+		for j := 0; j < skip; j++ {
+			name = name[strings.Index(name, ".")+1:]
+		}
+
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// newDHCPZones returns the reverse zones covering nets with the PTR records
+// of the addresses from ipToHost within them.  The hostnames are put under
+// suffix.
+func newDHCPZones(nets []*net.IPNet, ipToHost *aghnet.IPMap, suffix string, ttl uint32) (lz *localZones) {
+	lz = &localZones{}
+	serial := uint32(time.Now().Unix())
+	for _, n := range nets {
+		for _, name := range reverseZoneNames(n) {
+			if lz.find(name) != nil {
+				continue
+			}
+
+			z, err := newLocalZone(&LocalZone{Name: name})
+			if err != nil {
+				// Generally shouldn't happen.
+				log.Debug("dns: dhcp zones: %s", err)
+
+				continue
+			}
+
+			z.soa.Serial = serial
+			// The zones of the DHCP networks never nest, so there is no
+			// need to sort them.
+			lz.zones = append(lz.zones, z)
+		}
+	}
+
+	ipToHost.Range(func(ip net.IP, v interface{}) (cont bool) {
+		host, _ := v.(string)
+		if netutil.ValidateHostname(host) != nil {
+			return true
+		}
+
+		arpa, err := dns.ReverseAddr(ip.String())
+		if err != nil {
+			return true
+		}
+
+		z := lz.find(arpa)
+		if z == nil {
+			// The address is outside of the current DHCP networks, for
+			// example a static lease left after a change of the range.
+			return true
+		}
+
+		err = z.add(&dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   arpa,
+				Rrtype: dns.TypePTR,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			Ptr: host + suffix,
+		})
+		if err != nil {
+			log.Debug("dns: dhcp zones: %s", err)
+		}
+
+		return true
+	})
+
+	return lz
+}
+
+// updateDHCPZones rebuilds the reverse zones of the DHCP networks from
+// ipToHost.  A nil ipToHost removes the zones.
+func (s *Server) updateDHCPZones(ipToHost *aghnet.IPMap) {
+	var lz *localZones
+	if ipToHost != nil {
+		s.serverLock.RLock()
+		ttl := s.conf.BlockedResponseTTL
+		s.serverLock.RUnlock()
+
+		lz = newDHCPZones(s.dhcpServer.Subnets(), ipToHost, s.localDomainSuffix, ttl)
+
+		log.Debug("dns: generated %d reverse zones for dhcp", len(lz.zones))
+	}
+
+	s.dhcpZonesLock.Lock()
+	defer s.dhcpZonesLock.Unlock()
+
+	s.dhcpZones = lz
+}
+
+// processDHCPZones responds to the requests for the names within the reverse
+// zones of the DHCP networks authoritatively, so that the requests for the
+// addresses without a lease don't reach the local upstreams.
+func (s *Server) processDHCPZones(dctx *dnsContext) (rc resultCode) {
+	pctx := dctx.proxyCtx
+	if pctx.Res != nil || !dctx.isLocalClient {
+		return resultCodeSuccess
+	}
+
+	q := pctx.Req.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return resultCodeSuccess
+	}
+
+	s.serverLock.RLock()
+	enabled := s.conf.DHCPReverseZones
+	s.serverLock.RUnlock()
+	if !enabled {
+		return resultCodeSuccess
+	}
+
+	s.dhcpZonesLock.Lock()
+	z := s.dhcpZones.find(q.Name)
+	s.dhcpZonesLock.Unlock()
+	if z == nil {
+		return resultCodeSuccess
+	}
+
+	log.Debug("dns: dhcp zone %q: responding to %s %q", z.name, dns.TypeToString[q.Qtype], q.Name)
+
+	resp := s.makeResponse(pctx.Req)
+	z.respond(resp, q)
+	pctx.Res = resp
+
+	return resultCodeSuccess
+}
@@ -0,0 +1,169 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReverseZoneNames(t *testing.T) {
+	testCases := []struct {
+		name string
+		cidr string
+		want []string
+	}{{
+		name: "ipv4_octet",
+		cidr: "192.168.12.0/24",
+		want: []string{"12.168.192.in-addr.arpa."},
+	}, {
+		name: "ipv4_between",
+		cidr: "10.1.4.0/22",
+		want: []string{
+			"4.1.10.in-addr.arpa.",
+			"5.1.10.in-addr.arpa.",
+			"6.1.10.in-addr.arpa.",
+			"7.1.10.in-addr.arpa.",
+		},
+	}, {
+		name: "ipv4_unmasked",
+		cidr: "172.16.0.0/16",
+		want: []string{"16.172.in-addr.arpa."},
+	}, {
+		name: "ipv6_nibble",
+		cidr: "2001:db8::100/120",
+		want: []string{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."},
+	}, {
+		name: "ipv6_between",
+		cidr: "2001:db8::/63",
+		want: []string{
+			"0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.",
+			"1.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.",
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, n, err := net.ParseCIDR(tc.cidr)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.want, reverseZoneNames(n))
+		})
+	}
+}
+
+func TestServer_processDHCPZones(t *testing.T) {
+	ipToHost := aghnet.NewIPMap(0)
+	ipToHost.Set(net.IP{192, 168, 12, 34}, "myhost")
+	ipToHost.Set(net.IP{192, 168, 12, 35}, "")
+	ipToHost.Set(net.IP{10, 0, 0, 1}, "outside")
+
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				BlockedResponseTTL: 10,
+				DHCPReverseZones:   true,
+			},
+		},
+		dhcpServer:        &testDHCP{},
+		localDomainSuffix: defaultLocalDomainSuffix,
+	}
+	s.updateDHCPZones(ipToHost)
+
+	testCases := []struct {
+		name      string
+		host      string
+		qtype     uint16
+		wantAns   string
+		wantRcode int
+		local     bool
+		wantRes   bool
+	}{{
+		name:      "leased",
+		host:      "34.12.168.192.in-addr.arpa.",
+		qtype:     dns.TypePTR,
+		wantAns:   "34.12.168.192.in-addr.arpa.\t10\tIN\tPTR\tmyhost.lan.",
+		wantRcode: dns.RcodeSuccess,
+		local:     true,
+		wantRes:   true,
+	}, {
+		name:      "not_leased",
+		host:      "35.12.168.192.in-addr.arpa.",
+		qtype:     dns.TypePTR,
+		wantAns:   "",
+		wantRcode: dns.RcodeNameError,
+		local:     true,
+		wantRes:   true,
+	}, {
+		name:      "no_data",
+		host:      "12.168.192.in-addr.arpa.",
+		qtype:     dns.TypeTXT,
+		wantAns:   "",
+		wantRcode: dns.RcodeSuccess,
+		local:     true,
+		wantRes:   true,
+	}, {
+		name:    "outside",
+		host:    "1.0.0.10.in-addr.arpa.",
+		qtype:   dns.TypePTR,
+		local:   true,
+		wantRes: false,
+	}, {
+		name:    "external_client",
+		host:    "34.12.168.192.in-addr.arpa.",
+		qtype:   dns.TypePTR,
+		local:   false,
+		wantRes: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Req: (&dns.Msg{}).SetQuestion(tc.host, tc.qtype),
+				},
+				isLocalClient: tc.local,
+			}
+
+			rc := s.processDHCPZones(dctx)
+			require.Equal(t, resultCodeSuccess, rc)
+
+			res := dctx.proxyCtx.Res
+			if !tc.wantRes {
+				assert.Nil(t, res)
+
+				return
+			}
+
+			require.NotNil(t, res)
+
+			assert.True(t, res.Authoritative)
+			assert.Equal(t, tc.wantRcode, res.Rcode)
+			if tc.wantAns == "" {
+				assert.Empty(t, res.Answer)
+			} else {
+				require.Len(t, res.Answer, 1)
+				assert.Equal(t, tc.wantAns, res.Answer[0].String())
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		s.conf.DHCPReverseZones = false
+		t.Cleanup(func() { s.conf.DHCPReverseZones = true })
+
+		dctx := &dnsContext{
+			proxyCtx: &proxy.DNSContext{
+				Req: (&dns.Msg{}).SetQuestion("35.12.168.192.in-addr.arpa.", dns.TypePTR),
+			},
+			isLocalClient: true,
+		}
+
+		s.processDHCPZones(dctx)
+		assert.Nil(t, dctx.proxyCtx.Res)
+	})
+}
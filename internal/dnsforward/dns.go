@@ -2,13 +2,17 @@ package dnsforward
 
 import (
 	"encoding/binary"
+	"fmt"
 	"net"
+	"slices"
 	"strings"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
 	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/stringutil"
@@ -22,6 +26,10 @@ type dnsContext struct {
 	// setts are the filtering settings for the client.
 	setts *filtering.Settings
 
+	// view is the split-horizon view matching the client.  It's nil if there
+	// is none.
+	view *view
+
 	result *filtering.Result
 	// origResp is the response received from upstream.  It is set when the
 	// response is modified by filters.
@@ -56,9 +64,21 @@ type dnsContext struct {
 	// responseAD shows if the response had the AD bit set.
 	responseAD bool
 
+	// consensusDiverged shows if the upstreams have returned different
+	// answers for a consensus domain.
+	consensusDiverged bool
+
 	// isLocalClient shows if client's IP address is from locally-served
 	// network.
 	isLocalClient bool
+
+	// rpzChecked shows if a response policy has already been applied to the
+	// request, so that the other policies must not be checked.
+	rpzChecked bool
+
+	// trace is the trace of the request.  It's nil if the request isn't
+	// sampled or the tracing is disabled.
+	trace *requestTrace
 }
 
 // resultCode is the result of a request processing function.
@@ -84,6 +104,13 @@ func (s *Server) handleDNSRequest(_ *proxy.Proxy, d *proxy.DNSContext) error {
 		startTime: time.Now(),
 	}
 
+	// Protect the response after the processing, including the one finished
+	// early, but before dnsproxy writes it.
+	defer s.protectResponse(d)
+
+	s.startRequestTrace(ctx)
+	defer s.finishRequestTrace(ctx)
+
 	type modProcessFunc func(ctx *dnsContext) (rc resultCode)
 
 	// Since (*dnsforward.Server).handleDNSRequest(...) is used as
@@ -94,15 +121,31 @@ func (s *Server) handleDNSRequest(_ *proxy.Proxy, d *proxy.DNSContext) error {
 	mods := []modProcessFunc{
 		s.processRecursion,
 		s.processInitial,
+		s.processQnameValidation,
+		s.processBlockAttribution,
 		s.processDetermineLocal,
+		s.processLocalZones,
 		s.processInternalHosts,
 		s.processRestrictLocal,
 		s.processInternalIPAddrs,
-		s.processFilteringBeforeRequest,
+		s.processDHCPZones,
+		s.processDoHBypass,
+		traced("filtering_request", s.processFilteringBeforeRequest),
+		s.processRPZRequest,
 		s.processLocalPTR,
-		s.processUpstream,
-		s.processFilteringAfterResponse,
+		s.processUpstreamTraced,
+		s.processBogusNXDomain,
+		s.processDNS64,
+		s.processPrivateAnswers,
+		traced("filtering_response", s.processFilteringAfterResponse),
+		s.processCNAMEChain,
+		s.processRPZResponse,
+		s.processAnswerNets,
+		s.processAnswerOrder,
+		s.processQtypePolicies,
+		s.processExtendedErrors,
 		s.ipset.process,
+		s.processRecordBlocked,
 		s.processQueryLogsAndStats,
 	}
 	for _, process := range mods {
@@ -125,6 +168,41 @@ func (s *Server) handleDNSRequest(_ *proxy.Proxy, d *proxy.DNSContext) error {
 	return nil
 }
 
+// serveRequest processes the request received by the listeners served by
+// AdGuard Home itself instead of dnsproxy, the same way dnsproxy does.  ok is
+// false if there is no response to write.
+func (s *Server) serveRequest(pctx *proxy.DNSContext) (ok bool) {
+	prx := s.proxy()
+	if prx == nil {
+		return false
+	}
+
+	req := pctx.Req
+	allowed, err := s.beforeRequestHandler(prx, pctx)
+	if err != nil {
+		log.Debug("dns: %s: before request handler: %s", pctx.Proto, err)
+		pctx.Res = s.genServerFailure(req)
+	} else if !allowed {
+		return false
+	}
+
+	if pctx.Res == nil {
+		switch {
+		case len(req.Question) != 1:
+			pctx.Res = s.genServerFailure(req)
+		case s.conf.RefuseAny && req.Question[0].Qtype == dns.TypeANY:
+			pctx.Res = s.genRefusedANYResponse(req)
+		default:
+			err = s.handleDNSRequest(prx, pctx)
+			if err != nil {
+				log.Debug("dns: %s: handling request: %s", pctx.Proto, err)
+			}
+		}
+	}
+
+	return pctx.Res != nil
+}
+
 // processRecursion checks the incoming request and halts it's handling if s
 // have tried to resolve it recently.
 func (s *Server) processRecursion(dctx *dnsContext) (rc resultCode) {
@@ -174,23 +252,52 @@ func (s *Server) processInitial(ctx *dnsContext) (rc resultCode) {
 	ctx.protectionEnabled = s.conf.ProtectionEnabled
 	ctx.setts = s.getClientRequestFilteringSettings(ctx)
 
+	ctx.view = s.viewFor(ctx)
+	if ctx.view != nil {
+		ctx.setts.ViewRewrites = ctx.view.rewrites
+	}
+
 	return resultCodeSuccess
 }
 
-func (s *Server) setTableHostToIP(t hostToIPTable) {
+func (s *Server) setTableHostToIP(t, t6 hostToIPTable) {
 	s.tableHostToIPLock.Lock()
 	defer s.tableHostToIPLock.Unlock()
 
 	s.tableHostToIP = t
+	s.tableHostToIPv6 = t6
 }
 
-func (s *Server) setTableIPToHost(t *netutil.IPMap) {
+func (s *Server) setTableIPToHost(t *aghnet.IPMap) {
 	s.tableIPToHostLock.Lock()
 	defer s.tableIPToHostLock.Unlock()
 
 	s.tableIPToHost = t
 }
 
+// scheduleLeasesUpdate makes the server rebuild the tables of the DHCP leases
+// at next, so that the records of the expired leases are removed.  A zero next
+// cancels the scheduled update.
+func (s *Server) scheduleLeasesUpdate(next time.Time) {
+	s.leasesTimerLock.Lock()
+	defer s.leasesTimerLock.Unlock()
+
+	if s.leasesTimer != nil {
+		s.leasesTimer.Stop()
+		s.leasesTimer = nil
+	}
+
+	if next.IsZero() {
+		return
+	}
+
+	s.leasesTimer = time.AfterFunc(time.Until(next), func() {
+		log.Debug("dns: dhcp lease expired, updating records")
+
+		s.onDHCPLeaseChanged(dhcpd.LeaseChangedAdded)
+	})
+}
+
 func (s *Server) onDHCPLeaseChanged(flags int) {
 	var err error
 
@@ -206,19 +313,21 @@ func (s *Server) onDHCPLeaseChanged(flags int) {
 		return
 	}
 
-	var hostToIP hostToIPTable
-	var ipToHost *netutil.IPMap
+	var hostToIP, hostToIPv6 hostToIPTable
+	var ipToHost *aghnet.IPMap
+	var nextExpiry time.Time
 	if add {
 		ll := s.dhcpServer.Leases(dhcpd.LeasesAll)
 
 		hostToIP = make(hostToIPTable, len(ll))
-		ipToHost = netutil.NewIPMap(len(ll))
+		hostToIPv6 = hostToIPTable{}
+		ipToHost = aghnet.NewIPMap(len(ll))
 
 		for _, l := range ll {
 			// TODO(a.garipov): Remove this after we're finished
 			// with the client hostname validations in the DHCP
 			// server code.
-			err = netutil.ValidateDomainName(l.Hostname)
+			err = netutil.ValidateHostname(l.Hostname)
 			if err != nil {
 				log.Debug(
 					"dns: skipping invalid hostname %q from dhcp: %s",
@@ -227,20 +336,29 @@ func (s *Server) onDHCPLeaseChanged(flags int) {
 				)
 			}
 
+			if !l.IsStatic() && !l.Expiry.IsZero() &&
+				(nextExpiry.IsZero() || l.Expiry.Before(nextExpiry)) {
+				nextExpiry = l.Expiry
+			}
+
 			lowhost := strings.ToLower(l.Hostname)
 
 			ipToHost.Set(l.IP, lowhost)
 
-			ip := make(net.IP, 4)
-			copy(ip, l.IP.To4())
-			hostToIP[lowhost] = ip
+			if ip4 := l.IP.To4(); ip4 != nil {
+				hostToIP[lowhost] = slices.Clone(ip4)
+			} else {
+				hostToIPv6[lowhost] = slices.Clone(l.IP)
+			}
 		}
 
-		log.Debug("dns: added %d A/PTR entries from DHCP", ipToHost.Len())
+		log.Debug("dns: added %d A/AAAA/PTR entries from DHCP", ipToHost.Len())
 	}
 
-	s.setTableHostToIP(hostToIP)
+	s.scheduleLeasesUpdate(nextExpiry)
+	s.setTableHostToIP(hostToIP, hostToIPv6)
 	s.setTableIPToHost(ipToHost)
+	s.updateDHCPZones(ipToHost)
 }
 
 // processDetermineLocal determines if the client's IP address is from
@@ -258,44 +376,37 @@ func (s *Server) processDetermineLocal(dctx *dnsContext) (rc resultCode) {
 	return rc
 }
 
-// hostToIP tries to get an IP leased by DHCP and returns the copy of address
-// since the data inside the internal table may be changed while request
-// processing.  It's safe for concurrent use.
-func (s *Server) hostToIP(host string) (ip net.IP, ok bool) {
+// hostToIP tries to get an IP address of the type requested by qtype leased by
+// DHCP and returns the copy of address since the data inside the internal
+// table may be changed while request processing.  ok is true if host has any
+// leased address, even if ip is nil.  It's safe for concurrent use.
+func (s *Server) hostToIP(host string, qtype uint16) (ip net.IP, ok bool) {
 	s.tableHostToIPLock.Lock()
 	defer s.tableHostToIPLock.Unlock()
 
-	if s.tableHostToIP == nil {
-		return nil, false
-	}
+	ip4, ok4 := s.tableHostToIP[host]
+	ip6, ok6 := s.tableHostToIPv6[host]
 
-	var ipFromTable net.IP
-	ipFromTable, ok = s.tableHostToIP[host]
-	if !ok {
-		return nil, false
+	if qtype == dns.TypeA {
+		ip = ip4
+	} else {
+		ip = ip6
 	}
 
-	ip = make(net.IP, len(ipFromTable))
-	copy(ip, ipFromTable)
-
-	return ip, true
+	return slices.Clone(ip), ok4 || ok6
 }
 
-// processInternalHosts respond to A requests if the target hostname is known to
-// the server.
-//
-// TODO(a.garipov): Adapt to AAAA as well.
+// processInternalHosts respond to A and AAAA requests if the target hostname
+// is known to the server.
 func (s *Server) processInternalHosts(dctx *dnsContext) (rc resultCode) {
-	if !s.dhcpServer.Enabled() {
+	if !s.dhcpServer.Enabled() || dctx.proxyCtx.Res != nil {
+		// Go on since either there are no leases or the response has
+		// already been set by the local zones.
 		return resultCodeSuccess
 	}
 
 	req := dctx.proxyCtx.Req
 	q := req.Question[0]
-
-	// Go on processing the AAAA request despite the fact that we don't
-	// support it yet.  The expected behavior here is to respond with an
-	// empty asnwer and not NXDOMAIN.
 	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
 		return resultCodeSuccess
 	}
@@ -315,7 +426,7 @@ func (s *Server) processInternalHosts(dctx *dnsContext) (rc resultCode) {
 		return resultCodeFinish
 	}
 
-	ip, ok := s.hostToIP(host)
+	ip, ok := s.hostToIP(host, q.Qtype)
 	if !ok {
 		// TODO(e.burkov): Inspect special cases when user want to apply some
 		// rules handled by other processors to the hosts with TLD.
@@ -326,13 +437,21 @@ func (s *Server) processInternalHosts(dctx *dnsContext) (rc resultCode) {
 
 	log.Debug("dns: internal record: %s -> %s", q.Name, ip)
 
+	// Respond with an empty answer and not NXDOMAIN if the host has no
+	// leased address of the requested type.
 	resp := s.makeResponse(req)
-	if q.Qtype == dns.TypeA {
-		a := &dns.A{
-			Hdr: s.hdr(req, dns.TypeA),
-			A:   ip,
+	if ip != nil {
+		if q.Qtype == dns.TypeA {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: s.hdr(req, dns.TypeA),
+				A:   ip,
+			})
+		} else {
+			resp.Answer = append(resp.Answer, &dns.AAAA{
+				Hdr:  s.hdr(req, dns.TypeAAAA),
+				AAAA: ip,
+			})
 		}
-		resp.Answer = append(resp.Answer, a)
 	}
 	dctx.proxyCtx.Res = resp
 
@@ -415,7 +534,8 @@ func (s *Server) ipToHost(ip net.IP) (host string, ok bool) {
 }
 
 // Respond to PTR requests if the target IP is leased by our DHCP server and the
-// requestor is inside the local network.
+// requestor is inside the local network.  The hostname is put under the local
+// domain, same as in processInternalHosts.
 func (s *Server) processInternalIPAddrs(ctx *dnsContext) (rc resultCode) {
 	d := ctx.proxyCtx
 	if d.Res != nil {
@@ -443,7 +563,7 @@ func (s *Server) processInternalIPAddrs(ctx *dnsContext) (rc resultCode) {
 			Ttl:    s.conf.BlockedResponseTTL,
 			Class:  dns.ClassINET,
 		},
-		Ptr: dns.Fqdn(host),
+		Ptr: host + s.localDomainSuffix,
 	}
 	resp.Answer = append(resp.Answer, ptr)
 	d.Res = resp
@@ -543,7 +663,11 @@ func (s *Server) processUpstream(dctx *dnsContext) (rc resultCode) {
 		}
 	}
 
+	lr := s.listenerRule(pctx)
+	useCache := lr.usesCache()
+
 	req := pctx.Req
+	clientAD := req.AuthenticatedData
 	origReqAD := false
 	if s.conf.EnableDNSSEC {
 		if req.AuthenticatedData {
@@ -553,15 +677,53 @@ func (s *Server) processUpstream(dctx *dnsContext) (rc resultCode) {
 		}
 	}
 
+	dnssecState := s.prepareDNSSECRequest(req)
+
 	// Process the request further since it wasn't filtered.
 	prx := s.proxy()
 	if prx == nil {
+		dnssecState.restore(req)
 		dctx.err = srvClosedErr
 
 		return resultCodeError
 	}
 
-	if dctx.err = prx.Resolve(pctx); dctx.err != nil {
+	// dnsproxy adds the EDNS Client Subnet option if it's enabled globally or
+	// on any listener, so that its cache takes the subnets into account.
+	var clientAddr net.Addr
+	if prx.EnableEDNSClientSubnet && !lr.ecsEnabled(s.conf.EnableEDNSClientSubnet) {
+		clientAddr = hideClientAddr(pctx)
+	}
+
+	if !useCache && pctx.CustomUpstreamConfig == nil {
+		// dnsproxy doesn't use the cache for the requests with the custom
+		// upstreams.
+		pctx.CustomUpstreamConfig = prx.UpstreamConfig
+	}
+
+	dctx.err = prx.Resolve(pctx)
+	if errors.Is(dctx.err, errConsensusDiverged) {
+		dctx.consensusDiverged, dctx.err = true, nil
+		pctx.Res = s.genServerFailure(req)
+	}
+	dnssecState.restore(req)
+
+	if clientAddr != nil {
+		pctx.Addr = clientAddr
+	}
+
+	if dctx.err != nil {
+		if s.serveStale(dctx) {
+			return resultCodeSuccess
+		}
+
+		s.setExtendedError(
+			pctx.Req,
+			pctx.Res,
+			dns.ExtendedErrorCodeNetworkError,
+			fmt.Sprintf("upstream: %s", dctx.err),
+		)
+
 		return resultCodeError
 	}
 
@@ -573,6 +735,10 @@ func (s *Server) processUpstream(dctx *dnsContext) (rc resultCode) {
 		pctx.Res.AuthenticatedData = false
 	}
 
+	s.validateDNSSEC(dctx, dnssecState, clientAD)
+
+	s.storeStale(dctx)
+
 	return resultCodeSuccess
 }
 
@@ -0,0 +1,532 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/stringutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+)
+
+// dns64DiscoveryName is the name used to discover the NAT64 prefix, see RFC
+// 7050.
+const dns64DiscoveryName = "ipv4only.arpa."
+
+// defaultDNS64RefreshIvl is the interval between the refreshes of the NAT64
+// prefix and the networks of the interfaces used when the interval isn't set.
+const defaultDNS64RefreshIvl = 1 * time.Hour
+
+// dns64WellKnownIPs are the well-known IPv4 addresses of ipv4only.arpa, see
+// RFC 7050.
+var dns64WellKnownIPs = []net.IP{{192, 0, 0, 170}, {192, 0, 0, 171}}
+
+// dns64WellKnownPrefix is the Well-Known Prefix, which must not be used with
+// the non-global IPv4 addresses, see RFC 6052.
+var dns64WellKnownPrefix = mustParseCIDRs("64:ff9b::/96")[0]
+
+// dns64PrefixLens are the lengths of the NAT64 prefixes allowed by RFC 6052,
+// the longest first.
+var dns64PrefixLens = []int{96, 64, 56, 48, 40, 32}
+
+// DNS64Config is the configuration of the synthesis of the AAAA records from
+// the A ones for the IPv6-only clients behind a NAT64, see RFC 6147.
+type DNS64Config struct {
+	// Prefix is the NAT64 prefix, for example "64:ff9b::/96".  If it's empty,
+	// the prefix is discovered via ipv4only.arpa, see RFC 7050.
+	Prefix string `yaml:"prefix"`
+
+	// Clients are the IP addresses, CIDRs, and ClientIDs of the clients, for
+	// which the records are synthesized.
+	Clients []string `yaml:"clients"`
+
+	// Interfaces are the names of the network interfaces, for the clients
+	// from the networks of which the records are synthesized.
+	Interfaces []string `yaml:"interfaces"`
+
+	// RefreshInterval is the interval between the discoveries of the NAT64
+	// prefix and the updates of the networks of Interfaces.  If it's zero,
+	// they're refreshed every hour.
+	RefreshInterval timeutil.Duration `yaml:"refresh_interval"`
+
+	// Enabled, if true, enables the synthesis.  The clients querying over
+	// IPv4 are considered dual-stack, so the records are never synthesized
+	// for them.
+	Enabled bool `yaml:"enabled"`
+}
+
+// validateNAT64Prefix returns an error if n isn't a valid NAT64 prefix.
+func validateNAT64Prefix(n *net.IPNet) (err error) {
+	ones, bits := n.Mask.Size()
+	if bits != net.IPv6len*8 {
+		return fmt.Errorf("prefix %s isn't ipv6", n)
+	}
+
+	for _, l := range dns64PrefixLens {
+		if l != ones {
+			continue
+		}
+
+		if l > 64 && n.IP[8] != 0 {
+			return fmt.Errorf("prefix %s has non-zero bits 64 to 71", n)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("bad prefix length %d", ones)
+}
+
+// embedIPv4 returns the IPv4-embedded IPv6 address of ip4 within prefix, see
+// RFC 6052.
+func embedIPv4(prefix *net.IPNet, ip4 net.IP) (ip net.IP) {
+	ones, _ := prefix.Mask.Size()
+
+	ip = make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.Mask(prefix.Mask))
+
+	pos := ones / 8
+	for _, b := range ip4.To4() {
+		// Skip the bits 64 to 71, which must be zero.
+		if pos == 8 {
+			pos++
+		}
+
+		ip[pos] = b
+		pos++
+	}
+
+	return ip
+}
+
+// extractIPv4 returns the IPv4 address embedded into ip with the prefix of
+// length ones, see RFC 6052.
+func extractIPv4(ip net.IP, ones int) (ip4 net.IP) {
+	ip4 = make(net.IP, net.IPv4len)
+
+	pos := ones / 8
+	for i := range ip4 {
+		if pos == 8 {
+			pos++
+		}
+
+		ip4[i] = ip[pos]
+		pos++
+	}
+
+	return ip4
+}
+
+// nat64PrefixFromAnswer returns the NAT64 prefix, with which one of the
+// well-known addresses of ipv4only.arpa is embedded into the addresses of
+// answer.  It returns nil if there is none.
+func nat64PrefixFromAnswer(answer []dns.RR) (prefix *net.IPNet) {
+	for _, rr := range answer {
+		aaaa, ok := rr.(*dns.AAAA)
+		if !ok {
+			continue
+		}
+
+		for _, ones := range dns64PrefixLens {
+			ip4 := extractIPv4(aaaa.AAAA, ones)
+			for _, wk := range dns64WellKnownIPs {
+				if !ip4.Equal(wk) {
+					continue
+				}
+
+				mask := net.CIDRMask(ones, net.IPv6len*8)
+
+				return &net.IPNet{IP: aaaa.AAAA.Mask(mask), Mask: mask}
+			}
+		}
+	}
+
+	return nil
+}
+
+// dns64 synthesizes the AAAA records for the selected IPv6-only clients.
+type dns64 struct {
+	// exchange sends the internal requests, such as the discovery ones.
+	exchange func(req *dns.Msg) (resp *dns.Msg, err error)
+
+	// done is closed to stop the refreshing.
+	done chan struct{}
+
+	// mu protects prefix and ifaceNets.
+	mu *sync.RWMutex
+
+	// prefix is the current NAT64 prefix.  It's nil if it isn't discovered
+	// yet.
+	prefix *net.IPNet
+
+	// ifaceNets are the current networks of the interfaces.
+	ifaceNets []*net.IPNet
+
+	// clientNets are the networks of the selected clients.
+	clientNets []*net.IPNet
+
+	// clientIDs are the ClientIDs of the selected clients.
+	clientIDs *stringutil.Set
+
+	// ifaces are the names of the selected interfaces.
+	ifaces []string
+
+	// refreshIvl is the interval between the refreshes.
+	refreshIvl time.Duration
+
+	// discover is true if the prefix should be discovered.
+	discover bool
+}
+
+// newDNS64 returns a new properly initialized *dns64.  It returns nil if the
+// synthesis is disabled.
+func newDNS64(
+	conf *DNS64Config,
+	exchange func(req *dns.Msg) (resp *dns.Msg, err error),
+) (d *dns64, err error) {
+	if !conf.Enabled {
+		return nil, nil
+	}
+
+	d = &dns64{
+		exchange:   exchange,
+		mu:         &sync.RWMutex{},
+		clientIDs:  stringutil.NewSet(),
+		ifaces:     conf.Interfaces,
+		refreshIvl: conf.RefreshInterval.Duration,
+		discover:   conf.Prefix == "",
+	}
+
+	if d.refreshIvl <= 0 {
+		d.refreshIvl = defaultDNS64RefreshIvl
+	}
+
+	if conf.Prefix != "" {
+		var n *net.IPNet
+		_, n, err = net.ParseCIDR(conf.Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("bad prefix: %w", err)
+		}
+
+		err = validateNAT64Prefix(n)
+		if err != nil {
+			return nil, err
+		}
+
+		d.prefix = n
+	}
+
+	for _, c := range conf.Clients {
+		if ip := net.ParseIP(c); ip != nil {
+			d.clientNets = append(d.clientNets, &net.IPNet{
+				IP:   ip,
+				Mask: net.CIDRMask(net.IPv6len*8, net.IPv6len*8),
+			})
+		} else if _, n, cidrErr := net.ParseCIDR(c); cidrErr == nil {
+			d.clientNets = append(d.clientNets, n)
+		} else if err = ValidateClientID(c); err == nil {
+			d.clientIDs.Add(c)
+		} else {
+			return nil, fmt.Errorf("bad client %q", c)
+		}
+	}
+
+	return d, nil
+}
+
+// start starts refreshing the prefix and the networks of the interfaces.  d
+// may be nil.
+func (d *dns64) start() {
+	if d == nil || d.done != nil {
+		return
+	}
+
+	d.done = make(chan struct{})
+	go d.run(d.done)
+}
+
+// stop stops refreshing.  d may be nil.
+func (d *dns64) stop() {
+	if d == nil || d.done == nil {
+		return
+	}
+
+	close(d.done)
+	d.done = nil
+}
+
+// run refreshes the prefix and the networks of the interfaces until done is
+// closed.
+func (d *dns64) run(done <-chan struct{}) {
+	defer aghos.OnPanicAndExit("dns: dns64")
+
+	t := time.NewTicker(d.refreshIvl)
+	defer t.Stop()
+
+	for {
+		d.refresh()
+
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			// Go on.
+		}
+	}
+}
+
+// refresh discovers the prefix, if needed, and updates the networks of the
+// interfaces.
+func (d *dns64) refresh() {
+	var prefix *net.IPNet
+	if d.discover {
+		var err error
+		prefix, err = d.discoverPrefix()
+		if err != nil {
+			log.Info("dns: dns64: discovering prefix: %s", err)
+		} else {
+			log.Debug("dns: dns64: discovered prefix %s", prefix)
+		}
+	}
+
+	var nets []*net.IPNet
+	for _, name := range d.ifaces {
+		ifaceNets, err := interfaceNets(name)
+		if err != nil {
+			log.Info("dns: dns64: getting networks of %s: %s", name, err)
+
+			continue
+		}
+
+		nets = append(nets, ifaceNets...)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Keep the previous prefix, if the discovery has failed.
+	if prefix != nil {
+		d.prefix = prefix
+	}
+
+	d.ifaceNets = nets
+}
+
+// discoverPrefix discovers the NAT64 prefix via ipv4only.arpa.
+func (d *dns64) discoverPrefix() (prefix *net.IPNet, err error) {
+	req := (&dns.Msg{}).SetQuestion(dns64DiscoveryName, dns.TypeAAAA)
+	resp, err := d.exchange(req)
+	if err != nil {
+		return nil, err
+	} else if resp == nil {
+		return nil, errors.Error("no response")
+	}
+
+	prefix = nat64PrefixFromAnswer(resp.Answer)
+	if prefix == nil {
+		return nil, errors.Error("no nat64 prefix in response")
+	}
+
+	return prefix, nil
+}
+
+// exchangeInternal resolves req using the internal proxy.
+func (s *Server) exchangeInternal(req *dns.Msg) (resp *dns.Msg, err error) {
+	pctx := &proxy.DNSContext{
+		Proto:     proxy.ProtoUDP,
+		Req:       req,
+		StartTime: time.Now(),
+	}
+
+	err = s.internalProxy.Resolve(pctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return pctx.Res, nil
+}
+
+// interfaceNets returns the networks of the network interface with name.
+func interfaceNets(name string) (nets []*net.IPNet, err error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok {
+			nets = append(nets, n)
+		}
+	}
+
+	return nets, nil
+}
+
+// currentPrefix returns the current NAT64 prefix, if any.
+func (d *dns64) currentPrefix() (prefix *net.IPNet) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.prefix
+}
+
+// selects returns true if the records are synthesized for the client with ip
+// and clientID.  enabled is the per-client setting.
+func (d *dns64) selects(ip net.IP, clientID string, enabled bool) (ok bool) {
+	if ip == nil || ip.To4() != nil {
+		// The clients querying over IPv4 are dual-stack.
+		return false
+	}
+
+	if enabled || (clientID != "" && d.clientIDs.Has(clientID)) {
+		return true
+	}
+
+	for _, n := range d.clientNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, n := range d.ifaceNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// synthesizeAAAA returns the AAAA records embedding the addresses of the A
+// records of answer within prefix and their number.  The other records are
+// kept.  ttlCap, if not zero, caps the TTLs of the synthesized records.
+func (s *Server) synthesizeAAAA(
+	answer []dns.RR,
+	prefix *net.IPNet,
+	ttlCap uint32,
+) (rrs []dns.RR, n int) {
+	wellKnown := prefix.IP.Equal(dns64WellKnownPrefix.IP) &&
+		prefix.Mask.String() == dns64WellKnownPrefix.Mask.String()
+
+	for _, rr := range answer {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			rrs = append(rrs, rr)
+
+			continue
+		}
+
+		if ip4 := a.A.To4(); ip4 == nil || ip4.IsUnspecified() || ip4.IsLoopback() {
+			continue
+		} else if wellKnown && s.isRebindingIP(ip4) {
+			continue
+		}
+
+		ttl := a.Hdr.Ttl
+		if ttlCap != 0 && ttl > ttlCap {
+			ttl = ttlCap
+		}
+
+		rrs = append(rrs, &dns.AAAA{
+			Hdr: dns.RR_Header{
+				Name:   a.Hdr.Name,
+				Rrtype: dns.TypeAAAA,
+				Class:  a.Hdr.Class,
+				Ttl:    ttl,
+			},
+			AAAA: embedIPv4(prefix, a.A),
+		})
+		n++
+	}
+
+	return rrs, n
+}
+
+// processDNS64 synthesizes the AAAA records for the selected clients, if the
+// name has no AAAA records of its own.
+func (s *Server) processDNS64(dctx *dnsContext) (rc resultCode) {
+	d := s.dns64
+	pctx := dctx.proxyCtx
+	if d == nil || !dctx.responseFromUpstream || pctx.Res == nil {
+		return resultCodeSuccess
+	}
+
+	q := pctx.Req.Question[0]
+	if q.Qtype != dns.TypeAAAA || pctx.Res.Rcode != dns.RcodeSuccess {
+		return resultCodeSuccess
+	} else if _, answered := cnameChain(pctx.Res.Answer, q.Name, dns.TypeAAAA); answered {
+		return resultCodeSuccess
+	}
+
+	// The validating clients must get the unmodified responses, see RFC
+	// 6147.
+	if opt := pctx.Req.IsEdns0(); opt != nil && opt.Do() && pctx.Req.CheckingDisabled {
+		return resultCodeSuccess
+	}
+
+	setts := dctx.setts
+	enabled := setts != nil && setts.DNS64
+	ip, _ := netutil.IPAndPortFromAddr(pctx.Addr)
+	if !d.selects(ip, dctx.clientID, enabled) {
+		return resultCodeSuccess
+	}
+
+	prefix := d.currentPrefix()
+	if prefix == nil {
+		return resultCodeSuccess
+	}
+
+	aCtx := &proxy.DNSContext{
+		Proto:                proxy.ProtoUDP,
+		Req:                  (&dns.Msg{}).SetQuestion(q.Name, dns.TypeA),
+		StartTime:            time.Now(),
+		CustomUpstreamConfig: pctx.CustomUpstreamConfig,
+	}
+
+	err := s.internalProxy.Resolve(aCtx)
+	if err != nil || aCtx.Res == nil || aCtx.Res.Rcode != dns.RcodeSuccess {
+		log.Debug("dns: dns64: looking up a records of %s: %v", q.Name, err)
+
+		return resultCodeSuccess
+	}
+
+	// The TTL of the synthesized records must not exceed the negative caching
+	// TTL of the AAAA response, see RFC 6147.
+	var ttlCap uint32
+	for _, rr := range pctx.Res.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttlCap = soa.Minttl
+			if soa.Hdr.Ttl < ttlCap {
+				ttlCap = soa.Hdr.Ttl
+			}
+		}
+	}
+
+	answer, n := s.synthesizeAAAA(aCtx.Res.Answer, prefix, ttlCap)
+	if n == 0 {
+		return resultCodeSuccess
+	}
+
+	log.Debug("dns: dns64: synthesized %d aaaa records for %s", n, q.Name)
+
+	pctx.Res.Answer = answer
+	pctx.Res.Ns = nil
+	pctx.Res.AuthenticatedData = false
+
+	return resultCodeSuccess
+}
@@ -0,0 +1,247 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbedIPv4(t *testing.T) {
+	ip4 := net.IP{192, 0, 2, 33}
+
+	// See the examples in RFC 6052, section 2.4.
+	testCases := []struct {
+		prefix string
+		want   string
+	}{{
+		prefix: "2001:db8::/32",
+		want:   "2001:db8:c000:221::",
+	}, {
+		prefix: "2001:db8:100::/40",
+		want:   "2001:db8:1c0:2:21::",
+	}, {
+		prefix: "2001:db8:122::/48",
+		want:   "2001:db8:122:c000:2:2100::",
+	}, {
+		prefix: "2001:db8:122:300::/56",
+		want:   "2001:db8:122:3c0:0:221::",
+	}, {
+		prefix: "2001:db8:122:344::/64",
+		want:   "2001:db8:122:344:c0:2:2100:0",
+	}, {
+		prefix: "2001:db8:122:344::/96",
+		want:   "2001:db8:122:344::192.0.2.33",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.prefix, func(t *testing.T) {
+			_, n, err := net.ParseCIDR(tc.prefix)
+			require.NoError(t, err)
+			require.NoError(t, validateNAT64Prefix(n))
+
+			ip := embedIPv4(n, ip4)
+			assert.Equal(t, net.ParseIP(tc.want), ip)
+
+			ones, _ := n.Mask.Size()
+			assert.Equal(t, ip4, extractIPv4(ip, ones))
+		})
+	}
+}
+
+func TestNAT64PrefixFromAnswer(t *testing.T) {
+	_, n, err := net.ParseCIDR("2001:db8:122::/48")
+	require.NoError(t, err)
+
+	answer := []dns.RR{
+		newCNAME(dns64DiscoveryName, "nat64.example."),
+		newAAAA("nat64.example.", embedIPv4(n, net.IP{192, 0, 0, 171})),
+	}
+
+	assert.Equal(t, n, nat64PrefixFromAnswer(answer))
+
+	answer = []dns.RR{newAAAA(dns64DiscoveryName, net.ParseIP("2001:db8::1"))}
+	assert.Nil(t, nat64PrefixFromAnswer(answer))
+}
+
+func TestNewDNS64_errors(t *testing.T) {
+	testCases := []struct {
+		conf       *DNS64Config
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       &DNS64Config{Enabled: true, Prefix: "2001:db8::/80"},
+		name:       "bad_prefix_length",
+		wantErrMsg: "bad prefix length 80",
+	}, {
+		conf:       &DNS64Config{Enabled: true, Prefix: "2001:db8:0:0:ff00::/96"},
+		name:       "bad_u_octet",
+		wantErrMsg: "prefix 2001:db8:0:0:ff00::/96 has non-zero bits 64 to 71",
+	}, {
+		conf:       &DNS64Config{Enabled: true, Prefix: "192.0.2.0/24"},
+		name:       "ipv4_prefix",
+		wantErrMsg: "prefix 192.0.2.0/24 isn't ipv6",
+	}, {
+		conf:       &DNS64Config{Enabled: true, Clients: []string{"!bad"}},
+		name:       "bad_client",
+		wantErrMsg: `bad client "!bad"`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newDNS64(tc.conf, nil)
+			require.Error(t, err)
+
+			assert.Equal(t, tc.wantErrMsg, err.Error())
+		})
+	}
+
+	d, err := newDNS64(&DNS64Config{Prefix: "bad"}, nil)
+	require.NoError(t, err)
+
+	assert.Nil(t, d)
+}
+
+func TestDNS64_selects(t *testing.T) {
+	d, err := newDNS64(&DNS64Config{
+		Enabled: true,
+		Clients: []string{"2001:db8:1::/64", "2001:db8:2::1", "phone"},
+	}, nil)
+	require.NoError(t, err)
+
+	_, ifaceNet, err := net.ParseCIDR("2001:db8:3::/64")
+	require.NoError(t, err)
+
+	d.ifaceNets = []*net.IPNet{ifaceNet}
+
+	testCases := []struct {
+		name     string
+		ip       net.IP
+		clientID string
+		enabled  bool
+		want     bool
+	}{{
+		name: "subnet",
+		ip:   net.ParseIP("2001:db8:1::5"),
+		want: true,
+	}, {
+		name: "ip",
+		ip:   net.ParseIP("2001:db8:2::1"),
+		want: true,
+	}, {
+		name:     "client_id",
+		ip:       net.ParseIP("2001:db8:4::1"),
+		clientID: "phone",
+		want:     true,
+	}, {
+		name: "interface",
+		ip:   net.ParseIP("2001:db8:3::1"),
+		want: true,
+	}, {
+		name:    "persistent",
+		ip:      net.ParseIP("2001:db8:4::1"),
+		enabled: true,
+		want:    true,
+	}, {
+		name: "other",
+		ip:   net.ParseIP("2001:db8:4::1"),
+		want: false,
+	}, {
+		name:    "ipv4",
+		ip:      net.IP{192, 0, 2, 1},
+		enabled: true,
+		want:    false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, d.selects(tc.ip, tc.clientID, tc.enabled))
+		})
+	}
+}
+
+func TestServer_processDNS64(t *testing.T) {
+	s := createTestServer(t, &filtering.Config{}, ServerConfig{
+		UDPListenAddrs: []*net.UDPAddr{{}},
+		TCPListenAddrs: []*net.TCPAddr{{}},
+	}, nil)
+	s.internalProxy.UpstreamConfig.Upstreams = []upstream.Upstream{
+		&noDataUpstream{
+			a: map[string]net.IP{
+				"ipv4.example.": {192, 0, 2, 33},
+				"dual.example.": {192, 0, 2, 34},
+			},
+		},
+	}
+
+	var err error
+	s.dns64, err = newDNS64(&DNS64Config{
+		Enabled: true,
+		Prefix:  "2001:db8:64::/96",
+		Clients: []string{"2001:db8::/64"},
+	}, nil)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name     string
+		host     string
+		clientIP net.IP
+		answer   []dns.RR
+		want     []dns.RR
+	}{{
+		name:     "synthesized",
+		host:     "ipv4.example.",
+		clientIP: net.ParseIP("2001:db8::1"),
+		answer:   nil,
+		want: []dns.RR{
+			newAAAA("ipv4.example.", net.ParseIP("2001:db8:64::192.0.2.33")),
+		},
+	}, {
+		name:     "has_aaaa",
+		host:     "dual.example.",
+		clientIP: net.ParseIP("2001:db8::1"),
+		answer:   []dns.RR{newAAAA("dual.example.", net.ParseIP("2001:db8:5::1"))},
+		want:     []dns.RR{newAAAA("dual.example.", net.ParseIP("2001:db8:5::1"))},
+	}, {
+		name:     "not_selected",
+		host:     "ipv4.example.",
+		clientIP: net.ParseIP("2001:db8:1::1"),
+		answer:   nil,
+		want:     nil,
+	}, {
+		name:     "ipv4_client",
+		host:     "ipv4.example.",
+		clientIP: net.IP{192, 0, 2, 1},
+		answer:   nil,
+		want:     nil,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := (&dns.Msg{}).SetQuestion(tc.host, dns.TypeAAAA)
+			resp := (&dns.Msg{}).SetReply(req)
+			resp.Answer = tc.answer
+
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Req:  req,
+					Res:  resp,
+					Addr: &net.UDPAddr{IP: tc.clientIP, Port: 53},
+				},
+				setts:                &filtering.Settings{},
+				result:               &filtering.Result{},
+				responseFromUpstream: true,
+			}
+
+			rc := s.processDNS64(dctx)
+			require.Equal(t, resultCodeSuccess, rc)
+
+			assert.Equal(t, tc.want, dctx.proxyCtx.Res.Answer)
+		})
+	}
+}
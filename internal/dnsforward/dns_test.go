@@ -3,9 +3,11 @@ package dnsforward
 import (
 	"net"
 	"testing"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/dnsproxy/upstream"
@@ -148,6 +150,7 @@ func TestServer_ProcessInternalHosts(t *testing.T) {
 	)
 
 	knownIP := net.IP{1, 2, 3, 4}
+	knownIPv6 := net.ParseIP("fd00::1")
 	testCases := []struct {
 		name    string
 		host    string
@@ -190,6 +193,20 @@ func TestServer_ProcessInternalHosts(t *testing.T) {
 		wantIP:  nil,
 		wantRes: resultCodeSuccess,
 		qtyp:    dns.TypeAAAA,
+	}, {
+		name:    "success_internal_aaaa_known",
+		host:    "example6.lan",
+		suffix:  defaultLocalDomainSuffix,
+		wantIP:  knownIPv6,
+		wantRes: resultCodeSuccess,
+		qtyp:    dns.TypeAAAA,
+	}, {
+		name:    "success_internal_a_only_aaaa",
+		host:    "example6.lan",
+		suffix:  defaultLocalDomainSuffix,
+		wantIP:  nil,
+		wantRes: resultCodeSuccess,
+		qtyp:    dns.TypeA,
 	}, {
 		name:    "success_custom_suffix",
 		host:    "example.custom",
@@ -207,6 +224,9 @@ func TestServer_ProcessInternalHosts(t *testing.T) {
 				tableHostToIP: hostToIPTable{
 					"example": knownIP,
 				},
+				tableHostToIPv6: hostToIPTable{
+					"example6": knownIPv6,
+				},
 			}
 
 			req := &dns.Msg{
@@ -239,27 +259,105 @@ func TestServer_ProcessInternalHosts(t *testing.T) {
 
 			require.NoError(t, dctx.err)
 
-			if tc.qtyp == dns.TypeAAAA {
-				// TODO(a.garipov): Remove this special handling
-				// when we fully support AAAA.
-				require.NotNil(t, pctx.Res)
+			if tc.host == examplecom || tc.qtyp == dns.TypeCNAME {
+				assert.Nil(t, pctx.Res)
 
-				ans := pctx.Res.Answer
+				return
+			}
+
+			require.NotNil(t, pctx.Res)
+
+			ans := pctx.Res.Answer
+			if tc.wantIP == nil {
+				// The known hosts without the addresses of the
+				// requested type get an empty answer.
 				require.Len(t, ans, 0)
-			} else if tc.wantIP == nil {
-				assert.Nil(t, pctx.Res)
-			} else {
-				require.NotNil(t, pctx.Res)
 
-				ans := pctx.Res.Answer
-				require.Len(t, ans, 1)
+				return
+			}
+
+			require.Len(t, ans, 1)
 
+			if tc.qtyp == dns.TypeAAAA {
+				assert.Equal(t, tc.wantIP, ans[0].(*dns.AAAA).AAAA)
+			} else {
 				assert.Equal(t, tc.wantIP, ans[0].(*dns.A).A)
 			}
 		})
 	}
 }
 
+// leasesDHCP is a DHCP server for tests with the leases set by the test.
+type leasesDHCP struct {
+	testDHCP
+
+	leases []*dhcpd.Lease
+}
+
+// Leases implements the dhcpd.ServerInterface interface for *leasesDHCP.
+func (d *leasesDHCP) Leases(_ dhcpd.GetLeasesFlags) (leases []*dhcpd.Lease) {
+	return d.leases
+}
+
+func TestServer_onDHCPLeaseChanged(t *testing.T) {
+	dhcp := &leasesDHCP{
+		leases: []*dhcpd.Lease{{
+			Expiry:   time.Now().Add(time.Hour),
+			Hostname: "NAS",
+			IP:       net.IP{192, 168, 1, 2},
+		}, {
+			Expiry:   time.Now().Add(time.Hour),
+			Hostname: "nas",
+			IP:       net.ParseIP("fd00::2"),
+		}, {
+			Expiry:   time.Unix(1, 0),
+			Hostname: "printer",
+			IP:       net.IP{192, 168, 1, 3},
+		}},
+	}
+
+	s := &Server{
+		dhcpServer:        dhcp,
+		localDomainSuffix: defaultLocalDomainSuffix,
+	}
+	t.Cleanup(func() { s.scheduleLeasesUpdate(time.Time{}) })
+
+	s.onDHCPLeaseChanged(dhcpd.LeaseChangedAdded)
+
+	ip, ok := s.hostToIP("nas", dns.TypeA)
+	require.True(t, ok)
+	assert.Equal(t, net.IP{192, 168, 1, 2}, ip)
+
+	ip, ok = s.hostToIP("nas", dns.TypeAAAA)
+	require.True(t, ok)
+	assert.Equal(t, net.ParseIP("fd00::2"), ip)
+
+	host, ok := s.ipToHost(net.ParseIP("fd00::2"))
+	require.True(t, ok)
+	assert.Equal(t, "nas", host)
+
+	// The update is scheduled for the earliest dynamic lease only.
+	require.NotNil(t, s.leasesTimer)
+
+	// Expire the dynamic leases and make the update fire right away.
+	dhcp.leases = dhcp.leases[2:]
+	s.scheduleLeasesUpdate(time.Now())
+
+	assert.Eventually(t, func() (ok bool) {
+		_, ok = s.hostToIP("nas", dns.TypeA)
+
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+
+	_, ok = s.hostToIP("printer", dns.TypeA)
+	assert.True(t, ok)
+
+	s.leasesTimerLock.Lock()
+	defer s.leasesTimerLock.Unlock()
+
+	assert.Nil(t, s.leasesTimer)
+}
+
 func TestServer_ProcessRestrictLocal(t *testing.T) {
 	ups := &aghtest.TestUpstream{
 		Reverse: map[string][]string{
@@ -8,6 +8,7 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
@@ -48,7 +49,8 @@ var defaultBlockedHosts = []string{"version.bind", "id.server", "hostname.bind"}
 
 var webRegistered bool
 
-// hostToIPTable is an alias for the type of Server.tableHostToIP.
+// hostToIPTable is an alias for the type of Server.tableHostToIP and
+// Server.tableHostToIPv6.
 type hostToIPTable = map[string]net.IP
 
 // Server is the main way to start a DNS server.
@@ -69,6 +71,98 @@ type Server struct {
 	stats      stats.Stats
 	access     *accessCtx
 
+	// privacy are the parsed response privacy settings.
+	privacy []*privacyRule
+
+	// listeners are the parsed listener settings.
+	listeners []*listenerRule
+
+	// dot is the DNS-over-TLS server used instead of the one from dnsProxy
+	// when the DNS-over-TLS tuning settings are set.  It's nil otherwise.
+	dot *dotServer
+
+	// udp is the plain DNS-over-UDP server used instead of the one from
+	// dnsProxy when the listeners are tuned.  It's nil otherwise.
+	udp *udpServer
+
+	// xfr serves the zone transfers of the local records.  It's nil if the
+	// zone transfers are disabled.
+	xfr *xfrServer
+
+	// health is the checker of the upstreams' health.  It's nil if the health
+	// checks are disabled.
+	health *healthChecker
+
+	// tracer exports the traces of the query processing.  It's nil if the
+	// tracing is disabled.
+	tracer *tracer
+
+	// dohAuth authorizes the DNS-over-HTTPS clients using the external
+	// webhook.  It's nil if the webhook isn't set or the client certificates
+	// are required.
+	dohAuth *dohAuth
+
+	// tlsUpstreams are the DNS-over-TLS and DNS-over-HTTPS upstreams
+	// connected to by AdGuard Home itself by their addresses.  See
+	// handleUpstreamsPool.
+	tlsUpstreams map[string]*tlsUpstream
+
+	// ddr upgrades the plain upstreams to their designated resolvers.  It's
+	// nil if the discovery is disabled.
+	ddr *ddrDiscoverer
+
+	// spoof are the counters of the spoofing detection.
+	spoof *spoofCounters
+
+	// ratelimiter limits the requests from the clients.  It's nil if the
+	// ratelimit is disabled.
+	ratelimiter *ratelimiter
+
+	// dohBypass are the detected attempts to bypass the filtering using the
+	// public DNS-over-HTTPS providers.
+	dohBypass *dohBypass
+
+	// rpz are the response policy zones.  It's nil if there are none.
+	rpz *rpzSet
+
+	// answerNetsStrip is true if only the answers within the blocked
+	// networks are removed from the responses instead of blocking the whole
+	// responses.
+	answerNetsStrip bool
+
+	// bogusNXDomain are the networks of the addresses, the responses with
+	// which are replaced with NXDOMAIN ones.
+	bogusNXDomain []*net.IPNet
+
+	// dns64 synthesizes the AAAA records for the IPv6-only clients.  It's nil
+	// if the synthesis is disabled.
+	dns64 *dns64
+
+	// blocked are the latest block decisions for each client.  See
+	// processBlockAttribution.
+	blocked cache.Cache
+
+	// upstreamTestMu protects upstreamTestReport.
+	upstreamTestMu sync.Mutex
+
+	// upstreamTestReport is the report of the latest bulk upstream test.  It's
+	// nil until loaded or until the first test.
+	upstreamTestReport *upstreamTestReport
+
+	// stale are the latest upstream responses served when all the upstreams
+	// fail.  See serveStale.
+	stale *staleCache
+
+	// staleRefreshMu protects staleRefreshing.
+	staleRefreshMu *sync.Mutex
+
+	// staleRefreshing are the keys of stale, which are being refreshed in the
+	// background.
+	staleRefreshing map[string]struct{}
+
+	// snapshot mirrors the cache of dnsProxy to persist it across restarts.
+	snapshot *cacheSnapshot
+
 	// localDomainSuffix is the suffix used to detect internal hosts.  It
 	// must be a valid domain name plus dots on each side.
 	localDomainSuffix string
@@ -82,12 +176,26 @@ type Server struct {
 	// anonymizer masks the client's IP addresses if needed.
 	anonymizer *aghnet.IPMut
 
+	// tableHostToIP and tableHostToIPv6 are the IPv4 and IPv6 addresses
+	// leased by the DHCP server by the lowercased hostnames.  Both are
+	// protected by tableHostToIPLock.
 	tableHostToIP     hostToIPTable
+	tableHostToIPv6   hostToIPTable
 	tableHostToIPLock sync.Mutex
 
-	tableIPToHost     *netutil.IPMap
+	tableIPToHost     *aghnet.IPMap
 	tableIPToHostLock sync.Mutex
 
+	// dhcpZones are the reverse zones generated for the networks of the
+	// DHCP server.  It's protected by dhcpZonesLock.
+	dhcpZones     *localZones
+	dhcpZonesLock sync.Mutex
+
+	// leasesTimer rebuilds the tables of the DHCP leases when the earliest
+	// of the dynamic ones expires.  It's protected by leasesTimerLock.
+	leasesTimer     *time.Timer
+	leasesTimerLock sync.Mutex
+
 	// clientIDCache is a temporary storage for clientIDs that were
 	// extracted during the BeforeRequestHandler stage.
 	clientIDCache cache.Cache
@@ -96,7 +204,20 @@ type Server struct {
 	// We don't Start() it and so no listen port is required.
 	internalProxy *proxy.Proxy
 
-	isRunning bool
+	// dnssec validates the upstream responses if DNSSECValidation is
+	// enabled.
+	dnssec *dnssecValidator
+
+	// localZones are the compiled LocalZones.
+	localZones *localZones
+
+	// views are the compiled Views.
+	views []*view
+
+	// isRunning is 1 if the server is running.  It's only changed with
+	// serverLock locked, but it's read atomically without locking, so that
+	// the crash reports can include it.
+	isRunning uint32
 
 	conf ServerConfig
 	// serverLock protects Server.
@@ -146,7 +267,7 @@ func NewServer(p DNSCreateParams) (s *Server, err error) {
 	if p.LocalDomain == "" {
 		localDomainSuffix = defaultLocalDomainSuffix
 	} else {
-		err = netutil.ValidateDomainName(p.LocalDomain)
+		err = netutil.ValidateHostname(p.LocalDomain)
 		if err != nil {
 			return nil, fmt.Errorf("local domain: %w", err)
 		}
@@ -168,8 +289,19 @@ func NewServer(p DNSCreateParams) (s *Server, err error) {
 			EnableLRU: true,
 			MaxCount:  defaultClientIDCacheCount,
 		}),
-		anonymizer: p.Anonymizer,
+		blocked: cache.New(cache.Config{
+			EnableLRU: true,
+			MaxCount:  defaultBlockedCacheCount,
+		}),
+		stale:           newStaleCache(defaultStaleCacheCount),
+		staleRefreshMu:  &sync.Mutex{},
+		staleRefreshing: map[string]struct{}{},
+		snapshot:        newCacheSnapshot(),
+		anonymizer:      p.Anonymizer,
+		spoof:           &spoofCounters{},
+		dohBypass:       newDoHBypass(),
 	}
+	s.dnssec = newDNSSECValidator(s.dnssecExchange)
 
 	// TODO(e.burkov): Enable the refresher after the actual implementation
 	// passes the public testing.
@@ -222,6 +354,11 @@ func (s *Server) Close() {
 	if err := s.ipset.close(); err != nil {
 		log.Error("closing ipset: %s", err)
 	}
+
+	s.rpz.close()
+	s.rpz = nil
+
+	s.scheduleLeasesUpdate(time.Time{})
 }
 
 // WriteDiskConfig - write configuration
@@ -238,6 +375,11 @@ func (s *Server) WriteDiskConfig(c *FilteringConfig) {
 	c.BlockedHosts = stringutil.CloneSlice(sc.BlockedHosts)
 	c.TrustedProxies = stringutil.CloneSlice(sc.TrustedProxies)
 	c.UpstreamDNS = stringutil.CloneSlice(sc.UpstreamDNS)
+	c.UpstreamGroups = cloneUpstreamGroups(sc.UpstreamGroups)
+	c.UpstreamWeights = cloneUpstreamWeights(sc.UpstreamWeights)
+	c.LocalZones = cloneLocalZones(sc.LocalZones)
+	c.Views = cloneViews(sc.Views)
+	c.DoHBypassHosts = stringutil.CloneSlice(sc.DoHBypassHosts)
 }
 
 // RDNSSettings returns the copy of actual RDNS configuration.
@@ -357,13 +499,51 @@ func (s *Server) Start() error {
 	return s.startLocked()
 }
 
-// startLocked starts the DNS server without locking. For internal use only.
+// startLocked starts the DNS server without locking.  If any of the listeners
+// fails to start, the started ones are stopped.  For internal use only.
 func (s *Server) startLocked() error {
 	err := s.dnsProxy.Start()
-	if err == nil {
-		s.isRunning = true
+	if err != nil {
+		return err
 	}
-	return err
+
+	err = s.startListenersLocked()
+	if err != nil {
+		return errors.WithDeferred(err, s.stopLocked())
+	}
+
+	s.health.start()
+	s.tracer.start()
+	s.ddr.start()
+	s.dns64.start()
+
+	if s.cacheSnapshotEnabled() {
+		s.snapshot.start(s.conf.CacheSnapshotFile, int(s.conf.CacheSize), s.dnsProxy)
+	}
+
+	atomic.StoreUint32(&s.isRunning, 1)
+
+	return nil
+}
+
+// startListenersLocked starts the listeners served by s itself rather than by
+// dnsproxy.  For internal use only.
+func (s *Server) startListenersLocked() (err error) {
+	if s.dot != nil {
+		err = s.dot.start()
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.udp != nil {
+		err = s.udp.start()
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.xfr.start()
 }
 
 // defaultLocalTimeout is the default timeout for resolving addresses from
@@ -437,19 +617,23 @@ func (s *Server) setupResolvers(localAddrs []string) (err error) {
 
 	log.Debug("upstreams to resolve PTR for local addresses: %v", localAddrs)
 
+	opts := &upstream.Options{
+		Bootstrap: bootstraps,
+		Timeout:   defaultLocalTimeout,
+		// TODO(e.burkov): Should we verify server's ceritificates?
+	}
+
 	var upsConfig *proxy.UpstreamConfig
-	upsConfig, err = proxy.ParseUpstreamsConfig(
-		localAddrs,
-		&upstream.Options{
-			Bootstrap: bootstraps,
-			Timeout:   defaultLocalTimeout,
-			// TODO(e.burkov): Should we verify server's ceritificates?
-		},
-	)
+	upsConfig, err = proxy.ParseUpstreamsConfig(localAddrs, opts)
 	if err != nil {
 		return fmt.Errorf("parsing upstreams: %w", err)
 	}
 
+	err = s.applyUpstreamRetry(upsConfig, opts)
+	if err != nil {
+		return err
+	}
+
 	s.localResolvers = &proxy.Proxy{
 		Config: proxy.Config{
 			UpstreamConfig: upsConfig,
@@ -492,6 +676,11 @@ func (s *Server) Prepare(config *ServerConfig) error {
 		return err
 	}
 
+	s.listeners, err = newListenerRules(&s.conf.FilteringConfig)
+	if err != nil {
+		return fmt.Errorf("dns: %w", err)
+	}
+
 	// Create DNS proxy configuration
 	// --
 	var proxyConfig proxy.Config
@@ -504,11 +693,98 @@ func (s *Server) Prepare(config *ServerConfig) error {
 	// --
 	s.prepareIntlProxy()
 
-	s.access, err = newAccessCtx(s.conf.AllowedClients, s.conf.DisallowedClients, s.conf.BlockedHosts)
+	for name, m := range map[string]ErrorResponseMode{
+		"ratelimit_response":     s.conf.RatelimitResponse,
+		"disallowed_response":    s.conf.DisallowedResponse,
+		"blocked_hosts_response": s.conf.BlockedHostsResponse,
+	} {
+		if err = m.validate(); err != nil {
+			return fmt.Errorf("dns: %s: %w", name, err)
+		}
+	}
+
+	if err = s.conf.QnameValidation.validate(); err != nil {
+		return fmt.Errorf("dns: qname_validation: %w", err)
+	}
+
+	if err = s.conf.Tracing.validate(); err != nil {
+		return fmt.Errorf("dns: tracing: %w", err)
+	}
+
+	s.tracer = newTracer(&s.conf.Tracing)
+
+	if err = s.conf.DoHAuth.validate(); err != nil {
+		return fmt.Errorf("dns: doh_auth_webhook: %w", err)
+	}
+
+	s.dohAuth = nil
+	if s.conf.ClientCAPath == "" {
+		s.dohAuth = newDoHAuth(&s.conf.DoHAuth)
+	}
+
+	s.ratelimiter, err = newRatelimiter(&s.conf.FilteringConfig)
+	if err != nil {
+		return fmt.Errorf("dns: %w", err)
+	}
+
+	s.access, err = newAccessCtx(
+		s.conf.AllowedClients,
+		s.conf.DisallowedClients,
+		s.conf.BlockedHosts,
+		s.conf.ProtoSchedules,
+	)
 	if err != nil {
 		return err
 	}
 
+	s.privacy, err = newPrivacyRules(s.conf.ResponsePrivacy)
+	if err != nil {
+		return fmt.Errorf("response privacy: %w", err)
+	}
+
+	for _, c := range s.conf.RPZ {
+		if err = c.validate(); err != nil {
+			return fmt.Errorf("validating response policy zones: %w", err)
+		}
+	}
+
+	s.rpz = newRPZSet(s.conf.RPZ, s.rpz)
+
+	var answerNets []*net.IPNet
+	answerNets, s.answerNetsStrip, err = parseAnswerNets(
+		s.conf.BlockedAnswerNets,
+		s.conf.BlockedAnswerMode,
+	)
+	if err != nil {
+		return fmt.Errorf("dns: %w", err)
+	}
+
+	if s.dnsFilter != nil {
+		s.dnsFilter.SetBlockedAnswerNets(answerNets)
+	}
+
+	s.bogusNXDomain = newBogusNXDomain(s.conf.BogusNXDomain)
+
+	s.localZones, err = newLocalZones(s.conf.LocalZones)
+	if err != nil {
+		return fmt.Errorf("local zones: %w", err)
+	}
+
+	s.views, err = newViews(s.conf.Views)
+	if err != nil {
+		return fmt.Errorf("views: %w", err)
+	}
+
+	s.dns64, err = newDNS64(&s.conf.DNS64, s.exchangeInternal)
+	if err != nil {
+		return fmt.Errorf("dns64: %w", err)
+	}
+
+	s.xfr, err = newXFRServer(s, &s.conf.ZoneTransfer)
+	if err != nil {
+		return fmt.Errorf("zone transfer: %w", err)
+	}
+
 	// Register web handlers if necessary
 	// --
 	if !webRegistered && s.conf.HTTPRegister != nil {
@@ -547,16 +823,39 @@ func (s *Server) stopLocked() error {
 		}
 	}
 
-	s.isRunning = false
+	if s.dot != nil {
+		err := s.dot.stop()
+		if err != nil {
+			return fmt.Errorf("could not stop the DNS server properly: %w", err)
+		}
+	}
+
+	if s.udp != nil {
+		err := s.udp.stop()
+		if err != nil {
+			return fmt.Errorf("could not stop the DNS server properly: %w", err)
+		}
+	}
+
+	err := s.xfr.stop()
+	if err != nil {
+		return fmt.Errorf("could not stop the DNS server properly: %w", err)
+	}
+
+	s.health.stop()
+	s.tracer.stop()
+	s.ddr.stop()
+	s.dns64.stop()
+	s.snapshot.stop()
+
+	atomic.StoreUint32(&s.isRunning, 0)
 	return nil
 }
 
-// IsRunning returns true if the DNS server is running.
+// IsRunning returns true if the DNS server is running.  It doesn't lock the
+// server, so it's safe to call it while handling a panic.
 func (s *Server) IsRunning() bool {
-	s.serverLock.RLock()
-	defer s.serverLock.RUnlock()
-
-	return s.isRunning
+	return atomic.LoadUint32(&s.isRunning) != 0
 }
 
 // srvClosedErr is returned when the method can't complete without inacessible
@@ -604,9 +903,46 @@ func (s *Server) Reconfigure(config *ServerConfig) error {
 
 // ServeHTTP is a HTTP handler method we use to provide DNS-over-HTTPS.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if prx := s.proxy(); prx != nil {
-		prx.ServeHTTP(w, r)
+	s.serverLock.RLock()
+	requireCert := s.conf.ClientCAPath != ""
+	auth := s.dohAuth
+	s.serverLock.RUnlock()
+
+	// The HTTPS server only verifies the client certificates if they're
+	// given, since it also serves the web UI, so require them here.
+	if requireCert && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+		http.Error(w, "client certificate required", http.StatusForbidden)
+
+		return
 	}
+
+	if auth != nil {
+		clientID, err := clientIDFromPath(r.URL.Path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		if !auth.authorize(r, clientID, time.Now()) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+
+			return
+		}
+	}
+
+	prx := s.proxy()
+	if prx == nil {
+		return
+	}
+
+	if isDoHJSONRequest(r) {
+		s.serveDoHJSON(w, r, prx)
+
+		return
+	}
+
+	prx.ServeHTTP(w, r)
 }
 
 // IsBlockedClient returns true if the client is blocked by the current access
@@ -904,6 +904,10 @@ func TestRewrite(t *testing.T) {
 			Domain: "my.alias.example.org",
 			Answer: "example.org",
 			Type:   dns.TypeCNAME,
+		}, {
+			Domain: "_sip._udp.test.com",
+			Answer: "SRV 10 60 5060 test.com",
+			Type:   dns.TypeSRV,
 		}},
 	}
 	f := filtering.New(c, nil)
@@ -984,6 +988,19 @@ func TestRewrite(t *testing.T) {
 
 		assert.Equal(t, "example.org.", reply.Answer[0].(*dns.CNAME).Target)
 		assert.Equal(t, dns.TypeA, reply.Answer[1].Header().Rrtype)
+
+		req = createTestMessageWithType("_sip._udp.test.com.", dns.TypeSRV)
+		reply, eerr = dns.Exchange(req, addr.String())
+		require.NoError(t, eerr)
+
+		require.Len(t, reply.Answer, 1)
+
+		srv, ok := reply.Answer[0].(*dns.SRV)
+		require.True(t, ok)
+
+		assert.Equal(t, "_sip._udp.test.com.", srv.Hdr.Name)
+		assert.Equal(t, uint16(5060), srv.Port)
+		assert.Equal(t, "test.com.", srv.Target)
 	}
 
 	for _, protect := range []bool{true, false} {
@@ -1023,6 +1040,13 @@ func (d *testDHCP) Leases(flags dhcpd.GetLeasesFlags) (leases []*dhcpd.Lease) {
 
 func (d *testDHCP) SetOnLeaseChanged(onLeaseChanged dhcpd.OnLeaseChangedT) {}
 
+func (d *testDHCP) Subnets() (nets []*net.IPNet) {
+	return []*net.IPNet{{
+		IP:   net.IP{192, 168, 12, 0},
+		Mask: net.CIDRMask(24, 32),
+	}}
+}
+
 func TestPTRResponseFromDHCPLeases(t *testing.T) {
 	snd, err := aghnet.NewSubnetDetector()
 	require.NoError(t, err)
@@ -1062,7 +1086,7 @@ func TestPTRResponseFromDHCPLeases(t *testing.T) {
 
 	ptr, ok := resp.Answer[0].(*dns.PTR)
 	require.True(t, ok)
-	assert.Equal(t, "myhost.", ptr.Ptr)
+	assert.Equal(t, "myhost.lan.", ptr.Ptr)
 }
 
 func TestPTRResponseFromHosts(t *testing.T) {
@@ -1180,8 +1204,9 @@ func TestNewServer(t *testing.T) {
 		in: DNSCreateParams{
 			LocalDomain: "!!!",
 		},
-		wantErrMsg: `local domain: bad domain name "!!!": ` +
-			`bad domain name label "!!!": bad domain name label rune '!'`,
+		wantErrMsg: `local domain: bad hostname "!!!": ` +
+			`bad top-level domain name label "!!!": ` +
+			`bad top-level domain name label rune '!'`,
 	}}
 
 	for _, tc := range testCases {
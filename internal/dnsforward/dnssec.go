@@ -0,0 +1,868 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// dnssecResult is the result of the DNSSEC validation of a response.
+type dnssecResult uint8
+
+// dnssecResult values.  See RFC 4035, section 4.3.
+const (
+	dnssecInsecure dnssecResult = iota
+	dnssecSecure
+	dnssecBogus
+)
+
+// rootAnchors are the trust anchors of the root zone.  It's the DS of the
+// KSK-2017 root key.
+//
+// See https://data.iana.org/root-anchors/root-anchors.xml.
+var rootAnchors = []*dns.DS{{
+	Hdr: dns.RR_Header{
+		Name:   ".",
+		Rrtype: dns.TypeDS,
+		Class:  dns.ClassINET,
+	},
+	KeyTag:     20326,
+	Algorithm:  dns.RSASHA256,
+	DigestType: dns.SHA256,
+	Digest:     "E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBB683457104237C7F8EC8D",
+}}
+
+const (
+	// dnssecMaxFailures is the number of the latest validation failures
+	// kept for the HTTP API.
+	dnssecMaxFailures = 100
+
+	// dnssecMaxCacheTTL is the maximum time the validated keys and
+	// delegations are cached for.
+	dnssecMaxCacheTTL = 24 * time.Hour
+)
+
+// errNoSignatures is returned when an RRset expected to be signed isn't.
+const errNoSignatures errors.Error = "no signatures"
+
+// cutState is the DNSSEC state of a name with regard to the delegations.
+type cutState uint8
+
+// cutState values.
+const (
+	// cutNone means that the name isn't a zone cut, so it's within the
+	// same zone as its parent.
+	cutNone cutState = iota
+
+	// cutSecure means that the name is a signed delegation.
+	cutSecure
+
+	// cutInsecure means that the name is a provably unsigned delegation.
+	cutInsecure
+
+	// cutNonexistent means that the name provably doesn't exist.
+	cutNonexistent
+)
+
+// zoneKeys are the cached validated keys of a zone.
+type zoneKeys struct {
+	expire time.Time
+	keys   []*dns.DNSKEY
+}
+
+// zoneCut is the cached DNSSEC state of a name.
+type zoneCut struct {
+	expire time.Time
+	state  cutState
+}
+
+// dnssecFailure is a validation failure in the HTTP API.
+type dnssecFailure struct {
+	Time     string `json:"time"`
+	Domain   string `json:"domain"`
+	QType    string `json:"qtype"`
+	Upstream string `json:"upstream,omitempty"`
+	Reason   string `json:"reason"`
+}
+
+// dnssecValidator validates the DNSSEC chain of trust of the upstream
+// responses starting from the root trust anchors.
+type dnssecValidator struct {
+	// exchange sends req to the upstreams.
+	exchange func(req *dns.Msg) (resp *dns.Msg, err error)
+
+	// now returns the current time.  It's time.Now everywhere except the
+	// tests.
+	now func() (t time.Time)
+
+	// mu protects keys, cuts, and failures.
+	mu *sync.Mutex
+
+	// keys are the validated keys by the lowercased FQDNs of the zones.
+	keys map[string]*zoneKeys
+
+	// cuts are the DNSSEC states by the lowercased FQDNs.
+	cuts map[string]*zoneCut
+
+	// failures are the latest validation failures, the newest last.
+	failures []*dnssecFailure
+
+	// anchors are the trust anchors of the root zone.
+	anchors []*dns.DS
+}
+
+// newDNSSECValidator returns a new validator using exchange to look up the
+// DNSSEC records.
+func newDNSSECValidator(exchange func(req *dns.Msg) (resp *dns.Msg, err error)) (v *dnssecValidator) {
+	return &dnssecValidator{
+		exchange: exchange,
+		now:      time.Now,
+		mu:       &sync.Mutex{},
+		keys:     map[string]*zoneKeys{},
+		cuts:     map[string]*zoneCut{},
+		anchors:  rootAnchors,
+	}
+}
+
+// query looks up the records of qtype for name with the DNSSEC records and
+// without the validation by the upstreams.
+func (v *dnssecValidator) query(name string, qtype uint16) (resp *dns.Msg, err error) {
+	req := (&dns.Msg{}).SetQuestion(name, qtype)
+	req.SetEdns0(dns.DefaultMsgSize, true)
+	req.CheckingDisabled = true
+
+	resp, err = v.exchange(req)
+	if err != nil {
+		return nil, fmt.Errorf("looking up %s %q: %w", dns.TypeToString[qtype], name, err)
+	} else if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf(
+			"looking up %s %q: rcode %s",
+			dns.TypeToString[qtype],
+			name,
+			dns.RcodeToString[resp.Rcode],
+		)
+	}
+
+	return resp, nil
+}
+
+// cacheExpire returns the expiration time of the cached data with the records
+// rrs.
+func (v *dnssecValidator) cacheExpire(rrs []dns.RR) (expire time.Time) {
+	ttl := dnssecMaxCacheTTL
+	for _, rr := range rrs {
+		if d := time.Duration(rr.Header().Ttl) * time.Second; d < ttl {
+			ttl = d
+		}
+	}
+
+	return v.now().Add(ttl)
+}
+
+// rrsetOf returns the records of rrs with name and type t.
+func rrsetOf(rrs []dns.RR, name string, t uint16) (set []dns.RR) {
+	for _, rr := range rrs {
+		if h := rr.Header(); h.Rrtype == t && strings.EqualFold(h.Name, name) {
+			set = append(set, rr)
+		}
+	}
+
+	return set
+}
+
+// sigsOf returns the signatures of the RRset of name and type t within rrs.
+func sigsOf(rrs []dns.RR, name string, t uint16) (sigs []*dns.RRSIG) {
+	for _, rr := range rrs {
+		sig, ok := rr.(*dns.RRSIG)
+		if ok && sig.TypeCovered == t && strings.EqualFold(sig.Hdr.Name, name) {
+			sigs = append(sigs, sig)
+		}
+	}
+
+	return sigs
+}
+
+// verifySig checks that sig is a currently valid signature of set made with k.
+func (v *dnssecValidator) verifySig(sig *dns.RRSIG, k *dns.DNSKEY, set []dns.RR) (err error) {
+	if sig.KeyTag != k.KeyTag() || sig.Algorithm != k.Algorithm {
+		return errors.Error("key mismatch")
+	} else if !sig.ValidityPeriod(v.now()) {
+		return errors.Error("signature expired or not yet valid")
+	}
+
+	return sig.Verify(k, set)
+}
+
+// matchesDS returns true if k is the key of one of dss.
+func matchesDS(k *dns.DNSKEY, dss []*dns.DS) (ok bool) {
+	for _, ds := range dss {
+		if ds.KeyTag != k.KeyTag() || ds.Algorithm != k.Algorithm {
+			continue
+		}
+
+		if d := k.ToDS(ds.DigestType); d != nil && strings.EqualFold(d.Digest, ds.Digest) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// keysFor returns the validated keys of zone.
+func (v *dnssecValidator) keysFor(zone string) (keys []*dns.DNSKEY, err error) {
+	zone = dns.CanonicalName(zone)
+
+	v.mu.Lock()
+	zk, ok := v.keys[zone]
+	v.mu.Unlock()
+	if ok && v.now().Before(zk.expire) {
+		return zk.keys, nil
+	}
+
+	dss := v.anchors
+	if zone != "." {
+		dss, err = v.dsFor(zone)
+		if err != nil {
+			return nil, err
+		} else if len(dss) == 0 {
+			return nil, fmt.Errorf("no ds records for %q", zone)
+		}
+	}
+
+	resp, err := v.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+
+	set := rrsetOf(resp.Answer, zone, dns.TypeDNSKEY)
+	if len(set) == 0 {
+		return nil, fmt.Errorf("no dnskey records for %q", zone)
+	}
+
+	for _, rr := range set {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+
+	sigs := sigsOf(resp.Answer, zone, dns.TypeDNSKEY)
+	if !v.signedByDS(keys, sigs, set, dss) {
+		return nil, fmt.Errorf("dnskey records of %q: not signed by a trusted key", zone)
+	}
+
+	v.mu.Lock()
+	v.keys[zone] = &zoneKeys{
+		expire: v.cacheExpire(set),
+		keys:   keys,
+	}
+	v.mu.Unlock()
+
+	return keys, nil
+}
+
+// signedByDS returns true if set is signed with one of sigs made by one of
+// keys, which matches one of dss.
+func (v *dnssecValidator) signedByDS(keys []*dns.DNSKEY, sigs []*dns.RRSIG, set []dns.RR, dss []*dns.DS) (ok bool) {
+	for _, k := range keys {
+		if !matchesDS(k, dss) {
+			continue
+		}
+
+		for _, sig := range sigs {
+			if v.verifySig(sig, k, set) == nil {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// dsFor returns the validated DS records of zone.  dss is empty if there are
+// none.
+func (v *dnssecValidator) dsFor(zone string) (dss []*dns.DS, err error) {
+	resp, err := v.query(zone, dns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+
+	set := rrsetOf(resp.Answer, zone, dns.TypeDS)
+	if len(set) == 0 {
+		return nil, nil
+	}
+
+	err = v.verifyRRset(set, parentSigs(sigsOf(resp.Answer, zone, dns.TypeDS), zone))
+	if err != nil {
+		return nil, fmt.Errorf("ds records of %q: %w", zone, err)
+	}
+
+	for _, rr := range set {
+		dss = append(dss, rr.(*dns.DS))
+	}
+
+	return dss, nil
+}
+
+// parentSigs returns the signatures of sigs made by the parent zones of name,
+// since the DS records are only authoritative in the parent zone.
+func parentSigs(sigs []*dns.RRSIG, name string) (filtered []*dns.RRSIG) {
+	for _, sig := range sigs {
+		if !strings.EqualFold(sig.SignerName, name) {
+			filtered = append(filtered, sig)
+		}
+	}
+
+	return filtered
+}
+
+// verifyRRset checks that set is signed with one of sigs made by a validated
+// key of the signer.
+func (v *dnssecValidator) verifyRRset(set []dns.RR, sigs []*dns.RRSIG) (err error) {
+	if len(sigs) == 0 {
+		return errNoSignatures
+	}
+
+	owner := set[0].Header().Name
+	err = errors.Error("no matching keys")
+	for _, sig := range sigs {
+		if !dns.IsSubDomain(sig.SignerName, owner) {
+			err = fmt.Errorf("signer %q isn't a parent of %q", sig.SignerName, owner)
+
+			continue
+		}
+
+		var keys []*dns.DNSKEY
+		keys, err = v.keysFor(sig.SignerName)
+		if err != nil {
+			continue
+		}
+
+		for _, k := range keys {
+			if k.KeyTag() != sig.KeyTag || k.Algorithm != sig.Algorithm {
+				continue
+			}
+
+			err = v.verifySig(sig, k, set)
+			if err == nil {
+				return nil
+			}
+		}
+	}
+
+	return err
+}
+
+// provenInsecure returns true if name is within a zone provably delegated
+// without DNSSEC.
+func (v *dnssecValidator) provenInsecure(name string) (ok bool, err error) {
+	labels := dns.SplitDomainName(dns.CanonicalName(name))
+	for i := len(labels) - 1; i >= 0; i-- {
+		var st cutState
+		st, err = v.cutAt(strings.Join(labels[i:], ".") + ".")
+		if err != nil {
+			return false, err
+		}
+
+		switch st {
+		case cutInsecure:
+			return true, nil
+		case cutNonexistent:
+			return false, nil
+		default:
+			// Go on.
+		}
+	}
+
+	return false, nil
+}
+
+// cutAt returns the DNSSEC state of name with regard to the delegations.
+func (v *dnssecValidator) cutAt(name string) (st cutState, err error) {
+	v.mu.Lock()
+	zc, ok := v.cuts[name]
+	v.mu.Unlock()
+	if ok && v.now().Before(zc.expire) {
+		return zc.state, nil
+	}
+
+	resp, err := v.query(name, dns.TypeDS)
+	if err != nil {
+		return cutNone, err
+	}
+
+	var rrs []dns.RR
+	if set := rrsetOf(resp.Answer, name, dns.TypeDS); len(set) > 0 {
+		err = v.verifyRRset(set, parentSigs(sigsOf(resp.Answer, name, dns.TypeDS), name))
+		if err != nil {
+			return cutNone, fmt.Errorf("ds records of %q: %w", name, err)
+		}
+
+		st, rrs = cutSecure, set
+	} else if len(rrsetOf(resp.Answer, name, dns.TypeCNAME)) > 0 {
+		// An alias can't be a zone cut.
+		st, rrs = cutNone, resp.Answer
+	} else {
+		st, err = v.dsDenial(resp, name)
+		if err != nil {
+			return cutNone, err
+		}
+
+		rrs = resp.Ns
+	}
+
+	v.mu.Lock()
+	v.cuts[name] = &zoneCut{
+		expire: v.cacheExpire(rrs),
+		state:  st,
+	}
+	v.mu.Unlock()
+
+	return st, nil
+}
+
+// dsDenial returns the DNSSEC state of name from the validated proof of the
+// absence of its DS records in resp.
+func (v *dnssecValidator) dsDenial(resp *dns.Msg, name string) (st cutState, err error) {
+	err = v.verifyDenialRecords(resp.Ns)
+	if err != nil {
+		return cutNone, fmt.Errorf("denial of ds records of %q: %w", name, err)
+	}
+
+	proven := false
+	for _, rr := range resp.Ns {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if strings.EqualFold(rr.Hdr.Name, name) {
+				return cutFromBitmap(rr.TypeBitMap), nil
+			}
+
+			proven = proven || nsecCovers(rr, name)
+		case *dns.NSEC3:
+			if rr.Match(name) {
+				return cutFromBitmap(rr.TypeBitMap), nil
+			} else if rr.Cover(name) {
+				if rr.Flags&1 == 1 {
+					// The opt-out NSEC3 records only cover the unsigned
+					// delegations.  See RFC 5155, section 6.
+					return cutInsecure, nil
+				}
+
+				proven = true
+			}
+		}
+	}
+
+	if !proven {
+		return cutNone, fmt.Errorf("no proof of absence of ds records of %q", name)
+	} else if resp.Rcode == dns.RcodeNameError {
+		return cutNonexistent, nil
+	}
+
+	return cutNone, nil
+}
+
+// cutFromBitmap returns the DNSSEC state of the name without the DS records
+// and with the record types from the NSEC or NSEC3 bitmap.
+func cutFromBitmap(types []uint16) (st cutState) {
+	if hasType(types, dns.TypeNS) && !hasType(types, dns.TypeSOA) {
+		return cutInsecure
+	}
+
+	return cutNone
+}
+
+// hasType returns true if types contains t.
+func hasType(types []uint16, t uint16) (ok bool) {
+	for _, typ := range types {
+		if typ == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+// verifyDenialRecords checks the signatures of all the NSEC and NSEC3 records
+// in rrs.
+func (v *dnssecValidator) verifyDenialRecords(rrs []dns.RR) (err error) {
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype != dns.TypeNSEC && h.Rrtype != dns.TypeNSEC3 {
+			continue
+		}
+
+		err = v.verifyRRset([]dns.RR{rr}, sigsOf(rrs, h.Name, h.Rrtype))
+		if err != nil {
+			return fmt.Errorf("%s %q: %w", dns.TypeToString[h.Rrtype], h.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// canonicalCompare compares the domain names a and b in the canonical DNS
+// order.  See RFC 4034, section 6.1.
+func canonicalCompare(a, b string) (res int) {
+	la := dns.SplitDomainName(dns.CanonicalName(a))
+	lb := dns.SplitDomainName(dns.CanonicalName(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+
+	return len(la) - len(lb)
+}
+
+// nsecCovers returns true if name is strictly between the owner of n and the
+// next name in the canonical order.
+func nsecCovers(n *dns.NSEC, name string) (ok bool) {
+	afterOwner := canonicalCompare(n.Hdr.Name, name) < 0
+	beforeNext := canonicalCompare(name, n.NextDomain) < 0
+	if canonicalCompare(n.Hdr.Name, n.NextDomain) < 0 {
+		return afterOwner && beforeNext
+	}
+
+	// The last NSEC record of the zone points back to the apex.
+	return afterOwner || beforeNext
+}
+
+// rrsetKey is the key of a set of records.
+type rrsetKey struct {
+	name  string
+	rtype uint16
+}
+
+// rrsets returns the RRsets within rrs except the signatures in the order of
+// appearance.
+func rrsets(rrs []dns.RR) (keys []rrsetKey, sets map[rrsetKey][]dns.RR) {
+	sets = map[rrsetKey][]dns.RR{}
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeRRSIG || h.Rrtype == dns.TypeOPT {
+			continue
+		}
+
+		k := rrsetKey{name: dns.CanonicalName(h.Name), rtype: h.Rrtype}
+		if _, ok := sets[k]; !ok {
+			keys = append(keys, k)
+		}
+
+		sets[k] = append(sets[k], rr)
+	}
+
+	return keys, sets
+}
+
+// validate validates resp and returns the result.  err describes the reason
+// if res is dnssecBogus.
+func (v *dnssecValidator) validate(resp *dns.Msg) (res dnssecResult, err error) {
+	if len(resp.Question) != 1 ||
+		(resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+		return dnssecInsecure, nil
+	}
+
+	var secure, insecure bool
+	for i, sec := range [][]dns.RR{resp.Answer, resp.Ns} {
+		keys, sets := rrsets(sec)
+		for _, k := range keys {
+			if i == 1 && k.rtype == dns.TypeNS {
+				// The delegation records in the authority section aren't
+				// signed.  See RFC 4035, section 2.2.
+				continue
+			}
+
+			var ins bool
+			ins, err = v.validateRRset(sets[k], sigsOf(sec, k.name, k.rtype))
+			if err != nil {
+				return dnssecBogus, fmt.Errorf("%s %q: %w", dns.TypeToString[k.rtype], k.name, err)
+			}
+
+			insecure = insecure || ins
+			secure = secure || !ins
+		}
+	}
+
+	q := resp.Question[0]
+	if len(resp.Answer) == 0 && !insecure {
+		err = v.validateDenial(resp, q, secure)
+		if errors.Is(err, errInsecureDenial) {
+			return dnssecInsecure, nil
+		} else if err != nil {
+			return dnssecBogus, err
+		}
+	}
+
+	if insecure {
+		return dnssecInsecure, nil
+	}
+
+	return dnssecSecure, nil
+}
+
+// validateRRset validates the RRset set with the signatures sigs.  insecure is
+// true if set isn't signed and is provably within an unsigned zone.
+func (v *dnssecValidator) validateRRset(set []dns.RR, sigs []*dns.RRSIG) (insecure bool, err error) {
+	if len(sigs) > 0 {
+		return false, v.verifyRRset(set, sigs)
+	}
+
+	h := set[0].Header()
+	name := h.Name
+	if h.Rrtype == dns.TypeNSEC3 {
+		// The owners of the NSEC3 records are the hashes within the zone.
+		if i, end := dns.NextLabel(name, 0); !end {
+			name = name[i:]
+		}
+	}
+
+	insecure, err = v.provenInsecure(name)
+	if err != nil {
+		return false, err
+	} else if !insecure {
+		return false, errNoSignatures
+	}
+
+	return true, nil
+}
+
+// errInsecureDenial is returned by validateDenial when the negative response
+// is provably from an unsigned zone.
+const errInsecureDenial errors.Error = "insecure denial"
+
+// validateDenial checks the proof of the nonexistence of the data requested
+// with q in the negative response resp.  signed is true if there are validated
+// records in the authority section.
+func (v *dnssecValidator) validateDenial(resp *dns.Msg, q dns.Question, signed bool) (err error) {
+	if !signed {
+		insecure, perr := v.provenInsecure(q.Name)
+		if perr != nil {
+			return perr
+		} else if insecure {
+			return errInsecureDenial
+		}
+
+		return fmt.Errorf("%q: no signed proof of nonexistence", q.Name)
+	}
+
+	nxdomain := resp.Rcode == dns.RcodeNameError
+	for _, rr := range resp.Ns {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if nsecCovers(rr, q.Name) {
+				return nil
+			} else if !nxdomain && strings.EqualFold(rr.Hdr.Name, q.Name) &&
+				!hasType(rr.TypeBitMap, q.Qtype) && !hasType(rr.TypeBitMap, dns.TypeCNAME) {
+				return nil
+			}
+		case *dns.NSEC3:
+			if rr.Cover(q.Name) {
+				if nxdomain || rr.Flags&1 == 1 {
+					return nil
+				}
+			} else if !nxdomain && rr.Match(q.Name) && !hasType(rr.TypeBitMap, q.Qtype) {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("%q: no proof of nonexistence", q.Name)
+}
+
+// addFailure remembers the validation failure of the response to q from the
+// upstream with address ups.
+func (v *dnssecValidator) addFailure(q dns.Question, ups string, reason error) {
+	f := &dnssecFailure{
+		Time:     v.now().Format(time.RFC3339),
+		Domain:   strings.TrimSuffix(q.Name, "."),
+		QType:    dns.TypeToString[q.Qtype],
+		Upstream: ups,
+		Reason:   reason.Error(),
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.failures = append(v.failures, f)
+	if len(v.failures) > dnssecMaxFailures {
+		v.failures = append(v.failures[:0:0], v.failures[len(v.failures)-dnssecMaxFailures:]...)
+	}
+}
+
+// latestFailures returns the latest validation failures, the newest first.
+func (v *dnssecValidator) latestFailures() (fs []*dnssecFailure) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fs = make([]*dnssecFailure, 0, len(v.failures))
+	for i := len(v.failures) - 1; i >= 0; i-- {
+		fs = append(fs, v.failures[i])
+	}
+
+	return fs
+}
+
+// dnssecReqState is the state of the client's request before it has been
+// changed for the DNSSEC validation.
+type dnssecReqState struct {
+	// addedOPT is true if the request had no OPT record.
+	addedOPT bool
+
+	// do is the DO bit of the request.
+	do bool
+}
+
+// prepareDNSSECRequest makes req request the DNSSEC records without the
+// validation by the upstreams, if the local validation is enabled.  st is nil
+// if the response to req mustn't be validated, for example when the client
+// has disabled the checking itself.
+func (s *Server) prepareDNSSECRequest(req *dns.Msg) (st *dnssecReqState) {
+	if !s.conf.DNSSECValidation || req.CheckingDisabled {
+		return nil
+	}
+
+	st = &dnssecReqState{}
+	if opt := req.IsEdns0(); opt != nil {
+		st.do = opt.Do()
+		opt.SetDo()
+	} else {
+		req.SetEdns0(dns.DefaultMsgSize, true)
+		st.addedOPT = true
+	}
+
+	req.CheckingDisabled = true
+
+	return st
+}
+
+// restore reverts the changes made to req by prepareDNSSECRequest.
+func (st *dnssecReqState) restore(req *dns.Msg) {
+	if st == nil {
+		return
+	}
+
+	req.CheckingDisabled = false
+	if st.addedOPT {
+		req.Extra = withoutOPT(req.Extra)
+	} else if opt := req.IsEdns0(); opt != nil && !st.do {
+		opt.SetDo(false)
+	}
+}
+
+// withoutOPT returns rrs without the OPT records.
+func withoutOPT(rrs []dns.RR) (filtered []dns.RR) {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			filtered = append(filtered, rr)
+		}
+	}
+
+	return filtered
+}
+
+// validateDNSSEC validates the upstream response in dctx requested with the
+// state st.  The bogus responses are replaced with SERVFAIL.  reqAD is true if
+// the client has set the AD bit.
+func (s *Server) validateDNSSEC(dctx *dnsContext, st *dnssecReqState, reqAD bool) {
+	if st == nil || s.dnssec == nil {
+		return
+	}
+
+	pctx := dctx.proxyCtx
+	resp := pctx.Res
+	resp.CheckingDisabled = false
+
+	res, err := s.dnssec.validate(resp)
+	if res == dnssecBogus {
+		q := pctx.Req.Question[0]
+		ups := ""
+		if pctx.Upstream != nil {
+			ups = pctx.Upstream.Address()
+		}
+
+		log.Debug("dns: dnssec: bogus response for %q from %s: %s", q.Name, ups, err)
+		s.dnssec.addFailure(q, ups, err)
+
+		pctx.Res = s.genServerFailure(pctx.Req)
+		s.setExtendedError(pctx.Req, pctx.Res, dns.ExtendedErrorCodeDNSBogus, err.Error())
+		dctx.responseAD = false
+
+		return
+	}
+
+	// Only set the AD bit for the clients, which have indicated that they
+	// understand it.  See RFC 6840, section 5.8.
+	secure := res == dnssecSecure
+	resp.AuthenticatedData = secure && (reqAD || st.do)
+	dctx.responseAD = secure
+
+	if st.do {
+		return
+	}
+
+	qtype := pctx.Req.Question[0].Qtype
+	resp.Answer = withoutDNSSEC(resp.Answer, qtype)
+	resp.Ns = withoutDNSSEC(resp.Ns, qtype)
+	if st.addedOPT {
+		resp.Extra = withoutOPT(resp.Extra)
+	} else if opt := resp.IsEdns0(); opt != nil {
+		opt.SetDo(false)
+	}
+}
+
+// dnssecExchange sends req to the upstreams using the internal proxy.
+func (s *Server) dnssecExchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	s.serverLock.RLock()
+	prx := s.internalProxy
+	s.serverLock.RUnlock()
+
+	if prx == nil {
+		return nil, srvClosedErr
+	}
+
+	pctx := &proxy.DNSContext{
+		Proto:     proxy.ProtoUDP,
+		Req:       req,
+		StartTime: time.Now(),
+	}
+
+	err = prx.Resolve(pctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return pctx.Res, nil
+}
+
+// dnssecFailuresJSON is the response to the GET /control/dnssec/failures HTTP
+// API.
+type dnssecFailuresJSON struct {
+	Failures []*dnssecFailure `json:"failures"`
+	Enabled  bool             `json:"enabled"`
+}
+
+// handleDNSSECFailures is the handler for the GET /control/dnssec/failures
+// HTTP API.
+func (s *Server) handleDNSSECFailures(w http.ResponseWriter, r *http.Request) {
+	s.serverLock.RLock()
+	enabled := s.conf.DNSSECValidation
+	s.serverLock.RUnlock()
+
+	resp := &dnssecFailuresJSON{
+		Failures: s.dnssec.latestFailures(),
+		Enabled:  enabled,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "encoding response: %s", err)
+	}
+}
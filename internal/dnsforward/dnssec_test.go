@@ -0,0 +1,291 @@
+package dnsforward
+
+import (
+	"crypto"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testZoneKey is a DNSSEC key of a test zone.
+type testZoneKey struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+// newTestZoneKey generates a new key for zone.
+func newTestZoneKey(t *testing.T, zone string) (k *testZoneKey) {
+	t.Helper()
+
+	key := &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+
+	priv, err := key.Generate(256)
+	require.NoError(t, err)
+
+	return &testZoneKey{
+		key:  key,
+		priv: priv.(crypto.Signer),
+	}
+}
+
+// sign returns set with its signature.
+func (k *testZoneKey) sign(t *testing.T, now time.Time, set ...dns.RR) (signed []dns.RR) {
+	t.Helper()
+
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: set[0].Header().Ttl},
+		Algorithm:  k.key.Algorithm,
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		KeyTag:     k.key.KeyTag(),
+		SignerName: k.key.Hdr.Name,
+	}
+	require.NoError(t, sig.Sign(k.priv, set))
+
+	return append(set, sig)
+}
+
+// testResponse returns a response to a question for name and qtype.
+func testResponse(name string, qtype uint16, rcode int, ans, ns []dns.RR) (resp *dns.Msg) {
+	resp = (&dns.Msg{}).SetQuestion(name, qtype)
+	resp.Response = true
+	resp.Rcode = rcode
+	resp.Answer = ans
+	resp.Ns = ns
+
+	return resp
+}
+
+// newTestValidator returns a validator with the test root trust anchor and the
+// test zones:
+//
+//   - "example." is a signed zone delegated from the root;
+//   - "insecure." is an unsigned zone delegated from the root.
+//
+// The returned map contains the responses to the questions by the names and
+// the types.
+func newTestValidator(t *testing.T) (v *dnssecValidator, zones map[dns.Question]*dns.Msg, exKey *testZoneKey) {
+	t.Helper()
+
+	now := time.Now()
+	rootKey := newTestZoneKey(t, ".")
+	exKey = newTestZoneKey(t, "example.")
+
+	exDS := exKey.key.ToDS(dns.SHA256)
+	exDS.Hdr.Ttl = 3600
+
+	q := func(name string, qtype uint16) (k dns.Question) {
+		return dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET}
+	}
+
+	zones = map[dns.Question]*dns.Msg{
+		q(".", dns.TypeDNSKEY): testResponse(
+			".",
+			dns.TypeDNSKEY,
+			dns.RcodeSuccess,
+			rootKey.sign(t, now, rootKey.key),
+			nil,
+		),
+		q("example.", dns.TypeDS): testResponse(
+			"example.",
+			dns.TypeDS,
+			dns.RcodeSuccess,
+			rootKey.sign(t, now, exDS),
+			nil,
+		),
+		q("example.", dns.TypeDNSKEY): testResponse(
+			"example.",
+			dns.TypeDNSKEY,
+			dns.RcodeSuccess,
+			exKey.sign(t, now, exKey.key),
+			nil,
+		),
+		q("insecure.", dns.TypeDS): testResponse(
+			"insecure.",
+			dns.TypeDS,
+			dns.RcodeSuccess,
+			nil,
+			rootKey.sign(t, now, newTestRR(t, "insecure. 3600 IN NSEC zzz. NS RRSIG NSEC")),
+		),
+	}
+
+	v = newDNSSECValidator(func(req *dns.Msg) (resp *dns.Msg, err error) {
+		if !req.CheckingDisabled {
+			return nil, errors.Error("checking enabled")
+		}
+
+		resp, ok := zones[req.Question[0]]
+		if !ok {
+			return testResponse(req.Question[0].Name, req.Question[0].Qtype, dns.RcodeServerFailure, nil, nil), nil
+		}
+
+		return resp.Copy(), nil
+	})
+
+	rootDS := rootKey.key.ToDS(dns.SHA256)
+	v.anchors = []*dns.DS{rootDS}
+
+	return v, zones, exKey
+}
+
+func TestDNSSECValidator_validate(t *testing.T) {
+	v, _, exKey := newTestValidator(t)
+	now := time.Now()
+
+	wwwA := newTestRR(t, "www.example. 300 IN A 1.2.3.4")
+	wwwSigned := exKey.sign(t, now, wwwA)
+
+	tampered := dns.Copy(wwwA).(*dns.A)
+	tampered.A = net.IP{5, 6, 7, 8}
+
+	testCases := []struct {
+		resp    *dns.Msg
+		name    string
+		wantErr string
+		want    dnssecResult
+	}{{
+		resp:    testResponse("www.example.", dns.TypeA, dns.RcodeSuccess, wwwSigned, nil),
+		name:    "secure",
+		wantErr: "",
+		want:    dnssecSecure,
+	}, {
+		resp: testResponse(
+			"www.example.",
+			dns.TypeA,
+			dns.RcodeSuccess,
+			[]dns.RR{tampered, wwwSigned[1]},
+			nil,
+		),
+		name:    "tampered",
+		wantErr: "A \"www.example.\"",
+		want:    dnssecBogus,
+	}, {
+		resp:    testResponse("www.example.", dns.TypeA, dns.RcodeSuccess, []dns.RR{wwwA}, nil),
+		name:    "stripped_signature",
+		wantErr: "A \"www.example.\"",
+		want:    dnssecBogus,
+	}, {
+		resp: testResponse(
+			"www.insecure.",
+			dns.TypeA,
+			dns.RcodeSuccess,
+			[]dns.RR{newTestRR(t, "www.insecure. 300 IN A 1.2.3.4")},
+			nil,
+		),
+		name:    "insecure",
+		wantErr: "",
+		want:    dnssecInsecure,
+	}, {
+		resp: testResponse(
+			"www.example.",
+			dns.TypeAAAA,
+			dns.RcodeSuccess,
+			nil,
+			exKey.sign(t, now, newTestRR(t, "www.example. 300 IN NSEC zzz.example. A RRSIG NSEC")),
+		),
+		name:    "secure_nodata",
+		wantErr: "",
+		want:    dnssecSecure,
+	}, {
+		resp: testResponse(
+			"www.example.",
+			dns.TypeA,
+			dns.RcodeSuccess,
+			nil,
+			exKey.sign(t, now, newTestRR(t, "www.example. 300 IN NSEC zzz.example. A RRSIG NSEC")),
+		),
+		name:    "bad_nodata",
+		wantErr: "no proof of nonexistence",
+		want:    dnssecBogus,
+	}, {
+		resp:    testResponse("www.example.", dns.TypeA, dns.RcodeServerFailure, nil, nil),
+		name:    "servfail",
+		wantErr: "",
+		want:    dnssecInsecure,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := v.validate(tc.resp)
+			assert.Equal(t, tc.want, res)
+			if tc.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestDNSSECValidator_keysFor(t *testing.T) {
+	v, zones, _ := newTestValidator(t)
+
+	keys, err := v.keysFor("example.")
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+
+	// Make sure the validated keys are cached.
+	for k := range zones {
+		delete(zones, k)
+	}
+
+	cached, err := v.keysFor("EXAMPLE.")
+	require.NoError(t, err)
+	assert.Equal(t, keys, cached)
+
+	_, err = v.keysFor("other.")
+	assert.Error(t, err)
+}
+
+func TestDNSSECValidator_failures(t *testing.T) {
+	v, _, _ := newTestValidator(t)
+
+	for i := 0; i < dnssecMaxFailures+10; i++ {
+		q := dns.Question{Name: strings.Repeat("a", i+1) + ".", Qtype: dns.TypeA}
+		v.addFailure(q, "1.1.1.1:53", errors.Error("bogus"))
+	}
+
+	fs := v.latestFailures()
+	require.Len(t, fs, dnssecMaxFailures)
+
+	assert.Equal(t, strings.Repeat("a", dnssecMaxFailures+10), fs[0].Domain)
+	assert.Equal(t, "A", fs[0].QType)
+	assert.Equal(t, "bogus", fs[0].Reason)
+}
+
+func TestCanonicalCompare(t *testing.T) {
+	// The names are in the canonical order from RFC 4034, section 6.1.
+	names := []string{
+		"example.",
+		"a.example.",
+		"yljkjljk.a.example.",
+		"Z.a.example.",
+		"zABC.a.EXAMPLE.",
+		"z.example.",
+		"*.z.example.",
+	}
+
+	for i := 1; i < len(names); i++ {
+		assert.Negative(t, canonicalCompare(names[i-1], names[i]), names[i])
+		assert.Positive(t, canonicalCompare(names[i], names[i-1]), names[i])
+	}
+
+	assert.Zero(t, canonicalCompare("A.example.", "a.EXAMPLE."))
+}
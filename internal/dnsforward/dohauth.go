@@ -0,0 +1,288 @@
+package dnsforward
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/timeutil"
+)
+
+// Parameters of the DNS-over-HTTPS authorization webhook.
+const (
+	// defaultDoHAuthTimeout is the timeout of a webhook request used when the
+	// timeout isn't set.
+	defaultDoHAuthTimeout = 2 * time.Second
+
+	// defaultDoHAuthCacheTTL is the time the verdicts are cached for used when
+	// the TTL isn't set.
+	defaultDoHAuthCacheTTL = 5 * time.Minute
+
+	// maxDoHAuthCacheSize is the maximum number of the cached verdicts.
+	maxDoHAuthCacheSize = 10_000
+
+	// maxDoHAuthRespSize is the maximum size of the webhook response body.
+	maxDoHAuthRespSize = 64 * 1024
+)
+
+// DoHAuthConfig is the configuration of the external authorization webhook of
+// the DNS-over-HTTPS clients.  It's only used when the client certificates
+// aren't required, see TLSConfig.ClientCAPath.
+type DoHAuthConfig struct {
+	// Headers are added to each webhook request, for example to authenticate
+	// AdGuard Home at the webhook.
+	Headers map[string]string `yaml:"headers"`
+
+	// URL is the URL of the webhook.  If it's empty, the DNS-over-HTTPS
+	// clients aren't authorized.
+	URL string `yaml:"url"`
+
+	// ForwardHeaders are the names of the headers of the DNS-over-HTTPS
+	// request sent to the webhook.  The verdicts are cached by their values
+	// as well as by the IP address and the ClientID.  If empty, no headers
+	// are sent.
+	ForwardHeaders []string `yaml:"forward_headers"`
+
+	// Timeout is the timeout of a webhook request.  If it's zero, two seconds
+	// are used.
+	Timeout timeutil.Duration `yaml:"timeout"`
+
+	// CacheTTL is the time the verdicts are cached for.  If it's zero, five
+	// minutes are used.
+	CacheTTL timeutil.Duration `yaml:"cache_ttl"`
+
+	// FailOpen, if true, makes the server allow the requests when the webhook
+	// fails to respond.  Otherwise, they're denied.  The verdicts of the
+	// failed requests aren't cached.
+	FailOpen bool `yaml:"fail_open"`
+}
+
+// validate returns an error if c is invalid.
+func (c *DoHAuthConfig) validate() (err error) {
+	if c.URL == "" {
+		return nil
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("url: %w", err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("url: bad scheme %q", u.Scheme)
+	}
+
+	if c.Timeout.Duration < 0 {
+		return fmt.Errorf("negative timeout %s", c.Timeout)
+	} else if c.CacheTTL.Duration < 0 {
+		return fmt.Errorf("negative cache_ttl %s", c.CacheTTL)
+	}
+
+	return nil
+}
+
+// dohAuthRequest is the body of the webhook request.
+type dohAuthRequest struct {
+	// Headers are the forwarded headers of the DNS-over-HTTPS request.
+	Headers map[string][]string `json:"headers"`
+
+	// ClientIP is the IP address of the client the connection is accepted
+	// from.  When AdGuard Home is behind a reverse proxy, it's the address of
+	// the proxy, and the webhook should use the forwarded headers instead.
+	ClientIP string `json:"client_ip"`
+
+	// ClientID is the ClientID from the path of the request, if any.
+	ClientID string `json:"client_id"`
+}
+
+// dohAuthResponse is the body of the webhook response.
+type dohAuthResponse struct {
+	// Allow is the verdict of the webhook.
+	Allow bool `json:"allow"`
+}
+
+// dohAuthVerdict is a cached verdict of the webhook.
+type dohAuthVerdict struct {
+	// expire is the time the verdict expires at.
+	expire time.Time
+
+	// allow shows if the client is allowed.
+	allow bool
+}
+
+// dohAuth authorizes the DNS-over-HTTPS clients using an external webhook and
+// caches its verdicts.
+type dohAuth struct {
+	// cli is the client used for the webhook requests.
+	cli *http.Client
+
+	// headers are added to each webhook request.
+	headers map[string]string
+
+	// mu protects cache.
+	mu *sync.Mutex
+
+	// cache are the cached verdicts by the keys of the requests.
+	cache map[string]*dohAuthVerdict
+
+	// url is the URL of the webhook.
+	url string
+
+	// fwdHeaders are the canonical names of the forwarded headers.
+	fwdHeaders []string
+
+	// ttl is the time the verdicts are cached for.
+	ttl time.Duration
+
+	// failOpen shows if the requests are allowed when the webhook fails.
+	failOpen bool
+}
+
+// newDoHAuth returns a new DNS-over-HTTPS authorizer for conf.  It returns nil
+// if the authorization is disabled.  conf is assumed to be valid.
+func newDoHAuth(conf *DoHAuthConfig) (a *dohAuth) {
+	if conf.URL == "" {
+		return nil
+	}
+
+	timeout := conf.Timeout.Duration
+	if timeout == 0 {
+		timeout = defaultDoHAuthTimeout
+	}
+
+	ttl := conf.CacheTTL.Duration
+	if ttl == 0 {
+		ttl = defaultDoHAuthCacheTTL
+	}
+
+	fwdHeaders := make([]string, 0, len(conf.ForwardHeaders))
+	for _, h := range conf.ForwardHeaders {
+		fwdHeaders = append(fwdHeaders, http.CanonicalHeaderKey(h))
+	}
+
+	sort.Strings(fwdHeaders)
+
+	return &dohAuth{
+		cli:        &http.Client{Timeout: timeout},
+		headers:    conf.Headers,
+		mu:         &sync.Mutex{},
+		cache:      map[string]*dohAuthVerdict{},
+		url:        conf.URL,
+		fwdHeaders: fwdHeaders,
+		ttl:        ttl,
+		failOpen:   conf.FailOpen,
+	}
+}
+
+// newRequest returns the webhook request body and the cache key for the
+// DNS-over-HTTPS request r.
+func (a *dohAuth) newRequest(r *http.Request, clientID string) (req *dohAuthRequest, key string) {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	req = &dohAuthRequest{
+		Headers:  map[string][]string{},
+		ClientIP: ip,
+		ClientID: clientID,
+	}
+
+	h := sha256.New()
+	_, _ = io.WriteString(h, ip+"\x00"+clientID)
+	for _, name := range a.fwdHeaders {
+		vals := r.Header.Values(name)
+		if len(vals) == 0 {
+			continue
+		}
+
+		req.Headers[name] = vals
+		_, _ = io.WriteString(h, "\x00"+name+":"+strings.Join(vals, "\x00"))
+	}
+
+	return req, hex.EncodeToString(h.Sum(nil))
+}
+
+// ask sends req to the webhook and returns its verdict.
+func (a *dohAuth) ask(req *dohAuthRequest) (allow bool, err error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return false, fmt.Errorf("encoding: %w", err)
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("creating request: %w", err)
+	}
+
+	httpReq.Header.Set("Content-Type", "application/json")
+	for k, v := range a.headers {
+		httpReq.Header.Set(k, v)
+	}
+
+	resp, err := a.cli.Do(httpReq)
+	if err != nil {
+		return false, err
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	authResp := &dohAuthResponse{}
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxDoHAuthRespSize)).Decode(authResp)
+	if err != nil {
+		return false, fmt.Errorf("decoding response: %w", err)
+	}
+
+	return authResp.Allow, nil
+}
+
+// authorize returns true if the client of the DNS-over-HTTPS request r with
+// clientID is allowed by the webhook as of now.
+func (a *dohAuth) authorize(r *http.Request, clientID string, now time.Time) (allow bool) {
+	req, key := a.newRequest(r, clientID)
+
+	a.mu.Lock()
+	v, ok := a.cache[key]
+	a.mu.Unlock()
+
+	if ok && now.Before(v.expire) {
+		return v.allow
+	}
+
+	allow, err := a.ask(req)
+	if err != nil {
+		log.Error("dns: doh auth webhook: client %s (id %q): %s", req.ClientIP, clientID, err)
+
+		return a.failOpen
+	}
+
+	log.Debug("dns: doh auth webhook: client %s (id %q): allow %t", req.ClientIP, clientID, allow)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.cache) >= maxDoHAuthCacheSize {
+		// Keep it simple and just start over.
+		a.cache = map[string]*dohAuthVerdict{}
+	}
+
+	a.cache[key] = &dohAuthVerdict{
+		expire: now.Add(a.ttl),
+		allow:  allow,
+	}
+
+	return allow
+}
@@ -0,0 +1,162 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestDoHAuthWebhook returns the URL of a webhook, which allows the
+// requests with the ClientID "good" and fails the ones with the ClientID
+// "fail", and the counter of its calls.
+func newTestDoHAuthWebhook(t *testing.T) (u string, calls *uint32) {
+	t.Helper()
+
+	calls = new(uint32)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint32(calls, 1)
+
+		assert.Equal(t, "secret", r.Header.Get("X-Webhook-Token"))
+
+		req := &dohAuthRequest{}
+		err := json.NewDecoder(r.Body).Decode(req)
+		if !assert.NoError(t, err) {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		assert.Equal(t, "192.0.2.1", req.ClientIP)
+		assert.Equal(t, []string{"Bearer 1"}, req.Headers["Authorization"])
+		assert.NotContains(t, req.Headers, "User-Agent")
+
+		if req.ClientID == "fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(&dohAuthResponse{Allow: req.ClientID == "good"})
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv.URL, calls
+}
+
+func TestDoHAuth_authorize(t *testing.T) {
+	u, calls := newTestDoHAuthWebhook(t)
+
+	a := newDoHAuth(&DoHAuthConfig{
+		Headers:        map[string]string{"X-Webhook-Token": "secret"},
+		URL:            u,
+		ForwardHeaders: []string{"authorization"},
+		CacheTTL:       timeutil.Duration{Duration: time.Minute},
+	})
+	require.NotNil(t, a)
+
+	newReq := func() (r *http.Request) {
+		r = httptest.NewRequest(http.MethodGet, "/dns-query", nil)
+		r.RemoteAddr = "192.0.2.1:12345"
+		r.Header.Set("Authorization", "Bearer 1")
+		r.Header.Set("User-Agent", "test")
+
+		return r
+	}
+
+	now := time.Now()
+
+	testCases := []struct {
+		name      string
+		clientID  string
+		wantCalls uint32
+		want      bool
+	}{{
+		name:      "allowed",
+		clientID:  "good",
+		wantCalls: 1,
+		want:      true,
+	}, {
+		name:      "allowed_cached",
+		clientID:  "good",
+		wantCalls: 1,
+		want:      true,
+	}, {
+		name:      "denied",
+		clientID:  "bad",
+		wantCalls: 2,
+		want:      false,
+	}, {
+		name:      "denied_cached",
+		clientID:  "bad",
+		wantCalls: 2,
+		want:      false,
+	}, {
+		name:      "failed",
+		clientID:  "fail",
+		wantCalls: 3,
+		want:      false,
+	}, {
+		name:      "failed_not_cached",
+		clientID:  "fail",
+		wantCalls: 4,
+		want:      false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, a.authorize(newReq(), tc.clientID, now))
+			assert.Equal(t, tc.wantCalls, atomic.LoadUint32(calls))
+		})
+	}
+
+	t.Run("expired", func(t *testing.T) {
+		assert.True(t, a.authorize(newReq(), "good", now.Add(2*time.Minute)))
+		assert.Equal(t, uint32(5), atomic.LoadUint32(calls))
+	})
+
+	t.Run("fail_open", func(t *testing.T) {
+		a.failOpen = true
+		assert.True(t, a.authorize(newReq(), "fail", now))
+	})
+}
+
+func TestDoHAuthConfig_validate(t *testing.T) {
+	testCases := []struct {
+		conf       *DoHAuthConfig
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       &DoHAuthConfig{},
+		name:       "disabled",
+		wantErrMsg: "",
+	}, {
+		conf:       &DoHAuthConfig{URL: "https://auth.example/check"},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		conf:       &DoHAuthConfig{URL: "ftp://auth.example"},
+		name:       "bad_scheme",
+		wantErrMsg: `url: bad scheme "ftp"`,
+	}, {
+		conf: &DoHAuthConfig{
+			URL:     "http://auth.example",
+			Timeout: timeutil.Duration{Duration: -time.Second},
+		},
+		name:       "negative_timeout",
+		wantErrMsg: "negative timeout -1s",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.conf.validate())
+		})
+	}
+}
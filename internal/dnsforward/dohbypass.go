@@ -0,0 +1,243 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/stringutil"
+	"github.com/miekg/dns"
+)
+
+// dohProviderHosts are the hostnames of the known public DNS-over-HTTPS
+// providers.  The subdomains of each hostname are matched as well, since some
+// providers put the client identifiers or the alternative endpoints there.
+//
+// Keep sorted.
+var dohProviderHosts = []string{
+	"cloudflare-dns.com",
+	"d.adguard-dns.com",
+	"dns-family.adguard.com",
+	"dns-unfiltered.adguard.com",
+	"dns.adguard-dns.com",
+	"dns.adguard.com",
+	"dns.alidns.com",
+	"dns.controld.com",
+	"dns.digitale-gesellschaft.ch",
+	"dns.google",
+	"dns.mullvad.net",
+	"dns.nextdns.io",
+	"dns.quad9.net",
+	"dns.switch.ch",
+	"dns.twnic.tw",
+	"dns10.quad9.net",
+	"dns11.quad9.net",
+	"dns9.quad9.net",
+	"doh.applied-privacy.net",
+	"doh.cleanbrowsing.org",
+	"doh.dns.sb",
+	"doh.familyshield.opendns.com",
+	"doh.ffmuc.net",
+	"doh.libredns.gr",
+	"doh.mullvad.net",
+	"doh.opendns.com",
+	"doh.pub",
+	"doh.xfinity.com",
+	"family.adguard-dns.com",
+	"family.canadianshield.cira.ca",
+	"freedns.controld.com",
+	"one.one.one.one",
+	"private.canadianshield.cira.ca",
+	"protected.canadianshield.cira.ca",
+	"unfiltered.adguard-dns.com",
+}
+
+// dohBypassServiceName is the name of the blocked service reported for the
+// blocked requests for the DNS-over-HTTPS providers.
+const dohBypassServiceName = "doh_bypass"
+
+// dohBypassMaxClients is the maximum number of the clients, the bypass
+// attempts of which are counted.
+const dohBypassMaxClients = 1000
+
+// dohBypassClient are the bypass attempts of a single client.
+type dohBypassClient struct {
+	// last is the time of the latest attempt.
+	last time.Time
+
+	// hosts are the numbers of the attempts by the provider hostnames.
+	hosts map[string]uint64
+
+	// count is the total number of the attempts.
+	count uint64
+}
+
+// dohBypass detects the requests for the hostnames of the public
+// DNS-over-HTTPS providers, which the devices use to bypass the filtering.
+type dohBypass struct {
+	// mu protects clients.
+	mu *sync.Mutex
+
+	// clients are the bypass attempts by the client IDs.
+	clients map[string]*dohBypassClient
+}
+
+// newDoHBypass returns a new DNS-over-HTTPS bypass detector.
+func newDoHBypass() (b *dohBypass) {
+	return &dohBypass{
+		mu:      &sync.Mutex{},
+		clients: map[string]*dohBypassClient{},
+	}
+}
+
+// matchDoHProvider returns the hostname from hosts, which is either host itself
+// or its parent domain.  provider is empty if there is none.
+func matchDoHProvider(hosts []string, host string) (provider string) {
+	for _, h := range hosts {
+		h = strings.ToLower(strings.TrimSuffix(h, "."))
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return h
+		}
+	}
+
+	return ""
+}
+
+// record counts the attempt of client to resolve the provider hostname.
+func (b *dohBypass) record(client, provider string, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.clients[client]
+	if !ok {
+		if len(b.clients) >= dohBypassMaxClients {
+			// Keep it simple and just start over.
+			b.clients = map[string]*dohBypassClient{}
+		}
+
+		c = &dohBypassClient{
+			hosts: map[string]uint64{},
+		}
+		b.clients[client] = c
+	}
+
+	c.last = now
+	c.hosts[provider]++
+	c.count++
+}
+
+// processDoHBypass detects the requests for the hostnames of the public
+// DNS-over-HTTPS providers and blocks them, if configured.
+func (s *Server) processDoHBypass(dctx *dnsContext) (rc resultCode) {
+	pctx := dctx.proxyCtx
+	if pctx.Res != nil {
+		return resultCodeSuccess
+	}
+
+	q := pctx.Req.Question[0]
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeHTTPS, dns.TypeSVCB:
+		// Go on.
+	default:
+		return resultCodeSuccess
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+
+	s.serverLock.RLock()
+	block := s.conf.BlockDoHBypass
+	provider := matchDoHProvider(dohProviderHosts, host)
+	if provider == "" {
+		provider = matchDoHProvider(s.conf.DoHBypassHosts, host)
+	}
+	s.serverLock.RUnlock()
+
+	if provider == "" {
+		return resultCodeSuccess
+	}
+
+	client := stringutil.Coalesce(dctx.clientID, ipStringFromAddr(pctx.Addr))
+	s.dohBypass.record(client, provider, time.Now())
+
+	if !block || !dctx.protectionEnabled {
+		log.Debug("dns: doh bypass: client %s resolves %q", client, host)
+
+		return resultCodeSuccess
+	}
+
+	log.Debug("dns: doh bypass: blocking %q for client %s", host, client)
+
+	dctx.result = &filtering.Result{
+		IsFiltered:  true,
+		Reason:      filtering.FilteredBlockedService,
+		ServiceName: dohBypassServiceName,
+	}
+	pctx.Res = s.genDNSFilterMessage(pctx, dctx.result)
+
+	return resultCodeSuccess
+}
+
+// dohBypassClientJSON are the bypass attempts of a single client.
+type dohBypassClientJSON struct {
+	Hosts  map[string]uint64 `json:"hosts"`
+	Client string            `json:"client"`
+	Last   string            `json:"last"`
+	Count  uint64            `json:"count"`
+}
+
+// dohBypassStatsJSON is the response to the GET /control/doh_bypass/stats HTTP
+// API.
+type dohBypassStatsJSON struct {
+	Clients []*dohBypassClientJSON `json:"clients"`
+	Blocked bool                   `json:"blocked"`
+}
+
+// handleDoHBypassStats is the handler for the GET /control/doh_bypass/stats
+// HTTP API.  The clients with the most attempts come first.
+func (s *Server) handleDoHBypassStats(w http.ResponseWriter, r *http.Request) {
+	s.serverLock.RLock()
+	blocked := s.conf.BlockDoHBypass
+	s.serverLock.RUnlock()
+
+	resp := &dohBypassStatsJSON{
+		Clients: []*dohBypassClientJSON{},
+		Blocked: blocked,
+	}
+
+	s.dohBypass.mu.Lock()
+	for id, c := range s.dohBypass.clients {
+		hosts := make(map[string]uint64, len(c.hosts))
+		for h, n := range c.hosts {
+			hosts[h] = n
+		}
+
+		resp.Clients = append(resp.Clients, &dohBypassClientJSON{
+			Hosts:  hosts,
+			Client: id,
+			Last:   c.last.Format(time.RFC3339),
+			Count:  c.count,
+		})
+	}
+	s.dohBypass.mu.Unlock()
+
+	sort.Slice(resp.Clients, func(i, j int) bool {
+		ci, cj := resp.Clients[i], resp.Clients[j]
+		if ci.Count != cj.Count {
+			return ci.Count > cj.Count
+		}
+
+		return ci.Client < cj.Client
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "encoding response: %s", err)
+	}
+}
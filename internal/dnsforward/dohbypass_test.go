@@ -0,0 +1,162 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_processDoHBypass(t *testing.T) {
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				DoHBypassHosts: []string{"DoH.Example."},
+			},
+		},
+		dohBypass: newDoHBypass(),
+	}
+
+	testCases := []struct {
+		name      string
+		host      string
+		clientID  string
+		qtype     uint16
+		block     bool
+		wantBlock bool
+		wantCount bool
+	}{{
+		name:      "builtin",
+		host:      "dns.google.",
+		clientID:  "",
+		qtype:     dns.TypeA,
+		block:     true,
+		wantBlock: true,
+		wantCount: true,
+	}, {
+		name:      "subdomain",
+		host:      "abc123.dns.nextdns.io.",
+		clientID:  "laptop",
+		qtype:     dns.TypeHTTPS,
+		block:     true,
+		wantBlock: true,
+		wantCount: true,
+	}, {
+		name:      "custom",
+		host:      "doh.example.",
+		clientID:  "",
+		qtype:     dns.TypeAAAA,
+		block:     true,
+		wantBlock: true,
+		wantCount: true,
+	}, {
+		name:      "detect_only",
+		host:      "cloudflare-dns.com.",
+		clientID:  "",
+		qtype:     dns.TypeA,
+		block:     false,
+		wantBlock: false,
+		wantCount: true,
+	}, {
+		name:      "other_type",
+		host:      "dns.google.",
+		clientID:  "",
+		qtype:     dns.TypeTXT,
+		block:     true,
+		wantBlock: false,
+		wantCount: false,
+	}, {
+		name:      "not_provider",
+		host:      "notdns.google.example.",
+		clientID:  "",
+		qtype:     dns.TypeA,
+		block:     true,
+		wantBlock: false,
+		wantCount: false,
+	}}
+
+	addr := &net.UDPAddr{IP: net.IP{192, 168, 1, 2}, Port: 53}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s.conf.BlockDoHBypass = tc.block
+			s.dohBypass = newDoHBypass()
+
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Req:  (&dns.Msg{}).SetQuestion(tc.host, tc.qtype),
+					Addr: addr,
+				},
+				clientID:          tc.clientID,
+				protectionEnabled: true,
+			}
+
+			rc := s.processDoHBypass(dctx)
+			require.Equal(t, resultCodeSuccess, rc)
+
+			if tc.wantBlock {
+				require.NotNil(t, dctx.result)
+				require.NotNil(t, dctx.proxyCtx.Res)
+
+				assert.Equal(t, filtering.FilteredBlockedService, dctx.result.Reason)
+				assert.Equal(t, dohBypassServiceName, dctx.result.ServiceName)
+			} else {
+				assert.Nil(t, dctx.result)
+				assert.Nil(t, dctx.proxyCtx.Res)
+			}
+
+			if tc.wantCount {
+				client := tc.clientID
+				if client == "" {
+					client = "192.168.1.2"
+				}
+
+				require.Contains(t, s.dohBypass.clients, client)
+				assert.EqualValues(t, 1, s.dohBypass.clients[client].count)
+			} else {
+				assert.Empty(t, s.dohBypass.clients)
+			}
+		})
+	}
+}
+
+func TestServer_handleDoHBypassStats(t *testing.T) {
+	s := &Server{
+		dohBypass: newDoHBypass(),
+	}
+	s.conf.BlockDoHBypass = true
+
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := s.dohBypass
+	b.record("192.168.1.2", "dns.google", now)
+	b.record("laptop", "dns.google", now)
+	b.record("laptop", "cloudflare-dns.com", now)
+
+	w := httptest.NewRecorder()
+	s.handleDoHBypassStats(w, httptest.NewRequest(http.MethodGet, "/control/doh_bypass/stats", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp := &dohBypassStatsJSON{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(resp))
+
+	assert.True(t, resp.Blocked)
+	require.Len(t, resp.Clients, 2)
+
+	assert.Equal(t, "laptop", resp.Clients[0].Client)
+	assert.EqualValues(t, 2, resp.Clients[0].Count)
+	assert.Equal(t, map[string]uint64{
+		"dns.google":         1,
+		"cloudflare-dns.com": 1,
+	}, resp.Clients[0].Hosts)
+
+	assert.Equal(t, "192.168.1.2", resp.Clients[1].Client)
+	assert.EqualValues(t, 1, resp.Clients[1].Count)
+}
@@ -0,0 +1,272 @@
+package dnsforward
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// The JSON DNS API is the flavor of DNS-over-HTTPS used by Google and
+// Cloudflare, where the question is passed in the "name" and "type" query
+// parameters and the response is a JSON object.  See
+// https://developers.google.com/speed/public-dns/docs/doh/json.
+
+// Media types of the DNS-over-HTTPS requests and responses.
+const (
+	dohJSONType = "application/dns-json"
+	dohWireType = "application/dns-message"
+)
+
+// isDoHJSONRequest returns true if r is a request to the JSON DNS API.
+func isDoHJSONRequest(r *http.Request) (ok bool) {
+	if r.Method != http.MethodGet {
+		return false
+	}
+
+	q := r.URL.Query()
+	if q.Get("dns") != "" {
+		return false
+	}
+
+	return q.Get("name") != "" || strings.Contains(r.Header.Get("Accept"), dohJSONType)
+}
+
+// isTrueParam returns true if the value of a boolean query parameter is
+// truthy.
+func isTrueParam(v string) (ok bool) {
+	return v == "1" || strings.EqualFold(v, "true")
+}
+
+// dohJSONRequest returns the DNS request for the query parameters of a JSON
+// DNS API request.
+func dohJSONRequest(q url.Values) (req *dns.Msg, err error) {
+	name := q.Get("name")
+	if name == "" {
+		return nil, errors.Error("name is required")
+	} else if _, ok := dns.IsDomainName(name); !ok {
+		return nil, fmt.Errorf("bad name %q", name)
+	}
+
+	qtype := dns.TypeA
+	if t := q.Get("type"); t != "" {
+		var n uint64
+		n, err = strconv.ParseUint(t, 10, 16)
+		if err == nil && n > 0 {
+			qtype = uint16(n)
+		} else if known, ok := dns.StringToType[strings.ToUpper(t)]; ok {
+			qtype = known
+		} else {
+			return nil, fmt.Errorf("bad type %q", t)
+		}
+	}
+
+	req = (&dns.Msg{}).SetQuestion(dns.Fqdn(name), qtype)
+	req.CheckingDisabled = isTrueParam(q.Get("cd"))
+	if isTrueParam(q.Get("do")) {
+		req.SetEdns0(dns.DefaultMsgSize, true)
+	}
+
+	return req, nil
+}
+
+// dohJSONQuestion is a question of a JSON DNS API response.
+type dohJSONQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+// dohJSONRR is a resource record of a JSON DNS API response.
+type dohJSONRR struct {
+	Name string `json:"name"`
+	Data string `json:"data"`
+	TTL  uint32 `json:"TTL"`
+	Type uint16 `json:"type"`
+}
+
+// dohJSONResponse is a JSON DNS API response.
+type dohJSONResponse struct {
+	Question   []dohJSONQuestion `json:"Question"`
+	Answer     []dohJSONRR       `json:"Answer,omitempty"`
+	Authority  []dohJSONRR       `json:"Authority,omitempty"`
+	Additional []dohJSONRR       `json:"Additional,omitempty"`
+	Comment    string            `json:"Comment,omitempty"`
+	Status     int               `json:"Status"`
+	TC         bool              `json:"TC"`
+	RD         bool              `json:"RD"`
+	RA         bool              `json:"RA"`
+	AD         bool              `json:"AD"`
+	CD         bool              `json:"CD"`
+}
+
+// toDoHJSONRRs converts rrs into the JSON DNS API records.  The OPT
+// pseudo-records are skipped.
+func toDoHJSONRRs(rrs []dns.RR) (res []dohJSONRR) {
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+
+		res = append(res, dohJSONRR{
+			Name: hdr.Name,
+			Data: strings.TrimPrefix(rr.String(), hdr.String()),
+			TTL:  hdr.Ttl,
+			Type: hdr.Rrtype,
+		})
+	}
+
+	return res
+}
+
+// newDoHJSONResponse converts resp into the JSON DNS API response.  The extended
+// DNS error, if any, is reported in the comment.
+func newDoHJSONResponse(resp *dns.Msg) (jr *dohJSONResponse) {
+	jr = &dohJSONResponse{
+		Answer:     toDoHJSONRRs(resp.Answer),
+		Authority:  toDoHJSONRRs(resp.Ns),
+		Additional: toDoHJSONRRs(resp.Extra),
+		Status:     resp.Rcode,
+		TC:         resp.Truncated,
+		RD:         resp.RecursionDesired,
+		RA:         resp.RecursionAvailable,
+		AD:         resp.AuthenticatedData,
+		CD:         resp.CheckingDisabled,
+	}
+
+	for _, q := range resp.Question {
+		jr.Question = append(jr.Question, dohJSONQuestion{
+			Name: q.Name,
+			Type: q.Qtype,
+		})
+	}
+
+	if opt := resp.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if ede, ok := o.(*dns.EDNS0_EDE); ok {
+				jr.Comment = ede.String()
+
+				break
+			}
+		}
+	}
+
+	return jr
+}
+
+// dohResponseRecorder keeps the DNS-over-HTTPS response written by dnsproxy to
+// convert it into the JSON DNS API one.
+type dohResponseRecorder struct {
+	// header is the header of the response.
+	header http.Header
+
+	// body is the body of the response.
+	body *bytes.Buffer
+
+	// code is the status code of the response.  It's zero until written.
+	code int
+}
+
+// type check
+var _ http.ResponseWriter = (*dohResponseRecorder)(nil)
+
+// Header implements the http.ResponseWriter interface for
+// *dohResponseRecorder.
+func (rec *dohResponseRecorder) Header() (h http.Header) {
+	return rec.header
+}
+
+// Write implements the http.ResponseWriter interface for
+// *dohResponseRecorder.
+func (rec *dohResponseRecorder) Write(b []byte) (n int, err error) {
+	if rec.code == 0 {
+		rec.code = http.StatusOK
+	}
+
+	return rec.body.Write(b)
+}
+
+// WriteHeader implements the http.ResponseWriter interface for
+// *dohResponseRecorder.
+func (rec *dohResponseRecorder) WriteHeader(code int) {
+	if rec.code == 0 {
+		rec.code = code
+	}
+}
+
+// serveDoHJSON serves the JSON DNS API request r by passing it to prx as a
+// DNS-over-HTTPS GET request, so that it's processed the same way as any
+// other one, and converting the response.
+func (s *Server) serveDoHJSON(w http.ResponseWriter, r *http.Request, prx *proxy.Proxy) {
+	q := r.URL.Query()
+	req, err := dohJSONRequest(q)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "json dns api: %s", err)
+
+		return
+	}
+
+	packed, err := req.Pack()
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "json dns api: packing request: %s", err)
+
+		return
+	}
+
+	// Keep the path and the headers, since the ClientID and the trace context
+	// are taken from them.
+	wireReq := r.Clone(r.Context())
+	wireReq.URL.RawQuery = url.Values{
+		"dns": []string{base64.RawURLEncoding.EncodeToString(packed)},
+	}.Encode()
+	wireReq.Header.Set("Accept", dohWireType)
+
+	rec := &dohResponseRecorder{
+		header: http.Header{},
+		body:   &bytes.Buffer{},
+	}
+	prx.ServeHTTP(rec, wireReq)
+
+	if rec.code == 0 {
+		rec.code = http.StatusOK
+	}
+
+	if rec.code != http.StatusOK || rec.header.Get("Content-Type") != dohWireType {
+		for k, v := range rec.header {
+			w.Header()[k] = v
+		}
+
+		w.WriteHeader(rec.code)
+		_, _ = w.Write(rec.body.Bytes())
+
+		return
+	}
+
+	resp := &dns.Msg{}
+	err = resp.Unpack(rec.body.Bytes())
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "json dns api: unpacking response: %s", err)
+
+		return
+	}
+
+	if cc := rec.header.Get("Cache-Control"); cc != "" {
+		w.Header().Set("Cache-Control", cc)
+	}
+
+	w.Header().Set("Content-Type", dohJSONType)
+	err = json.NewEncoder(w).Encode(newDoHJSONResponse(resp))
+	if err != nil {
+		log.Debug("json dns api: writing response: %s", err)
+	}
+}
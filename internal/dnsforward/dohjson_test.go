@@ -0,0 +1,148 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoHJSONRequest(t *testing.T) {
+	testCases := []struct {
+		name       string
+		query      string
+		wantErrMsg string
+		wantType   uint16
+		wantDO     bool
+	}{{
+		name:       "default_type",
+		query:      "name=example.org",
+		wantErrMsg: "",
+		wantType:   dns.TypeA,
+		wantDO:     false,
+	}, {
+		name:       "numeric_type",
+		query:      "name=example.org&type=28",
+		wantErrMsg: "",
+		wantType:   dns.TypeAAAA,
+		wantDO:     false,
+	}, {
+		name:       "mnemonic_type",
+		query:      "name=example.org&type=mx&do=1",
+		wantErrMsg: "",
+		wantType:   dns.TypeMX,
+		wantDO:     true,
+	}, {
+		name:       "no_name",
+		query:      "type=A",
+		wantErrMsg: "name is required",
+		wantType:   0,
+		wantDO:     false,
+	}, {
+		name:       "bad_type",
+		query:      "name=example.org&type=BAD",
+		wantErrMsg: `bad type "BAD"`,
+		wantType:   0,
+		wantDO:     false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			q, err := url.ParseQuery(tc.query)
+			require.NoError(t, err)
+
+			req, err := dohJSONRequest(q)
+			if tc.wantErrMsg != "" {
+				require.Error(t, err)
+
+				assert.Equal(t, tc.wantErrMsg, err.Error())
+
+				return
+			}
+
+			require.NoError(t, err)
+			require.Len(t, req.Question, 1)
+
+			assert.Equal(t, "example.org.", req.Question[0].Name)
+			assert.Equal(t, tc.wantType, req.Question[0].Qtype)
+
+			opt := req.IsEdns0()
+			assert.Equal(t, tc.wantDO, opt != nil && opt.Do())
+		})
+	}
+}
+
+func TestServer_serveDoHJSON(t *testing.T) {
+	s := createTestServer(t, &filtering.Config{}, ServerConfig{
+		UDPListenAddrs: []*net.UDPAddr{{}},
+		TCPListenAddrs: []*net.TCPAddr{{}},
+		FilteringConfig: FilteringConfig{
+			ProtectionEnabled: true,
+			BlockingMode:      BlockingModeDefault,
+		},
+	}, nil)
+	s.conf.UpstreamConfig.Upstreams = []upstream.Upstream{
+		&aghtest.TestUpstream{
+			IPv4: map[string][]net.IP{
+				"example.com.": {{1, 2, 3, 4}},
+			},
+		},
+	}
+	startDeferStop(t, s)
+
+	t.Run("answer", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/dns-query?name=example.com&type=A", nil)
+		s.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code)
+
+		assert.Equal(t, dohJSONType, w.Header().Get("Content-Type"))
+
+		resp := &dohJSONResponse{}
+		err := json.NewDecoder(w.Body).Decode(resp)
+		require.NoError(t, err)
+
+		assert.Equal(t, dns.RcodeSuccess, resp.Status)
+		assert.Equal(t, []dohJSONQuestion{{Name: "example.com.", Type: dns.TypeA}}, resp.Question)
+		require.Len(t, resp.Answer, 1)
+
+		assert.Equal(t, "1.2.3.4", resp.Answer[0].Data)
+		assert.Equal(t, dns.TypeA, resp.Answer[0].Type)
+	})
+
+	t.Run("blocked", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/dns-query?name=nxdomain.example.org", nil)
+		s.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code)
+
+		resp := &dohJSONResponse{}
+		err := json.NewDecoder(w.Body).Decode(resp)
+		require.NoError(t, err)
+
+		assert.Equal(t, dns.RcodeSuccess, resp.Status)
+		require.Len(t, resp.Answer, 1)
+
+		assert.Equal(t, "0.0.0.0", resp.Answer[0].Data)
+	})
+
+	t.Run("bad_request", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/dns-query?type=A", nil)
+		r.Header.Set("Accept", dohJSONType)
+		s.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
@@ -0,0 +1,277 @@
+package dnsforward
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// defaultDoTIdleTimeout is the default time after which an idle DNS-over-TLS
+// connection is closed.  It's the same as the one used by dnsproxy.
+const defaultDoTIdleTimeout = 10 * time.Second
+
+// dotTuned returns true if any of the DNS-over-TLS tuning settings is set, in
+// which case the DNS-over-TLS listeners are served by dotServer instead of
+// dnsproxy.
+func (c *TLSConfig) dotTuned() (ok bool) {
+	return c.DoTTCPFastOpen ||
+		c.DoTKeepAlive.Duration != 0 ||
+		c.DoTIdleTimeout.Duration != 0 ||
+		c.DoTEDNSKeepalive
+}
+
+// dotServer is the DNS-over-TLS server with tunable TCP settings.
+type dotServer struct {
+	// srv is the DNS server handling the requests.
+	srv *Server
+
+	// tlsConf is the TLS configuration of the listeners.
+	tlsConf *tls.Config
+
+	// mu protects listeners and conns.
+	mu *sync.Mutex
+
+	// listeners are the currently open listeners.
+	listeners []net.Listener
+
+	// conns are the currently open client connections.
+	conns map[net.Conn]struct{}
+
+	// addrs are the addresses to listen on.
+	addrs []*net.TCPAddr
+
+	// keepAlive is the TCP keepalive period.  If it's zero, the default
+	// period is used.
+	keepAlive time.Duration
+
+	// idleTimeout is the time after which an idle connection is closed.
+	idleTimeout time.Duration
+
+	// fastOpen enables TCP Fast Open on the listeners.
+	fastOpen bool
+
+	// ednsKeepalive enables the EDNS TCP Keepalive option in the responses.
+	ednsKeepalive bool
+}
+
+// newDoTServer returns a new DNS-over-TLS server for the current
+// configuration of s.
+func newDoTServer(s *Server, tlsConf *tls.Config) (d *dotServer) {
+	idleTimeout := s.conf.DoTIdleTimeout.Duration
+	if idleTimeout == 0 {
+		idleTimeout = defaultDoTIdleTimeout
+	}
+
+	return &dotServer{
+		srv:           s,
+		tlsConf:       tlsConf,
+		mu:            &sync.Mutex{},
+		conns:         map[net.Conn]struct{}{},
+		addrs:         s.conf.TLSListenAddrs,
+		keepAlive:     s.conf.DoTKeepAlive.Duration,
+		idleTimeout:   idleTimeout,
+		fastOpen:      s.conf.DoTTCPFastOpen,
+		ednsKeepalive: s.conf.DoTEDNSKeepalive,
+	}
+}
+
+// start starts listening on all the addresses.
+func (d *dotServer) start() (err error) {
+	lc := &net.ListenConfig{
+		KeepAlive: d.keepAlive,
+	}
+	if d.fastOpen {
+		lc.Control = controlFastOpen
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, addr := range d.addrs {
+		var l net.Listener
+		l, err = lc.Listen(context.Background(), "tcp", addr.String())
+		if err != nil {
+			return fmt.Errorf("dot: listening on %s: %w", addr, err)
+		}
+
+		log.Info("dns: listening to tls://%s", l.Addr())
+
+		d.listeners = append(d.listeners, l)
+		go d.serve(tls.NewListener(l, d.tlsConf))
+	}
+
+	return nil
+}
+
+// stop closes all the listeners and the client connections.
+func (d *dotServer) stop() (err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var errs []error
+	for _, l := range d.listeners {
+		if cerr := l.Close(); cerr != nil {
+			errs = append(errs, cerr)
+		}
+	}
+	d.listeners = nil
+
+	for c := range d.conns {
+		_ = c.Close()
+	}
+	d.conns = map[net.Conn]struct{}{}
+
+	if len(errs) > 0 {
+		return errors.List("dot: closing listeners", errs...)
+	}
+
+	return nil
+}
+
+// serve accepts the connections from l until it's closed.
+func (d *dotServer) serve(l net.Listener) {
+	defer aghos.OnPanicAndExit("dot: serve")
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Info("dot: accepting: %s", err)
+			}
+
+			return
+		}
+
+		d.mu.Lock()
+		d.conns[conn] = struct{}{}
+		d.mu.Unlock()
+
+		go d.handleConn(conn)
+	}
+}
+
+// handleConn handles the DNS messages from conn until it's closed or idle for
+// longer than the idle timeout.
+func (d *dotServer) handleConn(conn net.Conn) {
+	defer log.OnPanic("dot: handling conn")
+	defer func() {
+		d.mu.Lock()
+		delete(d.conns, conn)
+		d.mu.Unlock()
+
+		_ = conn.Close()
+	}()
+
+	dc := &dns.Conn{Conn: conn}
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(d.idleTimeout))
+		n, err := dc.Read(buf)
+		if err != nil {
+			return
+		}
+
+		req := &dns.Msg{}
+		err = req.Unpack(buf[:n])
+		if err != nil {
+			log.Debug("dot: unpacking request from %s: %s", conn.RemoteAddr(), err)
+
+			return
+		}
+
+		if !d.handleReq(conn, req) {
+			return
+		}
+	}
+}
+
+// handleReq processes req received over conn and writes the response.  ok is
+// false if the connection must be closed.
+func (d *dotServer) handleReq(conn net.Conn, req *dns.Msg) (ok bool) {
+	if req.Response {
+		return true
+	}
+
+	pctx := &proxy.DNSContext{
+		Proto:     proxy.ProtoTLS,
+		Req:       req,
+		Addr:      conn.RemoteAddr(),
+		Conn:      conn,
+		StartTime: time.Now(),
+	}
+
+	if !d.srv.serveRequest(pctx) {
+		return false
+	}
+
+	if d.ednsKeepalive {
+		d.setEDNSKeepalive(req, pctx.Res)
+	}
+
+	pctx.Res.Compress = true
+	data, err := pctx.Res.Pack()
+	if err != nil {
+		log.Debug("dot: packing response: %s", err)
+
+		return false
+	}
+
+	_ = conn.SetWriteDeadline(time.Now().Add(defaultDoTIdleTimeout))
+	_, err = conn.Write(proxyutil.AddPrefix(data))
+	if err != nil {
+		log.Debug("dot: writing response to %s: %s", conn.RemoteAddr(), err)
+
+		return false
+	}
+
+	return true
+}
+
+// setEDNSKeepalive adds the EDNS TCP Keepalive option with the idle timeout to
+// resp if req contains it.  See RFC 7828, section 3.3.2.
+func (d *dotServer) setEDNSKeepalive(req, resp *dns.Msg) {
+	reqOpt := req.IsEdns0()
+	if reqOpt == nil || !hasEDNSOption(reqOpt, dns.EDNS0TCPKEEPALIVE) {
+		return
+	}
+
+	respOpt := resp.IsEdns0()
+	if respOpt == nil {
+		resp.SetEdns0(reqOpt.UDPSize(), reqOpt.Do())
+		respOpt = resp.IsEdns0()
+	} else if hasEDNSOption(respOpt, dns.EDNS0TCPKEEPALIVE) {
+		return
+	}
+
+	// The timeout is measured in units of 100 milliseconds.
+	timeout := d.idleTimeout / (100 * time.Millisecond)
+	if timeout > 0xffff {
+		timeout = 0xffff
+	}
+
+	respOpt.Option = append(respOpt.Option, &dns.EDNS0_TCP_KEEPALIVE{
+		Code:    dns.EDNS0TCPKEEPALIVE,
+		Timeout: uint16(timeout),
+	})
+}
+
+// hasEDNSOption returns true if opt contains an option with code.
+func hasEDNSOption(opt *dns.OPT, code uint16) (ok bool) {
+	for _, o := range opt.Option {
+		if o.Option() == code {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,26 @@
+//go:build linux
+// +build linux
+
+package dnsforward
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// dotFastOpenQueueLen is the maximum length of the queue of the pending TCP
+// Fast Open requests.
+const dotFastOpenQueueLen = 256
+
+// controlFastOpen enables TCP Fast Open on the listening socket.
+func controlFastOpen(_, _ string, c syscall.RawConn) (err error) {
+	cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN, dotFastOpenQueueLen)
+	})
+	if cerr != nil {
+		return cerr
+	}
+
+	return err
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package dnsforward
+
+import (
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// controlFastOpen does nothing since TCP Fast Open on the listening sockets is
+// only supported on Linux.
+func controlFastOpen(_, _ string, _ syscall.RawConn) (err error) {
+	log.Info("dot: tcp fast open is not supported on this platform")
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package dnsforward
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoTServer_tuned(t *testing.T) {
+	s, certPem := createTestTLS(t, TLSConfig{
+		TLSListenAddrs:   []*net.TCPAddr{{IP: net.IP{127, 0, 0, 1}}},
+		DoTIdleTimeout:   timeutil.Duration{Duration: 5 * time.Second},
+		DoTEDNSKeepalive: true,
+	})
+	s.conf.UpstreamConfig.Upstreams = []upstream.Upstream{
+		&aghtest.TestUpstream{
+			IPv4: map[string][]net.IP{
+				"google-public-dns-a.google.com.": {{8, 8, 8, 8}},
+			},
+		},
+	}
+	require.NotNil(t, s.dot)
+
+	startDeferStop(t, s)
+
+	require.Len(t, s.dot.listeners, 1)
+	addr := s.dot.listeners[0].Addr()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPem)
+	conn, err := dns.DialWithTLS("tcp-tls", addr.String(), &tls.Config{
+		ServerName: tlsServerName,
+		RootCAs:    roots,
+		MinVersion: tls.VersionTLS12,
+	})
+	require.NoError(t, err)
+
+	t.Run("plain", func(t *testing.T) {
+		sendTestMessages(t, conn)
+	})
+
+	t.Run("edns_keepalive", func(t *testing.T) {
+		req := createGoogleATestMessage()
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{
+			Code: dns.EDNS0TCPKEEPALIVE,
+		})
+
+		err = conn.WriteMsg(req)
+		require.NoError(t, err)
+
+		var resp *dns.Msg
+		resp, err = conn.ReadMsg()
+		require.NoError(t, err)
+
+		assertGoogleAResponse(t, resp)
+
+		respOpt := resp.IsEdns0()
+		require.NotNil(t, respOpt)
+
+		var ka *dns.EDNS0_TCP_KEEPALIVE
+		for _, o := range respOpt.Option {
+			if k, ok := o.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+				ka = k
+			}
+		}
+		require.NotNil(t, ka)
+
+		assert.Equal(t, uint16(50), ka.Timeout)
+	})
+}
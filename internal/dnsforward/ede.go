@@ -0,0 +1,120 @@
+package dnsforward
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/miekg/dns"
+)
+
+// maxExtraTextLen is the maximum length of the EXTRA-TEXT field of the
+// Extended DNS Errors added by the server, so that the responses still fit
+// into the plain DNS datagrams.
+const maxExtraTextLen = 200
+
+// setExtendedError adds the RFC 8914 Extended DNS Error with code and text to
+// resp if the Extended DNS Errors are enabled and the client has sent req with
+// an OPT record, since the clients without EDNS can't receive them anyway.
+func (s *Server) setExtendedError(req, resp *dns.Msg, code uint16, text string) {
+	if !s.conf.ExtendedErrors || resp == nil {
+		return
+	}
+
+	reqOpt := req.IsEdns0()
+	if reqOpt == nil {
+		return
+	}
+
+	if len(text) > maxExtraTextLen {
+		text = text[:maxExtraTextLen]
+		for !utf8.ValidString(text) {
+			text = text[:len(text)-1]
+		}
+	}
+
+	opt := resp.IsEdns0()
+	if opt == nil {
+		resp.SetEdns0(dns.DefaultMsgSize, reqOpt.Do())
+		opt = resp.IsEdns0()
+	}
+
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+		InfoCode:  code,
+		ExtraText: text,
+	})
+}
+
+// filteredExtendedError returns the Extended DNS Error explaining why the
+// request has been filtered with res.  ok is false if res isn't an error from
+// the client's point of view, for example a rewrite.
+func (s *Server) filteredExtendedError(res *filtering.Result) (code uint16, text string, ok bool) {
+	switch res.Reason {
+	case filtering.FilteredBlockList:
+		return dns.ExtendedErrorCodeBlocked, s.ruleText(res.Rules), true
+	case filtering.FilteredBlockedService:
+		return dns.ExtendedErrorCodeBlocked, fmt.Sprintf("blocked service %q", res.ServiceName), true
+	case filtering.FilteredSafeBrowsing:
+		return dns.ExtendedErrorCodeBlocked, "blocked by safe browsing", true
+	case filtering.FilteredParental:
+		return dns.ExtendedErrorCodeFiltered, "blocked by parental control", true
+	case filtering.FilteredQuarantine:
+		return dns.ExtendedErrorCodeProhibited, "client is quarantined", true
+	default:
+		return 0, "", false
+	}
+}
+
+// ruleText returns the extra text describing the first of the blocking rules.
+func (s *Server) ruleText(rules []*filtering.ResultRule) (text string) {
+	if len(rules) == 0 {
+		return "blocked by filtering rules"
+	}
+
+	r := rules[0]
+	switch id := r.FilterListID; id {
+	case filtering.CustomListID:
+		return fmt.Sprintf("blocked by custom rule %q", r.Text)
+	case filtering.RPZListID:
+		return fmt.Sprintf("blocked by response policy %q", r.Text)
+	case filtering.AnswerNetsListID:
+		return fmt.Sprintf("answer is in blocked network %q", r.Text)
+	default:
+		var name string
+		if s.conf.FilterListName != nil {
+			name = s.conf.FilterListName(id)
+		}
+
+		if name == "" {
+			return fmt.Sprintf("blocked by rule %q from filter list %d", r.Text, id)
+		}
+
+		return fmt.Sprintf("blocked by rule %q from filter list %q", r.Text, name)
+	}
+}
+
+// processExtendedErrors adds the Extended DNS Error to the response if the
+// request has been filtered.
+func (s *Server) processExtendedErrors(dctx *dnsContext) (rc resultCode) {
+	pctx := dctx.proxyCtx
+	if !s.conf.ExtendedErrors || pctx.Res == nil {
+		return resultCodeSuccess
+	}
+
+	if dctx.consensusDiverged {
+		s.setExtendedError(
+			pctx.Req,
+			pctx.Res,
+			dns.ExtendedErrorCodeOther,
+			"answers of consensus upstreams diverge",
+		)
+
+		return resultCodeSuccess
+	}
+
+	if code, text, ok := s.filteredExtendedError(dctx.result); ok {
+		s.setExtendedError(pctx.Req, pctx.Res, code, text)
+	}
+
+	return resultCodeSuccess
+}
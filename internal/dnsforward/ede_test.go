@@ -0,0 +1,183 @@
+package dnsforward
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// extendedErrors returns the Extended DNS Errors from msg.
+func extendedErrors(msg *dns.Msg) (edes []*dns.EDNS0_EDE) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		if ede, ok := o.(*dns.EDNS0_EDE); ok {
+			edes = append(edes, ede)
+		}
+	}
+
+	return edes
+}
+
+func TestServer_processExtendedErrors(t *testing.T) {
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				ExtendedErrors: true,
+				FilterListName: func(id int64) (name string) {
+					if id == 1 {
+						return "Ads"
+					}
+
+					return ""
+				},
+			},
+		},
+	}
+
+	longRule := "||" + strings.Repeat("a", maxExtraTextLen) + ".example^"
+
+	testCases := []struct {
+		res      *filtering.Result
+		name     string
+		wantText string
+		edns     bool
+		diverged bool
+		wantCode uint16
+		wantNone bool
+	}{{
+		res: &filtering.Result{
+			Reason: filtering.FilteredBlockList,
+			Rules:  []*filtering.ResultRule{{Text: "||ads.example^", FilterListID: 1}},
+		},
+		name:     "named_list",
+		wantText: `blocked by rule "||ads.example^" from filter list "Ads"`,
+		edns:     true,
+		diverged: false,
+		wantCode: dns.ExtendedErrorCodeBlocked,
+		wantNone: false,
+	}, {
+		res: &filtering.Result{
+			Reason: filtering.FilteredBlockList,
+			Rules:  []*filtering.ResultRule{{Text: "||ads.example^", FilterListID: 2}},
+		},
+		name:     "unnamed_list",
+		wantText: `blocked by rule "||ads.example^" from filter list 2`,
+		edns:     true,
+		diverged: false,
+		wantCode: dns.ExtendedErrorCodeBlocked,
+		wantNone: false,
+	}, {
+		res: &filtering.Result{
+			Reason: filtering.FilteredBlockList,
+			Rules: []*filtering.ResultRule{{
+				Text:         longRule,
+				FilterListID: filtering.CustomListID,
+			}},
+		},
+		name:     "custom_long",
+		wantText: (`blocked by custom rule "` + longRule)[:maxExtraTextLen],
+		edns:     true,
+		diverged: false,
+		wantCode: dns.ExtendedErrorCodeBlocked,
+		wantNone: false,
+	}, {
+		res: &filtering.Result{
+			Reason: filtering.FilteredBlockList,
+			Rules: []*filtering.ResultRule{{
+				Text:         "ads.example.rpz.test. nxdomain",
+				FilterListID: filtering.RPZListID,
+			}},
+		},
+		name:     "rpz",
+		wantText: `blocked by response policy "ads.example.rpz.test. nxdomain"`,
+		edns:     true,
+		diverged: false,
+		wantCode: dns.ExtendedErrorCodeBlocked,
+		wantNone: false,
+	}, {
+		res: &filtering.Result{
+			Reason:      filtering.FilteredBlockedService,
+			ServiceName: "example",
+		},
+		name:     "blocked_service",
+		wantText: `blocked service "example"`,
+		edns:     true,
+		diverged: false,
+		wantCode: dns.ExtendedErrorCodeBlocked,
+		wantNone: false,
+	}, {
+		res:      &filtering.Result{Reason: filtering.FilteredParental},
+		name:     "parental",
+		wantText: "blocked by parental control",
+		edns:     true,
+		diverged: false,
+		wantCode: dns.ExtendedErrorCodeFiltered,
+		wantNone: false,
+	}, {
+		res:      &filtering.Result{},
+		name:     "diverged",
+		wantText: "answers of consensus upstreams diverge",
+		edns:     true,
+		diverged: true,
+		wantCode: dns.ExtendedErrorCodeOther,
+		wantNone: false,
+	}, {
+		res:      &filtering.Result{Reason: filtering.Rewritten},
+		name:     "rewritten",
+		wantText: "",
+		edns:     true,
+		diverged: false,
+		wantCode: 0,
+		wantNone: true,
+	}, {
+		res:      &filtering.Result{Reason: filtering.FilteredParental},
+		name:     "no_edns",
+		wantText: "",
+		edns:     false,
+		diverged: false,
+		wantCode: 0,
+		wantNone: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := (&dns.Msg{}).SetQuestion("ads.example.", dns.TypeA)
+			if tc.edns {
+				req.SetEdns0(dns.DefaultMsgSize, false)
+			}
+
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Req: req,
+					Res: (&dns.Msg{}).SetReply(req),
+				},
+				result:            tc.res,
+				consensusDiverged: tc.diverged,
+			}
+
+			rc := s.processExtendedErrors(dctx)
+			require.Equal(t, resultCodeSuccess, rc)
+
+			edes := extendedErrors(dctx.proxyCtx.Res)
+			if tc.wantNone {
+				assert.Empty(t, edes)
+
+				return
+			}
+
+			require.Len(t, edes, 1)
+
+			assert.Equal(t, tc.wantCode, edes[0].InfoCode)
+			assert.Equal(t, tc.wantText, edes[0].ExtraText)
+		})
+	}
+}
@@ -23,11 +23,29 @@ func (s *Server) beforeRequestHandler(
 	clientID, err := s.clientIDFromDNSContext(pctx)
 	if err != nil {
 		return false, fmt.Errorf("getting clientid: %w", err)
+	} else if clientID == "" {
+		clientID = s.certClientID(pctx)
 	}
 
-	blocked, _ := s.IsBlockedClient(ip, clientID)
-	if blocked {
-		return s.preBlockedResponse(pctx)
+	lr := s.listenerRule(pctx)
+	if blocked, _ := s.IsBlockedClient(ip, clientID); blocked && lr.checksAccess() {
+		return s.preBlockedResponse(
+			pctx,
+			s.conf.DisallowedResponse,
+			dns.ExtendedErrorCodeProhibited,
+			"client is blocked",
+		)
+	}
+
+	if s.isDisabledProto(pctx) {
+		log.Debug("protocol %s is disabled by schedule", pctx.Proto)
+
+		return s.preBlockedResponse(
+			pctx,
+			s.conf.DisallowedResponse,
+			dns.ExtendedErrorCodeProhibited,
+			fmt.Sprintf("protocol %s is disabled by schedule", pctx.Proto),
+		)
 	}
 
 	if len(pctx.Req.Question) == 1 {
@@ -35,10 +53,27 @@ func (s *Server) beforeRequestHandler(
 		if s.access.isBlockedHost(host) {
 			log.Debug("host %s is in access blocklist", host)
 
-			return s.preBlockedResponse(pctx)
+			return s.preBlockedResponse(
+				pctx,
+				s.conf.BlockedHostsResponse,
+				dns.ExtendedErrorCodeBlocked,
+				"host is blocked by access settings",
+			)
 		}
 	}
 
+	// Apply the ratelimit after the access settings, same as dnsproxy does.
+	if s.isRatelimited(pctx, lr.ratelimiterOr(s.ratelimiter), ip, clientID) {
+		log.Debug("dns: ratelimiting %s", ip)
+
+		return s.preBlockedResponse(
+			pctx,
+			s.conf.RatelimitResponse,
+			dns.ExtendedErrorCodeOther,
+			"ratelimit exceeded",
+		)
+	}
+
 	if clientID != "" {
 		key := [8]byte{}
 		binary.BigEndian.PutUint64(key[:], pctx.RequestID)
@@ -58,6 +93,10 @@ func (s *Server) getClientRequestFilteringSettings(ctx *dnsContext) *filtering.S
 		s.conf.FilterHandler(ip, ctx.clientID, &setts)
 	}
 
+	if tags := s.certTags(ctx.proxyCtx); len(tags) > 0 {
+		setts.ClientTags = mergeTags(setts.ClientTags, tags)
+	}
+
 	return &setts
 }
 
@@ -77,7 +116,8 @@ func (s *Server) filterDNSRequest(ctx *dnsContext) (*filtering.Result, error) {
 		d.Res = s.genDNSFilterMessage(d, &res)
 	case res.Reason.In(filtering.Rewritten, filtering.RewrittenRule) &&
 		res.CanonName != "" &&
-		len(res.IPList) == 0:
+		len(res.IPList) == 0 &&
+		len(res.Records) == 0:
 		// Resolve the new canonical name, not the original host name.  The
 		// original question is readded in processFilteringAfterResponse.
 		ctx.origQuestion = q
@@ -104,6 +144,13 @@ func (s *Server) filterDNSRequest(ctx *dnsContext) (*filtering.Result, error) {
 			}
 		}
 
+		for _, rr := range res.Records {
+			h := rr.Header()
+			*h = s.hdr(req, h.Rrtype)
+			h.Name = dns.Fqdn(name)
+			resp.Answer = append(resp.Answer, rr)
+		}
+
 		d.Res = resp
 	case res.Reason.In(filtering.RewrittenRule, filtering.RewrittenAutoHosts):
 		if err = s.filterDNSRewrite(req, res, d); err != nil {
@@ -0,0 +1,146 @@
+package dnsforward
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// connAttemptDelay is the time after which the next address is tried if the
+// connection to the previous one hasn't been established yet.  See RFC 8305,
+// Section 5.
+const connAttemptDelay = 250 * time.Millisecond
+
+// interleaveFamilies returns ips sorted so that the address families
+// alternate, starting with IPv6, and the relative order of the addresses of
+// the same family is kept.  See RFC 8305, Section 4.
+func interleaveFamilies(ips []net.IPAddr) (sorted []net.IPAddr) {
+	var v4, v6 []net.IPAddr
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	sorted = make([]net.IPAddr, 0, len(ips))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			sorted = append(sorted, v6[i])
+		}
+
+		if i < len(v4) {
+			sorted = append(sorted, v4[i])
+		}
+	}
+
+	return sorted
+}
+
+// dialResult is the result of a single connection attempt.
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialHappyEyeballs connects to port on one of ips racing the connection
+// attempts like the Happy Eyeballs algorithm does, so that an unreachable
+// address family only delays the connection by connAttemptDelay instead of
+// the whole dial timeout.  See RFC 8305.
+func dialHappyEyeballs(
+	ctx context.Context,
+	dial func(ctx context.Context, network, addr string) (conn net.Conn, err error),
+	network string,
+	ips []net.IPAddr,
+	port string,
+) (conn net.Conn, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	addrs := interleaveFamilies(ips)
+
+	// Buffer the results so that the attempts still in progress after the
+	// connection is established don't block.
+	results := make(chan dialResult, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		addr := net.JoinHostPort(addrs[next].String(), port)
+		next++
+		pending++
+
+		go func() {
+			c, dErr := dial(ctx, network, addr)
+			results <- dialResult{conn: c, err: dErr}
+		}()
+	}
+
+	start()
+
+	timer := time.NewTimer(connAttemptDelay)
+	defer timer.Stop()
+
+	var errs []error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go closeLate(results, pending)
+
+				return r.conn, nil
+			}
+
+			errs = append(errs, r.err)
+			if next < len(addrs) {
+				// Don't wait for the delay if the previous attempt has
+				// already failed.
+				start()
+				resetTimer(timer, connAttemptDelay)
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+				timer.Reset(connAttemptDelay)
+			}
+		}
+	}
+
+	return nil, errors.List("all connection attempts failed", errs...)
+}
+
+// closeLate receives n results from results and closes the connections, which
+// have been established after the winning one.
+func closeLate(results <-chan dialResult, n int) {
+	for ; n > 0; n-- {
+		if r := <-results; r.conn != nil {
+			_ = r.conn.Close()
+		}
+	}
+}
+
+// resetTimer stops t, drains its channel if necessary, and resets it to d.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+
+	t.Reset(d)
+}
+
+// isHostnameTLSUpstream returns true if addr is the address of a DNS-over-TLS
+// or a DNS-over-HTTPS upstream specified by a hostname.
+func isHostnameTLSUpstream(addr string) (ok bool) {
+	u, err := url.Parse(addr)
+	if err != nil || (u.Scheme != "tls" && u.Scheme != "https") {
+		return false
+	}
+
+	return u.Hostname() != "" && net.ParseIP(u.Hostname()) == nil
+}
@@ -0,0 +1,63 @@
+package dnsforward
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterleaveFamilies(t *testing.T) {
+	v4a, v4b := net.IPAddr{IP: net.IP{1, 1, 1, 1}}, net.IPAddr{IP: net.IP{2, 2, 2, 2}}
+	v6a, v6b := net.IPAddr{IP: net.ParseIP("2001:db8::1")}, net.IPAddr{IP: net.ParseIP("2001:db8::2")}
+
+	got := interleaveFamilies([]net.IPAddr{v4a, v4b, v6a, v6b})
+	assert.Equal(t, []net.IPAddr{v6a, v4a, v6b, v4b}, got)
+
+	got = interleaveFamilies([]net.IPAddr{v4a, v4b})
+	assert.Equal(t, []net.IPAddr{v4a, v4b}, got)
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			c, aErr := l.Accept()
+			if aErr != nil {
+				return
+			}
+
+			_ = c.Close()
+		}
+	}()
+
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+
+	// The IPv6 address is from the discard-only prefix, so the attempt to
+	// connect to it either fails or hangs, which mustn't delay the connection
+	// by the whole timeout.
+	ips := []net.IPAddr{{IP: net.ParseIP("100::1")}, {IP: net.IP{127, 0, 0, 1}}}
+	d := &net.Dialer{Timeout: 5 * time.Second}
+
+	start := time.Now()
+	conn, err := dialHappyEyeballs(context.Background(), d.DialContext, "tcp", ips, port)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	assert.Less(t, time.Since(start), 2*time.Second)
+	assert.Equal(t, l.Addr().String(), conn.RemoteAddr().String())
+
+	t.Run("all_fail", func(t *testing.T) {
+		require.NoError(t, l.Close())
+
+		_, err = dialHappyEyeballs(context.Background(), d.DialContext, "tcp", ips[1:], port)
+		assert.Error(t, err)
+	})
+}
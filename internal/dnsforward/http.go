@@ -3,6 +3,7 @@ package dnsforward
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"net"
 	"net/http"
 	"strconv"
@@ -24,6 +25,8 @@ type dnsConfig struct {
 	UpstreamsFile *string   `json:"upstream_dns_file"`
 	Bootstraps    *[]string `json:"bootstrap_dns"`
 
+	UpstreamGroups *[]*UpstreamGroupConfig `json:"upstream_groups"`
+
 	ProtectionEnabled *bool         `json:"protection_enabled"`
 	RateLimit         *uint32       `json:"ratelimit"`
 	BlockingMode      *BlockingMode `json:"blocking_mode"`
@@ -33,13 +36,53 @@ type dnsConfig struct {
 	DNSSECEnabled     *bool         `json:"dnssec_enabled"`
 	DisableIPv6       *bool         `json:"disable_ipv6"`
 	UpstreamMode      *string       `json:"upstream_mode"`
-	CacheSize         *uint32       `json:"cache_size"`
-	CacheMinTTL       *uint32       `json:"cache_ttl_min"`
-	CacheMaxTTL       *uint32       `json:"cache_ttl_max"`
-	CacheOptimistic   *bool         `json:"cache_optimistic"`
-	ResolveClients    *bool         `json:"resolve_clients"`
-	UsePrivateRDNS    *bool         `json:"use_private_ptr_resolvers"`
-	LocalPTRUpstreams *[]string     `json:"local_ptr_upstreams"`
+
+	// UpstreamWeights are the weights of the upstreams used in the weighted
+	// upstream mode.
+	UpstreamWeights  *map[string]uint `json:"upstream_weights"`
+	CacheSize        *uint32          `json:"cache_size"`
+	CacheMinTTL      *uint32          `json:"cache_ttl_min"`
+	CacheMaxTTL      *uint32          `json:"cache_ttl_max"`
+	CacheOptimistic  *bool            `json:"cache_optimistic"`
+	CacheServeStale  *bool            `json:"cache_serve_stale"`
+	CacheMaxStaleTTL *uint32          `json:"cache_max_stale_ttl"`
+	CachePersistent  *bool            `json:"cache_persistent"`
+
+	// CacheNegativeMinTTL and CacheNegativeMaxTTL override the TTLs of the
+	// negative responses.
+	CacheNegativeMinTTL *uint32   `json:"cache_negative_ttl_min"`
+	CacheNegativeMaxTTL *uint32   `json:"cache_negative_ttl_max"`
+	ResolveClients      *bool     `json:"resolve_clients"`
+	UsePrivateRDNS      *bool     `json:"use_private_ptr_resolvers"`
+	LocalPTRUpstreams   *[]string `json:"local_ptr_upstreams"`
+
+	// StripPrivateAnswers and PrivateAnswersAllowed are the settings of the
+	// DNS rebinding protection.
+	StripPrivateAnswers   *bool     `json:"strip_private_answers"`
+	PrivateAnswersAllowed *[]string `json:"private_answers_allowed"`
+
+	CNAMEInspection *bool `json:"cname_inspection"`
+
+	// BindHosts and Port are the IP addresses and the port the plain DNS
+	// server listens on.  Changing them requires ServerConfig.SetBindAddrs.
+	BindHosts []net.IP `json:"bind_hosts"`
+	Port      *int     `json:"port"`
+
+	// Provisional, if true, means that the change of BindHosts and Port must
+	// be reverted unless it's confirmed in time.
+	Provisional bool `json:"provisional,omitempty"`
+}
+
+// listenHostsPort returns the IP addresses and the port of addrs.  port is
+// zero if addrs are empty.
+func listenHostsPort(addrs []*net.UDPAddr) (hosts []net.IP, port int) {
+	hosts = make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		hosts = append(hosts, a.IP)
+		port = a.Port
+	}
+
+	return hosts, port
 }
 
 func (s *Server) getDNSConfig() dnsConfig {
@@ -48,6 +91,11 @@ func (s *Server) getDNSConfig() dnsConfig {
 
 	upstreams := stringutil.CloneSliceOrEmpty(s.conf.UpstreamDNS)
 	upstreamFile := s.conf.UpstreamDNSFileName
+	upstreamGroups := cloneUpstreamGroups(s.conf.UpstreamGroups)
+	if upstreamGroups == nil {
+		upstreamGroups = []*UpstreamGroupConfig{}
+	}
+
 	bootstraps := stringutil.CloneSliceOrEmpty(s.conf.BootstrapDNS)
 	protectionEnabled := s.conf.ProtectionEnabled
 	blockingMode := s.conf.BlockingMode
@@ -61,19 +109,36 @@ func (s *Server) getDNSConfig() dnsConfig {
 	cacheMinTTL := s.conf.CacheMinTTL
 	cacheMaxTTL := s.conf.CacheMaxTTL
 	cacheOptimistic := s.conf.CacheOptimistic
+	cacheServeStale := s.conf.CacheServeStale
+	cacheMaxStaleTTL := s.conf.CacheMaxStaleTTL
+	cachePersistent := s.conf.CachePersistent
+	cacheNegativeMinTTL := s.conf.CacheNegativeMinTTL
+	cacheNegativeMaxTTL := s.conf.CacheNegativeMaxTTL
 	resolveClients := s.conf.ResolveClients
 	usePrivateRDNS := s.conf.UsePrivateRDNS
 	localPTRUpstreams := stringutil.CloneSliceOrEmpty(s.conf.LocalPTRResolvers)
+	stripPrivateAnswers := s.conf.StripPrivateAnswers
+	privateAnswersAllowed := stringutil.CloneSliceOrEmpty(s.conf.PrivateAnswersAllowed)
+	cnameInspection := s.conf.CNAMEInspection
+	bindHosts, port := listenHostsPort(s.conf.UDPListenAddrs)
+	upstreamWeights := cloneUpstreamWeights(s.conf.UpstreamWeights)
+	if upstreamWeights == nil {
+		upstreamWeights = map[string]uint{}
+	}
+
 	var upstreamMode string
 	if s.conf.FastestAddr {
 		upstreamMode = "fastest_addr"
 	} else if s.conf.AllServers {
 		upstreamMode = "parallel"
+	} else {
+		upstreamMode = s.upstreamBalancerMode()
 	}
 
 	return dnsConfig{
 		Upstreams:         &upstreams,
 		UpstreamsFile:     &upstreamFile,
+		UpstreamGroups:    &upstreamGroups,
 		Bootstraps:        &bootstraps,
 		ProtectionEnabled: &protectionEnabled,
 		BlockingMode:      &blockingMode,
@@ -87,10 +152,25 @@ func (s *Server) getDNSConfig() dnsConfig {
 		CacheMinTTL:       &cacheMinTTL,
 		CacheMaxTTL:       &cacheMaxTTL,
 		CacheOptimistic:   &cacheOptimistic,
-		UpstreamMode:      &upstreamMode,
-		ResolveClients:    &resolveClients,
-		UsePrivateRDNS:    &usePrivateRDNS,
-		LocalPTRUpstreams: &localPTRUpstreams,
+		CacheServeStale:   &cacheServeStale,
+		CacheMaxStaleTTL:  &cacheMaxStaleTTL,
+		CachePersistent:   &cachePersistent,
+
+		CacheNegativeMinTTL: &cacheNegativeMinTTL,
+		CacheNegativeMaxTTL: &cacheNegativeMaxTTL,
+		UpstreamMode:        &upstreamMode,
+		UpstreamWeights:     &upstreamWeights,
+		ResolveClients:      &resolveClients,
+		UsePrivateRDNS:      &usePrivateRDNS,
+		LocalPTRUpstreams:   &localPTRUpstreams,
+
+		StripPrivateAnswers:   &stripPrivateAnswers,
+		PrivateAnswersAllowed: &privateAnswersAllowed,
+
+		CNAMEInspection: &cnameInspection,
+
+		BindHosts: bindHosts,
+		Port:      &port,
 	}
 }
 
@@ -147,6 +227,9 @@ func (req *dnsConfig) checkUpstreamsMode() bool {
 		"",
 		"fastest_addr",
 		"parallel",
+		UpstreamModeWeighted,
+		UpstreamModeAdaptive,
+		UpstreamModeSticky,
 	} {
 		if *req.UpstreamMode == valid {
 			return true
@@ -166,7 +249,7 @@ func (req *dnsConfig) checkBootstrap() (string, error) {
 			return boot, fmt.Errorf("invalid bootstrap server address: empty")
 		}
 
-		if _, err := upstream.NewResolver(boot, nil); err != nil {
+		if _, err := upstream.NewUpstreamResolver(boot, nil); err != nil {
 			return boot, fmt.Errorf("invalid bootstrap server address: %w", err)
 		}
 	}
@@ -190,6 +273,19 @@ func (req *dnsConfig) checkCacheTTL() bool {
 	return min <= max
 }
 
+// checkNegativeCacheTTL returns false if the minimum TTL of the negative
+// responses in req is greater than the maximum one.  Zero maximum means no
+// limit.
+func (req *dnsConfig) checkNegativeCacheTTL() (ok bool) {
+	if req.CacheNegativeMinTTL == nil || req.CacheNegativeMaxTTL == nil {
+		return true
+	}
+
+	max := *req.CacheNegativeMaxTTL
+
+	return max == 0 || *req.CacheNegativeMinTTL <= max
+}
+
 func (s *Server) handleSetConfig(w http.ResponseWriter, r *http.Request) {
 	req := dnsConfig{}
 	dec := json.NewDecoder(r.Body)
@@ -207,6 +303,23 @@ func (s *Server) handleSetConfig(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if req.UpstreamGroups != nil {
+		if err := validateUpstreamGroups(*req.UpstreamGroups); err != nil {
+			aghhttp.Error(r, w, http.StatusBadRequest, "wrong upstream groups: %s", err)
+
+			return
+		}
+	}
+
+	if req.UpstreamWeights != nil {
+		_, err := normalizeUpstreamWeights(*req.UpstreamWeights, &upstream.Options{Timeout: DefaultTimeout})
+		if err != nil {
+			aghhttp.Error(r, w, http.StatusBadRequest, "wrong upstream weights: %s", err)
+
+			return
+		}
+	}
+
 	if errBoot, err := req.checkBootstrap(); err != nil {
 		aghhttp.Error(
 			r,
@@ -243,6 +356,34 @@ func (s *Server) handleSetConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !req.checkNegativeCacheTTL() {
+		aghhttp.Error(
+			r,
+			w,
+			http.StatusBadRequest,
+			"cache_negative_ttl_min must be less or equal than cache_negative_ttl_max",
+		)
+
+		return
+	}
+
+	if req.PrivateAnswersAllowed != nil {
+		if err := validatePrivateAnswersZones(*req.PrivateAnswersAllowed); err != nil {
+			aghhttp.Error(r, w, http.StatusBadRequest, "private_answers_allowed: %s", err)
+
+			return
+		}
+	}
+
+	if req.BindHosts != nil || req.Port != nil {
+		err := s.setBindAddrs(req)
+		if err != nil {
+			aghhttp.Error(r, w, http.StatusBadRequest, "bind addresses: %s", err)
+
+			return
+		}
+	}
+
 	restart := s.setConfig(req)
 	s.conf.ConfigModified()
 
@@ -253,12 +394,56 @@ func (s *Server) handleSetConfig(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// setBindAddrs changes the addresses the plain DNS server listens on using
+// s.conf.SetBindAddrs.
+func (s *Server) setBindAddrs(req dnsConfig) (err error) {
+	if s.conf.SetBindAddrs == nil {
+		return errors.Error("changing is not supported")
+	}
+
+	var port int
+	if req.Port != nil {
+		port = *req.Port
+		if port <= 0 || port > math.MaxUint16 {
+			return fmt.Errorf("bad port %d", port)
+		}
+	}
+
+	if req.BindHosts != nil && len(req.BindHosts) == 0 {
+		return errors.Error("no bind hosts")
+	}
+
+	return s.conf.SetBindAddrs(req.BindHosts, port, req.Provisional)
+}
+
 func (s *Server) setConfigRestartable(dc dnsConfig) (restart bool) {
 	if dc.Upstreams != nil {
 		s.conf.UpstreamDNS = *dc.Upstreams
 		restart = true
 	}
 
+	if dc.UpstreamGroups != nil {
+		s.conf.UpstreamGroups = *dc.UpstreamGroups
+		restart = true
+	}
+
+	if dc.UpstreamMode != nil {
+		weighted := *dc.UpstreamMode == UpstreamModeWeighted
+		adaptive := *dc.UpstreamMode == UpstreamModeAdaptive
+		sticky := *dc.UpstreamMode == UpstreamModeSticky
+		restart = restart ||
+			s.conf.UpstreamWeighted != weighted ||
+			s.conf.UpstreamAdaptive != adaptive ||
+			s.conf.UpstreamSticky != sticky
+		s.conf.UpstreamWeighted, s.conf.UpstreamAdaptive = weighted, adaptive
+		s.conf.UpstreamSticky = sticky
+	}
+
+	if dc.UpstreamWeights != nil {
+		s.conf.UpstreamWeights = *dc.UpstreamWeights
+		restart = true
+	}
+
 	if dc.LocalPTRUpstreams != nil {
 		s.conf.LocalPTRResolvers = *dc.LocalPTRUpstreams
 		restart = true
@@ -304,6 +489,21 @@ func (s *Server) setConfigRestartable(dc dnsConfig) (restart bool) {
 		restart = true
 	}
 
+	if dc.CachePersistent != nil {
+		s.conf.CachePersistent = *dc.CachePersistent
+		restart = true
+	}
+
+	if dc.CacheNegativeMinTTL != nil {
+		s.conf.CacheNegativeMinTTL = *dc.CacheNegativeMinTTL
+		restart = true
+	}
+
+	if dc.CacheNegativeMaxTTL != nil {
+		s.conf.CacheNegativeMaxTTL = *dc.CacheNegativeMaxTTL
+		restart = true
+	}
+
 	return restart
 }
 
@@ -344,6 +544,26 @@ func (s *Server) setConfig(dc dnsConfig) (restart bool) {
 		s.conf.UsePrivateRDNS = *dc.UsePrivateRDNS
 	}
 
+	if dc.CacheServeStale != nil {
+		s.conf.CacheServeStale = *dc.CacheServeStale
+	}
+
+	if dc.CacheMaxStaleTTL != nil {
+		s.conf.CacheMaxStaleTTL = *dc.CacheMaxStaleTTL
+	}
+
+	if dc.StripPrivateAnswers != nil {
+		s.conf.StripPrivateAnswers = *dc.StripPrivateAnswers
+	}
+
+	if dc.PrivateAnswersAllowed != nil {
+		s.conf.PrivateAnswersAllowed = *dc.PrivateAnswersAllowed
+	}
+
+	if dc.CNAMEInspection != nil {
+		s.conf.CNAMEInspection = *dc.CNAMEInspection
+	}
+
 	return s.setConfigRestartable(dc)
 }
 
@@ -374,6 +594,11 @@ func ValidateUpstreams(upstreams []string) (err error) {
 		return nil
 	}
 
+	upstreams, err = ExpandForcedTransports(upstreams)
+	if err != nil {
+		return err
+	}
+
 	_, err = proxy.ParseUpstreamsConfig(
 		upstreams,
 		&upstream.Options{
@@ -456,7 +681,7 @@ func separateUpstream(upstreamStr string) (upstream string, useDefault bool, err
 			continue
 		}
 
-		err = netutil.ValidateDomainName(host)
+		err = netutil.ValidateHostname(host)
 		if err != nil {
 			return "", false, fmt.Errorf("domain at index %d: %w", i, err)
 		}
@@ -591,66 +816,6 @@ func checkDNS(input string, bootstrap []string, timeout time.Duration, ef excFun
 	return nil
 }
 
-func (s *Server) handleTestUpstreamDNS(w http.ResponseWriter, r *http.Request) {
-	req := &upstreamJSON{}
-	err := json.NewDecoder(r.Body).Decode(req)
-	if err != nil {
-		aghhttp.Error(r, w, http.StatusBadRequest, "Failed to read request body: %s", err)
-
-		return
-	}
-
-	result := map[string]string{}
-	bootstraps := req.BootstrapDNS
-
-	timeout := s.conf.UpstreamTimeout
-	for _, host := range req.Upstreams {
-		err = checkDNS(host, bootstraps, timeout, checkDNSUpstreamExc)
-		if err != nil {
-			log.Info("%v", err)
-			result[host] = err.Error()
-
-			continue
-		}
-
-		result[host] = "OK"
-	}
-
-	for _, host := range req.PrivateUpstreams {
-		err = checkDNS(host, bootstraps, timeout, checkPrivateUpstreamExc)
-		if err != nil {
-			log.Info("%v", err)
-			// TODO(e.burkov): If passed upstream have already
-			// written an error above, we rewriting the error for
-			// it.  These cases should be handled properly instead.
-			result[host] = err.Error()
-
-			continue
-		}
-
-		result[host] = "OK"
-	}
-
-	jsonVal, err := json.Marshal(result)
-	if err != nil {
-		aghhttp.Error(
-			r,
-			w,
-			http.StatusInternalServerError,
-			"Unable to marshal status json: %s",
-			err,
-		)
-
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	_, err = w.Write(jsonVal)
-	if err != nil {
-		aghhttp.Error(r, w, http.StatusInternalServerError, "Couldn't write body: %s", err)
-	}
-}
-
 // Control flow:
 // web
 //  -> dnsforward.handleDoH -> dnsforward.ServeHTTP
@@ -674,10 +839,24 @@ func (s *Server) registerHandlers() {
 	s.conf.HTTPRegister(http.MethodGet, "/control/dns_info", s.handleGetConfig)
 	s.conf.HTTPRegister(http.MethodPost, "/control/dns_config", s.handleSetConfig)
 	s.conf.HTTPRegister(http.MethodPost, "/control/test_upstream_dns", s.handleTestUpstreamDNS)
+	s.conf.HTTPRegister(http.MethodPost, "/control/test_upstream_dns/bulk", s.handleTestUpstreamDNSBulk)
+	s.conf.HTTPRegister(http.MethodGet, "/control/test_upstream_dns/report", s.handleUpstreamTestReport)
 
 	s.conf.HTTPRegister(http.MethodGet, "/control/access/list", s.handleAccessList)
 	s.conf.HTTPRegister(http.MethodPost, "/control/access/set", s.handleAccessSet)
 
+	s.conf.HTTPRegister(http.MethodGet, "/control/spoofing/stats", s.handleSpoofingStats)
+	s.conf.HTTPRegister(http.MethodGet, "/control/doh_bypass/stats", s.handleDoHBypassStats)
+	s.conf.HTTPRegister(http.MethodGet, "/control/udp/stats", s.handleUDPStats)
+	s.conf.HTTPRegister(http.MethodGet, "/control/ratelimit/status", s.handleRatelimitStatus)
+	s.conf.HTTPRegister(http.MethodGet, "/control/upstreams/health", s.handleUpstreamsHealth)
+	s.conf.HTTPRegister(http.MethodGet, "/control/upstreams/pool", s.handleUpstreamsPool)
+	s.conf.HTTPRegister(http.MethodGet, "/control/dnssec/failures", s.handleDNSSECFailures)
+
+	s.conf.HTTPRegister(http.MethodGet, "/control/local_zones/list", s.handleLocalZonesList)
+	s.conf.HTTPRegister(http.MethodPost, "/control/local_zones/set", s.handleLocalZonesSet)
+	s.conf.HTTPRegister(http.MethodPost, "/control/local_zones/delete", s.handleLocalZonesDelete)
+
 	// Register both versions, with and without the trailing slash, to
 	// prevent a 301 Moved Permanently redirect when clients request the
 	// path without the trailing slash.  Those redirects break some clients.
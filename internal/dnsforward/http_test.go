@@ -190,7 +190,7 @@ func TestDNSForwardHTTP_handleSetConfig(t *testing.T) {
 		name: "bootstraps_bad",
 		wantSet: `a can not be used as bootstrap dns cause: ` +
 			`invalid bootstrap server address: ` +
-			`Resolver a is not eligible to be a bootstrap DNS server`,
+			`bootstrap a:53: ParseAddr("a"): unable to parse IP`,
 	}, {
 		name:    "cache_bad_ttl",
 		wantSet: `cache_ttl_min must be less or equal than cache_ttl_max`,
@@ -203,6 +203,39 @@ func TestDNSForwardHTTP_handleSetConfig(t *testing.T) {
 	}, {
 		name:    "local_ptr_upstreams_null",
 		wantSet: "",
+	}, {
+		name:    "upstream_groups_good",
+		wantSet: "",
+	}, {
+		name:    "upstream_groups_bad",
+		wantSet: `wrong upstream groups: upstream group at index 0: group "corp": no domains`,
+	}, {
+		name:    "upstream_mode_weighted",
+		wantSet: "",
+	}, {
+		name:    "upstream_mode_adaptive",
+		wantSet: "",
+	}, {
+		name:    "upstream_weights_bad",
+		wantSet: `wrong upstream weights: weight of "!!!": address !!!: missing port in address`,
+	}, {
+		name:    "cache_negative_ttl",
+		wantSet: "",
+	}, {
+		name:    "cache_negative_ttl_bad",
+		wantSet: "cache_negative_ttl_min must be less or equal than cache_negative_ttl_max",
+	}, {
+		name:    "private_answers",
+		wantSet: "",
+	}, {
+		name: "private_answers_bad",
+		wantSet: `private_answers_allowed: zone at index 0: ` +
+			`bad hostname "bad domain": ` +
+			`bad top-level domain name label "bad domain": ` +
+			`bad top-level domain name label rune ' '`,
+	}, {
+		name:    "bind_addrs_unsupported",
+		wantSet: "bind addresses: changing is not supported",
 	}}
 
 	var data map[string]struct {
@@ -234,6 +267,68 @@ func TestDNSForwardHTTP_handleSetConfig(t *testing.T) {
 	}
 }
 
+func TestServer_setBindAddrs(t *testing.T) {
+	var gotHosts []net.IP
+	var gotPort int
+	var gotProvisional bool
+	s := &Server{
+		conf: ServerConfig{
+			SetBindAddrs: func(hosts []net.IP, port int, provisional bool) (err error) {
+				gotHosts, gotPort, gotProvisional = hosts, port, provisional
+
+				return nil
+			},
+		},
+	}
+
+	intPtr := func(v int) (p *int) { return &v }
+
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		wantHosts  []net.IP
+		req        dnsConfig
+		wantPort   int
+	}{{
+		name:       "hosts",
+		wantErrMsg: "",
+		wantHosts:  []net.IP{{127, 0, 0, 1}},
+		req:        dnsConfig{BindHosts: []net.IP{{127, 0, 0, 1}}, Provisional: true},
+		wantPort:   0,
+	}, {
+		name:       "port",
+		wantErrMsg: "",
+		wantHosts:  nil,
+		req:        dnsConfig{Port: intPtr(5353)},
+		wantPort:   5353,
+	}, {
+		name:       "bad_port",
+		wantErrMsg: "bad port 65536",
+		wantHosts:  nil,
+		req:        dnsConfig{Port: intPtr(65536)},
+		wantPort:   0,
+	}, {
+		name:       "no_hosts",
+		wantErrMsg: "no bind hosts",
+		wantHosts:  nil,
+		req:        dnsConfig{BindHosts: []net.IP{}},
+		wantPort:   0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gotHosts, gotPort, gotProvisional = nil, 0, false
+
+			err := s.setBindAddrs(tc.req)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.wantHosts, gotHosts)
+			assert.Equal(t, tc.wantPort, gotPort)
+			assert.Equal(t, tc.wantErrMsg == "" && tc.req.Provisional, gotProvisional)
+		})
+	}
+}
+
 func TestIsCommentOrEmpty(t *testing.T) {
 	assert.True(t, IsCommentOrEmpty(""))
 	assert.True(t, IsCommentOrEmpty("# comment"))
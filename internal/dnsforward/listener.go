@@ -0,0 +1,225 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+)
+
+// ListenerSettings are the settings overriding the global ones for the
+// requests received over a protocol on the particular listeners, for example
+// to limit the clients of a public DNS-over-TLS listener more strictly than
+// the ones of a LAN plain DNS listener.
+type ListenerSettings struct {
+	// Proto is the protocol.  It must be one of "udp" or "tcp" for plain DNS
+	// over UDP or TCP, "dns" for both, "doh", "dot", "doq", or "dnscrypt".
+	Proto string `yaml:"proto"`
+
+	// Listeners are the IP addresses or CIDRs of the listeners, to the
+	// requests of which the settings apply.  For plain DNS, the addresses are
+	// matched against the ones from bind_hosts.  If Listeners are empty, the
+	// settings apply on all the listeners.
+	Listeners []string `yaml:"listeners"`
+
+	// Ratelimit, if set, is the maximum number of requests per second from a
+	// client used instead of the global one, with the burst of the same
+	// size.  Zero disables the limit.  The plain DNS-over-TCP requests are
+	// never limited, so it can't be set for the "tcp" protocol.
+	Ratelimit *uint32 `yaml:"ratelimit"`
+
+	// EDNSClientSubnet, if set, enables or disables adding the EDNS Client
+	// Subnet option to the requests instead of the global setting.
+	EDNSClientSubnet *bool `yaml:"edns_client_subnet"`
+
+	// Cache, if false, makes the requests bypass the cache.  The cache can't
+	// be enabled on the listeners if it's disabled globally.
+	Cache *bool `yaml:"cache"`
+
+	// AccessLists, if false, disables the checks of the allowed and the
+	// disallowed clients.
+	AccessLists *bool `yaml:"access_lists"`
+}
+
+// listenerProtos maps the protocol names of ListenerSettings to the
+// protocols.
+var listenerProtos = map[string][]proxy.Proto{
+	"udp":      {proxy.ProtoUDP},
+	"tcp":      {proxy.ProtoTCP},
+	"dns":      {proxy.ProtoUDP, proxy.ProtoTCP},
+	"doh":      {proxy.ProtoHTTPS},
+	"dot":      {proxy.ProtoTLS},
+	"doq":      {proxy.ProtoQUIC},
+	"dnscrypt": {proxy.ProtoDNSCrypt},
+}
+
+// listenerRule is the parsed ListenerSettings.
+type listenerRule struct {
+	// protos are the protocols of the requests.
+	protos []proxy.Proto
+
+	// nets are the networks of the listeners.  If it's empty, the rule
+	// applies to all the listeners.
+	nets []*net.IPNet
+
+	// ratelimiter is used instead of the global one if hasRatelimit is
+	// true.  It's nil if the requests aren't limited.
+	ratelimiter *ratelimiter
+
+	// ecs, cache, and access are the overridden settings.  nil means the
+	// global setting.
+	ecs    *bool
+	cache  *bool
+	access *bool
+
+	// hasRatelimit is true if the ratelimit is overridden.
+	hasRatelimit bool
+}
+
+// newListenerRule parses the listener settings.  c is the global
+// configuration, which the ratelimit settings other than the rate itself are
+// taken from.
+func newListenerRule(ls *ListenerSettings, c *FilteringConfig) (r *listenerRule, err error) {
+	r = &listenerRule{
+		ecs:    ls.EDNSClientSubnet,
+		cache:  ls.Cache,
+		access: ls.AccessLists,
+	}
+
+	var ok bool
+	r.protos, ok = listenerProtos[strings.ToLower(ls.Proto)]
+	if !ok {
+		return nil, fmt.Errorf("bad proto %q", ls.Proto)
+	}
+
+	r.nets, err = parseListenerNets(ls.Listeners)
+	if err != nil {
+		return nil, err
+	}
+
+	if ls.Ratelimit != nil {
+		if len(r.protos) == 1 && r.protos[0] == proxy.ProtoTCP {
+			return nil, errors.Error("ratelimit: plain dns-over-tcp requests are never limited")
+		}
+
+		r.hasRatelimit = true
+		r.ratelimiter, err = newRatelimiter(&FilteringConfig{
+			Ratelimit:              *ls.Ratelimit,
+			RatelimitWhitelist:     c.RatelimitWhitelist,
+			RatelimitSubnetLenIPv4: c.RatelimitSubnetLenIPv4,
+			RatelimitSubnetLenIPv6: c.RatelimitSubnetLenIPv6,
+			RatelimitPerDomain:     c.RatelimitPerDomain,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// newListenerRules parses all listener settings of c.
+func newListenerRules(c *FilteringConfig) (rules []*listenerRule, err error) {
+	for i, ls := range c.ListenerSettings {
+		var r *listenerRule
+		r, err = newListenerRule(ls, c)
+		if err != nil {
+			return nil, fmt.Errorf("listener settings at index %d: %w", i, err)
+		}
+
+		rules = append(rules, r)
+	}
+
+	return rules, nil
+}
+
+// listenerRuleFor returns the first of rules applying to the requests
+// received over proto on the listener with localIP, or nil if there is none.
+func listenerRuleFor(rules []*listenerRule, proto proxy.Proto, localIP net.IP) (r *listenerRule) {
+	for _, r = range rules {
+		for _, p := range r.protos {
+			if p == proto && listenerMatches(r.nets, localIP) {
+				return r
+			}
+		}
+	}
+
+	return nil
+}
+
+// enablesECS returns true if any of rules enables the EDNS Client Subnet
+// option.
+func enablesECS(rules []*listenerRule) (ok bool) {
+	for _, r := range rules {
+		if r.ecs != nil && *r.ecs {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checksAccess returns true if the allowed and the disallowed clients are
+// checked for the requests.  r may be nil.
+func (r *listenerRule) checksAccess() (ok bool) {
+	return r == nil || r.access == nil || *r.access
+}
+
+// usesCache returns true if the requests may be answered from the cache.  r
+// may be nil.
+func (r *listenerRule) usesCache() (ok bool) {
+	return r == nil || r.cache == nil || *r.cache
+}
+
+// ratelimiterOr returns the ratelimiter for the requests, which is global if
+// r doesn't override it.  r may be nil.
+func (r *listenerRule) ratelimiterOr(global *ratelimiter) (rl *ratelimiter) {
+	if r == nil || !r.hasRatelimit {
+		return global
+	}
+
+	return r.ratelimiter
+}
+
+// ecsEnabled returns true if the EDNS Client Subnet option should be added to
+// the requests, which is global if r doesn't override it.  r may be nil.
+func (r *listenerRule) ecsEnabled(global bool) (ok bool) {
+	if r == nil || r.ecs == nil {
+		return global
+	}
+
+	return *r.ecs
+}
+
+// listenerRule returns the settings of the listener, which has received the
+// request in pctx, or nil if there are none.
+func (s *Server) listenerRule(pctx *proxy.DNSContext) (r *listenerRule) {
+	s.serverLock.RLock()
+	rules := s.listeners
+	s.serverLock.RUnlock()
+
+	if len(rules) == 0 {
+		return nil
+	}
+
+	return listenerRuleFor(rules, pctx.Proto, localIPFromDNSContext(pctx))
+}
+
+// hideClientAddr removes the address of the client from pctx, so that dnsproxy
+// doesn't add the EDNS Client Subnet option with it, and returns the removed
+// address.  The addresses of the special-purpose networks are never sent, and
+// only those may use the private PTR upstreams, so they are kept.  addr is nil
+// if nothing has been removed.
+func hideClientAddr(pctx *proxy.DNSContext) (addr net.Addr) {
+	ip, _ := netutil.IPAndPortFromAddr(pctx.Addr)
+	if ip == nil || netutil.IsSpecialPurpose(ip) {
+		return nil
+	}
+
+	addr, pctx.Addr = pctx.Addr, nil
+
+	return addr
+}
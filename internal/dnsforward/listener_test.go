@@ -0,0 +1,142 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewListenerRules(t *testing.T) {
+	strict := uint32(5)
+	off := false
+
+	c := &FilteringConfig{
+		Ratelimit: 20,
+		ListenerSettings: []*ListenerSettings{{
+			Proto:     "dot",
+			Listeners: []string{"203.0.113.1"},
+			Ratelimit: &strict,
+		}, {
+			Proto:       "udp",
+			Listeners:   []string{"192.168.1.0/24"},
+			Cache:       &off,
+			AccessLists: &off,
+		}, {
+			Proto:            "dns",
+			EDNSClientSubnet: &off,
+		}},
+	}
+
+	rules, err := newListenerRules(c)
+	require.NoError(t, err)
+	require.Len(t, rules, 3)
+
+	assert.False(t, enablesECS(rules))
+
+	global := &ratelimiter{}
+	testCases := []struct {
+		ip        net.IP
+		want      *listenerRule
+		name      string
+		proto     proxy.Proto
+		wantCache bool
+	}{{
+		ip:        net.IP{203, 0, 113, 1},
+		want:      rules[0],
+		name:      "dot_public",
+		proto:     proxy.ProtoTLS,
+		wantCache: true,
+	}, {
+		ip:        net.IP{192, 168, 1, 1},
+		want:      nil,
+		name:      "dot_lan",
+		proto:     proxy.ProtoTLS,
+		wantCache: true,
+	}, {
+		ip:        net.IP{192, 168, 1, 1},
+		want:      rules[1],
+		name:      "udp_lan",
+		proto:     proxy.ProtoUDP,
+		wantCache: false,
+	}, {
+		ip:        net.IP{192, 168, 1, 1},
+		want:      rules[2],
+		name:      "tcp_lan",
+		proto:     proxy.ProtoTCP,
+		wantCache: true,
+	}, {
+		ip:        nil,
+		want:      rules[2],
+		name:      "udp_unknown",
+		proto:     proxy.ProtoUDP,
+		wantCache: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := listenerRuleFor(rules, tc.proto, tc.ip)
+			assert.Same(t, tc.want, r)
+			assert.Equal(t, tc.wantCache, r.usesCache())
+		})
+	}
+
+	assert.Same(t, global, rules[1].ratelimiterOr(global))
+	assert.NotSame(t, global, rules[0].ratelimiterOr(global))
+	assert.False(t, rules[1].checksAccess())
+	assert.True(t, rules[0].checksAccess())
+	assert.False(t, rules[2].ecsEnabled(true))
+	assert.True(t, rules[0].ecsEnabled(true))
+
+	_, err = newListenerRules(&FilteringConfig{
+		ListenerSettings: []*ListenerSettings{{Proto: "smtp"}},
+	})
+	testutil.AssertErrorMsg(t, `listener settings at index 0: bad proto "smtp"`, err)
+
+	_, err = newListenerRules(&FilteringConfig{
+		ListenerSettings: []*ListenerSettings{{Proto: "tcp", Ratelimit: &strict}},
+	})
+	testutil.AssertErrorMsg(
+		t,
+		"listener settings at index 0: ratelimit: plain dns-over-tcp requests are never limited",
+		err,
+	)
+}
+
+func TestHideClientAddr(t *testing.T) {
+	testCases := []struct {
+		addr     net.Addr
+		name     string
+		wantHide bool
+	}{{
+		addr:     &net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 53},
+		name:     "public",
+		wantHide: true,
+	}, {
+		addr:     &net.UDPAddr{IP: net.IP{192, 168, 1, 1}, Port: 53},
+		name:     "private",
+		wantHide: false,
+	}, {
+		addr:     nil,
+		name:     "unknown",
+		wantHide: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pctx := &proxy.DNSContext{Addr: tc.addr}
+
+			addr := hideClientAddr(pctx)
+			if tc.wantHide {
+				assert.Equal(t, tc.addr, addr)
+				assert.Nil(t, pctx.Addr)
+			} else {
+				assert.Nil(t, addr)
+				assert.Equal(t, tc.addr, pctx.Addr)
+			}
+		})
+	}
+}
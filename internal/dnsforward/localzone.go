@@ -0,0 +1,487 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/stringutil"
+	"github.com/miekg/dns"
+)
+
+// LocalZone is the configuration of a zone served authoritatively by the
+// server itself.
+type LocalZone struct {
+	// Name is the name of the zone, for example "home.arpa".
+	Name string `yaml:"name" json:"name"`
+
+	// Records are the resource records of the zone in the master file
+	// format, for example "nas 3600 IN A 192.168.1.2".  The owner names are
+	// relative to the zone unless they end with a dot, and "@" is the apex
+	// of the zone.  A default SOA record is used if there is none.
+	Records []string `yaml:"records" json:"records"`
+}
+
+// cloneLocalZones returns a deep copy of zones.
+func cloneLocalZones(zones []*LocalZone) (clone []*LocalZone) {
+	if zones == nil {
+		return nil
+	}
+
+	clone = make([]*LocalZone, len(zones))
+	for i, z := range zones {
+		clone[i] = &LocalZone{
+			Name:    z.Name,
+			Records: stringutil.CloneSlice(z.Records),
+		}
+	}
+
+	return clone
+}
+
+// localZoneTypes are the types of the records allowed in the local zones.
+var localZoneTypes = map[uint16]struct{}{
+	dns.TypeSOA:   {},
+	dns.TypeNS:    {},
+	dns.TypeA:     {},
+	dns.TypeAAAA:  {},
+	dns.TypeCNAME: {},
+	dns.TypeSRV:   {},
+	dns.TypeTXT:   {},
+	dns.TypeMX:    {},
+	dns.TypePTR:   {},
+}
+
+// localZoneMaxCNAMEs is the maximum length of a CNAME chain followed within a
+// local zone.
+const localZoneMaxCNAMEs = 8
+
+// localZone is a compiled local zone.
+type localZone struct {
+	// soa is the SOA record of the zone.
+	soa *dns.SOA
+
+	// records are the records of the zone by their lowercased owner names.
+	records map[string][]dns.RR
+
+	// names are all the existing names of the zone including the empty
+	// non-terminals.
+	names *stringutil.Set
+
+	// name is the lowercased FQDN of the zone.
+	name string
+}
+
+// newLocalZone compiles and validates c.
+func newLocalZone(c *LocalZone) (z *localZone, err error) {
+	name := dns.CanonicalName(c.Name)
+	if _, ok := dns.IsDomainName(name); !ok || name == "." {
+		return nil, fmt.Errorf("bad zone name %q", c.Name)
+	}
+
+	z = &localZone{
+		records: map[string][]dns.RR{},
+		names:   stringutil.NewSet(name),
+		name:    name,
+	}
+
+	zp := dns.NewZoneParser(strings.NewReader(strings.Join(c.Records, "\n")), name, "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		err = z.add(rr)
+		if err != nil {
+			return nil, fmt.Errorf("zone %q: %w", c.Name, err)
+		}
+	}
+
+	if err = zp.Err(); err != nil {
+		return nil, fmt.Errorf("zone %q: parsing records: %w", c.Name, err)
+	}
+
+	if z.soa == nil {
+		z.soa = &dns.SOA{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeSOA,
+				Class:  dns.ClassINET,
+				Ttl:    3600,
+			},
+			Ns:      "localhost.",
+			Mbox:    "hostmaster." + name,
+			Serial:  1,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			Minttl:  60,
+		}
+		z.records[name] = append(z.records[name], z.soa)
+	}
+
+	return z, nil
+}
+
+// add validates rr and adds it to z.
+func (z *localZone) add(rr dns.RR) (err error) {
+	h := rr.Header()
+	owner := dns.CanonicalName(h.Name)
+	if _, ok := localZoneTypes[h.Rrtype]; !ok {
+		return fmt.Errorf("record %q: type %s not supported", rr, dns.TypeToString[h.Rrtype])
+	} else if !dns.IsSubDomain(z.name, owner) {
+		return fmt.Errorf("record %q: owner outside of the zone", rr)
+	}
+
+	existing := z.records[owner]
+	switch h.Rrtype {
+	case dns.TypeSOA:
+		if owner != z.name {
+			return fmt.Errorf("record %q: soa must be at the apex", rr)
+		} else if z.soa != nil {
+			return fmt.Errorf("record %q: more than one soa", rr)
+		}
+
+		z.soa = rr.(*dns.SOA)
+	case dns.TypeCNAME:
+		if owner == z.name {
+			return fmt.Errorf("record %q: cname can't be at the apex", rr)
+		} else if len(existing) > 0 {
+			return fmt.Errorf("record %q: cname and other data", rr)
+		}
+	default:
+		if len(existing) > 0 && existing[0].Header().Rrtype == dns.TypeCNAME {
+			return fmt.Errorf("record %q: cname and other data", rr)
+		}
+	}
+
+	h.Name = owner
+	z.records[owner] = append(existing, rr)
+
+	// Add the name and the empty non-terminals above it.
+	for n := owner; n != z.name; n = n[strings.Index(n, ".")+1:] {
+		z.names.Add(n)
+	}
+
+	return nil
+}
+
+// lookup returns the records of name, synthesizing them from the wildcard
+// records if necessary.  ok is false if name doesn't exist in z.
+func (z *localZone) lookup(name string) (rrs []dns.RR, ok bool) {
+	if z.names.Has(name) {
+		return z.records[name], true
+	}
+
+	// Find the closest encloser and try its wildcard.  See RFC 4592.
+	encloser := name
+	for encloser != z.name && !z.names.Has(encloser) {
+		encloser = encloser[strings.Index(encloser, ".")+1:]
+	}
+
+	wild, ok := z.records["*."+encloser]
+	if !ok {
+		return nil, false
+	}
+
+	rrs = make([]dns.RR, 0, len(wild))
+	for _, rr := range wild {
+		rr = dns.Copy(rr)
+		rr.Header().Name = name
+		rrs = append(rrs, rr)
+	}
+
+	return rrs, true
+}
+
+// rrsOfType returns the records of type qtype from rrs.  All records are
+// returned for the requests of type ANY.
+func rrsOfType(rrs []dns.RR, qtype uint16) (filtered []dns.RR) {
+	for _, rr := range rrs {
+		if qtype == dns.TypeANY || rr.Header().Rrtype == qtype {
+			filtered = append(filtered, dns.Copy(rr))
+		}
+	}
+
+	return filtered
+}
+
+// respond fills resp with the authoritative answer to the question q within
+// z.
+func (z *localZone) respond(resp *dns.Msg, q dns.Question) {
+	resp.Authoritative = true
+
+	name := dns.CanonicalName(q.Name)
+	for i := 0; i <= localZoneMaxCNAMEs; i++ {
+		rrs, ok := z.lookup(name)
+		if !ok {
+			resp.Rcode = dns.RcodeNameError
+			resp.Ns = []dns.RR{dns.Copy(z.soa)}
+
+			return
+		}
+
+		if ans := rrsOfType(rrs, q.Qtype); len(ans) > 0 {
+			resp.Answer = append(resp.Answer, ans...)
+			z.addAdditional(resp, ans)
+
+			return
+		}
+
+		if len(rrs) == 0 || rrs[0].Header().Rrtype != dns.TypeCNAME {
+			// There is no data of the type for the name.
+			resp.Ns = []dns.RR{dns.Copy(z.soa)}
+
+			return
+		}
+
+		cname := dns.Copy(rrs[0]).(*dns.CNAME)
+		resp.Answer = append(resp.Answer, cname)
+
+		name = dns.CanonicalName(cname.Target)
+		if !dns.IsSubDomain(z.name, name) {
+			// Let the client resolve the target outside of the zone.
+			return
+		}
+	}
+}
+
+// addAdditional adds the addresses of the targets of the NS, MX, and SRV
+// records within z from ans to the additional section of resp.
+func (z *localZone) addAdditional(resp *dns.Msg, ans []dns.RR) {
+	for _, rr := range ans {
+		var target string
+		switch rr := rr.(type) {
+		case *dns.NS:
+			target = rr.Ns
+		case *dns.MX:
+			target = rr.Mx
+		case *dns.SRV:
+			target = rr.Target
+		default:
+			continue
+		}
+
+		target = dns.CanonicalName(target)
+		if !dns.IsSubDomain(z.name, target) {
+			continue
+		}
+
+		rrs, _ := z.lookup(target)
+		resp.Extra = append(resp.Extra, rrsOfType(rrs, dns.TypeA)...)
+		resp.Extra = append(resp.Extra, rrsOfType(rrs, dns.TypeAAAA)...)
+	}
+}
+
+// localZones is a set of compiled local zones.
+type localZones struct {
+	// zones are sorted by the number of labels in the descending order, so
+	// that the most specific zone is found first.
+	zones []*localZone
+}
+
+// newLocalZones compiles and validates confs.
+func newLocalZones(confs []*LocalZone) (lz *localZones, err error) {
+	lz = &localZones{}
+	seen := stringutil.NewSet()
+	for i, c := range confs {
+		var z *localZone
+		z, err = newLocalZone(c)
+		if err != nil {
+			return nil, fmt.Errorf("local zone at index %d: %w", i, err)
+		} else if seen.Has(z.name) {
+			return nil, fmt.Errorf("local zone at index %d: duplicate zone %q", i, c.Name)
+		}
+
+		seen.Add(z.name)
+		lz.zones = append(lz.zones, z)
+	}
+
+	sort.SliceStable(lz.zones, func(i, j int) bool {
+		return dns.CountLabel(lz.zones[i].name) > dns.CountLabel(lz.zones[j].name)
+	})
+
+	return lz, nil
+}
+
+// find returns the most specific zone containing name.  z is nil if there is
+// none.
+func (lz *localZones) find(name string) (z *localZone) {
+	if lz == nil {
+		return nil
+	}
+
+	name = dns.CanonicalName(name)
+	for _, z = range lz.zones {
+		if dns.IsSubDomain(z.name, name) {
+			return z
+		}
+	}
+
+	return nil
+}
+
+// exact returns the zone with name.  z is nil if there is none.
+func (lz *localZones) exact(name string) (z *localZone) {
+	if lz == nil {
+		return nil
+	}
+
+	name = dns.CanonicalName(name)
+	for _, z = range lz.zones {
+		if z.name == name {
+			return z
+		}
+	}
+
+	return nil
+}
+
+// processLocalZones responds to the requests for the names within the local
+// zones authoritatively.
+func (s *Server) processLocalZones(dctx *dnsContext) (rc resultCode) {
+	pctx := dctx.proxyCtx
+	q := pctx.Req.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return resultCodeSuccess
+	}
+
+	var z *localZone
+	if dctx.view != nil {
+		z = dctx.view.zones.find(q.Name)
+	}
+
+	if z == nil {
+		s.serverLock.RLock()
+		z = s.localZones.find(q.Name)
+		s.serverLock.RUnlock()
+	}
+	if z == nil {
+		return resultCodeSuccess
+	}
+
+	log.Debug("dns: local zone %q: responding to %s %q", z.name, dns.TypeToString[q.Qtype], q.Name)
+
+	resp := s.makeResponse(pctx.Req)
+	z.respond(resp, q)
+	pctx.Res = resp
+
+	return resultCodeSuccess
+}
+
+// localZonesJSON is the object for the GET /control/local_zones/list HTTP API.
+type localZonesJSON struct {
+	Zones []*LocalZone `json:"zones"`
+}
+
+// handleLocalZonesList is the handler for the GET /control/local_zones/list
+// HTTP API.
+func (s *Server) handleLocalZonesList(w http.ResponseWriter, r *http.Request) {
+	s.serverLock.RLock()
+	zones := cloneLocalZones(s.conf.LocalZones)
+	s.serverLock.RUnlock()
+
+	if zones == nil {
+		zones = []*LocalZone{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(&localZonesJSON{Zones: zones})
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "encoding response: %s", err)
+	}
+}
+
+// setLocalZones validates and applies confs.
+func (s *Server) setLocalZones(confs []*LocalZone) (err error) {
+	lz, err := newLocalZones(confs)
+	if err != nil {
+		return err
+	}
+
+	s.serverLock.Lock()
+	s.conf.LocalZones = confs
+	s.localZones = lz
+	s.serverLock.Unlock()
+
+	s.conf.ConfigModified()
+
+	return nil
+}
+
+// handleLocalZonesSet is the handler for the POST /control/local_zones/set
+// HTTP API.  It adds the zone or replaces the one with the same name.
+func (s *Server) handleLocalZonesSet(w http.ResponseWriter, r *http.Request) {
+	zone := &LocalZone{}
+	err := json.NewDecoder(r.Body).Decode(zone)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "decoding request: %s", err)
+
+		return
+	}
+
+	name := dns.CanonicalName(zone.Name)
+
+	s.serverLock.RLock()
+	zones := cloneLocalZones(s.conf.LocalZones)
+	s.serverLock.RUnlock()
+
+	replaced := false
+	for i, z := range zones {
+		if dns.CanonicalName(z.Name) == name {
+			zones[i], replaced = zone, true
+
+			break
+		}
+	}
+
+	if !replaced {
+		zones = append(zones, zone)
+	}
+
+	err = s.setLocalZones(zones)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+	}
+}
+
+// localZoneNameJSON is the request to the POST /control/local_zones/delete
+// HTTP API.
+type localZoneNameJSON struct {
+	Name string `json:"name"`
+}
+
+// errNoLocalZone is returned when the requested local zone doesn't exist.
+const errNoLocalZone errors.Error = "no such zone"
+
+// handleLocalZonesDelete is the handler for the POST /control/local_zones/delete
+// HTTP API.
+func (s *Server) handleLocalZonesDelete(w http.ResponseWriter, r *http.Request) {
+	req := &localZoneNameJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "decoding request: %s", err)
+
+		return
+	}
+
+	name := dns.CanonicalName(req.Name)
+
+	s.serverLock.RLock()
+	zones := cloneLocalZones(s.conf.LocalZones)
+	s.serverLock.RUnlock()
+
+	for i, z := range zones {
+		if dns.CanonicalName(z.Name) == name {
+			err = s.setLocalZones(append(zones[:i], zones[i+1:]...))
+			if err != nil {
+				aghhttp.Error(r, w, http.StatusInternalServerError, "%s", err)
+			}
+
+			return
+		}
+	}
+
+	aghhttp.Error(r, w, http.StatusBadRequest, "%q: %s", req.Name, errNoLocalZone)
+}
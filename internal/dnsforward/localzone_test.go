@@ -0,0 +1,260 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalZones_respond(t *testing.T) {
+	lz, err := newLocalZones([]*LocalZone{{
+		Name: "home.arpa",
+		Records: []string{
+			"@ 3600 IN NS ns",
+			"ns 3600 IN A 192.168.1.1",
+			"nas 300 IN A 192.168.1.2",
+			"nas 300 IN AAAA fd00::2",
+			"www 300 IN CNAME nas",
+			"ext 300 IN CNAME example.org.",
+			"_smb._tcp 300 IN SRV 0 0 445 nas",
+			"@ 300 IN TXT \"v=spf1 -all\"",
+			"*.dyn 300 IN A 192.168.1.100",
+		},
+	}, {
+		Name:    "lab.home.arpa",
+		Records: []string{"srv 300 IN A 10.0.0.1"},
+	}})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name      string
+		host      string
+		wantAns   []string
+		wantExtra []string
+		wantRcode int
+		qtype     uint16
+		wantSOA   bool
+	}{{
+		name:      "a",
+		host:      "NAS.home.arpa.",
+		wantAns:   []string{"192.168.1.2"},
+		wantExtra: nil,
+		wantRcode: dns.RcodeSuccess,
+		qtype:     dns.TypeA,
+		wantSOA:   false,
+	}, {
+		name:      "cname",
+		host:      "www.home.arpa.",
+		wantAns:   []string{"nas.home.arpa.", "fd00::2"},
+		wantExtra: nil,
+		wantRcode: dns.RcodeSuccess,
+		qtype:     dns.TypeAAAA,
+		wantSOA:   false,
+	}, {
+		name:      "external_cname",
+		host:      "ext.home.arpa.",
+		wantAns:   []string{"example.org."},
+		wantExtra: nil,
+		wantRcode: dns.RcodeSuccess,
+		qtype:     dns.TypeA,
+		wantSOA:   false,
+	}, {
+		name:      "srv",
+		host:      "_smb._tcp.home.arpa.",
+		wantAns:   []string{"nas.home.arpa."},
+		wantExtra: []string{"192.168.1.2", "fd00::2"},
+		wantRcode: dns.RcodeSuccess,
+		qtype:     dns.TypeSRV,
+		wantSOA:   false,
+	}, {
+		name:      "txt",
+		host:      "home.arpa.",
+		wantAns:   []string{"v=spf1 -all"},
+		wantExtra: nil,
+		wantRcode: dns.RcodeSuccess,
+		qtype:     dns.TypeTXT,
+		wantSOA:   false,
+	}, {
+		name:      "wildcard",
+		host:      "a.b.dyn.home.arpa.",
+		wantAns:   []string{"192.168.1.100"},
+		wantExtra: nil,
+		wantRcode: dns.RcodeSuccess,
+		qtype:     dns.TypeA,
+		wantSOA:   false,
+	}, {
+		name:      "nodata",
+		host:      "nas.home.arpa.",
+		wantAns:   nil,
+		wantExtra: nil,
+		wantRcode: dns.RcodeSuccess,
+		qtype:     dns.TypeTXT,
+		wantSOA:   true,
+	}, {
+		name:      "empty_non_terminal",
+		host:      "_tcp.home.arpa.",
+		wantAns:   nil,
+		wantExtra: nil,
+		wantRcode: dns.RcodeSuccess,
+		qtype:     dns.TypeA,
+		wantSOA:   true,
+	}, {
+		name:      "nxdomain",
+		host:      "none.home.arpa.",
+		wantAns:   nil,
+		wantExtra: nil,
+		wantRcode: dns.RcodeNameError,
+		qtype:     dns.TypeA,
+		wantSOA:   true,
+	}, {
+		name:      "subzone",
+		host:      "srv.lab.home.arpa.",
+		wantAns:   []string{"10.0.0.1"},
+		wantExtra: nil,
+		wantRcode: dns.RcodeSuccess,
+		qtype:     dns.TypeA,
+		wantSOA:   false,
+	}}
+
+	// data returns the data of the records as strings.
+	data := func(rrs []dns.RR) (d []string) {
+		for _, rr := range rrs {
+			switch rr := rr.(type) {
+			case *dns.A:
+				d = append(d, rr.A.String())
+			case *dns.AAAA:
+				d = append(d, rr.AAAA.String())
+			case *dns.CNAME:
+				d = append(d, rr.Target)
+			case *dns.SRV:
+				d = append(d, rr.Target)
+			case *dns.TXT:
+				d = append(d, strings.Join(rr.Txt, ""))
+			}
+		}
+
+		return d
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := (&dns.Msg{}).SetQuestion(tc.host, tc.qtype)
+			z := lz.find(tc.host)
+			require.NotNil(t, z)
+
+			resp := (&dns.Msg{}).SetReply(req)
+			z.respond(resp, req.Question[0])
+
+			assert.True(t, resp.Authoritative)
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+			assert.Equal(t, tc.wantAns, data(resp.Answer))
+			assert.Equal(t, tc.wantExtra, data(resp.Extra))
+
+			if tc.wantSOA {
+				require.Len(t, resp.Ns, 1)
+				assert.IsType(t, (*dns.SOA)(nil), resp.Ns[0])
+			} else {
+				assert.Empty(t, resp.Ns)
+			}
+		})
+	}
+
+	assert.Nil(t, lz.find("example.org."))
+}
+
+func TestNewLocalZones_errors(t *testing.T) {
+	testCases := []struct {
+		name    string
+		wantErr string
+		zones   []*LocalZone
+	}{{
+		name:    "bad_type",
+		wantErr: "type HINFO not supported",
+		zones:   []*LocalZone{{Name: "lan", Records: []string{"a IN HINFO cpu os"}}},
+	}, {
+		name:    "cname_and_other",
+		wantErr: "cname and other data",
+		zones: []*LocalZone{{Name: "lan", Records: []string{
+			"a IN A 192.168.1.1",
+			"a IN CNAME b",
+		}}},
+	}, {
+		name:    "outside",
+		wantErr: "owner outside of the zone",
+		zones:   []*LocalZone{{Name: "lan", Records: []string{"a.example. IN A 192.168.1.1"}}},
+	}, {
+		name:    "duplicate",
+		wantErr: "duplicate zone",
+		zones:   []*LocalZone{{Name: "lan"}, {Name: "LAN."}},
+	}, {
+		name:    "syntax",
+		wantErr: "parsing records",
+		zones:   []*LocalZone{{Name: "lan", Records: []string{"a IN A bad"}}},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newLocalZones(tc.zones)
+			require.Error(t, err)
+
+			assert.Contains(t, err.Error(), tc.wantErr)
+		})
+	}
+}
+
+func TestServer_handleLocalZones(t *testing.T) {
+	modified := 0
+	s := &Server{}
+	s.conf.ConfigModified = func() { modified++ }
+
+	set := func(t *testing.T, body string) (code int) {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/control/local_zones/set", strings.NewReader(body))
+		s.handleLocalZonesSet(w, r)
+
+		return w.Code
+	}
+
+	list := func(t *testing.T) (zones []*LocalZone) {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		s.handleLocalZonesList(w, httptest.NewRequest(http.MethodGet, "/control/local_zones/list", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		resp := &localZonesJSON{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(resp))
+
+		return resp.Zones
+	}
+
+	assert.Empty(t, list(t))
+
+	require.Equal(t, http.StatusOK, set(t, `{"name":"lan","records":["nas IN A 192.168.1.2"]}`))
+	require.Equal(t, http.StatusOK, set(t, `{"name":"LAN","records":["nas IN A 192.168.1.3"]}`))
+	assert.Equal(t, 2, modified)
+
+	zones := list(t)
+	require.Len(t, zones, 1)
+	assert.Equal(t, []string{"nas IN A 192.168.1.3"}, zones[0].Records)
+	assert.NotNil(t, s.localZones.find("nas.lan."))
+
+	assert.Equal(t, http.StatusBadRequest, set(t, `{"name":"lan","records":["nas IN A bad"]}`))
+	assert.Equal(t, 2, modified)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/control/local_zones/delete", strings.NewReader(`{"name":"lan."}`))
+	s.handleLocalZonesDelete(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.Empty(t, list(t))
+	assert.Nil(t, s.localZones.find("nas.lan."))
+}
@@ -274,16 +274,48 @@ func (s *Server) genBlockedHost(request *dns.Msg, newAddr string, d *proxy.DNSCo
 	return resp
 }
 
-// preBlockedResponse returns a protocol-appropriate response for a request that
-// was blocked by access settings.
-func (s *Server) preBlockedResponse(pctx *proxy.DNSContext) (reply bool, err error) {
-	if pctx.Proto == proxy.ProtoUDP || pctx.Proto == proxy.ProtoDNSCrypt {
-		// Return nil so that dnsproxy drops the connection and thus
-		// prevent DNS amplification attacks.
+// preBlockedResponse returns a response for a request that was blocked by
+// access settings or the ratelimit according to mode.  code and text are the
+// Extended DNS Error explaining the reason.  reply is false if the request must
+// be dropped.
+func (s *Server) preBlockedResponse(
+	pctx *proxy.DNSContext,
+	mode ErrorResponseMode,
+	code uint16,
+	text string,
+) (reply bool, err error) {
+	switch mode {
+	case ErrorResponseModeDrop:
 		return false, nil
+	case ErrorResponseModeNXDOMAIN:
+		pctx.Res = s.genNXDomain(pctx.Req)
+	case ErrorResponseModeREFUSED:
+		pctx.Res = s.makeResponseREFUSED(pctx.Req)
+	case ErrorResponseModeTruncate:
+		if pctx.Proto != proxy.ProtoUDP {
+			pctx.Res = s.makeResponseREFUSED(pctx.Req)
+
+			break
+		}
+
+		// Don't add anything to the truncated response to keep it as
+		// small as the request.
+		pctx.Res = s.makeResponse(pctx.Req)
+		pctx.Res.Truncated = true
+
+		return true, nil
+	default:
+		if pctx.Proto == proxy.ProtoUDP || pctx.Proto == proxy.ProtoDNSCrypt {
+			// Return nil so that dnsproxy drops the connection and
+			// thus prevent DNS amplification attacks.
+			return false, nil
+		}
+
+		pctx.Res = s.makeResponseREFUSED(pctx.Req)
 	}
 
-	pctx.Res = s.makeResponseREFUSED(pctx.Req)
+	s.setExtendedError(pctx.Req, pctx.Res, code, text)
+	s.protectResponse(pctx)
 
 	return true, nil
 }
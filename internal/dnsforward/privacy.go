@@ -0,0 +1,202 @@
+package dnsforward
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+)
+
+// ResponsePrivacy are the countermeasures against the traffic analysis applied
+// to the responses sent over an encrypted protocol.
+type ResponsePrivacy struct {
+	// Proto is the protocol.  It must be one of "doh", "dot", or "doq".
+	Proto string `yaml:"proto"`
+
+	// Listeners are the IP addresses or CIDRs of the listeners, to the
+	// responses of which the countermeasures are applied.  If Listeners are
+	// empty, they're applied on all the listeners.
+	Listeners []string `yaml:"listeners"`
+
+	// PaddingBlockSize is the size of the blocks, to the multiple of which
+	// the responses are padded using the EDNS Padding option, if the
+	// requests have it.  RFC 8467 recommends 468.  If it's zero, the
+	// responses aren't padded.
+	PaddingBlockSize int `yaml:"padding_block_size"`
+
+	// MaxJitter is the maximum random delay added before sending the
+	// responses.  If it's zero, the responses aren't delayed.
+	MaxJitter timeutil.Duration `yaml:"max_jitter"`
+}
+
+// privacyProtos maps the protocol names of ResponsePrivacy to the protocols.
+var privacyProtos = map[string]proxy.Proto{
+	"doh": proxy.ProtoHTTPS,
+	"dot": proxy.ProtoTLS,
+	"doq": proxy.ProtoQUIC,
+}
+
+// privacyRule is the parsed ResponsePrivacy.
+type privacyRule struct {
+	// proto is the protocol of the responses.
+	proto proxy.Proto
+
+	// nets are the networks of the listeners.  If it's empty, the rule
+	// applies to all the listeners.
+	nets []*net.IPNet
+
+	// blockSize is the padding block size.
+	blockSize int
+
+	// maxJitter is the maximum response delay.
+	maxJitter time.Duration
+}
+
+// newPrivacyRule parses the response privacy settings.
+func newPrivacyRule(rp *ResponsePrivacy) (r *privacyRule, err error) {
+	r = &privacyRule{
+		blockSize: rp.PaddingBlockSize,
+		maxJitter: rp.MaxJitter.Duration,
+	}
+
+	var ok bool
+	r.proto, ok = privacyProtos[strings.ToLower(rp.Proto)]
+	if !ok {
+		return nil, fmt.Errorf("bad proto %q", rp.Proto)
+	}
+
+	if r.blockSize < 0 || r.blockSize > dns.MaxMsgSize {
+		return nil, fmt.Errorf("bad padding block size %d", r.blockSize)
+	} else if r.maxJitter < 0 {
+		return nil, fmt.Errorf("bad max jitter %s", r.maxJitter)
+	}
+
+	r.nets, err = parseListenerNets(rp.Listeners)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// newPrivacyRules parses all response privacy settings.
+func newPrivacyRules(rps []*ResponsePrivacy) (rules []*privacyRule, err error) {
+	for i, rp := range rps {
+		var r *privacyRule
+		r, err = newPrivacyRule(rp)
+		if err != nil {
+			return nil, fmt.Errorf("rule at index %d: %w", i, err)
+		}
+
+		rules = append(rules, r)
+	}
+
+	return rules, nil
+}
+
+// privacyRuleFor returns the first of rules applying to the responses sent
+// over proto on the listener with localIP, or nil if there is none.
+func privacyRuleFor(rules []*privacyRule, proto proxy.Proto, localIP net.IP) (r *privacyRule) {
+	for _, r = range rules {
+		if r.proto == proto && listenerMatches(r.nets, localIP) {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// protectResponse pads the response in pctx and delays it, if the response
+// privacy settings for its protocol and listener require that.
+func (s *Server) protectResponse(pctx *proxy.DNSContext) {
+	if pctx.Res == nil {
+		return
+	}
+
+	s.serverLock.RLock()
+	rules := s.privacy
+	s.serverLock.RUnlock()
+
+	if len(rules) == 0 {
+		return
+	}
+
+	r := privacyRuleFor(rules, pctx.Proto, localIPFromDNSContext(pctx))
+	if r == nil {
+		return
+	}
+
+	if r.blockSize > 0 {
+		padResponse(pctx.Req, pctx.Res, r.blockSize)
+	}
+
+	if r.maxJitter > 0 {
+		time.Sleep(jitter(r.maxJitter))
+	}
+}
+
+// jitter returns a random duration in the [0, max) interval.  It uses a
+// cryptographically secure generator, so that the delays can't be predicted
+// and subtracted.
+func jitter(max time.Duration) (d time.Duration) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		log.Debug("dns: generating jitter: %s", err)
+
+		return 0
+	}
+
+	return time.Duration(n.Int64())
+}
+
+// padResponse pads resp to a multiple of blockSize with the EDNS Padding
+// option, if req has it.  See RFC 7830 and RFC 8467.
+func padResponse(req, resp *dns.Msg, blockSize int) {
+	reqOpt := req.IsEdns0()
+	if reqOpt == nil || !hasPaddingOption(reqOpt) {
+		// RFC 7830 forbids padding the responses to the requests without
+		// the option.
+		return
+	}
+
+	opt := resp.IsEdns0()
+	if opt == nil {
+		resp.SetEdns0(reqOpt.UDPSize(), reqOpt.Do())
+		opt = resp.IsEdns0()
+	}
+
+	// Remove the padding added by the upstream, if any.
+	opts := make([]dns.EDNS0, 0, len(opt.Option)+1)
+	for _, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_PADDING); !ok {
+			opts = append(opts, o)
+		}
+	}
+
+	pad := &dns.EDNS0_PADDING{}
+	opt.Option = append(opts, pad)
+
+	// Measure the response the way it's going to be packed.
+	resp.Compress = true
+	if rem := resp.Len() % blockSize; rem != 0 {
+		pad.Padding = make([]byte, blockSize-rem)
+	}
+}
+
+// hasPaddingOption returns true if opt contains the EDNS Padding option.
+func hasPaddingOption(opt *dns.OPT) (ok bool) {
+	for _, o := range opt.Option {
+		if _, ok = o.(*dns.EDNS0_PADDING); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,123 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPadResponse(t *testing.T) {
+	const blockSize = 468
+
+	newResp := func(req *dns.Msg) (resp *dns.Msg) {
+		resp = (&dns.Msg{}).SetReply(req)
+		resp.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{
+				Name:   req.Question[0].Name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    60,
+			},
+			A: net.IP{192, 0, 2, 1},
+		}}
+
+		return resp
+	}
+
+	t.Run("padded", func(t *testing.T) {
+		req := (&dns.Msg{}).SetQuestion("host.example.", dns.TypeA)
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_PADDING{})
+
+		resp := newResp(req)
+		padResponse(req, resp, blockSize)
+		require.NotNil(t, resp.IsEdns0())
+
+		assert.Zero(t, resp.Len()%blockSize)
+
+		data, err := resp.Pack()
+		require.NoError(t, err)
+
+		assert.Len(t, data, blockSize)
+
+		// Padding again mustn't add another option.
+		padResponse(req, resp, blockSize)
+
+		assert.Len(t, resp.IsEdns0().Option, 1)
+		assert.Equal(t, blockSize, resp.Len())
+	})
+
+	t.Run("no_option", func(t *testing.T) {
+		req := (&dns.Msg{}).SetQuestion("host.example.", dns.TypeA)
+		req.SetEdns0(dns.DefaultMsgSize, false)
+
+		resp := newResp(req)
+		l := resp.Len()
+		padResponse(req, resp, blockSize)
+
+		assert.Nil(t, resp.IsEdns0())
+		assert.Equal(t, l, resp.Len())
+	})
+}
+
+func TestNewPrivacyRules(t *testing.T) {
+	rules, err := newPrivacyRules([]*ResponsePrivacy{{
+		Proto:            "dot",
+		Listeners:        []string{"192.0.2.0/24"},
+		PaddingBlockSize: 468,
+	}, {
+		Proto:     "DoH",
+		MaxJitter: timeutil.Duration{Duration: 10 * time.Millisecond},
+	}})
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+
+	assert.Same(t, rules[0], privacyRuleFor(rules, proxy.ProtoTLS, net.IP{192, 0, 2, 1}))
+	assert.Nil(t, privacyRuleFor(rules, proxy.ProtoTLS, net.IP{198, 51, 100, 1}))
+	assert.Nil(t, privacyRuleFor(rules, proxy.ProtoQUIC, net.IP{192, 0, 2, 1}))
+	assert.Same(t, rules[1], privacyRuleFor(rules, proxy.ProtoHTTPS, nil))
+
+	testCases := []struct {
+		rp         *ResponsePrivacy
+		name       string
+		wantErrMsg string
+	}{{
+		rp:         &ResponsePrivacy{Proto: "dns"},
+		name:       "plain",
+		wantErrMsg: `rule at index 0: bad proto "dns"`,
+	}, {
+		rp:         &ResponsePrivacy{Proto: "doq", PaddingBlockSize: -1},
+		name:       "block_size",
+		wantErrMsg: "rule at index 0: bad padding block size -1",
+	}, {
+		rp:         &ResponsePrivacy{Proto: "doq", Listeners: []string{"bad"}},
+		name:       "listener",
+		wantErrMsg: `rule at index 0: bad listener "bad": invalid CIDR address: bad`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err = newPrivacyRules([]*ResponsePrivacy{tc.rp})
+			require.Error(t, err)
+
+			assert.Equal(t, tc.wantErrMsg, err.Error())
+		})
+	}
+}
+
+func TestJitter(t *testing.T) {
+	const max = 10 * time.Millisecond
+
+	for i := 0; i < 100; i++ {
+		d := jitter(max)
+		require.GreaterOrEqual(t, int64(d), int64(0))
+		require.Less(t, int64(d), int64(max))
+	}
+}
@@ -0,0 +1,190 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// inZones returns true if host is one of zones or a subdomain of one of them.
+// host must be a lowercased FQDN.  The zones may have the leading "*.".
+func inZones(host string, zones []string) (ok bool) {
+	host = strings.TrimSuffix(host, ".")
+	for _, z := range zones {
+		z = strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(z, "*."), "."))
+		if host == z || strings.HasSuffix(host, "."+z) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// alwaysLocalZones are the zones, which are never considered public, in
+// addition to the local domain name.  See RFC 6761 and RFC 8375.
+var alwaysLocalZones = []string{
+	"home.arpa",
+	"localhost",
+}
+
+// isPrivateAnswersZone returns true if the private addresses must be stripped
+// from the answers for host.  host must be a lowercased FQDN.
+func (s *Server) isPrivateAnswersZone(host string) (ok bool) {
+	if strings.HasSuffix(host, s.localDomainSuffix) ||
+		inZones(host, alwaysLocalZones) ||
+		inZones(host, s.conf.PrivateAnswersAllowed) {
+		return false
+	}
+
+	return len(s.conf.StripPrivateAnswersZones) == 0 ||
+		inZones(host, s.conf.StripPrivateAnswersZones)
+}
+
+// rebindingNets are the networks, the addresses from which are stripped from
+// the answers in addition to the locally-served ones, since they also reach
+// the client itself or its local network.
+var rebindingNets = mustParseCIDRs(
+	// "This" network.
+	"0.0.0.0/8",
+	// Shared Address Space, used by the CGNATs.
+	"100.64.0.0/10",
+	// Unique-Local, the whole range.
+	"fc00::/7",
+)
+
+// mustParseCIDRs parses cidrs and panics if any of them is invalid.
+func mustParseCIDRs(cidrs ...string) (nets []*net.IPNet) {
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets
+}
+
+// isRebindingIP returns true if ip is a private, loopback, or otherwise local
+// address, which the public names must not resolve to.  The IPv4-mapped IPv6
+// addresses are checked as IPv4 ones.
+func (s *Server) isRebindingIP(ip net.IP) (ok bool) {
+	if s.subnetDetector.IsLocallyServedNetwork(ip) {
+		return true
+	}
+
+	for _, n := range rebindingNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validatePrivateAnswersZones returns an error if any of zones isn't a valid
+// domain name with an optional leading "*.".
+func validatePrivateAnswersZones(zones []string) (err error) {
+	for i, z := range zones {
+		name := strings.TrimSuffix(strings.TrimPrefix(z, "*."), ".")
+		err = netutil.ValidateHostname(name)
+		if err != nil {
+			return fmt.Errorf("zone at index %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// upstreamHostIP returns the IP address of the upstream with addr, if it's
+// specified by one.
+func upstreamHostIP(addr string) (ip net.IP) {
+	host := addr
+	if strings.Contains(addr, "://") {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil
+		}
+
+		host = u.Hostname()
+	} else if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+
+	return net.ParseIP(strings.Trim(host, "[]"))
+}
+
+// isPrivateUpstream returns true if the upstream with addr is within the
+// locally-served networks, so that its private answers are trusted.
+func (s *Server) isPrivateUpstream(addr string) (ok bool) {
+	ip := upstreamHostIP(addr)
+
+	return ip != nil && s.subnetDetector.IsLocallyServedNetwork(ip)
+}
+
+// processPrivateAnswers removes the A and AAAA records with the addresses from
+// the locally-served networks from the responses of the public upstreams for
+// the public names.  Such answers are either a misconfiguration or an attempt
+// to reach the local network through the clients, like the DNS rebinding
+// attacks do.
+func (s *Server) processPrivateAnswers(dctx *dnsContext) (rc resultCode) {
+	pctx := dctx.proxyCtx
+	if !dctx.responseFromUpstream ||
+		pctx.Res == nil ||
+		len(pctx.Req.Question) != 1 {
+		return resultCodeSuccess
+	}
+
+	host := strings.ToLower(pctx.Req.Question[0].Name)
+
+	s.serverLock.RLock()
+	strip := s.conf.StripPrivateAnswers && s.isPrivateAnswersZone(host)
+	s.serverLock.RUnlock()
+	if !strip {
+		return resultCodeSuccess
+	}
+
+	upsAddr := pctx.CachedUpstreamAddr
+	if pctx.Upstream != nil {
+		upsAddr = pctx.Upstream.Address()
+	}
+
+	if s.isPrivateUpstream(upsAddr) {
+		return resultCodeSuccess
+	}
+
+	var stripped int
+	ans := pctx.Res.Answer[:0]
+	for _, rr := range pctx.Res.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			// Go on.
+		}
+
+		if ip != nil && s.isRebindingIP(ip) {
+			stripped++
+
+			continue
+		}
+
+		ans = append(ans, rr)
+	}
+
+	if stripped > 0 {
+		log.Info("dns: stripped %d private answers for %q from %s", stripped, host, upsAddr)
+		pctx.Res.Answer = ans
+	}
+
+	return resultCodeSuccess
+}
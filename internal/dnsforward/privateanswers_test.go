@@ -0,0 +1,157 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_processPrivateAnswers(t *testing.T) {
+	snd, err := aghnet.NewSubnetDetector()
+	require.NoError(t, err)
+
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				StripPrivateAnswers:   true,
+				PrivateAnswersAllowed: []string{"corp.example"},
+			},
+		},
+		subnetDetector:    snd,
+		localDomainSuffix: defaultLocalDomainSuffix,
+	}
+
+	privIP, pubIP := net.IP{192, 168, 0, 1}, net.IP{1, 2, 3, 4}
+
+	testCases := []struct {
+		name    string
+		host    string
+		upsAddr string
+		wantIPs []net.IP
+	}{{
+		name:    "stripped",
+		host:    "rebind.example.",
+		upsAddr: "tls://dns.example",
+		wantIPs: []net.IP{pubIP},
+	}, {
+		name:    "allowed_zone",
+		host:    "vpn.corp.example.",
+		upsAddr: "tls://dns.example",
+		wantIPs: []net.IP{privIP, pubIP},
+	}, {
+		name:    "local_domain",
+		host:    "printer.lan.",
+		upsAddr: "tls://dns.example",
+		wantIPs: []net.IP{privIP, pubIP},
+	}, {
+		name:    "private_upstream",
+		host:    "rebind.example.",
+		upsAddr: "192.168.0.53:53",
+		wantIPs: []net.IP{privIP, pubIP},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := (&dns.Msg{}).SetQuestion(tc.host, dns.TypeA)
+			resp := (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{
+				newA(tc.host, privIP),
+				newA(tc.host, pubIP),
+			}
+
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Req:      req,
+					Res:      resp,
+					Upstream: &aghtest.TestUpstream{Addr: tc.upsAddr},
+				},
+				responseFromUpstream: true,
+			}
+
+			rc := s.processPrivateAnswers(dctx)
+			require.Equal(t, resultCodeSuccess, rc)
+
+			var ips []net.IP
+			for _, rr := range dctx.proxyCtx.Res.Answer {
+				a, ok := rr.(*dns.A)
+				require.True(t, ok)
+
+				ips = append(ips, a.A)
+			}
+
+			assert.Equal(t, tc.wantIPs, ips)
+		})
+	}
+}
+
+func TestServer_isRebindingIP(t *testing.T) {
+	snd, err := aghnet.NewSubnetDetector()
+	require.NoError(t, err)
+
+	s := &Server{
+		subnetDetector: snd,
+	}
+
+	testCases := []struct {
+		name string
+		ip   net.IP
+		want bool
+	}{{
+		name: "private",
+		ip:   net.IP{10, 0, 0, 1},
+		want: true,
+	}, {
+		name: "loopback",
+		ip:   net.IP{127, 0, 0, 1},
+		want: true,
+	}, {
+		name: "this_network",
+		ip:   net.IP{0, 0, 0, 0},
+		want: true,
+	}, {
+		name: "shared",
+		ip:   net.IP{100, 64, 1, 1},
+		want: true,
+	}, {
+		name: "mapped",
+		ip:   net.ParseIP("::ffff:192.168.1.1"),
+		want: true,
+	}, {
+		name: "unique_local",
+		ip:   net.ParseIP("fc00::1"),
+		want: true,
+	}, {
+		name: "public",
+		ip:   net.IP{1, 2, 3, 4},
+		want: false,
+	}, {
+		name: "public_ipv6",
+		ip:   net.ParseIP("2606:4700::1111"),
+		want: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, s.isRebindingIP(tc.ip))
+		})
+	}
+}
+
+// newA returns a new A record for host with ip.
+func newA(host string, ip net.IP) (rr *dns.A) {
+	return &dns.A{
+		Hdr: dns.RR_Header{
+			Name:   host,
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    60,
+		},
+		A: ip,
+	}
+}
@@ -0,0 +1,86 @@
+package dnsforward
+
+import (
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// isMalformedQname returns true if name contains anything besides the ASCII
+// letters, digits, hyphens, and underscores within the labels.  The latter are
+// allowed, since they are common in the service names, like in SRV and TXT
+// requests, and in the hostnames of the IoT devices.  The bytes, which miekg/dns
+// escapes in the presentation format, like spaces, dots within the labels, and
+// non-ASCII bytes, are always considered malformed.
+func isMalformedQname(name string) (ok bool) {
+	if name == "." {
+		return false
+	}
+
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; {
+		case
+			c >= 'a' && c <= 'z',
+			c >= 'A' && c <= 'Z',
+			c >= '0' && c <= '9',
+			c == '-',
+			c == '_',
+			c == '.':
+			// Go on.
+		default:
+			return true
+		}
+	}
+
+	return false
+}
+
+// processQnameValidation handles the requests with the malformed names
+// according to the qname validation mode.  In the strict mode, it responds with
+// FORMERR, and in the lenient mode, it disables the filtering of the request,
+// since the filtering rules and the other checks treat such names
+// inconsistently.
+func (s *Server) processQnameValidation(dctx *dnsContext) (rc resultCode) {
+	s.serverLock.RLock()
+	mode := s.conf.QnameValidation
+	s.serverLock.RUnlock()
+
+	if mode == QnameValidationOff {
+		return resultCodeSuccess
+	}
+
+	pctx := dctx.proxyCtx
+	q := pctx.Req.Question[0]
+	if !isMalformedQname(q.Name) {
+		return resultCodeSuccess
+	}
+
+	switch mode {
+	case QnameValidationStrict:
+		log.Debug("dns: malformed qname %q from %s, responding with formerr", q.Name, pctx.Addr)
+
+		pctx.Res = s.makeResponse(pctx.Req)
+		pctx.Res.Rcode = dns.RcodeFormatError
+
+		// Log the request, since the processing stops here.
+		dctx.result = &filtering.Result{
+			Reason:     filtering.FilteredInvalid,
+			IsFiltered: true,
+		}
+		s.processQueryLogsAndStats(dctx)
+
+		return resultCodeFinish
+	case QnameValidationLenient:
+		log.Info("dns: malformed qname %q from %s, not filtering", q.Name, pctx.Addr)
+
+		dctx.protectionEnabled = false
+		if dctx.setts != nil {
+			dctx.setts.ProtectionEnabled = false
+		}
+	default:
+		// Generally shouldn't happen, since the mode is validated in
+		// Prepare.
+	}
+
+	return resultCodeSuccess
+}
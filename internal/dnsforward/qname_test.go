@@ -0,0 +1,124 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsMalformedQname(t *testing.T) {
+	testCases := []struct {
+		name  string
+		qname string
+		want  bool
+	}{{
+		name:  "root",
+		qname: ".",
+		want:  false,
+	}, {
+		name:  "valid",
+		qname: "www.example.com.",
+		want:  false,
+	}, {
+		name:  "underscore",
+		qname: "_sip._tcp.my_device.lan.",
+		want:  false,
+	}, {
+		name:  "space",
+		qname: `living\032room.lan.`,
+		want:  true,
+	}, {
+		name:  "dot_in_label",
+		qname: `a\.b.example.`,
+		want:  true,
+	}, {
+		name:  "non_ascii",
+		qname: `caf\195\169.example.`,
+		want:  true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, isMalformedQname(tc.qname))
+		})
+	}
+}
+
+func TestServer_processQnameValidation(t *testing.T) {
+	const qname = `living\032room.lan.`
+
+	testCases := []struct {
+		name          string
+		mode          QnameValidationMode
+		wantRC        resultCode
+		wantRcode     int
+		wantRes       bool
+		wantProtected bool
+	}{{
+		name:          "off",
+		mode:          QnameValidationOff,
+		wantRC:        resultCodeSuccess,
+		wantRcode:     0,
+		wantRes:       false,
+		wantProtected: true,
+	}, {
+		name:          "lenient",
+		mode:          QnameValidationLenient,
+		wantRC:        resultCodeSuccess,
+		wantRcode:     0,
+		wantRes:       false,
+		wantProtected: false,
+	}, {
+		name:          "strict",
+		mode:          QnameValidationStrict,
+		wantRC:        resultCodeFinish,
+		wantRcode:     dns.RcodeFormatError,
+		wantRes:       true,
+		wantProtected: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{
+				conf: ServerConfig{
+					FilteringConfig: FilteringConfig{
+						QnameValidation: tc.mode,
+					},
+				},
+				anonymizer: aghnet.NewIPMut(nil),
+			}
+
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Req:  (&dns.Msg{}).SetQuestion(qname, dns.TypeA),
+					Addr: &net.UDPAddr{IP: net.IP{192, 168, 0, 2}, Port: 1},
+				},
+				setts:             &filtering.Settings{ProtectionEnabled: true},
+				protectionEnabled: true,
+			}
+
+			rc := s.processQnameValidation(dctx)
+			assert.Equal(t, tc.wantRC, rc)
+			assert.Equal(t, tc.wantProtected, dctx.protectionEnabled)
+			assert.Equal(t, tc.wantProtected, dctx.setts.ProtectionEnabled)
+
+			res := dctx.proxyCtx.Res
+			if !tc.wantRes {
+				assert.Nil(t, res)
+
+				return
+			}
+
+			require.NotNil(t, res)
+
+			assert.Equal(t, tc.wantRcode, res.Rcode)
+			assert.Equal(t, filtering.FilteredInvalid, dctx.result.Reason)
+		})
+	}
+}
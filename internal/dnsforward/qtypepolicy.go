@@ -0,0 +1,161 @@
+package dnsforward
+
+import (
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// rfc8482HINFOCPU is the CPU field of the HINFO record returned in response to
+// the refused ANY requests, see RFC 8482.
+const rfc8482HINFOCPU = "RFC8482"
+
+// rfc8482HINFOTTL is the TTL of the HINFO record returned in response to the
+// refused ANY requests.  RFC 8482 recommends a long one.
+const rfc8482HINFOTTL = 86400
+
+// genRefusedANYResponse returns the response to the refused ANY request req.
+// It's either a NOTIMP one or, if RefuseAnyHINFO is set, the one with a
+// synthesized HINFO record, as described in RFC 8482.
+func (s *Server) genRefusedANYResponse(req *dns.Msg) (resp *dns.Msg) {
+	resp = s.makeResponse(req)
+	if !s.conf.RefuseAnyHINFO {
+		resp.Rcode = dns.RcodeNotImplemented
+
+		return resp
+	}
+
+	resp.Answer = []dns.RR{&dns.HINFO{
+		Hdr: dns.RR_Header{
+			Name:   req.Question[0].Name,
+			Rrtype: dns.TypeHINFO,
+			Class:  dns.ClassINET,
+			Ttl:    rfc8482HINFOTTL,
+		},
+		Cpu: rfc8482HINFOCPU,
+		Os:  "",
+	}}
+
+	return resp
+}
+
+// processQtypePolicies applies the policies for the particular record types
+// to the response: it strips the ECH parameters from the HTTPS and SVCB
+// records, if StripECH is set, and removes the AAAA records and the IPv6
+// hints, if the client has IPv6 disabled.
+func (s *Server) processQtypePolicies(dctx *dnsContext) (rc resultCode) {
+	resp := dctx.proxyCtx.Res
+	if resp == nil {
+		return resultCodeSuccess
+	}
+
+	stripECH := s.conf.StripECH
+	disableAAAA := dctx.setts != nil && dctx.setts.DisableAAAA
+	if !stripECH && !disableAAAA {
+		return resultCodeSuccess
+	}
+
+	var modified bool
+	for _, rrs := range []*[]dns.RR{&resp.Answer, &resp.Ns, &resp.Extra} {
+		var m bool
+		*rrs, m = mangleRecords(*rrs, stripECH, disableAAAA)
+		modified = modified || m
+	}
+
+	if modified {
+		log.Debug("dns: applied qtype policies to %s", dctx.proxyCtx.Req.Question[0].Name)
+	}
+
+	return resultCodeSuccess
+}
+
+// mangleRecords removes the AAAA records, if disableAAAA is true, and strips
+// the ECH parameters, if stripECH is true, and the IPv6 hints, if disableAAAA
+// is true, from the HTTPS and SVCB records of rrs.  The signatures of the
+// changed records are removed as well, since they're no longer valid.
+func mangleRecords(rrs []dns.RR, stripECH, disableAAAA bool) (res []dns.RR, modified bool) {
+	var removeKeys []dns.SVCBKey
+	if stripECH {
+		removeKeys = append(removeKeys, dns.SVCB_ECHCONFIG)
+	}
+
+	if disableAAAA {
+		removeKeys = append(removeKeys, dns.SVCB_IPV6HINT)
+	}
+
+	changedTypes := map[uint16]struct{}{}
+	res = rrs[:0]
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.AAAA:
+			if disableAAAA {
+				changedTypes[dns.TypeAAAA] = struct{}{}
+
+				continue
+			}
+		case *dns.HTTPS:
+			if removeSVCBKeys(&rr.SVCB, removeKeys) {
+				changedTypes[dns.TypeHTTPS] = struct{}{}
+			}
+		case *dns.SVCB:
+			if removeSVCBKeys(rr, removeKeys) {
+				changedTypes[dns.TypeSVCB] = struct{}{}
+			}
+		default:
+			// Go on.
+		}
+
+		res = append(res, rr)
+	}
+
+	if len(changedTypes) == 0 {
+		return res, false
+	}
+
+	signed := res
+	res = res[:0]
+	for _, rr := range signed {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			if _, changed := changedTypes[sig.TypeCovered]; changed {
+				continue
+			}
+		}
+
+		res = append(res, rr)
+	}
+
+	return res, true
+}
+
+// removeSVCBKeys removes the parameters with keys from svcb.  It returns true
+// if any has been removed.
+func removeSVCBKeys(svcb *dns.SVCB, keys []dns.SVCBKey) (removed bool) {
+	if len(keys) == 0 {
+		return false
+	}
+
+	vals := svcb.Value[:0]
+	for _, v := range svcb.Value {
+		if containsSVCBKey(keys, v.Key()) {
+			removed = true
+
+			continue
+		}
+
+		vals = append(vals, v)
+	}
+
+	svcb.Value = vals
+
+	return removed
+}
+
+// containsSVCBKey returns true if keys contain key.
+func containsSVCBKey(keys []dns.SVCBKey, key dns.SVCBKey) (ok bool) {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,126 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_genRefusedANYResponse(t *testing.T) {
+	s := &Server{}
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeANY)
+
+	resp := s.genRefusedANYResponse(req)
+	assert.Equal(t, dns.RcodeNotImplemented, resp.Rcode)
+	assert.Empty(t, resp.Answer)
+
+	s.conf.RefuseAnyHINFO = true
+	resp = s.genRefusedANYResponse(req)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+
+	require.Len(t, resp.Answer, 1)
+
+	hinfo, ok := resp.Answer[0].(*dns.HINFO)
+	require.True(t, ok)
+
+	assert.Equal(t, rfc8482HINFOCPU, hinfo.Cpu)
+	assert.Equal(t, "example.org.", hinfo.Hdr.Name)
+}
+
+// newHTTPSWithHints returns a new HTTPS record for host with the ECH
+// parameter and the IPv4 and IPv6 hints.
+func newHTTPSWithHints(host string) (rr *dns.HTTPS) {
+	return &dns.HTTPS{
+		SVCB: dns.SVCB{
+			Hdr: dns.RR_Header{
+				Name:   host,
+				Rrtype: dns.TypeHTTPS,
+				Class:  dns.ClassINET,
+				Ttl:    60,
+			},
+			Priority: 1,
+			Target:   ".",
+			Value: []dns.SVCBKeyValue{
+				&dns.SVCBAlpn{Alpn: []string{"h2"}},
+				&dns.SVCBECHConfig{ECH: []byte{1, 2, 3}},
+				&dns.SVCBIPv4Hint{Hint: []net.IP{{192, 0, 2, 1}}},
+				&dns.SVCBIPv6Hint{Hint: []net.IP{net.ParseIP("2001:db8::1")}},
+			},
+		},
+	}
+}
+
+// svcbKeys returns the keys of the parameters of svcb.
+func svcbKeys(svcb *dns.SVCB) (keys []dns.SVCBKey) {
+	for _, v := range svcb.Value {
+		keys = append(keys, v.Key())
+	}
+
+	return keys
+}
+
+func TestServer_processQtypePolicies(t *testing.T) {
+	const host = "example.org."
+
+	testCases := []struct {
+		name        string
+		stripECH    bool
+		disableAAAA bool
+		wantKeys    []dns.SVCBKey
+		wantTypes   []uint16
+	}{{
+		name:      "none",
+		wantKeys:  []dns.SVCBKey{dns.SVCB_ALPN, dns.SVCB_ECHCONFIG, dns.SVCB_IPV4HINT, dns.SVCB_IPV6HINT},
+		wantTypes: []uint16{dns.TypeHTTPS, dns.TypeRRSIG, dns.TypeAAAA},
+	}, {
+		name:      "strip_ech",
+		stripECH:  true,
+		wantKeys:  []dns.SVCBKey{dns.SVCB_ALPN, dns.SVCB_IPV4HINT, dns.SVCB_IPV6HINT},
+		wantTypes: []uint16{dns.TypeHTTPS, dns.TypeAAAA},
+	}, {
+		name:        "disable_aaaa",
+		disableAAAA: true,
+		wantKeys:    []dns.SVCBKey{dns.SVCB_ALPN, dns.SVCB_ECHCONFIG, dns.SVCB_IPV4HINT},
+		wantTypes:   []uint16{dns.TypeHTTPS},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{}
+			s.conf.StripECH = tc.stripECH
+
+			https := newHTTPSWithHints(host)
+			req := (&dns.Msg{}).SetQuestion(host, dns.TypeHTTPS)
+			resp := (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{
+				https,
+				&dns.RRSIG{
+					Hdr:         dns.RR_Header{Name: host, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET},
+					TypeCovered: dns.TypeHTTPS,
+				},
+			}
+			resp.Extra = []dns.RR{newAAAA(host, net.ParseIP("2001:db8::1"))}
+
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Req: req,
+					Res: resp,
+				},
+				setts: &filtering.Settings{DisableAAAA: tc.disableAAAA},
+			}
+
+			rc := s.processQtypePolicies(dctx)
+			require.Equal(t, resultCodeSuccess, rc)
+
+			assert.Equal(t, tc.wantKeys, svcbKeys(&https.SVCB))
+
+			types := append(rrTypes(resp.Answer), rrTypes(resp.Extra)...)
+			assert.Equal(t, tc.wantTypes, types)
+		})
+	}
+}
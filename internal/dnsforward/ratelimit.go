@@ -0,0 +1,360 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/netutil"
+)
+
+// ratelimitBucket is a token bucket of a single client or a single pair of a
+// client and a domain.
+type ratelimitBucket struct {
+	// last is the time of the last refill.
+	last time.Time
+
+	// tokens is the number of the requests allowed at last.
+	tokens float64
+
+	// limited is the number of the requests limited by the bucket.
+	limited uint64
+}
+
+// refill adds the tokens accumulated since the last refill, but no more than
+// burst.
+func (b *ratelimitBucket) refill(now time.Time, rate, burst float64) {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+
+	b.last = now
+}
+
+// ratelimitKeyConfig is the configuration of the keys of the buckets.
+type ratelimitKeyConfig struct {
+	// allowlist are the IP addresses of the clients, which are never
+	// limited.
+	allowlist map[string]struct{}
+
+	// ipv4Mask and ipv6Mask are the masks of the subnets, the clients from
+	// which share the buckets.
+	ipv4Mask net.IPMask
+	ipv6Mask net.IPMask
+}
+
+// ratelimiter limits the number of the requests from the clients using the
+// token buckets.  The clients are identified by their ClientIDs or by their
+// subnets.  Optionally, the requests for every domain from every client are
+// limited separately as well.  A nil *ratelimiter doesn't limit anything.
+type ratelimiter struct {
+	// mu protects clients and domains.
+	mu *sync.Mutex
+
+	// clients are the buckets by the client keys.
+	clients map[string]*ratelimitBucket
+
+	// domains are the buckets by the client and domain keys.
+	domains map[ratelimitDomainKey]*ratelimitBucket
+
+	keys *ratelimitKeyConfig
+
+	// rate and burst are the parameters of the client buckets.  rate is
+	// zero if the clients aren't limited.
+	rate  float64
+	burst float64
+
+	// domainRate is the parameter of the domain buckets, which is also
+	// their burst.  It's zero if the domains aren't limited.
+	domainRate float64
+}
+
+// ratelimitDomainKey is the key of the bucket of a client and a domain.
+type ratelimitDomainKey struct {
+	client string
+	domain string
+}
+
+// maxRatelimitBuckets is the number of tracked buckets of each kind, after
+// which the full ones are dropped.
+const maxRatelimitBuckets = 100_000
+
+// newRatelimiter returns a ratelimiter for the configuration.  It returns nil
+// if neither the clients nor the domains are limited.
+func newRatelimiter(c *FilteringConfig) (rl *ratelimiter, err error) {
+	if c.Ratelimit == 0 && c.RatelimitPerDomain == 0 {
+		return nil, nil
+	}
+
+	keys := &ratelimitKeyConfig{
+		allowlist: map[string]struct{}{},
+	}
+
+	for i, s := range c.RatelimitWhitelist {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("ratelimit_whitelist at index %d: bad ip %q", i, s)
+		}
+
+		keys.allowlist[ip.String()] = struct{}{}
+	}
+
+	keys.ipv4Mask, err = ratelimitMask(c.RatelimitSubnetLenIPv4, netutil.IPv4BitLen)
+	if err != nil {
+		return nil, fmt.Errorf("ratelimit_subnet_len_ipv4: %w", err)
+	}
+
+	keys.ipv6Mask, err = ratelimitMask(c.RatelimitSubnetLenIPv6, netutil.IPv6BitLen)
+	if err != nil {
+		return nil, fmt.Errorf("ratelimit_subnet_len_ipv6: %w", err)
+	}
+
+	burst := c.RatelimitBurst
+	if burst == 0 {
+		burst = c.Ratelimit
+	}
+
+	return &ratelimiter{
+		mu:         &sync.Mutex{},
+		clients:    map[string]*ratelimitBucket{},
+		domains:    map[ratelimitDomainKey]*ratelimitBucket{},
+		keys:       keys,
+		rate:       float64(c.Ratelimit),
+		burst:      float64(burst),
+		domainRate: float64(c.RatelimitPerDomain),
+	}, nil
+}
+
+// ratelimitMask returns the mask of the subnet of the length l within the
+// addresses of bits bits.  Zero l means the whole address.
+func ratelimitMask(l, bits int) (m net.IPMask, err error) {
+	if l < 0 || l > bits {
+		return nil, fmt.Errorf("bad subnet length %d", l)
+	} else if l == 0 {
+		l = bits
+	}
+
+	return net.CIDRMask(l, bits), nil
+}
+
+// clientKey returns the key of the bucket of the client with ip and clientID.
+// ok is false if the client is never limited.
+func (c *ratelimitKeyConfig) clientKey(ip net.IP, clientID string) (key string, ok bool) {
+	if clientID != "" {
+		return "clientid:" + clientID, true
+	} else if ip == nil {
+		return "", false
+	} else if _, ok = c.allowlist[ip.String()]; ok {
+		return "", false
+	}
+
+	mask := c.ipv6Mask
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, mask = ip4, c.ipv4Mask
+	}
+
+	ones, _ := mask.Size()
+
+	return fmt.Sprintf("%s/%d", ip.Mask(mask), ones), true
+}
+
+// isLimited returns true if the request for host from the client with ip and
+// clientID exceeds the limits.  The requests over plain DNS-over-TCP are never
+// limited, since they can't be spoofed, and the truncated responses to the
+// limited requests send the clients there.
+func (rl *ratelimiter) isLimited(proto proxy.Proto, ip net.IP, clientID, host string) (ok bool) {
+	if rl == nil || proto == proxy.ProtoTCP {
+		return false
+	}
+
+	client, ok := rl.keys.clientKey(ip, clientID)
+	if !ok {
+		return false
+	}
+
+	now := time.Now()
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	var cb, db *ratelimitBucket
+	if rl.rate > 0 {
+		cb = rl.clients[client]
+		if cb == nil {
+			if len(rl.clients) >= maxRatelimitBuckets {
+				rl.dropFull(now)
+			}
+
+			cb = &ratelimitBucket{last: now, tokens: rl.burst}
+			rl.clients[client] = cb
+		}
+
+		cb.refill(now, rl.rate, rl.burst)
+	}
+
+	if rl.domainRate > 0 {
+		key := ratelimitDomainKey{client: client, domain: strings.ToLower(host)}
+		db = rl.domains[key]
+		if db == nil {
+			if len(rl.domains) >= maxRatelimitBuckets {
+				rl.dropFull(now)
+			}
+
+			db = &ratelimitBucket{last: now, tokens: rl.domainRate}
+			rl.domains[key] = db
+		}
+
+		db.refill(now, rl.domainRate, rl.domainRate)
+	}
+
+	// Only take the tokens if both buckets allow the request so that the
+	// requests limited by one bucket don't drain the other one.
+	for _, b := range []*ratelimitBucket{cb, db} {
+		if b != nil && b.tokens < 1 {
+			b.limited++
+
+			return true
+		}
+	}
+
+	for _, b := range []*ratelimitBucket{cb, db} {
+		if b != nil {
+			b.tokens--
+		}
+	}
+
+	return false
+}
+
+// dropFull removes the buckets which would be full by now, since they are the
+// same as the new ones.  rl.mu is expected to be locked.
+func (rl *ratelimiter) dropFull(now time.Time) {
+	for key, b := range rl.clients {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+			delete(rl.clients, key)
+		}
+	}
+
+	for key, b := range rl.domains {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.domainRate >= rl.domainRate {
+			delete(rl.domains, key)
+		}
+	}
+}
+
+// isRatelimited returns true if the request from the client with ip and
+// clientID exceeds the limits of rl, which may be nil.
+func (s *Server) isRatelimited(
+	pctx *proxy.DNSContext,
+	rl *ratelimiter,
+	ip net.IP,
+	clientID string,
+) (ok bool) {
+	var host string
+	if len(pctx.Req.Question) == 1 {
+		host = strings.TrimSuffix(pctx.Req.Question[0].Name, ".")
+	}
+
+	return rl.isLimited(pctx.Proto, ip, clientID, host)
+}
+
+// ratelimitBucketJSON is the state of a single bucket.
+type ratelimitBucketJSON struct {
+	Client string `json:"client"`
+
+	// Domain is empty for the buckets of the clients.
+	Domain string `json:"domain,omitempty"`
+
+	Tokens  float64 `json:"tokens"`
+	Limited uint64  `json:"limited"`
+}
+
+// ratelimitStatusJSON is the response for the GET /control/ratelimit/status
+// HTTP API.
+type ratelimitStatusJSON struct {
+	Buckets []*ratelimitBucketJSON `json:"buckets"`
+
+	Rate       float64 `json:"rate"`
+	Burst      float64 `json:"burst"`
+	DomainRate float64 `json:"per_domain_rate"`
+
+	Enabled bool `json:"enabled"`
+}
+
+// maxRatelimitStatusBuckets is the maximum number of the buckets in the
+// response for the GET /control/ratelimit/status HTTP API.
+const maxRatelimitStatusBuckets = 100
+
+// status returns the current state of the buckets, which aren't full, the
+// most drained ones first.
+func (rl *ratelimiter) status() (resp *ratelimitStatusJSON) {
+	resp = &ratelimitStatusJSON{
+		Buckets: []*ratelimitBucketJSON{},
+	}
+	if rl == nil {
+		return resp
+	}
+
+	resp.Enabled = true
+	resp.Rate, resp.Burst, resp.DomainRate = rl.rate, rl.burst, rl.domainRate
+
+	now := time.Now()
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	for key, b := range rl.clients {
+		b.refill(now, rl.rate, rl.burst)
+		if b.tokens < rl.burst {
+			resp.Buckets = append(resp.Buckets, &ratelimitBucketJSON{
+				Client:  key,
+				Tokens:  b.tokens,
+				Limited: b.limited,
+			})
+		}
+	}
+
+	for key, b := range rl.domains {
+		b.refill(now, rl.domainRate, rl.domainRate)
+		if b.tokens < rl.domainRate {
+			resp.Buckets = append(resp.Buckets, &ratelimitBucketJSON{
+				Client:  key.client,
+				Domain:  key.domain,
+				Tokens:  b.tokens,
+				Limited: b.limited,
+			})
+		}
+	}
+
+	sort.Slice(resp.Buckets, func(i, j int) bool {
+		return resp.Buckets[i].Tokens < resp.Buckets[j].Tokens
+	})
+
+	if len(resp.Buckets) > maxRatelimitStatusBuckets {
+		resp.Buckets = resp.Buckets[:maxRatelimitStatusBuckets]
+	}
+
+	return resp
+}
+
+// handleRatelimitStatus is the handler for the GET /control/ratelimit/status
+// HTTP API.
+func (s *Server) handleRatelimitStatus(w http.ResponseWriter, r *http.Request) {
+	s.serverLock.RLock()
+	rl := s.ratelimiter
+	s.serverLock.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(rl.status())
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "encoding response: %s", err)
+	}
+}
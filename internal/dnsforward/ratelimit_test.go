@@ -0,0 +1,120 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRatelimiter(t *testing.T) {
+	rl, err := newRatelimiter(&FilteringConfig{})
+	require.NoError(t, err)
+
+	assert.Nil(t, rl)
+	assert.False(t, rl.isLimited(proxy.ProtoUDP, net.IP{192, 0, 2, 1}, "", "example.org"))
+
+	_, err = newRatelimiter(&FilteringConfig{
+		Ratelimit:          1,
+		RatelimitWhitelist: []string{"bad"},
+	})
+	assert.Error(t, err)
+
+	_, err = newRatelimiter(&FilteringConfig{
+		Ratelimit:              1,
+		RatelimitSubnetLenIPv4: 33,
+	})
+	assert.Error(t, err)
+}
+
+func TestRatelimiter_isLimited(t *testing.T) {
+	rl, err := newRatelimiter(&FilteringConfig{
+		Ratelimit:              2,
+		RatelimitWhitelist:     []string{"192.0.2.2"},
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 56,
+	})
+	require.NoError(t, err)
+
+	ip, neighbour := net.IP{192, 0, 2, 1}, net.IP{192, 0, 2, 3}
+	allowed, other := net.IP{192, 0, 2, 2}, net.IP{198, 51, 100, 1}
+
+	assert.False(t, rl.isLimited(proxy.ProtoUDP, ip, "", "a.example"))
+	assert.False(t, rl.isLimited(proxy.ProtoUDP, neighbour, "", "b.example"))
+	assert.True(t, rl.isLimited(proxy.ProtoUDP, ip, "", "c.example"))
+
+	// Plain TCP is never limited.
+	assert.False(t, rl.isLimited(proxy.ProtoTCP, ip, "", "a.example"))
+
+	assert.False(t, rl.isLimited(proxy.ProtoUDP, other, "", "a.example"))
+	assert.False(t, rl.isLimited(proxy.ProtoQUIC, ip, "phone", "a.example"))
+
+	for i := 0; i < 3; i++ {
+		assert.False(t, rl.isLimited(proxy.ProtoUDP, allowed, "", "a.example"))
+	}
+
+	// Refill the bucket.
+	rl.clients["192.0.2.0/24"].last = time.Now().Add(-time.Second)
+	assert.False(t, rl.isLimited(proxy.ProtoUDP, ip, "", "a.example"))
+
+	st := rl.status()
+	require.True(t, st.Enabled)
+	require.NotEmpty(t, st.Buckets)
+
+	assert.Equal(t, "192.0.2.0/24", st.Buckets[0].Client)
+	assert.Equal(t, uint64(1), st.Buckets[0].Limited)
+}
+
+func TestRatelimiter_isLimited_perDomain(t *testing.T) {
+	rl, err := newRatelimiter(&FilteringConfig{
+		Ratelimit:          10,
+		RatelimitPerDomain: 1,
+	})
+	require.NoError(t, err)
+
+	ip := net.IP{192, 0, 2, 1}
+
+	assert.False(t, rl.isLimited(proxy.ProtoUDP, ip, "", "a.example"))
+	assert.True(t, rl.isLimited(proxy.ProtoUDP, ip, "", "A.example"))
+	assert.False(t, rl.isLimited(proxy.ProtoUDP, ip, "", "b.example"))
+
+	// The request limited by the domain bucket doesn't take the client's
+	// token.
+	assert.InDelta(t, 8, rl.clients["192.0.2.1/32"].tokens, 0.1)
+}
+
+func TestServer_preBlockedResponse_truncate(t *testing.T) {
+	s := &Server{}
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	pctx := &proxy.DNSContext{
+		Proto: proxy.ProtoUDP,
+		Req:   req,
+	}
+
+	reply, err := s.preBlockedResponse(pctx, ErrorResponseModeTruncate, dns.ExtendedErrorCodeOther, "")
+	require.NoError(t, err)
+	require.True(t, reply)
+	require.NotNil(t, pctx.Res)
+
+	assert.True(t, pctx.Res.Truncated)
+	assert.Equal(t, dns.RcodeSuccess, pctx.Res.Rcode)
+	assert.Empty(t, pctx.Res.Answer)
+
+	pctx = &proxy.DNSContext{
+		Proto: proxy.ProtoHTTPS,
+		Req:   req,
+	}
+
+	reply, err = s.preBlockedResponse(pctx, ErrorResponseModeTruncate, dns.ExtendedErrorCodeOther, "")
+	require.NoError(t, err)
+	require.True(t, reply)
+	require.NotNil(t, pctx.Res)
+
+	assert.False(t, pctx.Res.Truncated)
+	assert.Equal(t, dns.RcodeRefused, pctx.Res.Rcode)
+}
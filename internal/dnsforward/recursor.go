@@ -0,0 +1,654 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// rootHints are the IPv4 and IPv6 addresses of the root name servers.  See
+// https://www.iana.org/domains/root/servers.
+var rootHints = []string{
+	"198.41.0.4",
+	"2001:503:ba3e::2:30",
+	"170.247.170.2",
+	"2801:1b8:10::b",
+	"192.33.4.12",
+	"2001:500:2::c",
+	"199.7.91.13",
+	"2001:500:2d::d",
+	"192.203.230.10",
+	"2001:500:a8::e",
+	"192.5.5.241",
+	"2001:500:2f::f",
+	"192.112.36.4",
+	"2001:500:12::d0d",
+	"198.97.190.53",
+	"2001:500:1::53",
+	"192.36.148.17",
+	"2001:7fe::53",
+	"192.58.128.30",
+	"2001:503:c27::2:30",
+	"193.0.14.129",
+	"2001:7fd::1",
+	"199.7.83.42",
+	"2001:500:9f::42",
+	"202.12.27.33",
+	"2001:dc3::35",
+}
+
+const (
+	// recursorMaxReferrals is the maximum number of the referrals followed
+	// while resolving a single name.
+	recursorMaxReferrals = 16
+
+	// recursorMaxDepth is the maximum depth of the nested resolutions of the
+	// CNAME targets and the addresses of the name servers.
+	recursorMaxDepth = 6
+
+	// recursorMaxNSLookups is the maximum number of the name servers without
+	// glue, addresses of which are resolved for a single referral.
+	recursorMaxNSLookups = 3
+
+	// recursorUDPSize is the EDNS UDP payload size advertised to the
+	// authoritative servers.  See https://dnsflagday.net/2020.
+	recursorUDPSize = 1232
+
+	// recursorMaxDelegations is the maximum number of the cached
+	// delegations.
+	recursorMaxDelegations = 10_000
+
+	// recursorMaxDelegationTTL is the maximum time a delegation is cached.
+	recursorMaxDelegationTTL = 24 * time.Hour
+
+	// recursorMaxMinimizeSteps is the maximum number of the minimized
+	// requests sent while resolving a single name.  The full name is sent
+	// after that.  See RFC 9156, section 2.3.
+	recursorMaxMinimizeSteps = 10
+
+	// recursorAttemptDelay is the time after which the request is sent to
+	// the next name server of a zone if the previous one hasn't responded
+	// yet.
+	recursorAttemptDelay = 250 * time.Millisecond
+)
+
+// delegation is a cached set of the addresses of the name servers of a zone.
+type delegation struct {
+	// expire is the time when the delegation must be looked up again.
+	expire time.Time
+
+	// addrs are the addresses of the name servers with ports.
+	addrs []string
+}
+
+// recursor is an upstream, which resolves the requests iteratively starting
+// from the root name servers instead of forwarding them.  It's DNSSEC-aware in
+// that it requests and returns the DNSSEC records to the clients, which set
+// the DO bit, so that they can validate them.  The chain of trust itself is
+// validated by dnssecValidator when the DNSSEC validation is enabled.
+type recursor struct {
+	// exchange sends req to the server at addr.
+	exchange func(req *dns.Msg, addr string) (resp *dns.Msg, err error)
+
+	// mu protects delegations.
+	mu *sync.Mutex
+
+	// delegations are the cached delegations by the lowercased FQDNs of
+	// their zones.
+	delegations map[string]*delegation
+
+	// roots are the addresses of the root name servers with ports.
+	roots []string
+
+	// timeout is the timeout of a single exchange.
+	timeout time.Duration
+
+	// minimize, if true, makes the recursor only send the authoritative
+	// servers as many labels of the name as necessary to find the next
+	// delegation.  See RFC 9156.
+	minimize bool
+}
+
+// type check
+var _ upstream.Upstream = (*recursor)(nil)
+
+// newRecursor returns a new recursor using the root hints.  timeout is the
+// timeout of each exchange with an authoritative server.
+func newRecursor(timeout time.Duration) (r *recursor) {
+	r = &recursor{
+		mu:          &sync.Mutex{},
+		delegations: map[string]*delegation{},
+		timeout:     timeout,
+	}
+
+	for _, ip := range rootHints {
+		r.roots = append(r.roots, netutil.JoinHostPort(ip, 53))
+	}
+
+	r.exchange = r.exchangeNet
+
+	return r
+}
+
+// Address implements the upstream.Upstream interface for *recursor.
+func (r *recursor) Address() (addr string) {
+	return "recursive"
+}
+
+// Close implements the upstream.Upstream interface for *recursor.
+func (r *recursor) Close() (err error) {
+	return nil
+}
+
+// Exchange implements the upstream.Upstream interface for *recursor.
+func (r *recursor) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	if len(req.Question) != 1 {
+		return nil, errors.Error("recursor: exactly one question required")
+	}
+
+	q := req.Question[0]
+	res, err := r.resolve(q, 0)
+	if err != nil {
+		return nil, fmt.Errorf("recursor: resolving %q: %w", q.Name, err)
+	}
+
+	resp = (&dns.Msg{}).SetReply(req)
+	resp.RecursionAvailable = true
+	resp.Rcode = res.Rcode
+	resp.Answer = res.Answer
+	resp.Ns = res.Ns
+
+	opt := req.IsEdns0()
+	if opt != nil {
+		resp.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+
+	if opt == nil || !opt.Do() {
+		resp.Answer = withoutDNSSEC(resp.Answer, q.Qtype)
+		resp.Ns = withoutDNSSEC(resp.Ns, q.Qtype)
+	}
+
+	return resp, nil
+}
+
+// withoutDNSSEC returns rrs without the DNSSEC records, except for the ones of
+// qtype.
+func withoutDNSSEC(rrs []dns.RR, qtype uint16) (filtered []dns.RR) {
+	for _, rr := range rrs {
+		switch t := rr.Header().Rrtype; t {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			if t != qtype {
+				continue
+			}
+		}
+
+		filtered = append(filtered, rr)
+	}
+
+	return filtered
+}
+
+// resolve resolves q iteratively.  depth is the depth of the nested
+// resolutions.
+func (r *recursor) resolve(q dns.Question, depth int) (resp *dns.Msg, err error) {
+	if depth > recursorMaxDepth {
+		return nil, errors.Error("resolution is too deep")
+	}
+
+	name := strings.ToLower(q.Name)
+	zone, servers := r.closestDelegation(name)
+
+	// known is the number of the labels of name, which are known to be
+	// within zone.
+	known := dns.CountLabel(zone)
+	steps := 0
+	for i := 0; i < recursorMaxReferrals; {
+		sq, minimized := q, false
+		if r.minimize && steps < recursorMaxMinimizeSteps && known+1 < dns.CountLabel(name) {
+			sq, minimized = minimizedQuestion(q, name, known+1), true
+			steps++
+		}
+
+		resp, err = r.queryServers(servers, sq)
+		if err == nil {
+			dropOutOfBailiwick(resp, zone)
+		}
+
+		if minimized && (err != nil || !isNoErrorOrNXDomain(resp.Rcode)) {
+			// Some servers handle the minimized requests poorly, so send
+			// them the full name instead.  See RFC 9156, section 2.3.
+			log.Debug("recursor: minimized request for %q failed, sending full name", sq.Name)
+			steps = recursorMaxMinimizeSteps
+
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("querying servers of %q: %w", zone, err)
+		}
+
+		if minimized && resp.Rcode == dns.RcodeNameError {
+			// There is nothing below a nonexistent name.  See RFC 8020.
+			return resp, nil
+		} else if !minimized && (resp.Rcode != dns.RcodeSuccess || len(resp.Answer) > 0) {
+			return r.followCNAME(q, resp, depth)
+		}
+
+		next, nsNames, ttl := referral(resp, zone, name)
+		if next == "" {
+			if minimized {
+				// The name isn't a zone cut, so add the next label.
+				known++
+
+				continue
+			}
+
+			// There is no data of the type for the name.
+			return resp, nil
+		}
+
+		servers = glueAddrs(resp, next, nsNames)
+		if len(servers) == 0 {
+			servers = r.resolveNS(nsNames, depth)
+		}
+
+		if len(servers) == 0 {
+			return nil, fmt.Errorf("no addresses of name servers of %q", next)
+		}
+
+		r.setDelegation(next, servers, ttl)
+		zone, known = next, dns.CountLabel(next)
+		i++
+	}
+
+	return nil, errors.Error("too many referrals")
+}
+
+// dropOutOfBailiwick removes the records, which the servers of zone aren't
+// authoritative for, from the answer and the authority sections of resp, so
+// that a server can't inject the records of other zones, for example the ones
+// of a CNAME target.  The glue is checked separately by glueAddrs.
+func dropOutOfBailiwick(resp *dns.Msg, zone string) {
+	resp.Answer = inBailiwick(resp.Answer, zone)
+	resp.Ns = inBailiwick(resp.Ns, zone)
+}
+
+// inBailiwick returns the records of rrs with the owner names within zone.
+func inBailiwick(rrs []dns.RR, zone string) (filtered []dns.RR) {
+	for _, rr := range rrs {
+		name := rr.Header().Name
+		if !dns.IsSubDomain(zone, strings.ToLower(name)) {
+			log.Debug("recursor: dropping %q out of bailiwick of %q", name, zone)
+
+			continue
+		}
+
+		filtered = append(filtered, rr)
+	}
+
+	return filtered
+}
+
+// isNoErrorOrNXDomain returns true if rcode is either NOERROR or NXDOMAIN.
+func isNoErrorOrNXDomain(rcode int) (ok bool) {
+	return rcode == dns.RcodeSuccess || rcode == dns.RcodeNameError
+}
+
+// minimizedQuestion returns the question for the last labels labels of name
+// sent instead of q in the QNAME minimization mode.  The type A is used, since
+// some servers respond to the requests of type NS incorrectly.  See RFC 9156,
+// section 3.
+func minimizedQuestion(q dns.Question, name string, labels int) (mq dns.Question) {
+	idx := dns.Split(name)
+
+	return dns.Question{
+		Name:   name[idx[len(idx)-labels]:],
+		Qtype:  dns.TypeA,
+		Qclass: q.Qclass,
+	}
+}
+
+// followCNAME resolves the target of the CNAME chain in resp, if it doesn't
+// contain the records of the requested type for it.
+func (r *recursor) followCNAME(q dns.Question, resp *dns.Msg, depth int) (res *dns.Msg, err error) {
+	if q.Qtype == dns.TypeCNAME || resp.Rcode != dns.RcodeSuccess {
+		return resp, nil
+	}
+
+	target := strings.ToLower(q.Name)
+	for i := 0; i <= len(resp.Answer); i++ {
+		next := ""
+		for _, rr := range resp.Answer {
+			if c, ok := rr.(*dns.CNAME); ok && strings.EqualFold(c.Hdr.Name, target) {
+				next = strings.ToLower(c.Target)
+
+				break
+			}
+		}
+
+		if next == "" {
+			break
+		}
+
+		target = next
+	}
+
+	if target == strings.ToLower(q.Name) {
+		return resp, nil
+	}
+
+	for _, rr := range resp.Answer {
+		if h := rr.Header(); strings.EqualFold(h.Name, target) && h.Rrtype == q.Qtype {
+			return resp, nil
+		}
+	}
+
+	sub, err := r.resolve(dns.Question{Name: target, Qtype: q.Qtype, Qclass: q.Qclass}, depth+1)
+	if err != nil {
+		return nil, fmt.Errorf("following cname to %q: %w", target, err)
+	}
+
+	resp.Answer = append(resp.Answer, sub.Answer...)
+	resp.Ns = sub.Ns
+	resp.Rcode = sub.Rcode
+
+	return resp, nil
+}
+
+// referral returns the delegated zone, which is closer to name than zone, and
+// the names of its name servers from the authority section of resp.  next is
+// empty if resp isn't a referral.  ttl is the minimum TTL of the NS records.
+func referral(resp *dns.Msg, zone, name string) (next string, nsNames []string, ttl uint32) {
+	for _, rr := range resp.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+
+		owner := strings.ToLower(ns.Hdr.Name)
+		if next == "" {
+			// Only follow the referrals going down the tree to prevent
+			// loops.
+			if dns.CountLabel(owner) <= dns.CountLabel(zone) ||
+				!dns.IsSubDomain(zone, owner) ||
+				!dns.IsSubDomain(owner, name) {
+				continue
+			}
+
+			next, ttl = owner, ns.Hdr.Ttl
+		} else if owner != next {
+			continue
+		}
+
+		if ns.Hdr.Ttl < ttl {
+			ttl = ns.Hdr.Ttl
+		}
+
+		nsNames = append(nsNames, strings.ToLower(ns.Ns))
+	}
+
+	return next, nsNames, ttl
+}
+
+// glueAddrs returns the addresses of nsNames from the additional section of
+// resp.  Only the glue for the names within zone is accepted, since the
+// servers of the parent zone aren't authoritative for the others.
+func glueAddrs(resp *dns.Msg, zone string, nsNames []string) (addrs []string) {
+	for _, rr := range resp.Extra {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+
+		name := strings.ToLower(rr.Header().Name)
+		if !dns.IsSubDomain(zone, name) || !containsName(nsNames, name) {
+			continue
+		}
+
+		addrs = append(addrs, netutil.JoinHostPort(ip.String(), 53))
+	}
+
+	return addrs
+}
+
+// containsName returns true if names contains name.
+func containsName(names []string, name string) (ok bool) {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolveNS resolves the addresses of the first of nsNames, which have them.
+func (r *recursor) resolveNS(nsNames []string, depth int) (addrs []string) {
+	for i, ns := range nsNames {
+		if i >= recursorMaxNSLookups {
+			break
+		}
+
+		q := dns.Question{Name: dns.Fqdn(ns), Qtype: dns.TypeA, Qclass: dns.ClassINET}
+		resp, err := r.resolve(q, depth+1)
+		if err != nil {
+			log.Debug("recursor: resolving name server %q: %s", ns, err)
+
+			continue
+		}
+
+		for _, rr := range resp.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				addrs = append(addrs, netutil.JoinHostPort(a.A.String(), 53))
+			}
+		}
+
+		if len(addrs) > 0 {
+			return addrs
+		}
+	}
+
+	return nil
+}
+
+// closestDelegation returns the closest enclosing zone of name with cached
+// name servers and their addresses.  If there is none, it returns the root
+// zone and the root servers.
+func (r *recursor) closestDelegation(name string) (zone string, addrs []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		zone = name[off:]
+		if d, ok := r.delegations[zone]; ok {
+			if now.Before(d.expire) {
+				return zone, d.addrs
+			}
+
+			delete(r.delegations, zone)
+		}
+	}
+
+	return ".", r.roots
+}
+
+// setDelegation caches the addresses of the name servers of zone for ttl
+// seconds.
+func (r *recursor) setDelegation(zone string, addrs []string, ttl uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.delegations) >= recursorMaxDelegations {
+		// Keep it simple and just start over.
+		r.delegations = map[string]*delegation{}
+	}
+
+	dur := time.Duration(ttl) * time.Second
+	if dur > recursorMaxDelegationTTL {
+		dur = recursorMaxDelegationTTL
+	}
+
+	r.delegations[zone] = &delegation{
+		expire: time.Now().Add(dur),
+		addrs:  addrs,
+	}
+}
+
+// queryResult is the result of a single request to a name server.
+type queryResult struct {
+	resp *dns.Msg
+	err  error
+}
+
+// queryServers sends a non-recursive request for q to servers until one of
+// them responds with something other than a server failure or a refusal.  The
+// requests are raced like the connection attempts of dialHappyEyeballs, so
+// that an unresponsive server or an unreachable address family only delays
+// the response by recursorAttemptDelay.
+func (r *recursor) queryServers(servers []string, q dns.Question) (resp *dns.Msg, err error) {
+	if len(servers) == 0 {
+		return nil, errors.Error("no servers")
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion(q.Name, q.Qtype)
+	req.Question[0].Qclass = q.Qclass
+	req.RecursionDesired = false
+	req.SetEdns0(recursorUDPSize, true)
+
+	servers = interleaveServers(servers)
+
+	// Buffer the results so that the requests still in progress after the
+	// response is received don't block.
+	results := make(chan queryResult, len(servers))
+	next, pending := 0, 0
+	start := func() {
+		addr := servers[next]
+		next++
+		pending++
+
+		go func() {
+			res := queryResult{err: fmt.Errorf("%s: no response", addr)}
+			defer func() { results <- res }()
+			defer log.OnPanic("recursor: querying " + addr)
+
+			res.resp, res.err = r.queryServer(req.Copy(), addr)
+		}()
+	}
+
+	start()
+
+	timer := time.NewTimer(recursorAttemptDelay)
+	defer timer.Stop()
+
+	var errs []error
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				return res.resp, nil
+			}
+
+			errs = append(errs, res.err)
+			if next < len(servers) {
+				// Don't wait for the delay if the previous request has
+				// already failed.
+				start()
+				resetTimer(timer, recursorAttemptDelay)
+			}
+		case <-timer.C:
+			if next < len(servers) {
+				start()
+				timer.Reset(recursorAttemptDelay)
+			}
+		}
+	}
+
+	return nil, errors.List("all servers failed", errs...)
+}
+
+// queryServer sends req to the server at addr and returns an error if it
+// responds with a server failure, a refusal, or to another question.
+func (r *recursor) queryServer(req *dns.Msg, addr string) (resp *dns.Msg, err error) {
+	resp, err = r.exchange(req, addr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", addr, err)
+	}
+
+	if len(resp.Question) != 1 || !strings.EqualFold(resp.Question[0].Name, req.Question[0].Name) {
+		return nil, fmt.Errorf("%s: question mismatch", addr)
+	}
+
+	if resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused {
+		return nil, fmt.Errorf("%s: rcode %s", addr, dns.RcodeToString[resp.Rcode])
+	}
+
+	return resp, nil
+}
+
+// interleaveServers returns addrs sorted so that the address families
+// alternate, starting with IPv6, like interleaveFamilies does.
+func interleaveServers(addrs []string) (sorted []string) {
+	var v4, v6 []string
+	for _, addr := range addrs {
+		host, _, err := net.SplitHostPort(addr)
+		if ip := net.ParseIP(host); err == nil && ip != nil && ip.To4() == nil {
+			v6 = append(v6, addr)
+		} else {
+			v4 = append(v4, addr)
+		}
+	}
+
+	sorted = make([]string, 0, len(addrs))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			sorted = append(sorted, v6[i])
+		}
+
+		if i < len(v4) {
+			sorted = append(sorted, v4[i])
+		}
+	}
+
+	return sorted
+}
+
+// exchangeNet sends req to the server at addr over UDP and retries over TCP,
+// if the response is truncated.
+func (r *recursor) exchangeNet(req *dns.Msg, addr string) (resp *dns.Msg, err error) {
+	c := &dns.Client{
+		Net:     "udp",
+		Timeout: r.timeout,
+		UDPSize: recursorUDPSize,
+	}
+
+	resp, _, err = c.Exchange(req, addr)
+	if err == nil && resp.Truncated {
+		c.Net = "tcp"
+		resp, _, err = c.Exchange(req, addr)
+	}
+
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, errors.Error("timeout")
+		}
+
+		return nil, err
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,408 @@
+package dnsforward
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRR is a helper that parses the resource record from s.
+func newTestRR(t *testing.T, s string) (rr dns.RR) {
+	t.Helper()
+
+	rr, err := dns.NewRR(s)
+	require.NoError(t, err)
+
+	return rr
+}
+
+// testZoneServer is a fake authoritative server.
+type testZoneServer struct {
+	// answers are the responses to the names.  The responses to the names
+	// missing from answers are taken from the closest enclosing zone in
+	// referrals.
+	answers map[string]func(resp *dns.Msg)
+
+	// referrals are the responses delegating the zones.
+	referrals map[string]func(resp *dns.Msg)
+}
+
+// newTestRecursor returns a recursor with a single root server resolving in
+// the fake hierarchy of servers.  queries counts the queries by the server
+// addresses.
+func newTestRecursor(t *testing.T, servers map[string]*testZoneServer) (r *recursor, queries map[string]int) {
+	t.Helper()
+
+	mu := &sync.Mutex{}
+	queries = map[string]int{}
+
+	r = newRecursor(time.Second)
+	r.roots = []string{"192.0.2.1:53"}
+	r.exchange = func(req *dns.Msg, addr string) (resp *dns.Msg, err error) {
+		mu.Lock()
+		queries[addr]++
+		mu.Unlock()
+
+		assert.False(t, req.RecursionDesired)
+
+		srv, ok := servers[addr]
+		if !ok {
+			return nil, errors.Error("no server")
+		}
+
+		resp = (&dns.Msg{}).SetReply(req)
+		name := strings.ToLower(req.Question[0].Name)
+		if a, ok := srv.answers[name]; ok {
+			a(resp)
+
+			return resp, nil
+		}
+
+		for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+			if ref, ok := srv.referrals[name[off:]]; ok {
+				ref(resp)
+
+				return resp, nil
+			}
+		}
+
+		resp.Rcode = dns.RcodeRefused
+
+		return resp, nil
+	}
+
+	return r, queries
+}
+
+func TestRecursor_Exchange(t *testing.T) {
+	servers := map[string]*testZoneServer{
+		"192.0.2.1:53": {
+			referrals: map[string]func(resp *dns.Msg){
+				"example.": func(resp *dns.Msg) {
+					resp.Ns = []dns.RR{newTestRR(t, "example. 3600 IN NS ns.example.")}
+					resp.Extra = []dns.RR{
+						newTestRR(t, "ns.example. 3600 IN A 192.0.2.2"),
+						// Out-of-bailiwick glue must be ignored.
+						newTestRR(t, "ns.other. 3600 IN A 192.0.2.66"),
+					}
+				},
+				"other.": func(resp *dns.Msg) {
+					resp.Ns = []dns.RR{newTestRR(t, "other. 3600 IN NS ns.other.")}
+					resp.Extra = []dns.RR{newTestRR(t, "ns.other. 3600 IN A 192.0.2.4")}
+				},
+			},
+		},
+		"192.0.2.2:53": {
+			answers: map[string]func(resp *dns.Msg){
+				"host.example.": func(resp *dns.Msg) {
+					resp.Authoritative = true
+					resp.Answer = []dns.RR{
+						newTestRR(t, "host.example. 60 IN A 192.0.2.100"),
+						newTestRR(t, "host.example. 60 IN RRSIG A 8 2 60 20300101000000 20200101000000 1 example. AAAA"),
+					}
+				},
+				"alias.example.": func(resp *dns.Msg) {
+					resp.Authoritative = true
+					resp.Answer = []dns.RR{newTestRR(t, "alias.example. 60 IN CNAME host.sub.other.")}
+				},
+				"poisoned.example.": func(resp *dns.Msg) {
+					resp.Authoritative = true
+					resp.Answer = []dns.RR{
+						newTestRR(t, "poisoned.example. 60 IN CNAME host.sub.other."),
+						// The out-of-bailiwick records must be ignored.
+						newTestRR(t, "host.sub.other. 60 IN A 192.0.2.66"),
+					}
+				},
+				"nx.example.": func(resp *dns.Msg) {
+					resp.Authoritative = true
+					resp.Rcode = dns.RcodeNameError
+					resp.Ns = []dns.RR{newTestRR(t, "example. 60 IN SOA ns.example. admin.example. 1 60 60 60 60")}
+				},
+			},
+			referrals: map[string]func(resp *dns.Msg){
+				// The name server of the delegated zone has no glue.
+				"sub.example.": func(resp *dns.Msg) {
+					resp.Ns = []dns.RR{newTestRR(t, "sub.example. 3600 IN NS ns.other.")}
+				},
+			},
+		},
+		"192.0.2.4:53": {
+			answers: map[string]func(resp *dns.Msg){
+				"ns.other.": func(resp *dns.Msg) {
+					resp.Authoritative = true
+					resp.Answer = []dns.RR{newTestRR(t, "ns.other. 60 IN A 192.0.2.4")}
+				},
+				"host.sub.example.": func(resp *dns.Msg) {
+					resp.Authoritative = true
+					resp.Answer = []dns.RR{newTestRR(t, "host.sub.example. 60 IN A 192.0.2.101")}
+				},
+				"host.sub.other.": func(resp *dns.Msg) {
+					resp.Authoritative = true
+					resp.Answer = []dns.RR{newTestRR(t, "host.sub.other. 60 IN A 192.0.2.102")}
+				},
+			},
+		},
+	}
+
+	testCases := []struct {
+		name      string
+		host      string
+		wantRcode int
+		wantIPs   []net.IP
+		wantLen   int
+		do        bool
+	}{{
+		name:      "glue",
+		host:      "host.example.",
+		wantRcode: dns.RcodeSuccess,
+		wantIPs:   []net.IP{{192, 0, 2, 100}},
+		wantLen:   1,
+		do:        false,
+	}, {
+		name:      "dnssec",
+		host:      "host.example.",
+		wantRcode: dns.RcodeSuccess,
+		wantIPs:   []net.IP{{192, 0, 2, 100}},
+		wantLen:   2,
+		do:        true,
+	}, {
+		name:      "glueless",
+		host:      "host.sub.example.",
+		wantRcode: dns.RcodeSuccess,
+		wantIPs:   []net.IP{{192, 0, 2, 101}},
+		wantLen:   1,
+		do:        false,
+	}, {
+		name:      "cname",
+		host:      "alias.example.",
+		wantRcode: dns.RcodeSuccess,
+		wantIPs:   []net.IP{{192, 0, 2, 102}},
+		wantLen:   2,
+		do:        false,
+	}, {
+		name:      "out_of_bailiwick",
+		host:      "poisoned.example.",
+		wantRcode: dns.RcodeSuccess,
+		wantIPs:   []net.IP{{192, 0, 2, 102}},
+		wantLen:   2,
+		do:        false,
+	}, {
+		name:      "nxdomain",
+		host:      "nx.example.",
+		wantRcode: dns.RcodeNameError,
+		wantIPs:   nil,
+		wantLen:   0,
+		do:        false,
+	}}
+
+	for _, minimize := range []bool{false, true} {
+		for _, tc := range testCases {
+			name := tc.name
+			if minimize {
+				name += "_minimized"
+			}
+
+			t.Run(name, func(t *testing.T) {
+				r, _ := newTestRecursor(t, servers)
+				r.minimize = minimize
+
+				req := (&dns.Msg{}).SetQuestion(tc.host, dns.TypeA)
+				req.SetEdns0(dns.DefaultMsgSize, tc.do)
+
+				resp, err := r.Exchange(req)
+				require.NoError(t, err)
+
+				assert.Equal(t, req.Id, resp.Id)
+				assert.Equal(t, tc.wantRcode, resp.Rcode)
+				assert.True(t, resp.RecursionAvailable)
+				assert.False(t, resp.AuthenticatedData)
+				require.Len(t, resp.Answer, tc.wantLen)
+
+				var ips []net.IP
+				for _, rr := range resp.Answer {
+					if a, ok := rr.(*dns.A); ok {
+						ips = append(ips, a.A.To4())
+					}
+				}
+
+				assert.Equal(t, tc.wantIPs, ips)
+			})
+		}
+	}
+
+	t.Run("delegation_cache", func(t *testing.T) {
+		r, queries := newTestRecursor(t, servers)
+
+		for i := 0; i < 3; i++ {
+			req := (&dns.Msg{}).SetQuestion("host.example.", dns.TypeA)
+			_, err := r.Exchange(req)
+			require.NoError(t, err)
+		}
+
+		assert.Equal(t, 1, queries["192.0.2.1:53"])
+		assert.Equal(t, 3, queries["192.0.2.2:53"])
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		r, _ := newTestRecursor(t, servers)
+
+		req := (&dns.Msg{}).SetQuestion("host.test.", dns.TypeA)
+		_, err := r.Exchange(req)
+		assert.Error(t, err)
+	})
+}
+
+func TestRecursor_minimize(t *testing.T) {
+	servers := map[string]*testZoneServer{
+		"192.0.2.1:53": {
+			referrals: map[string]func(resp *dns.Msg){
+				"example.": func(resp *dns.Msg) {
+					resp.Ns = []dns.RR{newTestRR(t, "example. 3600 IN NS ns.example.")}
+					resp.Extra = []dns.RR{newTestRR(t, "ns.example. 3600 IN A 192.0.2.2")}
+				},
+			},
+		},
+		"192.0.2.2:53": {
+			answers: map[string]func(resp *dns.Msg){
+				// An empty non-terminal.
+				"b.example.": func(resp *dns.Msg) {
+					resp.Authoritative = true
+				},
+				"a.b.example.": func(resp *dns.Msg) {
+					resp.Authoritative = true
+					resp.Answer = []dns.RR{newTestRR(t, "a.b.example. 60 IN TXT \"data\"")}
+				},
+				"nx.example.": func(resp *dns.Msg) {
+					resp.Authoritative = true
+					resp.Rcode = dns.RcodeNameError
+				},
+			},
+		},
+	}
+
+	r, _ := newTestRecursor(t, servers)
+	r.minimize = true
+
+	var seen []dns.Question
+	exchange := r.exchange
+	r.exchange = func(req *dns.Msg, addr string) (resp *dns.Msg, err error) {
+		seen = append(seen, req.Question[0])
+
+		return exchange(req, addr)
+	}
+
+	t.Run("success", func(t *testing.T) {
+		seen = nil
+
+		resp, err := r.Exchange((&dns.Msg{}).SetQuestion("a.b.example.", dns.TypeTXT))
+		require.NoError(t, err)
+		require.Len(t, resp.Answer, 1)
+
+		assert.Equal(t, []dns.Question{
+			{Name: "example.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+			{Name: "b.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+			{Name: "a.b.example.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET},
+		}, seen)
+	})
+
+	t.Run("nxdomain", func(t *testing.T) {
+		seen = nil
+
+		resp, err := r.Exchange((&dns.Msg{}).SetQuestion("a.nx.example.", dns.TypeA))
+		require.NoError(t, err)
+
+		assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+		require.Len(t, seen, 1)
+		assert.Equal(t, "nx.example.", seen[0].Name)
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		seen = nil
+
+		// The server refuses the request for the minimized name, since
+		// it's unknown.
+		_, err := r.Exchange((&dns.Msg{}).SetQuestion("a.b.c.example.", dns.TypeA))
+		assert.Error(t, err)
+
+		require.Len(t, seen, 2)
+		assert.Equal(t, "c.example.", seen[0].Name)
+		assert.Equal(t, "a.b.c.example.", seen[1].Name)
+	})
+}
+
+func TestReferral(t *testing.T) {
+	resp := &dns.Msg{
+		Ns: []dns.RR{
+			newTestRR(t, "example. 3600 IN NS a.ns.example."),
+			newTestRR(t, "example. 600 IN NS b.ns.example."),
+			newTestRR(t, "other. 600 IN NS ns.other."),
+		},
+	}
+
+	next, nsNames, ttl := referral(resp, ".", "host.example.")
+	assert.Equal(t, "example.", next)
+	assert.Equal(t, []string{"a.ns.example.", "b.ns.example."}, nsNames)
+	assert.Equal(t, uint32(600), ttl)
+
+	// Referrals up the tree or to the same zone mustn't be followed.
+	next, _, _ = referral(resp, "example.", "host.example.")
+	assert.Empty(t, next)
+
+	next, _, _ = referral(resp, "sub.example.", "host.sub.example.")
+	assert.Empty(t, next)
+}
+
+func TestRecursor_queryServers(t *testing.T) {
+	const (
+		v6Addr     = "[2001:db8::1]:53"
+		slowAddr   = "192.0.2.1:53"
+		answerAddr = "192.0.2.2:53"
+	)
+
+	q := dns.Question{Name: "example.", Qtype: dns.TypeNS, Qclass: dns.ClassINET}
+
+	// unblock makes the slow server respond after the test.
+	unblock := make(chan struct{})
+	t.Cleanup(func() { close(unblock) })
+
+	mu := &sync.Mutex{}
+	var queried []string
+
+	r := newRecursor(time.Second)
+	r.exchange = func(req *dns.Msg, addr string) (resp *dns.Msg, err error) {
+		mu.Lock()
+		queried = append(queried, addr)
+		mu.Unlock()
+
+		switch addr {
+		case v6Addr:
+			return nil, errors.Error("network is unreachable")
+		case slowAddr:
+			<-unblock
+		}
+
+		return (&dns.Msg{}).SetReply(req), nil
+	}
+
+	start := time.Now()
+	resp, err := r.queryServers([]string{slowAddr, answerAddr, v6Addr}, q)
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+
+	// The unreachable IPv6 server is queried first and the next one right
+	// after it fails, while the answering one is only queried after the
+	// delay.
+	assert.GreaterOrEqual(t, time.Since(start), recursorAttemptDelay)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.Equal(t, []string{v6Addr, slowAddr, answerAddr}, queried)
+}
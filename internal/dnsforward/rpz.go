@@ -0,0 +1,507 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+)
+
+// RPZConfig is the configuration of a single response policy zone.
+type RPZConfig struct {
+	// Zone is the name of the policy zone, for example "rpz.example.net".
+	Zone string `yaml:"zone"`
+
+	// Primary is the address of the primary server, from which the zone is
+	// transferred using AXFR and IXFR.  The port defaults to 53.
+	Primary string `yaml:"primary"`
+
+	// File is the path to the policy zone in the master file format.  Only
+	// one of Primary and File should be set.
+	File string `yaml:"file"`
+
+	// Refresh is the interval of the zone refresh.  If it's zero, the
+	// refresh interval from the SOA record of the zone is used.
+	Refresh timeutil.Duration `yaml:"refresh"`
+
+	// TSIGName is the name of the TSIG key used to sign the zone transfer
+	// requests.  The transfers are unsigned if it's empty.
+	TSIGName string `yaml:"tsig_name"`
+
+	// TSIGAlgorithm is the algorithm of the TSIG key, hmac-sha256 by
+	// default.
+	TSIGAlgorithm string `yaml:"tsig_algorithm"`
+
+	// TSIGSecret is the base64-encoded secret of the TSIG key.
+	TSIGSecret string `yaml:"tsig_secret"`
+}
+
+// validate returns an error if c isn't a valid response policy zone
+// configuration.
+func (c *RPZConfig) validate() (err error) {
+	switch {
+	case c == nil:
+		return errors.Error("no configuration")
+	case c.Zone == "":
+		return errors.Error("no zone name")
+	case (c.File == "") == (c.Primary == ""):
+		return fmt.Errorf("rpz %s: exactly one of file and primary must be set", c.Zone)
+	case c.File != "" && c.TSIGName != "":
+		return fmt.Errorf("rpz %s: tsig key can't be used with a file", c.Zone)
+	case c.TSIGName != "" && c.TSIGSecret == "":
+		return fmt.Errorf("rpz %s: no secret for tsig key %q", c.Zone, c.TSIGName)
+	case c.Refresh.Duration < 0:
+		return fmt.Errorf("rpz %s: negative refresh interval %s", c.Zone, c.Refresh)
+	default:
+		return nil
+	}
+}
+
+// rpzAction is the action of a response policy.
+type rpzAction uint8
+
+// rpzAction values.
+const (
+	// rpzActionNXDOMAIN responds with NXDOMAIN.  It's encoded as a CNAME to
+	// the root domain.
+	rpzActionNXDOMAIN rpzAction = iota
+
+	// rpzActionNODATA responds with an empty answer.  It's encoded as a
+	// CNAME to the wildcard of the root domain.
+	rpzActionNODATA
+
+	// rpzActionPassthru stops the policy processing and lets the response
+	// through.
+	rpzActionPassthru
+
+	// rpzActionDrop doesn't respond at all.
+	rpzActionDrop
+
+	// rpzActionTCPOnly makes the clients using plain DNS over UDP to retry
+	// over TCP.
+	rpzActionTCPOnly
+
+	// rpzActionLocalData responds with the records of the policy.
+	rpzActionLocalData
+)
+
+// String implements the fmt.Stringer interface for rpzAction.
+func (a rpzAction) String() (s string) {
+	switch a {
+	case rpzActionNXDOMAIN:
+		return "nxdomain"
+	case rpzActionNODATA:
+		return "nodata"
+	case rpzActionPassthru:
+		return "passthru"
+	case rpzActionDrop:
+		return "drop"
+	case rpzActionTCPOnly:
+		return "tcp-only"
+	case rpzActionLocalData:
+		return "local-data"
+	default:
+		return fmt.Sprintf("!bad_rpz_action_%d", a)
+	}
+}
+
+// Special labels and targets of the response policy zones.
+const (
+	rpzLabelClientIP = "rpz-client-ip"
+	rpzLabelIP       = "rpz-ip"
+	rpzLabelNSDName  = "rpz-nsdname"
+	rpzLabelNSIP     = "rpz-nsip"
+
+	rpzTargetPassthru = "rpz-passthru."
+	rpzTargetDrop     = "rpz-drop."
+	rpzTargetTCPOnly  = "rpz-tcp-only."
+)
+
+// rpzPolicy is a single policy of a response policy zone.
+type rpzPolicy struct {
+	// owner is the owner name of the policy records.  It's used as the rule
+	// text in the query log.
+	owner string
+
+	// data are the records of the local data policy.  If it's a CNAME, it's
+	// the only record.
+	data []dns.RR
+
+	action rpzAction
+}
+
+// rule returns the text describing p for the query log.
+func (p *rpzPolicy) rule() (text string) {
+	return p.owner + " " + p.action.String()
+}
+
+// newRPZPolicy creates a policy from the records with the same owner name.
+func newRPZPolicy(owner string, rrs []dns.RR) (p *rpzPolicy) {
+	p = &rpzPolicy{
+		owner:  owner,
+		action: rpzActionLocalData,
+	}
+
+	for _, rr := range rrs {
+		cname, ok := rr.(*dns.CNAME)
+		if !ok {
+			continue
+		}
+
+		switch strings.ToLower(cname.Target) {
+		case ".":
+			p.action = rpzActionNXDOMAIN
+		case "*.":
+			p.action = rpzActionNODATA
+		case rpzTargetPassthru:
+			p.action = rpzActionPassthru
+		case rpzTargetDrop:
+			p.action = rpzActionDrop
+		case rpzTargetTCPOnly:
+			p.action = rpzActionTCPOnly
+		default:
+			p.data = []dns.RR{cname}
+		}
+
+		return p
+	}
+
+	p.data = rrs
+
+	return p
+}
+
+// rpzNames is a set of the names with policies.
+type rpzNames struct {
+	// exact are the policies for the names themselves.
+	exact map[string]*rpzPolicy
+
+	// wildcards are the policies for the subdomains of the names.
+	wildcards map[string]*rpzPolicy
+}
+
+// add adds the policy for name, which must be lowercased and fully qualified.
+// name may be a wildcard.
+func (ns *rpzNames) add(name string, p *rpzPolicy) {
+	if name == "*." {
+		ns.wildcards["."] = p
+	} else if strings.HasPrefix(name, "*.") {
+		ns.wildcards[name[2:]] = p
+	} else {
+		ns.exact[name] = p
+	}
+}
+
+// match returns the policy for name, which must be lowercased and fully
+// qualified.  The closer wildcards have a higher priority.
+func (ns *rpzNames) match(name string) (p *rpzPolicy) {
+	if p = ns.exact[name]; p != nil {
+		return p
+	}
+
+	for name != "." {
+		i := strings.IndexByte(name, '.')
+		name = name[i+1:]
+		if name == "" {
+			name = "."
+		}
+
+		if p = ns.wildcards[name]; p != nil {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// len returns the number of policies in ns.
+func (ns *rpzNames) len() (n int) {
+	return len(ns.exact) + len(ns.wildcards)
+}
+
+// newRPZNames returns a new empty set of the names with policies.
+func newRPZNames() (ns *rpzNames) {
+	return &rpzNames{
+		exact:     map[string]*rpzPolicy{},
+		wildcards: map[string]*rpzPolicy{},
+	}
+}
+
+// rpzNets is a set of the IP networks with policies.  The IPv4 networks are
+// stored as their IPv4-mapped IPv6 forms.
+type rpzNets struct {
+	// nets are the policies for the networks by their prefix lengths and
+	// masked addresses.
+	nets map[int]map[string]*rpzPolicy
+
+	// lens are the prefix lengths of nets in the descending order.
+	lens []int
+}
+
+// add adds the policy for n.
+func (ns *rpzNets) add(n *net.IPNet, p *rpzPolicy) {
+	ones, bits := n.Mask.Size()
+	if bits == net.IPv4len*8 {
+		ones += (net.IPv6len - net.IPv4len) * 8
+	}
+
+	byLen := ns.nets[ones]
+	if byLen == nil {
+		byLen = map[string]*rpzPolicy{}
+		ns.nets[ones] = byLen
+
+		ns.lens = append(ns.lens, ones)
+		sort.Sort(sort.Reverse(sort.IntSlice(ns.lens)))
+	}
+
+	masked := n.IP.To16().Mask(net.CIDRMask(ones, net.IPv6len*8))
+	byLen[string(masked)] = p
+}
+
+// match returns the policy for the longest network containing ip.
+func (ns *rpzNets) match(ip net.IP) (p *rpzPolicy) {
+	ip = ip.To16()
+	if ip == nil {
+		return nil
+	}
+
+	for _, l := range ns.lens {
+		masked := ip.Mask(net.CIDRMask(l, net.IPv6len*8))
+		if p = ns.nets[l][string(masked)]; p != nil {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// len returns the number of policies in ns.
+func (ns *rpzNets) len() (n int) {
+	for _, byLen := range ns.nets {
+		n += len(byLen)
+	}
+
+	return n
+}
+
+// newRPZNets returns a new empty set of the IP networks with policies.
+func newRPZNets() (ns *rpzNets) {
+	return &rpzNets{
+		nets: map[int]map[string]*rpzPolicy{},
+	}
+}
+
+// rpzZone is a parsed response policy zone.  The policies of different
+// triggers are checked in the order of the fields.
+type rpzZone struct {
+	clientIPs *rpzNets
+	qnames    *rpzNames
+	ips       *rpzNets
+	nsdnames  *rpzNames
+	nsIPs     *rpzNets
+
+	// name is the lowercased and fully qualified name of the zone.
+	name string
+
+	// serial is the serial number of the zone from its SOA record.
+	serial uint32
+}
+
+// newRPZZone parses the policies of the zone with name from its records.  The
+// records with invalid triggers are skipped.
+func newRPZZone(name string, rrs []dns.RR) (z *rpzZone, skipped int) {
+	z = &rpzZone{
+		clientIPs: newRPZNets(),
+		qnames:    newRPZNames(),
+		ips:       newRPZNets(),
+		nsdnames:  newRPZNames(),
+		nsIPs:     newRPZNets(),
+		name:      dns.CanonicalName(name),
+	}
+
+	var owners []string
+	byOwner := map[string][]dns.RR{}
+	for _, rr := range rrs {
+		owner := dns.CanonicalName(rr.Header().Name)
+		if owner == z.name {
+			if soa, ok := rr.(*dns.SOA); ok {
+				z.serial = soa.Serial
+			}
+
+			// Skip the SOA and NS records of the apex.
+			continue
+		}
+
+		if _, ok := byOwner[owner]; !ok {
+			owners = append(owners, owner)
+		}
+
+		byOwner[owner] = append(byOwner[owner], rr)
+	}
+
+	for _, owner := range owners {
+		if err := z.add(owner, byOwner[owner]); err != nil {
+			skipped++
+		}
+	}
+
+	return z, skipped
+}
+
+// add adds the policy with records rrs by the trigger encoded in owner.
+func (z *rpzZone) add(owner string, rrs []dns.RR) (err error) {
+	trigger := strings.TrimSuffix(owner, z.name)
+	if trigger == owner || !strings.HasSuffix(trigger, ".") {
+		return fmt.Errorf("%s is outside of the zone", owner)
+	}
+
+	p := newRPZPolicy(owner, rrs)
+	trigger = trigger[:len(trigger)-1]
+	i := strings.LastIndexByte(trigger, '.')
+	label, rest := trigger[i+1:], ""
+	if i >= 0 {
+		rest = trigger[:i]
+	}
+
+	var nets *rpzNets
+	switch label {
+	case rpzLabelClientIP:
+		nets = z.clientIPs
+	case rpzLabelIP:
+		nets = z.ips
+	case rpzLabelNSIP:
+		nets = z.nsIPs
+	case rpzLabelNSDName:
+		z.nsdnames.add(dns.Fqdn(rest), p)
+
+		return nil
+	default:
+		z.qnames.add(trigger+".", p)
+
+		return nil
+	}
+
+	n, err := parseRPZNet(rest)
+	if err != nil {
+		return err
+	}
+
+	nets.add(n, p)
+
+	return nil
+}
+
+// parseRPZNet parses the IP network encoded as the prefix length followed by
+// the reversed labels of the address, for example "24.0.2.0.192" for
+// 192.0.2.0/24.  The zero groups of IPv6 addresses may be replaced with "zz"
+// the same way they're replaced with "::", for example "64.zz.db8.2001" for
+// 2001:db8::/64.
+func parseRPZNet(s string) (n *net.IPNet, err error) {
+	labels := strings.Split(s, ".")
+	if len(labels) < 2 {
+		return nil, fmt.Errorf("bad ip trigger %q", s)
+	}
+
+	ones, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return nil, fmt.Errorf("bad prefix length in ip trigger %q: %w", s, err)
+	}
+
+	labels = labels[1:]
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+
+	var ip net.IP
+	bits := net.IPv6len * 8
+	if len(labels) == net.IPv4len && !strings.Contains(s, "zz") {
+		ip, bits = net.ParseIP(strings.Join(labels, ".")).To4(), net.IPv4len*8
+	} else {
+		addr := strings.ReplaceAll(strings.Join(labels, ":"), "zz", "")
+		if strings.HasPrefix(addr, ":") {
+			addr = ":" + addr
+		}
+
+		if strings.HasSuffix(addr, ":") {
+			addr += ":"
+		}
+
+		if ip = net.ParseIP(addr); ip != nil && ip.To4() != nil {
+			ip = nil
+		}
+	}
+
+	if ip == nil || ones < 1 || ones > bits {
+		return nil, fmt.Errorf("bad ip trigger %q", s)
+	}
+
+	mask := net.CIDRMask(ones, bits)
+
+	return &net.IPNet{
+		IP:   ip.Mask(mask),
+		Mask: mask,
+	}, nil
+}
+
+// len returns the number of policies in z.
+func (z *rpzZone) len() (n int) {
+	return z.clientIPs.len() +
+		z.qnames.len() +
+		z.ips.len() +
+		z.nsdnames.len() +
+		z.nsIPs.len()
+}
+
+// hasNSTriggers returns true if z contains the policies, which require the
+// lookup of the authoritative nameservers.
+func (z *rpzZone) hasNSTriggers() (ok bool) {
+	return z.nsdnames.len() > 0 || z.nsIPs.len() > 0
+}
+
+// matchRequest returns the policy for the request for qname from the client
+// with ip.  qname must be lowercased and fully qualified.
+func (z *rpzZone) matchRequest(qname string, ip net.IP) (p *rpzPolicy) {
+	if ip != nil {
+		if p = z.clientIPs.match(ip); p != nil {
+			return p
+		}
+	}
+
+	return z.qnames.match(qname)
+}
+
+// matchAnswer returns the policy for the first of the IP addresses from the
+// answer matching any.
+func (z *rpzZone) matchAnswer(ips []net.IP) (p *rpzPolicy) {
+	for _, ip := range ips {
+		if p = z.ips.match(ip); p != nil {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// matchNS returns the policy for the first of the authoritative nameservers of
+// the domain matching either by name or by address.  nss and nsIPs must be
+// lowercased and fully qualified.
+func (z *rpzZone) matchNS(nss []string, nsIPs []net.IP) (p *rpzPolicy) {
+	for _, ns := range nss {
+		if p = z.nsdnames.match(ns); p != nil {
+			return p
+		}
+	}
+
+	for _, ip := range nsIPs {
+		if p = z.nsIPs.match(ip); p != nil {
+			return p
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,476 @@
+package dnsforward
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRPZZone is the response policy zone used in tests.
+const testRPZZone = `$TTL 300
+@ SOA ns.rpz.test. admin.rpz.test. 1 3600 600 86400 60
+@ NS ns.rpz.test.
+nx.example CNAME .
+nodata.example CNAME *.
+*.wild.example CNAME .
+pass.wild.example CNAME rpz-passthru.
+drop.example CNAME rpz-drop.
+tcp.example CNAME rpz-tcp-only.
+local.example A 192.0.2.1
+local.example AAAA 2001:db8::1
+redirect.example CNAME safe.example.org.
+garden.example CNAME *.walled.example.org.
+32.10.2.0.192.rpz-client-ip CNAME .
+24.0.100.51.198.rpz-ip CNAME .
+48.zz.db8.2001.rpz-ip CNAME .
+ns.bad.example.rpz-nsdname CNAME .
+*.evil.example.rpz-nsdname CNAME .
+32.53.0.0.10.rpz-nsip CNAME .
+bad.rpz-ip CNAME .
+`
+
+// parseTestZone parses the records of the zone with name from text.
+func parseTestZone(t *testing.T, name, text string) (rrs []dns.RR) {
+	t.Helper()
+
+	zp := dns.NewZoneParser(strings.NewReader(text), name, "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+	require.NoError(t, zp.Err())
+
+	return rrs
+}
+
+// newTestRPZZone returns testRPZZone parsed.
+func newTestRPZZone(t *testing.T) (z *rpzZone) {
+	t.Helper()
+
+	z, skipped := newRPZZone("rpz.test", parseTestZone(t, "rpz.test.", testRPZZone))
+	require.Equal(t, 1, skipped)
+
+	return z
+}
+
+func TestParseRPZNet(t *testing.T) {
+	testCases := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{{
+		name:    "ipv4",
+		in:      "24.0.2.0.192",
+		want:    "192.0.2.0/24",
+		wantErr: false,
+	}, {
+		name:    "ipv4_host",
+		in:      "32.1.2.0.192",
+		want:    "192.0.2.1/32",
+		wantErr: false,
+	}, {
+		name:    "ipv6_zz",
+		in:      "64.zz.db8.2001",
+		want:    "2001:db8::/64",
+		wantErr: false,
+	}, {
+		name:    "ipv6_zz_start",
+		in:      "128.1.zz",
+		want:    "::1/128",
+		wantErr: false,
+	}, {
+		name:    "ipv6_full",
+		in:      "128.1.0.0.0.0.0.db8.2001",
+		want:    "2001:db8::1/128",
+		wantErr: false,
+	}, {
+		name:    "bad_prefix",
+		in:      "33.1.2.0.192",
+		want:    "",
+		wantErr: true,
+	}, {
+		name:    "bad_ipv4",
+		in:      "32.2.0.192",
+		want:    "",
+		wantErr: true,
+	}, {
+		name:    "no_address",
+		in:      "32",
+		want:    "",
+		wantErr: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			n, err := parseRPZNet(tc.in)
+			if tc.wantErr {
+				assert.Error(t, err)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.want, n.String())
+		})
+	}
+}
+
+func TestRPZZone_match(t *testing.T) {
+	z := newTestRPZZone(t)
+
+	assert.Equal(t, "rpz.test.", z.name)
+	assert.Equal(t, uint32(1), z.serial)
+	assert.Equal(t, 15, z.len())
+	assert.True(t, z.hasNSTriggers())
+
+	clientIP := net.IP{192, 0, 2, 10}
+
+	testCases := []struct {
+		name       string
+		qname      string
+		clientIP   net.IP
+		wantOwner  string
+		wantAction rpzAction
+	}{{
+		name:       "exact",
+		qname:      "nx.example.",
+		clientIP:   nil,
+		wantOwner:  "nx.example.rpz.test.",
+		wantAction: rpzActionNXDOMAIN,
+	}, {
+		name:       "wildcard",
+		qname:      "a.b.wild.example.",
+		clientIP:   nil,
+		wantOwner:  "*.wild.example.rpz.test.",
+		wantAction: rpzActionNXDOMAIN,
+	}, {
+		name:       "exact_over_wildcard",
+		qname:      "pass.wild.example.",
+		clientIP:   nil,
+		wantOwner:  "pass.wild.example.rpz.test.",
+		wantAction: rpzActionPassthru,
+	}, {
+		name:       "wildcard_parent",
+		qname:      "wild.example.",
+		clientIP:   nil,
+		wantOwner:  "",
+		wantAction: 0,
+	}, {
+		name:       "client_ip",
+		qname:      "pass.wild.example.",
+		clientIP:   clientIP,
+		wantOwner:  "32.10.2.0.192.rpz-client-ip.rpz.test.",
+		wantAction: rpzActionNXDOMAIN,
+	}, {
+		name:       "local_data",
+		qname:      "local.example.",
+		clientIP:   net.IP{192, 0, 2, 11},
+		wantOwner:  "local.example.rpz.test.",
+		wantAction: rpzActionLocalData,
+	}, {
+		name:       "none",
+		qname:      "example.",
+		clientIP:   nil,
+		wantOwner:  "",
+		wantAction: 0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := z.matchRequest(tc.qname, tc.clientIP)
+			if tc.wantOwner == "" {
+				assert.Nil(t, p)
+
+				return
+			}
+
+			require.NotNil(t, p)
+
+			assert.Equal(t, tc.wantOwner, p.owner)
+			assert.Equal(t, tc.wantAction, p.action)
+		})
+	}
+
+	t.Run("answer", func(t *testing.T) {
+		p := z.matchAnswer([]net.IP{{192, 0, 2, 1}, {198, 51, 100, 7}})
+		require.NotNil(t, p)
+		assert.Equal(t, "24.0.100.51.198.rpz-ip.rpz.test.", p.owner)
+
+		p = z.matchAnswer([]net.IP{net.ParseIP("2001:db8:0:1::1")})
+		require.NotNil(t, p)
+		assert.Equal(t, "48.zz.db8.2001.rpz-ip.rpz.test.", p.owner)
+
+		assert.Nil(t, z.matchAnswer([]net.IP{net.ParseIP("2001:db9::1")}))
+	})
+
+	t.Run("ns", func(t *testing.T) {
+		p := z.matchNS([]string{"ns.good.example.", "ns.bad.example."}, nil)
+		require.NotNil(t, p)
+		assert.Equal(t, "ns.bad.example.rpz-nsdname.rpz.test.", p.owner)
+
+		p = z.matchNS([]string{"ns1.evil.example."}, nil)
+		require.NotNil(t, p)
+		assert.Equal(t, "*.evil.example.rpz-nsdname.rpz.test.", p.owner)
+
+		p = z.matchNS([]string{"ns.good.example."}, []net.IP{{10, 0, 0, 53}})
+		require.NotNil(t, p)
+		assert.Equal(t, "32.53.0.0.10.rpz-nsip.rpz.test.", p.owner)
+
+		assert.Nil(t, z.matchNS([]string{"evil.example."}, []net.IP{{10, 0, 0, 54}}))
+	})
+}
+
+func TestServer_processRPZRequest(t *testing.T) {
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				BlockedResponseTTL: 10,
+			},
+		},
+		anonymizer: aghnet.NewIPMut(nil),
+		rpz: &rpzSet{
+			ns: newRPZNSCache(),
+			feeds: []*rpzFeed{{
+				mu:   &sync.RWMutex{},
+				zone: newTestRPZZone(t),
+			}},
+		},
+	}
+
+	testCases := []struct {
+		wantRes      *dns.Msg
+		wantResult   *filtering.Result
+		name         string
+		qname        string
+		wantQName    string
+		qtype        uint16
+		wantRC       resultCode
+		wantAnswered bool
+	}{{
+		wantRes: (&dns.Msg{}).SetRcode(
+			(&dns.Msg{}).SetQuestion("nx.example.", dns.TypeA),
+			dns.RcodeNameError,
+		),
+		wantResult: &filtering.Result{
+			Rules: []*filtering.ResultRule{{
+				Text:         "nx.example.rpz.test. nxdomain",
+				FilterListID: filtering.RPZListID,
+			}},
+			Reason:     filtering.FilteredBlockList,
+			IsFiltered: true,
+		},
+		name:         "nxdomain",
+		qname:        "nx.example.",
+		wantQName:    "nx.example.",
+		qtype:        dns.TypeA,
+		wantRC:       resultCodeSuccess,
+		wantAnswered: true,
+	}, {
+		wantRes: nil,
+		wantResult: &filtering.Result{
+			Rules: []*filtering.ResultRule{{
+				Text:         "redirect.example.rpz.test. local-data",
+				FilterListID: filtering.RPZListID,
+			}},
+			Reason:    filtering.RewrittenRule,
+			CanonName: "safe.example.org.",
+		},
+		name:         "redirect",
+		qname:        "redirect.example.",
+		wantQName:    "safe.example.org.",
+		qtype:        dns.TypeA,
+		wantRC:       resultCodeSuccess,
+		wantAnswered: false,
+	}, {
+		wantRes: nil,
+		wantResult: &filtering.Result{
+			Rules: []*filtering.ResultRule{{
+				Text:         "garden.example.rpz.test. local-data",
+				FilterListID: filtering.RPZListID,
+			}},
+			Reason:    filtering.RewrittenRule,
+			CanonName: "garden.example.walled.example.org.",
+		},
+		name:         "wildcard_redirect",
+		qname:        "garden.example.",
+		wantQName:    "garden.example.walled.example.org.",
+		qtype:        dns.TypeAAAA,
+		wantRC:       resultCodeSuccess,
+		wantAnswered: false,
+	}, {
+		wantRes:      nil,
+		wantResult:   &filtering.Result{},
+		name:         "passthru",
+		qname:        "pass.wild.example.",
+		wantQName:    "pass.wild.example.",
+		qtype:        dns.TypeA,
+		wantRC:       resultCodeSuccess,
+		wantAnswered: false,
+	}, {
+		wantRes:      nil,
+		wantResult:   &filtering.Result{},
+		name:         "no_match",
+		qname:        "example.org.",
+		wantQName:    "example.org.",
+		qtype:        dns.TypeA,
+		wantRC:       resultCodeSuccess,
+		wantAnswered: false,
+	}, {
+		wantRes: nil,
+		wantResult: &filtering.Result{
+			Rules: []*filtering.ResultRule{{
+				Text:         "drop.example.rpz.test. drop",
+				FilterListID: filtering.RPZListID,
+			}},
+			Reason:     filtering.FilteredBlockList,
+			IsFiltered: true,
+		},
+		name:         "drop",
+		qname:        "drop.example.",
+		wantQName:    "drop.example.",
+		qtype:        dns.TypeA,
+		wantRC:       resultCodeFinish,
+		wantAnswered: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Proto: proxy.ProtoUDP,
+					Req:   (&dns.Msg{}).SetQuestion(tc.qname, tc.qtype),
+					Addr:  &net.UDPAddr{IP: net.IP{192, 0, 2, 11}, Port: 53},
+				},
+				result:            &filtering.Result{},
+				protectionEnabled: true,
+			}
+
+			rc := s.processRPZRequest(dctx)
+			require.Equal(t, tc.wantRC, rc)
+
+			pctx := dctx.proxyCtx
+			assert.Equal(t, tc.wantResult, dctx.result)
+			assert.Equal(t, tc.wantQName, pctx.Req.Question[0].Name)
+
+			if !tc.wantAnswered {
+				assert.Nil(t, pctx.Res)
+
+				return
+			}
+
+			require.NotNil(t, pctx.Res)
+			assert.Equal(t, tc.wantRes.Rcode, pctx.Res.Rcode)
+			assert.Equal(t, tc.wantRes.Answer, pctx.Res.Answer)
+		})
+	}
+
+	t.Run("local_data", func(t *testing.T) {
+		dctx := &dnsContext{
+			proxyCtx: &proxy.DNSContext{
+				Req: (&dns.Msg{}).SetQuestion("local.example.", dns.TypeAAAA),
+			},
+			result:            &filtering.Result{},
+			protectionEnabled: true,
+		}
+
+		require.Equal(t, resultCodeSuccess, s.processRPZRequest(dctx))
+		require.NotNil(t, dctx.proxyCtx.Res)
+
+		ans := dctx.proxyCtx.Res.Answer
+		require.Len(t, ans, 1)
+
+		aaaa, ok := ans[0].(*dns.AAAA)
+		require.True(t, ok)
+
+		assert.Equal(t, "local.example.", aaaa.Hdr.Name)
+		assert.Equal(t, net.ParseIP("2001:db8::1"), aaaa.AAAA)
+		assert.False(t, dctx.result.IsFiltered)
+	})
+
+	t.Run("tcp_only", func(t *testing.T) {
+		dctx := &dnsContext{
+			proxyCtx: &proxy.DNSContext{
+				Proto: proxy.ProtoUDP,
+				Req:   (&dns.Msg{}).SetQuestion("tcp.example.", dns.TypeA),
+			},
+			result:            &filtering.Result{},
+			protectionEnabled: true,
+		}
+
+		require.Equal(t, resultCodeSuccess, s.processRPZRequest(dctx))
+		require.NotNil(t, dctx.proxyCtx.Res)
+
+		assert.True(t, dctx.proxyCtx.Res.Truncated)
+
+		dctx.proxyCtx.Proto, dctx.proxyCtx.Res, dctx.rpzChecked = proxy.ProtoTCP, nil, false
+		require.Equal(t, resultCodeSuccess, s.processRPZRequest(dctx))
+
+		assert.Nil(t, dctx.proxyCtx.Res)
+	})
+
+	t.Run("protection_disabled", func(t *testing.T) {
+		dctx := &dnsContext{
+			proxyCtx: &proxy.DNSContext{
+				Req: (&dns.Msg{}).SetQuestion("nx.example.", dns.TypeA),
+			},
+			result:            &filtering.Result{},
+			protectionEnabled: false,
+		}
+
+		require.Equal(t, resultCodeSuccess, s.processRPZRequest(dctx))
+
+		assert.Nil(t, dctx.proxyCtx.Res)
+	})
+}
+
+func TestServer_processRPZResponse(t *testing.T) {
+	s := &Server{
+		rpz: &rpzSet{
+			ns: newRPZNSCache(),
+			feeds: []*rpzFeed{{
+				mu:   &sync.RWMutex{},
+				zone: newTestRPZZone(t),
+			}},
+		},
+	}
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	resp := (&dns.Msg{}).SetReply(req)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{
+			Name:   "example.org.",
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    60,
+		},
+		A: net.IP{198, 51, 100, 1},
+	}}
+
+	dctx := &dnsContext{
+		proxyCtx: &proxy.DNSContext{
+			Req: req,
+			Res: resp,
+		},
+		result:               &filtering.Result{},
+		protectionEnabled:    true,
+		responseFromUpstream: true,
+	}
+
+	require.Equal(t, resultCodeSuccess, s.processRPZResponse(dctx))
+	require.NotNil(t, dctx.proxyCtx.Res)
+
+	assert.Equal(t, dns.RcodeNameError, dctx.proxyCtx.Res.Rcode)
+	assert.Same(t, resp, dctx.origResp)
+	assert.True(t, dctx.result.IsFiltered)
+	require.Len(t, dctx.result.Rules, 1)
+	assert.Equal(t, "24.0.100.51.198.rpz-ip.rpz.test. nxdomain", dctx.result.Rules[0].Text)
+}
@@ -0,0 +1,448 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Intervals of the response policy zone refreshes.
+const (
+	// defaultRPZRefreshIvl is used when neither the configuration nor the
+	// SOA record of the zone sets the refresh interval.
+	defaultRPZRefreshIvl = 1 * time.Hour
+
+	// defaultRPZRetryIvl is used after a failed refresh when the SOA record
+	// doesn't set the retry interval.
+	defaultRPZRetryIvl = 5 * time.Minute
+
+	// minRPZRefreshIvl is the lower bound of the intervals, so that the
+	// primary servers aren't hammered by the zones with tiny SOA timers.
+	minRPZRefreshIvl = 10 * time.Second
+)
+
+// Timeouts of the zone transfers.
+const (
+	rpzDialTimeout = 10 * time.Second
+	rpzReadTimeout = 30 * time.Second
+)
+
+// rpzTSIGFudge is the allowed clock skew of the signed transfer requests in
+// seconds.
+const rpzTSIGFudge = 300
+
+// rpzFeed is a response policy zone loaded from a file or transferred from a
+// primary server and kept up to date.
+type rpzFeed struct {
+	conf *RPZConfig
+
+	// done is closed to stop the refreshes.
+	done chan struct{}
+
+	// mu protects zone.
+	mu *sync.RWMutex
+
+	// zone is the current parsed zone.  It's nil until the zone is loaded
+	// for the first time.
+	zone *rpzZone
+
+	// The fields below are only used by the refreshing goroutine.
+
+	// records are the current records of the zone.
+	records []dns.RR
+
+	// soa is the current SOA record of the zone.
+	soa *dns.SOA
+
+	// modTime is the modification time of the loaded zone file.
+	modTime time.Time
+}
+
+// newRPZFeed creates a new feed for the zone described by conf and starts
+// refreshing it.  conf must be valid.
+func newRPZFeed(conf *RPZConfig) (f *rpzFeed) {
+	c := *conf
+	c.Zone = dns.CanonicalName(c.Zone)
+
+	f = &rpzFeed{
+		conf: &c,
+		done: make(chan struct{}),
+		mu:   &sync.RWMutex{},
+	}
+
+	go f.run()
+
+	return f
+}
+
+// close stops the refreshes of the feed.
+func (f *rpzFeed) close() {
+	close(f.done)
+}
+
+// currentZone returns the current parsed zone or nil if it isn't loaded yet.
+func (f *rpzFeed) currentZone() (z *rpzZone) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.zone
+}
+
+// run refreshes the zone until the feed is closed.
+func (f *rpzFeed) run() {
+	defer aghos.OnPanicAndExit("dns: rpz feed")
+
+	for {
+		err := f.refresh()
+		if err != nil {
+			log.Error("dns: rpz %s: refreshing: %s", f.conf.Zone, err)
+		}
+
+		t := time.NewTimer(f.interval(err != nil))
+		select {
+		case <-t.C:
+			// Go on.
+		case <-f.done:
+			t.Stop()
+
+			return
+		}
+	}
+}
+
+// interval returns the duration until the next refresh.
+func (f *rpzFeed) interval(failed bool) (ivl time.Duration) {
+	switch {
+	case failed && f.soa != nil && f.soa.Retry > 0:
+		ivl = time.Duration(f.soa.Retry) * time.Second
+	case failed:
+		ivl = defaultRPZRetryIvl
+	case f.conf.Refresh.Duration > 0:
+		ivl = f.conf.Refresh.Duration
+	case f.soa != nil && f.soa.Refresh > 0:
+		ivl = time.Duration(f.soa.Refresh) * time.Second
+	default:
+		ivl = defaultRPZRefreshIvl
+	}
+
+	if ivl < minRPZRefreshIvl {
+		return minRPZRefreshIvl
+	}
+
+	return ivl
+}
+
+// refresh reloads the zone if it has changed.
+func (f *rpzFeed) refresh() (err error) {
+	var changed bool
+	if f.conf.File != "" {
+		changed, err = f.loadFile()
+	} else {
+		changed, err = f.transfer()
+	}
+
+	if err != nil || !changed {
+		return err
+	}
+
+	z, skipped := newRPZZone(f.conf.Zone, f.records)
+	if skipped > 0 {
+		log.Info("dns: rpz %s: skipped %d records with bad triggers", f.conf.Zone, skipped)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.zone = z
+
+	log.Info("dns: rpz %s: loaded %d policies, serial %d", f.conf.Zone, z.len(), z.serial)
+
+	return nil
+}
+
+// loadFile reads the zone from the file if it has been modified since the last
+// load.
+func (f *rpzFeed) loadFile() (changed bool, err error) {
+	fi, err := os.Stat(f.conf.File)
+	if err != nil {
+		return false, err
+	}
+
+	if f.records != nil && fi.ModTime().Equal(f.modTime) {
+		return false, nil
+	}
+
+	file, err := os.Open(f.conf.File)
+	if err != nil {
+		return false, err
+	}
+	defer func() { err = errors.WithDeferred(err, file.Close()) }()
+
+	var rrs []dns.RR
+	zp := dns.NewZoneParser(file, f.conf.Zone, f.conf.File)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+
+	if err = zp.Err(); err != nil {
+		return false, fmt.Errorf("parsing %s: %w", f.conf.File, err)
+	}
+
+	f.records, f.modTime = rrs, fi.ModTime()
+
+	return true, nil
+}
+
+// transfer updates the zone from the primary server.  It requests the changes
+// using IXFR if the zone has been transferred before, and falls back to AXFR
+// if the incremental transfer fails.
+func (f *rpzFeed) transfer() (changed bool, err error) {
+	if f.soa != nil {
+		changed, err = f.transferZone(true)
+		if err == nil {
+			return changed, nil
+		}
+
+		log.Debug("dns: rpz %s: ixfr: %s; trying axfr", f.conf.Zone, err)
+	}
+
+	return f.transferZone(false)
+}
+
+// transferZone performs a single incremental or full zone transfer and
+// applies its result.
+func (f *rpzFeed) transferZone(incremental bool) (changed bool, err error) {
+	req := &dns.Msg{}
+	if incremental {
+		req.SetIxfr(f.conf.Zone, f.soa.Serial, f.soa.Ns, f.soa.Mbox)
+	} else {
+		req.SetAxfr(f.conf.Zone)
+	}
+
+	t := &dns.Transfer{
+		DialTimeout: rpzDialTimeout,
+		ReadTimeout: rpzReadTimeout,
+	}
+
+	if name := f.conf.TSIGName; name != "" {
+		name = dns.CanonicalName(name)
+		alg := dns.HmacSHA256
+		if f.conf.TSIGAlgorithm != "" {
+			alg = dns.CanonicalName(f.conf.TSIGAlgorithm)
+		}
+
+		t.TsigSecret = map[string]string{name: f.conf.TSIGSecret}
+		req.SetTsig(name, alg, rpzTSIGFudge, time.Now().Unix())
+	}
+
+	addr := f.conf.Primary
+	if _, _, err = net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+
+	envs, err := t.In(req, addr)
+	if err != nil {
+		return false, err
+	}
+
+	var rrs []dns.RR
+	for env := range envs {
+		if env.Error != nil {
+			err = env.Error
+
+			continue
+		}
+
+		rrs = append(rrs, env.RR...)
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	var serial uint32
+	if incremental {
+		serial = f.soa.Serial
+	}
+
+	records, soa, err := applyXFR(f.records, serial, incremental, rrs)
+	if err != nil || soa == nil {
+		return false, err
+	}
+
+	f.records, f.soa = records, soa
+
+	return true, nil
+}
+
+// rrKey returns the key identifying rr within a zone regardless of its TTL
+// and the case of its owner name.
+func rrKey(rr dns.RR) (key string) {
+	c := dns.Copy(rr)
+	hdr := c.Header()
+	hdr.Name, hdr.Ttl = dns.CanonicalName(hdr.Name), 0
+
+	return c.String()
+}
+
+// applyXFR applies the records of the zone transfer response to the records
+// of the zone with serial.  If incremental is false or the server has responded
+// to the IXFR request with the whole zone, records are replaced.  soa is nil if
+// the zone hasn't changed.
+func applyXFR(
+	records []dns.RR,
+	serial uint32,
+	incremental bool,
+	rrs []dns.RR,
+) (next []dns.RR, soa *dns.SOA, err error) {
+	if len(rrs) == 0 {
+		return nil, nil, errors.Error("empty transfer response")
+	}
+
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return nil, nil, errors.Error("transfer response doesn't start with soa")
+	}
+
+	if incremental && (len(rrs) == 1 || soa.Serial == serial) {
+		return records, nil, nil
+	}
+
+	if len(rrs) < 2 {
+		return nil, nil, errors.Error("truncated transfer response")
+	}
+
+	last, ok := rrs[len(rrs)-1].(*dns.SOA)
+	if !ok || last.Serial != soa.Serial {
+		return nil, nil, errors.Error("transfer response doesn't end with soa")
+	}
+
+	if _, ok = rrs[1].(*dns.SOA); !ok || !incremental {
+		return rrs[:len(rrs)-1], soa, nil
+	}
+
+	set := make(map[string]dns.RR, len(records))
+	for _, rr := range records {
+		if rr.Header().Rrtype != dns.TypeSOA {
+			set[rrKey(rr)] = rr
+		}
+	}
+
+	// The differences are the sequences of the old SOA followed by the
+	// deleted records and the new SOA followed by the added records.
+	deleting, first := false, true
+	for _, rr := range rrs[1 : len(rrs)-1] {
+		if s, isSOA := rr.(*dns.SOA); isSOA {
+			deleting = !deleting
+			if first && s.Serial != serial {
+				return nil, nil, fmt.Errorf("ixfr starts from serial %d, not %d", s.Serial, serial)
+			}
+
+			first = false
+
+			continue
+		}
+
+		if deleting {
+			delete(set, rrKey(rr))
+		} else {
+			set[rrKey(rr)] = rr
+		}
+	}
+
+	next = make([]dns.RR, 0, len(set)+1)
+	next = append(next, soa)
+	for _, rr := range set {
+		next = append(next, rr)
+	}
+
+	return next, soa, nil
+}
+
+// rpzSet is the set of response policy zones in the order of their priority.
+// A nil *rpzSet contains no zones.
+type rpzSet struct {
+	// ns caches the authoritative nameservers of the domains.
+	ns *rpzNSCache
+
+	feeds []*rpzFeed
+}
+
+// newRPZSet returns the set of the response policy zones described by confs.
+// The feeds from prev with the same configuration are reused, and the others
+// are closed.  confs must be valid.
+func newRPZSet(confs []*RPZConfig, prev *rpzSet) (set *rpzSet) {
+	var prevFeeds []*rpzFeed
+	if prev != nil {
+		prevFeeds = prev.feeds
+	}
+
+	if len(confs) > 0 {
+		set = &rpzSet{
+			ns: newRPZNSCache(),
+		}
+	}
+
+	for _, conf := range confs {
+		c := *conf
+		c.Zone = dns.CanonicalName(c.Zone)
+
+		var f *rpzFeed
+		for i, pf := range prevFeeds {
+			if pf != nil && *pf.conf == c {
+				f, prevFeeds[i] = pf, nil
+
+				break
+			}
+		}
+
+		if f == nil {
+			f = newRPZFeed(conf)
+		}
+
+		set.feeds = append(set.feeds, f)
+	}
+
+	for _, pf := range prevFeeds {
+		if pf != nil {
+			pf.close()
+		}
+	}
+
+	return set
+}
+
+// zones returns the loaded zones of the set.
+func (set *rpzSet) zones() (zones []*rpzZone) {
+	if set == nil {
+		return nil
+	}
+
+	for _, f := range set.feeds {
+		if z := f.currentZone(); z != nil {
+			zones = append(zones, z)
+		}
+	}
+
+	return zones
+}
+
+// close stops the refreshes of all the zones of the set.
+func (set *rpzSet) close() {
+	if set == nil {
+		return
+	}
+
+	for _, f := range set.feeds {
+		f.close()
+	}
+
+	set.feeds = nil
+}
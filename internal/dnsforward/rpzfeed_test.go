@@ -0,0 +1,236 @@
+package dnsforward
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestSOA returns the SOA record of rpz.test. with serial.
+func newTestSOA(serial uint32) (soa *dns.SOA) {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   "rpz.test.",
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    300,
+		},
+		Ns:      "ns.rpz.test.",
+		Mbox:    "admin.rpz.test.",
+		Serial:  serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  60,
+	}
+}
+
+// newTestCNAME returns the CNAME record with name in rpz.test. and target.
+func newTestCNAME(name, target string) (rr *dns.CNAME) {
+	return &dns.CNAME{
+		Hdr: dns.RR_Header{
+			Name:   name + ".rpz.test.",
+			Rrtype: dns.TypeCNAME,
+			Class:  dns.ClassINET,
+			Ttl:    300,
+		},
+		Target: target,
+	}
+}
+
+func TestApplyXFR(t *testing.T) {
+	soa1, soa2 := newTestSOA(1), newTestSOA(2)
+	nx, drop := newTestCNAME("nx.example", "."), newTestCNAME("drop.example", rpzTargetDrop)
+	records := []dns.RR{soa1, nx}
+
+	upperNX := newTestCNAME("NX.example", ".")
+	upperNX.Hdr.Ttl = 60
+
+	testCases := []struct {
+		name        string
+		rrs         []dns.RR
+		want        []dns.RR
+		wantErrMsg  string
+		incremental bool
+		wantChanged bool
+	}{{
+		name:        "axfr",
+		rrs:         []dns.RR{soa2, drop, soa2},
+		want:        []dns.RR{soa2, drop},
+		wantErrMsg:  "",
+		incremental: false,
+		wantChanged: true,
+	}, {
+		name:        "ixfr_as_axfr",
+		rrs:         []dns.RR{soa2, drop, soa2},
+		want:        []dns.RR{soa2, drop},
+		wantErrMsg:  "",
+		incremental: true,
+		wantChanged: true,
+	}, {
+		name:        "ixfr",
+		rrs:         []dns.RR{soa2, soa1, upperNX, soa2, drop, soa2},
+		want:        []dns.RR{soa2, drop},
+		wantErrMsg:  "",
+		incremental: true,
+		wantChanged: true,
+	}, {
+		name:        "up_to_date",
+		rrs:         []dns.RR{soa1},
+		want:        records,
+		wantErrMsg:  "",
+		incremental: true,
+		wantChanged: false,
+	}, {
+		name:        "wrong_serial",
+		rrs:         []dns.RR{soa2, newTestSOA(0), soa2, drop, soa2},
+		want:        nil,
+		wantErrMsg:  "ixfr starts from serial 0, not 1",
+		incremental: true,
+		wantChanged: false,
+	}, {
+		name:        "no_last_soa",
+		rrs:         []dns.RR{soa2, drop},
+		want:        nil,
+		wantErrMsg:  "transfer response doesn't end with soa",
+		incremental: false,
+		wantChanged: false,
+	}, {
+		name:        "no_soa",
+		rrs:         []dns.RR{drop},
+		want:        nil,
+		wantErrMsg:  "transfer response doesn't start with soa",
+		incremental: false,
+		wantChanged: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			next, soa, err := applyXFR(records, 1, tc.incremental, tc.rrs)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.want, next)
+			assert.Equal(t, tc.wantChanged, soa != nil)
+		})
+	}
+}
+
+// startTestPrimary starts a primary server of rpz.test., which responds to
+// the IXFR requests with the change from the serial 1 to 2.  serial is the
+// current serial of the zone.  It returns the server's address.
+func startTestPrimary(t *testing.T, serial *uint32) (addr string) {
+	t.Helper()
+
+	zone := map[uint32][]dns.RR{
+		1: {newTestCNAME("nx.example", ".")},
+		2: {newTestCNAME("drop.example", rpzTargetDrop)},
+	}
+
+	h := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		cur := newTestSOA(atomic.LoadUint32(serial))
+		rrs := []dns.RR{cur}
+		switch r.Question[0].Qtype {
+		case dns.TypeAXFR:
+			rrs = append(append(rrs, zone[cur.Serial]...), cur)
+		case dns.TypeIXFR:
+			if r.Ns[0].(*dns.SOA).Serial < cur.Serial {
+				rrs = append(rrs, newTestSOA(1))
+				rrs = append(rrs, zone[1]...)
+				rrs = append(rrs, cur)
+				rrs = append(rrs, zone[2]...)
+				rrs = append(rrs, cur)
+			}
+		}
+
+		ch := make(chan *dns.Envelope, 1)
+		ch <- &dns.Envelope{RR: rrs}
+		close(ch)
+
+		tr := &dns.Transfer{}
+		_ = tr.Out(w, r, ch)
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	started := &sync.WaitGroup{}
+	started.Add(1)
+	srv := &dns.Server{
+		Listener:          l,
+		Handler:           h,
+		NotifyStartedFunc: started.Done,
+	}
+
+	go func() { _ = srv.ActivateAndServe() }()
+	started.Wait()
+	testutil.CleanupAndRequireSuccess(t, srv.Shutdown)
+
+	return l.Addr().String()
+}
+
+func TestRPZFeed_refresh(t *testing.T) {
+	t.Run("transfer", func(t *testing.T) {
+		serial := uint32(1)
+		f := &rpzFeed{
+			conf: &RPZConfig{
+				Zone:    "rpz.test.",
+				Primary: startTestPrimary(t, &serial),
+			},
+			mu: &sync.RWMutex{},
+		}
+
+		require.NoError(t, f.refresh())
+
+		z := f.currentZone()
+		require.NotNil(t, z)
+
+		assert.Equal(t, uint32(1), z.serial)
+		assert.NotNil(t, z.matchRequest("nx.example.", nil))
+		assert.Nil(t, z.matchRequest("drop.example.", nil))
+
+		atomic.StoreUint32(&serial, 2)
+		require.NoError(t, f.refresh())
+
+		z = f.currentZone()
+		require.NotNil(t, z)
+
+		assert.Equal(t, uint32(2), z.serial)
+		assert.Nil(t, z.matchRequest("nx.example.", nil))
+		assert.NotNil(t, z.matchRequest("drop.example.", nil))
+
+		require.NoError(t, f.refresh())
+		assert.Same(t, z, f.currentZone())
+	})
+
+	t.Run("file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "rpz.zone")
+		err := os.WriteFile(path, []byte(testRPZZone), 0o644)
+		require.NoError(t, err)
+
+		f := &rpzFeed{
+			conf: &RPZConfig{
+				Zone: "rpz.test.",
+				File: path,
+			},
+			mu: &sync.RWMutex{},
+		}
+
+		require.NoError(t, f.refresh())
+
+		z := f.currentZone()
+		require.NotNil(t, z)
+
+		assert.Equal(t, 15, z.len())
+
+		require.NoError(t, f.refresh())
+		assert.Same(t, z, f.currentZone())
+	})
+}
@@ -0,0 +1,331 @@
+package dnsforward
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// Parameters of the cache of the authoritative nameservers.
+const (
+	rpzNSCacheTTL  = 5 * time.Minute
+	rpzNSCacheSize = 10_000
+)
+
+// rpzNSEntry is the cached set of the authoritative nameservers of a domain.
+type rpzNSEntry struct {
+	expire time.Time
+	names  []string
+	ips    []net.IP
+}
+
+// rpzNSCache is the cache of the authoritative nameservers of the domains
+// used by the NSDNAME and NSIP triggers.
+type rpzNSCache struct {
+	// mu protects entries.
+	mu      *sync.Mutex
+	entries map[string]*rpzNSEntry
+}
+
+// newRPZNSCache returns a new empty cache of the nameservers.
+func newRPZNSCache() (c *rpzNSCache) {
+	return &rpzNSCache{
+		mu:      &sync.Mutex{},
+		entries: map[string]*rpzNSEntry{},
+	}
+}
+
+// get returns the cached entry for host or nil if there is no such entry or
+// it has expired.
+func (c *rpzNSCache) get(host string) (e *rpzNSEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e = c.entries[host]
+	if e == nil || time.Now().After(e.expire) {
+		return nil
+	}
+
+	return e
+}
+
+// set caches e for host.  The whole cache is dropped once it's full, which is
+// enough for the short-living entries.
+func (c *rpzNSCache) set(host string, e *rpzNSEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= rpzNSCacheSize {
+		c.entries = map[string]*rpzNSEntry{}
+	}
+
+	e.expire = time.Now().Add(rpzNSCacheTTL)
+	c.entries[host] = e
+}
+
+// rpzZones returns the loaded response policy zones and the cache of the
+// nameservers.
+func (s *Server) rpzZones() (zones []*rpzZone, nsCache *rpzNSCache) {
+	s.serverLock.RLock()
+	defer s.serverLock.RUnlock()
+
+	if s.rpz == nil {
+		return nil, nil
+	}
+
+	return s.rpz.zones(), s.rpz.ns
+}
+
+// rpzApplicable returns true if the response policies should be checked for
+// the request.
+func rpzApplicable(dctx *dnsContext) (ok bool) {
+	return dctx.protectionEnabled &&
+		!dctx.rpzChecked &&
+		dctx.result.Reason != filtering.NotFilteredAllowList &&
+		!dctx.result.IsFiltered
+}
+
+// processRPZRequest applies the response policy zones using the client IP
+// and the QNAME triggers.
+func (s *Server) processRPZRequest(dctx *dnsContext) (rc resultCode) {
+	pctx := dctx.proxyCtx
+	if pctx.Res != nil || dctx.origQuestion.Name != "" || !rpzApplicable(dctx) {
+		return resultCodeSuccess
+	}
+
+	zones, _ := s.rpzZones()
+	if len(zones) == 0 {
+		return resultCodeSuccess
+	}
+
+	qname := dns.CanonicalName(pctx.Req.Question[0].Name)
+	ip, _ := netutil.IPAndPortFromAddr(pctx.Addr)
+	for _, z := range zones {
+		if p := z.matchRequest(qname, ip); p != nil {
+			return s.applyRPZ(dctx, p, false)
+		}
+	}
+
+	return resultCodeSuccess
+}
+
+// processRPZResponse applies the response policy zones using the response IP
+// and the nameserver triggers.
+func (s *Server) processRPZResponse(dctx *dnsContext) (rc resultCode) {
+	pctx := dctx.proxyCtx
+	if !dctx.responseFromUpstream || !rpzApplicable(dctx) {
+		return resultCodeSuccess
+	}
+
+	zones, nsCache := s.rpzZones()
+	if len(zones) == 0 {
+		return resultCodeSuccess
+	}
+
+	var ips []net.IP
+	for _, rr := range pctx.Res.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			ips = append(ips, rr.A)
+		case *dns.AAAA:
+			ips = append(ips, rr.AAAA)
+		default:
+			// Go on.
+		}
+	}
+
+	qname := dns.CanonicalName(pctx.Req.Question[0].Name)
+	var ns *rpzNSEntry
+	for _, z := range zones {
+		p := z.matchAnswer(ips)
+		if p == nil && z.hasNSTriggers() {
+			if ns == nil {
+				ns = s.rpzNameservers(nsCache, qname, z.nsIPs.len() > 0)
+			}
+
+			p = z.matchNS(ns.names, ns.ips)
+		}
+
+		if p != nil {
+			return s.applyRPZ(dctx, p, true)
+		}
+	}
+
+	return resultCodeSuccess
+}
+
+// applyRPZ applies the action of policy p to the request.  afterResponse is
+// true if the policy is triggered by the response.
+func (s *Server) applyRPZ(dctx *dnsContext, p *rpzPolicy, afterResponse bool) (rc resultCode) {
+	dctx.rpzChecked = true
+
+	pctx := dctx.proxyCtx
+	req := pctx.Req
+	log.Debug("dns: rpz: %s for %s", p.rule(), req.Question[0].Name)
+
+	if afterResponse && p.action != rpzActionPassthru {
+		dctx.origResp = pctx.Res
+	}
+
+	res := &filtering.Result{
+		Rules: []*filtering.ResultRule{{
+			Text:         p.rule(),
+			FilterListID: filtering.RPZListID,
+		}},
+		Reason:     filtering.FilteredBlockList,
+		IsFiltered: true,
+	}
+
+	switch p.action {
+	case rpzActionPassthru:
+		return resultCodeSuccess
+	case rpzActionTCPOnly:
+		if pctx.Proto == proxy.ProtoUDP {
+			pctx.Res = s.makeResponse(req)
+			pctx.Res.Truncated = true
+		}
+
+		return resultCodeSuccess
+	case rpzActionNXDOMAIN:
+		pctx.Res = s.genNXDomain(req)
+	case rpzActionNODATA:
+		pctx.Res = s.makeResponse(req)
+		pctx.Res.Ns = s.genSOA(req)
+	case rpzActionDrop:
+		// Log the dropped request, since the processing stops here.
+		pctx.Res = nil
+		dctx.result = res
+		s.processQueryLogsAndStats(dctx)
+
+		return resultCodeFinish
+	case rpzActionLocalData:
+		res.Reason, res.IsFiltered = filtering.RewrittenRule, false
+		s.rpzLocalData(dctx, p, res, afterResponse)
+	}
+
+	dctx.result = res
+
+	return resultCodeSuccess
+}
+
+// rpzLocalData responds with the local data of p.  The CNAME triggered by the
+// request is resolved further unless it's requested itself.
+func (s *Server) rpzLocalData(dctx *dnsContext, p *rpzPolicy, res *filtering.Result, afterResponse bool) {
+	pctx := dctx.proxyCtx
+	req := pctx.Req
+	q := req.Question[0]
+
+	resp := s.makeResponse(req)
+	if cname, ok := p.data[0].(*dns.CNAME); ok {
+		target := cname.Target
+		if strings.HasPrefix(target, "*.") {
+			// Prepend the wildcard targets with the requested name.
+			target = q.Name + target[2:]
+		}
+
+		res.CanonName = target
+		if !afterResponse && q.Qtype != dns.TypeCNAME {
+			// Resolve the new canonical name, not the original host name.
+			// The original question is readded in
+			// processFilteringAfterResponse.
+			dctx.origQuestion = q
+			req.Question[0].Name = target
+
+			return
+		}
+
+		resp.Answer = append(resp.Answer, s.genAnswerCNAME(req, target))
+		pctx.Res = resp
+
+		return
+	}
+
+	for _, rr := range p.data {
+		if rr.Header().Rrtype != q.Qtype {
+			continue
+		}
+
+		ans := dns.Copy(rr)
+		ans.Header().Name = q.Name
+		resp.Answer = append(resp.Answer, ans)
+	}
+
+	if len(resp.Answer) == 0 {
+		resp.Ns = s.genSOA(req)
+	}
+
+	pctx.Res = resp
+}
+
+// rpzNameservers returns the authoritative nameservers of qname.  If withIPs
+// is true, their addresses are resolved as well.
+func (s *Server) rpzNameservers(nsCache *rpzNSCache, qname string, withIPs bool) (e *rpzNSEntry) {
+	if e = nsCache.get(qname); e != nil && (e.ips != nil || !withIPs) {
+		return e
+	}
+
+	e = &rpzNSEntry{}
+	names, soaName := s.lookupNS(qname)
+	if len(names) == 0 && soaName != "" && soaName != qname {
+		names, _ = s.lookupNS(soaName)
+	}
+
+	e.names = names
+	if withIPs {
+		e.ips = []net.IP{}
+		for _, name := range names {
+			addrs, err := s.internalProxy.LookupIPAddr(strings.TrimSuffix(name, "."))
+			if err != nil {
+				log.Debug("dns: rpz: resolving nameserver %s: %s", name, err)
+
+				continue
+			}
+
+			for _, a := range addrs {
+				e.ips = append(e.ips, a.IP)
+			}
+		}
+	}
+
+	nsCache.set(qname, e)
+
+	return e
+}
+
+// lookupNS returns the nameservers of the zone name as well as the owner of
+// the SOA record from the authority section, if any.
+func (s *Server) lookupNS(name string) (names []string, soaName string) {
+	req := (&dns.Msg{}).SetQuestion(name, dns.TypeNS)
+	pctx := &proxy.DNSContext{
+		Proto:     proxy.ProtoUDP,
+		Req:       req,
+		StartTime: time.Now(),
+	}
+
+	if err := s.internalProxy.Resolve(pctx); err != nil {
+		log.Debug("dns: rpz: looking up nameservers of %s: %s", name, err)
+
+		return nil, ""
+	}
+
+	for _, rr := range pctx.Res.Answer {
+		if ns, ok := rr.(*dns.NS); ok {
+			names = append(names, dns.CanonicalName(ns.Ns))
+		}
+	}
+
+	for _, rr := range pctx.Res.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			soaName = dns.CanonicalName(soa.Hdr.Name)
+		}
+	}
+
+	return names, soaName
+}
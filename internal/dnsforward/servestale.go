@@ -0,0 +1,361 @@
+package dnsforward
+
+import (
+	"container/list"
+	"encoding/binary"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/stringutil"
+	"github.com/miekg/dns"
+)
+
+// Serve-stale parameters.  See RFC 8767.
+const (
+	// DefaultCacheMaxStaleTTL is the default maximum time in seconds, for
+	// which a response is served after its expiration.  RFC 8767 suggests
+	// between one and three days.
+	DefaultCacheMaxStaleTTL = 24 * 60 * 60
+
+	// staleAnswerTTL is the TTL of the records in a stale response as
+	// recommended by RFC 8767.
+	staleAnswerTTL = 30
+
+	// defaultStaleCacheCount is the maximum number of the responses kept to
+	// be served when all the upstreams fail.
+	defaultStaleCacheCount = 10 * 1024
+)
+
+// staleItem is a response kept in the stale cache.
+type staleItem struct {
+	// expiry is the time, when the response stops being fresh.
+	expiry time.Time
+
+	// resp is the copy of the response.
+	resp *dns.Msg
+
+	// key is the key of the item in the cache.
+	key string
+}
+
+// staleCache is the LRU cache of the responses served when all the upstreams
+// fail.  Unlike the dnsproxy cache, it keeps the copies of the responses
+// instead of the packed ones, since most of them are never served.
+type staleCache struct {
+	// mu protects items and lru.
+	mu *sync.Mutex
+
+	// items are the elements of lru by their keys.
+	items map[string]*list.Element
+
+	// lru contains the *staleItem values, the most recently used first.
+	lru *list.List
+
+	// maxCount is the maximum number of the items.
+	maxCount int
+}
+
+// newStaleCache returns a new stale cache keeping at most maxCount responses.
+func newStaleCache(maxCount int) (c *staleCache) {
+	return &staleCache{
+		mu:       &sync.Mutex{},
+		items:    map[string]*list.Element{},
+		lru:      list.New(),
+		maxCount: maxCount,
+	}
+}
+
+// set puts resp, which is fresh until expiry, into c under key.  resp must not
+// be changed afterwards.
+func (c *staleCache) set(key string, resp *dns.Msg, expiry time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		item := e.Value.(*staleItem)
+		item.resp, item.expiry = resp, expiry
+		c.lru.MoveToFront(e)
+
+		return
+	}
+
+	c.items[key] = c.lru.PushFront(&staleItem{
+		expiry: expiry,
+		resp:   resp,
+		key:    key,
+	})
+
+	for c.lru.Len() > c.maxCount {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.items, e.Value.(*staleItem).key)
+	}
+}
+
+// get returns the copy of the response under key and the time, when it stops
+// being fresh.  resp is nil if there is no such response.
+func (c *staleCache) get(key string) (resp *dns.Msg, expiry time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, time.Time{}
+	}
+
+	c.lru.MoveToFront(e)
+	item := e.Value.(*staleItem)
+
+	return item.resp.Copy(), item.expiry
+}
+
+// del removes the response under key from c.
+func (c *staleCache) del(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.lru.Remove(e)
+		delete(c.items, key)
+	}
+}
+
+// staleCacheKey returns the key of the stale response for the request of dctx.
+// key is nil if the request can't be served from the stale cache.
+func staleCacheKey(dctx *dnsContext) (key []byte) {
+	pctx := dctx.proxyCtx
+	req := pctx.Req
+	if len(req.Question) != 1 {
+		return nil
+	}
+
+	q := req.Question[0]
+	key = make([]byte, 5, 5+len(q.Name))
+	binary.BigEndian.PutUint16(key, q.Qtype)
+	binary.BigEndian.PutUint16(key[2:], q.Qclass)
+	if opt := req.IsEdns0(); opt != nil && opt.Do() {
+		key[4] = 1
+	}
+
+	key = append(key, strings.ToLower(q.Name)...)
+
+	// The custom upstreams of a client may answer differently, so keep its
+	// responses separately.
+	if pctx.CustomUpstreamConfig != nil {
+		id := stringutil.Coalesce(dctx.clientID, ipStringFromAddr(pctx.Addr))
+		key = append([]byte(id+"\x00"), key...)
+	}
+
+	return key
+}
+
+// staleResponseTTL returns the minimum TTL of the records of resp, which is
+// the time the whole response stays fresh.
+func staleResponseTTL(resp *dns.Msg) (ttl uint32) {
+	first := true
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			if first || hdr.Ttl < ttl {
+				ttl, first = hdr.Ttl, false
+			}
+		}
+	}
+
+	return ttl
+}
+
+// isStaleCacheable returns true if resp may be served stale.  These are the
+// responses, which dnsproxy caches, except for the SERVFAIL ones.
+func isStaleCacheable(resp *dns.Msg) (ok bool) {
+	if resp == nil ||
+		resp.Truncated ||
+		len(resp.Question) != 1 ||
+		staleResponseTTL(resp) == 0 {
+		return false
+	}
+
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+		qt := resp.Question[0].Qtype
+
+		return (qt != dns.TypeA && qt != dns.TypeAAAA) || hasIPAnswer(resp) || isAuthNegative(resp)
+	case dns.RcodeNameError:
+		return isAuthNegative(resp)
+	default:
+		return false
+	}
+}
+
+// hasIPAnswer returns true if the answer section of resp contains at least one
+// A or AAAA record.
+func hasIPAnswer(resp *dns.Msg) (ok bool) {
+	for _, rr := range resp.Answer {
+		if t := rr.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isAuthNegative returns true if the authority section of resp contains a SOA
+// record and no NS records, so that the negative response is authoritative.
+// See RFC 2308.
+func isAuthNegative(resp *dns.Msg) (ok bool) {
+	for _, rr := range resp.Ns {
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA:
+			ok = true
+		case dns.TypeNS:
+			return false
+		}
+	}
+
+	return ok
+}
+
+// storeStale keeps the upstream response of dctx to serve it when all the
+// upstreams fail later.  The responses from the dnsproxy cache are skipped,
+// since they have been kept when they were received from the upstreams.
+func (s *Server) storeStale(dctx *dnsContext) {
+	pctx := dctx.proxyCtx
+	if !s.conf.CacheServeStale || pctx.CachedUpstreamAddr != "" || !isStaleCacheable(pctx.Res) {
+		return
+	}
+
+	key := staleCacheKey(dctx)
+	if key == nil {
+		return
+	}
+
+	s.setStale(key, pctx.Res, time.Now())
+}
+
+// setStale puts the copy of resp into the stale cache under key.  resp expires
+// after its minimum TTL since now.
+func (s *Server) setStale(key []byte, resp *dns.Msg, now time.Time) {
+	expiry := now.Add(time.Duration(staleResponseTTL(resp)) * time.Second)
+	s.stale.set(string(key), resp.Copy(), expiry)
+}
+
+// getStale returns the response from the stale cache by key, if it has expired
+// no longer than the maximum stale TTL before now.  resp is nil if there is no
+// such response.
+func (s *Server) getStale(key []byte, now time.Time) (resp *dns.Msg) {
+	resp, expiry := s.stale.get(string(key))
+	if resp == nil {
+		return nil
+	}
+
+	maxStale := s.conf.CacheMaxStaleTTL
+	if maxStale == 0 {
+		maxStale = DefaultCacheMaxStaleTTL
+	}
+
+	if now.After(expiry.Add(time.Duration(maxStale) * time.Second)) {
+		s.stale.del(string(key))
+
+		return nil
+	}
+
+	return resp
+}
+
+// serveStale answers the request of dctx with the stale response, if there is
+// one, and starts refreshing it in the background.  It must only be called
+// when all the upstreams have failed.
+func (s *Server) serveStale(dctx *dnsContext) (ok bool) {
+	if !s.conf.CacheServeStale {
+		return false
+	}
+
+	key := staleCacheKey(dctx)
+	if key == nil {
+		return false
+	}
+
+	resp := s.getStale(key, time.Now())
+	if resp == nil {
+		return false
+	}
+
+	pctx := dctx.proxyCtx
+	log.Debug("dns: serving stale response for %s: %s", pctx.Req.Question[0].Name, dctx.err)
+
+	resp.Id = pctx.Req.Id
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range rrs {
+			if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT {
+				hdr.Ttl = staleAnswerTTL
+			}
+		}
+	}
+
+	s.setExtendedError(pctx.Req, resp, dns.ExtendedErrorCodeStaleAnswer, "")
+
+	s.refreshStale(key, pctx)
+
+	pctx.Res = resp
+	dctx.err = nil
+	dctx.responseFromUpstream = true
+	dctx.responseAD = resp.AuthenticatedData
+
+	return true
+}
+
+// refreshStale resolves the request of pctx in the background and replaces the
+// stale response under key with the new one on success.  Only one refresh for
+// each key runs at a time.
+func (s *Server) refreshStale(key []byte, pctx *proxy.DNSContext) {
+	k := string(key)
+
+	s.staleRefreshMu.Lock()
+	defer s.staleRefreshMu.Unlock()
+
+	if _, ok := s.staleRefreshing[k]; ok {
+		return
+	}
+
+	s.staleRefreshing[k] = struct{}{}
+
+	refreshCtx := &proxy.DNSContext{
+		Proto:                pctx.Proto,
+		Req:                  pctx.Req.Copy(),
+		Addr:                 pctx.Addr,
+		CustomUpstreamConfig: pctx.CustomUpstreamConfig,
+	}
+
+	go func() {
+		defer log.OnPanic("dns: refreshing stale response")
+		defer func() {
+			s.staleRefreshMu.Lock()
+			defer s.staleRefreshMu.Unlock()
+
+			delete(s.staleRefreshing, k)
+		}()
+
+		prx := s.proxy()
+		if prx == nil {
+			return
+		}
+
+		err := prx.Resolve(refreshCtx)
+		if err != nil {
+			log.Debug("dns: refreshing stale response: %s", err)
+
+			return
+		}
+
+		if isStaleCacheable(refreshCtx.Res) {
+			s.setStale(key, refreshCtx.Res, time.Now())
+		}
+	}()
+}
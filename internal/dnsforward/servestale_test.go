@@ -0,0 +1,253 @@
+package dnsforward
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_serveStale(t *testing.T) {
+	const (
+		host   = "host.example."
+		ttl    = 60
+		maxTTL = 3600
+	)
+
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				CacheServeStale:  true,
+				CacheMaxStaleTTL: maxTTL,
+			},
+		},
+		stale:           newStaleCache(defaultStaleCacheCount),
+		staleRefreshMu:  &sync.Mutex{},
+		staleRefreshing: map[string]struct{}{},
+	}
+
+	newCtx := func(qname string) (dctx *dnsContext) {
+		return &dnsContext{
+			proxyCtx: &proxy.DNSContext{
+				Req:  (&dns.Msg{}).SetQuestion(qname, dns.TypeA),
+				Addr: &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 12345},
+			},
+		}
+	}
+
+	dctx := newCtx(host)
+	resp := (&dns.Msg{}).SetReply(dctx.proxyCtx.Req)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   net.IP{192, 0, 2, 2},
+	}}
+	dctx.proxyCtx.Res = resp
+	s.storeStale(dctx)
+
+	key := staleCacheKey(newCtx("Host.Example."))
+	require.NotNil(t, key)
+
+	now := time.Now()
+	testCases := []struct {
+		now     time.Time
+		name    string
+		wantNil bool
+	}{{
+		now:     now,
+		name:    "fresh",
+		wantNil: false,
+	}, {
+		now:     now.Add((ttl + maxTTL/2) * time.Second),
+		name:    "stale",
+		wantNil: false,
+	}, {
+		now:     now.Add((ttl + maxTTL + 1) * time.Second),
+		name:    "too_stale",
+		wantNil: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := s.getStale(key, tc.now)
+			if tc.wantNil {
+				assert.Nil(t, got)
+
+				return
+			}
+
+			require.NotNil(t, got)
+			require.Len(t, got.Answer, 1)
+
+			assert.Equal(t, resp.Answer[0].String(), got.Answer[0].String())
+		})
+	}
+
+	// The too stale response is removed.
+	assert.Nil(t, s.getStale(key, now))
+
+	t.Run("serve", func(t *testing.T) {
+		s.storeStale(dctx)
+
+		served := newCtx(host)
+		served.err = errors.Error("all upstreams failed")
+		require.True(t, s.serveStale(served))
+
+		assert.NoError(t, served.err)
+		assert.True(t, served.responseFromUpstream)
+
+		got := served.proxyCtx.Res
+		require.NotNil(t, got)
+		require.Len(t, got.Answer, 1)
+
+		assert.Equal(t, served.proxyCtx.Req.Id, got.Id)
+		assert.Equal(t, uint32(staleAnswerTTL), got.Answer[0].Header().Ttl)
+		assert.False(t, s.serveStale(newCtx("other.example.")))
+	})
+
+	t.Run("cached", func(t *testing.T) {
+		cachedHost := "cached.example."
+		cached := newCtx(cachedHost)
+		cachedResp := resp.Copy()
+		cachedResp.Question[0].Name = cachedHost
+		cachedResp.Answer[0].Header().Name = cachedHost
+		cached.proxyCtx.Res = cachedResp
+		cached.proxyCtx.CachedUpstreamAddr = "192.0.2.53:53"
+		s.storeStale(cached)
+
+		assert.Nil(t, s.getStale(staleCacheKey(newCtx(cachedHost)), now))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		s.conf.CacheServeStale = false
+		t.Cleanup(func() { s.conf.CacheServeStale = true })
+
+		assert.False(t, s.serveStale(newCtx(host)))
+	})
+}
+
+func TestIsStaleCacheable(t *testing.T) {
+	const host = "host.example."
+
+	newResp := func(qtype uint16, rcode int, ans, ns []dns.RR) (resp *dns.Msg) {
+		resp = (&dns.Msg{}).SetRcode((&dns.Msg{}).SetQuestion(host, qtype), rcode)
+		resp.Answer, resp.Ns = ans, ns
+
+		return resp
+	}
+
+	hdr := func(rrtype uint16) (h dns.RR_Header) {
+		return dns.RR_Header{Name: host, Rrtype: rrtype, Class: dns.ClassINET, Ttl: 60}
+	}
+
+	a := []dns.RR{&dns.A{Hdr: hdr(dns.TypeA), A: net.IP{192, 0, 2, 1}}}
+	txt := []dns.RR{&dns.TXT{Hdr: hdr(dns.TypeTXT), Txt: []string{"txt"}}}
+	soa := []dns.RR{&dns.SOA{Hdr: hdr(dns.TypeSOA), Ns: "ns.example.", Mbox: "mbox.example."}}
+	ns := []dns.RR{&dns.NS{Hdr: hdr(dns.TypeNS), Ns: "ns.example."}}
+
+	truncated := newResp(dns.TypeA, dns.RcodeSuccess, a, nil)
+	truncated.Truncated = true
+
+	zeroTTL := newResp(dns.TypeA, dns.RcodeSuccess, a, nil)
+	zeroTTL.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeA}}}
+
+	testCases := []struct {
+		resp *dns.Msg
+		name string
+		want bool
+	}{{
+		resp: nil,
+		name: "nil",
+		want: false,
+	}, {
+		resp: newResp(dns.TypeA, dns.RcodeSuccess, a, nil),
+		name: "success",
+		want: true,
+	}, {
+		resp: newResp(dns.TypeTXT, dns.RcodeSuccess, txt, nil),
+		name: "success_txt",
+		want: true,
+	}, {
+		resp: newResp(dns.TypeA, dns.RcodeSuccess, txt, nil),
+		name: "success_no_ip",
+		want: false,
+	}, {
+		resp: newResp(dns.TypeA, dns.RcodeSuccess, nil, soa),
+		name: "nodata",
+		want: true,
+	}, {
+		resp: newResp(dns.TypeA, dns.RcodeNameError, nil, soa),
+		name: "nxdomain",
+		want: true,
+	}, {
+		resp: newResp(dns.TypeA, dns.RcodeNameError, nil, append(soa, ns...)),
+		name: "nxdomain_referral",
+		want: false,
+	}, {
+		resp: newResp(dns.TypeA, dns.RcodeNameError, nil, nil),
+		name: "nxdomain_no_soa",
+		want: false,
+	}, {
+		resp: newResp(dns.TypeA, dns.RcodeServerFailure, nil, soa),
+		name: "servfail",
+		want: false,
+	}, {
+		resp: truncated,
+		name: "truncated",
+		want: false,
+	}, {
+		resp: zeroTTL,
+		name: "zero_ttl",
+		want: false,
+	}, {
+		resp: &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeSuccess}, Answer: a},
+		name: "no_question",
+		want: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, isStaleCacheable(tc.resp))
+		})
+	}
+}
+
+func TestStaleCache(t *testing.T) {
+	c := newStaleCache(2)
+	expiry := time.Now()
+
+	newResp := func(host string) (resp *dns.Msg) {
+		return (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+	}
+
+	c.set("a", newResp("a.example."), expiry)
+	c.set("b", newResp("b.example."), expiry)
+
+	// Make "a" the most recently used one.
+	got, gotExpiry := c.get("a")
+	require.NotNil(t, got)
+
+	assert.Equal(t, expiry, gotExpiry)
+
+	// The copy must not affect the cached response.
+	got.Question[0].Name = "changed.example."
+
+	c.set("c", newResp("c.example."), expiry)
+
+	got, _ = c.get("b")
+	assert.Nil(t, got)
+
+	got, _ = c.get("a")
+	require.NotNil(t, got)
+
+	assert.Equal(t, "a.example.", got.Question[0].Name)
+
+	c.del("a")
+	got, _ = c.get("a")
+	assert.Nil(t, got)
+}
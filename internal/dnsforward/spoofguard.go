@@ -0,0 +1,299 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// spoofDetectWindow is the time during which the additional responses to a
+// query sent over UDP are awaited after the first one.
+const spoofDetectWindow = 50 * time.Millisecond
+
+// defaultSpoofGuardTimeout is the timeout of an exchange with an upstream
+// used when the upstream timeout isn't set.
+const defaultSpoofGuardTimeout = 10 * time.Second
+
+// spoofCounters are the counters of the spoofing detection.  They must only be
+// accessed atomically.
+type spoofCounters struct {
+	// detected is the number of queries, for which differing responses have
+	// been received.
+	detected uint64
+
+	// retried is the number of queries retried over TCP after differing
+	// responses have been received.
+	retried uint64
+}
+
+// spoofGuard is a plain DNS upstream, which detects the differing UDP responses
+// to a single query.  Such responses usually mean that someone is trying to
+// poison the cache by spoofing the responses of the upstream.
+type spoofGuard struct {
+	// counters are the shared counters of all the guards of the server.
+	counters *spoofCounters
+
+	// addr is the address of the upstream.
+	addr string
+
+	// bind is the binding of the upstream to a local interface or a source
+	// address.  It's nil if the upstream isn't bound.
+	bind *upstreamBind
+
+	// timeout is the timeout of the exchange with the upstream.
+	timeout time.Duration
+
+	// tcpRetry, if true, makes the guard retry the query over TCP if
+	// differing responses are received.  In that case, each response is
+	// delayed by spoofDetectWindow.
+	tcpRetry bool
+
+	// noTCPFallback, if true, makes the guard return the truncated responses
+	// as is instead of repeating the query over TCP.
+	noTCPFallback bool
+}
+
+// type check
+var _ upstream.Upstream = (*spoofGuard)(nil)
+
+// Address implements the upstream.Upstream interface for *spoofGuard.
+func (g *spoofGuard) Address() (addr string) {
+	return g.addr
+}
+
+// Close implements the upstream.Upstream interface for *spoofGuard.
+func (g *spoofGuard) Close() (err error) {
+	return nil
+}
+
+// Exchange implements the upstream.Upstream interface for *spoofGuard.
+func (g *spoofGuard) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := g.bind.dialer("udp", g.addr, g.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("binding to %s: %w", g.bind, err)
+	}
+
+	conn, err := d.Dial("udp", g.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(g.timeout))
+	if _, err = conn.Write(packed); err != nil {
+		return nil, errors.WithDeferred(err, conn.Close())
+	}
+
+	resp, err = readResponse(conn, req)
+	if err != nil {
+		return nil, errors.WithDeferred(err, conn.Close())
+	}
+
+	if resp.Truncated && !g.noTCPFallback {
+		_ = conn.Close()
+
+		return g.exchangeTCP(req)
+	}
+
+	if !g.tcpRetry {
+		go g.watch(conn, req, resp)
+
+		return resp, nil
+	}
+
+	spoofed := g.awaitDiffering(conn, req, resp)
+	_ = conn.Close()
+	if !spoofed {
+		return resp, nil
+	}
+
+	atomic.AddUint64(&g.counters.retried, 1)
+
+	return g.exchangeTCP(req)
+}
+
+// exchangeTCP sends req to the upstream over TCP.
+func (g *spoofGuard) exchangeTCP(req *dns.Msg) (resp *dns.Msg, err error) {
+	d, err := g.bind.dialer("tcp", g.addr, g.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("binding to %s: %w", g.bind, err)
+	}
+
+	c := &dns.Client{
+		Net:     "tcp",
+		Dialer:  d,
+		Timeout: g.timeout,
+	}
+
+	resp, _, err = c.Exchange(req, g.addr)
+
+	return resp, err
+}
+
+// watch waits for the differing responses to req in background and closes
+// conn.
+func (g *spoofGuard) watch(conn net.Conn, req, resp *dns.Msg) {
+	defer log.OnPanic("dns: spoof guard")
+	defer func() { _ = conn.Close() }()
+
+	_ = g.awaitDiffering(conn, req, resp)
+}
+
+// awaitDiffering reads the responses to req from conn during spoofDetectWindow
+// and returns true if any of them differs from resp.
+func (g *spoofGuard) awaitDiffering(conn net.Conn, req, resp *dns.Msg) (spoofed bool) {
+	_ = conn.SetReadDeadline(time.Now().Add(spoofDetectWindow))
+
+	fp := answerFingerprint(resp)
+	for {
+		dup, err := readResponse(conn, req)
+		if err != nil {
+			// Most probably, the window has passed.
+			return false
+		}
+
+		if answerFingerprint(dup) != fp {
+			atomic.AddUint64(&g.counters.detected, 1)
+			log.Info(
+				"dns: possible spoofing: differing responses from %s for %q with id %d",
+				g.addr,
+				req.Question[0].Name,
+				req.Id,
+			)
+
+			return true
+		}
+	}
+}
+
+// readResponse reads the packets from conn until a response to req is
+// received.
+func readResponse(conn net.Conn, req *dns.Msg) (resp *dns.Msg, err error) {
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		var n int
+		n, err = conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		resp = &dns.Msg{}
+		if resp.Unpack(buf[:n]) == nil && isResponseTo(resp, req) {
+			return resp, nil
+		}
+	}
+}
+
+// isResponseTo returns true if resp is a response to req.
+func isResponseTo(resp, req *dns.Msg) (ok bool) {
+	if !resp.Response || resp.Id != req.Id || len(resp.Question) != len(req.Question) {
+		return false
+	}
+
+	for i, q := range resp.Question {
+		rq := req.Question[i]
+		if q.Qtype != rq.Qtype || q.Qclass != rq.Qclass || !strings.EqualFold(q.Name, rq.Name) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isPlainUDP returns true if u is a plain DNS upstream using UDP.
+func isPlainUDP(u upstream.Upstream) (ok bool) {
+	addr := u.Address()
+	if strings.Contains(addr, "://") {
+		return false
+	}
+
+	_, _, err := net.SplitHostPort(addr)
+
+	return err == nil
+}
+
+// guardUpstreams replaces the plain UDP upstreams in conf with spoof guards.
+// It must be called before the upstreams are wrapped by anything except the
+// bindings, since the wrappers report the addresses of the upstreams they wrap
+// and would be replaced along with them.
+func (s *Server) guardUpstreams(conf *proxy.UpstreamConfig) {
+	timeout := s.conf.UpstreamTimeout
+	if timeout == 0 {
+		timeout = defaultSpoofGuardTimeout
+	}
+
+	guards := map[upstream.Upstream]upstream.Upstream{}
+	wrap := func(ups []upstream.Upstream) {
+		for i, u := range ups {
+			var bind *upstreamBind
+			if bu, ok := u.(*boundUpstream); ok {
+				bind = bu.bind
+			}
+
+			if !isPlainUDP(u) {
+				continue
+			}
+
+			g, ok := guards[u]
+			if !ok {
+				g = &spoofGuard{
+					counters: s.spoof,
+					addr:     u.Address(),
+					bind:     bind,
+					timeout:  timeout,
+					tcpRetry: s.conf.SpoofDetectionTCPRetry,
+				}
+				guards[u] = g
+			}
+
+			ups[i] = g
+		}
+	}
+
+	wrap(conf.Upstreams)
+	for _, ups := range conf.DomainReservedUpstreams {
+		wrap(ups)
+	}
+}
+
+// spoofStatsJSON is the response of the spoofing detection statistics handler.
+type spoofStatsJSON struct {
+	Detected   uint64 `json:"detected"`
+	TCPRetries uint64 `json:"tcp_retries"`
+	Enabled    bool   `json:"enabled"`
+}
+
+// handleSpoofingStats is the handler for the GET /control/spoofing/stats HTTP
+// API.
+func (s *Server) handleSpoofingStats(w http.ResponseWriter, r *http.Request) {
+	s.serverLock.RLock()
+	enabled := s.conf.SpoofDetection
+	s.serverLock.RUnlock()
+
+	resp := spoofStatsJSON{
+		Detected:   atomic.LoadUint64(&s.spoof.detected),
+		TCPRetries: atomic.LoadUint64(&s.spoof.retried),
+		Enabled:    enabled,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "encoding response: %s", err)
+	}
+}
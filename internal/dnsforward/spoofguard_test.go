@@ -0,0 +1,132 @@
+package dnsforward
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSpoofedUpstream starts a plain DNS upstream, which answers each UDP query
+// with the A record from ips in order, and each TCP query with tcpIP.
+func newSpoofedUpstream(t *testing.T, ips []net.IP, tcpIP net.IP) (addr string) {
+	t.Helper()
+
+	answer := func(req *dns.Msg, ip net.IP) (resp *dns.Msg) {
+		resp = (&dns.Msg{}).SetReply(req)
+		resp.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{
+				Name:   req.Question[0].Name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    60,
+			},
+			A: ip,
+		}}
+
+		return resp
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, pc.Close)
+
+	udpSrv := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			for _, ip := range ips {
+				_ = w.WriteMsg(answer(req, ip))
+			}
+		}),
+	}
+	go func() { _ = udpSrv.ActivateAndServe() }()
+
+	addr = pc.LocalAddr().String()
+	l, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	tcpSrv := &dns.Server{
+		Listener: l,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			_ = w.WriteMsg(answer(req, tcpIP))
+		}),
+	}
+	go func() { _ = tcpSrv.ActivateAndServe() }()
+
+	return addr
+}
+
+func TestSpoofGuard_Exchange(t *testing.T) {
+	spoofIP, realIP, tcpIP := net.IP{1, 2, 3, 4}, net.IP{5, 6, 7, 8}, net.IP{9, 9, 9, 9}
+
+	testCases := []struct {
+		wantIP      net.IP
+		name        string
+		ips         []net.IP
+		tcpRetry    bool
+		wantSpoofed bool
+	}{{
+		wantIP:      realIP,
+		name:        "single",
+		ips:         []net.IP{realIP},
+		tcpRetry:    true,
+		wantSpoofed: false,
+	}, {
+		wantIP:      realIP,
+		name:        "same",
+		ips:         []net.IP{realIP, realIP},
+		tcpRetry:    true,
+		wantSpoofed: false,
+	}, {
+		wantIP:      spoofIP,
+		name:        "differing_no_retry",
+		ips:         []net.IP{spoofIP, realIP},
+		tcpRetry:    false,
+		wantSpoofed: true,
+	}, {
+		wantIP:      tcpIP,
+		name:        "differing_retry",
+		ips:         []net.IP{spoofIP, realIP},
+		tcpRetry:    true,
+		wantSpoofed: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			g := &spoofGuard{
+				counters: &spoofCounters{},
+				addr:     newSpoofedUpstream(t, tc.ips, tcpIP),
+				timeout:  time.Second,
+				tcpRetry: tc.tcpRetry,
+			}
+
+			resp, err := g.Exchange(createTestMessage("example.org."))
+			require.NoError(t, err)
+			require.Len(t, resp.Answer, 1)
+
+			a, ok := resp.Answer[0].(*dns.A)
+			require.True(t, ok)
+
+			assert.Equal(t, tc.wantIP.To16(), a.A.To16())
+
+			var wantDetected uint64
+			if tc.wantSpoofed {
+				wantDetected = 1
+			}
+
+			assert.Eventually(t, func() bool {
+				return atomic.LoadUint64(&g.counters.detected) == wantDetected
+			}, time.Second, 10*time.Millisecond)
+
+			if tc.tcpRetry {
+				assert.Equal(t, wantDetected, atomic.LoadUint64(&g.counters.retried))
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package dnsforward
 
 import (
 	"net"
+	"slices"
 	"strings"
 	"time"
 
@@ -28,7 +29,15 @@ func (s *Server) processQueryLogsAndStats(dctx *dnsContext) (rc resultCode) {
 	}
 
 	ip, _ := netutil.IPAndPortFromAddr(pctx.Addr)
-	ip = netutil.CloneIP(ip)
+	if s.isHealthProbe(msg, ip) {
+		return resultCodeSuccess
+	}
+
+	if s.conf.RequestProcessed != nil {
+		s.conf.RequestProcessed(dctx.setts, dctx.result, pctx.Res)
+	}
+
+	ip = slices.Clone(ip)
 
 	s.serverLock.RLock()
 	defer s.serverLock.RUnlock()
@@ -50,6 +59,7 @@ func (s *Server) processQueryLogsAndStats(dctx *dnsContext) (rc resultCode) {
 			ClientID:          dctx.clientID,
 			ClientIP:          ip,
 			AuthenticatedData: dctx.responseAD,
+			ConsensusDiverged: dctx.consensusDiverged,
 		}
 
 		switch pctx.Proto {
@@ -80,6 +90,17 @@ func (s *Server) processQueryLogsAndStats(dctx *dnsContext) (rc resultCode) {
 	return resultCodeSuccess
 }
 
+// isHealthProbe returns true if req from the client with ip is a local health
+// check request.
+func (s *Server) isHealthProbe(req *dns.Msg, ip net.IP) (ok bool) {
+	name := s.conf.HealthProbeName
+	if name == "" || ip == nil || !ip.IsLoopback() || len(req.Question) == 0 {
+		return false
+	}
+
+	return strings.EqualFold(req.Question[0].Name, dns.Fqdn(name))
+}
+
 func (s *Server) updateStats(
 	ctx *dnsContext,
 	elapsed time.Duration,
@@ -113,7 +134,8 @@ func (s *Server) updateStats(
 		e.Result = stats.RSafeSearch
 	case filtering.FilteredBlockList,
 		filtering.FilteredInvalid,
-		filtering.FilteredBlockedService:
+		filtering.FilteredBlockedService,
+		filtering.FilteredQuarantine:
 		e.Result = stats.RFiltered
 	}
 
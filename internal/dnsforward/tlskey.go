@@ -0,0 +1,61 @@
+package dnsforward
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// HasKeyPair returns true if c contains both the certificate chain and the
+// private key, either as the PEM data or as the signer.
+func (c *TLSConfig) HasKeyPair() (ok bool) {
+	return len(c.CertificateChainData) != 0 &&
+		(len(c.PrivateKeyData) != 0 || c.PrivateKeySigner != nil)
+}
+
+// KeyPair returns the TLS certificate made of the certificate chain and the
+// private key from c.  If c.PrivateKeySigner is set, it's used as the private
+// key, and c.PrivateKeyData is ignored.
+func (c *TLSConfig) KeyPair() (cert tls.Certificate, err error) {
+	if c.PrivateKeySigner == nil {
+		return tls.X509KeyPair(c.CertificateChainData, c.PrivateKeyData)
+	}
+
+	rest := c.CertificateChainData
+	for {
+		var b *pem.Block
+		b, rest = pem.Decode(rest)
+		if b == nil {
+			break
+		}
+
+		if b.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, b.Bytes)
+		}
+	}
+
+	if len(cert.Certificate) == 0 {
+		return tls.Certificate{}, errors.Error("tls: no certificates found in the chain")
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("tls: parsing certificate: %w", err)
+	}
+
+	pub, ok := leaf.PublicKey.(interface{ Equal(x crypto.PublicKey) bool })
+	if !ok || !pub.Equal(c.PrivateKeySigner.Public()) {
+		return tls.Certificate{}, errors.Error(
+			"tls: private key does not match public key",
+		)
+	}
+
+	cert.PrivateKey = c.PrivateKeySigner
+	cert.Leaf = leaf
+
+	return cert, nil
+}
@@ -0,0 +1,76 @@
+package dnsforward
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSigner is a crypto.Signer, which hides the type of the wrapped private
+// key, like the signers of the hardware tokens do.
+type testSigner struct {
+	crypto.Signer
+}
+
+func TestTLSConfig_KeyPair(t *testing.T) {
+	_, certPem, keyPem := createServerTLSConfig(t)
+
+	b, _ := pem.Decode(keyPem)
+	require.NotNil(t, b)
+
+	key, err := x509.ParsePKCS1PrivateKey(b.Bytes)
+	require.NoError(t, err)
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		signer     crypto.Signer
+		name       string
+		wantErrMsg string
+		chain      []byte
+	}{{
+		signer:     testSigner{Signer: key},
+		name:       "success",
+		wantErrMsg: "",
+		chain:      certPem,
+	}, {
+		signer:     testSigner{Signer: otherKey},
+		name:       "mismatch",
+		wantErrMsg: "tls: private key does not match public key",
+		chain:      certPem,
+	}, {
+		signer:     testSigner{Signer: key},
+		name:       "no_chain",
+		wantErrMsg: "tls: no certificates found in the chain",
+		chain:      keyPem,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &TLSConfig{
+				CertificateChainData: tc.chain,
+				PrivateKeySigner:     tc.signer,
+			}
+			require.True(t, c.HasKeyPair())
+
+			cert, kpErr := c.KeyPair()
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, kpErr)
+			if tc.wantErrMsg != "" {
+				return
+			}
+
+			assert.Equal(t, tc.signer, cert.PrivateKey)
+			require.NotNil(t, cert.Leaf)
+			assert.Len(t, cert.Certificate, 1)
+		})
+	}
+}
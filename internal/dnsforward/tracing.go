@@ -0,0 +1,634 @@
+package dnsforward
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+)
+
+// Parameters of the trace exporter.
+const (
+	// defaultTraceServiceName is the name of the service reported to the
+	// collector used when the name isn't set.
+	defaultTraceServiceName = "adguardhome"
+
+	// defaultTraceSampleRatio is the fraction of the traced requests used when
+	// the ratio isn't set.
+	defaultTraceSampleRatio = 0.01
+
+	// defaultTraceExportIvl is the interval between the exports used when the
+	// interval isn't set.
+	defaultTraceExportIvl = 5 * time.Second
+
+	// traceExportTimeout is the timeout of a single export.
+	traceExportTimeout = 10 * time.Second
+
+	// maxTraceBatch is the maximum number of the spans in a single export.
+	maxTraceBatch = 512
+
+	// maxQueuedSpans is the maximum number of the spans waiting for the
+	// export.  The spans finished while the queue is full are dropped, so
+	// that a slow collector never delays the queries.
+	maxQueuedSpans = 4 * maxTraceBatch
+
+	// traceScopeName is the name of the instrumentation scope.
+	traceScopeName = "github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
+)
+
+// TracingConfig is the configuration of the exporter of the OpenTelemetry
+// traces of the query processing.
+type TracingConfig struct {
+	// Headers are added to each export request, for example to authenticate
+	// at the collector.
+	Headers map[string]string `yaml:"headers"`
+
+	// URL is the OTLP/HTTP traces endpoint of the collector, for example
+	// "http://localhost:4318/v1/traces".  If it's empty, the tracing is
+	// disabled.
+	URL string `yaml:"url"`
+
+	// ServiceName is the name of the service reported to the collector.  If
+	// it's empty, "adguardhome" is used.
+	ServiceName string `yaml:"service_name"`
+
+	// SampleRatio is the fraction of the traced requests, from 0 to 1.  If
+	// it's zero, one percent of the requests is traced.  The DNS-over-HTTPS
+	// requests with a W3C traceparent header are traced according to its
+	// sampled flag instead.
+	SampleRatio float64 `yaml:"sample_ratio"`
+
+	// Interval is the interval between the exports.  If it's zero, the spans
+	// are exported every five seconds.
+	Interval timeutil.Duration `yaml:"interval"`
+}
+
+// validate returns an error if the tracing configuration is invalid.
+func (c *TracingConfig) validate() (err error) {
+	if c.URL == "" {
+		return nil
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("url: %w", err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("url: bad scheme %q", u.Scheme)
+	}
+
+	if c.SampleRatio < 0 || c.SampleRatio > 1 || math.IsNaN(c.SampleRatio) {
+		return fmt.Errorf("sample_ratio: must be from 0 to 1, got %v", c.SampleRatio)
+	}
+
+	return nil
+}
+
+// Kinds of the spans as defined by OTLP.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// spanStatusError is the OTLP status code of the failed spans.
+const spanStatusError = 2
+
+// traceID and spanID are the identifiers of the traces and the spans.
+type (
+	traceID [16]byte
+	spanID  [8]byte
+)
+
+// otlpValue is an OTLP attribute value.  Exactly one of the fields is set.
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+// otlpAttr is an OTLP attribute.
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// strAttr returns a string attribute.
+func strAttr(key, val string) (a otlpAttr) {
+	return otlpAttr{Key: key, Value: otlpValue{StringValue: &val}}
+}
+
+// intAttr returns an integer attribute.  OTLP/JSON encodes 64-bit integers as
+// strings.
+func intAttr(key string, val int64) (a otlpAttr) {
+	s := strconv.FormatInt(val, 10)
+
+	return otlpAttr{Key: key, Value: otlpValue{IntValue: &s}}
+}
+
+// boolAttr returns a boolean attribute.
+func boolAttr(key string, val bool) (a otlpAttr) {
+	return otlpAttr{Key: key, Value: otlpValue{BoolValue: &val}}
+}
+
+// otlpStatus is the status of an OTLP span.
+type otlpStatus struct {
+	Message string `json:"message,omitempty"`
+	Code    int    `json:"code"`
+}
+
+// otlpSpan is a finished span in the OTLP/JSON encoding.
+type otlpSpan struct {
+	Status       *otlpStatus `json:"status,omitempty"`
+	TraceID      string      `json:"traceId"`
+	SpanID       string      `json:"spanId"`
+	ParentSpanID string      `json:"parentSpanId,omitempty"`
+	Name         string      `json:"name"`
+	Attributes   []otlpAttr  `json:"attributes,omitempty"`
+	Start        uint64      `json:"startTimeUnixNano,string"`
+	End          uint64      `json:"endTimeUnixNano,string"`
+	Kind         int         `json:"kind"`
+}
+
+// otlpExport is the body of an OTLP/HTTP traces export request.
+type otlpExport struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// otlpResourceSpans are the spans of a single resource.
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+// otlpResource describes the service emitting the spans.
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+// otlpScopeSpans are the spans of a single instrumentation scope.
+type otlpScopeSpans struct {
+	Scope otlpScope   `json:"scope"`
+	Spans []*otlpSpan `json:"spans"`
+}
+
+// otlpScope is the instrumentation scope.
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+// tracer samples the requests and exports their spans to an OpenTelemetry
+// collector using OTLP/HTTP with the JSON encoding.
+type tracer struct {
+	// spans are the finished spans waiting for the export.
+	spans chan *otlpSpan
+
+	// done is closed to stop the exports.  It's nil if the tracer isn't
+	// running.
+	done chan struct{}
+
+	// stopped is closed once the remaining spans are exported after done is
+	// closed.
+	stopped chan struct{}
+
+	// cli is the client used for the exports.
+	cli *http.Client
+
+	// headers are added to each export request.
+	headers map[string]string
+
+	// url is the traces endpoint of the collector.
+	url string
+
+	// serviceName is the name of the service reported to the collector.
+	serviceName string
+
+	// ratio is the fraction of the traced requests.
+	ratio float64
+
+	// ivl is the interval between the exports.
+	ivl time.Duration
+}
+
+// newTracer returns a new tracer for conf.  It returns nil if the tracing is
+// disabled.  conf is assumed to be valid.
+func newTracer(conf *TracingConfig) (t *tracer) {
+	if conf.URL == "" {
+		return nil
+	}
+
+	serviceName := conf.ServiceName
+	if serviceName == "" {
+		serviceName = defaultTraceServiceName
+	}
+
+	ratio := conf.SampleRatio
+	if ratio == 0 {
+		ratio = defaultTraceSampleRatio
+	}
+
+	ivl := conf.Interval.Duration
+	if ivl == 0 {
+		ivl = defaultTraceExportIvl
+	}
+
+	return &tracer{
+		spans:       make(chan *otlpSpan, maxQueuedSpans),
+		cli:         &http.Client{Timeout: traceExportTimeout},
+		headers:     conf.Headers,
+		url:         conf.URL,
+		serviceName: serviceName,
+		ratio:       ratio,
+		ivl:         ivl,
+	}
+}
+
+// start starts exporting the spans.  t may be nil.
+func (t *tracer) start() {
+	if t == nil || t.done != nil {
+		return
+	}
+
+	t.done = make(chan struct{})
+	t.stopped = make(chan struct{})
+	go t.run(t.done, t.stopped)
+}
+
+// stop exports the remaining spans and stops the exports.  t may be nil.
+func (t *tracer) stop() {
+	if t == nil || t.done == nil {
+		return
+	}
+
+	close(t.done)
+	<-t.stopped
+	t.done, t.stopped = nil, nil
+}
+
+// run exports the spans every t.ivl or once a batch is full until done is
+// closed, and then exports the remaining ones and closes stopped.
+func (t *tracer) run(done <-chan struct{}, stopped chan<- struct{}) {
+	defer aghos.OnPanicAndExit("dns: tracer")
+	defer close(stopped)
+
+	tick := time.NewTicker(t.ivl)
+	defer tick.Stop()
+
+	batch := make([]*otlpSpan, 0, maxTraceBatch)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		err := t.export(batch)
+		if err != nil {
+			log.Error("dns: exporting %d spans: %s", len(batch), err)
+		}
+
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case sp := <-t.spans:
+			batch = append(batch, sp)
+			if len(batch) == maxTraceBatch {
+				flush()
+			}
+		case <-tick.C:
+			flush()
+		case <-done:
+			for {
+				select {
+				case sp := <-t.spans:
+					batch = append(batch, sp)
+					if len(batch) == maxTraceBatch {
+						flush()
+					}
+				default:
+					flush()
+
+					return
+				}
+			}
+		}
+	}
+}
+
+// export sends spans to the collector.
+func (t *tracer) export(spans []*otlpSpan) (err error) {
+	body, err := json.Marshal(&otlpExport{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpAttr{strAttr("service.name", t.serviceName)},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: traceScopeName},
+				Spans: spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("encoding: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := t.cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	// Drain the body to reuse the connection.
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// enqueue queues sp for the export or drops it if the queue is full.
+func (t *tracer) enqueue(sp *otlpSpan) {
+	select {
+	case t.spans <- sp:
+	default:
+		log.Debug("dns: tracing: queue is full, dropping span %q", sp.Name)
+	}
+}
+
+// parseTraceparent parses the value of a W3C traceparent header.
+func parseTraceparent(v string) (tid traceID, parent spanID, sampled bool, err error) {
+	parts := strings.Split(v, "-")
+	if len(parts) < 4 {
+		return tid, parent, false, fmt.Errorf("bad traceparent %q", v)
+	}
+
+	var flags [1]byte
+	for _, f := range []struct {
+		dst []byte
+		val string
+	}{{
+		dst: tid[:],
+		val: parts[1],
+	}, {
+		dst: parent[:],
+		val: parts[2],
+	}, {
+		dst: flags[:],
+		val: parts[3],
+	}} {
+		if hex.DecodedLen(len(f.val)) != len(f.dst) {
+			return tid, parent, false, fmt.Errorf("bad traceparent %q", v)
+		}
+
+		if _, err = hex.Decode(f.dst, []byte(f.val)); err != nil {
+			return tid, parent, false, fmt.Errorf("bad traceparent %q: %w", v, err)
+		}
+	}
+
+	if parts[0] == "ff" || tid == (traceID{}) || parent == (spanID{}) {
+		return tid, parent, false, fmt.Errorf("bad traceparent %q", v)
+	}
+
+	return tid, parent, flags[0]&0x1 != 0, nil
+}
+
+// requestTrace is the trace of the processing of a single sampled request.
+type requestTrace struct {
+	// tracer exports the spans once the request is processed.
+	tracer *tracer
+
+	// spans are the finished child spans.
+	spans []*otlpSpan
+
+	// start is the time the request was received at.
+	start time.Time
+
+	// id is the ID of the trace.
+	id traceID
+
+	// root is the ID of the span of the whole request.
+	root spanID
+
+	// parent is the ID of the remote parent span.  It's zero if there is no
+	// such span.
+	parent spanID
+}
+
+// newSpanID returns a new random span ID.
+func newSpanID() (id spanID) {
+	_, _ = rand.Read(id[:])
+
+	return id
+}
+
+// startTrace returns the trace of the request if it's sampled and nil
+// otherwise.  t may be nil.
+func (t *tracer) startTrace(dctx *dnsContext) (tr *requestTrace) {
+	if t == nil {
+		return nil
+	}
+
+	pctx := dctx.proxyCtx
+	tr = &requestTrace{
+		tracer: t,
+		start:  pctx.StartTime,
+	}
+
+	sampled := false
+	if r := pctx.HTTPRequest; r != nil && r.Header.Get("traceparent") != "" {
+		var err error
+		tr.id, tr.parent, sampled, err = parseTraceparent(r.Header.Get("traceparent"))
+		if err != nil {
+			log.Debug("dns: tracing: %s", err)
+		}
+	}
+
+	if tr.parent == (spanID{}) {
+		sampled = mathrand.Float64() < t.ratio
+		_, _ = rand.Read(tr.id[:])
+	}
+
+	if !sampled {
+		return nil
+	}
+
+	tr.root = newSpanID()
+	if tr.start.IsZero() {
+		tr.start = dctx.startTime
+	}
+
+	return tr
+}
+
+// span returns a finished child span of the request.
+func (tr *requestTrace) span(name string, kind int, start, end time.Time) (sp *otlpSpan) {
+	id := newSpanID()
+	sp = &otlpSpan{
+		TraceID:      hex.EncodeToString(tr.id[:]),
+		SpanID:       hex.EncodeToString(id[:]),
+		ParentSpanID: hex.EncodeToString(tr.root[:]),
+		Name:         name,
+		Start:        uint64(start.UnixNano()),
+		End:          uint64(end.UnixNano()),
+		Kind:         kind,
+	}
+	tr.spans = append(tr.spans, sp)
+
+	return sp
+}
+
+// finish exports the span of the whole request along with the child spans.
+func (tr *requestTrace) finish(dctx *dnsContext, end time.Time) {
+	pctx := dctx.proxyCtx
+	root := &otlpSpan{
+		TraceID: hex.EncodeToString(tr.id[:]),
+		SpanID:  hex.EncodeToString(tr.root[:]),
+		Name:    "dns.request",
+		Start:   uint64(tr.start.UnixNano()),
+		End:     uint64(end.UnixNano()),
+		Kind:    spanKindServer,
+	}
+
+	if tr.parent != (spanID{}) {
+		root.ParentSpanID = hex.EncodeToString(tr.parent[:])
+	}
+
+	if q := pctx.Req.Question; len(q) > 0 {
+		root.Attributes = append(
+			root.Attributes,
+			strAttr("dns.question.name", q[0].Name),
+			strAttr("dns.question.type", dns.Type(q[0].Qtype).String()),
+		)
+	}
+
+	root.Attributes = append(root.Attributes, strAttr("network.protocol.name", string(pctx.Proto)))
+	if ip, _ := netutil.IPAndPortFromAddr(pctx.Addr); ip != nil {
+		root.Attributes = append(root.Attributes, strAttr("client.address", ip.String()))
+	}
+
+	if dctx.clientID != "" {
+		root.Attributes = append(root.Attributes, strAttr("dns.client_id", dctx.clientID))
+	}
+
+	if res := dctx.result; res != nil {
+		root.Attributes = append(root.Attributes, boolAttr("dns.filtered", res.IsFiltered))
+	}
+
+	if pctx.Res != nil {
+		root.Attributes = append(
+			root.Attributes,
+			strAttr("dns.response.code", dns.RcodeToString[pctx.Res.Rcode]),
+			intAttr("dns.response.answers", int64(len(pctx.Res.Answer))),
+		)
+	}
+
+	if dctx.err != nil {
+		root.Status = &otlpStatus{Code: spanStatusError, Message: dctx.err.Error()}
+	}
+
+	tr.tracer.enqueue(root)
+	for _, sp := range tr.spans {
+		tr.tracer.enqueue(sp)
+	}
+}
+
+// startRequestTrace samples the request and, if it's sampled, records the
+// span of the processing done by dnsproxy and the access checks before the
+// request got to handleDNSRequest.
+func (s *Server) startRequestTrace(dctx *dnsContext) {
+	dctx.trace = s.tracer.startTrace(dctx)
+	if dctx.trace == nil {
+		return
+	}
+
+	dctx.trace.span("access_check", spanKindInternal, dctx.trace.start, dctx.startTime)
+}
+
+// finishRequestTrace exports the trace of the request, if it's sampled.
+func (s *Server) finishRequestTrace(dctx *dnsContext) {
+	if dctx.trace != nil {
+		dctx.trace.finish(dctx, time.Now())
+	}
+}
+
+// traced returns a processing function recording a span named name for every
+// call of f within the sampled requests.
+func traced(
+	name string,
+	f func(dctx *dnsContext) (rc resultCode),
+) (traced func(dctx *dnsContext) (rc resultCode)) {
+	return func(dctx *dnsContext) (rc resultCode) {
+		if dctx.trace == nil {
+			return f(dctx)
+		}
+
+		start := time.Now()
+		rc = f(dctx)
+		dctx.trace.span(name, spanKindInternal, start, time.Now())
+
+		return rc
+	}
+}
+
+// processUpstreamTraced calls processUpstream and records either the cache or
+// the upstream exchange span within the sampled requests.
+func (s *Server) processUpstreamTraced(dctx *dnsContext) (rc resultCode) {
+	pctx := dctx.proxyCtx
+	if dctx.trace == nil || pctx.Res != nil {
+		return s.processUpstream(dctx)
+	}
+
+	start := time.Now()
+	rc = s.processUpstream(dctx)
+	end := time.Now()
+
+	var sp *otlpSpan
+	if pctx.Upstream == nil && pctx.CachedUpstreamAddr != "" {
+		sp = dctx.trace.span("cache", spanKindInternal, start, end)
+		sp.Attributes = append(
+			sp.Attributes,
+			boolAttr("dns.cache.hit", true),
+			strAttr("dns.upstream", pctx.CachedUpstreamAddr),
+		)
+
+		return rc
+	}
+
+	sp = dctx.trace.span("upstream_exchange", spanKindClient, start, end)
+	if pctx.Upstream != nil {
+		sp.Attributes = append(sp.Attributes, strAttr("dns.upstream", pctx.Upstream.Address()))
+	}
+
+	if dctx.err != nil {
+		sp.Status = &otlpStatus{Code: spanStatusError, Message: dctx.err.Error()}
+	}
+
+	return rc
+}
@@ -0,0 +1,194 @@
+package dnsforward
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	testCases := []struct {
+		name        string
+		in          string
+		wantErr     bool
+		wantSampled bool
+	}{{
+		name:        "sampled",
+		in:          "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		wantErr:     false,
+		wantSampled: true,
+	}, {
+		name:        "not_sampled",
+		in:          "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+		wantErr:     false,
+		wantSampled: false,
+	}, {
+		name:        "zero_trace",
+		in:          "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		wantErr:     true,
+		wantSampled: false,
+	}, {
+		name:        "short",
+		in:          "00-4bf92f3577b34da6-00f067aa0ba902b7-01",
+		wantErr:     true,
+		wantSampled: false,
+	}, {
+		name:        "garbage",
+		in:          "garbage",
+		wantErr:     true,
+		wantSampled: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tid, parent, sampled, err := parseTraceparent(tc.in)
+			if tc.wantErr {
+				assert.Error(t, err)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.wantSampled, sampled)
+			assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", hex.EncodeToString(tid[:]))
+			assert.Equal(t, "00f067aa0ba902b7", hex.EncodeToString(parent[:]))
+		})
+	}
+}
+
+func TestTracer_export(t *testing.T) {
+	var mu sync.Mutex
+	var exports []*otlpExport
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "secret", r.Header.Get("X-Token"))
+
+		e := &otlpExport{}
+		err := json.NewDecoder(r.Body).Decode(e)
+		require.NoError(t, err)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		exports = append(exports, e)
+	}))
+	t.Cleanup(srv.Close)
+
+	tr := newTracer(&TracingConfig{
+		Headers:     map[string]string{"X-Token": "secret"},
+		URL:         srv.URL,
+		SampleRatio: 1,
+	})
+	require.NotNil(t, tr)
+
+	tr.start()
+
+	now := time.Now()
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	dctx := &dnsContext{
+		proxyCtx: &proxy.DNSContext{
+			Proto:     proxy.ProtoDNSCrypt,
+			Req:       req,
+			Res:       (&dns.Msg{}).SetReply(req),
+			Addr:      &net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 53},
+			StartTime: now.Add(-time.Millisecond),
+			HTTPRequest: &http.Request{
+				Header: http.Header{
+					"Traceparent": []string{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+				},
+			},
+		},
+		result:    &filtering.Result{},
+		startTime: now,
+	}
+
+	s := &Server{tracer: tr}
+	s.startRequestTrace(dctx)
+	require.NotNil(t, dctx.trace)
+
+	rc := traced("filtering_request", func(_ *dnsContext) (rc resultCode) {
+		return resultCodeSuccess
+	})(dctx)
+	require.Equal(t, resultCodeSuccess, rc)
+
+	s.finishRequestTrace(dctx)
+	tr.stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	require.Len(t, exports, 1)
+	require.Len(t, exports[0].ResourceSpans, 1)
+
+	rs := exports[0].ResourceSpans[0]
+	require.Len(t, rs.Resource.Attributes, 1)
+	require.NotNil(t, rs.Resource.Attributes[0].Value.StringValue)
+
+	assert.Equal(t, defaultTraceServiceName, *rs.Resource.Attributes[0].Value.StringValue)
+
+	require.Len(t, rs.ScopeSpans, 1)
+
+	spans := rs.ScopeSpans[0].Spans
+	require.Len(t, spans, 3)
+
+	root := spans[0]
+	assert.Equal(t, "dns.request", root.Name)
+	assert.Equal(t, spanKindServer, root.Kind)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", root.TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", root.ParentSpanID)
+	assert.Less(t, root.Start, root.End)
+
+	names := []string{}
+	for _, sp := range spans[1:] {
+		names = append(names, sp.Name)
+
+		assert.Equal(t, root.TraceID, sp.TraceID)
+		assert.Equal(t, root.SpanID, sp.ParentSpanID)
+	}
+
+	assert.Equal(t, []string{"access_check", "filtering_request"}, names)
+}
+
+func TestTracer_startTrace(t *testing.T) {
+	tr := newTracer(&TracingConfig{
+		URL:         "http://127.0.0.1:4318/v1/traces",
+		SampleRatio: 1,
+	})
+	require.NotNil(t, tr)
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	newCtx := func(traceparent string) (dctx *dnsContext) {
+		pctx := &proxy.DNSContext{
+			Proto:     proxy.ProtoHTTPS,
+			Req:       req,
+			StartTime: time.Now(),
+		}
+		if traceparent != "" {
+			pctx.HTTPRequest = &http.Request{
+				Header: http.Header{"Traceparent": []string{traceparent}},
+			}
+		}
+
+		return &dnsContext{proxyCtx: pctx}
+	}
+
+	assert.NotNil(t, tr.startTrace(newCtx("")))
+	assert.NotNil(t, tr.startTrace(newCtx("garbage")))
+	assert.Nil(t, tr.startTrace(newCtx("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")))
+
+	var disabled *tracer
+	assert.Nil(t, disabled.startTrace(newCtx("")))
+	assert.Nil(t, newTracer(&TracingConfig{}))
+}
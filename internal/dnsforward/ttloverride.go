@@ -0,0 +1,194 @@
+package dnsforward
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// TTLOverrideRule is a rule overriding the TTLs of the responses for the
+// domains.
+type TTLOverrideRule struct {
+	// Domains are the domains, which the rule is applied to, along with their
+	// subdomains.
+	Domains []string `yaml:"domains"`
+
+	// Min is the minimum TTL of the responses.  Zero means no override.
+	Min uint32 `yaml:"min"`
+
+	// Max is the maximum TTL of the responses.  Zero means no override.
+	Max uint32 `yaml:"max"`
+}
+
+// ttlRange is the range of the TTLs.  Zero bounds mean no override.
+type ttlRange struct {
+	min uint32
+	max uint32
+}
+
+// clamp returns ttl within r.
+func (r ttlRange) clamp(ttl uint32) (clamped uint32) {
+	if ttl < r.min {
+		return r.min
+	}
+
+	if r.max != 0 && ttl > r.max {
+		return r.max
+	}
+
+	return ttl
+}
+
+// ttlOverrides are the compiled TTL override settings.
+type ttlOverrides struct {
+	// domains are the TTL ranges of the domain rules by the lowercased FQDNs
+	// of the domains.
+	domains map[string]ttlRange
+
+	// negative is the TTL range of the NXDOMAIN and NODATA responses.
+	negative ttlRange
+}
+
+// newTTLOverrides compiles the TTL override settings of conf.  o is nil if
+// there is nothing to override.
+func newTTLOverrides(conf *FilteringConfig) (o *ttlOverrides, err error) {
+	negative := ttlRange{
+		min: conf.CacheNegativeMinTTL,
+		max: conf.CacheNegativeMaxTTL,
+	}
+	if negative.max != 0 && negative.min > negative.max {
+		return nil, fmt.Errorf("negative ttl: min %d is greater than max %d", negative.min, negative.max)
+	}
+
+	domains := map[string]ttlRange{}
+	for i, rule := range conf.CacheTTLRules {
+		if rule.Max != 0 && rule.Min > rule.Max {
+			return nil, fmt.Errorf("ttl rule at index %d: min %d is greater than max %d", i, rule.Min, rule.Max)
+		}
+
+		for _, d := range rule.Domains {
+			d = strings.ToLower(strings.TrimSuffix(d, "."))
+			err = netutil.ValidateHostname(d)
+			if err != nil {
+				return nil, fmt.Errorf("ttl rule at index %d: %w", i, err)
+			}
+
+			domains[dns.Fqdn(d)] = ttlRange{min: rule.Min, max: rule.Max}
+		}
+	}
+
+	if negative == (ttlRange{}) && len(domains) == 0 {
+		return nil, nil
+	}
+
+	return &ttlOverrides{
+		domains:  domains,
+		negative: negative,
+	}, nil
+}
+
+// rangeFor returns the TTL range for resp.  ok is false if the TTLs of resp
+// shouldn't be overridden.  The most specific domain rule has priority over
+// the negative range.
+func (o *ttlOverrides) rangeFor(resp *dns.Msg) (r ttlRange, ok bool) {
+	if len(resp.Question) == 1 {
+		name := strings.ToLower(resp.Question[0].Name)
+		for {
+			if r, ok = o.domains[name]; ok {
+				return r, true
+			}
+
+			i := strings.IndexByte(name, '.')
+			if i < 0 || i == len(name)-1 {
+				break
+			}
+
+			name = name[i+1:]
+		}
+	}
+
+	isNegative := resp.Rcode == dns.RcodeNameError ||
+		(resp.Rcode == dns.RcodeSuccess && len(resp.Answer) == 0)
+	if isNegative && o.negative != (ttlRange{}) {
+		return o.negative, true
+	}
+
+	return ttlRange{}, false
+}
+
+// apply overrides the TTLs of the records of resp.  The MINIMUM field of the
+// SOA records is also overridden, since it limits the negative caching.  See
+// RFC 2308.
+func (o *ttlOverrides) apply(resp *dns.Msg) {
+	r, ok := o.rangeFor(resp)
+	if !ok {
+		return
+	}
+
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			hdr.Ttl = r.clamp(hdr.Ttl)
+			if soa, isSOA := rr.(*dns.SOA); isSOA {
+				soa.Minttl = r.clamp(soa.Minttl)
+			}
+		}
+	}
+}
+
+// ttlOverrideUpstream is an upstream, which overrides the TTLs of the
+// responses of the wrapped one, so that they're cached by dnsproxy with the
+// overridden TTLs.
+type ttlOverrideUpstream struct {
+	upstream.Upstream
+
+	overrides *ttlOverrides
+}
+
+// type check
+var _ upstream.Upstream = (*ttlOverrideUpstream)(nil)
+
+// Exchange implements the upstream.Upstream interface for
+// *ttlOverrideUpstream.
+func (u *ttlOverrideUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	resp, err = u.Upstream.Exchange(req)
+	if resp != nil {
+		u.overrides.apply(resp)
+	}
+
+	return resp, err
+}
+
+// applyTTLOverrides wraps the upstreams of conf with the ones overriding the
+// TTLs of the responses according to the configuration of s.
+func (s *Server) applyTTLOverrides(conf *proxy.UpstreamConfig) (err error) {
+	o, err := newTTLOverrides(&s.conf.FilteringConfig)
+	if err != nil {
+		return fmt.Errorf("ttl overrides: %w", err)
+	} else if o == nil {
+		return nil
+	}
+
+	wrap := func(ups []upstream.Upstream) {
+		for i, u := range ups {
+			if _, ok := u.(*ttlOverrideUpstream); !ok {
+				ups[i] = &ttlOverrideUpstream{Upstream: u, overrides: o}
+			}
+		}
+	}
+
+	wrap(conf.Upstreams)
+	for _, ups := range conf.DomainReservedUpstreams {
+		wrap(ups)
+	}
+
+	return nil
+}
@@ -0,0 +1,194 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTTLOverrides_apply(t *testing.T) {
+	o, err := newTTLOverrides(&FilteringConfig{
+		CacheNegativeMinTTL: 60,
+		CacheNegativeMaxTTL: 600,
+		CacheTTLRules: []*TTLOverrideRule{{
+			Domains: []string{"Example.com"},
+			Min:     300,
+		}, {
+			Domains: []string{"short.example.com."},
+			Max:     10,
+		}},
+	})
+	require.NoError(t, err)
+	require.NotNil(t, o)
+
+	newResp := func(host string, rcode int, ttl uint32) (resp *dns.Msg) {
+		resp = (&dns.Msg{}).SetRcode((&dns.Msg{}).SetQuestion(host, dns.TypeA), rcode)
+		if rcode == dns.RcodeSuccess {
+			resp.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+				A:   net.IP{192, 0, 2, 1},
+			}}
+		} else {
+			resp.Ns = []dns.RR{&dns.SOA{
+				Hdr:    dns.RR_Header{Name: host, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+				Ns:     "ns.example.",
+				Mbox:   "hostmaster.example.",
+				Minttl: ttl,
+			}}
+		}
+
+		return resp
+	}
+
+	testCases := []struct {
+		resp    *dns.Msg
+		name    string
+		wantTTL uint32
+	}{{
+		resp:    newResp("nx.example.org.", dns.RcodeNameError, 0),
+		name:    "nxdomain_min",
+		wantTTL: 60,
+	}, {
+		resp:    newResp("nx.example.org.", dns.RcodeNameError, 3600),
+		name:    "nxdomain_max",
+		wantTTL: 600,
+	}, {
+		resp:    newResp("ok.example.org.", dns.RcodeSuccess, 5),
+		name:    "positive",
+		wantTTL: 5,
+	}, {
+		resp:    newResp("www.example.com.", dns.RcodeSuccess, 5),
+		name:    "rule_subdomain",
+		wantTTL: 300,
+	}, {
+		resp:    newResp("nx.example.com.", dns.RcodeNameError, 5),
+		name:    "rule_over_negative",
+		wantTTL: 300,
+	}, {
+		resp:    newResp("a.short.example.com.", dns.RcodeSuccess, 3600),
+		name:    "rule_specific",
+		wantTTL: 10,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			o.apply(tc.resp)
+
+			var rr dns.RR
+			if len(tc.resp.Answer) > 0 {
+				rr = tc.resp.Answer[0]
+			} else {
+				require.Len(t, tc.resp.Ns, 1)
+
+				rr = tc.resp.Ns[0]
+				assert.Equal(t, tc.wantTTL, rr.(*dns.SOA).Minttl)
+			}
+
+			assert.Equal(t, tc.wantTTL, rr.Header().Ttl)
+		})
+	}
+}
+
+func TestNewTTLOverrides_errors(t *testing.T) {
+	testCases := []struct {
+		conf       *FilteringConfig
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       &FilteringConfig{},
+		name:       "empty",
+		wantErrMsg: "",
+	}, {
+		conf: &FilteringConfig{
+			CacheNegativeMinTTL: 60,
+			CacheNegativeMaxTTL: 10,
+		},
+		name:       "negative",
+		wantErrMsg: "negative ttl: min 60 is greater than max 10",
+	}, {
+		conf: &FilteringConfig{
+			CacheTTLRules: []*TTLOverrideRule{{
+				Domains: []string{"example.com"},
+				Min:     60,
+				Max:     10,
+			}},
+		},
+		name:       "rule_range",
+		wantErrMsg: "ttl rule at index 0: min 60 is greater than max 10",
+	}, {
+		conf: &FilteringConfig{
+			CacheTTLRules: []*TTLOverrideRule{{
+				Domains: []string{"-bad"},
+				Min:     60,
+			}},
+		},
+		name: "rule_domain",
+		wantErrMsg: `ttl rule at index 0: bad hostname "-bad": ` +
+			`bad top-level domain name label "-bad": ` +
+			`bad top-level domain name label rune '-'`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			o, err := newTTLOverrides(tc.conf)
+			if tc.wantErrMsg == "" {
+				assert.NoError(t, err)
+				assert.Nil(t, o)
+
+				return
+			}
+
+			require.Error(t, err)
+
+			assert.Equal(t, tc.wantErrMsg, err.Error())
+		})
+	}
+}
+
+func TestServer_applyTTLOverrides(t *testing.T) {
+	const host = "host.example."
+
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				CacheTTLRules: []*TTLOverrideRule{{
+					Domains: []string{"example"},
+					Min:     60,
+				}},
+			},
+		},
+	}
+
+	ups := &aghtest.TestUpstream{
+		IPv4: map[string][]net.IP{host: {{192, 0, 2, 1}}},
+		Addr: "test",
+	}
+	conf := &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{ups},
+		DomainReservedUpstreams: map[string][]upstream.Upstream{
+			"example.": {ups},
+		},
+	}
+
+	err := s.applyTTLOverrides(conf)
+	require.NoError(t, err)
+
+	require.Len(t, conf.Upstreams, 1)
+	require.IsType(t, (*ttlOverrideUpstream)(nil), conf.Upstreams[0])
+	require.IsType(t, (*ttlOverrideUpstream)(nil), conf.DomainReservedUpstreams["example."][0])
+
+	assert.Equal(t, "test", conf.Upstreams[0].Address())
+
+	resp, err := conf.Upstreams[0].Exchange((&dns.Msg{}).SetQuestion(host, dns.TypeA))
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+	require.Len(t, resp.Answer, 1)
+
+	assert.Equal(t, uint32(60), resp.Answer[0].Header().Ttl)
+}
@@ -0,0 +1,49 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// maxTunnelResponseSize is the maximum size of the DNS responses sent through
+// the tunnels.  It keeps the responses within the usual WireGuard MTU of 1420
+// bytes together with the IPv6 and UDP headers.
+const maxTunnelResponseSize = 1232
+
+// ServeTunnelDNS processes the DNS request packet received through a tunnel,
+// such as WireGuard, from client and returns the packed response.  resp is
+// nil if there is nothing to reply.
+func (s *Server) ServeTunnelDNS(packet []byte, client *net.UDPAddr) (resp []byte, err error) {
+	req := &dns.Msg{}
+	err = req.Unpack(packet)
+	if err != nil {
+		return nil, fmt.Errorf("unpacking request: %w", err)
+	} else if req.Response {
+		return nil, nil
+	}
+
+	pctx := &proxy.DNSContext{
+		Proto:     proxy.ProtoUDP,
+		Req:       req,
+		Addr:      client,
+		StartTime: time.Now(),
+	}
+
+	if !s.serveRequest(pctx) {
+		return nil, nil
+	}
+
+	size := udpSize(req)
+	if size > maxTunnelResponseSize {
+		size = maxTunnelResponseSize
+	}
+
+	pctx.Res.Truncate(size)
+	pctx.Res.Compress = true
+
+	return pctx.Res.Pack()
+}
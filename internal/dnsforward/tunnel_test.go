@@ -0,0 +1,73 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_ServeTunnelDNS(t *testing.T) {
+	bigIPs := make([]net.IP, 100)
+	for i := range bigIPs {
+		bigIPs[i] = net.IP{0x20, 0x01, 0x0d, 0xb8, 15: byte(i)}
+	}
+
+	s := createTestServer(t, &filtering.Config{}, ServerConfig{
+		UDPListenAddrs: []*net.UDPAddr{{IP: net.IP{127, 0, 0, 1}}},
+		TCPListenAddrs: []*net.TCPAddr{{IP: net.IP{127, 0, 0, 1}}},
+	}, nil)
+	s.conf.UpstreamConfig.Upstreams = []upstream.Upstream{
+		&aghtest.TestUpstream{
+			IPv4: map[string][]net.IP{
+				"google-public-dns-a.google.com.": {{8, 8, 8, 8}},
+			},
+			IPv6: map[string][]net.IP{
+				"big.example.": bigIPs,
+			},
+		},
+	}
+	startDeferStop(t, s)
+
+	client := &net.UDPAddr{IP: net.IP{10, 99, 0, 2}, Port: 12345}
+	exchange := func(t *testing.T, req *dns.Msg) (resp *dns.Msg) {
+		t.Helper()
+
+		packet, err := req.Pack()
+		require.NoError(t, err)
+
+		data, err := s.ServeTunnelDNS(packet, client)
+		require.NoError(t, err)
+		require.NotNil(t, data)
+
+		resp = &dns.Msg{}
+		require.NoError(t, resp.Unpack(data))
+
+		return resp
+	}
+
+	t.Run("success", func(t *testing.T) {
+		assertGoogleAResponse(t, exchange(t, createGoogleATestMessage()))
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		req := (&dns.Msg{}).SetQuestion("big.example.", dns.TypeAAAA)
+		req.SetEdns0(dns.DefaultMsgSize, false)
+
+		resp := exchange(t, req)
+		assert.True(t, resp.Truncated)
+
+		resp.Compress = true
+		assert.LessOrEqual(t, resp.Len(), maxTunnelResponseSize)
+	})
+
+	t.Run("bad_packet", func(t *testing.T) {
+		_, err := s.ServeTunnelDNS([]byte{1, 2, 3}, client)
+		assert.Error(t, err)
+	})
+}
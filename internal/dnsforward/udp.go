@@ -0,0 +1,486 @@
+package dnsforward
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// UDPListenerConfig is the tuning configuration of plain DNS-over-UDP
+// listeners.
+type UDPListenerConfig struct {
+	// IP is the address of the listener, one of the bind hosts.  The
+	// configuration without IP is used for all the listeners without their
+	// own configuration.
+	IP net.IP `yaml:"ip"`
+
+	// ReadBufferSize is the size of the socket's receive buffer, SO_RCVBUF.
+	// If it's zero, the system default is used.
+	ReadBufferSize int `yaml:"read_buffer_size"`
+
+	// WriteBufferSize is the size of the socket's send buffer, SO_SNDBUF.
+	// If it's zero, the system default is used.
+	WriteBufferSize int `yaml:"write_buffer_size"`
+
+	// EDNSBufferSize is the UDP payload size advertised in the OPT records
+	// of the responses.  The larger responses are truncated even if the
+	// client advertises a larger size.  If it's zero, the size of the client
+	// is used.
+	EDNSBufferSize uint16 `yaml:"edns_bufsize"`
+}
+
+// validateUDPListeners returns an error if confs contain an invalid or a
+// duplicated configuration.
+func validateUDPListeners(confs []*UDPListenerConfig) (err error) {
+	seen := map[string]struct{}{}
+	for i, c := range confs {
+		switch {
+		case c == nil:
+			return fmt.Errorf("udp listener at index %d: no configuration", i)
+		case c.ReadBufferSize < 0 || c.WriteBufferSize < 0:
+			return fmt.Errorf("udp listener %s: negative buffer size", c.IP)
+		case c.EDNSBufferSize != 0 && c.EDNSBufferSize < dns.MinMsgSize:
+			return fmt.Errorf(
+				"udp listener %s: edns bufsize %d is less than %d",
+				c.IP,
+				c.EDNSBufferSize,
+				dns.MinMsgSize,
+			)
+		}
+
+		key := c.IP.String()
+		if _, ok := seen[key]; ok {
+			return fmt.Errorf("udp listener %s: duplicated configuration", c.IP)
+		}
+
+		seen[key] = struct{}{}
+	}
+
+	return nil
+}
+
+// udpListenerConfFor returns the configuration from confs for the listener on
+// addr.  It returns an empty configuration if there is none.
+func udpListenerConfFor(addr *net.UDPAddr, confs []*UDPListenerConfig) (c *UDPListenerConfig) {
+	c = &UDPListenerConfig{}
+	for _, lc := range confs {
+		if lc.IP == nil {
+			c = lc
+		} else if lc.IP.Equal(addr.IP) {
+			return lc
+		}
+	}
+
+	return c
+}
+
+// udpListener is a single plain DNS-over-UDP listener of udpServer.
+type udpListener struct {
+	conf *UDPListenerConfig
+	addr *net.UDPAddr
+	conn *net.UDPConn
+
+	// ifaces, if not nil, are the network interfaces, which the listener
+	// accepts the requests from.
+	ifaces *udpIfaces
+
+	// responses is the number of the responses sent.  It should be accessed
+	// atomically.
+	responses uint64
+
+	// truncated is the number of the truncated responses sent.  It should be
+	// accessed atomically.
+	truncated uint64
+}
+
+// udpServer serves the plain DNS-over-UDP listeners with tunable socket
+// buffers and EDNS buffer size instead of dnsproxy.
+type udpServer struct {
+	// srv is the DNS server handling the requests.
+	srv *Server
+
+	// sema limits the number of the goroutines handling the requests.  It's
+	// nil if there is no limit.
+	sema chan struct{}
+
+	// mu protects the connections of listeners.
+	mu *sync.Mutex
+
+	listeners []*udpListener
+
+	oobSize int
+}
+
+// udpTuned returns true if the tuning of the DNS-over-UDP listeners is
+// configured, in which case they are served by udpServer instead of dnsproxy.
+func (c *FilteringConfig) udpTuned() (ok bool) {
+	return len(c.UDPListeners) > 0 || len(c.UDPBindInterfaces) > 0
+}
+
+// newUDPServer returns a new DNS-over-UDP server for the current configuration
+// of s.
+func newUDPServer(s *Server) (u *udpServer, err error) {
+	err = validateUDPListeners(s.conf.UDPListeners)
+	if err != nil {
+		return nil, err
+	}
+
+	u = &udpServer{
+		srv:     s,
+		mu:      &sync.Mutex{},
+		oobSize: aghnet.UDPGetOOBSize(),
+	}
+
+	if n := s.conf.MaxGoroutines; n > 0 {
+		u.sema = make(chan struct{}, n)
+	}
+
+	if len(s.conf.UDPBindInterfaces) > 0 {
+		if len(s.conf.UDPListenAddrs) == 0 {
+			return nil, errors.Error("udp: binding to interfaces: no listen addresses")
+		}
+
+		// The listeners are bound to the unspecified address, so only the
+		// ports of the listen addresses matter.
+		var ports []int
+		for _, addr := range s.conf.UDPListenAddrs {
+			if !slices.Contains(ports, addr.Port) {
+				ports = append(ports, addr.Port)
+			}
+		}
+
+		groups := groupUDPIfaces(s.conf.UDPBindInterfaces)
+		for _, port := range ports {
+			for _, ifaces := range groups {
+				addr := &net.UDPAddr{IP: net.IPv6unspecified, Port: port}
+				u.listeners = append(u.listeners, &udpListener{
+					conf:   udpListenerConfFor(addr, s.conf.UDPListeners),
+					addr:   addr,
+					ifaces: ifaces,
+				})
+			}
+		}
+
+		return u, nil
+	}
+
+	for _, addr := range s.conf.UDPListenAddrs {
+		u.listeners = append(u.listeners, &udpListener{
+			conf: udpListenerConfFor(addr, s.conf.UDPListeners),
+			addr: addr,
+		})
+	}
+
+	return u, nil
+}
+
+// start starts listening on all the addresses.  If any of the listeners
+// fails, the already started ones are closed.
+func (u *udpServer) start() (err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for _, l := range u.listeners {
+		l.conn, err = listenUDP(l.addr, l.conf, l.ifaces)
+		if err != nil {
+			err = fmt.Errorf("udp: listening on %s%s: %w", l.addr, l.ifaces, err)
+
+			return errors.WithDeferred(err, u.stopLocked())
+		}
+
+		log.Info("dns: listening to udp://%s%s", l.conn.LocalAddr(), l.ifaces)
+
+		go u.serve(l, l.conn)
+	}
+
+	return nil
+}
+
+// listenUDP opens the UDP socket on addr and tunes it according to conf.  If
+// ifaces isn't nil, the socket is bound to them where supported.
+func listenUDP(
+	addr *net.UDPAddr,
+	conf *UDPListenerConfig,
+	ifaces *udpIfaces,
+) (conn *net.UDPConn, err error) {
+	lc := &net.ListenConfig{}
+	if ifaces != nil {
+		lc.Control = ifaces.control
+	}
+
+	pc, err := lc.ListenPacket(context.Background(), "udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	c, ok := pc.(*net.UDPConn)
+	if !ok {
+		return nil, errors.WithDeferred(fmt.Errorf("unexpected conn type %T", pc), pc.Close())
+	}
+
+	defer func() {
+		if err != nil {
+			err = errors.WithDeferred(err, c.Close())
+		}
+	}()
+
+	if conf.ReadBufferSize > 0 {
+		if err = c.SetReadBuffer(conf.ReadBufferSize); err != nil {
+			return nil, fmt.Errorf("setting read buffer size: %w", err)
+		}
+	}
+
+	if conf.WriteBufferSize > 0 {
+		if err = c.SetWriteBuffer(conf.WriteBufferSize); err != nil {
+			return nil, fmt.Errorf("setting write buffer size: %w", err)
+		}
+	}
+
+	if err = aghnet.UDPSetOptions(c); err != nil {
+		return nil, fmt.Errorf("setting options: %w", err)
+	}
+
+	return c, nil
+}
+
+// stop closes all the listeners.
+func (u *udpServer) stop() (err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.stopLocked()
+}
+
+// stopLocked closes all the listeners.  u.mu is expected to be locked.
+func (u *udpServer) stopLocked() (err error) {
+	var errs []error
+	for _, l := range u.listeners {
+		if l.conn == nil {
+			continue
+		}
+
+		if cerr := l.conn.Close(); cerr != nil {
+			errs = append(errs, cerr)
+		}
+
+		l.conn = nil
+	}
+
+	if len(errs) > 0 {
+		return errors.List("udp: closing listeners", errs...)
+	}
+
+	return nil
+}
+
+// serve reads the requests from conn of l until it's closed.
+func (u *udpServer) serve(l *udpListener, conn *net.UDPConn) {
+	defer aghos.OnPanicAndExit("udp: serve")
+
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, localIP, remoteAddr, err := aghnet.UDPRead(conn, buf, u.oobSize)
+		if n > 0 {
+			// Copy the packet, since buf is overwritten by the next read.
+			packet := make([]byte, n)
+			copy(packet, buf)
+
+			u.acquire()
+			go func() {
+				defer u.release()
+
+				u.handlePacket(l, conn, packet, localIP, remoteAddr)
+			}()
+		}
+
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Info("udp: reading: %s", err)
+			}
+
+			return
+		}
+	}
+}
+
+// acquire blocks until the request can be handled.
+func (u *udpServer) acquire() {
+	if u.sema != nil {
+		u.sema <- struct{}{}
+	}
+}
+
+// release releases the slot taken by acquire.
+func (u *udpServer) release() {
+	if u.sema != nil {
+		<-u.sema
+	}
+}
+
+// handlePacket processes the request received over conn of l and writes the
+// response.
+func (u *udpServer) handlePacket(
+	l *udpListener,
+	conn *net.UDPConn,
+	packet []byte,
+	localIP net.IP,
+	remoteAddr *net.UDPAddr,
+) {
+	defer log.OnPanic("udp: handling packet")
+
+	req := &dns.Msg{}
+	err := req.Unpack(packet)
+	if err != nil {
+		log.Debug("udp: unpacking request from %s: %s", remoteAddr, err)
+
+		return
+	}
+
+	if l.ifaces != nil && !l.ifaces.accepts(localIP) {
+		log.Debug("udp: dropping request from %s to %s on another interface", remoteAddr, localIP)
+
+		return
+	}
+
+	if req.Response {
+		return
+	}
+
+	pctx := &proxy.DNSContext{
+		Proto:     proxy.ProtoUDP,
+		Req:       req,
+		Addr:      remoteAddr,
+		Conn:      conn,
+		StartTime: time.Now(),
+	}
+
+	if !u.srv.serveRequest(pctx) {
+		return
+	}
+
+	truncated := l.finishResponse(req, pctx.Res)
+	data, err := pctx.Res.Pack()
+	if err != nil {
+		log.Debug("udp: packing response: %s", err)
+
+		return
+	}
+
+	atomic.AddUint64(&l.responses, 1)
+	if truncated {
+		atomic.AddUint64(&l.truncated, 1)
+	}
+
+	_, err = aghnet.UDPWrite(data, conn, remoteAddr, localIP)
+	if err != nil {
+		log.Debug("udp: writing response to %s: %s", remoteAddr, err)
+	}
+}
+
+// udpSize returns the UDP payload size advertised in the OPT record of req, but
+// not less than dns.MinMsgSize.
+func udpSize(req *dns.Msg) (size int) {
+	if opt := req.IsEdns0(); opt != nil && opt.UDPSize() > dns.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+
+	return dns.MinMsgSize
+}
+
+// finishResponse advertises the configured EDNS buffer size in resp and
+// truncates it to the size acceptable for both the client and the listener.
+// truncated is true if resp has the TC bit set.
+func (l *udpListener) finishResponse(req, resp *dns.Msg) (truncated bool) {
+	size := udpSize(req)
+	if bufSize := int(l.conf.EDNSBufferSize); bufSize > 0 {
+		if bufSize < size {
+			size = bufSize
+		}
+
+		if opt := resp.IsEdns0(); opt != nil {
+			opt.SetUDPSize(l.conf.EDNSBufferSize)
+		}
+	}
+
+	resp.Truncate(size)
+	resp.Compress = true
+
+	return resp.Truncated
+}
+
+// udpListenerStatsJSON is the statistics of a single DNS-over-UDP listener.
+type udpListenerStatsJSON struct {
+	Address         string  `json:"address"`
+	ReadBufferSize  int     `json:"read_buffer_size"`
+	WriteBufferSize int     `json:"write_buffer_size"`
+	EDNSBufferSize  uint16  `json:"edns_bufsize"`
+	Responses       uint64  `json:"responses"`
+	Truncated       uint64  `json:"truncated"`
+	TruncationRate  float64 `json:"truncation_rate"`
+}
+
+// udpStatsJSON is the response for the GET /control/udp/stats HTTP API.
+type udpStatsJSON struct {
+	Listeners []*udpListenerStatsJSON `json:"listeners"`
+
+	// Tuned is false if the listeners are served by dnsproxy, in which case
+	// there are no statistics.
+	Tuned bool `json:"tuned"`
+}
+
+// stats returns the statistics of the listeners of u.
+func (u *udpServer) stats() (listeners []*udpListenerStatsJSON) {
+	listeners = []*udpListenerStatsJSON{}
+	if u == nil {
+		return listeners
+	}
+
+	for _, l := range u.listeners {
+		ls := &udpListenerStatsJSON{
+			Address:         l.addr.String() + l.ifaces.String(),
+			ReadBufferSize:  l.conf.ReadBufferSize,
+			WriteBufferSize: l.conf.WriteBufferSize,
+			EDNSBufferSize:  l.conf.EDNSBufferSize,
+			Responses:       atomic.LoadUint64(&l.responses),
+			Truncated:       atomic.LoadUint64(&l.truncated),
+		}
+
+		if ls.Responses > 0 {
+			ls.TruncationRate = float64(ls.Truncated) / float64(ls.Responses)
+		}
+
+		listeners = append(listeners, ls)
+	}
+
+	return listeners
+}
+
+// handleUDPStats is the handler for the GET /control/udp/stats HTTP API.
+func (s *Server) handleUDPStats(w http.ResponseWriter, r *http.Request) {
+	s.serverLock.RLock()
+	resp := udpStatsJSON{
+		Listeners: s.udp.stats(),
+		Tuned:     s.udp != nil,
+	}
+	s.serverLock.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "encoding response: %s", err)
+	}
+}
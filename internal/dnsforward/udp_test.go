@@ -0,0 +1,241 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUDPServer_tuned(t *testing.T) {
+	const ednsSize = 1232
+
+	s := createTestServer(t, &filtering.Config{}, ServerConfig{
+		UDPListenAddrs: []*net.UDPAddr{{IP: net.IP{127, 0, 0, 1}}},
+		TCPListenAddrs: []*net.TCPAddr{{IP: net.IP{127, 0, 0, 1}}},
+		FilteringConfig: FilteringConfig{
+			UDPListeners: []*UDPListenerConfig{{
+				ReadBufferSize:  1 << 16,
+				WriteBufferSize: 1 << 16,
+				EDNSBufferSize:  ednsSize,
+			}},
+		},
+	}, nil)
+
+	bigIPs := make([]net.IP, 100)
+	for i := range bigIPs {
+		bigIPs[i] = net.IP{0x20, 0x01, 0x0d, 0xb8, 15: byte(i)}
+	}
+
+	s.conf.UpstreamConfig.Upstreams = []upstream.Upstream{
+		&aghtest.TestUpstream{
+			IPv4: map[string][]net.IP{
+				"google-public-dns-a.google.com.": {{8, 8, 8, 8}},
+			},
+			IPv6: map[string][]net.IP{
+				"big.example.": bigIPs,
+			},
+		},
+	}
+	require.NotNil(t, s.udp)
+	require.Len(t, s.udp.listeners, 1)
+
+	startDeferStop(t, s)
+
+	l := s.udp.listeners[0]
+	addr := l.conn.LocalAddr().String()
+	client := &dns.Client{}
+
+	t.Run("advertise", func(t *testing.T) {
+		req := createGoogleATestMessage()
+		req.SetEdns0(dns.DefaultMsgSize, false)
+
+		resp, _, err := client.Exchange(req, addr)
+		require.NoError(t, err)
+
+		assertGoogleAResponse(t, resp)
+		assert.False(t, resp.Truncated)
+
+		opt := resp.IsEdns0()
+		require.NotNil(t, opt)
+
+		assert.Equal(t, uint16(ednsSize), opt.UDPSize())
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		req := (&dns.Msg{}).SetQuestion("big.example.", dns.TypeAAAA)
+		req.SetEdns0(dns.DefaultMsgSize, false)
+
+		resp, _, err := client.Exchange(req, addr)
+		require.NoError(t, err)
+
+		assert.True(t, resp.Truncated)
+
+		resp.Compress = true
+		assert.LessOrEqual(t, resp.Len(), ednsSize)
+	})
+
+	stats := s.udp.stats()
+	require.Len(t, stats, 1)
+
+	assert.Equal(t, uint64(2), stats[0].Responses)
+	assert.Equal(t, uint64(1), stats[0].Truncated)
+	assert.Equal(t, 0.5, stats[0].TruncationRate)
+}
+
+func TestUDPServer_bindInterfaces(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	require.NoError(t, err)
+
+	var loName string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 && iface.Flags&net.FlagUp != 0 {
+			loName = iface.Name
+
+			break
+		}
+	}
+
+	if loName == "" {
+		t.Skip("no loopback interface")
+	}
+
+	s := createTestServer(t, &filtering.Config{}, ServerConfig{
+		UDPListenAddrs: []*net.UDPAddr{{IP: net.IP{127, 0, 0, 1}}},
+		TCPListenAddrs: []*net.TCPAddr{{IP: net.IP{127, 0, 0, 1}}},
+		FilteringConfig: FilteringConfig{
+			UDPBindInterfaces: []string{loName},
+		},
+	}, nil)
+	s.conf.UpstreamConfig.Upstreams = []upstream.Upstream{
+		&aghtest.TestUpstream{
+			IPv4: map[string][]net.IP{
+				"google-public-dns-a.google.com.": {{8, 8, 8, 8}},
+			},
+		},
+	}
+	require.NotNil(t, s.udp)
+	require.Len(t, s.udp.listeners, 1)
+
+	l := s.udp.listeners[0]
+	require.NotNil(t, l.ifaces)
+
+	assert.True(t, l.addr.IP.IsUnspecified())
+
+	startDeferStop(t, s)
+
+	port := l.conn.LocalAddr().(*net.UDPAddr).Port
+	addr := (&net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: port}).String()
+
+	resp, _, err := (&dns.Client{}).Exchange(createGoogleATestMessage(), addr)
+	require.NoError(t, err)
+
+	assertGoogleAResponse(t, resp)
+}
+
+func TestNewUDPServer_bindInterfaces(t *testing.T) {
+	names := []string{"eth0", "eth1"}
+	s := &Server{
+		conf: ServerConfig{
+			UDPListenAddrs: []*net.UDPAddr{
+				{IP: net.IP{192, 0, 2, 1}, Port: 53},
+				{IP: net.IP{192, 0, 2, 2}, Port: 53},
+				{IP: net.IP{192, 0, 2, 1}, Port: 5353},
+			},
+			FilteringConfig: FilteringConfig{
+				UDPBindInterfaces: names,
+			},
+		},
+	}
+
+	u, err := newUDPServer(s)
+	require.NoError(t, err)
+
+	groups := len(groupUDPIfaces(names))
+	require.Len(t, u.listeners, 2*groups)
+
+	for i, l := range u.listeners {
+		assert.True(t, l.addr.IP.IsUnspecified())
+		assert.NotNil(t, l.ifaces)
+
+		wantPort := 53
+		if i >= groups {
+			wantPort = 5353
+		}
+
+		assert.Equal(t, wantPort, l.addr.Port)
+	}
+}
+
+func TestUDPServer_start_rollback(t *testing.T) {
+	busy, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, busy.Close()) })
+
+	busyAddr, ok := busy.LocalAddr().(*net.UDPAddr)
+	require.True(t, ok)
+
+	s := &Server{
+		conf: ServerConfig{
+			UDPListenAddrs: []*net.UDPAddr{
+				{IP: net.IP{127, 0, 0, 1}},
+				busyAddr,
+			},
+		},
+	}
+
+	u, err := newUDPServer(s)
+	require.NoError(t, err)
+	require.Len(t, u.listeners, 2)
+
+	err = u.start()
+	require.Error(t, err)
+
+	for _, l := range u.listeners {
+		assert.Nil(t, l.conn)
+	}
+}
+
+func TestUDPListenerConfFor(t *testing.T) {
+	def := &UDPListenerConfig{EDNSBufferSize: 1232}
+	own := &UDPListenerConfig{IP: net.IP{192, 0, 2, 1}, EDNSBufferSize: 4096}
+
+	testCases := []struct {
+		addr  *net.UDPAddr
+		want  *UDPListenerConfig
+		name  string
+		confs []*UDPListenerConfig
+	}{{
+		addr:  &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 53},
+		want:  own,
+		name:  "own",
+		confs: []*UDPListenerConfig{def, own},
+	}, {
+		addr:  &net.UDPAddr{IP: net.IP{192, 0, 2, 2}, Port: 53},
+		want:  def,
+		name:  "default",
+		confs: []*UDPListenerConfig{own, def},
+	}, {
+		addr:  &net.UDPAddr{IP: net.IP{192, 0, 2, 2}, Port: 53},
+		want:  &UDPListenerConfig{},
+		name:  "none",
+		confs: []*UDPListenerConfig{own},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, udpListenerConfFor(tc.addr, tc.confs))
+		})
+	}
+
+	t.Run("validate", func(t *testing.T) {
+		assert.NoError(t, validateUDPListeners([]*UDPListenerConfig{def, own}))
+		assert.Error(t, validateUDPListeners([]*UDPListenerConfig{def, {}}))
+		assert.Error(t, validateUDPListeners([]*UDPListenerConfig{{EDNSBufferSize: 511}}))
+	})
+}
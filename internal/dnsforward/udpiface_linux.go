@@ -0,0 +1,61 @@
+//go:build linux
+// +build linux
+
+package dnsforward
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// udpIfaces is a network interface, which a DNS-over-UDP listener is bound to
+// with SO_BINDTODEVICE.
+type udpIfaces struct {
+	name string
+}
+
+// groupUDPIfaces returns a separate group for each of names, since a socket
+// can only be bound to a single device.
+func groupUDPIfaces(names []string) (groups []*udpIfaces) {
+	groups = make([]*udpIfaces, 0, len(names))
+	for _, name := range names {
+		groups = append(groups, &udpIfaces{name: name})
+	}
+
+	return groups
+}
+
+// String implements the fmt.Stringer interface for *udpIfaces.
+func (ifaces *udpIfaces) String() (s string) {
+	if ifaces == nil {
+		return ""
+	}
+
+	return "%" + ifaces.name
+}
+
+// control binds the socket to the interface.  SO_REUSEADDR is required to bind
+// the sockets of several interfaces to the same port.
+func (ifaces *udpIfaces) control(_, _ string, c syscall.RawConn) (err error) {
+	cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		if err != nil {
+			return
+		}
+
+		err = unix.BindToDevice(int(fd), ifaces.name)
+	})
+	if cerr != nil {
+		return cerr
+	}
+
+	return err
+}
+
+// accepts returns true, since the requests from the other interfaces are
+// already dropped by the kernel.
+func (ifaces *udpIfaces) accepts(_ net.IP) (ok bool) {
+	return true
+}
@@ -0,0 +1,112 @@
+//go:build !linux
+// +build !linux
+
+package dnsforward
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// udpIfaceAddrsTTL is the time, for which the addresses of the interfaces are
+// cached.
+const udpIfaceAddrsTTL = 10 * time.Second
+
+// udpIfaces are the network interfaces, which a DNS-over-UDP listener accepts
+// the requests from.  Since binding a socket to a device isn't supported on
+// this platform, the listener is bound to the unspecified address and the
+// requests are filtered by their destination addresses.
+type udpIfaces struct {
+	// mu protects ips and updated.
+	mu *sync.Mutex
+
+	// updated is the time, when ips have been updated.
+	updated time.Time
+
+	names []string
+
+	// ips are the current addresses of the interfaces.
+	ips []net.IP
+}
+
+// groupUDPIfaces returns a single group with all names, since all of them are
+// served by the same socket.
+func groupUDPIfaces(names []string) (groups []*udpIfaces) {
+	return []*udpIfaces{{
+		mu:    &sync.Mutex{},
+		names: names,
+	}}
+}
+
+// String implements the fmt.Stringer interface for *udpIfaces.
+func (ifaces *udpIfaces) String() (s string) {
+	if ifaces == nil {
+		return ""
+	}
+
+	return "%" + strings.Join(ifaces.names, ",")
+}
+
+// control does nothing, since binding a socket to a device isn't supported on
+// this platform.
+func (ifaces *udpIfaces) control(_, _ string, _ syscall.RawConn) (err error) {
+	return nil
+}
+
+// accepts returns true if localIP is one of the current addresses of the
+// interfaces.  It also returns true if localIP is nil, since the destination
+// addresses of the requests aren't known on some platforms, like Windows.
+func (ifaces *udpIfaces) accepts(localIP net.IP) (ok bool) {
+	if localIP == nil {
+		return true
+	}
+
+	ifaces.mu.Lock()
+	defer ifaces.mu.Unlock()
+
+	if now := time.Now(); now.Sub(ifaces.updated) >= udpIfaceAddrsTTL {
+		ifaces.ips = ifaces.currentIPs()
+		ifaces.updated = now
+	}
+
+	for _, ip := range ifaces.ips {
+		if ip.Equal(localIP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// currentIPs returns the current addresses of the interfaces.
+func (ifaces *udpIfaces) currentIPs() (ips []net.IP) {
+	for _, name := range ifaces.names {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			log.Debug("udp: getting interface %q: %s", name, err)
+
+			continue
+		}
+
+		var addrs []net.Addr
+		addrs, err = iface.Addrs()
+		if err != nil {
+			log.Debug("udp: getting addresses of interface %q: %s", name, err)
+
+			continue
+		}
+
+		for _, addr := range addrs {
+			if ipnet, isIPNet := addr.(*net.IPNet); isIPNet {
+				ips = append(ips, ipnet.IP)
+			}
+		}
+	}
+
+	return ips
+}
@@ -0,0 +1,492 @@
+package dnsforward
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Upstream modes, in which the upstreams are balanced by AdGuard Home itself
+// and not by dnsproxy.
+const (
+	// UpstreamModeWeighted is the upstream mode, in which each query is sent
+	// to an upstream chosen randomly in proportion to its weight.
+	UpstreamModeWeighted = "weighted"
+
+	// UpstreamModeAdaptive is the upstream mode, in which each query is sent
+	// to the upstream with the lowest rolling 95th percentile latency.
+	UpstreamModeAdaptive = "adaptive"
+
+	// UpstreamModeSticky is the upstream mode, in which the queries for a
+	// domain are sent to the upstream, which has answered the previous one
+	// for it, until the TTL of that answer expires.  The other queries are
+	// sent to a random upstream.
+	UpstreamModeSticky = "sticky"
+)
+
+// Parameters of the sticky upstream mode.
+const (
+	// stickyMinTTL and stickyMaxTTL are the bounds of the time, for which a
+	// domain sticks to an upstream.
+	stickyMinTTL = 1 * time.Minute
+	stickyMaxTTL = 1 * time.Hour
+
+	// stickyMaxDomains is the maximum number of the domains sticking to the
+	// upstreams at a time.
+	stickyMaxDomains = 10_000
+)
+
+// Parameters of the adaptive upstream mode.
+const (
+	// latencyWindowSize is the number of the latest exchanges, which the
+	// latency percentile of an upstream is calculated from.
+	latencyWindowSize = 100
+
+	// latencyPercentile is the percentile of the latency, by which the
+	// upstreams are ordered.
+	latencyPercentile = 0.95
+
+	// adaptiveExploreRate is the share of the queries sent to a random
+	// upstream first, so that the latencies of the slower upstreams stay
+	// up to date.
+	adaptiveExploreRate = 0.05
+)
+
+// defaultUpstreamWeight is the weight of the upstreams without an explicitly
+// configured one.
+const defaultUpstreamWeight = 1
+
+// latencyStats are the rolling latency statistics of an upstream.
+type latencyStats struct {
+	// mu protects the fields below.
+	mu *sync.Mutex
+
+	// window are the latencies of the latest exchanges.
+	window []time.Duration
+
+	// next is the index of window to replace with the next latency once the
+	// window is full.
+	next int
+
+	// percentile is the latencyPercentile of window.
+	percentile time.Duration
+}
+
+// record adds the latency of an exchange to the statistics.
+func (s *latencyStats) record(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.window) < latencyWindowSize {
+		s.window = append(s.window, d)
+	} else {
+		s.window[s.next] = d
+		s.next = (s.next + 1) % latencyWindowSize
+	}
+
+	sorted := append([]time.Duration{}, s.window...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	i := int(math.Ceil(latencyPercentile*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+
+	s.percentile = sorted[i]
+}
+
+// get returns the latency percentile.  It's zero if there are no exchanges
+// yet, so that the new upstreams are tried first.
+func (s *latencyStats) get() (p time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.percentile
+}
+
+// stickyEntry is the upstream, which a domain sticks to.
+type stickyEntry struct {
+	// expire is the time when the domain stops sticking to the upstream.
+	expire time.Time
+
+	// idx is the index of the upstream.
+	idx int
+}
+
+// stickyUpstreams are the upstreams, which the domains stick to.
+type stickyUpstreams struct {
+	// mu protects entries.
+	mu *sync.Mutex
+
+	// entries are the sticky upstreams by the lowercased domains.
+	entries map[string]stickyEntry
+}
+
+// get returns the index of the upstream, which host sticks to at now.
+func (s *stickyUpstreams) get(host string, now time.Time) (idx int, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[host]
+	if !ok {
+		return 0, false
+	} else if now.After(e.expire) {
+		delete(s.entries, host)
+
+		return 0, false
+	}
+
+	return e.idx, true
+}
+
+// set makes host stick to the upstream with idx until expire.
+func (s *stickyUpstreams) set(host string, idx int, now, expire time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.entries[host]; !ok && len(s.entries) >= stickyMaxDomains {
+		for h, e := range s.entries {
+			if now.After(e.expire) {
+				delete(s.entries, h)
+			}
+		}
+
+		// Make room by dropping an arbitrary entry, if there are still too
+		// many of them.
+		for h := range s.entries {
+			if len(s.entries) < stickyMaxDomains {
+				break
+			}
+
+			delete(s.entries, h)
+		}
+	}
+
+	s.entries[host] = stickyEntry{
+		expire: expire,
+		idx:    idx,
+	}
+}
+
+// stickyTTL returns the time, for which the domain sticks to the upstream,
+// which has answered with resp.  It's the lowest TTL of the records of resp
+// within the bounds.
+func stickyTTL(resp *dns.Msg) (ttl time.Duration) {
+	ttl = stickyMaxTTL
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns} {
+		for _, rr := range rrs {
+			if rrTTL := time.Duration(rr.Header().Ttl) * time.Second; rrTTL < ttl {
+				ttl = rrTTL
+			}
+		}
+	}
+
+	if ttl < stickyMinTTL {
+		return stickyMinTTL
+	}
+
+	return ttl
+}
+
+// upstreamBalancer is an upstream, which orders its upstreams for each query
+// according to the mode and fails over to the next one on error.
+type upstreamBalancer struct {
+	// rand is the source of the random numbers.  It's protected by randMu.
+	rand   *rand.Rand
+	randMu *sync.Mutex
+
+	// mode is either UpstreamModeWeighted, UpstreamModeAdaptive, or
+	// UpstreamModeSticky.
+	mode string
+
+	// ups are the balanced upstreams.
+	ups []upstream.Upstream
+
+	// weights are the weights of ups in the same order.  Only used in the
+	// weighted mode.
+	weights []uint
+
+	// stats are the latency statistics of ups in the same order.  Only used
+	// in the adaptive mode.
+	stats []*latencyStats
+
+	// sticky are the upstreams, which the domains stick to.  Only used in
+	// the sticky mode.
+	sticky *stickyUpstreams
+
+	// penalty is the latency recorded for the failed exchanges.
+	penalty time.Duration
+}
+
+// type check
+var _ upstream.Upstream = (*upstreamBalancer)(nil)
+
+// newUpstreamBalancer returns a new balancer of ups.  weights are the weights
+// of the upstreams by their addresses.
+func newUpstreamBalancer(
+	mode string,
+	ups []upstream.Upstream,
+	weights map[string]uint,
+	penalty time.Duration,
+) (b *upstreamBalancer) {
+	b = &upstreamBalancer{
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		randMu:  &sync.Mutex{},
+		mode:    mode,
+		ups:     ups,
+		penalty: penalty,
+	}
+
+	switch mode {
+	case UpstreamModeWeighted:
+		b.weights = make([]uint, len(ups))
+		for i, u := range ups {
+			w, ok := weights[u.Address()]
+			if !ok {
+				w = defaultUpstreamWeight
+			}
+
+			b.weights[i] = w
+		}
+	case UpstreamModeAdaptive:
+		b.stats = make([]*latencyStats, len(ups))
+		for i := range ups {
+			b.stats[i] = &latencyStats{mu: &sync.Mutex{}}
+		}
+	case UpstreamModeSticky:
+		b.sticky = &stickyUpstreams{
+			mu:      &sync.Mutex{},
+			entries: map[string]stickyEntry{},
+		}
+	}
+
+	return b
+}
+
+// float64 returns a pseudo-random number in [0.0, 1.0).
+func (b *upstreamBalancer) float64() (f float64) {
+	b.randMu.Lock()
+	defer b.randMu.Unlock()
+
+	return b.rand.Float64()
+}
+
+// order returns the indexes of b.ups in the order, in which they should be
+// tried for the current query for host.
+func (b *upstreamBalancer) order(host string, now time.Time) (idxs []int) {
+	idxs = make([]int, len(b.ups))
+	for i := range idxs {
+		idxs[i] = i
+	}
+
+	if b.mode == UpstreamModeSticky {
+		b.randMu.Lock()
+		b.rand.Shuffle(len(idxs), func(i, j int) { idxs[i], idxs[j] = idxs[j], idxs[i] })
+		b.randMu.Unlock()
+
+		if stuck, ok := b.sticky.get(host, now); ok {
+			for i, idx := range idxs {
+				if idx == stuck {
+					idxs[0], idxs[i] = idxs[i], idxs[0]
+
+					break
+				}
+			}
+		}
+
+		return idxs
+	}
+
+	if b.mode == UpstreamModeWeighted {
+		// Use the weighted random sampling without replacement by
+		// Efraimidis and Spirakis, so that the first upstream is chosen in
+		// proportion to its weight and the rest make a fallback order.  The
+		// upstreams with zero weight are only used as the last resort.
+		keys := make([]float64, len(b.ups))
+		for i, w := range b.weights {
+			if w == 0 {
+				keys[i] = -1
+
+				continue
+			}
+
+			keys[i] = math.Pow(b.float64(), 1/float64(w))
+		}
+
+		sort.SliceStable(idxs, func(i, j int) bool { return keys[idxs[i]] > keys[idxs[j]] })
+
+		return idxs
+	}
+
+	latencies := make([]time.Duration, len(b.ups))
+	for i, s := range b.stats {
+		latencies[i] = s.get()
+	}
+
+	sort.SliceStable(idxs, func(i, j int) bool { return latencies[idxs[i]] < latencies[idxs[j]] })
+
+	if len(idxs) > 1 && b.float64() < adaptiveExploreRate {
+		i := 1 + int(b.float64()*float64(len(idxs)-1))
+		idxs[0], idxs[i] = idxs[i], idxs[0]
+	}
+
+	return idxs
+}
+
+// Exchange implements the upstream.Upstream interface for *upstreamBalancer.
+func (b *upstreamBalancer) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	var host string
+	if len(req.Question) > 0 {
+		host = strings.ToLower(req.Question[0].Name)
+	}
+
+	now := time.Now()
+
+	var errs []error
+	for _, i := range b.order(host, now) {
+		u := b.ups[i]
+
+		start := time.Now()
+		resp, err = u.Exchange(req)
+		elapsed := time.Since(start)
+		if err != nil {
+			elapsed = b.penalty
+		}
+
+		if b.stats != nil {
+			b.stats[i].record(elapsed)
+		}
+
+		if err != nil {
+			log.Debug("dns: %s upstreams: %s: %s", b.mode, u.Address(), err)
+			errs = append(errs, fmt.Errorf("%s: %w", u.Address(), err))
+
+			continue
+		}
+
+		if b.sticky != nil && host != "" {
+			b.sticky.set(host, i, now, now.Add(stickyTTL(resp)))
+		}
+
+		return resp, nil
+	}
+
+	return nil, errors.List("all upstreams failed to exchange request", errs...)
+}
+
+// Address implements the upstream.Upstream interface for *upstreamBalancer.
+func (b *upstreamBalancer) Address() (addr string) {
+	return b.mode
+}
+
+// Close implements the upstream.Upstream interface for *upstreamBalancer.
+func (b *upstreamBalancer) Close() (err error) {
+	return closeUpstreams(b.ups...)
+}
+
+// upstreamBalancerMode returns the upstream mode of s, in which the upstreams
+// are balanced by an upstreamBalancer, or an empty string if they're balanced
+// by dnsproxy.
+func (s *Server) upstreamBalancerMode() (mode string) {
+	switch {
+	case s.conf.AllServers, s.conf.FastestAddr:
+		return ""
+	case s.conf.UpstreamWeighted:
+		return UpstreamModeWeighted
+	case s.conf.UpstreamAdaptive:
+		return UpstreamModeAdaptive
+	case s.conf.UpstreamSticky:
+		return UpstreamModeSticky
+	default:
+		return ""
+	}
+}
+
+// normalizeUpstreamWeights returns the weights with the keys replaced by the
+// addresses of the upstreams, as reported by the upstreams themselves, so that
+// "1.1.1.1" and "1.1.1.1:53" mean the same upstream.
+func normalizeUpstreamWeights(
+	weights map[string]uint,
+	opts *upstream.Options,
+) (normalized map[string]uint, err error) {
+	normalized = make(map[string]uint, len(weights))
+	for addr, w := range weights {
+		_, err = validateUpstream(addr)
+		if err != nil {
+			return nil, fmt.Errorf("weight of %q: %w", addr, err)
+		}
+
+		var u upstream.Upstream
+		u, err = upstream.AddressToUpstream(addr, opts)
+		if err != nil {
+			return nil, fmt.Errorf("weight of %q: %w", addr, err)
+		}
+
+		normalized[u.Address()] = w
+	}
+
+	return normalized, nil
+}
+
+// applyUpstreamBalancer replaces each set of the upstreams of conf, which has
+// more than one upstream, with an upstreamBalancer, if the upstream mode
+// requires that.  The upstream groups are kept as is, since they have their
+// own order.
+func (s *Server) applyUpstreamBalancer(conf *proxy.UpstreamConfig, opts *upstream.Options) (err error) {
+	mode := s.upstreamBalancerMode()
+	if mode == "" {
+		return nil
+	}
+
+	var weights map[string]uint
+	if mode == UpstreamModeWeighted {
+		weights, err = normalizeUpstreamWeights(s.conf.UpstreamWeights, opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	penalty := opts.Timeout
+	if penalty == 0 {
+		penalty = DefaultTimeout
+	}
+
+	balance := func(ups []upstream.Upstream) (balanced []upstream.Upstream) {
+		if len(ups) < 2 {
+			return ups
+		}
+
+		return []upstream.Upstream{newUpstreamBalancer(mode, ups, weights, penalty)}
+	}
+
+	conf.Upstreams = balance(conf.Upstreams)
+	for d, ups := range conf.DomainReservedUpstreams {
+		conf.DomainReservedUpstreams[d] = balance(ups)
+	}
+
+	return nil
+}
+
+// cloneUpstreamWeights returns a copy of weights.
+func cloneUpstreamWeights(weights map[string]uint) (clone map[string]uint) {
+	if weights == nil {
+		return nil
+	}
+
+	clone = make(map[string]uint, len(weights))
+	for addr, w := range weights {
+		clone[addr] = w
+	}
+
+	return clone
+}
@@ -0,0 +1,206 @@
+package dnsforward
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyStats(t *testing.T) {
+	s := &latencyStats{mu: &sync.Mutex{}}
+	assert.Zero(t, s.get())
+
+	for i := 1; i <= latencyWindowSize; i++ {
+		s.record(time.Duration(i) * time.Millisecond)
+	}
+
+	assert.Equal(t, 95*time.Millisecond, s.get())
+
+	// The oldest and the fastest ones are replaced.
+	for i := 0; i < latencyWindowSize/2; i++ {
+		s.record(time.Second)
+	}
+
+	assert.Equal(t, time.Second, s.get())
+}
+
+func TestUpstreamBalancer_order(t *testing.T) {
+	const n = 10_000
+
+	a := &aghtest.TestUpstream{Addr: "a"}
+	b := &aghtest.TestUpstream{Addr: "b"}
+	c := &aghtest.TestUpstream{Addr: "c"}
+	ups := []upstream.Upstream{a, b, c}
+
+	t.Run("weighted", func(t *testing.T) {
+		weights := map[string]uint{"a": 3, "c": 0}
+		bal := newUpstreamBalancer(UpstreamModeWeighted, ups, weights, time.Second)
+
+		var first int
+		for i := 0; i < n; i++ {
+			order := bal.order("", time.Now())
+			require.Len(t, order, 3)
+
+			if order[0] == 0 {
+				first++
+			}
+
+			assert.Equal(t, 2, order[2])
+		}
+
+		assert.InDelta(t, 0.75, float64(first)/n, 0.05)
+	})
+
+	t.Run("adaptive", func(t *testing.T) {
+		bal := newUpstreamBalancer(UpstreamModeAdaptive, ups, nil, time.Second)
+		bal.stats[0].record(50 * time.Millisecond)
+		bal.stats[1].record(10 * time.Millisecond)
+		bal.stats[2].record(time.Second)
+
+		var first int
+		for i := 0; i < n; i++ {
+			if bal.order("", time.Now())[0] == 1 {
+				first++
+			}
+		}
+
+		assert.InDelta(t, 1-adaptiveExploreRate, float64(first)/n, 0.02)
+	})
+}
+
+func TestUpstreamBalancer_Exchange(t *testing.T) {
+	const host = "host.example."
+
+	ok := &aghtest.TestUpstream{
+		IPv4: map[string][]net.IP{host: {{192, 0, 2, 1}}},
+	}
+	errUps := &aghtest.TestErrUpstream{Err: errors.Error("test")}
+
+	req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+
+	bal := newUpstreamBalancer(UpstreamModeAdaptive, []upstream.Upstream{errUps, ok}, nil, time.Second)
+	for i := 0; i < 10; i++ {
+		resp, err := bal.Exchange(req)
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	}
+
+	// The failed upstream is penalized.
+	assert.Equal(t, time.Second, bal.stats[0].get())
+	assert.Less(t, bal.stats[1].get(), time.Second)
+
+	bal = newUpstreamBalancer(UpstreamModeWeighted, []upstream.Upstream{errUps, errUps}, nil, time.Second)
+	_, err := bal.Exchange(req)
+	assert.ErrorIs(t, err, errUps.Err)
+}
+
+func TestUpstreamBalancer_sticky(t *testing.T) {
+	const host = "host.example."
+
+	ups := []upstream.Upstream{
+		&aghtest.TestUpstream{IPv4: map[string][]net.IP{host: {{192, 0, 2, 1}}}},
+		&aghtest.TestUpstream{IPv4: map[string][]net.IP{host: {{192, 0, 2, 2}}}},
+		&aghtest.TestUpstream{IPv4: map[string][]net.IP{host: {{192, 0, 2, 3}}}},
+	}
+
+	bal := newUpstreamBalancer(UpstreamModeSticky, ups, nil, time.Second)
+	req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+
+	resp, err := bal.Exchange(req)
+	require.NoError(t, err)
+	require.NotEmpty(t, resp.Answer)
+
+	want := resp.Answer[0].(*dns.A).A
+	for i := 0; i < 20; i++ {
+		resp, err = bal.Exchange(req)
+		require.NoError(t, err)
+		require.NotEmpty(t, resp.Answer)
+
+		assert.Equal(t, want, resp.Answer[0].(*dns.A).A)
+	}
+
+	now := time.Now()
+	idx, ok := bal.sticky.get(host, now)
+	require.True(t, ok)
+
+	assert.Equal(t, idx, bal.order(host, now)[0])
+
+	_, ok = bal.sticky.get(host, now.Add(stickyMaxTTL+time.Second))
+	assert.False(t, ok)
+}
+
+func TestStickyTTL(t *testing.T) {
+	resp := &dns.Msg{}
+	assert.Equal(t, stickyMaxTTL, stickyTTL(resp))
+
+	resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Ttl: 300}}}
+	assert.Equal(t, 5*time.Minute, stickyTTL(resp))
+
+	resp.Ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Ttl: 1}}}
+	assert.Equal(t, stickyMinTTL, stickyTTL(resp))
+}
+
+func TestServer_applyUpstreamBalancer(t *testing.T) {
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				UpstreamWeighted: true,
+				UpstreamWeights:  map[string]uint{"192.0.2.1": 5},
+			},
+		},
+	}
+
+	conf, err := proxy.ParseUpstreamsConfig([]string{
+		"192.0.2.1",
+		"192.0.2.2:53",
+		"[/single.example/]198.51.100.1:53",
+		"[/double.example/]198.51.100.2:53",
+		"[/double.example/]198.51.100.3:53",
+	}, nil)
+	require.NoError(t, err)
+
+	opts := &upstream.Options{Timeout: DefaultTimeout}
+	err = s.applyUpstreamBalancer(conf, opts)
+	require.NoError(t, err)
+
+	require.Len(t, conf.Upstreams, 1)
+
+	bal, ok := conf.Upstreams[0].(*upstreamBalancer)
+	require.True(t, ok)
+
+	assert.Equal(t, UpstreamModeWeighted, bal.Address())
+	assert.Equal(t, []uint{5, defaultUpstreamWeight}, bal.weights)
+
+	ups := conf.DomainReservedUpstreams["single.example."]
+	require.Len(t, ups, 1)
+
+	assert.Equal(t, "198.51.100.1:53", ups[0].Address())
+
+	ups = conf.DomainReservedUpstreams["double.example."]
+	require.Len(t, ups, 1)
+	require.IsType(t, (*upstreamBalancer)(nil), ups[0])
+
+	t.Run("parallel", func(t *testing.T) {
+		s.conf.AllServers = true
+		t.Cleanup(func() { s.conf.AllServers = false })
+
+		conf, err = proxy.ParseUpstreamsConfig([]string{"192.0.2.1", "192.0.2.2"}, nil)
+		require.NoError(t, err)
+
+		err = s.applyUpstreamBalancer(conf, opts)
+		require.NoError(t, err)
+
+		assert.Len(t, conf.Upstreams, 2)
+	})
+}
@@ -0,0 +1,360 @@
+package dnsforward
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// UpstreamBindConfig binds the outgoing queries to a single upstream to a local
+// network interface or a source address, so that the upstreams can be routed
+// through the different links, for example in multi-WAN and VPN-split setups.
+type UpstreamBindConfig struct {
+	// Upstream is the address of the upstream the way it's specified in the
+	// upstream servers, for example "tls://dns.corp.example".  Only the plain
+	// DNS, DNS-over-TCP, DNS-over-TLS, and DNS-over-HTTPS upstreams are
+	// supported.
+	Upstream string `yaml:"upstream"`
+
+	// Interface is the name of the network interface to send the queries
+	// through, for example "wg0".  On Linux, the sockets are bound to the
+	// interface itself, and on the other platforms, to its address of the
+	// family of the upstream's address.
+	Interface string `yaml:"interface"`
+
+	// SourceIP is the local address to send the queries from.  Only the
+	// addresses of the upstream of the same family are used.
+	SourceIP string `yaml:"source_ip"`
+}
+
+// errBindFamily is returned when the local address of the binding can't be
+// used to connect to the address of the upstream.
+const errBindFamily errors.Error = "address family of the upstream doesn't match the source address"
+
+// upstreamBind is the parsed binding of an upstream.
+type upstreamBind struct {
+	// iface is the name of the network interface.  It's empty if the
+	// upstream is bound to a source address only.
+	iface string
+
+	// ip is the source address.  It's nil if the upstream is bound to an
+	// interface only.
+	ip net.IP
+}
+
+// newUpstreamBind returns the parsed binding of c.
+func newUpstreamBind(c *UpstreamBindConfig) (b *upstreamBind, err error) {
+	b = &upstreamBind{
+		iface: c.Interface,
+	}
+
+	if c.SourceIP != "" {
+		b.ip = net.ParseIP(c.SourceIP)
+		if b.ip == nil {
+			return nil, fmt.Errorf("bad source ip %q", c.SourceIP)
+		}
+	}
+
+	if b.iface == "" && b.ip == nil {
+		return nil, errors.Error("no interface or source ip")
+	}
+
+	return b, nil
+}
+
+// String implements the fmt.Stringer interface for *upstreamBind.
+func (b *upstreamBind) String() (s string) {
+	if b == nil {
+		return ""
+	}
+
+	var parts []string
+	if b.ip != nil {
+		parts = append(parts, b.ip.String())
+	}
+
+	if b.iface != "" {
+		parts = append(parts, "%"+b.iface)
+	}
+
+	return strings.Join(parts, "")
+}
+
+// localIP returns the local address to connect to remote from.  remote is nil
+// if the address of the upstream is a hostname.  ip is nil if the socket only
+// needs to be bound to the interface.
+func (b *upstreamBind) localIP(remote net.IP) (ip net.IP, err error) {
+	if b.ip != nil {
+		ip = b.ip
+	} else {
+		ip, err = b.ifaceIP(remote)
+		if err != nil {
+			return nil, fmt.Errorf("interface %q: %w", b.iface, err)
+		}
+	}
+
+	if ip != nil && remote != nil && (ip.To4() == nil) != (remote.To4() == nil) {
+		return nil, errBindFamily
+	}
+
+	return ip, nil
+}
+
+// dialer returns the dialer for the connections to addr over network with
+// timeout.  b may be nil, in which case the default dialer is returned.
+func (b *upstreamBind) dialer(network, addr string, timeout time.Duration) (d *net.Dialer, err error) {
+	d = &net.Dialer{
+		Timeout: timeout,
+	}
+
+	if b == nil {
+		return d, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ip, err := b.localIP(net.ParseIP(host))
+	if err != nil {
+		return nil, err
+	}
+
+	if ip != nil {
+		if strings.HasPrefix(network, "udp") {
+			d.LocalAddr = &net.UDPAddr{IP: ip}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+	}
+
+	if b.iface != "" {
+		d.Control = b.control
+	}
+
+	return d, nil
+}
+
+// boundUpstream is a plain DNS or DNS-over-TCP upstream bound to an interface
+// or a source address, since dnsproxy doesn't allow to set the local address
+// of the upstreams.
+type boundUpstream struct {
+	// bind is the binding of the upstream.
+	bind *upstreamBind
+
+	// addr is the address of the upstream as returned by the dnsproxy one.
+	addr string
+
+	// hostPort is the host and the port of the upstream.
+	hostPort string
+
+	// network is either "udp" or "tcp".
+	network string
+
+	// timeout is the timeout of the exchange.
+	timeout time.Duration
+
+	// resolvers, if not empty, resolve the hostname of the upstream, like the
+	// bootstrap resolvers of the dnsproxy upstreams.  Otherwise, the system
+	// resolver is used.
+	resolvers []upstream.Resolver
+
+	// noTCPFallback, if true, makes the upstream return the truncated UDP
+	// responses as is instead of repeating the query over TCP.
+	noTCPFallback bool
+}
+
+// type check
+var _ upstream.Upstream = (*boundUpstream)(nil)
+
+// Address implements the upstream.Upstream interface for *boundUpstream.
+func (u *boundUpstream) Address() (addr string) {
+	return u.addr
+}
+
+// Close implements the upstream.Upstream interface for *boundUpstream.  The
+// connections of u aren't reused, so there is nothing to close.
+func (u *boundUpstream) Close() (err error) {
+	return nil
+}
+
+// Exchange implements the upstream.Upstream interface for *boundUpstream.  The
+// truncated UDP responses are retried over TCP, unless u.noTCPFallback is set.
+func (u *boundUpstream) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
+	resp, err = u.exchange(u.network, m)
+	if err == nil && resp.Truncated && u.network == "udp" && !u.noTCPFallback {
+		return u.exchange("tcp", m)
+	}
+
+	return resp, err
+}
+
+// exchange sends m to the upstream over network.
+func (u *boundUpstream) exchange(network string, m *dns.Msg) (resp *dns.Msg, err error) {
+	hostPort, err := u.resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := u.bind.dialer(network, hostPort, u.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("binding to %s: %w", u.bind, err)
+	}
+
+	c := &dns.Client{
+		Net:     network,
+		Dialer:  d,
+		Timeout: u.timeout,
+	}
+
+	resp, _, err = c.Exchange(m, hostPort)
+
+	return resp, err
+}
+
+// resolve returns the address of the upstream with its hostname resolved with
+// u.resolvers, if there are any.
+func (u *boundUpstream) resolve() (hostPort string, err error) {
+	host, port, err := net.SplitHostPort(u.hostPort)
+	if err != nil {
+		return "", err
+	} else if len(u.resolvers) == 0 || net.ParseIP(host) != nil {
+		return u.hostPort, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), u.timeout)
+	defer cancel()
+
+	for _, r := range u.resolvers {
+		var addrs []netip.Addr
+		addrs, err = r.LookupNetIP(ctx, "ip", host)
+		if len(addrs) > 0 {
+			return net.JoinHostPort(addrs[0].String(), port), nil
+		}
+	}
+
+	if err == nil {
+		err = errors.Error("no addresses")
+	}
+
+	return "", fmt.Errorf("resolving %s: %w", host, err)
+}
+
+// bindUpstream returns the upstream for u bound with b.  u is expected to be
+// either a dnsproxy upstream or a *tlsUpstream.
+func (s *Server) bindUpstream(u upstream.Upstream, b *upstreamBind) (res upstream.Upstream, err error) {
+	if tu, ok := u.(*tlsUpstream); ok {
+		tu.bind = b
+
+		return tu, nil
+	}
+
+	addr := u.Address()
+	if !strings.Contains(addr, "://") {
+		addr = "udp://" + addr
+	}
+
+	parsed, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	switch parsed.Scheme {
+	case "udp", "tcp":
+		return &boundUpstream{
+			bind:     b,
+			addr:     u.Address(),
+			hostPort: parsed.Host,
+			network:  parsed.Scheme,
+			timeout:  s.conf.UpstreamTimeout,
+		}, nil
+	case "tls", "https":
+		var tu *tlsUpstream
+		tu, err = s.newPooledTLSUpstream(&UpstreamTLSConfig{Upstream: u.Address()})
+		if err != nil {
+			return nil, err
+		}
+
+		tu.bind = b
+		s.trackTLSUpstream(tu)
+
+		return tu, nil
+	default:
+		return nil, fmt.Errorf("binding %s upstreams isn't supported", parsed.Scheme)
+	}
+}
+
+// applyUpstreamBind replaces the upstreams of conf having their own binding
+// with the bound ones.  It must be called after applyUpstreamTLS, so that the
+// upstreams having their own TLS configuration keep it.
+func (s *Server) applyUpstreamBind(conf *proxy.UpstreamConfig) (err error) {
+	if len(s.conf.UpstreamBind) == 0 {
+		return nil
+	}
+
+	binds := make(map[string]*upstreamBind, len(s.conf.UpstreamBind))
+	for _, c := range s.conf.UpstreamBind {
+		var u upstream.Upstream
+		u, err = upstream.AddressToUpstream(c.Upstream, &upstream.Options{
+			Timeout: s.conf.UpstreamTimeout,
+		})
+		if err != nil {
+			return fmt.Errorf("upstream bind for %q: %w", c.Upstream, err)
+		}
+
+		binds[u.Address()], err = newUpstreamBind(c)
+		if err != nil {
+			return fmt.Errorf("upstream bind for %q: %w", c.Upstream, err)
+		}
+	}
+
+	// Bind each upstream once, since the same upstream may be used for
+	// several domains.
+	bound := map[upstream.Upstream]upstream.Upstream{}
+	replace := func(ups []upstream.Upstream) (rErr error) {
+		for i, u := range ups {
+			b, ok := binds[u.Address()]
+			if !ok {
+				continue
+			}
+
+			bu, ok := bound[u]
+			if !ok {
+				bu, rErr = s.bindUpstream(u, b)
+				if rErr != nil {
+					return fmt.Errorf("upstream bind for %q: %w", u.Address(), rErr)
+				}
+
+				bound[u] = bu
+			}
+
+			ups[i] = bu
+		}
+
+		return nil
+	}
+
+	err = replace(conf.Upstreams)
+	if err != nil {
+		return err
+	}
+
+	for _, ups := range conf.DomainReservedUpstreams {
+		err = replace(ups)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
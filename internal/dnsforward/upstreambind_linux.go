@@ -0,0 +1,29 @@
+//go:build linux
+// +build linux
+
+package dnsforward
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// control binds the socket to the interface with SO_BINDTODEVICE.
+func (b *upstreamBind) control(_, _ string, c syscall.RawConn) (err error) {
+	cerr := c.Control(func(fd uintptr) {
+		err = unix.BindToDevice(int(fd), b.iface)
+	})
+	if cerr != nil {
+		return cerr
+	}
+
+	return err
+}
+
+// ifaceIP returns nil, since the socket is bound to the interface itself and
+// the kernel chooses the source address.
+func (b *upstreamBind) ifaceIP(_ net.IP) (ip net.IP, err error) {
+	return nil, nil
+}
@@ -0,0 +1,43 @@
+//go:build !linux
+// +build !linux
+
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// control does nothing, since binding a socket to a device isn't supported on
+// this platform.  The socket is bound to the address of the interface instead.
+func (b *upstreamBind) control(_, _ string, _ syscall.RawConn) (err error) {
+	return nil
+}
+
+// ifaceIP returns the current address of the interface of the same family as
+// remote, or any of its addresses if remote is nil.
+func (b *upstreamBind) ifaceIP(remote net.IP) (ip net.IP, err error) {
+	iface, err := net.InterfaceByName(b.iface)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("getting addresses: %w", err)
+	}
+
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		if remote == nil || (ipnet.IP.To4() == nil) == (remote.To4() == nil) {
+			return ipnet.IP, nil
+		}
+	}
+
+	return nil, errBindFamily
+}
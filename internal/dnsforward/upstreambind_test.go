@@ -0,0 +1,162 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamBind_localIP(t *testing.T) {
+	b, err := newUpstreamBind(&UpstreamBindConfig{SourceIP: "192.0.2.1"})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name    string
+		remote  net.IP
+		wantErr error
+	}{{
+		name:    "same_family",
+		remote:  net.IP{203, 0, 113, 1},
+		wantErr: nil,
+	}, {
+		name:    "hostname",
+		remote:  nil,
+		wantErr: nil,
+	}, {
+		name:    "other_family",
+		remote:  net.ParseIP("2001:db8::1"),
+		wantErr: errBindFamily,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ip, lErr := b.localIP(tc.remote)
+			if tc.wantErr != nil {
+				assert.ErrorIs(t, lErr, tc.wantErr)
+
+				return
+			}
+
+			require.NoError(t, lErr)
+
+			assert.Equal(t, b.ip, ip)
+		})
+	}
+
+	_, err = newUpstreamBind(&UpstreamBindConfig{Upstream: "1.1.1.1"})
+	assert.Error(t, err)
+
+	_, err = newUpstreamBind(&UpstreamBindConfig{SourceIP: "bad"})
+	assert.Error(t, err)
+}
+
+func TestBoundUpstream_Exchange(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	remotes := make(chan net.Addr, 1)
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			remotes <- w.RemoteAddr()
+
+			_ = w.WriteMsg((&dns.Msg{}).SetReply(r))
+		}),
+	}
+
+	go func() { _ = srv.ActivateAndServe() }()
+	testutil.CleanupAndRequireSuccess(t, srv.Shutdown)
+
+	addr := pc.LocalAddr().String()
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+
+	u := &boundUpstream{
+		bind:     &upstreamBind{ip: net.IP{127, 0, 0, 1}},
+		addr:     addr,
+		hostPort: addr,
+		network:  "udp",
+		timeout:  time.Second,
+	}
+
+	resp, err := u.Exchange(req)
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+
+	remote := <-remotes
+	require.IsType(t, (*net.UDPAddr)(nil), remote)
+
+	assert.True(t, remote.(*net.UDPAddr).IP.Equal(u.bind.ip))
+
+	u.bind = &upstreamBind{ip: net.IPv6loopback}
+	_, err = u.Exchange(req)
+	assert.ErrorIs(t, err, errBindFamily)
+}
+
+func TestServer_applyUpstreamBind(t *testing.T) {
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				UpstreamBind: []*UpstreamBindConfig{{
+					Upstream: "192.0.2.1",
+					SourceIP: "127.0.0.1",
+				}, {
+					Upstream:  "tls://192.0.2.2",
+					Interface: "lo",
+				}},
+			},
+			UpstreamTimeout: time.Second,
+		},
+	}
+
+	conf, err := proxy.ParseUpstreamsConfig([]string{
+		"192.0.2.1",
+		"tls://192.0.2.2",
+		"192.0.2.3",
+		"[/example.org/]192.0.2.1",
+	}, nil)
+	require.NoError(t, err)
+
+	err = s.applyUpstreamBind(conf)
+	require.NoError(t, err)
+
+	require.Len(t, conf.Upstreams, 3)
+
+	bu, ok := conf.Upstreams[0].(*boundUpstream)
+	require.True(t, ok)
+
+	assert.Equal(t, "udp", bu.network)
+	assert.Equal(t, "192.0.2.1:53", bu.Address())
+
+	tu, ok := conf.Upstreams[1].(*tlsUpstream)
+	require.True(t, ok)
+	require.NotNil(t, tu.bind)
+
+	assert.Equal(t, "lo", tu.bind.iface)
+
+	_, ok = conf.Upstreams[2].(*boundUpstream)
+	assert.False(t, ok)
+
+	domainUps := conf.DomainReservedUpstreams["example.org."]
+	require.Len(t, domainUps, 1)
+
+	assert.Same(t, bu, domainUps[0])
+
+	t.Run("unsupported", func(t *testing.T) {
+		s.conf.UpstreamBind = []*UpstreamBindConfig{{
+			Upstream: "quic://192.0.2.4",
+			SourceIP: "127.0.0.1",
+		}}
+
+		conf, err = proxy.ParseUpstreamsConfig([]string{"quic://192.0.2.4"}, nil)
+		require.NoError(t, err)
+
+		err = s.applyUpstreamBind(conf)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,289 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// ECS policy modes.
+const (
+	// ECSModeStrip removes the EDNS Client Subnet option from the requests.
+	ECSModeStrip = "strip"
+
+	// ECSModeForward forwards the EDNS Client Subnet option of the requests,
+	// shortening the subnets to the configured prefix lengths.
+	ECSModeForward = "forward"
+
+	// ECSModeInject sends the configured subnet instead of the client's one.
+	ECSModeInject = "inject"
+)
+
+// UpstreamECSConfig is the EDNS Client Subnet policy of a single upstream.  The
+// upstreams without a policy receive the option of the requests unchanged.
+type UpstreamECSConfig struct {
+	// Upstream is the address of the upstream the way it's specified in the
+	// upstream servers, for example "https://dns.example/dns-query".
+	Upstream string `yaml:"upstream"`
+
+	// Mode is either ECSModeStrip, ECSModeForward, or ECSModeInject.
+	Mode string `yaml:"mode"`
+
+	// Subnet is the subnet sent in the ECSModeInject mode, for example
+	// "203.0.113.0/24".
+	Subnet string `yaml:"subnet"`
+
+	// IPv4Prefix is the maximum length of the forwarded IPv4 subnets in the
+	// ECSModeForward mode.  If zero, the subnets aren't shortened.
+	IPv4Prefix int `yaml:"ipv4_prefix"`
+
+	// IPv6Prefix is the maximum length of the forwarded IPv6 subnets in the
+	// ECSModeForward mode.  If zero, the subnets aren't shortened.
+	IPv6Prefix int `yaml:"ipv6_prefix"`
+}
+
+// newECSPolicy returns the policy for c.
+func newECSPolicy(c *UpstreamECSConfig) (p *ecsPolicy, err error) {
+	p = &ecsPolicy{mode: c.Mode}
+
+	switch c.Mode {
+	case ECSModeStrip:
+		// Go on.
+	case ECSModeForward:
+		if c.IPv4Prefix < 0 || c.IPv4Prefix > net.IPv4len*8 {
+			return nil, fmt.Errorf("bad ipv4 prefix length %d", c.IPv4Prefix)
+		} else if c.IPv6Prefix < 0 || c.IPv6Prefix > net.IPv6len*8 {
+			return nil, fmt.Errorf("bad ipv6 prefix length %d", c.IPv6Prefix)
+		}
+
+		p.v4Len, p.v6Len = uint8(c.IPv4Prefix), uint8(c.IPv6Prefix)
+	case ECSModeInject:
+		var n *net.IPNet
+		_, n, err = net.ParseCIDR(c.Subnet)
+		if err != nil {
+			return nil, fmt.Errorf("bad subnet: %w", err)
+		}
+
+		ones, _ := n.Mask.Size()
+		p.subnet = &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        2,
+			SourceNetmask: uint8(ones),
+			Address:       n.IP,
+		}
+
+		if ip4 := n.IP.To4(); ip4 != nil {
+			p.subnet.Family, p.subnet.Address = 1, ip4
+		}
+	default:
+		return nil, fmt.Errorf("bad mode %q", c.Mode)
+	}
+
+	return p, nil
+}
+
+// ecsPolicy is the parsed EDNS Client Subnet policy of an upstream.
+type ecsPolicy struct {
+	// subnet is the option sent in the ECSModeInject mode.
+	subnet *dns.EDNS0_SUBNET
+
+	// mode is the mode of the policy.
+	mode string
+
+	// v4Len and v6Len are the maximum lengths of the forwarded subnets.  Zero
+	// means no limit.
+	v4Len uint8
+	v6Len uint8
+}
+
+// ecsOption returns the EDNS Client Subnet option of m and its index within
+// the OPT record, if any.
+func ecsOption(m *dns.Msg) (opt *dns.OPT, i int, e *dns.EDNS0_SUBNET) {
+	opt = m.IsEdns0()
+	if opt == nil {
+		return nil, -1, nil
+	}
+
+	for j, o := range opt.Option {
+		if sn, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return opt, j, sn
+		}
+	}
+
+	return opt, -1, nil
+}
+
+// apply returns the option to send instead of orig, which may be nil.
+func (p *ecsPolicy) apply(orig *dns.EDNS0_SUBNET) (e *dns.EDNS0_SUBNET) {
+	switch p.mode {
+	case ECSModeStrip:
+		return nil
+	case ECSModeInject:
+		return p.subnet
+	default:
+		if orig == nil {
+			return nil
+		}
+
+		max, bits := p.v4Len, net.IPv4len*8
+		if orig.Family == 2 {
+			max, bits = p.v6Len, net.IPv6len*8
+		}
+
+		if max == 0 || orig.SourceNetmask <= max {
+			return orig
+		}
+
+		return &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        orig.Family,
+			SourceNetmask: max,
+			Address:       orig.Address.Mask(net.CIDRMask(int(max), bits)),
+		}
+	}
+}
+
+// ecsUpstream is an upstream, which applies an EDNS Client Subnet policy to the
+// requests.  The option of the responses is restored to the one of the
+// request, so that the responses are cached correctly.
+type ecsUpstream struct {
+	// u is the underlying upstream.
+	u upstream.Upstream
+
+	// policy is the policy applied to the requests.
+	policy *ecsPolicy
+}
+
+// type check
+var _ upstream.Upstream = (*ecsUpstream)(nil)
+
+// Exchange implements the upstream.Upstream interface for *ecsUpstream.
+func (u *ecsUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	_, _, orig := ecsOption(req)
+	sent := u.policy.apply(orig)
+	if sent == orig {
+		return u.u.Exchange(req)
+	}
+
+	req = req.Copy()
+	opt, i, _ := ecsOption(req)
+	switch {
+	case sent == nil:
+		opt.Option = append(opt.Option[:i], opt.Option[i+1:]...)
+	case i >= 0:
+		opt.Option[i] = sent
+	case opt != nil:
+		opt.Option = append(opt.Option, sent)
+	default:
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		opt = req.IsEdns0()
+		opt.Option = append(opt.Option, sent)
+	}
+
+	resp, err = u.u.Exchange(req)
+	if err != nil || resp == nil {
+		return resp, err
+	}
+
+	restoreECS(resp, orig, u.policy.mode == ECSModeInject)
+
+	return resp, nil
+}
+
+// restoreECS replaces the EDNS Client Subnet option of resp with orig, the one
+// of the original request.  The option is removed if orig is nil.  If global
+// is true, the response is valid for any subnet, so its scope is reset.
+func restoreECS(resp *dns.Msg, orig *dns.EDNS0_SUBNET, global bool) {
+	opt, i, e := ecsOption(resp)
+	if e == nil {
+		return
+	} else if orig == nil {
+		opt.Option = append(opt.Option[:i], opt.Option[i+1:]...)
+
+		return
+	}
+
+	scope := e.SourceScope
+	if global {
+		scope = 0
+	} else if scope > e.SourceNetmask {
+		// The response can't be more specific than the subnet sent.
+		scope = e.SourceNetmask
+	}
+
+	opt.Option[i] = &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        orig.Family,
+		SourceNetmask: orig.SourceNetmask,
+		SourceScope:   scope,
+		Address:       orig.Address,
+	}
+}
+
+// Address implements the upstream.Upstream interface for *ecsUpstream.
+func (u *ecsUpstream) Address() (addr string) {
+	return u.u.Address()
+}
+
+// Close implements the upstream.Upstream interface for *ecsUpstream.
+func (u *ecsUpstream) Close() (err error) {
+	return u.u.Close()
+}
+
+// applyUpstreamECS wraps the upstreams of conf having their own EDNS Client
+// Subnet policy.
+func (s *Server) applyUpstreamECS(conf *proxy.UpstreamConfig) (err error) {
+	if len(s.conf.UpstreamECS) == 0 {
+		return nil
+	}
+
+	policies := make(map[string]*ecsPolicy, len(s.conf.UpstreamECS))
+	for _, c := range s.conf.UpstreamECS {
+		var u upstream.Upstream
+		u, err = upstream.AddressToUpstream(c.Upstream, &upstream.Options{
+			Timeout: s.conf.UpstreamTimeout,
+		})
+		if err != nil {
+			return fmt.Errorf("upstream ecs for %q: %w", c.Upstream, err)
+		}
+
+		policies[u.Address()], err = newECSPolicy(c)
+		if err != nil {
+			return fmt.Errorf("upstream ecs for %q: %w", c.Upstream, err)
+		}
+	}
+
+	// Wrap each upstream once, since the same upstream may be used for several
+	// domains.
+	wrapped := map[upstream.Upstream]*ecsUpstream{}
+	wrap := func(ups []upstream.Upstream) {
+		for i, u := range ups {
+			if _, ok := u.(*ecsUpstream); ok {
+				continue
+			}
+
+			p, ok := policies[u.Address()]
+			if !ok {
+				continue
+			}
+
+			eu, ok := wrapped[u]
+			if !ok {
+				eu = &ecsUpstream{u: u, policy: p}
+				wrapped[u] = eu
+			}
+
+			ups[i] = eu
+		}
+	}
+
+	wrap(conf.Upstreams)
+	for _, ups := range conf.DomainReservedUpstreams {
+		wrap(ups)
+	}
+
+	return nil
+}
@@ -0,0 +1,284 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ecsEchoUpstream is an upstream, which keeps the last EDNS Client Subnet
+// option received and echoes it with the full scope.
+type ecsEchoUpstream struct {
+	last *dns.EDNS0_SUBNET
+}
+
+// Exchange implements the upstream.Upstream interface for *ecsEchoUpstream.
+func (u *ecsEchoUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	_, _, u.last = ecsOption(req)
+
+	resp = (&dns.Msg{}).SetReply(req)
+	if u.last != nil {
+		echo := *u.last
+		echo.SourceScope = echo.SourceNetmask
+		resp.SetEdns0(dns.DefaultMsgSize, false)
+		opt := resp.IsEdns0()
+		opt.Option = append(opt.Option, &echo)
+	}
+
+	return resp, nil
+}
+
+// Address implements the upstream.Upstream interface for *ecsEchoUpstream.
+func (u *ecsEchoUpstream) Address() (addr string) {
+	return "192.0.2.53:53"
+}
+
+// Close implements the upstream.Upstream interface for *ecsEchoUpstream.
+func (u *ecsEchoUpstream) Close() (err error) {
+	return nil
+}
+
+// newECSRequest returns a new request with the EDNS Client Subnet option for
+// subnet, if it's not empty.
+func newECSRequest(t *testing.T, subnet string) (req *dns.Msg) {
+	t.Helper()
+
+	req = (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	if subnet == "" {
+		return req
+	}
+
+	_, n, err := net.ParseCIDR(subnet)
+	require.NoError(t, err)
+
+	ones, _ := n.Mask.Size()
+	e := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        2,
+		SourceNetmask: uint8(ones),
+		Address:       n.IP,
+	}
+	if ip4 := n.IP.To4(); ip4 != nil {
+		e.Family, e.Address = 1, ip4
+	}
+
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, e)
+
+	return req
+}
+
+func TestECSUpstream_Exchange(t *testing.T) {
+	testCases := []struct {
+		conf      *UpstreamECSConfig
+		name      string
+		reqSubnet string
+		wantSent  string
+		wantScope uint8
+	}{{
+		conf:      &UpstreamECSConfig{Mode: ECSModeStrip},
+		name:      "strip",
+		reqSubnet: "198.51.100.0/24",
+		wantSent:  "",
+		wantScope: 0,
+	}, {
+		conf:      &UpstreamECSConfig{Mode: ECSModeForward, IPv4Prefix: 16},
+		name:      "forward_shortened",
+		reqSubnet: "198.51.100.0/24",
+		wantSent:  "198.51.0.0/16",
+		wantScope: 16,
+	}, {
+		conf:      &UpstreamECSConfig{Mode: ECSModeForward, IPv4Prefix: 16},
+		name:      "forward_ipv6",
+		reqSubnet: "2001:db8::/56",
+		wantSent:  "2001:db8::/56",
+		wantScope: 56,
+	}, {
+		conf:      &UpstreamECSConfig{Mode: ECSModeInject, Subnet: "203.0.113.0/24"},
+		name:      "inject",
+		reqSubnet: "198.51.100.0/24",
+		wantSent:  "203.0.113.0/24",
+		wantScope: 0,
+	}, {
+		conf:      &UpstreamECSConfig{Mode: ECSModeInject, Subnet: "203.0.113.0/24"},
+		name:      "inject_no_ecs",
+		reqSubnet: "",
+		wantSent:  "203.0.113.0/24",
+		wantScope: 0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := newECSPolicy(tc.conf)
+			require.NoError(t, err)
+
+			echo := &ecsEchoUpstream{}
+			u := &ecsUpstream{u: echo, policy: p}
+
+			req := newECSRequest(t, tc.reqSubnet)
+			_, _, orig := ecsOption(req)
+
+			resp, err := u.Exchange(req)
+			require.NoError(t, err)
+
+			// The original request must stay intact.
+			_, _, after := ecsOption(req)
+			assert.Equal(t, orig, after)
+
+			if tc.wantSent == "" {
+				assert.Nil(t, echo.last)
+			} else {
+				require.NotNil(t, echo.last)
+
+				sent := &net.IPNet{
+					IP:   echo.last.Address,
+					Mask: net.CIDRMask(int(echo.last.SourceNetmask), len(echo.last.Address)*8),
+				}
+				assert.Equal(t, tc.wantSent, sent.String())
+			}
+
+			_, _, got := ecsOption(resp)
+			if orig == nil {
+				assert.Nil(t, got)
+
+				return
+			} else if tc.wantSent == "" {
+				return
+			}
+
+			require.NotNil(t, got)
+
+			assert.Equal(t, orig.Address, got.Address)
+			assert.Equal(t, orig.SourceNetmask, got.SourceNetmask)
+			assert.Equal(t, tc.wantScope, got.SourceScope)
+		})
+	}
+}
+
+func TestNewECSPolicy_errors(t *testing.T) {
+	testCases := []struct {
+		conf       *UpstreamECSConfig
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       &UpstreamECSConfig{Mode: "bad"},
+		name:       "bad_mode",
+		wantErrMsg: `bad mode "bad"`,
+	}, {
+		conf:       &UpstreamECSConfig{Mode: ECSModeForward, IPv4Prefix: 33},
+		name:       "bad_ipv4_prefix",
+		wantErrMsg: "bad ipv4 prefix length 33",
+	}, {
+		conf:       &UpstreamECSConfig{Mode: ECSModeForward, IPv6Prefix: -1},
+		name:       "bad_ipv6_prefix",
+		wantErrMsg: "bad ipv6 prefix length -1",
+	}, {
+		conf:       &UpstreamECSConfig{Mode: ECSModeInject, Subnet: "203.0.113.0"},
+		name:       "bad_subnet",
+		wantErrMsg: "bad subnet: invalid CIDR address: 203.0.113.0",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newECSPolicy(tc.conf)
+			require.Error(t, err)
+
+			assert.Equal(t, tc.wantErrMsg, err.Error())
+		})
+	}
+}
+
+func TestServer_applyUpstreamECS(t *testing.T) {
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				UpstreamECS: []*UpstreamECSConfig{{
+					Upstream: "192.0.2.1",
+					Mode:     ECSModeStrip,
+				}},
+			},
+			UpstreamTimeout: time.Second,
+		},
+	}
+
+	conf, err := proxy.ParseUpstreamsConfig([]string{
+		"192.0.2.1",
+		"192.0.2.2",
+		"[/domain.example/]192.0.2.1",
+	}, nil)
+	require.NoError(t, err)
+
+	err = s.applyUpstreamECS(conf)
+	require.NoError(t, err)
+
+	eu, ok := conf.Upstreams[0].(*ecsUpstream)
+	require.True(t, ok)
+
+	assert.Equal(t, ECSModeStrip, eu.policy.mode)
+
+	_, ok = conf.Upstreams[1].(*ecsUpstream)
+	assert.False(t, ok)
+
+	assert.Same(t, eu, conf.DomainReservedUpstreams["domain.example."][0])
+}
+
+func TestServer_prepareUpstreamSettings_ecsSpoofGuard(t *testing.T) {
+	// received is the EDNS Client Subnet option received by the upstream.
+	received := make(chan *dns.EDNS0_SUBNET, 1)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			_, _, e := ecsOption(r)
+			received <- e
+
+			_ = w.WriteMsg((&dns.Msg{}).SetReply(r))
+		}),
+	}
+
+	go func() { _ = srv.ActivateAndServe() }()
+	testutil.CleanupAndRequireSuccess(t, srv.Shutdown)
+
+	addr := pc.LocalAddr().String()
+
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				UpstreamDNS:    []string{addr},
+				SpoofDetection: true,
+				UpstreamECS: []*UpstreamECSConfig{{
+					Upstream: addr,
+					Mode:     ECSModeStrip,
+				}},
+			},
+			UpstreamTimeout: time.Second,
+		},
+		spoof: &spoofCounters{},
+	}
+
+	err = s.prepareUpstreamSettings()
+	require.NoError(t, err)
+
+	ups := s.conf.UpstreamConfig.Upstreams
+	require.Len(t, ups, 1)
+
+	eu, ok := ups[0].(*ecsUpstream)
+	require.True(t, ok)
+
+	_, ok = eu.u.(*spoofGuard)
+	require.True(t, ok)
+
+	_, err = eu.Exchange(newECSRequest(t, "1.2.3.0/24"))
+	require.NoError(t, err)
+
+	assert.Nil(t, <-received)
+}
@@ -0,0 +1,281 @@
+package dnsforward
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/stringutil"
+	"github.com/miekg/dns"
+)
+
+// DefaultUpstreamGroupName is the name of the upstream group used for the
+// domains not attached to any other group.
+const DefaultUpstreamGroupName = "default"
+
+// UpstreamGroupConfig is the configuration of a named group of upstreams, to
+// which the queries for the attached domains and their subdomains are sent.
+type UpstreamGroupConfig struct {
+	// Name is the unique name of the group, for example "corp".  The group
+	// named DefaultUpstreamGroupName replaces the default upstreams.
+	Name string `yaml:"name" json:"name"`
+
+	// Upstreams are the addresses of the upstreams of the group in the order
+	// of failover.  The queries are sent to the first upstream, and to the
+	// next one only if the previous one fails or responds with SERVFAIL.
+	Upstreams []string `yaml:"upstreams" json:"upstreams"`
+
+	// Domains are the domain suffixes attached to the group.  They must be
+	// empty for the group named DefaultUpstreamGroupName.
+	Domains []string `yaml:"domains" json:"domains"`
+}
+
+// validateUpstreamGroups returns an error if the upstream groups are invalid,
+// for example if a domain is attached to several groups.
+func validateUpstreamGroups(groups []*UpstreamGroupConfig) (err error) {
+	names := stringutil.NewSet()
+	domains := map[string]string{}
+	for i, g := range groups {
+		if g == nil {
+			return fmt.Errorf("upstream group at index %d: no group", i)
+		}
+
+		err = g.validate()
+		if err != nil {
+			return fmt.Errorf("upstream group at index %d: %w", i, err)
+		}
+
+		if names.Has(g.Name) {
+			return fmt.Errorf("upstream group at index %d: duplicate name %q", i, g.Name)
+		}
+
+		names.Add(g.Name)
+
+		for _, d := range g.Domains {
+			d = upstreamGroupDomain(d)
+			if prev, ok := domains[d]; ok {
+				return fmt.Errorf(
+					"upstream group %q: domain %q is already attached to group %q",
+					g.Name,
+					d,
+					prev,
+				)
+			}
+
+			domains[d] = g.Name
+		}
+	}
+
+	return nil
+}
+
+// validate returns an error if the upstream group is invalid.
+func (c *UpstreamGroupConfig) validate() (err error) {
+	if c.Name == "" {
+		return errors.Error("empty name")
+	}
+
+	ups := stringutil.FilterOut(c.Upstreams, IsCommentOrEmpty)
+	if len(ups) == 0 {
+		return fmt.Errorf("group %q: no upstreams", c.Name)
+	}
+
+	for _, u := range ups {
+		if strings.HasPrefix(u, "[/") {
+			return fmt.Errorf("group %q: upstream %q: domains must be attached to the group", c.Name, u)
+		}
+	}
+
+	_, err = proxy.ParseUpstreamsConfig(ups, &upstream.Options{Timeout: DefaultTimeout})
+	if err != nil {
+		return fmt.Errorf("group %q: %w", c.Name, err)
+	}
+
+	if c.Name == DefaultUpstreamGroupName {
+		if len(c.Domains) > 0 {
+			return fmt.Errorf("group %q: domains can't be attached to the default group", c.Name)
+		}
+
+		return nil
+	}
+
+	if len(c.Domains) == 0 {
+		return fmt.Errorf("group %q: no domains", c.Name)
+	}
+
+	for _, d := range c.Domains {
+		err = netutil.ValidateHostname(strings.TrimSuffix(d, "."))
+		if err != nil {
+			return fmt.Errorf("group %q: %w", c.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// upstreamGroupDomain returns the key of the reserved upstreams for domain d.
+func upstreamGroupDomain(d string) (key string) {
+	return dns.Fqdn(strings.ToLower(d))
+}
+
+// upstreamGroup is an upstream, which sends the queries to the upstreams of a
+// group in order and only fails over to the next one when the previous one
+// fails.
+type upstreamGroup struct {
+	// name is the name of the group.
+	name string
+
+	// ups are the upstreams of the group in the order of failover.
+	ups []upstream.Upstream
+}
+
+// type check
+var _ upstream.Upstream = (*upstreamGroup)(nil)
+
+// Exchange implements the upstream.Upstream interface for *upstreamGroup.  It
+// returns the first response, which isn't a SERVFAIL, or the last SERVFAIL
+// response if all the upstreams have failed.
+func (g *upstreamGroup) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	var servFail *dns.Msg
+	var errs []error
+	for _, u := range g.ups {
+		resp, err = u.Exchange(req)
+		if err != nil {
+			log.Debug("dns: upstream group %s: %s: %s", g.name, u.Address(), err)
+			errs = append(errs, fmt.Errorf("%s: %w", u.Address(), err))
+
+			continue
+		}
+
+		if resp.Rcode == dns.RcodeServerFailure {
+			log.Debug("dns: upstream group %s: %s: servfail", g.name, u.Address())
+			servFail = resp
+
+			continue
+		}
+
+		return resp, nil
+	}
+
+	if servFail != nil {
+		return servFail, nil
+	}
+
+	return nil, errors.List(fmt.Sprintf("all upstreams of group %q failed", g.name), errs...)
+}
+
+// Address implements the upstream.Upstream interface for *upstreamGroup.
+func (g *upstreamGroup) Address() (addr string) {
+	return "group:" + g.name
+}
+
+// Close implements the upstream.Upstream interface for *upstreamGroup.
+func (g *upstreamGroup) Close() (err error) {
+	return closeUpstreams(g.ups...)
+}
+
+// closeUpstreams closes all ups and returns the joined errors, if any.
+func closeUpstreams(ups ...upstream.Upstream) (err error) {
+	var errs []error
+	for _, u := range ups {
+		err = u.Close()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("closing %s: %w", u.Address(), err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// applyUpstreamGroups adds the upstream groups from s.conf.UpstreamGroups to
+// conf.  The group named DefaultUpstreamGroupName replaces the default
+// upstreams, and the other groups take precedence over the
+// "[/domain/]upstream" lines for their domains.
+func (s *Server) applyUpstreamGroups(conf *proxy.UpstreamConfig, opts *upstream.Options) (err error) {
+	err = validateUpstreamGroups(s.conf.UpstreamGroups)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range s.conf.UpstreamGroups {
+		var groupConf *proxy.UpstreamConfig
+		groupConf, err = proxy.ParseUpstreamsConfig(
+			stringutil.FilterOut(c.Upstreams, IsCommentOrEmpty),
+			opts,
+		)
+		if err != nil {
+			return fmt.Errorf("upstream group %q: %w", c.Name, err)
+		}
+
+		err = s.applyUpstreamTLS(groupConf)
+		if err != nil {
+			return fmt.Errorf("upstream group %q: %w", c.Name, err)
+		}
+
+		// Guard the plain upstreams before any other wrapper is applied, like
+		// the default ones.
+		if s.conf.SpoofDetection {
+			s.guardUpstreams(groupConf)
+		}
+
+		err = s.applyUpstreamRetry(groupConf, opts)
+		if err != nil {
+			return fmt.Errorf("upstream group %q: %w", c.Name, err)
+		}
+
+		s.ddr.wrap(groupConf)
+
+		err = s.applyUpstreamPadding(groupConf)
+		if err != nil {
+			return fmt.Errorf("upstream group %q: %w", c.Name, err)
+		}
+
+		err = s.applyUpstreamECS(groupConf)
+		if err != nil {
+			return fmt.Errorf("upstream group %q: %w", c.Name, err)
+		}
+
+		g := &upstreamGroup{
+			name: c.Name,
+			ups:  groupConf.Upstreams,
+		}
+
+		if c.Name == DefaultUpstreamGroupName {
+			conf.Upstreams = []upstream.Upstream{g}
+
+			continue
+		}
+
+		if conf.DomainReservedUpstreams == nil {
+			conf.DomainReservedUpstreams = map[string][]upstream.Upstream{}
+		}
+
+		for _, d := range c.Domains {
+			conf.DomainReservedUpstreams[upstreamGroupDomain(d)] = []upstream.Upstream{g}
+		}
+	}
+
+	return nil
+}
+
+// cloneUpstreamGroups returns a deep copy of groups.
+func cloneUpstreamGroups(groups []*UpstreamGroupConfig) (clone []*UpstreamGroupConfig) {
+	if groups == nil {
+		return nil
+	}
+
+	clone = make([]*UpstreamGroupConfig, len(groups))
+	for i, g := range groups {
+		clone[i] = &UpstreamGroupConfig{
+			Name:      g.Name,
+			Upstreams: stringutil.CloneSlice(g.Upstreams),
+			Domains:   stringutil.CloneSlice(g.Domains),
+		}
+	}
+
+	return clone
+}
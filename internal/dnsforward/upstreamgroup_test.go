@@ -0,0 +1,301 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// servFailUpstream is an upstream, which always responds with SERVFAIL.
+type servFailUpstream struct{}
+
+// type check
+var _ upstream.Upstream = servFailUpstream{}
+
+// Exchange implements the upstream.Upstream interface for servFailUpstream.
+func (servFailUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	return (&dns.Msg{}).SetRcode(req, dns.RcodeServerFailure), nil
+}
+
+// Address implements the upstream.Upstream interface for servFailUpstream.
+func (servFailUpstream) Address() (addr string) {
+	return "servfail"
+}
+
+// Close implements the upstream.Upstream interface for servFailUpstream.
+func (servFailUpstream) Close() (err error) {
+	return nil
+}
+
+func TestUpstreamGroup_Exchange(t *testing.T) {
+	const host = "host.corp.example."
+
+	ok := &aghtest.TestUpstream{
+		IPv4: map[string][]net.IP{host: {{192, 0, 2, 1}}},
+	}
+	errUps := &aghtest.TestErrUpstream{Err: errors.Error("test")}
+
+	testCases := []struct {
+		name      string
+		ups       []upstream.Upstream
+		wantRcode int
+		wantErr   bool
+	}{{
+		name:      "first",
+		ups:       []upstream.Upstream{ok, errUps},
+		wantRcode: dns.RcodeSuccess,
+		wantErr:   false,
+	}, {
+		name:      "error_failover",
+		ups:       []upstream.Upstream{errUps, ok},
+		wantRcode: dns.RcodeSuccess,
+		wantErr:   false,
+	}, {
+		name:      "servfail_failover",
+		ups:       []upstream.Upstream{servFailUpstream{}, errUps, ok},
+		wantRcode: dns.RcodeSuccess,
+		wantErr:   false,
+	}, {
+		name:      "servfail",
+		ups:       []upstream.Upstream{servFailUpstream{}, errUps},
+		wantRcode: dns.RcodeServerFailure,
+		wantErr:   false,
+	}, {
+		name:      "error",
+		ups:       []upstream.Upstream{errUps, errUps},
+		wantRcode: 0,
+		wantErr:   true,
+	}}
+
+	req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			g := &upstreamGroup{name: "corp", ups: tc.ups}
+
+			resp, err := g.Exchange(req)
+			if tc.wantErr {
+				assert.Error(t, err)
+				assert.Nil(t, resp)
+
+				return
+			}
+
+			require.NoError(t, err)
+			require.NotNil(t, resp)
+
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+		})
+	}
+}
+
+func TestValidateUpstreamGroups(t *testing.T) {
+	corp := &UpstreamGroupConfig{
+		Name:      "corp",
+		Upstreams: []string{"192.0.2.1", "# comment", "tls://dns.corp.example"},
+		Domains:   []string{"corp.example", "internal.example."},
+	}
+	def := &UpstreamGroupConfig{
+		Name:      DefaultUpstreamGroupName,
+		Upstreams: []string{"192.0.2.2", "192.0.2.3"},
+	}
+
+	testCases := []struct {
+		name    string
+		groups  []*UpstreamGroupConfig
+		wantErr bool
+	}{{
+		name:    "valid",
+		groups:  []*UpstreamGroupConfig{corp, def},
+		wantErr: false,
+	}, {
+		name:    "duplicate_name",
+		groups:  []*UpstreamGroupConfig{corp, corp},
+		wantErr: true,
+	}, {
+		name: "duplicate_domain",
+		groups: []*UpstreamGroupConfig{corp, {
+			Name:      "lab",
+			Upstreams: []string{"192.0.2.4"},
+			Domains:   []string{"CORP.example."},
+		}},
+		wantErr: true,
+	}, {
+		name: "no_upstreams",
+		groups: []*UpstreamGroupConfig{{
+			Name:      "lab",
+			Upstreams: []string{"# comment"},
+			Domains:   []string{"lab.example"},
+		}},
+		wantErr: true,
+	}, {
+		name: "reserved_upstream",
+		groups: []*UpstreamGroupConfig{{
+			Name:      "lab",
+			Upstreams: []string{"[/lab.example/]192.0.2.4"},
+			Domains:   []string{"lab.example"},
+		}},
+		wantErr: true,
+	}, {
+		name: "no_domains",
+		groups: []*UpstreamGroupConfig{{
+			Name:      "lab",
+			Upstreams: []string{"192.0.2.4"},
+		}},
+		wantErr: true,
+	}, {
+		name: "default_domains",
+		groups: []*UpstreamGroupConfig{{
+			Name:      DefaultUpstreamGroupName,
+			Upstreams: []string{"192.0.2.4"},
+			Domains:   []string{"lab.example"},
+		}},
+		wantErr: true,
+	}, {
+		name: "bad_domain",
+		groups: []*UpstreamGroupConfig{{
+			Name:      "lab",
+			Upstreams: []string{"192.0.2.4"},
+			Domains:   []string{"lab..example"},
+		}},
+		wantErr: true,
+	}, {
+		name:    "no_name",
+		groups:  []*UpstreamGroupConfig{{Upstreams: []string{"192.0.2.4"}}},
+		wantErr: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateUpstreamGroups(tc.groups)
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestServer_applyUpstreamGroups(t *testing.T) {
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				UpstreamGroups: []*UpstreamGroupConfig{{
+					Name:      "corp",
+					Upstreams: []string{"192.0.2.1:53", "192.0.2.2:53"},
+					Domains:   []string{"Corp.example"},
+				}, {
+					Name:      DefaultUpstreamGroupName,
+					Upstreams: []string{"192.0.2.3:53"},
+				}},
+			},
+		},
+	}
+
+	conf, err := proxy.ParseUpstreamsConfig([]string{
+		"198.51.100.1:53",
+		"[/corp.example/]198.51.100.2:53",
+		"[/other.example/]198.51.100.3:53",
+	}, nil)
+	require.NoError(t, err)
+
+	err = s.applyUpstreamGroups(conf, &upstream.Options{Timeout: DefaultTimeout})
+	require.NoError(t, err)
+
+	require.Len(t, conf.Upstreams, 1)
+	assert.Equal(t, "group:"+DefaultUpstreamGroupName, conf.Upstreams[0].Address())
+
+	ups := conf.DomainReservedUpstreams["corp.example."]
+	require.Len(t, ups, 1)
+
+	g, ok := ups[0].(*upstreamGroup)
+	require.True(t, ok)
+	require.Len(t, g.ups, 2)
+
+	assert.Equal(t, "192.0.2.1:53", g.ups[0].Address())
+	assert.Equal(t, "192.0.2.2:53", g.ups[1].Address())
+
+	ups = conf.DomainReservedUpstreams["other.example."]
+	require.Len(t, ups, 1)
+
+	assert.Equal(t, "198.51.100.3:53", ups[0].Address())
+}
+
+func TestServer_applyUpstreamGroups_spoofDetection(t *testing.T) {
+	const addr = "192.0.2.1:53"
+
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				SpoofDetection: true,
+				UpstreamECS: []*UpstreamECSConfig{{
+					Upstream: addr,
+					Mode:     ECSModeStrip,
+				}},
+				UpstreamGroups: []*UpstreamGroupConfig{{
+					Name:      "corp",
+					Upstreams: []string{addr},
+					Domains:   []string{"corp.example"},
+				}},
+			},
+		},
+		spoof: &spoofCounters{},
+	}
+
+	conf := &proxy.UpstreamConfig{}
+	err := s.applyUpstreamGroups(conf, &upstream.Options{Timeout: DefaultTimeout})
+	require.NoError(t, err)
+
+	ups := conf.DomainReservedUpstreams["corp.example."]
+	require.Len(t, ups, 1)
+
+	g, ok := ups[0].(*upstreamGroup)
+	require.True(t, ok)
+	require.Len(t, g.ups, 1)
+
+	eu, ok := g.ups[0].(*ecsUpstream)
+	require.True(t, ok)
+
+	_, ok = eu.u.(*spoofGuard)
+	assert.True(t, ok)
+}
+
+func TestServer_applyUpstreamGroups_retry(t *testing.T) {
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				UpstreamRetry: UpstreamRetryConfig{
+					Attempts: 2,
+				},
+				UpstreamGroups: []*UpstreamGroupConfig{{
+					Name:      "corp",
+					Upstreams: []string{"192.0.2.1:53"},
+					Domains:   []string{"corp.example"},
+				}},
+			},
+		},
+	}
+
+	conf := &proxy.UpstreamConfig{}
+	err := s.applyUpstreamGroups(conf, &upstream.Options{Timeout: DefaultTimeout})
+	require.NoError(t, err)
+
+	ups := conf.DomainReservedUpstreams["corp.example."]
+	require.Len(t, ups, 1)
+
+	g, ok := ups[0].(*upstreamGroup)
+	require.True(t, ok)
+	require.Len(t, g.ups, 1)
+
+	ru, ok := g.ups[0].(*retryUpstream)
+	require.True(t, ok)
+
+	assert.Equal(t, 2, ru.policy.attempts)
+}
@@ -0,0 +1,466 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Parameters of the upstream health checks.
+const (
+	// defaultHealthCheckInterval is the interval between the probes used when
+	// the interval isn't set.
+	defaultHealthCheckInterval = 30 * time.Second
+
+	// defaultHealthCheckName is the name queried by the probes used when the
+	// name isn't set.  The NS records of the root zone are cheap to get from
+	// any recursive resolver.
+	defaultHealthCheckName = "."
+
+	// healthFailureThreshold is the number of the consecutive failed probes,
+	// after which an upstream is quarantined.
+	healthFailureThreshold = 3
+
+	// healthWindowSize is the number of the latest probes, which the error
+	// rate and the latency of an upstream are calculated from.
+	healthWindowSize = 20
+
+	// maxHealthBackoff is the maximum duration of a quarantine, unless the
+	// interval between the probes is longer.
+	maxHealthBackoff = 10 * time.Minute
+)
+
+// healthProbe is the result of a single probe of an upstream.
+type healthProbe struct {
+	// latency is the duration of the exchange.
+	latency time.Duration
+
+	// failed is true if the upstream hasn't responded or responded with
+	// SERVFAIL.
+	failed bool
+}
+
+// upstreamHealth is the health state of a single upstream.
+type upstreamHealth struct {
+	// u is the checked upstream.
+	u upstream.Upstream
+
+	// mu protects the fields below.
+	mu *sync.Mutex
+
+	// probes are the results of the latest probes.
+	probes []healthProbe
+
+	// until is the time, until which the upstream is quarantined.  It's zero
+	// if the upstream is healthy.
+	until time.Time
+
+	// total is the number of the probes since the start.
+	total uint64
+
+	// backoff is the duration of the latest quarantine.
+	backoff time.Duration
+
+	// failures is the number of the consecutive failed or slow probes.
+	failures int
+}
+
+// quarantined returns true if the upstream is quarantined at now.
+func (h *upstreamHealth) quarantined(now time.Time) (ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return now.Before(h.until)
+}
+
+// record updates the state with the result of a probe made at now.  slow is
+// true if the probe has taken longer than allowed.  changed is true if the
+// upstream has been quarantined or has become healthy again.
+func (h *upstreamHealth) record(
+	p healthProbe,
+	slow bool,
+	now time.Time,
+	interval time.Duration,
+) (changed bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.total++
+	if len(h.probes) == healthWindowSize {
+		h.probes = append(h.probes[:0], h.probes[1:]...)
+	}
+
+	h.probes = append(h.probes, p)
+
+	if !p.failed && !slow {
+		changed = !h.until.IsZero()
+		if changed {
+			log.Info("dns: upstream %s is healthy again", h.u.Address())
+		}
+
+		h.failures, h.backoff, h.until = 0, 0, time.Time{}
+
+		return changed
+	}
+
+	h.failures++
+	if h.failures < healthFailureThreshold {
+		return false
+	}
+
+	switch {
+	case h.backoff == 0:
+		changed = true
+		h.backoff = interval
+	case !h.until.IsZero():
+		// The quarantine is over but the upstream is still unhealthy, so
+		// double it.
+		h.backoff *= 2
+		max := maxHealthBackoff
+		if interval > max {
+			max = interval
+		}
+
+		if h.backoff > max {
+			h.backoff = max
+		}
+	}
+
+	h.until = now.Add(h.backoff)
+	log.Info("dns: upstream %s is unhealthy, quarantined for %s", h.u.Address(), h.backoff)
+
+	return changed
+}
+
+// upstreamHealthJSON is the health state of a single upstream in the HTTP API.
+type upstreamHealthJSON struct {
+	// Until is the time until which the upstream is quarantined, if it is.
+	Until *time.Time `json:"quarantined_until,omitempty"`
+
+	Address string `json:"address"`
+
+	Probes uint64 `json:"probes"`
+
+	// ErrorRate is the share of the failed probes among the latest ones.
+	ErrorRate float64 `json:"error_rate"`
+
+	// AvgLatency is the average duration of the latest successful probes in
+	// milliseconds.
+	AvgLatency float64 `json:"avg_latency_ms"`
+
+	ConsecutiveFailures int `json:"consecutive_failures"`
+
+	Quarantined bool `json:"quarantined"`
+}
+
+// toJSON returns the health state of the upstream at now for the HTTP API.
+func (h *upstreamHealth) toJSON(now time.Time) (j *upstreamHealthJSON) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	j = &upstreamHealthJSON{
+		Address:             h.u.Address(),
+		Probes:              h.total,
+		ConsecutiveFailures: h.failures,
+		Quarantined:         now.Before(h.until),
+	}
+
+	if j.Quarantined {
+		until := h.until
+		j.Until = &until
+	}
+
+	var failed int
+	var latency time.Duration
+	for _, p := range h.probes {
+		if p.failed {
+			failed++
+
+			continue
+		}
+
+		latency += p.latency
+	}
+
+	if n := len(h.probes); n > 0 {
+		j.ErrorRate = float64(failed) / float64(n)
+	}
+
+	if ok := len(h.probes) - failed; ok > 0 {
+		j.AvgLatency = float64(latency) / float64(ok) / float64(time.Millisecond)
+	}
+
+	return j
+}
+
+// healthUpstream is an upstream, which fails fast while it's quarantined and
+// at least one other upstream of the same set is healthy, so that the queries
+// are resolved by the healthy ones.
+type healthUpstream struct {
+	// health is the health state of the upstream.
+	health *upstreamHealth
+
+	// set are the health states of all the upstreams of the set, including
+	// this one.
+	set []*upstreamHealth
+}
+
+// type check
+var _ upstream.Upstream = (*healthUpstream)(nil)
+
+// Exchange implements the upstream.Upstream interface for *healthUpstream.
+func (u *healthUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	now := time.Now()
+	if u.health.quarantined(now) {
+		for _, h := range u.set {
+			if !h.quarantined(now) {
+				return nil, fmt.Errorf("upstream %s is quarantined", u.Address())
+			}
+		}
+
+		// All the upstreams of the set are quarantined, so it's better to
+		// try anyway.
+	}
+
+	return u.health.u.Exchange(req)
+}
+
+// Address implements the upstream.Upstream interface for *healthUpstream.
+func (u *healthUpstream) Address() (addr string) {
+	return u.health.u.Address()
+}
+
+// Close implements the upstream.Upstream interface for *healthUpstream.
+func (u *healthUpstream) Close() (err error) {
+	return u.health.u.Close()
+}
+
+// healthChecker probes the upstreams on an interval and quarantines the
+// unhealthy ones.
+type healthChecker struct {
+	// states are the health states of the checked upstreams.
+	states map[upstream.Upstream]*upstreamHealth
+
+	// done is closed when the checker is stopped.
+	done chan struct{}
+
+	// name is the domain name queried by the probes.
+	name string
+
+	// interval is the interval between the probes.
+	interval time.Duration
+
+	// onChange, if not nil, is called when an upstream is quarantined or
+	// becomes healthy again.
+	onChange func(addr string, healthy bool)
+
+	// maxLatency is the maximum duration of a probe, after which it's
+	// considered failed.  Zero means no limit.
+	maxLatency time.Duration
+}
+
+// newHealthChecker returns a new health checker.  interval and name are
+// replaced with the default values if empty.
+func newHealthChecker(
+	interval time.Duration,
+	maxLatency time.Duration,
+	name string,
+) (c *healthChecker, err error) {
+	if interval < 0 {
+		return nil, fmt.Errorf("upstream_health_check_interval: negative value %s", interval)
+	} else if interval == 0 {
+		interval = defaultHealthCheckInterval
+	}
+
+	if maxLatency < 0 {
+		return nil, fmt.Errorf("upstream_health_check_max_latency: negative value %s", maxLatency)
+	}
+
+	if name == "" {
+		name = defaultHealthCheckName
+	}
+
+	return &healthChecker{
+		states:     map[upstream.Upstream]*upstreamHealth{},
+		name:       dns.Fqdn(name),
+		interval:   interval,
+		maxLatency: maxLatency,
+	}, nil
+}
+
+// wrap replaces the upstreams of conf, including the members of upstream
+// groups and balancers, with the ones checked by c.
+func (c *healthChecker) wrap(conf *proxy.UpstreamConfig) {
+	c.wrapSet(conf.Upstreams)
+	for _, ups := range conf.DomainReservedUpstreams {
+		c.wrapSet(ups)
+	}
+}
+
+// wrapSet replaces the upstreams of ups with the ones checked by c.
+func (c *healthChecker) wrapSet(ups []upstream.Upstream) {
+	set := make([]*upstreamHealth, 0, len(ups))
+	var wrapped []*healthUpstream
+	for i, u := range ups {
+		switch u := u.(type) {
+		case *upstreamGroup:
+			c.wrapSet(u.ups)
+		case *upstreamBalancer:
+			c.wrapSet(u.ups)
+		case *consensusUpstream:
+			c.wrapSet(u.ups)
+		case *healthUpstream:
+			// Already wrapped, since the sets may share the underlying
+			// slices.
+		default:
+			h, ok := c.states[u]
+			if !ok {
+				h = &upstreamHealth{
+					u:  u,
+					mu: &sync.Mutex{},
+				}
+				c.states[u] = h
+			}
+
+			hu := &healthUpstream{health: h}
+			set = append(set, h)
+			wrapped = append(wrapped, hu)
+			ups[i] = hu
+		}
+	}
+
+	for _, hu := range wrapped {
+		hu.set = set
+	}
+}
+
+// start starts probing the upstreams.  c may be nil.
+func (c *healthChecker) start() {
+	if c == nil || c.done != nil {
+		return
+	}
+
+	c.done = make(chan struct{})
+	go c.run(c.done)
+}
+
+// stop stops probing the upstreams.  c may be nil.
+func (c *healthChecker) stop() {
+	if c == nil || c.done == nil {
+		return
+	}
+
+	close(c.done)
+	c.done = nil
+}
+
+// run probes the upstreams on the interval until done is closed.
+func (c *healthChecker) run(done <-chan struct{}) {
+	defer aghos.OnPanicAndExit("dns: upstream health checker")
+
+	t := time.NewTicker(c.interval)
+	defer t.Stop()
+
+	for {
+		c.probeAll()
+
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			// Go on.
+		}
+	}
+}
+
+// probeAll probes all the upstreams, which are due, concurrently.
+func (c *healthChecker) probeAll() {
+	wg := &sync.WaitGroup{}
+	now := time.Now()
+	for _, h := range c.states {
+		if h.quarantined(now) {
+			// Probe it once the quarantine is over.
+			continue
+		}
+
+		wg.Add(1)
+		go func(h *upstreamHealth) {
+			defer log.OnPanic("dns: upstream health probe")
+			defer wg.Done()
+
+			c.probe(h)
+		}(h)
+	}
+
+	wg.Wait()
+}
+
+// probe sends a single probe to the upstream of h and records the result.
+func (c *healthChecker) probe(h *upstreamHealth) {
+	req := (&dns.Msg{}).SetQuestion(c.name, dns.TypeNS)
+
+	start := time.Now()
+	resp, err := h.u.Exchange(req)
+	p := healthProbe{
+		latency: time.Since(start),
+		failed:  err != nil || resp == nil || resp.Rcode == dns.RcodeServerFailure,
+	}
+
+	if p.failed {
+		log.Debug("dns: health probe of upstream %s failed: %v", h.u.Address(), err)
+	}
+
+	slow := c.maxLatency > 0 && p.latency > c.maxLatency
+	changed := h.record(p, slow, time.Now(), c.interval)
+	if changed && c.onChange != nil {
+		c.onChange(h.u.Address(), !p.failed && !slow)
+	}
+}
+
+// upstreamsHealthJSON is the response of the upstream health handler.
+type upstreamsHealthJSON struct {
+	Upstreams []*upstreamHealthJSON `json:"upstreams"`
+
+	// Enabled is true if the health checks are enabled.
+	Enabled bool `json:"enabled"`
+}
+
+// handleUpstreamsHealth is the handler for the GET /control/upstreams/health
+// HTTP API.
+func (s *Server) handleUpstreamsHealth(w http.ResponseWriter, r *http.Request) {
+	s.serverLock.RLock()
+	c := s.health
+	s.serverLock.RUnlock()
+
+	resp := &upstreamsHealthJSON{
+		Upstreams: []*upstreamHealthJSON{},
+		Enabled:   c != nil,
+	}
+
+	if c != nil {
+		now := time.Now()
+		for _, h := range c.states {
+			resp.Upstreams = append(resp.Upstreams, h.toJSON(now))
+		}
+
+		sort.Slice(resp.Upstreams, func(i, j int) bool {
+			return resp.Upstreams[i].Address < resp.Upstreams[j].Address
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "encoding response: %s", err)
+	}
+}
@@ -0,0 +1,138 @@
+package dnsforward
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamHealth_record(t *testing.T) {
+	const interval = time.Minute
+
+	h := &upstreamHealth{
+		u:  &aghtest.TestUpstream{Addr: "192.0.2.1:53"},
+		mu: &sync.Mutex{},
+	}
+
+	now := time.Now()
+	failed := healthProbe{failed: true}
+	for i := 0; i < healthFailureThreshold-1; i++ {
+		h.record(failed, false, now, interval)
+		assert.False(t, h.quarantined(now))
+	}
+
+	changed := h.record(healthProbe{latency: time.Second}, true, now, interval)
+	require.True(t, h.quarantined(now))
+
+	assert.True(t, changed)
+
+	assert.False(t, h.quarantined(now.Add(interval)))
+
+	wantBackoffs := []time.Duration{2 * interval, 4 * interval, 8 * interval, maxHealthBackoff}
+	for _, want := range wantBackoffs {
+		now = h.until
+		changed = h.record(failed, false, now, interval)
+		assert.False(t, changed)
+
+		assert.Equal(t, want, h.backoff)
+		assert.Equal(t, now.Add(want), h.until)
+	}
+
+	changed = h.record(healthProbe{latency: time.Millisecond}, false, h.until, interval)
+	assert.True(t, changed)
+	assert.False(t, h.quarantined(now))
+	assert.Zero(t, h.backoff)
+
+	j := h.toJSON(now)
+	assert.Equal(t, uint64(healthFailureThreshold+len(wantBackoffs)+1), j.Probes)
+	assert.InDelta(t, float64(len(wantBackoffs)+2)/float64(j.Probes), j.ErrorRate, 0.001)
+	assert.InDelta(t, 500.5, j.AvgLatency, 0.001)
+	assert.False(t, j.Quarantined)
+	assert.Nil(t, j.Until)
+}
+
+func TestHealthChecker(t *testing.T) {
+	const host = "host.example."
+
+	good := &aghtest.TestUpstream{Addr: "good"}
+	bad := &aghtest.TestErrUpstream{Err: errors.Error("test")}
+	member := &aghtest.TestUpstream{Addr: "member"}
+
+	conf := &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{bad, good},
+		DomainReservedUpstreams: map[string][]upstream.Upstream{
+			"corp.example.": {&upstreamGroup{
+				name: "corp",
+				ups:  []upstream.Upstream{member, bad},
+			}},
+			"lab.example.": {bad},
+		},
+	}
+
+	c, err := newHealthChecker(0, 0, "")
+	require.NoError(t, err)
+
+	c.wrap(conf)
+	require.Len(t, c.states, 3)
+
+	for i := 0; i < healthFailureThreshold; i++ {
+		c.probeAll()
+	}
+
+	now := time.Now()
+	assert.True(t, c.states[bad].quarantined(now))
+	assert.False(t, c.states[good].quarantined(now))
+	assert.False(t, c.states[member].quarantined(now))
+
+	req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+
+	require.IsType(t, (*healthUpstream)(nil), conf.Upstreams[0])
+
+	_, err = conf.Upstreams[0].Exchange(req)
+	require.Error(t, err)
+
+	assert.Contains(t, err.Error(), "is quarantined")
+
+	g, ok := conf.DomainReservedUpstreams["corp.example."][0].(*upstreamGroup)
+	require.True(t, ok)
+	require.IsType(t, (*healthUpstream)(nil), g.ups[1])
+
+	// The only upstream of the set is tried anyway.
+	_, err = conf.DomainReservedUpstreams["lab.example."][0].Exchange(req)
+	assert.ErrorIs(t, err, bad.Err)
+}
+
+func TestNewHealthChecker_negative(t *testing.T) {
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		interval   time.Duration
+		maxLatency time.Duration
+	}{{
+		name:       "interval",
+		wantErrMsg: "upstream_health_check_interval: negative value -1s",
+		interval:   -time.Second,
+		maxLatency: 0,
+	}, {
+		name:       "max_latency",
+		wantErrMsg: "upstream_health_check_max_latency: negative value -1s",
+		interval:   0,
+		maxLatency: -time.Second,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newHealthChecker(tc.interval, tc.maxLatency, "")
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
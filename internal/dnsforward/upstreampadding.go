@@ -0,0 +1,210 @@
+package dnsforward
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net/url"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Query padding policies.
+const (
+	// PaddingPolicyOff disables padding the queries.
+	PaddingPolicyOff = "off"
+
+	// PaddingPolicyBlockLength pads the queries to a multiple of
+	// queryPaddingBlockSize.
+	PaddingPolicyBlockLength = "block_length"
+
+	// PaddingPolicyRandom pads the queries by a random number of octets less
+	// than queryPaddingBlockSize.
+	PaddingPolicyRandom = "random"
+)
+
+// queryPaddingBlockSize is the size of the blocks, to the multiple of which
+// the queries are padded.  It's the one recommended by RFC 8467.
+const queryPaddingBlockSize = 128
+
+// validatePaddingPolicy returns an error if policy isn't a known query padding
+// policy.  An empty policy is the same as PaddingPolicyOff.
+func validatePaddingPolicy(policy string) (err error) {
+	switch policy {
+	case "", PaddingPolicyOff, PaddingPolicyBlockLength, PaddingPolicyRandom:
+		return nil
+	default:
+		return fmt.Errorf("bad upstream padding policy %q", policy)
+	}
+}
+
+// isEncryptedUpstreamAddr returns true if addr is the address of a
+// DNS-over-TLS, DNS-over-HTTPS, or DNS-over-QUIC upstream.
+func isEncryptedUpstreamAddr(addr string) (ok bool) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return false
+	}
+
+	switch u.Scheme {
+	case "tls", "https", "quic":
+		return true
+	default:
+		return false
+	}
+}
+
+// paddedUpstream is an encrypted upstream, the queries to which are padded with
+// the EDNS Padding option to resist the traffic analysis.  See RFC 7830 and
+// RFC 8467.
+type paddedUpstream struct {
+	// u is the underlying upstream.
+	u upstream.Upstream
+
+	// policy is either PaddingPolicyBlockLength or PaddingPolicyRandom.
+	policy string
+}
+
+// type check
+var _ upstream.Upstream = (*paddedUpstream)(nil)
+
+// padUpstream returns u padding the queries according to policy.  It returns
+// u itself if the queries aren't padded.
+func padUpstream(u upstream.Upstream, policy string) (res upstream.Upstream) {
+	if policy == "" || policy == PaddingPolicyOff {
+		return u
+	}
+
+	return &paddedUpstream{u: u, policy: policy}
+}
+
+// Exchange implements the upstream.Upstream interface for *paddedUpstream.
+func (u *paddedUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	origOpt := req.IsEdns0()
+	hadPadding := origOpt != nil && hasPaddingOption(origOpt)
+
+	req = req.Copy()
+	padQuery(req, u.policy)
+
+	resp, err = u.u.Exchange(req)
+	if err != nil || resp == nil {
+		return resp, err
+	}
+
+	if origOpt == nil {
+		removeOPT(resp)
+	} else if !hadPadding {
+		removePadding(resp)
+	}
+
+	return resp, nil
+}
+
+// Address implements the upstream.Upstream interface for *paddedUpstream.
+func (u *paddedUpstream) Address() (addr string) {
+	return u.u.Address()
+}
+
+// Close implements the upstream.Upstream interface for *paddedUpstream.
+func (u *paddedUpstream) Close() (err error) {
+	return u.u.Close()
+}
+
+// padQuery pads req with the EDNS Padding option according to policy,
+// replacing the padding it already has, if any.
+func padQuery(req *dns.Msg, policy string) {
+	opt := req.IsEdns0()
+	if opt == nil {
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		opt = req.IsEdns0()
+	}
+
+	removePadding(req)
+
+	pad := &dns.EDNS0_PADDING{}
+	opt.Option = append(opt.Option, pad)
+
+	var n int
+	if policy == PaddingPolicyRandom {
+		r, err := rand.Int(rand.Reader, big.NewInt(queryPaddingBlockSize))
+		if err != nil {
+			log.Debug("dns: generating padding length: %s", err)
+		} else {
+			n = int(r.Int64())
+		}
+	} else if rem := req.Len() % queryPaddingBlockSize; rem != 0 {
+		n = queryPaddingBlockSize - rem
+	}
+
+	pad.Padding = make([]byte, n)
+}
+
+// removePadding removes the EDNS Padding options from m.
+func removePadding(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	opts := opt.Option[:0]
+	for _, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_PADDING); !ok {
+			opts = append(opts, o)
+		}
+	}
+
+	opt.Option = opts
+}
+
+// removeOPT removes the OPT pseudo-records from m.
+func removeOPT(m *dns.Msg) {
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+
+	m.Extra = extra
+}
+
+// applyUpstreamPadding replaces the encrypted upstreams of conf with the ones
+// padding the queries according to s.conf.UpstreamPadding.
+func (s *Server) applyUpstreamPadding(conf *proxy.UpstreamConfig) (err error) {
+	policy := s.conf.UpstreamPadding
+	err = validatePaddingPolicy(policy)
+	if err != nil {
+		return err
+	} else if policy == "" || policy == PaddingPolicyOff {
+		return nil
+	}
+
+	// Wrap each upstream once, since the same upstream may be used for several
+	// domains.
+	padded := map[upstream.Upstream]upstream.Upstream{}
+	wrap := func(ups []upstream.Upstream) {
+		for i, u := range ups {
+			if _, ok := u.(*paddedUpstream); ok || !isEncryptedUpstreamAddr(u.Address()) {
+				continue
+			}
+
+			pu, ok := padded[u]
+			if !ok {
+				pu = padUpstream(u, policy)
+				padded[u] = pu
+			}
+
+			ups[i] = pu
+		}
+	}
+
+	wrap(conf.Upstreams)
+	for _, ups := range conf.DomainReservedUpstreams {
+		wrap(ups)
+	}
+
+	return nil
+}
@@ -0,0 +1,166 @@
+package dnsforward
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// paddingEchoUpstream is an upstream, which keeps the last request and pads the
+// responses if the requests are padded.
+type paddingEchoUpstream struct {
+	last *dns.Msg
+}
+
+// Exchange implements the upstream.Upstream interface for
+// *paddingEchoUpstream.
+func (u *paddingEchoUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	u.last = req
+
+	resp = (&dns.Msg{}).SetReply(req)
+	if opt := req.IsEdns0(); opt != nil {
+		resp.SetEdns0(opt.UDPSize(), opt.Do())
+		if hasPaddingOption(opt) {
+			padResponse(req, resp, 468)
+		}
+	}
+
+	return resp, nil
+}
+
+// Address implements the upstream.Upstream interface for
+// *paddingEchoUpstream.
+func (u *paddingEchoUpstream) Address() (addr string) {
+	return "tls://dns.example:853"
+}
+
+func (u *paddingEchoUpstream) Close() (err error) {
+	return nil
+}
+
+// paddingLen returns the length of the EDNS Padding option of m or -1 if
+// there is none.
+func paddingLen(m *dns.Msg) (n int) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return -1
+	}
+
+	for _, o := range opt.Option {
+		if p, ok := o.(*dns.EDNS0_PADDING); ok {
+			return len(p.Padding)
+		}
+	}
+
+	return -1
+}
+
+func TestPadQuery(t *testing.T) {
+	for _, name := range []string{"example.org.", "a-much-longer-subdomain.of.example.org."} {
+		req := (&dns.Msg{}).SetQuestion(name, dns.TypeA)
+		padQuery(req, PaddingPolicyBlockLength)
+
+		assert.Zero(t, req.Len()%queryPaddingBlockSize, name)
+		assert.GreaterOrEqual(t, paddingLen(req), 0)
+	}
+
+	// A previous padding is replaced.
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	padQuery(req, PaddingPolicyBlockLength)
+	padQuery(req, PaddingPolicyBlockLength)
+
+	assert.Zero(t, req.Len()%queryPaddingBlockSize)
+	assert.Len(t, req.IsEdns0().Option, 1)
+
+	req = (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	padQuery(req, PaddingPolicyRandom)
+
+	n := paddingLen(req)
+	assert.GreaterOrEqual(t, n, 0)
+	assert.Less(t, n, queryPaddingBlockSize)
+}
+
+func TestPaddedUpstream_Exchange(t *testing.T) {
+	echo := &paddingEchoUpstream{}
+	u := padUpstream(echo, PaddingPolicyBlockLength)
+
+	t.Run("no_edns", func(t *testing.T) {
+		req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+
+		resp, err := u.Exchange(req)
+		require.NoError(t, err)
+
+		assert.Nil(t, req.IsEdns0())
+		assert.Zero(t, echo.last.Len()%queryPaddingBlockSize)
+		assert.Nil(t, resp.IsEdns0())
+	})
+
+	t.Run("edns", func(t *testing.T) {
+		req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+		req.SetEdns0(dns.DefaultMsgSize, true)
+
+		resp, err := u.Exchange(req)
+		require.NoError(t, err)
+
+		assert.Equal(t, -1, paddingLen(req))
+		assert.GreaterOrEqual(t, paddingLen(echo.last), 0)
+
+		require.NotNil(t, resp.IsEdns0())
+
+		assert.Equal(t, -1, paddingLen(resp))
+	})
+
+	t.Run("padded", func(t *testing.T) {
+		req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+		req.SetEdns0(dns.DefaultMsgSize, true)
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_PADDING{})
+
+		resp, err := u.Exchange(req)
+		require.NoError(t, err)
+
+		assert.GreaterOrEqual(t, paddingLen(resp), 0)
+	})
+}
+
+func TestServer_applyUpstreamPadding(t *testing.T) {
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				UpstreamPadding: PaddingPolicyRandom,
+			},
+		},
+	}
+
+	conf, err := proxy.ParseUpstreamsConfig([]string{
+		"tls://dns.example",
+		"https://dns.example/dns-query",
+		"192.0.2.1",
+		"[/domain.example/]tls://dns.example",
+	}, nil)
+	require.NoError(t, err)
+
+	err = s.applyUpstreamPadding(conf)
+	require.NoError(t, err)
+
+	pu, ok := conf.Upstreams[0].(*paddedUpstream)
+	require.True(t, ok)
+
+	assert.Equal(t, PaddingPolicyRandom, pu.policy)
+	assert.Same(t, pu, conf.DomainReservedUpstreams["domain.example."][0])
+
+	_, ok = conf.Upstreams[1].(*paddedUpstream)
+	assert.True(t, ok)
+
+	_, ok = conf.Upstreams[2].(*paddedUpstream)
+	assert.False(t, ok)
+
+	s.conf.UpstreamPadding = "bad"
+	err = s.applyUpstreamPadding(conf)
+	require.Error(t, err)
+
+	assert.Equal(t, `bad upstream padding policy "bad"`, err.Error())
+}
@@ -0,0 +1,243 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+)
+
+// Default values of the connection pool settings.
+const (
+	// defaultPoolMaxIdleTLS is the maximum number of the idle DNS-over-TLS
+	// connections per upstream used when the maximum isn't set.
+	defaultPoolMaxIdleTLS = 1
+
+	// defaultPoolMaxIdleHTTPS is the maximum number of the idle
+	// DNS-over-HTTPS connections per upstream used when the maximum isn't
+	// set.  It's the same as the default of package net/http.
+	defaultPoolMaxIdleHTTPS = http.DefaultMaxIdleConnsPerHost
+
+	// defaultPoolIdleTimeout is the time after which an idle connection is
+	// closed used when the timeout isn't set.
+	defaultPoolIdleTimeout = 5 * time.Minute
+)
+
+// UpstreamPoolConfig is the configuration of the pools of the connections to
+// the DNS-over-TLS and DNS-over-HTTPS upstreams.  If any of the settings is
+// set, all such upstreams are connected to by AdGuard Home itself instead of
+// dnsproxy, so that the settings apply and the statistics of their pools are
+// available.
+type UpstreamPoolConfig struct {
+	// MaxIdleConns is the maximum number of the idle connections kept per
+	// upstream.  If zero, one connection is kept for each DNS-over-TLS
+	// upstream and two for each DNS-over-HTTPS one.
+	MaxIdleConns int `yaml:"max_idle_conns"`
+
+	// IdleTimeout is the time after which an idle connection is closed.  If
+	// zero, five minutes are used.
+	IdleTimeout timeutil.Duration `yaml:"idle_timeout"`
+
+	// KeepAlive is the interval between the TCP keepalive probes of the
+	// connections.  If zero, the default of the operating system or of Go is
+	// used.  If negative, the probes are disabled.
+	KeepAlive timeutil.Duration `yaml:"keepalive"`
+}
+
+// tuned returns true if any of the settings of c is set.
+func (c *UpstreamPoolConfig) tuned() (ok bool) {
+	return c.MaxIdleConns != 0 || c.IdleTimeout.Duration != 0 || c.KeepAlive.Duration != 0
+}
+
+// isTLSUpstreamAddr returns true if addr is the address of a DNS-over-TLS or a
+// DNS-over-HTTPS upstream.
+func isTLSUpstreamAddr(addr string) (ok bool) {
+	u, err := url.Parse(addr)
+
+	return err == nil && (u.Scheme == "tls" || u.Scheme == "https")
+}
+
+// poolCounters are the statistics of the connection pool of an upstream.  They
+// must only be accessed atomically.
+type poolCounters struct {
+	// dials is the number of the established connections.
+	dials uint64
+
+	// dialErrors is the number of the failed connection attempts.
+	dialErrors uint64
+
+	// reused is the number of the exchanges over the idle connections.
+	reused uint64
+
+	// expired is the number of the idle connections closed after the idle
+	// timeout.
+	expired uint64
+}
+
+// pooledConn is an idle DNS-over-TLS connection.
+type pooledConn struct {
+	// conn is the connection.
+	conn *dns.Conn
+
+	// since is the time since which the connection is idle.
+	since time.Time
+}
+
+// tunePool applies the pool settings c to u.  It must be called before u is
+// used.
+func (u *tlsUpstream) tunePool(c *UpstreamPoolConfig) {
+	u.keepAlive = c.KeepAlive.Duration
+	if c.IdleTimeout.Duration > 0 {
+		u.idleTimeout = c.IdleTimeout.Duration
+	}
+
+	if c.MaxIdleConns > 0 {
+		u.maxIdle = c.MaxIdleConns
+	}
+
+	if u.client != nil {
+		t := u.client.Transport.(*http.Transport)
+		t.MaxIdleConnsPerHost = u.maxIdle
+		t.IdleConnTimeout = u.idleTimeout
+	}
+}
+
+// getIdle returns the most recently used idle DNS-over-TLS connection, which
+// hasn't expired yet, or nil if there is none.  The expired ones are closed.
+func (u *tlsUpstream) getIdle(now time.Time) (conn *dns.Conn) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for len(u.idle) > 0 {
+		last := len(u.idle) - 1
+		pc := u.idle[last]
+		u.idle = u.idle[:last]
+
+		if now.Sub(pc.since) < u.idleTimeout {
+			return pc.conn
+		}
+
+		atomic.AddUint64(&u.pool.expired, 1)
+		_ = pc.conn.Close()
+	}
+
+	return nil
+}
+
+// putIdle keeps conn as an idle connection or closes it if the pool is full.
+func (u *tlsUpstream) putIdle(conn *dns.Conn, now time.Time) (err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if len(u.idle) >= u.maxIdle {
+		return conn.Close()
+	}
+
+	u.idle = append(u.idle, pooledConn{conn: conn, since: now})
+
+	return nil
+}
+
+// idleNum returns the number of the idle DNS-over-TLS connections.
+func (u *tlsUpstream) idleNum() (n int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return len(u.idle)
+}
+
+// upstreamPoolJSON is the statistics of the connection pool of an upstream.
+type upstreamPoolJSON struct {
+	// Idle is the current number of the idle connections.  It's nil for the
+	// DNS-over-HTTPS upstreams, since their pools are managed by package
+	// net/http.
+	Idle *int `json:"idle,omitempty"`
+
+	Address    string `json:"address"`
+	Dials      uint64 `json:"dials"`
+	DialErrors uint64 `json:"dial_errors"`
+	Reused     uint64 `json:"reused"`
+	Expired    uint64 `json:"expired"`
+	MaxIdle    int    `json:"max_idle"`
+
+	// IdleTimeout is the idle timeout in milliseconds.
+	IdleTimeout int64 `json:"idle_timeout"`
+}
+
+// poolJSON returns the statistics of the pool of u.
+func (u *tlsUpstream) poolJSON() (j *upstreamPoolJSON) {
+	j = &upstreamPoolJSON{
+		Address:     u.addr,
+		Dials:       atomic.LoadUint64(&u.pool.dials),
+		DialErrors:  atomic.LoadUint64(&u.pool.dialErrors),
+		Reused:      atomic.LoadUint64(&u.pool.reused),
+		Expired:     atomic.LoadUint64(&u.pool.expired),
+		MaxIdle:     u.maxIdle,
+		IdleTimeout: u.idleTimeout.Milliseconds(),
+	}
+
+	if u.client == nil {
+		n := u.idleNum()
+		j.Idle = &n
+	}
+
+	return j
+}
+
+// upstreamsPoolJSON is the response to the upstream pools statistics request.
+type upstreamsPoolJSON struct {
+	Upstreams []*upstreamPoolJSON `json:"upstreams"`
+}
+
+// newPooledTLSUpstream returns a new upstream for c with the pool settings of
+// the server.
+func (s *Server) newPooledTLSUpstream(c *UpstreamTLSConfig) (u *tlsUpstream, err error) {
+	u, err = newTLSUpstream(c, s.conf.BootstrapDNS, s.conf.UpstreamTimeout, s.conf.TLSv12Roots)
+	if err != nil {
+		return nil, err
+	}
+
+	u.tunePool(&s.conf.UpstreamPool)
+
+	return u, nil
+}
+
+// trackTLSUpstream adds u to the upstreams, the pool statistics of which are
+// published.
+func (s *Server) trackTLSUpstream(u *tlsUpstream) {
+	if s.tlsUpstreams == nil {
+		s.tlsUpstreams = map[string]*tlsUpstream{}
+	}
+
+	s.tlsUpstreams[u.addr] = u
+}
+
+// handleUpstreamsPool is the handler for the GET /control/upstreams/pool HTTP
+// API.
+func (s *Server) handleUpstreamsPool(w http.ResponseWriter, r *http.Request) {
+	resp := &upstreamsPoolJSON{
+		Upstreams: []*upstreamPoolJSON{},
+	}
+
+	s.serverLock.RLock()
+	for _, u := range s.tlsUpstreams {
+		resp.Upstreams = append(resp.Upstreams, u.poolJSON())
+	}
+	s.serverLock.RUnlock()
+
+	sort.Slice(resp.Upstreams, func(i, j int) bool {
+		return resp.Upstreams[i].Address < resp.Upstreams[j].Address
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "encoding response: %s", err)
+	}
+}
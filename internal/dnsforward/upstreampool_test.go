@@ -0,0 +1,149 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSUpstream_tunePool(t *testing.T) {
+	c := &UpstreamPoolConfig{
+		MaxIdleConns: 4,
+		IdleTimeout:  timeutil.Duration{Duration: time.Minute},
+		KeepAlive:    timeutil.Duration{Duration: 15 * time.Second},
+	}
+
+	t.Run("tls", func(t *testing.T) {
+		u, err := newTLSUpstream(&UpstreamTLSConfig{Upstream: "tls://dns.example"}, nil, time.Second, nil)
+		require.NoError(t, err)
+
+		assert.Equal(t, defaultPoolMaxIdleTLS, u.maxIdle)
+		assert.Equal(t, defaultPoolIdleTimeout, u.idleTimeout)
+
+		u.tunePool(c)
+
+		assert.Equal(t, 4, u.maxIdle)
+		assert.Equal(t, time.Minute, u.idleTimeout)
+		assert.Equal(t, 15*time.Second, u.keepAlive)
+	})
+
+	t.Run("https", func(t *testing.T) {
+		u, err := newTLSUpstream(&UpstreamTLSConfig{Upstream: "https://dns.example/dns-query"}, nil, time.Second, nil)
+		require.NoError(t, err)
+
+		assert.Equal(t, defaultPoolMaxIdleHTTPS, u.maxIdle)
+
+		u.tunePool(c)
+
+		tr := u.client.Transport.(*http.Transport)
+		assert.Equal(t, 4, tr.MaxIdleConnsPerHost)
+		assert.Equal(t, time.Minute, tr.IdleConnTimeout)
+	})
+}
+
+func TestTLSUpstream_idle(t *testing.T) {
+	u, err := newTLSUpstream(&UpstreamTLSConfig{Upstream: "tls://dns.example"}, nil, time.Second, nil)
+	require.NoError(t, err)
+
+	u.tunePool(&UpstreamPoolConfig{
+		MaxIdleConns: 2,
+		IdleTimeout:  timeutil.Duration{Duration: time.Minute},
+	})
+
+	newConn := func() (conn *dns.Conn) {
+		c, _ := net.Pipe()
+		t.Cleanup(func() { _ = c.Close() })
+
+		return &dns.Conn{Conn: c}
+	}
+
+	now := time.Now()
+	stale, fresh := newConn(), newConn()
+
+	require.NoError(t, u.putIdle(stale, now.Add(-2*time.Minute)))
+	require.NoError(t, u.putIdle(fresh, now))
+	// The pool is full, so the connection is closed.
+	require.NoError(t, u.putIdle(newConn(), now))
+
+	assert.Equal(t, 2, u.idleNum())
+
+	assert.Same(t, fresh, u.getIdle(now))
+	assert.Nil(t, u.getIdle(now))
+
+	assert.Equal(t, 0, u.idleNum())
+	assert.Equal(t, uint64(1), u.pool.expired)
+}
+
+func TestServer_applyUpstreamTLS_pool(t *testing.T) {
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				UpstreamPool: UpstreamPoolConfig{
+					MaxIdleConns: 3,
+				},
+			},
+			UpstreamTimeout: time.Second,
+		},
+	}
+
+	conf, err := proxy.ParseUpstreamsConfig([]string{
+		"tls://dns.example",
+		"https://192.0.2.1/dns-query",
+		"192.0.2.2",
+		"[/domain.example/]tls://dns.example",
+	}, nil)
+	require.NoError(t, err)
+
+	err = s.applyUpstreamTLS(conf)
+	require.NoError(t, err)
+
+	require.Len(t, conf.Upstreams, 3)
+
+	tu, ok := conf.Upstreams[0].(*tlsUpstream)
+	require.True(t, ok)
+
+	assert.Equal(t, 3, tu.maxIdle)
+
+	_, ok = conf.Upstreams[1].(*tlsUpstream)
+	assert.True(t, ok)
+
+	_, ok = conf.Upstreams[2].(*tlsUpstream)
+	assert.False(t, ok)
+
+	ups := conf.DomainReservedUpstreams["domain.example."]
+	require.Len(t, ups, 1)
+
+	assert.Same(t, tu, ups[0])
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/control/upstreams/pool", nil)
+	s.handleUpstreamsPool(w, r)
+
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp := &upstreamsPoolJSON{}
+	err = json.NewDecoder(w.Body).Decode(resp)
+	require.NoError(t, err)
+	require.Len(t, resp.Upstreams, 2)
+
+	https, tls := resp.Upstreams[0], resp.Upstreams[1]
+
+	assert.Equal(t, "https://192.0.2.1:443/dns-query", https.Address)
+	assert.Nil(t, https.Idle)
+
+	assert.Equal(t, "tls://dns.example:853", tls.Address)
+	require.NotNil(t, tls.Idle)
+
+	assert.Equal(t, 0, *tls.Idle)
+	assert.Equal(t, 3, tls.MaxIdle)
+	assert.Equal(t, defaultPoolIdleTimeout.Milliseconds(), tls.IdleTimeout)
+}
@@ -0,0 +1,361 @@
+package dnsforward
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	netproxy "golang.org/x/net/proxy"
+)
+
+// UpstreamProxyConfig is the proxy of a single upstream.
+type UpstreamProxyConfig struct {
+	// Upstream is the address of the upstream the way it's specified in the
+	// upstream servers, for example "tls://dns.example".  Only the
+	// DNS-over-TLS and DNS-over-HTTPS upstreams are supported.
+	Upstream string `yaml:"upstream"`
+
+	// URL is the URL of the proxy, see FilteringConfig.UpstreamProxy.  If
+	// it's empty, the upstream is connected to directly even if the global
+	// proxy is set.
+	URL string `yaml:"url"`
+}
+
+// upstreamProxy tunnels the connections to an upstream through a SOCKS5 or an
+// HTTP CONNECT proxy.  The hostnames of the upstreams are resolved by the
+// proxy, so that the bootstrap servers aren't required to be reachable.
+type upstreamProxy struct {
+	// url is the URL of the proxy.
+	url *url.URL
+
+	// socks is the dialer of the SOCKS5 proxy.  It's nil if the proxy is an
+	// HTTP one.
+	socks netproxy.ContextDialer
+
+	// timeout is the timeout of the connection to the proxy.
+	timeout time.Duration
+}
+
+// newUpstreamProxy returns a new proxy for rawURL.
+func newUpstreamProxy(rawURL string, timeout time.Duration) (p *upstreamProxy, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	} else if u.Host == "" {
+		return nil, fmt.Errorf("no host in %q", rawURL)
+	}
+
+	p = &upstreamProxy{
+		url:     u,
+		timeout: timeout,
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		var auth *netproxy.Auth
+		if u.User != nil {
+			pass, _ := u.User.Password()
+			auth = &netproxy.Auth{User: u.User.Username(), Password: pass}
+		}
+
+		var d netproxy.Dialer
+		d, err = netproxy.SOCKS5("tcp", hostWithPort(u, "1080"), auth, &net.Dialer{Timeout: timeout})
+		if err != nil {
+			return nil, err
+		}
+
+		p.socks = d.(netproxy.ContextDialer)
+	case "http":
+		// Go on.
+	default:
+		return nil, fmt.Errorf("bad scheme %q, want socks5 or http", u.Scheme)
+	}
+
+	return p, nil
+}
+
+// hostWithPort returns the host of u with the port, or with defPort if u has
+// none.
+func hostWithPort(u *url.URL, defPort string) (hostPort string) {
+	if u.Port() != "" {
+		return u.Host
+	}
+
+	return net.JoinHostPort(u.Hostname(), defPort)
+}
+
+// String implements the fmt.Stringer interface for *upstreamProxy.  The
+// password is redacted.
+func (p *upstreamProxy) String() (s string) {
+	if p == nil {
+		return ""
+	}
+
+	return p.url.Redacted()
+}
+
+// dial connects to addr over TCP through the proxy.
+func (p *upstreamProxy) dial(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, fmt.Errorf("proxying %s isn't supported", network)
+	}
+
+	if p.socks != nil {
+		conn, err = p.socks.DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = p.dialHTTP(ctx, addr)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("dialing %s through proxy %s: %w", addr, p, err)
+	}
+
+	return conn, nil
+}
+
+// dialHTTP connects to addr through the HTTP proxy using the CONNECT method.
+func (p *upstreamProxy) dialHTTP(ctx context.Context, addr string) (conn net.Conn, err error) {
+	d := &net.Dialer{Timeout: p.timeout}
+	conn, err = d.DialContext(ctx, "tcp", hostWithPort(p.url, "80"))
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			err = errors.WithDeferred(err, conn.Close())
+		}
+	}()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		err = conn.SetDeadline(deadline)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+
+	if u := p.url.User; u != nil {
+		pass, _ := u.Password()
+		cred := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+
+	err = req.Write(conn)
+	if err != nil {
+		return nil, fmt.Errorf("writing connect request: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("reading connect response: %w", err)
+	}
+
+	// The body of a successful response to CONNECT is the tunnel itself, so
+	// don't close it.
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("connect: unexpected status %s", resp.Status)
+	}
+
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+
+	return conn, nil
+}
+
+// bufferedConn is a connection, some data of which has already been read into
+// a buffer.
+type bufferedConn struct {
+	net.Conn
+
+	// r reads the buffered data first.
+	r *bufio.Reader
+}
+
+// Read implements the net.Conn interface for *bufferedConn.
+func (c *bufferedConn) Read(b []byte) (n int, err error) {
+	return c.r.Read(b)
+}
+
+// proxyUpstream returns the upstream for u tunneled through p.  u is expected
+// to be either a dnsproxy upstream or a *tlsUpstream.  ok is false if
+// proxying the upstreams of such type isn't supported.
+func (s *Server) proxyUpstream(
+	u upstream.Upstream,
+	p *upstreamProxy,
+) (res upstream.Upstream, ok bool, err error) {
+	if tu, isTLS := u.(*tlsUpstream); isTLS {
+		tu.proxy = p
+
+		return tu, true, nil
+	}
+
+	addr := u.Address()
+	if !strings.HasPrefix(addr, "tls://") && !strings.HasPrefix(addr, "https://") {
+		return nil, false, nil
+	}
+
+	tu, err := s.newPooledTLSUpstream(&UpstreamTLSConfig{Upstream: addr})
+	if err != nil {
+		return nil, false, err
+	}
+
+	tu.proxy = p
+	s.trackTLSUpstream(tu)
+
+	return tu, true, nil
+}
+
+// upstreamProxies are the proxies of the upstreams.
+type upstreamProxies struct {
+	// global is the proxy of all the upstreams, which don't have their own
+	// proxies.  It's nil if there is none.
+	global *upstreamProxy
+
+	// byAddr are the own proxies of the upstreams by their addresses.  It
+	// contains nil for the upstreams connected to directly.
+	byAddr map[string]*upstreamProxy
+}
+
+// newUpstreamProxies returns the proxies of the upstreams from the
+// configuration of s.  ps is nil if there are no proxies.
+func (s *Server) newUpstreamProxies() (ps *upstreamProxies, err error) {
+	if s.conf.UpstreamProxy == "" && len(s.conf.UpstreamProxies) == 0 {
+		return nil, nil
+	}
+
+	ps = &upstreamProxies{
+		byAddr: make(map[string]*upstreamProxy, len(s.conf.UpstreamProxies)),
+	}
+
+	if s.conf.UpstreamProxy != "" {
+		ps.global, err = newUpstreamProxy(s.conf.UpstreamProxy, s.conf.UpstreamTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("upstream proxy: %w", err)
+		}
+	}
+
+	for _, c := range s.conf.UpstreamProxies {
+		var u upstream.Upstream
+		u, err = upstream.AddressToUpstream(c.Upstream, &upstream.Options{
+			Timeout: s.conf.UpstreamTimeout,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("upstream proxy for %q: %w", c.Upstream, err)
+		}
+
+		var p *upstreamProxy
+		if c.URL != "" {
+			p, err = newUpstreamProxy(c.URL, s.conf.UpstreamTimeout)
+			if err != nil {
+				return nil, fmt.Errorf("upstream proxy for %q: %w", c.Upstream, err)
+			}
+		}
+
+		ps.byAddr[u.Address()] = p
+	}
+
+	return ps, nil
+}
+
+// forAddr returns the proxy of the upstream with addr.  own is true if the
+// upstream has its own proxy setting.  p is nil if the upstream should be
+// connected to directly.  ps may be nil.
+func (ps *upstreamProxies) forAddr(addr string) (p *upstreamProxy, own bool) {
+	if ps == nil {
+		return nil, false
+	}
+
+	p, own = ps.byAddr[addr]
+	if !own {
+		p = ps.global
+	}
+
+	return p, own
+}
+
+// applyUpstreamProxy replaces the upstreams of conf, which must be tunneled
+// through a proxy, with the proxied ones.  The plain DNS and DNSCrypt upstreams
+// are connected to directly, while the DNS-over-QUIC ones are rejected unless
+// they are excluded with their own empty proxy settings.  It must be called
+// after applyUpstreamTLS and applyUpstreamBind, so that the upstreams keep
+// their TLS configuration.
+func (s *Server) applyUpstreamProxy(conf *proxy.UpstreamConfig) (err error) {
+	ps, err := s.newUpstreamProxies()
+	if err != nil {
+		return err
+	} else if ps == nil {
+		return nil
+	}
+
+	proxied := map[upstream.Upstream]upstream.Upstream{}
+	replace := func(ups []upstream.Upstream) (rErr error) {
+		for i, u := range ups {
+			addr := u.Address()
+			p, own := ps.forAddr(addr)
+			if p == nil {
+				continue
+			}
+
+			pu, done := proxied[u]
+			if !done {
+				var ok bool
+				pu, ok, rErr = s.proxyUpstream(u, p)
+				if rErr != nil {
+					return fmt.Errorf("upstream proxy for %q: %w", addr, rErr)
+				} else if !ok && (own || strings.HasPrefix(addr, "quic://")) {
+					// Don't let the encrypted upstreams bypass the proxy
+					// silently, since DNS-over-QUIC would require a proxy
+					// of UDP.
+					return fmt.Errorf("upstream proxy for %q: only tls and https upstreams are supported", addr)
+				} else if !ok {
+					log.Debug("dns: upstream %s is not proxied, since it's not encrypted", addr)
+					pu = u
+				}
+
+				proxied[u] = pu
+			}
+
+			ups[i] = pu
+		}
+
+		return nil
+	}
+
+	err = replace(conf.Upstreams)
+	if err != nil {
+		return err
+	}
+
+	for _, ups := range conf.DomainReservedUpstreams {
+		err = replace(ups)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,336 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+)
+
+// maxRetryAttempts is the maximum number of the attempts to query an upstream.
+const maxRetryAttempts = 10
+
+// UpstreamRetryConfig is the retry policy of the queries to the upstreams.  In
+// the per-upstream policies, the zero and nil values mean that the global
+// policy applies.
+type UpstreamRetryConfig struct {
+	// TCPOnTruncated, if false, makes the server return the truncated
+	// responses of the plain DNS-over-UDP upstreams as is, instead of
+	// repeating the query over TCP.  If nil, the query is repeated.
+	TCPOnTruncated *bool `yaml:"tcp_on_truncated,omitempty"`
+
+	// Upstream is the address of the upstream the way it's specified in the
+	// upstream servers, for example "8.8.8.8".  It's only used in the
+	// per-upstream policies.
+	Upstream string `yaml:"upstream,omitempty"`
+
+	// Timeout is the timeout of a single attempt.  If zero or not shorter
+	// than the upstream timeout, the latter is used.
+	Timeout timeutil.Duration `yaml:"timeout"`
+
+	// Backoff is the delay before the first retry.  It's doubled before each
+	// next one.
+	Backoff timeutil.Duration `yaml:"backoff"`
+
+	// Attempts is the total number of the attempts to query the upstream,
+	// including the first one.  If zero or one, the failed queries aren't
+	// retried.
+	Attempts int `yaml:"attempts"`
+}
+
+// retryPolicy is the parsed retry policy of an upstream.
+type retryPolicy struct {
+	// timeout is the timeout of a single attempt.  Zero means the upstream
+	// timeout.
+	timeout time.Duration
+
+	// backoff is the delay before the first retry.
+	backoff time.Duration
+
+	// attempts is the total number of the attempts.
+	attempts int
+
+	// tcpOnTruncated shows if the truncated responses are repeated over TCP.
+	tcpOnTruncated bool
+}
+
+// newRetryPolicy returns the policy of c with the unset values taken from
+// base, which may be nil.  The attempt timeouts not shorter than upsTimeout,
+// the upstream timeout, are dropped.
+func newRetryPolicy(
+	c *UpstreamRetryConfig,
+	base *retryPolicy,
+	upsTimeout time.Duration,
+) (p *retryPolicy, err error) {
+	if c.Attempts < 0 || c.Attempts > maxRetryAttempts {
+		return nil, fmt.Errorf("attempts: must be between 0 and %d, got %d", maxRetryAttempts, c.Attempts)
+	} else if c.Timeout.Duration < 0 {
+		return nil, fmt.Errorf("negative timeout %s", c.Timeout)
+	} else if c.Backoff.Duration < 0 {
+		return nil, fmt.Errorf("negative backoff %s", c.Backoff)
+	}
+
+	p = &retryPolicy{
+		attempts:       1,
+		tcpOnTruncated: true,
+	}
+	if base != nil {
+		*p = *base
+	}
+
+	if c.Attempts > 0 {
+		p.attempts = c.Attempts
+	}
+
+	if c.Timeout.Duration > 0 {
+		p.timeout = c.Timeout.Duration
+		if p.timeout >= upsTimeout {
+			p.timeout = 0
+		}
+	}
+
+	if c.Backoff.Duration > 0 {
+		p.backoff = c.Backoff.Duration
+	}
+
+	if c.TCPOnTruncated != nil {
+		p.tcpOnTruncated = *c.TCPOnTruncated
+	}
+
+	return p, nil
+}
+
+// isDefault returns true if p doesn't change the behavior of the upstream.
+func (p *retryPolicy) isDefault() (ok bool) {
+	return p.attempts <= 1 && p.timeout == 0 && p.tcpOnTruncated
+}
+
+// retryUpstream is an upstream, the failed queries to which are retried
+// according to a policy.
+type retryUpstream struct {
+	// u is the underlying upstream.
+	u upstream.Upstream
+
+	// policy is the retry policy of the upstream.
+	policy *retryPolicy
+}
+
+// type check
+var _ upstream.Upstream = (*retryUpstream)(nil)
+
+// Exchange implements the upstream.Upstream interface for *retryUpstream.
+func (u *retryUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	delay := u.policy.backoff
+	for i := 1; ; i++ {
+		resp, err = u.exchange(req)
+		if err == nil || i >= u.policy.attempts {
+			return resp, err
+		}
+
+		log.Debug("dns: upstream %s: attempt %d of %d: %s", u.Address(), i, u.policy.attempts, err)
+
+		if delay > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+// exchange makes a single attempt to query the upstream.  If the attempt takes
+// longer than the timeout of the policy, it's abandoned, and its result is
+// discarded.
+func (u *retryUpstream) exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	timeout := u.policy.timeout
+	if timeout <= 0 {
+		return u.u.Exchange(req)
+	}
+
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+
+	// Buffer the result, so that the abandoned attempt doesn't block.  Use a
+	// copy of the request, since the next attempt may be made concurrently.
+	resCh := make(chan result, 1)
+	attemptReq := req.Copy()
+	go func() {
+		defer log.OnPanic("dns: upstream retry")
+
+		r, rErr := u.u.Exchange(attemptReq)
+		resCh <- result{resp: r, err: rErr}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case res := <-resCh:
+		return res.resp, res.err
+	case <-timer.C:
+		return nil, fmt.Errorf("attempt timed out after %s", timeout)
+	}
+}
+
+// Address implements the upstream.Upstream interface for *retryUpstream.
+func (u *retryUpstream) Address() (addr string) {
+	return u.u.Address()
+}
+
+// Close implements the upstream.Upstream interface for *retryUpstream.
+func (u *retryUpstream) Close() (err error) {
+	return u.u.Close()
+}
+
+// isPlainUDPUpstreamAddr returns true if addr is the address of a plain
+// DNS-over-UDP upstream.
+func isPlainUDPUpstreamAddr(addr string) (ok bool) {
+	return !strings.Contains(addr, "://") || strings.HasPrefix(addr, "udp://")
+}
+
+// noTCPFallback returns the upstream for u, which returns the truncated
+// responses as is instead of repeating the query over TCP.  u is returned
+// unchanged if it isn't a plain DNS-over-UDP one.  resolvers and timeout must
+// be the ones u has been created with.
+func noTCPFallback(
+	u upstream.Upstream,
+	resolvers []upstream.Resolver,
+	timeout time.Duration,
+) (res upstream.Upstream) {
+	switch u := u.(type) {
+	case *boundUpstream:
+		u.noTCPFallback = true
+
+		return u
+	case *spoofGuard:
+		u.noTCPFallback = true
+
+		return u
+	}
+
+	addr := u.Address()
+	if !isPlainUDPUpstreamAddr(addr) {
+		return u
+	}
+
+	// Make sure it's not one of the special upstreams, like the recursor.
+	parsed, err := url.Parse("udp://" + strings.TrimPrefix(addr, "udp://"))
+	if err != nil {
+		return u
+	} else if _, _, err = net.SplitHostPort(parsed.Host); err != nil {
+		return u
+	}
+
+	return &boundUpstream{
+		addr:          addr,
+		hostPort:      parsed.Host,
+		network:       "udp",
+		timeout:       timeout,
+		resolvers:     resolvers,
+		noTCPFallback: true,
+	}
+}
+
+// ApplyUpstreamRetry wraps the upstreams of conf, created with opts, into the
+// ones retrying the failed queries according to the retry policies of s.  It
+// is used for the upstreams of the clients.
+func (s *Server) ApplyUpstreamRetry(conf *proxy.UpstreamConfig, opts *upstream.Options) (err error) {
+	s.serverLock.RLock()
+	defer s.serverLock.RUnlock()
+
+	return s.applyUpstreamRetry(conf, opts)
+}
+
+// applyUpstreamRetry wraps the upstreams of conf, created with opts, into the
+// ones retrying the failed queries according to s.conf.UpstreamRetry and
+// s.conf.UpstreamRetries.
+func (s *Server) applyUpstreamRetry(conf *proxy.UpstreamConfig, opts *upstream.Options) (err error) {
+	global, err := newRetryPolicy(&s.conf.UpstreamRetry, nil, opts.Timeout)
+	if err != nil {
+		return fmt.Errorf("upstream retry: %w", err)
+	}
+
+	policies := make(map[string]*retryPolicy, len(s.conf.UpstreamRetries))
+	for _, c := range s.conf.UpstreamRetries {
+		var u upstream.Upstream
+		u, err = upstream.AddressToUpstream(c.Upstream, &upstream.Options{
+			Timeout: s.conf.UpstreamTimeout,
+		})
+		if err != nil {
+			return fmt.Errorf("upstream retry for %q: %w", c.Upstream, err)
+		}
+
+		policies[u.Address()], err = newRetryPolicy(c, global, opts.Timeout)
+		if err != nil {
+			return fmt.Errorf("upstream retry for %q: %w", c.Upstream, err)
+		}
+	}
+
+	if global.isDefault() && len(policies) == 0 {
+		return nil
+	}
+
+	resolvers, err := newBootstrapResolvers(opts.Bootstrap, opts.Timeout)
+	if err != nil {
+		return fmt.Errorf("upstream retry: %w", err)
+	}
+
+	// Wrap each upstream once, since the same upstream may be used for several
+	// domains.
+	wrapped := map[upstream.Upstream]upstream.Upstream{}
+	wrap := func(ups []upstream.Upstream) {
+		for i, u := range ups {
+			if _, ok := u.(*retryUpstream); ok {
+				continue
+			}
+
+			ru, ok := wrapped[u]
+			if !ok {
+				ru = retryUpstreamFor(u, global, policies, resolvers, opts.Timeout)
+				wrapped[u] = ru
+			}
+
+			ups[i] = ru
+		}
+	}
+
+	wrap(conf.Upstreams)
+	for _, ups := range conf.DomainReservedUpstreams {
+		wrap(ups)
+	}
+
+	return nil
+}
+
+// retryUpstreamFor returns u retrying the failed queries according to its
+// policy from policies or the global one.  resolvers and timeout must be the
+// ones u has been created with.
+func retryUpstreamFor(
+	u upstream.Upstream,
+	global *retryPolicy,
+	policies map[string]*retryPolicy,
+	resolvers []upstream.Resolver,
+	timeout time.Duration,
+) (res upstream.Upstream) {
+	p, ok := policies[u.Address()]
+	if !ok {
+		p = global
+	}
+
+	if !p.tcpOnTruncated {
+		u = noTCPFallback(u, resolvers, timeout)
+	}
+
+	if p.attempts <= 1 && p.timeout == 0 {
+		return u
+	}
+
+	return &retryUpstream{u: u, policy: p}
+}
@@ -0,0 +1,314 @@
+package dnsforward
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyUpstream is an upstream, which fails the first fails queries and
+// sleeps for delay before answering each one.
+type flakyUpstream struct {
+	calls uint32
+	fails uint32
+	delay time.Duration
+}
+
+// Exchange implements the upstream.Upstream interface for *flakyUpstream.
+func (u *flakyUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	n := atomic.AddUint32(&u.calls, 1)
+	time.Sleep(u.delay)
+
+	if n <= u.fails {
+		return nil, errors.Error("flaky")
+	}
+
+	return (&dns.Msg{}).SetReply(req), nil
+}
+
+// Address implements the upstream.Upstream interface for *flakyUpstream.
+func (u *flakyUpstream) Address() (addr string) {
+	return "192.0.2.53:53"
+}
+
+// Close implements the upstream.Upstream interface for *flakyUpstream.
+func (u *flakyUpstream) Close() (err error) {
+	return nil
+}
+
+func TestRetryUpstream_Exchange(t *testing.T) {
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+
+	testCases := []struct {
+		ups       *flakyUpstream
+		policy    *retryPolicy
+		name      string
+		wantErr   string
+		wantCalls uint32
+	}{{
+		ups:       &flakyUpstream{fails: 2},
+		policy:    &retryPolicy{attempts: 3, backoff: time.Millisecond},
+		name:      "success",
+		wantErr:   "",
+		wantCalls: 3,
+	}, {
+		ups:       &flakyUpstream{fails: 3},
+		policy:    &retryPolicy{attempts: 3},
+		name:      "exhausted",
+		wantErr:   "flaky",
+		wantCalls: 3,
+	}, {
+		ups:       &flakyUpstream{delay: time.Second},
+		policy:    &retryPolicy{attempts: 2, timeout: 10 * time.Millisecond},
+		name:      "timeout",
+		wantErr:   "attempt timed out after 10ms",
+		wantCalls: 2,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u := &retryUpstream{u: tc.ups, policy: tc.policy}
+
+			resp, err := u.Exchange(req)
+			testutil.AssertErrorMsg(t, tc.wantErr, err)
+			if tc.wantErr == "" {
+				assert.NotNil(t, resp)
+			}
+
+			assert.Equal(t, tc.wantCalls, atomic.LoadUint32(&tc.ups.calls))
+		})
+	}
+}
+
+func TestNewRetryPolicy(t *testing.T) {
+	global, err := newRetryPolicy(&UpstreamRetryConfig{
+		Attempts: 3,
+		Backoff:  timeutil.Duration{Duration: time.Second},
+		Timeout:  timeutil.Duration{Duration: time.Minute},
+	}, nil, 10*time.Second)
+	require.NoError(t, err)
+
+	assert.Equal(t, &retryPolicy{
+		timeout:        0,
+		backoff:        time.Second,
+		attempts:       3,
+		tcpOnTruncated: true,
+	}, global)
+
+	noTCP := false
+	p, err := newRetryPolicy(&UpstreamRetryConfig{
+		TCPOnTruncated: &noTCP,
+		Timeout:        timeutil.Duration{Duration: time.Second},
+	}, global, 10*time.Second)
+	require.NoError(t, err)
+
+	assert.Equal(t, &retryPolicy{
+		timeout:        time.Second,
+		backoff:        time.Second,
+		attempts:       3,
+		tcpOnTruncated: false,
+	}, p)
+
+	_, err = newRetryPolicy(&UpstreamRetryConfig{Attempts: 11}, nil, time.Second)
+	testutil.AssertErrorMsg(t, "attempts: must be between 0 and 10, got 11", err)
+}
+
+func TestServer_applyUpstreamRetry(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			resp := (&dns.Msg{}).SetReply(r)
+			resp.Truncated = true
+
+			_ = w.WriteMsg(resp)
+		}),
+	}
+
+	go func() { _ = srv.ActivateAndServe() }()
+	testutil.CleanupAndRequireSuccess(t, srv.Shutdown)
+
+	addr := pc.LocalAddr().String()
+	noTCP := false
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				UpstreamRetry: UpstreamRetryConfig{
+					Attempts: 2,
+				},
+				UpstreamRetries: []*UpstreamRetryConfig{{
+					Upstream:       addr,
+					TCPOnTruncated: &noTCP,
+				}},
+			},
+			UpstreamTimeout: time.Second,
+		},
+	}
+
+	conf, err := proxy.ParseUpstreamsConfig([]string{
+		addr,
+		"tls://192.0.2.2",
+		"[/example.org/]" + addr,
+	}, nil)
+	require.NoError(t, err)
+
+	err = s.applyUpstreamRetry(conf, &upstream.Options{Timeout: time.Second})
+	require.NoError(t, err)
+
+	require.Len(t, conf.Upstreams, 2)
+
+	ru, ok := conf.Upstreams[0].(*retryUpstream)
+	require.True(t, ok)
+
+	assert.Equal(t, 2, ru.policy.attempts)
+	assert.False(t, ru.policy.tcpOnTruncated)
+
+	bu, ok := ru.u.(*boundUpstream)
+	require.True(t, ok)
+
+	assert.True(t, bu.noTCPFallback)
+
+	tlsRU, ok := conf.Upstreams[1].(*retryUpstream)
+	require.True(t, ok)
+
+	assert.True(t, tlsRU.policy.tcpOnTruncated)
+
+	domainUps := conf.DomainReservedUpstreams["example.org."]
+	require.Len(t, domainUps, 1)
+
+	assert.Same(t, ru, domainUps[0])
+
+	resp, err := ru.Exchange((&dns.Msg{}).SetQuestion("example.org.", dns.TypeA))
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+
+	assert.True(t, resp.Truncated)
+}
+
+// fixedResolver is an upstream.Resolver resolving all hosts to ip.
+type fixedResolver struct {
+	ip netip.Addr
+}
+
+// type check
+var _ upstream.Resolver = fixedResolver{}
+
+// LookupNetIP implements the upstream.Resolver interface for fixedResolver.
+func (r fixedResolver) LookupNetIP(
+	_ context.Context,
+	_ string,
+	_ string,
+) (addrs []netip.Addr, err error) {
+	return []netip.Addr{r.ip}, nil
+}
+
+func TestNoTCPFallback_hostname(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			resp := (&dns.Msg{}).SetReply(r)
+			resp.Truncated = true
+
+			_ = w.WriteMsg(resp)
+		}),
+	}
+
+	go func() { _ = srv.ActivateAndServe() }()
+	testutil.CleanupAndRequireSuccess(t, srv.Shutdown)
+
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	u, err := upstream.AddressToUpstream(
+		fmt.Sprintf("dns.example:%d", port),
+		&upstream.Options{Timeout: time.Second},
+	)
+	require.NoError(t, err)
+
+	resolvers := []upstream.Resolver{fixedResolver{ip: netip.MustParseAddr("127.0.0.1")}}
+	res := noTCPFallback(u, resolvers, time.Second)
+
+	bu, ok := res.(*boundUpstream)
+	require.True(t, ok)
+
+	assert.Equal(t, u.Address(), bu.Address())
+
+	resp, err := bu.Exchange((&dns.Msg{}).SetQuestion("example.org.", dns.TypeA))
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+
+	assert.True(t, resp.Truncated)
+}
+
+func TestServer_prepareUpstreamSettings_retrySpoofGuard(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			resp := (&dns.Msg{}).SetReply(r)
+			resp.Truncated = true
+
+			_ = w.WriteMsg(resp)
+		}),
+	}
+
+	go func() { _ = srv.ActivateAndServe() }()
+	testutil.CleanupAndRequireSuccess(t, srv.Shutdown)
+
+	addr := pc.LocalAddr().String()
+	noTCP := false
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				UpstreamDNS:    []string{addr},
+				SpoofDetection: true,
+				UpstreamRetry: UpstreamRetryConfig{
+					TCPOnTruncated: &noTCP,
+					Attempts:       3,
+				},
+			},
+			UpstreamTimeout: time.Second,
+		},
+		spoof: &spoofCounters{},
+	}
+
+	err = s.prepareUpstreamSettings()
+	require.NoError(t, err)
+
+	ups := s.conf.UpstreamConfig.Upstreams
+	require.Len(t, ups, 1)
+
+	ru, ok := ups[0].(*retryUpstream)
+	require.True(t, ok)
+
+	assert.Equal(t, 3, ru.policy.attempts)
+
+	g, ok := ru.u.(*spoofGuard)
+	require.True(t, ok)
+
+	assert.True(t, g.noTCPFallback)
+
+	resp, err := ru.Exchange((&dns.Msg{}).SetQuestion("example.org.", dns.TypeA))
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+
+	assert.True(t, resp.Truncated)
+}
@@ -0,0 +1,348 @@
+package dnsforward
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/stringutil"
+	"github.com/google/renameio/maybe"
+)
+
+// Limits of the upstream tests.
+const (
+	// maxUpstreamTests is the maximum number of the upstreams tested
+	// concurrently.
+	maxUpstreamTests = 16
+
+	// maxUpstreamTestCandidates is the maximum number of the upstreams in a
+	// single bulk test request.
+	maxUpstreamTestCandidates = 1000
+)
+
+// upstreamTestOK is the result of a successful upstream test.
+const upstreamTestOK = "OK"
+
+// upstreamTestResult is the result of testing a single upstream.
+type upstreamTestResult struct {
+	// Upstream is the tested upstream as specified in the request.
+	Upstream string `json:"upstream"`
+
+	// Result is upstreamTestOK or the description of the error.
+	Result string `json:"result"`
+
+	// Elapsed is the duration of the test in milliseconds.
+	Elapsed float64 `json:"elapsed_ms"`
+
+	// Private is true if the upstream has been tested as a resolver for the
+	// private addresses.
+	Private bool `json:"private,omitempty"`
+}
+
+// upstreamTestReport is the report of the latest bulk upstream test.
+type upstreamTestReport struct {
+	// Time is the time when the test has been finished.
+	Time time.Time `json:"time"`
+
+	Results []*upstreamTestResult `json:"results"`
+
+	// Canceled is true if the test has been interrupted before all the
+	// upstreams have been tested.
+	Canceled bool `json:"canceled"`
+}
+
+// upstreamTest is a single test of an upstream.
+type upstreamTest struct {
+	ef      excFunc
+	host    string
+	private bool
+}
+
+// newUpstreamTests returns the tests of the upstreams from req.  The comments
+// and the duplicates are skipped.
+func newUpstreamTests(req *upstreamJSON) (tests []*upstreamTest) {
+	add := func(hosts []string, ef excFunc, private bool) {
+		set := stringutil.NewSet()
+		for _, h := range hosts {
+			if IsCommentOrEmpty(h) || set.Has(h) {
+				continue
+			}
+
+			set.Add(h)
+			tests = append(tests, &upstreamTest{
+				ef:      ef,
+				host:    h,
+				private: private,
+			})
+		}
+	}
+
+	add(req.Upstreams, checkDNSUpstreamExc, false)
+	add(req.PrivateUpstreams, checkPrivateUpstreamExc, true)
+
+	return tests
+}
+
+// runUpstreamTests runs tests concurrently, at most maxUpstreamTests at a
+// time, and calls onResult with the result of each one as soon as it's
+// finished.  onResult is never called concurrently.  The tests, which haven't
+// been started yet when ctx is canceled, are skipped.
+func (s *Server) runUpstreamTests(
+	ctx context.Context,
+	tests []*upstreamTest,
+	bootstraps []string,
+	onResult func(res *upstreamTestResult),
+) (err error) {
+	timeout := s.conf.UpstreamTimeout
+
+	// withTLS makes the check use the TLS configuration of the upstream, if
+	// there is one.
+	withTLS := func(ef excFunc) (wrapped excFunc) {
+		return func(u upstream.Upstream) (err error) {
+			u, err = s.withUpstreamTLS(u, bootstraps, timeout)
+			if err != nil {
+				return err
+			}
+
+			return ef(u)
+		}
+	}
+
+	resMu := &sync.Mutex{}
+	sem := make(chan struct{}, maxUpstreamTests)
+	wg := &sync.WaitGroup{}
+
+	for _, t := range tests {
+		select {
+		case sem <- struct{}{}:
+			// Go on.
+		case <-ctx.Done():
+			wg.Wait()
+
+			return ctx.Err()
+		}
+
+		wg.Add(1)
+		go func(t *upstreamTest) {
+			defer log.OnPanic("dns: upstream test")
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			start := time.Now()
+			res := &upstreamTestResult{
+				Upstream: t.host,
+				Result:   upstreamTestOK,
+				Private:  t.private,
+			}
+
+			testErr := checkDNS(t.host, bootstraps, timeout, withTLS(t.ef))
+			if testErr != nil {
+				log.Info("%v", testErr)
+				res.Result = testErr.Error()
+			}
+
+			res.Elapsed = float64(time.Since(start)) / float64(time.Millisecond)
+
+			resMu.Lock()
+			defer resMu.Unlock()
+
+			onResult(res)
+		}(t)
+	}
+
+	wg.Wait()
+
+	return nil
+}
+
+func (s *Server) handleTestUpstreamDNS(w http.ResponseWriter, r *http.Request) {
+	req := &upstreamJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "Failed to read request body: %s", err)
+
+		return
+	}
+
+	result := map[string]string{}
+	var private []*upstreamTestResult
+	_ = s.runUpstreamTests(r.Context(), newUpstreamTests(req), req.BootstrapDNS, func(res *upstreamTestResult) {
+		if res.Private {
+			private = append(private, res)
+		} else {
+			result[res.Upstream] = res.Result
+		}
+	})
+
+	// TODO(e.burkov): If passed upstream have already written an error above,
+	// we rewriting the error for it.  These cases should be handled properly
+	// instead.
+	for _, res := range private {
+		result[res.Upstream] = res.Result
+	}
+
+	jsonVal, err := json.Marshal(result)
+	if err != nil {
+		aghhttp.Error(
+			r,
+			w,
+			http.StatusInternalServerError,
+			"Unable to marshal status json: %s",
+			err,
+		)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(jsonVal)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "Couldn't write body: %s", err)
+	}
+}
+
+// handleTestUpstreamDNSBulk is the handler for the POST
+// /control/test_upstream_dns/bulk HTTP API.  It streams the results as
+// newline-delimited JSON objects in the order, in which the tests finish, and
+// saves the report.
+func (s *Server) handleTestUpstreamDNSBulk(w http.ResponseWriter, r *http.Request) {
+	req := &upstreamJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "Failed to read request body: %s", err)
+
+		return
+	}
+
+	tests := newUpstreamTests(req)
+	if len(tests) > maxUpstreamTestCandidates {
+		aghhttp.Error(
+			r,
+			w,
+			http.StatusBadRequest,
+			"too many upstreams: %d, max %d",
+			len(tests),
+			maxUpstreamTestCandidates,
+		)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	f, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	report := &upstreamTestReport{
+		Results: make([]*upstreamTestResult, 0, len(tests)),
+	}
+
+	err = s.runUpstreamTests(r.Context(), tests, req.BootstrapDNS, func(res *upstreamTestResult) {
+		report.Results = append(report.Results, res)
+
+		if encErr := enc.Encode(res); encErr != nil {
+			log.Debug("dns: writing upstream test result: %s", encErr)
+
+			return
+		}
+
+		if f != nil {
+			f.Flush()
+		}
+	})
+
+	report.Time, report.Canceled = time.Now(), err != nil
+	log.Info(
+		"dns: tested %d of %d upstreams, canceled: %t",
+		len(report.Results),
+		len(tests),
+		report.Canceled,
+	)
+
+	err = s.saveUpstreamTestReport(report)
+	if err != nil {
+		log.Error("dns: saving upstream test report: %s", err)
+	}
+}
+
+// saveUpstreamTestReport keeps report as the latest one and writes it to the
+// report file, if it's set.
+func (s *Server) saveUpstreamTestReport(report *upstreamTestReport) (err error) {
+	s.upstreamTestMu.Lock()
+	defer s.upstreamTestMu.Unlock()
+
+	s.upstreamTestReport = report
+
+	path := s.conf.UpstreamTestReportFile
+	if path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("encoding: %w", err)
+	}
+
+	return maybe.WriteFile(path, data, 0o644)
+}
+
+// loadUpstreamTestReport returns the latest upstream test report.  It reads
+// the report file if there is no report since the start.  report is nil if
+// there is no report at all.
+func (s *Server) loadUpstreamTestReport() (report *upstreamTestReport, err error) {
+	s.upstreamTestMu.Lock()
+	defer s.upstreamTestMu.Unlock()
+
+	path := s.conf.UpstreamTestReportFile
+	if s.upstreamTestReport != nil || path == "" {
+		return s.upstreamTestReport, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	report = &upstreamTestReport{}
+	err = json.Unmarshal(data, report)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %q: %w", path, err)
+	}
+
+	s.upstreamTestReport = report
+
+	return report, nil
+}
+
+// handleUpstreamTestReport is the handler for the GET
+// /control/test_upstream_dns/report HTTP API.
+func (s *Server) handleUpstreamTestReport(w http.ResponseWriter, r *http.Request) {
+	report, err := s.loadUpstreamTestReport()
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "loading report: %s", err)
+
+		return
+	}
+
+	if report == nil {
+		aghhttp.Error(r, w, http.StatusNotFound, "no upstream test report")
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(report)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+	}
+}
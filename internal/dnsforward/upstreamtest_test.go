@@ -0,0 +1,143 @@
+package dnsforward
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startTestUpstream starts a plain DNS server, which passes the upstream tests,
+// and returns its address.
+func startTestUpstream(t *testing.T) (addr string) {
+	t.Helper()
+
+	h := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := (&dns.Msg{}).SetReply(r)
+		if q := r.Question[0]; q.Qtype == dns.TypeA {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET},
+				A:   net.IP{8, 8, 8, 8},
+			})
+		}
+
+		_ = w.WriteMsg(resp)
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	started := &sync.WaitGroup{}
+	started.Add(1)
+	srv := &dns.Server{
+		PacketConn:        pc,
+		Handler:           h,
+		NotifyStartedFunc: started.Done,
+	}
+
+	go func() { _ = srv.ActivateAndServe() }()
+	started.Wait()
+	testutil.CleanupAndRequireSuccess(t, srv.Shutdown)
+
+	return pc.LocalAddr().String()
+}
+
+func TestServer_handleTestUpstreamDNSBulk(t *testing.T) {
+	good := startTestUpstream(t)
+
+	// Nothing listens on the port, so the test fails immediately.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	bad := pc.LocalAddr().String()
+	require.NoError(t, pc.Close())
+
+	reportFile := filepath.Join(t.TempDir(), "upstream_test.json")
+	s := &Server{
+		conf: ServerConfig{
+			UpstreamTimeout:        time.Second,
+			UpstreamTestReportFile: reportFile,
+		},
+	}
+
+	body, err := json.Marshal(&upstreamJSON{
+		Upstreams:        []string{good, "# comment", bad, good, ""},
+		PrivateUpstreams: []string{good},
+	})
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodPost, "/control/test_upstream_dns/bulk", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	s.handleTestUpstreamDNSBulk(w, r)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+
+	got := map[string]*upstreamTestResult{}
+	sc := bufio.NewScanner(w.Body)
+	for sc.Scan() {
+		res := &upstreamTestResult{}
+		err = json.Unmarshal(sc.Bytes(), res)
+		require.NoError(t, err)
+
+		key := res.Upstream
+		if res.Private {
+			key = "private:" + key
+		}
+
+		got[key] = res
+	}
+	require.NoError(t, sc.Err())
+	require.Len(t, got, 3)
+
+	assert.Equal(t, upstreamTestOK, got[good].Result)
+	assert.Equal(t, upstreamTestOK, got["private:"+good].Result)
+	assert.NotEqual(t, upstreamTestOK, got[bad].Result)
+
+	// A new server loads the report from the file.
+	s = &Server{conf: ServerConfig{UpstreamTestReportFile: reportFile}}
+	report, err := s.loadUpstreamTestReport()
+	require.NoError(t, err)
+	require.NotNil(t, report)
+
+	assert.Len(t, report.Results, 3)
+	assert.False(t, report.Canceled)
+	assert.False(t, report.Time.IsZero())
+
+	t.Run("too_many", func(t *testing.T) {
+		ups := make([]string, maxUpstreamTestCandidates+1)
+		for i := range ups {
+			ups[i] = fmt.Sprintf("192.0.2.1:%d", 1000+i)
+		}
+
+		body, err = json.Marshal(&upstreamJSON{Upstreams: ups})
+		require.NoError(t, err)
+
+		r = httptest.NewRequest(http.MethodPost, "/control/test_upstream_dns/bulk", bytes.NewReader(body))
+		w = httptest.NewRecorder()
+		s.handleTestUpstreamDNSBulk(w, r)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("no_report", func(t *testing.T) {
+		s = &Server{conf: ServerConfig{UpstreamTestReportFile: filepath.Join(t.TempDir(), "none.json")}}
+
+		w = httptest.NewRecorder()
+		s.handleUpstreamTestReport(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
@@ -0,0 +1,601 @@
+package dnsforward
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/netip"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// UpstreamTLSConfig is the TLS configuration of a single DNS-over-TLS or
+// DNS-over-HTTPS upstream, for example one using a certificate issued by a
+// private CA.
+type UpstreamTLSConfig struct {
+	// Upstream is the address of the upstream the way it's specified in the
+	// upstream servers, for example "tls://dns.corp.example".
+	Upstream string `yaml:"upstream"`
+
+	// MinVersion is the minimum TLS version, either "1.2" or "1.3".  If it's
+	// empty, TLS 1.2 is used.
+	MinVersion string `yaml:"min_version"`
+
+	// RootCAPath is the path to the PEM-encoded certificates of the root CAs
+	// used to verify the upstream instead of the system ones.
+	RootCAPath string `yaml:"root_ca_path"`
+
+	// CipherSuites are the names of the allowed TLS 1.2 cipher suites as
+	// defined in package crypto/tls, for example
+	// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256".  If empty, the default ones are
+	// used.  TLS 1.3 cipher suites aren't configurable.
+	CipherSuites []string `yaml:"cipher_suites"`
+
+	// SPKIPins are the base64-encoded SHA-256 hashes of the DER-encoded
+	// SubjectPublicKeyInfo.  If not empty, at least one certificate of the
+	// verified chain must match one of them.
+	SPKIPins []string `yaml:"spki_pins"`
+}
+
+// tlsVersions are the supported values of UpstreamTLSConfig.MinVersion.
+var tlsVersions = map[string]uint16{
+	"":    tls.VersionTLS12,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// errSPKIMismatch is returned when no certificate of the upstream matches the
+// SPKI pins.
+const errSPKIMismatch errors.Error = "no certificate matches the spki pins"
+
+// tlsConfig returns the client TLS configuration for c.  roots are used if c
+// has no root CAs of its own.
+func (c *UpstreamTLSConfig) tlsConfig(roots *x509.CertPool) (conf *tls.Config, err error) {
+	minVer, ok := tlsVersions[c.MinVersion]
+	if !ok {
+		return nil, fmt.Errorf("bad min version %q", c.MinVersion)
+	}
+
+	conf = &tls.Config{
+		MinVersion: minVer,
+		RootCAs:    roots,
+	}
+
+	if len(c.CipherSuites) > 0 {
+		ids := make(map[string]uint16)
+		for _, cs := range tls.CipherSuites() {
+			ids[cs.Name] = cs.ID
+		}
+
+		for _, name := range c.CipherSuites {
+			id, known := ids[name]
+			if !known {
+				return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+			}
+
+			conf.CipherSuites = append(conf.CipherSuites, id)
+		}
+	}
+
+	if c.RootCAPath != "" {
+		var data []byte
+		data, err = os.ReadFile(c.RootCAPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading root cas: %w", err)
+		}
+
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in %s", c.RootCAPath)
+		}
+	}
+
+	if len(c.SPKIPins) > 0 {
+		pins := make([][]byte, 0, len(c.SPKIPins))
+		for _, p := range c.SPKIPins {
+			var pin []byte
+			pin, err = base64.StdEncoding.DecodeString(p)
+			if err != nil || len(pin) != sha256.Size {
+				return nil, fmt.Errorf("bad spki pin %q", p)
+			}
+
+			pins = append(pins, pin)
+		}
+
+		conf.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) (err error) {
+			return verifySPKIPins(pins, chains)
+		}
+	}
+
+	return conf, nil
+}
+
+// verifySPKIPins returns nil if a certificate of chains matches any of pins.
+func verifySPKIPins(pins [][]byte, chains [][]*x509.Certificate) (err error) {
+	for _, chain := range chains {
+		for _, cert := range chain {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if bytes.Equal(sum[:], pin) {
+					return nil
+				}
+			}
+		}
+	}
+
+	return errSPKIMismatch
+}
+
+// tlsUpstream is a DNS-over-TLS or DNS-over-HTTPS upstream with its own TLS
+// configuration, since dnsproxy only allows to configure TLS globally.
+type tlsUpstream struct {
+	// addr is the address of the upstream as returned by the dnsproxy one.
+	addr string
+
+	// url is the parsed address of the upstream.
+	url *url.URL
+
+	// resolvers resolve the hostname of the upstream.
+	resolvers []upstream.Resolver
+
+	// hints are the addresses of the upstream used instead of resolving its
+	// hostname, if any.
+	hints []net.IPAddr
+
+	// conf is the TLS configuration.
+	conf *tls.Config
+
+	// client is the HTTP client for DNS-over-HTTPS.
+	client *http.Client
+
+	// mu protects idle.
+	mu *sync.Mutex
+
+	// idle are the idle DNS-over-TLS connections, the most recently used one
+	// last.
+	idle []pooledConn
+
+	// pool are the statistics of the connection pool.
+	pool *poolCounters
+
+	// bind is the binding of the upstream to a local interface or a source
+	// address.  It's nil if the upstream isn't bound.
+	bind *upstreamBind
+
+	// proxy is the proxy the connections to the upstream are tunneled
+	// through.  It's nil if the upstream is connected to directly.
+	proxy *upstreamProxy
+
+	// timeout is the timeout of the exchange.
+	timeout time.Duration
+
+	// idleTimeout is the time after which an idle connection is closed.
+	idleTimeout time.Duration
+
+	// keepAlive is the interval between the TCP keepalive probes.  See
+	// UpstreamPoolConfig.KeepAlive.
+	keepAlive time.Duration
+
+	// maxIdle is the maximum number of the idle connections.
+	maxIdle int
+}
+
+// type check
+var _ upstream.Upstream = (*tlsUpstream)(nil)
+
+// newTLSUpstream returns a new upstream for c.
+func newTLSUpstream(
+	c *UpstreamTLSConfig,
+	bootstrap []string,
+	timeout time.Duration,
+	roots *x509.CertPool,
+) (u *tlsUpstream, err error) {
+	// Create the dnsproxy upstream to validate the address and to get the same
+	// address as the parsed upstream servers have.
+	pu, err := upstream.AddressToUpstream(c.Upstream, &upstream.Options{Timeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+
+	u = &tlsUpstream{
+		addr:        pu.Address(),
+		mu:          &sync.Mutex{},
+		pool:        &poolCounters{},
+		timeout:     timeout,
+		idleTimeout: defaultPoolIdleTimeout,
+		maxIdle:     defaultPoolMaxIdleTLS,
+	}
+
+	u.url, err = url.Parse(u.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	u.conf, err = c.tlsConfig(roots)
+	if err != nil {
+		return nil, err
+	}
+
+	u.conf.ServerName = u.url.Hostname()
+
+	switch u.url.Scheme {
+	case "tls":
+		// Go on.
+	case "https":
+		u.maxIdle = defaultPoolMaxIdleHTTPS
+		u.client = &http.Client{
+			Transport: &http.Transport{
+				DialContext:         u.dial,
+				TLSClientConfig:     u.conf,
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: u.maxIdle,
+				IdleConnTimeout:     u.idleTimeout,
+			},
+			Timeout: timeout,
+		}
+	default:
+		return nil, fmt.Errorf("%s: only tls and https upstreams are supported", u.addr)
+	}
+
+	u.resolvers, err = newBootstrapResolvers(bootstrap, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// newBootstrapResolvers returns the resolvers for the hostnames of the
+// upstreams from the bootstrap addresses.  The system resolver is used if
+// bootstrap is empty.
+func newBootstrapResolvers(
+	bootstrap []string,
+	timeout time.Duration,
+) (resolvers []upstream.Resolver, err error) {
+	for _, b := range bootstrap {
+		var r upstream.Resolver
+		r, err = upstream.NewUpstreamResolver(b, &upstream.Options{Timeout: timeout})
+		if err != nil {
+			return nil, fmt.Errorf("bootstrap %q: %w", b, err)
+		}
+
+		resolvers = append(resolvers, r)
+	}
+
+	if len(resolvers) == 0 {
+		resolvers = []upstream.Resolver{net.DefaultResolver}
+	}
+
+	return resolvers, nil
+}
+
+// Address implements the upstream.Upstream interface for *tlsUpstream.
+func (u *tlsUpstream) Address() (addr string) {
+	return u.addr
+}
+
+// Close implements the upstream.Upstream interface for *tlsUpstream.  It
+// closes the idle connections.
+func (u *tlsUpstream) Close() (err error) {
+	if u.client != nil {
+		u.client.CloseIdleConnections()
+
+		return nil
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var errs []error
+	for _, pc := range u.idle {
+		errs = append(errs, pc.conn.Close())
+	}
+	u.idle = nil
+
+	return errors.Join(errs...)
+}
+
+// Exchange implements the upstream.Upstream interface for *tlsUpstream.
+func (u *tlsUpstream) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
+	if u.client != nil {
+		return u.exchangeHTTPS(m)
+	}
+
+	return u.exchangeTLS(m)
+}
+
+// dial connects to the upstream and counts the connection attempt.
+func (u *tlsUpstream) dial(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	conn, err = u.dialUpstream(ctx, network, addr)
+	if err != nil {
+		atomic.AddUint64(&u.pool.dialErrors, 1)
+
+		return nil, err
+	}
+
+	atomic.AddUint64(&u.pool.dials, 1)
+
+	return conn, nil
+}
+
+// dialUpstream connects to the upstream resolving its hostname with the
+// bootstrap resolvers or through the proxy, if there is one.
+func (u *tlsUpstream) dialUpstream(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	if u.proxy != nil {
+		return u.proxy.dial(ctx, network, addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	dial := func(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+		var d *net.Dialer
+		d, err = u.bind.dialer(network, addr, u.timeout)
+		if err != nil {
+			return nil, fmt.Errorf("binding to %s: %w", u.bind, err)
+		}
+
+		d.KeepAlive = u.keepAlive
+
+		return d.DialContext(ctx, network, addr)
+	}
+
+	if net.ParseIP(host) != nil {
+		return dial(ctx, network, addr)
+	}
+
+	ips := u.hints
+	for _, r := range u.resolvers {
+		if len(ips) > 0 {
+			break
+		}
+
+		var addrs []netip.Addr
+		addrs, err = r.LookupNetIP(ctx, "ip", host)
+		for _, a := range addrs {
+			ips = append(ips, net.IPAddr{IP: a.AsSlice(), Zone: a.Zone()})
+		}
+	}
+
+	if len(ips) == 0 {
+		if err == nil {
+			err = errors.Error("no addresses")
+		}
+
+		return nil, fmt.Errorf("resolving %s: %w", host, err)
+	}
+
+	conn, err = dialHappyEyeballs(ctx, dial, network, ips, port)
+	if err != nil {
+		return nil, fmt.Errorf("dialing %s: %w", addr, err)
+	}
+
+	return conn, nil
+}
+
+// exchangeTLS sends m over DNS-over-TLS reusing an idle connection, if any.
+func (u *tlsUpstream) exchangeTLS(m *dns.Msg) (resp *dns.Msg, err error) {
+	conn := u.getIdle(time.Now())
+	if conn != nil {
+		resp, err = u.exchangeConn(conn, m)
+		if err == nil {
+			atomic.AddUint64(&u.pool.reused, 1)
+
+			return resp, nil
+		}
+
+		// The server has most probably closed the idle connection, so try a
+		// new one.
+		log.Debug("dnsforward: %s: reusing connection: %s", u.addr, err)
+	}
+
+	addr := u.url.Host
+	if u.url.Port() == "" {
+		addr = net.JoinHostPort(u.url.Hostname(), "853")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), u.timeout)
+	defer cancel()
+
+	rawConn, err := u.dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Client(rawConn, u.conf)
+	err = tlsConn.SetDeadline(time.Now().Add(u.timeout))
+	if err == nil {
+		err = tlsConn.Handshake()
+	}
+
+	if err != nil {
+		return nil, errors.WithDeferred(fmt.Errorf("tls handshake: %w", err), rawConn.Close())
+	}
+
+	return u.exchangeConn(&dns.Conn{Conn: tlsConn}, m)
+}
+
+// exchangeConn sends m over conn and keeps conn as an idle one if it succeeds
+// and the pool isn't full.  conn is closed otherwise.
+func (u *tlsUpstream) exchangeConn(conn *dns.Conn, m *dns.Msg) (resp *dns.Msg, err error) {
+	defer func() {
+		if err != nil {
+			err = errors.WithDeferred(err, conn.Close())
+
+			return
+		}
+
+		err = u.putIdle(conn, time.Now())
+	}()
+
+	err = conn.SetDeadline(time.Now().Add(u.timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.WriteMsg(m)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err = conn.ReadMsg()
+	if err != nil {
+		return nil, err
+	} else if resp.Id != m.Id {
+		return nil, dns.ErrId
+	}
+
+	return resp, nil
+}
+
+// exchangeHTTPS sends m over DNS-over-HTTPS.
+func (u *tlsUpstream) exchangeHTTPS(m *dns.Msg) (resp *dns.Msg, err error) {
+	buf, err := m.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing message: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, u.addr, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddUint64(&u.pool.reused, 1)
+			}
+		},
+	}))
+
+	hresp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = errors.WithDeferred(err, hresp.Body.Close()) }()
+
+	if hresp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: unexpected status code %d", u.addr, hresp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(hresp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+
+	resp = &dns.Msg{}
+	err = resp.Unpack(body)
+	if err != nil {
+		return nil, fmt.Errorf("unpacking response: %w", err)
+	} else if resp.Id != m.Id {
+		return nil, dns.ErrId
+	}
+
+	return resp, nil
+}
+
+// withUpstreamTLS returns the upstream with the TLS configuration for the
+// address of u, if there is one, and u otherwise.
+func (s *Server) withUpstreamTLS(
+	u upstream.Upstream,
+	bootstrap []string,
+	timeout time.Duration,
+) (res upstream.Upstream, err error) {
+	for _, c := range s.conf.UpstreamTLS {
+		var tu *tlsUpstream
+		tu, err = newTLSUpstream(c, bootstrap, timeout, s.conf.TLSv12Roots)
+		if err != nil {
+			return nil, fmt.Errorf("upstream tls for %q: %w", c.Upstream, err)
+		}
+
+		if tu.Address() == u.Address() {
+			return tu, nil
+		}
+	}
+
+	return u, nil
+}
+
+// applyUpstreamTLS replaces the upstreams of conf having their own TLS
+// configuration.  If s.conf.UpstreamHappyEyeballs is true, it also replaces the
+// other DNS-over-TLS and DNS-over-HTTPS upstreams specified by hostnames, so
+// that their connections are raced across the address families.  If the
+// connection pool is tuned, it replaces all such upstreams, so that the pool
+// settings apply to them.
+func (s *Server) applyUpstreamTLS(conf *proxy.UpstreamConfig) (err error) {
+	pooled := s.conf.UpstreamPool.tuned()
+	if len(s.conf.UpstreamTLS) == 0 && !s.conf.UpstreamHappyEyeballs && !pooled {
+		return nil
+	}
+
+	byAddr := make(map[string]*tlsUpstream, len(s.conf.UpstreamTLS))
+	for _, c := range s.conf.UpstreamTLS {
+		var u *tlsUpstream
+		u, err = s.newPooledTLSUpstream(c)
+		if err != nil {
+			return fmt.Errorf("upstream tls for %q: %w", c.Upstream, err)
+		}
+
+		byAddr[u.Address()] = u
+	}
+
+	replace := func(ups []upstream.Upstream) (rErr error) {
+		for i, u := range ups {
+			addr := u.Address()
+			_, ok := byAddr[addr]
+			if !ok && ((s.conf.UpstreamHappyEyeballs && isHostnameTLSUpstream(addr)) ||
+				(pooled && isTLSUpstreamAddr(addr))) {
+				var tu *tlsUpstream
+				tu, rErr = s.newPooledTLSUpstream(&UpstreamTLSConfig{Upstream: addr})
+				if rErr != nil {
+					return fmt.Errorf("upstream %q: %w", addr, rErr)
+				}
+
+				byAddr[addr] = tu
+			}
+
+			if tu, ok := byAddr[addr]; ok {
+				s.trackTLSUpstream(tu)
+				ups[i] = tu
+			}
+		}
+
+		return nil
+	}
+
+	err = replace(conf.Upstreams)
+	if err != nil {
+		return err
+	}
+
+	for _, ups := range conf.DomainReservedUpstreams {
+		err = replace(ups)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
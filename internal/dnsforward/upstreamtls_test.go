@@ -0,0 +1,201 @@
+package dnsforward
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testDoHHandler answers the DNS-over-HTTPS requests with an A record.
+func testDoHHandler(t *testing.T) (h http.HandlerFunc) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		req := &dns.Msg{}
+		require.NoError(t, req.Unpack(body))
+
+		resp := (&dns.Msg{}).SetReply(req)
+		resp.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET},
+			A:   net.IP{1, 2, 3, 4},
+		}}
+
+		data, err := resp.Pack()
+		require.NoError(t, err)
+
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(data)
+	}
+}
+
+func TestTLSUpstream(t *testing.T) {
+	srv := httptest.NewUnstartedServer(testDoHHandler(t))
+	srv.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	cert := srv.Certificate()
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o600)
+	require.NoError(t, err)
+
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(spki[:])
+	otherPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	addr := srv.URL + "/dns-query"
+
+	testCases := []struct {
+		conf       *UpstreamTLSConfig
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       &UpstreamTLSConfig{Upstream: addr, RootCAPath: caPath},
+		name:       "root_ca",
+		wantErrMsg: "",
+	}, {
+		conf: &UpstreamTLSConfig{
+			Upstream:     addr,
+			RootCAPath:   caPath,
+			SPKIPins:     []string{otherPin, pin},
+			CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+		},
+		name:       "pins_and_ciphers",
+		wantErrMsg: "",
+	}, {
+		conf:       &UpstreamTLSConfig{Upstream: addr},
+		name:       "unknown_ca",
+		wantErrMsg: "x509: certificate signed by unknown authority",
+	}, {
+		conf:       &UpstreamTLSConfig{Upstream: addr, RootCAPath: caPath, SPKIPins: []string{otherPin}},
+		name:       "pin_mismatch",
+		wantErrMsg: errSPKIMismatch.Error(),
+	}, {
+		conf:       &UpstreamTLSConfig{Upstream: addr, RootCAPath: caPath, MinVersion: "1.3"},
+		name:       "min_version",
+		wantErrMsg: "tls: protocol version not supported",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, uerr := newTLSUpstream(tc.conf, nil, time.Second, nil)
+			require.NoError(t, uerr)
+
+			resp, uerr := u.Exchange((&dns.Msg{}).SetQuestion("example.org.", dns.TypeA))
+			if tc.wantErrMsg != "" {
+				require.Error(t, uerr)
+
+				assert.Contains(t, uerr.Error(), tc.wantErrMsg)
+
+				return
+			}
+
+			require.NoError(t, uerr)
+			require.Len(t, resp.Answer, 1)
+
+			assert.Equal(t, net.IP{1, 2, 3, 4}, resp.Answer[0].(*dns.A).A.To4())
+		})
+	}
+
+	t.Run("dot", func(t *testing.T) {
+		l, lerr := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+			Certificates: srv.TLS.Certificates,
+		})
+		require.NoError(t, lerr)
+
+		dotSrv := &dns.Server{
+			Listener: l,
+			Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+				_ = w.WriteMsg((&dns.Msg{}).SetReply(req))
+			}),
+		}
+		go func() { _ = dotSrv.ActivateAndServe() }()
+		t.Cleanup(func() { _ = dotSrv.Shutdown() })
+
+		u, uerr := newTLSUpstream(&UpstreamTLSConfig{
+			Upstream:   "tls://" + l.Addr().String(),
+			RootCAPath: caPath,
+			MinVersion: "1.3",
+		}, nil, time.Second, nil)
+		require.NoError(t, uerr)
+
+		// The second exchange reuses the connection.
+		for i := 0; i < 2; i++ {
+			_, uerr = u.Exchange((&dns.Msg{}).SetQuestion("example.org.", dns.TypeA))
+			require.NoError(t, uerr)
+		}
+	})
+
+	t.Run("apply", func(t *testing.T) {
+		s := &Server{
+			conf: ServerConfig{
+				FilteringConfig: FilteringConfig{
+					UpstreamTLS: []*UpstreamTLSConfig{{Upstream: addr, RootCAPath: caPath}},
+				},
+			},
+		}
+
+		conf, perr := proxy.ParseUpstreamsConfig([]string{addr, "[/example.org/]" + addr}, nil)
+		require.NoError(t, perr)
+
+		require.NoError(t, s.applyUpstreamTLS(conf))
+
+		assert.IsType(t, &tlsUpstream{}, conf.Upstreams[0])
+		assert.IsType(t, &tlsUpstream{}, conf.DomainReservedUpstreams["example.org."][0])
+
+		var u upstream.Upstream
+		u, perr = s.withUpstreamTLS(conf.Upstreams[0], nil, time.Second)
+		require.NoError(t, perr)
+
+		assert.IsType(t, &tlsUpstream{}, u)
+	})
+}
+
+func TestUpstreamTLSConfig_tlsConfig(t *testing.T) {
+	testCases := []struct {
+		conf       *UpstreamTLSConfig
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       &UpstreamTLSConfig{MinVersion: "1.1"},
+		name:       "bad_version",
+		wantErrMsg: `bad min version "1.1"`,
+	}, {
+		conf:       &UpstreamTLSConfig{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		name:       "insecure_cipher",
+		wantErrMsg: `unknown or insecure cipher suite "TLS_RSA_WITH_RC4_128_SHA"`,
+	}, {
+		conf:       &UpstreamTLSConfig{SPKIPins: []string{"AAAA"}},
+		name:       "short_pin",
+		wantErrMsg: `bad spki pin "AAAA"`,
+	}, {
+		conf:       &UpstreamTLSConfig{RootCAPath: "upstreamtls_test.go"},
+		name:       "no_certs",
+		wantErrMsg: "no certificates in upstreamtls_test.go",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.conf.tlsConfig(nil)
+			require.Error(t, err)
+
+			assert.Equal(t, tc.wantErrMsg, err.Error())
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// Forced upstream transports.  These are specified after the domains in the
+// upstream specification with the "@" prefix, for example:
+//
+//	[/example.org/]@tcp 192.0.2.1 192.0.2.2
+//	[/secret.example/]@tls #
+//
+// The addresses of the plain DNS upstreams are converted to use the forced
+// transport, and "#" stands for the default upstreams of the same list.
+const (
+	// ForcedTransportTCP makes the upstreams for the domains use TCP, or a
+	// protocol working over it.
+	ForcedTransportTCP = "tcp"
+
+	// ForcedTransportTLS makes the upstreams for the domains use
+	// DNS-over-TLS.
+	ForcedTransportTLS = "tls"
+)
+
+// forcedTransportPrefix is the prefix of the forced transport in the upstream
+// specification.
+const forcedTransportPrefix = "@"
+
+// ExpandForcedTransports returns the upstream specifications with the lines
+// forcing the transport for domains replaced with the ordinary ones, one per
+// upstream, understood by proxy.ParseUpstreamsConfig.  upstreams must not
+// contain comments.  The lines without the forced transport are kept as is.
+func ExpandForcedTransports(upstreams []string) (expanded []string, err error) {
+	var defaults []string
+	for _, u := range upstreams {
+		if !strings.HasPrefix(u, "[/") {
+			defaults = append(defaults, u)
+		}
+	}
+
+	expanded = make([]string, 0, len(upstreams))
+	for _, u := range upstreams {
+		var lines []string
+		lines, err = expandForcedTransport(u, defaults)
+		if err != nil {
+			return nil, fmt.Errorf("bad upstream for domain spec %q: %w", u, err)
+		}
+
+		expanded = append(expanded, lines...)
+	}
+
+	return expanded, nil
+}
+
+// expandForcedTransport returns the upstream specifications for the single
+// line u.  defaults are the default upstreams used in place of "#".
+func expandForcedTransport(u string, defaults []string) (lines []string, err error) {
+	if !strings.HasPrefix(u, "[/") {
+		return []string{u}, nil
+	}
+
+	i := strings.Index(u, "/]")
+	if i < 0 {
+		// Let the parser report it.
+		return []string{u}, nil
+	}
+
+	domains, spec := u[:i+len("/]")], u[i+len("/]"):]
+	if !strings.HasPrefix(spec, forcedTransportPrefix) {
+		return []string{u}, nil
+	}
+
+	fields := strings.Fields(spec)
+	transport := strings.TrimPrefix(fields[0], forcedTransportPrefix)
+	if transport != ForcedTransportTCP && transport != ForcedTransportTLS {
+		return nil, fmt.Errorf("unknown transport %q", transport)
+	}
+
+	addrs := fields[1:]
+	if len(addrs) == 0 {
+		return nil, errors.Error("no upstreams")
+	}
+
+	for _, addr := range addrs {
+		if addr != "#" {
+			lines, err = appendForced(lines, domains, addr, transport)
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		if len(defaults) == 0 {
+			return nil, errors.Error("no default upstreams to force transport on")
+		}
+
+		for _, d := range defaults {
+			lines, err = appendForced(lines, domains, d, transport)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return lines, nil
+}
+
+// appendForced appends the specification of the upstream with address addr
+// for domains converted to use transport to lines.
+func appendForced(lines []string, domains, addr, transport string) (res []string, err error) {
+	forced, err := forceTransport(addr, transport)
+	if err != nil {
+		return lines, fmt.Errorf("upstream %q: %w", addr, err)
+	}
+
+	return append(lines, domains+forced), nil
+}
+
+// forceTransport returns the address of the upstream addr converted to use
+// transport.  The plain DNS upstreams are converted, the ones already using a
+// suitable protocol are returned unchanged, and an error is returned for the
+// rest.  Since DNS-over-TLS has its own port, the port of the plain DNS
+// upstream is dropped when converting to it.
+func forceTransport(addr, transport string) (forced string, err error) {
+	host := addr
+	switch {
+	case strings.HasPrefix(addr, "tcp://"):
+		if transport == ForcedTransportTCP {
+			return addr, nil
+		}
+
+		host = strings.TrimPrefix(addr, "tcp://")
+	case strings.HasPrefix(addr, "udp://"):
+		host = strings.TrimPrefix(addr, "udp://")
+	case strings.HasPrefix(addr, "tls://"):
+		return addr, nil
+	case strings.HasPrefix(addr, "https://"):
+		if transport == ForcedTransportTCP {
+			return addr, nil
+		}
+
+		return "", fmt.Errorf("can't be forced to %s", transport)
+	case strings.Contains(addr, "://"):
+		return "", fmt.Errorf("can't be forced to %s", transport)
+	default:
+		// Go on.
+	}
+
+	if transport == ForcedTransportTLS {
+		if h, _, splitErr := net.SplitHostPort(host); splitErr == nil {
+			host = h
+		}
+	}
+
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		host = "[" + host + "]"
+	}
+
+	return transport + "://" + host, nil
+}
@@ -0,0 +1,97 @@
+package dnsforward
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandForcedTransports(t *testing.T) {
+	testCases := []struct {
+		name       string
+		upstreams  []string
+		want       []string
+		wantErrMsg string
+	}{{
+		name:       "unchanged",
+		upstreams:  []string{"1.1.1.1", "[/example.org/]192.0.2.1", "[/www.example.org/]#"},
+		want:       []string{"1.1.1.1", "[/example.org/]192.0.2.1", "[/www.example.org/]#"},
+		wantErrMsg: "",
+	}, {
+		name:      "tcp",
+		upstreams: []string{"[/example.org/]@tcp 192.0.2.1 udp://192.0.2.2:5353 tls://dns.example https://dns.example/dns-query"},
+		want: []string{
+			"[/example.org/]tcp://192.0.2.1",
+			"[/example.org/]tcp://192.0.2.2:5353",
+			"[/example.org/]tls://dns.example",
+			"[/example.org/]https://dns.example/dns-query",
+		},
+		wantErrMsg: "",
+	}, {
+		name:      "tls",
+		upstreams: []string{"[/a.example/b.example/]@tls 192.0.2.1:53 tcp://dns.example 2001:db8::1"},
+		want: []string{
+			"[/a.example/b.example/]tls://192.0.2.1",
+			"[/a.example/b.example/]tls://dns.example",
+			"[/a.example/b.example/]tls://[2001:db8::1]",
+		},
+		wantErrMsg: "",
+	}, {
+		name:      "default",
+		upstreams: []string{"1.1.1.1", "tls://8.8.8.8", "[/example.org/]@tls #"},
+		want: []string{
+			"1.1.1.1",
+			"tls://8.8.8.8",
+			"[/example.org/]tls://1.1.1.1",
+			"[/example.org/]tls://8.8.8.8",
+		},
+		wantErrMsg: "",
+	}, {
+		name:       "unknown_transport",
+		upstreams:  []string{"[/example.org/]@quic 192.0.2.1"},
+		want:       nil,
+		wantErrMsg: `bad upstream for domain spec "[/example.org/]@quic 192.0.2.1": unknown transport "quic"`,
+	}, {
+		name:       "no_upstreams",
+		upstreams:  []string{"[/example.org/]@tcp"},
+		want:       nil,
+		wantErrMsg: `bad upstream for domain spec "[/example.org/]@tcp": no upstreams`,
+	}, {
+		name:       "no_defaults",
+		upstreams:  []string{"[/example.org/]@tcp #"},
+		want:       nil,
+		wantErrMsg: `bad upstream for domain spec "[/example.org/]@tcp #": no default upstreams to force transport on`,
+	}, {
+		name:      "incompatible",
+		upstreams: []string{"[/example.org/]@tls https://dns.example/dns-query"},
+		want:      nil,
+		wantErrMsg: `bad upstream for domain spec "[/example.org/]@tls https://dns.example/dns-query": ` +
+			`upstream "https://dns.example/dns-query": can't be forced to tls`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ExpandForcedTransports(tc.upstreams)
+			if tc.wantErrMsg != "" {
+				require.Error(t, err)
+
+				assert.Equal(t, tc.wantErrMsg, err.Error())
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestValidateUpstreams_forcedTransport(t *testing.T) {
+	err := ValidateUpstreams([]string{"8.8.8.8", "[/example.org/]@tcp 192.0.2.1 #"})
+	assert.NoError(t, err)
+
+	err = ValidateUpstreams([]string{"8.8.8.8", "[/example.org/]@tls sdns://AQMAAAAAAAAAFDE3Ni4xMDMuMTMwLjEzMDo1NDQz"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,240 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/stringutil"
+)
+
+// View is a split-horizon view: a set of rewrites and local zones, which only
+// apply to the requests of the matching clients.  For example, it allows the
+// internal clients to resolve the names of the services to their LAN addresses
+// while the guests get the public ones.
+type View struct {
+	// Name is the name of the view used in the logs.
+	Name string `yaml:"name"`
+
+	// Clients are the IP addresses, CIDRs, ClientIDs, and names of the
+	// persistent clients, to which the view applies.  If empty, the view
+	// applies to all the clients connecting through Interfaces.
+	Clients []string `yaml:"clients"`
+
+	// Interfaces are the names of the network interfaces, on the addresses of
+	// which the requests must be received for the view to apply.  Note that
+	// the requests received on the unspecified addresses can't be matched.
+	// If empty, the interface isn't checked.
+	Interfaces []string `yaml:"interfaces"`
+
+	// Rewrites are the rewrites of the view, which take precedence over the
+	// global ones.
+	Rewrites []filtering.RewriteEntry `yaml:"rewrites"`
+
+	// LocalZones are the local zones of the view, which take precedence over
+	// the global ones.
+	LocalZones []*LocalZone `yaml:"local_zones"`
+}
+
+// cloneViews returns a deep copy of views.
+func cloneViews(views []*View) (clone []*View) {
+	if views == nil {
+		return nil
+	}
+
+	clone = make([]*View, len(views))
+	for i, v := range views {
+		clone[i] = &View{
+			Name:       v.Name,
+			Clients:    stringutil.CloneSlice(v.Clients),
+			Interfaces: stringutil.CloneSlice(v.Interfaces),
+			LocalZones: cloneLocalZones(v.LocalZones),
+		}
+
+		if v.Rewrites != nil {
+			clone[i].Rewrites = make([]filtering.RewriteEntry, len(v.Rewrites))
+			copy(clone[i].Rewrites, v.Rewrites)
+		}
+	}
+
+	return clone
+}
+
+// view is a compiled split-horizon view.
+type view struct {
+	// ids are the ClientIDs and the names of the persistent clients.
+	ids *stringutil.Set
+
+	// zones are the local zones of the view.
+	zones *localZones
+
+	// name is the name of the view.
+	name string
+
+	// nets are the networks of the clients.
+	nets []*net.IPNet
+
+	// ifaceIPs are the addresses of the interfaces.
+	ifaceIPs []net.IP
+
+	// rewrites are the normalized rewrites of the view.
+	rewrites []filtering.RewriteEntry
+}
+
+// newView compiles and validates c.
+func newView(c *View) (v *view, err error) {
+	if c.Name == "" {
+		return nil, errors.Error("no name")
+	} else if len(c.Clients) == 0 && len(c.Interfaces) == 0 {
+		return nil, errors.Error("no clients or interfaces")
+	}
+
+	v = &view{
+		ids:  stringutil.NewSet(),
+		name: c.Name,
+	}
+
+	for _, cli := range c.Clients {
+		if ip := net.ParseIP(cli); ip != nil {
+			v.nets = append(v.nets, netutil.SingleIPSubnet(ip))
+		} else if _, n, perr := net.ParseCIDR(cli); perr == nil {
+			v.nets = append(v.nets, n)
+		} else {
+			v.ids.Add(cli)
+		}
+	}
+
+	for _, name := range c.Interfaces {
+		var iface *net.Interface
+		iface, err = net.InterfaceByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("interface %q: %w", name, err)
+		}
+
+		var ips []net.IP
+		ips, err = aghnet.IfaceIPAddrs(iface, aghnet.IPVersion4)
+		if err != nil {
+			return nil, fmt.Errorf("interface %q: %w", name, err)
+		}
+
+		v.ifaceIPs = append(v.ifaceIPs, ips...)
+
+		ips, err = aghnet.IfaceIPAddrs(iface, aghnet.IPVersion6)
+		if err != nil {
+			return nil, fmt.Errorf("interface %q: %w", name, err)
+		}
+
+		v.ifaceIPs = append(v.ifaceIPs, ips...)
+	}
+
+	v.rewrites = make([]filtering.RewriteEntry, len(c.Rewrites))
+	copy(v.rewrites, c.Rewrites)
+	err = filtering.NormalizeRewrites(v.rewrites)
+	if err != nil {
+		return nil, err
+	}
+
+	v.zones, err = newLocalZones(c.LocalZones)
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// newViews compiles and validates confs.
+func newViews(confs []*View) (views []*view, err error) {
+	seen := stringutil.NewSet()
+	for i, c := range confs {
+		var v *view
+		v, err = newView(c)
+		if err != nil {
+			return nil, fmt.Errorf("view at index %d: %w", i, err)
+		} else if seen.Has(v.name) {
+			return nil, fmt.Errorf("view at index %d: duplicate name %q", i, c.Name)
+		}
+
+		seen.Add(v.name)
+		views = append(views, v)
+	}
+
+	return views, nil
+}
+
+// matches returns true if the client with ip, clientID, and the persistent
+// client name sends the request to localIP, which is within the view.  ip,
+// clientID, name, and localIP may be empty.
+func (v *view) matches(ip net.IP, clientID, name string, localIP net.IP) (ok bool) {
+	return v.matchesClient(ip, clientID, name) && v.matchesIface(localIP)
+}
+
+// matchesClient returns true if the client is within the view.
+func (v *view) matchesClient(ip net.IP, clientID, name string) (ok bool) {
+	if v.ids.Len() == 0 && len(v.nets) == 0 {
+		return true
+	}
+
+	if (clientID != "" && v.ids.Has(clientID)) || (name != "" && v.ids.Has(name)) {
+		return true
+	} else if ip == nil {
+		return false
+	}
+
+	for _, n := range v.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchesIface returns true if localIP is one of the addresses of the
+// interfaces of the view.
+func (v *view) matchesIface(localIP net.IP) (ok bool) {
+	if len(v.ifaceIPs) == 0 {
+		return true
+	} else if localIP == nil {
+		return false
+	}
+
+	for _, ip := range v.ifaceIPs {
+		if ip.Equal(localIP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// viewFor returns the first view matching the client of dctx.  v is nil if
+// there is none.  dctx.setts must be set.
+func (s *Server) viewFor(dctx *dnsContext) (v *view) {
+	s.serverLock.RLock()
+	views := s.views
+	s.serverLock.RUnlock()
+
+	if len(views) == 0 {
+		return nil
+	}
+
+	pctx := dctx.proxyCtx
+	ip, _ := netutil.IPAndPortFromAddr(pctx.Addr)
+	localIP := localIPFromDNSContext(pctx)
+
+	var name string
+	if dctx.setts != nil {
+		name = dctx.setts.ClientName
+	}
+
+	for _, v = range views {
+		if v.matches(ip, dctx.clientID, name, localIP) {
+			return v
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,194 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewViews(t *testing.T) {
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		confs      []*View
+	}{{
+		name:       "success",
+		wantErrMsg: "",
+		confs: []*View{{
+			Name:     "internal",
+			Clients:  []string{"192.168.1.0/24", "fd00::1", "laptop"},
+			Rewrites: []filtering.RewriteEntry{{Domain: "nas.example", Answer: "192.168.1.2"}},
+		}},
+	}, {
+		name:       "no_name",
+		wantErrMsg: "view at index 0: no name",
+		confs:      []*View{{Clients: []string{"laptop"}}},
+	}, {
+		name:       "no_clients",
+		wantErrMsg: "view at index 0: no clients or interfaces",
+		confs:      []*View{{Name: "internal"}},
+	}, {
+		name:       "duplicate",
+		wantErrMsg: `view at index 1: duplicate name "internal"`,
+		confs: []*View{{
+			Name:    "internal",
+			Clients: []string{"laptop"},
+		}, {
+			Name:    "internal",
+			Clients: []string{"phone"},
+		}},
+	}, {
+		name:       "bad_zone",
+		wantErrMsg: `view at index 0: local zone at index 0: bad zone name ""`,
+		confs: []*View{{
+			Name:       "internal",
+			Clients:    []string{"laptop"},
+			LocalZones: []*LocalZone{{}},
+		}},
+	}, {
+		name:       "bad_interface",
+		wantErrMsg: `view at index 0: interface "nonexistent0": route ip+net: no such network interface`,
+		confs: []*View{{
+			Name:       "internal",
+			Interfaces: []string{"nonexistent0"},
+		}},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newViews(tc.confs)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
+
+func TestView_matches(t *testing.T) {
+	v, err := newView(&View{
+		Name:    "internal",
+		Clients: []string{"192.168.1.0/24", "fd00::1", "laptop"},
+	})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name     string
+		ip       net.IP
+		clientID string
+		cliName  string
+		want     bool
+	}{{
+		name:     "subnet",
+		ip:       net.IP{192, 168, 1, 10},
+		clientID: "",
+		cliName:  "",
+		want:     true,
+	}, {
+		name:     "ip",
+		ip:       net.ParseIP("fd00::1"),
+		clientID: "",
+		cliName:  "",
+		want:     true,
+	}, {
+		name:     "client_id",
+		ip:       net.IP{1, 2, 3, 4},
+		clientID: "laptop",
+		cliName:  "",
+		want:     true,
+	}, {
+		name:     "client_name",
+		ip:       net.IP{1, 2, 3, 4},
+		clientID: "",
+		cliName:  "laptop",
+		want:     true,
+	}, {
+		name:     "guest",
+		ip:       net.IP{192, 168, 2, 10},
+		clientID: "phone",
+		cliName:  "",
+		want:     false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, v.matches(tc.ip, tc.clientID, tc.cliName, nil))
+		})
+	}
+
+	t.Run("interface", func(t *testing.T) {
+		iv := &view{
+			ids:      v.ids,
+			nets:     v.nets,
+			ifaceIPs: []net.IP{{192, 168, 1, 1}},
+		}
+
+		ip := net.IP{192, 168, 1, 10}
+		assert.True(t, iv.matches(ip, "", "", net.IP{192, 168, 1, 1}))
+		assert.False(t, iv.matches(ip, "", "", net.IP{10, 0, 0, 1}))
+		assert.False(t, iv.matches(ip, "", "", nil))
+	})
+}
+
+func TestServer_processLocalZones_view(t *testing.T) {
+	s := createTestServer(t, &filtering.Config{}, ServerConfig{
+		UDPListenAddrs: []*net.UDPAddr{{}},
+		TCPListenAddrs: []*net.TCPAddr{{}},
+		FilteringConfig: FilteringConfig{
+			LocalZones: []*LocalZone{{
+				Name:    "example",
+				Records: []string{"nas 300 IN A 203.0.113.2"},
+			}},
+			Views: []*View{{
+				Name:    "internal",
+				Clients: []string{"192.168.1.0/24"},
+				LocalZones: []*LocalZone{{
+					Name:    "example",
+					Records: []string{"nas 300 IN A 192.168.1.2"},
+				}},
+			}},
+		},
+	}, nil)
+
+	testCases := []struct {
+		name string
+		ip   net.IP
+		want net.IP
+	}{{
+		name: "internal",
+		ip:   net.IP{192, 168, 1, 10},
+		want: net.IP{192, 168, 1, 2},
+	}, {
+		name: "guest",
+		ip:   net.IP{192, 168, 2, 10},
+		want: net.IP{203, 0, 113, 2},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Req:  (&dns.Msg{}).SetQuestion("nas.example.", dns.TypeA),
+					Addr: &net.UDPAddr{IP: tc.ip, Port: 53},
+				},
+				setts: &filtering.Settings{},
+			}
+			dctx.view = s.viewFor(dctx)
+
+			rc := s.processLocalZones(dctx)
+			require.Equal(t, resultCodeSuccess, rc)
+
+			res := dctx.proxyCtx.Res
+			require.NotNil(t, res)
+			require.Len(t, res.Answer, 1)
+
+			a, ok := res.Answer[0].(*dns.A)
+			require.True(t, ok)
+
+			assert.Equal(t, tc.want, a.A.To4())
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package dnsforward
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// defaultBlockedCacheCount is the default count of items in the LRU cache of
+// the latest block decisions, one per client.
+const defaultBlockedCacheCount = 4096
+
+// maxTXTStringLen is the maximum length of a single character string within
+// a TXT record.
+const maxTXTStringLen = 255
+
+// blockedCacheKey returns the key of the latest block decision for the client
+// of dctx.  The client is identified by its ClientID, if any, or by its IP
+// address.
+func blockedCacheKey(dctx *dnsContext) (key []byte) {
+	if dctx.clientID != "" {
+		return []byte("id:" + dctx.clientID)
+	}
+
+	ip, _ := netutil.IPAndPortFromAddr(dctx.proxyCtx.Addr)
+	if ip == nil {
+		return nil
+	}
+
+	return []byte("ip:" + ip.String())
+}
+
+// isBlockDecision returns true if res is a decision to block the request, as
+// opposed to rewriting it or allowing it.
+func isBlockDecision(res *filtering.Result) (ok bool) {
+	if !res.IsFiltered {
+		return false
+	}
+
+	switch res.Reason {
+	case filtering.FilteredBlockList,
+		filtering.FilteredSafeBrowsing,
+		filtering.FilteredParental,
+		filtering.FilteredInvalid,
+		filtering.FilteredBlockedService,
+		filtering.FilteredQuarantine:
+		return true
+	default:
+		return false
+	}
+}
+
+// blockDecisionTXT returns the strings of the TXT record describing the
+// decision res to block host made at now.
+func blockDecisionTXT(host string, res *filtering.Result, now time.Time) (strs []string) {
+	strs = []string{
+		"domain=" + host,
+		"reason=" + res.Reason.String(),
+	}
+
+	if res.ServiceName != "" {
+		strs = append(strs, "service="+res.ServiceName)
+	}
+
+	for _, r := range res.Rules {
+		strs = append(strs, "rule="+r.Text, "filter_list_id="+strconv.FormatInt(r.FilterListID, 10))
+	}
+
+	strs = append(strs, "time="+now.UTC().Format(time.RFC3339))
+
+	for i, s := range strs {
+		if len(s) > maxTXTStringLen {
+			strs[i] = s[:maxTXTStringLen]
+		}
+	}
+
+	return strs
+}
+
+// processBlockAttribution answers the TXT requests for the block attribution
+// name with the latest block decision for the asking client.
+func (s *Server) processBlockAttribution(dctx *dnsContext) (rc resultCode) {
+	name := s.conf.BlockAttributionName
+	req := dctx.proxyCtx.Req
+	if name == "" || s.blocked == nil || !strings.EqualFold(req.Question[0].Name, dns.Fqdn(name)) {
+		return resultCodeSuccess
+	}
+
+	resp := s.makeResponse(req)
+	dctx.proxyCtx.Res = resp
+
+	if req.Question[0].Qtype != dns.TypeTXT {
+		// Respond with an empty answer so that the name isn't leaked to the
+		// upstreams.
+		//
+		// Do not even put into query log.
+		return resultCodeFinish
+	}
+
+	strs := []string{"none"}
+	if key := blockedCacheKey(dctx); key != nil {
+		if val := s.blocked.Get(key); val != nil {
+			strs = strings.Split(string(val), "\n")
+		}
+	}
+
+	ans := s.genAnswerTXT(req, strs)
+	// Never cache the answers, since they change with every blocked request.
+	ans.Hdr.Ttl = 0
+	resp.Answer = append(resp.Answer, ans)
+
+	log.Debug("dns: block attribution for %s: %q", dctx.proxyCtx.Addr, strs)
+
+	return resultCodeFinish
+}
+
+// processRecordBlocked remembers the decision to block the request as the
+// latest one for the client, if the block attribution is enabled.
+func (s *Server) processRecordBlocked(dctx *dnsContext) (rc resultCode) {
+	if s.conf.BlockAttributionName == "" || s.blocked == nil || !isBlockDecision(dctx.result) {
+		return resultCodeSuccess
+	}
+
+	key := blockedCacheKey(dctx)
+	if key == nil {
+		return resultCodeSuccess
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(dctx.proxyCtx.Req.Question[0].Name), ".")
+	strs := blockDecisionTXT(host, dctx.result, time.Now())
+	s.blocked.Set(key, []byte(strings.Join(strs, "\n")))
+
+	return resultCodeSuccess
+}
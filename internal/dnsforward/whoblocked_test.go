@@ -0,0 +1,170 @@
+package dnsforward
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/cache"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_processBlockAttribution(t *testing.T) {
+	const name = "whoblocked.example.adguard"
+
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				BlockAttributionName: name,
+				BlockedResponseTTL:   10,
+			},
+		},
+		blocked: cache.New(cache.Config{EnableLRU: true, MaxCount: 16}),
+	}
+
+	clientAddr := &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 12345}
+	otherAddr := &net.UDPAddr{IP: net.IP{192, 0, 2, 2}, Port: 12345}
+
+	newCtx := func(addr net.Addr, clientID, qname string, qtype uint16) (dctx *dnsContext) {
+		return &dnsContext{
+			proxyCtx: &proxy.DNSContext{
+				Req:  (&dns.Msg{}).SetQuestion(qname, qtype),
+				Addr: addr,
+			},
+			result:   &filtering.Result{},
+			clientID: clientID,
+		}
+	}
+
+	blocked := newCtx(clientAddr, "", "Ads.Example.", dns.TypeA)
+	blocked.result = &filtering.Result{
+		IsFiltered: true,
+		Reason:     filtering.FilteredBlockList,
+		Rules: []*filtering.ResultRule{{
+			Text:         "||ads.example^",
+			FilterListID: 1,
+		}},
+	}
+	require.Equal(t, resultCodeSuccess, s.processRecordBlocked(blocked))
+
+	rewritten := newCtx(clientAddr, "", "rewritten.example.", dns.TypeA)
+	rewritten.result = &filtering.Result{
+		IsFiltered: true,
+		Reason:     filtering.Rewritten,
+	}
+	require.Equal(t, resultCodeSuccess, s.processRecordBlocked(rewritten))
+
+	testCases := []struct {
+		addr      net.Addr
+		name      string
+		clientID  string
+		qname     string
+		wantTXT   []string
+		qtype     uint16
+		wantRC    resultCode
+		wantNoAns bool
+	}{{
+		addr:     clientAddr,
+		name:     "latest",
+		clientID: "",
+		qname:    "WhoBlocked.example.adguard.",
+		wantTXT: []string{
+			"domain=ads.example",
+			"reason=FilteredBlackList",
+			"rule=||ads.example^",
+			"filter_list_id=1",
+		},
+		qtype:  dns.TypeTXT,
+		wantRC: resultCodeFinish,
+	}, {
+		addr:     otherAddr,
+		name:     "other_client",
+		clientID: "",
+		qname:    name + ".",
+		wantTXT:  []string{"none"},
+		qtype:    dns.TypeTXT,
+		wantRC:   resultCodeFinish,
+	}, {
+		addr:     clientAddr,
+		name:     "client_id",
+		clientID: "cli",
+		qname:    name + ".",
+		wantTXT:  []string{"none"},
+		qtype:    dns.TypeTXT,
+		wantRC:   resultCodeFinish,
+	}, {
+		addr:      clientAddr,
+		name:      "not_txt",
+		clientID:  "",
+		qname:     name + ".",
+		qtype:     dns.TypeA,
+		wantRC:    resultCodeFinish,
+		wantNoAns: true,
+	}, {
+		addr:     clientAddr,
+		name:     "other_name",
+		clientID: "",
+		qname:    "example.adguard.",
+		qtype:    dns.TypeTXT,
+		wantRC:   resultCodeSuccess,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dctx := newCtx(tc.addr, tc.clientID, tc.qname, tc.qtype)
+
+			rc := s.processBlockAttribution(dctx)
+			require.Equal(t, tc.wantRC, rc)
+
+			resp := dctx.proxyCtx.Res
+			if tc.wantRC == resultCodeSuccess {
+				assert.Nil(t, resp)
+
+				return
+			}
+
+			require.NotNil(t, resp)
+			assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+
+			if tc.wantNoAns {
+				assert.Empty(t, resp.Answer)
+
+				return
+			}
+
+			require.Len(t, resp.Answer, 1)
+
+			txt, ok := resp.Answer[0].(*dns.TXT)
+			require.True(t, ok)
+
+			assert.Zero(t, txt.Hdr.Ttl)
+
+			strs := txt.Txt
+			if len(tc.wantTXT) > 1 {
+				require.Len(t, strs, len(tc.wantTXT)+1)
+
+				assert.True(t, strings.HasPrefix(strs[len(strs)-1], "time="))
+				strs = strs[:len(strs)-1]
+			}
+
+			assert.Equal(t, tc.wantTXT, strs)
+		})
+	}
+}
+
+func TestBlockDecisionTXT_long(t *testing.T) {
+	res := &filtering.Result{
+		IsFiltered: true,
+		Reason:     filtering.FilteredBlockList,
+		Rules:      []*filtering.ResultRule{{Text: strings.Repeat("a", 300)}},
+	}
+
+	for _, s := range blockDecisionTXT("example.com", res, time.Now()) {
+		assert.LessOrEqual(t, len(s), maxTXTStringLen)
+	}
+}
@@ -0,0 +1,517 @@
+package dnsforward
+
+import (
+	"encoding/base64"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// ZoneTransferConfig is the configuration of the zone transfers (AXFR), which
+// allow the secondary DNS servers to pull the local records from AdGuard Home.
+type ZoneTransferConfig struct {
+	// ListenAddrs are the addresses, on which the zone transfers and the SOA
+	// queries are served over TCP and UDP, for example "192.168.1.1:5353".
+	// If empty, the zone transfers are disabled.
+	ListenAddrs []string `yaml:"listen_addrs"`
+
+	// Zones are the names of the transferred zones.  A zone contains the
+	// records of the local zone or the DHCP reverse zone with the same name,
+	// the addresses of the DHCP clients if it's the local domain, and the
+	// rewrites of the names within it.
+	Zones []string `yaml:"zones"`
+
+	// TSIGKeys are the keys, with one of which the transfer requests must be
+	// signed.
+	TSIGKeys []*TSIGKey `yaml:"tsig_keys"`
+}
+
+// TSIGKey is a key for the transaction signatures (RFC 8945).
+type TSIGKey struct {
+	// Name is the name of the key, for example "transfer.example".
+	Name string `yaml:"name"`
+
+	// Algorithm is the name of the algorithm, for example "hmac-sha256".  If
+	// empty, "hmac-sha256" is used.
+	Algorithm string `yaml:"algorithm"`
+
+	// Secret is the base64-encoded secret of the key.
+	Secret string `yaml:"secret"`
+}
+
+// tsigAlgorithms are the supported TSIG algorithms.
+var tsigAlgorithms = map[string]struct{}{
+	dns.HmacSHA1:   {},
+	dns.HmacSHA224: {},
+	dns.HmacSHA256: {},
+	dns.HmacSHA384: {},
+	dns.HmacSHA512: {},
+}
+
+// xfrEnvelopeSize is the number of the records sent within a single message of
+// a zone transfer.
+const xfrEnvelopeSize = 100
+
+// zoneSerial is the serial of a transferred zone, which is incremented each
+// time the contents of the zone change.
+type zoneSerial struct {
+	// hash is the hash of the contents of the zone.
+	hash uint64
+
+	// serial is the current serial.
+	serial uint32
+}
+
+// xfrServer serves the zone transfers of the local records.
+type xfrServer struct {
+	// srv is the DNS server, the records of which are transferred.
+	srv *Server
+
+	// mu protects servers and serials.
+	mu *sync.Mutex
+
+	// servers are the running servers.
+	servers []*dns.Server
+
+	// serials are the serials of the zones by their names.
+	serials map[string]*zoneSerial
+
+	// secrets are the secrets of the TSIG keys by their canonical names.
+	secrets map[string]string
+
+	// algorithms are the canonical names of the algorithms of the TSIG keys
+	// by the canonical names of the keys.
+	algorithms map[string]string
+
+	// zones are the canonical names of the transferred zones.
+	zones map[string]struct{}
+
+	// addrs are the addresses to listen on.
+	addrs []string
+}
+
+// newXFRServer returns a new zone transfer server for c.  It returns nil if
+// the zone transfers are disabled.
+func newXFRServer(srv *Server, c *ZoneTransferConfig) (x *xfrServer, err error) {
+	if len(c.ListenAddrs) == 0 {
+		return nil, nil
+	} else if len(c.TSIGKeys) == 0 {
+		return nil, errors.Error("no tsig keys")
+	}
+
+	x = &xfrServer{
+		srv:        srv,
+		mu:         &sync.Mutex{},
+		serials:    map[string]*zoneSerial{},
+		secrets:    make(map[string]string, len(c.TSIGKeys)),
+		algorithms: make(map[string]string, len(c.TSIGKeys)),
+		zones:      make(map[string]struct{}, len(c.Zones)),
+		addrs:      c.ListenAddrs,
+	}
+
+	for i, k := range c.TSIGKeys {
+		err = validateTSIGKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("tsig key at index %d: %w", i, err)
+		}
+
+		name := dns.CanonicalName(k.Name)
+		x.secrets[name] = k.Secret
+
+		x.algorithms[name] = dns.HmacSHA256
+		if k.Algorithm != "" {
+			x.algorithms[name] = dns.CanonicalName(k.Algorithm)
+		}
+	}
+
+	for i, z := range c.Zones {
+		name := dns.CanonicalName(z)
+		if _, ok := dns.IsDomainName(name); !ok || name == "." {
+			return nil, fmt.Errorf("zone at index %d: bad name %q", i, z)
+		}
+
+		x.zones[name] = struct{}{}
+	}
+
+	for i, addr := range c.ListenAddrs {
+		_, _, err = net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("listen addr at index %d: %w", i, err)
+		}
+	}
+
+	return x, nil
+}
+
+// validateTSIGKey returns an error if k is invalid.
+func validateTSIGKey(k *TSIGKey) (err error) {
+	if _, ok := dns.IsDomainName(k.Name); !ok || k.Name == "" {
+		return fmt.Errorf("bad name %q", k.Name)
+	}
+
+	if k.Algorithm != "" {
+		if _, ok := tsigAlgorithms[dns.CanonicalName(k.Algorithm)]; !ok {
+			return fmt.Errorf("bad algorithm %q", k.Algorithm)
+		}
+	}
+
+	_, err = base64.StdEncoding.DecodeString(k.Secret)
+	if err != nil {
+		return fmt.Errorf("bad secret: %w", err)
+	} else if k.Secret == "" {
+		return errors.Error("empty secret")
+	}
+
+	return nil
+}
+
+// start starts serving the zone transfers.  x may be nil.  The transfers are
+// only served if all the listeners are opened.
+func (x *xfrServer) start() (err error) {
+	if x == nil {
+		return nil
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	dss := make([]*dns.Server, 0, 2*len(x.addrs))
+	for _, addr := range x.addrs {
+		var l net.Listener
+		l, err = net.Listen("tcp", addr)
+		if err != nil {
+			err = fmt.Errorf("xfr: listening on tcp %s: %w", addr, err)
+
+			return errors.WithDeferred(err, closeXFRListeners(dss))
+		}
+
+		dss = append(dss, &dns.Server{Listener: l})
+
+		var pc net.PacketConn
+		pc, err = net.ListenPacket("udp", addr)
+		if err != nil {
+			err = fmt.Errorf("xfr: listening on udp %s: %w", addr, err)
+
+			return errors.WithDeferred(err, closeXFRListeners(dss))
+		}
+
+		dss = append(dss, &dns.Server{PacketConn: pc})
+	}
+
+	for _, ds := range dss {
+		x.serve(ds)
+	}
+
+	for _, addr := range x.addrs {
+		log.Info("dns: serving zone transfers on %s", addr)
+	}
+
+	return nil
+}
+
+// closeXFRListeners closes the listeners of dss, which aren't served yet.
+func closeXFRListeners(dss []*dns.Server) (err error) {
+	var errs []error
+	for _, ds := range dss {
+		var cerr error
+		if ds.Listener != nil {
+			cerr = ds.Listener.Close()
+		} else {
+			cerr = ds.PacketConn.Close()
+		}
+
+		if cerr != nil {
+			errs = append(errs, cerr)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.List("xfr: closing listeners", errs...)
+	}
+
+	return nil
+}
+
+// serve starts ds in a separate goroutine.  x.mu is expected to be locked.
+func (x *xfrServer) serve(ds *dns.Server) {
+	ds.Handler = dns.HandlerFunc(x.handle)
+	ds.TsigSecret = x.secrets
+	x.servers = append(x.servers, ds)
+
+	go func() {
+		defer aghos.OnPanicAndExit("xfr: serve")
+
+		err := ds.ActivateAndServe()
+		if err != nil {
+			log.Debug("xfr: serving: %s", err)
+		}
+	}()
+}
+
+// stop stops serving the zone transfers.  x may be nil.
+func (x *xfrServer) stop() (err error) {
+	if x == nil {
+		return nil
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	var errs []error
+	for _, ds := range x.servers {
+		if serr := ds.Shutdown(); serr != nil {
+			errs = append(errs, serr)
+		}
+	}
+	x.servers = nil
+
+	if len(errs) > 0 {
+		return errors.List("xfr: shutting down", errs...)
+	}
+
+	return nil
+}
+
+// handle responds to the zone transfer and the SOA requests.  The transfers
+// require a valid TSIG, and the SOA queries are signed if they have one.
+func (x *xfrServer) handle(w dns.ResponseWriter, req *dns.Msg) {
+	defer log.OnPanic("xfr: handle")
+
+	resp := (&dns.Msg{}).SetReply(req)
+	defer func() {
+		if resp == nil {
+			return
+		}
+
+		if err := w.WriteMsg(resp); err != nil {
+			log.Debug("xfr: writing response to %s: %s", w.RemoteAddr(), err)
+		}
+	}()
+
+	tsig := req.IsTsig()
+	if tsig != nil && !x.validTSIG(w, tsig) {
+		resp.Rcode = dns.RcodeNotAuth
+
+		return
+	} else if tsig != nil {
+		resp.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+	}
+
+	if len(req.Question) != 1 {
+		resp.Rcode = dns.RcodeFormatError
+
+		return
+	}
+
+	q := req.Question[0]
+	zone := dns.CanonicalName(q.Name)
+	if _, ok := x.zones[zone]; !ok || q.Qclass != dns.ClassINET {
+		resp.Rcode = dns.RcodeRefused
+
+		return
+	}
+
+	soa, rrs := x.zone(zone)
+	resp.Authoritative = true
+
+	_, isTCP := w.RemoteAddr().(*net.TCPAddr)
+	switch q.Qtype {
+	case dns.TypeSOA:
+		resp.Answer = []dns.RR{soa}
+	case dns.TypeAXFR, dns.TypeIXFR:
+		if tsig == nil {
+			log.Info("xfr: unsigned transfer request from %s", w.RemoteAddr())
+			resp.Rcode = dns.RcodeRefused
+		} else if !isTCP {
+			// Make the client retry over TCP.  See RFC 1995.
+			resp.Answer = []dns.RR{soa}
+		} else {
+			resp = nil
+			x.transfer(w, req, soa, rrs)
+		}
+	default:
+		resp.Rcode = dns.RcodeRefused
+	}
+}
+
+// validTSIG returns true if tsig of the request received from w is valid and
+// uses the configured algorithm of its key.
+func (x *xfrServer) validTSIG(w dns.ResponseWriter, tsig *dns.TSIG) (ok bool) {
+	if err := w.TsigStatus(); err != nil {
+		log.Info("xfr: bad tsig from %s: %s", w.RemoteAddr(), err)
+
+		return false
+	}
+
+	alg := dns.CanonicalName(tsig.Algorithm)
+	if want := x.algorithms[dns.CanonicalName(tsig.Hdr.Name)]; alg != want {
+		log.Info("xfr: tsig from %s: want algorithm %q, got %q", w.RemoteAddr(), want, alg)
+
+		return false
+	}
+
+	return true
+}
+
+// transfer sends the whole zone to w.  The IXFR requests are answered the same
+// way, as allowed by RFC 1995.
+func (x *xfrServer) transfer(w dns.ResponseWriter, req *dns.Msg, soa *dns.SOA, rrs []dns.RR) {
+	log.Debug("xfr: transferring %q with %d records to %s", soa.Hdr.Name, len(rrs), w.RemoteAddr())
+
+	all := make([]dns.RR, 0, len(rrs)+2)
+	all = append(all, soa)
+	all = append(all, rrs...)
+	all = append(all, soa)
+
+	// Fill the whole channel in advance, so that nothing leaks if the
+	// transfer fails midway.
+	ch := make(chan *dns.Envelope, (len(all)+xfrEnvelopeSize-1)/xfrEnvelopeSize)
+	for len(all) > 0 {
+		n := xfrEnvelopeSize
+		if n > len(all) {
+			n = len(all)
+		}
+
+		ch <- &dns.Envelope{RR: all[:n]}
+		all = all[n:]
+	}
+	close(ch)
+
+	if err := (&dns.Transfer{}).Out(w, req, ch); err != nil {
+		log.Info("xfr: transferring %q to %s: %s", soa.Hdr.Name, w.RemoteAddr(), err)
+	}
+}
+
+// zone returns the SOA and the other records of the zone with name.
+func (x *xfrServer) zone(name string) (soa *dns.SOA, rrs []dns.RR) {
+	soa, rrs = x.srv.zoneRecords(name)
+
+	sort.Slice(rrs, func(i, j int) bool {
+		return rrs[i].String() < rrs[j].String()
+	})
+
+	h := fnv.New64a()
+	for _, rr := range rrs {
+		_, _ = h.Write([]byte(rr.String()))
+		_, _ = h.Write([]byte{'\n'})
+	}
+
+	sum := h.Sum64()
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	zs := x.serials[name]
+	if zs == nil {
+		zs = &zoneSerial{hash: sum, serial: soa.Serial}
+		if now := uint32(time.Now().Unix()); now > zs.serial {
+			zs.serial = now
+		}
+
+		x.serials[name] = zs
+	} else if zs.hash != sum {
+		zs.hash = sum
+		zs.serial++
+	}
+
+	soa.Serial = zs.serial
+
+	return soa, rrs
+}
+
+// zoneRecords returns the SOA and the other records of the local zone, the
+// DHCP reverse zone, the DHCP clients, and the rewrites within the zone with
+// name, which must be canonical.
+func (s *Server) zoneRecords(name string) (soa *dns.SOA, rrs []dns.RR) {
+	s.serverLock.RLock()
+	lz := s.localZones
+	ttl := s.conf.BlockedResponseTTL
+	suffix := s.localDomainSuffix
+	s.serverLock.RUnlock()
+
+	s.dhcpZonesLock.Lock()
+	dz := s.dhcpZones
+	s.dhcpZonesLock.Unlock()
+
+	for _, zones := range []*localZones{lz, dz} {
+		z := zones.exact(name)
+		if z == nil {
+			continue
+		}
+
+		if soa == nil {
+			soa = dns.Copy(z.soa).(*dns.SOA)
+		}
+
+		for _, zrrs := range z.records {
+			for _, rr := range zrrs {
+				if rr.Header().Rrtype != dns.TypeSOA {
+					rrs = append(rrs, dns.Copy(rr))
+				}
+			}
+		}
+	}
+
+	if "."+name == suffix {
+		rrs = append(rrs, s.dhcpRecords(name, ttl)...)
+	}
+
+	if s.dnsFilter != nil {
+		rrs = append(rrs, s.dnsFilter.RewriteRecords(name, ttl)...)
+	}
+
+	if soa == nil {
+		soa = &dns.SOA{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeSOA,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			Ns:      "localhost.",
+			Mbox:    "hostmaster." + name,
+			Serial:  1,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			Minttl:  ttl,
+		}
+	}
+
+	return soa, rrs
+}
+
+// dhcpRecords returns the A and AAAA records of the DHCP clients within the
+// local domain zone.
+func (s *Server) dhcpRecords(zone string, ttl uint32) (rrs []dns.RR) {
+	s.tableHostToIPLock.Lock()
+	defer s.tableHostToIPLock.Unlock()
+
+	hdr := func(host string, rrType uint16) (h dns.RR_Header) {
+		return dns.RR_Header{
+			Name:   strings.ToLower(host) + "." + zone,
+			Rrtype: rrType,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		}
+	}
+
+	for host, ip := range s.tableHostToIP {
+		rrs = append(rrs, &dns.A{Hdr: hdr(host, dns.TypeA), A: ip})
+	}
+
+	for host, ip := range s.tableHostToIPv6 {
+		rrs = append(rrs, &dns.AAAA{Hdr: hdr(host, dns.TypeAAAA), AAAA: ip})
+	}
+
+	return rrs
+}
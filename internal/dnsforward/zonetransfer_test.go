@@ -0,0 +1,227 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestXFRServer(t *testing.T) {
+	const (
+		keyName   = "transfer.example."
+		keySecret = "c2VjcmV0LXNlY3JldC1zZWNyZXQ="
+	)
+
+	s := createTestServer(t, &filtering.Config{
+		Rewrites: []filtering.RewriteEntry{{
+			Domain: "rewritten.home.arpa",
+			Answer: "192.168.1.3",
+		}, {
+			Domain: "*.home.arpa",
+			Answer: "*.example.org",
+		}, {
+			Domain: "other.example",
+			Answer: "192.168.1.4",
+		}},
+	}, ServerConfig{
+		UDPListenAddrs: []*net.UDPAddr{{}},
+		TCPListenAddrs: []*net.TCPAddr{{}},
+		FilteringConfig: FilteringConfig{
+			UpstreamDNS:        []string{"8.8.8.8:53"},
+			BlockedResponseTTL: 10,
+			LocalZones: []*LocalZone{{
+				Name:    "home.arpa",
+				Records: []string{"nas 300 IN A 192.168.1.2"},
+			}},
+			ZoneTransfer: ZoneTransferConfig{
+				ListenAddrs: []string{"127.0.0.1:0"},
+				Zones:       []string{"home.arpa"},
+				TSIGKeys: []*TSIGKey{{
+					Name:   keyName,
+					Secret: keySecret,
+				}},
+			},
+		},
+	}, nil)
+
+	require.NotNil(t, s.xfr)
+
+	err := s.xfr.start()
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, s.xfr.stop)
+
+	require.NotEmpty(t, s.xfr.servers)
+
+	addr := s.xfr.servers[0].Listener.Addr().String()
+
+	newReq := func(name string, qtype uint16, signed bool) (req *dns.Msg) {
+		req = (&dns.Msg{}).SetQuestion(name, qtype)
+		if signed {
+			req.SetTsig(keyName, dns.HmacSHA256, 300, 0)
+		}
+
+		return req
+	}
+
+	t.Run("axfr", func(t *testing.T) {
+		tr := &dns.Transfer{TsigSecret: map[string]string{keyName: keySecret}}
+		ch, terr := tr.In(newReq("home.arpa.", dns.TypeAXFR, true), addr)
+		require.NoError(t, terr)
+
+		var rrs []string
+		for env := range ch {
+			require.NoError(t, env.Error)
+
+			for _, rr := range env.RR {
+				if rr.Header().Rrtype != dns.TypeSOA {
+					rrs = append(rrs, rr.String())
+				}
+			}
+		}
+
+		assert.ElementsMatch(t, []string{
+			"nas.home.arpa.\t300\tIN\tA\t192.168.1.2",
+			"rewritten.home.arpa.\t10\tIN\tA\t192.168.1.3",
+		}, rrs)
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		c := &dns.Client{Net: "tcp"}
+		resp, _, cerr := c.Exchange(newReq("home.arpa.", dns.TypeAXFR, false), addr)
+		require.NoError(t, cerr)
+
+		assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+	})
+
+	t.Run("bad_key", func(t *testing.T) {
+		tr := &dns.Transfer{TsigSecret: map[string]string{keyName: "b3RoZXI="}}
+		ch, terr := tr.In(newReq("home.arpa.", dns.TypeAXFR, true), addr)
+		require.NoError(t, terr)
+
+		env := <-ch
+		assert.Error(t, env.Error)
+	})
+
+	t.Run("bad_algorithm", func(t *testing.T) {
+		req := (&dns.Msg{}).SetQuestion("home.arpa.", dns.TypeAXFR)
+		req.SetTsig(keyName, dns.HmacSHA512, 300, 0)
+
+		tr := &dns.Transfer{TsigSecret: map[string]string{keyName: keySecret}}
+		ch, terr := tr.In(req, addr)
+		require.NoError(t, terr)
+
+		env := <-ch
+		assert.Error(t, env.Error)
+	})
+
+	t.Run("unknown_zone", func(t *testing.T) {
+		c := &dns.Client{Net: "tcp"}
+		resp, _, cerr := c.Exchange(newReq("example.org.", dns.TypeSOA, false), addr)
+		require.NoError(t, cerr)
+
+		assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+	})
+
+	t.Run("soa", func(t *testing.T) {
+		c := &dns.Client{Net: "tcp"}
+		resp, _, cerr := c.Exchange(newReq("home.arpa.", dns.TypeSOA, false), addr)
+		require.NoError(t, cerr)
+		require.Len(t, resp.Answer, 1)
+
+		soa, ok := resp.Answer[0].(*dns.SOA)
+		require.True(t, ok)
+
+		s.xfr.mu.Lock()
+		defer s.xfr.mu.Unlock()
+
+		assert.Equal(t, s.xfr.serials["home.arpa."].serial, soa.Serial)
+	})
+}
+
+func TestNewXFRServer(t *testing.T) {
+	key := &TSIGKey{Name: "key.example", Secret: "c2VjcmV0"}
+
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		conf       ZoneTransferConfig
+	}{{
+		name:       "disabled",
+		wantErrMsg: "",
+		conf:       ZoneTransferConfig{Zones: []string{"home.arpa"}},
+	}, {
+		name:       "valid",
+		wantErrMsg: "",
+		conf: ZoneTransferConfig{
+			ListenAddrs: []string{"127.0.0.1:5353"},
+			Zones:       []string{"home.arpa"},
+			TSIGKeys:    []*TSIGKey{key},
+		},
+	}, {
+		name:       "no_keys",
+		wantErrMsg: "no tsig keys",
+		conf: ZoneTransferConfig{
+			ListenAddrs: []string{"127.0.0.1:5353"},
+		},
+	}, {
+		name:       "bad_algorithm",
+		wantErrMsg: `tsig key at index 0: bad algorithm "md4"`,
+		conf: ZoneTransferConfig{
+			ListenAddrs: []string{"127.0.0.1:5353"},
+			TSIGKeys:    []*TSIGKey{{Name: "key", Algorithm: "md4", Secret: "c2VjcmV0"}},
+		},
+	}, {
+		name:       "root_zone",
+		wantErrMsg: `zone at index 0: bad name "."`,
+		conf: ZoneTransferConfig{
+			ListenAddrs: []string{"127.0.0.1:5353"},
+			Zones:       []string{"."},
+			TSIGKeys:    []*TSIGKey{key},
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newXFRServer(&Server{}, &tc.conf)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
+
+func TestXFRServer_start_rollback(t *testing.T) {
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	freeAddr := free.Addr().String()
+	require.NoError(t, free.Close())
+
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, busy.Close)
+
+	x, err := newXFRServer(&Server{}, &ZoneTransferConfig{
+		ListenAddrs: []string{freeAddr, busy.Addr().String()},
+		Zones:       []string{"home.arpa"},
+		TSIGKeys:    []*TSIGKey{{Name: "key.example", Secret: "c2VjcmV0"}},
+	})
+	require.NoError(t, err)
+
+	err = x.start()
+	require.Error(t, err)
+
+	assert.Empty(t, x.servers)
+
+	// The listeners on the first address must be closed.
+	l, err := net.Listen("tcp", freeAddr)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	pc, err := net.ListenPacket("udp", freeAddr)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, pc.Close)
+}
@@ -3,6 +3,8 @@ package filtering
 import (
 	"encoding/json"
 	"net/http"
+	"sort"
+	"sync"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
 	"github.com/AdguardTeam/golibs/log"
@@ -11,6 +13,10 @@ import (
 
 var serviceRules map[string][]*rules.NetworkRule // service name -> filtering rules
 
+// serviceRulesLock protects serviceRules, which may be updated from the blocked
+// services feed.
+var serviceRulesLock = &sync.RWMutex{}
+
 type svc struct {
 	name  string
 	rules []string
@@ -253,6 +259,9 @@ func initBlockedServices() {
 
 // BlockedSvcKnown - return TRUE if a blocked service name is known
 func BlockedSvcKnown(s string) bool {
+	serviceRulesLock.RLock()
+	defer serviceRulesLock.RUnlock()
+
 	_, ok := serviceRules[s]
 	return ok
 }
@@ -265,6 +274,10 @@ func (d *DNSFilter) ApplyBlockedServices(setts *Settings, list []string, global
 		defer d.confLock.RUnlock()
 		list = d.Config.BlockedServices
 	}
+
+	serviceRulesLock.RLock()
+	defer serviceRulesLock.RUnlock()
+
 	for _, name := range list {
 		rules, ok := serviceRules[name]
 
@@ -294,6 +307,27 @@ func (d *DNSFilter) handleBlockedServicesList(w http.ResponseWriter, r *http.Req
 	}
 }
 
+// handleBlockedServicesAvailable is the handler for the GET
+// /control/blocked_services/services HTTP API.
+func (d *DNSFilter) handleBlockedServicesAvailable(w http.ResponseWriter, r *http.Request) {
+	serviceRulesLock.RLock()
+	ids := make([]string, 0, len(serviceRules))
+	for id := range serviceRules {
+		ids = append(ids, id)
+	}
+	serviceRulesLock.RUnlock()
+
+	sort.Strings(ids)
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(ids)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+
+		return
+	}
+}
+
 func (d *DNSFilter) handleBlockedServicesSet(w http.ResponseWriter, r *http.Request) {
 	list := []string{}
 	err := json.NewDecoder(r.Body).Decode(&list)
@@ -316,4 +350,5 @@ func (d *DNSFilter) handleBlockedServicesSet(w http.ResponseWriter, r *http.Requ
 func (d *DNSFilter) registerBlockedServicesHandlers() {
 	d.Config.HTTPRegister(http.MethodGet, "/control/blocked_services/list", d.handleBlockedServicesList)
 	d.Config.HTTPRegister(http.MethodPost, "/control/blocked_services/set", d.handleBlockedServicesSet)
+	d.Config.HTTPRegister(http.MethodGet, "/control/blocked_services/services", d.handleBlockedServicesAvailable)
 }
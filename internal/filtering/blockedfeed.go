@@ -0,0 +1,184 @@
+package filtering
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/AdguardTeam/urlfilter/rules"
+)
+
+// defaultBlockedServicesFeedIvl is the default interval between the updates
+// of the blocked services definitions.
+const defaultBlockedServicesFeedIvl = 24 * time.Hour
+
+// blockedServicesFeedMaxSize is the maximum size of the blocked services feed
+// and its signature.
+const blockedServicesFeedMaxSize = 4 * 1024 * 1024
+
+// BlockedServicesFeedConfig is the configuration of the updatable feed of the
+// blocked services definitions.
+type BlockedServicesFeedConfig struct {
+	// URL is the URL of the feed.  The detached signature is fetched from
+	// the same URL with the ".sig" suffix.  If URL is empty, the built-in
+	// definitions are used.
+	URL string `yaml:"url"`
+
+	// PublicKey is the base64-encoded Ed25519 public key used to verify the
+	// signature of the feed.  It must be set if URL is set.
+	PublicKey string `yaml:"public_key"`
+
+	// Interval is the interval between the updates.  If it's zero, the feed
+	// is updated once a day.
+	Interval timeutil.Duration `yaml:"interval"`
+}
+
+// blockedServicesFeed is the JSON structure of the blocked services feed.
+type blockedServicesFeed struct {
+	BlockedServices []*blockedServiceJSON `json:"blocked_services"`
+}
+
+// blockedServiceJSON is the JSON structure of a single blocked service
+// definition in the feed.
+type blockedServiceJSON struct {
+	ID    string   `json:"id"`
+	Rules []string `json:"rules"`
+}
+
+// runBlockedServicesFeed updates the blocked services definitions from the
+// feed until done is closed.
+func (d *DNSFilter) runBlockedServicesFeed(done <-chan struct{}) {
+	defer aghos.OnPanicAndExit("filtering: blocked services feed")
+
+	conf := d.Config.BlockedServicesFeed
+	ivl := conf.Interval.Duration
+	if ivl == 0 {
+		ivl = defaultBlockedServicesFeedIvl
+	}
+
+	t := time.NewTicker(ivl)
+	defer t.Stop()
+
+	for {
+		err := d.updateBlockedServices(&conf)
+		if err != nil {
+			log.Error("filtering: updating blocked services: %s", err)
+		}
+
+		select {
+		case <-t.C:
+			// Go on.
+		case <-done:
+			return
+		}
+	}
+}
+
+// updateBlockedServices fetches, verifies, and applies the blocked services
+// definitions from the feed.
+func (d *DNSFilter) updateBlockedServices(conf *BlockedServicesFeedConfig) (err error) {
+	pub, err := base64.StdEncoding.DecodeString(conf.PublicKey)
+	if err != nil {
+		return fmt.Errorf("decoding public key: %w", err)
+	} else if len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("bad public key length %d", len(pub))
+	}
+
+	data, err := d.fetchFeed(conf.URL, blockedServicesFeedMaxSize)
+	if err != nil {
+		return fmt.Errorf("fetching feed: %w", err)
+	}
+
+	sigData, err := d.fetchFeed(conf.URL+".sig", blockedServicesFeedMaxSize)
+	if err != nil {
+		return fmt.Errorf("fetching signature: %w", err)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sigData)))
+	if err != nil {
+		return fmt.Errorf("decoding signature: %w", err)
+	}
+
+	if !ed25519.Verify(ed25519.PublicKey(pub), data, sig) {
+		return errors.Error("signature verification failed")
+	}
+
+	svcRules, err := parseBlockedServicesFeed(data)
+	if err != nil {
+		return fmt.Errorf("parsing feed: %w", err)
+	}
+
+	serviceRulesLock.Lock()
+	defer serviceRulesLock.Unlock()
+
+	serviceRules = svcRules
+
+	log.Info("filtering: updated blocked services: %d services", len(svcRules))
+
+	return nil
+}
+
+// fetchFeed returns the body of the response for u, which is at most maxSize
+// bytes long.
+func (d *DNSFilter) fetchFeed(u string, maxSize int64) (body []byte, err error) {
+	cli := d.Config.HTTPClient
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+
+	resp, err := cli.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, maxSize))
+}
+
+// parseBlockedServicesFeed parses the blocked services definitions from data.
+func parseBlockedServicesFeed(data []byte) (svcRules map[string][]*rules.NetworkRule, err error) {
+	feed := &blockedServicesFeed{}
+	err = json.Unmarshal(data, feed)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(feed.BlockedServices) == 0 {
+		return nil, errors.Error("no blocked services")
+	}
+
+	svcRules = make(map[string][]*rules.NetworkRule, len(feed.BlockedServices))
+	for i, s := range feed.BlockedServices {
+		if s == nil || s.ID == "" {
+			return nil, fmt.Errorf("service at index %d: no id", i)
+		}
+
+		netRules := []*rules.NetworkRule{}
+		for _, text := range s.Rules {
+			var rule *rules.NetworkRule
+			rule, err = rules.NewNetworkRule(text, BlockedSvcsListID)
+			if err != nil {
+				return nil, fmt.Errorf("service %q: rule %q: %w", s.ID, text, err)
+			}
+
+			netRules = append(netRules, rule)
+		}
+
+		svcRules[s.ID] = netRules
+	}
+
+	return svcRules, nil
+}
@@ -0,0 +1,109 @@
+package filtering
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSFilter_updateBlockedServices(t *testing.T) {
+	const feed = `{"blocked_services":[` +
+		`{"id":"telegram","rules":["||t.me^","||telegram.org^"]},` +
+		`{"id":"newsvc","rules":["||new.example^"]}` +
+		`]}`
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, []byte(feed)))
+	badSig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, []byte("other")))
+
+	curSig := sig
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/services.json":
+			_, _ = w.Write([]byte(feed))
+		case "/services.json.sig":
+			_, _ = w.Write([]byte(curSig + "\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	prevRules := serviceRules
+	t.Cleanup(func() { serviceRules = prevRules })
+
+	d := &DNSFilter{}
+	conf := &BlockedServicesFeedConfig{
+		URL:       srv.URL + "/services.json",
+		PublicKey: base64.StdEncoding.EncodeToString(pub),
+	}
+
+	t.Run("bad_signature", func(t *testing.T) {
+		curSig = badSig
+		t.Cleanup(func() { curSig = sig })
+
+		err = d.updateBlockedServices(conf)
+		assert.Error(t, err)
+
+		assert.False(t, BlockedSvcKnown("newsvc"))
+	})
+
+	t.Run("success", func(t *testing.T) {
+		err = d.updateBlockedServices(conf)
+		require.NoError(t, err)
+
+		assert.True(t, BlockedSvcKnown("newsvc"))
+		assert.True(t, BlockedSvcKnown("telegram"))
+		assert.False(t, BlockedSvcKnown("facebook"))
+
+		require.Len(t, serviceRules["telegram"], 2)
+		assert.Equal(t, "||t.me^", serviceRules["telegram"][0].Text())
+	})
+
+	t.Run("not_found", func(t *testing.T) {
+		err = d.updateBlockedServices(&BlockedServicesFeedConfig{
+			URL:       srv.URL + "/missing.json",
+			PublicKey: conf.PublicKey,
+		})
+		assert.Error(t, err)
+	})
+}
+
+func TestParseBlockedServicesFeed(t *testing.T) {
+	testCases := []struct {
+		name       string
+		data       string
+		wantErrMsg string
+	}{{
+		name:       "empty",
+		data:       `{"blocked_services":[]}`,
+		wantErrMsg: "no blocked services",
+	}, {
+		name:       "no_id",
+		data:       `{"blocked_services":[{"rules":["||example.org^"]}]}`,
+		wantErrMsg: "service at index 0: no id",
+	}, {
+		name:       "success",
+		data:       `{"blocked_services":[{"id":"svc","rules":["||example.org^"]}]}`,
+		wantErrMsg: "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseBlockedServicesFeed([]byte(tc.data))
+			if tc.wantErrMsg == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.wantErrMsg)
+			}
+		})
+	}
+}
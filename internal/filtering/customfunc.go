@@ -0,0 +1,330 @@
+package filtering
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// CustomFunction is the configuration of a custom filter function implemented
+// by a WebAssembly module.
+//
+// The module must not import anything and must export:
+//
+//   - memory, its linear memory;
+//   - buffer() -> i32, the address of a buffer of at least
+//     customFuncBufferSize bytes within the memory;
+//   - verdict(qname_ptr, qname_len, qtype, client_ptr, client_len i32) -> i32,
+//     the function returning one of the customVerdict values.
+//
+// Before each call of verdict the host writes the lowercased host name and the
+// string representation of the client's IP address into the buffer.
+type CustomFunction struct {
+	// Name is the name of the function used in the query log.
+	Name string `yaml:"name"`
+
+	// Path is the path to the WebAssembly module.  Relative paths are
+	// resolved against Config.CustomFunctionsDir.
+	Path string `yaml:"path"`
+
+	// Enabled defines if the function is used.
+	Enabled bool `yaml:"enabled"`
+}
+
+// customFuncBufferSize is the minimum size of the buffer exported by a custom
+// function module.  It's enough for the longest domain name and the longest
+// textual IPv6 address.
+const customFuncBufferSize = 512
+
+// customVerdict is the result of a custom filter function.
+type customVerdict uint64
+
+// Custom function verdicts.
+const (
+	customVerdictPass customVerdict = iota
+	customVerdictBlock
+	customVerdictAllow
+)
+
+// Resource limits of a custom function.
+const (
+	// customFuncMaxSize is the maximum size of a custom function module.
+	customFuncMaxSize = 16 * 1024 * 1024
+
+	// customFuncMaxPages is the maximum number of the 64 KiB memory pages of a
+	// custom function module.
+	customFuncMaxPages = 16
+
+	// customFuncTimeout is the maximum duration of a single call of a custom
+	// function, including the start function of the module.
+	customFuncTimeout = 100 * time.Millisecond
+)
+
+// customFunc is a loaded custom filter function.
+type customFunc struct {
+	// rt is the WebAssembly runtime of the function.
+	rt wazero.Runtime
+
+	// compiled is the compiled module used to recreate mod.
+	compiled wazero.CompiledModule
+
+	// mu protects mod, since the modules aren't safe for concurrent use.
+	mu *sync.Mutex
+
+	// mod is the instance of the module.  It's closed by the runtime when a
+	// call times out, and is recreated on the next call.
+	mod api.Module
+
+	// name is the name of the function.
+	name string
+}
+
+// hasFunc returns true if m exports the function name with the i32 params
+// and a single i32 result.
+func hasFunc(m wazero.CompiledModule, name string, params int) (ok bool) {
+	def, ok := m.ExportedFunctions()[name]
+	if !ok {
+		return false
+	}
+
+	pts, rts := def.ParamTypes(), def.ResultTypes()
+	if len(pts) != params || len(rts) != 1 || rts[0] != api.ValueTypeI32 {
+		return false
+	}
+
+	for _, pt := range pts {
+		if pt != api.ValueTypeI32 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validateCustomFunc returns an error if m doesn't implement the interface of
+// a custom function.
+func validateCustomFunc(m wazero.CompiledModule) (err error) {
+	switch {
+	case len(m.ImportedFunctions()) > 0 || len(m.ImportedMemories()) > 0:
+		return errors.Error("module must not import anything")
+	case m.ExportedMemories()["memory"] == nil:
+		return errors.Error("no exported memory")
+	case !hasFunc(m, "buffer", 0):
+		return errors.Error("no exported function buffer() -> i32")
+	case !hasFunc(m, "verdict", 5):
+		return errors.Error("no exported function verdict(i32, i32, i32, i32, i32) -> i32")
+	default:
+		return nil
+	}
+}
+
+// newCustomFunc loads and instantiates the custom function module configured
+// by conf.  dir is used to resolve the relative path.
+func newCustomFunc(conf *CustomFunction, dir string) (f *customFunc, err error) {
+	path := conf.Path
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	} else if fi.Size() > customFuncMaxSize {
+		return nil, fmt.Errorf("module is too large: %d bytes", fi.Size())
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	rt := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(customFuncMaxPages).
+		WithCloseOnContextDone(true))
+	defer func() {
+		if err != nil {
+			_ = rt.Close(ctx)
+		}
+	}()
+
+	compiled, err := rt.CompileModule(ctx, b)
+	if err != nil {
+		return nil, fmt.Errorf("compiling: %w", err)
+	}
+
+	err = validateCustomFunc(compiled)
+	if err != nil {
+		return nil, err
+	}
+
+	f = &customFunc{
+		rt:       rt,
+		compiled: compiled,
+		mu:       &sync.Mutex{},
+		name:     conf.Name,
+	}
+
+	err = f.instantiate()
+	if err != nil {
+		return nil, fmt.Errorf("instantiating: %w", err)
+	}
+
+	return f, nil
+}
+
+// instantiate creates a new instance of the module of f.  f.mu is expected to
+// be locked, if f is shared.
+func (f *customFunc) instantiate() (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), customFuncTimeout)
+	defer cancel()
+
+	// Use an empty name, since the runtime requires the names of the
+	// instances to be unique.
+	f.mod, err = f.rt.InstantiateModule(ctx, f.compiled, wazero.NewModuleConfig().WithName(""))
+
+	return err
+}
+
+// call calls the exported function name of f.mod with args within the
+// timeout and returns its result.  f.mu is expected to be locked.
+func (f *customFunc) call(name string, args ...uint64) (res uint64, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), customFuncTimeout)
+	defer cancel()
+
+	results, err := f.mod.ExportedFunction(name).Call(ctx, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return results[0], nil
+}
+
+// verdict calls the function for host, qtype, and client.
+func (f *customFunc) verdict(host string, qtype uint16, client string) (v customVerdict, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.mod.IsClosed() {
+		// The previous call has timed out.
+		err = f.instantiate()
+		if err != nil {
+			return customVerdictPass, fmt.Errorf("reinstantiating: %w", err)
+		}
+	}
+
+	res, err := f.call("buffer")
+	if err != nil {
+		return customVerdictPass, fmt.Errorf("calling buffer: %w", err)
+	}
+
+	ptr := uint32(res)
+	mem := f.mod.ExportedMemory("memory")
+	if uint64(ptr)+customFuncBufferSize > uint64(mem.Size()) {
+		return customVerdictPass, fmt.Errorf("buffer at %d is out of memory bounds", ptr)
+	} else if len(host)+len(client) > customFuncBufferSize {
+		return customVerdictPass, errors.Error("arguments are too long")
+	}
+
+	// The bounds are checked above.
+	_ = mem.Write(ptr, []byte(host+client))
+
+	hostLen, clientLen := uint64(len(host)), uint64(len(client))
+	res, err = f.call("verdict", uint64(ptr), hostLen, uint64(qtype), uint64(ptr)+hostLen, clientLen)
+	if err != nil {
+		return customVerdictPass, fmt.Errorf("calling verdict: %w", err)
+	}
+
+	v = customVerdict(uint32(res))
+	if v > customVerdictAllow {
+		return customVerdictPass, fmt.Errorf("unknown verdict %d", v)
+	}
+
+	return v, nil
+}
+
+// close releases the resources of f.
+func (f *customFunc) close() (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.rt.Close(context.Background())
+}
+
+// initCustomFuncs loads the enabled custom functions from the configuration.
+// The modules that can't be loaded are skipped.
+func (d *DNSFilter) initCustomFuncs(c *Config) {
+	for i := range c.CustomFunctions {
+		conf := &c.CustomFunctions[i]
+		if !conf.Enabled {
+			continue
+		}
+
+		f, err := newCustomFunc(conf, c.CustomFunctionsDir)
+		if err != nil {
+			log.Error("filtering: loading custom function %q: %s", conf.Name, err)
+
+			continue
+		}
+
+		log.Info("filtering: loaded custom function %q from %q", conf.Name, conf.Path)
+
+		d.customFuncs = append(d.customFuncs, f)
+	}
+}
+
+// checkCustomFuncs checks host against the custom functions in their order
+// until one of them returns something other than pass.  The errors of the
+// functions are logged and their verdicts are ignored, so err is always nil.
+func (d *DNSFilter) checkCustomFuncs(
+	host string,
+	qtype uint16,
+	setts *Settings,
+) (res Result, err error) {
+	if !setts.FilteringEnabled || len(d.customFuncs) == 0 {
+		return Result{}, nil
+	}
+
+	var client string
+	if setts.ClientIP != nil {
+		client = setts.ClientIP.String()
+	}
+
+	for _, f := range d.customFuncs {
+		v, verr := f.verdict(host, qtype, client)
+		if verr != nil {
+			log.Debug("filtering: custom function %q: %s", f.name, verr)
+
+			continue
+		}
+
+		var reason Reason
+		switch v {
+		case customVerdictBlock:
+			reason = FilteredBlockList
+		case customVerdictAllow:
+			reason = NotFilteredAllowList
+		default:
+			continue
+		}
+
+		return Result{
+			Rules: []*ResultRule{{
+				Text:         f.name,
+				FilterListID: CustomFunctionsListID,
+			}},
+			Reason:     reason,
+			IsFiltered: reason == FilteredBlockList,
+		}, nil
+	}
+
+	return Result{}, nil
+}
@@ -0,0 +1,181 @@
+package filtering
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCustomFuncModule is a WebAssembly module, which allows the hosts
+// starting with "a", blocks the ones starting with "b", and passes the AAAA
+// queries.
+var testCustomFuncModule = []byte{
+	// Magic and version.
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+	// Types: () -> i32 and (i32, i32, i32, i32, i32) -> i32.
+	0x01, 0x0e, 0x02,
+	0x60, 0x00, 0x01, 0x7f,
+	0x60, 0x05, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x01, 0x7f,
+	// Functions.
+	0x03, 0x03, 0x02, 0x00, 0x01,
+	// Memory of one page.
+	0x05, 0x03, 0x01, 0x00, 0x01,
+	// Exports: memory, buffer, and verdict.
+	0x07, 0x1d, 0x03,
+	0x06, 'm', 'e', 'm', 'o', 'r', 'y', 0x02, 0x00,
+	0x06, 'b', 'u', 'f', 'f', 'e', 'r', 0x00, 0x00,
+	0x07, 'v', 'e', 'r', 'd', 'i', 'c', 't', 0x00, 0x01,
+	// Code.
+	0x0a, 0x26, 0x02,
+	// buffer returns 256.
+	0x05, 0x00, 0x41, 0x80, 0x02, 0x0b,
+	// verdict returns ((qname[0] == 'b') | (qname[0] == 'a') << 1) *
+	// (qtype != AAAA).
+	0x1e, 0x00,
+	0x20, 0x00, 0x2d, 0x00, 0x00, 0x41, 0xe2, 0x00, 0x46,
+	0x20, 0x00, 0x2d, 0x00, 0x00, 0x41, 0xe1, 0x00, 0x46, 0x41, 0x01, 0x74,
+	0x72,
+	0x20, 0x02, 0x41, 0x1c, 0x47,
+	0x6c,
+	0x0b,
+}
+
+func TestDNSFilter_CheckHost_customFuncs(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "func.wasm"), testCustomFuncModule, 0o644)
+	require.NoError(t, err)
+
+	d := newForTest(t, &Config{
+		CustomFunctions: []CustomFunction{{
+			Name:    "missing",
+			Path:    "missing.wasm",
+			Enabled: true,
+		}, {
+			Name:    "disabled",
+			Path:    "func.wasm",
+			Enabled: false,
+		}, {
+			Name:    "test",
+			Path:    "func.wasm",
+			Enabled: true,
+		}},
+		CustomFunctionsDir: dir,
+	}, []Filter{{
+		ID: 1, Data: []byte("||bad.blocked^\n"),
+	}})
+	t.Cleanup(d.Close)
+
+	require.Len(t, d.customFuncs, 1)
+
+	testCases := []struct {
+		name       string
+		host       string
+		wantRule   string
+		wantListID int64
+		wantReason Reason
+		qtype      uint16
+	}{{
+		name:       "allowed",
+		host:       "allowed.example",
+		wantRule:   "test",
+		wantListID: CustomFunctionsListID,
+		wantReason: NotFilteredAllowList,
+		qtype:      dns.TypeA,
+	}, {
+		name:       "blocked",
+		host:       "blocked.example",
+		wantRule:   "test",
+		wantListID: CustomFunctionsListID,
+		wantReason: FilteredBlockList,
+		qtype:      dns.TypeA,
+	}, {
+		name:       "passed_aaaa",
+		host:       "blocked.example",
+		wantReason: NotFilteredNotFound,
+		qtype:      dns.TypeAAAA,
+	}, {
+		name:       "passed",
+		host:       "other.example",
+		wantReason: NotFilteredNotFound,
+		qtype:      dns.TypeA,
+	}, {
+		name:       "rules_first",
+		host:       "bad.blocked",
+		wantRule:   "||bad.blocked^",
+		wantListID: 1,
+		wantReason: FilteredBlockList,
+		qtype:      dns.TypeA,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, cerr := d.CheckHost(tc.host, tc.qtype, &setts)
+			require.NoError(t, cerr)
+
+			assert.Equal(t, tc.wantReason, res.Reason)
+			if tc.wantRule == "" {
+				assert.Empty(t, res.Rules)
+
+				return
+			}
+
+			require.Len(t, res.Rules, 1)
+
+			assert.Equal(t, tc.wantRule, res.Rules[0].Text)
+			assert.Equal(t, tc.wantListID, res.Rules[0].FilterListID)
+		})
+	}
+}
+
+// testCustomFuncLoopModule is a WebAssembly module, which verdict function
+// never returns.
+var testCustomFuncLoopModule = []byte{
+	// Magic and version.
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+	// Types: () -> i32 and (i32, i32, i32, i32, i32) -> i32.
+	0x01, 0x0e, 0x02,
+	0x60, 0x00, 0x01, 0x7f,
+	0x60, 0x05, 0x7f, 0x7f, 0x7f, 0x7f, 0x7f, 0x01, 0x7f,
+	// Functions.
+	0x03, 0x03, 0x02, 0x00, 0x01,
+	// Memory of one page.
+	0x05, 0x03, 0x01, 0x00, 0x01,
+	// Exports: memory, buffer, and verdict.
+	0x07, 0x1d, 0x03,
+	0x06, 'm', 'e', 'm', 'o', 'r', 'y', 0x02, 0x00,
+	0x06, 'b', 'u', 'f', 'f', 'e', 'r', 0x00, 0x00,
+	0x07, 'v', 'e', 'r', 'd', 'i', 'c', 't', 0x00, 0x01,
+	// Code.
+	0x0a, 0x11, 0x02,
+	// buffer returns 256.
+	0x05, 0x00, 0x41, 0x80, 0x02, 0x0b,
+	// verdict loops forever.
+	0x09, 0x00, 0x03, 0x40, 0x0c, 0x00, 0x0b, 0x41, 0x00, 0x0b,
+}
+
+func TestCustomFunc_verdict_timeout(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "loop.wasm"), testCustomFuncLoopModule, 0o644)
+	require.NoError(t, err)
+
+	f, err := newCustomFunc(&CustomFunction{Name: "loop", Path: "loop.wasm"}, dir)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, f.close)
+
+	v, err := f.verdict("host.example", dns.TypeA, "192.0.2.1")
+	require.Error(t, err)
+
+	assert.Equal(t, customVerdictPass, v)
+	assert.True(t, f.mod.IsClosed())
+
+	prev := f.mod
+	_, err = f.verdict("host.example", dns.TypeA, "192.0.2.1")
+	require.Error(t, err)
+
+	assert.NotSame(t, prev, f.mod)
+}
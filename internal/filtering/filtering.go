@@ -13,13 +13,17 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/AdGuardHome/internal/schedule"
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/cache"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/stringutil"
+	"github.com/AdguardTeam/golibs/timeutil"
 	"github.com/AdguardTeam/urlfilter"
 	"github.com/AdguardTeam/urlfilter/filterlist"
 	"github.com/AdguardTeam/urlfilter/rules"
@@ -36,6 +40,10 @@ const (
 	ParentalListID
 	SafeBrowsingListID
 	SafeSearchListID
+	CustomFunctionsListID
+	QuarantineListID
+	RPZListID
+	AnswerNetsListID
 )
 
 // ServiceEntry - blocked service array element
@@ -52,11 +60,42 @@ type Settings struct {
 
 	ServicesRules []ServiceEntry
 
+	// FilterListIDs, if not empty, are the IDs of the only blocklists, the
+	// rules of which are applied.  The custom filtering rules and the
+	// allowlists are always applied.
+	FilterListIDs []int64
+
 	ProtectionEnabled   bool
 	FilteringEnabled    bool
 	SafeSearchEnabled   bool
 	SafeBrowsingEnabled bool
 	ParentalEnabled     bool
+
+	// Quarantined, if true, means that only the hosts explicitly allowed by
+	// the allowlists and the custom filtering rules are resolved for the
+	// client, and the other settings are ignored.
+	Quarantined bool
+
+	// AnswerOrder is the order of the A and AAAA records in the responses to
+	// the client.  If empty, the order of the upstream is kept.
+	AnswerOrder string
+
+	// SuppressAAAAWithoutA, if true, means that the AAAA records are removed
+	// from the responses to the client, if the name has no A records.
+	SuppressAAAAWithoutA bool
+
+	// DNS64, if true, means that the AAAA records are synthesized for the
+	// client, if DNS64 is enabled.
+	DNS64 bool
+
+	// DisableAAAA, if true, means that the AAAA records and the IPv6 hints
+	// are removed from the responses to the client.
+	DisableAAAA bool
+
+	// ViewRewrites are the normalized rewrites of the split-horizon view,
+	// which the client belongs to.  They take precedence over the global
+	// rewrites.  See NormalizeRewrites.
+	ViewRewrites []RewriteEntry
 }
 
 // Resolver is the interface for net.Resolver to simplify testing.
@@ -86,6 +125,30 @@ type Config struct {
 	// Per-client settings can override this configuration.
 	BlockedServices []string `yaml:"blocked_services"`
 
+	// BlockedServicesFeed is the configuration of the updatable feed of the
+	// blocked services definitions.
+	BlockedServicesFeed BlockedServicesFeedConfig `yaml:"blocked_services_feed"`
+
+	// IPBlocklists are the updatable lists of the networks, which are added
+	// to the blocked answer networks.
+	IPBlocklists []IPBlocklist `yaml:"ip_blocklists"`
+
+	// IPBlocklistsInterval is the interval between the updates of the IP
+	// blocklists.  If it's zero, the lists are updated once a day.
+	IPBlocklistsInterval timeutil.Duration `yaml:"ip_blocklists_update_interval"`
+
+	// CustomFunctions are the custom filter functions implemented by
+	// WebAssembly modules.  They are applied after the filtering rules.
+	CustomFunctions []CustomFunction `yaml:"custom_functions"`
+
+	// CustomFunctionsDir is the directory against which the relative paths of
+	// the custom functions are resolved.
+	CustomFunctionsDir string `yaml:"-"`
+
+	// HTTPClient is the client used to fetch the blocked services feed and
+	// the IP blocklists.  If it's nil, http.DefaultClient is used.
+	HTTPClient *http.Client `yaml:"-"`
+
 	// EtcHosts is a container of IP-hostname pairs taken from the operating
 	// system configuration files (e.g. /etc/hosts).
 	EtcHosts *aghnet.HostsContainer `yaml:"-"`
@@ -98,6 +161,10 @@ type Config struct {
 
 	// CustomResolver is the resolver used by DNSFilter.
 	CustomResolver Resolver `yaml:"-"`
+
+	// QuarantineBlocked, if not nil, is called each time a request of a
+	// quarantined client is blocked.  It must not block.
+	QuarantineBlocked func(setts *Settings, host string, qtype uint16) `yaml:"-"`
 }
 
 // LookupStats store stats collected during safebrowsing or parental checks
@@ -134,6 +201,31 @@ type DNSFilter struct {
 	filteringEngineAllow *urlfilter.DNSEngine
 	engineLock           sync.RWMutex
 
+	// listScheds are the parsed schedules of the filter lists by their IDs.
+	// It's protected by engineLock.
+	listScheds map[int64]*schedule.Interval
+
+	// activeLists is the key of the set of the scheduled filter lists, which
+	// were active when the engines were built.  It's protected by engineLock.
+	activeLists string
+
+	// allowFilters and allBlockFilters are all the allowlists and blocklists,
+	// including the ones inactive according to their schedules.  They are used
+	// to rebuild the engines when a schedule starts or ends.  They're
+	// protected by engineLock.
+	allowFilters    []Filter
+	allBlockFilters []Filter
+
+	// blockFilters are the blocklists the engine has been built from.  It's
+	// protected by engineLock.
+	blockFilters []Filter
+
+	// listSetEngines are the engines for the subsets of the blocklists by the
+	// keys of the subsets.  It's protected by listSetEnginesLock, and the
+	// engines are only used with engineLock locked.
+	listSetEngines     map[string]*listSetEngine
+	listSetEnginesLock sync.Mutex
+
 	parentalServer       string // access via methods
 	safeBrowsingServer   string // access via methods
 	parentalUpstream     upstream.Upstream
@@ -157,6 +249,25 @@ type DNSFilter struct {
 	resolver Resolver
 
 	hostCheckers []hostChecker
+
+	// customFuncs are the loaded custom filter functions.
+	customFuncs []*customFunc
+
+	// blockedSvcFeedDone is closed to stop the blocked services feed
+	// updates.  It's nil if the updates aren't running.
+	blockedSvcFeedDone chan struct{}
+
+	// answerNets are the ranges of the blocked answer networks, both the
+	// static ones from staticAnswerNets and the ones from ipBlocklistNets.
+	// These fields are protected by answerNetsLock.
+	answerNets       ipRangeSet
+	staticAnswerNets []*net.IPNet
+	ipBlocklistNets  []*net.IPNet
+	answerNetsLock   sync.RWMutex
+
+	// ipBlocklistsDone is closed to stop the IP blocklists updates.  It's nil
+	// if the updates aren't running.
+	ipBlocklistsDone chan struct{}
 }
 
 // Filter represents a filter list
@@ -164,6 +275,10 @@ type Filter struct {
 	ID       int64  // auto-assigned when filter is added (see nextFilterID)
 	Data     []byte `yaml:"-"` // List of rules divided by '\n'
 	FilePath string `yaml:"-"` // Path to a filtering rules file
+
+	// Schedule, if not nil, is the daily time interval during which the list
+	// is active.  The list is always active if Schedule is nil.
+	Schedule *schedule.Config `yaml:"schedule,omitempty"`
 }
 
 // Reason holds an enum detailing why it was filtered or not filtered
@@ -210,6 +325,10 @@ const (
 	//
 	// See https://github.com/AdguardTeam/AdGuardHome/issues/2499.
 	RewrittenRule
+
+	// FilteredQuarantine is returned when the client is quarantined and the
+	// host isn't explicitly allowed.
+	FilteredQuarantine
 )
 
 // TODO(a.garipov): Resync with actual code names or replace completely
@@ -229,6 +348,8 @@ var reasonNames = []string{
 	Rewritten:          "Rewrite",
 	RewrittenAutoHosts: "RewriteEtcHosts",
 	RewrittenRule:      "RewriteRule",
+
+	FilteredQuarantine: "FilteredQuarantine",
 }
 
 func (r Reason) String() string {
@@ -312,7 +433,7 @@ func (d *DNSFilter) SetFilters(blockFilters, allowFilters []Filter, async bool)
 		return nil
 	}
 
-	err := d.initFiltering(allowFilters, blockFilters)
+	err := d.initFiltering(allowFilters, blockFilters, time.Now())
 	if err != nil {
 		log.Error("Can't initialize filtering subsystem: %s", err)
 		return err
@@ -321,14 +442,23 @@ func (d *DNSFilter) SetFilters(blockFilters, allowFilters []Filter, async bool)
 	return nil
 }
 
-// Starts initializing new filters by signal from channel
+// Starts initializing new filters by signal from channel.  It also rebuilds
+// the engines when the schedules of the filter lists start or end.
 func (d *DNSFilter) filtersInitializer() {
+	defer aghos.OnPanicAndExit("filtering: initializing filters")
+
+	t := time.NewTicker(listSchedsIvl)
+	defer t.Stop()
+
 	for {
-		params := <-d.filtersInitializerChan
-		err := d.initFiltering(params.allowFilters, params.blockFilters)
-		if err != nil {
-			log.Error("Can't initialize filtering subsystem: %s", err)
-			continue
+		select {
+		case params := <-d.filtersInitializerChan:
+			err := d.initFiltering(params.allowFilters, params.blockFilters, time.Now())
+			if err != nil {
+				log.Error("Can't initialize filtering subsystem: %s", err)
+			}
+		case now := <-t.C:
+			d.rebuildOnSchedule(now)
 		}
 	}
 }
@@ -337,6 +467,24 @@ func (d *DNSFilter) filtersInitializer() {
 func (d *DNSFilter) Close() {
 	d.engineLock.Lock()
 	defer d.engineLock.Unlock()
+
+	if d.blockedSvcFeedDone != nil {
+		close(d.blockedSvcFeedDone)
+		d.blockedSvcFeedDone = nil
+	}
+
+	if d.ipBlocklistsDone != nil {
+		close(d.ipBlocklistsDone)
+		d.ipBlocklistsDone = nil
+	}
+
+	for _, f := range d.customFuncs {
+		err := f.close()
+		if err != nil {
+			log.Debug("filtering: closing custom function %q: %s", f.name, err)
+		}
+	}
+
 	d.reset()
 }
 
@@ -356,6 +504,8 @@ func (d *DNSFilter) reset() {
 			log.Error("filtering: rulesStorageAllow.Close: %s", err)
 		}
 	}
+
+	d.resetListSetEngines()
 }
 
 // ResultRule contains information about applied rules.
@@ -390,6 +540,12 @@ type Result struct {
 	// Rewritten.
 	IPList []net.IP `json:",omitempty"`
 
+	// Records are the records of the types other than A, AAAA, and CNAME
+	// from the lookup rewrite result.  It is empty unless Reason is set to
+	// Rewritten.  The owner names and the TTLs of the records are to be set
+	// by the caller.
+	Records []dns.RR `json:"-"`
+
 	// CanonName is the CNAME value from the lookup rewrite result.  It is empty
 	// unless Reason is set to Rewritten or RewrittenRule.
 	CanonName string `json:",omitempty"`
@@ -434,7 +590,18 @@ func (d *DNSFilter) CheckHost(
 
 	host = strings.ToLower(host)
 
+	if setts.Quarantined {
+		return d.checkQuarantined(host, qtype, setts)
+	}
+
 	if setts.FilteringEnabled {
+		if len(setts.ViewRewrites) > 0 {
+			res = resolveRewrites(setts.ViewRewrites, host, qtype)
+			if res.Reason == Rewritten {
+				return res, nil
+			}
+		}
+
 		res = d.processRewrites(host, qtype)
 		if res.Reason == Rewritten {
 			return res, nil
@@ -455,6 +622,37 @@ func (d *DNSFilter) CheckHost(
 	return Result{}, nil
 }
 
+// checkQuarantined blocks each host not explicitly allowed by the allowlists or
+// the custom filtering rules.
+func (d *DNSFilter) checkQuarantined(
+	host string,
+	qtype uint16,
+	setts *Settings,
+) (res Result, err error) {
+	allowSetts := *setts
+	allowSetts.FilteringEnabled = true
+	allowSetts.ProtectionEnabled = true
+
+	res, err = d.matchHost(host, qtype, &allowSetts)
+	if err != nil {
+		return Result{}, fmt.Errorf("quarantine: %w", err)
+	} else if res.Reason == NotFilteredAllowList {
+		return res, nil
+	}
+
+	if d.QuarantineBlocked != nil {
+		d.QuarantineBlocked(setts, host, qtype)
+	}
+
+	return Result{
+		IsFiltered: true,
+		Reason:     FilteredQuarantine,
+		Rules: []*ResultRule{{
+			FilterListID: QuarantineListID,
+		}},
+	}, nil
+}
+
 // matchSysHosts tries to match the host against the operating system's hosts
 // database.  err is always nil.
 func (d *DNSFilter) matchSysHosts(
@@ -507,6 +705,9 @@ func (d *DNSFilter) matchSysHostsIntl(
 	return res, nil
 }
 
+// maxRewriteCNAMEs is the maximum length of a chain of the CNAME rewrites.
+const maxRewriteCNAMEs = 16
+
 // Process rewrites table
 // . Find CNAME for a domain name (exact match or by wildcard)
 //  . if found and CNAME equals to domain name - this is an exception;  exit
@@ -514,11 +715,19 @@ func (d *DNSFilter) matchSysHostsIntl(
 //  . repeat for the new domain name (Note: we return only the last CNAME)
 // . Find A or AAAA record for a domain name (exact match or by wildcard)
 //  . if found, set IP addresses (IPv4 or IPv6 depending on qtype) in Result.IPList array
+// . Find SRV, MX, TXT, HTTPS, or SVCB record for a domain name
+//  . if found, set the records of the qtype in Result.Records array
 func (d *DNSFilter) processRewrites(host string, qtype uint16) (res Result) {
 	d.confLock.RLock()
 	defer d.confLock.RUnlock()
 
-	rr := findRewrites(d.Rewrites, host, qtype)
+	return resolveRewrites(d.Rewrites, host, qtype)
+}
+
+// resolveRewrites processes the rewrites table entries for host.  See
+// processRewrites.
+func resolveRewrites(entries []RewriteEntry, host string, qtype uint16) (res Result) {
+	rr := findRewrites(entries, host, qtype)
 	if len(rr) != 0 {
 		res.Reason = Rewritten
 	}
@@ -538,12 +747,18 @@ func (d *DNSFilter) processRewrites(host string, qtype uint16) (res Result) {
 		if cnames.Has(host) {
 			log.Info("rewrite: breaking CNAME redirection loop: %s.  Question: %s", host, origHost)
 
+			return res
+		} else if cnames.Len() >= maxRewriteCNAMEs {
+			// The generated names may never repeat, for example with
+			// a regexp rewrite appending a label.
+			log.Info("rewrite: too many CNAME redirections for %s", origHost)
+
 			return res
 		}
 
 		cnames.Add(host)
 		res.CanonName = rr[0].Answer
-		rr = findRewrites(d.Rewrites, host, qtype)
+		rr = findRewrites(entries, host, qtype)
 	}
 
 	for _, r := range rr {
@@ -556,6 +771,9 @@ func (d *DNSFilter) processRewrites(host string, qtype uint16) (res Result) {
 
 			res.IPList = append(res.IPList, r.IP)
 			log.Debug("rewrite: A/AAAA for %s is %s", host, r.IP)
+		} else if r.Type == qtype && r.RR != nil {
+			res.Records = append(res.Records, dns.Copy(r.RR))
+			log.Debug("rewrite: %s for %s is %s", dns.TypeToString[qtype], host, r.Answer)
 		}
 	}
 
@@ -615,7 +833,7 @@ func newRuleStorage(filters []Filter) (rs *filterlist.RuleStorage, err error) {
 		case len(f.Data) != 0:
 			lists = append(lists, &filterlist.StringRuleList{
 				ID:             id,
-				RulesText:      string(f.Data),
+				RulesText:      NormalizeRules(string(f.Data)),
 				IgnoreCosmetic: true,
 			})
 		case f.FilePath == "":
@@ -633,7 +851,7 @@ func newRuleStorage(filters []Filter) (rs *filterlist.RuleStorage, err error) {
 
 			lists = append(lists, &filterlist.StringRuleList{
 				ID:             id,
-				RulesText:      string(data),
+				RulesText:      NormalizeRules(string(data)),
 				IgnoreCosmetic: true,
 			})
 		default:
@@ -657,14 +875,21 @@ func newRuleStorage(filters []Filter) (rs *filterlist.RuleStorage, err error) {
 	return rs, nil
 }
 
-// Initialize urlfilter objects.
-func (d *DNSFilter) initFiltering(allowFilters, blockFilters []Filter) error {
-	rulesStorage, err := newRuleStorage(blockFilters)
+// Initialize urlfilter objects.  The filter lists, which are inactive at now
+// according to their schedules, are left out of the engines.
+func (d *DNSFilter) initFiltering(allowFilters, blockFilters []Filter, now time.Time) error {
+	listScheds, err := newListScheds(allowFilters, blockFilters)
+	if err != nil {
+		return err
+	}
+
+	activeBlock := activeFilters(blockFilters, listScheds, now)
+	rulesStorage, err := newRuleStorage(activeBlock)
 	if err != nil {
 		return err
 	}
 
-	rulesStorageAllow, err := newRuleStorage(allowFilters)
+	rulesStorageAllow, err := newRuleStorage(activeFilters(allowFilters, listScheds, now))
 	if err != nil {
 		return err
 	}
@@ -681,6 +906,11 @@ func (d *DNSFilter) initFiltering(allowFilters, blockFilters []Filter) error {
 		d.filteringEngine = filteringEngine
 		d.rulesStorageAllow = rulesStorageAllow
 		d.filteringEngineAllow = filteringEngineAllow
+		d.listScheds = listScheds
+		d.activeLists = activeListsKey(listScheds, now)
+		d.allowFilters = allowFilters
+		d.allBlockFilters = blockFilters
+		d.blockFilters = activeBlock
 	}()
 
 	// Make sure that the OS reclaims memory as soon as possible.
@@ -811,11 +1041,17 @@ func (d *DNSFilter) matchHost(
 		}
 	}
 
-	if d.filteringEngine == nil {
+	engine := d.filteringEngine
+	if engine == nil {
 		return Result{}, nil
+	} else if len(setts.FilterListIDs) > 0 {
+		engine, err = d.engineFor(setts.FilterListIDs)
+		if err != nil {
+			return Result{}, err
+		}
 	}
 
-	dnsres, ok := d.filteringEngine.MatchRequest(ureq)
+	dnsres, ok := engine.MatchRequest(ureq)
 	// Check DNS rewrites first, because the API there is a bit awkward.
 	if dnsr := dnsres.DNSRewrites(); len(dnsr) > 0 {
 		res = d.processDNSRewrites(dnsr)
@@ -835,6 +1071,7 @@ func (d *DNSFilter) matchHost(
 	}
 
 	res = d.matchHostProcessDNSResult(qtype, dnsres)
+
 	for _, r := range res.Rules {
 		log.Debug(
 			"filtering: found rule %q for host %q, filter list id: %d",
@@ -892,6 +1129,8 @@ func New(c *Config, blockFilters []Filter) (d *DNSFilter) {
 		if c.CustomResolver != nil {
 			d.resolver = c.CustomResolver
 		}
+
+		d.initCustomFuncs(c)
 	}
 
 	d.hostCheckers = []hostChecker{{
@@ -900,6 +1139,9 @@ func New(c *Config, blockFilters []Filter) (d *DNSFilter) {
 	}, {
 		check: d.matchHost,
 		name:  "filtering",
+	}, {
+		check: d.checkCustomFuncs,
+		name:  "custom functions",
 	}, {
 		check: matchBlockedServicesRules,
 		name:  "blocked services",
@@ -936,7 +1178,7 @@ func New(c *Config, blockFilters []Filter) (d *DNSFilter) {
 	d.BlockedServices = bsvcs
 
 	if blockFilters != nil {
-		err = d.initFiltering(nil, blockFilters)
+		err = d.initFiltering(nil, blockFilters, time.Now())
 		if err != nil {
 			log.Error("Can't initialize filtering subsystem: %s", err)
 			d.Close()
@@ -959,4 +1201,14 @@ func (d *DNSFilter) Start() {
 		d.registerRewritesHandlers()
 		d.registerBlockedServicesHandlers()
 	}
+
+	if d.Config.BlockedServicesFeed.URL != "" {
+		d.blockedSvcFeedDone = make(chan struct{})
+		go d.runBlockedServicesFeed(d.blockedSvcFeedDone)
+	}
+
+	if len(d.Config.IPBlocklists) > 0 {
+		d.ipBlocklistsDone = make(chan struct{})
+		go d.runIPBlocklists(d.ipBlocklistsDone)
+	}
 }
@@ -740,6 +740,129 @@ func TestWhitelist(t *testing.T) {
 	assert.Equal(t, "||host2^", res.Rules[0].Text)
 }
 
+func TestDNSFilter_CheckHost_filterListIDs(t *testing.T) {
+	filters := []Filter{{
+		ID: CustomListID, Data: []byte("||custom.example^\n"),
+	}, {
+		ID: 1, Data: []byte("||first.example^\n" +
+			"||important.example^$important\n" +
+			"@@||exception.example^\n"),
+	}, {
+		ID: 2, Data: []byte("||second.example^\n" +
+			"||important.example^\n" +
+			"||exception.example^\n"),
+	}}
+
+	d := newForTest(t, nil, filters)
+	t.Cleanup(d.Close)
+
+	s := setts
+	s.FilterListIDs = []int64{2}
+
+	testCases := []struct {
+		name string
+		host string
+		want bool
+	}{{
+		name: "custom",
+		host: "custom.example",
+		want: true,
+	}, {
+		name: "not_selected",
+		host: "first.example",
+		want: false,
+	}, {
+		name: "selected",
+		host: "second.example",
+		want: true,
+	}, {
+		name: "hidden_by_not_selected",
+		host: "important.example",
+		want: true,
+	}, {
+		name: "not_selected_exception",
+		host: "exception.example",
+		want: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := d.CheckHost(tc.host, dns.TypeA, &s)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.want, res.IsFiltered)
+			for _, r := range res.Rules {
+				assert.Contains(t, []int64{CustomListID, 2}, r.FilterListID)
+			}
+		})
+	}
+
+	t.Run("all_lists", func(t *testing.T) {
+		res, err := d.CheckHost("exception.example", dns.TypeA, &setts)
+		require.NoError(t, err)
+
+		assert.False(t, res.IsFiltered)
+	})
+}
+
+func TestDNSFilter_CheckHost_quarantine(t *testing.T) {
+	filters := []Filter{{
+		ID: CustomListID, Data: []byte("@@||custom.example^\n||blocked.example^\n"),
+	}}
+	allowFilters := []Filter{{
+		ID: 1, Data: []byte("||allowed.example^\n"),
+	}}
+
+	var blocked []string
+	d := newForTest(t, &Config{
+		QuarantineBlocked: func(_ *Settings, host string, _ uint16) {
+			blocked = append(blocked, host)
+		},
+	}, nil)
+	t.Cleanup(d.Close)
+
+	err := d.SetFilters(filters, allowFilters, false)
+	require.NoError(t, err)
+
+	s := setts
+	s.FilteringEnabled = false
+	s.Quarantined = true
+
+	testCases := []struct {
+		name       string
+		host       string
+		wantReason Reason
+	}{{
+		name:       "custom_allowed",
+		host:       "custom.example",
+		wantReason: NotFilteredAllowList,
+	}, {
+		name:       "allowlist",
+		host:       "allowed.example",
+		wantReason: NotFilteredAllowList,
+	}, {
+		name:       "blocked",
+		host:       "blocked.example",
+		wantReason: FilteredQuarantine,
+	}, {
+		name:       "not_matched",
+		host:       "other.example",
+		wantReason: FilteredQuarantine,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, resErr := d.CheckHost(tc.host, dns.TypeA, &s)
+			require.NoError(t, resErr)
+
+			assert.Equal(t, tc.wantReason, res.Reason)
+			assert.Equal(t, tc.wantReason == FilteredQuarantine, res.IsFiltered)
+		})
+	}
+
+	assert.Equal(t, []string{"blocked.example", "other.example"}, blocked)
+}
+
 // Client Settings.
 
 func applyClientSettings(setts *Settings) {
@@ -0,0 +1,163 @@
+package filtering
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/net/idna"
+)
+
+// isASCII returns true if s only contains ASCII characters.
+func isASCII(s string) (ok bool) {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isHostRune returns true if r may be a part of a hostname in a rule.
+func isHostRune(r rune) (ok bool) {
+	return r == '.' || r == '-' || r == '_' ||
+		unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+// hostToASCII converts the part of a hostname host into punycode.  It returns
+// host unchanged if it only contains ASCII characters or can't be converted.
+func hostToASCII(host string) (ascii string) {
+	if isASCII(host) {
+		return host
+	}
+
+	ascii, err := idna.ToASCII(strings.ToLower(host))
+	if err != nil {
+		log.Debug("filtering: converting %q to punycode: %s", host, err)
+
+		return host
+	}
+
+	return ascii
+}
+
+// NormalizeRule converts the internationalized domain names within the pattern
+// of the filtering rule into punycode, which is the form the rules are matched
+// against.  Comments, regular expressions, and modifiers are left unchanged.
+func NormalizeRule(rule string) (norm string) {
+	if isASCII(rule) {
+		return rule
+	}
+
+	trimmed := strings.TrimSpace(rule)
+	if trimmed == "" || trimmed[0] == '!' || trimmed[0] == '#' {
+		return rule
+	}
+
+	pattern, mods := rule, ""
+	if i := strings.IndexByte(rule, '$'); i >= 0 {
+		pattern, mods = rule[:i], rule[i:]
+	}
+
+	if strings.HasPrefix(strings.TrimPrefix(trimmed, "@@"), "/") {
+		// A regular expression.
+		return rule
+	}
+
+	b := &strings.Builder{}
+	start := -1
+	for i, r := range pattern {
+		if isHostRune(r) {
+			if start < 0 {
+				start = i
+			}
+
+			continue
+		}
+
+		if start >= 0 {
+			b.WriteString(hostToASCII(pattern[start:i]))
+			start = -1
+		}
+
+		b.WriteRune(r)
+	}
+
+	if start >= 0 {
+		b.WriteString(hostToASCII(pattern[start:]))
+	}
+
+	b.WriteString(mods)
+
+	return b.String()
+}
+
+// NormalizeRules applies NormalizeRule to each line of text.
+func NormalizeRules(text string) (norm string) {
+	if isASCII(text) {
+		return text
+	}
+
+	lines := strings.SplitAfter(text, "\n")
+	for i, l := range lines {
+		eol := l[len(strings.TrimRight(l, "\r\n")):]
+		lines[i] = NormalizeRule(l[:len(l)-len(eol)]) + eol
+	}
+
+	return strings.Join(lines, "")
+}
+
+// latinLookalikes are the Cyrillic and Greek lowercase letters, which are
+// hardly distinguishable from the Latin ones.
+const latinLookalikes = "асеһіјӏоԁԛрѕԝхуү" + "αικνορυϲ"
+
+// IsHomograph returns true if host contains a label, which looks like it's
+// made to be confused with another one.  That is either a label mixing the
+// letters of Latin, Cyrillic, and Greek scripts, or a Cyrillic or Greek label
+// made only of the letters looking like Latin ones.  host may be either in
+// Unicode or in punycode.
+func IsHomograph(host string) (ok bool) {
+	uhost, err := idna.ToUnicode(host)
+	if err != nil || isASCII(uhost) {
+		return false
+	}
+
+	for _, label := range strings.Split(strings.ToLower(uhost), ".") {
+		if isHomographLabel(label) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isHomographLabel returns true if label is a homograph.  See IsHomograph.
+func isHomographLabel(label string) (ok bool) {
+	var latin, cyrillic, greek bool
+	lookalikes := true
+	for _, r := range label {
+		switch {
+		case unicode.Is(unicode.Latin, r):
+			latin = true
+		case unicode.Is(unicode.Cyrillic, r):
+			cyrillic = true
+		case unicode.Is(unicode.Greek, r):
+			greek = true
+		default:
+			continue
+		}
+
+		lookalikes = lookalikes && strings.ContainsRune(latinLookalikes, r)
+	}
+
+	switch {
+	case latin && (cyrillic || greek), cyrillic && greek:
+		return true
+	case cyrillic || greek:
+		return lookalikes
+	default:
+		return false
+	}
+}
@@ -0,0 +1,107 @@
+package filtering
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeRule(t *testing.T) {
+	testCases := []struct {
+		name string
+		rule string
+		want string
+	}{{
+		name: "ascii",
+		rule: "||example.org^",
+		want: "||example.org^",
+	}, {
+		name: "adblock",
+		rule: "||пример.рф^",
+		want: "||xn--e1afmkfd.xn--p1ai^",
+	}, {
+		name: "upper",
+		rule: "||ПРИМЕР.РФ^",
+		want: "||xn--e1afmkfd.xn--p1ai^",
+	}, {
+		name: "allowlist_wildcard",
+		rule: "@@||*.bücher.example^",
+		want: "@@||*.xn--bcher-kva.example^",
+	}, {
+		name: "hosts",
+		rule: "0.0.0.0 bücher.example",
+		want: "0.0.0.0 xn--bcher-kva.example",
+	}, {
+		name: "modifiers",
+		rule: "||bücher.example^$client='Ребёнок'",
+		want: "||xn--bcher-kva.example^$client='Ребёнок'",
+	}, {
+		name: "comment",
+		rule: "! Блокировка",
+		want: "! Блокировка",
+	}, {
+		name: "regexp",
+		rule: "/пример\\.рф/",
+		want: "/пример\\.рф/",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, NormalizeRule(tc.rule))
+		})
+	}
+
+	t.Run("rules", func(t *testing.T) {
+		const text = "||example.org^\r\n||пример.рф^\r\n! пример"
+
+		assert.Equal(t, "||example.org^\r\n||xn--e1afmkfd.xn--p1ai^\r\n! пример", NormalizeRules(text))
+	})
+}
+
+func TestIsHomograph(t *testing.T) {
+	testCases := []struct {
+		name string
+		host string
+		want bool
+	}{{
+		name: "ascii",
+		host: "apple.com",
+		want: false,
+	}, {
+		name: "cyrillic",
+		host: "пример.рф",
+		want: false,
+	}, {
+		name: "latin_accents",
+		host: "bücher.example",
+		want: false,
+	}, {
+		name: "mixed",
+		// The first letter is the Cyrillic "а".
+		host: "аpple.com",
+		want: true,
+	}, {
+		name: "lookalikes",
+		// All the letters are Cyrillic.
+		host: "асе.com",
+		want: true,
+	}, {
+		name: "punycode",
+		host: "xn--pple-43d.com",
+		want: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, IsHomograph(tc.host))
+		})
+	}
+}
+
+func TestUnicodeRules(t *testing.T) {
+	d := newForTest(t, nil, []Filter{{ID: 0, Data: []byte("||пример.рф^\n")}})
+	t.Cleanup(d.Close)
+
+	d.checkMatch(t, "xn--e1afmkfd.xn--p1ai")
+	d.checkMatch(t, "sub.xn--e1afmkfd.xn--p1ai")
+}
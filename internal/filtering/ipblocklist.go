@@ -0,0 +1,269 @@
+package filtering
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// defaultIPBlocklistsIvl is the default interval between the updates of the IP
+// blocklists.
+const defaultIPBlocklistsIvl = 24 * time.Hour
+
+// ipBlocklistMaxSize is the maximum size of a single IP blocklist.
+const ipBlocklistMaxSize = 16 * 1024 * 1024
+
+// IPBlocklist is an updatable list of the IP addresses and the CIDRs of the
+// networks, for example the known sinkholes and the bulletproof hosters.  The
+// networks are added to the blocked answer networks, see MatchAnswerIP.
+type IPBlocklist struct {
+	// Name is the human-readable name of the list.
+	Name string `yaml:"name"`
+
+	// URL is the URL of the list or the absolute path to a local file.  The
+	// list contains an IP address or a CIDR per line.  Anything after the
+	// first whitespace, "#", or ";" on a line is ignored, so that the lists
+	// like Spamhaus DROP could be used as is.
+	URL string `yaml:"url"`
+
+	// Enabled tells if the list is used.
+	Enabled bool `yaml:"enabled"`
+}
+
+// ipRange is a range of the IP addresses from a blocked answer network.
+// The addresses are in the 16-byte form.
+type ipRange struct {
+	start net.IP
+	end   net.IP
+
+	// ipNet is the network the range is made of.
+	ipNet *net.IPNet
+}
+
+// contains returns true if ip, in the 16-byte form, is within r.
+func (r *ipRange) contains(ip net.IP) (ok bool) {
+	return bytes.Compare(r.start, ip) <= 0 && bytes.Compare(ip, r.end) <= 0
+}
+
+// newIPRange returns the range of the addresses of n.
+func newIPRange(n *net.IPNet) (r *ipRange) {
+	ip := n.IP
+	if ip4 := ip.To4(); ip4 != nil && len(n.Mask) == net.IPv4len {
+		ip = ip4
+	}
+
+	end := make(net.IP, len(ip))
+	for i := range ip {
+		end[i] = ip[i] | ^n.Mask[i]
+	}
+
+	return &ipRange{
+		start: ip.To16(),
+		end:   end.To16(),
+		ipNet: n,
+	}
+}
+
+// ipRangeSet is a set of the disjoint IP ranges sorted by their starts, which
+// allows matching an address against lots of networks quickly.
+type ipRangeSet []*ipRange
+
+// newIPRangeSet returns the set of the ranges of nets.  Since the networks are
+// either nested or disjoint, the nested ones are dropped, so that the rest are
+// disjoint.
+func newIPRangeSet(nets []*net.IPNet) (s ipRangeSet) {
+	ranges := make([]*ipRange, 0, len(nets))
+	for _, n := range nets {
+		ranges = append(ranges, newIPRange(n))
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		if c := bytes.Compare(ranges[i].start, ranges[j].start); c != 0 {
+			return c < 0
+		}
+
+		// Put the wider one first.
+		return bytes.Compare(ranges[i].end, ranges[j].end) > 0
+	})
+
+	for _, r := range ranges {
+		if l := len(s); l > 0 && bytes.Compare(r.end, s[l-1].end) <= 0 {
+			continue
+		}
+
+		s = append(s, r)
+	}
+
+	return s
+}
+
+// match returns the network containing ip or nil if there is none.
+func (s ipRangeSet) match(ip net.IP) (n *net.IPNet) {
+	ip = ip.To16()
+	if ip == nil {
+		return nil
+	}
+
+	i := sort.Search(len(s), func(i int) bool {
+		return bytes.Compare(s[i].start, ip) > 0
+	})
+	if i == 0 {
+		return nil
+	}
+
+	if r := s[i-1]; r.contains(ip) {
+		return r.ipNet
+	}
+
+	return nil
+}
+
+// parseIPBlocklist parses the networks from the IP blocklist data.  The
+// invalid lines are skipped.
+func parseIPBlocklist(data []byte) (nets []*net.IPNet) {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		l := sc.Text()
+		if i := strings.IndexAny(l, " \t#;"); i >= 0 {
+			l = l[:i]
+		}
+
+		if l == "" {
+			continue
+		}
+
+		if ip := net.ParseIP(l); ip != nil {
+			bits := net.IPv6len * 8
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, net.IPv4len*8
+			}
+
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(l)
+		if err != nil {
+			log.Debug("filtering: ip blocklist: skipping %q: %s", l, err)
+
+			continue
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets
+}
+
+// runIPBlocklists updates the IP blocklists until done is closed.
+func (d *DNSFilter) runIPBlocklists(done <-chan struct{}) {
+	defer aghos.OnPanicAndExit("filtering: ip blocklists")
+
+	ivl := d.Config.IPBlocklistsInterval.Duration
+	if ivl == 0 {
+		ivl = defaultIPBlocklistsIvl
+	}
+
+	t := time.NewTicker(ivl)
+	defer t.Stop()
+
+	// lastGood are the networks of the lists by their URLs from the last
+	// successful updates.  They are used when an update fails.
+	lastGood := map[string][]*net.IPNet{}
+	for {
+		d.updateIPBlocklists(d.Config.IPBlocklists, lastGood)
+
+		select {
+		case <-t.C:
+			// Go on.
+		case <-done:
+			return
+		}
+	}
+}
+
+// updateIPBlocklists fetches the enabled lists and applies them.  The lists,
+// which fail to update, keep their networks from lastGood.
+func (d *DNSFilter) updateIPBlocklists(lists []IPBlocklist, lastGood map[string][]*net.IPNet) {
+	var nets []*net.IPNet
+	for _, l := range lists {
+		if !l.Enabled || l.URL == "" {
+			continue
+		}
+
+		data, err := d.fetchIPBlocklist(l.URL)
+		if err != nil {
+			log.Error("filtering: updating ip blocklist %q: %s", l.Name, err)
+		} else {
+			lastGood[l.URL] = parseIPBlocklist(data)
+			log.Debug("filtering: ip blocklist %q: %d networks", l.Name, len(lastGood[l.URL]))
+		}
+
+		nets = append(nets, lastGood[l.URL]...)
+	}
+
+	d.answerNetsLock.Lock()
+	defer d.answerNetsLock.Unlock()
+
+	d.ipBlocklistNets = nets
+	d.rebuildAnswerNets()
+
+	log.Info("filtering: updated ip blocklists: %d networks", len(nets))
+}
+
+// fetchIPBlocklist returns the contents of the IP blocklist at u, which is
+// either a URL or an absolute file path.
+func (d *DNSFilter) fetchIPBlocklist(u string) (data []byte, err error) {
+	if !filepath.IsAbs(u) {
+		return d.fetchFeed(u, ipBlocklistMaxSize)
+	}
+
+	f, err := os.Open(u)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	return io.ReadAll(io.LimitReader(f, ipBlocklistMaxSize))
+}
+
+// SetBlockedAnswerNets sets the static blocked answer networks, which are
+// matched along with the networks from the IP blocklists.
+func (d *DNSFilter) SetBlockedAnswerNets(nets []*net.IPNet) {
+	d.answerNetsLock.Lock()
+	defer d.answerNetsLock.Unlock()
+
+	d.staticAnswerNets = nets
+	d.rebuildAnswerNets()
+}
+
+// rebuildAnswerNets rebuilds the set of the blocked answer networks from the
+// static ones and the ones from the IP blocklists.  d.answerNetsLock is
+// expected to be locked for writing.
+func (d *DNSFilter) rebuildAnswerNets() {
+	nets := make([]*net.IPNet, 0, len(d.staticAnswerNets)+len(d.ipBlocklistNets))
+	nets = append(nets, d.staticAnswerNets...)
+	nets = append(nets, d.ipBlocklistNets...)
+
+	d.answerNets = newIPRangeSet(nets)
+}
+
+// MatchAnswerIP returns the blocked answer network, either a static one or one
+// from the IP blocklists, containing ip or nil if there is none.
+func (d *DNSFilter) MatchAnswerIP(ip net.IP) (n *net.IPNet) {
+	d.answerNetsLock.RLock()
+	defer d.answerNetsLock.RUnlock()
+
+	return d.answerNets.match(ip)
+}
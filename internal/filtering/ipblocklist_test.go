@@ -0,0 +1,130 @@
+package filtering
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIPBlocklist(t *testing.T) {
+	const data = "; Spamhaus DROP List\n" +
+		"192.0.2.0/24 ; SBL1\n" +
+		"# comment\n" +
+		"\n" +
+		"198.51.100.7\n" +
+		"2001:db8::/32\n" +
+		"bad\n"
+
+	nets := parseIPBlocklist([]byte(data))
+	require.Len(t, nets, 3)
+
+	assert.Equal(t, "192.0.2.0/24", nets[0].String())
+	assert.Equal(t, "198.51.100.7/32", nets[1].String())
+	assert.Equal(t, "2001:db8::/32", nets[2].String())
+}
+
+func TestIPRangeSet_match(t *testing.T) {
+	nets := parseIPBlocklist([]byte("10.0.0.0/8\n10.1.0.0/16\n192.0.2.1\n2001:db8::/32\n"))
+	s := newIPRangeSet(nets)
+
+	// The nested network is dropped.
+	require.Len(t, s, 3)
+
+	testCases := []struct {
+		ip   net.IP
+		want string
+	}{{
+		ip:   net.IP{10, 1, 2, 3},
+		want: "10.0.0.0/8",
+	}, {
+		ip:   net.IP{10, 255, 255, 255},
+		want: "10.0.0.0/8",
+	}, {
+		ip:   net.IP{192, 0, 2, 1},
+		want: "192.0.2.1/32",
+	}, {
+		ip:   net.IP{192, 0, 2, 2},
+		want: "",
+	}, {
+		ip:   net.IP{9, 255, 255, 255},
+		want: "",
+	}, {
+		ip:   net.ParseIP("2001:db8:1::1"),
+		want: "2001:db8::/32",
+	}, {
+		ip:   net.ParseIP("2001:db9::1"),
+		want: "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.ip.String(), func(t *testing.T) {
+			n := s.match(tc.ip)
+			if tc.want == "" {
+				assert.Nil(t, n)
+
+				return
+			}
+
+			require.NotNil(t, n)
+
+			assert.Equal(t, tc.want, n.String())
+		})
+	}
+}
+
+func TestDNSFilter_updateIPBlocklists(t *testing.T) {
+	fail := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		_, _ = w.Write([]byte("192.0.2.0/24\n"))
+	}))
+	t.Cleanup(srv.Close)
+
+	d := &DNSFilter{}
+	lists := []IPBlocklist{{
+		Name:    "sinkholes",
+		URL:     srv.URL,
+		Enabled: true,
+	}, {
+		Name:    "disabled",
+		URL:     srv.URL + "/other",
+		Enabled: false,
+	}}
+	lastGood := map[string][]*net.IPNet{}
+
+	ip := net.IP{192, 0, 2, 1}
+	static := &net.IPNet{IP: net.IP{198, 51, 100, 0}, Mask: net.CIDRMask(24, 32)}
+
+	d.SetBlockedAnswerNets([]*net.IPNet{static})
+	d.updateIPBlocklists(lists, lastGood)
+
+	n := d.MatchAnswerIP(ip)
+	require.NotNil(t, n)
+
+	assert.Equal(t, "192.0.2.0/24", n.String())
+
+	// The static networks are kept along with the ones from the lists.
+	assert.Equal(t, static, d.MatchAnswerIP(net.IP{198, 51, 100, 1}))
+
+	// The failed update keeps the previous networks.
+	fail = true
+	d.updateIPBlocklists(lists, lastGood)
+
+	assert.NotNil(t, d.MatchAnswerIP(ip))
+
+	// The lists are kept when the static networks change.
+	d.SetBlockedAnswerNets(nil)
+
+	assert.NotNil(t, d.MatchAnswerIP(ip))
+	assert.Nil(t, d.MatchAnswerIP(net.IP{198, 51, 100, 1}))
+	assert.Nil(t, d.MatchAnswerIP(net.IP{203, 0, 113, 1}))
+}
@@ -0,0 +1,97 @@
+package filtering
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/schedule"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// listSchedsIvl is the interval between the checks of the schedules of the
+// filter lists.  The schedules have a resolution of one minute.
+const listSchedsIvl = 1 * time.Minute
+
+// newListScheds parses the schedules of the filter lists from filters.  scheds
+// is nil if none of the lists have a schedule.
+func newListScheds(filters ...[]Filter) (scheds map[int64]*schedule.Interval, err error) {
+	for _, fs := range filters {
+		for _, f := range fs {
+			if f.Schedule == nil {
+				continue
+			}
+
+			var ivl *schedule.Interval
+			ivl, err = schedule.New(f.Schedule)
+			if err != nil {
+				return nil, fmt.Errorf("filter list %d: schedule: %w", f.ID, err)
+			}
+
+			if scheds == nil {
+				scheds = map[int64]*schedule.Interval{}
+			}
+
+			scheds[f.ID] = ivl
+		}
+	}
+
+	return scheds, nil
+}
+
+// listActive returns true if the filter list with id is active at now
+// according to scheds.
+func listActive(scheds map[int64]*schedule.Interval, id int64, now time.Time) (ok bool) {
+	ivl, ok := scheds[id]
+
+	return !ok || ivl.Contains(now)
+}
+
+// activeFilters returns the filters, which are active at now according to
+// scheds.  filters is returned as is if none of them have a schedule.
+func activeFilters(filters []Filter, scheds map[int64]*schedule.Interval, now time.Time) (active []Filter) {
+	if len(scheds) == 0 {
+		return filters
+	}
+
+	active = make([]Filter, 0, len(filters))
+	for _, f := range filters {
+		if listActive(scheds, f.ID, now) {
+			active = append(active, f)
+		}
+	}
+
+	return active
+}
+
+// activeListsKey returns the key of the set of the scheduled filter lists,
+// which are active at now.
+func activeListsKey(scheds map[int64]*schedule.Interval, now time.Time) (key string) {
+	var ids []int64
+	for id, ivl := range scheds {
+		if ivl.Contains(now) {
+			ids = append(ids, id)
+		}
+	}
+
+	return listSetKey(ids)
+}
+
+// rebuildOnSchedule rebuilds the filtering engines if a scheduled filter list
+// has become active or inactive since the last build.
+func (d *DNSFilter) rebuildOnSchedule(now time.Time) {
+	d.engineLock.RLock()
+	changed := len(d.listScheds) > 0 && activeListsKey(d.listScheds, now) != d.activeLists
+	allowFilters, blockFilters := d.allowFilters, d.allBlockFilters
+	d.engineLock.RUnlock()
+
+	if !changed {
+		return
+	}
+
+	log.Debug("filtering: scheduled filter lists changed, rebuilding engines")
+
+	err := d.initFiltering(allowFilters, blockFilters, now)
+	if err != nil {
+		log.Error("filtering: rebuilding engines on schedule: %s", err)
+	}
+}
@@ -0,0 +1,157 @@
+package filtering
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/schedule"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSFilter_initFiltering_schedule(t *testing.T) {
+	const schedID = 1
+
+	allowFilters := []Filter{{
+		ID:   2,
+		Data: []byte("@@||allowed.example^\n"),
+		Schedule: &schedule.Config{
+			Start: "18:00",
+			End:   "22:00",
+		},
+	}}
+	blockFilters := []Filter{{
+		ID:   CustomListID,
+		Data: []byte("||custom.example^\n"),
+	}, {
+		ID:   schedID,
+		Data: []byte("||sched.example^\n||allowed.example^\n"),
+		Schedule: &schedule.Config{
+			Days:  []string{"mon", "tue", "wed", "thu", "fri"},
+			Start: "09:00",
+			End:   "17:00",
+		},
+	}, {
+		ID:   3,
+		Data: []byte("||always.example^\n"),
+	}}
+
+	// 2021-01-04 is a Monday.
+	workTime := time.Date(2021, 1, 4, 10, 0, 0, 0, time.Local)
+	evening := time.Date(2021, 1, 4, 20, 0, 0, 0, time.Local)
+	weekend := time.Date(2021, 1, 9, 10, 0, 0, 0, time.Local)
+
+	testCases := []struct {
+		now         time.Time
+		name        string
+		wantBlocked []string
+		wantAllowed []string
+	}{{
+		now:         workTime,
+		name:        "work_time",
+		wantBlocked: []string{"custom.example", "sched.example", "allowed.example", "always.example"},
+		wantAllowed: nil,
+	}, {
+		now:         evening,
+		name:        "evening",
+		wantBlocked: []string{"custom.example", "always.example"},
+		wantAllowed: []string{"sched.example", "allowed.example"},
+	}, {
+		now:         weekend,
+		name:        "weekend",
+		wantBlocked: []string{"custom.example", "always.example"},
+		wantAllowed: []string{"sched.example", "allowed.example"},
+	}}
+
+	d := newForTest(t, nil, nil)
+	t.Cleanup(d.Close)
+
+	s := setts
+	check := func(t *testing.T, host string, want bool) {
+		t.Helper()
+
+		res, err := d.CheckHost(host, dns.TypeA, &s)
+		require.NoError(t, err)
+
+		assert.Equalf(t, want, res.IsFiltered, "host %q", host)
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := d.initFiltering(allowFilters, blockFilters, tc.now)
+			require.NoError(t, err)
+
+			for _, host := range tc.wantBlocked {
+				check(t, host, true)
+			}
+
+			for _, host := range tc.wantAllowed {
+				check(t, host, false)
+			}
+		})
+	}
+
+	t.Run("filter_list_ids", func(t *testing.T) {
+		err := d.initFiltering(allowFilters, blockFilters, evening)
+		require.NoError(t, err)
+
+		s.FilterListIDs = []int64{schedID}
+		t.Cleanup(func() { s.FilterListIDs = nil })
+
+		check(t, "custom.example", true)
+		check(t, "sched.example", false)
+	})
+}
+
+func TestDNSFilter_rebuildOnSchedule(t *testing.T) {
+	blockFilters := []Filter{{
+		ID:   1,
+		Data: []byte("||sched.example^\n"),
+		Schedule: &schedule.Config{
+			Start: "09:00",
+			End:   "17:00",
+		},
+	}}
+
+	// 2021-01-04 is a Monday.
+	morning := time.Date(2021, 1, 4, 8, 59, 0, 0, time.Local)
+	start := time.Date(2021, 1, 4, 9, 0, 0, 0, time.Local)
+	end := time.Date(2021, 1, 4, 17, 0, 0, 0, time.Local)
+
+	d := newForTest(t, nil, nil)
+	t.Cleanup(d.Close)
+
+	err := d.initFiltering(nil, blockFilters, morning)
+	require.NoError(t, err)
+
+	s := setts
+	isBlocked := func() (ok bool) {
+		res, cErr := d.CheckHost("sched.example", dns.TypeA, &s)
+		require.NoError(t, cErr)
+
+		return res.IsFiltered
+	}
+
+	require.False(t, isBlocked())
+
+	d.rebuildOnSchedule(start)
+	assert.True(t, isBlocked())
+
+	engine := d.filteringEngine
+	d.rebuildOnSchedule(start.Add(time.Hour))
+	assert.Same(t, engine, d.filteringEngine)
+
+	d.rebuildOnSchedule(end)
+	assert.False(t, isBlocked())
+}
+
+func TestNewListScheds_bad(t *testing.T) {
+	_, err := newListScheds([]Filter{{
+		ID:       3,
+		Schedule: &schedule.Config{Start: "09:00", End: "09:00"},
+	}})
+	require.Error(t, err)
+
+	assert.Equal(t, "filter list 3: schedule: empty interval", err.Error())
+}
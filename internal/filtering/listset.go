@@ -0,0 +1,108 @@
+package filtering
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/urlfilter"
+	"github.com/AdguardTeam/urlfilter/filterlist"
+)
+
+// listSetEngine is a filtering engine built from the custom filtering rules
+// and a subset of the blocklists, see Settings.FilterListIDs.  Building
+// separate engines is necessary, since an engine only returns the most
+// important of the matching rules, which may come from a list outside of the
+// subset and hide the rules of the lists within it.
+type listSetEngine struct {
+	storage *filterlist.RuleStorage
+	engine  *urlfilter.DNSEngine
+}
+
+// listSetKey returns the key of the set of the blocklists with ids.
+func listSetKey(ids []int64) (key string) {
+	sorted := make([]int64, len(ids))
+	copy(sorted, ids)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	b := &strings.Builder{}
+	for i, id := range sorted {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+
+		b.WriteString(strconv.FormatInt(id, 10))
+	}
+
+	return b.String()
+}
+
+// engineFor returns the filtering engine for the custom filtering rules and
+// the blocklists with ids, building it if necessary.  ids must not be empty.
+// d.engineLock is expected to be locked for reading.
+func (d *DNSFilter) engineFor(ids []int64) (e *urlfilter.DNSEngine, err error) {
+	key := listSetKey(ids)
+
+	d.listSetEnginesLock.Lock()
+	defer d.listSetEnginesLock.Unlock()
+
+	if lse, ok := d.listSetEngines[key]; ok {
+		return lse.engine, nil
+	}
+
+	selected := make([]Filter, 0, len(ids)+1)
+	for _, f := range d.blockFilters {
+		if f.ID == CustomListID || containsID(ids, f.ID) {
+			selected = append(selected, f)
+		}
+	}
+
+	rs, err := newRuleStorage(selected)
+	if err != nil {
+		return nil, fmt.Errorf("filter lists %s: %w", key, err)
+	}
+
+	lse := &listSetEngine{
+		storage: rs,
+		engine:  urlfilter.NewDNSEngine(rs),
+	}
+
+	if d.listSetEngines == nil {
+		d.listSetEngines = map[string]*listSetEngine{}
+	}
+
+	d.listSetEngines[key] = lse
+
+	log.Debug("filtering: built engine for filter lists %s", key)
+
+	return lse.engine, nil
+}
+
+// containsID returns true if ids contains id.
+func containsID(ids []int64, id int64) (ok bool) {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resetListSetEngines closes and removes the engines of the blocklist sets.
+// d.engineLock is expected to be locked for writing.
+func (d *DNSFilter) resetListSetEngines() {
+	d.listSetEnginesLock.Lock()
+	defer d.listSetEnginesLock.Unlock()
+
+	for key, lse := range d.listSetEngines {
+		err := lse.storage.Close()
+		if err != nil {
+			log.Error("filtering: closing engine for filter lists %s: %s", key, err)
+		}
+	}
+
+	d.listSetEngines = nil
+}
@@ -4,8 +4,10 @@ package filtering
 
 import (
 	"encoding/json"
+	"fmt"
 	"net"
 	"net/http"
+	"regexp"
 	"sort"
 	"strings"
 
@@ -16,18 +18,42 @@ import (
 
 // RewriteEntry is a rewrite array element
 type RewriteEntry struct {
-	// Domain is the domain for which this rewrite should work.
+	// re is the compiled regular expression, if Domain is one.
+	re *regexp.Regexp
+
+	// Domain is the domain for which this rewrite should work.  It's either
+	// a domain name, a wildcard like "*.example.com", or a regular
+	// expression between slashes like "/^(.*)\.lab$/".
 	Domain string `yaml:"domain"`
-	// Answer is the IP address, canonical name, or one of the special
-	// values: "A" or "AAAA".
+	// Answer is the IP address, canonical name, one of the special values:
+	// "A" or "AAAA", or a record of one of the rewriteRRTypes in the master
+	// file format without the owner, like "SRV 10 60 5060 sip.example.com".
+	// If Domain is a wildcard, each "*" in Answer is
+	// replaced with the labels of the host matched by the wildcard.  If
+	// Domain is a regular expression, Answer may refer to its capture
+	// groups, like "$1.internal" or "${name}.internal".
 	Answer string `yaml:"answer"`
 	// IP is the IP address that should be used in the response if Type is
 	// A or AAAA.
 	IP net.IP `yaml:"-"`
-	// Type is the DNS record type: A, AAAA, or CNAME.
+	// RR is the record that should be used in the response if Type is one
+	// of the rewriteRRTypes.
+	RR dns.RR `yaml:"-"`
+	// Type is the DNS record type: A, AAAA, CNAME, or one of the
+	// rewriteRRTypes.  It's zero if Answer is invalid.
 	Type uint16 `yaml:"-"`
 }
 
+// rewriteRRTypes are the types of the records, which the rewrites can answer
+// with in addition to A, AAAA, and CNAME.
+var rewriteRRTypes = map[string]uint16{
+	"HTTPS": dns.TypeHTTPS,
+	"MX":    dns.TypeMX,
+	"SRV":   dns.TypeSRV,
+	"SVCB":  dns.TypeSVCB,
+	"TXT":   dns.TypeTXT,
+}
+
 // equal returns true if the entry is considered equal to the other.
 func (e *RewriteEntry) equal(other RewriteEntry) (ok bool) {
 	return e.Domain == other.Domain && e.Answer == other.Answer
@@ -35,49 +61,80 @@ func (e *RewriteEntry) equal(other RewriteEntry) (ok bool) {
 
 // matchesQType returns true if the entry matched qtype.
 func (e *RewriteEntry) matchesQType(qtype uint16) (ok bool) {
-	// Add CNAMEs, since they match for all types requests.
-	if e.Type == dns.TypeCNAME {
+	switch e.Type {
+	case dns.TypeCNAME:
+		// Add CNAMEs, since they match for all types requests.
 		return true
-	}
+	case dns.TypeA, dns.TypeAAAA:
+		// Reject types other than A and AAAA.
+		if qtype != dns.TypeA && qtype != dns.TypeAAAA {
+			return false
+		}
 
-	// Reject types other than A and AAAA.
-	if qtype != dns.TypeA && qtype != dns.TypeAAAA {
-		return false
+		// If the types match or the entry is set to allow only the
+		// other type, include them.
+		return e.Type == qtype || e.IP == nil
+	default:
+		return e.Type == qtype
 	}
-
-	// If the types match or the entry is set to allow only the other type,
-	// include them.
-	return e.Type == qtype || e.IP == nil
 }
 
 // normalize makes sure that the a new or decoded entry is normalized with
-// regards to domain name case, IP length, and so on.
-func (e *RewriteEntry) normalize() {
-	// TODO(a.garipov): Write a case-agnostic version of strings.HasSuffix
-	// and use it in matchDomainWildcard instead of using strings.ToLower
-	// everywhere.
-	e.Domain = strings.ToLower(e.Domain)
+// regards to domain name case, IP length, and so on.  err is only returned if
+// the domain is an invalid regular expression or the answer is an invalid
+// record.
+func (e *RewriteEntry) normalize() (err error) {
+	e.re = nil
+	if isRegexpRewrite(e.Domain) {
+		// Don't lowercase the regular expression, since that could change
+		// its meaning, like with "\D".
+		e.re, err = regexp.Compile("(?i)" + e.Domain[1:len(e.Domain)-1])
+		if err != nil {
+			return fmt.Errorf("bad regexp: %w", err)
+		}
+	} else {
+		// TODO(a.garipov): Write a case-agnostic version of
+		// strings.HasSuffix and use it in matchDomainWildcard instead of
+		// using strings.ToLower everywhere.
+		e.Domain = strings.ToLower(e.Domain)
+	}
+
+	err = e.normalizeAnswer()
+	if err != nil {
+		return fmt.Errorf("bad answer: %w", err)
+	}
+
+	return nil
+}
 
+// normalizeAnswer sets the type, the IP address, and the record of the entry
+// from its answer.
+func (e *RewriteEntry) normalizeAnswer() (err error) {
+	e.IP, e.RR = nil, nil
 	switch e.Answer {
 	case "AAAA":
-		e.IP = nil
 		e.Type = dns.TypeAAAA
 
-		return
+		return nil
 	case "A":
-		e.IP = nil
 		e.Type = dns.TypeA
 
-		return
+		return nil
 	default:
 		// Go on.
 	}
 
+	// Domain names can't contain spaces, so the answers with them are
+	// records.
+	if i := strings.IndexByte(e.Answer, ' '); i >= 0 {
+		return e.normalizeRR(e.Answer[:i], e.Answer[i+1:])
+	}
+
 	ip := net.ParseIP(e.Answer)
 	if ip == nil {
 		e.Type = dns.TypeCNAME
 
-		return
+		return nil
 	}
 
 	ip4 := ip.To4()
@@ -88,6 +145,91 @@ func (e *RewriteEntry) normalize() {
 		e.IP = ip
 		e.Type = dns.TypeAAAA
 	}
+
+	return nil
+}
+
+// normalizeRR sets the type and the record of the entry from the type and the
+// data of the record.
+func (e *RewriteEntry) normalizeRR(typ, rdata string) (err error) {
+	e.Type = 0
+
+	qtype, ok := rewriteRRTypes[strings.ToUpper(typ)]
+	if !ok {
+		return fmt.Errorf("record type %q not supported", typ)
+	}
+
+	// Use the root as the owner, since it's replaced with the requested
+	// host in the response anyway.  The relative names within rdata become
+	// absolute as well.
+	rr, err := dns.NewRR(". IN " + dns.TypeToString[qtype] + " " + rdata)
+	if err != nil {
+		return err
+	} else if rr == nil {
+		return fmt.Errorf("no data for %s record", typ)
+	}
+
+	e.RR, e.Type = rr, qtype
+
+	return nil
+}
+
+// expand returns the entry for host with the answer generated from the
+// patterns of e, if any.  ok is false if host doesn't match e.
+func (e *RewriteEntry) expand(host string) (exp RewriteEntry, ok bool) {
+	switch {
+	case e.re != nil:
+		m := e.re.FindStringSubmatchIndex(host)
+		if m == nil {
+			return exp, false
+		}
+
+		exp = RewriteEntry{
+			Domain: e.Domain,
+			Answer: string(e.re.ExpandString(nil, e.Answer, host, m)),
+		}
+	case e.Domain == host:
+		return *e, true
+	case matchDomainWildcard(host, e.Domain):
+		if !strings.Contains(e.Answer, "*") {
+			return *e, true
+		}
+
+		exp = RewriteEntry{
+			Domain: e.Domain,
+			Answer: strings.ReplaceAll(e.Answer, "*", strings.TrimSuffix(host, e.Domain[1:])),
+		}
+	default:
+		return exp, false
+	}
+
+	err := exp.normalizeAnswer()
+	if err != nil {
+		log.Debug("rewrite: entry for %q: answer for %q: %s", e.Domain, host, err)
+
+		return exp, false
+	}
+
+	return exp, true
+}
+
+// isRegexpRewrite returns true if domain is a regular expression between
+// slashes.
+func isRegexpRewrite(domain string) (ok bool) {
+	return len(domain) > 2 && domain[0] == '/' && domain[len(domain)-1] == '/'
+}
+
+// rewriteRank returns the rank of the domain of a rewrite entry for sorting:
+// exact domains first, then wildcards, and then regular expressions.
+func rewriteRank(domain string) (rank int) {
+	switch {
+	case isRegexpRewrite(domain):
+		return 2
+	case isWildcard(domain):
+		return 1
+	default:
+		return 0
+	}
 }
 
 func isWildcard(host string) bool {
@@ -104,7 +246,7 @@ func matchDomainWildcard(host, wildcard string) (ok bool) {
 // The sorting priority:
 //
 //   A and AAAA > CNAME
-//   wildcard > exact
+//   regexp > wildcard > exact
 //   lower level wildcard > higher level wildcard
 //
 type rewritesSorted []RewriteEntry
@@ -123,34 +265,48 @@ func (a rewritesSorted) Less(i, j int) bool {
 		return false
 	}
 
-	if isWildcard(a[i].Domain) {
-		if !isWildcard(a[j].Domain) {
-			return false
-		}
-	} else {
-		if isWildcard(a[j].Domain) {
-			return true
-		}
+	if ri, rj := rewriteRank(a[i].Domain), rewriteRank(a[j].Domain); ri != rj {
+		return ri < rj
 	}
 
-	// both are wildcards
+	// both are of the same kind
 	return len(a[i].Domain) > len(a[j].Domain)
 }
 
 func (d *DNSFilter) prepareRewrites() {
 	for i := range d.Rewrites {
-		d.Rewrites[i].normalize()
+		err := d.Rewrites[i].normalize()
+		if err != nil {
+			// The entry with a nil re never matches, so keep it for
+			// the user to fix it.
+			log.Error("rewrite: entry for %q: %s", d.Rewrites[i].Domain, err)
+		}
 	}
 }
 
+// NormalizeRewrites normalizes entries, so that they can be used as the
+// rewrites of a view.  Unlike the global rewrites, the invalid entries are
+// reported as errors.
+func NormalizeRewrites(entries []RewriteEntry) (err error) {
+	for i := range entries {
+		err = entries[i].normalize()
+		if err != nil {
+			return fmt.Errorf("rewrite at index %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
 // findRewrites returns the list of matched rewrite entries.  The priority is:
 // CNAME, then A and AAAA; exact, then wildcard.  If the host is matched
 // exactly, wildcard entries aren't returned.  If the host matched by wildcards,
 // return the most specific for the question type.
 func findRewrites(entries []RewriteEntry, host string, qtype uint16) (matched []RewriteEntry) {
 	rr := rewritesSorted{}
-	for _, e := range entries {
-		if e.Domain != host && !matchDomainWildcard(host, e.Domain) {
+	for i := range entries {
+		e, ok := entries[i].expand(host)
+		if !ok {
 			continue
 		}
 
@@ -166,7 +322,7 @@ func findRewrites(entries []RewriteEntry, host string, qtype uint16) (matched []
 	sort.Sort(rr)
 
 	for i, r := range rr {
-		if isWildcard(r.Domain) {
+		if rewriteRank(r.Domain) > 0 {
 			// Don't use rr[:0], because we need to return at least
 			// one item here.
 			rr = rr[:max(1, i)]
@@ -178,6 +334,58 @@ func findRewrites(entries []RewriteEntry, host string, qtype uint16) (matched []
 	return rr
 }
 
+// RewriteRecords returns the records of the rewrites of the names within zone,
+// which must be a lowercased FQDN, with ttl.  The rewrites with the regular
+// expressions, the wildcard ones with the patterns in the answers, and the
+// exceptions are skipped, since they can't be expressed as records.
+func (d *DNSFilter) RewriteRecords(zone string, ttl uint32) (rrs []dns.RR) {
+	d.confLock.RLock()
+	defer d.confLock.RUnlock()
+
+	for _, e := range d.Rewrites {
+		if e.re != nil || isRegexpRewrite(e.Domain) || e.Type == 0 {
+			continue
+		} else if isWildcard(e.Domain) && strings.Contains(e.Answer, "*") {
+			continue
+		} else if e.IP == nil && (e.Type == dns.TypeA || e.Type == dns.TypeAAAA) {
+			continue
+		}
+
+		name := dns.Fqdn(e.Domain)
+		if !dns.IsSubDomain(zone, name) {
+			continue
+		}
+
+		hdr := dns.RR_Header{
+			Name:   name,
+			Rrtype: e.Type,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		}
+
+		var rr dns.RR
+		switch e.Type {
+		case dns.TypeA:
+			rr = &dns.A{Hdr: hdr, A: e.IP}
+		case dns.TypeAAAA:
+			rr = &dns.AAAA{Hdr: hdr, AAAA: e.IP}
+		case dns.TypeCNAME:
+			rr = &dns.CNAME{Hdr: hdr, Target: dns.Fqdn(e.Answer)}
+		default:
+			if e.RR == nil {
+				continue
+			}
+
+			rr = dns.Copy(e.RR)
+			*rr.Header() = hdr
+		}
+
+		rrs = append(rrs, rr)
+	}
+
+	return rrs
+}
+
 func max(a, b int) int {
 	if a > b {
 		return a
@@ -226,7 +434,13 @@ func (d *DNSFilter) handleRewriteAdd(w http.ResponseWriter, r *http.Request) {
 		Domain: jsent.Domain,
 		Answer: jsent.Answer,
 	}
-	ent.normalize()
+	err = ent.normalize()
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
 	d.confLock.Lock()
 	d.Config.Rewrites = append(d.Config.Rewrites, ent)
 	d.confLock.Unlock()
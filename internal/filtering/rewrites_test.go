@@ -4,6 +4,7 @@ import (
 	"net"
 	"testing"
 
+	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -339,3 +340,225 @@ func TestRewritesExceptionIP(t *testing.T) {
 		})
 	}
 }
+
+func TestRewritesPatterns(t *testing.T) {
+	d := newForTest(t, nil, nil)
+	t.Cleanup(d.Close)
+
+	d.Rewrites = []RewriteEntry{{
+		Domain: "*.dev.example.com",
+		Answer: "*.internal",
+	}, {
+		Domain: "a.internal",
+		Answer: "10.0.0.1",
+	}, {
+		Domain: `/^host-(\d+)\.lab$/`,
+		Answer: "10.0.1.$1",
+	}, {
+		Domain: `/^(.*)\.corp$/`,
+		Answer: "${1}.internal",
+	}, {
+		Domain: "exact.corp",
+		Answer: "a.internal",
+	}, {
+		Domain: `/^(.*)\.loop$/`,
+		Answer: "a.$1.loop",
+	}, {
+		Domain: "/(/",
+		Answer: "10.0.3.1",
+	}}
+	d.prepareRewrites()
+
+	testCases := []struct {
+		name      string
+		host      string
+		wantCName string
+		wantVals  []net.IP
+	}{{
+		name:      "wildcard_substitution",
+		host:      "a.dev.example.com",
+		wantCName: "a.internal",
+		wantVals:  []net.IP{{10, 0, 0, 1}},
+	}, {
+		name:      "wildcard_substitution_levels",
+		host:      "b.a.dev.example.com",
+		wantCName: "b.a.internal",
+		wantVals:  nil,
+	}, {
+		name:      "regexp_ip",
+		host:      "host-42.lab",
+		wantCName: "",
+		wantVals:  []net.IP{{10, 0, 1, 42}},
+	}, {
+		name:      "regexp_cname",
+		host:      "a.corp",
+		wantCName: "a.internal",
+		wantVals:  []net.IP{{10, 0, 0, 1}},
+	}, {
+		name:      "regexp_case",
+		host:      "HOST-7.LAB",
+		wantCName: "",
+		wantVals:  []net.IP{{10, 0, 1, 7}},
+	}, {
+		name:      "exact_over_regexp",
+		host:      "exact.corp",
+		wantCName: "a.internal",
+		wantVals:  []net.IP{{10, 0, 0, 1}},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := d.processRewrites(tc.host, dns.TypeA)
+			require.Equalf(t, Rewritten, r.Reason, "got %s", r.Reason)
+
+			assert.Equal(t, tc.wantCName, r.CanonName)
+			assert.Equal(t, tc.wantVals, r.IPList)
+		})
+	}
+
+	t.Run("endless_cnames", func(t *testing.T) {
+		r := d.processRewrites("x.loop", dns.TypeA)
+		assert.Empty(t, r.IPList)
+	})
+
+	t.Run("bad_regexp", func(t *testing.T) {
+		e := &RewriteEntry{Domain: "/(/", Answer: "10.0.3.1"}
+		assert.Error(t, e.normalize())
+	})
+}
+
+func TestRewritesRecords(t *testing.T) {
+	d := newForTest(t, nil, nil)
+	t.Cleanup(d.Close)
+
+	d.Rewrites = []RewriteEntry{{
+		Domain: "_sip._udp.example.lan",
+		Answer: "SRV 10 60 5060 sip",
+	}, {
+		Domain: "_sip._udp.example.lan",
+		Answer: "10.0.0.1",
+	}, {
+		Domain: "example.lan",
+		Answer: "mx 10 mail.example.lan",
+	}, {
+		Domain: "example.lan",
+		Answer: `TXT "v=spf1 -all"`,
+	}, {
+		Domain: "*.svc.lan",
+		Answer: "HTTPS 1 *.backend.lan alpn=h2",
+	}, {
+		Domain: "alias.lan",
+		Answer: "example.lan",
+	}}
+	d.prepareRewrites()
+
+	testCases := []struct {
+		name      string
+		host      string
+		wantCName string
+		want      []string
+		qtype     uint16
+	}{{
+		name:      "srv",
+		host:      "_sip._udp.example.lan",
+		wantCName: "",
+		want:      []string{".\t3600\tIN\tSRV\t10 60 5060 sip."},
+		qtype:     dns.TypeSRV,
+	}, {
+		name:      "mx",
+		host:      "example.lan",
+		wantCName: "",
+		want:      []string{".\t3600\tIN\tMX\t10 mail.example.lan."},
+		qtype:     dns.TypeMX,
+	}, {
+		name:      "txt",
+		host:      "example.lan",
+		wantCName: "",
+		want:      []string{".\t3600\tIN\tTXT\t\"v=spf1 -all\""},
+		qtype:     dns.TypeTXT,
+	}, {
+		name:      "https_wildcard",
+		host:      "web.svc.lan",
+		wantCName: "",
+		want:      []string{".\t3600\tIN\tHTTPS\t1 web.backend.lan. alpn=\"h2\""},
+		qtype:     dns.TypeHTTPS,
+	}, {
+		name:      "cname",
+		host:      "alias.lan",
+		wantCName: "example.lan",
+		want:      []string{".\t3600\tIN\tMX\t10 mail.example.lan."},
+		qtype:     dns.TypeMX,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := d.processRewrites(tc.host, tc.qtype)
+			require.Equalf(t, Rewritten, r.Reason, "got %s", r.Reason)
+
+			assert.Equal(t, tc.wantCName, r.CanonName)
+			assert.Empty(t, r.IPList)
+
+			var got []string
+			for _, rr := range r.Records {
+				got = append(got, rr.String())
+			}
+
+			assert.Equal(t, tc.want, got)
+		})
+	}
+
+	t.Run("other_type", func(t *testing.T) {
+		r := d.processRewrites("_sip._udp.example.lan", dns.TypeA)
+		require.Equal(t, Rewritten, r.Reason)
+
+		assert.Empty(t, r.Records)
+		assert.Equal(t, []net.IP{{10, 0, 0, 1}}, r.IPList)
+	})
+
+	t.Run("bad_records", func(t *testing.T) {
+		for _, answer := range []string{"SRV 10 sip", "NS ns.example.lan", "MX 10"} {
+			e := &RewriteEntry{Domain: "example.lan", Answer: answer}
+			assert.Errorf(t, e.normalize(), "answer %q", answer)
+		}
+	})
+}
+
+func TestDNSFilter_CheckHost_viewRewrites(t *testing.T) {
+	d := newForTest(t, nil, nil)
+	t.Cleanup(d.Close)
+
+	d.Rewrites = []RewriteEntry{{
+		Domain: "nas.example",
+		Answer: "203.0.113.2",
+	}, {
+		Domain: "www.example",
+		Answer: "203.0.113.3",
+	}}
+	d.prepareRewrites()
+
+	viewRewrites := []RewriteEntry{{
+		Domain: "nas.example",
+		Answer: "192.168.1.2",
+	}}
+	require.NoError(t, NormalizeRewrites(viewRewrites))
+
+	setts := &Settings{
+		FilteringEnabled: true,
+		ViewRewrites:     viewRewrites,
+	}
+
+	res, err := d.CheckHost("nas.example", dns.TypeA, setts)
+	require.NoError(t, err)
+	require.Len(t, res.IPList, 1)
+
+	assert.Equal(t, net.IP{192, 168, 1, 2}, res.IPList[0].To4())
+
+	res, err = d.CheckHost("www.example", dns.TypeA, setts)
+	require.NoError(t, err)
+	require.Len(t, res.IPList, 1)
+
+	assert.Equal(t, net.IP{203, 0, 113, 3}, res.IPList[0].To4())
+
+	err = NormalizeRewrites([]RewriteEntry{viewRewrites[0], {Domain: "bad.example", Answer: "NAPTR x"}})
+	testutil.AssertErrorMsg(t, `rewrite at index 1: bad answer: record type "NAPTR" not supported`, err)
+}
@@ -365,8 +365,9 @@ func (a *Auth) httpCookie(req loginJSON, addr string) (cookie string, err error)
 	})
 
 	return fmt.Sprintf(
-		"%s=%s; Path=/; HttpOnly; Expires=%s",
+		"%s=%s; Path=%s; HttpOnly; Expires=%s",
 		sessionCookieName, hex.EncodeToString(sess),
+		webPath("/"),
 		cookieExpiryFormat(now.Add(cookieTTL)),
 	), nil
 }
@@ -491,10 +492,10 @@ func handleLogout(w http.ResponseWriter, r *http.Request) {
 
 	Context.auth.RemoveSession(sess)
 
-	w.Header().Set("Location", "/login.html")
+	w.Header().Set("Location", webPath("/login.html"))
 
-	s := fmt.Sprintf("%s=; Path=/; HttpOnly; Expires=Thu, 01 Jan 1970 00:00:00 GMT",
-		sessionCookieName)
+	s := fmt.Sprintf("%s=; Path=%s; HttpOnly; Expires=Thu, 01 Jan 1970 00:00:00 GMT",
+		sessionCookieName, webPath("/"))
 	w.Header().Set("Set-Cookie", s)
 
 	w.WriteHeader(http.StatusFound)
@@ -556,7 +557,7 @@ func optionalAuthThird(w http.ResponseWriter, r *http.Request) (authFirst bool)
 			if glProcessRedirect(w, r) {
 				log.Debug("auth: redirected to login page by GL-Inet submodule")
 			} else {
-				w.Header().Set("Location", "/login.html")
+				w.Header().Set("Location", webPath("/login.html"))
 				w.WriteHeader(http.StatusFound)
 			}
 		} else {
@@ -578,7 +579,7 @@ func optionalAuth(handler func(http.ResponseWriter, *http.Request)) func(http.Re
 			if authRequired && err == nil {
 				r := Context.auth.checkSession(cookie.Value)
 				if r == checkSessionOK {
-					w.Header().Set("Location", "/")
+					w.Header().Set("Location", webPath("/"))
 					w.WriteHeader(http.StatusFound)
 
 					return
@@ -633,6 +634,153 @@ func (a *Auth) UserAdd(u *User, password string) {
 	log.Debug("auth: added user: %s", u.Name)
 }
 
+// setUsers replaces the users with users and returns the previous ones.  The
+// sessions of the removed users and of the users with changed passwords are
+// removed.
+func (a *Auth) setUsers(users []User) (prev []User) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	prev, a.users = a.users, users
+
+	prevHashes := make(map[string]string, len(prev))
+	for _, u := range prev {
+		prevHashes[u.Name] = u.PasswordHash
+	}
+
+	hashes := make(map[string]string, len(users))
+	for _, u := range users {
+		hashes[u.Name] = u.PasswordHash
+	}
+
+	for sess, s := range a.sessions {
+		if hash, ok := hashes[s.userName]; ok && hash == prevHashes[s.userName] {
+			continue
+		}
+
+		delete(a.sessions, sess)
+		key, _ := hex.DecodeString(sess)
+		a.removeSession(key)
+	}
+
+	log.Debug("auth: set %d users", len(users))
+
+	return prev
+}
+
+// userJSON is the JSON structure for a user of the web interface.
+type userJSON struct {
+	Name string `json:"name"`
+
+	// Password is the new password of the user.  It's never sent to the
+	// clients.  If it's empty, the password of an existing user isn't
+	// changed.
+	Password string `json:"password,omitempty"`
+}
+
+// usersJSON is the JSON structure for the users of the web interface.
+type usersJSON struct {
+	Users []userJSON `json:"users"`
+
+	// Provisional, if true, means that the new users must be reverted unless
+	// the change is confirmed within defaultConfirmTimeout.
+	Provisional bool `json:"provisional,omitempty"`
+}
+
+// newUsers returns the users from reqs.  The passwords of the users without
+// new ones are taken from existing.
+func newUsers(reqs []userJSON, existing []User) (users []User, err error) {
+	hashes := make(map[string]string, len(existing))
+	for _, u := range existing {
+		hashes[u.Name] = u.PasswordHash
+	}
+
+	users = make([]User, 0, len(reqs))
+	names := make(map[string]struct{}, len(reqs))
+	for i, req := range reqs {
+		if req.Name == "" {
+			return nil, fmt.Errorf("user at index %d: empty name", i)
+		} else if _, ok := names[req.Name]; ok {
+			return nil, fmt.Errorf("user at index %d: duplicate name %q", i, req.Name)
+		}
+
+		names[req.Name] = struct{}{}
+
+		u := User{Name: req.Name}
+		if req.Password == "" {
+			var ok bool
+			u.PasswordHash, ok = hashes[req.Name]
+			if !ok {
+				return nil, fmt.Errorf("user %q: no password", req.Name)
+			}
+		} else {
+			var hash []byte
+			hash, err = bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+			if err != nil {
+				return nil, fmt.Errorf("user %q: hashing password: %w", req.Name, err)
+			}
+
+			u.PasswordHash = string(hash)
+		}
+
+		users = append(users, u)
+	}
+
+	return users, nil
+}
+
+// handleGetUsers is the handler for the GET /control/users HTTP API.
+func handleGetUsers(w http.ResponseWriter, r *http.Request) {
+	users := Context.auth.GetUsers()
+	resp := usersJSON{
+		Users: make([]userJSON, 0, len(users)),
+	}
+
+	for _, u := range users {
+		resp.Users = append(resp.Users, userJSON{Name: u.Name})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "encoding response: %s", err)
+	}
+}
+
+// handleSetUsers is the handler for the POST /control/users/set HTTP API.
+func handleSetUsers(w http.ResponseWriter, r *http.Request) {
+	req := usersJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "parsing request: %s", err)
+
+		return
+	}
+
+	prev := Context.auth.GetUsers()
+	users, err := newUsers(req.Users, prev)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	if req.Provisional {
+		err = Context.confirm.begin(defaultConfirmTimeout, func() {
+			Context.auth.setUsers(prev)
+			onConfigModified()
+		})
+		if err != nil {
+			aghhttp.Error(r, w, http.StatusConflict, "%s", err)
+
+			return
+		}
+	}
+
+	Context.auth.setUsers(users)
+	onConfigModified()
+}
+
 // UserFind - find a user
 func (a *Auth) UserFind(login, password string) User {
 	a.lock.Lock()
@@ -254,3 +254,93 @@ func TestRealIP(t *testing.T) {
 		})
 	}
 }
+
+func TestAuth_setUsers(t *testing.T) {
+	a := InitAuth(filepath.Join(t.TempDir(), "sessions.db"), []User{{
+		Name:         "kept",
+		PasswordHash: "hash",
+	}, {
+		Name:         "changed",
+		PasswordHash: "hash",
+	}, {
+		Name:         "removed",
+		PasswordHash: "hash",
+	}}, 60, nil)
+	require.NotNil(t, a)
+	t.Cleanup(a.Close)
+
+	expire := uint32(time.Now().UTC().Unix() + 60)
+	sessions := map[string]string{}
+	for _, name := range []string{"kept", "changed", "removed"} {
+		sess, err := newSessionToken()
+		require.NoError(t, err)
+
+		a.addSession(sess, &session{userName: name, expire: expire})
+		sessions[name] = hex.EncodeToString(sess)
+	}
+
+	prev := a.setUsers([]User{{
+		Name:         "kept",
+		PasswordHash: "hash",
+	}, {
+		Name:         "changed",
+		PasswordHash: "new_hash",
+	}})
+	assert.Len(t, prev, 3)
+	assert.Len(t, a.GetUsers(), 2)
+
+	assert.Equal(t, checkSessionOK, a.checkSession(sessions["kept"]))
+	assert.Equal(t, checkSessionNotFound, a.checkSession(sessions["changed"]))
+	assert.Equal(t, checkSessionNotFound, a.checkSession(sessions["removed"]))
+}
+
+func TestNewUsers(t *testing.T) {
+	existing := []User{{
+		Name:         "admin",
+		PasswordHash: "hash",
+	}}
+
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		reqs       []userJSON
+	}{{
+		name:       "keep_password",
+		wantErrMsg: "",
+		reqs:       []userJSON{{Name: "admin"}},
+	}, {
+		name:       "new_user",
+		wantErrMsg: "",
+		reqs:       []userJSON{{Name: "admin"}, {Name: "user", Password: "password"}},
+	}, {
+		name:       "empty_name",
+		wantErrMsg: "user at index 0: empty name",
+		reqs:       []userJSON{{Password: "password"}},
+	}, {
+		name:       "duplicate",
+		wantErrMsg: `user at index 1: duplicate name "admin"`,
+		reqs:       []userJSON{{Name: "admin"}, {Name: "admin", Password: "password"}},
+	}, {
+		name:       "no_password",
+		wantErrMsg: `user "user": no password`,
+		reqs:       []userJSON{{Name: "user"}},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			users, err := newUsers(tc.reqs, existing)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+			if tc.wantErrMsg != "" {
+				return
+			}
+
+			require.Len(t, users, len(tc.reqs))
+
+			assert.Equal(t, "hash", users[0].PasswordHash)
+			for i, u := range users {
+				assert.Equal(t, tc.reqs[i].Name, u.Name)
+				assert.NotEmpty(t, u.PasswordHash)
+			}
+		})
+	}
+}
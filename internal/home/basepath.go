@@ -0,0 +1,76 @@
+package home
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// dohPath is the path of the DNS-over-HTTPS handler.  Unlike the web UI and
+// the control API, it's also served outside of the base path, since the
+// DNS-over-HTTPS clients expect it at the standard location.
+const dohPath = "/dns-query"
+
+// normalizeBasePath validates the base path of the web UI p and returns it
+// with the leading and the trailing slashes.  The empty p means the root.
+func normalizeBasePath(p string) (norm string, err error) {
+	if p == "" {
+		return "/", nil
+	}
+
+	u, err := url.Parse(p)
+	if err != nil {
+		return "", fmt.Errorf("bad base path %q: %w", p, err)
+	} else if u.Scheme != "" || u.Host != "" || u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("bad base path %q: must be a path only", p)
+	}
+
+	norm = path.Clean("/" + u.Path)
+	if norm != "/" {
+		norm += "/"
+	}
+
+	return norm, nil
+}
+
+// webPath returns the absolute path of the web UI resource p, which must be an
+// absolute path within the base path.
+func webPath(p string) (full string) {
+	if Context.web == nil {
+		return p
+	}
+
+	return Context.web.conf.BasePath + strings.TrimPrefix(p, "/")
+}
+
+// wrapBasePath returns a handler, which only serves the requests under the base
+// path of the web UI, with the base path stripped, and the DNS-over-HTTPS
+// requests.
+func (web *Web) wrapBasePath(h http.Handler) (wrapped http.Handler) {
+	base := web.conf.BasePath
+	if base == "/" {
+		return h
+	}
+
+	prefix := strings.TrimSuffix(base, "/")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.Path
+		switch {
+		case p == prefix:
+			u := &url.URL{Path: base, RawQuery: r.URL.RawQuery}
+			http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+		case strings.HasPrefix(p, base):
+			rr := r.Clone(r.Context())
+			rr.URL.Path = strings.TrimPrefix(p, prefix)
+			rr.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, prefix)
+			h.ServeHTTP(w, rr)
+		case p == dohPath || strings.HasPrefix(p, dohPath+"/"):
+			h.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
@@ -0,0 +1,114 @@
+package home
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeBasePath(t *testing.T) {
+	testCases := []struct {
+		name       string
+		in         string
+		want       string
+		wantErrMsg string
+	}{{
+		name:       "empty",
+		in:         "",
+		want:       "/",
+		wantErrMsg: "",
+	}, {
+		name:       "root",
+		in:         "/",
+		want:       "/",
+		wantErrMsg: "",
+	}, {
+		name:       "no_slashes",
+		in:         "adguard",
+		want:       "/adguard/",
+		wantErrMsg: "",
+	}, {
+		name:       "nested",
+		in:         "/apps//adguard/",
+		want:       "/apps/adguard/",
+		wantErrMsg: "",
+	}, {
+		name:       "url",
+		in:         "http://example.com/adguard/",
+		want:       "",
+		wantErrMsg: `bad base path "http://example.com/adguard/": must be a path only`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := normalizeBasePath(tc.in)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestWeb_wrapBasePath(t *testing.T) {
+	web := &Web{conf: &webConfig{BasePath: "/adguard/"}}
+	h := web.wrapBasePath(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+
+	testCases := []struct {
+		name     string
+		path     string
+		wantBody string
+		wantLoc  string
+		wantCode int
+	}{{
+		name:     "stripped",
+		path:     "/adguard/control/status",
+		wantBody: "/control/status",
+		wantLoc:  "",
+		wantCode: http.StatusOK,
+	}, {
+		name:     "root",
+		path:     "/adguard/",
+		wantBody: "/",
+		wantLoc:  "",
+		wantCode: http.StatusOK,
+	}, {
+		name:     "no_slash",
+		path:     "/adguard?a=b",
+		wantBody: "",
+		wantLoc:  "/adguard/?a=b",
+		wantCode: http.StatusMovedPermanently,
+	}, {
+		name:     "doh",
+		path:     "/dns-query/cli",
+		wantBody: "/dns-query/cli",
+		wantLoc:  "",
+		wantCode: http.StatusOK,
+	}, {
+		name:     "outside",
+		path:     "/control/status",
+		wantBody: "",
+		wantLoc:  "",
+		wantCode: http.StatusNotFound,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			w := httptest.NewRecorder()
+
+			h.ServeHTTP(w, r)
+			require.Equal(t, tc.wantCode, w.Code)
+
+			assert.Equal(t, tc.wantLoc, w.Header().Get("Location"))
+			if tc.wantBody != "" {
+				assert.Equal(t, tc.wantBody, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package home
+
+import (
+	"net"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Settings of waiting for the bind addresses at startup.
+const (
+	// bindWaitTimeout is the maximum duration of waiting for all the bind
+	// addresses to become available.
+	bindWaitTimeout = 2 * time.Minute
+
+	// bindWaitIvl is the interval between the checks.
+	bindWaitIvl = 1 * time.Second
+)
+
+// waitBindAddrs waits until each of ips can be bound to.  That may not be the
+// case right after the boot, when the interfaces haven't got their addresses
+// from a DHCP server yet.  It gives up after timeout and returns false, leaving
+// the reporting of the error to the listeners.
+func waitBindAddrs(ips []net.IP, timeout, ivl time.Duration) (ok bool) {
+	deadline := time.Now().Add(timeout)
+	for _, ip := range ips {
+		logged := false
+		for {
+			err := aghnet.CheckPort("udp", ip, 0)
+			if !aghnet.IsAddrNotAvail(err) {
+				break
+			}
+
+			if time.Now().After(deadline) {
+				log.Info("bind addrs: %s is still not available, giving up", ip)
+
+				return false
+			}
+
+			if !logged {
+				log.Info("bind addrs: waiting for %s to become available", ip)
+				logged = true
+			}
+
+			time.Sleep(ivl)
+		}
+	}
+
+	return true
+}
+
+// dnsBindAddrs returns the addresses the DNS server is going to listen on.
+func dnsBindAddrs() (ips []net.IP) {
+	config.RLock()
+	defer config.RUnlock()
+
+	ips = append(ips, config.DNS.BindHosts...)
+	ips = append(ips, config.TLS.DoTBindHosts...)
+	ips = append(ips, config.TLS.DoQBindHosts...)
+
+	return ips
+}
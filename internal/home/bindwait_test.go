@@ -0,0 +1,36 @@
+package home
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaitBindAddrs(t *testing.T) {
+	testCases := []struct {
+		name   string
+		ips    []net.IP
+		wantOK bool
+	}{{
+		name:   "empty",
+		ips:    nil,
+		wantOK: true,
+	}, {
+		name:   "available",
+		ips:    []net.IP{{127, 0, 0, 1}, {0, 0, 0, 0}},
+		wantOK: true,
+	}, {
+		name:   "not_available",
+		ips:    []net.IP{{127, 0, 0, 1}, {192, 0, 2, 1}},
+		wantOK: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ok := waitBindAddrs(tc.ips, 10*time.Millisecond, time.Millisecond)
+			assert.Equal(t, tc.wantOK, ok)
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package home
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/stringutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+)
+
+// defaultCanaryDuration is the default duration of a canary trial.
+const defaultCanaryDuration = timeutil.Day
+
+// canaryConfig is the configuration of a canary trial: a pending policy change
+// applied only to a few test clients for a trial period, after which it's
+// either promoted or discarded.
+type canaryConfig struct {
+	// Start is the time the trial has started.
+	Start time.Time `yaml:"start"`
+
+	// Policy is the pending version of the policy.  When promoted, it
+	// replaces the policy with the same name or is added as a new one.
+	Policy *policy `yaml:"policy"`
+
+	// Clients are the names of the persistent clients, which the pending
+	// policy applies to during the trial.
+	Clients []string `yaml:"clients"`
+
+	// Duration is the duration of the trial.  If zero, defaultCanaryDuration
+	// is used.
+	Duration timeutil.Duration `yaml:"duration"`
+}
+
+// end returns the time the trial ends.
+func (c *canaryConfig) end() (t time.Time) {
+	d := c.Duration.Duration
+	if d <= 0 {
+		d = defaultCanaryDuration
+	}
+
+	return c.Start.Add(d)
+}
+
+// canaryCounters are the statistics of the requests of a group of clients
+// during the canary trial.
+type canaryCounters struct {
+	// requests is the number of the processed requests.
+	requests uint64
+
+	// blocked is the number of the filtered requests.
+	blocked uint64
+
+	// nxdomain is the number of the NXDOMAIN responses.
+	nxdomain uint64
+}
+
+// add counts the request with res and resp.
+func (cc *canaryCounters) add(res *filtering.Result, resp *dns.Msg) {
+	cc.requests++
+	if res != nil && res.IsFiltered {
+		cc.blocked++
+	}
+
+	if resp != nil && resp.Rcode == dns.RcodeNameError {
+		cc.nxdomain++
+	}
+}
+
+// canaryTrial applies the pending policy change to the test clients and
+// compares their statistics with the ones of the rest of the clients.  The
+// statistics are only kept in memory.
+type canaryTrial struct {
+	// policies are the filtering policies, which the pending policy is
+	// promoted into.
+	policies *policiesContainer
+
+	// clientExists returns true if the persistent client with name exists.
+	clientExists func(name string) (ok bool)
+
+	// now returns the current time.  It's time.Now everywhere except the
+	// tests.
+	now func() (t time.Time)
+
+	// mu protects conf, clients, canary, and control.
+	mu *sync.Mutex
+
+	// conf is the configuration of the current trial.  It's nil if there is
+	// no trial.
+	conf *canaryConfig
+
+	// clients are the names of the test clients.
+	clients *stringutil.Set
+
+	// canary are the statistics of the test clients.
+	canary canaryCounters
+
+	// control are the statistics of the rest of the clients.
+	control canaryCounters
+}
+
+// newCanaryTrial returns a new canary trial manager and resumes the trial from
+// conf, if any.  The invalid trial is discarded.
+func newCanaryTrial(
+	conf *canaryConfig,
+	policies *policiesContainer,
+	clientExists func(name string) (ok bool),
+) (ct *canaryTrial) {
+	ct = &canaryTrial{
+		policies:     policies,
+		clientExists: clientExists,
+		now:          time.Now,
+		mu:           &sync.Mutex{},
+	}
+
+	if conf == nil {
+		return ct
+	}
+
+	err := ct.check(conf)
+	if err != nil {
+		log.Error("canary: discarding trial: %s", err)
+
+		return ct
+	}
+
+	ct.conf = conf
+	ct.clients = stringutil.NewSet(conf.Clients...)
+
+	return ct
+}
+
+// check validates conf.
+func (ct *canaryTrial) check(conf *canaryConfig) (err error) {
+	if conf.Policy == nil {
+		return errors.Error("no policy")
+	} else if len(conf.Clients) == 0 {
+		return errors.Error("no clients")
+	} else if conf.Duration.Duration < 0 {
+		return fmt.Errorf("negative duration %s", conf.Duration)
+	}
+
+	err = ct.policies.check(conf.Policy)
+	if err != nil {
+		return fmt.Errorf("policy: %w", err)
+	}
+
+	for _, name := range conf.Clients {
+		if !ct.clientExists(name) {
+			return fmt.Errorf("unknown client %q", name)
+		}
+	}
+
+	return nil
+}
+
+// WriteDiskConfig writes the current trial into conf.
+func (ct *canaryTrial) WriteDiskConfig(conf **canaryConfig) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if ct.conf == nil {
+		*conf = nil
+
+		return
+	}
+
+	c := *ct.conf
+	c.Clients = stringutil.CloneSlice(ct.conf.Clients)
+	*conf = &c
+}
+
+// start starts a new trial of conf.  It returns an error if a trial is already
+// in progress.
+func (ct *canaryTrial) start(conf *canaryConfig) (err error) {
+	err = ct.check(conf)
+	if err != nil {
+		return err
+	}
+
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if ct.conf != nil {
+		return errors.Error("trial already exists")
+	}
+
+	conf.Start = ct.now()
+	ct.conf = conf
+	ct.clients = stringutil.NewSet(conf.Clients...)
+	ct.canary, ct.control = canaryCounters{}, canaryCounters{}
+
+	log.Info("canary: started trial of policy %q for %d clients", conf.Policy.Name, len(conf.Clients))
+
+	return nil
+}
+
+// stopLocked ends the trial.  ct.mu is expected to be locked.
+func (ct *canaryTrial) stopLocked() {
+	ct.conf = nil
+	ct.clients = nil
+	ct.canary, ct.control = canaryCounters{}, canaryCounters{}
+}
+
+// discard ends the trial without applying the pending policy.
+func (ct *canaryTrial) discard() (err error) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if ct.conf == nil {
+		return errors.Error("no trial")
+	}
+
+	log.Info("canary: discarded trial of policy %q", ct.conf.Policy.Name)
+	ct.stopLocked()
+
+	return nil
+}
+
+// promote ends the trial and applies the pending policy to all its clients.
+func (ct *canaryTrial) promote() (err error) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if ct.conf == nil {
+		return errors.Error("no trial")
+	}
+
+	p := ct.conf.Policy
+	if ct.policies.has(p.Name) {
+		err = ct.policies.update(p.Name, p)
+	} else {
+		err = ct.policies.add(p)
+	}
+
+	if err != nil {
+		return fmt.Errorf("promoting policy %q: %w", p.Name, err)
+	}
+
+	log.Info("canary: promoted policy %q", p.Name)
+	ct.stopLocked()
+
+	return nil
+}
+
+// activeLocked returns true if the trial is in progress at the moment now.
+// ct.mu is expected to be locked.
+func (ct *canaryTrial) activeLocked(now time.Time) (ok bool) {
+	return ct.conf != nil && !now.Before(ct.conf.Start) && now.Before(ct.conf.end())
+}
+
+// apply sets the filtering settings of the pending policy to setts, if the
+// client with setts is a test client of the trial in progress.  ct may be
+// nil.
+func (ct *canaryTrial) apply(setts *filtering.Settings) (ok bool) {
+	if ct == nil || setts.ClientName == "" {
+		return false
+	}
+
+	now := ct.now()
+
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if !ct.activeLocked(now) || !ct.clients.Has(setts.ClientName) {
+		return false
+	}
+
+	p := ct.conf.Policy
+	if !p.isActive(now) {
+		return false
+	}
+
+	log.Debug("canary: using pending policy %q for client %s", p.Name, setts.ClientName)
+	p.apply(setts)
+
+	return true
+}
+
+// requestProcessed counts the request of the client with setts in the
+// statistics of its group, if the trial is in progress.  It's used as
+// dnsforward.ServerConfig.RequestProcessed.  ct may be nil.
+func (ct *canaryTrial) requestProcessed(setts *filtering.Settings, res *filtering.Result, resp *dns.Msg) {
+	if ct == nil || setts == nil {
+		return
+	}
+
+	now := ct.now()
+
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if !ct.activeLocked(now) {
+		return
+	}
+
+	if setts.ClientName != "" && ct.clients.Has(setts.ClientName) {
+		ct.canary.add(res, resp)
+	} else {
+		ct.control.add(res, resp)
+	}
+}
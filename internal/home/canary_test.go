@@ -0,0 +1,144 @@
+package home
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCanaryTrial returns a canary trial manager with the persistent client
+// "tester" and the policy "default" for tests.
+func newTestCanaryTrial(t *testing.T) (ct *canaryTrial, pc *policiesContainer) {
+	t.Helper()
+
+	clients := &clientsContainer{
+		testing: true,
+	}
+	pc = newPoliciesContainer([]*policy{{
+		Name:             "default",
+		FilteringEnabled: true,
+	}}, clients)
+	clients.policies = pc
+	clients.Init(nil, nil, nil)
+
+	ok, err := clients.Add(&Client{Name: "tester", IDs: []string{"1.1.1.1"}})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	return newCanaryTrial(nil, pc, clients.has), pc
+}
+
+func TestCanaryTrial(t *testing.T) {
+	ct, pc := newTestCanaryTrial(t)
+
+	start := time.Date(2022, 1, 17, 12, 0, 0, 0, time.UTC)
+	now := start
+	ct.now = func() (t time.Time) { return now }
+
+	err := ct.start(&canaryConfig{
+		Policy: &policy{
+			Name:             "default",
+			FilteringEnabled: true,
+			ParentalEnabled:  true,
+		},
+		Clients:  []string{"tester"},
+		Duration: timeutil.Duration{Duration: time.Hour},
+	})
+	require.NoError(t, err)
+
+	tester := &filtering.Settings{ClientName: "tester"}
+	other := &filtering.Settings{ClientName: "other"}
+
+	require.True(t, ct.apply(tester))
+	assert.True(t, tester.ParentalEnabled)
+
+	require.False(t, ct.apply(other))
+	assert.False(t, other.ParentalEnabled)
+
+	nxdomain := (&dns.Msg{}).SetRcode(&dns.Msg{}, dns.RcodeNameError)
+	ct.requestProcessed(tester, &filtering.Result{IsFiltered: true}, &dns.Msg{})
+	ct.requestProcessed(tester, &filtering.Result{}, nxdomain)
+	ct.requestProcessed(other, &filtering.Result{}, &dns.Msg{})
+
+	assert.Equal(t, canaryCounters{requests: 2, blocked: 1, nxdomain: 1}, ct.canary)
+	assert.Equal(t, canaryCounters{requests: 1}, ct.control)
+
+	t.Run("finished", func(t *testing.T) {
+		now = start.Add(2 * time.Hour)
+
+		assert.False(t, ct.apply(&filtering.Settings{ClientName: "tester"}))
+
+		ct.requestProcessed(other, &filtering.Result{}, &dns.Msg{})
+		assert.Equal(t, canaryCounters{requests: 1}, ct.control)
+	})
+
+	t.Run("promote", func(t *testing.T) {
+		require.NoError(t, ct.promote())
+
+		p, ok := pc.byName("default", now)
+		require.True(t, ok)
+
+		assert.True(t, p.ParentalEnabled)
+		assert.Nil(t, ct.conf)
+		testutil.AssertErrorMsg(t, "no trial", ct.promote())
+	})
+}
+
+func TestCanaryTrial_start(t *testing.T) {
+	ct, _ := newTestCanaryTrial(t)
+
+	testCases := []struct {
+		conf       *canaryConfig
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       &canaryConfig{Clients: []string{"tester"}},
+		name:       "no_policy",
+		wantErrMsg: "no policy",
+	}, {
+		conf:       &canaryConfig{Policy: &policy{Name: "new"}},
+		name:       "no_clients",
+		wantErrMsg: "no clients",
+	}, {
+		conf: &canaryConfig{
+			Policy:  &policy{Name: "new"},
+			Clients: []string{"nobody"},
+		},
+		name:       "unknown_client",
+		wantErrMsg: `unknown client "nobody"`,
+	}, {
+		conf: &canaryConfig{
+			Policy:  &policy{Name: "new", BlockedServices: []string{"unknown"}},
+			Clients: []string{"tester"},
+		},
+		name:       "bad_policy",
+		wantErrMsg: `policy: invalid blocked service: "unknown"`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, ct.start(tc.conf))
+		})
+	}
+
+	t.Run("discard", func(t *testing.T) {
+		conf := &canaryConfig{
+			Policy:  &policy{Name: "new"},
+			Clients: []string{"tester"},
+		}
+		require.NoError(t, ct.start(conf))
+
+		err := ct.start(conf)
+		testutil.AssertErrorMsg(t, "trial already exists", err)
+
+		require.NoError(t, ct.discard())
+		assert.Nil(t, ct.conf)
+		assert.False(t, ct.policies.has("new"))
+	})
+}
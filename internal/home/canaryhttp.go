@@ -0,0 +1,138 @@
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/stringutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+)
+
+// canaryGroupJSON are the statistics of a group of clients during the canary
+// trial.
+type canaryGroupJSON struct {
+	Requests        uint64  `json:"requests"`
+	BlockedPercent  float64 `json:"blocked_percent"`
+	NXDomainPercent float64 `json:"nxdomain_percent"`
+}
+
+// newCanaryGroupJSON returns the statistics of cc in the JSON form.
+func newCanaryGroupJSON(cc *canaryCounters) (g *canaryGroupJSON) {
+	g = &canaryGroupJSON{
+		Requests: cc.requests,
+	}
+
+	if cc.requests > 0 {
+		g.BlockedPercent = 100 * float64(cc.blocked) / float64(cc.requests)
+		g.NXDomainPercent = 100 * float64(cc.nxdomain) / float64(cc.requests)
+	}
+
+	return g
+}
+
+// canaryStatusJSON is the response of the canary status handler.
+type canaryStatusJSON struct {
+	Policy  *policy          `json:"policy,omitempty"`
+	Canary  *canaryGroupJSON `json:"canary,omitempty"`
+	Control *canaryGroupJSON `json:"control,omitempty"`
+	Start   string           `json:"start,omitempty"`
+	End     string           `json:"end,omitempty"`
+	Clients []string         `json:"clients,omitempty"`
+	Exists  bool             `json:"exists"`
+	Active  bool             `json:"active"`
+}
+
+// handleCanaryStatus is the handler for the GET /control/canary HTTP API.
+func (ct *canaryTrial) handleCanaryStatus(w http.ResponseWriter, r *http.Request) {
+	now := ct.now()
+	resp := &canaryStatusJSON{}
+
+	ct.mu.Lock()
+	if ct.conf != nil {
+		resp.Policy = ct.conf.Policy
+		resp.Canary = newCanaryGroupJSON(&ct.canary)
+		resp.Control = newCanaryGroupJSON(&ct.control)
+		resp.Start = ct.conf.Start.UTC().Format(time.RFC3339)
+		resp.End = ct.conf.end().UTC().Format(time.RFC3339)
+		resp.Clients = stringutil.CloneSlice(ct.conf.Clients)
+		resp.Exists = true
+		resp.Active = ct.activeLocked(now)
+	}
+	ct.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "encoding response: %s", err)
+	}
+}
+
+// canaryStartJSON is the request of the canary start handler.
+type canaryStartJSON struct {
+	Policy  *policy  `json:"policy"`
+	Clients []string `json:"clients"`
+
+	// Duration is the duration of the trial in milliseconds.
+	Duration uint64 `json:"duration"`
+}
+
+// handleCanaryStart is the handler for the POST /control/canary/start HTTP
+// API.
+func (ct *canaryTrial) handleCanaryStart(w http.ResponseWriter, r *http.Request) {
+	req := &canaryStartJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return
+	}
+
+	err = ct.start(&canaryConfig{
+		Policy:   req.Policy,
+		Clients:  req.Clients,
+		Duration: timeutil.Duration{Duration: time.Duration(req.Duration) * time.Millisecond},
+	})
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	onConfigModified()
+}
+
+// handleCanaryPromote is the handler for the POST /control/canary/promote HTTP
+// API.
+func (ct *canaryTrial) handleCanaryPromote(w http.ResponseWriter, r *http.Request) {
+	err := ct.promote()
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	onConfigModified()
+}
+
+// handleCanaryDiscard is the handler for the POST /control/canary/discard HTTP
+// API.
+func (ct *canaryTrial) handleCanaryDiscard(w http.ResponseWriter, r *http.Request) {
+	err := ct.discard()
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	onConfigModified()
+}
+
+// registerWebHandlers registers the HTTP handlers for the canary API.
+func (ct *canaryTrial) registerWebHandlers() {
+	httpRegister(http.MethodGet, "/control/canary", ct.handleCanaryStatus)
+	httpRegister(http.MethodPost, "/control/canary/start", ct.handleCanaryStart)
+	httpRegister(http.MethodPost, "/control/canary/promote", ct.handleCanaryPromote)
+	httpRegister(http.MethodPost, "/control/canary/discard", ct.handleCanaryDiscard)
+}
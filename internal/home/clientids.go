@@ -0,0 +1,319 @@
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/stringutil"
+)
+
+// maxClientIDHistory is the maximum number of the ID changes kept for a
+// persistent client.
+const maxClientIDHistory = 100
+
+// Client ID change actions.
+const (
+	clientIDAdded   = "added"
+	clientIDRemoved = "removed"
+)
+
+// clientIDEvent is a change of the IDs of a persistent client.
+type clientIDEvent struct {
+	// Time is the time of the change.
+	Time time.Time `yaml:"time" json:"time"`
+
+	// ID is the added or removed ID.
+	ID string `yaml:"id" json:"id"`
+
+	// Action is either clientIDAdded or clientIDRemoved.
+	Action string `yaml:"action" json:"action"`
+
+	// Client is the name of the persistent client, which the ID has been
+	// moved from or to by a merge or a split.  It's empty if the ID has been
+	// changed directly.
+	Client string `yaml:"client,omitempty" json:"client,omitempty"`
+}
+
+// cloneIDHistory returns a shallow copy of history.  The events are never
+// modified, so they're shared.
+func cloneIDHistory(history []*clientIDEvent) (clone []*clientIDEvent) {
+	if history == nil {
+		return nil
+	}
+
+	return append([]*clientIDEvent{}, history...)
+}
+
+// appendIDEvent appends a new event to history, removing the oldest ones if
+// there are too many.
+func appendIDEvent(history []*clientIDEvent, e *clientIDEvent) (res []*clientIDEvent) {
+	res = append(history, e)
+	if l := len(res); l > maxClientIDHistory {
+		res = append([]*clientIDEvent{}, res[l-maxClientIDHistory:]...)
+	}
+
+	return res
+}
+
+// syncIDHistory appends the events to history, so that the IDs it ends with
+// are ids.
+func syncIDHistory(history []*clientIDEvent, ids []string, now time.Time) (res []*clientIDEvent) {
+	// Use a slice to keep the order of the removal events stable.
+	var current []string
+	for _, e := range history {
+		current = stringutil.FilterOut(current, func(id string) (ok bool) { return id == e.ID })
+		if e.Action == clientIDAdded {
+			current = append(current, e.ID)
+		}
+	}
+
+	res = history
+	want := stringutil.NewSet(ids...)
+	for _, id := range current {
+		if !want.Has(id) {
+			res = appendIDEvent(res, &clientIDEvent{Time: now, ID: id, Action: clientIDRemoved})
+		}
+	}
+
+	for _, id := range ids {
+		if !stringutil.InSlice(current, id) {
+			res = appendIDEvent(res, &clientIDEvent{Time: now, ID: id, Action: clientIDAdded})
+		}
+	}
+
+	return res
+}
+
+// merge moves the IDs of the persistent client with srcName to the one with
+// dstName and removes the former.  The settings of the client with dstName
+// are kept, so that the requests from the moved IDs are attributed to it from
+// now on.
+func (clients *clientsContainer) merge(dstName, srcName string, now time.Time) (err error) {
+	if dstName == srcName {
+		return errors.Error("cannot merge client with itself")
+	}
+
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	dst, ok := clients.list[dstName]
+	if !ok {
+		return fmt.Errorf("client %q not found", dstName)
+	}
+
+	src, ok := clients.list[srcName]
+	if !ok {
+		return fmt.Errorf("client %q not found", srcName)
+	}
+
+	ids := make([]string, 0, len(dst.IDs)+len(src.IDs))
+	ids = append(ids, dst.IDs...)
+	for _, id := range src.IDs {
+		ids = append(ids, id)
+		clients.idIndex[id] = dst
+		dst.IDHistory = appendIDEvent(dst.IDHistory, &clientIDEvent{
+			Time:   now,
+			ID:     id,
+			Action: clientIDAdded,
+			Client: srcName,
+		})
+	}
+
+	dst.IDs = ids
+	delete(clients.list, srcName)
+
+	log.Debug("clients: merged %q into %q: ID:%q", srcName, dstName, src.IDs)
+
+	return nil
+}
+
+// split moves ids of the persistent client with name to a new persistent
+// client with newName, which has the same settings.  The client with name
+// must keep at least one ID.
+func (clients *clientsContainer) split(name, newName string, ids []string, now time.Time) (err error) {
+	// Validate and normalize the IDs and the new name.
+	nc := &Client{Name: newName, IDs: ids}
+	err = clients.check(nc)
+	if err != nil {
+		return err
+	}
+
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	c, ok := clients.list[name]
+	if !ok {
+		return fmt.Errorf("client %q not found", name)
+	}
+
+	if _, ok = clients.list[newName]; ok {
+		return errors.Error("client already exists")
+	}
+
+	for _, id := range nc.IDs {
+		if clients.idIndex[id] != c {
+			return fmt.Errorf("client %q has no id %q", name, id)
+		}
+	}
+
+	moved := stringutil.NewSet(nc.IDs...)
+	var kept, split []string
+	for _, id := range c.IDs {
+		if moved.Has(id) {
+			split = append(split, id)
+		} else {
+			kept = append(kept, id)
+		}
+	}
+
+	if len(kept) == 0 {
+		return errors.Error("client must keep at least one id")
+	}
+
+	*nc = *c
+	nc.upstreamConfig = nil
+	nc.Name = newName
+	nc.IDs = split
+	nc.Tags = stringutil.CloneSlice(c.Tags)
+	nc.BlockedServices = stringutil.CloneSlice(c.BlockedServices)
+	nc.Upstreams = stringutil.CloneSlice(c.Upstreams)
+	nc.Metadata = cloneMetadata(c.Metadata)
+	nc.IDHistory = nil
+
+	for _, id := range nc.IDs {
+		clients.idIndex[id] = nc
+		c.IDHistory = appendIDEvent(c.IDHistory, &clientIDEvent{
+			Time:   now,
+			ID:     id,
+			Action: clientIDRemoved,
+			Client: newName,
+		})
+		nc.IDHistory = appendIDEvent(nc.IDHistory, &clientIDEvent{
+			Time:   now,
+			ID:     id,
+			Action: clientIDAdded,
+			Client: name,
+		})
+	}
+
+	c.IDs = kept
+	clients.list[newName] = nc
+
+	log.Debug("clients: split %q from %q: ID:%q", newName, name, nc.IDs)
+
+	return nil
+}
+
+// idHistory returns a copy of the ID history of the persistent client with
+// name.  ok is false if there is no such client.
+func (clients *clientsContainer) idHistory(name string) (history []*clientIDEvent, ok bool) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	c, ok := clients.list[name]
+	if !ok {
+		return nil, false
+	}
+
+	return cloneIDHistory(c.IDHistory), true
+}
+
+// clientMergeJSON is the request to merge persistent clients.
+type clientMergeJSON struct {
+	// Target is the name of the client, which receives the IDs.
+	Target string `json:"target"`
+
+	// Source is the name of the client, which is removed.
+	Source string `json:"source"`
+}
+
+// handleMergeClients is the handler for the POST /control/clients/merge HTTP
+// API.
+func (clients *clientsContainer) handleMergeClients(w http.ResponseWriter, r *http.Request) {
+	mj := clientMergeJSON{}
+	err := json.NewDecoder(r.Body).Decode(&mj)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return
+	}
+
+	err = clients.merge(mj.Target, mj.Source, time.Now())
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "merging clients: %s", err)
+
+		return
+	}
+
+	onConfigModified()
+}
+
+// clientSplitJSON is the request to split the IDs of a persistent client into
+// a new one.
+type clientSplitJSON struct {
+	// Name is the name of the client, which the IDs are split from.
+	Name string `json:"name"`
+
+	// NewName is the name of the new client.
+	NewName string `json:"new_name"`
+
+	// IDs are the IDs moved to the new client.
+	IDs []string `json:"ids"`
+}
+
+// handleSplitClient is the handler for the POST /control/clients/split HTTP
+// API.
+func (clients *clientsContainer) handleSplitClient(w http.ResponseWriter, r *http.Request) {
+	sj := clientSplitJSON{}
+	err := json.NewDecoder(r.Body).Decode(&sj)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return
+	}
+
+	err = clients.split(sj.Name, sj.NewName, sj.IDs, time.Now())
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "splitting client: %s", err)
+
+		return
+	}
+
+	onConfigModified()
+}
+
+// clientIDHistoryJSON is the ID history of a persistent client.
+type clientIDHistoryJSON struct {
+	Name    string           `json:"name"`
+	History []*clientIDEvent `json:"history"`
+}
+
+// handleClientIDHistory is the handler for the GET /control/clients/history
+// HTTP API.
+func (clients *clientsContainer) handleClientIDHistory(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	history, ok := clients.idHistory(name)
+	if !ok {
+		aghhttp.Error(r, w, http.StatusNotFound, "client %q not found", name)
+
+		return
+	}
+
+	if history == nil {
+		history = []*clientIDEvent{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(clientIDHistoryJSON{
+		Name:    name,
+		History: history,
+	})
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "encoding response: %s", err)
+	}
+}
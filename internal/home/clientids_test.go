@@ -0,0 +1,181 @@
+package home
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// idEvents returns the IDs and the actions of history in a compact form.
+func idEvents(history []*clientIDEvent) (evs []string) {
+	for _, e := range history {
+		ev := e.Action + " " + e.ID
+		if e.Client != "" {
+			ev += " " + e.Client
+		}
+
+		evs = append(evs, ev)
+	}
+
+	return evs
+}
+
+func TestClientsContainer_mergeSplit(t *testing.T) {
+	clients := clientsContainer{
+		testing: true,
+	}
+	clients.Init(nil, nil, nil)
+
+	ok, err := clients.Add(&Client{
+		Name: "laptop",
+		IDs:  []string{"1.1.1.1"},
+	})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = clients.Add(&Client{
+		Name: "phone",
+		IDs:  []string{"2.2.2.2", "aa:aa:aa:aa:aa:aa"},
+	})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	now := time.Now()
+
+	t.Run("merge", func(t *testing.T) {
+		require.NoError(t, clients.merge("laptop", "phone", now))
+
+		c, found := clients.Find("2.2.2.2")
+		require.True(t, found)
+
+		assert.Equal(t, "laptop", c.Name)
+		assert.Equal(t, []string{"1.1.1.1", "2.2.2.2", "aa:aa:aa:aa:aa:aa"}, c.IDs)
+
+		_, found = clients.idHistory("phone")
+		assert.False(t, found)
+
+		history, found := clients.idHistory("laptop")
+		require.True(t, found)
+
+		assert.Equal(t, []string{
+			"added 1.1.1.1",
+			"added 2.2.2.2 phone",
+			"added aa:aa:aa:aa:aa:aa phone",
+		}, idEvents(history))
+	})
+
+	t.Run("split", func(t *testing.T) {
+		err = clients.split("laptop", "phone", []string{"AA:AA:AA:AA:AA:AA", "2.2.2.2"}, now)
+		require.NoError(t, err)
+
+		c, found := clients.Find("aa:aa:aa:aa:aa:aa")
+		require.True(t, found)
+
+		assert.Equal(t, "phone", c.Name)
+		assert.Equal(t, []string{"2.2.2.2", "aa:aa:aa:aa:aa:aa"}, c.IDs)
+
+		history, found := clients.idHistory("phone")
+		require.True(t, found)
+
+		assert.Equal(t, []string{
+			"added 2.2.2.2 laptop",
+			"added aa:aa:aa:aa:aa:aa laptop",
+		}, idEvents(history))
+
+		history, found = clients.idHistory("laptop")
+		require.True(t, found)
+		require.Len(t, history, 5)
+
+		assert.Equal(t, []string{
+			"removed 2.2.2.2 phone",
+			"removed aa:aa:aa:aa:aa:aa phone",
+		}, idEvents(history[3:]))
+	})
+
+	t.Run("update", func(t *testing.T) {
+		err = clients.Update("laptop", &Client{
+			Name: "laptop",
+			IDs:  []string{"3.3.3.3"},
+		})
+		require.NoError(t, err)
+
+		history, found := clients.idHistory("laptop")
+		require.True(t, found)
+		require.Len(t, history, 7)
+
+		assert.Equal(t, []string{
+			"removed 1.1.1.1",
+			"added 3.3.3.3",
+		}, idEvents(history[5:]))
+	})
+
+	testCases := []struct {
+		run        func() (err error)
+		name       string
+		wantErrMsg string
+	}{{
+		run:        func() (err error) { return clients.merge("laptop", "laptop", now) },
+		name:       "merge_self",
+		wantErrMsg: "cannot merge client with itself",
+	}, {
+		run:        func() (err error) { return clients.merge("laptop", "tablet", now) },
+		name:       "merge_not_found",
+		wantErrMsg: `client "tablet" not found`,
+	}, {
+		run: func() (err error) {
+			return clients.split("laptop", "tablet", []string{"2.2.2.2"}, now)
+		},
+		name:       "split_foreign_id",
+		wantErrMsg: `client "laptop" has no id "2.2.2.2"`,
+	}, {
+		run: func() (err error) {
+			return clients.split("laptop", "tablet", []string{"3.3.3.3"}, now)
+		},
+		name:       "split_all",
+		wantErrMsg: "client must keep at least one id",
+	}, {
+		run: func() (err error) {
+			return clients.split("laptop", "phone", []string{"3.3.3.3"}, now)
+		},
+		name:       "split_exists",
+		wantErrMsg: "client already exists",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err = tc.run()
+			require.Error(t, err)
+
+			assert.Equal(t, tc.wantErrMsg, err.Error())
+		})
+	}
+}
+
+func TestSyncIDHistory(t *testing.T) {
+	now := time.Now()
+
+	history := syncIDHistory(nil, []string{"1.1.1.1", "2.2.2.2"}, now)
+	assert.Equal(t, []string{"added 1.1.1.1", "added 2.2.2.2"}, idEvents(history))
+
+	// Nothing changes if the IDs are the same.
+	history = syncIDHistory(history, []string{"2.2.2.2", "1.1.1.1"}, now)
+	assert.Len(t, history, 2)
+
+	history = syncIDHistory(history, []string{"1.1.1.1"}, now)
+	history = syncIDHistory(history, []string{"1.1.1.1", "2.2.2.2"}, now)
+	assert.Equal(t, []string{
+		"added 1.1.1.1",
+		"added 2.2.2.2",
+		"removed 2.2.2.2",
+		"added 2.2.2.2",
+	}, idEvents(history))
+
+	for i := 0; i < maxClientIDHistory; i++ {
+		history = syncIDHistory(history, nil, now)
+		history = syncIDHistory(history, []string{"1.1.1.1", "2.2.2.2"}, now)
+	}
+
+	assert.Len(t, history, maxClientIDHistory)
+}
@@ -0,0 +1,89 @@
+package home
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// Limits of the free-form metadata of the persistent clients.  They keep the
+// configuration file and the responses of the HTTP API reasonably small.
+const (
+	// maxClientNotesLen is the maximum length of the notes, in runes.
+	maxClientNotesLen = 4096
+
+	// maxClientFieldLen is the maximum length of the location, the owner, and
+	// the metadata values, in runes.
+	maxClientFieldLen = 256
+
+	// maxClientIconLen is the maximum length of the icon, in runes.  An icon
+	// is either an emoji, which may consist of several code points, or the
+	// name of an icon.
+	maxClientIconLen = 64
+
+	// maxClientMetaKeyLen is the maximum length of a metadata key, in runes.
+	maxClientMetaKeyLen = 64
+
+	// maxClientMetaFields is the maximum number of the metadata fields.
+	maxClientMetaFields = 64
+)
+
+// checkClientMeta returns an error if the metadata of c exceeds the limits.
+func checkClientMeta(c *Client) (err error) {
+	for _, f := range []struct {
+		name string
+		val  string
+		max  int
+	}{{
+		name: "notes",
+		val:  c.Notes,
+		max:  maxClientNotesLen,
+	}, {
+		name: "location",
+		val:  c.Location,
+		max:  maxClientFieldLen,
+	}, {
+		name: "owner",
+		val:  c.Owner,
+		max:  maxClientFieldLen,
+	}, {
+		name: "icon",
+		val:  c.Icon,
+		max:  maxClientIconLen,
+	}} {
+		if n := utf8.RuneCountInString(f.val); n > f.max {
+			return fmt.Errorf("%s: too long: %d runes, max %d", f.name, n, f.max)
+		}
+	}
+
+	if len(c.Metadata) > maxClientMetaFields {
+		return fmt.Errorf("metadata: too many fields: %d, max %d", len(c.Metadata), maxClientMetaFields)
+	}
+
+	for k, v := range c.Metadata {
+		if k == "" {
+			return errors.Error("metadata: empty key")
+		} else if n := utf8.RuneCountInString(k); n > maxClientMetaKeyLen {
+			return fmt.Errorf("metadata: key %q: too long: %d runes, max %d", k, n, maxClientMetaKeyLen)
+		} else if n = utf8.RuneCountInString(v); n > maxClientFieldLen {
+			return fmt.Errorf("metadata: value of %q: too long: %d runes, max %d", k, n, maxClientFieldLen)
+		}
+	}
+
+	return nil
+}
+
+// cloneMetadata returns a deep copy of m.  It returns nil if m is empty.
+func cloneMetadata(m map[string]string) (clone map[string]string) {
+	if len(m) == 0 {
+		return nil
+	}
+
+	clone = make(map[string]string, len(m))
+	for k, v := range m {
+		clone[k] = v
+	}
+
+	return clone
+}
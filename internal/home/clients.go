@@ -38,17 +38,64 @@ type Client struct {
 
 	Name string
 
+	// Policy is the name of the filtering policy assigned to the client.  If
+	// it's empty, the policies assigned to the tags of the client apply.
+	Policy string
+
 	IDs             []string
 	Tags            []string
 	BlockedServices []string
 	Upstreams       []string
 
+	// IDHistory are the changes of the IDs of the client, oldest first.
+	IDHistory []*clientIDEvent
+
 	UseOwnSettings        bool
 	FilteringEnabled      bool
 	SafeSearchEnabled     bool
 	SafeBrowsingEnabled   bool
 	ParentalEnabled       bool
 	UseOwnBlockedServices bool
+
+	// Metadata are the arbitrary key-value pairs describing the client, for
+	// example its serial number or purchase date.
+	Metadata map[string]string
+
+	// Notes are the free-form notes about the client.
+	Notes string
+
+	// Location is where the client is, for example "Living room".
+	Location string
+
+	// Owner is the person the client belongs to.
+	Owner string
+
+	// Icon is an emoji or the name of an icon shown for the client.
+	Icon string
+
+	// Quarantined, if true, means that only the explicitly allowed hosts are
+	// resolved for the client regardless of its settings and policy, and
+	// each blocked request is reported.
+	Quarantined bool
+
+	// AnswerOrder is the order of the A and AAAA records in the responses to
+	// the client, see dnsforward.AnswerOrderIPv4First.  If empty, the order of
+	// the upstream is kept.
+	AnswerOrder string
+
+	// SuppressAAAAWithoutA, if true, means that the AAAA records are removed
+	// from the responses to the client, if the name has no A records.  It's
+	// useful for the stub resolvers, which are known to break on such names.
+	SuppressAAAAWithoutA bool
+
+	// DNS64, if true, means that the AAAA records are synthesized for the
+	// client, if DNS64 is enabled.
+	DNS64 bool
+
+	// DisableAAAA, if true, means that the AAAA records and the IPv6 hints
+	// of the HTTPS and SVCB records are removed from the responses to the
+	// client.
+	DisableAAAA bool
 }
 
 type clientSource uint
@@ -60,6 +107,7 @@ const (
 	ClientSourceARP
 	ClientSourceDHCP
 	ClientSourceHostsFile
+	ClientSourceRADIUS
 )
 
 // RuntimeClient information
@@ -83,7 +131,7 @@ type clientsContainer struct {
 	idIndex map[string]*Client // ID -> client
 
 	// ipToRC is the IP address to *RuntimeClient map.
-	ipToRC *netutil.IPMap
+	ipToRC *aghnet.IPMap
 
 	lock sync.Mutex
 
@@ -99,6 +147,14 @@ type clientsContainer struct {
 	// hosts databse.
 	etcHosts *aghnet.HostsContainer
 
+	// policies is used for checking the policies assigned to the clients.  It
+	// may be nil.
+	policies *policiesContainer
+
+	// quotas are the quotas checked when the clients are added or updated.
+	// It's nil while the clients from the configuration file are loaded.
+	quotas *quotasConfig
+
 	testing bool // if TRUE, this object is used for internal tests
 }
 
@@ -115,7 +171,7 @@ func (clients *clientsContainer) Init(
 	}
 	clients.list = make(map[string]*Client)
 	clients.idIndex = make(map[string]*Client)
-	clients.ipToRC = netutil.NewIPMap(0)
+	clients.ipToRC = aghnet.NewIPMap(0)
 
 	clients.allTags = stringutil.NewSet(clientTags...)
 
@@ -136,6 +192,8 @@ func (clients *clientsContainer) Init(
 }
 
 func (clients *clientsContainer) handleHostsUpdates() {
+	defer onPanicReport("clients: hosts updates")
+
 	if clients.etcHosts != nil {
 		for upd := range clients.etcHosts.Upd() {
 			clients.addFromHostsFile(upd)
@@ -160,19 +218,35 @@ func (clients *clientsContainer) Reload() {
 }
 
 type clientObject struct {
-	Name string `yaml:"name"`
+	Name   string `yaml:"name"`
+	Policy string `yaml:"policy"`
 
 	Tags            []string `yaml:"tags"`
 	IDs             []string `yaml:"ids"`
 	BlockedServices []string `yaml:"blocked_services"`
 	Upstreams       []string `yaml:"upstreams"`
 
+	IDHistory []*clientIDEvent `yaml:"id_history,omitempty"`
+
+	Metadata map[string]string `yaml:"metadata,omitempty"`
+
+	Notes    string `yaml:"notes,omitempty"`
+	Location string `yaml:"location,omitempty"`
+	Owner    string `yaml:"owner,omitempty"`
+	Icon     string `yaml:"icon,omitempty"`
+
 	UseGlobalSettings        bool `yaml:"use_global_settings"`
 	FilteringEnabled         bool `yaml:"filtering_enabled"`
 	ParentalEnabled          bool `yaml:"parental_enabled"`
 	SafeSearchEnabled        bool `yaml:"safesearch_enabled"`
 	SafeBrowsingEnabled      bool `yaml:"safebrowsing_enabled"`
 	UseGlobalBlockedServices bool `yaml:"use_global_blocked_services"`
+	Quarantined              bool `yaml:"quarantined"`
+
+	AnswerOrder          string `yaml:"answer_order,omitempty"`
+	SuppressAAAAWithoutA bool   `yaml:"suppress_aaaa_without_a,omitempty"`
+	DNS64                bool   `yaml:"dns64,omitempty"`
+	DisableAAAA          bool   `yaml:"disable_aaaa,omitempty"`
 }
 
 // addFromConfig initializes the clients containter with objects from the
@@ -180,10 +254,18 @@ type clientObject struct {
 func (clients *clientsContainer) addFromConfig(objects []*clientObject) {
 	for _, o := range objects {
 		cli := &Client{
-			Name: o.Name,
+			Name:   o.Name,
+			Policy: o.Policy,
 
 			IDs:       o.IDs,
 			Upstreams: o.Upstreams,
+			IDHistory: o.IDHistory,
+
+			Metadata: o.Metadata,
+			Notes:    o.Notes,
+			Location: o.Location,
+			Owner:    o.Owner,
+			Icon:     o.Icon,
 
 			UseOwnSettings:        !o.UseGlobalSettings,
 			FilteringEnabled:      o.FilteringEnabled,
@@ -191,6 +273,12 @@ func (clients *clientsContainer) addFromConfig(objects []*clientObject) {
 			SafeSearchEnabled:     o.SafeSearchEnabled,
 			SafeBrowsingEnabled:   o.SafeBrowsingEnabled,
 			UseOwnBlockedServices: !o.UseGlobalBlockedServices,
+			Quarantined:           o.Quarantined,
+
+			AnswerOrder:          o.AnswerOrder,
+			SuppressAAAAWithoutA: o.SuppressAAAAWithoutA,
+			DNS64:                o.DNS64,
+			DisableAAAA:          o.DisableAAAA,
 		}
 
 		for _, s := range o.BlockedServices {
@@ -227,19 +315,34 @@ func (clients *clientsContainer) forConfig() (objs []*clientObject) {
 	objs = make([]*clientObject, 0, len(clients.list))
 	for _, cli := range clients.list {
 		o := &clientObject{
-			Name: cli.Name,
+			Name:   cli.Name,
+			Policy: cli.Policy,
 
 			Tags:            stringutil.CloneSlice(cli.Tags),
 			IDs:             stringutil.CloneSlice(cli.IDs),
 			BlockedServices: stringutil.CloneSlice(cli.BlockedServices),
 			Upstreams:       stringutil.CloneSlice(cli.Upstreams),
 
+			IDHistory: cloneIDHistory(cli.IDHistory),
+
+			Metadata: cloneMetadata(cli.Metadata),
+			Notes:    cli.Notes,
+			Location: cli.Location,
+			Owner:    cli.Owner,
+			Icon:     cli.Icon,
+
 			UseGlobalSettings:        !cli.UseOwnSettings,
 			FilteringEnabled:         cli.FilteringEnabled,
 			ParentalEnabled:          cli.ParentalEnabled,
 			SafeSearchEnabled:        cli.SafeSearchEnabled,
 			SafeBrowsingEnabled:      cli.SafeBrowsingEnabled,
 			UseGlobalBlockedServices: !cli.UseOwnBlockedServices,
+			Quarantined:              cli.Quarantined,
+
+			AnswerOrder:          cli.AnswerOrder,
+			SuppressAAAAWithoutA: cli.SuppressAAAAWithoutA,
+			DNS64:                cli.DNS64,
+			DisableAAAA:          cli.DisableAAAA,
 		}
 
 		objs = append(objs, o)
@@ -255,6 +358,8 @@ func (clients *clientsContainer) forConfig() (objs []*clientObject) {
 }
 
 func (clients *clientsContainer) periodicUpdate() {
+	defer onPanicReport("clients: updating")
+
 	for {
 		clients.Reload()
 		time.Sleep(clientsUpdatePeriod)
@@ -343,6 +448,7 @@ func (clients *clientsContainer) clientOrArtificial(
 	if ok {
 		return &querylog.Client{
 			Name: client.Name,
+			Tags: client.Tags,
 		}, false
 	}
 
@@ -406,18 +512,31 @@ func (clients *clientsContainer) findUpstreams(
 		return c.upstreamConfig, nil
 	}
 
+	upstreams, err = dnsforward.ExpandForcedTransports(upstreams)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &upstream.Options{
+		Bootstrap:    config.DNS.BootstrapDNS,
+		Timeout:      config.DNS.UpstreamTimeout.Duration,
+		RootCAs:      Context.tlsRoots,
+		CipherSuites: Context.tlsCiphers,
+	}
+
 	var conf *proxy.UpstreamConfig
-	conf, err = proxy.ParseUpstreamsConfig(
-		upstreams,
-		&upstream.Options{
-			Bootstrap: config.DNS.BootstrapDNS,
-			Timeout:   config.DNS.UpstreamTimeout.Duration,
-		},
-	)
+	conf, err = proxy.ParseUpstreamsConfig(upstreams, opts)
 	if err != nil {
 		return nil, err
 	}
 
+	if clients.dnsServer != nil {
+		err = clients.dnsServer.ApplyUpstreamRetry(conf, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	c.upstreamConfig = conf
 
 	return conf, nil
@@ -544,11 +663,25 @@ func (clients *clientsContainer) check(c *Client) (err error) {
 
 	sort.Strings(c.Tags)
 
+	if c.Policy != "" && clients.policies != nil && !clients.policies.has(c.Policy) {
+		return fmt.Errorf("invalid policy: %q", c.Policy)
+	}
+
 	err = dnsforward.ValidateUpstreams(c.Upstreams)
 	if err != nil {
 		return fmt.Errorf("invalid upstream servers: %w", err)
 	}
 
+	err = dnsforward.ValidateAnswerOrder(c.AnswerOrder)
+	if err != nil {
+		return fmt.Errorf("invalid answer order: %w", err)
+	}
+
+	err = checkClientMeta(c)
+	if err != nil {
+		return fmt.Errorf("invalid metadata: %w", err)
+	}
+
 	return nil
 }
 
@@ -578,6 +711,13 @@ func (clients *clientsContainer) Add(c *Client) (ok bool, err error) {
 		}
 	}
 
+	err = clients.checkQuotasLocked(c, nil)
+	if err != nil {
+		return false, err
+	}
+
+	c.IDHistory = syncIDHistory(c.IDHistory, c.IDs, time.Now())
+
 	// update Name index
 	clients.list[c.Name] = c
 
@@ -613,6 +753,44 @@ func (clients *clientsContainer) Del(name string) (ok bool) {
 	return true
 }
 
+// has returns true if the persistent client with name exists.
+func (clients *clientsContainer) has(name string) (ok bool) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	_, ok = clients.list[name]
+
+	return ok
+}
+
+// policyUser returns the name of a client, which the policy with name is
+// assigned to.
+func (clients *clientsContainer) policyUser(name string) (cliName string, ok bool) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	for _, c := range clients.list {
+		if c.Policy == name {
+			return c.Name, true
+		}
+	}
+
+	return "", false
+}
+
+// renamePolicy assigns the policy with name to the clients, which the policy
+// with prev is assigned to.
+func (clients *clientsContainer) renamePolicy(prev, name string) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	for _, c := range clients.list {
+		if c.Policy == prev {
+			c.Policy = name
+		}
+	}
+}
+
 // equalStringSlices returns true if the slices are equal.
 func equalStringSlices(a, b []string) (ok bool) {
 	if len(a) != len(b) {
@@ -651,6 +829,11 @@ func (clients *clientsContainer) Update(name string, c *Client) (err error) {
 		}
 	}
 
+	err = clients.checkQuotasLocked(c, prev)
+	if err != nil {
+		return err
+	}
+
 	// Second, check the IP index.
 	if !equalStringSlices(prev.IDs, c.IDs) {
 		for _, id := range c.IDs {
@@ -678,11 +861,27 @@ func (clients *clientsContainer) Update(name string, c *Client) (err error) {
 	// update upstreams cache
 	c.upstreamConfig = nil
 
+	c.IDHistory = syncIDHistory(prev.IDHistory, c.IDs, time.Now())
+
 	*prev = *c
 
 	return nil
 }
 
+// setQuarantined puts the persistent client with name into the quarantine or
+// releases it.  ok is false if there is no such client.
+func (clients *clientsContainer) setQuarantined(name string, q bool) (ok bool) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	c, ok := clients.list[name]
+	if ok {
+		c.Quarantined = q
+	}
+
+	return ok
+}
+
 // SetWHOISInfo sets the WHOIS information for a client.
 func (clients *clientsContainer) SetWHOISInfo(ip net.IP, wi *RuntimeClientWHOISInfo) {
 	clients.lock.Lock()
@@ -736,6 +935,7 @@ func (clients *clientsContainer) addHostLocked(ip net.IP, host string, src clien
 		}
 
 		rc.Source = src
+		rc.Host = host
 	} else {
 		rc = &RuntimeClient{
 			Host:      host,
@@ -751,6 +951,22 @@ func (clients *clientsContainer) addHostLocked(ip net.IP, host string, src clien
 	return true
 }
 
+// rmHost removes the runtime client with the ip if it has been added from
+// the specified source.
+func (clients *clientsContainer) rmHost(ip net.IP, src clientSource) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	rc, ok := clients.findRuntimeClientLocked(ip)
+	if !ok || rc.Source != src {
+		return
+	}
+
+	clients.ipToRC.Del(ip)
+
+	log.Debug("clients: removed %s -> %q [%d]", ip, rc.Host, clients.ipToRC.Len())
+}
+
 // rmHostsBySrc removes all entries that match the specified source.
 func (clients *clientsContainer) rmHostsBySrc(src clientSource) {
 	n := 0
@@ -775,7 +991,7 @@ func (clients *clientsContainer) rmHostsBySrc(src clientSource) {
 
 // addFromHostsFile fills the client-hostname pairing index from the system's
 // hosts files.
-func (clients *clientsContainer) addFromHostsFile(hosts *netutil.IPMap) {
+func (clients *clientsContainer) addFromHostsFile(hosts *aghnet.IPMap) {
 	clients.lock.Lock()
 	defer clients.lock.Unlock()
 
@@ -836,7 +1052,7 @@ func (clients *clientsContainer) addFromSystemARP() {
 		host := ln[:lparen]
 		ipStr := ln[lparen+2 : rparen]
 		ip := net.ParseIP(ipStr)
-		if netutil.ValidateDomainName(host) != nil || ip == nil {
+		if netutil.ValidateHostname(host) != nil || ip == nil {
 			continue
 		}
 
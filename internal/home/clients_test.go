@@ -3,6 +3,7 @@ package home
 import (
 	"net"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -77,6 +78,18 @@ func TestClients(t *testing.T) {
 		assert.False(t, ok)
 	})
 
+	t.Run("add_fail_answer_order", func(t *testing.T) {
+		ok, err := clients.Add(&Client{
+			IDs:         []string{"1.2.3.6"},
+			Name:        "client4",
+			AnswerOrder: "bad",
+		})
+		require.Error(t, err)
+		assert.False(t, ok)
+
+		assert.Equal(t, `invalid answer order: unknown value "bad"`, err.Error())
+	})
+
 	t.Run("update_fail_name", func(t *testing.T) {
 		err := clients.Update("client3", &Client{
 			IDs:  []string{"1.2.3.0"},
@@ -132,6 +145,23 @@ func TestClients(t *testing.T) {
 		assert.Equal(t, "1.1.1.2", c.IDs[0])
 	})
 
+	t.Run("quarantine", func(t *testing.T) {
+		require.True(t, clients.setQuarantined("client1-renamed", true))
+
+		c, ok := clients.Find("1.1.1.2")
+		require.True(t, ok)
+
+		assert.True(t, c.Quarantined)
+
+		require.True(t, clients.setQuarantined("client1-renamed", false))
+
+		c, ok = clients.Find("1.1.1.2")
+		require.True(t, ok)
+
+		assert.False(t, c.Quarantined)
+		assert.False(t, clients.setQuarantined("client3", true))
+	})
+
 	t.Run("del_success", func(t *testing.T) {
 		ok := clients.Del("client1-renamed")
 		require.True(t, ok)
@@ -349,3 +379,56 @@ func TestClientsCustomUpstream(t *testing.T) {
 	assert.Len(t, config.Upstreams, 1)
 	assert.Len(t, config.DomainReservedUpstreams, 1)
 }
+
+func TestClientsMetadata(t *testing.T) {
+	clients := clientsContainer{}
+	clients.testing = true
+
+	clients.Init(nil, nil, nil)
+
+	ok, err := clients.Add(&Client{
+		IDs:      []string{"1.1.1.1"},
+		Name:     "tv",
+		Notes:    "Bought in 2021.",
+		Location: "Living room",
+		Owner:    "Everyone",
+		Icon:     "📺",
+		Metadata: map[string]string{"serial": "ABC123"},
+	})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	objs := clients.forConfig()
+	require.Len(t, objs, 1)
+
+	o := objs[0]
+	assert.Equal(t, "Bought in 2021.", o.Notes)
+	assert.Equal(t, "Living room", o.Location)
+	assert.Equal(t, "Everyone", o.Owner)
+	assert.Equal(t, "📺", o.Icon)
+	assert.Equal(t, map[string]string{"serial": "ABC123"}, o.Metadata)
+
+	// The configuration must not share the map with the client.
+	o.Metadata["serial"] = "changed"
+
+	c, ok := clients.Find("1.1.1.1")
+	require.True(t, ok)
+
+	assert.Equal(t, "ABC123", c.Metadata["serial"])
+
+	t.Run("too_long", func(t *testing.T) {
+		_, err = clients.Add(&Client{
+			IDs:  []string{"2.2.2.2"},
+			Name: "long",
+			Icon: strings.Repeat("x", maxClientIconLen+1),
+		})
+		assert.Error(t, err)
+
+		_, err = clients.Add(&Client{
+			IDs:      []string{"2.2.2.2"},
+			Name:     "empty_key",
+			Metadata: map[string]string{"": "value"},
+		})
+		assert.Error(t, err)
+	})
+}
@@ -31,17 +31,34 @@ type clientJSON struct {
 
 	Name string `json:"name"`
 
+	// Policy is the name of the filtering policy assigned to the client.
+	Policy string `json:"policy"`
+
 	BlockedServices []string `json:"blocked_services"`
 	IDs             []string `json:"ids"`
 	Tags            []string `json:"tags"`
 	Upstreams       []string `json:"upstreams"`
 
+	// Metadata are the arbitrary key-value pairs describing the client.
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	Notes    string `json:"notes,omitempty"`
+	Location string `json:"location,omitempty"`
+	Owner    string `json:"owner,omitempty"`
+	Icon     string `json:"icon,omitempty"`
+
 	FilteringEnabled         bool `json:"filtering_enabled"`
 	ParentalEnabled          bool `json:"parental_enabled"`
 	SafeBrowsingEnabled      bool `json:"safebrowsing_enabled"`
 	SafeSearchEnabled        bool `json:"safesearch_enabled"`
 	UseGlobalBlockedServices bool `json:"use_global_blocked_services"`
 	UseGlobalSettings        bool `json:"use_global_settings"`
+	Quarantined              bool `json:"quarantined"`
+
+	AnswerOrder          string `json:"answer_order,omitempty"`
+	SuppressAAAAWithoutA bool   `json:"suppress_aaaa_without_a"`
+	DNS64                bool   `json:"dns64"`
+	DisableAAAA          bool   `json:"disable_aaaa"`
 }
 
 type runtimeClientJSON struct {
@@ -95,6 +112,8 @@ func (clients *clientsContainer) handleGetClients(w http.ResponseWriter, r *http
 			cj.Source = "ARP"
 		case ClientSourceWHOIS:
 			cj.Source = "WHOIS"
+		case ClientSourceRADIUS:
+			cj.Source = "RADIUS"
 		}
 
 		data.RuntimeClients = append(data.RuntimeClients, cj)
@@ -123,6 +142,7 @@ func (clients *clientsContainer) handleGetClients(w http.ResponseWriter, r *http
 func jsonToClient(cj clientJSON) (c *Client) {
 	return &Client{
 		Name:                cj.Name,
+		Policy:              cj.Policy,
 		IDs:                 cj.IDs,
 		Tags:                cj.Tags,
 		UseOwnSettings:      !cj.UseGlobalSettings,
@@ -135,6 +155,19 @@ func jsonToClient(cj clientJSON) (c *Client) {
 		BlockedServices:       cj.BlockedServices,
 
 		Upstreams: cj.Upstreams,
+
+		Metadata: cj.Metadata,
+		Notes:    cj.Notes,
+		Location: cj.Location,
+		Owner:    cj.Owner,
+		Icon:     cj.Icon,
+
+		Quarantined: cj.Quarantined,
+
+		AnswerOrder:          cj.AnswerOrder,
+		SuppressAAAAWithoutA: cj.SuppressAAAAWithoutA,
+		DNS64:                cj.DNS64,
+		DisableAAAA:          cj.DisableAAAA,
 	}
 }
 
@@ -142,6 +175,7 @@ func jsonToClient(cj clientJSON) (c *Client) {
 func clientToJSON(c *Client) (cj *clientJSON) {
 	return &clientJSON{
 		Name:                c.Name,
+		Policy:              c.Policy,
 		IDs:                 c.IDs,
 		Tags:                c.Tags,
 		UseGlobalSettings:   !c.UseOwnSettings,
@@ -154,6 +188,19 @@ func clientToJSON(c *Client) (cj *clientJSON) {
 		BlockedServices:          c.BlockedServices,
 
 		Upstreams: c.Upstreams,
+
+		Metadata: cloneMetadata(c.Metadata),
+		Notes:    c.Notes,
+		Location: c.Location,
+		Owner:    c.Owner,
+		Icon:     c.Icon,
+
+		Quarantined: c.Quarantined,
+
+		AnswerOrder:          c.AnswerOrder,
+		SuppressAAAAWithoutA: c.SuppressAAAAWithoutA,
+		DNS64:                c.DNS64,
+		DisableAAAA:          c.DisableAAAA,
 	}
 }
 
@@ -168,6 +215,10 @@ func (clients *clientsContainer) handleAddClient(w http.ResponseWriter, r *http.
 	}
 
 	c := jsonToClient(cj)
+	if t := clients.quotas.tenantOf(r); t != nil {
+		c.Owner = t.Name
+	}
+
 	ok, err := clients.Add(c)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
@@ -200,6 +251,15 @@ func (clients *clientsContainer) handleDelClient(w http.ResponseWriter, r *http.
 		return
 	}
 
+	if t := clients.quotas.tenantOf(r); t != nil {
+		err = clients.checkOwner(cj.Name, t)
+		if err != nil {
+			aghhttp.Error(r, w, http.StatusForbidden, "%s", err)
+
+			return
+		}
+	}
+
 	if !clients.Del(cj.Name) {
 		aghhttp.Error(r, w, http.StatusBadRequest, "Client not found")
 		return
@@ -230,6 +290,17 @@ func (clients *clientsContainer) handleUpdateClient(w http.ResponseWriter, r *ht
 	}
 
 	c := jsonToClient(dj.Data)
+	if t := clients.quotas.tenantOf(r); t != nil {
+		err = clients.checkOwner(dj.Name, t)
+		if err != nil {
+			aghhttp.Error(r, w, http.StatusForbidden, "%s", err)
+
+			return
+		}
+
+		c.Owner = t.Name
+	}
+
 	err = clients.Update(dj.Name, c)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
@@ -314,4 +385,8 @@ func (clients *clientsContainer) registerWebHandlers() {
 	httpRegister(http.MethodPost, "/control/clients/delete", clients.handleDelClient)
 	httpRegister(http.MethodPost, "/control/clients/update", clients.handleUpdateClient)
 	httpRegister(http.MethodGet, "/control/clients/find", clients.handleFindClient)
+	httpRegister(http.MethodPost, "/control/clients/quarantine", clients.handleQuarantine)
+	httpRegister(http.MethodPost, "/control/clients/merge", clients.handleMergeClients)
+	httpRegister(http.MethodPost, "/control/clients/split", clients.handleSplitClient)
+	httpRegister(http.MethodGet, "/control/clients/history", clients.handleClientIDHistory)
 }
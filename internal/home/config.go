@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
@@ -60,6 +61,11 @@ type configuration struct {
 	BindPort     int    `yaml:"bind_port"`      // BindPort is the port the HTTP server
 	BetaBindPort int    `yaml:"beta_bind_port"` // BetaBindPort is the port for new client
 	Users        []User `yaml:"users"`          // Users that can access HTTP server
+	// WebBasePath is the URL path prefix under which the web UI and the
+	// control API are served, for example "/adguard/", so that they can
+	// be placed behind a path-routing reverse proxy.  The proxy must pass
+	// the prefix through.  If it's empty, the root is used.
+	WebBasePath string `yaml:"web_base_path"`
 	// AuthAttempts is the maximum number of failed login attempts a user
 	// can do before being blocked.
 	AuthAttempts uint `yaml:"auth_attempts"`
@@ -88,6 +94,61 @@ type configuration struct {
 	// Keep this field sorted to ensure consistent ordering.
 	Clients []*clientObject `yaml:"clients"`
 
+	// Policies are the named filtering policies, which can be assigned to
+	// the persistent clients.
+	Policies []*policy `yaml:"policies"`
+
+	// Canary is the canary trial of a pending policy change in progress.
+	// It's nil if there is none.
+	Canary *canaryConfig `yaml:"canary,omitempty"`
+
+	// RADIUS is the configuration of the RADIUS accounting listener, which
+	// associates the usernames of authenticated users with their IP
+	// addresses.
+	RADIUS radiusConfig `yaml:"radius"`
+
+	// ListServer is the configuration of the list server mode, in which the
+	// filter lists are served to the other instances.
+	ListServer listServerConfig `yaml:"list_server"`
+
+	// Quarantine is the configuration of the notifications about the blocked
+	// requests of the quarantined clients.
+	Quarantine quarantineConfig `yaml:"quarantine"`
+
+	// Failover is the configuration of the health checks and the state hooks
+	// for the VRRP failover.
+	Failover failoverConfig `yaml:"failover"`
+
+	// DiskGuard is the configuration of the monitoring of the free space on
+	// the disk with the data directory.
+	DiskGuard diskGuardConfig `yaml:"disk_guard"`
+
+	// Notifications is the configuration of the notifications about the
+	// important events, such as an upstream going down.
+	Notifications notificationsConfig `yaml:"notifications"`
+
+	// InterceptionCheck is the configuration of the periodic checks for the
+	// transparent interception of the DNS traffic.
+	InterceptionCheck interceptionCheckConfig `yaml:"interception_check"`
+
+	// WireGuard is the configuration of the built-in WireGuard endpoint,
+	// which serves DNS to the remote peers.
+	WireGuard wireGuardConfig `yaml:"wireguard"`
+
+	// StatsShare is the configuration of the read-only statistics share
+	// links.
+	StatsShare statsShareConfig `yaml:"stats_share"`
+
+	// Portal is the configuration of the login portal, which maps the
+	// devices to the users and their filtering policies.
+	Portal portalConfig `yaml:"portal"`
+
+	// Quotas is the configuration of the quotas enforced in the HTTP API.
+	Quotas quotasConfig `yaml:"quotas"`
+
+	// Update is the configuration of the self-update.
+	Update updateConfig `yaml:"update"`
+
 	logSettings `yaml:",inline"`
 
 	OSConfig *osConfig `yaml:"os"`
@@ -105,6 +166,14 @@ type dnsConfig struct {
 	// time interval for statistics (in days)
 	StatsInterval uint32 `yaml:"statistics_interval"`
 
+	// StatsPush is the configuration of the exporter that pushes the
+	// statistics to a time series database.
+	StatsPush stats.PushConfig `yaml:"statistics_push"`
+
+	// StatsPresence is the configuration of the tracking of the online and
+	// offline states of the clients.
+	StatsPresence stats.PresenceConfig `yaml:"statistics_presence"`
+
 	QueryLogEnabled     bool `yaml:"querylog_enabled"`      // if true, query log is enabled
 	QueryLogFileEnabled bool `yaml:"querylog_file_enabled"` // if true, query log will be written to a file
 	// QueryLogInterval is the interval for query log's files rotation.
@@ -112,11 +181,24 @@ type dnsConfig struct {
 	QueryLogMemSize   uint32            `yaml:"querylog_size_memory"` // number of entries kept in memory before they are flushed to disk
 	AnonymizeClientIP bool              `yaml:"anonymize_client_ip"`  // anonymize clients' IP addresses in logs and stats
 
+	// QueryLogFlushInterval is the maximum time the query log entries are
+	// kept in memory before they're flushed to disk.
+	QueryLogFlushInterval timeutil.Duration `yaml:"querylog_flush_interval"`
+
 	dnsforward.FilteringConfig `yaml:",inline"`
 
-	FilteringEnabled           bool             `yaml:"filtering_enabled"`       // whether or not use filter lists
-	FiltersUpdateIntervalHours uint32           `yaml:"filters_update_interval"` // time period to update filters (in hours)
-	DnsfilterConf              filtering.Config `yaml:",inline"`
+	FilteringEnabled           bool   `yaml:"filtering_enabled"`       // whether or not use filter lists
+	FiltersUpdateIntervalHours uint32 `yaml:"filters_update_interval"` // time period to update filters (in hours)
+
+	// FiltersUpdateParallel is the maximum number of filter lists downloaded
+	// simultaneously during an update.
+	FiltersUpdateParallel int `yaml:"filters_update_parallel"`
+
+	// FiltersUpdateBandwidth is the limit of the aggregate download speed of
+	// the filter lists in bytes per second.  Zero means no limit.
+	FiltersUpdateBandwidth uint64 `yaml:"filters_update_bandwidth"`
+
+	DnsfilterConf filtering.Config `yaml:",inline"`
 
 	// UpstreamTimeout is the timeout for querying upstream servers.
 	UpstreamTimeout timeutil.Duration `yaml:"upstream_timeout"`
@@ -159,6 +241,27 @@ type tlsConfigSettings struct {
 	// Allow DoH queries via unencrypted HTTP (e.g. for reverse proxying)
 	AllowUnencryptedDoH bool `yaml:"allow_unencrypted_doh" json:"allow_unencrypted_doh"`
 
+	// DoTBindHosts are the IP addresses to listen for the DNS-over-TLS
+	// requests on.  If empty, the addresses from dns.bind_hosts are used.
+	DoTBindHosts []net.IP `yaml:"dot_bind_hosts" json:"-"`
+
+	// DoQBindHosts are the IP addresses to listen for the DNS-over-QUIC
+	// requests on.  If empty, the addresses from dns.bind_hosts are used.
+	DoQBindHosts []net.IP `yaml:"doq_bind_hosts" json:"-"`
+
+	// HTTPSBindHosts are the IP addresses the HTTPS server, which also
+	// serves the DNS-over-HTTPS requests, listens on.  If empty, bind_host
+	// is used.
+	HTTPSBindHosts []net.IP `yaml:"https_bind_hosts" json:"-"`
+
+	// EnableHTTP3 makes the HTTPS server also serve the HTTP/3 requests,
+	// including the DNS-over-HTTP/3 ones, on the same port over UDP.
+	EnableHTTP3 bool `yaml:"enable_http3" json:"-"`
+
+	// AddrCertificates are the certificates used instead of the default one
+	// for the connections accepted on the particular local addresses.
+	AddrCertificates []*addrCertificate `yaml:"addr_certificates" json:"-"`
+
 	dnsforward.TLSConfig `yaml:",inline" json:",inline"`
 }
 
@@ -181,7 +284,11 @@ var config = &configuration{
 			BlockedResponseTTL: 10,        // in seconds
 			Ratelimit:          20,
 			RefuseAny:          true,
-			AllServers:         false,
+
+			RatelimitSubnetLenIPv4: 24,
+			RatelimitSubnetLenIPv6: 56,
+
+			AllServers: false,
 			FastestTimeout: timeutil.Duration{
 				Duration: fastip.DefaultPingWaitTimeout,
 			},
@@ -193,9 +300,12 @@ var config = &configuration{
 			// https://github.com/AdguardTeam/AdGuardHome/issues/2015#issuecomment-674041912
 			// was later increased to 300 due to https://github.com/AdguardTeam/AdGuardHome/issues/2257
 			MaxGoroutines: 300,
+
+			DHCPReverseZones: true,
 		},
 		FilteringEnabled:           true, // whether or not use filter lists
 		FiltersUpdateIntervalHours: 24,
+		FiltersUpdateParallel:      defaultFiltersUpdateParallel,
 		UpstreamTimeout:            timeutil.Duration{Duration: dnsforward.DefaultTimeout},
 		LocalDomainName:            "lan",
 		ResolveClients:             true,
@@ -213,6 +323,16 @@ var config = &configuration{
 		LogMaxSize:    100,
 		LogMaxAge:     3,
 	},
+	DiskGuard: diskGuardConfig{
+		Interval:        timeutil.Duration{Duration: 1 * time.Minute},
+		LowSpaceMB:      512,
+		CriticalSpaceMB: 64,
+	},
+	InterceptionCheck: interceptionCheckConfig{
+		Interval:     timeutil.Duration{Duration: defaultInterceptionInterval},
+		NXDomainZone: defaultInterceptionNXDomainZone,
+		Enabled:      false,
+	},
 	OSConfig:      &osConfig{},
 	SchemaVersion: currentSchemaVersion,
 }
@@ -225,8 +345,11 @@ func initConfig() {
 	config.DNS.QueryLogFileEnabled = true
 	config.DNS.QueryLogInterval = timeutil.Duration{Duration: 90 * timeutil.Day}
 	config.DNS.QueryLogMemSize = 1000
+	config.DNS.QueryLogFlushInterval = timeutil.Duration{Duration: 10 * time.Second}
 
 	config.DNS.CacheSize = 4 * 1024 * 1024
+	config.DNS.CacheMaxStaleTTL = dnsforward.DefaultCacheMaxStaleTTL
+	config.DNS.CoalesceRequests = true
 	config.DNS.DnsfilterConf.SafeBrowsingCacheSize = 1 * 1024 * 1024
 	config.DNS.DnsfilterConf.SafeSearchCacheSize = 1 * 1024 * 1024
 	config.DNS.DnsfilterConf.ParentalCacheSize = 1 * 1024 * 1024
@@ -355,6 +478,7 @@ func (c *configuration) write() error {
 		config.DNS.QueryLogFileEnabled = dc.FileEnabled
 		config.DNS.QueryLogInterval = timeutil.Duration{Duration: dc.RotationIvl}
 		config.DNS.QueryLogMemSize = dc.MemSize
+		config.DNS.QueryLogFlushInterval = timeutil.Duration{Duration: dc.FlushIvl}
 		config.DNS.AnonymizeClientIP = dc.AnonymizeClientIP
 	}
 
@@ -368,12 +492,33 @@ func (c *configuration) write() error {
 		c := dnsforward.FilteringConfig{}
 		s.WriteDiskConfig(&c)
 		dns := &config.DNS
-		dns.FilteringConfig = c
+		if Context.safeMode {
+			// Don't overwrite the DNS settings with the ones of the safe
+			// mode, but keep the changes made by the user.
+			mergeSafeModeEdits(&dns.FilteringConfig, &Context.safeModeDNS, &c)
+		} else {
+			dns.FilteringConfig = c
+		}
+
 		dns.LocalPTRResolvers,
 			dns.ResolveClients,
 			dns.UsePrivateRDNS = s.RDNSSettings()
 	}
 
+	if Context.notifier != nil {
+		Context.notifier.WriteDiskConfig(&config.Notifications)
+	}
+
+	if Context.wireGuard != nil {
+		Context.wireGuard.WriteDiskConfig(&config.WireGuard)
+	}
+
+	if Context.statsShare != nil {
+		Context.statsShare.WriteDiskConfig(&config.StatsShare)
+	}
+
+	Context.portal.WriteDiskConfig(&config.Portal)
+
 	if Context.dhcpServer != nil {
 		c := dhcpd.ServerConfig{}
 		Context.dhcpServer.WriteDiskConfig(&c)
@@ -381,6 +526,13 @@ func (c *configuration) write() error {
 	}
 
 	config.Clients = Context.clients.forConfig()
+	if Context.policies != nil {
+		config.Policies = Context.policies.forConfig()
+	}
+
+	if Context.canary != nil {
+		Context.canary.WriteDiskConfig(&config.Canary)
+	}
 
 	configFile := config.getConfigFilename()
 	log.Debug("Writing YAML file: %s", configFile)
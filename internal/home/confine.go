@@ -0,0 +1,114 @@
+package home
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// confine restricts the system calls and the filesystem access of the process
+// on Linux.  The files configured after that are only accessible if they're
+// within the working directory.
+func confine(args options) {
+	if runtime.GOOS != "linux" {
+		return
+	} else if args.noConfinement {
+		log.Info("confinement: disabled by the command-line option")
+
+		return
+	}
+
+	err := aghos.Confine(confinedPaths(args))
+	if err != nil {
+		log.Error("confinement: %s", err)
+
+		return
+	}
+
+	log.Info("confinement: applied")
+}
+
+// confinedPaths returns the paths, which AdGuard Home needs the access to
+// according to the current configuration.
+func confinedPaths(args options) (paths map[string]aghos.FSAccess) {
+	abs := func(p string) (res string) {
+		if filepath.IsAbs(p) {
+			return p
+		}
+
+		return filepath.Join(Context.workDir, p)
+	}
+
+	paths = map[string]aghos.FSAccess{}
+	grant := func(p string, a aghos.FSAccess) {
+		if p = abs(p); paths[p] < a {
+			paths[p] = a
+		}
+	}
+
+	grant(Context.workDir, aghos.FSAccessFull)
+	grant(filepath.Dir(abs(Context.configFilename)), aghos.FSAccessFull)
+
+	// The updates replace the executable.
+	if exe, err := os.Executable(); err == nil {
+		grant(filepath.Dir(exe), aghos.FSAccessFull)
+	}
+
+	if args.localFrontend {
+		if wd, err := os.Getwd(); err == nil {
+			grant(wd, aghos.FSAccessRead)
+		}
+	}
+
+	if Context.pidFileName != "" {
+		grant(filepath.Dir(abs(Context.pidFileName)), aghos.FSAccessFull)
+	}
+
+	config.RLock()
+	defer config.RUnlock()
+
+	logFile := config.LogFile
+	if args.logFile != "" {
+		logFile = args.logFile
+	}
+
+	if logFile != "" && logFile != configSyslog {
+		// The rotation creates and removes the files next to the log file.
+		grant(filepath.Dir(abs(logFile)), aghos.FSAccessFull)
+	}
+
+	files := []string{
+		config.TLS.CertificatePath,
+		config.TLS.PrivateKeyPath,
+		config.TLS.ClientCAPath,
+		config.DNS.UpstreamDNSFileName,
+		config.TLS.DNSCryptConfigFile,
+	}
+
+	for _, c := range config.TLS.AddrCertificates {
+		files = append(files, c.CertificatePath, c.PrivateKeyPath)
+	}
+
+	for _, c := range config.DNS.UpstreamTLS {
+		files = append(files, c.RootCAPath)
+	}
+
+	for _, flts := range [][]filter{config.Filters, config.WhitelistFilters} {
+		for _, flt := range flts {
+			if filepath.IsAbs(flt.URL) {
+				files = append(files, flt.URL)
+			}
+		}
+	}
+
+	for _, f := range files {
+		if f != "" {
+			grant(f, aghos.FSAccessRead)
+		}
+	}
+
+	return paths
+}
@@ -0,0 +1,147 @@
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// defaultConfirmTimeout is the time after which a provisionally applied
+// configuration change is reverted unless confirmed.
+const defaultConfirmTimeout = 60 * time.Second
+
+// errChangePending is returned when a provisional change is requested while
+// another one is still waiting for confirmation.
+const errChangePending errors.Error = "another provisional change is waiting for confirmation"
+
+// configConfirm tracks a provisionally applied configuration change, which is
+// reverted automatically unless it's confirmed in time, like a "commit
+// confirmed" on a network switch.
+type configConfirm struct {
+	// mu protects all the fields below.
+	mu *sync.Mutex
+
+	// timer fires the revert.  It's nil if there is no pending change.
+	timer *time.Timer
+
+	// deadline is the time when the pending change is going to be reverted.
+	deadline time.Time
+
+	// gen is the generation of the pending change used to make sure that
+	// the revert of a confirmed change isn't performed.
+	gen uint64
+}
+
+// newConfigConfirm returns a new properly initialized *configConfirm.
+func newConfigConfirm() (c *configConfirm) {
+	return &configConfirm{
+		mu: &sync.Mutex{},
+	}
+}
+
+// begin registers a provisional change.  revert is called in a separate
+// goroutine after timeout unless c.confirm is called before that.
+func (c *configConfirm) begin(timeout time.Duration, revert func()) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.timer != nil {
+		return errChangePending
+	}
+
+	c.gen++
+	gen := c.gen
+	c.deadline = time.Now().Add(timeout)
+	c.timer = time.AfterFunc(timeout, func() {
+		defer log.OnPanic("confirm")
+
+		c.mu.Lock()
+		if c.gen != gen || c.timer == nil {
+			c.mu.Unlock()
+
+			return
+		}
+
+		c.timer = nil
+		c.mu.Unlock()
+
+		log.Info("confirm: provisional change is not confirmed, reverting")
+
+		revert()
+	})
+
+	log.Info("confirm: provisional change applied, confirm it before %s", c.deadline)
+
+	return nil
+}
+
+// confirm makes the pending change permanent.  ok is false if there is no
+// pending change.
+func (c *configConfirm) confirm() (ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.timer == nil {
+		return false
+	}
+
+	c.timer.Stop()
+	c.timer = nil
+	c.gen++
+
+	log.Info("confirm: provisional change confirmed")
+
+	return true
+}
+
+// status returns the deadline of the pending change.  ok is false if there is
+// no pending change.
+func (c *configConfirm) status() (deadline time.Time, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.deadline, c.timer != nil
+}
+
+// confirmStatusJSON is the JSON structure for the status of a provisional
+// change.
+type confirmStatusJSON struct {
+	// Deadline is the time when the pending change is going to be reverted.
+	// It's nil if Pending is false.
+	Deadline *time.Time `json:"deadline,omitempty"`
+
+	// Pending is true if there is a change waiting for confirmation.
+	Pending bool `json:"pending"`
+}
+
+// handleConfirmStatus is the handler for the GET /control/config/confirm/status
+// HTTP API.
+func (c *configConfirm) handleConfirmStatus(w http.ResponseWriter, r *http.Request) {
+	resp := confirmStatusJSON{}
+	if deadline, ok := c.status(); ok {
+		resp.Deadline = &deadline
+		resp.Pending = true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "encoding response: %s", err)
+	}
+}
+
+// handleConfirm is the handler for the POST /control/config/confirm HTTP API.
+// Since the previous listeners are closed when the change is applied, the
+// request is necessarily received using the new configuration.
+func (c *configConfirm) handleConfirm(w http.ResponseWriter, r *http.Request) {
+	if !c.confirm() {
+		aghhttp.Error(r, w, http.StatusNotFound, "no pending change")
+
+		return
+	}
+}
@@ -0,0 +1,58 @@
+package home
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigConfirm(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+
+	t.Run("revert", func(t *testing.T) {
+		c := newConfigConfirm()
+
+		reverted := make(chan struct{})
+		err := c.begin(timeout, func() { close(reverted) })
+		require.NoError(t, err)
+
+		_, ok := c.status()
+		assert.True(t, ok)
+
+		err = c.begin(timeout, func() {})
+		assert.ErrorIs(t, err, errChangePending)
+
+		select {
+		case <-reverted:
+			// Go on.
+		case <-time.After(10 * timeout):
+			t.Fatal("change is not reverted")
+		}
+
+		_, ok = c.status()
+		assert.False(t, ok)
+	})
+
+	t.Run("confirm", func(t *testing.T) {
+		c := newConfigConfirm()
+
+		reverted := make(chan struct{})
+		err := c.begin(timeout, func() { close(reverted) })
+		require.NoError(t, err)
+
+		assert.True(t, c.confirm())
+		assert.False(t, c.confirm())
+
+		select {
+		case <-reverted:
+			t.Fatal("confirmed change is reverted")
+		case <-time.After(2 * timeout):
+			// Go on.
+		}
+
+		_, ok := c.status()
+		assert.False(t, ok)
+	})
+}
@@ -24,7 +24,7 @@ func appendDNSAddrs(dst []string, addrs ...net.IP) (res []string) {
 	for _, addr := range addrs {
 		var hostport string
 		if config.DNS.Port != defaultPortDNS {
-			hostport = netutil.JoinHostPort(addr.String(), config.DNS.Port)
+			hostport = netutil.JoinHostPort(addr.String(), uint16(config.DNS.Port))
 		} else {
 			hostport = addr.String()
 		}
@@ -107,6 +107,13 @@ type statusResponse struct {
 	IsRunning       bool   `json:"running"`
 	Version         string `json:"version"`
 	Language        string `json:"language"`
+
+	// DiskSpace is the level of the free space on the disk with the data
+	// directory, if it's monitored.
+	DiskSpace string `json:"disk_space,omitempty"`
+
+	// SafeMode is true if AdGuard Home runs in the safe mode.
+	SafeMode bool `json:"safe_mode"`
 }
 
 func handleStatus(w http.ResponseWriter, r *http.Request) {
@@ -131,6 +138,7 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 			IsRunning: isRunning(),
 			Version:   version.Version(),
 			Language:  config.Language,
+			SafeMode:  Context.safeMode,
 		}
 	}()
 
@@ -141,6 +149,10 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 		resp.IsProtectionEnabled = c.ProtectionEnabled
 	}
 
+	if Context.diskGuard != nil {
+		resp.DiskSpace = Context.diskGuard.currentLevel().String()
+	}
+
 	// IsDHCPAvailable field is now false by default for Windows.
 	if runtime.GOOS != "windows" {
 		resp.IsDHCPAvailable = Context.dhcpServer != nil
@@ -182,10 +194,21 @@ func registerControlHandlers() {
 	Context.mux.HandleFunc("/control/version.json", postInstall(optionalAuth(handleGetVersionJSON)))
 	httpRegister(http.MethodPost, "/control/update", handleUpdate)
 	httpRegister(http.MethodGet, "/control/profile", handleGetProfile)
+	httpRegister(http.MethodGet, "/control/config/confirm/status", Context.confirm.handleConfirmStatus)
+	httpRegister(http.MethodPost, "/control/config/confirm", Context.confirm.handleConfirm)
+	httpRegister(http.MethodGet, "/control/web_info", handleWebInfo)
+	httpRegister(http.MethodPost, "/control/web_config", handleWebConfig)
+	httpRegister(http.MethodGet, "/control/users", handleGetUsers)
+	httpRegister(http.MethodPost, "/control/users/set", handleSetUsers)
 
 	// No auth is necessary for DoH/DoT configurations
 	Context.mux.HandleFunc("/apple/doh.mobileconfig", postInstall(handleMobileConfigDoH))
 	Context.mux.HandleFunc("/apple/dot.mobileconfig", postInstall(handleMobileConfigDoT))
+	registerFailoverHandlers()
+	registerNotificationsHandlers()
+	registerWireGuardHandlers()
+	registerStatsShareHandlers()
+	registerPortalHandlers()
 	RegisterAuthHandlers()
 }
 
@@ -287,13 +310,13 @@ func handleHTTPSRedirect(w http.ResponseWriter, r *http.Request) (ok bool) {
 	if r.TLS == nil && web.forceHTTPS {
 		hostPort := host
 		if port := web.conf.PortHTTPS; port != defaultPortHTTPS {
-			hostPort = netutil.JoinHostPort(host, port)
+			hostPort = netutil.JoinHostPort(host, uint16(port))
 		}
 
 		httpsURL := &url.URL{
 			Scheme:   schemeHTTPS,
 			Host:     hostPort,
-			Path:     r.URL.Path,
+			Path:     webPath(r.URL.Path),
 			RawQuery: r.URL.RawQuery,
 		}
 		http.Redirect(w, r, httpsURL.String(), http.StatusTemporaryRedirect)
@@ -324,7 +347,7 @@ func postInstall(handler func(http.ResponseWriter, *http.Request)) func(http.Res
 		path := r.URL.Path
 		if Context.firstRun && !strings.HasPrefix(path, "/install.") &&
 			!strings.HasPrefix(path, "/assets/") {
-			http.Redirect(w, r, "/install.html", http.StatusFound)
+			http.Redirect(w, r, webPath("/install.html"), http.StatusFound)
 
 			return
 		}
@@ -0,0 +1,251 @@
+package home
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// ipsEqual returns true if a and b contain the same IP addresses in the same
+// order.
+func ipsEqual(a, b []net.IP) (ok bool) {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i, ip := range a {
+		if !ip.Equal(b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validateBindPorts returns an error if the web port webPort or the plain DNS
+// port dnsPort conflict with each other or with the other ports in use.
+func validateBindPorts(webPort, dnsPort int) (err error) {
+	tlsConf := tlsConfigSettings{}
+	Context.tls.WriteDiskConfig(&tlsConf)
+
+	ports := []int{webPort, config.BetaBindPort, dnsPort}
+	if tlsConf.Enabled {
+		ports = append(
+			ports,
+			tlsConf.PortHTTPS,
+			tlsConf.PortDNSOverTLS,
+			tlsConf.PortDNSOverQUIC,
+			tlsConf.PortDNSCrypt,
+		)
+	}
+
+	return validatePorts(ports...)
+}
+
+// setDNSBindAddrs changes the addresses the plain DNS server listens on.
+// hosts is nil and port is zero if they aren't changed.  If provisional is
+// true, the change is reverted unless it's confirmed within
+// defaultConfirmTimeout.
+func setDNSBindAddrs(hosts []net.IP, port int, provisional bool) (err error) {
+	config.RLock()
+	prevHosts, prevPort, webPort := config.DNS.BindHosts, config.DNS.Port, config.BindPort
+	config.RUnlock()
+
+	if hosts == nil {
+		hosts = prevHosts
+	}
+
+	if port == 0 {
+		port = prevPort
+	}
+
+	if port == prevPort && ipsEqual(hosts, prevHosts) {
+		return nil
+	}
+
+	err = validateBindPorts(webPort, port)
+	if err != nil {
+		return err
+	}
+
+	// The server may listen on the previous port on all of the hosts, so
+	// only check the availability of a new one.
+	if port != prevPort {
+		for _, h := range hosts {
+			for _, network := range []string{"udp", "tcp"} {
+				err = aghnet.CheckPort(network, h, port)
+				if err != nil {
+					return fmt.Errorf("checking %s address %s:%d: %w", network, h, port, err)
+				}
+			}
+		}
+	}
+
+	if provisional {
+		err = Context.confirm.begin(defaultConfirmTimeout, func() {
+			revertErr := applyDNSBindAddrs(prevHosts, prevPort)
+			if revertErr != nil {
+				log.Error("dns: reverting bind addresses: %s", revertErr)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return applyDNSBindAddrs(hosts, port)
+}
+
+// applyDNSBindAddrs sets the addresses the plain DNS server listens on and
+// restarts it.
+func applyDNSBindAddrs(hosts []net.IP, port int) (err error) {
+	config.Lock()
+	config.DNS.BindHosts, config.DNS.Port = hosts, port
+	config.Unlock()
+
+	onConfigModified()
+
+	return reconfigureDNSServer()
+}
+
+// webConfigJSON is the JSON structure for the address of the web interface.
+type webConfigJSON struct {
+	BindHost net.IP `json:"bind_host"`
+	BindPort int    `json:"bind_port"`
+
+	// Provisional, if true, means that the new address must be reverted
+	// unless it's confirmed within defaultConfirmTimeout.
+	Provisional bool `json:"provisional,omitempty"`
+}
+
+// handleWebInfo is the handler for the GET /control/web_info HTTP API.
+func handleWebInfo(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	resp := webConfigJSON{
+		BindHost: config.BindHost,
+		BindPort: config.BindPort,
+	}
+	config.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "encoding response: %s", err)
+	}
+}
+
+// handleWebConfig is the handler for the POST /control/web_config HTTP API.
+// The HTTP server is restarted on the new address after the response is sent.
+func handleWebConfig(w http.ResponseWriter, r *http.Request) {
+	req := webConfigJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "parsing request: %s", err)
+
+		return
+	}
+
+	if req.BindHost == nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "no bind_host")
+
+		return
+	} else if req.BindPort <= 0 || req.BindPort > math.MaxUint16 {
+		aghhttp.Error(r, w, http.StatusBadRequest, "bad bind_port %d", req.BindPort)
+
+		return
+	}
+
+	config.RLock()
+	prevHost, prevPort, dnsPort := config.BindHost, config.BindPort, config.DNS.Port
+	config.RUnlock()
+
+	if req.BindHost.Equal(prevHost) && req.BindPort == prevPort {
+		return
+	}
+
+	err = validateBindPorts(req.BindPort, dnsPort)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	// The server may listen on the previous port on all of the hosts, so
+	// only check the availability of a new one.
+	if req.BindPort != prevPort {
+		err = aghnet.CheckPort("tcp", req.BindHost, req.BindPort)
+		if err != nil {
+			aghhttp.Error(
+				r,
+				w,
+				http.StatusBadRequest,
+				"checking address %s:%d: %s",
+				req.BindHost,
+				req.BindPort,
+				err,
+			)
+
+			return
+		}
+	}
+
+	if req.Provisional {
+		err = Context.confirm.begin(defaultConfirmTimeout, func() {
+			Context.web.setBindAddr(prevHost, prevPort)
+		})
+		if err != nil {
+			aghhttp.Error(r, w, http.StatusConflict, "%s", err)
+
+			return
+		}
+	}
+
+	aghhttp.OK(w)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	Context.web.setBindAddr(req.BindHost, req.BindPort)
+}
+
+// setBindAddr sets the address of the web interface and restarts the HTTP
+// servers, as well as the HTTPS one if it listens on the same host.  It's safe
+// for concurrent use, since the revert of a provisional change calls it from
+// the timer goroutine.
+func (web *Web) setBindAddr(host net.IP, port int) {
+	config.Lock()
+	config.BindHost, config.BindPort = host, port
+	web.conf.BindHost, web.conf.BindPort = host, port
+	restartHTTPS := len(web.conf.HTTPSBindHosts) == 0
+	config.Unlock()
+
+	onConfigModified()
+
+	// Method http.(*Server).Shutdown needs to be called in a separate
+	// goroutine and with its own context, because it waits until all requests
+	// are handled and will be blocked by it's own caller.
+	go func() {
+		defer log.OnPanic("web")
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		shutdownSrv(ctx, web.httpServer)
+		shutdownSrv(ctx, web.httpServerBeta)
+
+		if restartHTTPS {
+			web.httpsServer.cond.L.Lock()
+			defer web.httpsServer.cond.L.Unlock()
+
+			shutdownSrv(ctx, web.httpsServer.server)
+			closeHTTP3(web.httpsServer.server3)
+		}
+	}()
+}
@@ -13,8 +13,11 @@ import (
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/AdGuardHome/internal/schedule"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/miekg/dns"
+	"golang.org/x/net/idna"
 )
 
 // validateFilterURL validates the filter list URL or file name.
@@ -179,9 +182,10 @@ func (f *Filtering) handleFilteringRemoveURL(w http.ResponseWriter, r *http.Requ
 }
 
 type filterURLJSON struct {
-	Name    string `json:"name"`
-	URL     string `json:"url"`
-	Enabled bool   `json:"enabled"`
+	Schedule *schedule.Config `json:"schedule"`
+	Name     string           `json:"name"`
+	URL      string           `json:"url"`
+	Enabled  bool             `json:"enabled"`
 }
 
 type filterURLReq struct {
@@ -207,11 +211,21 @@ func (f *Filtering) handleFilteringSetURL(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if fj.Data.Schedule != nil {
+		_, err = schedule.New(fj.Data.Schedule)
+		if err != nil {
+			aghhttp.Error(r, w, http.StatusBadRequest, "invalid schedule: %s", err)
+
+			return
+		}
+	}
+
 	filt := filter{
 		Enabled: fj.Data.Enabled,
 		Name:    fj.Data.Name,
 		URL:     fj.Data.URL,
 	}
+	filt.Schedule = fj.Data.Schedule
 	status := f.filterSetProperties(fj.URL, filt, fj.Whitelist)
 	if (status & statusFound) == 0 {
 		http.Error(w, "URL doesn't exist", http.StatusBadRequest)
@@ -224,8 +238,8 @@ func (f *Filtering) handleFilteringSetURL(w http.ResponseWriter, r *http.Request
 
 	onConfigModified()
 	restart := false
-	if (status & statusEnabledChanged) != 0 {
-		// we must add or remove filter rules
+	if (status & (statusEnabledChanged | statusScheduleChanged)) != 0 {
+		// we must add or remove filter rules or update their schedules
 		restart = true
 	}
 	if (status&statusUpdateRequired) != 0 && fj.Data.Enabled {
@@ -256,7 +270,15 @@ func (f *Filtering) handleFilteringSetRules(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	config.UserRules = strings.Split(string(body), "\n")
+	rules := strings.Split(string(body), "\n")
+	err = config.Quotas.checkCustomRules(rules, config.Quotas.tenantOf(r))
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	config.UserRules = rules
 	onConfigModified()
 	enableFilters(true)
 }
@@ -311,12 +333,13 @@ func (f *Filtering) handleFilteringRefresh(w http.ResponseWriter, r *http.Reques
 }
 
 type filterJSON struct {
-	ID          int64  `json:"id"`
-	Enabled     bool   `json:"enabled"`
-	URL         string `json:"url"`
-	Name        string `json:"name"`
-	RulesCount  uint32 `json:"rules_count"`
-	LastUpdated string `json:"last_updated"`
+	Schedule    *schedule.Config `json:"schedule,omitempty"`
+	ID          int64            `json:"id"`
+	Enabled     bool             `json:"enabled"`
+	URL         string           `json:"url"`
+	Name        string           `json:"name"`
+	RulesCount  uint32           `json:"rules_count"`
+	LastUpdated string           `json:"last_updated"`
 }
 
 type filteringConfig struct {
@@ -334,6 +357,7 @@ func filterToJSON(f filter) filterJSON {
 		URL:        f.URL,
 		Name:       f.Name,
 		RulesCount: uint32(f.RulesCount),
+		Schedule:   f.Schedule,
 	}
 
 	if !f.LastUpdated.IsZero() {
@@ -426,12 +450,24 @@ type checkHostResp struct {
 	// for Rewrite:
 	CanonName string   `json:"cname"`    // CNAME value
 	IPList    []net.IP `json:"ip_addrs"` // list of IP addresses
+
+	// Homograph is true if the host looks like it's made to be confused with
+	// another one.
+	Homograph bool `json:"homograph"`
 }
 
 func (f *Filtering) handleCheckHost(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
 	host := q.Get("name")
 
+	// The rules are matched against the punycode form of the internationalized
+	// domain names.
+	if ascii, err := idna.ToASCII(strings.ToLower(host)); err != nil {
+		log.Debug("check host: converting %q to punycode: %s", host, err)
+	} else {
+		host = ascii
+	}
+
 	setts := Context.dnsFilter.GetConfig()
 	setts.FilteringEnabled = true
 	setts.ProtectionEnabled = true
@@ -455,6 +491,7 @@ func (f *Filtering) handleCheckHost(w http.ResponseWriter, r *http.Request) {
 	resp.SvcName = result.ServiceName
 	resp.CanonName = result.CanonName
 	resp.IPList = result.IPList
+	resp.Homograph = filtering.IsHomograph(host)
 
 	if len(result.Rules) > 0 {
 		resp.FilterID = result.Rules[0].FilterListID
@@ -487,6 +524,7 @@ func (f *Filtering) RegisterFilteringHandlers() {
 	httpRegister(http.MethodPost, "/control/filtering/remove_url", f.handleFilteringRemoveURL)
 	httpRegister(http.MethodPost, "/control/filtering/set_url", f.handleFilteringSetURL)
 	httpRegister(http.MethodPost, "/control/filtering/refresh", f.handleFilteringRefresh)
+	httpRegister(http.MethodGet, "/control/filtering/update_status", f.handleFilteringUpdateStatus)
 	httpRegister(http.MethodPost, "/control/filtering/set_rules", f.handleFilteringSetRules)
 	httpRegister(http.MethodGet, "/control/filtering/check_host", f.handleCheckHost)
 }
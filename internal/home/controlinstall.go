@@ -73,8 +73,16 @@ type checkConfigReq struct {
 }
 
 type checkConfigRespEnt struct {
-	Status     string `json:"status"`
-	CanAutofix bool   `json:"can_autofix"`
+	// Holder is the process holding the port, if it's known.
+	Holder *portHolderJSON `json:"holder,omitempty"`
+
+	Status string `json:"status"`
+
+	// AutofixService is the systemd unit of the service, which is disabled
+	// by the autofix, if CanAutofix is true.
+	AutofixService string `json:"autofix_service,omitempty"`
+
+	CanAutofix bool `json:"can_autofix"`
 }
 
 type staticIPJSON struct {
@@ -108,7 +116,7 @@ func (web *Web) handleInstallCheckConfig(w http.ResponseWriter, r *http.Request)
 	} else if reqData.Web.Port != 0 {
 		err = aghnet.CheckPort("tcp", reqData.Web.IP, reqData.Web.Port)
 		if err != nil {
-			respData.Web.Status = err.Error()
+			_ = portConflictStatus(&respData.Web, err, "tcp", reqData.Web.Port)
 		}
 	}
 
@@ -116,41 +124,62 @@ func (web *Web) handleInstallCheckConfig(w http.ResponseWriter, r *http.Request)
 	if err = pm.validate(); err != nil {
 		respData.DNS.Status = err.Error()
 	} else if reqData.DNS.Port != 0 {
-		err = aghnet.CheckPort("udp", reqData.DNS.IP, reqData.DNS.Port)
+		checkDNSPort(&reqData.DNS, &respData.DNS)
+		if respData.DNS.Status == "" && !reqData.DNS.IP.IsUnspecified() {
+			respData.StaticIP = handleStaticIP(reqData.DNS.IP, reqData.SetStaticIP)
+		}
+	}
 
-		if aghnet.IsAddrInUse(err) {
-			canAutofix := checkDNSStubListener()
-			if canAutofix && reqData.DNS.Autofix {
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(respData)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "Unable to marshal JSON: %s", err)
 
-				err = disableDNSStubListener()
-				if err != nil {
-					log.Error("Couldn't disable DNSStubListener: %s", err)
-				}
+		return
+	}
+}
 
-				err = aghnet.CheckPort("udp", reqData.DNS.IP, reqData.DNS.Port)
-				canAutofix = false
-			}
+// checkDNSPort checks if the DNS port from req is available over both UDP and
+// TCP and fills resp.  If the port is held by a known service, which can be
+// disabled, and req asks for the autofix, the service is disabled.
+func checkDNSPort(req *checkConfigReqEnt, resp *checkConfigRespEnt) {
+	for _, network := range []string{"udp", "tcp"} {
+		err := aghnet.CheckPort(network, req.IP, req.Port)
+		if err == nil {
+			continue
+		}
 
-			respData.DNS.CanAutofix = canAutofix
+		svc := portConflictStatus(resp, err, network, req.Port)
+		if svc == nil && resp.Holder == nil && aghnet.IsAddrInUse(err) {
+			// The holder may be unknown because of the lack of the
+			// permissions, so assume the most common one.
+			svc = portServices["systemd-resolve"]
 		}
 
-		if err == nil {
-			err = aghnet.CheckPort("tcp", reqData.DNS.IP, reqData.DNS.Port)
+		if svc == nil || !svc.canDisable() {
+			return
+		}
+
+		if !req.Autofix {
+			resp.CanAutofix = true
+			resp.AutofixService = svc.unit
+
+			return
 		}
 
+		err = svc.disable()
 		if err != nil {
-			respData.DNS.Status = err.Error()
-		} else if !reqData.DNS.IP.IsUnspecified() {
-			respData.StaticIP = handleStaticIP(reqData.DNS.IP, reqData.SetStaticIP)
+			log.Error("disabling %s: %s", svc.unit, err)
 		}
-	}
 
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(respData)
-	if err != nil {
-		aghhttp.Error(r, w, http.StatusInternalServerError, "Unable to marshal JSON: %s", err)
+		err = aghnet.CheckPort(network, req.IP, req.Port)
+		if err != nil {
+			_ = portConflictStatus(resp, err, network, req.Port)
 
-		return
+			return
+		}
+
+		*resp = checkConfigRespEnt{}
 	}
 }
 
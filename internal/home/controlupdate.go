@@ -3,7 +3,9 @@ package home
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -18,6 +20,37 @@ import (
 	"github.com/AdguardTeam/golibs/log"
 )
 
+// updateConfig is the configuration of the self-update.
+type updateConfig struct {
+	// MirrorURL is the base URL of the update mirror, which serves the
+	// version information and the packages in the same layout as
+	// https://static.adguard.com/adguardhome.  If empty, the official server
+	// is used.
+	MirrorURL string `yaml:"mirror_url"`
+
+	// DisableDelta makes AdGuard Home always download the full packages
+	// instead of the binary patches.
+	DisableDelta bool `yaml:"disable_delta"`
+}
+
+// validate returns an error if c is invalid.
+func (c *updateConfig) validate() (err error) {
+	if c.MirrorURL == "" {
+		return nil
+	}
+
+	u, err := url.Parse(c.MirrorURL)
+	if err != nil {
+		return fmt.Errorf("mirror_url: %w", err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("mirror_url: bad scheme %q", u.Scheme)
+	} else if u.Host == "" {
+		return errors.Error("mirror_url: no host")
+	}
+
+	return nil
+}
+
 // temporaryError is the interface for temporary errors from the Go standard
 // library.
 type temporaryError interface {
@@ -0,0 +1,231 @@
+package home
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/AdGuardHome/internal/version"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// crashLogLines is the number of the latest log lines kept for the crash
+// reports.
+const crashLogLines = 200
+
+// logRing is an io.Writer which keeps the latest lines written to it.
+type logRing struct {
+	// mu protects lines and next.
+	mu *sync.Mutex
+
+	// lines is the circular buffer of the lines.  Its elements are empty
+	// until the buffer is filled for the first time.
+	lines []string
+
+	// next is the index of the element of lines to write the next line to.
+	next int
+}
+
+// newLogRing returns a new *logRing keeping the n latest lines.
+func newLogRing(n int) (r *logRing) {
+	return &logRing{
+		mu:    &sync.Mutex{},
+		lines: make([]string, n),
+	}
+}
+
+// type check
+var _ io.Writer = (*logRing)(nil)
+
+// Write implements the io.Writer interface for *logRing.
+func (r *logRing) Write(p []byte) (n int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := bufio.NewScanner(bytes.NewReader(p))
+	for s.Scan() {
+		r.lines[r.next] = s.Text()
+		r.next = (r.next + 1) % len(r.lines)
+	}
+
+	return len(p), nil
+}
+
+// recent returns the kept lines, the oldest first.
+func (r *logRing) recent() (lines []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.lines {
+		l := r.lines[(r.next+i)%len(r.lines)]
+		if l != "" {
+			lines = append(lines, l)
+		}
+	}
+
+	return lines
+}
+
+// installLogRing makes the current log output also write to Context.logRing
+// and makes the panics in the goroutines of the other packages write the crash
+// reports as well.  It must be called after the log output is configured.
+func installLogRing() {
+	Context.logRing = newLogRing(crashLogLines)
+	log.SetOutput(io.MultiWriter(log.Writer(), Context.logRing))
+
+	aghos.SetPanicHandler(reportPanic)
+}
+
+// onPanicReport is a deferred helper which, once a panic happens, logs it,
+// writes the crash report into the working directory, and exits.  Unlike
+// log.OnPanicAndExit, it leaves the data to investigate the crash even when
+// the log isn't written anywhere, as it's often the case on routers.  The
+// goroutines of the other packages use aghos.OnPanicAndExit, which calls
+// reportPanic once installLogRing is called.
+func onPanicReport(prefix string) {
+	v := recover()
+	if v == nil {
+		return
+	}
+
+	reportPanic(prefix, v)
+}
+
+// reportPanic logs the panic with value v, writes the crash report into the
+// working directory, and exits.  It implements aghos.PanicHandler.
+func reportPanic(prefix string, v interface{}) {
+	log.Error("%s: panic encountered, exiting: %v", prefix, v)
+
+	path, err := writeCrashReport(v, time.Now())
+	if err != nil {
+		log.Error("%s: writing crash report: %s", prefix, err)
+	} else {
+		log.Error("%s: crash report written to %s", prefix, path)
+	}
+
+	os.Exit(1)
+}
+
+// writeCrashReport writes the crash report of the panic with value v into a
+// new file in the working directory and returns its path.
+func writeCrashReport(v interface{}, now time.Time) (path string, err error) {
+	name := fmt.Sprintf("crash-%s.txt", now.UTC().Format("20060102-150405"))
+	path = filepath.Join(Context.workDir, name)
+
+	buf := &bytes.Buffer{}
+	crashReport(buf, v, now)
+
+	err = os.WriteFile(path, buf.Bytes(), 0o600)
+	if err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// crashReport writes the report of the panic with value v to w.  The state of
+// the modules is read without locking, since the locks may be held by the
+// panicking goroutine.
+func crashReport(w io.Writer, v interface{}, now time.Time) {
+	fmt.Fprintf(w, "%s\n", version.Full())
+	fmt.Fprintf(w, "time: %s\n", now.UTC().Format(time.RFC3339))
+	if !Context.startTime.IsZero() {
+		fmt.Fprintf(w, "uptime: %s\n", now.Sub(Context.startTime).Truncate(time.Second))
+	}
+
+	fmt.Fprintf(w, "panic: %v\n", v)
+
+	fmt.Fprintln(w, "\n# metrics")
+
+	ms := &runtime.MemStats{}
+	runtime.ReadMemStats(ms)
+	fmt.Fprintf(w, "goroutines: %d\n", runtime.NumGoroutine())
+	fmt.Fprintf(w, "heap alloc: %d bytes\n", ms.HeapAlloc)
+	fmt.Fprintf(w, "sys: %d bytes\n", ms.Sys)
+	fmt.Fprintf(w, "gc cycles: %d\n", ms.NumGC)
+
+	fmt.Fprintln(w, "\n# config")
+
+	confPath := config.getConfigFilename()
+	fmt.Fprintf(w, "file: %s\n", confPath)
+	data, err := os.ReadFile(confPath)
+	if err != nil {
+		fmt.Fprintf(w, "sha256: error: %s\n", err)
+	} else {
+		fmt.Fprintf(w, "sha256: %x\n", sha256.Sum256(data))
+	}
+
+	fmt.Fprintln(w, "\n# modules")
+
+	for _, s := range moduleStates() {
+		fmt.Fprintln(w, s)
+	}
+
+	fmt.Fprintln(w, "\n# recent log")
+
+	if Context.logRing != nil {
+		for _, l := range Context.logRing.recent() {
+			fmt.Fprintln(w, l)
+		}
+	}
+
+	fmt.Fprintln(w, "\n# goroutines")
+
+	_, _ = w.Write(allStacks())
+}
+
+// moduleStates returns the human-readable states of the main modules.
+func moduleStates() (states []string) {
+	onOff := func(ok bool) (s string) {
+		if ok {
+			return "enabled"
+		}
+
+		return "disabled"
+	}
+
+	dnsState := "not initialized"
+	if Context.dnsServer != nil {
+		dnsState = "stopped"
+		if Context.dnsServer.IsRunning() {
+			dnsState = "running"
+		}
+	}
+
+	diskState := "not monitored"
+	if Context.diskGuard != nil {
+		diskState = Context.diskGuard.currentLevel().String()
+	}
+
+	return []string{
+		fmt.Sprintf("first run: %t", Context.firstRun),
+		"dns: " + dnsState,
+		"protection: " + onOff(config.DNS.ProtectionEnabled),
+		"filtering: " + onOff(config.DNS.FilteringEnabled),
+		"query log: " + onOff(config.DNS.QueryLogEnabled),
+		"dhcp: " + onOff(Context.dhcpServer != nil && Context.dhcpServer.Enabled()),
+		"tls: " + onOff(config.TLS.Enabled),
+		"disk space: " + diskState,
+	}
+}
+
+// allStacks returns the stack traces of all goroutines.
+func allStacks() (stacks []byte) {
+	stacks = make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(stacks, true)
+		if n < len(stacks) {
+			return stacks[:n]
+		}
+
+		stacks = make([]byte, 2*len(stacks))
+	}
+}
@@ -0,0 +1,62 @@
+package home
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogRing(t *testing.T) {
+	r := newLogRing(3)
+	assert.Empty(t, r.recent())
+
+	_, _ = r.Write([]byte("1\n"))
+	_, _ = r.Write([]byte("2\n3\n"))
+	assert.Equal(t, []string{"1", "2", "3"}, r.recent())
+
+	_, _ = r.Write([]byte("4\n"))
+	assert.Equal(t, []string{"2", "3", "4"}, r.recent())
+}
+
+func TestWriteCrashReport(t *testing.T) {
+	prevWorkDir, prevConfFile, prevRing := Context.workDir, Context.configFilename, Context.logRing
+	t.Cleanup(func() {
+		Context.workDir, Context.configFilename, Context.logRing = prevWorkDir, prevConfFile, prevRing
+	})
+
+	const confData = "dns:\n  bind_hosts: []\n"
+
+	dir := t.TempDir()
+	Context.workDir = dir
+	Context.configFilename = "AdGuardHome.yaml"
+	Context.logRing = newLogRing(crashLogLines)
+	_, _ = Context.logRing.Write([]byte("last log line\n"))
+
+	err := os.WriteFile(filepath.Join(dir, Context.configFilename), []byte(confData), 0o600)
+	require.NoError(t, err)
+
+	now := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	path, err := writeCrashReport("test panic", now)
+	require.NoError(t, err)
+
+	assert.Equal(t, filepath.Join(dir, "crash-20220102-030405.txt"), path)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	report := string(data)
+	for _, want := range []string{
+		"panic: test panic\n",
+		"sha256: 0aefb33bda2cc7e9eddf08ce24f59f611528a2e8d37a1794115f11f0ca070d50\n",
+		"dns: not initialized\n",
+		"last log line\n",
+		"# goroutines\n",
+		"TestWriteCrashReport",
+	} {
+		assert.Contains(t, report, want)
+	}
+}
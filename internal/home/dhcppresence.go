@@ -0,0 +1,70 @@
+package home
+
+import (
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
+)
+
+// leaseWatcher reports the clients, which have obtained or renewed their
+// dynamic DHCP leases, as active to the statistics presence tracker.
+type leaseWatcher struct {
+	// mu protects expiry and started.
+	mu *sync.Mutex
+
+	// leases returns the current dynamic leases.
+	leases func() (ls []*dhcpd.Lease)
+
+	// seen is called with the IP address of each client, which has obtained
+	// or renewed its lease.
+	seen func(client string)
+
+	// expiry are the expiration times of the leases by their IP addresses as
+	// of the previous change.
+	expiry map[string]time.Time
+
+	// started is true if the initial leases have already been recorded.
+	started bool
+}
+
+// newLeaseWatcher returns a new lease watcher for the leases of srv reporting
+// to the statistics module from Context.
+func newLeaseWatcher(srv *dhcpd.Server) (w *leaseWatcher) {
+	return &leaseWatcher{
+		mu:     &sync.Mutex{},
+		leases: func() (ls []*dhcpd.Lease) { return srv.Leases(dhcpd.LeasesDynamic) },
+		seen: func(client string) {
+			// The statistics are initialized after the DHCP server.
+			if Context.stats != nil {
+				Context.stats.ClientSeen(client)
+			}
+		},
+		expiry: map[string]time.Time{},
+	}
+}
+
+// onLeaseChanged is the dhcpd.OnLeaseChangedT callback.  Each grant or renewal
+// of a lease moves its expiration time, so the leases with the new expiration
+// times belong to the clients that have just been active.
+func (w *leaseWatcher) onLeaseChanged(flags int) {
+	if flags != dhcpd.LeaseChangedAdded {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	expiry := map[string]time.Time{}
+	for _, l := range w.leases() {
+		ip := l.IP.String()
+		expiry[ip] = l.Expiry
+
+		if prev, ok := w.expiry[ip]; w.started && (!ok || !prev.Equal(l.Expiry)) {
+			w.seen(ip)
+		}
+	}
+
+	w.expiry = expiry
+	w.started = true
+}
@@ -0,0 +1,49 @@
+package home
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeaseWatcher(t *testing.T) {
+	exp := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	leases := []*dhcpd.Lease{{
+		Expiry: exp,
+		IP:     net.IP{192, 168, 0, 2},
+	}, {
+		Expiry: exp,
+		IP:     net.IP{192, 168, 0, 3},
+	}}
+
+	var seen []string
+	w := &leaseWatcher{
+		mu:     &sync.Mutex{},
+		leases: func() (ls []*dhcpd.Lease) { return leases },
+		seen:   func(client string) { seen = append(seen, client) },
+		expiry: map[string]time.Time{},
+	}
+
+	// The initial leases aren't reported.
+	w.onLeaseChanged(dhcpd.LeaseChangedAdded)
+	assert.Empty(t, seen)
+
+	leases[1] = &dhcpd.Lease{
+		Expiry: exp.Add(time.Hour),
+		IP:     net.IP{192, 168, 0, 3},
+	}
+	leases = append(leases, &dhcpd.Lease{
+		Expiry: exp,
+		IP:     net.IP{192, 168, 0, 4},
+	})
+
+	w.onLeaseChanged(dhcpd.LeaseChangedDBStore)
+	assert.Empty(t, seen)
+
+	w.onLeaseChanged(dhcpd.LeaseChangedAdded)
+	assert.Equal(t, []string{"192.168.0.3", "192.168.0.4"}, seen)
+}
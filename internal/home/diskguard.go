@@ -0,0 +1,166 @@
+package home
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/timeutil"
+)
+
+// diskGuardConfig is the configuration of the monitoring of the free space on
+// the disk with the data directory.
+type diskGuardConfig struct {
+	// Interval is the interval between the checks.  If zero, the free space
+	// isn't monitored.
+	Interval timeutil.Duration `yaml:"interval"`
+
+	// LowSpaceMB is the amount of the free space in mebibytes below which
+	// the query log stops writing to the file.
+	LowSpaceMB uint64 `yaml:"low_space_mb"`
+
+	// CriticalSpaceMB is the amount of the free space in mebibytes below
+	// which the statistics also stop writing to the database.
+	CriticalSpaceMB uint64 `yaml:"critical_space_mb"`
+}
+
+// diskSpaceLevel is the level of the free space on the disk.
+type diskSpaceLevel uint32
+
+// diskSpaceLevel values.
+const (
+	diskSpaceUnknown diskSpaceLevel = iota
+	diskSpaceOK
+	diskSpaceLow
+	diskSpaceCritical
+)
+
+// String implements the fmt.Stringer interface for diskSpaceLevel.
+func (l diskSpaceLevel) String() (s string) {
+	switch l {
+	case diskSpaceOK:
+		return "ok"
+	case diskSpaceLow:
+		return "low"
+	case diskSpaceCritical:
+		return "critical"
+	default:
+		return ""
+	}
+}
+
+// mebibyte is the number of bytes in a mebibyte.
+const mebibyte = 1024 * 1024
+
+// diskGuard monitors the free space on the disk with the data directory and
+// pauses the writes of the query log and the statistics when it's low, so that
+// a full disk doesn't corrupt their files.
+type diskGuard struct {
+	// conf is the configuration of the guard.
+	conf *diskGuardConfig
+
+	// freeSpace returns the free space on the disk with path.  It's
+	// aghos.FreeSpace everywhere except the tests.
+	freeSpace func(path string) (free uint64, err error)
+
+	// dir is the monitored directory.
+	dir string
+
+	// level is the current level of the free space.  It must only be
+	// accessed atomically.
+	level uint32
+}
+
+// newDiskGuard returns a new properly initialized disk guard for dir.
+func newDiskGuard(conf *diskGuardConfig, dir string) (g *diskGuard) {
+	return &diskGuard{
+		conf:      conf,
+		freeSpace: aghos.FreeSpace,
+		dir:       dir,
+	}
+}
+
+// classify returns the level of free.
+func (g *diskGuard) classify(free uint64) (l diskSpaceLevel) {
+	switch {
+	case free < g.conf.CriticalSpaceMB*mebibyte:
+		return diskSpaceCritical
+	case free < g.conf.LowSpaceMB*mebibyte:
+		return diskSpaceLow
+	default:
+		return diskSpaceOK
+	}
+}
+
+// currentLevel returns the level of the free space seen by the latest check.
+func (g *diskGuard) currentLevel() (l diskSpaceLevel) {
+	return diskSpaceLevel(atomic.LoadUint32(&g.level))
+}
+
+// check checks the free space and applies the corresponding degradation.  It
+// returns the new level.
+func (g *diskGuard) check() (l diskSpaceLevel, err error) {
+	free, err := g.freeSpace(g.dir)
+	if err != nil {
+		return diskSpaceUnknown, err
+	}
+
+	l = g.classify(free)
+	prev := diskSpaceLevel(atomic.SwapUint32(&g.level, uint32(l)))
+	if l != prev {
+		switch l {
+		case diskSpaceLow, diskSpaceCritical:
+			log.Error(
+				"disk guard: only %d MiB free in %s, disk space is %s",
+				free/mebibyte,
+				g.dir,
+				l,
+			)
+		default:
+			if prev != diskSpaceUnknown {
+				log.Info("disk guard: %d MiB free in %s, resuming", free/mebibyte, g.dir)
+			}
+		}
+	}
+
+	// Apply the degradation on every check, since the modules may have been
+	// recreated after a reconfiguration.
+	if Context.queryLog != nil {
+		Context.queryLog.PauseDiskWrites(l >= diskSpaceLow)
+	}
+
+	if Context.stats != nil {
+		Context.stats.PauseDiskWrites(l >= diskSpaceCritical)
+	}
+
+	return l, nil
+}
+
+// start starts checking the free space periodically in a separate goroutine.
+func (g *diskGuard) start() {
+	ivl := g.conf.Interval.Duration
+	if ivl == 0 {
+		return
+	}
+
+	go func() {
+		defer onPanicReport("disk guard")
+
+		for {
+			_, err := g.check()
+			if err != nil {
+				if errors.As(err, new(*aghos.UnsupportedError)) {
+					log.Info("disk guard: %s, stopping", err)
+
+					return
+				}
+
+				log.Error("disk guard: checking free space: %s", err)
+			}
+
+			time.Sleep(ivl)
+		}
+	}()
+}
@@ -0,0 +1,72 @@
+package home
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskGuard_check(t *testing.T) {
+	const testErr errors.Error = "test error"
+
+	var free uint64
+	var freeErr error
+	g := newDiskGuard(&diskGuardConfig{
+		LowSpaceMB:      512,
+		CriticalSpaceMB: 64,
+	}, "/data")
+	g.freeSpace = func(_ string) (n uint64, err error) {
+		return free, freeErr
+	}
+
+	testCases := []struct {
+		err        error
+		name       string
+		wantErrMsg string
+		free       uint64
+		want       diskSpaceLevel
+	}{{
+		err:        nil,
+		name:       "ok",
+		wantErrMsg: "",
+		free:       1024 * mebibyte,
+		want:       diskSpaceOK,
+	}, {
+		err:        nil,
+		name:       "low",
+		wantErrMsg: "",
+		free:       256 * mebibyte,
+		want:       diskSpaceLow,
+	}, {
+		err:        nil,
+		name:       "critical",
+		wantErrMsg: "",
+		free:       32 * mebibyte,
+		want:       diskSpaceCritical,
+	}, {
+		err:        nil,
+		name:       "resumed",
+		wantErrMsg: "",
+		free:       512 * mebibyte,
+		want:       diskSpaceOK,
+	}, {
+		err:        testErr,
+		name:       "error",
+		wantErrMsg: string(testErr),
+		free:       0,
+		want:       diskSpaceUnknown,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			free, freeErr = tc.free, tc.err
+
+			l, err := g.check()
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.want, l)
+		})
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
@@ -16,6 +17,7 @@ import (
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/stringutil"
 	"github.com/ameshkov/dnscrypt/v2"
 	yaml "gopkg.in/yaml.v2"
 )
@@ -51,6 +53,9 @@ func initDNSServer() (err error) {
 		LimitDays:      config.DNS.StatsInterval,
 		ConfigModified: onConfigModified,
 		HTTPRegister:   httpRegister,
+		HTTPClient:     Context.client,
+		Push:           config.DNS.StatsPush,
+		Presence:       config.DNS.StatsPresence,
 	}
 	Context.stats, err = stats.New(statsConf)
 	if err != nil {
@@ -63,7 +68,9 @@ func initDNSServer() (err error) {
 		FindClient:        Context.clients.findMultiple,
 		BaseDir:           baseDir,
 		RotationIvl:       config.DNS.QueryLogInterval.Duration,
+		MaxRotationIvl:    config.Quotas.maxQueryLogInterval,
 		MemSize:           config.DNS.QueryLogMemSize,
+		FlushIvl:          config.DNS.QueryLogFlushInterval.Duration,
 		Enabled:           config.DNS.QueryLogEnabled,
 		FileEnabled:       config.DNS.QueryLogFileEnabled,
 		AnonymizeClientIP: config.DNS.AnonymizeClientIP,
@@ -75,6 +82,9 @@ func initDNSServer() (err error) {
 	filterConf.EtcHosts = Context.etcHosts
 	filterConf.ConfigModified = onConfigModified
 	filterConf.HTTPRegister = httpRegister
+	filterConf.HTTPClient = Context.client
+	filterConf.CustomFunctionsDir = Context.workDir
+	filterConf.QuarantineBlocked = newQuarantineNotifier(&config.Quarantine, Context.client).notify
 	Context.dnsFilter = filtering.New(&filterConf, nil)
 
 	p := dnsforward.DNSCreateParams{
@@ -177,27 +187,42 @@ func generateServerConfig() (newConf dnsforward.ServerConfig, err error) {
 		hosts = []net.IP{{127, 0, 0, 1}}
 	}
 
+	filteringConf := dnsConf.FilteringConfig
+	if Context.safeMode {
+		filteringConf = safeModeFilteringConfig(&dnsConf.FilteringConfig)
+		Context.safeModeDNS = filteringConf
+		Context.safeModeDNS.UpstreamDNS = stringutil.CloneSlice(filteringConf.UpstreamDNS)
+		Context.safeModeDNS.BootstrapDNS = stringutil.CloneSlice(filteringConf.BootstrapDNS)
+	}
+
 	newConf = dnsforward.ServerConfig{
 		UDPListenAddrs:  ipsToUDPAddrs(hosts, dnsConf.Port),
 		TCPListenAddrs:  ipsToTCPAddrs(hosts, dnsConf.Port),
-		FilteringConfig: dnsConf.FilteringConfig,
+		FilteringConfig: filteringConf,
 		ConfigModified:  onConfigModified,
 		HTTPRegister:    httpRegister,
 		OnDNSRequest:    onDNSRequest,
+		SetBindAddrs:    setDNSBindAddrs,
+	}
+
+	if Context.failover != nil {
+		newConf.HealthProbeName = Context.failover.probeName()
 	}
 
 	tlsConf := tlsConfigSettings{}
 	Context.tls.WriteDiskConfig(&tlsConf)
-	if tlsConf.Enabled {
+	if tlsConf.Enabled && !Context.safeMode {
 		newConf.TLSConfig = tlsConf.TLSConfig
 		newConf.TLSConfig.ServerName = tlsConf.ServerName
 
 		if tlsConf.PortDNSOverTLS != 0 {
-			newConf.TLSListenAddrs = ipsToTCPAddrs(hosts, tlsConf.PortDNSOverTLS)
+			dotHosts := bindHostsOr(tlsConf.DoTBindHosts, hosts)
+			newConf.TLSListenAddrs = ipsToTCPAddrs(dotHosts, tlsConf.PortDNSOverTLS)
 		}
 
 		if tlsConf.PortDNSOverQUIC != 0 {
-			newConf.QUICListenAddrs = ipsToUDPAddrs(hosts, tlsConf.PortDNSOverQUIC)
+			doqHosts := bindHostsOr(tlsConf.DoQBindHosts, hosts)
+			newConf.QUICListenAddrs = ipsToUDPAddrs(doqHosts, tlsConf.PortDNSOverQUIC)
 		}
 
 		if tlsConf.PortDNSCrypt != 0 {
@@ -216,6 +241,12 @@ func generateServerConfig() (newConf dnsforward.ServerConfig, err error) {
 
 	newConf.FilterHandler = applyAdditionalFiltering
 	newConf.GetCustomUpstreamByClient = Context.clients.findUpstreams
+	newConf.FilterListName = filterListName
+	newConf.UpstreamHealthChanged = Context.notifier.upstreamHealthChanged
+	newConf.RequestProcessed = Context.canary.requestProcessed
+	newConf.UpstreamTestReportFile = filepath.Join(Context.getDataDir(), "upstream_test.json")
+	newConf.CacheSnapshotFile = filepath.Join(Context.getDataDir(), "dns_cache.json")
+	newConf.DDRPinFile = filepath.Join(Context.getDataDir(), "ddr_pins.json")
 
 	newConf.ResolveClients = dnsConf.ResolveClients
 	newConf.UsePrivateRDNS = dnsConf.UsePrivateRDNS
@@ -272,7 +303,7 @@ func getDNSEncryption() (de dnsEncryption) {
 		if tlsConf.PortHTTPS != 0 {
 			addr := hostname
 			if tlsConf.PortHTTPS != defaultPortHTTPS {
-				addr = netutil.JoinHostPort(addr, tlsConf.PortHTTPS)
+				addr = netutil.JoinHostPort(addr, uint16(tlsConf.PortHTTPS))
 			}
 
 			de.https = (&url.URL{
@@ -285,14 +316,14 @@ func getDNSEncryption() (de dnsEncryption) {
 		if tlsConf.PortDNSOverTLS != 0 {
 			de.tls = (&url.URL{
 				Scheme: "tls",
-				Host:   netutil.JoinHostPort(hostname, tlsConf.PortDNSOverTLS),
+				Host:   netutil.JoinHostPort(hostname, uint16(tlsConf.PortDNSOverTLS)),
 			}).String()
 		}
 
 		if tlsConf.PortDNSOverQUIC != 0 {
 			de.quic = (&url.URL{
 				Scheme: "quic",
-				Host:   netutil.JoinHostPort(hostname, tlsConf.PortDNSOverQUIC),
+				Host:   netutil.JoinHostPort(hostname, uint16(tlsConf.PortDNSOverQUIC)),
 			}).String()
 		}
 	}
@@ -315,6 +346,8 @@ func applyAdditionalFiltering(clientAddr net.IP, clientID string, setts *filteri
 	if !ok {
 		c, ok = Context.clients.Find(clientAddr.String())
 		if !ok {
+			applyPortalSession(clientAddr, setts)
+
 			return
 		}
 	}
@@ -327,6 +360,36 @@ func applyAdditionalFiltering(clientAddr net.IP, clientID string, setts *filteri
 
 	setts.ClientName = c.Name
 	setts.ClientTags = c.Tags
+	setts.AnswerOrder = c.AnswerOrder
+	setts.SuppressAAAAWithoutA = c.SuppressAAAAWithoutA
+	setts.DNS64 = c.DNS64
+	setts.DisableAAAA = c.DisableAAAA
+	if c.Quarantined {
+		log.Debug("client %s is quarantined", c.Name)
+		setts.Quarantined = true
+
+		return
+	}
+
+	// The pending policy of a canary trial overrides the policy of the test
+	// client, but not the quarantine.
+	if Context.canary.apply(setts) {
+		return
+	}
+
+	// The user logged in via the portal overrides the policy of the device,
+	// but not the quarantine.
+	if applyPortalSession(clientAddr, setts) {
+		return
+	}
+
+	if p, ok := Context.policies.find(c, time.Now()); ok {
+		log.Debug("using policy %q for client %s", p.Name, c.Name)
+		p.apply(setts)
+
+		return
+	}
+
 	if !c.UseOwnSettings {
 		return
 	}
@@ -0,0 +1,332 @@
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+)
+
+// failoverConfig is the configuration of the integration with the VRRP
+// daemons, such as keepalived, for the high-availability pairs of AdGuard Home
+// instances.
+type failoverConfig struct {
+	// ProbeName is the domain name resolved by the DNS health check.  If
+	// empty, defaultProbeName is used.
+	ProbeName string `yaml:"probe_name"`
+
+	// ProbeTimeout is the timeout of the DNS health check.  If zero,
+	// defaultProbeTimeout is used.
+	ProbeTimeout timeutil.Duration `yaml:"probe_timeout"`
+
+	// OnMaster is the command with its arguments run when the instance
+	// becomes the master.
+	OnMaster []string `yaml:"on_master"`
+
+	// OnBackup is the command with its arguments run when the instance
+	// becomes the backup.
+	OnBackup []string `yaml:"on_backup"`
+
+	// OnFault is the command with its arguments run when the instance enters
+	// the fault state.
+	OnFault []string `yaml:"on_fault"`
+}
+
+// Default DNS health check parameters.
+const (
+	defaultProbeName    = "example.org"
+	defaultProbeTimeout = 2 * time.Second
+)
+
+// failoverState is the VRRP state of the instance.  The values are the ones
+// keepalived passes to the notify scripts.
+type failoverState string
+
+// failoverState values.
+const (
+	failoverStateUnknown failoverState = "UNKNOWN"
+	failoverStateMaster  failoverState = "MASTER"
+	failoverStateBackup  failoverState = "BACKUP"
+	failoverStateFault   failoverState = "FAULT"
+)
+
+// failover tracks the VRRP state of the instance and runs the state hooks.
+type failover struct {
+	// mu protects state and changed.
+	mu *sync.Mutex
+
+	// hookMu is held while a hook is running, so that the hooks are run in
+	// the order of the state changes.
+	hookMu *sync.Mutex
+
+	// conf is the failover configuration.
+	conf *failoverConfig
+
+	// runCmd runs a hook command.  It's aghos.RunCommand everywhere except
+	// the tests.
+	runCmd func(cmd string, args ...string) (code int, out string, err error)
+
+	// changed is the time of the last state change.
+	changed time.Time
+
+	// state is the current state.
+	state failoverState
+}
+
+// newFailover returns a new properly initialized failover tracker.
+func newFailover(conf *failoverConfig) (f *failover) {
+	return &failover{
+		mu:      &sync.Mutex{},
+		hookMu:  &sync.Mutex{},
+		conf:    conf,
+		runCmd:  aghos.RunCommand,
+		changed: time.Now(),
+		state:   failoverStateUnknown,
+	}
+}
+
+// hook returns the command configured for state.
+func (f *failover) hook(state failoverState) (cmd []string) {
+	switch state {
+	case failoverStateMaster:
+		return f.conf.OnMaster
+	case failoverStateBackup:
+		return f.conf.OnBackup
+	case failoverStateFault:
+		return f.conf.OnFault
+	default:
+		return nil
+	}
+}
+
+// setState changes the state of the instance and runs the corresponding hook
+// if the state has actually changed.
+func (f *failover) setState(state failoverState) (err error) {
+	f.hookMu.Lock()
+	defer f.hookMu.Unlock()
+
+	f.mu.Lock()
+	prev := f.state
+	if prev != state {
+		f.state, f.changed = state, time.Now()
+	}
+	f.mu.Unlock()
+
+	if prev == state {
+		return nil
+	}
+
+	log.Info("failover: state changed from %s to %s", prev, state)
+
+	cmd := f.hook(state)
+	if len(cmd) == 0 {
+		return nil
+	}
+
+	code, out, err := f.runCmd(cmd[0], cmd[1:]...)
+	if err != nil {
+		return fmt.Errorf("running %s hook: %w", state, err)
+	} else if code != 0 {
+		return fmt.Errorf("%s hook exited with code %d: %s", state, code, out)
+	}
+
+	log.Debug("failover: %s hook output: %s", state, out)
+
+	return nil
+}
+
+// probeAddr returns the address of the local DNS listener the health check
+// queries are sent to.
+func probeAddr(hosts []net.IP, port int) (addr string) {
+	ip := net.IP{127, 0, 0, 1}
+	if len(hosts) > 0 {
+		if h := hosts[0]; !h.IsUnspecified() {
+			ip = h
+		} else if h.To4() == nil {
+			ip = net.IPv6loopback
+		}
+	}
+
+	return netutil.JoinHostPort(ip.String(), uint16(port))
+}
+
+// probeDNS resolves name using the DNS server at addr and returns the response
+// code.  The DNS server is considered healthy if the name is resolved or
+// doesn't exist, since both responses require the upstream servers to work.
+func probeDNS(addr, name string, timeout time.Duration) (rcode int, err error) {
+	req := (&dns.Msg{}).SetQuestion(dns.Fqdn(name), dns.TypeA)
+	cli := &dns.Client{Timeout: timeout}
+
+	resp, _, err := cli.Exchange(req, addr)
+	if err != nil {
+		return 0, err
+	}
+
+	rcode = resp.Rcode
+	if rcode != dns.RcodeSuccess && rcode != dns.RcodeNameError {
+		return rcode, fmt.Errorf("unexpected rcode %s", dns.RcodeToString[rcode])
+	}
+
+	return rcode, nil
+}
+
+// healthJSON is the response to the health check requests.
+type healthJSON struct {
+	Status string `json:"status"`
+	State  string `json:"state"`
+	Rcode  string `json:"rcode,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	// Elapsed is the duration of the DNS health check in milliseconds.
+	Elapsed float64 `json:"elapsed_ms,omitempty"`
+}
+
+// writeHealth writes the health check response.  The status code is 503 if
+// err isn't nil, so that the VRRP check scripts can only look at the exit code
+// of curl -f.
+func writeHealth(w http.ResponseWriter, resp *healthJSON, err error) {
+	code := http.StatusOK
+	resp.Status = "ok"
+	if err != nil {
+		code = http.StatusServiceUnavailable
+		resp.Status = "fail"
+		resp.Error = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		log.Debug("failover: writing health response: %s", err)
+	}
+}
+
+// handleHealth is the handler for the GET /health HTTP API.  It's a cheap
+// liveness check, which only ensures that the DNS server is running.
+func (f *failover) handleHealth(w http.ResponseWriter, r *http.Request) {
+	resp := &healthJSON{State: string(f.currentState())}
+
+	var err error
+	if Context.dnsServer == nil || !Context.dnsServer.IsRunning() {
+		err = fmt.Errorf("dns server is not running")
+	}
+
+	writeHealth(w, resp, err)
+}
+
+// handleHealthDNS is the handler for the GET /health/dns HTTP API.  It resolves
+// the probe name using the local DNS listener.
+func (f *failover) handleHealthDNS(w http.ResponseWriter, r *http.Request) {
+	resp := &healthJSON{State: string(f.currentState())}
+
+	config.RLock()
+	addr := probeAddr(config.DNS.BindHosts, config.DNS.Port)
+	config.RUnlock()
+
+	timeout := f.conf.ProbeTimeout.Duration
+	if timeout == 0 {
+		timeout = defaultProbeTimeout
+	}
+
+	start := time.Now()
+	rcode, err := probeDNS(addr, f.probeName(), timeout)
+	resp.Elapsed = float64(time.Since(start)) / float64(time.Millisecond)
+	if err == nil || rcode != 0 {
+		resp.Rcode = dns.RcodeToString[rcode]
+	}
+
+	writeHealth(w, resp, err)
+}
+
+// probeName returns the name resolved by the DNS health check.
+func (f *failover) probeName() (name string) {
+	if f.conf.ProbeName != "" {
+		return f.conf.ProbeName
+	}
+
+	return defaultProbeName
+}
+
+// currentState returns the current state of the instance.
+func (f *failover) currentState() (state failoverState) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.state
+}
+
+// failoverStateJSON is the VRRP state of the instance.
+type failoverStateJSON struct {
+	State string `json:"state"`
+
+	// Changed is the time of the last state change in RFC 3339 format.  It's
+	// ignored in the requests.
+	Changed string `json:"changed,omitempty"`
+}
+
+// handleStatus is the handler for the GET /control/failover/status HTTP API.
+func (f *failover) handleStatus(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	resp := &failoverStateJSON{
+		State:   string(f.state),
+		Changed: f.changed.Format(time.RFC3339),
+	}
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+	}
+}
+
+// handleSetState is the handler for the POST /control/failover/state HTTP API.
+// It's supposed to be called from the VRRP daemon's notify script.
+func (f *failover) handleSetState(w http.ResponseWriter, r *http.Request) {
+	req := &failoverStateJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return
+	}
+
+	state := failoverState(strings.ToUpper(req.State))
+	switch state {
+	case failoverStateMaster, failoverStateBackup, failoverStateFault:
+		// Go on.
+	default:
+		aghhttp.Error(r, w, http.StatusBadRequest, "bad state %q", req.State)
+
+		return
+	}
+
+	err = f.setState(state)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "%s", err)
+	}
+}
+
+// registerFailoverHandlers registers the HTTP handlers of the health checks
+// and the VRRP state changes.  The health checks don't require authentication,
+// since the VRRP daemons usually can't provide any.
+func registerFailoverHandlers() {
+	f := Context.failover
+	Context.mux.HandleFunc("/health", postInstall(ensureGET(f.handleHealth)))
+	Context.mux.HandleFunc("/health/dns", postInstall(ensureGET(f.handleHealthDNS)))
+
+	httpRegister(http.MethodGet, "/control/failover/status", f.handleStatus)
+	httpRegister(http.MethodPost, "/control/failover/state", f.handleSetState)
+}
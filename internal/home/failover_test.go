@@ -0,0 +1,75 @@
+package home
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeAddr(t *testing.T) {
+	testCases := []struct {
+		name  string
+		want  string
+		hosts []net.IP
+	}{{
+		name:  "none",
+		want:  "127.0.0.1:53",
+		hosts: nil,
+	}, {
+		name:  "unspecified_v4",
+		want:  "127.0.0.1:53",
+		hosts: []net.IP{net.IPv4zero},
+	}, {
+		name:  "unspecified_v6",
+		want:  "[::1]:53",
+		hosts: []net.IP{net.IPv6unspecified},
+	}, {
+		name:  "specific",
+		want:  "192.168.1.1:53",
+		hosts: []net.IP{{192, 168, 1, 1}, {127, 0, 0, 1}},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, probeAddr(tc.hosts, 53))
+		})
+	}
+}
+
+func TestFailover_setState(t *testing.T) {
+	var ran [][]string
+	f := newFailover(&failoverConfig{
+		OnMaster: []string{"/bin/master", "up"},
+		OnFault:  []string{"/bin/fault"},
+	})
+	f.runCmd = func(cmd string, args ...string) (code int, out string, err error) {
+		ran = append(ran, append([]string{cmd}, args...))
+		if cmd == "/bin/fault" {
+			return 1, "oops", nil
+		}
+
+		return 0, "", nil
+	}
+
+	require.Equal(t, failoverStateUnknown, f.currentState())
+
+	err := f.setState(failoverStateMaster)
+	require.NoError(t, err)
+
+	// The same state mustn't run the hook again.
+	err = f.setState(failoverStateMaster)
+	require.NoError(t, err)
+
+	// No hook is configured for the backup state.
+	err = f.setState(failoverStateBackup)
+	require.NoError(t, err)
+
+	err = f.setState(failoverStateFault)
+	testutil.AssertErrorMsg(t, "FAULT hook exited with code 1: oops", err)
+
+	assert.Equal(t, failoverStateFault, f.currentState())
+	assert.Equal(t, [][]string{{"/bin/master", "up"}, {"/bin/fault"}}, ran)
+}
@@ -2,12 +2,14 @@ package home
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
@@ -29,11 +31,19 @@ type Filtering struct {
 	refreshStatus     uint32 // 0:none; 1:in progress
 	refreshLock       sync.Mutex
 	filterTitleRegexp *regexp.Regexp
+
+	// progress is the progress of the current or the last update.
+	progress *filterUpdateProgress
+
+	// limiter limits the download speed of the current update.  It's nil if
+	// there is no limit.
+	limiter *bandwidthLimiter
 }
 
 // Init - initialize the module
 func (f *Filtering) Init() {
 	f.filterTitleRegexp = regexp.MustCompile(`^! Title: +(.*)$`)
+	f.progress = newFilterUpdateProgress()
 	_ = os.MkdirAll(filepath.Join(Context.getDataDir(), filterDir), 0o755)
 	f.loadFilters(config.Filters)
 	f.loadFilters(config.WhitelistFilters)
@@ -45,11 +55,14 @@ func (f *Filtering) Init() {
 // Start - start the module
 func (f *Filtering) Start() {
 	f.RegisterFilteringHandlers()
+	f.initListServer()
 
 	// Here we should start updating filters,
 	//  but currently we can't wake up the periodic task to do so.
 	// So for now we just start this periodic task from here.
-	go f.periodicallyRefreshFilters()
+	if !Context.safeMode {
+		go f.periodicallyRefreshFilters()
+	}
 }
 
 // Close - close the module
@@ -73,15 +86,20 @@ type filter struct {
 	checksum    uint32    // checksum of the file data
 	white       bool
 
+	// etag is the entity tag of the last downloaded version of the list.
+	// It's only kept in memory.
+	etag string
+
 	filtering.Filter `yaml:",inline"`
 }
 
 const (
-	statusFound          = 1
-	statusEnabledChanged = 2
-	statusURLChanged     = 4
-	statusURLExists      = 8
-	statusUpdateRequired = 0x10
+	statusFound           = 1
+	statusEnabledChanged  = 2
+	statusURLChanged      = 4
+	statusURLExists       = 8
+	statusUpdateRequired  = 0x10
+	statusScheduleChanged = 0x20
 )
 
 // Update properties for a filter specified by its URL
@@ -106,6 +124,11 @@ func (f *Filtering) filterSetProperties(url string, newf filter, whitelist bool)
 			filt.URL, newf.Name, newf.URL, newf.Enabled)
 		filt.Name = newf.Name
 
+		if !reflect.DeepEqual(filt.Schedule, newf.Schedule) {
+			r |= statusScheduleChanged
+			filt.Schedule = newf.Schedule
+		}
+
 		if filt.URL != newf.URL {
 			r |= statusURLChanged | statusUpdateRequired
 			if filterExistsNoLock(newf.URL) {
@@ -165,6 +188,23 @@ func filterExistsNoLock(url string) bool {
 	return false
 }
 
+// filterListName returns the name of the blocklist or the allowlist with id.
+// It returns an empty string if there is no such list.
+func filterListName(id int64) (name string) {
+	config.RLock()
+	defer config.RUnlock()
+
+	for _, filters := range [][]filter{config.Filters, config.WhitelistFilters} {
+		for _, f := range filters {
+			if f.ID == id {
+				return f.Name
+			}
+		}
+	}
+
+	return ""
+}
+
 // Add a filter
 // Return FALSE if a filter with this URL exists
 func filterAdd(f filter) bool {
@@ -239,6 +279,8 @@ func assignUniqueFilterID() int64 {
 
 // Sets up a timer that will be checking for filters updates periodically
 func (f *Filtering) periodicallyRefreshFilters() {
+	defer onPanicReport("filters: refreshing")
+
 	const maxInterval = 1 * 60 * 60
 	intval := 5 // use a dynamically increasing time interval
 	for {
@@ -283,10 +325,10 @@ func (f *Filtering) refreshFilters(flags int, important bool) (int, error) {
 
 func (f *Filtering) refreshFiltersArray(filters *[]filter, force bool) (int, []filter, []bool, bool) {
 	var updateFilters []filter
-	var updateFlags []bool // 'true' if filter data has changed
 
 	now := time.Now()
 	config.RLock()
+	parallel := config.DNS.FiltersUpdateParallel
 	for i := range *filters {
 		f := &(*filters)[i] // otherwise we will be operating on a copy
 
@@ -304,6 +346,7 @@ func (f *Filtering) refreshFiltersArray(filters *[]filter, force bool) (int, []f
 		uf.URL = f.URL
 		uf.Name = f.Name
 		uf.checksum = f.checksum
+		uf.etag = f.etag
 		updateFilters = append(updateFilters, uf)
 	}
 	config.RUnlock()
@@ -312,18 +355,9 @@ func (f *Filtering) refreshFiltersArray(filters *[]filter, force bool) (int, []f
 		return 0, nil, nil, false
 	}
 
-	nfail := 0
-	for i := range updateFilters {
-		uf := &updateFilters[i]
-		updated, err := f.update(uf)
-		updateFlags = append(updateFlags, updated)
-		if err != nil {
-			nfail++
-			log.Printf("Failed to update filter %s: %s\n", uf.URL, err)
-			continue
-		}
-	}
+	f.progress.add(updateFilters)
 
+	updateFlags, nfail := f.updateParallel(updateFilters, parallel)
 	if nfail == len(updateFilters) {
 		return 0, nil, nil, true
 	}
@@ -340,6 +374,7 @@ func (f *Filtering) refreshFiltersArray(filters *[]filter, force bool) (int, []f
 				continue
 			}
 			f.LastUpdated = uf.LastUpdated
+			f.etag = uf.etag
 			if !updated {
 				continue
 			}
@@ -385,6 +420,13 @@ const (
 func (f *Filtering) refreshFiltersIfNecessary(flags int) (int, bool) {
 	log.Debug("Filters: updating...")
 
+	config.RLock()
+	f.limiter = newBandwidthLimiter(config.DNS.FiltersUpdateBandwidth)
+	config.RUnlock()
+
+	f.progress.begin()
+	defer f.progress.finish()
+
 	updateCount := 0
 	var updateFilters []filter
 	var updateFlags []bool
@@ -493,6 +535,7 @@ func (f *Filtering) read(reader io.Reader, tmpFile *os.File, filter *filter) (in
 	firstChunk := make([]byte, 4*1024)
 	firstChunkLen := 0
 	buf := make([]byte, 64*1024)
+	var pending []byte
 	total := 0
 	for {
 		n, err := reader.Read(buf)
@@ -521,11 +564,21 @@ func (f *Filtering) read(reader io.Reader, tmpFile *os.File, filter *filter) (in
 			}
 		}
 
-		_, err2 := tmpFile.Write(buf[:n])
+		// Only normalize the complete lines and keep the rest until the next
+		// chunk.
+		pending = append(pending, buf[:n]...)
+		i := bytes.LastIndexByte(pending, '\n')
+		if err == io.EOF {
+			i = len(pending) - 1
+		}
+
+		_, err2 := io.WriteString(tmpFile, filtering.NormalizeRules(string(pending[:i+1])))
 		if err2 != nil {
 			return total, err2
 		}
 
+		pending = append(pending[:0], pending[i+1:]...)
+
 		if err == io.EOF {
 			return total, nil
 		}
@@ -605,6 +658,8 @@ func (f *Filtering) updateIntl(flt *filter) (ok bool, err error) {
 	var rnum, n int
 	var cs uint32
 
+	etag := flt.etag
+
 	var tmpFile *os.File
 	tmpFile, err = os.CreateTemp(filepath.Join(Context.getDataDir(), filterDir), "")
 	if err != nil {
@@ -616,6 +671,13 @@ func (f *Filtering) updateIntl(flt *filter) (ok bool, err error) {
 		if ok {
 			log.Printf("updated filter %d: %d bytes, %d rules", flt.ID, n, rnum)
 		}
+
+		// Only keep the entity tag if it matches the stored contents.
+		if err == nil {
+			flt.etag = etag
+		} else {
+			flt.etag = ""
+		}
 	}()
 
 	// Change the default 0o600 permission to something more acceptable by
@@ -638,7 +700,7 @@ func (f *Filtering) updateIntl(flt *filter) (ok bool, err error) {
 		r = file
 	} else {
 		var resp *http.Response
-		resp, err = Context.client.Get(flt.URL)
+		resp, err = requestFilter(flt)
 		if err != nil {
 			log.Printf("requesting filter from %s, skip: %s", flt.URL, err)
 
@@ -646,20 +708,94 @@ func (f *Filtering) updateIntl(flt *filter) (ok bool, err error) {
 		}
 		defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
 
-		if resp.StatusCode != http.StatusOK {
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusIMUsed:
+			// Go on.
+		case http.StatusNotModified:
+			log.Tracef("filter #%d from %s is not modified, skip", flt.ID, flt.URL)
+
+			return false, nil
+		default:
 			log.Printf("got status code %d from %s, skip", resp.StatusCode, flt.URL)
 
 			return false, fmt.Errorf("got status code != 200: %d", resp.StatusCode)
 		}
 
-		r = resp.Body
+		f.progress.update(flt.ID, func(fp *filterProgressJSON) { fp.Total = resp.ContentLength })
+
+		r = &filterUpdateReader{
+			r:        resp.Body,
+			limiter:  f.limiter,
+			progress: f.progress,
+			id:       flt.ID,
+		}
+
+		if resp.StatusCode == http.StatusIMUsed {
+			r, err = patchFilter(flt, r, resp.Header)
+			if err != nil {
+				return false, fmt.Errorf("applying delta: %w", err)
+			}
+		}
+
+		etag = resp.Header.Get("ETag")
 	}
 
+	f.progress.update(flt.ID, func(fp *filterProgressJSON) { fp.State = filterUpdateDownloading })
+
 	name, rnum, cs, n, err = f.processUpdate(r, tmpFile, flt)
 
 	return cs != flt.checksum, err
 }
 
+// requestFilter requests the contents of flt.  If the entity tag of the stored
+// contents is known, the request is conditional and accepts the line delta
+// against them.
+func requestFilter(flt *filter) (resp *http.Response, err error) {
+	req, err := http.NewRequest(http.MethodGet, flt.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if flt.etag != "" {
+		req.Header.Set("If-None-Match", flt.etag)
+		req.Header.Set("A-IM", lineDeltaIM)
+	}
+
+	return Context.client.Do(req)
+}
+
+// maxFilterDeltaSize is the maximum size of a filter list delta.
+const maxFilterDeltaSize = 64 * 1024 * 1024
+
+// patchFilter applies the line delta read from r to the stored contents of flt
+// and returns the reader of the result.  h are the headers of the response.
+func patchFilter(flt *filter, r io.Reader, h http.Header) (patched io.Reader, err error) {
+	if im := h.Get("IM"); im != lineDeltaIM {
+		return nil, fmt.Errorf("unsupported instance manipulation %q", im)
+	}
+
+	base, err := os.ReadFile(flt.Path())
+	if err != nil {
+		return nil, fmt.Errorf("reading base: %w", err)
+	}
+
+	delta, err := io.ReadAll(io.LimitReader(r, maxFilterDeltaSize))
+	if err != nil {
+		return nil, fmt.Errorf("reading delta: %w", err)
+	}
+
+	data, err := patchLines(base, delta)
+	if err != nil {
+		return nil, err
+	}
+
+	if etag := h.Get("ETag"); etag != listETag(data) {
+		return nil, fmt.Errorf("result doesn't match entity tag %s", etag)
+	}
+
+	return bytes.NewReader(data), nil
+}
+
 // loads filter contents from the file in dataDir
 func (f *Filtering) load(filter *filter) (err error) {
 	filterFilePath := filter.Path()
@@ -710,6 +846,18 @@ func enableFilters(async bool) {
 }
 
 func enableFiltersLocked(async bool) {
+	if Context.safeMode {
+		// Don't load any rules, since one of them may be the reason the user
+		// can't access the web UI.
+		if err := Context.dnsFilter.SetFilters(nil, nil, async); err != nil {
+			log.Debug("disabling filters: %s", err)
+		}
+
+		Context.dnsFilter.SetEnabled(false)
+
+		return
+	}
+
 	filters := []filtering.Filter{{
 		ID:   filtering.CustomListID,
 		Data: []byte(strings.Join(config.UserRules, "\n")),
@@ -723,6 +871,7 @@ func enableFiltersLocked(async bool) {
 		filters = append(filters, filtering.Filter{
 			ID:       filter.ID,
 			FilePath: filter.Path(),
+			Schedule: filter.Schedule,
 		})
 	}
 
@@ -735,6 +884,7 @@ func enableFiltersLocked(async bool) {
 		allowFilters = append(allowFilters, filtering.Filter{
 			ID:       filter.ID,
 			FilePath: filter.Path(),
+			Schedule: filter.Schedule,
 		})
 	}
 
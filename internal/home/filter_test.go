@@ -11,7 +11,6 @@ import (
 	"testing"
 	"time"
 
-	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -62,7 +61,7 @@ func TestFilters(t *testing.T) {
 	f := &filter{
 		URL: (&url.URL{
 			Scheme: "http",
-			Host: (&netutil.IPPort{
+			Host: (&net.TCPAddr{
 				IP:   net.IP{127, 0, 0, 1},
 				Port: l.Addr().(*net.TCPAddr).Port,
 			}).String(),
@@ -113,3 +112,73 @@ func TestFilters(t *testing.T) {
 
 	require.NoError(t, os.Remove(f.Path()))
 }
+
+func TestFiltering_updateParallel(t *testing.T) {
+	fltContent := []byte("||example.org^\n||example.com^\n")
+	l := testStartFilterListener(t, &fltContent)
+
+	Context = homeContext{
+		workDir: t.TempDir(),
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+	Context.filters.Init()
+
+	srvURL := (&url.URL{
+		Scheme: "http",
+		Host: (&net.TCPAddr{
+			IP:   net.IP{127, 0, 0, 1},
+			Port: l.Addr().(*net.TCPAddr).Port,
+		}).String(),
+	}).String()
+
+	flts := []filter{{
+		URL: srvURL + "/1.txt",
+	}, {
+		URL: srvURL + "/2.txt",
+	}, {
+		URL: filepath.Join(t.TempDir(), "nonexistent.txt"),
+	}}
+	for i := range flts {
+		flts[i].ID = int64(i + 1)
+	}
+
+	f := &Context.filters
+	f.progress.begin()
+	f.progress.add(flts)
+
+	updated, nfail := f.updateParallel(flts, 2)
+	f.progress.finish()
+
+	assert.Equal(t, []bool{true, true, false}, updated)
+	assert.Equal(t, 1, nfail)
+
+	running, progress := f.progress.status()
+	assert.False(t, running)
+	require.Len(t, progress, 3)
+
+	for i, fp := range progress[:2] {
+		assert.Equal(t, flts[i].ID, fp.ID)
+		assert.Equal(t, filterUpdateDone, fp.State)
+		assert.Equal(t, int64(len(fltContent)), fp.Bytes)
+		assert.Equal(t, 2, flts[i].RulesCount)
+	}
+
+	assert.Equal(t, filterUpdateFailed, progress[2].State)
+	assert.NotEmpty(t, progress[2].Error)
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	var l *bandwidthLimiter
+	assert.NotPanics(t, func() { l.wait(1000) })
+
+	l = newBandwidthLimiter(100_000)
+
+	start := time.Now()
+	l.wait(10_000)
+	l.wait(10_000)
+
+	// Both chunks together must take at least 200 ms at 100 kB/s.
+	assert.GreaterOrEqual(t, time.Since(start), 190*time.Millisecond)
+}
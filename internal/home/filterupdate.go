@@ -0,0 +1,266 @@
+package home
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// defaultFiltersUpdateParallel is the default maximum number of filter lists
+// downloaded simultaneously.
+const defaultFiltersUpdateParallel = 4
+
+// filterUpdateState is the state of the update of a single filter list.
+type filterUpdateState string
+
+// Filter list update states.
+const (
+	filterUpdatePending     filterUpdateState = "pending"
+	filterUpdateDownloading filterUpdateState = "downloading"
+	filterUpdateDone        filterUpdateState = "done"
+	filterUpdateFailed      filterUpdateState = "failed"
+)
+
+// filterProgressJSON is the progress of the update of a single filter list.
+type filterProgressJSON struct {
+	// Error is the error message, if the update has failed.
+	Error string `json:"error,omitempty"`
+
+	URL   string            `json:"url"`
+	State filterUpdateState `json:"state"`
+	ID    int64             `json:"id"`
+
+	// Bytes is the number of bytes downloaded so far.
+	Bytes int64 `json:"bytes"`
+
+	// Total is the expected size of the list in bytes, or -1 if it's
+	// unknown.
+	Total int64 `json:"total"`
+}
+
+// filterUpdateProgress is the progress of the current or the last update of
+// the filter lists.
+type filterUpdateProgress struct {
+	// mu protects all the fields below.
+	mu *sync.Mutex
+
+	// filters are the lists being updated in the order of the update.
+	filters []*filterProgressJSON
+
+	// running is true if the update is in progress.
+	running bool
+}
+
+// newFilterUpdateProgress returns a new properly initialized progress.
+func newFilterUpdateProgress() (p *filterUpdateProgress) {
+	return &filterUpdateProgress{
+		mu: &sync.Mutex{},
+	}
+}
+
+// begin clears the progress of the previous update and marks the update as
+// running.
+func (p *filterUpdateProgress) begin() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.filters = nil
+	p.running = true
+}
+
+// finish marks the update as finished.
+func (p *filterUpdateProgress) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.running = false
+}
+
+// add adds flts to the update as pending.
+func (p *filterUpdateProgress) add(flts []filter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, flt := range flts {
+		p.filters = append(p.filters, &filterProgressJSON{
+			URL:   flt.URL,
+			State: filterUpdatePending,
+			ID:    flt.ID,
+			Total: -1,
+		})
+	}
+}
+
+// update calls f with the progress of the filter with id, if there is one.
+// p may be nil.
+func (p *filterUpdateProgress) update(id int64, f func(fp *filterProgressJSON)) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, fp := range p.filters {
+		if fp.ID == id {
+			f(fp)
+
+			return
+		}
+	}
+}
+
+// status returns a copy of the current progress.
+func (p *filterUpdateProgress) status() (running bool, filters []filterProgressJSON) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	filters = make([]filterProgressJSON, 0, len(p.filters))
+	for _, fp := range p.filters {
+		filters = append(filters, *fp)
+	}
+
+	return p.running, filters
+}
+
+// bandwidthLimiter limits the aggregate download speed of several concurrent
+// readers.
+type bandwidthLimiter struct {
+	// mu protects next.
+	mu *sync.Mutex
+
+	// next is the time when the bandwidth becomes available again.
+	next time.Time
+
+	// rate is the limit in bytes per second.
+	rate uint64
+}
+
+// newBandwidthLimiter returns a limiter for rate bytes per second.  If rate is
+// zero, l is nil, which means no limit.
+func newBandwidthLimiter(rate uint64) (l *bandwidthLimiter) {
+	if rate == 0 {
+		return nil
+	}
+
+	return &bandwidthLimiter{
+		mu:   &sync.Mutex{},
+		rate: rate,
+	}
+}
+
+// wait blocks until n more bytes can be received without exceeding the limit.
+// l may be nil.
+func (l *bandwidthLimiter) wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+
+	l.next = l.next.Add(time.Duration(uint64(n) * uint64(time.Second) / l.rate))
+	d := l.next.Sub(now)
+	l.mu.Unlock()
+
+	time.Sleep(d)
+}
+
+// filterUpdateReader is an io.Reader that reports the progress of the download
+// of a filter list and keeps its speed within the limit.
+type filterUpdateReader struct {
+	r        io.Reader
+	limiter  *bandwidthLimiter
+	progress *filterUpdateProgress
+	id       int64
+}
+
+// type check
+var _ io.Reader = (*filterUpdateReader)(nil)
+
+// Read implements the io.Reader interface for *filterUpdateReader.
+func (r *filterUpdateReader) Read(b []byte) (n int, err error) {
+	n, err = r.r.Read(b)
+	r.progress.update(r.id, func(fp *filterProgressJSON) { fp.Bytes += int64(n) })
+	r.limiter.wait(n)
+
+	return n, err
+}
+
+// updateParallel updates flts using at most parallel goroutines.  updated
+// contains true for the lists, data of which has changed.  nfail is the number
+// of lists, which have failed to update.
+func (f *Filtering) updateParallel(flts []filter, parallel int) (updated []bool, nfail int) {
+	if parallel <= 0 {
+		parallel = defaultFiltersUpdateParallel
+	}
+
+	updated = make([]bool, len(flts))
+	errs := make([]error, len(flts))
+
+	indexes := make(chan int)
+	wg := &sync.WaitGroup{}
+	for w := 0; w < parallel && w < len(flts); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer log.OnPanic("filters: updating")
+
+			for i := range indexes {
+				updated[i], errs[i] = f.update(&flts[i])
+			}
+		}()
+	}
+
+	for i := range flts {
+		indexes <- i
+	}
+	close(indexes)
+
+	wg.Wait()
+
+	for i, err := range errs {
+		flt := &flts[i]
+		if err != nil {
+			nfail++
+			log.Printf("Failed to update filter %s: %s\n", flt.URL, err)
+		}
+
+		f.progress.update(flt.ID, func(fp *filterProgressJSON) {
+			if err != nil {
+				fp.State, fp.Error = filterUpdateFailed, err.Error()
+			} else {
+				fp.State = filterUpdateDone
+			}
+		})
+	}
+
+	return updated, nfail
+}
+
+// filterUpdateStatusJSON is the response of the filter update status handler.
+type filterUpdateStatusJSON struct {
+	Filters []filterProgressJSON `json:"filters"`
+	Running bool                 `json:"running"`
+}
+
+// handleFilteringUpdateStatus is the handler for the GET
+// /control/filtering/update_status HTTP API.
+func (f *Filtering) handleFilteringUpdateStatus(w http.ResponseWriter, r *http.Request) {
+	resp := filterUpdateStatusJSON{}
+	resp.Running, resp.Filters = f.progress.status()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "encoding response: %s", err)
+	}
+}
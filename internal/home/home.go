@@ -45,6 +45,8 @@ type homeContext struct {
 	// --
 
 	clients    clientsContainer     // per-client-settings module
+	policies   *policiesContainer   // filtering policies module
+	canary     *canaryTrial         // canary trials of policy changes module
 	stats      stats.Stats          // statistics module
 	queryLog   querylog.QueryLog    // query log module
 	dnsServer  *dnsforward.Server   // DNS module
@@ -52,10 +54,20 @@ type homeContext struct {
 	whois      *WHOIS               // WHOIS module
 	dnsFilter  *filtering.DNSFilter // DNS filtering module
 	dhcpServer *dhcpd.Server        // DHCP module
+	radius     *radiusAcct          // RADIUS accounting module
+	failover   *failover            // VRRP failover module
+	diskGuard  *diskGuard           // free disk space monitoring module
+	notifier   *notifier            // administrator notifications module
+	intercept  *interceptionChecker // DNS interception detection module
+	wireGuard  *wireGuard           // WireGuard DNS endpoint module
+	statsShare *statsShare          // statistics share links module
+	portal     *loginPortal         // login portal module, nil if disabled
 	auth       *Auth                // HTTP authentication module
 	filters    Filtering            // DNS filtering module
 	web        *Web                 // Web (HTTP, HTTPS) module
 	tls        *TLSMod              // TLS module
+	// confirm tracks the provisionally applied configuration changes.
+	confirm *configConfirm
 	// etcHosts is an IP-hostname pairs set taken from system configuration
 	// (e.g. /etc/hosts) files.
 	etcHosts *aghnet.HostsContainer
@@ -85,6 +97,16 @@ type homeContext struct {
 	appSignalChannel chan os.Signal // Channel for receiving OS signals by the console app
 	// runningAsService flag is set to true when options are passed from the service runner
 	runningAsService bool
+	// logRing keeps the latest log lines for the crash reports.
+	logRing *logRing
+	// startTime is the time when AdGuard Home has been started.
+	startTime time.Time
+	// safeMode is true if AdGuard Home runs with the filtering, DHCP, and the
+	// custom DNS settings disabled.  See safeModeFilteringConfig.
+	safeMode bool
+	// safeModeDNS is the configuration of the DNS server generated for the
+	// safe mode.  See mergeSafeModeEdits.
+	safeModeDNS dnsforward.FilteringConfig
 }
 
 // getDataDir returns path to the directory where we store databases and filters
@@ -101,9 +123,13 @@ func Main(clientBuildFS fs.FS) {
 	// therefore, we must do it manually instead of using a lib
 	args := loadOptions()
 
+	defer onPanicReport("main")
+
 	Context.appSignalChannel = make(chan os.Signal)
 	signal.Notify(Context.appSignalChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
 	go func() {
+		defer onPanicReport("signals")
+
 		for {
 			sig := <-Context.appSignalChannel
 			log.Info("Received signal %q", sig)
@@ -132,6 +158,10 @@ func Main(clientBuildFS fs.FS) {
 
 func setupContext(args options) {
 	Context.runningAsService = args.runningAsService
+	Context.safeMode = args.safeMode
+	if Context.safeMode {
+		log.Info("Running in safe mode: filtering, dhcp, and custom dns settings are disabled")
+	}
 	Context.disableUpdate = args.disableUpdate ||
 		version.Channel() == version.ChannelDevelopment
 
@@ -177,6 +207,7 @@ func setupContext(args options) {
 	}
 
 	Context.mux = http.NewServeMux()
+	Context.confirm = newConfigConfirm()
 }
 
 // logIfUnsupported logs a formatted warning if the error is one of the
@@ -274,16 +305,26 @@ func setupConfig(args options) (err error) {
 		return fmt.Errorf("initing dhcp: %w", err)
 	}
 
+	if config.DNS.StatsPresence.Enabled {
+		Context.dhcpServer.SetOnLeaseChanged(newLeaseWatcher(Context.dhcpServer).onLeaseChanged)
+	}
+
+	if err = config.Update.validate(); err != nil {
+		return fmt.Errorf("update: %w", err)
+	}
+
 	Context.updater = updater.NewUpdater(&updater.Config{
-		Client:   Context.client,
-		Version:  version.Version(),
-		Channel:  version.Channel(),
-		GOARCH:   runtime.GOARCH,
-		GOOS:     runtime.GOOS,
-		GOARM:    version.GOARM(),
-		GOMIPS:   version.GOMIPS(),
-		WorkDir:  Context.workDir,
-		ConfName: config.getConfigFilename(),
+		Client:       Context.client,
+		Version:      version.Version(),
+		Channel:      version.Channel(),
+		GOARCH:       runtime.GOARCH,
+		GOOS:         runtime.GOOS,
+		GOARM:        version.GOARM(),
+		GOMIPS:       version.GOMIPS(),
+		WorkDir:      Context.workDir,
+		ConfName:     config.getConfigFilename(),
+		MirrorURL:    config.Update.MirrorURL,
+		DisableDelta: config.Update.DisableDelta,
 	})
 
 	if !args.noEtcHosts {
@@ -292,7 +333,15 @@ func setupConfig(args options) (err error) {
 		}
 	}
 
+	Context.policies = newPoliciesContainer(config.Policies, &Context.clients)
+	Context.policies.registerWebHandlers()
+
+	Context.clients.policies = Context.policies
 	Context.clients.Init(config.Clients, Context.dhcpServer, Context.etcHosts)
+	Context.clients.quotas = &config.Quotas
+
+	Context.canary = newCanaryTrial(config.Canary, Context.policies, Context.clients.has)
+	Context.canary.registerWebHandlers()
 
 	if args.bindPort != 0 {
 		pm := portsMap{}
@@ -346,11 +395,17 @@ func initWeb(args options, clientBuildFS fs.FS) (web *Web, err error) {
 		}
 	}
 
+	basePath, err := normalizeBasePath(config.WebBasePath)
+	if err != nil {
+		return nil, err
+	}
+
 	webConf := webConfig{
 		firstRun:     Context.firstRun,
 		BindHost:     config.BindHost,
 		BindPort:     config.BindPort,
 		BetaBindPort: config.BetaBindPort,
+		BasePath:     basePath,
 
 		ReadTimeout:       readTimeout,
 		ReadHeaderTimeout: readHdrTimeout,
@@ -386,6 +441,8 @@ func run(args options, clientBuildFS fs.FS) {
 
 	// configure log level and output
 	configureLogger(args)
+	installLogRing()
+	Context.startTime = time.Now()
 
 	// Go memory hacks
 	memoryUsage(args)
@@ -423,6 +480,8 @@ func run(args options, clientBuildFS fs.FS) {
 			mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 			mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 			go func() {
+				defer onPanicReport("pprof")
+
 				log.Info("pprof: listening on localhost:6060")
 				lerr := http.ListenAndServe("localhost:6060", mux)
 				log.Error("Error while running the pprof server: %s", lerr)
@@ -463,6 +522,19 @@ func run(args options, clientBuildFS fs.FS) {
 		log.Fatalf("Can't initialize TLS module")
 	}
 
+	Context.failover = newFailover(&config.Failover)
+	Context.wireGuard = newWireGuard(&config.WireGuard, serveTunnelDNS)
+	Context.statsShare = newStatsShare(&config.StatsShare)
+	Context.portal = newLoginPortal(&config.Portal, Context.policies)
+
+	Context.notifier = newNotifier(&config.Notifications, Context.client)
+	if Context.dhcpServer != nil {
+		Context.notifier.watchLeases(Context.dhcpServer)
+	}
+
+	Context.intercept = newInterceptionChecker(&config.InterceptionCheck, configuredUpstreams, Context.notifier)
+	Context.intercept.registerWebHandlers()
+
 	Context.web, err = initWeb(args, clientBuildFS)
 	fatalOnError(err)
 
@@ -476,19 +548,45 @@ func run(args options, clientBuildFS fs.FS) {
 		Context.tls.Start()
 
 		go func() {
+			defer onPanicReport("dns")
+
+			waitBindAddrs(dnsBindAddrs(), bindWaitTimeout, bindWaitIvl)
+
 			serr := startDNSServer()
 			if serr != nil {
 				closeDNSServer()
+				logPortConflicts()
 				fatalOnError(serr)
 			}
 		}()
 
-		if Context.dhcpServer != nil {
+		if Context.dhcpServer != nil && !Context.safeMode {
 			err = Context.dhcpServer.Start()
 			if err != nil {
 				log.Error("starting dhcp server: %s", err)
 			}
 		}
+
+		if config.RADIUS.ListenAddr != "" && !Context.safeMode {
+			Context.radius, err = newRADIUSAcct(&config.RADIUS, &Context.clients)
+			fatalOnError(err)
+
+			Context.radius.Start()
+		}
+
+		if !Context.safeMode {
+			startWireGuard()
+		}
+
+		Context.diskGuard = newDiskGuard(&config.DiskGuard, Context.getDataDir())
+		Context.diskGuard.start()
+
+		Context.notifier.startCertChecks()
+		Context.intercept.start()
+	}
+
+	if !Context.firstRun {
+		confine(args)
 	}
 
 	Context.web.Start()
@@ -696,6 +794,18 @@ func cleanup(ctx context.Context) {
 		}
 	}
 
+	if Context.wireGuard != nil {
+		if err = Context.wireGuard.close(); err != nil {
+			log.Error("closing wireguard endpoint: %s", err)
+		}
+	}
+
+	if Context.radius != nil {
+		if err = Context.radius.Close(); err != nil {
+			log.Error("closing radius listener: %s", err)
+		}
+	}
+
 	if Context.etcHosts != nil {
 		// Currently Context.hostsWatcher is only used in Context.etcHosts and
 		// needs closing only in case of the successful initialization of
@@ -709,6 +819,8 @@ func cleanup(ctx context.Context) {
 		}
 	}
 
+	Context.notifier.stopCertChecks()
+
 	if Context.tls != nil {
 		Context.tls.Close()
 		Context.tls = nil
@@ -761,12 +873,12 @@ func printWebAddrs(proto, addr string, port, betaPort int) {
 		hostBetaMsg = hostMsg + " (BETA)"
 	)
 
-	log.Printf(hostMsg, proto, netutil.JoinHostPort(addr, port))
+	log.Printf(hostMsg, proto, netutil.JoinHostPort(addr, uint16(port)))
 	if betaPort == 0 {
 		return
 	}
 
-	log.Printf(hostBetaMsg, proto, netutil.JoinHostPort(addr, config.BetaBindPort))
+	log.Printf(hostBetaMsg, proto, netutil.JoinHostPort(addr, uint16(config.BetaBindPort)))
 }
 
 // printHTTPAddresses prints the IP addresses which user can use to access the
@@ -789,6 +901,14 @@ func printHTTPAddresses(proto string) {
 		return
 	}
 
+	if proto == schemeHTTPS && len(tlsConf.HTTPSBindHosts) > 0 {
+		for _, h := range tlsConf.HTTPSBindHosts {
+			printWebAddrs(proto, h.String(), port, 0)
+		}
+
+		return
+	}
+
 	bindhost := config.BindHost
 	if !bindhost.IsUnspecified() {
 		printWebAddrs(proto, bindhost.String(), port, config.BetaBindPort)
@@ -0,0 +1,373 @@
+package home
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/stringutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+)
+
+// interceptionCheckConfig is the configuration of the periodic checks for the
+// transparent interception of the DNS traffic, for example by the ISP.
+type interceptionCheckConfig struct {
+	// Interval is the interval between the checks.  If zero,
+	// defaultInterceptionInterval is used.
+	Interval timeutil.Duration `yaml:"interval"`
+
+	// ProbeAddrs are the addresses, which are known not to serve DNS.  Any
+	// response from them means that the queries are intercepted on the way.
+	// If empty, defaultInterceptionProbeAddrs are used.
+	ProbeAddrs []string `yaml:"probe_addrs"`
+
+	// NXDomainZone is the zone, in which the random names are queried to
+	// detect the upstreams rewriting the NXDOMAIN responses.  If empty,
+	// defaultInterceptionNXDomainZone is used.
+	NXDomainZone string `yaml:"nxdomain_zone"`
+
+	// Enabled shows if the checks are run periodically.  The checks can be
+	// run on demand regardless.
+	Enabled bool `yaml:"enabled"`
+}
+
+// Interception check parameters.
+const (
+	// defaultInterceptionInterval is the default interval between the
+	// checks.
+	defaultInterceptionInterval = 6 * time.Hour
+
+	// defaultInterceptionNXDomainZone is the default zone for the random
+	// names.
+	defaultInterceptionNXDomainZone = "com"
+
+	// interceptionTimeout is the timeout of a single probe.
+	interceptionTimeout = 3 * time.Second
+)
+
+// defaultInterceptionProbeAddrs are the default addresses not serving DNS.
+// The address is from the TEST-NET-3 block, see RFC 5737.
+var defaultInterceptionProbeAddrs = []string{"203.0.113.53"}
+
+// interceptionProbe is the result of sending a query to an address, which
+// doesn't serve DNS.
+type interceptionProbe struct {
+	// Addr is the address the query has been sent to.
+	Addr string `json:"addr"`
+
+	// Network is the network the query has been sent over, either "udp" or
+	// "tcp".
+	Network string `json:"network"`
+
+	// Intercepted shows if a response has been received.
+	Intercepted bool `json:"intercepted"`
+}
+
+// nxdomainRewrite is an upstream, which has answered a query for a
+// non-existing name with addresses.
+type nxdomainRewrite struct {
+	// Upstream is the address of the upstream.
+	Upstream string `json:"upstream"`
+
+	// Answers are the addresses the upstream has responded with.
+	Answers []string `json:"answers"`
+}
+
+// interceptionReport is the result of an interception check.
+type interceptionReport struct {
+	// Time is the time of the check.
+	Time time.Time `json:"time"`
+
+	// Probes are the results of the queries to the addresses not serving
+	// DNS.
+	Probes []*interceptionProbe `json:"probes"`
+
+	// NXDomainRewrites are the plain DNS upstreams rewriting the NXDOMAIN
+	// responses.
+	NXDomainRewrites []*nxdomainRewrite `json:"nxdomain_rewrites"`
+
+	// Intercepted shows if any of the probes has been intercepted.
+	Intercepted bool `json:"intercepted"`
+}
+
+// detected returns true if r shows any kind of tampering with the DNS
+// traffic.  r may be nil.
+func (r *interceptionReport) detected() (ok bool) {
+	return r != nil && (r.Intercepted || len(r.NXDomainRewrites) > 0)
+}
+
+// interceptionChecker periodically sends the canary queries to detect the
+// transparent interception of the DNS traffic and the rewriting of the
+// NXDOMAIN responses, which the users often take for the misbehavior of
+// AdGuard Home.
+type interceptionChecker struct {
+	// exchange sends req to addr over network and returns the response.  It's
+	// replaced in tests.
+	exchange func(network, addr string, req *dns.Msg) (resp *dns.Msg, err error)
+
+	// upstreams returns the configured upstreams.
+	upstreams func() (ups []string)
+
+	// notifier is used to notify about the changes of the detection status.
+	// It may be nil.
+	notifier *notifier
+
+	// conf is the configuration of the checks.  It's not modified.
+	conf *interceptionCheckConfig
+
+	// mu protects report.
+	mu *sync.Mutex
+
+	// report is the result of the latest check.  It's nil if there has been
+	// none.
+	report *interceptionReport
+}
+
+// newInterceptionChecker returns a new properly initialized interception
+// checker.
+func newInterceptionChecker(
+	conf *interceptionCheckConfig,
+	upstreams func() (ups []string),
+	n *notifier,
+) (c *interceptionChecker) {
+	return &interceptionChecker{
+		exchange:  exchangeInterceptionProbe,
+		upstreams: upstreams,
+		notifier:  n,
+		conf:      conf,
+		mu:        &sync.Mutex{},
+	}
+}
+
+// exchangeInterceptionProbe is the default exchange function of the
+// interception checker.
+func exchangeInterceptionProbe(network, addr string, req *dns.Msg) (resp *dns.Msg, err error) {
+	cli := &dns.Client{
+		Net:     network,
+		Timeout: interceptionTimeout,
+	}
+
+	resp, _, err = cli.Exchange(req, addr)
+
+	return resp, err
+}
+
+// randomLabel returns a random DNS label, which is very unlikely to exist.
+func randomLabel() (l string) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		// Generally shouldn't happen, but use something unique anyway.
+		return fmt.Sprintf("agh-%d", time.Now().UnixNano())
+	}
+
+	return "agh-" + hex.EncodeToString(b)
+}
+
+// plainUpstreamAddr returns the host and port of the plain DNS-over-UDP
+// upstream from the line of the upstream configuration.  ok is false if line
+// isn't such an upstream.
+func plainUpstreamAddr(line string) (hostPort string, ok bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "[/") {
+		return "", false
+	}
+
+	if strings.Contains(line, "://") {
+		if !strings.HasPrefix(line, "udp://") {
+			return "", false
+		}
+
+		line = strings.TrimPrefix(line, "udp://")
+	}
+
+	if ip := net.ParseIP(line); ip != nil {
+		return net.JoinHostPort(line, "53"), true
+	}
+
+	host, _, err := net.SplitHostPort(line)
+	if err != nil || net.ParseIP(host) == nil {
+		return "", false
+	}
+
+	return line, true
+}
+
+// probe sends a query to each of the addresses not serving DNS over both UDP
+// and TCP.
+func (c *interceptionChecker) probe() (probes []*interceptionProbe) {
+	addrs := c.conf.ProbeAddrs
+	if len(addrs) == 0 {
+		addrs = defaultInterceptionProbeAddrs
+	}
+
+	for _, addr := range addrs {
+		hostPort := addr
+		if net.ParseIP(addr) != nil {
+			hostPort = net.JoinHostPort(addr, "53")
+		}
+
+		for _, network := range []string{"udp", "tcp"} {
+			req := (&dns.Msg{}).SetQuestion(randomLabel()+".example.", dns.TypeA)
+			resp, err := c.exchange(network, hostPort, req)
+			if err != nil {
+				log.Debug("interception check: probing %s over %s: %s", addr, network, err)
+			}
+
+			probes = append(probes, &interceptionProbe{
+				Addr:        addr,
+				Network:     network,
+				Intercepted: err == nil && resp != nil,
+			})
+		}
+	}
+
+	return probes
+}
+
+// checkNXDomain queries a random non-existing name from each of the plain DNS
+// upstreams and returns the ones responding with addresses.
+func (c *interceptionChecker) checkNXDomain() (rewrites []*nxdomainRewrite) {
+	zone := c.conf.NXDomainZone
+	if zone == "" {
+		zone = defaultInterceptionNXDomainZone
+	}
+
+	seen := stringutil.NewSet()
+	for _, line := range c.upstreams() {
+		hostPort, ok := plainUpstreamAddr(line)
+		if !ok || seen.Has(hostPort) {
+			continue
+		}
+
+		seen.Add(hostPort)
+
+		req := (&dns.Msg{}).SetQuestion(dns.Fqdn(randomLabel()+"."+zone), dns.TypeA)
+		resp, err := c.exchange("udp", hostPort, req)
+		if err != nil {
+			log.Debug("interception check: querying %s: %s", hostPort, err)
+
+			continue
+		} else if resp.Rcode != dns.RcodeSuccess {
+			continue
+		}
+
+		var answers []string
+		for _, rr := range resp.Answer {
+			if a, isA := rr.(*dns.A); isA {
+				answers = append(answers, a.A.String())
+			}
+		}
+
+		if len(answers) > 0 {
+			rewrites = append(rewrites, &nxdomainRewrite{
+				Upstream: line,
+				Answers:  answers,
+			})
+		}
+	}
+
+	return rewrites
+}
+
+// check runs the interception check, saves its report, and notifies about the
+// change of the detection status.
+func (c *interceptionChecker) check() (r *interceptionReport) {
+	r = &interceptionReport{
+		Time:             time.Now(),
+		Probes:           c.probe(),
+		NXDomainRewrites: c.checkNXDomain(),
+	}
+
+	for _, p := range r.Probes {
+		if p.Intercepted {
+			r.Intercepted = true
+
+			break
+		}
+	}
+
+	c.mu.Lock()
+	prev := c.report
+	c.report = r
+	c.mu.Unlock()
+
+	if r.detected() != prev.detected() {
+		c.notifier.notify(interceptionNotification(r))
+	}
+
+	return r
+}
+
+// interceptionNotification returns the notification about the detection
+// status from r.
+func interceptionNotification(r *interceptionReport) (msg *notificationJSON) {
+	msg = &notificationJSON{
+		Title: "DNS tampering is gone",
+		Body:  "The DNS queries are no longer intercepted or rewritten on the way to the upstreams.",
+		Tag:   "interception",
+	}
+
+	switch {
+	case r.Intercepted:
+		msg.Title = "DNS interception detected"
+		msg.Body = "The DNS queries to the addresses not serving DNS get responses, so the network, " +
+			"likely the ISP, transparently intercepts the DNS traffic."
+	case len(r.NXDomainRewrites) > 0:
+		msg.Title = "NXDOMAIN rewriting detected"
+		msg.Body = fmt.Sprintf(
+			"Upstream %s responds to the queries for non-existing domains with addresses.",
+			r.NXDomainRewrites[0].Upstream,
+		)
+	}
+
+	return msg
+}
+
+// latest returns the report of the latest check or nil if there has been none.
+func (c *interceptionChecker) latest() (r *interceptionReport) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.report
+}
+
+// start starts running the checks periodically in a separate goroutine, if
+// enabled.
+func (c *interceptionChecker) start() {
+	if !c.conf.Enabled {
+		return
+	}
+
+	ivl := c.conf.Interval.Duration
+	if ivl <= 0 {
+		ivl = defaultInterceptionInterval
+	}
+
+	go func() {
+		defer onPanicReport("interception check")
+
+		for {
+			r := c.check()
+			if r.detected() {
+				log.Info("interception check: dns tampering detected")
+			}
+
+			time.Sleep(ivl)
+		}
+	}()
+}
+
+// configuredUpstreams returns a copy of the upstreams from the configuration.
+func configuredUpstreams() (ups []string) {
+	config.RLock()
+	defer config.RUnlock()
+
+	return stringutil.CloneSlice(config.DNS.UpstreamDNS)
+}
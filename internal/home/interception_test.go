@@ -0,0 +1,140 @@
+package home
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlainUpstreamAddr(t *testing.T) {
+	testCases := []struct {
+		name     string
+		line     string
+		wantAddr string
+		wantOK   bool
+	}{{
+		name:     "ip",
+		line:     "8.8.8.8",
+		wantAddr: "8.8.8.8:53",
+		wantOK:   true,
+	}, {
+		name:     "udp_port",
+		line:     "udp://8.8.8.8:5353",
+		wantAddr: "8.8.8.8:5353",
+		wantOK:   true,
+	}, {
+		name:     "ipv6_port",
+		line:     "[::1]:53",
+		wantAddr: "[::1]:53",
+		wantOK:   true,
+	}, {
+		name:     "tls",
+		line:     "tls://dns.adguard.com",
+		wantAddr: "",
+		wantOK:   false,
+	}, {
+		name:     "domain_specific",
+		line:     "[/example.org/]8.8.8.8",
+		wantAddr: "",
+		wantOK:   false,
+	}, {
+		name:     "comment",
+		line:     "# 8.8.8.8",
+		wantAddr: "",
+		wantOK:   false,
+	}, {
+		name:     "hostname",
+		line:     "dns.example:53",
+		wantAddr: "",
+		wantOK:   false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, ok := plainUpstreamAddr(tc.line)
+			assert.Equal(t, tc.wantAddr, addr)
+			assert.Equal(t, tc.wantOK, ok)
+		})
+	}
+}
+
+func TestInterceptionChecker_check(t *testing.T) {
+	const probeAddr = "192.0.2.1"
+
+	var intercepted, rewritten bool
+	c := newInterceptionChecker(&interceptionCheckConfig{
+		ProbeAddrs: []string{probeAddr},
+	}, func() (ups []string) {
+		return []string{"1.1.1.1", "udp://1.1.1.1:53", "tls://1.1.1.1"}
+	}, nil)
+
+	var queried []string
+	c.exchange = func(network, addr string, req *dns.Msg) (resp *dns.Msg, err error) {
+		queried = append(queried, network+" "+addr)
+		resp = (&dns.Msg{}).SetReply(req)
+
+		switch addr {
+		case net.JoinHostPort(probeAddr, "53"):
+			if !intercepted {
+				return nil, errors.Error("timeout")
+			}
+		case "1.1.1.1:53":
+			if !rewritten {
+				resp.Rcode = dns.RcodeNameError
+
+				return resp, nil
+			}
+
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   req.Question[0].Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+				},
+				A: net.IP{198, 51, 100, 1},
+			})
+		}
+
+		return resp, nil
+	}
+
+	assert.Nil(t, c.latest())
+
+	r := c.check()
+	assert.False(t, r.detected())
+	assert.Same(t, r, c.latest())
+	assert.Equal(t, []string{
+		"udp 192.0.2.1:53",
+		"tcp 192.0.2.1:53",
+		"udp 1.1.1.1:53",
+	}, queried)
+
+	t.Run("intercepted", func(t *testing.T) {
+		intercepted = true
+
+		r = c.check()
+		require.Len(t, r.Probes, 2)
+
+		assert.True(t, r.Intercepted)
+		assert.True(t, r.Probes[0].Intercepted)
+		assert.Equal(t, "DNS interception detected", interceptionNotification(r).Title)
+	})
+
+	t.Run("rewritten", func(t *testing.T) {
+		intercepted, rewritten = false, true
+
+		r = c.check()
+		assert.False(t, r.Intercepted)
+		require.Len(t, r.NXDomainRewrites, 1)
+
+		assert.Equal(t, &nxdomainRewrite{
+			Upstream: "1.1.1.1",
+			Answers:  []string{"198.51.100.1"},
+		}, r.NXDomainRewrites[0])
+		assert.Equal(t, "NXDOMAIN rewriting detected", interceptionNotification(r).Title)
+	})
+}
@@ -0,0 +1,51 @@
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+)
+
+// interceptionStatusJSON is the response of the interception check handlers.
+type interceptionStatusJSON struct {
+	// Report is the report of the latest check.  It's nil if there has been
+	// none.
+	Report *interceptionReport `json:"report"`
+
+	Enabled bool `json:"enabled"`
+}
+
+// writeStatus writes the status of the checks with r into w.
+func (c *interceptionChecker) writeStatus(w http.ResponseWriter, r *http.Request, rep *interceptionReport) {
+	resp := &interceptionStatusJSON{
+		Report:  rep,
+		Enabled: c.conf.Enabled,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "encoding response: %s", err)
+	}
+}
+
+// handleInterceptionStatus is the handler for the GET
+// /control/interception_check HTTP API.
+func (c *interceptionChecker) handleInterceptionStatus(w http.ResponseWriter, r *http.Request) {
+	c.writeStatus(w, r, c.latest())
+}
+
+// handleInterceptionRun is the handler for the POST
+// /control/interception_check/run HTTP API.  It runs the check and responds
+// with its report.
+func (c *interceptionChecker) handleInterceptionRun(w http.ResponseWriter, r *http.Request) {
+	c.writeStatus(w, r, c.check())
+}
+
+// registerWebHandlers registers the HTTP handlers for the interception check
+// API.
+func (c *interceptionChecker) registerWebHandlers() {
+	httpRegister(http.MethodGet, "/control/interception_check", c.handleInterceptionStatus)
+	httpRegister(http.MethodPost, "/control/interception_check/run", c.handleInterceptionRun)
+}
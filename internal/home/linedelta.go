@@ -0,0 +1,200 @@
+package home
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// lineDeltaIM is the name of the instance manipulation used for the line-based
+// delta encoding of the filter lists.  See RFC 3229.
+const lineDeltaIM = "adguard-line-delta"
+
+// The operations of the line delta.  Each operation takes a single line of the
+// delta.
+const (
+	// lineDeltaCopy is followed by the number of lines to copy from the base.
+	lineDeltaCopy = '='
+
+	// lineDeltaSkip is followed by the number of lines of the base to skip.
+	lineDeltaSkip = '-'
+
+	// lineDeltaInsert is followed by the line to insert.
+	lineDeltaInsert = '+'
+
+	// lineDeltaNoEOL means that the last inserted line has no trailing
+	// newline.
+	lineDeltaNoEOL = '!'
+)
+
+// splitLines splits data into lines keeping the newlines.
+func splitLines(data []byte) (lines [][]byte) {
+	lines = bytes.SplitAfter(data, []byte("\n"))
+	if last := len(lines) - 1; len(lines[last]) == 0 {
+		lines = lines[:last]
+	}
+
+	return lines
+}
+
+// lineDeltaWriter builds a line delta merging the adjacent copies and skips.
+type lineDeltaWriter struct {
+	buf *bytes.Buffer
+
+	// op is the pending copy or skip operation, or zero if there is none.
+	op byte
+
+	// n is the number of lines of the pending operation.
+	n int
+}
+
+// add adds n lines of the copy or skip operation op.
+func (w *lineDeltaWriter) add(op byte, n int) {
+	if w.op != op {
+		w.flush()
+		w.op = op
+	}
+
+	w.n += n
+}
+
+// insert adds the insertion of line.
+func (w *lineDeltaWriter) insert(line []byte) {
+	w.flush()
+
+	w.buf.WriteByte(lineDeltaInsert)
+	w.buf.Write(line)
+	if !bytes.HasSuffix(line, []byte("\n")) {
+		w.buf.WriteByte('\n')
+		w.buf.WriteByte(lineDeltaNoEOL)
+		w.buf.WriteByte('\n')
+	}
+}
+
+// flush writes the pending operation, if any.
+func (w *lineDeltaWriter) flush() {
+	if w.op == 0 || w.n == 0 {
+		w.op, w.n = 0, 0
+
+		return
+	}
+
+	w.buf.WriteByte(w.op)
+	w.buf.WriteString(strconv.Itoa(w.n))
+	w.buf.WriteByte('\n')
+
+	w.op, w.n = 0, 0
+}
+
+// diffLines returns the line delta transforming base into target.  The delta
+// isn't necessarily minimal: the lines are matched greedily, which works well
+// for the lists that only get lines appended, removed, or changed in place.
+func diffLines(base, target []byte) (delta []byte) {
+	oldLines, newLines := splitLines(base), splitLines(target)
+
+	// oldLeft and newLeft are the numbers of the yet unprocessed occurrences
+	// of each line.
+	oldLeft := make(map[string]int, len(oldLines))
+	for _, l := range oldLines {
+		oldLeft[string(l)]++
+	}
+
+	newLeft := make(map[string]int, len(newLines))
+	for _, l := range newLines {
+		newLeft[string(l)]++
+	}
+
+	w := &lineDeltaWriter{
+		buf: &bytes.Buffer{},
+	}
+
+	i, j := 0, 0
+	for i < len(oldLines) && j < len(newLines) {
+		o, n := string(oldLines[i]), string(newLines[j])
+		switch {
+		case o == n:
+			w.add(lineDeltaCopy, 1)
+			oldLeft[o]--
+			newLeft[n]--
+			i++
+			j++
+		case oldLeft[n] == 0:
+			// The new line doesn't appear later in the base.
+			w.insert(newLines[j])
+			newLeft[n]--
+			j++
+		default:
+			// Either the old line doesn't appear later in the target, or
+			// the lines are reordered, in which case the old one is
+			// dropped.
+			w.add(lineDeltaSkip, 1)
+			oldLeft[o]--
+			i++
+		}
+	}
+
+	if i < len(oldLines) {
+		w.add(lineDeltaSkip, len(oldLines)-i)
+	}
+
+	for ; j < len(newLines); j++ {
+		w.insert(newLines[j])
+	}
+
+	w.flush()
+
+	return w.buf.Bytes()
+}
+
+// errBadLineDelta is returned when a line delta can't be applied to the base.
+const errBadLineDelta errors.Error = "bad line delta"
+
+// patchLines applies the line delta to base.
+func patchLines(base, delta []byte) (res []byte, err error) {
+	lines := splitLines(base)
+	buf := &bytes.Buffer{}
+
+	i := 0
+	inserted := false
+	for _, op := range splitLines(delta) {
+		op = bytes.TrimSuffix(op, []byte("\n"))
+		if len(op) == 0 {
+			return nil, fmt.Errorf("%w: empty operation", errBadLineDelta)
+		}
+
+		switch op[0] {
+		case lineDeltaCopy, lineDeltaSkip:
+			var n int
+			n, err = strconv.Atoi(string(op[1:]))
+			if err != nil || n <= 0 || i+n > len(lines) {
+				return nil, fmt.Errorf("%w: bad operation %q", errBadLineDelta, op)
+			}
+
+			if op[0] == lineDeltaCopy {
+				for _, l := range lines[i : i+n] {
+					buf.Write(l)
+				}
+			}
+
+			i += n
+			inserted = false
+		case lineDeltaInsert:
+			buf.Write(op[1:])
+			buf.WriteByte('\n')
+			inserted = true
+		case lineDeltaNoEOL:
+			if !inserted {
+				return nil, fmt.Errorf("%w: no inserted line to strip", errBadLineDelta)
+			}
+
+			buf.Truncate(buf.Len() - 1)
+			inserted = false
+		default:
+			return nil, fmt.Errorf("%w: unknown operation %q", errBadLineDelta, op[0])
+		}
+	}
+
+	return buf.Bytes(), nil
+}
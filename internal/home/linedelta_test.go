@@ -0,0 +1,140 @@
+package home
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffLines(t *testing.T) {
+	testCases := []struct {
+		name   string
+		base   string
+		target string
+	}{{
+		name:   "empty",
+		base:   "",
+		target: "",
+	}, {
+		name:   "from_empty",
+		base:   "",
+		target: "||example.org^\n",
+	}, {
+		name:   "to_empty",
+		base:   "||example.org^\n",
+		target: "",
+	}, {
+		name:   "same",
+		base:   "||example.org^\n||example.com^\n",
+		target: "||example.org^\n||example.com^\n",
+	}, {
+		name:   "append",
+		base:   "! Title\n||example.org^\n",
+		target: "! Title\n||example.org^\n||example.com^\n",
+	}, {
+		name:   "remove",
+		base:   "! Title\n||example.org^\n||example.com^\n||example.net^\n",
+		target: "! Title\n||example.net^\n",
+	}, {
+		name:   "change",
+		base:   "! Version: 1\n||example.org^\n",
+		target: "! Version: 2\n||example.org^\n",
+	}, {
+		name:   "reorder",
+		base:   "a\nb\nc\na\n",
+		target: "c\na\nb\nb\n",
+	}, {
+		name:   "crlf",
+		base:   "! Title\r\n||example.org^\r\n",
+		target: "! Title\r\n||example.com^\r\n",
+	}, {
+		name:   "no_eol",
+		base:   "||example.org^\n||example.com^",
+		target: "||example.org^\n||example.net^",
+	}, {
+		name:   "add_eol",
+		base:   "||example.org^",
+		target: "||example.org^\n",
+	}, {
+		name:   "plus_lines",
+		base:   "+1\n=1\n",
+		target: "=1\n-1\n!\n",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			delta := diffLines([]byte(tc.base), []byte(tc.target))
+
+			res, err := patchLines([]byte(tc.base), delta)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.target, string(res))
+		})
+	}
+
+	t.Run("compact", func(t *testing.T) {
+		delta := diffLines([]byte("a\nb\nc\nd\n"), []byte("a\nb\nc\nd\ne\n"))
+
+		assert.Equal(t, "=4\n+e\n", string(delta))
+	})
+}
+
+func TestPatchLines(t *testing.T) {
+	const base = "a\nb\n"
+
+	testCases := []struct {
+		name       string
+		delta      string
+		want       string
+		wantErrMsg string
+	}{{
+		name:       "success",
+		delta:      "-1\n=1\n+c\n!\n",
+		want:       "b\nc",
+		wantErrMsg: "",
+	}, {
+		name:       "empty_op",
+		delta:      "=1\n\n",
+		want:       "",
+		wantErrMsg: "bad line delta: empty operation",
+	}, {
+		name:       "too_many",
+		delta:      "=3\n",
+		want:       "",
+		wantErrMsg: `bad line delta: bad operation "=3"`,
+	}, {
+		name:       "bad_number",
+		delta:      "-x\n",
+		want:       "",
+		wantErrMsg: `bad line delta: bad operation "-x"`,
+	}, {
+		name:       "no_insert",
+		delta:      "=1\n!\n",
+		want:       "",
+		wantErrMsg: "bad line delta: no inserted line to strip",
+	}, {
+		name:       "unknown",
+		delta:      "*1\n",
+		want:       "",
+		wantErrMsg: `bad line delta: unknown operation '*'`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := patchLines([]byte(base), []byte(tc.delta))
+			if tc.wantErrMsg != "" {
+				require.Error(t, err)
+
+				assert.ErrorIs(t, err, errBadLineDelta)
+				assert.Equal(t, tc.wantErrMsg, err.Error())
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.want, string(res))
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package home
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// listServerConfig is the configuration of the list server mode, in which the
+// instance serves its filter lists to the other instances subscribed to them.
+type listServerConfig struct {
+	// Token is the secret token the subscribers must present either in the
+	// Authorization header with the Bearer scheme or in the token query
+	// parameter.  It must not be empty when Enabled is true.
+	Token string `yaml:"token"`
+
+	// Enabled defines if the filter lists are served.
+	Enabled bool `yaml:"enabled"`
+}
+
+// listServerHistory is the number of versions of each list the list server
+// keeps to be able to send the deltas against them.
+const listServerHistory = 3
+
+// listVersion is a version of a served filter list.
+type listVersion struct {
+	// etag is the entity tag of the version.
+	etag string
+
+	// data is the contents of the list.
+	data []byte
+}
+
+// listServer serves the filter lists to the other instances.
+type listServer struct {
+	// mu protects versions.
+	mu *sync.Mutex
+
+	// versions are the recently served versions of the lists by their IDs,
+	// oldest first.
+	versions map[int64][]*listVersion
+
+	// token is the secret token of the subscribers.
+	token []byte
+}
+
+// newListServer returns a new properly initialized list server.
+func newListServer(conf *listServerConfig) (s *listServer, err error) {
+	if conf.Token == "" {
+		return nil, errors.Error("list server: empty token")
+	}
+
+	return &listServer{
+		mu:       &sync.Mutex{},
+		versions: map[int64][]*listVersion{},
+		token:    []byte(conf.Token),
+	}, nil
+}
+
+// listETag returns the entity tag for the list contents data.
+func listETag(data []byte) (etag string) {
+	return fmt.Sprintf(`"%08x"`, crc32.ChecksumIEEE(data))
+}
+
+// remember records the version of the list with id and returns the previous
+// version with baseETag, if any.
+func (s *listServer) remember(id int64, v *listVersion, baseETag string) (base *listVersion) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vers := s.versions[id]
+	for _, prev := range vers {
+		if prev.etag == baseETag {
+			base = prev
+		}
+	}
+
+	if len(vers) == 0 || vers[len(vers)-1].etag != v.etag {
+		vers = append(vers, v)
+		if over := len(vers) - listServerHistory; over > 0 {
+			vers = append(vers[:0], vers[over:]...)
+		}
+
+		s.versions[id] = vers
+	}
+
+	return base
+}
+
+// authorized returns true if r presents the token of the subscribers.
+func (s *listServer) authorized(r *http.Request) (ok bool) {
+	token := r.URL.Query().Get("token")
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), s.token) == 1
+}
+
+// wrap returns a handler, which only accepts the authorized GET requests.
+func (s *listServer) wrap(h http.HandlerFunc) (wrapped http.HandlerFunc) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			aghhttp.Error(r, w, http.StatusMethodNotAllowed, "only GET is allowed")
+
+			return
+		} else if !s.authorized(r) {
+			aghhttp.Error(r, w, http.StatusUnauthorized, "invalid token")
+
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+// listServerListJSON is a filter list in the index of the list server.
+type listServerListJSON struct {
+	Name       string `json:"name"`
+	URL        string `json:"url"`
+	ID         int64  `json:"id"`
+	RulesCount int    `json:"rules_count"`
+	Allowlist  bool   `json:"allowlist"`
+}
+
+// listServerPath is the path of the handler serving a single list.
+const listServerPath = "/control/list_server/list"
+
+// handleIndex is the handler for the GET /control/list_server/lists HTTP API.
+func (s *listServer) handleIndex(w http.ResponseWriter, r *http.Request) {
+	lists := []*listServerListJSON{}
+
+	config.RLock()
+	for i, flts := range [][]filter{config.Filters, config.WhitelistFilters} {
+		for _, flt := range flts {
+			if !flt.Enabled {
+				continue
+			}
+
+			lists = append(lists, &listServerListJSON{
+				Name:       flt.Name,
+				URL:        listServerPath + "?id=" + strconv.FormatInt(flt.ID, 10),
+				ID:         flt.ID,
+				RulesCount: flt.RulesCount,
+				Allowlist:  i == 1,
+			})
+		}
+	}
+	config.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(map[string]interface{}{"lists": lists})
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "encoding response: %s", err)
+	}
+}
+
+// enabledFilterPath returns the path to the contents of the enabled filter list
+// with id.  ok is false if there is no such list.
+func enabledFilterPath(id int64) (path string, ok bool) {
+	config.RLock()
+	defer config.RUnlock()
+
+	for _, flts := range [][]filter{config.Filters, config.WhitelistFilters} {
+		for _, flt := range flts {
+			if flt.ID == id && flt.Enabled {
+				return flt.Path(), true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// handleList is the handler for the GET /control/list_server/list HTTP API.
+// It supports the conditional requests and the delta encoding of RFC 3229 with
+// the line delta instance manipulation.
+func (s *listServer) handleList(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "bad id: %s", err)
+
+		return
+	}
+
+	path, ok := enabledFilterPath(id)
+	if !ok {
+		aghhttp.Error(r, w, http.StatusNotFound, "no enabled list with id %d", id)
+
+		return
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "reading list: %s", err)
+
+		return
+	}
+
+	v := &listVersion{
+		etag: listETag(data),
+		data: data,
+	}
+	baseETag := r.Header.Get("If-None-Match")
+	base := s.remember(id, v, baseETag)
+
+	h := w.Header()
+	h.Set("ETag", v.etag)
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Vary", "A-IM, If-None-Match")
+
+	if baseETag == v.etag {
+		w.WriteHeader(http.StatusNotModified)
+
+		return
+	}
+
+	body := data
+	if base != nil && acceptsLineDelta(r) {
+		log.Debug("list server: sending delta for list %d from %s", id, baseETag)
+
+		body = diffLines(base.data, data)
+		h.Set("IM", lineDeltaIM)
+		h.Set("Delta-Base", baseETag)
+		w.WriteHeader(http.StatusIMUsed)
+	}
+
+	_, err = w.Write(body)
+	if err != nil {
+		log.Debug("list server: writing list %d: %s", id, err)
+	}
+}
+
+// acceptsLineDelta returns true if the client of r accepts the line delta.
+func acceptsLineDelta(r *http.Request) (ok bool) {
+	for _, im := range strings.Split(r.Header.Get("A-IM"), ",") {
+		if strings.TrimSpace(im) == lineDeltaIM {
+			return true
+		}
+	}
+
+	return false
+}
+
+// initListServer starts serving the filter lists if the list server mode is
+// enabled.
+func (f *Filtering) initListServer() {
+	config.RLock()
+	conf := config.ListServer
+	config.RUnlock()
+
+	if !conf.Enabled {
+		return
+	}
+
+	s, err := newListServer(&conf)
+	if err != nil {
+		log.Error("%s", err)
+
+		return
+	}
+
+	// The handlers check the token of the subscribers on their own, so they
+	// are registered without the authentication of the users.
+	httpRegister("", "/control/list_server/lists", s.wrap(s.handleIndex))
+	httpRegister("", listServerPath, s.wrap(s.handleList))
+
+	log.Info("list server: serving the filter lists")
+}
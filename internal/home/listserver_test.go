@@ -0,0 +1,126 @@
+package home
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListServer(t *testing.T) {
+	const (
+		token = "secret"
+
+		srvID = 1
+		cliID = 2
+	)
+
+	prevConfig := config
+	t.Cleanup(func() { config = prevConfig })
+
+	srvFlt := filter{
+		Enabled: true,
+		Name:    "Served",
+	}
+	srvFlt.ID = srvID
+
+	config = &configuration{
+		Filters: []filter{srvFlt},
+	}
+
+	Context = homeContext{
+		workDir: t.TempDir(),
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+	Context.filters.Init()
+
+	err := os.MkdirAll(filepath.Join(Context.getDataDir(), filterDir), 0o755)
+	require.NoError(t, err)
+
+	setContent := func(t *testing.T, content string) {
+		t.Helper()
+
+		err = os.WriteFile(srvFlt.Path(), []byte(content), 0o644)
+		require.NoError(t, err)
+	}
+
+	s, err := newListServer(&listServerConfig{Token: token, Enabled: true})
+	require.NoError(t, err)
+
+	var lastStatus int
+	srv := httptest.NewServer(s.wrap(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		s.handleList(rec, r)
+		lastStatus = rec.Code
+
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		_, _ = w.Write(rec.Body.Bytes())
+	}))
+	t.Cleanup(srv.Close)
+
+	cliFlt := &filter{
+		URL: srv.URL + listServerPath + "?id=1&token=" + token,
+	}
+	cliFlt.ID = cliID
+
+	t.Run("unauthorized", func(t *testing.T) {
+		var resp *http.Response
+		resp, err = http.Get(srv.URL + listServerPath + "?id=1&token=bad")
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	testCases := []struct {
+		name       string
+		content    string
+		wantStatus int
+		wantOK     bool
+	}{{
+		name:       "full",
+		content:    "! Title\n||example.org^\n",
+		wantStatus: http.StatusOK,
+		wantOK:     true,
+	}, {
+		name:       "not_modified",
+		content:    "! Title\n||example.org^\n",
+		wantStatus: http.StatusNotModified,
+		wantOK:     false,
+	}, {
+		name:       "delta",
+		content:    "! Title\n||example.org^\n||example.com^\n",
+		wantStatus: http.StatusIMUsed,
+		wantOK:     true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			setContent(t, tc.content)
+
+			var ok bool
+			ok, err = Context.filters.update(cliFlt)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.wantOK, ok)
+			assert.Equal(t, tc.wantStatus, lastStatus)
+			assert.Equal(t, listETag([]byte(tc.content)), cliFlt.etag)
+
+			var data []byte
+			data, err = os.ReadFile(cliFlt.Path())
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.content, string(data))
+		})
+	}
+}
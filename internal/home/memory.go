@@ -31,6 +31,8 @@ func memoryUsage(args options) {
 	// periodically call "debug.FreeOSMemory" so
 	// that the OS could reclaim the free memory
 	go func() {
+		defer onPanicReport("memory")
+
 		ticker := time.NewTicker(5 * time.Minute)
 		for range ticker.C {
 			log.Debug("free os memory")
@@ -0,0 +1,576 @@
+package home
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// notificationsConfig is the configuration of the notifications about the
+// events important for the administrator, such as an upstream going down.
+type notificationsConfig struct {
+	// WebPush is the configuration of the Web Push channel, which delivers
+	// the notifications to the subscribed browsers even when the dashboard
+	// isn't open.
+	WebPush webPushConfig `yaml:"web_push"`
+
+	// CertExpiryDays is the number of days before the expiration of the TLS
+	// certificate, starting from which the administrator is notified about
+	// it.  If zero, defaultCertExpiryDays is used.
+	CertExpiryDays int `yaml:"cert_expiry_days"`
+}
+
+// webPushConfig is the configuration of the Web Push channel.
+type webPushConfig struct {
+	// Subject is the contact of the administrator for the operators of the
+	// push services, either a "mailto:" or an "https:" URL.
+	Subject string `yaml:"subject"`
+
+	// PrivateKey is the base64url-encoded VAPID private key.  It's generated
+	// when the dashboard requests the public key for the first time.
+	PrivateKey string `yaml:"private_key"`
+
+	// Subscriptions are the push subscriptions of the browsers.
+	Subscriptions []*webPushSubscription `yaml:"subscriptions"`
+}
+
+// webPushSubscription is a push subscription of a browser.
+type webPushSubscription struct {
+	// Endpoint is the URL of the push service, to which the notifications
+	// for the browser are sent.
+	Endpoint string `yaml:"endpoint"`
+
+	// P256DH is the base64url-encoded public key of the browser.
+	P256DH string `yaml:"p256dh"`
+
+	// Auth is the base64url-encoded authentication secret of the browser.
+	Auth string `yaml:"auth"`
+}
+
+// Notification parameters.
+const (
+	// defaultCertExpiryDays is the default number of days before the
+	// expiration of the TLS certificate, starting from which the
+	// administrator is notified about it.
+	defaultCertExpiryDays = 14
+
+	// certCheckInterval is the interval between the checks of the TLS
+	// certificate expiration.
+	certCheckInterval = 6 * time.Hour
+
+	// maxWebPushNotifications is the maximum number of the notifications
+	// being sent at the same time.  The newer ones are dropped.
+	maxWebPushNotifications = 16
+)
+
+// notificationJSON is the payload of a push notification, which the service
+// worker of the dashboard shows.
+type notificationJSON struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+
+	// Tag is the tag of the notification, so that a newer one about the same
+	// thing replaces the older one.
+	Tag string `json:"tag"`
+}
+
+// notifier sends the notifications about the important events to the
+// administrator.
+type notifier struct {
+	// cli is the client used to send the push notifications.
+	cli *http.Client
+
+	// mu protects the fields below.
+	mu *sync.Mutex
+
+	// conf is the current configuration.
+	conf *notificationsConfig
+
+	// key is the parsed VAPID private key.  It's nil until generated.
+	key *ecdsa.PrivateKey
+
+	// sem limits the number of the notifications being sent.
+	sem chan struct{}
+
+	// confModified is called when the configuration is changed.  It's
+	// onConfigModified everywhere except the tests.
+	confModified func()
+
+	// leases returns all the current DHCP leases.
+	leases func() (ls []*dhcpd.Lease)
+
+	// devices are the hardware addresses of the devices with the DHCP
+	// leases.
+	devices map[string]struct{}
+
+	// certNotified is the expiration time of the TLS certificate, about which
+	// the administrator has already been notified.
+	certNotified time.Time
+
+	// certChecksDone is closed to stop the certificate checks.  It's nil if
+	// the checks aren't running.
+	certChecksDone chan struct{}
+}
+
+// newNotifier returns a new properly initialized notifier.  cli may be nil.
+// An invalid VAPID key is replaced with the new one.
+func newNotifier(conf *notificationsConfig, cli *http.Client) (n *notifier) {
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+
+	c := *conf
+	c.WebPush.Subscriptions = append([]*webPushSubscription{}, conf.WebPush.Subscriptions...)
+
+	n = &notifier{
+		cli:  cli,
+		mu:   &sync.Mutex{},
+		conf: &c,
+		sem:  make(chan struct{}, maxWebPushNotifications),
+
+		confModified: onConfigModified,
+	}
+
+	if c.WebPush.PrivateKey != "" {
+		var err error
+		n.key, err = parseVAPIDKey(c.WebPush.PrivateKey)
+		if err != nil {
+			log.Error("notifications: %s, a new key will be generated", err)
+			c.WebPush.PrivateKey = ""
+			c.WebPush.Subscriptions = nil
+		}
+	}
+
+	return n
+}
+
+// WriteDiskConfig writes the current configuration to conf.
+func (n *notifier) WriteDiskConfig(conf *notificationsConfig) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	*conf = *n.conf
+	conf.WebPush.Subscriptions = append([]*webPushSubscription{}, n.conf.WebPush.Subscriptions...)
+}
+
+// publicKey returns the base64url-encoded VAPID public key.  It generates the
+// key pair if there is none yet, in which case generated is true.
+func (n *notifier) publicKey() (pub string, generated bool, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.key == nil {
+		var priv string
+		priv, err = newVAPIDKey()
+		if err != nil {
+			return "", false, fmt.Errorf("generating vapid key: %w", err)
+		}
+
+		n.key, err = parseVAPIDKey(priv)
+		if err != nil {
+			return "", false, err
+		}
+
+		n.conf.WebPush.PrivateKey, generated = priv, true
+	}
+
+	return vapidPublicKey(n.key), generated, nil
+}
+
+// notify sends the notification to all the subscribed browsers.  n may be nil.
+func (n *notifier) notify(msg *notificationJSON) {
+	if n == nil {
+		return
+	}
+
+	log.Info("notifications: %s: %s", msg.Title, msg.Body)
+
+	n.mu.Lock()
+	key, subject := n.key, n.conf.WebPush.Subject
+	subs := append([]*webPushSubscription{}, n.conf.WebPush.Subscriptions...)
+	n.mu.Unlock()
+
+	if key == nil || len(subs) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		log.Error("notifications: encoding: %s", err)
+
+		return
+	}
+
+	for _, sub := range subs {
+		select {
+		case n.sem <- struct{}{}:
+			// Go on.
+		default:
+			log.Debug("notifications: too many pending notifications, dropping")
+
+			return
+		}
+
+		go func(sub *webPushSubscription) {
+			defer log.OnPanic("notifications")
+			defer func() { <-n.sem }()
+
+			n.push(key, subject, sub, payload)
+		}(sub)
+	}
+}
+
+// push sends payload to sub and removes the subscription if it's gone.
+func (n *notifier) push(key *ecdsa.PrivateKey, subject string, sub *webPushSubscription, payload []byte) {
+	err := sendWebPush(n.cli, key, subject, sub, payload)
+	if err == nil {
+		return
+	} else if !errors.Is(err, errWebPushGone) {
+		log.Error("notifications: sending to %s: %s", sub.Endpoint, err)
+
+		return
+	}
+
+	log.Info("notifications: subscription %s is gone, removing", sub.Endpoint)
+	if n.unsubscribe(sub.Endpoint) {
+		n.confModified()
+	}
+}
+
+// subscribe adds the push subscription replacing the one with the same
+// endpoint, if any.
+func (n *notifier) subscribe(sub *webPushSubscription) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	subs := n.conf.WebPush.Subscriptions
+	for i, s := range subs {
+		if s.Endpoint == sub.Endpoint {
+			subs[i] = sub
+
+			return
+		}
+	}
+
+	n.conf.WebPush.Subscriptions = append(subs, sub)
+}
+
+// unsubscribe removes the push subscription with endpoint.  ok is false if
+// there is no such subscription.
+func (n *notifier) unsubscribe(endpoint string) (ok bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	subs := n.conf.WebPush.Subscriptions
+	for i, s := range subs {
+		if s.Endpoint == endpoint {
+			n.conf.WebPush.Subscriptions = append(subs[:i:i], subs[i+1:]...)
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// upstreamHealthChanged is the dnsforward.ServerConfig.UpstreamHealthChanged
+// callback.  n may be nil.
+func (n *notifier) upstreamHealthChanged(addr string, healthy bool) {
+	msg := &notificationJSON{
+		Title: "Upstream is down",
+		Body:  fmt.Sprintf("Upstream %s has failed the health checks and is removed from rotation.", addr),
+		Tag:   "upstream:" + addr,
+	}
+
+	if healthy {
+		msg.Title = "Upstream is back"
+		msg.Body = fmt.Sprintf("Upstream %s has passed the health check and is back in rotation.", addr)
+	}
+
+	n.notify(msg)
+}
+
+// checkCert notifies about the TLS certificate, which expires at notAfter, if
+// it expires in less than the configured number of days as of now.
+func (n *notifier) checkCert(notAfter, now time.Time) {
+	if notAfter.IsZero() {
+		return
+	}
+
+	n.mu.Lock()
+	days := n.conf.CertExpiryDays
+	if days <= 0 {
+		days = defaultCertExpiryDays
+	}
+
+	due := !n.certNotified.Equal(notAfter) && now.AddDate(0, 0, days).After(notAfter)
+	if due {
+		n.certNotified = notAfter
+	}
+	n.mu.Unlock()
+
+	if !due {
+		return
+	}
+
+	msg := &notificationJSON{
+		Title: "TLS certificate is expiring",
+		Body:  "The TLS certificate expires on " + notAfter.Format("2006-01-02") + ".",
+		Tag:   "tls_cert",
+	}
+
+	if !now.Before(notAfter) {
+		msg.Title = "TLS certificate has expired"
+		msg.Body = "The TLS certificate has expired on " + notAfter.Format("2006-01-02") + "."
+	}
+
+	n.notify(msg)
+}
+
+// startCertChecks starts checking the expiration of the TLS certificate of
+// Context.tls periodically in a separate goroutine until stopCertChecks is
+// called.  It does nothing if the checks are already running.
+func (n *notifier) startCertChecks() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.certChecksDone != nil {
+		return
+	}
+
+	n.certChecksDone = make(chan struct{})
+
+	go n.runCertChecks(n.certChecksDone)
+}
+
+// stopCertChecks stops the certificate checks started by startCertChecks.
+func (n *notifier) stopCertChecks() {
+	if n == nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.certChecksDone == nil {
+		return
+	}
+
+	close(n.certChecksDone)
+	n.certChecksDone = nil
+}
+
+// runCertChecks checks the expiration of the TLS certificate on the interval
+// until done is closed.
+func (n *notifier) runCertChecks(done <-chan struct{}) {
+	defer onPanicReport("notifications: certificate checks")
+
+	t := time.NewTicker(certCheckInterval)
+	defer t.Stop()
+
+	for {
+		n.checkCert(Context.tls.certNotAfter(), time.Now())
+
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			// Go on.
+		}
+	}
+}
+
+// watchLeases makes n notify about the devices obtaining their first lease
+// from srv since the start.
+func (n *notifier) watchLeases(srv *dhcpd.Server) {
+	n.leases = func() (ls []*dhcpd.Lease) { return srv.Leases(dhcpd.LeasesAll) }
+
+	n.mu.Lock()
+	n.devices = map[string]struct{}{}
+	for _, l := range n.leases() {
+		n.devices[l.HWAddr.String()] = struct{}{}
+	}
+	n.mu.Unlock()
+
+	srv.SetOnLeaseChanged(n.onLeaseChanged)
+}
+
+// onLeaseChanged is the dhcpd.OnLeaseChangedT callback, which notifies about
+// the devices, which have obtained a lease for the first time.
+func (n *notifier) onLeaseChanged(flags int) {
+	if flags != dhcpd.LeaseChangedAdded && flags != dhcpd.LeaseChangedAddedStatic {
+		return
+	}
+
+	var msgs []*notificationJSON
+
+	n.mu.Lock()
+	devices := make(map[string]struct{}, len(n.devices))
+	for _, l := range n.leases() {
+		mac := l.HWAddr.String()
+		devices[mac] = struct{}{}
+		if _, ok := n.devices[mac]; ok {
+			continue
+		}
+
+		msgs = append(msgs, newDeviceNotification(l.Hostname, l.IP, mac))
+	}
+
+	n.devices = devices
+	n.mu.Unlock()
+
+	for _, msg := range msgs {
+		n.notify(msg)
+	}
+}
+
+// newDeviceNotification returns the notification about the new device.
+func newDeviceNotification(host string, ip net.IP, mac string) (msg *notificationJSON) {
+	name := host
+	if name == "" {
+		name = mac
+	}
+
+	return &notificationJSON{
+		Title: "New device",
+		Body:  fmt.Sprintf("Device %s has obtained IP address %s (%s).", name, ip, mac),
+		Tag:   "device:" + mac,
+	}
+}
+
+// webPushStatusJSON is the status of the Web Push channel.
+type webPushStatusJSON struct {
+	// PublicKey is the base64url-encoded VAPID public key, which is the
+	// "applicationServerKey" of the push subscriptions.
+	PublicKey string `json:"public_key"`
+
+	Subscriptions int `json:"subscriptions"`
+}
+
+// handleWebPushStatus is the handler for the GET
+// /control/notifications/web_push/status HTTP API.
+func (n *notifier) handleWebPushStatus(w http.ResponseWriter, r *http.Request) {
+	pub, generated, err := n.publicKey()
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "%s", err)
+
+		return
+	}
+
+	if generated {
+		n.confModified()
+	}
+
+	n.mu.Lock()
+	resp := &webPushStatusJSON{
+		PublicKey:     pub,
+		Subscriptions: len(n.conf.WebPush.Subscriptions),
+	}
+	n.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+	}
+}
+
+// webPushSubscriptionJSON is the push subscription the way PushSubscription
+// of the browsers encodes it.
+type webPushSubscriptionJSON struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256DH string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+// handleWebPushSubscribe is the handler for the POST
+// /control/notifications/web_push/subscribe HTTP API.
+func (n *notifier) handleWebPushSubscribe(w http.ResponseWriter, r *http.Request) {
+	sj := &webPushSubscriptionJSON{}
+	err := json.NewDecoder(r.Body).Decode(sj)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return
+	}
+
+	u, err := url.Parse(sj.Endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		aghhttp.Error(r, w, http.StatusBadRequest, "endpoint must be an https url")
+
+		return
+	}
+
+	_, _, err = decodeSubscriptionKeys(sj.Keys.P256DH, sj.Keys.Auth)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "bad subscription keys: %s", err)
+
+		return
+	}
+
+	n.subscribe(&webPushSubscription{
+		Endpoint: sj.Endpoint,
+		P256DH:   sj.Keys.P256DH,
+		Auth:     sj.Keys.Auth,
+	})
+
+	n.confModified()
+}
+
+// handleWebPushUnsubscribe is the handler for the POST
+// /control/notifications/web_push/unsubscribe HTTP API.
+func (n *notifier) handleWebPushUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	sj := &webPushSubscriptionJSON{}
+	err := json.NewDecoder(r.Body).Decode(sj)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return
+	}
+
+	if n.unsubscribe(sj.Endpoint) {
+		n.confModified()
+	}
+}
+
+// handleWebPushTest is the handler for the POST
+// /control/notifications/web_push/test HTTP API.
+func (n *notifier) handleWebPushTest(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	subscribed := n.key != nil && len(n.conf.WebPush.Subscriptions) > 0
+	n.mu.Unlock()
+
+	if !subscribed {
+		aghhttp.Error(r, w, http.StatusBadRequest, "no subscriptions")
+
+		return
+	}
+
+	n.notify(&notificationJSON{
+		Title: "AdGuard Home",
+		Body:  "This is a test notification.",
+		Tag:   "test",
+	})
+}
+
+// registerNotificationsHandlers registers the HTTP handlers of the Web Push
+// channel.
+func registerNotificationsHandlers() {
+	n := Context.notifier
+	httpRegister(http.MethodGet, "/control/notifications/web_push/status", n.handleWebPushStatus)
+	httpRegister(http.MethodPost, "/control/notifications/web_push/subscribe", n.handleWebPushSubscribe)
+	httpRegister(http.MethodPost, "/control/notifications/web_push/unsubscribe", n.handleWebPushUnsubscribe)
+	httpRegister(http.MethodPost, "/control/notifications/web_push/test", n.handleWebPushTest)
+}
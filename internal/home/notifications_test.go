@@ -0,0 +1,173 @@
+package home
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestNotifier returns a notifier with a single subscription, the
+// notifications to which are sent to msgs.  If gone is true, the push service
+// reports the subscription as gone.
+func newTestNotifier(t *testing.T, gone bool) (n *notifier, msgs chan *notificationJSON) {
+	t.Helper()
+
+	ua := newTestUserAgent(t)
+	msgs = make(chan *notificationJSON, 8)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		msg := &notificationJSON{}
+		err = json.Unmarshal(ua.decrypt(t, body), msg)
+		require.NoError(t, err)
+
+		msgs <- msg
+
+		if gone {
+			w.WriteHeader(http.StatusGone)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	n = newNotifier(&notificationsConfig{}, srv.Client())
+	n.confModified = func() {}
+
+	_, generated, err := n.publicKey()
+	require.NoError(t, err)
+	require.True(t, generated)
+
+	n.subscribe(ua.subscription(srv.URL + "/sub"))
+
+	return n, msgs
+}
+
+// receive returns the next notification from msgs or fails the test.
+func receive(t *testing.T, msgs chan *notificationJSON) (msg *notificationJSON) {
+	t.Helper()
+
+	select {
+	case msg = <-msgs:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification")
+	}
+
+	return nil
+}
+
+func TestNotifier_push(t *testing.T) {
+	n, msgs := newTestNotifier(t, true)
+
+	modified := make(chan struct{}, 1)
+	n.confModified = func() { modified <- struct{}{} }
+
+	n.upstreamHealthChanged("192.0.2.1:53", false)
+
+	msg := receive(t, msgs)
+	assert.Equal(t, "upstream:192.0.2.1:53", msg.Tag)
+
+	select {
+	case <-modified:
+		// Go on.
+	case <-time.After(5 * time.Second):
+		t.Fatal("config isn't modified")
+	}
+
+	conf := &notificationsConfig{}
+	n.WriteDiskConfig(conf)
+
+	assert.Empty(t, conf.WebPush.Subscriptions)
+	assert.NotEmpty(t, conf.WebPush.PrivateKey)
+}
+
+func TestNotifier_checkCert(t *testing.T) {
+	n, msgs := newTestNotifier(t, false)
+
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := now.AddDate(0, 0, defaultCertExpiryDays+1)
+
+	n.checkCert(notAfter, now)
+	assert.Empty(t, msgs)
+
+	now = now.AddDate(0, 0, 2)
+	n.checkCert(notAfter, now)
+
+	msg := receive(t, msgs)
+	assert.Equal(t, "tls_cert", msg.Tag)
+	assert.Equal(t, "TLS certificate is expiring", msg.Title)
+
+	// Only notify once about the same certificate.
+	n.checkCert(notAfter, notAfter)
+	n.checkCert(time.Time{}, notAfter)
+
+	// A new certificate, which has already expired.
+	n.checkCert(now, now)
+
+	msg = receive(t, msgs)
+	assert.Equal(t, "TLS certificate has expired", msg.Title)
+	assert.Empty(t, msgs)
+}
+
+func TestNotifier_stopCertChecks(t *testing.T) {
+	n, _ := newTestNotifier(t, false)
+
+	n.startCertChecks()
+	done := n.certChecksDone
+	require.NotNil(t, done)
+
+	// Starting the running checks again doesn't start another goroutine.
+	n.startCertChecks()
+	assert.Equal(t, done, n.certChecksDone)
+
+	n.stopCertChecks()
+	assert.Nil(t, n.certChecksDone)
+
+	_, ok := <-done
+	assert.False(t, ok)
+
+	assert.NotPanics(t, n.stopCertChecks)
+	assert.NotPanics(t, (*notifier)(nil).stopCertChecks)
+}
+
+func TestNotifier_onLeaseChanged(t *testing.T) {
+	n, msgs := newTestNotifier(t, false)
+
+	known := &dhcpd.Lease{
+		HWAddr: net.HardwareAddr{0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA},
+		IP:     net.IP{192, 168, 0, 2},
+	}
+	added := &dhcpd.Lease{
+		Hostname: "laptop",
+		HWAddr:   net.HardwareAddr{0xBB, 0xBB, 0xBB, 0xBB, 0xBB, 0xBB},
+		IP:       net.IP{192, 168, 0, 3},
+	}
+
+	leases := []*dhcpd.Lease{known}
+	n.leases = func() (ls []*dhcpd.Lease) { return leases }
+	n.devices = map[string]struct{}{known.HWAddr.String(): {}}
+
+	leases = append(leases, added)
+	n.onLeaseChanged(dhcpd.LeaseChangedRemovedAll)
+	assert.Empty(t, msgs)
+
+	n.onLeaseChanged(dhcpd.LeaseChangedAdded)
+
+	msg := receive(t, msgs)
+	assert.Equal(t, "device:bb:bb:bb:bb:bb:bb", msg.Tag)
+	assert.Contains(t, msg.Body, "laptop")
+
+	n.onLeaseChanged(dhcpd.LeaseChangedAdded)
+	assert.Empty(t, msgs)
+}
@@ -40,6 +40,20 @@ type options struct {
 	// localFrontend forces AdGuard Home to use the frontend files from disk
 	// rather than the ones that have been compiled into the binary.
 	localFrontend bool
+
+	// setSystemDNS makes the service installation point the system DNS
+	// settings at AdGuard Home.  The original settings are restored on
+	// uninstallation.
+	setSystemDNS bool
+
+	// noConfinement disables the restriction of the system calls and the
+	// filesystem access of the process on Linux.
+	noConfinement bool
+
+	// safeMode makes AdGuard Home start with the filtering, DHCP, and the
+	// custom DNS settings disabled, so that only the web UI and the plain
+	// forwarding work.
+	safeMode bool
 }
 
 // functions used for their side-effects
@@ -248,6 +262,40 @@ var localFrontendArg = arg{
 	serialize:       func(o options) []string { return boolSliceOrNil(o.localFrontend) },
 }
 
+var setSystemDNSArg = arg{
+	description:     "Point the system DNS settings at AdGuard Home on service installation.  Use with -s install.",
+	longName:        "set-system-dns",
+	shortName:       "",
+	updateWithValue: nil,
+	updateNoValue:   func(o options) (options, error) { o.setSystemDNS = true; return o, nil },
+	effect:          nil,
+	// Only the installation uses the option, so don't pass it to the
+	// service.
+	serialize: func(o options) []string { return nil },
+}
+
+var noConfinementArg = arg{
+	description:     "Don't restrict the system calls and the filesystem access on Linux.",
+	longName:        "no-confinement",
+	shortName:       "",
+	updateWithValue: nil,
+	updateNoValue:   func(o options) (options, error) { o.noConfinement = true; return o, nil },
+	effect:          nil,
+	serialize:       func(o options) []string { return boolSliceOrNil(o.noConfinement) },
+}
+
+var safeModeArg = arg{
+	description:     "Start with the filtering, DHCP, and the custom DNS settings disabled to recover from a broken configuration.",
+	longName:        "safe-mode",
+	shortName:       "",
+	updateWithValue: nil,
+	updateNoValue:   func(o options) (options, error) { o.safeMode = true; return o, nil },
+	effect:          nil,
+	// The safe mode is meant for a single run, so don't pass it to the
+	// service.
+	serialize: func(o options) []string { return nil },
+}
+
 func init() {
 	args = []arg{
 		configArg,
@@ -262,6 +310,9 @@ func init() {
 		disableMemoryOptimizationArg,
 		noEtcHostsArg,
 		localFrontendArg,
+		setSystemDNSArg,
+		noConfinementArg,
+		safeModeArg,
 		verboseArg,
 		glinetArg,
 		versionArg,
@@ -117,6 +117,21 @@ func TestParseGLInet(t *testing.T) {
 	assert.True(t, testParseOK(t, "--glinet").glinetMode, "--glinet is GL-Inet mode")
 }
 
+func TestParseSetSystemDNS(t *testing.T) {
+	assert.False(t, testParseOK(t).setSystemDNS, "empty is not set system dns")
+	assert.True(t, testParseOK(t, "--set-system-dns").setSystemDNS, "--set-system-dns is set system dns")
+}
+
+func TestParseNoConfinement(t *testing.T) {
+	assert.False(t, testParseOK(t).noConfinement, "empty is not no confinement")
+	assert.True(t, testParseOK(t, "--no-confinement").noConfinement, "--no-confinement is no confinement")
+}
+
+func TestParseSafeMode(t *testing.T) {
+	assert.False(t, testParseOK(t).safeMode, "empty is not safe mode")
+	assert.True(t, testParseOK(t, "--safe-mode").safeMode, "--safe-mode is safe mode")
+}
+
 func TestParseUnknown(t *testing.T) {
 	testParseErr(t, "unknown word", "x")
 	testParseErr(t, "unknown short", "-x")
@@ -177,6 +192,18 @@ func TestSerialize(t *testing.T) {
 		name: "disable_mem_opt",
 		opts: options{disableMemoryOptimization: true},
 		ss:   []string{"--no-mem-optimization"},
+	}, {
+		name: "set_system_dns",
+		opts: options{setSystemDNS: true},
+		ss:   []string{},
+	}, {
+		name: "no_confinement",
+		opts: options{noConfinement: true},
+		ss:   []string{"--no-confinement"},
+	}, {
+		name: "safe_mode",
+		opts: options{safeMode: true},
+		ss:   []string{},
 	}, {
 		name: "multiple",
 		opts: options{
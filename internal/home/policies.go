@@ -0,0 +1,283 @@
+package home
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/AdGuardHome/internal/schedule"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/stringutil"
+)
+
+// policy is a named set of filtering settings, which can be assigned to the
+// persistent clients either explicitly or by their tags.
+type policy struct {
+	// ivl is the parsed Schedule.  It's nil if the policy is always active.
+	ivl *schedule.Interval
+
+	// Schedule, if not nil, is the time interval during which the policy is
+	// active.  Outside of it, the clients use their own settings.
+	Schedule *schedule.Config `yaml:"schedule" json:"schedule,omitempty"`
+
+	// Name is the unique name of the policy.
+	Name string `yaml:"name" json:"name"`
+
+	// Tags are the tags of the client groups, to which the policy applies,
+	// unless the client has a policy assigned explicitly.
+	Tags []string `yaml:"tags" json:"tags"`
+
+	// BlockedServices are the IDs of the services blocked by the policy.
+	BlockedServices []string `yaml:"blocked_services" json:"blocked_services"`
+
+	// FilterListIDs are the IDs of the blocklists applied by the policy.  If
+	// it's empty, all enabled blocklists are applied.
+	FilterListIDs []int64 `yaml:"filter_list_ids" json:"filter_list_ids"`
+
+	FilteringEnabled    bool `yaml:"filtering_enabled" json:"filtering_enabled"`
+	SafeSearchEnabled   bool `yaml:"safesearch_enabled" json:"safesearch_enabled"`
+	SafeBrowsingEnabled bool `yaml:"safebrowsing_enabled" json:"safebrowsing_enabled"`
+	ParentalEnabled     bool `yaml:"parental_enabled" json:"parental_enabled"`
+}
+
+// isActive returns true if the policy applies at the moment now.
+func (p *policy) isActive(now time.Time) (ok bool) {
+	return p.ivl == nil || p.ivl.Contains(now)
+}
+
+// apply sets the filtering settings of the policy to setts.
+func (p *policy) apply(setts *filtering.Settings) {
+	Context.dnsFilter.ApplyBlockedServices(setts, p.BlockedServices, false)
+
+	setts.FilterListIDs = p.FilterListIDs
+	setts.FilteringEnabled = p.FilteringEnabled
+	setts.SafeSearchEnabled = p.SafeSearchEnabled
+	setts.SafeBrowsingEnabled = p.SafeBrowsingEnabled
+	setts.ParentalEnabled = p.ParentalEnabled
+}
+
+// policiesContainer is the storage of the filtering policies.
+type policiesContainer struct {
+	// clients are the persistent clients, which the policies are assigned
+	// to.  Its lock must only be acquired after lock.
+	clients *clientsContainer
+
+	// lock protects list.
+	lock *sync.RWMutex
+
+	// list maps the names of the policies to them.
+	list map[string]*policy
+}
+
+// newPoliciesContainer returns a new policies container with the policies from
+// the configuration file.  The invalid policies are skipped.
+func newPoliciesContainer(objs []*policy, clients *clientsContainer) (pc *policiesContainer) {
+	pc = &policiesContainer{
+		clients: clients,
+		lock:    &sync.RWMutex{},
+		list:    map[string]*policy{},
+	}
+
+	for _, p := range objs {
+		err := pc.add(p)
+		if err != nil {
+			log.Error("policies: adding policy %q: %s", p.Name, err)
+		}
+	}
+
+	return pc
+}
+
+// check validates p and parses its schedule.
+func (pc *policiesContainer) check(p *policy) (err error) {
+	if p.Name == "" {
+		return errors.Error("invalid name")
+	}
+
+	for _, t := range p.Tags {
+		if !stringutil.InSlice(clientTags, t) {
+			return fmt.Errorf("invalid tag: %q", t)
+		}
+	}
+
+	sort.Strings(p.Tags)
+
+	for _, s := range p.BlockedServices {
+		if !filtering.BlockedSvcKnown(s) {
+			return fmt.Errorf("invalid blocked service: %q", s)
+		}
+	}
+
+	p.ivl = nil
+	if p.Schedule != nil {
+		p.ivl, err = schedule.New(p.Schedule)
+		if err != nil {
+			return fmt.Errorf("invalid schedule: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// add adds a new policy.
+func (pc *policiesContainer) add(p *policy) (err error) {
+	err = pc.check(p)
+	if err != nil {
+		return err
+	}
+
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	if _, ok := pc.list[p.Name]; ok {
+		return errors.Error("policy already exists")
+	}
+
+	pc.list[p.Name] = p
+
+	return nil
+}
+
+// update replaces the policy with name with p.  If p has a different name, the
+// clients, which the policy is assigned to, are updated as well.
+func (pc *policiesContainer) update(name string, p *policy) (err error) {
+	err = pc.check(p)
+	if err != nil {
+		return err
+	}
+
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	if _, ok := pc.list[name]; !ok {
+		return errors.Error("policy not found")
+	}
+
+	if p.Name != name {
+		if _, ok := pc.list[p.Name]; ok {
+			return errors.Error("policy already exists")
+		}
+
+		delete(pc.list, name)
+		pc.clients.renamePolicy(name, p.Name)
+	}
+
+	pc.list[p.Name] = p
+
+	return nil
+}
+
+// del removes the policy with name.  It returns an error if the policy is
+// assigned to a client.
+func (pc *policiesContainer) del(name string) (err error) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	if _, ok := pc.list[name]; !ok {
+		return errors.Error("policy not found")
+	}
+
+	if cliName, ok := pc.clients.policyUser(name); ok {
+		return fmt.Errorf("policy is assigned to client %q", cliName)
+	}
+
+	delete(pc.list, name)
+
+	return nil
+}
+
+// has returns true if the policy with name exists.
+func (pc *policiesContainer) has(name string) (ok bool) {
+	pc.lock.RLock()
+	defer pc.lock.RUnlock()
+
+	_, ok = pc.list[name]
+
+	return ok
+}
+
+// byName returns the policy with name, if it's active at the moment now.
+func (pc *policiesContainer) byName(name string, now time.Time) (p *policy, ok bool) {
+	pc.lock.RLock()
+	defer pc.lock.RUnlock()
+
+	p, ok = pc.list[name]
+
+	return p, ok && p.isActive(now)
+}
+
+// find returns the policy that applies to c at the moment now.  The policy
+// assigned explicitly has priority over the ones assigned to the tags of c.
+// Among the latter, the first active one by name is used.
+func (pc *policiesContainer) find(c *Client, now time.Time) (p *policy, ok bool) {
+	pc.lock.RLock()
+	defer pc.lock.RUnlock()
+
+	if c.Policy != "" {
+		p, ok = pc.list[c.Policy]
+
+		return p, ok && p.isActive(now)
+	}
+
+	if len(c.Tags) == 0 {
+		return nil, false
+	}
+
+	for _, p = range pc.sortedLocked() {
+		if p.isActive(now) && hasCommonTag(p.Tags, c.Tags) {
+			return p, true
+		}
+	}
+
+	return nil, false
+}
+
+// sortedLocked returns the policies sorted by name.  pc.lock must be held.
+func (pc *policiesContainer) sortedLocked() (ps []*policy) {
+	ps = make([]*policy, 0, len(pc.list))
+	for _, p := range pc.list {
+		ps = append(ps, p)
+	}
+
+	sort.Slice(ps, func(i, j int) bool { return ps[i].Name < ps[j].Name })
+
+	return ps
+}
+
+// forConfig returns the copies of all policies sorted by name for the
+// configuration file and the HTTP API.
+func (pc *policiesContainer) forConfig() (objs []*policy) {
+	pc.lock.RLock()
+	defer pc.lock.RUnlock()
+
+	objs = make([]*policy, 0, len(pc.list))
+	for _, p := range pc.sortedLocked() {
+		o := *p
+		o.Tags = stringutil.CloneSlice(p.Tags)
+		o.BlockedServices = stringutil.CloneSlice(p.BlockedServices)
+		o.FilterListIDs = append([]int64(nil), p.FilterListIDs...)
+
+		objs = append(objs, &o)
+	}
+
+	return objs
+}
+
+// hasCommonTag returns true if the sorted slices a and b have a common element.
+func hasCommonTag(a, b []string) (ok bool) {
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] == b[j]:
+			return true
+		case a[i] < b[j]:
+			i++
+		default:
+			j++
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,95 @@
+package home
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/schedule"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPoliciesContainer(t *testing.T) {
+	clients := &clientsContainer{
+		testing: true,
+	}
+	pc := newPoliciesContainer([]*policy{{
+		Name: "kids",
+		Tags: []string{"user_child"},
+		Schedule: &schedule.Config{
+			Start: "20:00",
+			End:   "07:00",
+		},
+		FilteringEnabled: true,
+	}, {
+		Name:             "strict",
+		FilteringEnabled: true,
+		ParentalEnabled:  true,
+	}, {
+		Name: "bad_tag",
+		Tags: []string{"user_unknown"},
+	}}, clients)
+	clients.policies = pc
+	clients.Init(nil, nil, nil)
+
+	require.True(t, pc.has("kids"))
+	require.True(t, pc.has("strict"))
+	require.False(t, pc.has("bad_tag"))
+
+	// 2022-01-17 is a Monday.
+	night := time.Date(2022, 1, 17, 22, 0, 0, 0, time.UTC)
+	noon := time.Date(2022, 1, 17, 12, 0, 0, 0, time.UTC)
+
+	child := &Client{Name: "child", IDs: []string{"1.1.1.1"}, Tags: []string{"user_child"}}
+	assigned := &Client{Name: "assigned", IDs: []string{"2.2.2.2"}, Policy: "strict"}
+	for _, c := range []*Client{child, assigned} {
+		ok, err := clients.Add(c)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+
+	t.Run("find", func(t *testing.T) {
+		p, ok := pc.find(child, night)
+		require.True(t, ok)
+		assert.Equal(t, "kids", p.Name)
+
+		_, ok = pc.find(child, noon)
+		assert.False(t, ok)
+
+		p, ok = pc.find(assigned, noon)
+		require.True(t, ok)
+		assert.Equal(t, "strict", p.Name)
+
+		_, ok = pc.find(&Client{Name: "other"}, night)
+		assert.False(t, ok)
+	})
+
+	t.Run("unknown_policy", func(t *testing.T) {
+		_, err := clients.Add(&Client{Name: "bad", IDs: []string{"3.3.3.3"}, Policy: "none"})
+		assert.Error(t, err)
+	})
+
+	t.Run("del_assigned", func(t *testing.T) {
+		err := pc.del("strict")
+		assert.Error(t, err)
+	})
+
+	t.Run("rename", func(t *testing.T) {
+		err := pc.update("strict", &policy{Name: "stricter", ParentalEnabled: true})
+		require.NoError(t, err)
+
+		c, ok := clients.Find("2.2.2.2")
+		require.True(t, ok)
+		assert.Equal(t, "stricter", c.Policy)
+
+		assert.False(t, pc.has("strict"))
+	})
+
+	t.Run("del", func(t *testing.T) {
+		err := pc.del("kids")
+		require.NoError(t, err)
+
+		_, ok := pc.find(child, night)
+		assert.False(t, ok)
+	})
+}
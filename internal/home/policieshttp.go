@@ -0,0 +1,113 @@
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+)
+
+// policyListJSON is the response of the policies list handler.
+type policyListJSON struct {
+	Policies []*policy `json:"policies"`
+}
+
+// handleGetPolicies is the handler for the GET /control/policies HTTP API.
+func (pc *policiesContainer) handleGetPolicies(w http.ResponseWriter, r *http.Request) {
+	data := policyListJSON{
+		Policies: pc.forConfig(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "encoding response: %s", err)
+	}
+}
+
+// handleAddPolicy is the handler for the POST /control/policies/add HTTP API.
+func (pc *policiesContainer) handleAddPolicy(w http.ResponseWriter, r *http.Request) {
+	p := &policy{}
+	err := json.NewDecoder(r.Body).Decode(p)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return
+	}
+
+	err = pc.add(p)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	onConfigModified()
+}
+
+// policyNameJSON is the request of the policy removal handler.
+type policyNameJSON struct {
+	Name string `json:"name"`
+}
+
+// handleDelPolicy is the handler for the POST /control/policies/delete HTTP
+// API.
+func (pc *policiesContainer) handleDelPolicy(w http.ResponseWriter, r *http.Request) {
+	req := policyNameJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return
+	}
+
+	err = pc.del(req.Name)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	onConfigModified()
+}
+
+// policyUpdateJSON is the request of the policy update handler.
+type policyUpdateJSON struct {
+	Data *policy `json:"data"`
+	Name string  `json:"name"`
+}
+
+// handleUpdatePolicy is the handler for the POST /control/policies/update HTTP
+// API.
+func (pc *policiesContainer) handleUpdatePolicy(w http.ResponseWriter, r *http.Request) {
+	req := policyUpdateJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return
+	}
+
+	if req.Data == nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "no policy data")
+
+		return
+	}
+
+	err = pc.update(req.Name, req.Data)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	onConfigModified()
+}
+
+// registerWebHandlers registers the HTTP handlers for the policies API.
+func (pc *policiesContainer) registerWebHandlers() {
+	httpRegister(http.MethodGet, "/control/policies", pc.handleGetPolicies)
+	httpRegister(http.MethodPost, "/control/policies/add", pc.handleAddPolicy)
+	httpRegister(http.MethodPost, "/control/policies/delete", pc.handleDelPolicy)
+	httpRegister(http.MethodPost, "/control/policies/update", pc.handleUpdatePolicy)
+}
@@ -0,0 +1,434 @@
+package home
+
+import (
+	"encoding/json"
+	"html/template"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// portalConfig is the configuration of the login portal, which lets the people
+// sharing a device choose their filtering policy.
+type portalConfig struct {
+	// Users are the users, who can log in via the portal.
+	Users []*portalUser `yaml:"users"`
+
+	// SessionDuration is the time during which the policy of the logged in
+	// user applies to the device.  If zero, defaultPortalSessionDuration is
+	// used.
+	SessionDuration timeutil.Duration `yaml:"session_duration"`
+
+	// Enabled, if true, enables the login portal.
+	Enabled bool `yaml:"enabled"`
+}
+
+// portalUser is a user of the login portal.
+type portalUser struct {
+	// Name is the unique name of the user.
+	Name string `yaml:"name"`
+
+	// PasswordHash is the bcrypt hash of the password of the user.  If
+	// empty, the user logs in with the name only.
+	PasswordHash string `yaml:"password"`
+
+	// Policy is the name of the filtering policy applied to the devices,
+	// which the user has logged in from.
+	Policy string `yaml:"policy"`
+}
+
+// Login portal parameters.
+const (
+	// defaultPortalSessionDuration is the default duration of a portal
+	// session.
+	defaultPortalSessionDuration = 8 * time.Hour
+
+	// portalPath is the path of the login portal page.
+	portalPath = "/portal"
+
+	// portalMaxAttempts is the number of the failed login attempts, after
+	// which the address is blocked for portalBlockDuration.
+	portalMaxAttempts = 5
+
+	// portalBlockDuration is the duration of blocking an address after too
+	// many failed login attempts.
+	portalBlockDuration = 15 * time.Minute
+)
+
+// portalSession is the login of a user from an IP address.
+type portalSession struct {
+	// expires is the time when the session ends.
+	expires time.Time
+
+	// user is the name of the logged in user.
+	user string
+
+	// policy is the name of the policy of the user.
+	policy string
+}
+
+// loginPortal maps the IP addresses of the devices to the users logged in from
+// them, so that the shared devices get per-person filtering policies.
+type loginPortal struct {
+	// mu protects sessions.
+	mu *sync.Mutex
+
+	// sessions are the active sessions by the IP addresses.
+	sessions map[string]*portalSession
+
+	// users are the portal users by their names.
+	users map[string]*portalUser
+
+	// blocker limits the failed login attempts.
+	blocker *authRateLimiter
+
+	// now returns the current time.  It's time.Now everywhere except the
+	// tests.
+	now func() (t time.Time)
+
+	// conf is the portal configuration.
+	conf *portalConfig
+
+	// duration is the duration of the sessions.
+	duration time.Duration
+}
+
+// newLoginPortal returns a new login portal.  It returns nil if the portal is
+// disabled.  The users with invalid or unknown policies are skipped.
+func newLoginPortal(conf *portalConfig, policies *policiesContainer) (lp *loginPortal) {
+	if !conf.Enabled {
+		return nil
+	}
+
+	lp = &loginPortal{
+		mu:       &sync.Mutex{},
+		sessions: map[string]*portalSession{},
+		users:    map[string]*portalUser{},
+		blocker:  newAuthRateLimiter(portalBlockDuration, portalMaxAttempts),
+		now:      time.Now,
+		conf:     conf,
+		duration: conf.SessionDuration.Duration,
+	}
+
+	if lp.duration <= 0 {
+		lp.duration = defaultPortalSessionDuration
+	}
+
+	for _, u := range conf.Users {
+		switch {
+		case u.Name == "":
+			log.Error("portal: skipping user with empty name")
+		case lp.users[u.Name] != nil:
+			log.Error("portal: skipping duplicate user %q", u.Name)
+		case policies != nil && !policies.has(u.Policy):
+			log.Error("portal: skipping user %q: unknown policy %q", u.Name, u.Policy)
+		default:
+			lp.users[u.Name] = u
+		}
+	}
+
+	return lp
+}
+
+// WriteDiskConfig writes the current configuration into conf.
+func (lp *loginPortal) WriteDiskConfig(conf *portalConfig) {
+	if lp == nil {
+		return
+	}
+
+	*conf = *lp.conf
+}
+
+// login checks the credentials and starts a session of the user with name for
+// ip.  ok is false if the credentials are invalid.
+func (lp *loginPortal) login(ip net.IP, name, password string) (s *portalSession, ok bool) {
+	u, ok := lp.users[name]
+	if !ok {
+		return nil, false
+	}
+
+	if u.PasswordHash != "" &&
+		bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+		return nil, false
+	}
+
+	s = &portalSession{
+		expires: lp.now().Add(lp.duration),
+		user:    u.Name,
+		policy:  u.Policy,
+	}
+
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	lp.sessions[ip.String()] = s
+
+	return s, true
+}
+
+// logout ends the session for ip, if any.
+func (lp *loginPortal) logout(ip net.IP) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	delete(lp.sessions, ip.String())
+}
+
+// find returns the active session for ip.  The expired sessions are removed.
+func (lp *loginPortal) find(ip net.IP) (s *portalSession, ok bool) {
+	if lp == nil {
+		return nil, false
+	}
+
+	key := ip.String()
+
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	s, ok = lp.sessions[key]
+	if !ok {
+		return nil, false
+	}
+
+	if !lp.now().Before(s.expires) {
+		delete(lp.sessions, key)
+
+		return nil, false
+	}
+
+	return s, true
+}
+
+// applyPortalSession applies the policy of the user logged in from ip via the
+// login portal to setts.  ok is false if there is no such session or the policy
+// is not active at the moment.
+func applyPortalSession(ip net.IP, setts *filtering.Settings) (ok bool) {
+	s, ok := Context.portal.find(ip)
+	if !ok {
+		return false
+	}
+
+	p, ok := Context.policies.byName(s.policy, time.Now())
+	if !ok {
+		return false
+	}
+
+	log.Debug("using policy %q of portal user %q for ip %s", p.Name, s.user, ip)
+	p.apply(setts)
+
+	return true
+}
+
+// remoteIP returns the IP address of the peer.  The proxy headers are ignored,
+// since they can be forged by the device itself.
+func remoteIP(r *http.Request) (ip net.IP) {
+	host, err := netutil.SplitHost(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+
+	return net.ParseIP(host)
+}
+
+// portalTmpl is the template of the login portal page.
+var portalTmpl = template.Must(template.New("portal").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>AdGuard Home</title>
+</head>
+<body>
+<h1>Who is using this device?</h1>
+{{- with .Error }}
+<p><strong>{{ . }}</strong></p>
+{{- end }}
+{{- if .User }}
+<p>Logged in as {{ .User }} until {{ .Expires }}.</p>
+<form method="post" action="{{ .Path }}/logout"><button type="submit">Log out</button></form>
+{{- else }}
+<form method="post" action="{{ .Path }}/login">
+<p><select name="name">{{ range .Users }}<option>{{ . }}</option>{{ end }}</select></p>
+<p><input type="password" name="password" placeholder="Password, if any"></p>
+<p><button type="submit">Log in</button></p>
+</form>
+{{- end }}
+</body>
+</html>
+`))
+
+// writePage writes the portal page for ip with the optional error message.
+func (lp *loginPortal) writePage(w http.ResponseWriter, ip net.IP, code int, errMsg string) {
+	data := struct {
+		Path    string
+		User    string
+		Expires string
+		Error   string
+		Users   []string
+	}{
+		Path:  webPath(portalPath),
+		Error: errMsg,
+	}
+
+	if s, ok := lp.find(ip); ok {
+		data.User = s.user
+		data.Expires = s.expires.Format(time.RFC3339)
+	} else {
+		for name := range lp.users {
+			data.Users = append(data.Users, name)
+		}
+
+		sort.Strings(data.Users)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+
+	err := portalTmpl.Execute(w, data)
+	if err != nil {
+		log.Debug("portal: writing page: %s", err)
+	}
+}
+
+// handlePage is the handler for the GET /portal page.
+func (lp *loginPortal) handlePage(w http.ResponseWriter, r *http.Request) {
+	lp.writePage(w, remoteIP(r), http.StatusOK, "")
+}
+
+// handleLogin is the handler for the POST /portal/login form.
+func (lp *loginPortal) handleLogin(w http.ResponseWriter, r *http.Request) {
+	ip := remoteIP(r)
+	if ip == nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "portal: bad remote address %q", r.RemoteAddr)
+
+		return
+	}
+
+	key := ip.String()
+	if left := lp.blocker.check(key); left > 0 {
+		lp.writePage(w, ip, http.StatusTooManyRequests, "Too many attempts, try again later.")
+
+		return
+	}
+
+	name := r.PostFormValue("name")
+	s, ok := lp.login(ip, name, r.PostFormValue("password"))
+	if !ok {
+		log.Info("portal: failed login of user %q from ip %s", name, ip)
+		lp.blocker.inc(key)
+		lp.writePage(w, ip, http.StatusForbidden, "Invalid name or password.")
+
+		return
+	}
+
+	lp.blocker.remove(key)
+	log.Info("portal: user %q logged in from ip %s until %s", s.user, ip, s.expires)
+
+	lp.writePage(w, ip, http.StatusOK, "")
+}
+
+// handleLogout is the handler for the POST /portal/logout form.
+func (lp *loginPortal) handleLogout(w http.ResponseWriter, r *http.Request) {
+	ip := remoteIP(r)
+	if ip == nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "portal: bad remote address %q", r.RemoteAddr)
+
+		return
+	}
+
+	lp.logout(ip)
+	log.Info("portal: logged out ip %s", ip)
+
+	lp.writePage(w, ip, http.StatusOK, "")
+}
+
+// portalSessionJSON is an active portal session.
+type portalSessionJSON struct {
+	IP      string `json:"ip"`
+	User    string `json:"user"`
+	Policy  string `json:"policy"`
+	Expires string `json:"expires"`
+}
+
+// handleSessions is the handler for the GET /control/portal/sessions HTTP API.
+func (lp *loginPortal) handleSessions(w http.ResponseWriter, r *http.Request) {
+	now := lp.now()
+	resp := []*portalSessionJSON{}
+
+	lp.mu.Lock()
+	for ip, s := range lp.sessions {
+		if now.Before(s.expires) {
+			resp = append(resp, &portalSessionJSON{
+				IP:      ip,
+				User:    s.user,
+				Policy:  s.policy,
+				Expires: s.expires.UTC().Format(time.RFC3339),
+			})
+		}
+	}
+	lp.mu.Unlock()
+
+	sort.Slice(resp, func(i, j int) bool { return resp[i].IP < resp[j].IP })
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "encoding response: %s", err)
+	}
+}
+
+// portalLogoutJSON is the request to the POST /control/portal/sessions/delete
+// HTTP API.
+type portalLogoutJSON struct {
+	IP net.IP `json:"ip"`
+}
+
+// handleSessionsDelete is the handler for the POST
+// /control/portal/sessions/delete HTTP API.  It ends the session for the IP
+// address.
+func (lp *loginPortal) handleSessionsDelete(w http.ResponseWriter, r *http.Request) {
+	req := &portalLogoutJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "json decode: %s", err)
+
+		return
+	}
+
+	if req.IP == nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "ip: must be set")
+
+		return
+	}
+
+	lp.logout(req.IP)
+	log.Info("portal: logged out ip %s by admin", req.IP)
+}
+
+// registerPortalHandlers registers the HTTP handlers of the login portal, if
+// it's enabled.
+func registerPortalHandlers() {
+	lp := Context.portal
+	if lp == nil {
+		return
+	}
+
+	httpRegister(http.MethodGet, "/control/portal/sessions", lp.handleSessions)
+	httpRegister(http.MethodPost, "/control/portal/sessions/delete", lp.handleSessionsDelete)
+
+	// No auth is necessary for the portal itself, since it only affects the
+	// device, which the request comes from.
+	Context.mux.HandleFunc(portalPath, postInstall(ensureGET(lp.handlePage)))
+	Context.mux.HandleFunc(portalPath+"/login", postInstall(ensurePOST(lp.handleLogin)))
+	Context.mux.HandleFunc(portalPath+"/logout", postInstall(ensurePOST(lp.handleLogout)))
+}
@@ -0,0 +1,127 @@
+package home
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoginPortal(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	lp := newLoginPortal(&portalConfig{
+		Users: []*portalUser{{
+			Name:   "kid",
+			Policy: "kids",
+		}, {
+			Name:         "parent",
+			PasswordHash: string(hash),
+			Policy:       "adults",
+		}, {
+			Name:   "",
+			Policy: "adults",
+		}},
+		SessionDuration: timeutil.Duration{Duration: time.Hour},
+		Enabled:         true,
+	}, nil)
+	require.NotNil(t, lp)
+	require.Len(t, lp.users, 2)
+
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	lp.now = func() (t time.Time) { return now }
+
+	login := func(t *testing.T, addr, name, password string) (code int) {
+		t.Helper()
+
+		form := url.Values{"name": []string{name}, "password": []string{password}}
+		r := httptest.NewRequest(http.MethodPost, portalPath+"/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		lp.handleLogin(w, r)
+
+		return w.Code
+	}
+
+	ip := net.IP{192, 168, 1, 2}
+
+	t.Run("no_password", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, login(t, "192.168.1.2:12345", "kid", ""))
+
+		s, ok := lp.find(ip)
+		require.True(t, ok)
+
+		assert.Equal(t, "kid", s.user)
+		assert.Equal(t, "kids", s.policy)
+	})
+
+	t.Run("password", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, login(t, "192.168.1.2:12345", "parent", "wrong"))
+
+		s, ok := lp.find(ip)
+		require.True(t, ok)
+		assert.Equal(t, "kid", s.user)
+
+		require.Equal(t, http.StatusOK, login(t, "192.168.1.2:12345", "parent", "secret"))
+
+		s, ok = lp.find(ip)
+		require.True(t, ok)
+		assert.Equal(t, "adults", s.policy)
+	})
+
+	t.Run("blocked", func(t *testing.T) {
+		for i := 0; i < portalMaxAttempts; i++ {
+			assert.Equal(t, http.StatusForbidden, login(t, "192.168.1.3:1", "nobody", ""))
+		}
+
+		assert.Equal(t, http.StatusTooManyRequests, login(t, "192.168.1.3:1", "kid", ""))
+	})
+
+	t.Run("sessions", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		lp.handleSessions(w, httptest.NewRequest(http.MethodGet, "/control/portal/sessions", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp []*portalSessionJSON
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		require.Len(t, resp, 1)
+
+		assert.Equal(t, "192.168.1.2", resp[0].IP)
+		assert.Equal(t, "parent", resp[0].User)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		now = now.Add(time.Hour)
+		t.Cleanup(func() { now = now.Add(-time.Hour) })
+
+		_, ok := lp.find(ip)
+		assert.False(t, ok)
+	})
+
+	t.Run("logout", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, login(t, "192.168.1.2:12345", "kid", ""))
+
+		r := httptest.NewRequest(
+			http.MethodPost,
+			"/control/portal/sessions/delete",
+			strings.NewReader(`{"ip":"192.168.1.2"}`),
+		)
+		w := httptest.NewRecorder()
+		lp.handleSessionsDelete(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		_, ok := lp.find(ip)
+		assert.False(t, ok)
+	})
+}
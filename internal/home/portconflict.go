@@ -0,0 +1,208 @@
+package home
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// portService is a known service, which may hold the DNS port and which
+// AdGuard Home can disable to free it.
+type portService struct {
+	// canDisable returns true if the service can be disabled automatically.
+	canDisable func() (ok bool)
+
+	// disable disables the service, so that it frees the port.
+	disable func() (err error)
+
+	// unit is the name of the systemd unit of the service.
+	unit string
+}
+
+// resolvedUnit is the name of the systemd unit of systemd-resolved.
+const resolvedUnit = "systemd-resolved"
+
+// portServices are the known services by the names of their processes.  Note
+// that the names of the processes are truncated to 15 characters on Linux.
+var portServices = map[string]*portService{
+	"systemd-resolve": {
+		canDisable: checkDNSStubListener,
+		disable:    disableDNSStubListener,
+		unit:       resolvedUnit,
+	},
+	"dnsmasq":    newUnitService("dnsmasq"),
+	"named":      newUnitService("named"),
+	"unbound":    newUnitService("unbound"),
+	"pihole-FTL": newUnitService("pihole-FTL"),
+}
+
+// newUnitService returns a service, which is disabled by stopping and
+// disabling its systemd unit.
+func newUnitService(unit string) (s *portService) {
+	return &portService{
+		canDisable: func() (ok bool) {
+			if runtime.GOOS != "linux" {
+				return false
+			}
+
+			code, _, err := aghos.RunCommand("systemctl", "is-active", "--quiet", unit)
+
+			return err == nil && code == 0
+		},
+		disable: func() (err error) {
+			code, out, err := aghos.RunCommand("systemctl", "disable", "--now", unit)
+			if err != nil {
+				return err
+			} else if code != 0 {
+				return fmt.Errorf("systemctl exited with code %d: %s", code, out)
+			}
+
+			return nil
+		},
+		unit: unit,
+	}
+}
+
+// findPortHolder returns the process holding port of network and the known
+// service it belongs to, if any.  h is nil if the process can't be found.
+func findPortHolder(network string, port int) (h *aghos.PortHolder, svc *portService) {
+	h, err := aghos.FindPortHolder(network, port)
+	if err != nil {
+		log.Debug("port conflict: finding holder of %s port %d: %s", network, port, err)
+
+		return nil, nil
+	}
+
+	return h, portServices[h.Name]
+}
+
+// portHolderJSON is the process holding a port in the install HTTP API.
+type portHolderJSON struct {
+	Name string `json:"name"`
+	PID  int    `json:"pid"`
+}
+
+// portConflictStatus returns the status of the failed check of port of network
+// and fills the holder of ent, if the port is held by another process.  svc
+// is the known service holding the port, if any.
+func portConflictStatus(
+	ent *checkConfigRespEnt,
+	checkErr error,
+	network string,
+	port int,
+) (svc *portService) {
+	ent.Status = checkErr.Error()
+	if !aghnet.IsAddrInUse(checkErr) {
+		return nil
+	}
+
+	var h *aghos.PortHolder
+	h, svc = findPortHolder(network, port)
+	if h == nil {
+		return nil
+	}
+
+	ent.Status = fmt.Sprintf("%s, the port is used by %s", checkErr, h)
+	ent.Holder = &portHolderJSON{
+		Name: h.Name,
+		PID:  h.PID,
+	}
+
+	return svc
+}
+
+// portCheck is a port AdGuard Home listens on.
+type portCheck struct {
+	ip      net.IP
+	network string
+	port    int
+}
+
+// dnsPortChecks returns the ports of the DNS server and of the encrypted DNS
+// listeners.
+func dnsPortChecks() (checks []portCheck) {
+	config.RLock()
+	defer config.RUnlock()
+
+	add := func(network string, ips []net.IP, port int) {
+		if port == 0 {
+			return
+		}
+
+		for _, ip := range ips {
+			checks = append(checks, portCheck{ip: ip, network: network, port: port})
+		}
+	}
+
+	add("udp", config.DNS.BindHosts, config.DNS.Port)
+	add("tcp", config.DNS.BindHosts, config.DNS.Port)
+
+	if tlsConf := config.TLS; tlsConf.Enabled {
+		add("tcp", []net.IP{config.BindHost}, tlsConf.PortHTTPS)
+
+		dotHosts := config.DNS.BindHosts
+		if len(tlsConf.DoTBindHosts) > 0 {
+			dotHosts = tlsConf.DoTBindHosts
+		}
+
+		add("tcp", dotHosts, tlsConf.PortDNSOverTLS)
+
+		doqHosts := config.DNS.BindHosts
+		if len(tlsConf.DoQBindHosts) > 0 {
+			doqHosts = tlsConf.DoQBindHosts
+		}
+
+		add("udp", doqHosts, tlsConf.PortDNSOverQUIC)
+	}
+
+	return checks
+}
+
+// logPortConflicts logs the processes holding the ports of the DNS server
+// along with the hints on freeing them.  It's intended to be called after the
+// DNS server has failed to start and has been closed.
+func logPortConflicts() {
+	for _, c := range dnsPortChecks() {
+		err := aghnet.CheckPort(c.network, c.ip, c.port)
+		if !aghnet.IsAddrInUse(err) {
+			continue
+		}
+
+		h, svc := findPortHolder(c.network, c.port)
+		switch {
+		case h == nil:
+			log.Error(
+				"port conflict: %s port %d on %s is used by another process, "+
+					"run AdGuard Home as root to find out which",
+				c.network,
+				c.port,
+				c.ip,
+			)
+		case svc == nil:
+			log.Error("port conflict: %s port %d on %s is used by %s", c.network, c.port, c.ip, h)
+		case svc.unit == resolvedUnit:
+			log.Error(
+				"port conflict: %s port %d on %s is used by %s, "+
+					"disable its DNSStubListener in /etc/systemd/resolved.conf",
+				c.network,
+				c.port,
+				c.ip,
+				h,
+			)
+		default:
+			log.Error(
+				"port conflict: %s port %d on %s is used by %s, "+
+					"disable it with \"systemctl disable --now %s\"",
+				c.network,
+				c.port,
+				c.ip,
+				h,
+				svc.unit,
+			)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package home
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortConflictStatus(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("only /proc is used in the test")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	ip := net.IP{127, 0, 0, 1}
+	port := l.Addr().(*net.TCPAddr).Port
+
+	err = aghnet.CheckPort("tcp", ip, port)
+	require.True(t, aghnet.IsAddrInUse(err))
+
+	ent := &checkConfigRespEnt{}
+	svc := portConflictStatus(ent, err, "tcp", port)
+	assert.Nil(t, svc)
+
+	require.NotNil(t, ent.Holder)
+
+	assert.Equal(t, os.Getpid(), ent.Holder.PID)
+	assert.Contains(t, ent.Status, "the port is used by")
+}
@@ -0,0 +1,166 @@
+package home
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// quarantineConfig is the configuration of the notifications about the blocked
+// requests of the quarantined clients.
+type quarantineConfig struct {
+	// WebhookURL, if not empty, is the URL to which each blocked request of
+	// a quarantined client is sent as a JSON object using a POST request.
+	WebhookURL string `yaml:"webhook_url"`
+}
+
+// maxQuarantineNotifications is the maximum number of the webhook
+// notifications being sent at the same time.  The newer ones are dropped.
+const maxQuarantineNotifications = 16
+
+// quarantineNotifier notifies about the blocked requests of the quarantined
+// clients.
+type quarantineNotifier struct {
+	// cli is the client used to send the webhook notifications.
+	cli *http.Client
+
+	// sem limits the number of the notifications being sent.
+	sem chan struct{}
+
+	// url is the URL of the webhook.  If it's empty, the notifications are
+	// only written to the log.
+	url string
+}
+
+// newQuarantineNotifier returns a new properly initialized quarantine
+// notifier.  cli may be nil.
+func newQuarantineNotifier(conf *quarantineConfig, cli *http.Client) (n *quarantineNotifier) {
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+
+	return &quarantineNotifier{
+		cli: cli,
+		sem: make(chan struct{}, maxQuarantineNotifications),
+		url: conf.WebhookURL,
+	}
+}
+
+// quarantineEventJSON is the notification about a blocked request of a
+// quarantined client.
+type quarantineEventJSON struct {
+	Time   string `json:"time"`
+	Client string `json:"client"`
+	IP     net.IP `json:"ip"`
+	Host   string `json:"host"`
+	QType  string `json:"qtype"`
+}
+
+// notify is the filtering.Config.QuarantineBlocked callback.
+func (n *quarantineNotifier) notify(setts *filtering.Settings, host string, qtype uint16) {
+	qt := dns.TypeToString[qtype]
+	log.Info(
+		"quarantine: blocked %s request for %q from client %q (%s)",
+		qt,
+		host,
+		setts.ClientName,
+		setts.ClientIP,
+	)
+
+	if n.url == "" {
+		return
+	}
+
+	select {
+	case n.sem <- struct{}{}:
+		// Go on.
+	default:
+		log.Debug("quarantine: too many pending notifications, dropping")
+
+		return
+	}
+
+	e := &quarantineEventJSON{
+		Time:   time.Now().UTC().Format(time.RFC3339),
+		Client: setts.ClientName,
+		IP:     setts.ClientIP,
+		Host:   host,
+		QType:  qt,
+	}
+
+	go func() {
+		defer log.OnPanic("quarantine")
+		defer func() { <-n.sem }()
+
+		err := n.send(e)
+		if err != nil {
+			log.Error("quarantine: sending notification: %s", err)
+		}
+	}()
+}
+
+// send posts e to the webhook.
+func (n *quarantineNotifier) send(e *quarantineEventJSON) (err error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("encoding: %w", err)
+	}
+
+	resp, err := n.cli.Post(n.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	// Drain the body to reuse the connection.
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// quarantineJSON is the request to quarantine a persistent client or to
+// release it from the quarantine.
+type quarantineJSON struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+// handleQuarantine is the handler for the POST /control/clients/quarantine
+// HTTP API.
+func (clients *clientsContainer) handleQuarantine(w http.ResponseWriter, r *http.Request) {
+	qj := quarantineJSON{}
+	err := json.NewDecoder(r.Body).Decode(&qj)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return
+	}
+
+	if !clients.setQuarantined(qj.Name, qj.Enabled) {
+		aghhttp.Error(r, w, http.StatusBadRequest, "Client not found")
+
+		return
+	}
+
+	if qj.Enabled {
+		log.Info("quarantine: client %q is quarantined", qj.Name)
+	} else {
+		log.Info("quarantine: client %q is released", qj.Name)
+	}
+
+	onConfigModified()
+}
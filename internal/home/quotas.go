@@ -0,0 +1,185 @@
+package home
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/timeutil"
+)
+
+// quotasConfig is the configuration of the quotas enforced in the HTTP API,
+// for example when AdGuard Home is provided as a service to the groups of
+// friends or family.  The zero values mean no limit.
+type quotasConfig struct {
+	// Tenants are the quotas of the particular tenants.  The limits of a
+	// tenant only lower the global ones for the requests of its user.
+	Tenants []*tenantQuota `yaml:"tenants"`
+
+	// MaxQueryLogInterval is the maximum query log rotation interval, which
+	// can be set in the API.  Since the rotated file is kept, the actual
+	// retention is up to twice as long.
+	MaxQueryLogInterval timeutil.Duration `yaml:"max_querylog_interval"`
+
+	// MaxClients is the maximum number of the persistent clients.
+	MaxClients int `yaml:"max_clients"`
+
+	// MaxCustomRules is the maximum number of the custom filtering rules,
+	// not counting the comments and the empty lines.
+	MaxCustomRules int `yaml:"max_custom_rules"`
+}
+
+// tenantQuota is the quota of a single tenant.
+type tenantQuota struct {
+	// Name is the name of the user of the web interface, who is the tenant.
+	// It's set as the owner of the persistent clients the user adds, and the
+	// user can only change the clients it owns.
+	Name string `yaml:"name"`
+
+	// MaxQueryLogInterval is the maximum query log rotation interval, which
+	// the tenant can set.
+	MaxQueryLogInterval timeutil.Duration `yaml:"max_querylog_interval"`
+
+	// MaxClients is the maximum number of the persistent clients of the
+	// tenant.
+	MaxClients int `yaml:"max_clients"`
+
+	// MaxCustomRules is the maximum number of the custom filtering rules,
+	// which the tenant can set.
+	MaxCustomRules int `yaml:"max_custom_rules"`
+}
+
+// errQuotaExceeded is returned when a change would exceed a quota.
+const errQuotaExceeded errors.Error = "quota exceeded"
+
+// tenant returns the quota of the tenant with name or nil if there is none.
+func (q *quotasConfig) tenant(name string) (t *tenantQuota) {
+	if name == "" {
+		return nil
+	}
+
+	for _, t = range q.Tenants {
+		if t.Name == name {
+			return t
+		}
+	}
+
+	return nil
+}
+
+// tenantOf returns the quota of the tenant, who has made the request r, or nil
+// if the user isn't a tenant.  q may be nil.
+func (q *quotasConfig) tenantOf(r *http.Request) (t *tenantQuota) {
+	if q == nil || len(q.Tenants) == 0 || Context.auth == nil {
+		return nil
+	}
+
+	return q.tenant(Context.auth.getCurrentUser(r).Name)
+}
+
+// maxQueryLogInterval returns the maximum query log rotation interval, which
+// can be set in the request r.  Zero means no limit.
+func (q *quotasConfig) maxQueryLogInterval(r *http.Request) (ivl time.Duration) {
+	ivl = q.MaxQueryLogInterval.Duration
+	t := q.tenantOf(r)
+	if t == nil {
+		return ivl
+	}
+
+	tenantIvl := t.MaxQueryLogInterval.Duration
+	if ivl <= 0 || (tenantIvl > 0 && tenantIvl < ivl) {
+		return tenantIvl
+	}
+
+	return ivl
+}
+
+// checkCustomRules returns an error if the number of the custom filtering
+// rules in lines exceeds the quota.  t is the quota of the tenant setting the
+// rules, if any.
+func (q *quotasConfig) checkCustomRules(lines []string, t *tenantQuota) (err error) {
+	maxRules := q.MaxCustomRules
+	if t != nil && t.MaxCustomRules > 0 && (maxRules <= 0 || t.MaxCustomRules < maxRules) {
+		maxRules = t.MaxCustomRules
+	}
+
+	if maxRules <= 0 {
+		return nil
+	}
+
+	n := 0
+	for _, l := range lines {
+		l = strings.TrimSpace(l)
+		if l != "" && l[0] != '!' && l[0] != '#' {
+			n++
+		}
+	}
+
+	if n > maxRules {
+		return fmt.Errorf("%w: %d custom rules, at most %d allowed", errQuotaExceeded, n, maxRules)
+	}
+
+	return nil
+}
+
+// checkQuotasLocked returns an error if adding c or, if prev isn't nil,
+// replacing prev with it exceeds the quotas.  clients.lock is expected to be
+// locked.
+func (clients *clientsContainer) checkQuotasLocked(c, prev *Client) (err error) {
+	q := clients.quotas
+	if q == nil {
+		return nil
+	}
+
+	if prev == nil && q.MaxClients > 0 && len(clients.list) >= q.MaxClients {
+		return fmt.Errorf("%w: at most %d persistent clients allowed", errQuotaExceeded, q.MaxClients)
+	}
+
+	if prev != nil && prev.Owner == c.Owner {
+		return nil
+	}
+
+	t := q.tenant(c.Owner)
+	if t == nil || t.MaxClients <= 0 {
+		return nil
+	}
+
+	n := 0
+	for _, cli := range clients.list {
+		if cli.Owner == c.Owner {
+			n++
+		}
+	}
+
+	if n >= t.MaxClients {
+		return fmt.Errorf(
+			"%w: at most %d persistent clients allowed for %q",
+			errQuotaExceeded,
+			t.MaxClients,
+			c.Owner,
+		)
+	}
+
+	return nil
+}
+
+// checkOwnerLocked returns an error if the tenant t can't change the client
+// with name.  clients.lock is expected to be locked.
+func (clients *clientsContainer) checkOwnerLocked(name string, t *tenantQuota) (err error) {
+	c, ok := clients.list[name]
+	if ok && c.Owner != t.Name {
+		return fmt.Errorf("client %q isn't owned by %q", name, t.Name)
+	}
+
+	return nil
+}
+
+// checkOwner is like checkOwnerLocked but locks clients.lock.
+func (clients *clientsContainer) checkOwner(name string, t *tenantQuota) (err error) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	return clients.checkOwnerLocked(name, t)
+}
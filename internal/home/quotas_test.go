@@ -0,0 +1,133 @@
+package home
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotasConfig_checkCustomRules(t *testing.T) {
+	q := &quotasConfig{}
+	rules := []string{"! comment", "||example.org^", "", "# comment", "@@||example.com^"}
+	assert.NoError(t, q.checkCustomRules(rules, nil))
+
+	tenant := &tenantQuota{Name: "smith", MaxCustomRules: 1}
+	err := q.checkCustomRules(rules, tenant)
+	assert.ErrorIs(t, err, errQuotaExceeded)
+
+	q.MaxCustomRules = 2
+	assert.NoError(t, q.checkCustomRules(rules, nil))
+
+	err = q.checkCustomRules(rules, tenant)
+	assert.ErrorIs(t, err, errQuotaExceeded)
+
+	rules = append(rules, "||example.net^")
+	err = q.checkCustomRules(rules, nil)
+	assert.ErrorIs(t, err, errQuotaExceeded)
+}
+
+func TestQuotasConfig_maxQueryLogInterval(t *testing.T) {
+	a := InitAuth(filepath.Join(t.TempDir(), "sessions.db"), []User{{
+		Name: "admin",
+	}, {
+		Name: "smith",
+	}}, 60, nil)
+	require.NotNil(t, a)
+	t.Cleanup(a.Close)
+
+	prevAuth := Context.auth
+	Context.auth = a
+	t.Cleanup(func() { Context.auth = prevAuth })
+
+	expire := uint32(time.Now().UTC().Unix() + 60)
+	newReq := func(name string) (r *http.Request) {
+		sess := []byte(name)
+		a.addSession(sess, &session{userName: name, expire: expire})
+
+		r = httptest.NewRequest(http.MethodPut, "/control/querylog/config/update", nil)
+		r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: hex.EncodeToString(sess)})
+
+		return r
+	}
+
+	q := &quotasConfig{
+		Tenants: []*tenantQuota{{
+			Name:                "smith",
+			MaxQueryLogInterval: timeutil.Duration{Duration: timeutil.Day},
+		}},
+		MaxQueryLogInterval: timeutil.Duration{Duration: 7 * timeutil.Day},
+	}
+
+	assert.Equal(t, 7*timeutil.Day, q.maxQueryLogInterval(newReq("admin")))
+	assert.Equal(t, timeutil.Day, q.maxQueryLogInterval(newReq("smith")))
+
+	q.MaxQueryLogInterval = timeutil.Duration{}
+	assert.Equal(t, timeutil.Day, q.maxQueryLogInterval(newReq("smith")))
+	assert.Zero(t, q.maxQueryLogInterval(newReq("admin")))
+}
+
+func TestClients_quotas(t *testing.T) {
+	clients := clientsContainer{}
+	clients.testing = true
+
+	clients.Init(nil, nil, nil)
+	clients.quotas = &quotasConfig{
+		Tenants: []*tenantQuota{{
+			Name:       "smith",
+			MaxClients: 1,
+		}},
+		MaxClients: 3,
+	}
+
+	ok, err := clients.Add(&Client{Name: "phone", IDs: []string{"1.1.1.1"}, Owner: "smith"})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	_, err = clients.Add(&Client{Name: "laptop", IDs: []string{"1.1.1.2"}, Owner: "smith"})
+	assert.ErrorIs(t, err, errQuotaExceeded)
+
+	ok, err = clients.Add(&Client{Name: "laptop", IDs: []string{"1.1.1.2"}, Owner: "jones"})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	err = clients.Update("laptop", &Client{Name: "laptop", IDs: []string{"1.1.1.2"}, Owner: "smith"})
+	assert.ErrorIs(t, err, errQuotaExceeded)
+
+	err = clients.Update("phone", &Client{Name: "phone", IDs: []string{"1.1.1.3"}, Owner: "smith"})
+	require.NoError(t, err)
+
+	ok, err = clients.Add(&Client{Name: "tv", IDs: []string{"1.1.1.4"}})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	_, err = clients.Add(&Client{Name: "tablet", IDs: []string{"1.1.1.5"}})
+	assert.ErrorIs(t, err, errQuotaExceeded)
+}
+
+func TestClients_checkOwner(t *testing.T) {
+	clients := clientsContainer{}
+	clients.testing = true
+
+	clients.Init(nil, nil, nil)
+
+	ok, err := clients.Add(&Client{Name: "phone", IDs: []string{"1.1.1.1"}, Owner: "smith"})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = clients.Add(&Client{Name: "tv", IDs: []string{"1.1.1.2"}})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	tenant := &tenantQuota{Name: "smith"}
+	assert.NoError(t, clients.checkOwner("phone", tenant))
+	assert.NoError(t, clients.checkOwner("unknown", tenant))
+	assert.Error(t, clients.checkOwner("tv", tenant))
+}
@@ -0,0 +1,270 @@
+package home
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// radiusConfig is the configuration of the RADIUS accounting listener.
+type radiusConfig struct {
+	// ListenAddr is the UDP address to listen for the accounting requests
+	// on.  If it's empty, the listener is disabled.
+	ListenAddr string `yaml:"listen_addr"`
+
+	// Secret is the shared secret used to authenticate the accounting
+	// requests.  It must not be empty when ListenAddr is set.
+	Secret string `yaml:"secret"`
+}
+
+// RADIUS packet codes.
+//
+// See RFC 2866, section 4.
+const (
+	radiusCodeAcctRequest  byte = 4
+	radiusCodeAcctResponse byte = 5
+)
+
+// RADIUS attribute types.
+//
+// See RFC 2865, section 5, RFC 2866, section 5, and RFC 6911, section 3.1.
+const (
+	radiusAttrUserName          byte = 1
+	radiusAttrFramedIPAddress   byte = 8
+	radiusAttrAcctStatusType    byte = 40
+	radiusAttrFramedIPv6Address byte = 168
+)
+
+// radiusAcctStatus is the value of the Acct-Status-Type RADIUS attribute.
+type radiusAcctStatus uint32
+
+// Acct-Status-Type values.
+//
+// See RFC 2866, section 5.1.
+const (
+	radiusAcctStart   radiusAcctStatus = 1
+	radiusAcctStop    radiusAcctStatus = 2
+	radiusAcctInterim radiusAcctStatus = 3
+	radiusAcctOn      radiusAcctStatus = 7
+	radiusAcctOff     radiusAcctStatus = 8
+)
+
+const (
+	// radiusHdrLen is the length of the RADIUS packet header: code,
+	// identifier, length, and authenticator.
+	radiusHdrLen = 20
+
+	// radiusMaxLen is the maximum length of a RADIUS packet.
+	radiusMaxLen = 4096
+)
+
+// radiusAcctReq is the parsed accounting request.
+type radiusAcctReq struct {
+	userName string
+	ip       net.IP
+	status   radiusAcctStatus
+}
+
+// radiusAcct is the RADIUS accounting listener that feeds the username-to-IP
+// mappings into the clients container.
+type radiusAcct struct {
+	clients *clientsContainer
+	conn    net.PacketConn
+	secret  []byte
+}
+
+// newRADIUSAcct creates a new RADIUS accounting listener.  conf must not be
+// nil.  The listener isn't started.
+func newRADIUSAcct(conf *radiusConfig, clients *clientsContainer) (r *radiusAcct, err error) {
+	if conf.Secret == "" {
+		return nil, errors.Error("radius: empty secret")
+	}
+
+	conn, err := net.ListenPacket("udp", conf.ListenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("radius: listening: %w", err)
+	}
+
+	return &radiusAcct{
+		clients: clients,
+		conn:    conn,
+		secret:  []byte(conf.Secret),
+	}, nil
+}
+
+// Start starts handling the accounting requests in a separate goroutine.
+func (r *radiusAcct) Start() {
+	log.Info("radius: listening on %s", r.conn.LocalAddr())
+
+	go r.serve()
+}
+
+// Close stops the listener.
+func (r *radiusAcct) Close() (err error) {
+	return r.conn.Close()
+}
+
+// serve reads the accounting requests from the connection until it's closed.
+func (r *radiusAcct) serve() {
+	defer onPanicReport("radius")
+
+	buf := make([]byte, radiusMaxLen)
+	for {
+		n, addr, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			log.Debug("radius: reading: %s", err)
+
+			continue
+		}
+
+		resp, err := r.handle(buf[:n])
+		if err != nil {
+			log.Debug("radius: handling request from %s: %s", addr, err)
+
+			continue
+		}
+
+		_, err = r.conn.WriteTo(resp, addr)
+		if err != nil {
+			log.Debug("radius: writing response to %s: %s", addr, err)
+		}
+	}
+}
+
+// handle validates and applies the accounting request contained in pkt and
+// returns the response packet.
+func (r *radiusAcct) handle(pkt []byte) (resp []byte, err error) {
+	req, err := r.parse(pkt)
+	if err != nil {
+		return nil, err
+	}
+
+	r.apply(req)
+
+	return r.response(pkt), nil
+}
+
+// parse validates the packet's authenticator and parses the accounting
+// request.
+func (r *radiusAcct) parse(pkt []byte) (req *radiusAcctReq, err error) {
+	if len(pkt) < radiusHdrLen {
+		return nil, fmt.Errorf("packet too short: %d bytes", len(pkt))
+	}
+
+	if pkt[0] != radiusCodeAcctRequest {
+		return nil, fmt.Errorf("unexpected code %d", pkt[0])
+	}
+
+	l := int(binary.BigEndian.Uint16(pkt[2:4]))
+	if l < radiusHdrLen || l > len(pkt) {
+		return nil, fmt.Errorf("bad length %d", l)
+	}
+
+	// Octets after the length field are treated as padding.  Compare the
+	// authenticators in constant time to not leak the expected one.
+	pkt = pkt[:l]
+	if !hmac.Equal(r.reqAuthenticator(pkt), pkt[4:radiusHdrLen]) {
+		return nil, errors.Error("bad authenticator")
+	}
+
+	req = &radiusAcctReq{}
+	for attrs := pkt[radiusHdrLen:]; len(attrs) > 0; {
+		if len(attrs) < 2 || attrs[1] < 2 || int(attrs[1]) > len(attrs) {
+			return nil, errors.Error("malformed attribute")
+		}
+
+		typ, val := attrs[0], attrs[2:attrs[1]]
+		attrs = attrs[attrs[1]:]
+
+		switch typ {
+		case radiusAttrUserName:
+			req.userName = strings.TrimSpace(string(val))
+		case radiusAttrFramedIPAddress:
+			if len(val) == net.IPv4len {
+				req.ip = net.IP(val).To16()
+			}
+		case radiusAttrFramedIPv6Address:
+			if len(val) == net.IPv6len && req.ip == nil {
+				req.ip = slices.Clone(val)
+			}
+		case radiusAttrAcctStatusType:
+			if len(val) == 4 {
+				req.status = radiusAcctStatus(binary.BigEndian.Uint32(val))
+			}
+		default:
+			// Go on.
+		}
+	}
+
+	if req.status == 0 {
+		return nil, errors.Error("no acct-status-type")
+	}
+
+	return req, nil
+}
+
+// reqAuthenticator computes the expected Request Authenticator of pkt.
+//
+// See RFC 2866, section 3.
+func (r *radiusAcct) reqAuthenticator(pkt []byte) (auth []byte) {
+	h := md5.New()
+	_, _ = h.Write(pkt[:4])
+	_, _ = h.Write(make([]byte, md5.Size))
+	_, _ = h.Write(pkt[radiusHdrLen:])
+	_, _ = h.Write(r.secret)
+
+	return h.Sum(nil)
+}
+
+// response builds the Accounting-Response packet for the request pkt.
+func (r *radiusAcct) response(pkt []byte) (resp []byte) {
+	resp = make([]byte, radiusHdrLen)
+	resp[0] = radiusCodeAcctResponse
+	resp[1] = pkt[1]
+	binary.BigEndian.PutUint16(resp[2:4], radiusHdrLen)
+
+	h := md5.New()
+	_, _ = h.Write(resp[:4])
+	_, _ = h.Write(pkt[4:radiusHdrLen])
+	_, _ = h.Write(r.secret)
+	copy(resp[4:], h.Sum(nil))
+
+	return resp
+}
+
+// apply updates the clients container in accordance with req.
+func (r *radiusAcct) apply(req *radiusAcctReq) {
+	switch req.status {
+	case radiusAcctStart, radiusAcctInterim:
+		if req.ip == nil || req.userName == "" {
+			log.Debug("radius: no address or username in accounting request")
+
+			return
+		}
+
+		_, _ = r.clients.AddHost(req.ip, req.userName, ClientSourceRADIUS)
+	case radiusAcctStop:
+		if req.ip != nil {
+			r.clients.rmHost(req.ip, ClientSourceRADIUS)
+		}
+	case radiusAcctOn, radiusAcctOff:
+		// The NAS has restarted, so all the sessions are gone.
+		r.clients.lock.Lock()
+		defer r.clients.lock.Unlock()
+
+		r.clients.rmHostsBySrc(ClientSourceRADIUS)
+	default:
+		log.Debug("radius: unsupported acct-status-type %d", req.status)
+	}
+}
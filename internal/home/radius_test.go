@@ -0,0 +1,120 @@
+package home
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRADIUSPacket returns a valid Accounting-Request packet with the
+// provided attributes signed with secret.
+func newTestRADIUSPacket(secret string, attrs ...[]byte) (pkt []byte) {
+	pkt = make([]byte, radiusHdrLen)
+	pkt[0] = radiusCodeAcctRequest
+	pkt[1] = 42
+	for _, a := range attrs {
+		pkt = append(pkt, a...)
+	}
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+
+	h := md5.New()
+	_, _ = h.Write(pkt[:4])
+	_, _ = h.Write(make([]byte, md5.Size))
+	_, _ = h.Write(pkt[radiusHdrLen:])
+	_, _ = h.Write([]byte(secret))
+	copy(pkt[4:radiusHdrLen], h.Sum(nil))
+
+	return pkt
+}
+
+// newTestRADIUSAttr returns a RADIUS attribute with typ and val.
+func newTestRADIUSAttr(typ byte, val []byte) (attr []byte) {
+	return append([]byte{typ, byte(len(val) + 2)}, val...)
+}
+
+func TestRADIUSAcct_handle(t *testing.T) {
+	const secret = "secret"
+
+	clients := &clientsContainer{testing: true}
+	clients.Init(nil, nil, nil)
+
+	r := &radiusAcct{
+		clients: clients,
+		secret:  []byte(secret),
+	}
+
+	ip := net.IP{192, 168, 0, 10}
+	statusAttr := func(st radiusAcctStatus) (attr []byte) {
+		val := make([]byte, 4)
+		binary.BigEndian.PutUint32(val, uint32(st))
+
+		return newTestRADIUSAttr(radiusAttrAcctStatusType, val)
+	}
+	userAttr := newTestRADIUSAttr(radiusAttrUserName, []byte("alice"))
+	ipAttr := newTestRADIUSAttr(radiusAttrFramedIPAddress, ip)
+
+	t.Run("start", func(t *testing.T) {
+		pkt := newTestRADIUSPacket(secret, statusAttr(radiusAcctStart), userAttr, ipAttr)
+		resp, err := r.handle(pkt)
+		require.NoError(t, err)
+		require.Len(t, resp, radiusHdrLen)
+
+		assert.Equal(t, radiusCodeAcctResponse, resp[0])
+		assert.Equal(t, pkt[1], resp[1])
+
+		rc, ok := clients.FindRuntimeClient(ip)
+		require.True(t, ok)
+
+		assert.Equal(t, "alice", rc.Host)
+		assert.Equal(t, ClientSourceRADIUS, rc.Source)
+	})
+
+	t.Run("overrides_dhcp", func(t *testing.T) {
+		otherIP := net.IP{192, 168, 0, 11}
+		ok, err := clients.AddHost(otherIP, "phone", ClientSourceDHCP)
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		pkt := newTestRADIUSPacket(
+			secret,
+			statusAttr(radiusAcctInterim),
+			newTestRADIUSAttr(radiusAttrUserName, []byte("bob")),
+			newTestRADIUSAttr(radiusAttrFramedIPAddress, otherIP),
+		)
+		_, err = r.handle(pkt)
+		require.NoError(t, err)
+
+		rc, ok := clients.FindRuntimeClient(otherIP)
+		require.True(t, ok)
+
+		assert.Equal(t, "bob", rc.Host)
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		pkt := newTestRADIUSPacket(secret, statusAttr(radiusAcctStop), userAttr, ipAttr)
+		_, err := r.handle(pkt)
+		require.NoError(t, err)
+
+		_, ok := clients.FindRuntimeClient(ip)
+		assert.False(t, ok)
+	})
+
+	t.Run("bad_secret", func(t *testing.T) {
+		pkt := newTestRADIUSPacket("wrong", statusAttr(radiusAcctStart), userAttr, ipAttr)
+		_, err := r.handle(pkt)
+		assert.Error(t, err)
+
+		_, ok := clients.FindRuntimeClient(ip)
+		assert.False(t, ok)
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		pkt := newTestRADIUSPacket(secret, []byte{radiusAttrUserName, 1})
+		_, err := r.handle(pkt)
+		assert.Error(t, err)
+	})
+}
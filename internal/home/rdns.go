@@ -117,7 +117,7 @@ func (r *RDNS) Begin(ip net.IP) {
 // workerLoop handles incoming IP addresses from ipChan and adds it into
 // clients.
 func (r *RDNS) workerLoop() {
-	defer log.OnPanic("rdns")
+	defer onPanicReport("rdns")
 
 	for ip := range r.ipCh {
 		host, err := r.exchanger.Exchange(ip)
@@ -0,0 +1,59 @@
+package home
+
+import (
+	"reflect"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/stringutil"
+)
+
+// safeModeFilteringConfig returns the configuration of the DNS server used in
+// the safe mode, in which only the plain forwarding to the upstreams works and
+// the filtering as well as the other custom settings are disabled, so that the
+// users locked out by a broken configuration could fix it in the web UI.  The
+// invalid upstreams are replaced with the default ones.
+func safeModeFilteringConfig(conf *dnsforward.FilteringConfig) (c dnsforward.FilteringConfig) {
+	c = dnsforward.FilteringConfig{
+		UpstreamDNS:         stringutil.CloneSlice(conf.UpstreamDNS),
+		UpstreamDNSFileName: conf.UpstreamDNSFileName,
+		BootstrapDNS:        stringutil.CloneSlice(conf.BootstrapDNS),
+		AllServers:          conf.AllServers,
+		CacheSize:           conf.CacheSize,
+	}
+
+	if c.UpstreamDNSFileName != "" {
+		// The upstreams from the file can't be validated here, so use the
+		// default ones instead.
+		log.Info("safe mode: not using upstreams from %s", c.UpstreamDNSFileName)
+
+		c.UpstreamDNSFileName = ""
+		c.UpstreamDNS = nil
+	} else if err := dnsforward.ValidateUpstreams(c.UpstreamDNS); err != nil {
+		log.Info("safe mode: using default upstreams: %s", err)
+
+		c.UpstreamDNS = nil
+	}
+
+	return c
+}
+
+// mergeSafeModeEdits sets the fields of dst to the ones of cur, which differ
+// from the ones of the safe mode configuration base.  That is, it only keeps
+// the changes made by the user while running in the safe mode.
+func mergeSafeModeEdits(dst, base, cur *dnsforward.FilteringConfig) {
+	dstVal := reflect.ValueOf(dst).Elem()
+	baseVal := reflect.ValueOf(base).Elem()
+	curVal := reflect.ValueOf(cur).Elem()
+	for i := 0; i < curVal.NumField(); i++ {
+		f := curVal.Field(i)
+		if f.Kind() == reflect.Func {
+			// The handlers aren't a part of the configuration file.
+			continue
+		}
+
+		if !reflect.DeepEqual(f.Interface(), baseVal.Field(i).Interface()) {
+			dstVal.Field(i).Set(f)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package home
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSafeModeFilteringConfig(t *testing.T) {
+	conf := &dnsforward.FilteringConfig{
+		ProtectionEnabled: true,
+		BlockingMode:      dnsforward.BlockingModeNXDOMAIN,
+		UpstreamDNS:       []string{"1.1.1.1", "[/local/]192.168.1.1"},
+		BootstrapDNS:      []string{"9.9.9.9"},
+		BlockedHosts:      []string{"version.bind"},
+		CacheSize:         1024,
+	}
+
+	c := safeModeFilteringConfig(conf)
+	assert.False(t, c.ProtectionEnabled)
+	assert.Empty(t, c.BlockingMode)
+	assert.Empty(t, c.BlockedHosts)
+	assert.Equal(t, conf.UpstreamDNS, c.UpstreamDNS)
+	assert.Equal(t, conf.BootstrapDNS, c.BootstrapDNS)
+	assert.Equal(t, conf.CacheSize, c.CacheSize)
+
+	conf.UpstreamDNS = []string{"bad://upstream"}
+	c = safeModeFilteringConfig(conf)
+	assert.Empty(t, c.UpstreamDNS)
+
+	conf.UpstreamDNS = []string{"1.1.1.1"}
+	conf.UpstreamDNSFileName = "upstreams.txt"
+	c = safeModeFilteringConfig(conf)
+	assert.Empty(t, c.UpstreamDNS)
+	assert.Empty(t, c.UpstreamDNSFileName)
+}
+
+func TestMergeSafeModeEdits(t *testing.T) {
+	dst := &dnsforward.FilteringConfig{
+		ProtectionEnabled: true,
+		UpstreamDNS:       []string{"bad://upstream"},
+		BootstrapDNS:      []string{"9.9.9.9"},
+		BlockedHosts:      []string{"version.bind"},
+		CacheSize:         1024,
+	}
+
+	base := safeModeFilteringConfig(dst)
+
+	cur := base
+	cur.UpstreamDNS = []string{"1.1.1.1"}
+
+	mergeSafeModeEdits(dst, &base, &cur)
+
+	assert.True(t, dst.ProtectionEnabled)
+	assert.Equal(t, []string{"1.1.1.1"}, dst.UpstreamDNS)
+	assert.Equal(t, []string{"9.9.9.9"}, dst.BootstrapDNS)
+	assert.Equal(t, []string{"version.bind"}, dst.BlockedHosts)
+	assert.Equal(t, uint32(1024), dst.CacheSize)
+}
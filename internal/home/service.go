@@ -206,7 +206,12 @@ func handleServiceControlAction(opts options, clientBuildFS fs.FS) {
 		initConfigFilename(opts)
 		initWorkingDir(opts)
 		handleServiceInstallCommand(s)
+		if opts.setSystemDNS {
+			handleSetSystemDNS()
+		}
 	case "uninstall":
+		initConfigFilename(opts)
+		initWorkingDir(opts)
 		handleServiceUninstallCommand(s)
 	default:
 		if err = svcAction(s, action); err != nil {
@@ -268,6 +273,15 @@ AdGuard Home is now available at the following addresses:`)
 	}
 }
 
+// handleSetSystemDNS points the system DNS settings at the installed service.
+// The failure isn't fatal, since the service is already installed and running.
+func handleSetSystemDNS() {
+	if err := setSystemDNS(); err != nil {
+		log.Error("service: %s", err)
+		log.Printf("service: configure the system dns manually or retry after uninstalling")
+	}
+}
+
 // handleServiceStatusCommand handles service "uninstall" command
 func handleServiceUninstallCommand(s service.Service) {
 	if aghos.IsOpenWrt() {
@@ -283,6 +297,10 @@ func handleServiceUninstallCommand(s service.Service) {
 		log.Fatalf("service: executing action %q: %s", "uninstall", err)
 	}
 
+	if err := restoreSystemDNS(); err != nil {
+		log.Error("service: %s", err)
+	}
+
 	if runtime.GOOS == "darwin" {
 		// Remove log files on cleanup and log errors.
 		err := os.Remove(launchdStdoutPath)
@@ -315,10 +333,13 @@ func configureService(c *service.Config) {
 	c.Option["LogOutput"] = true
 	c.Option["Restart"] = "always"
 
-	// Start only once network is up on Linux/systemd.
+	// Start only once network is up on Linux/systemd.  The After setting
+	// alone only orders the units, so network-online.target must also be
+	// pulled in with Wants.
 	if runtime.GOOS == "linux" {
 		c.Dependencies = []string{
 			"After=syslog.target network-online.target",
+			"Wants=network-online.target",
 		}
 	}
 
@@ -596,5 +617,17 @@ daemon_flags={{ .Arguments | args }}
 
 rc_bg=YES
 
+# Wait for the default route for up to a minute, since the addresses of the
+# interfaces configured by DHCP may not be assigned yet.
+rc_pre() {
+	i=0
+	while [ $i -lt 60 ] && ! route -n get default >/dev/null 2>&1; do
+		sleep 1
+		i=$((i + 1))
+	done
+
+	return 0
+}
+
 rc_cmd $1
 `
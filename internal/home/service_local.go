@@ -0,0 +1,130 @@
+//go:build openbsd || solaris
+// +build openbsd solaris
+
+package home
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/kardianos/service"
+)
+
+// The file contains the helpers common for the local implementations of the
+// service.System and service.Service interfaces.
+
+// getBool returns the value of the given name from kv, assuming the value is a
+// boolean.  If the value isn't found or is not of the type, the defaultValue is
+// returned.
+func getBool(kv service.KeyValue, name string, defaultValue bool) (val bool) {
+	var ok bool
+	if val, ok = kv[name].(bool); ok {
+		return val
+	}
+
+	return defaultValue
+}
+
+// getString returns the value of the given name from kv, assuming the value is
+// a string.  If the value isn't found or is not of the type, the defaultValue
+// is returned.
+func getString(kv service.KeyValue, name, defaultValue string) (val string) {
+	var ok bool
+	if val, ok = kv[name].(string); ok {
+		return val
+	}
+
+	return defaultValue
+}
+
+// getFuncNiladic returns the value of the given name from kv, assuming the
+// value is a func().  If the value isn't found or is not of the type, the
+// defaultValue is returned.
+func getFuncNiladic(kv service.KeyValue, name string, defaultValue func()) (val func()) {
+	var ok bool
+	if val, ok = kv[name].(func()); ok {
+		return val
+	}
+
+	return defaultValue
+}
+
+// serviceExecPath returns the absolute path to the excutable to be run as a
+// service configured by c.
+func serviceExecPath(c *service.Config) (path string, err error) {
+	if c != nil && len(c.Executable) != 0 {
+		return filepath.Abs(c.Executable)
+	}
+
+	if path, err = os.Executable(); err != nil {
+		return "", err
+	}
+
+	return filepath.Abs(path)
+}
+
+// optionRunWait is the name of the option associated with function which waits
+// for the service to be stopped.
+const optionRunWait = "RunWait"
+
+// runWait is the default function to wait for service to be stopped.
+func runWait() {
+	sigChan := make(chan os.Signal, 3)
+	signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
+	<-sigChan
+}
+
+// newSysLogger returns a stub service.Logger implementation.
+func newSysLogger(_ string, _ chan<- error) (service.Logger, error) {
+	return sysLogger{}, nil
+}
+
+// sysLogger wraps calls of the logging functions understandable for service
+// interfaces.
+type sysLogger struct{}
+
+// Error implements service.Logger interface for sysLogger.
+func (sysLogger) Error(v ...interface{}) error {
+	log.Error(fmt.Sprint(v...))
+
+	return nil
+}
+
+// Warning implements service.Logger interface for sysLogger.
+func (sysLogger) Warning(v ...interface{}) error {
+	log.Info("warning: %s", fmt.Sprint(v...))
+
+	return nil
+}
+
+// Info implements service.Logger interface for sysLogger.
+func (sysLogger) Info(v ...interface{}) error {
+	log.Info(fmt.Sprint(v...))
+
+	return nil
+}
+
+// Errorf implements service.Logger interface for sysLogger.
+func (sysLogger) Errorf(format string, a ...interface{}) error {
+	log.Error(format, a...)
+
+	return nil
+}
+
+// Warningf implements service.Logger interface for sysLogger.
+func (sysLogger) Warningf(format string, a ...interface{}) error {
+	log.Info("warning: %s", fmt.Sprintf(format, a...))
+
+	return nil
+}
+
+// Infof implements service.Logger interface for sysLogger.
+func (sysLogger) Infof(format string, a ...interface{}) error {
+	log.Info(format, a...)
+
+	return nil
+}
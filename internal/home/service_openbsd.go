@@ -6,15 +6,12 @@ package home
 import (
 	"fmt"
 	"os"
-	"os/signal"
 	"path/filepath"
 	"strings"
-	"syscall"
 	"text/template"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
 	"github.com/AdguardTeam/golibs/errors"
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/stringutil"
 	"github.com/kardianos/service"
 )
@@ -79,42 +76,6 @@ func (s *openbsdRunComService) String() string {
 	return stringutil.Coalesce(s.cfg.DisplayName, s.cfg.Name)
 }
 
-// getBool returns the value of the given name from kv, assuming the value is a
-// boolean.  If the value isn't found or is not of the type, the defaultValue is
-// returned.
-func getBool(kv service.KeyValue, name string, defaultValue bool) (val bool) {
-	var ok bool
-	if val, ok = kv[name].(bool); ok {
-		return val
-	}
-
-	return defaultValue
-}
-
-// getString returns the value of the given name from kv, assuming the value is
-// a string.  If the value isn't found or is not of the type, the defaultValue
-// is returned.
-func getString(kv service.KeyValue, name, defaultValue string) (val string) {
-	var ok bool
-	if val, ok = kv[name].(string); ok {
-		return val
-	}
-
-	return defaultValue
-}
-
-// getFuncNiladic returns the value of the given name from kv, assuming the
-// value is a func().  If the value isn't found or is not of the type, the
-// defaultValue is returned.
-func getFuncNiladic(kv service.KeyValue, name string, defaultValue func()) (val func()) {
-	var ok bool
-	if val, ok = kv[name].(func()); ok {
-		return val
-	}
-
-	return defaultValue
-}
-
 const (
 	// optionUserService is the UserService option name.
 	optionUserService = "UserService"
@@ -174,19 +135,6 @@ func (s *openbsdRunComService) template() (t *template.Template) {
 	)))
 }
 
-// execPath returns the absolute path to the excutable to be run as a service.
-func (s *openbsdRunComService) execPath() (path string, err error) {
-	if c := s.cfg; c != nil && len(c.Executable) != 0 {
-		return filepath.Abs(c.Executable)
-	}
-
-	if path, err = os.Executable(); err != nil {
-		return "", err
-	}
-
-	return filepath.Abs(path)
-}
-
 // annotate wraps errors.Annotate applying a common error format.
 func (s *openbsdRunComService) annotate(action string, err error) (annotated error) {
 	return errors.Annotate(err, "%s %s %s service: %w", action, sysVersion, s.cfg.Name)
@@ -233,7 +181,7 @@ func (s *openbsdRunComService) writeScript() (err error) {
 	}
 
 	var execPath string
-	if execPath, err = s.execPath(); err != nil {
+	if execPath, err = serviceExecPath(s.cfg); err != nil {
 		return err
 	}
 
@@ -283,17 +231,6 @@ func (s *openbsdRunComService) Uninstall() (err error) {
 	return errors.Annotate(err, "removing rc.d script: %w")
 }
 
-// optionRunWait is the name of the option associated with function which waits
-// for the service to be stopped.
-const optionRunWait = "RunWait"
-
-// runWait is the default function to wait for service to be stopped.
-func runWait() {
-	sigChan := make(chan os.Signal, 3)
-	signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
-	<-sigChan
-}
-
 // Run implements service.Service interface for *openbsdRunComService.
 func (s *openbsdRunComService) Run() (err error) {
 	if err = s.i.Start(s); err != nil {
@@ -379,54 +316,3 @@ func (s *openbsdRunComService) Logger(errs chan<- error) (l service.Logger, err
 func (s *openbsdRunComService) SystemLogger(errs chan<- error) (l service.Logger, err error) {
 	return newSysLogger(s.cfg.Name, errs)
 }
-
-// newSysLogger returns a stub service.Logger implementation.
-func newSysLogger(_ string, _ chan<- error) (service.Logger, error) {
-	return sysLogger{}, nil
-}
-
-// sysLogger wraps calls of the logging functions understandable for service
-// interfaces.
-type sysLogger struct{}
-
-// Error implements service.Logger interface for sysLogger.
-func (sysLogger) Error(v ...interface{}) error {
-	log.Error(fmt.Sprint(v...))
-
-	return nil
-}
-
-// Warning implements service.Logger interface for sysLogger.
-func (sysLogger) Warning(v ...interface{}) error {
-	log.Info("warning: %s", fmt.Sprint(v...))
-
-	return nil
-}
-
-// Info implements service.Logger interface for sysLogger.
-func (sysLogger) Info(v ...interface{}) error {
-	log.Info(fmt.Sprint(v...))
-
-	return nil
-}
-
-// Errorf implements service.Logger interface for sysLogger.
-func (sysLogger) Errorf(format string, a ...interface{}) error {
-	log.Error(format, a...)
-
-	return nil
-}
-
-// Warningf implements service.Logger interface for sysLogger.
-func (sysLogger) Warningf(format string, a ...interface{}) error {
-	log.Info("warning: %s", fmt.Sprintf(format, a...))
-
-	return nil
-}
-
-// Infof implements service.Logger interface for sysLogger.
-func (sysLogger) Infof(format string, a ...interface{}) error {
-	log.Info(format, a...)
-
-	return nil
-}
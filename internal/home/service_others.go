@@ -1,5 +1,5 @@
-//go:build !openbsd
-// +build !openbsd
+//go:build !openbsd && !solaris
+// +build !openbsd,!solaris
 
 package home
 
@@ -0,0 +1,367 @@
+//go:build solaris
+// +build solaris
+
+package home
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/stringutil"
+	"github.com/kardianos/service"
+)
+
+// Solaris Service Implementation
+//
+// The file contains the illumos and Solaris implementations for service.System
+// and service.Service interfaces.  It uses the Service Management Facility,
+// i.e. an SMF manifest imported with svccfg and controlled with svcadm and
+// svcs.  It's written as if it was in a separate package and has only one
+// internal dependency.
+//
+// TODO(e.burkov):  Perhaps, file a PR to github.com/kardianos/service.
+
+// sysVersion is the version of local service.System interface
+// implementation.
+const sysVersion = "solaris-smf"
+
+func chooseSystem() {
+	service.ChooseSystem(solarisSystem{})
+}
+
+// solarisSystem is the service.System to be used on the illumos and Solaris.
+type solarisSystem struct{}
+
+// String implements service.System interface for solarisSystem.
+func (solarisSystem) String() string {
+	return sysVersion
+}
+
+// Detect implements service.System interface for solarisSystem.
+func (solarisSystem) Detect() (ok bool) {
+	return true
+}
+
+// Interactive implements service.System interface for solarisSystem.  The
+// restarter sets SMF_FMRI in the environment of the methods it runs.
+func (solarisSystem) Interactive() (ok bool) {
+	return os.Getenv("SMF_FMRI") == ""
+}
+
+// New implements service.System interface for solarisSystem.
+func (solarisSystem) New(i service.Interface, c *service.Config) (s service.Service, err error) {
+	return &solarisSMFService{
+		i:   i,
+		cfg: c,
+	}, nil
+}
+
+// solarisSMFService is the SMF-based service.Service to be used on the illumos
+// and Solaris.
+type solarisSMFService struct {
+	i   service.Interface
+	cfg *service.Config
+}
+
+// Platform implements service.Service interface for *solarisSMFService.
+func (*solarisSMFService) Platform() (p string) {
+	return "solaris"
+}
+
+// String implements service.Service interface for *solarisSMFService.
+func (s *solarisSMFService) String() string {
+	return stringutil.Coalesce(s.cfg.DisplayName, s.cfg.Name)
+}
+
+const (
+	// optionUserService is the UserService option name.
+	optionUserService = "UserService"
+
+	// optionUserServiceDefault is the UserService option default value.
+	optionUserServiceDefault = false
+
+	// errNoUserServiceSMF is returned when the service is requested to be a
+	// user one.
+	errNoUserServiceSMF errors.Error = "user services are not supported on " + sysVersion
+)
+
+// fmri returns the fault management resource identifier of the default
+// instance of the service.
+func (s *solarisSMFService) fmri() (fmri string) {
+	return "svc:/site/" + s.cfg.Name + ":default"
+}
+
+// manifestPath returns the absolute path to the manifest.
+func (s *solarisSMFService) manifestPath() (mp string, err error) {
+	if getBool(s.cfg.Option, optionUserService, optionUserServiceDefault) {
+		return "", errNoUserServiceSMF
+	}
+
+	const manifestPathPref = "/var/svc/manifest/site"
+
+	return filepath.Join(manifestPathPref, s.cfg.Name+".xml"), nil
+}
+
+const (
+	// optionSMFManifest is the SMF manifest option name.
+	optionSMFManifest = "SMFManifest"
+
+	// smfManifest is the default SMF manifest.  The startd duration is
+	// "child", since the process doesn't daemonize itself.
+	smfManifest = `<?xml version="1.0"?>
+<!DOCTYPE service_bundle SYSTEM "/usr/share/lib/xml/dtd/service_bundle.dtd.1">
+<!-- {{ .SvcInfo | xml }} -->
+<service_bundle type="manifest" name="{{ .Name | xml }}">
+  <service name="site/{{ .Name | xml }}" type="service" version="1">
+    <create_default_instance enabled="false"/>
+    <single_instance/>
+    <dependency name="network" grouping="require_all" restart_on="error" type="service">
+      <service_fmri value="svc:/milestone/network:default"/>
+    </dependency>
+    <dependency name="filesystem" grouping="require_all" restart_on="error" type="service">
+      <service_fmri value="svc:/system/filesystem/local:default"/>
+    </dependency>
+    <method_context{{ if .WorkingDirectory }} working_directory="{{ .WorkingDirectory | xml }}"{{ end }}>
+      <method_credential user="root" group="root"/>
+    </method_context>
+    <exec_method type="method" name="start" exec="{{ .Path | xml }}{{ range .Arguments }} {{ . | arg | xml }}{{ end }}" timeout_seconds="60"/>
+    <exec_method type="method" name="stop" exec=":kill" timeout_seconds="60"/>
+    <property_group name="startd" type="framework">
+      <propval name="duration" type="astring" value="child"/>
+    </property_group>
+    <stability value="Unstable"/>
+    <template>
+      <common_name>
+        <loctext xml:lang="C">{{ .DisplayName | xml }}</loctext>
+      </common_name>
+      <description>
+        <loctext xml:lang="C">{{ .Description | xml }}</loctext>
+      </description>
+    </template>
+  </service>
+</service_bundle>
+`
+)
+
+// template returns the SMF manifest template.
+func (s *solarisSMFService) template() (t *template.Template) {
+	tf := map[string]interface{}{
+		// arg quotes the argument for the shell, which runs the exec
+		// method.
+		"arg": func(a string) string {
+			return `'` + strings.ReplaceAll(a, `'`, `'\''`) + `'`
+		},
+		"xml": template.HTMLEscapeString,
+	}
+
+	return template.Must(template.New("").Funcs(tf).Parse(getString(
+		s.cfg.Option,
+		optionSMFManifest,
+		smfManifest,
+	)))
+}
+
+// annotate wraps errors.Annotate applying a common error format.
+func (s *solarisSMFService) annotate(action string, err error) (annotated error) {
+	return errors.Annotate(err, "%s %s %s service: %w", action, sysVersion, s.cfg.Name)
+}
+
+// runSMF runs one of the SMF utilities and returns its output.  The non-zero
+// exit code is considered an error.
+func runSMF(cmd string, args ...string) (out string, err error) {
+	var code int
+	code, out, err = aghos.RunCommand(cmd, args...)
+	if err != nil {
+		return "", err
+	} else if code != 0 {
+		return out, fmt.Errorf("%s finished with code %d", cmd, code)
+	}
+
+	return out, nil
+}
+
+// Install implements service.Service interface for *solarisSMFService.
+func (s *solarisSMFService) Install() (err error) {
+	defer func() { err = s.annotate("installing", err) }()
+
+	var manifestPath string
+	if manifestPath, err = s.manifestPath(); err != nil {
+		return err
+	}
+
+	if err = s.writeManifest(manifestPath); err != nil {
+		return err
+	}
+
+	_, err = runSMF("svccfg", "import", manifestPath)
+
+	return err
+}
+
+// writeManifest tries to write the SMF manifest for the service.
+func (s *solarisSMFService) writeManifest(manifestPath string) (err error) {
+	if _, err = os.Stat(manifestPath); !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("manifest already exists at %s", manifestPath)
+	}
+
+	var execPath string
+	if execPath, err = serviceExecPath(s.cfg); err != nil {
+		return err
+	}
+
+	t := s.template()
+	f, err := os.OpenFile(manifestPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("creating smf manifest file: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	return t.Execute(f, &struct {
+		*service.Config
+		Path    string
+		SvcInfo string
+	}{
+		Config:  s.cfg,
+		Path:    execPath,
+		SvcInfo: getString(s.cfg.Option, "SvcInfo", s.String()),
+	})
+}
+
+// Uninstall implements service.Service interface for *solarisSMFService.
+func (s *solarisSMFService) Uninstall() (err error) {
+	defer func() { err = s.annotate("uninstalling", err) }()
+
+	var manifestPath string
+	if manifestPath, err = s.manifestPath(); err != nil {
+		return err
+	}
+
+	if _, err = s.state(); err != nil {
+		return err
+	}
+
+	// Disable the instance synchronously first, since svccfg doesn't stop
+	// the running processes.
+	if _, err = runSMF("svcadm", "disable", "-s", s.fmri()); err != nil {
+		return err
+	}
+
+	if _, err = runSMF("svccfg", "delete", "site/"+s.cfg.Name); err != nil {
+		return err
+	}
+
+	if err = os.Remove(manifestPath); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return errors.Annotate(err, "removing smf manifest: %w")
+}
+
+// Run implements service.Service interface for *solarisSMFService.
+func (s *solarisSMFService) Run() (err error) {
+	if err = s.i.Start(s); err != nil {
+		return err
+	}
+
+	getFuncNiladic(s.cfg.Option, optionRunWait, runWait)()
+
+	return s.i.Stop(s)
+}
+
+// state returns the SMF state of the default instance of the service.  It
+// returns service.ErrNotInstalled if there is no such instance.
+func (s *solarisSMFService) state() (state string, err error) {
+	var code int
+	var out string
+	code, out, err = aghos.RunCommand("svcs", "-H", "-o", "state", s.fmri())
+	if err != nil {
+		return "", err
+	} else if code != 0 {
+		// svcs reports the unknown patterns on the standard error and
+		// finishes with a non-zero code.
+		return "", service.ErrNotInstalled
+	}
+
+	return strings.TrimSpace(out), nil
+}
+
+// smfStatus converts the SMF state of the instance into the service status.
+func smfStatus(state string) (status service.Status, err error) {
+	switch state {
+	case "online", "degraded":
+		return service.StatusRunning, nil
+	case "offline", "disabled", "maintenance", "uninitialized":
+		return service.StatusStopped, nil
+	default:
+		return service.StatusUnknown, fmt.Errorf("unexpected smf state %q", state)
+	}
+}
+
+// Status implements service.Service interface for *solarisSMFService.
+func (s *solarisSMFService) Status() (status service.Status, err error) {
+	defer func() { err = s.annotate("getting status of", err) }()
+
+	var state string
+	if state, err = s.state(); err != nil {
+		return service.StatusUnknown, err
+	}
+
+	return smfStatus(state)
+}
+
+// Start implements service.Service interface for *solarisSMFService.  The
+// instance is enabled persistently, so that it's also started with the system.
+// An instance in the maintenance state should be cleared first.
+func (s *solarisSMFService) Start() (err error) {
+	defer func() { err = s.annotate("starting", err) }()
+
+	var state string
+	if state, err = s.state(); err != nil {
+		return err
+	}
+
+	if state == "maintenance" {
+		if _, err = runSMF("svcadm", "clear", s.fmri()); err != nil {
+			return err
+		}
+	}
+
+	_, err = runSMF("svcadm", "enable", "-s", s.fmri())
+
+	return err
+}
+
+// Stop implements service.Service interface for *solarisSMFService.
+func (s *solarisSMFService) Stop() (err error) {
+	_, err = runSMF("svcadm", "disable", "-s", s.fmri())
+
+	return s.annotate("stopping", err)
+}
+
+// Restart implements service.Service interface for *solarisSMFService.
+func (s *solarisSMFService) Restart() (err error) {
+	_, err = runSMF("svcadm", "restart", s.fmri())
+
+	return s.annotate("restarting", err)
+}
+
+// Logger implements service.Service interface for *solarisSMFService.
+func (s *solarisSMFService) Logger(errs chan<- error) (l service.Logger, err error) {
+	if service.ChosenSystem().Interactive() {
+		return service.ConsoleLogger, nil
+	}
+
+	return s.SystemLogger(errs)
+}
+
+// SystemLogger implements service.Service interface for *solarisSMFService.
+// The restarter writes the output of the service into its log file in
+// /var/svc/log.
+func (s *solarisSMFService) SystemLogger(errs chan<- error) (l service.Logger, err error) {
+	return newSysLogger(s.cfg.Name, errs)
+}
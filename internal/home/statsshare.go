@@ -0,0 +1,464 @@
+package home
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/stats"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/stringutil"
+)
+
+// statsShareConfig is the configuration of the read-only statistics share
+// links.
+type statsShareConfig struct {
+	// Key is the base64-encoded key, which signs the share links.  It's
+	// generated when the first link is created.  Changing it revokes all the
+	// links created before.
+	Key string `yaml:"key"`
+}
+
+// Share link parameters.
+const (
+	// statsShareKeyLen is the length of the signing key in bytes.
+	statsShareKeyLen = 32
+
+	// defaultStatsShareTTLHours is the default lifetime of a share link.
+	defaultStatsShareTTLHours = 7 * 24
+
+	// maxStatsShareTTLHours is the maximum lifetime of a share link.
+	maxStatsShareTTLHours = 365 * 24
+
+	// statsSharedPath is the path of the read-only statistics view.
+	statsSharedPath = "/stats/shared"
+)
+
+// Share link errors.
+const (
+	errStatsShareBadToken errors.Error = "bad token"
+	errStatsShareExpired  errors.Error = "link expired"
+)
+
+// statsShareToken is the payload of a signed share link.
+type statsShareToken struct {
+	// Clients are the names of the persistent clients or the IDs of the
+	// clients, whose statistics are shared.  If empty, the aggregate
+	// statistics are shared.
+	Clients []string `json:"c,omitempty"`
+
+	// Expires is the Unix time in seconds, when the link expires.
+	Expires int64 `json:"e"`
+}
+
+// statsShare is the module creating and serving the read-only statistics
+// share links.
+type statsShare struct {
+	// mu protects conf and key.
+	mu *sync.Mutex
+
+	// conf is the share links configuration.
+	conf *statsShareConfig
+
+	// key is the decoded signing key.  It's nil until the first link is
+	// created.
+	key []byte
+
+	// data returns the statistics of the matched clients.  It's the
+	// SharedData method of the statistics module everywhere except the
+	// tests.
+	data func(match func(client string) (ok bool)) (d *stats.SharedData, ok bool)
+
+	// clientIDs returns the IDs of the persistent client with name.
+	clientIDs func(name string) (ids []string, ok bool)
+
+	// now returns the current time.  It's time.Now everywhere except the
+	// tests.
+	now func() (t time.Time)
+
+	// confModified is called when the configuration is changed by the HTTP
+	// API.  It's onConfigModified everywhere except the tests.
+	confModified func()
+}
+
+// newStatsShare returns a new share links module.
+func newStatsShare(conf *statsShareConfig) (ss *statsShare) {
+	ss = &statsShare{
+		mu: &sync.Mutex{},
+		conf: &statsShareConfig{
+			Key: conf.Key,
+		},
+		data: func(match func(client string) (ok bool)) (d *stats.SharedData, ok bool) {
+			if Context.stats == nil {
+				return nil, false
+			}
+
+			return Context.stats.SharedData(match)
+		},
+		clientIDs:    Context.clients.idsByName,
+		now:          time.Now,
+		confModified: onConfigModified,
+	}
+
+	if conf.Key != "" {
+		key, err := base64.StdEncoding.DecodeString(conf.Key)
+		if err != nil || len(key) != statsShareKeyLen {
+			log.Error("stats share: bad key, links will not work until the key is regenerated")
+		} else {
+			ss.key = key
+		}
+	}
+
+	return ss
+}
+
+// WriteDiskConfig writes the current configuration into conf.
+func (ss *statsShare) WriteDiskConfig(conf *statsShareConfig) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	*conf = *ss.conf
+}
+
+// rotateKeyLocked generates a new signing key.  ss.mu is expected to be
+// locked.
+func (ss *statsShare) rotateKeyLocked() (err error) {
+	key := make([]byte, statsShareKeyLen)
+	_, err = rand.Read(key)
+	if err != nil {
+		return fmt.Errorf("generating key: %w", err)
+	}
+
+	ss.key = key
+	ss.conf.Key = base64.StdEncoding.EncodeToString(key)
+
+	return nil
+}
+
+// signLocked returns the signature of payload.  ss.mu is expected to be
+// locked.
+func (ss *statsShare) signLocked(payload string) (sig string) {
+	mac := hmac.New(sha256.New, ss.key)
+	_, _ = mac.Write([]byte(payload))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newToken returns a new signed token sharing the statistics of clients.
+// keyCreated is true if the signing key has been generated.
+func (ss *statsShare) newToken(tok *statsShareToken) (token string, keyCreated bool, err error) {
+	data, err := json.Marshal(tok)
+	if err != nil {
+		return "", false, fmt.Errorf("encoding token: %w", err)
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if ss.key == nil {
+		err = ss.rotateKeyLocked()
+		if err != nil {
+			return "", false, err
+		}
+
+		keyCreated = true
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(data)
+
+	return payload + "." + ss.signLocked(payload), keyCreated, nil
+}
+
+// parseToken validates the signature and the expiration time of token and
+// returns its payload.
+func (ss *statsShare) parseToken(token string) (tok *statsShareToken, err error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return nil, errStatsShareBadToken
+	}
+
+	payload, sig := parts[0], parts[1]
+
+	ss.mu.Lock()
+	valid := ss.key != nil && hmac.Equal([]byte(sig), []byte(ss.signLocked(payload)))
+	ss.mu.Unlock()
+	if !valid {
+		return nil, errStatsShareBadToken
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errStatsShareBadToken
+	}
+
+	tok = &statsShareToken{}
+	err = json.Unmarshal(data, tok)
+	if err != nil {
+		return nil, errStatsShareBadToken
+	}
+
+	if ss.now().Unix() >= tok.Expires {
+		return nil, errStatsShareExpired
+	}
+
+	return tok, nil
+}
+
+// matcher returns a function matching the statistics keys of the clients.
+// The names of the persistent clients are expanded into their IDs.
+func (ss *statsShare) matcher(clients []string) (match func(client string) (ok bool)) {
+	var ids []string
+	for _, c := range clients {
+		if cids, ok := ss.clientIDs(c); ok {
+			ids = append(ids, cids...)
+		} else {
+			ids = append(ids, c)
+		}
+	}
+
+	var nets []*net.IPNet
+	idSet := map[string]struct{}{}
+	for _, id := range ids {
+		if _, n, err := net.ParseCIDR(id); err == nil {
+			nets = append(nets, n)
+		} else if ip := net.ParseIP(id); ip != nil {
+			idSet[ip.String()] = struct{}{}
+		} else {
+			idSet[id] = struct{}{}
+		}
+	}
+
+	return func(client string) (ok bool) {
+		if _, ok = idSet[client]; ok {
+			return true
+		}
+
+		ip := net.ParseIP(client)
+		if ip == nil {
+			return false
+		}
+
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// idsByName returns the IDs of the persistent client with name.
+func (clients *clientsContainer) idsByName(name string) (ids []string, ok bool) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	c, ok := clients.list[name]
+	if !ok {
+		return nil, false
+	}
+
+	return stringutil.CloneSlice(c.IDs), true
+}
+
+// statsShareReqJSON is the request to the POST /control/stats/share HTTP API.
+type statsShareReqJSON struct {
+	// Clients are the names of the persistent clients or the IDs of the
+	// clients to share the statistics of.  If empty, the aggregate
+	// statistics are shared.
+	Clients []string `json:"clients"`
+
+	// TTLHours is the lifetime of the link in hours.  If zero,
+	// defaultStatsShareTTLHours is used.
+	TTLHours uint32 `json:"ttl_hours"`
+}
+
+// statsShareRespJSON is the response to the POST /control/stats/share HTTP
+// API.
+type statsShareRespJSON struct {
+	URL     string `json:"url"`
+	Expires string `json:"expires"`
+}
+
+// handleCreate is the handler for the POST /control/stats/share HTTP API.
+func (ss *statsShare) handleCreate(w http.ResponseWriter, r *http.Request) {
+	req := &statsShareReqJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "json decode: %s", err)
+
+		return
+	}
+
+	ttl := req.TTLHours
+	if ttl == 0 {
+		ttl = defaultStatsShareTTLHours
+	} else if ttl > maxStatsShareTTLHours {
+		aghhttp.Error(r, w, http.StatusBadRequest, "ttl_hours: must be at most %d", maxStatsShareTTLHours)
+
+		return
+	}
+
+	for i, c := range req.Clients {
+		if c == "" {
+			aghhttp.Error(r, w, http.StatusBadRequest, "clients: at index %d: empty client", i)
+
+			return
+		}
+	}
+
+	expires := ss.now().Add(time.Duration(ttl) * time.Hour)
+	token, keyCreated, err := ss.newToken(&statsShareToken{
+		Clients: req.Clients,
+		Expires: expires.Unix(),
+	})
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "creating link: %s", err)
+
+		return
+	}
+
+	if keyCreated {
+		ss.confModified()
+	}
+
+	scheme := schemeHTTP
+	if r.TLS != nil {
+		scheme = schemeHTTPS
+	}
+
+	u := &url.URL{
+		Scheme:   scheme,
+		Host:     r.Host,
+		Path:     webPath(statsSharedPath),
+		RawQuery: url.Values{"token": []string{token}}.Encode(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(&statsShareRespJSON{
+		URL:     u.String(),
+		Expires: expires.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "encoding response: %s", err)
+	}
+}
+
+// handleRevoke is the handler for the POST /control/stats/share/revoke HTTP
+// API.  It revokes all the share links by rotating the signing key.
+func (ss *statsShare) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	ss.mu.Lock()
+	err := ss.rotateKeyLocked()
+	ss.mu.Unlock()
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "revoking links: %s", err)
+
+		return
+	}
+
+	log.Info("stats share: all links revoked")
+
+	ss.confModified()
+}
+
+// statsSharedTmpl is the template of the HTML read-only statistics view.
+var statsSharedTmpl = template.Must(template.New("shared").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>AdGuard Home statistics</title>
+</head>
+<body>
+<h1>AdGuard Home statistics</h1>
+<p>Link expires {{ .Expires }}.</p>
+<p>DNS queries: {{ .Data.NumDNSQueries }}</p>
+{{- if .Data.NumBlockedFiltering }}
+<p>Blocked by filters: {{ .Data.NumBlockedFiltering }}</p>
+{{- end }}
+{{- with .Data.Clients }}
+<h2>Clients</h2>
+<ul>{{ range . }}{{ range $c, $n := . }}<li>{{ $c }}: {{ $n }}</li>{{ end }}{{ end }}</ul>
+{{- end }}
+{{- with .Data.TopQueried }}
+<h2>Top queried domains</h2>
+<ul>{{ range . }}{{ range $d, $n := . }}<li>{{ $d }}: {{ $n }}</li>{{ end }}{{ end }}</ul>
+{{- end }}
+{{- with .Data.TopBlocked }}
+<h2>Top blocked domains</h2>
+<ul>{{ range . }}{{ range $d, $n := . }}<li>{{ $d }}: {{ $n }}</li>{{ end }}{{ end }}</ul>
+{{- end }}
+</body>
+</html>
+`))
+
+// handleShared is the handler for the GET /stats/shared page.  It requires no
+// authentication, since the access is granted by the signed token.  The
+// statistics are returned as JSON, unless the client accepts HTML.
+func (ss *statsShare) handleShared(w http.ResponseWriter, r *http.Request) {
+	tok, err := ss.parseToken(r.URL.Query().Get("token"))
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusForbidden, "%s", err)
+
+		return
+	}
+
+	var match func(client string) (ok bool)
+	if len(tok.Clients) > 0 {
+		match = ss.matcher(tok.Clients)
+	}
+
+	data, ok := ss.data(match)
+	if !ok {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "couldn't get statistics data")
+
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(data)
+		if err != nil {
+			aghhttp.Error(r, w, http.StatusInternalServerError, "encoding response: %s", err)
+		}
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = statsSharedTmpl.Execute(w, struct {
+		Data    *stats.SharedData
+		Expires string
+	}{
+		Data:    data,
+		Expires: time.Unix(tok.Expires, 0).UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		log.Debug("stats share: writing page: %s", err)
+	}
+}
+
+// registerStatsShareHandlers registers the HTTP handlers of the statistics
+// share links.
+func registerStatsShareHandlers() {
+	ss := Context.statsShare
+	httpRegister(http.MethodPost, "/control/stats/share", ss.handleCreate)
+	httpRegister(http.MethodPost, "/control/stats/share/revoke", ss.handleRevoke)
+
+	// No auth is necessary for the shared view, since the token grants the
+	// access.
+	Context.mux.HandleFunc(statsSharedPath, postInstall(ensureGET(ss.handleShared)))
+}
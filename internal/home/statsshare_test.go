@@ -0,0 +1,127 @@
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/stats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsShare(t *testing.T) {
+	ss := newStatsShare(&statsShareConfig{})
+
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	ss.now = func() (t time.Time) { return now }
+
+	modified := 0
+	ss.confModified = func() { modified++ }
+
+	ss.clientIDs = func(name string) (ids []string, ok bool) {
+		if name == "roommate" {
+			return []string{"192.168.1.0/24", "laptop"}, true
+		}
+
+		return nil, false
+	}
+
+	var gotMatch func(client string) (ok bool)
+	ss.data = func(match func(client string) (ok bool)) (d *stats.SharedData, ok bool) {
+		gotMatch = match
+
+		return &stats.SharedData{NumDNSQueries: 42}, true
+	}
+
+	create := func(t *testing.T, body string) (token string) {
+		t.Helper()
+
+		r := httptest.NewRequest(http.MethodPost, "/control/stats/share", strings.NewReader(body))
+		r.Host = "dns.example:3000"
+		w := httptest.NewRecorder()
+		ss.handleCreate(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		resp := &statsShareRespJSON{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(resp))
+
+		u, err := url.Parse(resp.URL)
+		require.NoError(t, err)
+
+		assert.Equal(t, "dns.example:3000", u.Host)
+		assert.Equal(t, statsSharedPath, u.Path)
+
+		return u.Query().Get("token")
+	}
+
+	view := func(t *testing.T, token, accept string) (w *httptest.ResponseRecorder) {
+		t.Helper()
+
+		r := httptest.NewRequest(http.MethodGet, statsSharedPath+"?token="+url.QueryEscape(token), nil)
+		r.Header.Set("Accept", accept)
+		w = httptest.NewRecorder()
+		ss.handleShared(w, r)
+
+		return w
+	}
+
+	token := create(t, `{"clients":["roommate"],"ttl_hours":24}`)
+	assert.Equal(t, 1, modified)
+
+	t.Run("json", func(t *testing.T) {
+		w := view(t, token, "application/json")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		d := &stats.SharedData{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(d))
+		assert.EqualValues(t, 42, d.NumDNSQueries)
+
+		require.NotNil(t, gotMatch)
+		assert.True(t, gotMatch("192.168.1.5"))
+		assert.True(t, gotMatch("laptop"))
+		assert.False(t, gotMatch("192.168.2.5"))
+		assert.False(t, gotMatch("phone"))
+	})
+
+	t.Run("html", func(t *testing.T) {
+		w := view(t, token, "text/html,application/xhtml+xml")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		assert.Contains(t, w.Body.String(), "DNS queries: 42")
+	})
+
+	t.Run("aggregate", func(t *testing.T) {
+		w := view(t, create(t, `{}`), "")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		assert.Nil(t, gotMatch)
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		w := view(t, "x"+token, "")
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		now = now.Add(25 * time.Hour)
+		t.Cleanup(func() { now = now.Add(-25 * time.Hour) })
+
+		w := view(t, token, "")
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("revoke", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		ss.handleRevoke(w, httptest.NewRequest(http.MethodPost, "/control/stats/share/revoke", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, 2, modified)
+
+		w = view(t, token, "")
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+}
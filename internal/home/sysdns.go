@@ -0,0 +1,246 @@
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// sysDNSBackupFilename is the name of the file within the working directory,
+// which keeps the original system DNS settings replaced with --set-system-dns.
+const sysDNSBackupFilename = "sysdns_backup.json"
+
+// sysDNSBackup is the original system DNS settings, which are restored when
+// the service is uninstalled.
+type sysDNSBackup struct {
+	// Files are the original contents of the files replaced by the helper by
+	// their absolute paths.
+	Files map[string]string `json:"files,omitempty"`
+
+	// Created are the absolute paths of the files created by the helper,
+	// which didn't exist and must be removed.
+	Created []string `json:"created,omitempty"`
+
+	// Links are the original targets of the symbolic links replaced by the
+	// helper by their absolute paths.
+	Links map[string]string `json:"links,omitempty"`
+
+	// Servers are the original DNS servers of the network interfaces or
+	// services by their names.  An empty list means that the servers have
+	// been obtained automatically.
+	Servers map[string][]string `json:"servers,omitempty"`
+
+	// Method is the name of the way the settings have been changed, for
+	// example "resolved" or "networksetup".
+	Method string `json:"method"`
+}
+
+// sysDNSBackupPath returns the path to the backup of the system DNS settings.
+func sysDNSBackupPath() (p string) {
+	return filepath.Join(Context.workDir, sysDNSBackupFilename)
+}
+
+// sysDNSAddr returns the address of the local AdGuard Home DNS server the
+// system should use.  It's taken from the configuration file, if there is one.
+func sysDNSAddr() (ip net.IP, err error) {
+	ip = net.IP{127, 0, 0, 1}
+
+	data, err := readConfigFile()
+	if errors.Is(err, os.ErrNotExist) {
+		return ip, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+
+	conf := &struct {
+		DNS struct {
+			BindHosts []net.IP `yaml:"bind_hosts"`
+			Port      int      `yaml:"port"`
+		} `yaml:"dns"`
+	}{}
+	if err = yaml.Unmarshal(data, conf); err != nil {
+		return nil, fmt.Errorf("parsing config: %w", err)
+	}
+
+	return pickSysDNSAddr(conf.DNS.BindHosts, conf.DNS.Port)
+}
+
+// pickSysDNSAddr returns the address from hosts the system resolver should use.
+// Most system resolvers don't support custom ports, so port must be either 53
+// or zero, which means the default one.
+func pickSysDNSAddr(hosts []net.IP, port int) (ip net.IP, err error) {
+	if port != 0 && port != 53 {
+		return nil, fmt.Errorf("dns port %d is not supported by system resolvers, need 53", port)
+	}
+
+	if len(hosts) == 0 {
+		return net.IP{127, 0, 0, 1}, nil
+	}
+
+	for _, h := range hosts {
+		if h.IsUnspecified() {
+			if h.To4() == nil {
+				return net.IPv6loopback, nil
+			}
+
+			return net.IP{127, 0, 0, 1}, nil
+		} else if h.IsLoopback() {
+			return h, nil
+		}
+	}
+
+	return hosts[0], nil
+}
+
+// setSystemDNS points the system DNS settings at the local AdGuard Home and
+// saves the original ones to be restored on uninstallation.
+func setSystemDNS() (err error) {
+	p := sysDNSBackupPath()
+	if _, err = os.Stat(p); err == nil {
+		return fmt.Errorf("system dns is already set, backup exists at %s", p)
+	}
+
+	ip, err := sysDNSAddr()
+	if err != nil {
+		return err
+	}
+
+	// Save the backup even if the settings have only been changed partially,
+	// so that they could still be restored.
+	b, err := setSysDNS(ip)
+	if b != nil {
+		data, merr := json.MarshalIndent(b, "", "  ")
+		if merr != nil {
+			return errors.WithDeferred(err, fmt.Errorf("encoding backup: %w", merr))
+		}
+
+		werr := os.WriteFile(p, data, 0o600)
+		if werr != nil {
+			return errors.WithDeferred(err, fmt.Errorf("writing backup: %w", werr))
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("setting system dns: %w", err)
+	}
+
+	log.Info("service: system dns set to %s using %s", ip, b.Method)
+
+	return nil
+}
+
+// restoreSystemDNS restores the system DNS settings changed by setSystemDNS, if
+// there are any.
+func restoreSystemDNS() (err error) {
+	p := sysDNSBackupPath()
+	data, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("reading backup: %w", err)
+	}
+
+	b := &sysDNSBackup{}
+	if err = json.Unmarshal(data, b); err != nil {
+		return fmt.Errorf("decoding backup: %w", err)
+	}
+
+	if err = restoreSysDNS(b); err != nil {
+		return fmt.Errorf("restoring system dns using %s: %w", b.Method, err)
+	}
+
+	log.Info("service: system dns restored using %s", b.Method)
+
+	return os.Remove(p)
+}
+
+// backupFile saves the current content of the file at p into b.  If the file
+// is a symbolic link, its target is saved instead.
+func (b *sysDNSBackup) backupFile(p string) (err error) {
+	fi, err := os.Lstat(p)
+	if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		var target string
+		target, err = os.Readlink(p)
+		if err != nil {
+			return err
+		}
+
+		if b.Links == nil {
+			b.Links = map[string]string{}
+		}
+		b.Links[p] = target
+
+		return nil
+	}
+
+	data, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		b.Created = append(b.Created, p)
+
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if b.Files == nil {
+		b.Files = map[string]string{}
+	}
+	b.Files[p] = string(data)
+
+	return nil
+}
+
+// restoreFiles writes the backed up files and symbolic links back and removes
+// the created files.
+func (b *sysDNSBackup) restoreFiles() (err error) {
+	var errs []error
+	for p, data := range b.Files {
+		err = os.WriteFile(p, []byte(data), 0o644)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, p := range b.Created {
+		err = os.Remove(p)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+
+	for p, target := range b.Links {
+		err = os.Remove(p)
+		if err == nil || errors.Is(err, os.ErrNotExist) {
+			err = os.Symlink(target, p)
+		}
+
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.List("restoring files", errs...)
+	}
+
+	return nil
+}
+
+// runSysDNSCommand runs the command and returns an error if it fails.
+func runSysDNSCommand(cmd string, args ...string) (out string, err error) {
+	code, out, err := aghos.RunCommand(cmd, args...)
+	if err != nil {
+		return "", err
+	} else if code != 0 {
+		return "", fmt.Errorf("%s exited with code %d", cmd, code)
+	}
+
+	return out, nil
+}
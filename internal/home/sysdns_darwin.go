@@ -0,0 +1,106 @@
+//go:build darwin
+// +build darwin
+
+package home
+
+import (
+	"bufio"
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// sysDNSMethodNetworksetup is the method of setting the system DNS on macOS.
+const sysDNSMethodNetworksetup = "networksetup"
+
+// networkServices returns the names of the enabled network services.
+func networkServices() (svcs []string, err error) {
+	out, err := runSysDNSCommand("networksetup", "-listallnetworkservices")
+	if err != nil {
+		return nil, err
+	}
+
+	s := bufio.NewScanner(strings.NewReader(out))
+	// Skip the line with the note about the disabled services.
+	s.Scan()
+	for s.Scan() {
+		// An asterisk denotes a disabled service.
+		if svc := s.Text(); svc != "" && svc[0] != '*' {
+			svcs = append(svcs, svc)
+		}
+	}
+
+	return svcs, s.Err()
+}
+
+// dnsServers returns the DNS servers set for svc.  servers are empty if they
+// are obtained automatically.
+func dnsServers(svc string) (servers []string, err error) {
+	out, err := runSysDNSCommand("networksetup", "-getdnsservers", svc)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range strings.Fields(out) {
+		// The output is a message instead of the list of addresses if there
+		// are no servers.
+		if net.ParseIP(f) == nil {
+			return nil, nil
+		}
+
+		servers = append(servers, f)
+	}
+
+	return servers, nil
+}
+
+// setSysDNS sets ip as the DNS server of every enabled network service.
+func setSysDNS(ip net.IP) (b *sysDNSBackup, err error) {
+	svcs, err := networkServices()
+	if err != nil {
+		return nil, err
+	}
+
+	b = &sysDNSBackup{
+		Servers: map[string][]string{},
+		Method:  sysDNSMethodNetworksetup,
+	}
+	for _, svc := range svcs {
+		var servers []string
+		servers, err = dnsServers(svc)
+		if err != nil {
+			return b, err
+		}
+
+		b.Servers[svc] = servers
+		_, err = runSysDNSCommand("networksetup", "-setdnsservers", svc, ip.String())
+		if err != nil {
+			return b, err
+		}
+	}
+
+	return b, nil
+}
+
+// restoreSysDNS restores the DNS servers of the network services from b.
+func restoreSysDNS(b *sysDNSBackup) (err error) {
+	var errs []error
+	for svc, servers := range b.Servers {
+		if len(servers) == 0 {
+			// Return to the automatically obtained servers.
+			servers = []string{"Empty"}
+		}
+
+		args := append([]string{"-setdnsservers", svc}, servers...)
+		if _, err = runSysDNSCommand("networksetup", args...); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.List("restoring dns servers", errs...)
+	}
+
+	return nil
+}
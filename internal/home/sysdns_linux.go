@@ -0,0 +1,138 @@
+//go:build linux
+// +build linux
+
+package home
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// Paths used to configure the system DNS on Linux.  See also resolvConfPath.
+//
+// The systemd-resolved drop-in differs from resolvedConfPath, which disables
+// the stub listener, so that they don't overwrite each other.
+const (
+	resolvedRunDir     = "/run/systemd/resolve/"
+	resolvedDropInPath = "/etc/systemd/resolved.conf.d/adguardhome-system-dns.conf"
+	nmDropInPath       = "/etc/NetworkManager/conf.d/90-adguardhome.conf"
+)
+
+// Methods of setting the system DNS on Linux.
+const (
+	sysDNSMethodResolved   = "resolved"
+	sysDNSMethodNM         = "networkmanager"
+	sysDNSMethodResolvConf = "resolvconf"
+)
+
+// usesResolved returns true if the resolv.conf file at p is managed by
+// systemd-resolved.
+func usesResolved(p string) (ok bool) {
+	target, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return false
+	}
+
+	return strings.HasPrefix(target, resolvedRunDir)
+}
+
+// usesNetworkManager returns true if NetworkManager is running.
+func usesNetworkManager() (ok bool) {
+	out, err := runSysDNSCommand("nmcli", "-t", "-f", "RUNNING", "general")
+
+	return err == nil && strings.TrimSpace(out) == "running"
+}
+
+// resolvedDropIn returns the systemd-resolved configuration, which makes it
+// send all queries to ip.
+func resolvedDropIn(ip net.IP) (conf string) {
+	return fmt.Sprintf("# Created by AdGuard Home.\n[Resolve]\nDNS=%s\nDomains=~.\n", ip)
+}
+
+// resolvConf returns the content of the resolv.conf file, which makes the
+// system resolver use ip.
+func resolvConf(ip net.IP) (conf string) {
+	return fmt.Sprintf("# Created by AdGuard Home.\nnameserver %s\n", ip)
+}
+
+// writeSysDNSFile backs up the file at p into b and replaces it with the one
+// containing data.
+func writeSysDNSFile(b *sysDNSBackup, p, data string) (err error) {
+	err = b.backupFile(p)
+	if err != nil {
+		return fmt.Errorf("backing up %s: %w", p, err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(p), 0o755)
+	if err != nil {
+		return err
+	}
+
+	// Remove the file first in case it's a symbolic link, the target of which
+	// mustn't be changed.
+	err = os.Remove(p)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return os.WriteFile(p, []byte(data), 0o644)
+}
+
+// setSysDNS configures the system resolver to use ip.  It uses
+// systemd-resolved or NetworkManager, if either manages the resolv.conf, and
+// rewrites the resolv.conf otherwise.
+func setSysDNS(ip net.IP) (b *sysDNSBackup, err error) {
+	switch {
+	case usesResolved(resolvConfPath):
+		b = &sysDNSBackup{Method: sysDNSMethodResolved}
+		err = writeSysDNSFile(b, resolvedDropInPath, resolvedDropIn(ip))
+		if err != nil {
+			return b, err
+		}
+
+		_, err = runSysDNSCommand("systemctl", "restart", "systemd-resolved")
+	case usesNetworkManager():
+		// Make NetworkManager leave the resolv.conf alone.
+		b = &sysDNSBackup{Method: sysDNSMethodNM}
+		err = writeSysDNSFile(b, nmDropInPath, "# Created by AdGuard Home.\n[main]\ndns=none\n")
+		if err != nil {
+			return b, err
+		}
+
+		_, err = runSysDNSCommand("systemctl", "reload", "NetworkManager")
+		if err != nil {
+			return b, err
+		}
+
+		err = writeSysDNSFile(b, resolvConfPath, resolvConf(ip))
+	default:
+		b = &sysDNSBackup{Method: sysDNSMethodResolvConf}
+		err = writeSysDNSFile(b, resolvConfPath, resolvConf(ip))
+	}
+
+	return b, err
+}
+
+// restoreSysDNS restores the system resolver settings from b.
+func restoreSysDNS(b *sysDNSBackup) (err error) {
+	err = b.restoreFiles()
+	if err != nil {
+		return err
+	}
+
+	switch b.Method {
+	case sysDNSMethodResolved:
+		_, err = runSysDNSCommand("systemctl", "restart", "systemd-resolved")
+	case sysDNSMethodNM:
+		_, err = runSysDNSCommand("systemctl", "reload", "NetworkManager")
+	default:
+		// Go on.
+	}
+
+	return err
+}
@@ -0,0 +1,20 @@
+//go:build !(linux || darwin || windows)
+// +build !linux,!darwin,!windows
+
+package home
+
+import (
+	"net"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+)
+
+// setSysDNS is not supported on this platform.
+func setSysDNS(_ net.IP) (b *sysDNSBackup, err error) {
+	return nil, aghos.Unsupported("setting system dns")
+}
+
+// restoreSysDNS is not supported on this platform.
+func restoreSysDNS(_ *sysDNSBackup) (err error) {
+	return aghos.Unsupported("restoring system dns")
+}
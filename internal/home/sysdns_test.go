@@ -0,0 +1,130 @@
+package home
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPickSysDNSAddr(t *testing.T) {
+	testCases := []struct {
+		want       net.IP
+		name       string
+		wantErrMsg string
+		hosts      []net.IP
+		port       int
+	}{{
+		want:       net.IP{127, 0, 0, 1},
+		name:       "default",
+		wantErrMsg: "",
+		hosts:      nil,
+		port:       0,
+	}, {
+		want:       net.IP{127, 0, 0, 1},
+		name:       "unspecified_v4",
+		wantErrMsg: "",
+		hosts:      []net.IP{{0, 0, 0, 0}},
+		port:       53,
+	}, {
+		want:       net.IPv6loopback,
+		name:       "unspecified_v6",
+		wantErrMsg: "",
+		hosts:      []net.IP{net.IPv6unspecified},
+		port:       53,
+	}, {
+		want:       net.IP{127, 0, 0, 2},
+		name:       "loopback",
+		wantErrMsg: "",
+		hosts:      []net.IP{{192, 168, 1, 1}, {127, 0, 0, 2}},
+		port:       53,
+	}, {
+		want:       net.IP{192, 168, 1, 1},
+		name:       "first",
+		wantErrMsg: "",
+		hosts:      []net.IP{{192, 168, 1, 1}, {192, 168, 1, 2}},
+		port:       53,
+	}, {
+		want:       nil,
+		name:       "bad_port",
+		wantErrMsg: "dns port 5353 is not supported by system resolvers, need 53",
+		hosts:      nil,
+		port:       5353,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ip, err := pickSysDNSAddr(tc.hosts, tc.port)
+			if tc.wantErrMsg != "" {
+				require.Error(t, err)
+
+				assert.Equal(t, tc.wantErrMsg, err.Error())
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.want, ip)
+		})
+	}
+}
+
+func TestSysDNSBackup_files(t *testing.T) {
+	dir := t.TempDir()
+
+	existing := filepath.Join(dir, "existing")
+	err := os.WriteFile(existing, []byte("nameserver 1.2.3.4\n"), 0o644)
+	require.NoError(t, err)
+
+	empty := filepath.Join(dir, "empty")
+	err = os.WriteFile(empty, nil, 0o644)
+	require.NoError(t, err)
+
+	created := filepath.Join(dir, "created")
+
+	b := &sysDNSBackup{}
+	require.NoError(t, b.backupFile(existing))
+	require.NoError(t, b.backupFile(empty))
+	require.NoError(t, b.backupFile(created))
+
+	var link, target string
+	if runtime.GOOS != "windows" {
+		link, target = filepath.Join(dir, "link"), filepath.Join(dir, "target")
+		require.NoError(t, os.Symlink(target, link))
+		require.NoError(t, b.backupFile(link))
+	}
+
+	for _, p := range []string{existing, empty, created, link} {
+		if p == "" {
+			continue
+		}
+
+		_ = os.Remove(p)
+		require.NoError(t, os.WriteFile(p, []byte("nameserver 127.0.0.1\n"), 0o644))
+	}
+
+	require.NoError(t, b.restoreFiles())
+
+	data, err := os.ReadFile(existing)
+	require.NoError(t, err)
+	assert.Equal(t, "nameserver 1.2.3.4\n", string(data))
+
+	// The originally empty file is kept empty rather than removed.
+	data, err = os.ReadFile(empty)
+	require.NoError(t, err)
+	assert.Empty(t, data)
+
+	_, err = os.Stat(created)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	if link != "" {
+		got, lerr := os.Readlink(link)
+		require.NoError(t, lerr)
+		assert.Equal(t, target, got)
+	}
+}
@@ -0,0 +1,113 @@
+//go:build windows
+// +build windows
+
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// sysDNSMethodPowerShell is the method of setting the system DNS on Windows.
+const sysDNSMethodPowerShell = "powershell"
+
+// runPowerShell runs the PowerShell command.
+func runPowerShell(cmd string) (out string, err error) {
+	return runSysDNSCommand("powershell", "-NoProfile", "-NonInteractive", "-Command", cmd)
+}
+
+// psQuote returns s as a single-quoted PowerShell string.
+func psQuote(s string) (q string) {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// nicDNSServers is the entry of the output of Get-DnsClientServerAddress.
+type nicDNSServers struct {
+	InterfaceAlias  string   `json:"InterfaceAlias"`
+	ServerAddresses []string `json:"ServerAddresses"`
+}
+
+// adaptersDNSServers returns the IPv4 DNS servers of the active network
+// adapters by their names.
+func adaptersDNSServers() (servers map[string][]string, err error) {
+	out, err := runPowerShell(
+		"@(Get-NetAdapter | Where-Object Status -eq 'Up' | " +
+			"Get-DnsClientServerAddress -AddressFamily IPv4 | " +
+			"Select-Object InterfaceAlias, ServerAddresses) | ConvertTo-Json",
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var nics []nicDNSServers
+	if err = json.Unmarshal([]byte(out), &nics); err != nil {
+		return nil, fmt.Errorf("decoding adapters: %w", err)
+	}
+
+	servers = make(map[string][]string, len(nics))
+	for _, n := range nics {
+		servers[n.InterfaceAlias] = n.ServerAddresses
+	}
+
+	return servers, nil
+}
+
+// setSysDNS sets ip as the DNS server of every active network adapter.
+func setSysDNS(ip net.IP) (b *sysDNSBackup, err error) {
+	servers, err := adaptersDNSServers()
+	if err != nil {
+		return nil, err
+	}
+
+	b = &sysDNSBackup{
+		Servers: map[string][]string{},
+		Method:  sysDNSMethodPowerShell,
+	}
+	for nic, ss := range servers {
+		b.Servers[nic] = ss
+		_, err = runPowerShell(fmt.Sprintf(
+			"Set-DnsClientServerAddress -InterfaceAlias %s -ServerAddresses %s",
+			psQuote(nic),
+			psQuote(ip.String()),
+		))
+		if err != nil {
+			return b, err
+		}
+	}
+
+	return b, nil
+}
+
+// restoreSysDNS restores the DNS servers of the network adapters from b.  Note
+// that the servers obtained via DHCP are indistinguishable from the static ones
+// in the output of Get-DnsClientServerAddress, so they are restored as static.
+func restoreSysDNS(b *sysDNSBackup) (err error) {
+	var errs []error
+	for nic, servers := range b.Servers {
+		cmd := "Set-DnsClientServerAddress -InterfaceAlias " + psQuote(nic)
+		if len(servers) == 0 {
+			cmd += " -ResetServerAddresses"
+		} else {
+			quoted := make([]string, 0, len(servers))
+			for _, s := range servers {
+				quoted = append(quoted, psQuote(s))
+			}
+
+			cmd += " -ServerAddresses " + strings.Join(quoted, ",")
+		}
+
+		if _, err = runPowerShell(cmd); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.List("restoring dns servers", errs...)
+	}
+
+	return nil
+}
@@ -25,6 +25,7 @@ import (
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"golang.org/x/sys/cpu"
 )
 
@@ -52,6 +53,10 @@ func tlsCreate(conf tlsConfigSettings) *TLSMod {
 				PortDNSOverTLS:      conf.PortDNSOverTLS,
 				PortDNSOverQUIC:     conf.PortDNSOverQUIC,
 				AllowUnencryptedDoH: conf.AllowUnencryptedDoH,
+				DoTBindHosts:        conf.DoTBindHosts,
+				DoQBindHosts:        conf.DoQBindHosts,
+				HTTPSBindHosts:      conf.HTTPSBindHosts,
+				EnableHTTP3:         conf.EnableHTTP3,
 			}}
 		}
 		t.setCertFileTime()
@@ -66,7 +71,7 @@ func (t *TLSMod) load() bool {
 	}
 
 	// validate current TLS config and update warnings (it could have been loaded from file)
-	data := validateCertificates(string(t.conf.CertificateChainData), string(t.conf.PrivateKeyData), t.conf.ServerName)
+	data := validateTLSSettings(&t.conf)
 	if !data.ValidPair {
 		log.Error("failed to validate certificate: %s", data.WarningValidation)
 		return false
@@ -98,6 +103,24 @@ func (t *TLSMod) setCertFileTime() {
 	t.certLastMod = fi.ModTime().UTC()
 }
 
+// certNotAfter returns the expiration time of the current certificate.  It's
+// zero if the encryption is disabled or there is no valid certificate.  t may
+// be nil.
+func (t *TLSMod) certNotAfter() (notAfter time.Time) {
+	if t == nil {
+		return time.Time{}
+	}
+
+	t.confLock.Lock()
+	defer t.confLock.Unlock()
+
+	if !t.conf.Enabled || !t.status.ValidCert {
+		return time.Time{}
+	}
+
+	return t.status.NotAfter
+}
+
 // Start updates the configuration of TLSMod and starts it.
 func (t *TLSMod) Start() {
 	if !tlsWebHandlersRegistered {
@@ -159,6 +182,7 @@ func (t *TLSMod) Reload() {
 func tlsLoadConfig(tls *tlsConfigSettings, status *tlsConfigStatus) bool {
 	tls.CertificateChainData = []byte(tls.CertificateChain)
 	tls.PrivateKeyData = []byte(tls.PrivateKey)
+	tls.PrivateKeySigner = nil
 
 	var err error
 	if tls.CertificatePath != "" {
@@ -187,6 +211,25 @@ func tlsLoadConfig(tls *tlsConfigSettings, status *tlsConfigStatus) bool {
 		status.ValidKey = true
 	}
 
+	if tls.PrivateKeyURI != "" {
+		if tls.PrivateKey != "" || tls.PrivateKeyPath != "" {
+			status.WarningValidation = "private key uri can't be set together with private key data or file"
+			return false
+		}
+		tls.PrivateKeySigner, err = openKeySigner(tls.PrivateKeyURI)
+		if err != nil {
+			status.WarningValidation = err.Error()
+			return false
+		}
+		status.ValidKey = true
+	}
+
+	tls.LocalAddrCerts, err = loadAddrCerts(tls.AddrCertificates)
+	if err != nil {
+		status.WarningValidation = err.Error()
+		return false
+	}
+
 	return true
 }
 
@@ -223,6 +266,9 @@ type tlsConfigSettingsExt struct {
 	// If private key saved as a string, we set this flag to true
 	// and omit key from answer.
 	PrivateKeySaved bool `yaml:"-" json:"private_key_saved,inline"`
+	// Provisional, if true, means that the new settings must be reverted
+	// unless they are confirmed within defaultConfirmTimeout.
+	Provisional bool `yaml:"-" json:"provisional"`
 }
 
 func (t *TLSMod) handleTLSStatus(w http.ResponseWriter, r *http.Request) {
@@ -249,6 +295,12 @@ func (t *TLSMod) handleTLSValidate(w http.ResponseWriter, r *http.Request) {
 		setts.PrivateKey = t.conf.PrivateKey
 	}
 
+	// The private key URI is only set in the configuration file, so keep it
+	// unless the key is replaced.
+	if setts.PrivateKey == "" && setts.PrivateKeyPath == "" {
+		setts.PrivateKeyURI = t.conf.PrivateKeyURI
+	}
+
 	if setts.Enabled {
 		if err = validatePorts(
 			config.BindPort,
@@ -279,7 +331,7 @@ func (t *TLSMod) handleTLSValidate(w http.ResponseWriter, r *http.Request) {
 
 	status := tlsConfigStatus{}
 	if tlsLoadConfig(&setts.tlsConfigSettings, &status) {
-		status = validateCertificates(string(setts.CertificateChainData), string(setts.PrivateKeyData), setts.ServerName)
+		status = validateTLSSettings(&setts.tlsConfigSettings)
 	}
 
 	data := tlsConfig{
@@ -300,7 +352,19 @@ func (t *TLSMod) setConfig(newConf tlsConfigSettings, status tlsConfigStatus) (r
 	// TODO(a.garipov): Define a custom comparer for dnsforward.TLSConfig.
 	newConf.DNSCryptConfigFile = t.conf.DNSCryptConfigFile
 	newConf.PortDNSCrypt = t.conf.PortDNSCrypt
-	if !cmp.Equal(t.conf, newConf, cmp.AllowUnexported(dnsforward.TLSConfig{})) {
+
+	// The same goes for the per-address listeners and certificates.
+	newConf.DoTBindHosts = t.conf.DoTBindHosts
+	newConf.DoQBindHosts = t.conf.DoQBindHosts
+	newConf.HTTPSBindHosts = t.conf.HTTPSBindHosts
+	newConf.EnableHTTP3 = t.conf.EnableHTTP3
+	newConf.AddrCertificates = t.conf.AddrCertificates
+	if !cmp.Equal(
+		t.conf,
+		newConf,
+		cmp.AllowUnexported(dnsforward.TLSConfig{}),
+		cmpopts.IgnoreFields(dnsforward.TLSConfig{}, "LocalAddrCerts", "PrivateKeySigner"),
+	) {
 		log.Info("tls config has changed, restarting https server")
 		restartHTTPS = true
 	} else {
@@ -320,6 +384,8 @@ func (t *TLSMod) setConfig(newConf tlsConfigSettings, status tlsConfigStatus) (r
 	t.conf.PrivateKey = newConf.PrivateKey
 	t.conf.PrivateKeyPath = newConf.PrivateKeyPath
 	t.conf.PrivateKeyData = newConf.PrivateKeyData
+	t.conf.PrivateKeyURI = newConf.PrivateKeyURI
+	t.conf.PrivateKeySigner = newConf.PrivateKeySigner
 	t.status = status
 
 	return restartHTTPS
@@ -337,6 +403,12 @@ func (t *TLSMod) handleTLSConfigure(w http.ResponseWriter, r *http.Request) {
 		data.PrivateKey = t.conf.PrivateKey
 	}
 
+	// The private key URI is only set in the configuration file, so keep it
+	// unless the key is replaced.
+	if data.PrivateKey == "" && data.PrivateKeyPath == "" {
+		data.PrivateKeyURI = t.conf.PrivateKeyURI
+	}
+
 	if data.Enabled {
 		if err = validatePorts(
 			config.BindPort,
@@ -377,7 +449,22 @@ func (t *TLSMod) handleTLSConfigure(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	status = validateCertificates(string(data.CertificateChainData), string(data.PrivateKeyData), data.ServerName)
+	status = validateTLSSettings(&data.tlsConfigSettings)
+
+	if data.Provisional {
+		t.confLock.Lock()
+		prevConf, prevStatus := t.conf, t.status
+		t.confLock.Unlock()
+
+		err = Context.confirm.begin(defaultConfirmTimeout, func() {
+			t.revert(prevConf, prevStatus)
+		})
+		if err != nil {
+			aghhttp.Error(r, w, http.StatusConflict, "%s", err)
+
+			return
+		}
+	}
 
 	restartHTTPS := t.setConfig(data.tlsConfigSettings, status)
 	t.setCertFileTime()
@@ -405,12 +492,35 @@ func (t *TLSMod) handleTLSConfigure(w http.ResponseWriter, r *http.Request) {
 	// request. It is also should be done in a separate goroutine due to the
 	// same reason.
 	if restartHTTPS {
+		// Use the stored configuration, since it also contains the settings,
+		// which aren't accepted from the frontend.
+		t.confLock.Lock()
+		webConf := t.conf
+		t.confLock.Unlock()
+
 		go func() {
-			Context.web.TLSConfigChanged(context.Background(), data.tlsConfigSettings)
+			Context.web.TLSConfigChanged(context.Background(), webConf)
 		}()
 	}
 }
 
+// revert restores the previous TLS settings after an unconfirmed provisional
+// change.
+func (t *TLSMod) revert(prevConf tlsConfigSettings, prevStatus tlsConfigStatus) {
+	restartHTTPS := t.setConfig(prevConf, prevStatus)
+	t.setCertFileTime()
+	onConfigModified()
+
+	err := reconfigureDNSServer()
+	if err != nil {
+		log.Error("tls: reverting: %s", err)
+	}
+
+	if restartHTTPS {
+		Context.web.TLSConfigChanged(context.Background(), prevConf)
+	}
+}
+
 func verifyCertChain(data *tlsConfigStatus, certChain, serverName string) error {
 	log.Tracef("TLS: got certificate: %d bytes", len(certChain))
 
@@ -0,0 +1,59 @@
+package home
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+)
+
+// addrCertificate is the certificate used for the encrypted connections
+// accepted on a particular local IP address.
+type addrCertificate struct {
+	// IP is the local address.
+	IP net.IP `yaml:"ip"`
+
+	// CertificatePath is the path to the PEM-encoded certificates chain.
+	CertificatePath string `yaml:"certificate_path"`
+
+	// PrivateKeyPath is the path to the PEM-encoded private key.
+	PrivateKeyPath string `yaml:"private_key_path"`
+}
+
+// loadAddrCerts loads the certificates from confs.  certs are nil if confs are
+// empty.
+func loadAddrCerts(confs []*addrCertificate) (certs map[string]*tls.Certificate, err error) {
+	if len(confs) == 0 {
+		return nil, nil
+	}
+
+	certs = make(map[string]*tls.Certificate, len(confs))
+	for i, c := range confs {
+		if c == nil || c.IP == nil {
+			return nil, fmt.Errorf("address certificate at index %d: no ip", i)
+		}
+
+		key := c.IP.String()
+		if _, ok := certs[key]; ok {
+			return nil, fmt.Errorf("address certificate at index %d: duplicate ip %s", i, key)
+		}
+
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(c.CertificatePath, c.PrivateKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("address certificate for %s: %w", key, err)
+		}
+
+		certs[key] = &cert
+	}
+
+	return certs, nil
+}
+
+// bindHostsOr returns hosts if it's not empty, and def otherwise.
+func bindHostsOr(hosts, def []net.IP) (res []net.IP) {
+	if len(hosts) > 0 {
+		return hosts
+	}
+
+	return def
+}
@@ -0,0 +1,180 @@
+package home
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCert writes a new self-signed certificate for name and its private
+// key into dir and returns the paths.
+func writeTestCert(t *testing.T, dir, name string) (certPath, keyPath string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPath = filepath.Join(dir, name+".crt")
+	keyPath = filepath.Join(dir, name+".key")
+
+	err = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	require.NoError(t, err)
+
+	err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	require.NoError(t, err)
+
+	return certPath, keyPath
+}
+
+func TestLoadAddrCerts(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeTestCert(t, dir, "lan.example")
+
+	ip := net.ParseIP("2001:db8::1")
+
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		confs      []*addrCertificate
+		wantLen    int
+	}{{
+		name:       "empty",
+		wantErrMsg: "",
+		confs:      nil,
+		wantLen:    0,
+	}, {
+		name:       "success",
+		wantErrMsg: "",
+		confs: []*addrCertificate{{
+			IP:              ip,
+			CertificatePath: certPath,
+			PrivateKeyPath:  keyPath,
+		}},
+		wantLen: 1,
+	}, {
+		name:       "no_ip",
+		wantErrMsg: "address certificate at index 0: no ip",
+		confs: []*addrCertificate{{
+			CertificatePath: certPath,
+			PrivateKeyPath:  keyPath,
+		}},
+		wantLen: 0,
+	}, {
+		name:       "duplicate",
+		wantErrMsg: "address certificate at index 1: duplicate ip 2001:db8::1",
+		confs: []*addrCertificate{{
+			IP:              ip,
+			CertificatePath: certPath,
+			PrivateKeyPath:  keyPath,
+		}, {
+			IP:              ip,
+			CertificatePath: certPath,
+			PrivateKeyPath:  keyPath,
+		}},
+		wantLen: 0,
+	}, {
+		name: "bad_key",
+		wantErrMsg: "address certificate for 2001:db8::1: " +
+			"tls: found a certificate rather than a key in the PEM for the private key",
+		confs: []*addrCertificate{{
+			IP:              ip,
+			CertificatePath: certPath,
+			PrivateKeyPath:  certPath,
+		}},
+		wantLen: 0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			certs, err := loadAddrCerts(tc.confs)
+			if tc.wantErrMsg != "" {
+				require.Error(t, err)
+
+				assert.Equal(t, tc.wantErrMsg, err.Error())
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Len(t, certs, tc.wantLen)
+		})
+	}
+}
+
+// testAddrConn is a net.Conn with a fixed local address.
+type testAddrConn struct {
+	net.Conn
+
+	laddr net.Addr
+}
+
+// LocalAddr implements the net.Conn interface for *testAddrConn.
+func (c *testAddrConn) LocalAddr() (addr net.Addr) {
+	return c.laddr
+}
+
+func TestCertGetter(t *testing.T) {
+	lanCert := &tls.Certificate{Certificate: [][]byte{{1}}}
+	def := tls.Certificate{Certificate: [][]byte{{2}}}
+
+	get := certGetter(def, map[string]*tls.Certificate{
+		"2001:db8::1": lanCert,
+	})
+
+	testCases := []struct {
+		conn net.Conn
+		want *tls.Certificate
+		name string
+	}{{
+		conn: &testAddrConn{laddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 853}},
+		want: lanCert,
+		name: "matched",
+	}, {
+		conn: &testAddrConn{laddr: &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 853}},
+		want: &def,
+		name: "other",
+	}, {
+		conn: nil,
+		want: &def,
+		name: "no_conn",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cert, err := get(&tls.ClientHelloInfo{Conn: tc.conn})
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.want.Certificate, cert.Certificate)
+		})
+	}
+
+	assert.Equal(t, []net.IP{{127, 0, 0, 1}}, bindHostsOr(nil, []net.IP{{127, 0, 0, 1}}))
+}
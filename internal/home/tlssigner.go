@@ -0,0 +1,215 @@
+package home
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// keySignerOpener opens the private key referenced by u, which is kept in a
+// hardware token, such as a PKCS#11 token.
+type keySignerOpener func(u *url.URL) (s crypto.Signer, err error)
+
+// keySignerOpeners are the openers of the private keys kept in the hardware
+// tokens by the URI schemes, for example "pkcs11" for the RFC 7512 URIs.  The
+// openers require cgo and the vendor libraries of the tokens, so they are
+// registered from the files built with the corresponding build tags, see
+// tlssigner_pkcs11.go.
+var keySignerOpeners = map[string]keySignerOpener{}
+
+// openKeySigner opens the private key referenced by uri.
+func openKeySigner(uri string) (s crypto.Signer, err error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("bad private key uri: %w", err)
+	}
+
+	open, ok := keySignerOpeners[u.Scheme]
+	if !ok {
+		schemes := make([]string, 0, len(keySignerOpeners))
+		for sch := range keySignerOpeners {
+			schemes = append(schemes, sch)
+		}
+		sort.Strings(schemes)
+
+		return nil, fmt.Errorf(
+			"private key uri scheme %q is not supported by this build, supported: %q",
+			u.Scheme,
+			schemes,
+		)
+	}
+
+	s, err = open(u)
+	if err != nil {
+		return nil, fmt.Errorf("opening private key from %s token: %w", u.Scheme, err)
+	}
+
+	return s, nil
+}
+
+// pkcs11URI is a parsed RFC 7512 PKCS#11 URI referencing a private key.
+type pkcs11URI struct {
+	// modulePath is the path to the PKCS#11 module of the token.
+	modulePath string
+
+	// token is the label of the token.
+	token string
+
+	// serial is the serial number of the token.
+	serial string
+
+	// object is the label of the key.
+	object string
+
+	// pin is the user PIN of the token.
+	pin string
+
+	// id is the ID of the key.
+	id []byte
+}
+
+// parsePKCS11URI parses the PKCS#11 URI u.  Besides the module-path and the
+// pin-value query attributes, the pin-source attribute is supported, which
+// must be the path to the file containing the PIN.
+func parsePKCS11URI(u *url.URL) (p *pkcs11URI, err error) {
+	p = &pkcs11URI{}
+	err = parsePKCS11Attrs(u.Opaque, ";", func(k, v string) (err error) {
+		switch k {
+		case "token":
+			p.token = v
+		case "serial":
+			p.serial = v
+		case "object":
+			p.object = v
+		case "id":
+			p.id = []byte(v)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("path: %w", err)
+	}
+
+	err = parsePKCS11Attrs(u.RawQuery, "&", func(k, v string) (err error) {
+		switch k {
+		case "module-path":
+			p.modulePath = v
+		case "pin-value":
+			p.pin = v
+		case "pin-source":
+			var pin []byte
+			pin, err = os.ReadFile(strings.TrimPrefix(v, "file:"))
+			if err != nil {
+				return fmt.Errorf("reading pin: %w", err)
+			}
+
+			p.pin = strings.TrimSpace(string(pin))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+
+	if p.modulePath == "" {
+		return nil, errors.Error("module-path is required")
+	} else if p.object == "" && p.id == nil {
+		return nil, errors.Error("object or id is required")
+	}
+
+	return p, nil
+}
+
+// parsePKCS11Attrs calls f for each percent-decoded attribute of s separated
+// by sep.
+func parsePKCS11Attrs(s, sep string, f func(k, v string) (err error)) (err error) {
+	if s == "" {
+		return nil
+	}
+
+	for _, attr := range strings.Split(s, sep) {
+		k, v, ok := strings.Cut(attr, "=")
+		if !ok {
+			return fmt.Errorf("attribute %q: no value", attr)
+		}
+
+		v, err = url.PathUnescape(v)
+		if err != nil {
+			return fmt.Errorf("attribute %q: %w", k, err)
+		}
+
+		err = f(k, v)
+		if err != nil {
+			return fmt.Errorf("attribute %q: %w", k, err)
+		}
+	}
+
+	return nil
+}
+
+// signerKeyType returns the type of the private key of s.
+func signerKeyType(s crypto.Signer) (typ string) {
+	switch s.Public().(type) {
+	case *rsa.PublicKey:
+		return keyTypeRSA
+	case *ecdsa.PublicKey:
+		return keyTypeECDSA
+	case ed25519.PublicKey:
+		return keyTypeED25519
+	default:
+		return ""
+	}
+}
+
+// validateTLSSettings validates the certificate chain and the private key
+// loaded into c.  On error, it returns a partially set status with the
+// WarningValidation field containing the error description.
+func validateTLSSettings(c *tlsConfigSettings) (data tlsConfigStatus) {
+	if c.PrivateKeySigner == nil {
+		return validateCertificates(
+			string(c.CertificateChainData),
+			string(c.PrivateKeyData),
+			c.ServerName,
+		)
+	}
+
+	certChain := string(c.CertificateChainData)
+	if certChain != "" && verifyCertChain(&data, certChain, c.ServerName) != nil {
+		return data
+	}
+
+	keyType := signerKeyType(c.PrivateKeySigner)
+	if keyType == keyTypeED25519 {
+		data.WarningValidation = "ED25519 keys are not supported by browsers; " +
+			"did you mean to use X25519 for key exchange?"
+
+		return data
+	}
+
+	data.ValidKey = true
+	data.KeyType = keyType
+	if certChain == "" {
+		return data
+	}
+
+	_, err := c.KeyPair()
+	if err != nil {
+		data.WarningValidation = fmt.Sprintf("Invalid certificate or key: %s", err)
+
+		return data
+	}
+
+	data.ValidPair = true
+
+	return data
+}
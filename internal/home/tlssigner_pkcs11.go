@@ -0,0 +1,96 @@
+//go:build pkcs11 && cgo
+// +build pkcs11,cgo
+
+package home
+
+import (
+	"crypto"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/ThalesIgnite/crypto11"
+)
+
+func init() {
+	keySignerOpeners["pkcs11"] = openPKCS11Signer
+}
+
+// pkcs11Token identifies an opened PKCS#11 token.
+type pkcs11Token struct {
+	modulePath string
+	token      string
+	serial     string
+}
+
+// pkcs11Contexts are the contexts of the opened PKCS#11 tokens.  The contexts
+// are kept open for the lifetime of the process, since the signers opened
+// from them are used by the TLS configurations, and a module can't be
+// initialized twice.
+var pkcs11Contexts = struct {
+	mu *sync.Mutex
+	m  map[pkcs11Token]*crypto11.Context
+}{
+	mu: &sync.Mutex{},
+	m:  map[pkcs11Token]*crypto11.Context{},
+}
+
+// openPKCS11Signer opens the private key referenced by the RFC 7512 PKCS#11
+// URI u.
+func openPKCS11Signer(u *url.URL) (s crypto.Signer, err error) {
+	p, err := parsePKCS11URI(u)
+	if err != nil {
+		return nil, fmt.Errorf("parsing uri: %w", err)
+	}
+
+	ctx, err := pkcs11Context(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var label []byte
+	if p.object != "" {
+		label = []byte(p.object)
+	}
+
+	signer, err := ctx.FindKeyPair(p.id, label)
+	if err != nil {
+		return nil, fmt.Errorf("finding key pair: %w", err)
+	} else if signer == nil {
+		return nil, errors.Error("key pair not found")
+	}
+
+	return signer, nil
+}
+
+// pkcs11Context returns the context of the token referenced by p, opening it
+// if necessary.
+func pkcs11Context(p *pkcs11URI) (ctx *crypto11.Context, err error) {
+	tok := pkcs11Token{
+		modulePath: p.modulePath,
+		token:      p.token,
+		serial:     p.serial,
+	}
+
+	pkcs11Contexts.mu.Lock()
+	defer pkcs11Contexts.mu.Unlock()
+
+	if ctx = pkcs11Contexts.m[tok]; ctx != nil {
+		return ctx, nil
+	}
+
+	ctx, err = crypto11.Configure(&crypto11.Config{
+		Path:        p.modulePath,
+		TokenLabel:  p.token,
+		TokenSerial: p.serial,
+		Pin:         p.pin,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("opening token: %w", err)
+	}
+
+	pkcs11Contexts.m[tok] = ctx
+
+	return ctx, nil
+}
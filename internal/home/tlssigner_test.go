@@ -0,0 +1,73 @@
+package home
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePKCS11URI(t *testing.T) {
+	pinPath := filepath.Join(t.TempDir(), "pin")
+	err := os.WriteFile(pinPath, []byte("5678\n"), 0o600)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		want       *pkcs11URI
+		name       string
+		uri        string
+		wantErrMsg string
+	}{{
+		want: &pkcs11URI{
+			modulePath: "/usr/lib/softhsm/libsofthsm2.so",
+			token:      "AdGuard Home",
+			object:     "dns",
+			pin:        "1234",
+		},
+		name: "object",
+		uri: "pkcs11:token=AdGuard%20Home;object=dns" +
+			"?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-value=1234",
+		wantErrMsg: "",
+	}, {
+		want: &pkcs11URI{
+			modulePath: "/lib/p11.so",
+			serial:     "0123",
+			pin:        "5678",
+			id:         []byte{0x01, 0xa2},
+		},
+		name:       "id_pin_source",
+		uri:        "pkcs11:serial=0123;id=%01%a2?module-path=/lib/p11.so&pin-source=file:" + pinPath,
+		wantErrMsg: "",
+	}, {
+		want:       nil,
+		name:       "no_module",
+		uri:        "pkcs11:object=dns",
+		wantErrMsg: "module-path is required",
+	}, {
+		want:       nil,
+		name:       "no_key",
+		uri:        "pkcs11:token=t?module-path=/lib/p11.so",
+		wantErrMsg: "object or id is required",
+	}, {
+		want:       nil,
+		name:       "bad_attr",
+		uri:        "pkcs11:object?module-path=/lib/p11.so",
+		wantErrMsg: `path: attribute "object": no value`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := url.Parse(tc.uri)
+			require.NoError(t, err)
+
+			p, err := parsePKCS11URI(u)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.want, p)
+		})
+	}
+}
@@ -3,6 +3,8 @@ package home
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"io/fs"
 	"net"
 	"net/http"
@@ -10,9 +12,12 @@ import (
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/NYTimes/gziphandler"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
 )
 
 // HTTP scheme constants.
@@ -39,6 +44,14 @@ type webConfig struct {
 	PortHTTPS    int
 	firstRun     bool
 
+	// BasePath is the normalized URL path prefix of the web UI and the
+	// control API.  It always starts and ends with a slash.
+	BasePath string
+
+	// HTTPSBindHosts are the addresses the HTTPS server listens on.  If
+	// empty, BindHost is used.
+	HTTPSBindHosts []net.IP
+
 	clientFS     fs.FS
 	clientBetaFS fs.FS
 
@@ -63,6 +76,22 @@ type HTTPSServer struct {
 	shutdown bool // if TRUE, don't restart the server
 	enabled  bool
 	cert     tls.Certificate
+
+	// addrCerts are the certificates used instead of cert for the
+	// connections accepted on the particular local addresses.
+	addrCerts map[string]*tls.Certificate
+
+	// server3 serves the HTTP/3 requests.  It's nil if HTTP/3 is disabled.
+	server3 *http3.Server
+
+	// enableHTTP3 is true if the HTTP/3 requests should be served as well.
+	enableHTTP3 bool
+
+	// clientCAs are the CAs used to verify the client certificates, if the
+	// clients present them.  The DNS-over-HTTPS requests are refused without
+	// a valid certificate.  It's nil if the client certificates aren't
+	// requested.
+	clientCAs *x509.CertPool
 }
 
 // Web - module object
@@ -123,19 +152,29 @@ func WebCheckPortAvailable(port int) bool {
 func (web *Web) TLSConfigChanged(ctx context.Context, tlsConf tlsConfigSettings) {
 	log.Debug("Web: applying new TLS configuration")
 	web.conf.PortHTTPS = tlsConf.PortHTTPS
+	web.conf.HTTPSBindHosts = tlsConf.HTTPSBindHosts
 	web.forceHTTPS = (tlsConf.ForceHTTPS && tlsConf.Enabled && tlsConf.PortHTTPS != 0)
 
 	enabled := tlsConf.Enabled &&
 		tlsConf.PortHTTPS != 0 &&
-		len(tlsConf.PrivateKeyData) != 0 &&
-		len(tlsConf.CertificateChainData) != 0
+		tlsConf.HasKeyPair()
 	var cert tls.Certificate
+	var clientCAs *x509.CertPool
 	var err error
 	if enabled {
-		cert, err = tls.X509KeyPair(tlsConf.CertificateChainData, tlsConf.PrivateKeyData)
+		cert, err = tlsConf.KeyPair()
 		if err != nil {
 			log.Fatal(err)
 		}
+
+		if tlsConf.ClientCAPath != "" {
+			clientCAs, err = dnsforward.LoadClientCAs(tlsConf.ClientCAPath)
+			if err != nil {
+				// Don't fail, since the DNS-over-HTTPS requests are
+				// refused without the client certificates anyway.
+				log.Error("web: loading client cas: %s", err)
+			}
+		}
 	}
 
 	web.httpsServer.cond.L.Lock()
@@ -146,8 +185,13 @@ func (web *Web) TLSConfigChanged(ctx context.Context, tlsConf tlsConfigSettings)
 		cancel()
 	}
 
+	closeHTTP3(web.httpsServer.server3)
+
 	web.httpsServer.enabled = enabled
+	web.httpsServer.enableHTTP3 = tlsConf.EnableHTTP3
+	web.httpsServer.clientCAs = clientCAs
 	web.httpsServer.cert = cert
+	web.httpsServer.addrCerts = tlsConf.LocalAddrCerts
 	web.httpsServer.cond.Broadcast()
 	web.httpsServer.cond.L.Unlock()
 }
@@ -159,35 +203,45 @@ func (web *Web) Start() {
 	// for https, we have a separate goroutine loop
 	go web.tlsServerLoop()
 
+	waitBindAddrs([]net.IP{web.conf.BindHost}, bindWaitTimeout, bindWaitIvl)
+
 	// this loop is used as an ability to change listening host and/or port
 	for !web.httpsServer.shutdown {
 		printHTTPAddresses(schemeHTTP)
 		errs := make(chan error, 2)
 
-		hostStr := web.conf.BindHost.String()
+		// The bind address may be changed concurrently by setBindAddr.
+		config.RLock()
+		hostStr, port := web.conf.BindHost.String(), web.conf.BindPort
+		config.RUnlock()
+
 		// we need to have new instance, because after Shutdown() the Server is not usable
 		web.httpServer = &http.Server{
 			ErrorLog:          log.StdLog("web: plain", log.DEBUG),
-			Addr:              netutil.JoinHostPort(hostStr, web.conf.BindPort),
-			Handler:           withMiddlewares(Context.mux, limitRequestBody),
+			Addr:              netutil.JoinHostPort(hostStr, uint16(port)),
+			Handler:           withMiddlewares(Context.mux, limitRequestBody, web.wrapBasePath),
 			ReadTimeout:       web.conf.ReadTimeout,
 			ReadHeaderTimeout: web.conf.ReadHeaderTimeout,
 			WriteTimeout:      web.conf.WriteTimeout,
 		}
 		go func() {
+			defer onPanicReport("web: serving http")
+
 			errs <- web.httpServer.ListenAndServe()
 		}()
 
 		if web.conf.BetaBindPort != 0 {
 			web.httpServerBeta = &http.Server{
 				ErrorLog:          log.StdLog("web: plain", log.DEBUG),
-				Addr:              netutil.JoinHostPort(hostStr, web.conf.BetaBindPort),
-				Handler:           withMiddlewares(Context.mux, limitRequestBody, web.wrapIndexBeta),
+				Addr:              netutil.JoinHostPort(hostStr, uint16(web.conf.BetaBindPort)),
+				Handler:           withMiddlewares(Context.mux, limitRequestBody, web.wrapIndexBeta, web.wrapBasePath),
 				ReadTimeout:       web.conf.ReadTimeout,
 				ReadHeaderTimeout: web.conf.ReadHeaderTimeout,
 				WriteTimeout:      web.conf.WriteTimeout,
 			}
 			go func() {
+				defer onPanicReport("web: serving beta http")
+
 				betaErr := web.httpServerBeta.ListenAndServe()
 				if betaErr != nil {
 					log.Error("starting beta http server: %s", betaErr)
@@ -217,6 +271,7 @@ func (web *Web) Close(ctx context.Context) {
 	defer cancel()
 
 	shutdownSrv(ctx, web.httpsServer.server)
+	closeHTTP3(web.httpsServer.server3)
 	shutdownSrv(ctx, web.httpServer)
 	shutdownSrv(ctx, web.httpServerBeta)
 
@@ -224,6 +279,8 @@ func (web *Web) Close(ctx context.Context) {
 }
 
 func (web *Web) tlsServerLoop() {
+	defer onPanicReport("web: tls server")
+
 	for {
 		web.httpsServer.cond.L.Lock()
 		if web.httpsServer.shutdown {
@@ -243,27 +300,173 @@ func (web *Web) tlsServerLoop() {
 		web.httpsServer.cond.L.Unlock()
 
 		// prepare HTTPS server
-		address := netutil.JoinHostPort(web.conf.BindHost.String(), web.conf.PortHTTPS)
+		hosts := bindHostsOr(web.conf.HTTPSBindHosts, []net.IP{web.conf.BindHost})
+		address := netutil.JoinHostPort(hosts[0].String(), uint16(web.conf.PortHTTPS))
+		tlsConf := &tls.Config{
+			GetCertificate: certGetter(web.httpsServer.cert, web.httpsServer.addrCerts),
+			MinVersion:     tls.VersionTLS12,
+			RootCAs:        Context.tlsRoots,
+			CipherSuites:   Context.tlsCiphers,
+		}
+		if web.httpsServer.clientCAs != nil {
+			tlsConf.ClientCAs = web.httpsServer.clientCAs
+			tlsConf.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+
+		handler := withMiddlewares(Context.mux, limitRequestBody, web.wrapBasePath)
+
+		web.httpsServer.server3 = nil
+		if web.httpsServer.enableHTTP3 {
+			web.httpsServer.server3 = &http3.Server{
+				Handler:   handler,
+				TLSConfig: tlsConf,
+				// Don't allow 0-RTT, since the early data can be replayed,
+				// and not all requests to the control API are idempotent.
+				QuicConfig: &quic.Config{},
+			}
+			handler = withAltSvc(handler, web.conf.PortHTTPS)
+		}
+
 		web.httpsServer.server = &http.Server{
-			ErrorLog: log.StdLog("web: https", log.DEBUG),
-			Addr:     address,
-			TLSConfig: &tls.Config{
-				Certificates: []tls.Certificate{web.httpsServer.cert},
-				MinVersion:   tls.VersionTLS12,
-				RootCAs:      Context.tlsRoots,
-				CipherSuites: Context.tlsCiphers,
-			},
-			Handler:           withMiddlewares(Context.mux, limitRequestBody),
+			ErrorLog:          log.StdLog("web: https", log.DEBUG),
+			Addr:              address,
+			TLSConfig:         tlsConf,
+			Handler:           handler,
 			ReadTimeout:       web.conf.ReadTimeout,
 			ReadHeaderTimeout: web.conf.ReadHeaderTimeout,
 			WriteTimeout:      web.conf.WriteTimeout,
 		}
 
+		waitBindAddrs(hosts, bindWaitTimeout, bindWaitIvl)
+
 		printHTTPAddresses(schemeHTTPS)
-		err := web.httpsServer.server.ListenAndServeTLS("", "")
+		err := web.serveHTTPS(hosts)
 		if err != http.ErrServerClosed {
 			cleanupAlways()
 			log.Fatal(err)
 		}
 	}
 }
+
+// certGetter returns a function returning the certificate from addrCerts for
+// the local address of the connection, or def if there is none.
+func certGetter(
+	def tls.Certificate,
+	addrCerts map[string]*tls.Certificate,
+) (f func(ch *tls.ClientHelloInfo) (cert *tls.Certificate, err error)) {
+	return func(ch *tls.ClientHelloInfo) (cert *tls.Certificate, err error) {
+		if c, ok := addrCerts[localIPString(ch.Conn)]; ok {
+			return c, nil
+		}
+
+		return &def, nil
+	}
+}
+
+// localIPString returns the string representation of the local IP address of
+// conn or an empty string, if there is none.
+func localIPString(conn net.Conn) (s string) {
+	if conn == nil {
+		return ""
+	}
+
+	ip, _ := netutil.IPAndPortFromAddr(conn.LocalAddr())
+	if ip == nil {
+		return ""
+	}
+
+	return ip.String()
+}
+
+// serveHTTPS listens on each of hosts and serves the HTTPS requests until the
+// server is closed or fails.
+func (web *Web) serveHTTPS(hosts []net.IP) (err error) {
+	srv := web.httpsServer.server
+
+	listeners := make([]net.Listener, 0, len(hosts))
+	for _, h := range hosts {
+		var l net.Listener
+		l, err = net.Listen("tcp", netutil.JoinHostPort(h.String(), uint16(web.conf.PortHTTPS)))
+		if err != nil {
+			for _, prev := range listeners {
+				_ = prev.Close()
+			}
+
+			return err
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	if srv3 := web.httpsServer.server3; srv3 != nil {
+		web.serveHTTP3(srv3, hosts)
+	}
+
+	errCh := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			defer onPanicReport("web: serving https")
+
+			errCh <- srv.ServeTLS(l, "", "")
+		}(l)
+	}
+
+	err = <-errCh
+	if err != http.ErrServerClosed {
+		// Stop serving on the other listeners as well.
+		_ = srv.Close()
+	}
+
+	return err
+}
+
+// serveHTTP3 starts serving the HTTP/3 requests with srv on each of hosts.
+// The failures are only logged, since HTTPS keeps working without HTTP/3.
+func (web *Web) serveHTTP3(srv *http3.Server, hosts []net.IP) {
+	for _, h := range hosts {
+		addr := netutil.JoinHostPort(h.String(), uint16(web.conf.PortHTTPS))
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			log.Error("web: listening for http/3 on %s: %s", addr, err)
+
+			continue
+		}
+
+		go func() {
+			defer onPanicReport("web: serving http/3")
+
+			serveErr := srv.Serve(conn)
+			if serveErr != http.ErrServerClosed {
+				log.Error("web: serving http/3 on %s: %s", addr, serveErr)
+			}
+
+			_ = conn.Close()
+		}()
+	}
+}
+
+// closeHTTP3 closes srv, if it's not nil.
+func closeHTTP3(srv *http3.Server) {
+	if srv == nil {
+		return
+	}
+
+	err := srv.Close()
+	if err != nil {
+		log.Debug("web: closing http/3 server: %s", err)
+	}
+}
+
+// withAltSvc returns a handler advertising HTTP/3 on port via the Alt-Svc
+// header to the clients, which don't use it yet.
+func withAltSvc(h http.Handler, port int) (wrapped http.Handler) {
+	altSvc := fmt.Sprintf(`h3=":%d"; ma=2592000`, port)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			w.Header().Set("Alt-Svc", altSvc)
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
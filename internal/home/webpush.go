@@ -0,0 +1,301 @@
+package home
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Web Push parameters.  See RFC 8030, RFC 8291, and RFC 8292.
+const (
+	// webPushTTL is the time in seconds, during which the push service keeps
+	// an undelivered notification.
+	webPushTTL = 24 * 60 * 60
+
+	// webPushRecordSize is the record size of the encrypted content.  The
+	// whole payload always fits into a single record.
+	webPushRecordSize = 4096
+
+	// webPushMaxPayload is the maximum length of the unencrypted payload,
+	// which is the size of the record without the padding delimiter and the
+	// authentication tag.
+	webPushMaxPayload = webPushRecordSize - 1 - 16
+
+	// vapidTokenTTL is the validity period of the VAPID tokens.  RFC 8292
+	// limits it to 24 hours.
+	vapidTokenTTL = 12 * time.Hour
+
+	// authSecretLen is the length of the authentication secret of a push
+	// subscription.
+	authSecretLen = 16
+)
+
+// errWebPushGone is returned by sendWebPush when the push service reports that
+// the subscription has expired or has been removed.
+const errWebPushGone errors.Error = "subscription is gone"
+
+// decodeBase64URL decodes the base64url-encoded s with or without padding.
+func decodeBase64URL(s string) (b []byte, err error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// newVAPIDKey generates a new VAPID private key and returns it in the
+// base64url encoding.
+func newVAPIDKey() (s string, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(key.D.FillBytes(make([]byte, 32))), nil
+}
+
+// parseVAPIDKey parses the base64url-encoded VAPID private key.
+func parseVAPIDKey(s string) (key *ecdsa.PrivateKey, err error) {
+	b, err := decodeBase64URL(s)
+	if err != nil {
+		return nil, fmt.Errorf("decoding vapid key: %w", err)
+	}
+
+	curve := elliptic.P256()
+	d := new(big.Int).SetBytes(b)
+	if len(b) != 32 || d.Sign() == 0 || d.Cmp(curve.Params().N) >= 0 {
+		return nil, errors.Error("bad vapid key")
+	}
+
+	key = &ecdsa.PrivateKey{D: d}
+	key.Curve = curve
+	key.X, key.Y = curve.ScalarBaseMult(b)
+
+	return key, nil
+}
+
+// vapidPublicKey returns the base64url-encoded uncompressed public key of key,
+// which is the "applicationServerKey" of the push subscriptions.
+func vapidPublicKey(key *ecdsa.PrivateKey) (s string) {
+	return base64.RawURLEncoding.EncodeToString(elliptic.Marshal(key.Curve, key.X, key.Y))
+}
+
+// vapidAuthorization returns the value of the Authorization header for the
+// request to the push service at endpoint as of now.  subject is the contact
+// of the administrator.
+func vapidAuthorization(
+	key *ecdsa.PrivateKey,
+	endpoint string,
+	subject string,
+	now time.Time,
+) (auth string, err error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("parsing endpoint: %w", err)
+	}
+
+	claims, err := json.Marshal(&struct {
+		Aud string `json:"aud"`
+		Sub string `json:"sub,omitempty"`
+		Exp int64  `json:"exp"`
+	}{
+		Aud: u.Scheme + "://" + u.Host,
+		Sub: subject,
+		Exp: now.Add(vapidTokenTTL).Unix(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("encoding claims: %w", err)
+	}
+
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`)) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+
+	r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+	if err != nil {
+		return "", fmt.Errorf("signing token: %w", err)
+	}
+
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	return fmt.Sprintf(
+		"vapid t=%s.%s, k=%s",
+		unsigned,
+		enc.EncodeToString(sig),
+		vapidPublicKey(key),
+	), nil
+}
+
+// encryptWebPush encrypts payload for the user agent with the public key
+// p256dh and the authentication secret auth, both base64url-encoded, using the
+// aes128gcm content encoding.
+func encryptWebPush(payload []byte, p256dh, auth string) (body []byte, err error) {
+	if len(payload) > webPushMaxPayload {
+		return nil, fmt.Errorf("payload is too long: %d bytes", len(payload))
+	}
+
+	uaPub, authSecret, err := decodeSubscriptionKeys(p256dh, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	curve := elliptic.P256()
+	uaX, uaY := elliptic.Unmarshal(curve, uaPub)
+
+	asPriv, asX, asY, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generating key: %w", err)
+	}
+
+	asPub := elliptic.Marshal(curve, asX, asY)
+	sx, _ := curve.ScalarMult(uaX, uaY, asPriv)
+	ecdhSecret := sx.FillBytes(make([]byte, 32))
+
+	salt := make([]byte, 16)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return nil, fmt.Errorf("generating salt: %w", err)
+	}
+
+	cek, nonce, err := webPushKeys(ecdhSecret, authSecret, salt, uaPub, asPub)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	buf.Write(salt)
+	_ = binary.Write(buf, binary.BigEndian, uint32(webPushRecordSize))
+	buf.WriteByte(byte(len(asPub)))
+	buf.Write(asPub)
+
+	// The delimiter of the last record, no padding.
+	plain := append(append([]byte{}, payload...), 0x02)
+
+	return gcm.Seal(buf.Bytes(), nonce, plain, nil), nil
+}
+
+// decodeSubscriptionKeys decodes and validates the keys of a push
+// subscription.
+func decodeSubscriptionKeys(p256dh, auth string) (uaPub, authSecret []byte, err error) {
+	uaPub, err = decodeBase64URL(p256dh)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding p256dh: %w", err)
+	}
+
+	if x, _ := elliptic.Unmarshal(elliptic.P256(), uaPub); x == nil {
+		return nil, nil, errors.Error("p256dh is not a p-256 public key")
+	}
+
+	authSecret, err = decodeBase64URL(auth)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding auth: %w", err)
+	}
+
+	if len(authSecret) != authSecretLen {
+		return nil, nil, fmt.Errorf("auth must be %d bytes long, got %d", authSecretLen, len(authSecret))
+	}
+
+	return uaPub, authSecret, nil
+}
+
+// webPushKeys derives the content encryption key and the nonce as defined in
+// RFC 8291.
+func webPushKeys(ecdhSecret, authSecret, salt, uaPub, asPub []byte) (cek, nonce []byte, err error) {
+	keyInfo := append([]byte("WebPush: info\x00"), uaPub...)
+	keyInfo = append(keyInfo, asPub...)
+
+	ikm := make([]byte, 32)
+	_, err = io.ReadFull(hkdf.New(sha256.New, ecdhSecret, authSecret, keyInfo), ikm)
+	if err != nil {
+		return nil, nil, fmt.Errorf("deriving ikm: %w", err)
+	}
+
+	cek = make([]byte, 16)
+	_, err = io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: aes128gcm\x00")), cek)
+	if err != nil {
+		return nil, nil, fmt.Errorf("deriving cek: %w", err)
+	}
+
+	nonce = make([]byte, 12)
+	_, err = io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: nonce\x00")), nonce)
+	if err != nil {
+		return nil, nil, fmt.Errorf("deriving nonce: %w", err)
+	}
+
+	return cek, nonce, nil
+}
+
+// sendWebPush sends the encrypted payload to the push service of sub.  It
+// returns errWebPushGone if the subscription is no longer valid.
+func sendWebPush(
+	cli *http.Client,
+	key *ecdsa.PrivateKey,
+	subject string,
+	sub *webPushSubscription,
+	payload []byte,
+) (err error) {
+	body, err := encryptWebPush(payload, sub.P256DH, sub.Auth)
+	if err != nil {
+		return fmt.Errorf("encrypting: %w", err)
+	}
+
+	auth, err := vapidAuthorization(key, sub.Endpoint, subject, time.Now())
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(webPushTTL))
+	req.Header.Set("Urgency", "high")
+
+	resp, err := cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	// Drain the body to reuse the connection.
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	switch code := resp.StatusCode; {
+	case code == http.StatusNotFound, code == http.StatusGone:
+		return errWebPushGone
+	case code < 200 || code >= 300:
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	default:
+		return nil
+	}
+}
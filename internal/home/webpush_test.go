@@ -0,0 +1,253 @@
+package home
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testUserAgent is the key pair and the authentication secret of a browser
+// subscribed to the push notifications.
+type testUserAgent struct {
+	priv []byte
+	pub  []byte
+	auth []byte
+}
+
+// newTestUserAgent returns a new testUserAgent.
+func newTestUserAgent(t *testing.T) (ua *testUserAgent) {
+	t.Helper()
+
+	priv, x, y, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	ua = &testUserAgent{
+		priv: priv,
+		pub:  elliptic.Marshal(elliptic.P256(), x, y),
+		auth: make([]byte, authSecretLen),
+	}
+
+	_, err = rand.Read(ua.auth)
+	require.NoError(t, err)
+
+	return ua
+}
+
+// subscription returns the push subscription of ua with endpoint.
+func (ua *testUserAgent) subscription(endpoint string) (sub *webPushSubscription) {
+	return &webPushSubscription{
+		Endpoint: endpoint,
+		P256DH:   base64.RawURLEncoding.EncodeToString(ua.pub),
+		Auth:     base64.RawURLEncoding.EncodeToString(ua.auth),
+	}
+}
+
+// decrypt decrypts the aes128gcm-encoded body the way the browser does.
+func (ua *testUserAgent) decrypt(t *testing.T, body []byte) (payload []byte) {
+	t.Helper()
+
+	require.Greater(t, len(body), 21)
+
+	salt := body[:16]
+	assert.Equal(t, uint32(webPushRecordSize), binary.BigEndian.Uint32(body[16:20]))
+
+	idLen := int(body[20])
+	require.Greater(t, len(body), 21+idLen)
+
+	asPub := body[21 : 21+idLen]
+
+	curve := elliptic.P256()
+	asX, asY := elliptic.Unmarshal(curve, asPub)
+	require.NotNil(t, asX)
+
+	sx, _ := curve.ScalarMult(asX, asY, ua.priv)
+
+	cek, nonce, err := webPushKeys(sx.FillBytes(make([]byte, 32)), ua.auth, salt, ua.pub, asPub)
+	require.NoError(t, err)
+
+	block, err := aes.NewCipher(cek)
+	require.NoError(t, err)
+
+	gcm, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+
+	plain, err := gcm.Open(nil, nonce, body[21+idLen:], nil)
+	require.NoError(t, err)
+	require.NotEmpty(t, plain)
+
+	assert.Equal(t, byte(0x02), plain[len(plain)-1])
+
+	return plain[:len(plain)-1]
+}
+
+func TestEncryptWebPush(t *testing.T) {
+	ua := newTestUserAgent(t)
+	sub := ua.subscription("https://push.example/sub")
+
+	const payload = `{"title":"test"}`
+
+	body, err := encryptWebPush([]byte(payload), sub.P256DH, sub.Auth)
+	require.NoError(t, err)
+
+	assert.Equal(t, payload, string(ua.decrypt(t, body)))
+
+	t.Run("too_long", func(t *testing.T) {
+		_, err = encryptWebPush(make([]byte, webPushMaxPayload+1), sub.P256DH, sub.Auth)
+		assert.Error(t, err)
+	})
+
+	t.Run("bad_keys", func(t *testing.T) {
+		_, err = encryptWebPush([]byte(payload), sub.Auth, sub.Auth)
+		assert.Error(t, err)
+
+		_, err = encryptWebPush([]byte(payload), sub.P256DH, sub.P256DH)
+		assert.Error(t, err)
+	})
+}
+
+func TestParseVAPIDKey(t *testing.T) {
+	s, err := newVAPIDKey()
+	require.NoError(t, err)
+
+	key, err := parseVAPIDKey(s)
+	require.NoError(t, err)
+
+	assert.True(t, key.Curve.IsOnCurve(key.X, key.Y))
+
+	_, err = parseVAPIDKey(base64.RawURLEncoding.EncodeToString(make([]byte, 32)))
+	assert.Error(t, err)
+
+	_, err = parseVAPIDKey("AAAA")
+	assert.Error(t, err)
+}
+
+// verifyVAPID checks the VAPID authorization header auth and returns the
+// claims of the token.
+func verifyVAPID(t *testing.T, key *ecdsa.PrivateKey, auth string) (claims map[string]interface{}) {
+	t.Helper()
+
+	require.True(t, strings.HasPrefix(auth, "vapid t="))
+
+	parts := strings.SplitN(strings.TrimPrefix(auth, "vapid t="), ", k=", 2)
+	require.Len(t, parts, 2)
+
+	assert.Equal(t, vapidPublicKey(key), parts[1])
+
+	token := strings.Split(parts[0], ".")
+	require.Len(t, token, 3)
+
+	sig, err := base64.RawURLEncoding.DecodeString(token[2])
+	require.NoError(t, err)
+	require.Len(t, sig, 64)
+
+	sum := sha256.Sum256([]byte(token[0] + "." + token[1]))
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	assert.True(t, ecdsa.Verify(&key.PublicKey, sum[:], r, s))
+
+	b, err := base64.RawURLEncoding.DecodeString(token[1])
+	require.NoError(t, err)
+
+	err = json.Unmarshal(b, &claims)
+	require.NoError(t, err)
+
+	return claims
+}
+
+func TestVAPIDAuthorization(t *testing.T) {
+	s, err := newVAPIDKey()
+	require.NoError(t, err)
+
+	key, err := parseVAPIDKey(s)
+	require.NoError(t, err)
+
+	now := time.Unix(1600000000, 0)
+	auth, err := vapidAuthorization(key, "https://push.example:8443/sub/1", "mailto:admin@example.org", now)
+	require.NoError(t, err)
+
+	claims := verifyVAPID(t, key, auth)
+	assert.Equal(t, "https://push.example:8443", claims["aud"])
+	assert.Equal(t, "mailto:admin@example.org", claims["sub"])
+	assert.Equal(t, float64(now.Add(vapidTokenTTL).Unix()), claims["exp"])
+}
+
+func TestSendWebPush(t *testing.T) {
+	s, err := newVAPIDKey()
+	require.NoError(t, err)
+
+	key, err := parseVAPIDKey(s)
+	require.NoError(t, err)
+
+	ua := newTestUserAgent(t)
+
+	const payload = `{"title":"test"}`
+
+	var code int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		verifyVAPID(t, key, r.Header.Get("Authorization"))
+
+		assert.Equal(t, "aes128gcm", r.Header.Get("Content-Encoding"))
+		assert.NotEmpty(t, r.Header.Get("TTL"))
+
+		body, rerr := io.ReadAll(r.Body)
+		require.NoError(t, rerr)
+
+		assert.Equal(t, payload, string(ua.decrypt(t, body)))
+
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(srv.Close)
+
+	sub := ua.subscription(srv.URL + "/sub")
+
+	testCases := []struct {
+		wantErr error
+		name    string
+		code    int
+	}{{
+		wantErr: nil,
+		name:    "created",
+		code:    http.StatusCreated,
+	}, {
+		wantErr: errWebPushGone,
+		name:    "gone",
+		code:    http.StatusGone,
+	}, {
+		wantErr: errWebPushGone,
+		name:    "not_found",
+		code:    http.StatusNotFound,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			code = tc.code
+
+			err = sendWebPush(srv.Client(), key, "", sub, []byte(payload))
+			assert.ErrorIs(t, err, tc.wantErr)
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		code = http.StatusTooManyRequests
+
+		err = sendWebPush(srv.Client(), key, "", sub, []byte(payload))
+		require.Error(t, err)
+
+		assert.Contains(t, err.Error(), "unexpected status")
+	})
+}
@@ -246,6 +246,8 @@ func (w *WHOIS) Begin(ip net.IP) {
 // workerLoop processes the IP addresses it got from the channel and associates
 // the retrieving WHOIS info with a client.
 func (w *WHOIS) workerLoop() {
+	defer onPanicReport("whois")
+
 	for ip := range w.ipChan {
 		info := w.process(context.Background(), ip)
 		if info == nil {
@@ -0,0 +1,571 @@
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghwg"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// wireGuardConfig is the configuration of the built-in WireGuard endpoint,
+// which only serves DNS to the peers.
+type wireGuardConfig struct {
+	// BindHost is the IP address to listen on.  If it's nil, the endpoint
+	// listens on all addresses.
+	BindHost net.IP `yaml:"bind_host"`
+
+	// PrivateKey is the base64-encoded private key of the endpoint.  It's
+	// generated when the endpoint is enabled for the first time.
+	PrivateKey string `yaml:"private_key"`
+
+	// Addresses are the tunnel addresses of the DNS server.  The peers should
+	// use them as their DNS servers.
+	Addresses []net.IP `yaml:"addresses"`
+
+	// Peers are the peers allowed to connect.
+	Peers []*wireGuardPeer `yaml:"peers"`
+
+	// Port is the UDP port to listen on.  If zero, defaultWireGuardPort is
+	// used.
+	Port int `yaml:"port"`
+
+	// Enabled defines if the endpoint is enabled.
+	Enabled bool `yaml:"enabled"`
+}
+
+// wireGuardPeer is the configuration of a single WireGuard peer.
+type wireGuardPeer struct {
+	Name         string   `yaml:"name"`
+	PublicKey    string   `yaml:"public_key"`
+	PresharedKey string   `yaml:"preshared_key"`
+	AllowedIPs   []net.IP `yaml:"allowed_ips"`
+}
+
+// toInternal converts p into the aghwg peer configuration.
+func (p *wireGuardPeer) toInternal() (pc *aghwg.PeerConfig, err error) {
+	pc = &aghwg.PeerConfig{
+		Name:       p.Name,
+		AllowedIPs: p.AllowedIPs,
+	}
+
+	pc.PublicKey, err = aghwg.ParseKey(p.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("peer %q: public key: %w", p.Name, err)
+	}
+
+	if p.PresharedKey != "" {
+		pc.PresharedKey, err = aghwg.ParseKey(p.PresharedKey)
+		if err != nil {
+			return nil, fmt.Errorf("peer %q: preshared key: %w", p.Name, err)
+		}
+	}
+
+	return pc, nil
+}
+
+// defaultWireGuardPort is the default UDP port of the WireGuard endpoint.
+const defaultWireGuardPort = 51820
+
+// wireGuard is the built-in WireGuard endpoint module.
+type wireGuard struct {
+	// mu protects conf and srv.
+	mu *sync.Mutex
+
+	conf *wireGuardConfig
+
+	// srv is the running WireGuard server.  It's nil if the endpoint is
+	// disabled.
+	srv *aghwg.Server
+
+	// handler processes the tunneled DNS requests.
+	handler aghwg.Handler
+
+	// confModified is called when the configuration is changed.  It's
+	// onConfigModified everywhere except the tests.
+	confModified func()
+}
+
+// newWireGuard returns a new WireGuard module.  The endpoint isn't started.
+func newWireGuard(conf *wireGuardConfig, h aghwg.Handler) (wg *wireGuard) {
+	c := *conf
+	c.Peers = append([]*wireGuardPeer{}, conf.Peers...)
+
+	return &wireGuard{
+		mu:           &sync.Mutex{},
+		conf:         &c,
+		handler:      h,
+		confModified: onConfigModified,
+	}
+}
+
+// WriteDiskConfig writes the current configuration to conf.
+func (wg *wireGuard) WriteDiskConfig(conf *wireGuardConfig) {
+	wg.mu.Lock()
+	defer wg.mu.Unlock()
+
+	*conf = *wg.conf
+	conf.Peers = append([]*wireGuardPeer{}, wg.conf.Peers...)
+}
+
+// start starts the endpoint if it's enabled.  generated is true if a new
+// private key has been generated and the configuration must be saved.
+func (wg *wireGuard) start() (generated bool, err error) {
+	wg.mu.Lock()
+	defer wg.mu.Unlock()
+
+	if !wg.conf.Enabled || wg.srv != nil {
+		return false, nil
+	}
+
+	var priv aghwg.Key
+	if wg.conf.PrivateKey == "" {
+		priv, err = aghwg.NewPrivateKey()
+		if err != nil {
+			return false, err
+		}
+
+		wg.conf.PrivateKey, generated = priv.String(), true
+	} else {
+		priv, err = aghwg.ParseKey(wg.conf.PrivateKey)
+		if err != nil {
+			return false, fmt.Errorf("private key: %w", err)
+		}
+	}
+
+	peers := make([]*aghwg.PeerConfig, 0, len(wg.conf.Peers))
+	for _, p := range wg.conf.Peers {
+		var pc *aghwg.PeerConfig
+		pc, err = p.toInternal()
+		if err != nil {
+			return generated, err
+		}
+
+		peers = append(peers, pc)
+	}
+
+	port := wg.conf.Port
+	if port == 0 {
+		port = defaultWireGuardPort
+	}
+
+	srv, err := aghwg.NewServer(&aghwg.Config{
+		Handler:    wg.handler,
+		ListenAddr: &net.UDPAddr{IP: wg.conf.BindHost, Port: port},
+		Addresses:  wg.conf.Addresses,
+		Peers:      peers,
+		PrivateKey: priv,
+	})
+	if err != nil {
+		return generated, err
+	}
+
+	err = srv.Start()
+	if err != nil {
+		return generated, err
+	}
+
+	wg.srv = srv
+
+	return generated, nil
+}
+
+// close stops the endpoint if it's running.
+func (wg *wireGuard) close() (err error) {
+	wg.mu.Lock()
+	defer wg.mu.Unlock()
+
+	if wg.srv == nil {
+		return nil
+	}
+
+	err = wg.srv.Close()
+	wg.srv = nil
+
+	return err
+}
+
+// serveTunnelDNS passes the DNS request received through the WireGuard tunnel
+// to the current DNS server.
+func serveTunnelDNS(req []byte, client *net.UDPAddr) (resp []byte, err error) {
+	s := Context.dnsServer
+	if s == nil || !s.IsRunning() {
+		return nil, errors.Error("dns server is not running")
+	}
+
+	return s.ServeTunnelDNS(req, client)
+}
+
+// startWireGuard starts the WireGuard module and logs the errors.
+func startWireGuard() {
+	generated, err := Context.wireGuard.start()
+	if generated {
+		Context.wireGuard.confModified()
+	}
+
+	if err != nil {
+		log.Error("wireguard: starting: %s", err)
+	}
+}
+
+// wireGuardPeerJSON is a WireGuard peer in the HTTP API.
+type wireGuardPeerJSON struct {
+	// LastHandshake is the time of the last handshake in RFC 3339 format.
+	// It's ignored in the requests.
+	LastHandshake string `json:"last_handshake,omitempty"`
+
+	// Endpoint is the last known address of the peer.  It's ignored in the
+	// requests.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	Name         string   `json:"name"`
+	PublicKey    string   `json:"public_key"`
+	PresharedKey string   `json:"preshared_key,omitempty"`
+	AllowedIPs   []net.IP `json:"allowed_ips"`
+
+	RxBytes uint64 `json:"rx_bytes"`
+	TxBytes uint64 `json:"tx_bytes"`
+}
+
+// wireGuardStatusJSON is the response to the GET /control/wireguard/status
+// HTTP API.
+type wireGuardStatusJSON struct {
+	PublicKey string               `json:"public_key,omitempty"`
+	Addresses []net.IP             `json:"addresses"`
+	Peers     []*wireGuardPeerJSON `json:"peers"`
+	Port      int                  `json:"port"`
+	Enabled   bool                 `json:"enabled"`
+	Running   bool                 `json:"running"`
+}
+
+// handleStatus is the handler for the GET /control/wireguard/status HTTP API.
+func (wg *wireGuard) handleStatus(w http.ResponseWriter, r *http.Request) {
+	wg.mu.Lock()
+	resp := &wireGuardStatusJSON{
+		Addresses: wg.conf.Addresses,
+		Peers:     make([]*wireGuardPeerJSON, 0, len(wg.conf.Peers)),
+		Port:      wg.conf.Port,
+		Enabled:   wg.conf.Enabled,
+		Running:   wg.srv != nil,
+	}
+
+	if resp.Port == 0 {
+		resp.Port = defaultWireGuardPort
+	}
+
+	stats := map[string]*aghwg.PeerStatus{}
+	if wg.srv != nil {
+		resp.PublicKey = wg.srv.PublicKey().String()
+		for _, st := range wg.srv.Peers() {
+			stats[st.PublicKey.String()] = st
+		}
+	}
+
+	for _, p := range wg.conf.Peers {
+		pj := &wireGuardPeerJSON{
+			Name:       p.Name,
+			PublicKey:  p.PublicKey,
+			AllowedIPs: p.AllowedIPs,
+		}
+
+		if st, ok := stats[p.PublicKey]; ok {
+			pj.RxBytes, pj.TxBytes = st.RxBytes, st.TxBytes
+			if !st.LastHandshake.IsZero() {
+				pj.LastHandshake = st.LastHandshake.Format(time.RFC3339)
+			}
+
+			if st.Endpoint != nil {
+				pj.Endpoint = st.Endpoint.String()
+			}
+		}
+
+		resp.Peers = append(resp.Peers, pj)
+	}
+	wg.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+	}
+}
+
+// wireGuardConfigJSON is the request to the POST /control/wireguard/config
+// HTTP API.
+type wireGuardConfigJSON struct {
+	Addresses []net.IP `json:"addresses"`
+	Port      int      `json:"port"`
+	Enabled   bool     `json:"enabled"`
+}
+
+// handleConfig is the handler for the POST /control/wireguard/config HTTP
+// API.  It restarts the endpoint with the new settings.
+func (wg *wireGuard) handleConfig(w http.ResponseWriter, r *http.Request) {
+	req := &wireGuardConfigJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return
+	}
+
+	if req.Port < 0 || req.Port > 0xffff {
+		aghhttp.Error(r, w, http.StatusBadRequest, "bad port %d", req.Port)
+
+		return
+	} else if req.Enabled && len(req.Addresses) == 0 {
+		aghhttp.Error(r, w, http.StatusBadRequest, "no tunnel addresses")
+
+		return
+	}
+
+	err = wg.close()
+	if err != nil {
+		log.Debug("wireguard: closing: %s", err)
+	}
+
+	wg.mu.Lock()
+	wg.conf.Addresses = req.Addresses
+	wg.conf.Port = req.Port
+	wg.conf.Enabled = req.Enabled
+	wg.mu.Unlock()
+
+	_, err = wg.start()
+	wg.confModified()
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "starting: %s", err)
+	}
+}
+
+// validate returns an error if p isn't a valid new peer among peers.
+func (p *wireGuardPeer) validate(peers []*wireGuardPeer) (err error) {
+	if p.Name == "" {
+		return errors.Error("no name")
+	} else if len(p.AllowedIPs) == 0 {
+		return errors.Error("no allowed ips")
+	}
+
+	for _, other := range peers {
+		if other.Name == p.Name {
+			return fmt.Errorf("peer %q already exists", p.Name)
+		} else if other.PublicKey == p.PublicKey {
+			return fmt.Errorf("public key is used by peer %q", other.Name)
+		}
+
+		for _, ip := range p.AllowedIPs {
+			for _, otherIP := range other.AllowedIPs {
+				if ip.Equal(otherIP) {
+					return fmt.Errorf("ip %s is used by peer %q", ip, other.Name)
+				}
+			}
+		}
+	}
+
+	_, err = p.toInternal()
+
+	return err
+}
+
+// wireGuardAddPeerRespJSON is the response to the POST
+// /control/wireguard/peers/add HTTP API.  The fields are only set if the key
+// pair of the peer has been generated by the server.
+type wireGuardAddPeerRespJSON struct {
+	// PrivateKey is the generated private key of the peer.  It isn't stored
+	// anywhere.
+	PrivateKey string `json:"private_key,omitempty"`
+
+	// Config is the wg-quick configuration for the peer.
+	Config string `json:"config,omitempty"`
+}
+
+// handleAddPeer is the handler for the POST /control/wireguard/peers/add HTTP
+// API.  If the public key isn't set, the key pair is generated and the
+// configuration for the peer is returned.
+func (wg *wireGuard) handleAddPeer(w http.ResponseWriter, r *http.Request) {
+	pj := &wireGuardPeerJSON{}
+	err := json.NewDecoder(r.Body).Decode(pj)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return
+	}
+
+	resp := &wireGuardAddPeerRespJSON{}
+	if pj.PublicKey == "" {
+		var priv aghwg.Key
+		priv, err = aghwg.NewPrivateKey()
+		if err != nil {
+			aghhttp.Error(r, w, http.StatusInternalServerError, "generating key: %s", err)
+
+			return
+		}
+
+		resp.PrivateKey, pj.PublicKey = priv.String(), priv.PublicKey().String()
+	}
+
+	p := &wireGuardPeer{
+		Name:         pj.Name,
+		PublicKey:    pj.PublicKey,
+		PresharedKey: pj.PresharedKey,
+		AllowedIPs:   pj.AllowedIPs,
+	}
+
+	running, err := wg.addPeer(p)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "bad peer: %s", err)
+
+		return
+	}
+
+	wg.confModified()
+
+	if resp.PrivateKey != "" && running {
+		wg.mu.Lock()
+		resp.Config = wg.peerConfig(p, resp.PrivateKey, r.Host)
+		wg.mu.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+	}
+}
+
+// addPeer validates p and adds it to the configuration and to the running
+// endpoint, if any.  running is true if the endpoint is running.
+func (wg *wireGuard) addPeer(p *wireGuardPeer) (running bool, err error) {
+	wg.mu.Lock()
+	defer wg.mu.Unlock()
+
+	err = p.validate(wg.conf.Peers)
+	if err != nil {
+		return false, err
+	}
+
+	if wg.srv != nil {
+		// The peer has just been validated, so the error is impossible.
+		pc, _ := p.toInternal()
+		err = wg.srv.AddPeer(pc)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	wg.conf.Peers = append(wg.conf.Peers, p)
+
+	return wg.srv != nil, nil
+}
+
+// peerConfig returns the wg-quick configuration of the peer p with the private
+// key priv connecting to the endpoint at host.  wg.mu is expected to be
+// locked.
+func (wg *wireGuard) peerConfig(p *wireGuardPeer, priv, host string) (conf string) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	port := wg.conf.Port
+	if port == 0 {
+		port = defaultWireGuardPort
+	}
+
+	addrs := make([]string, 0, len(p.AllowedIPs))
+	for _, ip := range p.AllowedIPs {
+		addrs = append(addrs, ip.String())
+	}
+
+	dnsAddrs := make([]string, 0, len(wg.conf.Addresses))
+	routes := make([]string, 0, len(wg.conf.Addresses))
+	for _, ip := range wg.conf.Addresses {
+		dnsAddrs = append(dnsAddrs, ip.String())
+		if ip.To4() != nil {
+			routes = append(routes, ip.String()+"/32")
+		} else {
+			routes = append(routes, ip.String()+"/128")
+		}
+	}
+
+	b := &strings.Builder{}
+	_, _ = fmt.Fprintf(b, "[Interface]\nPrivateKey = %s\n", priv)
+	_, _ = fmt.Fprintf(b, "Address = %s\n", strings.Join(addrs, ", "))
+	_, _ = fmt.Fprintf(b, "DNS = %s\n\n", strings.Join(dnsAddrs, ", "))
+	_, _ = fmt.Fprintf(b, "[Peer]\nPublicKey = %s\n", wg.srv.PublicKey())
+	if p.PresharedKey != "" {
+		_, _ = fmt.Fprintf(b, "PresharedKey = %s\n", p.PresharedKey)
+	}
+
+	_, _ = fmt.Fprintf(b, "AllowedIPs = %s\n", strings.Join(routes, ", "))
+	_, _ = fmt.Fprintf(b, "Endpoint = %s\n", net.JoinHostPort(host, fmt.Sprint(port)))
+
+	return b.String()
+}
+
+// wireGuardDelPeerJSON is the request to the POST
+// /control/wireguard/peers/delete HTTP API.
+type wireGuardDelPeerJSON struct {
+	Name string `json:"name"`
+}
+
+// handleDelPeer is the handler for the POST /control/wireguard/peers/delete
+// HTTP API.
+func (wg *wireGuard) handleDelPeer(w http.ResponseWriter, r *http.Request) {
+	req := &wireGuardDelPeerJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return
+	}
+
+	if !wg.delPeer(req.Name) {
+		aghhttp.Error(r, w, http.StatusBadRequest, "peer %q not found", req.Name)
+
+		return
+	}
+
+	wg.confModified()
+}
+
+// delPeer removes the peer with name from the configuration and from the
+// running endpoint, if any.  ok is false if there is no such peer.
+func (wg *wireGuard) delPeer(name string) (ok bool) {
+	wg.mu.Lock()
+	defer wg.mu.Unlock()
+
+	for i, p := range wg.conf.Peers {
+		if p.Name != name {
+			continue
+		}
+
+		if wg.srv != nil {
+			// The peers in the configuration are valid, so the error is
+			// impossible.
+			pub, _ := aghwg.ParseKey(p.PublicKey)
+			wg.srv.RemovePeer(pub)
+		}
+
+		wg.conf.Peers = append(wg.conf.Peers[:i:i], wg.conf.Peers[i+1:]...)
+
+		return true
+	}
+
+	return false
+}
+
+// registerWireGuardHandlers registers the HTTP handlers of the WireGuard
+// endpoint.
+func registerWireGuardHandlers() {
+	wg := Context.wireGuard
+	httpRegister(http.MethodGet, "/control/wireguard/status", wg.handleStatus)
+	httpRegister(http.MethodPost, "/control/wireguard/config", wg.handleConfig)
+	httpRegister(http.MethodPost, "/control/wireguard/peers/add", wg.handleAddPeer)
+	httpRegister(http.MethodPost, "/control/wireguard/peers/delete", wg.handleDelPeer)
+}
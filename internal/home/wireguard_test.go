@@ -0,0 +1,124 @@
+package home
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghwg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestWireGuard returns a new WireGuard module, which counts the
+// configuration changes in modified.
+func newTestWireGuard(t *testing.T) (wg *wireGuard, modified *int) {
+	t.Helper()
+
+	modified = new(int)
+	wg = newWireGuard(&wireGuardConfig{
+		BindHost:  net.IP{127, 0, 0, 1},
+		Addresses: []net.IP{{10, 99, 0, 1}},
+		Enabled:   true,
+	}, func(_ []byte, _ *net.UDPAddr) (resp []byte, err error) {
+		return nil, nil
+	})
+	wg.confModified = func() { *modified++ }
+
+	return wg, modified
+}
+
+func TestWireGuard_peers(t *testing.T) {
+	wg, modified := newTestWireGuard(t)
+
+	addPeer := func(t *testing.T, body string) (w *httptest.ResponseRecorder) {
+		t.Helper()
+
+		r := httptest.NewRequest(http.MethodPost, "/control/wireguard/peers/add", strings.NewReader(body))
+		r.Host = "dns.example:3000"
+		w = httptest.NewRecorder()
+		wg.handleAddPeer(w, r)
+
+		return w
+	}
+
+	t.Run("generate", func(t *testing.T) {
+		w := addPeer(t, `{"name":"phone","allowed_ips":["10.99.0.2"]}`)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		resp := &wireGuardAddPeerRespJSON{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(resp))
+
+		priv, err := aghwg.ParseKey(resp.PrivateKey)
+		require.NoError(t, err)
+
+		require.Len(t, wg.conf.Peers, 1)
+		assert.Equal(t, priv.PublicKey().String(), wg.conf.Peers[0].PublicKey)
+		assert.Equal(t, 1, *modified)
+	})
+
+	t.Run("duplicate_ip", func(t *testing.T) {
+		priv, err := aghwg.NewPrivateKey()
+		require.NoError(t, err)
+
+		body := &bytes.Buffer{}
+		require.NoError(t, json.NewEncoder(body).Encode(&wireGuardPeerJSON{
+			Name:       "laptop",
+			PublicKey:  priv.PublicKey().String(),
+			AllowedIPs: []net.IP{{10, 99, 0, 2}},
+		}))
+
+		w := addPeer(t, body.String())
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Len(t, wg.conf.Peers, 1)
+	})
+
+	t.Run("bad_key", func(t *testing.T) {
+		w := addPeer(t, `{"name":"tablet","public_key":"bad","allowed_ips":["10.99.0.3"]}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/control/wireguard/peers/delete", strings.NewReader(`{"name":"phone"}`))
+		w := httptest.NewRecorder()
+		wg.handleDelPeer(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, wg.conf.Peers)
+		assert.Equal(t, 2, *modified)
+
+		w = httptest.NewRecorder()
+		wg.handleDelPeer(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"name":"phone"}`)))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestWireGuard_peerConfig(t *testing.T) {
+	wg, _ := newTestWireGuard(t)
+
+	priv, err := aghwg.NewPrivateKey()
+	require.NoError(t, err)
+
+	wg.srv, err = aghwg.NewServer(&aghwg.Config{
+		Handler:    wg.handler,
+		Addresses:  wg.conf.Addresses,
+		PrivateKey: priv,
+	})
+	require.NoError(t, err)
+
+	conf := wg.peerConfig(&wireGuardPeer{
+		Name:       "phone",
+		AllowedIPs: []net.IP{{10, 99, 0, 2}},
+	}, "cHJpdg==", "dns.example:3000")
+
+	assert.Contains(t, conf, "PrivateKey = cHJpdg==\n")
+	assert.Contains(t, conf, "Address = 10.99.0.2\n")
+	assert.Contains(t, conf, "DNS = 10.99.0.1\n")
+	assert.Contains(t, conf, "PublicKey = "+wg.srv.PublicKey().String()+"\n")
+	assert.Contains(t, conf, "AllowedIPs = 10.99.0.1/32\n")
+	assert.Contains(t, conf, "Endpoint = dns.example:51820\n")
+}
@@ -0,0 +1,232 @@
+package querylog
+
+import (
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/miekg/dns"
+	"golang.org/x/net/publicsuffix"
+)
+
+// anomalyKind is the kind of a suspicious event found in the query log.
+type anomalyKind uint8
+
+// anomalyKind values.
+const (
+	// anomalyTunneling means that the queried names look like they carry
+	// encoded data, which is typical for DNS tunneling.
+	anomalyTunneling anomalyKind = iota + 1
+
+	// anomalyMalware means that the request was blocked by the safe
+	// browsing.
+	anomalyMalware
+
+	// anomalyNXDomainFlood means that the client has received too many
+	// NXDOMAIN responses in a short time, which is typical for the domain
+	// generation algorithms and the random subdomain attacks.
+	anomalyNXDomainFlood
+)
+
+// Anomaly detection parameters.
+const (
+	// anomalyIvl is the interval within which the events of the same kind
+	// from the same client are merged into a single anomaly.
+	anomalyIvl = 1 * time.Minute
+
+	// nxdomainFloodNum is the minimum number of NXDOMAIN responses a client
+	// has to receive within anomalyIvl to be considered flooding.
+	nxdomainFloodNum = 100
+
+	// tunnelingMinLen is the minimum length of the subdomain part of a
+	// queried name, which may be considered carrying encoded data.
+	tunnelingMinLen = 30
+
+	// tunnelingMinEntropy is the minimum Shannon entropy of the characters
+	// of the subdomain part of a queried name, in bits per character, which
+	// may be considered carrying encoded data.
+	tunnelingMinEntropy = 3.5
+)
+
+// anomaly is a suspicious event found in the query log.
+type anomaly struct {
+	// start and end are the times of the first and the last merged events.
+	start time.Time
+	end   time.Time
+
+	// clientIP is the IP address of the client.
+	clientIP net.IP
+
+	// clientID is the client ID, if any.
+	clientID string
+
+	// domain is the domain the anomaly is related to.  It's the registered
+	// domain for anomalyTunneling, the queried name for anomalyMalware, and
+	// empty for anomalyNXDomainFlood.
+	domain string
+
+	// host is the queried name of the last merged event.
+	host string
+
+	// qtype is the question type of the last merged event.
+	qtype string
+
+	// proto is the protocol of the last merged event.
+	proto ClientProto
+
+	// count is the number of the merged events.
+	count int
+
+	// kind is the kind of the anomaly.
+	kind anomalyKind
+}
+
+// anomalyKey is the key by which the events are merged into anomalies.
+type anomalyKey struct {
+	client string
+	domain string
+	bucket int64
+	kind   anomalyKind
+}
+
+// findAnomalies returns the anomalies found in entries newer than since,
+// sorted by their start time.
+func findAnomalies(entries []*logEntry, since time.Time) (anomalies []*anomaly) {
+	merged := map[anomalyKey]*anomaly{}
+	for _, e := range entries {
+		if e.Time.Before(since) {
+			continue
+		}
+
+		kind, domain := entryAnomaly(e)
+		if kind == 0 {
+			continue
+		}
+
+		k := anomalyKey{
+			client: e.IP.String() + "/" + e.ClientID,
+			domain: domain,
+			bucket: e.Time.Truncate(anomalyIvl).Unix(),
+			kind:   kind,
+		}
+
+		a, ok := merged[k]
+		if !ok {
+			a = &anomaly{
+				start:    e.Time,
+				end:      e.Time,
+				clientIP: e.IP,
+				clientID: e.ClientID,
+				domain:   domain,
+				kind:     kind,
+			}
+			merged[k] = a
+		}
+
+		a.count++
+		if !e.Time.After(a.start) {
+			a.start = e.Time
+		}
+
+		if !e.Time.Before(a.end) {
+			a.end = e.Time
+			a.host, a.qtype, a.proto = e.QHost, e.QType, e.ClientProto
+		}
+	}
+
+	for _, a := range merged {
+		if a.kind == anomalyNXDomainFlood && a.count < nxdomainFloodNum {
+			continue
+		}
+
+		anomalies = append(anomalies, a)
+	}
+
+	sort.Slice(anomalies, func(i, j int) (less bool) {
+		ai, aj := anomalies[i], anomalies[j]
+		if !ai.start.Equal(aj.start) {
+			return ai.start.Before(aj.start)
+		}
+
+		return ai.kind < aj.kind
+	})
+
+	return anomalies
+}
+
+// entryAnomaly returns the kind of the anomaly e is a part of and the domain it
+// is related to.  kind is zero if e isn't suspicious.
+func entryAnomaly(e *logEntry) (kind anomalyKind, domain string) {
+	if e.Result.IsFiltered && e.Result.Reason == filtering.FilteredSafeBrowsing {
+		return anomalyMalware, e.QHost
+	}
+
+	if base, ok := tunnelingDomain(e.QHost); ok {
+		return anomalyTunneling, base
+	}
+
+	if entryRcode(e) == dns.RcodeNameError {
+		return anomalyNXDomainFlood, ""
+	}
+
+	return 0, ""
+}
+
+// tunnelingDomain returns the registered domain of host and true if the
+// subdomain part of host looks like it carries encoded data.
+func tunnelingDomain(host string) (base string, ok bool) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if len(host) < tunnelingMinLen {
+		return "", false
+	}
+
+	base, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return "", false
+	}
+
+	sub := strings.ReplaceAll(strings.TrimSuffix(host, base), ".", "")
+	if len(sub) < tunnelingMinLen || entropy(sub) < tunnelingMinEntropy {
+		return "", false
+	}
+
+	return base, true
+}
+
+// entropy returns the Shannon entropy of the bytes of s in bits per byte.
+func entropy(s string) (bits float64) {
+	var freqs [256]int
+	for i := 0; i < len(s); i++ {
+		freqs[s[i]]++
+	}
+
+	l := float64(len(s))
+	for _, f := range freqs {
+		if f == 0 {
+			continue
+		}
+
+		p := float64(f) / l
+		bits -= p * math.Log2(p)
+	}
+
+	return bits
+}
+
+// entryRcode returns the response code of the answer in e or -1 if there is no
+// valid answer.
+func entryRcode(e *logEntry) (rcode int) {
+	if len(e.Answer) == 0 {
+		return -1
+	}
+
+	msg := &dns.Msg{}
+	if err := msg.Unpack(e.Answer); err != nil {
+		return -1
+	}
+
+	return msg.Rcode
+}
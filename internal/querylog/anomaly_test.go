@@ -0,0 +1,162 @@
+package querylog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunnelingDomain(t *testing.T) {
+	testCases := []struct {
+		name     string
+		host     string
+		wantBase string
+		wantOK   bool
+	}{{
+		name:     "short",
+		host:     "www.example.com",
+		wantBase: "",
+		wantOK:   false,
+	}, {
+		name:     "long_words",
+		host:     "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa.example.com",
+		wantBase: "",
+		wantOK:   false,
+	}, {
+		name:     "encoded",
+		host:     "mzxw6ytboi4dsnzsgq3dmobxhe2tenrs.gu4tmnjrgm2tcojz.tunnel.example.co.uk",
+		wantBase: "example.co.uk",
+		wantOK:   true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			base, ok := tunnelingDomain(tc.host)
+			assert.Equal(t, tc.wantOK, ok)
+			assert.Equal(t, tc.wantBase, base)
+		})
+	}
+}
+
+func TestFindAnomalies(t *testing.T) {
+	nxdomain := (&dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Response: true,
+			Rcode:    dns.RcodeNameError,
+		},
+	}).SetQuestion("random.example.", dns.TypeA)
+	nxdomainData, err := nxdomain.Pack()
+	require.NoError(t, err)
+
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	cliIP := net.IP{1, 2, 3, 4}
+	floodIP := net.IP{1, 2, 3, 5}
+
+	entries := []*logEntry{{
+		Time:  start,
+		QHost: "malware.example",
+		QType: "A",
+		IP:    cliIP,
+		Result: filtering.Result{
+			IsFiltered: true,
+			Reason:     filtering.FilteredSafeBrowsing,
+		},
+	}, {
+		Time:  start.Add(time.Second),
+		QHost: "malware.example",
+		QType: "A",
+		IP:    cliIP,
+		Result: filtering.Result{
+			IsFiltered: true,
+			Reason:     filtering.FilteredSafeBrowsing,
+		},
+	}, {
+		Time:  start.Add(-time.Hour),
+		QHost: "old.malware.example",
+		QType: "A",
+		IP:    cliIP,
+		Result: filtering.Result{
+			IsFiltered: true,
+			Reason:     filtering.FilteredSafeBrowsing,
+		},
+	}, {
+		Time:  start.Add(2 * time.Second),
+		QHost: "mzxw6ytboi4dsnzsgq3dmobxhe2tenrs.t.example.com",
+		QType: "TXT",
+		IP:    cliIP,
+	}, {
+		Time:   start.Add(3 * time.Second),
+		QHost:  "random.example",
+		QType:  "A",
+		IP:     cliIP,
+		Answer: nxdomainData,
+	}}
+
+	for i := 0; i < nxdomainFloodNum; i++ {
+		entries = append(entries, &logEntry{
+			Time:   start.Add(time.Duration(i) * 100 * time.Millisecond),
+			QHost:  "random.example",
+			QType:  "A",
+			IP:     floodIP,
+			Answer: nxdomainData,
+		})
+	}
+
+	anomalies := findAnomalies(entries, start)
+	require.Len(t, anomalies, 3)
+
+	assert.Equal(t, anomalyMalware, anomalies[0].kind)
+	assert.Equal(t, 2, anomalies[0].count)
+	assert.Equal(t, "malware.example", anomalies[0].domain)
+
+	assert.Equal(t, anomalyNXDomainFlood, anomalies[1].kind)
+	assert.Equal(t, nxdomainFloodNum, anomalies[1].count)
+	assert.Equal(t, floodIP, anomalies[1].clientIP)
+
+	assert.Equal(t, anomalyTunneling, anomalies[2].kind)
+	assert.Equal(t, "example.com", anomalies[2].domain)
+
+	t.Run("stix", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		err = writeSTIX(buf, anomalies)
+		require.NoError(t, err)
+
+		b := &stixBundleJSON{}
+		err = json.Unmarshal(buf.Bytes(), b)
+		require.NoError(t, err)
+
+		require.Len(t, b.Objects, 3)
+
+		assert.Equal(t, "[domain-name:value = 'malware.example']", b.Objects[0].Pattern)
+		assert.Equal(t, "[ipv4-addr:value = '1.2.3.5']", b.Objects[1].Pattern)
+		assert.Equal(t, "indicator--"+anomalies[0].id().String(), b.Objects[0].ID)
+	})
+
+	t.Run("eve", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		err = writeEVE(buf, anomalies)
+		require.NoError(t, err)
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		require.Len(t, lines, 3)
+
+		e := &eveEventJSON{}
+		err = json.Unmarshal([]byte(lines[0]), e)
+		require.NoError(t, err)
+
+		require.NotNil(t, e.Alert)
+
+		assert.Equal(t, "alert", e.EventType)
+		assert.Equal(t, "blocked", e.Alert.Action)
+		assert.Equal(t, "1.2.3.4", e.SrcIP)
+		assert.Equal(t, []string{"2"}, e.Alert.Metadata["count"])
+	})
+}
@@ -0,0 +1,333 @@
+package querylog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/log"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Anomaly export formats.
+const (
+	// anomalyFormatSTIX is a STIX 2.1 bundle of indicators, which can be
+	// added to a TAXII 2.1 collection as is.
+	anomalyFormatSTIX = "stix"
+
+	// anomalyFormatEVE is the Suricata EVE JSON format, one alert per line.
+	anomalyFormatEVE = "eve"
+)
+
+// Anomaly export parameters.
+const (
+	// defaultAnomalyPeriod is the period of time exported by default.
+	defaultAnomalyPeriod = 24 * time.Hour
+
+	// maxAnomalyEntries is the maximum number of the latest log entries the
+	// anomalies are looked for in.
+	maxAnomalyEntries = 100_000
+)
+
+// anomalyInfo is the description of an anomaly kind.
+type anomalyInfo struct {
+	// signature is the human-readable name of the anomaly kind.
+	signature string
+
+	// category is the Suricata alert category.
+	category string
+
+	// indicatorType is the STIX indicator type from the open vocabulary.
+	indicatorType string
+
+	// sid is the Suricata signature ID.  The IDs are within the range
+	// reserved for the local signatures.
+	sid int
+
+	// severity is the Suricata alert severity, 1 being the highest.
+	severity int
+}
+
+// anomalyInfos are the descriptions of the anomaly kinds.
+var anomalyInfos = map[anomalyKind]*anomalyInfo{
+	anomalyTunneling: {
+		signature:     "AdGuard Home: possible DNS tunneling",
+		category:      "Potentially Bad Traffic",
+		indicatorType: "anomalous-activity",
+		sid:           1_000_001,
+		severity:      2,
+	},
+	anomalyMalware: {
+		signature:     "AdGuard Home: malware or phishing domain blocked",
+		category:      "Domain Observed Used for C2 Detected",
+		indicatorType: "malicious-activity",
+		sid:           1_000_002,
+		severity:      1,
+	},
+	anomalyNXDomainFlood: {
+		signature:     "AdGuard Home: NXDOMAIN flood",
+		category:      "Potentially Bad Traffic",
+		indicatorType: "compromised",
+		sid:           1_000_003,
+		severity:      2,
+	},
+}
+
+// anomalyNamespace is the namespace of the UUIDs of the exported objects.  The
+// IDs are derived from the anomalies, so that exporting the same anomaly again
+// doesn't create a duplicate.
+var anomalyNamespace = uuid.Must(uuid.FromString("3b0c2a36-5e4f-4c51-9a0e-6b1f4c2d7e8a"))
+
+// id returns the stable identifier of a.
+func (a *anomaly) id() (id uuid.UUID) {
+	name := fmt.Sprintf(
+		"%d|%s|%s|%s|%d",
+		a.kind,
+		a.clientIP,
+		a.clientID,
+		a.domain,
+		a.start.Truncate(anomalyIvl).Unix(),
+	)
+
+	return uuid.NewV5(anomalyNamespace, name)
+}
+
+// description returns the human-readable description of a.
+func (a *anomaly) description() (desc string) {
+	client := a.clientIP.String()
+	if a.clientID != "" {
+		client = fmt.Sprintf("%s (client id %q)", client, a.clientID)
+	}
+
+	switch a.kind {
+	case anomalyTunneling:
+		return fmt.Sprintf(
+			"%d queries with the names looking like encoded data under %q from %s, last %q",
+			a.count,
+			a.domain,
+			client,
+			a.host,
+		)
+	case anomalyMalware:
+		return fmt.Sprintf("%d blocked queries for %q from %s", a.count, a.domain, client)
+	case anomalyNXDomainFlood:
+		return fmt.Sprintf("%d NXDOMAIN responses to %s, last for %q", a.count, client, a.host)
+	default:
+		return ""
+	}
+}
+
+// stixTimeFormat is the format of the STIX timestamps.
+const stixTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// stixIndicatorJSON is a STIX 2.1 indicator object.
+type stixIndicatorJSON struct {
+	Type           string   `json:"type"`
+	SpecVersion    string   `json:"spec_version"`
+	ID             string   `json:"id"`
+	Created        string   `json:"created"`
+	Modified       string   `json:"modified"`
+	Name           string   `json:"name"`
+	Description    string   `json:"description"`
+	IndicatorTypes []string `json:"indicator_types"`
+	Pattern        string   `json:"pattern"`
+	PatternType    string   `json:"pattern_type"`
+	ValidFrom      string   `json:"valid_from"`
+}
+
+// stixBundleJSON is a STIX 2.1 bundle.
+type stixBundleJSON struct {
+	Type    string               `json:"type"`
+	ID      string               `json:"id"`
+	Objects []*stixIndicatorJSON `json:"objects"`
+}
+
+// stixEscape escapes s for use as a string literal within a STIX pattern.
+func stixEscape(s string) (esc string) {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s)
+}
+
+// stixPattern returns the STIX pattern matching the observable of a.
+func (a *anomaly) stixPattern() (pattern string) {
+	if a.kind != anomalyNXDomainFlood {
+		return fmt.Sprintf("[domain-name:value = '%s']", stixEscape(a.domain))
+	}
+
+	addrType := "ipv6-addr"
+	if a.clientIP.To4() != nil {
+		addrType = "ipv4-addr"
+	}
+
+	return fmt.Sprintf("[%s:value = '%s']", addrType, a.clientIP)
+}
+
+// writeSTIX writes anomalies into w as a STIX 2.1 bundle.
+func writeSTIX(w io.Writer, anomalies []*anomaly) (err error) {
+	b := &stixBundleJSON{
+		Type:    "bundle",
+		ID:      "bundle--" + uuid.NewV4().String(),
+		Objects: make([]*stixIndicatorJSON, 0, len(anomalies)),
+	}
+
+	for _, a := range anomalies {
+		info := anomalyInfos[a.kind]
+		created := a.start.UTC().Format(stixTimeFormat)
+		b.Objects = append(b.Objects, &stixIndicatorJSON{
+			Type:           "indicator",
+			SpecVersion:    "2.1",
+			ID:             "indicator--" + a.id().String(),
+			Created:        created,
+			Modified:       a.end.UTC().Format(stixTimeFormat),
+			Name:           info.signature,
+			Description:    a.description(),
+			IndicatorTypes: []string{info.indicatorType},
+			Pattern:        a.stixPattern(),
+			PatternType:    "stix",
+			ValidFrom:      created,
+		})
+	}
+
+	return json.NewEncoder(w).Encode(b)
+}
+
+// eveTimeFormat is the format of the Suricata EVE timestamps.
+const eveTimeFormat = "2006-01-02T15:04:05.000000-0700"
+
+// eveAlertJSON is the alert part of a Suricata EVE event.
+type eveAlertJSON struct {
+	Metadata    map[string][]string `json:"metadata"`
+	Action      string              `json:"action"`
+	Signature   string              `json:"signature"`
+	Category    string              `json:"category"`
+	GID         int                 `json:"gid"`
+	SignatureID int                 `json:"signature_id"`
+	Rev         int                 `json:"rev"`
+	Severity    int                 `json:"severity"`
+}
+
+// eveDNSJSON is the DNS part of a Suricata EVE event.
+type eveDNSJSON struct {
+	Type   string `json:"type"`
+	RRName string `json:"rrname"`
+	RRType string `json:"rrtype"`
+}
+
+// eveEventJSON is a Suricata EVE event.
+type eveEventJSON struct {
+	Alert     *eveAlertJSON `json:"alert"`
+	DNS       *eveDNSJSON   `json:"dns"`
+	Timestamp string        `json:"timestamp"`
+	EventType string        `json:"event_type"`
+	SrcIP     string        `json:"src_ip"`
+	Proto     string        `json:"proto"`
+	AppProto  string        `json:"app_proto"`
+}
+
+// eveProto returns the transport protocol of the client protocol p.
+func eveProto(p ClientProto) (proto string) {
+	switch p {
+	case ClientProtoDoH, ClientProtoDoT:
+		return "TCP"
+	default:
+		return "UDP"
+	}
+}
+
+// writeEVE writes anomalies into w as Suricata EVE alerts.
+func writeEVE(w io.Writer, anomalies []*anomaly) (err error) {
+	enc := json.NewEncoder(w)
+	for _, a := range anomalies {
+		info := anomalyInfos[a.kind]
+
+		action := "allowed"
+		if a.kind == anomalyMalware {
+			action = "blocked"
+		}
+
+		md := map[string][]string{
+			"count": {strconv.Itoa(a.count)},
+			"first": {a.start.Format(eveTimeFormat)},
+		}
+		if a.clientID != "" {
+			md["client_id"] = []string{a.clientID}
+		}
+
+		err = enc.Encode(&eveEventJSON{
+			Alert: &eveAlertJSON{
+				Metadata:    md,
+				Action:      action,
+				Signature:   info.signature,
+				Category:    info.category,
+				GID:         1,
+				SignatureID: info.sid,
+				Rev:         1,
+				Severity:    info.severity,
+			},
+			DNS: &eveDNSJSON{
+				Type:   "query",
+				RRName: a.host,
+				RRType: a.qtype,
+			},
+			Timestamp: a.end.Format(eveTimeFormat),
+			EventType: "alert",
+			SrcIP:     a.clientIP.String(),
+			Proto:     eveProto(a.proto),
+			AppProto:  "dns",
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handleAnomalies is the handler for the GET /control/querylog/anomalies HTTP
+// API.
+func (l *queryLog) handleAnomalies(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	since := time.Now().Add(-defaultAnomalyPeriod)
+	if s := q.Get("since"); s != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			aghhttp.Error(r, w, http.StatusBadRequest, "bad since: %s", err)
+
+			return
+		}
+	}
+
+	var write func(w io.Writer, anomalies []*anomaly) (err error)
+	switch format := q.Get("format"); format {
+	case anomalyFormatSTIX, "":
+		w.Header().Set("Content-Type", "application/stix+json;version=2.1")
+		write = writeSTIX
+	case anomalyFormatEVE:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		write = writeEVE
+	default:
+		aghhttp.Error(r, w, http.StatusBadRequest, "unsupported format %q", format)
+
+		return
+	}
+
+	params := newSearchParams()
+	params.limit = maxAnomalyEntries
+	params.maxFileScanEntries = maxAnomalyEntries
+
+	entries, _ := l.search(params)
+	anomalies := findAnomalies(entries, since)
+
+	log.Debug("querylog: exporting %d anomalies since %s", len(anomalies), since)
+
+	err := write(w, anomalies)
+	if err != nil {
+		log.Debug("querylog: writing anomalies: %s", err)
+	}
+}
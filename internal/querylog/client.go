@@ -6,7 +6,12 @@ type Client struct {
 	WHOIS          *ClientWHOIS `json:"whois,omitempty"`
 	Name           string       `json:"name"`
 	DisallowedRule string       `json:"disallowed_rule"`
-	Disallowed     bool         `json:"disallowed"`
+
+	// Tags are the tags of the persistent client.  They are only used for
+	// searching.
+	Tags []string `json:"-"`
+
+	Disallowed bool `json:"disallowed"`
 }
 
 // ClientWHOIS is the filtered WHOIS data for the client.
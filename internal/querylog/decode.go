@@ -129,6 +129,16 @@ var logEntryHandlers = map[string]logEntryHandler{
 
 		return nil
 	},
+	"Diverged": func(t json.Token, ent *logEntry) error {
+		v, ok := t.(bool)
+		if !ok {
+			return nil
+		}
+
+		ent.ConsensusDiverged = v
+
+		return nil
+	},
 	"Upstream": func(t json.Token, ent *logEntry) error {
 		v, ok := t.(string)
 		if !ok {
@@ -35,6 +35,7 @@ func TestDecodeLogEntry(t *testing.T) {
 			`"Answer":"` + ansStr + `",` +
 			`"Cached":true,` +
 			`"AD":true,` +
+			`"Diverged":true,` +
 			`"Result":{` +
 			`"IsFiltered":true,` +
 			`"Reason":3,` +
@@ -85,6 +86,7 @@ func TestDecodeLogEntry(t *testing.T) {
 			Upstream:          "https://some.upstream",
 			Elapsed:           837429,
 			AuthenticatedData: true,
+			ConsensusDiverged: true,
 		}
 
 		got := &logEntry{}
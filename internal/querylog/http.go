@@ -11,19 +11,20 @@ import (
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
-	"github.com/AdguardTeam/golibs/jsonutil"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/stringutil"
 	"github.com/AdguardTeam/golibs/timeutil"
 	"golang.org/x/net/idna"
 )
 
+// qlogConfig is the JSON structure for the query log configuration.  The
+// fields are pointers to tell the absent ones from the zero values.
 type qlogConfig struct {
-	Enabled bool `json:"enabled"`
+	Enabled *bool `json:"enabled"`
 	// Use float64 here to support fractional numbers and not mess the API
 	// users by changing the units.
-	Interval          float64 `json:"interval"`
-	AnonymizeClientIP bool    `json:"anonymize_client_ip"`
+	Interval          *float64 `json:"interval"`
+	AnonymizeClientIP *bool    `json:"anonymize_client_ip"`
 }
 
 // Register web handlers
@@ -32,6 +33,7 @@ func (l *queryLog) initWeb() {
 	l.conf.HTTPRegister(http.MethodGet, "/control/querylog_info", l.handleQueryLogInfo)
 	l.conf.HTTPRegister(http.MethodPost, "/control/querylog_clear", l.handleQueryLogClear)
 	l.conf.HTTPRegister(http.MethodPost, "/control/querylog_config", l.handleQueryLogConfig)
+	l.conf.HTTPRegister(http.MethodGet, "/control/querylog/anomalies", l.handleAnomalies)
 }
 
 func (l *queryLog) handleQueryLog(w http.ResponseWriter, r *http.Request) {
@@ -74,10 +76,12 @@ func (l *queryLog) handleQueryLogClear(_ http.ResponseWriter, _ *http.Request) {
 
 // Get configuration
 func (l *queryLog) handleQueryLogInfo(w http.ResponseWriter, r *http.Request) {
-	resp := qlogConfig{}
-	resp.Enabled = l.conf.Enabled
-	resp.Interval = l.conf.RotationIvl.Hours() / 24
-	resp.AnonymizeClientIP = l.conf.AnonymizeClientIP
+	ivl := l.conf.RotationIvl.Hours() / 24
+	resp := qlogConfig{
+		Enabled:           &l.conf.Enabled,
+		Interval:          &ivl,
+		AnonymizeClientIP: &l.conf.AnonymizeClientIP,
+	}
 
 	jsonVal, err := json.Marshal(resp)
 	if err != nil {
@@ -110,20 +114,30 @@ func AnonymizeIP(ip net.IP) {
 // Set configuration
 func (l *queryLog) handleQueryLogConfig(w http.ResponseWriter, r *http.Request) {
 	d := &qlogConfig{}
-	req, err := jsonutil.DecodeObject(d, r.Body)
+	err := json.NewDecoder(r.Body).Decode(d)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
 
 		return
 	}
 
-	ivl := time.Duration(float64(timeutil.Day) * d.Interval)
-	if req.Exists("interval") && !checkInterval(ivl) {
+	var ivl time.Duration
+	if d.Interval != nil {
+		ivl = time.Duration(float64(timeutil.Day) * *d.Interval)
+	}
+
+	if d.Interval != nil && !checkInterval(ivl) {
 		aghhttp.Error(r, w, http.StatusBadRequest, "Unsupported interval")
 
 		return
 	}
 
+	if d.Interval != nil && l.exceedsMaxInterval(r, ivl) {
+		aghhttp.Error(r, w, http.StatusBadRequest, "Interval exceeds the quota")
+
+		return
+	}
+
 	defer l.conf.ConfigModified()
 
 	l.lock.Lock()
@@ -132,14 +146,14 @@ func (l *queryLog) handleQueryLogConfig(w http.ResponseWriter, r *http.Request)
 	// Copy data, modify it, then activate.  Other threads (readers) don't need
 	// to use this lock.
 	conf := *l.conf
-	if req.Exists("enabled") {
-		conf.Enabled = d.Enabled
+	if d.Enabled != nil {
+		conf.Enabled = *d.Enabled
 	}
-	if req.Exists("interval") {
+	if d.Interval != nil {
 		conf.RotationIvl = ivl
 	}
-	if req.Exists("anonymize_client_ip") {
-		if conf.AnonymizeClientIP = d.AnonymizeClientIP; conf.AnonymizeClientIP {
+	if d.AnonymizeClientIP != nil {
+		if conf.AnonymizeClientIP = *d.AnonymizeClientIP; conf.AnonymizeClientIP {
 			l.anonymizer.Store(AnonymizeIP)
 		} else {
 			l.anonymizer.Store(nil)
@@ -2,6 +2,7 @@ package querylog
 
 import (
 	"fmt"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -9,7 +10,6 @@ import (
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
 	"github.com/AdguardTeam/golibs/log"
-	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/miekg/dns"
 	"golang.org/x/net/idna"
 )
@@ -53,9 +53,12 @@ func (l *queryLog) entryToJSON(entry *logEntry, anonFunc aghnet.IPMutFunc) (json
 		log.Debug("querylog: translating %q into unicode: %s", hostname, err)
 	} else if qhost != hostname && qhost != "" {
 		question["unicode_name"] = qhost
+		if filtering.IsHomograph(qhost) {
+			question["homograph"] = true
+		}
 	}
 
-	eip := netutil.CloneIP(entry.IP)
+	eip := slices.Clone(entry.IP)
 	anonFunc(eip)
 
 	jsonEntry = jobject{
@@ -78,6 +81,10 @@ func (l *queryLog) entryToJSON(entry *logEntry, anonFunc aghnet.IPMutFunc) (json
 		jsonEntry["client_id"] = entry.ClientID
 	}
 
+	if entry.ConsensusDiverged {
+		jsonEntry["consensus_diverged"] = true
+	}
+
 	if len(entry.Result.Rules) > 0 {
 		if r := entry.Result.Rules[0]; len(r.Text) > 0 {
 			jsonEntry["rule"] = r.Text
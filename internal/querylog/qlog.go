@@ -4,9 +4,11 @@ package querylog
 import (
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
@@ -35,10 +37,27 @@ type queryLog struct {
 	buffer []*logEntry
 
 	fileFlushLock sync.Mutex // synchronize a file-flushing goroutine and main thread
-	flushPending  bool       // don't start another goroutine while the previous one is still running
 	fileWriteLock sync.Mutex
 
+	// flushReq wakes up the flushing goroutine when the buffer is full.
+	flushReq chan struct{}
+
+	// stopFlush is closed to stop the flushing goroutine.
+	stopFlush chan struct{}
+
+	// closeOnce makes sure that stopFlush is only closed once, since Close
+	// may be called several times.
+	closeOnce sync.Once
+
+	// flushStopped is closed when the flushing goroutine has stopped.  It's
+	// nil if the goroutine hasn't been started.
+	flushStopped chan struct{}
+
 	anonymizer *aghnet.IPMut
+
+	// diskPaused is non-zero if writing to the file is paused.  It must only
+	// be accessed atomically.
+	diskPaused uint32
 }
 
 // ClientProto values are names of the client protocols.
@@ -96,16 +115,50 @@ type logEntry struct {
 
 	Cached            bool `json:",omitempty"`
 	AuthenticatedData bool `json:"AD,omitempty"`
+	ConsensusDiverged bool `json:"Diverged,omitempty"`
+}
+
+// minBufferLimit is the minimum number of the entries kept in the memory
+// buffer, when writing them to the file can't keep up.
+const minBufferLimit = 1000
+
+// bufferLimit returns the maximum number of the entries kept in the memory
+// buffer, when writing them to the file can't keep up.  The oldest entries
+// are dropped then.
+func (l *queryLog) bufferLimit() (limit int) {
+	limit = 4 * int(l.conf.MemSize)
+	if limit < minBufferLimit {
+		return minBufferLimit
+	}
+
+	return limit
 }
 
 func (l *queryLog) Start() {
+	// Finish writing the entries interrupted by a crash before anything
+	// reads the file.
+	l.fileWriteLock.Lock()
+	err := recoverWAL(l.logFile)
+	l.fileWriteLock.Unlock()
+	if err != nil {
+		log.Error("querylog: recovering: %s", err)
+	}
+
 	if l.conf.HTTPRegister != nil {
 		l.initWeb()
 	}
+
+	l.flushStopped = make(chan struct{})
+	go l.periodicFlush()
 	go l.periodicRotate()
 }
 
 func (l *queryLog) Close() {
+	l.closeOnce.Do(func() { close(l.stopFlush) })
+	if l.flushStopped != nil {
+		<-l.flushStopped
+	}
+
 	_ = l.flushLogBuffer(true)
 }
 
@@ -122,10 +175,42 @@ func checkInterval(ivl time.Duration) (ok bool) {
 	return ivl == quarterDay || ivl == day || ivl == week || ivl == month || ivl == threeMonths
 }
 
+// exceedsMaxInterval returns true if ivl is longer than the maximum rotation
+// interval allowed in the HTTP API request r.
+func (l *queryLog) exceedsMaxInterval(r *http.Request, ivl time.Duration) (ok bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.conf.MaxRotationIvl == nil {
+		return false
+	}
+
+	maxIvl := l.conf.MaxRotationIvl(r)
+
+	return maxIvl > 0 && ivl > maxIvl
+}
+
 func (l *queryLog) WriteDiskConfig(c *Config) {
 	*c = *l.conf
 }
 
+// PauseDiskWrites implements the QueryLog interface for *queryLog.
+func (l *queryLog) PauseDiskWrites(pause bool) {
+	var v uint32
+	if pause {
+		v = 1
+	}
+
+	if atomic.SwapUint32(&l.diskPaused, v) != v {
+		log.Info("querylog: writing to file paused: %t", pause)
+	}
+}
+
+// fileEnabled returns true if the log is written to the file.
+func (l *queryLog) fileEnabled() (ok bool) {
+	return l.conf.FileEnabled && atomic.LoadUint32(&l.diskPaused) == 0
+}
+
 // Clear memory buffer and remove log files
 func (l *queryLog) clear() {
 	l.fileFlushLock.Lock()
@@ -133,11 +218,18 @@ func (l *queryLog) clear() {
 
 	l.bufferLock.Lock()
 	l.buffer = nil
-	l.flushPending = false
 	l.bufferLock.Unlock()
 
+	l.fileWriteLock.Lock()
+	defer l.fileWriteLock.Unlock()
+
+	err := os.Remove(l.logFile + walSuffix)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Error("removing wal file: %s", err)
+	}
+
 	oldLogFile := l.logFile + ".1"
-	err := os.Remove(oldLogFile)
+	err = os.Remove(oldLogFile)
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
 		log.Error("removing old log file %q: %s", oldLogFile, err)
 	}
@@ -187,6 +279,7 @@ func (l *queryLog) Add(params *AddParams) {
 
 		Cached:            params.Cached,
 		AuthenticatedData: params.AuthenticatedData,
+		ConsensusDiverged: params.ConsensusDiverged,
 	}
 
 	if params.Answer != nil {
@@ -217,7 +310,7 @@ func (l *queryLog) Add(params *AddParams) {
 	l.buffer = append(l.buffer, &entry)
 	needFlush := false
 
-	if !l.conf.FileEnabled {
+	if !l.fileEnabled() {
 		if len(l.buffer) > int(l.conf.MemSize) {
 			// writing to file is disabled - just remove the oldest entry from array
 			//
@@ -226,18 +319,28 @@ func (l *queryLog) Add(params *AddParams) {
 			l.buffer[0] = nil
 			l.buffer = l.buffer[1:]
 		}
-	} else if !l.flushPending {
+	} else {
 		needFlush = len(l.buffer) >= int(l.conf.MemSize)
-		if needFlush {
-			l.flushPending = true
+		if limit := l.bufferLimit(); len(l.buffer) > limit {
+			// Writing to the file can't keep up, so keep the buffer
+			// bounded by dropping the oldest entries.
+			dropped := len(l.buffer) - limit
+			log.Debug("querylog: buffer is full, dropping %d entries", dropped)
+
+			for i := 0; i < dropped; i++ {
+				l.buffer[i] = nil
+			}
+
+			l.buffer = l.buffer[dropped:]
 		}
 	}
 	l.bufferLock.Unlock()
 
-	// if buffer needs to be flushed to disk, do it now
+	// Wake up the flushing goroutine, unless it's already been.
 	if needFlush {
-		go func() {
-			_ = l.flushLogBuffer(false)
-		}()
+		select {
+		case l.flushReq <- struct{}{}:
+		default:
+		}
 	}
 }
@@ -249,6 +249,24 @@ func TestQueryLogFileDisabled(t *testing.T) {
 	assert.Equal(t, "example2.org", ll[1].QHost)
 }
 
+func TestQueryLog_bufferLimit(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		MemSize:     1,
+		BaseDir:     t.TempDir(),
+	})
+
+	// The flushing goroutine isn't started, so the entries are never written.
+	for i := 0; i < minBufferLimit+5; i++ {
+		addEntry(l, "example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	}
+
+	assert.Len(t, l.buffer, minBufferLimit)
+	assert.Len(t, l.flushReq, 1)
+}
+
 func addEntry(l *queryLog, host string, answerStr, client net.IP) {
 	q := dns.Msg{
 		Question: []dns.Question{{
@@ -306,7 +324,7 @@ func assertLogEntry(t *testing.T, entry *logEntry, host string, answer, client n
 	require.NoError(t, msg.Unpack(entry.Answer))
 	require.Len(t, msg.Answer, 1)
 
-	ip := proxyutil.GetIPFromDNSRecord(msg.Answer[0]).To16()
+	ip := proxyutil.IPFromRR(msg.Answer[0]).To16()
 	assert.Equal(t, answer, ip)
 }
 
@@ -378,3 +396,15 @@ func TestLogEntriesByTime_sort(t *testing.T) {
 			"%s %s", entries[i+1].Time, entries[i].Time)
 	}
 }
+
+func TestQueryLog_Close(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:     true,
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+
+	assert.NotPanics(t, l.Close)
+	assert.NotPanics(t, l.Close)
+}
@@ -26,6 +26,11 @@ type QueryLog interface {
 
 	// WriteDiskConfig - write configuration
 	WriteDiskConfig(c *Config)
+
+	// PauseDiskWrites stops writing the log to the file, for example when
+	// the disk is almost full, if pause is true, and resumes it otherwise.
+	// The entries are still kept in memory while paused.
+	PauseDiskWrites(pause bool)
 }
 
 // Config - configuration object
@@ -55,10 +60,20 @@ type Config struct {
 	//
 	RotationIvl time.Duration
 
+	// MaxRotationIvl returns the maximum RotationIvl, which can be set via
+	// the HTTP API request r.  Zero means no limit.  It may be nil.
+	MaxRotationIvl func(r *http.Request) (ivl time.Duration)
+
 	// MemSize is the number of entries kept in a memory buffer before they
 	// are flushed to disk.
 	MemSize uint32
 
+	// FlushIvl is the maximum time the entries are kept in the memory buffer
+	// before they're flushed to disk, so a crash loses at most the entries
+	// of that period.  If it's zero, the entries are only flushed when there
+	// are MemSize of them.
+	FlushIvl time.Duration
+
 	// Enabled tells if the query log is enabled.
 	Enabled bool
 
@@ -104,6 +119,10 @@ type AddParams struct {
 
 	// AuthenticatedData shows if the response had the AD bit set.
 	AuthenticatedData bool
+
+	// ConsensusDiverged shows if the upstreams have returned different
+	// answers for a consensus domain.
+	ConsensusDiverged bool
 }
 
 // validate returns an error if the parameters aren't valid.
@@ -141,6 +160,9 @@ func newQueryLog(conf Config) (l *queryLog) {
 
 		logFile:    filepath.Join(conf.BaseDir, queryLogFileName),
 		anonymizer: conf.Anonymizer,
+
+		flushReq:  make(chan struct{}, 1),
+		stopFlush: make(chan struct{}),
 	}
 
 	l.conf = &Config{}
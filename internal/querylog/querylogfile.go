@@ -7,13 +7,14 @@ import (
 	"os"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 )
 
 // flushLogBuffer flushes the current buffer to file and resets the current buffer
 func (l *queryLog) flushLogBuffer(fullFlush bool) error {
-	if !l.conf.FileEnabled {
+	if !l.fileEnabled() {
 		return nil
 	}
 
@@ -29,7 +30,6 @@ func (l *queryLog) flushLogBuffer(fullFlush bool) error {
 	}
 	flushBuffer := l.buffer
 	l.buffer = nil
-	l.flushPending = false
 	l.bufferLock.Unlock()
 	err := l.flushToFile(flushBuffer)
 	if err != nil {
@@ -61,31 +61,28 @@ func (l *queryLog) flushToFile(buffer []*logEntry) (err error) {
 	elapsed := time.Since(start)
 	log.Debug("%d elements serialized via json in %v: %d kB, %v/entry, %v/entry", len(buffer), elapsed, b.Len()/1024, float64(b.Len())/float64(len(buffer)), elapsed/time.Duration(len(buffer)))
 
-	var zb bytes.Buffer
 	filename := l.logFile
-	zb = b
 
 	l.fileWriteLock.Lock()
 	defer l.fileWriteLock.Unlock()
-	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
-	if err != nil {
-		log.Error("failed to create file \"%s\": %s", filename, err)
-		return err
-	}
-	defer func() { err = errors.WithDeferred(err, f.Close()) }()
 
-	n, err := f.Write(zb.Bytes())
+	err = appendWithWAL(filename, b.Bytes())
 	if err != nil {
-		log.Error("Couldn't write to file: %s", err)
+		log.Error("querylog: writing to file %q: %s", filename, err)
+
 		return err
 	}
 
-	log.Debug("querylog: ok \"%s\": %v bytes written", filename, n)
+	log.Debug("querylog: ok \"%s\": %v bytes written", filename, b.Len())
 
 	return nil
 }
 
 func (l *queryLog) rotate() error {
+	// Don't rename the file during a write.
+	l.fileWriteLock.Lock()
+	defer l.fileWriteLock.Unlock()
+
 	from := l.logFile
 	to := l.logFile + ".1"
 
@@ -132,8 +129,34 @@ func (l *queryLog) readFileFirstTimeValue() (first time.Time, err error) {
 	return t, nil
 }
 
+// periodicFlush writes the buffered entries to the file each time the buffer
+// is full or l.conf.FlushIvl passes until l.stopFlush is closed.
+func (l *queryLog) periodicFlush() {
+	defer aghos.OnPanicAndExit("querylog: flushing")
+	defer close(l.flushStopped)
+
+	var tick <-chan time.Time
+	if ivl := l.conf.FlushIvl; ivl > 0 {
+		t := time.NewTicker(ivl)
+		defer t.Stop()
+
+		tick = t.C
+	}
+
+	for {
+		select {
+		case <-l.flushReq:
+			_ = l.flushLogBuffer(false)
+		case <-tick:
+			_ = l.flushLogBuffer(true)
+		case <-l.stopFlush:
+			return
+		}
+	}
+}
+
 func (l *queryLog) periodicRotate() {
-	defer log.OnPanic("querylog: rotating")
+	defer aghos.OnPanicAndExit("querylog: rotating")
 
 	l.checkAndRotate()
 
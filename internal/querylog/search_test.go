@@ -92,3 +92,83 @@ func TestQueryLog_Search_findClient(t *testing.T) {
 
 	assert.Equal(t, knownClientName, gotClient.Name)
 }
+
+func TestQueryLog_Search_clientTags(t *testing.T) {
+	const childIP = "1.2.3.4"
+
+	findClient := func(ids []string) (c *Client, _ error) {
+		for _, id := range ids {
+			if id == childIP {
+				return &Client{
+					Name: "Dave's iPhone",
+					Tags: []string{"device_phone", "user_child"},
+				}, nil
+			}
+		}
+
+		return nil, nil
+	}
+
+	l := newQueryLog(Config{
+		FindClient:  findClient,
+		BaseDir:     t.TempDir(),
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		Enabled:     true,
+		FileEnabled: true,
+	})
+	t.Cleanup(l.Close)
+
+	q := &dns.Msg{
+		Question: []dns.Question{{
+			Name: "example.com",
+		}},
+	}
+
+	l.Add(&AddParams{Question: q, ClientIP: net.IP{1, 2, 3, 4}})
+	l.Add(&AddParams{Question: q, ClientIP: net.IP{1, 2, 3, 5}})
+
+	testCases := []struct {
+		name   string
+		term   string
+		strict bool
+		want   int
+	}{{
+		name:   "name_strict",
+		term:   "Dave's iPhone",
+		strict: true,
+		want:   1,
+	}, {
+		name:   "tag_strict",
+		term:   "user_child",
+		strict: true,
+		want:   1,
+	}, {
+		name:   "tag_partial_strict",
+		term:   "child",
+		strict: true,
+		want:   0,
+	}, {
+		name:   "tag_partial",
+		term:   "CHILD",
+		strict: false,
+		want:   1,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sp := &searchParams{
+				searchCriteria: []searchCriterion{{
+					value:         tc.term,
+					criterionType: ctTerm,
+					strict:        tc.strict,
+				}},
+				olderThan: time.Now().Add(10 * time.Second),
+				limit:     10,
+			}
+
+			entries, _ := l.search(sp)
+			assert.Len(t, entries, tc.want)
+		})
+	}
+}
@@ -11,8 +11,8 @@ type criterionType int
 
 const (
 	// ctTerm is for searching by the domain name, the client's IP address,
-	// the client's ID or the client's name.  The domain name search
-	// supports IDNAs.
+	// the client's ID, the client's name, or the client's tags.  The domain
+	// name search supports IDNAs.
 	ctTerm criterionType = iota
 	// ctFilteringStatus is for searching by the filtering status.
 	//
@@ -60,12 +60,14 @@ func ctDomainOrClientCaseStrict(
 	name string,
 	host string,
 	ip string,
+	tags []string,
 ) (ok bool) {
 	return strings.EqualFold(host, term) ||
 		(asciiTerm != "" && strings.EqualFold(host, asciiTerm)) ||
 		strings.EqualFold(clientID, term) ||
 		strings.EqualFold(ip, term) ||
-		strings.EqualFold(name, term)
+		strings.EqualFold(name, term) ||
+		hasTag(tags, term, strings.EqualFold)
 }
 
 func ctDomainOrClientCaseNonStrict(
@@ -75,12 +77,25 @@ func ctDomainOrClientCaseNonStrict(
 	name string,
 	host string,
 	ip string,
+	tags []string,
 ) (ok bool) {
 	return stringutil.ContainsFold(clientID, term) ||
 		stringutil.ContainsFold(host, term) ||
 		(asciiTerm != "" && stringutil.ContainsFold(host, asciiTerm)) ||
 		stringutil.ContainsFold(ip, term) ||
-		stringutil.ContainsFold(name, term)
+		stringutil.ContainsFold(name, term) ||
+		hasTag(tags, term, stringutil.ContainsFold)
+}
+
+// hasTag returns true if any of tags matches term according to match.
+func hasTag(tags []string, term string, match func(s, term string) (ok bool)) (ok bool) {
+	for _, t := range tags {
+		if match(t, term) {
+			return true
+		}
+	}
+
+	return false
 }
 
 // quickMatch quickly checks if the line matches the given search criterion.
@@ -94,8 +109,9 @@ func (c *searchCriterion) quickMatch(line string, findClient quickMatchClientFun
 		clientID := readJSONValue(line, `"CID":"`)
 
 		var name string
+		var tags []string
 		if cli := findClient(clientID, ip); cli != nil {
-			name = cli.Name
+			name, tags = cli.Name, cli.Tags
 		}
 
 		if c.strict {
@@ -106,6 +122,7 @@ func (c *searchCriterion) quickMatch(line string, findClient quickMatchClientFun
 				name,
 				host,
 				ip,
+				tags,
 			)
 		}
 
@@ -116,6 +133,7 @@ func (c *searchCriterion) quickMatch(line string, findClient quickMatchClientFun
 			name,
 			host,
 			ip,
+			tags,
 		)
 	case ctFilteringStatus:
 		// Go on, as we currently don't do quick matches against
@@ -143,16 +161,17 @@ func (c *searchCriterion) ctDomainOrClientCase(e *logEntry) bool {
 	host := e.QHost
 
 	var name string
+	var tags []string
 	if e.client != nil {
-		name = e.client.Name
+		name, tags = e.client.Name, e.client.Tags
 	}
 
 	ip := e.IP.String()
 	if c.strict {
-		return ctDomainOrClientCaseStrict(c.value, c.asciiVal, clientID, name, host, ip)
+		return ctDomainOrClientCaseStrict(c.value, c.asciiVal, clientID, name, host, ip, tags)
 	}
 
-	return ctDomainOrClientCaseNonStrict(c.value, c.asciiVal, clientID, name, host, ip)
+	return ctDomainOrClientCaseNonStrict(c.value, c.asciiVal, clientID, name, host, ip, tags)
 }
 
 func (c *searchCriterion) ctFilteringStatusCase(res filtering.Result) bool {
@@ -171,7 +190,11 @@ func (c *searchCriterion) ctFilteringStatusCase(res filtering.Result) bool {
 
 	case filteringStatusBlocked:
 		return res.IsFiltered &&
-			res.Reason.In(filtering.FilteredBlockList, filtering.FilteredBlockedService)
+			res.Reason.In(
+				filtering.FilteredBlockList,
+				filtering.FilteredBlockedService,
+				filtering.FilteredQuarantine,
+			)
 
 	case filteringStatusBlockedService:
 		return res.IsFiltered && res.Reason == filtering.FilteredBlockedService
@@ -199,6 +222,7 @@ func (c *searchCriterion) ctFilteringStatusCase(res filtering.Result) bool {
 		return !res.Reason.In(
 			filtering.FilteredBlockList,
 			filtering.FilteredBlockedService,
+			filtering.FilteredQuarantine,
 			filtering.NotFilteredAllowList,
 		)
 
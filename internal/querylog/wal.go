@@ -0,0 +1,166 @@
+package querylog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// walSuffix is the suffix of the write-ahead log file, into which the entries
+// are written before appending them to the query log file.
+const walSuffix = ".wal"
+
+// walHeaderLen is the length of the header of the write-ahead log, which
+// consists of the offset in the query log file and the length of the data,
+// both as 64-bit big-endian integers.
+const walHeaderLen = 16
+
+// walSumLen is the length of the CRC-32 checksum ending the write-ahead log.
+const walSumLen = 4
+
+// appendWithWAL appends data to the file with name.  The data is written into
+// the write-ahead log first, so that if the process crashes, the data is
+// either lost entirely or appended by recoverWAL, but the file is never left
+// with partially written entries.
+func appendWithWAL(name string, data []byte) (err error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening file: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	off, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("seeking end of file: %w", err)
+	}
+
+	walName := name + walSuffix
+	err = writeWAL(walName, off, data)
+	if err != nil {
+		return fmt.Errorf("writing wal: %w", err)
+	}
+
+	_, err = f.WriteAt(data, off)
+	if err != nil {
+		return fmt.Errorf("writing file: %w", err)
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return fmt.Errorf("syncing file: %w", err)
+	}
+
+	return os.Remove(walName)
+}
+
+// writeWAL writes the write-ahead log for data appended at off into the file
+// with name and makes sure it's on disk.
+func writeWAL(name string, off int64, data []byte) (err error) {
+	rec := make([]byte, walHeaderLen, walHeaderLen+len(data)+walSumLen)
+	binary.BigEndian.PutUint64(rec[:8], uint64(off))
+	binary.BigEndian.PutUint64(rec[8:walHeaderLen], uint64(len(data)))
+	rec = append(rec, data...)
+	rec = rec[:len(rec)+walSumLen]
+	binary.BigEndian.PutUint32(rec[len(rec)-walSumLen:], crc32.ChecksumIEEE(rec[:len(rec)-walSumLen]))
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	_, err = f.Write(rec)
+	if err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// parseWAL parses the write-ahead log rec.  ok is false if rec is incomplete
+// or corrupted.
+func parseWAL(rec []byte) (off int64, data []byte, ok bool) {
+	if len(rec) < walHeaderLen+walSumLen {
+		return 0, nil, false
+	}
+
+	sumIdx := len(rec) - walSumLen
+	if crc32.ChecksumIEEE(rec[:sumIdx]) != binary.BigEndian.Uint32(rec[sumIdx:]) {
+		return 0, nil, false
+	}
+
+	l := binary.BigEndian.Uint64(rec[8:walHeaderLen])
+	if l != uint64(sumIdx-walHeaderLen) {
+		return 0, nil, false
+	}
+
+	return int64(binary.BigEndian.Uint64(rec[:8])), rec[walHeaderLen:sumIdx], true
+}
+
+// recoverWAL finishes the append to the file with name interrupted by a
+// crash, if there has been one.
+func recoverWAL(name string) (err error) {
+	walName := name + walSuffix
+	rec, err := os.ReadFile(walName)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("reading wal: %w", err)
+	}
+
+	off, data, ok := parseWAL(rec)
+	if !ok {
+		// The crash has happened while writing the write-ahead log, so
+		// the file hasn't been changed.
+		log.Info("querylog: discarding incomplete wal %q", walName)
+
+		return os.Remove(walName)
+	}
+
+	err = rewriteAt(name, off, data)
+	if err != nil {
+		return err
+	}
+
+	log.Info("querylog: recovered %d bytes from wal %q", len(data), walName)
+
+	return os.Remove(walName)
+}
+
+// rewriteAt removes everything after off from the file with name and appends
+// data.
+func rewriteAt(name string, off int64, data []byte) (err error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening file: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("getting file info: %w", err)
+	}
+
+	if size := fi.Size(); size < off {
+		// The file has been replaced, so just append the data.
+		off = size
+	}
+
+	// Remove the partially written entries, if any.
+	err = f.Truncate(off)
+	if err != nil {
+		return fmt.Errorf("truncating file: %w", err)
+	}
+
+	_, err = f.WriteAt(data, off)
+	if err != nil {
+		return fmt.Errorf("writing file: %w", err)
+	}
+
+	return f.Sync()
+}
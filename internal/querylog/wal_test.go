@@ -0,0 +1,90 @@
+package querylog
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppendWithWAL(t *testing.T) {
+	name := filepath.Join(t.TempDir(), queryLogFileName)
+
+	require.NoError(t, appendWithWAL(name, []byte("first\n")))
+	require.NoError(t, appendWithWAL(name, []byte("second\n")))
+
+	data, err := os.ReadFile(name)
+	require.NoError(t, err)
+
+	assert.Equal(t, "first\nsecond\n", string(data))
+
+	_, err = os.Stat(name + walSuffix)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestRecoverWAL(t *testing.T) {
+	const (
+		written = "first\n"
+		lost    = "second\nthird\n"
+	)
+
+	testCases := []struct {
+		// prepare writes the file and the wal as they are left by a crash.
+		prepare func(t *testing.T, name string)
+		name    string
+		want    string
+	}{{
+		prepare: func(t *testing.T, name string) {
+			require.NoError(t, os.WriteFile(name, []byte(written), 0o644))
+		},
+		name: "no_wal",
+		want: written,
+	}, {
+		prepare: func(t *testing.T, name string) {
+			// The crash has happened in the middle of the append.
+			require.NoError(t, os.WriteFile(name, []byte(written+lost[:4]), 0o644))
+			require.NoError(t, writeWAL(name+walSuffix, int64(len(written)), []byte(lost)))
+		},
+		name: "partial_append",
+		want: written + lost,
+	}, {
+		prepare: func(t *testing.T, name string) {
+			// The crash has happened right before removing the wal.
+			require.NoError(t, os.WriteFile(name, []byte(written+lost), 0o644))
+			require.NoError(t, writeWAL(name+walSuffix, int64(len(written)), []byte(lost)))
+		},
+		name: "complete_append",
+		want: written + lost,
+	}, {
+		prepare: func(t *testing.T, name string) {
+			// The crash has happened in the middle of writing the wal.
+			require.NoError(t, os.WriteFile(name, []byte(written), 0o644))
+			require.NoError(t, writeWAL(name+walSuffix, int64(len(written)), []byte(lost)))
+
+			rec, err := os.ReadFile(name + walSuffix)
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile(name+walSuffix, rec[:len(rec)-3], 0o644))
+		},
+		name: "partial_wal",
+		want: written,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), queryLogFileName)
+			tc.prepare(t, name)
+
+			require.NoError(t, recoverWAL(name))
+
+			data, err := os.ReadFile(name)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.want, string(data))
+
+			_, err = os.Stat(name + walSuffix)
+			assert.ErrorIs(t, err, os.ErrNotExist)
+		})
+	}
+}
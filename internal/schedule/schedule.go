@@ -0,0 +1,114 @@
+// Package schedule contains the types for the time intervals recurring on the
+// selected days of the week.
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// Config is the configuration of a daily time interval.
+type Config struct {
+	// Days are the days of the week, when the interval starts, as
+	// three-letter abbreviations, e.g. "mon".  If Days are empty, the
+	// interval starts every day.
+	Days []string `yaml:"days" json:"days"`
+
+	// Start is the beginning of the interval in the "15:04" format in the
+	// local time zone.
+	Start string `yaml:"start" json:"start"`
+
+	// End is the end of the interval in the "15:04" format in the local time
+	// zone.  If End is earlier than Start, the interval ends on the next
+	// day.
+	End string `yaml:"end" json:"end"`
+}
+
+// Interval is the parsed Config.
+type Interval struct {
+	// days are the days of the week indexed by time.Weekday on which the
+	// interval starts.
+	days [7]bool
+
+	// start and end are the bounds of the interval since midnight.
+	start, end time.Duration
+}
+
+// weekdays maps the three-letter abbreviations of the days of the week to
+// their values.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseDayTime parses s in the "15:04" format and returns the time since
+// midnight.
+func parseDayTime(s string) (d time.Duration, err error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// New parses c into a new interval.
+func New(c *Config) (ivl *Interval, err error) {
+	ivl = &Interval{}
+
+	if len(c.Days) == 0 {
+		for i := range ivl.days {
+			ivl.days[i] = true
+		}
+	}
+
+	for _, d := range c.Days {
+		wd, ok := weekdays[strings.ToLower(d)]
+		if !ok {
+			return nil, fmt.Errorf("bad day %q", d)
+		}
+
+		ivl.days[wd] = true
+	}
+
+	if ivl.start, err = parseDayTime(c.Start); err != nil {
+		return nil, fmt.Errorf("bad start: %w", err)
+	}
+
+	if ivl.end, err = parseDayTime(c.End); err != nil {
+		return nil, fmt.Errorf("bad end: %w", err)
+	}
+
+	if ivl.start == ivl.end {
+		return nil, errors.Error("empty interval")
+	}
+
+	return ivl, nil
+}
+
+// Contains returns true if t is within the interval.
+func (ivl *Interval) Contains(t time.Time) (ok bool) {
+	h, m, _ := t.Clock()
+	sinceMidnight := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute
+	wd := t.Weekday()
+
+	if ivl.start < ivl.end {
+		return ivl.days[wd] && sinceMidnight >= ivl.start && sinceMidnight < ivl.end
+	}
+
+	// The interval spans midnight, so it either has started today or
+	// yesterday.
+	if ivl.days[wd] && sinceMidnight >= ivl.start {
+		return true
+	}
+
+	return ivl.days[(wd+6)%7] && sinceMidnight < ivl.end
+}
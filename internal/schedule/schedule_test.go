@@ -0,0 +1,81 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterval_Contains(t *testing.T) {
+	ivl, err := New(&Config{
+		Days:  []string{"fri", "Sat"},
+		Start: "22:00",
+		End:   "02:30",
+	})
+	require.NoError(t, err)
+
+	// 2022-01-21 is a Friday.
+	testCases := []struct {
+		t    time.Time
+		name string
+		want bool
+	}{{
+		t:    time.Date(2022, 1, 21, 21, 59, 0, 0, time.UTC),
+		name: "before",
+		want: false,
+	}, {
+		t:    time.Date(2022, 1, 21, 22, 0, 0, 0, time.UTC),
+		name: "start",
+		want: true,
+	}, {
+		t:    time.Date(2022, 1, 22, 2, 29, 0, 0, time.UTC),
+		name: "next_day",
+		want: true,
+	}, {
+		t:    time.Date(2022, 1, 22, 2, 30, 0, 0, time.UTC),
+		name: "end",
+		want: false,
+	}, {
+		t:    time.Date(2022, 1, 23, 1, 0, 0, 0, time.UTC),
+		name: "after_saturday",
+		want: true,
+	}, {
+		t:    time.Date(2022, 1, 24, 1, 0, 0, 0, time.UTC),
+		name: "after_sunday",
+		want: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, ivl.Contains(tc.t))
+		})
+	}
+}
+
+func TestNew_bad(t *testing.T) {
+	testCases := []struct {
+		conf *Config
+		name string
+	}{{
+		conf: &Config{Days: []string{"monday"}, Start: "09:00", End: "10:00"},
+		name: "bad_day",
+	}, {
+		conf: &Config{Start: "9am", End: "10:00"},
+		name: "bad_start",
+	}, {
+		conf: &Config{Start: "09:00", End: "24:00"},
+		name: "bad_end",
+	}, {
+		conf: &Config{Start: "09:00", End: "09:00"},
+		name: "empty",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := New(tc.conf)
+			assert.Error(t, err)
+		})
+	}
+}
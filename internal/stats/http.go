@@ -136,4 +136,5 @@ func (s *statsCtx) initWeb() {
 	s.conf.HTTPRegister(http.MethodPost, "/control/stats_reset", s.handleStatsReset)
 	s.conf.HTTPRegister(http.MethodPost, "/control/stats_config", s.handleStatsConfig)
 	s.conf.HTTPRegister(http.MethodGet, "/control/stats_info", s.handleStatsInfo)
+	s.conf.HTTPRegister(http.MethodGet, "/control/stats_presence", s.handlePresence)
 }
@@ -0,0 +1,231 @@
+package stats
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/timeutil"
+)
+
+// Default values of the presence tracking settings.
+const (
+	defaultOfflineAfter = 10 * time.Minute
+	presenceCheckIvl    = 1 * time.Minute
+
+	// maxPresenceEvents is the maximum number of the state transitions kept
+	// for a single client.
+	maxPresenceEvents = 100
+)
+
+// PresenceConfig is the configuration of the tracking of the online and
+// offline states of the clients.
+type PresenceConfig struct {
+	// OfflineAfter is the duration of inactivity, after which the client is
+	// considered offline.  If it's zero, ten minutes are used.
+	OfflineAfter timeutil.Duration `yaml:"offline_after"`
+
+	// Enabled defines if the presence is tracked.
+	Enabled bool `yaml:"enabled"`
+}
+
+// PresenceState is the activity state of a client.
+type PresenceState string
+
+// Client presence states.
+const (
+	PresenceOnline  PresenceState = "online"
+	PresenceOffline PresenceState = "offline"
+)
+
+// PresenceEvent is a transition of a client into another state.
+type PresenceEvent struct {
+	// Time is the time of the transition.  For the transitions into the
+	// offline state it's the time of the last activity of the client.
+	Time time.Time `json:"time"`
+
+	// State is the new state.
+	State PresenceState `json:"state"`
+}
+
+// clientPresence is the presence of a single client.
+type clientPresence struct {
+	// lastSeen is the time of the last activity.
+	lastSeen time.Time
+
+	// events are the state transitions, oldest first.
+	events []PresenceEvent
+
+	// online is true if the client is currently online.
+	online bool
+}
+
+// presenceTracker tracks the state transitions of the clients derived from
+// their activity.  The transitions are only kept in memory.
+type presenceTracker struct {
+	// mu protects clients.
+	mu *sync.Mutex
+
+	// clients are the presences of the clients by their IDs.
+	clients map[string]*clientPresence
+
+	// done is closed to stop the periodic checks.
+	done chan struct{}
+
+	// now returns the current time.  It's replaced in tests.
+	now func() (t time.Time)
+
+	// offlineAfter is the duration of inactivity, after which the client is
+	// considered offline.
+	offlineAfter time.Duration
+}
+
+// newPresenceTracker returns a new properly initialized presence tracker.
+func newPresenceTracker(conf *PresenceConfig) (p *presenceTracker) {
+	offlineAfter := conf.OfflineAfter.Duration
+	if offlineAfter <= 0 {
+		offlineAfter = defaultOfflineAfter
+	}
+
+	return &presenceTracker{
+		mu:           &sync.Mutex{},
+		clients:      map[string]*clientPresence{},
+		done:         make(chan struct{}),
+		now:          time.Now,
+		offlineAfter: offlineAfter,
+	}
+}
+
+// addEvent appends a transition into state to cp dropping the oldest ones over
+// the limit.
+func (cp *clientPresence) addEvent(t time.Time, state PresenceState) {
+	cp.events = append(cp.events, PresenceEvent{
+		Time:  t,
+		State: state,
+	})
+
+	if over := len(cp.events) - maxPresenceEvents; over > 0 {
+		cp.events = append(cp.events[:0], cp.events[over:]...)
+	}
+}
+
+// seen marks the client with id as active now.
+func (p *presenceTracker) seen(id string) {
+	now := p.now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cp, ok := p.clients[id]
+	if !ok {
+		cp = &clientPresence{}
+		p.clients[id] = cp
+	}
+
+	cp.lastSeen = now
+	if !cp.online {
+		cp.online = true
+		cp.addEvent(now, PresenceOnline)
+	}
+}
+
+// check marks the clients inactive for too long as offline.
+func (p *presenceTracker) check() {
+	now := p.now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for id, cp := range p.clients {
+		if cp.online && now.Sub(cp.lastSeen) >= p.offlineAfter {
+			log.Debug("stats: client %s is offline", id)
+
+			cp.online = false
+			cp.addEvent(cp.lastSeen, PresenceOffline)
+		}
+	}
+}
+
+// run periodically checks for the clients that have gone offline until done
+// is closed.
+func (p *presenceTracker) run() {
+	defer aghos.OnPanicAndExit("stats: presence")
+
+	t := time.NewTicker(presenceCheckIvl)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			p.check()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// clientPresenceJSON is the presence timeline of a single client.
+type clientPresenceJSON struct {
+	LastSeen time.Time       `json:"last_seen"`
+	Client   string          `json:"client"`
+	State    PresenceState   `json:"state"`
+	Events   []PresenceEvent `json:"events"`
+}
+
+// timelines returns the presence timelines of the clients sorted by their IDs.
+// If id isn't empty, only the timeline of that client is returned.
+func (p *presenceTracker) timelines(id string) (tls []*clientPresenceJSON) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	tls = []*clientPresenceJSON{}
+	for cid, cp := range p.clients {
+		if id != "" && cid != id {
+			continue
+		}
+
+		state := PresenceOffline
+		if cp.online {
+			state = PresenceOnline
+		}
+
+		tls = append(tls, &clientPresenceJSON{
+			LastSeen: cp.lastSeen,
+			Client:   cid,
+			State:    state,
+			Events:   append([]PresenceEvent{}, cp.events...),
+		})
+	}
+
+	sort.Slice(tls, func(i, j int) bool { return tls[i].Client < tls[j].Client })
+
+	return tls
+}
+
+// presenceJSON is the response of the presence handler.
+type presenceJSON struct {
+	Clients []*clientPresenceJSON `json:"clients"`
+	Enabled bool                  `json:"enabled"`
+}
+
+// handlePresence is the handler for the GET /control/stats_presence HTTP API.
+func (s *statsCtx) handlePresence(w http.ResponseWriter, r *http.Request) {
+	resp := &presenceJSON{
+		Clients: []*clientPresenceJSON{},
+	}
+	if s.presence != nil {
+		resp.Enabled = true
+		resp.Clients = s.presence.timelines(r.URL.Query().Get("client"))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "encoding response: %s", err)
+	}
+}
@@ -0,0 +1,111 @@
+package stats
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPresenceTracker(t *testing.T) {
+	p := newPresenceTracker(&PresenceConfig{
+		OfflineAfter: timeutil.Duration{Duration: 5 * time.Minute},
+		Enabled:      true,
+	})
+
+	start := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	p.now = func() (t time.Time) { return now }
+
+	p.seen("1.2.3.4")
+
+	now = start.Add(4 * time.Minute)
+	p.seen("1.2.3.4")
+	p.check()
+
+	now = start.Add(9 * time.Minute)
+	p.check()
+
+	now = start.Add(20 * time.Minute)
+	p.seen("1.2.3.4")
+	p.seen("client-id")
+
+	tls := p.timelines("")
+	require.Len(t, tls, 2)
+
+	tl := tls[0]
+	assert.Equal(t, "1.2.3.4", tl.Client)
+	assert.Equal(t, PresenceOnline, tl.State)
+	assert.Equal(t, now, tl.LastSeen)
+	assert.Equal(t, []PresenceEvent{{
+		Time:  start,
+		State: PresenceOnline,
+	}, {
+		Time:  start.Add(4 * time.Minute),
+		State: PresenceOffline,
+	}, {
+		Time:  now,
+		State: PresenceOnline,
+	}}, tl.Events)
+
+	assert.Equal(t, "client-id", tls[1].Client)
+
+	t.Run("filter", func(t *testing.T) {
+		tls = p.timelines("client-id")
+		require.Len(t, tls, 1)
+
+		assert.Equal(t, "client-id", tls[0].Client)
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		for i := 0; i < maxPresenceEvents; i++ {
+			now = now.Add(time.Hour)
+			p.check()
+			p.seen("1.2.3.4")
+		}
+
+		tls = p.timelines("1.2.3.4")
+		require.Len(t, tls, 1)
+
+		events := tls[0].Events
+		require.Len(t, events, maxPresenceEvents)
+
+		assert.Equal(t, now, events[len(events)-1].Time)
+	})
+}
+
+func TestStats_handlePresence(t *testing.T) {
+	s := &statsCtx{
+		conf:     &Config{},
+		presence: newPresenceTracker(&PresenceConfig{Enabled: true}),
+	}
+
+	s.Update(Entry{
+		Client: "1.2.3.4",
+		Domain: "example.org",
+		Result: RNotFiltered,
+	})
+	s.ClientSeen("5.6.7.8")
+
+	r := httptest.NewRequest(http.MethodGet, "/control/stats_presence?client=5.6.7.8", nil)
+	w := httptest.NewRecorder()
+	s.handlePresence(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp := &presenceJSON{}
+	err := json.Unmarshal(w.Body.Bytes(), resp)
+	require.NoError(t, err)
+
+	assert.True(t, resp.Enabled)
+	require.Len(t, resp.Clients, 1)
+
+	c := resp.Clients[0]
+	assert.Equal(t, "5.6.7.8", c.Client)
+	assert.Equal(t, PresenceOnline, c.State)
+	require.Len(t, c.Events, 1)
+}
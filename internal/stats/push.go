@@ -0,0 +1,265 @@
+package stats
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/timeutil"
+)
+
+// Default values of the push exporter settings.
+const (
+	defaultPushIvl         = 1 * time.Minute
+	defaultPushMeasurement = "adguardhome"
+)
+
+// PushConfig is the configuration of the exporter that periodically pushes the
+// statistics to a time series database using the InfluxDB line protocol.
+type PushConfig struct {
+	// Tags are added to each pushed line.
+	Tags map[string]string `yaml:"tags"`
+
+	// URL is the write endpoint of the database, for example
+	// "http://localhost:8086/write?db=adguard" for InfluxDB 1.x or
+	// VictoriaMetrics.  If it's empty, the exporter is disabled.
+	URL string `yaml:"url"`
+
+	// Token, if not empty, is sent in the Authorization header as required
+	// by InfluxDB 2.x.
+	Token string `yaml:"token"`
+
+	// Measurement is the name of the measurement.  If it's empty,
+	// "adguardhome" is used.
+	Measurement string `yaml:"measurement"`
+
+	// Interval is the interval between the pushes.  If it's zero, the
+	// statistics are pushed every minute.
+	Interval timeutil.Duration `yaml:"interval"`
+}
+
+// pushCounters are the cumulative counters sent by the push exporter.  Unlike
+// the units, they are never reset, so that the database can compute the rates.
+type pushCounters struct {
+	// nResult is the number of requests per result.
+	nResult []uint64
+
+	// nTotal is the total number of requests.
+	nTotal uint64
+
+	// timeSum is the sum of processing time of all requests (msec).
+	timeSum uint64
+
+	// timeMax is the maximum processing time since the last push (msec).
+	timeMax uint32
+}
+
+// update adds the entry to the counters.  It must be called with the stats
+// lock held.
+func (c *pushCounters) update(e *Entry) {
+	c.nResult[e.Result]++
+	c.nTotal++
+	c.timeSum += uint64(e.Time)
+	if e.Time > c.timeMax {
+		c.timeMax = e.Time
+	}
+}
+
+// pusher pushes the statistics to a time series database.
+type pusher struct {
+	// done is closed to stop the pushes.
+	done chan struct{}
+
+	// cli is the client used for the pushes.
+	cli *http.Client
+
+	// tags is the escaped and sorted set of tags prepended to the fields.
+	tags string
+
+	// url is the write endpoint.
+	url string
+
+	// token is the optional authorization token.
+	token string
+
+	// measurement is the escaped name of the measurement.
+	measurement string
+
+	// ivl is the interval between the pushes.
+	ivl time.Duration
+
+	// prevTotal and prevTimeSum are the values of the counters at the time
+	// of the previous push, used to compute the average processing time.
+	prevTotal   uint64
+	prevTimeSum uint64
+}
+
+// newPusher returns a new pusher for conf.  cli may be nil.
+func newPusher(conf *PushConfig, cli *http.Client) (p *pusher) {
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+
+	measurement := conf.Measurement
+	if measurement == "" {
+		measurement = defaultPushMeasurement
+	}
+
+	ivl := conf.Interval.Duration
+	if ivl == 0 {
+		ivl = defaultPushIvl
+	}
+
+	return &pusher{
+		done:        make(chan struct{}),
+		cli:         cli,
+		tags:        formatTags(conf.Tags),
+		url:         conf.URL,
+		token:       conf.Token,
+		measurement: escapeLineProto(measurement, ", "),
+		ivl:         ivl,
+	}
+}
+
+// formatTags returns the tags formatted for the line protocol.
+func formatTags(tags map[string]string) (s string) {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+
+	// Tags should be sorted by key for the best performance of the
+	// database.
+	sort.Strings(keys)
+
+	b := &strings.Builder{}
+	for _, k := range keys {
+		v := tags[k]
+		if k == "" || v == "" {
+			continue
+		}
+
+		_ = b.WriteByte(',')
+		_, _ = b.WriteString(escapeLineProto(k, ",= "))
+		_ = b.WriteByte('=')
+		_, _ = b.WriteString(escapeLineProto(v, ",= "))
+	}
+
+	return b.String()
+}
+
+// escapeLineProto escapes all characters from chars in s with a backslash.
+func escapeLineProto(s, chars string) (esc string) {
+	if !strings.ContainsAny(s, chars) {
+		return s
+	}
+
+	b := &strings.Builder{}
+	for _, r := range s {
+		if strings.ContainsRune(chars, r) {
+			_ = b.WriteByte('\\')
+		}
+
+		_, _ = b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// run pushes the statistics of s every p.ivl until p.done is closed.
+func (p *pusher) run(s *statsCtx) {
+	defer aghos.OnPanicAndExit("stats: pusher")
+
+	t := time.NewTicker(p.ivl)
+	defer t.Stop()
+
+	for {
+		select {
+		case now := <-t.C:
+			err := p.push(p.line(s.pushSnapshot(), now))
+			if err != nil {
+				log.Error("stats: pushing: %s", err)
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// line formats the counters c as a single line of the line protocol.
+func (p *pusher) line(c pushCounters, now time.Time) (line []byte) {
+	var avg float64
+	if n := c.nTotal - p.prevTotal; n > 0 {
+		avg = float64(c.timeSum-p.prevTimeSum) / float64(n)
+	}
+	p.prevTotal, p.prevTimeSum = c.nTotal, c.timeSum
+
+	b := &bytes.Buffer{}
+	_, _ = b.WriteString(p.measurement)
+	_, _ = b.WriteString(p.tags)
+	_, _ = fmt.Fprintf(
+		b,
+		" dns_queries=%di,blocked_filtering=%di,replaced_safebrowsing=%di,"+
+			"replaced_safesearch=%di,replaced_parental=%di,"+
+			"avg_processing_time_ms=%s,max_processing_time_ms=%di %d\n",
+		c.nTotal,
+		c.nResult[RFiltered],
+		c.nResult[RSafeBrowsing],
+		c.nResult[RSafeSearch],
+		c.nResult[RParental],
+		strconv.FormatFloat(avg, 'f', -1, 64),
+		c.timeMax,
+		now.UnixNano(),
+	)
+
+	return b.Bytes()
+}
+
+// push sends line to the database.
+func (p *pusher) push(line []byte) (err error) {
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(line))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Token "+p.token)
+	}
+
+	resp, err := p.cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	// Drain the body to reuse the connection.
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// pushSnapshot returns a copy of the current push counters and resets the
+// maximum processing time.
+func (s *statsCtx) pushSnapshot() (c pushCounters) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c = s.push
+	c.nResult = append([]uint64(nil), s.push.nResult...)
+	s.push.timeMax = 0
+
+	return c
+}
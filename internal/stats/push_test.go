@@ -0,0 +1,65 @@
+package stats
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPusher(t *testing.T) {
+	var gotBody, gotAuth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		gotBody, gotAuth = string(b), r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+
+	p := newPusher(&PushConfig{
+		Tags: map[string]string{
+			"host": "home router",
+			"dc":   "a,b",
+		},
+		URL:   srv.URL,
+		Token: "secret",
+	}, srv.Client())
+
+	s := &statsCtx{
+		mu:   &sync.Mutex{},
+		conf: &Config{},
+		push: pushCounters{
+			nResult: make([]uint64, rLast),
+		},
+		pusher: p,
+	}
+
+	s.Update(Entry{Client: "1.2.3.4", Domain: "example.org", Result: RNotFiltered, Time: 10})
+	s.Update(Entry{Client: "1.2.3.4", Domain: "ads.example", Result: RFiltered, Time: 2})
+	s.Update(Entry{Client: "1.2.3.4", Domain: "bad.example", Result: RSafeBrowsing, Time: 3})
+
+	line := p.line(s.pushSnapshot(), time.Unix(0, 42))
+	assert.Equal(t, `adguardhome,dc=a\,b,host=home\ router `+
+		`dns_queries=3i,blocked_filtering=1i,replaced_safebrowsing=1i,`+
+		`replaced_safesearch=0i,replaced_parental=0i,`+
+		`avg_processing_time_ms=5,max_processing_time_ms=10i 42`+"\n", string(line))
+
+	// The maximum is reset and the average only covers the new requests.
+	s.Update(Entry{Client: "1.2.3.4", Domain: "example.org", Result: RNotFiltered, Time: 4})
+	line = p.line(s.pushSnapshot(), time.Unix(0, 43))
+	assert.Contains(t, string(line), "dns_queries=4i,")
+	assert.Contains(t, string(line), "avg_processing_time_ms=4,max_processing_time_ms=4i 43")
+
+	err := p.push(line)
+	require.NoError(t, err)
+
+	assert.Equal(t, string(line), gotBody)
+	assert.Equal(t, "Token secret", gotAuth)
+}
@@ -0,0 +1,163 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+
+	"github.com/AdguardTeam/golibs/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The database is partitioned by time into segments.  Each segment is a bucket
+// with the units of a single day keyed by their IDs, so that the old units are
+// removed by deleting whole segments and a range of units is read from a few
+// buckets only.
+//
+// The per-unit buckets of the previous versions aren't converted.  They are
+// still read and deleted once outdated, so that downgrading only loses the
+// units written into the segments, which the previous versions ignore.
+
+// segmentUnits is the number of units in a segment.
+const segmentUnits = 24
+
+// segmentPrefix is the prefix of the names of the segment buckets, which
+// distinguishes them from the per-unit buckets of the previous versions.
+var segmentPrefix = []byte("seg:")
+
+// segmentName returns the name of the bucket of the segment containing the
+// unit with id.
+func segmentName(id uint32) (name []byte) {
+	name = make([]byte, len(segmentPrefix)+4)
+	copy(name, segmentPrefix)
+	binary.BigEndian.PutUint32(name[len(segmentPrefix):], id/segmentUnits)
+
+	return name
+}
+
+// segmentNameToFirstID returns the ID of the first unit of the segment with
+// name.  ok is false if name is not a valid segment name.
+func segmentNameToFirstID(name []byte) (id uint32, ok bool) {
+	if len(name) != len(segmentPrefix)+4 || !bytes.HasPrefix(name, segmentPrefix) {
+		return 0, false
+	}
+
+	return binary.BigEndian.Uint32(name[len(segmentPrefix):]) * segmentUnits, true
+}
+
+// unitKey returns the key of the unit with id within its segment.
+func unitKey(id uint32) (key []byte) {
+	key = make([]byte, 4)
+	binary.BigEndian.PutUint32(key, id)
+
+	return key
+}
+
+// legacyBucketNameLen is the length of the name of a per-unit bucket of the
+// previous versions, a 64-bit unsigned integer.
+const legacyBucketNameLen = 8
+
+// legacyBucketName returns the name of the per-unit bucket of the previous
+// versions for the unit with id.
+func legacyBucketName(id uint32) (name []byte) {
+	name = make([]byte, legacyBucketNameLen)
+	binary.BigEndian.PutUint64(name, uint64(id))
+
+	return name
+}
+
+// legacyUnitKey is the key of the unit within its per-unit bucket of the
+// previous versions.
+var legacyUnitKey = []byte{0}
+
+// deleteOldUnits deletes the segments with all the units older than firstID as
+// well as such per-unit buckets of the previous versions and returns the number
+// of the deleted buckets.
+func deleteOldUnits(tx *bolt.Tx, firstID uint32) (n int) {
+	var names [][]byte
+	_ = tx.ForEach(func(name []byte, _ *bolt.Bucket) (err error) {
+		if segFirstID, ok := segmentNameToFirstID(name); ok {
+			if segFirstID+segmentUnits <= firstID {
+				names = append(names, append([]byte(nil), name...))
+			}
+		} else if len(name) == legacyBucketNameLen {
+			if uint32(binary.BigEndian.Uint64(name)) < firstID {
+				names = append(names, append([]byte(nil), name...))
+			}
+		}
+
+		return nil
+	})
+
+	for _, name := range names {
+		err := tx.DeleteBucket(name)
+		if err != nil {
+			log.Debug("stats: deleting bucket %x: %s", name, err)
+
+			continue
+		}
+
+		log.Debug("stats: deleted bucket %x", name)
+
+		n++
+	}
+
+	return n
+}
+
+// flushUnitToDB writes udb into the segment of the unit with id.
+func (s *statsCtx) flushUnitToDB(tx *bolt.Tx, id uint32, udb *unitDB) bool {
+	log.Tracef("Flushing unit %d", id)
+
+	seg, err := tx.CreateBucketIfNotExists(segmentName(id))
+	if err != nil {
+		log.Error("tx.CreateBucketIfNotExists: %s", err)
+		return false
+	}
+
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	err = enc.Encode(udb)
+	if err != nil {
+		log.Error("gob.Encode: %s", err)
+		return false
+	}
+
+	err = seg.Put(unitKey(id), buf.Bytes())
+	if err != nil {
+		log.Error("bkt.Put: %s", err)
+		return false
+	}
+
+	return true
+}
+
+// loadUnitFromDB reads the unit with id from its segment or, if there is none,
+// from its per-unit bucket of the previous versions.  It returns nil if there
+// is no such unit.
+func (s *statsCtx) loadUnitFromDB(tx *bolt.Tx, id uint32) *unitDB {
+	var data []byte
+	if seg := tx.Bucket(segmentName(id)); seg != nil {
+		data = seg.Get(unitKey(id))
+	}
+
+	if data == nil {
+		if bkt := tx.Bucket(legacyBucketName(id)); bkt != nil {
+			data = bkt.Get(legacyUnitKey)
+		}
+	}
+
+	if data == nil {
+		return nil
+	}
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	udb := unitDB{}
+	err := dec.Decode(&udb)
+	if err != nil {
+		log.Error("gob Decode: %s", err)
+		return nil
+	}
+
+	return &udb
+}
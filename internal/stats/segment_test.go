@@ -0,0 +1,152 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/gob"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestSegmentName(t *testing.T) {
+	first, ok := segmentNameToFirstID(segmentName(49))
+	require.True(t, ok)
+
+	assert.EqualValues(t, 48, first)
+	assert.Equal(t, segmentName(48), segmentName(71))
+	assert.NotEqual(t, segmentName(71), segmentName(72))
+
+	_, ok = segmentNameToFirstID([]byte{0, 0, 0, 0, 0, 0, 0, 1})
+	assert.False(t, ok)
+}
+
+func TestStats_legacyUnits(t *testing.T) {
+	const curID = 1000
+
+	filename := filepath.Join(t.TempDir(), "stats.db")
+
+	db, err := bolt.Open(filename, 0o644, nil)
+	require.NoError(t, err)
+
+	// Write the previous and the outdated units in the legacy format.
+	err = db.Update(func(tx *bolt.Tx) (err error) {
+		for _, id := range []uint32{curID - 1, curID - 100} {
+			buf := &bytes.Buffer{}
+			err = gob.NewEncoder(buf).Encode(&unitDB{
+				NTotal:  uint64(id),
+				NResult: make([]uint64, rLast),
+			})
+			require.NoError(t, err)
+
+			var bkt *bolt.Bucket
+			bkt, err = tx.CreateBucket(legacyBucketName(id))
+			require.NoError(t, err)
+
+			err = bkt.Put(legacyUnitKey, buf.Bytes())
+			require.NoError(t, err)
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	s, err := createObject(Config{
+		Filename:  filename,
+		LimitDays: 1,
+		UnitID:    func() (id uint32) { return curID },
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, func() (err error) {
+		s.Close()
+
+		return nil
+	})
+
+	// The previous unit is read from the legacy bucket.
+	d, ok := s.getData()
+	require.True(t, ok)
+
+	assert.EqualValues(t, curID-1, d.NumDNSQueries)
+
+	tx := s.beginTxn(false)
+	require.NotNil(t, tx)
+	t.Cleanup(func() { _ = tx.Rollback() })
+
+	var names [][]byte
+	err = tx.ForEach(func(name []byte, _ *bolt.Bucket) (err error) {
+		names = append(names, append([]byte(nil), name...))
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Only the outdated legacy bucket is deleted.
+	assert.Equal(t, [][]byte{legacyBucketName(curID - 1)}, names)
+}
+
+func TestStats_rotate(t *testing.T) {
+	var hour uint32 = 100
+	s, err := createObject(Config{
+		Filename:  filepath.Join(t.TempDir(), "stats.db"),
+		LimitDays: 1,
+		UnitID:    func() (id uint32) { return atomic.LoadUint32(&hour) },
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, func() (err error) {
+		s.Close()
+
+		return nil
+	})
+
+	for i := 0; i < 30; i++ {
+		s.Update(Entry{
+			Domain: "example.com",
+			Client: "127.0.0.1",
+			Result: RNotFiltered,
+			Time:   1,
+		})
+
+		id := atomic.AddUint32(&hour, 1)
+		u, udb := s.rotate(id)
+		require.NotNil(t, u)
+
+		assert.EqualValues(t, 1, udb.NTotal)
+	}
+
+	s.Update(Entry{
+		Domain: "example.com",
+		Client: "127.0.0.2",
+		Result: RNotFiltered,
+		Time:   1,
+	})
+
+	// The units aren't flushed, so they are all pending.
+	snap := s.loadSnapshot()
+	assert.Len(t, snap.pending, 23)
+
+	d, ok := s.getData()
+	require.True(t, ok)
+
+	assert.EqualValues(t, 24, d.NumDNSQueries)
+	require.Len(t, d.DNSQueries, 24)
+
+	for _, n := range d.DNSQueries {
+		assert.EqualValues(t, 1, n)
+	}
+
+	// The flushed unit is read from the database.
+	curID := atomic.LoadUint32(&hour)
+	s.flush(curID-1, snap.pending[curID-1], curID)
+	assert.Len(t, s.loadSnapshot().pending, 22)
+
+	d, ok = s.getData()
+	require.True(t, ok)
+
+	assert.EqualValues(t, 24, d.NumDNSQueries)
+}
@@ -0,0 +1,104 @@
+package stats
+
+// SharedData is the read-only statistics shown to the holders of the share
+// links.
+type SharedData struct {
+	// TimeUnits is either "hours" or "days".
+	TimeUnits string `json:"time_units"`
+
+	// DNSQueries are the numbers of the requests per time unit.
+	DNSQueries []uint64 `json:"dns_queries"`
+
+	// BlockedFiltering are the numbers of the blocked requests per time
+	// unit.  It's only set for the aggregate statistics, since those aren't
+	// kept per client.
+	BlockedFiltering []uint64 `json:"blocked_filtering,omitempty"`
+
+	// TopQueried are the most requested domains.  It's only set for the
+	// aggregate statistics.
+	TopQueried []topAddrs `json:"top_queried_domains,omitempty"`
+
+	// TopBlocked are the most blocked domains.  It's only set for the
+	// aggregate statistics.
+	TopBlocked []topAddrs `json:"top_blocked_domains,omitempty"`
+
+	// Clients are the numbers of the requests of the matched clients.  It's
+	// only set for the per-client statistics.
+	Clients []topAddrs `json:"clients,omitempty"`
+
+	// NumDNSQueries is the total number of the requests.
+	NumDNSQueries uint64 `json:"num_dns_queries"`
+
+	// NumBlockedFiltering is the total number of the blocked requests.  It's
+	// only set for the aggregate statistics.
+	NumBlockedFiltering uint64 `json:"num_blocked_filtering,omitempty"`
+}
+
+// SharedData implements the Stats interface for *statsCtx.
+func (s *statsCtx) SharedData(match func(client string) (ok bool)) (data *SharedData, ok bool) {
+	if s.conf.limit == 0 {
+		return &SharedData{
+			TimeUnits:  "days",
+			DNSQueries: []uint64{},
+		}, true
+	}
+
+	if match == nil {
+		var resp statsResponse
+		resp, ok = s.getData()
+		if !ok {
+			return nil, false
+		}
+
+		return &SharedData{
+			TimeUnits:           resp.TimeUnits,
+			DNSQueries:          resp.DNSQueries,
+			BlockedFiltering:    resp.BlockedFiltering,
+			TopQueried:          resp.TopQueried,
+			TopBlocked:          resp.TopBlocked,
+			NumDNSQueries:       resp.NumDNSQueries,
+			NumBlockedFiltering: resp.NumBlockedFiltering,
+		}, true
+	}
+
+	limit := s.conf.limit
+	timeUnit := timeUnitFor(limit)
+
+	units, firstID := s.loadUnits(limit)
+	if units == nil {
+		return nil, false
+	}
+
+	matched := func(u *unitDB) (pairs []countPair) {
+		for _, p := range u.Clients {
+			if match(p.Name) {
+				pairs = append(pairs, p)
+			}
+		}
+
+		return pairs
+	}
+
+	data = &SharedData{
+		TimeUnits: "hours",
+		DNSQueries: statsCollector(units, firstID, timeUnit, func(u *unitDB) (num uint64) {
+			for _, p := range matched(u) {
+				num += p.Count
+			}
+
+			return num
+		}),
+		Clients: topsCollector(units, maxClients, matched),
+	}
+	if timeUnit == Days {
+		data.TimeUnits = "days"
+	}
+
+	for _, c := range data.Clients {
+		for _, n := range c {
+			data.NumDNSQueries += n
+		}
+	}
+
+	return data, true
+}
@@ -0,0 +1,56 @@
+package stats
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats_SharedData(t *testing.T) {
+	s, err := createObject(Config{
+		Filename:  filepath.Join(t.TempDir(), "stats.db"),
+		LimitDays: 1,
+	})
+	require.NoError(t, err)
+	t.Cleanup(s.Close)
+
+	for _, e := range []Entry{{
+		Domain: "example.org",
+		Client: "1.2.3.4",
+		Result: RNotFiltered,
+	}, {
+		Domain: "ads.example",
+		Client: "1.2.3.4",
+		Result: RFiltered,
+	}, {
+		Domain: "example.com",
+		Client: "5.6.7.8",
+		Result: RNotFiltered,
+	}} {
+		s.Update(e)
+	}
+
+	t.Run("aggregate", func(t *testing.T) {
+		d, ok := s.SharedData(nil)
+		require.True(t, ok)
+
+		assert.EqualValues(t, 3, d.NumDNSQueries)
+		assert.EqualValues(t, 1, d.NumBlockedFiltering)
+		assert.NotEmpty(t, d.TopQueried)
+		assert.Empty(t, d.Clients)
+	})
+
+	t.Run("client", func(t *testing.T) {
+		d, ok := s.SharedData(func(client string) (ok bool) { return client == "1.2.3.4" })
+		require.True(t, ok)
+
+		assert.EqualValues(t, 2, d.NumDNSQueries)
+		require.Len(t, d.DNSQueries, 24)
+		assert.EqualValues(t, 2, d.DNSQueries[23])
+		assert.Equal(t, []topAddrs{{"1.2.3.4": 2}}, d.Clients)
+		assert.Empty(t, d.TopQueried)
+		assert.Empty(t, d.BlockedFiltering)
+	})
+}
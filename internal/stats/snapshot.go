@@ -0,0 +1,225 @@
+package stats
+
+import (
+	"hash/fnv"
+	"runtime"
+	"sync"
+)
+
+// unitShards is the number of the shards of the current unit.  The requests
+// of different clients are mostly counted in different shards, so that they
+// don't contend for a single lock.
+const unitShards = 16
+
+// unitShard is a part of the current unit.
+type unitShard struct {
+	// mu protects u.
+	mu *sync.Mutex
+
+	// u is the part of the current unit.  It's nil once the statistics are
+	// closed.
+	u *unit
+}
+
+// shardFor returns the shard counting the requests of client.
+func (s *statsCtx) shardFor(client string) (sh *unitShard) {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(client))
+
+	return s.shards[h.Sum32()%unitShards]
+}
+
+// newShards returns the shards of a new empty unit with id.
+func newShards(id uint32) (shards []*unitShard) {
+	shards = make([]*unitShard, unitShards)
+	for i := range shards {
+		shards[i] = &unitShard{
+			mu: &sync.Mutex{},
+			u:  newUnit(id),
+		}
+	}
+
+	return shards
+}
+
+// newUnit returns a new empty unit with id.
+func newUnit(id uint32) (u *unit) {
+	return &unit{
+		id:             id,
+		nResult:        make([]uint64, rLast),
+		domains:        map[string]uint64{},
+		blockedDomains: map[string]uint64{},
+		clients:        map[string]uint64{},
+	}
+}
+
+// merge adds the counters of other to u.
+func (u *unit) merge(other *unit) {
+	u.nTotal += other.nTotal
+	u.timeSum += other.timeSum
+	for i, n := range other.nResult {
+		u.nResult[i] += n
+	}
+
+	for k, n := range other.domains {
+		u.domains[k] += n
+	}
+
+	for k, n := range other.blockedDomains {
+		u.blockedDomains[k] += n
+	}
+
+	for k, n := range other.clients {
+		u.clients[k] += n
+	}
+}
+
+// swapUnits replaces the shards of the current unit with the ones of a new
+// empty unit with id and returns the merged previous unit.  If closed is true,
+// the shards are left empty, which stops periodicFlush.  s.mu is expected to
+// be locked.
+func (s *statsCtx) swapUnits(id uint32, closed bool) (u *unit) {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+	}
+
+	defer func() {
+		for _, sh := range s.shards {
+			sh.mu.Unlock()
+		}
+	}()
+
+	for _, sh := range s.shards {
+		if sh.u == nil {
+			continue
+		} else if u == nil {
+			u = newUnit(sh.u.id)
+		}
+
+		u.merge(sh.u)
+
+		if closed {
+			sh.u = nil
+		} else {
+			sh.u = newUnit(id)
+		}
+	}
+
+	return u
+}
+
+// currentUnit returns a merged copy of the current unit.  ok is false if the
+// statistics are closed.  The shards are locked one at a time, so the writers
+// are only blocked for the time of copying one shard.
+func (s *statsCtx) currentUnit() (u *unit, ok bool) {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		if sh.u == nil {
+			sh.mu.Unlock()
+
+			return nil, false
+		} else if u == nil {
+			u = newUnit(sh.u.id)
+		} else if u.id != sh.u.id {
+			// The unit has been swapped while merging, so start over.
+			sh.mu.Unlock()
+
+			return s.currentUnit()
+		}
+
+		u.merge(sh.u)
+		sh.mu.Unlock()
+	}
+
+	return u, true
+}
+
+// unitsSnapshot is a copy-on-write snapshot of the units, which have been
+// rotated out but aren't written to the database yet, so that the readers see
+// them right away.  The rest of the units are read from the database, so that
+// only the current and the pending units are kept in memory.  It must not be
+// modified once published; the writers publish a modified copy instead.
+type unitsSnapshot struct {
+	// pending are the units, which aren't written to the database yet, by
+	// their IDs.
+	pending map[uint32]*unitDB
+
+	// curID is the ID of the current unit at the time of publishing.
+	curID uint32
+}
+
+// loadSnapshot returns the current snapshot of the pending units.
+func (s *statsCtx) loadSnapshot() (snap *unitsSnapshot) {
+	return s.snapshot.Load().(*unitsSnapshot)
+}
+
+// publishPending publishes a new snapshot with udb of the unit with id added
+// and the units older than the limit removed.  curID is the ID of the new
+// current unit.  s.mu is expected to be locked.
+func (s *statsCtx) publishPending(id uint32, udb *unitDB, curID uint32) {
+	prev := s.loadSnapshot()
+	firstID := curID - s.conf.limit + 1
+
+	pending := make(map[uint32]*unitDB, len(prev.pending)+1)
+	for uid, u := range prev.pending {
+		if uid-firstID < s.conf.limit {
+			pending[uid] = u
+		}
+	}
+
+	pending[id] = udb
+
+	s.snapshot.Store(&unitsSnapshot{
+		pending: pending,
+		curID:   curID,
+	})
+}
+
+// unpublishPending publishes a new snapshot without the unit with id, once it's
+// been written to the database or dropped.  s.mu is expected to be locked.
+func (s *statsCtx) unpublishPending(id uint32) {
+	prev := s.loadSnapshot()
+	if _, ok := prev.pending[id]; !ok {
+		return
+	}
+
+	pending := make(map[uint32]*unitDB, len(prev.pending))
+	for uid, u := range prev.pending {
+		if uid != id {
+			pending[uid] = u
+		}
+	}
+
+	s.snapshot.Store(&unitsSnapshot{
+		pending: pending,
+		curID:   prev.curID,
+	})
+}
+
+// resetSnapshot publishes a new empty snapshot with the ID of the current unit
+// curID.  s.mu is expected to be locked.
+func (s *statsCtx) resetSnapshot(curID uint32) {
+	s.snapshot.Store(&unitsSnapshot{
+		pending: map[uint32]*unitDB{},
+		curID:   curID,
+	})
+}
+
+// maxSnapshotRetries is the number of attempts to get a current unit
+// consistent with the snapshot, which only fails while the unit is being
+// flushed.
+const maxSnapshotRetries = 10
+
+// consistentUnits returns the snapshot of the pending units and the merged
+// current unit consistent with it.  ok is false if the statistics are closed.
+func (s *statsCtx) consistentUnits() (snap *unitsSnapshot, cur *unit, ok bool) {
+	for i := 0; ; i++ {
+		snap = s.loadSnapshot()
+		cur, ok = s.currentUnit()
+		if !ok || cur.id == snap.curID || i == maxSnapshotRetries {
+			return snap, cur, ok
+		}
+
+		runtime.Gosched()
+	}
+}
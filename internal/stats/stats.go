@@ -26,6 +26,17 @@ type Config struct {
 	// Register an HTTP handler
 	HTTPRegister func(string, string, func(http.ResponseWriter, *http.Request))
 
+	// HTTPClient is the client used to push the statistics.  If it's nil,
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// Push is the configuration of the push exporter.
+	Push PushConfig
+
+	// Presence is the configuration of the tracking of the online and
+	// offline states of the clients.
+	Presence PresenceConfig
+
 	limit uint32 // maximum time we need to keep data for (in hours)
 }
 
@@ -46,11 +57,25 @@ type Stats interface {
 	// Update counters
 	Update(e Entry)
 
+	// ClientSeen marks the client as active without counting a request, for
+	// example, when it has renewed its DHCP lease.
+	ClientSeen(client string)
+
 	// Get IP addresses of the clients with the most number of requests
 	GetTopClientsIP(limit uint) []net.IP
 
 	// WriteDiskConfig - write configuration
 	WriteDiskConfig(dc *DiskConfig)
+
+	// PauseDiskWrites stops writing the statistics to the database, for
+	// example when the disk is almost full, if pause is true, and resumes it
+	// otherwise.  The statistics of the hours passed while paused are lost.
+	PauseDiskWrites(pause bool)
+
+	// SharedData returns the read-only statistics of the clients for which
+	// match returns true.  If match is nil, the aggregate statistics without
+	// the per-client data are returned.
+	SharedData(match func(client string) (ok bool)) (data *SharedData, ok bool)
 }
 
 // TimeUnit - time unit
@@ -1,17 +1,15 @@
 package stats
 
 import (
-	"bytes"
-	"encoding/binary"
-	"encoding/gob"
 	"fmt"
 	"net"
 	"os"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
 	"github.com/AdguardTeam/golibs/log"
 	bolt "go.etcd.io/bbolt"
 )
@@ -26,13 +24,34 @@ const (
 
 // statsCtx - global context
 type statsCtx struct {
-	// mu protects unit.
+	// mu protects push and serializes the changes of the current unit's ID
+	// and of snapshot.  The requests are counted without locking it.
 	mu *sync.Mutex
-	// current is the actual statistics collection result.
-	current *unit
+
+	// shards are the parts of the current unit.
+	shards []*unitShard
+
+	// snapshot is the *unitsSnapshot of the units, which are rotated out but
+	// aren't written to the database yet.
+	snapshot atomic.Value
 
 	db   *bolt.DB
 	conf *Config
+
+	// push are the counters for the push exporter.  They are protected by
+	// mu.
+	push pushCounters
+
+	// pusher is the push exporter.  It's nil if the exporter is disabled.
+	pusher *pusher
+
+	// presence tracks the online and offline states of the clients.  It's
+	// nil if the tracking is disabled.
+	presence *presenceTracker
+
+	// diskPaused is non-zero if writing to the database is paused.  It must
+	// only be accessed atomically.
+	diskPaused uint32
 }
 
 // data for 1 time unit
@@ -91,17 +110,12 @@ func createObject(conf Config) (s *statsCtx, err error) {
 	var udb *unitDB
 	if tx != nil {
 		log.Tracef("Deleting old units...")
-		firstID := id - s.conf.limit - 1
-		unitDel := 0
 
-		err = tx.ForEach(newBucketWalker(tx, &unitDel, firstID))
-		if err != nil && !errors.Is(err, errStop) {
-			log.Debug("stats: deleting units: %s", err)
-		}
+		changed := deleteOldUnits(tx, id-s.conf.limit)
 
 		udb = s.loadUnitFromDB(tx, id)
 
-		if unitDel != 0 {
+		if changed != 0 {
 			s.commitTxn(tx)
 		} else {
 			err = tx.Rollback()
@@ -111,54 +125,38 @@ func createObject(conf Config) (s *statsCtx, err error) {
 		}
 	}
 
-	u := unit{}
-	s.initUnit(&u, id)
+	s.shards = newShards(id)
 	if udb != nil {
-		deserialize(&u, udb)
+		deserialize(s.shards[0].u, udb)
 	}
-	s.current = &u
-
-	log.Debug("stats: initialized")
-
-	return s, nil
-}
 
-// TODO(a.garipov): See if this is actually necessary.  Looks like a rather
-// bizarre solution.
-const errStop errors.Error = "stop iteration"
-
-// newBucketWalker returns a new bucket walker that deletes old units.  The
-// integer that unitDelPtr points to is incremented for every successful
-// deletion.  If the bucket isn't deleted, f returns errStop.
-func newBucketWalker(
-	tx *bolt.Tx,
-	unitDelPtr *int,
-	firstID uint32,
-) (f func(name []byte, b *bolt.Bucket) (err error)) {
-	return func(name []byte, _ *bolt.Bucket) (err error) {
-		nameID, ok := unitNameToID(name)
-		if !ok || nameID < firstID {
-			err = tx.DeleteBucket(name)
-			if err != nil {
-				log.Debug("stats: tx.DeleteBucket: %s", err)
-
-				return nil
-			}
+	s.resetSnapshot(id)
 
-			log.Debug("stats: deleted unit %d (name %x)", nameID, name)
+	s.push.nResult = make([]uint64, rLast)
+	if conf.Push.URL != "" {
+		s.pusher = newPusher(&conf.Push, conf.HTTPClient)
+	}
 
-			*unitDelPtr++
+	if conf.Presence.Enabled {
+		s.presence = newPresenceTracker(&conf.Presence)
+	}
 
-			return nil
-		}
+	log.Debug("stats: initialized")
 
-		return errStop
-	}
+	return s, nil
 }
 
 func (s *statsCtx) Start() {
 	s.initWeb()
 	go s.periodicFlush()
+
+	if s.pusher != nil {
+		go s.pusher.run(s)
+	}
+
+	if s.presence != nil {
+		go s.presence.run()
+	}
 }
 
 func checkInterval(days uint32) bool {
@@ -180,32 +178,11 @@ func (s *statsCtx) dbOpen() bool {
 	return true
 }
 
-// Atomically swap the currently active unit with a new value
-// Return old value
-func (s *statsCtx) swapUnit(new *unit) (u *unit) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	u = s.current
-	s.current = new
-
-	return u
-}
-
 // Get unit ID for the current hour
 func newUnitID() uint32 {
 	return uint32(time.Now().Unix() / (60 * 60))
 }
 
-// Initialize a unit
-func (s *statsCtx) initUnit(u *unit, id uint32) {
-	u.id = id
-	u.nResult = make([]uint64, rLast)
-	u.domains = make(map[string]uint64)
-	u.blockedDomains = make(map[string]uint64)
-	u.clients = make(map[string]uint64)
-}
-
 // Open a DB transaction
 func (s *statsCtx) beginTxn(wr bool) *bolt.Tx {
 	db := s.db
@@ -232,94 +209,100 @@ func (s *statsCtx) commitTxn(tx *bolt.Tx) {
 	log.Tracef("tx.Commit")
 }
 
-// bucketNameLen is the length of a bucket, a 64-bit unsigned integer.
-//
-// TODO(a.garipov): Find out why a 64-bit integer is used when IDs seem to
-// always be 32 bits.
-const bucketNameLen = 8
+// currentID returns the ID of the current unit.  ok is false if the statistics
+// are closed.
+func (s *statsCtx) currentID() (id uint32, ok bool) {
+	sh := s.shards[0]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 
-// idToUnitName converts a numerical ID into a database unit name.
-func idToUnitName(id uint32) (name []byte) {
-	name = make([]byte, bucketNameLen)
-	binary.BigEndian.PutUint64(name, uint64(id))
-
-	return name
-}
-
-// unitNameToID converts a database unit name into a numerical ID.  ok is false
-// if name is not a valid database unit name.
-func unitNameToID(name []byte) (id uint32, ok bool) {
-	if len(name) < bucketNameLen {
+	if sh.u == nil {
 		return 0, false
 	}
 
-	return uint32(binary.BigEndian.Uint64(name)), true
+	return sh.u.id, true
 }
 
-func (s *statsCtx) ongoing() (u *unit) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	return s.current
-}
-
-// Flush the current unit to DB and delete an old unit when a new hour is started
-// If a unit must be flushed:
-// . lock DB
-// . atomically set a new empty unit as the current one and get the old unit
-//   This is important to do it inside DB lock, so the reader won't get inconsistent results.
-// . write the unit to DB
-// . remove the stale unit from DB
-// . unlock DB
+// periodicFlush flushes the current unit when a new hour is started.  The unit
+// is first published in the snapshot, so that the readers see it right away,
+// and then written into its segment in the database together with the
+// deletion of the outdated units.
 func (s *statsCtx) periodicFlush() {
+	defer aghos.OnPanicAndExit("stats: flushing")
+
 	for {
-		ptr := s.ongoing()
-		if ptr == nil {
+		curID, ok := s.currentID()
+		if !ok {
 			break
 		}
 
 		id := s.conf.UnitID()
-		if ptr.id == id || s.conf.limit == 0 {
+		if curID == id || s.conf.limit == 0 {
 			time.Sleep(time.Second)
 
 			continue
 		}
 
-		tx := s.beginTxn(true)
-
-		nu := unit{}
-		s.initUnit(&nu, id)
-		u := s.swapUnit(&nu)
-		udb := serialize(u)
-
-		if tx == nil {
-			continue
+		u, udb := s.rotate(id)
+		if u == nil {
+			break
 		}
 
-		ok1 := s.flushUnitToDB(tx, u.id, udb)
-		ok2 := s.deleteUnit(tx, id-s.conf.limit)
-		if ok1 || ok2 {
-			s.commitTxn(tx)
-		} else {
-			_ = tx.Rollback()
-		}
+		s.flush(u.id, udb, id)
 	}
 
 	log.Tracef("periodicFlush() exited")
 }
 
-// Delete unit's data from file
-func (s *statsCtx) deleteUnit(tx *bolt.Tx, id uint32) bool {
-	err := tx.DeleteBucket(idToUnitName(id))
-	if err != nil {
-		log.Tracef("stats: bolt DeleteBucket: %s", err)
+// flush writes udb of the unit with id into the database and deletes the units
+// outdated for the current unit with curID.  The unit is then removed from the
+// snapshot, even if writing it has failed, so that the readers see the same
+// units as the database.
+func (s *statsCtx) flush(id uint32, udb *unitDB, curID uint32) {
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
 
-		return false
+		s.unpublishPending(id)
+	}()
+
+	// Don't even begin the transaction while paused, since committing it
+	// also writes to the file.
+	if atomic.LoadUint32(&s.diskPaused) != 0 {
+		log.Info("stats: writing paused, dropping unit %d", id)
+
+		return
+	}
+
+	tx := s.beginTxn(true)
+	if tx == nil {
+		return
 	}
 
-	log.Debug("stats: deleted unit %d", id)
+	ok1 := s.flushUnitToDB(tx, id, udb)
+	ok2 := deleteOldUnits(tx, curID-s.conf.limit) > 0
+	if ok1 || ok2 {
+		s.commitTxn(tx)
+	} else {
+		_ = tx.Rollback()
+	}
+}
 
-	return true
+// rotate makes a new empty unit with id the current one and publishes the
+// previous one in the snapshot until it's flushed.  u is nil if the statistics are closed.
+func (s *statsCtx) rotate(id uint32) (u *unit, udb *unitDB) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u = s.swapUnits(id, false)
+	if u == nil {
+		return nil, nil
+	}
+
+	udb = serialize(u)
+	s.publishPending(u.id, udb, id)
+
+	return u, udb
 }
 
 func convertMapToSlice(m map[string]uint64, max int) []countPair {
@@ -382,53 +365,6 @@ func deserialize(u *unit, udb *unitDB) {
 	u.timeSum = uint64(udb.TimeAvg) * u.nTotal
 }
 
-func (s *statsCtx) flushUnitToDB(tx *bolt.Tx, id uint32, udb *unitDB) bool {
-	log.Tracef("Flushing unit %d", id)
-
-	bkt, err := tx.CreateBucketIfNotExists(idToUnitName(id))
-	if err != nil {
-		log.Error("tx.CreateBucketIfNotExists: %s", err)
-		return false
-	}
-
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err = enc.Encode(udb)
-	if err != nil {
-		log.Error("gob.Encode: %s", err)
-		return false
-	}
-
-	err = bkt.Put([]byte{0}, buf.Bytes())
-	if err != nil {
-		log.Error("bkt.Put: %s", err)
-		return false
-	}
-
-	return true
-}
-
-func (s *statsCtx) loadUnitFromDB(tx *bolt.Tx, id uint32) *unitDB {
-	bkt := tx.Bucket(idToUnitName(id))
-	if bkt == nil {
-		return nil
-	}
-
-	// log.Tracef("Loading unit %d", id)
-
-	var buf bytes.Buffer
-	buf.Write(bkt.Get([]byte{0}))
-	dec := gob.NewDecoder(&buf)
-	udb := unitDB{}
-	err := dec.Decode(&udb)
-	if err != nil {
-		log.Error("gob Decode: %s", err)
-		return nil
-	}
-
-	return &udb
-}
-
 func convertTopSlice(a []countPair) []map[string]uint64 {
 	m := []map[string]uint64{}
 	for _, it := range a {
@@ -452,12 +388,38 @@ func (s *statsCtx) WriteDiskConfig(dc *DiskConfig) {
 	dc.Interval = s.conf.limit / 24
 }
 
+// PauseDiskWrites implements the Stats interface for *statsCtx.
+func (s *statsCtx) PauseDiskWrites(pause bool) {
+	var v uint32
+	if pause {
+		v = 1
+	}
+
+	if atomic.SwapUint32(&s.diskPaused, v) != v {
+		log.Info("stats: writing to database paused: %t", pause)
+	}
+}
+
 func (s *statsCtx) Close() {
-	u := s.swapUnit(nil)
-	udb := serialize(u)
-	tx := s.beginTxn(true)
+	if s.pusher != nil {
+		close(s.pusher.done)
+	}
+
+	if s.presence != nil {
+		close(s.presence.done)
+	}
+
+	s.mu.Lock()
+	u := s.swapUnits(0, true)
+	s.mu.Unlock()
+
+	var tx *bolt.Tx
+	if u != nil && atomic.LoadUint32(&s.diskPaused) == 0 {
+		tx = s.beginTxn(true)
+	}
+
 	if tx != nil {
-		if s.flushUnitToDB(tx, u.id, udb) {
+		if s.flushUnitToDB(tx, u.id, serialize(u)) {
 			s.commitTxn(tx)
 		} else {
 			_ = tx.Rollback()
@@ -487,9 +449,12 @@ func (s *statsCtx) clear() {
 		// all active transactions are now closed
 	}
 
-	u := unit{}
-	s.initUnit(&u, s.conf.UnitID())
-	_ = s.swapUnit(&u)
+	id := s.conf.UnitID()
+
+	s.mu.Lock()
+	_ = s.swapUnits(id, false)
+	s.resetSnapshot(id)
+	s.mu.Unlock()
 
 	err := os.Remove(s.conf.Filename)
 	if err != nil {
@@ -502,7 +467,7 @@ func (s *statsCtx) clear() {
 }
 
 func (s *statsCtx) Update(e Entry) {
-	if s.conf.limit == 0 {
+	if s.conf.limit == 0 && s.pusher == nil && s.presence == nil {
 		return
 	}
 
@@ -518,10 +483,29 @@ func (s *statsCtx) Update(e Entry) {
 		clientID = ip.String()
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if s.presence != nil {
+		s.presence.seen(clientID)
+	}
 
-	u := s.current
+	if s.pusher != nil {
+		s.mu.Lock()
+		s.push.update(&e)
+		s.mu.Unlock()
+	}
+
+	if s.conf.limit == 0 {
+		return
+	}
+
+	sh := s.shardFor(clientID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	u := sh.u
+	if u == nil {
+		// Closed.
+		return
+	}
 
 	u.nResult[e.Result]++
 
@@ -536,20 +520,45 @@ func (s *statsCtx) Update(e Entry) {
 	u.nTotal++
 }
 
+// ClientSeen implements the Stats interface for *statsCtx.
+func (s *statsCtx) ClientSeen(client string) {
+	if s.presence == nil || client == "" {
+		return
+	}
+
+	if ip := net.ParseIP(client); ip != nil {
+		client = ip.String()
+	}
+
+	s.presence.seen(client)
+}
+
+// loadUnits returns the units within limit from the database, the snapshot,
+// and the current unit, the oldest first, and the ID of the first one.  The
+// flushed units are read within a read-only transaction, which doesn't block
+// the writers.
 func (s *statsCtx) loadUnits(limit uint32) ([]*unitDB, uint32) {
-	tx := s.beginTxn(false)
-	if tx == nil {
+	snap, cur, ok := s.consistentUnits()
+	if !ok {
 		return nil, 0
 	}
 
-	cur := s.ongoing()
 	curID := cur.id
 
+	tx := s.beginTxn(false)
+	if tx != nil {
+		defer func() { _ = tx.Rollback() }()
+	}
+
 	// Per-hour units.
 	units := []*unitDB{}
 	firstID := curID - limit + 1
 	for i := firstID; i != curID; i++ {
-		u := s.loadUnitFromDB(tx, i)
+		u := snap.pending[i]
+		if u == nil && tx != nil {
+			u = s.loadUnitFromDB(tx, i)
+		}
+
 		if u == nil {
 			u = &unitDB{}
 			u.NResult = make([]uint64, rLast)
@@ -557,8 +566,6 @@ func (s *statsCtx) loadUnits(limit uint32) ([]*unitDB, uint32) {
 		units = append(units, u)
 	}
 
-	_ = tx.Rollback()
-
 	units = append(units, serialize(cur))
 
 	if len(units) != int(limit) {
@@ -603,6 +610,15 @@ func statsCollector(units []*unitDB, firstID uint32, timeUnit TimeUnit, ng numsG
 	return nums
 }
 
+// timeUnitFor returns the time unit of the statistics kept for limit hours.
+func timeUnitFor(limit uint32) (tu TimeUnit) {
+	if limit/24 > 7 {
+		return Days
+	}
+
+	return Hours
+}
+
 // pairsGetter is a signature for topsCollector argument.
 type pairsGetter func(u *unitDB) (pairs []countPair)
 
@@ -648,11 +664,7 @@ func topsCollector(units []*unitDB, max int, pg pairsGetter) []map[string]uint64
 */
 func (s *statsCtx) getData() (statsResponse, bool) {
 	limit := s.conf.limit
-
-	timeUnit := Hours
-	if limit/24 > 7 {
-		timeUnit = Days
-	}
+	timeUnit := timeUnitFor(limit)
 
 	units, firstID := s.loadUnits(limit)
 	if units == nil {
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -101,30 +102,77 @@ func (u *Updater) parseVersionResponse(data []byte) (VersionInfo, error) {
 	}
 
 	u.newVersion = info.NewVersion
-	u.packageURL = packageURL
+	u.packageURL = u.resolveURL(packageURL)
+
+	u.deltaURL, u.deltaSum = "", ""
+	if deltaURL, deltaSum, hasDelta := u.delta(versionJSON); hasDelta && !u.disableDelta {
+		u.deltaURL, u.deltaSum = u.resolveURL(deltaURL), deltaSum
+	}
 
 	return info, nil
 }
 
+// platformKeys returns the keys of the version information with prefix for the
+// current build, the most specific one first.
+func (u *Updater) platformKeys(prefix string) (keys []string) {
+	if u.goarch == "arm" && u.goarm != "" {
+		keys = append(keys, fmt.Sprintf("%s_%s_%sv%s", prefix, u.goos, u.goarch, u.goarm))
+	} else if u.goarch == "mips" && u.gomips != "" {
+		keys = append(keys, fmt.Sprintf("%s_%s_%s_%s", prefix, u.goos, u.goarch, u.gomips))
+	}
+
+	return append(keys, fmt.Sprintf("%s_%s_%s", prefix, u.goos, u.goarch))
+}
+
 // downloadURL returns the download URL for current build.
 func (u *Updater) downloadURL(json map[string]string) (string, bool) {
-	var key string
+	for _, key := range u.platformKeys("download") {
+		if val, ok := json[key]; ok {
+			return val, true
+		}
+	}
 
-	if u.goarch == "arm" && u.goarm != "" {
-		key = fmt.Sprintf("download_%s_%sv%s", u.goos, u.goarch, u.goarm)
-	} else if u.goarch == "mips" && u.gomips != "" {
-		key = fmt.Sprintf("download_%s_%s_%s", u.goos, u.goarch, u.gomips)
+	return "", false
+}
+
+// delta returns the URL of the binary patch from the current version for the
+// current build and the SHA-256 checksum of the patched executable.  The keys
+// of the patches are the download keys with the "delta" prefix and the
+// version, from which the patch updates, for example
+// "delta_linux_amd64_v0.107.0", and the keys of the checksums have the
+// additional "_sha256" suffix.
+func (u *Updater) delta(json map[string]string) (deltaURL, sum string, ok bool) {
+	for _, key := range u.platformKeys("delta") {
+		key += "_" + u.version
+		if deltaURL, ok = json[key]; !ok {
+			continue
+		}
+
+		if sum, ok = json[key+"_sha256"]; ok {
+			return deltaURL, sum, true
+		}
 	}
 
-	val, ok := json[key]
-	if !ok {
-		key = fmt.Sprintf("download_%s_%s", u.goos, u.goarch)
-		val, ok = json[key]
+	return "", "", false
+}
+
+// resolveURL resolves the relative URLs from the version information against
+// the version check URL and, if a mirror is used, replaces the official server
+// in the absolute ones with the mirror.
+func (u *Updater) resolveURL(rawURL string) (resolved string) {
+	if u.mirrorURL != "" && strings.HasPrefix(rawURL, defaultBaseURL+"/") {
+		return u.mirrorURL + strings.TrimPrefix(rawURL, defaultBaseURL)
 	}
 
-	if !ok {
-		return "", false
+	base, err := url.Parse(u.versionCheckURL)
+	if err != nil {
+		return rawURL
+	}
+
+	ref, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
 	}
 
-	return val, true
+	return base.ResolveReference(ref).String()
 }
@@ -0,0 +1,94 @@
+package updater
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/klauspost/compress/zstd"
+)
+
+// The binary patches are Zstandard frames, which use the old executable as the
+// raw content dictionary.  They are produced with the zstd(1) utility:
+//
+//	zstd --ultra -19 --patch-from=AdGuardHome.old AdGuardHome -o AdGuardHome.patch
+//
+// See scripts/make/build-release.sh.
+
+// maxPatchedSize is the maximum size of the patched executable in bytes.
+const maxPatchedSize = 128 * 1024 * 1024
+
+// maxPatchWindow is the maximum window size of the binary patches in bytes.
+// zstd(1) sets the window large enough to reference the whole old executable,
+// which can make it up to twice as large as the largest of the executables.
+const maxPatchWindow = 2 * maxPatchedSize
+
+// applyPatch returns the result of applying the binary patch to old.
+func applyPatch(old, patch []byte) (patched []byte, err error) {
+	dec, err := zstd.NewReader(
+		nil,
+		zstd.WithDecoderConcurrency(1),
+		zstd.WithDecoderDictRaw(0, old),
+		zstd.WithDecoderMaxMemory(maxPatchWindow),
+		zstd.WithDecoderMaxWindow(maxPatchWindow),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating decoder: %w", err)
+	}
+	defer dec.Close()
+
+	patched, err = dec.DecodeAll(patch, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decoding: %w", err)
+	} else if len(patched) > maxPatchedSize {
+		return nil, fmt.Errorf("size %d is too large", len(patched))
+	}
+
+	return patched, nil
+}
+
+// patch downloads the binary patch and applies it to the current executable,
+// placing the result into the update directory.
+func (u *Updater) patch() (err error) {
+	patchName := filepath.Join(u.updateDir, "AdGuardHome.patch")
+	err = u.downloadPackageFile(u.deltaURL, patchName)
+	if err != nil {
+		return fmt.Errorf("downloading patch: %w", err)
+	}
+
+	old, err := os.ReadFile(u.currentExeName)
+	if err != nil {
+		return fmt.Errorf("reading current executable: %w", err)
+	}
+
+	patch, err := os.ReadFile(patchName)
+	if err != nil {
+		return fmt.Errorf("reading patch: %w", err)
+	}
+
+	exe, err := applyPatch(old, patch)
+	if err != nil {
+		return fmt.Errorf("applying patch: %w", err)
+	}
+
+	sum := sha256.Sum256(exe)
+	if got := hex.EncodeToString(sum[:]); got != strings.ToLower(u.deltaSum) {
+		return fmt.Errorf("checksum mismatch: got %s, want %s", got, u.deltaSum)
+	}
+
+	err = os.WriteFile(u.updateExeName, exe, 0o755)
+	if err != nil {
+		return fmt.Errorf("writing patched executable: %w", err)
+	}
+
+	// The supporting files are left as they are.
+	u.unpackedFiles = nil
+
+	log.Debug("updater: patched %q with %d bytes", u.currentExeName, len(exe))
+
+	return nil
+}
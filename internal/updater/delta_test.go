@@ -0,0 +1,207 @@
+package updater
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readDeltaTestdata returns the old and the new executables and the binary
+// patch between them from testdata.  The patch has been produced with:
+//
+//	zstd --ultra -19 --patch-from=AdGuardHome.old AdGuardHome.new -o AdGuardHome.patch
+func readDeltaTestdata(t *testing.T) (old, updated, patch []byte) {
+	t.Helper()
+
+	var err error
+	old, err = os.ReadFile(filepath.Join("testdata", "AdGuardHome.old"))
+	require.NoError(t, err)
+
+	updated, err = os.ReadFile(filepath.Join("testdata", "AdGuardHome.new"))
+	require.NoError(t, err)
+
+	patch, err = os.ReadFile(filepath.Join("testdata", "AdGuardHome.patch"))
+	require.NoError(t, err)
+
+	return old, updated, patch
+}
+
+func TestApplyPatch(t *testing.T) {
+	old, updated, patch := readDeltaTestdata(t)
+
+	wrongOld := bytes.ReplaceAll(old, []byte("cache"), []byte("Cache"))
+
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		old        []byte
+		patch      []byte
+		want       []byte
+	}{{
+		name:       "success",
+		wantErrMsg: "",
+		old:        old,
+		patch:      patch,
+		want:       updated,
+	}, {
+		name:       "wrong_old",
+		wantErrMsg: "decoding: CRC check failed",
+		old:        wrongOld,
+		patch:      patch,
+		want:       nil,
+	}, {
+		name:       "not_patch",
+		wantErrMsg: "decoding: invalid input: magic number mismatch",
+		old:        old,
+		patch:      updated,
+		want:       nil,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			patched, err := applyPatch(tc.old, tc.patch)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.want, patched)
+		})
+	}
+}
+
+func TestUpdater_patch(t *testing.T) {
+	old, updated, patch := readDeltaTestdata(t)
+
+	wd := t.TempDir()
+
+	exeName := filepath.Join(wd, "AdGuardHome")
+	require.NoError(t, os.WriteFile(exeName, old, 0o755))
+
+	l, lport := startHTTPServer(string(patch))
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	newUpdater := func(sum string) (u *Updater) {
+		u = NewUpdater(&Config{
+			Client:  &http.Client{},
+			Version: "v0.103.0",
+			WorkDir: wd,
+		})
+
+		u.newVersion = "v0.103.1"
+		u.packageURL = "https://static.adguard.com/adguardhome/release/AdGuardHome_linux_amd64.tar.gz"
+		u.deltaURL = (&url.URL{
+			Scheme: "http",
+			Host:   net.JoinHostPort("127.0.0.1", lport),
+			Path:   "AdGuardHome.patch",
+		}).String()
+		u.deltaSum = sum
+
+		require.NoError(t, u.prepare())
+
+		return u
+	}
+
+	t.Run("success", func(t *testing.T) {
+		sum := sha256.Sum256(updated)
+		u := newUpdater(hex.EncodeToString(sum[:]))
+		t.Cleanup(u.clean)
+
+		require.NoError(t, u.patch())
+
+		d, err := os.ReadFile(u.updateExeName)
+		require.NoError(t, err)
+
+		assert.Equal(t, updated, d)
+	})
+
+	t.Run("bad_sum", func(t *testing.T) {
+		u := newUpdater("0000")
+		t.Cleanup(u.clean)
+
+		err := u.patch()
+		assert.Error(t, err)
+
+		_, err = os.Stat(u.updateExeName)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
+
+func TestUpdater_VersionInfo_delta(t *testing.T) {
+	const jsonData = `{
+  "version": "v0.103.1",
+  "announcement": "AdGuard Home v0.103.1 is now available!",
+  "announcement_url": "https://github.com/AdguardTeam/AdGuardHome/internal/releases",
+  "selfupdate_min_version": "v0.0",
+  "download_linux_amd64": "https://static.adguard.com/adguardhome/release/AdGuardHome_linux_amd64.tar.gz",
+  "delta_linux_amd64_v0.103.0": "AdGuardHome_linux_amd64_v0.103.0.patch",
+  "delta_linux_amd64_v0.103.0_sha256": "abcd",
+  "delta_linux_amd64_v0.102.0": "AdGuardHome_linux_amd64_v0.102.0.patch",
+  "delta_linux_amd64_v0.102.0_sha256": "ef01"
+}`
+
+	l, lport := startHTTPServer(jsonData)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	mirror := "http://" + net.JoinHostPort("127.0.0.1", lport) + "/agh/"
+
+	testCases := []struct {
+		name      string
+		version   string
+		wantDelta string
+		wantSum   string
+		disable   bool
+	}{{
+		name:      "delta",
+		version:   "v0.103.0",
+		wantDelta: "http://127.0.0.1:" + lport + "/agh/release/AdGuardHome_linux_amd64_v0.103.0.patch",
+		wantSum:   "abcd",
+		disable:   false,
+	}, {
+		name:      "no_delta",
+		version:   "v0.101.0",
+		wantDelta: "",
+		wantSum:   "",
+		disable:   false,
+	}, {
+		name:      "disabled",
+		version:   "v0.103.0",
+		wantDelta: "",
+		wantSum:   "",
+		disable:   true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u := NewUpdater(&Config{
+				Client:       &http.Client{},
+				Version:      tc.version,
+				Channel:      "release",
+				GOARCH:       "amd64",
+				GOOS:         "linux",
+				MirrorURL:    mirror,
+				DisableDelta: tc.disable,
+			})
+
+			assert.Equal(t, "http://127.0.0.1:"+lport+"/agh/release/version.json", u.VersionCheckURL())
+
+			_, err := u.VersionInfo(false)
+			require.NoError(t, err)
+
+			assert.Equal(
+				t,
+				"http://127.0.0.1:"+lport+"/agh/release/AdGuardHome_linux_amd64.tar.gz",
+				u.packageURL,
+			)
+			assert.Equal(t, tc.wantDelta, u.deltaURL)
+			assert.Equal(t, tc.wantSum, u.deltaSum)
+		})
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
 	"path"
@@ -38,6 +37,13 @@ type Updater struct {
 	confName        string
 	versionCheckURL string
 
+	// mirrorURL is the base URL of the update mirror without the trailing
+	// slash.  It's empty if the official server is used.
+	mirrorURL string
+
+	// disableDelta makes the updater always download the full packages.
+	disableDelta bool
+
 	// mu protects all fields below.
 	mu *sync.RWMutex
 
@@ -54,6 +60,13 @@ type Updater struct {
 	newVersion string
 	packageURL string
 
+	// deltaURL is the URL of the binary patch from the current version to the
+	// new one.  It's empty if there is no patch.
+	deltaURL string
+
+	// deltaSum is the hex-encoded SHA-256 checksum of the patched executable.
+	deltaSum string
+
 	// Cached fields to prevent too many API requests.
 	prevCheckError  error
 	prevCheckTime   time.Time
@@ -76,15 +89,31 @@ type Config struct {
 	ConfName string
 	// WorkDir is the working directory that is used for temporary files.
 	WorkDir string
+
+	// MirrorURL is the base URL of the update mirror, which serves the
+	// version information and the packages in the same layout as the official
+	// server, for example "https://mirror.example/adguardhome".  If empty,
+	// the official server is used.
+	MirrorURL string
+
+	// DisableDelta makes the updater always download the full packages
+	// instead of the binary patches.
+	DisableDelta bool
 }
 
+// defaultBaseURL is the base URL of the official update server.
+const defaultBaseURL = "https://static.adguard.com/adguardhome"
+
 // NewUpdater creates a new Updater.
 func NewUpdater(conf *Config) *Updater {
-	u := &url.URL{
-		Scheme: "https",
-		Host:   "static.adguard.com",
-		Path:   path.Join("adguardhome", conf.Channel, "version.json"),
+	base := defaultBaseURL
+	mirror := strings.TrimSuffix(conf.MirrorURL, "/")
+	if mirror != "" {
+		base = mirror
 	}
+
+	vcu := base + "/" + path.Join(conf.Channel, "version.json")
+
 	return &Updater{
 		client: conf.Client,
 
@@ -97,7 +126,9 @@ func NewUpdater(conf *Config) *Updater {
 
 		confName:        conf.ConfName,
 		workDir:         conf.WorkDir,
-		versionCheckURL: u.String(),
+		versionCheckURL: vcu,
+		mirrorURL:       mirror,
+		disableDelta:    conf.DisableDelta,
 
 		mu: &sync.RWMutex{},
 	}
@@ -115,12 +146,7 @@ func (u *Updater) Update() error {
 
 	defer u.clean()
 
-	err = u.downloadPackageFile(u.packageURL, u.packageName)
-	if err != nil {
-		return err
-	}
-
-	err = u.unpack()
+	err = u.fetch()
 	if err != nil {
 		return err
 	}
@@ -159,6 +185,27 @@ func (u *Updater) VersionCheckURL() (vcu string) {
 	return u.versionCheckURL
 }
 
+// fetch places the new executable and the supporting files into the update
+// directory.  It applies the binary patch if there is one and falls back to
+// downloading the full package if patching fails.
+func (u *Updater) fetch() (err error) {
+	if u.deltaURL != "" {
+		err = u.patch()
+		if err == nil {
+			return nil
+		}
+
+		log.Info("updater: patching failed, downloading full package: %s", err)
+	}
+
+	err = u.downloadPackageFile(u.packageURL, u.packageName)
+	if err != nil {
+		return err
+	}
+
+	return u.unpack()
+}
+
 func (u *Updater) prepare() (err error) {
 	u.updateDir = filepath.Join(u.workDir, fmt.Sprintf("agh-update-%s", u.newVersion))
 
@@ -0,0 +1,23 @@
+#!/bin/sh
+
+# AdGuard Home keepalived Health Check Script
+#
+# Exits with a non-zero code if the local AdGuard Home instance doesn't resolve
+# the probe name, so that keepalived lowers the priority of the instance or
+# puts it into the fault state.
+
+verbose="${VERBOSE:-0}"
+readonly verbose
+
+if [ "$verbose" -gt '0' ]
+then
+	set -x
+fi
+
+set -e -f -u
+
+# The address of the web interface of the local instance.
+agh_url="${AGH_URL:-http://127.0.0.1:3000}"
+readonly agh_url
+
+curl -f -s -o /dev/null -m 3 "${agh_url}/health/dns"
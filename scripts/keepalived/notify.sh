@@ -0,0 +1,50 @@
+#!/bin/sh
+
+# AdGuard Home keepalived Notify Script
+#
+# keepalived calls this script with the arguments "TYPE NAME STATE PRIORITY",
+# where STATE is one of MASTER, BACKUP, FAULT, and STOP.  The script reports the
+# new state to the local AdGuard Home instance, which then runs the hook
+# configured for it in the failover section of its configuration file.
+
+verbose="${VERBOSE:-0}"
+readonly verbose
+
+if [ "$verbose" -gt '0' ]
+then
+	set -x
+fi
+
+set -e -f -u
+
+# The address of the web interface of the local instance and the credentials of
+# one of its users.
+agh_url="${AGH_URL:-http://127.0.0.1:3000}"
+agh_user="${AGH_USER:-}"
+agh_pass="${AGH_PASS:-}"
+readonly agh_url agh_user agh_pass
+
+state="${3:?usage: notify.sh TYPE NAME STATE [PRIORITY]}"
+
+# AdGuard Home doesn't have a separate state for the stopped keepalived, so
+# consider it the same as backup, which releases the virtual address.
+case "$state"
+in
+('MASTER'|'BACKUP'|'FAULT')
+	# Go on.
+	;;
+('STOP')
+	state='BACKUP'
+	;;
+(*)
+	echo "unsupported state: $state" 1>&2
+
+	exit 1
+	;;
+esac
+
+curl -f -s -m 10\
+	${agh_user:+-u "${agh_user}:${agh_pass}"}\
+	-H 'Content-Type: application/json'\
+	-d "{\"state\":\"${state}\"}"\
+	"${agh_url}/control/failover/state"
@@ -105,6 +105,19 @@ readonly gpg_key_passphrase gpg_key
 dist="${DIST_DIR:-dist}"
 readonly dist
 
+# The directory of the previous release, from which to make the binary patches.
+# By default, no patches are made.
+prev_dist="${PREV_DIST_DIR:-}"
+if [ "$prev_dist" != '' ]
+then
+	# Get the previous version from its version.txt.
+	prev_version="$( sed -n -e 's/^version=//p' "./${prev_dist}/version.txt" )"
+	log "previous version '$prev_version'"
+else
+	prev_version=''
+fi
+readonly prev_dist prev_version
+
 log "checking tools"
 
 # Make sure we fail gracefully if one of the tools we need is missing.  Use
@@ -129,6 +142,13 @@ do
 done
 readonly sha256sum_cmd
 
+if [ "$prev_dist" != '' ] && ! command -v 'zstd' > /dev/null
+then
+	log "pieces don't fit, 'zstd' not found"
+
+	exit 1
+fi
+
 # Data section.  Arrange data into space-separated tables for read -r to read.
 # Use 0 for missing values.
 #
@@ -206,6 +226,24 @@ build() {
 
 	log "$build_output"
 
+	# Make the binary patch from the executable of the previous release, if
+	# there is one, and record its platform, filename, and the checksum of the
+	# new executable for version.json.  The updater applies the patches as
+	# Zstandard frames with the old executable as the raw dictionary.
+	build_prev_output="./${prev_dist}/${build_output#./${dist}/}"
+	if [ "$prev_dist" != '' ] && [ -f "$build_prev_output" ]
+	then
+		build_patch="${build_ar}_${prev_version}.patch"
+		zstd -q --ultra -19 --patch-from="$build_prev_output"\
+			"$build_output" -o "./${dist}/${build_patch}"
+
+		build_sum="$( $sha256sum_cmd "$build_output" | cut -d ' ' -f 1 )"
+		echo "${build_ar#AdGuardHome_} ${build_patch} ${build_sum}"\
+			>> "./${dist}/deltas.txt"
+
+		log "./${dist}/${build_patch}"
+	fi
+
 	if [ "$sign" -eq '1' ]
 	then
 		gpg\
@@ -301,6 +339,8 @@ build() {
 
 log "starting builds"
 
+rm -f "./${dist}/deltas.txt"
+
 # Go over all platforms defined in the space-separated table above, tweak the
 # values where necessary, and feed to build.
 echo "$platforms" | while read -r os arch arm mips snap
@@ -360,7 +400,7 @@ log "calculating checksums"
 (
 	cd "./${dist}"
 
-	find . ! -name . -prune \( -name '*.tar.gz' -o -name '*.zip' \)\
+	find . ! -name . -prune \( -name '*.tar.gz' -o -name '*.zip' -o -name '*.patch' \)\
 		-exec "$sha256sum_cmd" {} +\
 		> ./checksums.txt
 )
@@ -392,6 +432,17 @@ echo "{
   \"selfupdate_min_version\": \"0.0\",
 " >> "$version_json"
 
+# Add the binary patches from the previous version, if any.  The download URLs
+# are always written after them, so always add the trailing comma.
+if [ -f "./${dist}/deltas.txt" ]
+then
+	while read -r platform filename sum
+	do
+		echo "  \"delta_${platform}_${prev_version}\": \"${version_download_url}/${filename}\",
+  \"delta_${platform}_${prev_version}_sha256\": \"${sum}\"," >> "$version_json"
+	done < "./${dist}/deltas.txt"
+fi
+
 # Same as with checksums above, don't use ls, because files matching one of the
 # patterns may be absent.
 ar_files="$( find "./${dist}/" ! -name "${dist}" -prune \( -name '*.tar.gz' -o -name '*.zip' \) )"
@@ -117,10 +117,22 @@ else
 	cgo_enabled='1'
 	race_flags='--race=1'
 fi
-readonly cgo_enabled race_flags
+readonly race_flags
+
+# Allow users to include the support of the private keys kept in the PKCS#11
+# tokens.  It requires cgo as well as the PKCS#11 module of the token on the
+# target machine.
+if [ "${PKCS11:-0}" -eq '0' ]
+then
+	tags_flags='--tags='
+else
+	cgo_enabled='1'
+	tags_flags='--tags=pkcs11'
+fi
+readonly cgo_enabled tags_flags
 
 CGO_ENABLED="$cgo_enabled"
 GO111MODULE='on'
 export CGO_ENABLED GO111MODULE
 
-"$go" build --ldflags "$ldflags" "$race_flags" --trimpath "$o_flags" "$v_flags" "$x_flags"
+"$go" build --ldflags "$ldflags" "$race_flags" "$tags_flags" --trimpath "$o_flags" "$v_flags" "$x_flags"
@@ -52,7 +52,7 @@ trap not_found EXIT
 go_version="$( "$GO" version )"
 readonly go_version
 
-go_min_version='go1.16'
+go_min_version='go1.23'
 go_version_msg="
 warning: your go version (${go_version}) is different from the recommended minimal one (${go_min_version}).
 if you have the version installed, please set the GO environment variable.